@@ -14,6 +14,50 @@ type Config struct {
 	DataDirectory          string
 	MempoolDumpDirectory   string
 	TXIndex                bool
+	TXIndexDirectory       string
+	ResyncTxindex          bool
+	ResyncTxindexHeight    uint64
+	TxindexStoreTxns       bool
+	TxindexMempool         bool
+	TxindexMempoolInDb     bool
+	RetentionPolicies      []string
+	RetentionSweepSeconds  uint64
+	ValueLogGCSeconds      uint64
+	ValueLogGCDiscardRatio float64
+	DbProfile              string
+	DbMemTableSizeMB       uint64
+	DbNumCompactors        uint64
+	DbCompression          string
+	ArchiveDirectory        string
+	ArchiveAfterBlocks      uint64
+	BackupDirectory         string
+	BackupIntervalSeconds   uint64
+	PruneBlocks             uint64
+	VerifyBlockConservation bool
+	PrewarmCaches           bool
+	RepairReverseMappings   bool
+	RebuildIndexes          []string
+	VerifyDbIntegrity       bool
+	RepairDbIntegrity       bool
+	InboxFetchLimit         uint64
+	DecodeFailureThreshold  uint64
+	MaxTimestampSkewSeconds uint64
+	DedupeBlockTxns         bool
+	BalanceSnapshots        bool
+	StateCommitments        bool
+	ProfileCacheSize        uint64
+	PostCacheSize           uint64
+	PKIDCacheSize           uint64
+	RecentBlockHeaders      uint64
+	BlockHeaderCacheSize    uint64
+	UtxoOpsRetention        string
+	BootstrapSnapshot       string
+	CreateSnapshot          string
+	StateSyncManifest       string
+	StateSyncPeer           string
+	EventStreamAddress      string
+	ChainStore              string
+	PostgresURI             string
 
 	// Peers
 	ConnectIPs             []string
@@ -39,6 +83,13 @@ type Config struct {
 	// Fees
 	RateLimitFeerate       uint64
 	MinFeerate             uint64
+	MaxMempoolBytes        uint64
+
+	// Mempool limits
+	MempoolMaxTxnsPerPublicKey  uint64
+	MempoolMaxTxnsPerPeerIP     uint64
+	MempoolMaxSpamScore         float64
+	MempoolSpamReferenceFeerate uint64
 
 	// BlockProducer
 	MaxBlockTemplatesCache uint64
@@ -82,6 +133,50 @@ func LoadConfig() *Config {
 
 	config.MempoolDumpDirectory = viper.GetString("mempool-dump-dir")
 	config.TXIndex = viper.GetBool("txindex")
+	config.TXIndexDirectory = viper.GetString("txindex-dir")
+	config.ResyncTxindex = viper.GetBool("resync-txindex")
+	config.ResyncTxindexHeight = viper.GetUint64("resync-txindex-from-height")
+	config.TxindexStoreTxns = viper.GetBool("txindex-store-txns")
+	config.TxindexMempool = viper.GetBool("txindex-mempool")
+	config.TxindexMempoolInDb = viper.GetBool("txindex-mempool-in-db")
+	config.RetentionPolicies = viper.GetStringSlice("retention-policies")
+	config.RetentionSweepSeconds = viper.GetUint64("retention-sweep-seconds")
+	config.ValueLogGCSeconds = viper.GetUint64("value-log-gc-seconds")
+	config.ValueLogGCDiscardRatio = viper.GetFloat64("value-log-gc-discard-ratio")
+	config.DbProfile = viper.GetString("db-profile")
+	config.DbMemTableSizeMB = viper.GetUint64("db-memtable-size-mb")
+	config.DbNumCompactors = viper.GetUint64("db-num-compactors")
+	config.DbCompression = viper.GetString("db-compression")
+	config.ArchiveDirectory = viper.GetString("archive-dir")
+	config.ArchiveAfterBlocks = viper.GetUint64("archive-after-blocks")
+	config.BackupDirectory = viper.GetString("backup-dir")
+	config.BackupIntervalSeconds = viper.GetUint64("backup-interval-seconds")
+	config.PruneBlocks = viper.GetUint64("prune-blocks")
+	config.VerifyBlockConservation = viper.GetBool("verify-block-conservation")
+	config.PrewarmCaches = viper.GetBool("prewarm-caches")
+	config.RepairReverseMappings = viper.GetBool("repair-reverse-mappings")
+	config.RebuildIndexes = viper.GetStringSlice("rebuild-indexes")
+	config.VerifyDbIntegrity = viper.GetBool("verify-db-integrity")
+	config.RepairDbIntegrity = viper.GetBool("repair-db-integrity")
+	config.InboxFetchLimit = viper.GetUint64("inbox-fetch-limit")
+	config.DecodeFailureThreshold = viper.GetUint64("decode-failure-threshold")
+	config.MaxTimestampSkewSeconds = viper.GetUint64("max-timestamp-skew-seconds")
+	config.DedupeBlockTxns = viper.GetBool("dedupe-block-txns")
+	config.BalanceSnapshots = viper.GetBool("balance-snapshots")
+	config.StateCommitments = viper.GetBool("state-commitments")
+	config.ProfileCacheSize = viper.GetUint64("profile-cache-size")
+	config.PostCacheSize = viper.GetUint64("post-cache-size")
+	config.PKIDCacheSize = viper.GetUint64("pkid-cache-size")
+	config.RecentBlockHeaders = viper.GetUint64("recent-block-headers")
+	config.UtxoOpsRetention = viper.GetString("utxo-ops-retention")
+	config.BootstrapSnapshot = viper.GetString("bootstrap-snapshot")
+	config.CreateSnapshot = viper.GetString("create-snapshot")
+	config.StateSyncManifest = viper.GetString("state-sync-manifest")
+	config.StateSyncPeer = viper.GetString("state-sync-peer")
+	config.EventStreamAddress = viper.GetString("event-stream-address")
+	config.ChainStore = viper.GetString("chain-store")
+	config.PostgresURI = viper.GetString("postgres-uri")
+	config.BlockHeaderCacheSize = viper.GetUint64("block-header-cache-size")
 
 	// Peers
 	config.ConnectIPs = viper.GetStringSlice("connect-ips")
@@ -107,6 +202,13 @@ func LoadConfig() *Config {
 	// Fees
 	config.RateLimitFeerate = viper.GetUint64("rate-limit-feerate")
 	config.MinFeerate = viper.GetUint64("min-feerate")
+	config.MaxMempoolBytes = viper.GetUint64("max-mempool-bytes")
+
+	// Mempool limits
+	config.MempoolMaxTxnsPerPublicKey = viper.GetUint64("mempool-max-txns-per-public-key")
+	config.MempoolMaxTxnsPerPeerIP = viper.GetUint64("mempool-max-txns-per-peer-ip")
+	config.MempoolMaxSpamScore = viper.GetFloat64("mempool-max-spam-score")
+	config.MempoolSpamReferenceFeerate = viper.GetUint64("mempool-spam-reference-feerate")
 
 	// BlockProducer
 	config.MaxBlockTemplatesCache = viper.GetUint64("max-block-templates-cache")
@@ -133,11 +235,30 @@ func (config *Config) Print() {
 	glog.Infof("Logging to directory %s", config.LogDirectory)
 	glog.Infof("Running node in %s mode", config.Params.NetworkType)
 	glog.Infof("Data Directory: %s", config.DataDirectory)
+	glog.Infof("Db Profile: %s", config.DbProfile)
 
 	if config.MempoolDumpDirectory != "" {
 		glog.Infof("Mempool Dump Directory: %s", config.MempoolDumpDirectory)
 	}
 
+	if config.TXIndex && config.TXIndexDirectory != "" {
+		glog.Infof("TXIndex Directory: %s", config.TXIndexDirectory)
+	}
+
+	if config.ArchiveDirectory != "" {
+		glog.Infof("Archive Directory: %s (archiving after %d blocks)",
+			config.ArchiveDirectory, config.ArchiveAfterBlocks)
+	}
+
+	if config.BackupDirectory != "" {
+		glog.Infof("Backup Directory: %s (backing up every %d seconds)",
+			config.BackupDirectory, config.BackupIntervalSeconds)
+	}
+
+	if config.PruneBlocks > 0 {
+		glog.Infof("PRUNING: Keeping the last %d blocks", config.PruneBlocks)
+	}
+
 	if len(config.ConnectIPs) > 0 {
 		glog.Infof("Connect IPs: %s", config.ConnectIPs)
 	}
@@ -175,4 +296,9 @@ func (config *Config) Print() {
 
 	glog.Infof("Rate Limit Feerate: %d", config.RateLimitFeerate)
 	glog.Infof("Min Feerate: %d", config.MinFeerate)
+	glog.Infof("Max Mempool Bytes: %d", config.MaxMempoolBytes)
+	glog.Infof("Mempool Max Txns Per Public Key: %d", config.MempoolMaxTxnsPerPublicKey)
+	glog.Infof("Mempool Max Txns Per Peer IP: %d", config.MempoolMaxTxnsPerPeerIP)
+	glog.Infof("Mempool Max Spam Score: %v", config.MempoolMaxSpamScore)
+	glog.Infof("Mempool Spam Reference Feerate: %d", config.MempoolSpamReferenceFeerate)
 }
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/bitclout/core/lib"
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+)
+
+var exportDbCmd = &cobra.Command{
+	Use:   "export-db",
+	Short: "Export the entries under some prefixes of a node's db as typed records",
+	Long: `Writes the posts, profiles, balances, messages, and diamonds in the db in
+--data-dir to --file as line-delimited JSON or protobuf records. The node must
+not be running.`,
+	Run: ExportDb,
+}
+
+var importDbCmd = &cobra.Command{
+	Use:   "import-db",
+	Short: "Import records written by export-db into a node's db",
+	Long: `Writes the records in --file, along with the indexes derived from them, to the
+db in --data-dir. The node must not be running.`,
+	Run: ImportDb,
+}
+
+func init() {
+	exportDbCmd.Flags().String("data-dir", "", "The data directory of the node to export from.")
+	exportDbCmd.Flags().String("file", "", "The file to write the records to.")
+	exportDbCmd.Flags().String("format", lib.DbExportFormatJSON, "Can be json or proto.")
+	exportDbCmd.Flags().StringSlice("prefixes", []string{},
+		"A comma-separated list of the names of the prefixes to export, e.g. "+
+			"PostHashToPostEntry. When unset, every prefix that can be exported is.")
+	rootCmd.AddCommand(exportDbCmd)
+
+	importDbCmd.Flags().String("data-dir", "", "The data directory of the node to import into.")
+	importDbCmd.Flags().String("file", "", "The file export-db wrote.")
+	importDbCmd.Flags().String("format", lib.DbExportFormatJSON, "Can be json or proto.")
+	importDbCmd.Flags().Bool("testnet", false, "Import into a testnet node.")
+	rootCmd.AddCommand(importDbCmd)
+}
+
+func ExportDb(cmd *cobra.Command, args []string) {
+	dataDir, _ := cmd.Flags().GetString("data-dir")
+	filePath, _ := cmd.Flags().GetString("file")
+	format, _ := cmd.Flags().GetString("format")
+	prefixNames, _ := cmd.Flags().GetStringSlice("prefixes")
+	if dataDir == "" || filePath == "" {
+		glog.Fatal("Both --data-dir and --file have to be set")
+	}
+
+	db, err := lib.OpenBadgerDb(lib.GetBadgerDbPath(dataDir), nil)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer db.Close()
+	exportFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer exportFile.Close()
+
+	numRecords, err := lib.DbExport(db, prefixNames, format, exportFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Exported %d records to %v", numRecords, filePath)
+}
+
+func ImportDb(cmd *cobra.Command, args []string) {
+	dataDir, _ := cmd.Flags().GetString("data-dir")
+	filePath, _ := cmd.Flags().GetString("file")
+	format, _ := cmd.Flags().GetString("format")
+	testnet, _ := cmd.Flags().GetBool("testnet")
+	if dataDir == "" || filePath == "" {
+		glog.Fatal("Both --data-dir and --file have to be set")
+	}
+	params := &lib.BitCloutMainnetParams
+	if testnet {
+		params = &lib.BitCloutTestnetParams
+	}
+
+	db, err := lib.OpenBadgerDb(lib.GetBadgerDbPath(dataDir), nil)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer db.Close()
+	importFile, err := os.Open(filePath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer importFile.Close()
+
+	numRecords, err := lib.DbImport(db, params, format, importFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Imported %d records from %v", numRecords, filePath)
+}
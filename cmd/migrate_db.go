@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"github.com/bitclout/core/lib"
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+)
+
+var migrateDbCmd = &cobra.Command{
+	Use:   "migrate-db",
+	Short: "Copy a node's db to a different key/value backend",
+	Long: `Copies every key in the db at --from-dir to a new db at --to-dir and then
+checks that the two match. The node must not be running while this runs.`,
+	Run: MigrateDb,
+}
+
+func init() {
+	migrateDbCmd.Flags().String("from-backend", lib.KVBackendBadger,
+		"The backend of the db to copy from. Can be badger, leveldb or pebble.")
+	migrateDbCmd.Flags().String("from-dir", "", "The directory of the db to copy from.")
+	migrateDbCmd.Flags().String("to-backend", lib.KVBackendLevelDB,
+		"The backend of the db to copy to. Can be badger, leveldb or pebble.")
+	migrateDbCmd.Flags().String("to-dir", "",
+		"The directory of the db to copy to. It should be empty.")
+	migrateDbCmd.Flags().Int("batch-size", 10000, "The number of keys to write at a time.")
+	rootCmd.AddCommand(migrateDbCmd)
+}
+
+func MigrateDb(cmd *cobra.Command, args []string) {
+	fromBackend, _ := cmd.Flags().GetString("from-backend")
+	fromDir, _ := cmd.Flags().GetString("from-dir")
+	toBackend, _ := cmd.Flags().GetString("to-backend")
+	toDir, _ := cmd.Flags().GetString("to-dir")
+	batchSize, _ := cmd.Flags().GetInt("batch-size")
+	if fromDir == "" || toDir == "" {
+		glog.Fatal("Both --from-dir and --to-dir have to be set")
+	}
+
+	src, err := lib.OpenKVStore(fromBackend, fromDir)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := lib.OpenKVStore(toBackend, toDir)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer dst.Close()
+
+	numKeys, err := lib.MigrateKVStore(src, dst, batchSize)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if err := lib.VerifyKVStoreMigration(src, dst); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Copied %d keys from %v (%v) to %v (%v)", numKeys, fromDir, fromBackend, toDir, toBackend)
+}
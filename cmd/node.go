@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/addrmgr"
@@ -16,17 +17,25 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/golang/glog"
+	// Registers the "postgres" driver for --chain-store=postgres.
+	_ "github.com/lib/pq"
 	"github.com/sasha-s/go-deadlock"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"gopkg.in/DataDog/dd-trace-go.v1/profiler"
 )
 
 type Node struct {
-	Server     *lib.Server
-	chainDB    *badger.DB
-	TXIndex    *lib.TXIndex
-	Params     *lib.BitCloutParams
-	Config     *Config
+	Server           *lib.Server
+	dbManager        *lib.DbManager
+	chainDB          *badger.DB
+	dbLifecycle      *lib.CoreDBLifecycle
+	dbArchive        *lib.DbArchive
+	eventStream      *lib.EventStreamServer
+	TXIndex          *lib.TXIndex
+	ChainStore       lib.ChainStore
+	chainStoreMirror *lib.ChainStoreMirror
+	Params           *lib.BitCloutParams
+	Config           *Config
 }
 
 func NewNode(config *Config) *Node {
@@ -98,19 +107,172 @@ func (node *Node) Start() {
 		panic(err)
 	}
 
-	// Setup chain database
-	dbDir := lib.GetBadgerDbPath(node.Config.DataDirectory)
-	opts := badger.DefaultOptions(dbDir)
-	opts.ValueDir = dbDir
-	opts.MemTableSize = 1024 << 20
-	node.chainDB, err = badger.Open(opts)
+	// Setup chain database. The txindex db is opened through the same manager
+	// when the txindex is started.
+	dbOptions, err := lib.GetDbOptionsProfile(node.Config.DbProfile)
 	if err != nil {
 		panic(err)
 	}
+	if node.Config.DbMemTableSizeMB > 0 {
+		dbOptions.MemTableSize = int64(node.Config.DbMemTableSizeMB) << 20
+	}
+	if node.Config.DbNumCompactors > 0 {
+		dbOptions.NumCompactors = int(node.Config.DbNumCompactors)
+	}
+	if node.Config.DbCompression != "" {
+		dbOptions.Compression = node.Config.DbCompression
+	}
+	node.dbManager, err = lib.NewDbManager(&lib.DbManagerConfig{
+		DataDir:    node.Config.DataDirectory,
+		TxindexDir: node.Config.TXIndexDirectory,
+		MempoolDir: node.Config.MempoolDumpDirectory,
+		DbOptions:  dbOptions,
+		Params:     node.Params,
+	})
+	if err != nil {
+		panic(err)
+	}
+	node.chainDB = node.dbManager.ChainDB()
+	node.dbLifecycle = node.dbManager.ChainLifecycle()
+
+	// Load the chain state from a snapshot if we don't have a chain yet.
+	if node.Config.BootstrapSnapshot != "" &&
+		lib.DbGetBestHash(node.chainDB, lib.ChainTypeBitCloutBlock) == nil {
+
+		if err := bootstrapFromSnapshot(node.chainDB, node.Params,
+			node.Config.BootstrapSnapshot, node.Config.DataDirectory); err != nil {
+
+			panic(err)
+		}
+	}
+	// Otherwise sync the chain state from a peer if we were given a manifest.
+	if node.Config.StateSyncManifest != "" &&
+		lib.DbGetBestHash(node.chainDB, lib.ChainTypeBitCloutBlock) == nil {
+
+		if err := syncStateFromPeer(node.chainDB, node.Params,
+			node.Config.StateSyncManifest, node.Config.StateSyncPeer); err != nil {
+
+			panic(err)
+		}
+	}
+
+	// Log who we are and note any upgrade.
+	identityKey, err := lib.DbGetOrCreateNodeIdentity(node.chainDB)
+	if err != nil {
+		panic(err)
+	}
+	prevVersion, err := lib.DbRecordNodeVersion(node.chainDB, node.Params, time.Now())
+	if err != nil {
+		panic(err)
+	}
+	glog.Infof("Node identity: %v, previous version: %+v, telemetry opt-in: %v",
+		lib.PkToString(identityKey.PubKey().SerializeCompressed(), node.Params),
+		prevVersion, lib.DbGetTelemetryOptIn(node.chainDB))
+
+	// Save any settings the operator changed and log what the node will use.
+	nodeConfig, err := lib.DbGetNodeConfig(node.chainDB)
+	if err != nil {
+		panic(err)
+	}
+	if node.Config.InboxFetchLimit != 0 {
+		nodeConfig.MessagesToFetchPerInboxCall = node.Config.InboxFetchLimit
+	}
+	if node.Config.DecodeFailureThreshold != 0 {
+		nodeConfig.DecodeFailureAlertThreshold = node.Config.DecodeFailureThreshold
+	}
+	if node.Config.MaxTimestampSkewSeconds != 0 {
+		nodeConfig.MaxIndexedTimestampSkewSeconds = node.Config.MaxTimestampSkewSeconds
+	}
+	// Unlike the limits, deduping, balance snapshots, state commitments, recent
+	// block headers, utxo ops retention, and storing txns in the txindex follow
+	// their flags on every start.
+	nodeConfig.DedupeBlockTxns = node.Config.DedupeBlockTxns
+	nodeConfig.BalanceSnapshots = node.Config.BalanceSnapshots
+	nodeConfig.StateCommitments = node.Config.StateCommitments
+	nodeConfig.RecentBlockHeaders = uint32(node.Config.RecentBlockHeaders)
+	nodeConfig.UtxoOpsRetention, nodeConfig.UtxoOpsRetentionBlocks, err = lib.ParseUtxoOpsRetention(
+		node.Config.UtxoOpsRetention, node.Params)
+	if err != nil {
+		panic(err)
+	}
+	nodeConfig.TxindexTxnBytes = node.Config.TxindexStoreTxns
+	err = node.dbLifecycle.Update(func(txn lib.KVTxn) error {
+		return lib.DbPutNodeConfigWithTxn(txn, nodeConfig)
+	})
+	if err != nil {
+		panic(err)
+	}
+	glog.Infof("Node config: messages fetched per inbox: %d, decode failure alert threshold: %d, "+
+		"max timestamp skew seconds: %d, dedupe block txns: %v, balance snapshots: %v, "+
+		"state commitments: %v, recent block headers: %d, utxo ops kept for blocks: %d (0 means all), "+
+		"txindex stores txns: %v",
+		nodeConfig.GetMessagesToFetchPerInboxCall(), nodeConfig.GetDecodeFailureAlertThreshold(),
+		nodeConfig.GetMaxIndexedTimestampSkewSeconds(), nodeConfig.DedupeBlockTxns,
+		nodeConfig.BalanceSnapshots, nodeConfig.StateCommitments, nodeConfig.RecentBlockHeaders,
+		nodeConfig.GetUtxoOpsKeepBlocks(node.Params), nodeConfig.TxindexTxnBytes)
+
+	lib.SetDbCacheConfig(&lib.DbCacheConfig{
+		MaxProfileEntries:     int(node.Config.ProfileCacheSize),
+		MaxPostEntries:        int(node.Config.PostCacheSize),
+		MaxPKIDEntries:        int(node.Config.PKIDCacheSize),
+		MaxBlockHeaderEntries: int(node.Config.BlockHeaderCacheSize),
+	})
+
+	// Fix any indexes that only made it into the db in one direction.
+	if node.Config.RepairReverseMappings {
+		repairReports, err := lib.DbRepairReverseMappings(node.chainDB, lib.ReverseMappingPairs, false /*dryRun*/)
+		if err != nil {
+			panic(err)
+		}
+		for _, report := range repairReports {
+			glog.Infof("Reverse mapping repair: %+v", report)
+		}
+	}
+
+	// Regenerate any derived indexes that were asked for from their entries.
+	if len(node.Config.RebuildIndexes) > 0 {
+		indexNames := []lib.DbIndexName{}
+		for _, indexName := range node.Config.RebuildIndexes {
+			indexNames = append(indexNames, lib.DbIndexName(indexName))
+		}
+		rebuildReports, err := lib.RebuildIndexes(node.chainDB, indexNames)
+		if err != nil {
+			panic(err)
+		}
+		for _, report := range rebuildReports {
+			glog.Infof("Index rebuild: %+v", report)
+		}
+	}
+
+	// Cross-check the indexes that are stored more than once.
+	if node.Config.VerifyDbIntegrity || node.Config.RepairDbIntegrity {
+		integrityReports, err := lib.VerifyDbIntegrity(
+			node.chainDB, node.Params, node.Config.RepairDbIntegrity)
+		if err != nil {
+			panic(err)
+		}
+		for _, report := range integrityReports {
+			glog.Infof("Db integrity check: %+v", report)
+		}
+	}
 
 	// Setup snapshot logger
 	if node.Config.LogDBSummarySnapshots {
-		lib.StartDBSummarySnapshots(node.chainDB)
+		if err := lib.StartDBSummarySnapshots(node.dbLifecycle); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	// Setup value log GC
+	if node.Config.ValueLogGCSeconds > 0 {
+		err := node.dbManager.StartValueLogGC(&lib.DbValueLogGCConfig{
+			Interval:     time.Duration(node.Config.ValueLogGCSeconds) * time.Second,
+			DiscardRatio: node.Config.ValueLogGCDiscardRatio,
+			StatsdClient: statsdClient,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
 	}
 
 	// Setup the server
@@ -134,7 +296,7 @@ func (node *Node) Start() {
 		node.Config.BlockCypherAPIKey,
 		true,
 		node.Config.DataDirectory,
-		node.Config.MempoolDumpDirectory,
+		node.dbManager.MempoolDir(),
 		node.Config.DisableNetworking,
 		node.Config.ReadOnlyMode,
 		node.Config.IgnoreInboundInvs,
@@ -149,14 +311,183 @@ func (node *Node) Start() {
 		panic(err)
 	}
 
+	node.Server.GetBlockchain().SetVerifyBlockConservation(node.Config.VerifyBlockConservation)
+	node.Server.GetMempool().SetMaxTotalTxSizeBytes(node.Config.MaxMempoolBytes)
+	if node.Config.MempoolMaxTxnsPerPublicKey != 0 || node.Config.MempoolMaxTxnsPerPeerIP != 0 ||
+		node.Config.MempoolMaxSpamScore != 0 {
+
+		node.Server.EnableMempoolLimiter(&lib.MempoolLimiterConfig{
+			MaxTxnsPerPublicKey:            node.Config.MempoolMaxTxnsPerPublicKey,
+			MaxTxnsPerSource:               node.Config.MempoolMaxTxnsPerPeerIP,
+			MaxSpamScore:                   node.Config.MempoolMaxSpamScore,
+			SpamReferenceFeeRateNanosPerKB: node.Config.MempoolSpamReferenceFeerate,
+		})
+	}
+
+	// Write a snapshot of the chain state now that it's loaded.
+	if node.Config.CreateSnapshot != "" {
+		if err := createSnapshot(node.chainDB, node.Params, node.Config.CreateSnapshot); err != nil {
+			glog.Errorf("Problem creating snapshot: %v", err)
+		}
+	}
+
+	// Read the hot parts of the db before we start serving.
+	if node.Config.PrewarmCaches {
+		prewarmResults, err := lib.PrewarmCaches(node.chainDB, lib.DefaultPrewarmPrefixes(10000, 1000))
+		if err != nil {
+			glog.Errorf("Problem prewarming caches: %v", err)
+		}
+		for _, result := range prewarmResults {
+			glog.Infof("Prewarmed %v: %d keys, %d bytes in %v",
+				result.Name, result.KeysRead, result.BytesRead, result.Duration)
+		}
+	}
+
+	// Setup the chain store. A Postgres store is caught up with the chain before
+	// the server starts so it can follow along from here.
+	switch node.Config.ChainStore {
+	case lib.ChainStoreTypeBadger:
+		node.ChainStore = lib.NewBadgerChainStore(node.chainDB, node.Params)
+	case lib.ChainStoreTypePostgres:
+		pgStore, err := lib.NewPostgresChainStore(node.Config.PostgresURI, node.Params)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		isCurrent, err := lib.ChainStoreIsCurrent(node.chainDB, pgStore)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if !isCurrent {
+			glog.Infof("Copying the chain to Postgres since it's behind")
+			if err := pgStore.CopyFromDb(node.chainDB); err != nil {
+				glog.Fatal(err)
+			}
+		}
+		node.chainStoreMirror = lib.MirrorEntriesToChainStore(
+			node.Server.GetBlockchain().EventManager(), node.chainDB, pgStore)
+		node.ChainStore = pgStore
+	default:
+		glog.Fatalf("Unknown --chain-store %v; must be %v or %v", node.Config.ChainStore,
+			lib.ChainStoreTypeBadger, lib.ChainStoreTypePostgres)
+	}
+
+	// Setup the event stream before the server starts so clients don't miss the
+	// first blocks.
+	if node.Config.EventStreamAddress != "" {
+		eventStreamListener, err := net.Listen("tcp", node.Config.EventStreamAddress)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		node.eventStream = lib.NewEventStreamServer(
+			node.Server.GetBlockchain().EventManager(), eventStreamListener)
+		node.eventStream.Start()
+	}
+
 	node.Server.Start()
 
+	// Setup scheduled post publisher
+	if err := node.Server.StartScheduledPostPublisher(node.dbLifecycle); err != nil {
+		glog.Fatal(err)
+	}
+
+	// Setup decode failure reporter
+	if err := node.Server.StartDecodeFailureReporter(node.dbLifecycle); err != nil {
+		glog.Fatal(err)
+	}
+
+	// Setup timestamp index restorer
+	if err := lib.StartTimestampIndexRestorer(
+		node.dbLifecycle, lib.TimestampIndexRestoreIntervalSeconds*time.Second); err != nil {
+		glog.Fatal(err)
+	}
+
+	// Setup prune height advertiser
+	if err := node.Server.StartPruneHeightAdvertiser(node.dbLifecycle); err != nil {
+		glog.Fatal(err)
+	}
+
+	// Setup retention sweeper. Pruning is the blocks policy.
+	retentionPolicies, err := lib.ParseDbRetentionPolicies(node.Config.RetentionPolicies, node.Params)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if node.Config.PruneBlocks > 0 {
+		if err := lib.CheckRetentionKeepBlocks(node.Params, node.Config.PruneBlocks); err != nil {
+			glog.Fatal(err)
+		}
+		retentionPolicies["blocks"] = &lib.DbRetentionPolicy{
+			Type: lib.DbRetentionKeepBlocks,
+			N:    node.Config.PruneBlocks,
+		}
+	}
+	if policy := retentionPolicies["blocks"]; policy != nil && policy.Type == lib.DbRetentionKeepBlocks && node.Config.TXIndex {
+		glog.Fatal("Can't prune blocks when --txindex is set since the txindex " +
+			"needs every block")
+	}
+	if len(retentionPolicies) > 0 {
+		bc := node.Server.GetBlockchain()
+		err = lib.StartDbRetentionSweeper(node.dbLifecycle, retentionPolicies, func() uint64 {
+			bc.ChainLock.RLock()
+			defer bc.ChainLock.RUnlock()
+			return uint64(bc.BlockTip().Height)
+		}, time.Duration(node.Config.RetentionSweepSeconds)*time.Second)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	// Setup archive sweeper
+	if node.Config.ArchiveDirectory != "" {
+		node.dbArchive, err = lib.OpenDbArchive(node.Config.ArchiveDirectory)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		bc := node.Server.GetBlockchain()
+		err = lib.StartDbArchiveSweeper(node.dbLifecycle, node.dbArchive, node.Config.ArchiveAfterBlocks, func() uint64 {
+			bc.ChainLock.RLock()
+			defer bc.ChainLock.RUnlock()
+			return uint64(bc.BlockTip().Height)
+		}, time.Duration(node.Config.RetentionSweepSeconds)*time.Second)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	// Setup backups
+	if node.Config.BackupDirectory != "" {
+		if node.Config.BackupIntervalSeconds == 0 {
+			glog.Fatal("--backup-interval-seconds must be nonzero when --backup-dir is set")
+		}
+		err = lib.StartDbBackups(node.dbLifecycle, node.Params, node.Config.BackupDirectory,
+			time.Duration(node.Config.BackupIntervalSeconds)*time.Second)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
 	// Setup TXIndex
 	if node.Config.TXIndex {
-		node.TXIndex, err = lib.NewTXIndex(node.Server.GetBlockchain(), node.Server.GetBitcoinManager(), node.Params, node.Config.DataDirectory)
+		if node.Config.ResyncTxindex {
+			txIndexLifecycle, err := node.dbManager.OpenTxindexDb()
+			if err != nil {
+				glog.Fatal(err)
+			}
+			resyncReport, err := lib.ResyncTxindex(txIndexLifecycle.DB(), node.chainDB, node.Params,
+				uint32(node.Config.ResyncTxindexHeight), false /*dryRun*/)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			glog.Infof("Txindex resync: %+v", resyncReport)
+		}
+		node.TXIndex, err = lib.NewTXIndex(node.Server.GetBlockchain(), node.Server.GetBitcoinManager(), node.Params, node.dbManager)
 		if err != nil {
 			glog.Fatal(err)
 		}
+		if node.Config.TxindexMempool {
+			if err := node.TXIndex.EnableMempoolView(node.Config.TxindexMempoolInDb); err != nil {
+				glog.Fatal(err)
+			}
+		}
 
 		node.TXIndex.Start()
 	}
@@ -164,8 +495,33 @@ func (node *Node) Start() {
 
 func (node* Node) Stop() {
 	node.Server.Stop()
-	node.chainDB.Close()
-	node.TXIndex.Stop()
+	if node.TXIndex != nil {
+		node.TXIndex.Stop()
+	}
+	if node.eventStream != nil {
+		node.eventStream.Stop()
+	}
+	// Make the writes the mirror still has queued before closing the store.
+	if node.chainStoreMirror != nil {
+		node.chainStoreMirror.Stop()
+	}
+	if node.ChainStore != nil {
+		if err := node.ChainStore.Close(); err != nil {
+			glog.Errorf("Node.Stop: %v", err)
+		}
+	}
+
+	// The server is stopped so nothing else is writing to the dbs. Stop the
+	// background tasks and close them cleanly.
+	if err := node.dbManager.Close(); err != nil {
+		glog.Errorf("Node.Stop: %v", err)
+	}
+	// The archive sweeper stopped with the lifecycle.
+	if node.dbArchive != nil {
+		if err := node.dbArchive.Close(); err != nil {
+			glog.Errorf("Node.Stop: %v", err)
+		}
+	}
 }
 
 func validateParams(params *lib.BitCloutParams) {
@@ -327,3 +683,80 @@ func addSeedAddrsFromPrefixes(bitcloutAddrMgr *addrmgr.AddrManager, params *lib.
 		}
 	}()
 }
+
+// bootstrapFromSnapshot loads the snapshot at snapshotPath, which is either a
+// snapshot directory or a tar file, into the db. Tar files are extracted to a
+// temporary directory in the data dir first.
+func bootstrapFromSnapshot(db *badger.DB, params *lib.BitCloutParams, snapshotPath string, dataDir string) error {
+	snapshotDir := snapshotPath
+	if strings.HasSuffix(snapshotPath, ".tar") {
+		snapshotDir = filepath.Join(dataDir, "snapshot_extract")
+		if err := os.RemoveAll(snapshotDir); err != nil {
+			return err
+		}
+		defer os.RemoveAll(snapshotDir)
+
+		tarFile, err := os.Open(snapshotPath)
+		if err != nil {
+			return err
+		}
+		defer tarFile.Close()
+		if err := lib.ExtractSnapshotTar(tarFile, snapshotDir); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := lib.InitDbFromSnapshot(db, params, snapshotDir)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Loaded snapshot from %s at height %d (%v)",
+		snapshotPath, manifest.BlockHeight, manifest.BlockHash)
+	return nil
+}
+
+// syncStateFromPeer syncs the chain state in the manifest at manifestPath from
+// the peer at peerAddr into the db.
+func syncStateFromPeer(db *badger.DB, params *lib.BitCloutParams, manifestPath string, peerAddr string) error {
+	if peerAddr == "" {
+		return fmt.Errorf("syncStateFromPeer: --state-sync-peer must be set")
+	}
+	manifest, err := lib.ReadDbSnapshotManifestFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	if err := lib.SyncStateFromPeer(db, params, manifest, peerAddr); err != nil {
+		return err
+	}
+	glog.Infof("Synced state from %s at height %d (%v)",
+		peerAddr, manifest.BlockHeight, manifest.BlockHash)
+	return nil
+}
+
+// createSnapshot writes a snapshot of the db to snapshotPath, as a tar file if it
+// ends in .tar and as a directory otherwise.
+func createSnapshot(db *badger.DB, params *lib.BitCloutParams, snapshotPath string) error {
+	var manifest *lib.DbSnapshotManifest
+	if strings.HasSuffix(snapshotPath, ".tar") {
+		tarFile, err := os.OpenFile(snapshotPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		manifest, err = lib.DbWriteSnapshotTar(db, params, tarFile)
+		if closeErr := tarFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		manifest, err = lib.DbCreateSnapshot(db, params, snapshotPath)
+		if err != nil {
+			return err
+		}
+	}
+	glog.Infof("Created snapshot at %s at height %d (%v) with %d prefixes",
+		snapshotPath, manifest.BlockHeight, manifest.BlockHash, len(manifest.Prefixes))
+	return nil
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/bitclout/core/lib"
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+)
+
+var restoreDbCmd = &cobra.Command{
+	Use:   "restore-db",
+	Short: "Restore a node's db from the backups taken with --backup-dir",
+	Long: `Restores the full backup in --backup-dir and every incremental backup after
+it, in order, into a new db in --data-dir. The node must not be running and
+--data-dir must not already have a chain.`,
+	Run: RestoreDb,
+}
+
+func init() {
+	restoreDbCmd.Flags().String("backup-dir", "", "The directory the backups were written to.")
+	restoreDbCmd.Flags().String("data-dir", "", "The data directory of the node to restore.")
+	restoreDbCmd.Flags().Bool("testnet", false, "Restore a testnet node.")
+	rootCmd.AddCommand(restoreDbCmd)
+}
+
+func RestoreDb(cmd *cobra.Command, args []string) {
+	backupDir, _ := cmd.Flags().GetString("backup-dir")
+	dataDir, _ := cmd.Flags().GetString("data-dir")
+	testnet, _ := cmd.Flags().GetBool("testnet")
+	if backupDir == "" || dataDir == "" {
+		glog.Fatal("Both --backup-dir and --data-dir have to be set")
+	}
+	params := &lib.BitCloutMainnetParams
+	if testnet {
+		params = &lib.BitCloutTestnetParams
+	}
+
+	db, err := lib.OpenBadgerDb(lib.GetBadgerDbPath(dataDir), nil)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer db.Close()
+
+	manifest, err := lib.DbRestoreFromDir(db, params, backupDir)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Restored %v to height %d (%v)", dataDir, manifest.BlockHeight, manifest.BlockHash)
+}
@@ -56,6 +56,173 @@ func SetupRunFlags(cmd *cobra.Command) {
 			"ids to transaction information. This enables the use of certain API calls "+
 			"like ones that allow the lookup of particular transactions by their ID. "+
 			"Defaults to false because the index can be large.")
+	cmd.PersistentFlags().String("txindex-dir", "",
+		"When set, the txindex db is stored in the directory specified instead of "+
+			"under --data-dir, e.g. to keep it on a different disk.")
+	cmd.PersistentFlags().Bool("resync-txindex", false,
+		"When set to true, the txindex is checked against its blocks on startup. Missing "+
+			"public key mappings are rewritten and, if any txn metadata is bad, the txindex "+
+			"is rewound to before it so the blocks after it are indexed again.")
+	cmd.PersistentFlags().Uint64("resync-txindex-from-height", 0,
+		"The height --resync-txindex starts checking from. Checking the whole txindex "+
+			"can take a while.")
+	cmd.PersistentFlags().Bool("txindex-store-txns", false,
+		"When set to true, the txindex stores the bytes of each txn it indexes so a txn "+
+			"can be looked up without loading its whole block, at the cost of more disk. "+
+			"Txns indexed before it was set are still loaded from their blocks.")
+	cmd.PersistentFlags().Bool("txindex-mempool", false,
+		"When set to true, the txindex also indexes the txns in the mempool so they can "+
+			"be looked up, marked as unconfirmed, before they're mined.")
+	cmd.PersistentFlags().Bool("txindex-mempool-in-db", false,
+		"When set to true, --txindex-mempool keeps the mempool's txns in the txindex db "+
+			"rather than in memory.")
+	cmd.PersistentFlags().StringSlice("retention-policies", []string{},
+		"A comma-separated list of <index>=<policy> entries that limit how long "+
+			"data is kept for an index. The policy can be forever, days:<N>, or blocks:<N>. "+
+			"Supported indexes are blocks, conversations, private-messages, utxo-ops, utxo-spends, txn-daily-stats, faucet-public-keys, and faucet-ip-hashes. Note "+
+			"that keeping N blocks of blocks or utxo-ops means reorgs deeper than N blocks will fail, "+
+			"so N can't be less than the finality depth. Keeping N blocks of blocks is the same as --prune-blocks. "+
+			"Indexes without a policy are kept forever.")
+	cmd.PersistentFlags().Uint64("retention-sweep-seconds", 3600,
+		"How often the retention policies are applied to the db and old history "+
+			"is archived or pruned.")
+	cmd.PersistentFlags().Uint64("value-log-gc-seconds", 600,
+		"How often the space taken by deleted and overwritten values is reclaimed "+
+			"from the dbs. Set to 0 to never reclaim it.")
+	cmd.PersistentFlags().Float64("value-log-gc-discard-ratio", 0.5,
+		"A value log file is only rewritten when at least this fraction of it is "+
+			"stale. Lower values reclaim more space but rewrite more data.")
+	cmd.PersistentFlags().String("db-profile", "default",
+		"The set of badger options the dbs are opened with. Can be default, "+
+			"low-memory, or high-throughput. The --db-* flags below override it.")
+	cmd.PersistentFlags().Uint64("db-memtable-size-mb", 0,
+		"When set, the size of each badger memtable in MB. Txns bigger than about "+
+			"15% of it are rejected, so the node won't start if it's too small to "+
+			"connect the largest block the chain allows.")
+	cmd.PersistentFlags().Uint64("db-num-compactors", 0,
+		"When set, the number of goroutines compacting the dbs. Must be at least 2.")
+	cmd.PersistentFlags().String("db-compression", "",
+		"When set, how the dbs compress their tables. Can be none, snappy, or zstd. "+
+			"Only tables written after it's changed are affected.")
+	cmd.PersistentFlags().String("archive-dir", "",
+		"When set, the utxo operations and utxo spend records of blocks more than "+
+			"--archive-after-blocks behind the tip are moved out of the db and into "+
+			"append-only archive files in this directory. They can still be looked up "+
+			"but the db stays smaller. When unset, nothing is archived.")
+	cmd.PersistentFlags().Uint64("archive-after-blocks", 10000,
+		"How many blocks behind the tip history has to be before it's archived. "+
+			"Only used when --archive-dir is set.")
+	cmd.PersistentFlags().String("backup-dir", "",
+		"When set, the db is backed up to this directory while the node runs. The "+
+			"first backup is a full one and the rest only have what changed since the "+
+			"one before. Restore them with the restore-db command.")
+	cmd.PersistentFlags().Uint64("backup-interval-seconds", 3600,
+		"How often the db is backed up. Only used when --backup-dir is set.")
+	cmd.PersistentFlags().Uint64("prune-blocks", 0,
+		"When nonzero, the bodies and utxo operations of blocks more than this many "+
+			"blocks behind the tip are deleted from the db. Headers and state are kept, "+
+			"but the node can no longer serve the pruned blocks to peers or process "+
+			"reorgs deeper than this. Must be at least the finality depth. Can't be combined with "+
+			"--txindex.")
+	cmd.PersistentFlags().Bool("verify-block-conservation", false,
+		"When set to true, every block connected to the main chain is checked to make "+
+			"sure it doesn't create or destroy nanos beyond the block reward and fees. "+
+			"Violations are logged as errors. This slows down block processing.")
+	cmd.PersistentFlags().Bool("prewarm-caches", false,
+		"When set to true, profiles, recent posts, and the blocks at the tip are read "+
+			"into the db cache before the node starts serving. This avoids slow "+
+			"responses right after a restart at the cost of a longer startup.")
+	cmd.PersistentFlags().Bool("repair-reverse-mappings", false,
+		"When set to true, the follow, like, diamond, balance, and reclout indexes are checked "+
+			"on startup and any reverse mappings that are missing are rewritten from "+
+			"their forward mappings.")
+	cmd.PersistentFlags().StringSlice("rebuild-indexes", []string{},
+		"The derived indexes to drop and regenerate from their entries on startup. Can "+
+			"include post-tstamp, post-creator-bps, post-stake-multiple-bps, username-pkid, "+
+			"coin-locked-pkid, post-engagement-counts, and diamond-totals.")
+	cmd.PersistentFlags().Bool("verify-db-integrity", false,
+		"When set to true, the indexes that are stored more than once (follows, likes, "+
+			"diamonds, balances, reclouts, PKIDs, and messages) are cross-checked on startup "+
+			"and any mappings that are missing or orphaned are logged.")
+	cmd.PersistentFlags().Bool("repair-db-integrity", false,
+		"When set to true, the db integrity check runs on startup and also writes the "+
+			"mappings that are missing and deletes the ones that are orphaned.")
+	cmd.PersistentFlags().Uint64("inbox-fetch-limit", 0,
+		"When set, the most messages fetched when loading an inbox is changed to "+
+			"this and saved in the db so it's kept across restarts. When unset, the "+
+			"saved limit is used, or the default if one was never saved.")
+	cmd.PersistentFlags().Uint64("decode-failure-threshold", 0,
+		"When set, a db prefix is flagged as unhealthy once this many of its values "+
+			"have failed to decode. The threshold is saved in the db so it's kept across "+
+			"restarts. When unset, the saved threshold is used, or the default if one "+
+			"was never saved.")
+	cmd.PersistentFlags().Uint64("max-timestamp-skew-seconds", 0,
+		"When set, posts and messages with a timestamp more than this many seconds past "+
+			"the time of the block they're flushed with are kept out of the time-ordered "+
+			"indexes until the chain catches up with them. The setting is saved in the db so it's kept across restarts. When "+
+			"unset, the saved setting is used, or the default if one was never saved.")
+	cmd.PersistentFlags().Bool("dedupe-block-txns", false,
+		"When set to true, new blocks are stored as lists of txn hashes with each txn "+
+			"stored once, which saves disk when competing forks share txns and lets the "+
+			"txindex load a txn without loading its block. Blocks already stored are kept "+
+			"as they are and can be read either way.")
+	cmd.PersistentFlags().Bool("balance-snapshots", false,
+		"When set to true, the node keeps each public key's balance as of every block "+
+			"that changed it so balances at past heights can be looked up. Snapshots start "+
+			"at the tip the first time the flag is set and are deleted when it's unset.")
+	cmd.PersistentFlags().Bool("state-commitments", false,
+		"When set to true, the node keeps a commitment to its state as of every block "+
+			"so state from a snapshot or from peers can be checked against it. Commitments "+
+			"start at the tip the first time the flag is set and are deleted when it's unset.")
+	cmd.PersistentFlags().Uint64("profile-cache-size", 0,
+		"The number of profiles to keep decoded in memory after they're read from the "+
+			"db. When unset, profiles aren't cached.")
+	cmd.PersistentFlags().Uint64("post-cache-size", 0,
+		"The number of posts to keep decoded in memory after they're read from the "+
+			"db. When unset, posts aren't cached.")
+	cmd.PersistentFlags().Uint64("pkid-cache-size", 0,
+		"The number of public key to PKID mappings to keep in memory after they're "+
+			"read from the db. When unset, PKIDs aren't cached.")
+	cmd.PersistentFlags().Uint64("recent-block-headers", 0,
+		"When set, only the headers of the blocks within this many blocks of the tip "+
+			"are kept in memory and older ones are read from the db when a peer asks "+
+			"for them. Forks off of blocks further back than this are ignored. When unset, "+
+			"every header is kept in memory.")
+	cmd.PersistentFlags().Uint64("block-header-cache-size", 0,
+		"The number of old block headers to keep in memory after they're read from the "+
+			"db when --recent-block-headers is set. When unset, they aren't cached.")
+	cmd.PersistentFlags().String("utxo-ops-retention", "keep-all",
+		"How long the utxo operations of connected blocks are kept. Can be keep-all, "+
+			"keep-last:<N> to keep the last N blocks, or keep-none-after-finality to "+
+			"drop them once a block is final. Reorgs past the blocks that are kept will "+
+			"fail. Old utxo operations are deleted on the first start with a new setting.")
+	cmd.PersistentFlags().String("bootstrap-snapshot", "",
+		"A snapshot directory, or a snapshot .tar file, to load the chain state from "+
+			"when the node doesn't have a chain yet. The node then syncs from the "+
+			"snapshot's tip rather than from genesis. Ignored once the node has a chain.")
+	cmd.PersistentFlags().String("create-snapshot", "",
+		"When set, a snapshot of the chain state is written to this directory once "+
+			"the chain has loaded, or to this file as a tar stream if it ends in .tar. "+
+			"Other nodes can load it with --bootstrap-snapshot.")
+	cmd.PersistentFlags().String("state-sync-manifest", "",
+		"A snapshot manifest file to sync the chain state against from "+
+			"--state-sync-peer when the node doesn't have a chain yet. Peers only serve "+
+			"the state at heights that are a multiple of 1000, so the manifest has to be "+
+			"for one of those. Ignored once the node has a chain.")
+	cmd.PersistentFlags().String("state-sync-peer", "",
+		"The host:port of the peer to sync the chain state from. See --state-sync-manifest.")
+	cmd.PersistentFlags().String("event-stream-address", "",
+		"When set, the node listens on this host:port and streams connected blocks and "+
+			"txns, and optionally mempool txns and txindex metadata, to anyone who "+
+			"subscribes. See lib/event_stream.proto for the messages. Don't expose it "+
+			"publicly since there's no auth.")
+	cmd.PersistentFlags().String("chain-store", "badger",
+		"Where services built on the node read posts, profiles, follows, and balances "+
+			"from. Can be badger or postgres. The chain always runs on badger; with "+
+			"postgres the node copies the chain to --postgres-uri and keeps it in sync. "+
+			"Postgres trails the chain slightly since it's written in the background.")
+	cmd.PersistentFlags().String("postgres-uri", "",
+		"The Postgres connection string to use with --chain-store=postgres.")
 
 	// Peers
 	cmd.PersistentFlags().StringSlice("connect-ips", []string{},
@@ -135,6 +302,24 @@ func SetupRunFlags(cmd *cobra.Command) {
 			"rate-limit-feerate, should be the first line of "+
 			"defense against attacks that involve flooding the network with low-fee "+
 			"transactions in an attempt to overflow the mempool")
+	cmd.PersistentFlags().Uint64("max-mempool-bytes", 250000000,
+		"The most bytes the transactions in the mempool can add up to. When the mempool "+
+			"goes over it, the transactions with the lowest feerates are evicted along with "+
+			"the transactions that depend on them")
+	cmd.PersistentFlags().Uint64("mempool-max-txns-per-public-key", 0,
+		"The most unconfirmed transactions a single public key can have in the mempool. "+
+			"Set to zero for no limit")
+	cmd.PersistentFlags().Uint64("mempool-max-txns-per-peer-ip", 0,
+		"The most unconfirmed transactions the peers at a single IP can have relayed into "+
+			"the mempool. Set to zero for no limit")
+	cmd.PersistentFlags().Float64("mempool-max-spam-score", 0,
+		"Transactions with a spam score above this are rejected. A transaction's spam "+
+			"score is its size in KB times mempool-spam-reference-feerate over its feerate, "+
+			"scaled up by the recent rejections of its public key and peer IP. Set to zero "+
+			"for no limit")
+	cmd.PersistentFlags().Uint64("mempool-spam-reference-feerate", 1000,
+		"The feerate at which a 1KB transaction from a public key and peer IP without "+
+			"recent rejections has a spam score of one")
 
 	// BlockProducer
 	cmd.PersistentFlags().Uint64("max-block-templates-cache", 100,
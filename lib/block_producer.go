@@ -8,7 +8,6 @@ import (
 	"math"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/sasha-s/go-deadlock"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -38,6 +37,9 @@ type BitCloutBlockProducer struct {
 
 	latestBlockTemplateStats *BlockTemplateStats
 
+	// Picks the txns for the block templates and builds them.
+	templateProducer *BlockTemplateProducer
+
 	mempool        *BitCloutMempool
 	chain          *Blockchain
 	bitcoinManager *BitcoinManager
@@ -83,6 +85,7 @@ func NewBitCloutBlockProducer(
 		maxBlockTemplatesToCache:      _maxBlockTemplatesToCache,
 		blockProducerPrivateKey: _privKey,
 		recentBlockTemplatesProduced:  make(map[BlockHash]*MsgBitCloutBlock),
+		templateProducer:              NewBlockTemplateProducer(_mempool, _chain, _bitcoinManager, _params),
 
 		mempool:        _mempool,
 		chain:          _chain,
@@ -95,233 +98,64 @@ func (bbp *BitCloutBlockProducer) GetLatestBlockTemplateStats() *BlockTemplateSt
 	return bbp.latestBlockTemplateStats
 }
 
-func (bitcloutBlockProducer *BitCloutBlockProducer) _updateBlockTimestamp(blk *MsgBitCloutBlock, lastNode *BlockNode) {
-	// Set the block's timestamp. If the timesource's time happens to be before
-	// the timestamp set in the last block then set the time based on the last
-	// block's timestamp instead. We do this because consensus rules require a
-	// monotonically increasing timestamp.
-	blockTstamp := uint32(bitcloutBlockProducer.chain.timeSource.AdjustedTime().Unix())
-	if blockTstamp <= uint32(lastNode.Header.TstampSecs) {
-		blockTstamp = uint32(lastNode.Header.TstampSecs) + 1
-	}
-	blk.Header.TstampSecs = uint64(blockTstamp)
-}
-
 func (bitcloutBlockProducer *BitCloutBlockProducer) _getBlockTemplate(publicKey []byte) (
 	_blk *MsgBitCloutBlock, _diffTarget *BlockHash, _lastNode *BlockNode, _err error) {
 
-	// Get the current tip of the best block chain. Note that using the tip of the
-	// best block chain as opposed to the best header chain means we'll be mining
-	// stale blocks until we're fully synced. This isn't ideal, but is currently
-	// preferred to mining atop the best header chain because the latter currently results
-	// in the blocks being rejected as unconnectedTxns before the block tip is in-sync.
-	lastNode := bitcloutBlockProducer.chain.blockTip()
-
-	// Compute the public key to contribute the reward to.
-	rewardPk, err := btcec.ParsePubKey(publicKey, btcec.S256())
+	blockTemplate, err := bitcloutBlockProducer.templateProducer.ProduceBlockTemplate(
+		publicKey, uint64(bitcloutBlockProducer.chain.timeSource.AdjustedTime().Unix()))
 	if err != nil {
 		return nil, nil, nil, errors.Wrapf(err, "BitCloutBlockProducer._getBlockTemplate: ")
 	}
+	bitcloutBlockProducer._updateBlockTemplateStats(blockTemplate)
 
-	// Construct the next block.
-	blockRewardOutput := &BitCloutOutput{}
-	if rewardPk != nil {
-		// This is to account for a really weird edge case where somebody stops the BlockProducer
-		// in the middle of us getting a block.
-		blockRewardOutput.PublicKey = rewardPk.SerializeCompressed()
-	}
-	// Set the block reward output initially to the maximum value for a uint64.
-	// This ensures it will take the maximum amount of space in the block when
-	// encoded as a varint so our size estimates won't get messed up.
-	blockRewardOutput.AmountNanos = math.MaxUint64
-
-	// Block reward txn only needs a single output. No need to specify spending
-	// pk or sigs.
-	blockRewardTxn := NewMessage(MsgTypeTxn).(*MsgBitCloutTxn)
-	blockRewardTxn.TxOutputs = append(blockRewardTxn.TxOutputs, blockRewardOutput)
-	// Set the ExtraData to zero. This gives miners something they can
-	// twiddle if they run out of space on their actual nonce.
-	blockRewardTxn.TxnMeta = &BlockRewardMetadataa{
-		ExtraData: UintToBuf(0),
-	}
-
-	// Create the block and add the BlockReward txn to it.
-	blockRet := NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
-	blockRet.Txns = append(blockRet.Txns, blockRewardTxn)
-	// The version may be swapped out in a call to GetBlockTemplate in order to remain
-	// backwards-compatible with existing miners that use an older version.
-	blockRet.Header.Version = CurrentHeaderVersion
-	blockRet.Header.Height = uint64(lastNode.Height + 1)
-	blockRet.Header.PrevBlockHash = lastNode.Hash
-	bitcloutBlockProducer._updateBlockTimestamp(blockRet, lastNode)
-	// Start the nonce at zero. This is OK because we'll set a random ExtraData for the
-	// miner later.
-	blockRet.Header.Nonce = 0
-
-	// Only add transactions to the block if our chain is done syncing.
-	if bitcloutBlockProducer.chain.chainState() != SyncStateSyncingHeaders &&
-		bitcloutBlockProducer.chain.chainState() != SyncStateNeedBlocksss {
-
-		// Fetch a bunch of mempool transactions to add.
-		txnsOrderedByTimeAdded, _, err := bitcloutBlockProducer.mempool.GetTransactionsOrderedByTimeAdded()
-		if err != nil {
-			return nil, nil, nil, errors.Wrapf(err, "BitCloutBlockProducer._getBlockTemplate: Problem getting mempool transactions: ")
-		}
-
-		// Now keep
-		// adding transactions to the block until the block is full.
-		//
-		// Compute the size of the header and then add the number of bytes used to encode
-		// the number of transactions in the block. Note that headers have a fixed size.
-		//
-		// TODO: The code below is lazily-written and could be optimized to squeeze a few
-		// more bytes into each block.
-		//
-		// Track the total size of the block as we go. Since the number of transactions
-		// encoded in the block can become larger as we add transactions to it, add the
-		// maximum size for this field to the current size to ensure we don't overfill
-		// the block.
-		blockBytes, err := blockRet.ToBytes(false)
-		if err != nil {
-			return nil, nil, nil, errors.Wrapf(err, "BitCloutBlockProducer._getBlockTemplate: Problem serializing block: ")
-		}
-		currentBlockSize := uint64(len(blockBytes) + MaxVarintLen64)
-
-		// Create a new view object.
-		utxoView, err := NewUtxoView(
-			bitcloutBlockProducer.chain.db, bitcloutBlockProducer.params, bitcloutBlockProducer.bitcoinManager)
-		if err != nil {
-			return nil, nil, nil, errors.Wrapf(err,
-				"BitCloutBlockProducer._getBlockTemplate: Error generating checker UtxoView: ")
-		}
-
-		txnsAddedToBlock := make(map[BlockHash]bool)
-		for ii, mempoolTx := range txnsOrderedByTimeAdded {
-			// If we hit a transaction that's too big to fit into a block then we're done.
-			if mempoolTx.TxSizeBytes+currentBlockSize > bitcloutBlockProducer.params.MinerMaxBlockSizeBytes {
-				break
-			}
-
-			// Try to apply the transaction to the view with the strictest possible checks.
-			_, _, _, _, err := utxoView._connectTransaction(
-				mempoolTx.Tx, mempoolTx.Hash, int64(mempoolTx.TxSizeBytes), uint32(blockRet.Header.Height), true,
-				true, /*checkMerkleProof*/
-				bitcloutBlockProducer.params.MinerBitcoinMinBurnWorkBlockss,
-				false /*ignoreUtxos*/)
-			if err != nil {
-				// If we fail to apply this transaction then we're done. Don't mine any of the
-				// other transactions since they could be dependent on this one.
-				txnErrorString := fmt.Sprintf(
-					"BitCloutBlockProducer._getBlockTemplate: Stopping at txn %v because it's not ready yet: %v", ii, err)
-				glog.Infof(txnErrorString)
-				if mempoolTx.Tx.TxnMeta.GetTxnType() == TxnTypeBitcoinExchange {
-					// Print the Bitcoin block hash when we break out due to this.
-					btcErrorString := fmt.Sprintf("A bad BitcoinExchange transaction may be holding "+
-						"up block production: %v, Current header tip: %v",
-						mempoolTx.Tx.TxnMeta.(*BitcoinExchangeMetadata).BitcoinTransaction.TxHash(),
-						bitcloutBlockProducer.bitcoinManager.HeaderTip().Hash)
-					glog.Infof(btcErrorString)
-					txnErrorString += (" " + btcErrorString)
-					scs := spew.ConfigState{DisableMethods: true, Indent: "  "}
-					glog.Debugf("Spewing Bitcoin txn: %v", scs.Sdump(mempoolTx.Tx))
-				}
-
-				// Update the block template stats for the admin dashboard.
-				failingTxnHash := mempoolTx.Hash.String()
-				failingTxnOriginalTimeAdded := mempoolTx.Added
-				if bitcloutBlockProducer.latestBlockTemplateStats != nil &&
-					bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnHash == failingTxnHash {
-					// If we already have the txn stored, update the error message in case it changed
-					// and set the originalTimeAdded variable to compute an accurate staleness metric.
-					bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnError = txnErrorString
-					failingTxnOriginalTimeAdded = bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnOriginalTimeAdded
-				} else {
-					// If we haven't seen this txn before, build the block template stats from scratch.
-					blockTemplateStats := &BlockTemplateStats{}
-					blockTemplateStats.FailingTxnHash = mempoolTx.Hash.String()
-					blockTemplateStats.TxnCount = uint32(ii)
-					blockTemplateStats.FailingTxnError = txnErrorString
-					blockTemplateStats.FailingTxnOriginalTimeAdded = failingTxnOriginalTimeAdded
-					bitcloutBlockProducer.latestBlockTemplateStats = blockTemplateStats
-				}
-				// Compute the time since this txn started holding up the mempool.
-				currentTime := time.Now()
-				timeElapsed := currentTime.Sub(failingTxnOriginalTimeAdded)
-				bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnMinutesSinceAdded = timeElapsed.Minutes()
-
-				break
-			} else if bitcloutBlockProducer.latestBlockTemplateStats != nil {
-				bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnError = "You good"
-				bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnHash = "Nada"
-				bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnMinutesSinceAdded = 0
-				bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnOriginalTimeAdded = time.Now()
-			}
-
-			// If we get here then it means the txn is ready to be processed *and* we've added
-			// all of its dependencies to the block already. So go ahead and it to the block.
-			currentBlockSize += mempoolTx.TxSizeBytes + MaxVarintLen64
-			blockRet.Txns = append(blockRet.Txns, mempoolTx.Tx)
-			txnsAddedToBlock[*mempoolTx.Hash] = true
-		}
+	glog.Infof("Produced block with %v txns with approx %v total txns in mempool",
+		len(blockTemplate.Block.Txns), len(bitcloutBlockProducer.mempool.readOnlyUniversalTransactionList))
+	return blockTemplate.Block, blockTemplate.DiffTarget, blockTemplate.TipNode, nil
+}
 
-		// Double-check that the final block size is below the limit.
-		blockBytes, err = blockRet.ToBytes(false)
-		if err != nil {
-			return nil, nil, nil, errors.Wrapf(err, "BitCloutBlockProducer._getBlockTemplate: Problem serializing block after txns added: ")
-		}
-		if uint64(len(blockBytes)) > bitcloutBlockProducer.params.MinerMaxBlockSizeBytes {
-			return nil, nil, nil, fmt.Errorf("BitCloutBlockProducer._getBlockTemplate: Block created with size "+
-				"(%d) exceeds BlockProducerMaxBlockSizeBytes (%d): ", len(blockBytes), bitcloutBlockProducer.params.MinerMaxBlockSizeBytes)
+// _updateBlockTemplateStats records the first txn that couldn't be put in the
+// block template for the admin dashboard.
+func (bitcloutBlockProducer *BitCloutBlockProducer) _updateBlockTemplateStats(blockTemplate *BlockTemplate) {
+	if len(blockTemplate.FailedTxns) == 0 {
+		if bitcloutBlockProducer.latestBlockTemplateStats != nil {
+			bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnError = "You good"
+			bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnHash = "Nada"
+			bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnMinutesSinceAdded = 0
+			bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnOriginalTimeAdded = time.Now()
 		}
+		return
 	}
 
-	// Compute the total fee the BlockProducer should get.
-	totalFeeNanos := uint64(0)
-	feesUtxoView, err := NewUtxoView(bitcloutBlockProducer.chain.db, bitcloutBlockProducer.params, bitcloutBlockProducer.bitcoinManager)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf(
-			"BitCloutBlockProducer._getBlockTemplate: Error generating UtxoView to compute txn fees: %v", err)
-	}
-	// Skip the block reward, which is the first txn in the block.
-	for _, txnInBlock := range blockRet.Txns[1:] {
-		var feeNanos uint64
-		_, _, _, feeNanos, err = feesUtxoView._connectTransaction(
-			txnInBlock, txnInBlock.Hash(), 0, uint32(blockRet.Header.Height), false, /*verifySignatures*/
-			false, /*checkMerkleProof*/
-			0, false /*ignoreUtxos*/)
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf(
-				"BitCloutBlockProducer._getBlockTemplate: Error attaching txn to UtxoView for computed block: %v", err)
+	failedTxn := blockTemplate.FailedTxns[0]
+	txnErrorString := fmt.Sprintf(
+		"BitCloutBlockProducer._getBlockTemplate: Left out txn %v because it's not ready yet: %v",
+		failedTxn.MempoolTx.Hash, failedTxn.Err)
+	failingTxnHash := failedTxn.MempoolTx.Hash.String()
+	failingTxnOriginalTimeAdded := failedTxn.MempoolTx.Added
+	if bitcloutBlockProducer.latestBlockTemplateStats != nil &&
+		bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnHash == failingTxnHash {
+		// If we already have the txn stored, update the error message in case it changed
+		// and set the originalTimeAdded variable to compute an accurate staleness metric.
+		bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnError = txnErrorString
+		failingTxnOriginalTimeAdded = bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnOriginalTimeAdded
+	} else {
+		// If we haven't seen this txn before, build the block template stats from scratch.
+		bitcloutBlockProducer.latestBlockTemplateStats = &BlockTemplateStats{
+			FailingTxnHash:              failingTxnHash,
+			TxnCount:                    uint32(len(blockTemplate.Block.Txns) - 1),
+			FailingTxnError:             txnErrorString,
+			FailingTxnOriginalTimeAdded: failingTxnOriginalTimeAdded,
 		}
-
-		// Add the fee to the block reward output as we go. Note this has some risk of
-		// increasing the size of the block by one byte, but it seems like this is an
-		// extreme edge case that goes away as soon as the function is called again.
-		totalFeeNanos += feeNanos
-	}
-
-	// Now that the total fees have been computed, set the value of the block reward
-	// output.
-	blockRewardOutput.AmountNanos = CalcBlockRewardNanos(uint32(blockRet.Header.Height)) + totalFeeNanos
-
-	// Compute the merkle root for the block now that all of the transactions have
-	// been added.
-	merkleRoot, _, err := ComputeMerkleRoot(blockRet.Txns)
-	if err != nil {
-		return nil, nil, nil, errors.Wrapf(err, "BitCloutBlockProducer._getBlockTemplate: Problem computing merkle root: ")
-	}
-	blockRet.Header.TransactionMerkleRoot = merkleRoot
-
-	// Compute the next difficulty target given the current tip.
-	diffTarget, err := CalcNextDifficultyTarget(
-		lastNode, CurrentHeaderVersion, bitcloutBlockProducer.params)
-	if err != nil {
-		return nil, nil, nil, errors.Wrapf(err, "BitCloutBlockProducer._getBlockTemplate: Problem computing next difficulty: ")
 	}
+	// Compute the time since this txn started holding up the mempool.
+	bitcloutBlockProducer.latestBlockTemplateStats.FailingTxnMinutesSinceAdded =
+		time.Since(failingTxnOriginalTimeAdded).Minutes()
+}
 
-	glog.Infof("Produced block with %v txns with approx %v total txns in mempool",
-		len(blockRet.Txns), len(bitcloutBlockProducer.mempool.readOnlyUniversalTransactionList))
-	return blockRet, diffTarget, lastNode, nil
+// GetBlockTemplateProducer returns the producer that builds this block producer's
+// templates so external miners can get templates of their own.
+func (bitcloutBlockProducer *BitCloutBlockProducer) GetBlockTemplateProducer() *BlockTemplateProducer {
+	return bitcloutBlockProducer.templateProducer
 }
 
 func (bitcloutBlockProducer *BitCloutBlockProducer) Stop() {
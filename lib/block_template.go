@@ -0,0 +1,360 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// The BlockTemplateProducer builds the block a miner should work on next out of
+// the txns in the mempool. It picks txns by fee rate, highest first, and pulls
+// in the txns each one depends on ahead of it until the block is full. A txn
+// depends on the mempool txns whose outputs it spends and on the txn its
+// transactor added to the mempool right before it, since a txn can rely on
+// state that an earlier txn from the same public key created without spending
+// any of its outputs.
+//
+// Fee rate ties are broken by when the txns were added and then by hash, so the
+// same mempool, tip, and timestamp always produce the same block.
+
+// BlockTemplateMaxSelectionPasses is the most times the txns that failed to
+// connect are tried again, in case a txn picked later in the same pass was
+// what they were waiting on.
+const BlockTemplateMaxSelectionPasses = 3
+
+// BlockTemplateFailedTxn is a txn that was picked for a block template but
+// couldn't be connected.
+type BlockTemplateFailedTxn struct {
+	MempoolTx *MempoolTx
+	Err       error
+}
+
+type BlockTemplate struct {
+	// The block with its reward and merkle root filled in. Only its nonce and
+	// the reward's ExtraData are left for a miner to set.
+	Block *MsgBitCloutBlock
+	// The difficulty the block's hash has to beat.
+	DiffTarget *BlockHash
+	// The tip the block builds on.
+	TipNode *BlockNode
+	// The fees of the block's txns, which are included in the block reward.
+	TotalFeeNanos uint64
+	// The txns that were picked but couldn't be connected, in the order they
+	// were tried. The txns that depend on them are left out of the block too.
+	FailedTxns []*BlockTemplateFailedTxn
+}
+
+type BlockTemplateProducer struct {
+	mempool        *BitCloutMempool
+	chain          *Blockchain
+	bitcoinManager *BitcoinManager
+	params         *BitCloutParams
+}
+
+func NewBlockTemplateProducer(mempool *BitCloutMempool, chain *Blockchain,
+	bitcoinManager *BitcoinManager, params *BitCloutParams) *BlockTemplateProducer {
+
+	return &BlockTemplateProducer{
+		mempool:        mempool,
+		chain:          chain,
+		bitcoinManager: bitcoinManager,
+		params:         params,
+	}
+}
+
+// ProduceBlockTemplate builds a block on the current tip that pays its reward
+// to publicKey. The block's timestamp is tstampSecs unless that isn't after the
+// tip's, in which case it's one second after the tip's.
+func (btp *BlockTemplateProducer) ProduceBlockTemplate(publicKey []byte, tstampSecs uint64) (
+	*BlockTemplate, error) {
+
+	// Get the current tip of the best block chain. Note that using the tip of the
+	// best block chain as opposed to the best header chain means we'll be mining
+	// stale blocks until we're fully synced.
+	tipNode := btp.chain.blockTip()
+
+	// Compute the public key to contribute the reward to.
+	rewardPk, err := btcec.ParsePubKey(publicKey, btcec.S256())
+	if err != nil {
+		return nil, errors.Wrapf(err, "ProduceBlockTemplate: ")
+	}
+
+	// Set the block reward output initially to the maximum value for a uint64.
+	// This ensures it will take the maximum amount of space in the block when
+	// encoded as a varint so our size estimates won't get messed up.
+	blockRewardOutput := &BitCloutOutput{
+		PublicKey:   rewardPk.SerializeCompressed(),
+		AmountNanos: math.MaxUint64,
+	}
+	// Block reward txn only needs a single output. No need to specify spending
+	// pk or sigs. Set the ExtraData to zero. This gives miners something they
+	// can twiddle if they run out of space on their actual nonce.
+	blockRewardTxn := NewMessage(MsgTypeTxn).(*MsgBitCloutTxn)
+	blockRewardTxn.TxOutputs = append(blockRewardTxn.TxOutputs, blockRewardOutput)
+	blockRewardTxn.TxnMeta = &BlockRewardMetadataa{
+		ExtraData: UintToBuf(0),
+	}
+
+	block := NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
+	block.Txns = append(block.Txns, blockRewardTxn)
+	block.Header.Version = CurrentHeaderVersion
+	block.Header.Height = uint64(tipNode.Height + 1)
+	block.Header.PrevBlockHash = tipNode.Hash
+	// Consensus requires the timestamps to increase monotonically.
+	if tstampSecs <= uint64(tipNode.Header.TstampSecs) {
+		tstampSecs = uint64(tipNode.Header.TstampSecs) + 1
+	}
+	block.Header.TstampSecs = tstampSecs
+	block.Header.Nonce = 0
+
+	blockTemplate := &BlockTemplate{
+		Block:   block,
+		TipNode: tipNode,
+	}
+
+	// Only add transactions to the block if our chain is done syncing.
+	if btp.chain.chainState() != SyncStateSyncingHeaders &&
+		btp.chain.chainState() != SyncStateNeedBlocksss {
+
+		// Since the number of transactions encoded in the block can become larger
+		// as we add transactions to it, add the maximum size for this field to the
+		// current size to ensure we don't overfill the block.
+		blockBytes, err := block.ToBytes(false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ProduceBlockTemplate: Problem serializing block: ")
+		}
+		blockSizeBytes := uint64(len(blockBytes) + MaxVarintLen64)
+
+		mempoolTxns, _, err := btp.mempool.GetTransactionsOrderedByTimeAdded()
+		if err != nil {
+			return nil, errors.Wrapf(err, "ProduceBlockTemplate: Problem getting mempool transactions: ")
+		}
+		selectedTxns, totalFeeNanos, failedTxns, err := btp._selectTxns(
+			mempoolTxns, uint32(block.Header.Height), btp.params.MinerMaxBlockSizeBytes-blockSizeBytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ProduceBlockTemplate: ")
+		}
+		for _, mempoolTx := range selectedTxns {
+			block.Txns = append(block.Txns, mempoolTx.Tx)
+		}
+		blockTemplate.TotalFeeNanos = totalFeeNanos
+		blockTemplate.FailedTxns = failedTxns
+
+		// Double-check that the final block size is below the limit.
+		blockBytes, err = block.ToBytes(false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ProduceBlockTemplate: Problem serializing block after txns added: ")
+		}
+		if uint64(len(blockBytes)) > btp.params.MinerMaxBlockSizeBytes {
+			return nil, fmt.Errorf("ProduceBlockTemplate: Block created with size "+
+				"(%d) exceeds MinerMaxBlockSizeBytes (%d): ", len(blockBytes), btp.params.MinerMaxBlockSizeBytes)
+		}
+	}
+
+	// Now that the total fees have been computed, set the value of the block reward
+	// output.
+	blockRewardOutput.AmountNanos = CalcBlockRewardNanos(uint32(block.Header.Height)) + blockTemplate.TotalFeeNanos
+
+	merkleRoot, _, err := ComputeMerkleRoot(block.Txns)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ProduceBlockTemplate: Problem computing merkle root: ")
+	}
+	block.Header.TransactionMerkleRoot = merkleRoot
+
+	blockTemplate.DiffTarget, err = CalcNextDifficultyTarget(tipNode, CurrentHeaderVersion, btp.params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ProduceBlockTemplate: Problem computing next difficulty: ")
+	}
+
+	return blockTemplate, nil
+}
+
+// _blockTemplateTxnLess orders txns by fee rate, highest first, then by when
+// they were added and then by hash.
+func _blockTemplateTxnLess(mempoolTx *MempoolTx, other *MempoolTx) bool {
+	if mempoolTx.FeePerKB != other.FeePerKB {
+		return mempoolTx.FeePerKB > other.FeePerKB
+	}
+	if !mempoolTx.Added.Equal(other.Added) {
+		return mempoolTx.Added.Before(other.Added)
+	}
+	return bytes.Compare(mempoolTx.Hash[:], other.Hash[:]) < 0
+}
+
+// _selectTxns picks the txns for a block at blockHeight that fit in
+// maxSizeBytes and returns them in the order they have to be connected along
+// with their total fees and the txns that couldn't be connected.
+func (btp *BlockTemplateProducer) _selectTxns(
+	mempoolTxns []*MempoolTx, blockHeight uint32, maxSizeBytes uint64) (
+	_selectedTxns []*MempoolTx, _totalFeeNanos uint64, _failedTxns []*BlockTemplateFailedTxn, _err error) {
+
+	// Find the txns each txn depends on, going through the txns in the order
+	// they were added so a transactor's previous txn is the one seen last.
+	addedOrder := append([]*MempoolTx{}, mempoolTxns...)
+	sort.SliceStable(addedOrder, func(ii, jj int) bool {
+		if !addedOrder[ii].Added.Equal(addedOrder[jj].Added) {
+			return addedOrder[ii].Added.Before(addedOrder[jj].Added)
+		}
+		return bytes.Compare(addedOrder[ii].Hash[:], addedOrder[jj].Hash[:]) < 0
+	})
+	poolTxns := make(map[BlockHash]*MempoolTx)
+	for _, mempoolTx := range addedOrder {
+		poolTxns[*mempoolTx.Hash] = mempoolTx
+	}
+	parents := make(map[BlockHash][]*MempoolTx)
+	lastTxnForPublicKey := make(map[PkMapKey]*MempoolTx)
+	for _, mempoolTx := range addedOrder {
+		txParents := []*MempoolTx{}
+		isParent := make(map[BlockHash]bool)
+		addParent := func(parent *MempoolTx) {
+			if !isParent[*parent.Hash] {
+				isParent[*parent.Hash] = true
+				txParents = append(txParents, parent)
+			}
+		}
+		for _, txIn := range mempoolTx.Tx.TxInputs {
+			if parent, exists := poolTxns[txIn.TxID]; exists {
+				addParent(parent)
+			}
+		}
+		if len(mempoolTx.Tx.PublicKey) != 0 {
+			publicKey := MakePkMapKey(mempoolTx.Tx.PublicKey)
+			if parent, exists := lastTxnForPublicKey[publicKey]; exists {
+				addParent(parent)
+			}
+			lastTxnForPublicKey[publicKey] = mempoolTx
+		}
+		parents[*mempoolTx.Hash] = txParents
+	}
+
+	utxoView, err := NewUtxoView(btp.chain.db, btp.params, btp.bitcoinManager)
+	if err != nil {
+		return nil, 0, nil, errors.Wrapf(err, "_selectTxns: Problem generating UtxoView: ")
+	}
+
+	selectedTxns := []*MempoolTx{}
+	var failedTxns []*BlockTemplateFailedTxn
+	totalFeeNanos := uint64(0)
+	sizeBytes := uint64(0)
+	// Txns are included once they're in the block and skipped for the rest of a
+	// pass once they or a txn they depend on can't be connected.
+	included := make(map[BlockHash]bool)
+	var skipped map[BlockHash]bool
+
+	// _packageFor returns the txns that have to be added for mempoolTx to be
+	// added, parents first, or false if one of them was skipped.
+	var _packageFor func(mempoolTx *MempoolTx, visited map[BlockHash]bool, txnPackage []*MempoolTx) (
+		[]*MempoolTx, bool)
+	_packageFor = func(mempoolTx *MempoolTx, visited map[BlockHash]bool, txnPackage []*MempoolTx) (
+		[]*MempoolTx, bool) {
+
+		if skipped[*mempoolTx.Hash] {
+			return nil, false
+		}
+		if included[*mempoolTx.Hash] || visited[*mempoolTx.Hash] {
+			return txnPackage, true
+		}
+		visited[*mempoolTx.Hash] = true
+		for _, parent := range parents[*mempoolTx.Hash] {
+			var ok bool
+			if txnPackage, ok = _packageFor(parent, visited, txnPackage); !ok {
+				return nil, false
+			}
+		}
+		return append(txnPackage, mempoolTx), true
+	}
+
+	feeRateOrder := append([]*MempoolTx{}, addedOrder...)
+	sort.Slice(feeRateOrder, func(ii, jj int) bool {
+		return _blockTemplateTxnLess(feeRateOrder[ii], feeRateOrder[jj])
+	})
+	// A txn can depend on a txn from another public key without spending its
+	// outputs, like a creator coin buy on the profile whose coin it buys, so the
+	// txns that fail are tried again as long as each pass adds more txns, up to
+	// a few passes.
+	for pass := 0; pass < BlockTemplateMaxSelectionPasses; pass++ {
+		numIncludedBefore := len(included)
+		skipped = make(map[BlockHash]bool)
+		failedTxns = []*BlockTemplateFailedTxn{}
+		for _, mempoolTx := range feeRateOrder {
+			if included[*mempoolTx.Hash] || skipped[*mempoolTx.Hash] {
+				continue
+			}
+			txnPackage, ok := _packageFor(mempoolTx, make(map[BlockHash]bool), nil)
+			if !ok {
+				skipped[*mempoolTx.Hash] = true
+				continue
+			}
+			packageSizeBytes := uint64(0)
+			for _, packageTx := range txnPackage {
+				packageSizeBytes += packageTx.TxSizeBytes + MaxVarintLen64
+			}
+			// A smaller package could still fit so keep going.
+			if sizeBytes+packageSizeBytes > maxSizeBytes {
+				continue
+			}
+
+			// Try to apply the package to a copy of the view with the strictest
+			// possible checks so a package that fails partway through doesn't
+			// leave anything behind in the view.
+			packageView, err := utxoView.CopyUtxoView()
+			if err != nil {
+				return nil, 0, nil, errors.Wrapf(err, "_selectTxns: Problem copying UtxoView: ")
+			}
+			packageFeeNanos := uint64(0)
+			var failedTxn *BlockTemplateFailedTxn
+			for _, packageTx := range txnPackage {
+				_, _, _, feeNanos, err := packageView._connectTransaction(
+					packageTx.Tx, packageTx.Hash, int64(packageTx.TxSizeBytes), blockHeight, true, /*verifySignatures*/
+					true, /*checkMerkleProof*/
+					btp.params.MinerBitcoinMinBurnWorkBlockss,
+					false /*ignoreUtxos*/)
+				if err != nil {
+					failedTxn = &BlockTemplateFailedTxn{MempoolTx: packageTx, Err: err}
+					break
+				}
+				packageFeeNanos += feeNanos
+			}
+			if failedTxn != nil {
+				btp._logFailedTxn(failedTxn)
+				failedTxns = append(failedTxns, failedTxn)
+				skipped[*failedTxn.MempoolTx.Hash] = true
+				skipped[*mempoolTx.Hash] = true
+				continue
+			}
+
+			utxoView = packageView
+			for _, packageTx := range txnPackage {
+				included[*packageTx.Hash] = true
+			}
+			selectedTxns = append(selectedTxns, txnPackage...)
+			sizeBytes += packageSizeBytes
+			totalFeeNanos += packageFeeNanos
+		}
+		if len(failedTxns) == 0 || len(included) == numIncludedBefore {
+			break
+		}
+	}
+
+	return selectedTxns, totalFeeNanos, failedTxns, nil
+}
+
+func (btp *BlockTemplateProducer) _logFailedTxn(failedTxn *BlockTemplateFailedTxn) {
+	glog.Infof("BlockTemplateProducer: Leaving txn %v out of the block because it's not ready yet: %v",
+		failedTxn.MempoolTx.Hash, failedTxn.Err)
+	if failedTxn.MempoolTx.Tx.TxnMeta.GetTxnType() == TxnTypeBitcoinExchange {
+		// Print the Bitcoin block hash when this happens.
+		glog.Infof("A bad BitcoinExchange transaction may be holding up block production: %v, "+
+			"Current header tip: %v",
+			failedTxn.MempoolTx.Tx.TxnMeta.(*BitcoinExchangeMetadata).BitcoinTransaction.TxHash(),
+			btp.bitcoinManager.HeaderTip().Hash)
+		scs := spew.ConfigState{DisableMethods: true, Indent: "  "}
+		glog.Debugf("Spewing Bitcoin txn: %v", scs.Sdump(failedTxn.MempoolTx.Tx))
+	}
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockTemplateProducer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	processTxn := func(amountNanos uint64, feeRateNanosPerKB uint64, fromPk string, toPk string, fromPriv string) *MempoolTx {
+		txn := _assembleBasicTransferTxnFullySigned(t, chain, amountNanos, feeRateNanosPerKB,
+			fromPk, toPk, fromPriv, mempool)
+		_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+		require.NoError(err)
+		return mempool.poolMap[*txn.Hash()]
+	}
+	// Give the recipient something to spend so it can send txns of its own.
+	processTxn(1000000, 0, senderPkString, recipientPkString, senderPrivString)
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+
+	senderLowFeeTxn := processTxn(10, 100, senderPkString, recipientPkString, senderPrivString)
+	// The recipient pays itself so none of the sender's txns depend on its txn.
+	recipientTxn := processTxn(10, 1000, recipientPkString, recipientPkString, recipientPrivString)
+	senderHighFeeTxn := processTxn(10, 5000, senderPkString, recipientPkString, senderPrivString)
+	require.NoError(mempool.regenerateReadOnlyView())
+
+	senderPkBytes, _, err := Base58CheckDecode(senderPkString)
+	require.NoError(err)
+	templateProducer := NewBlockTemplateProducer(mempool, chain, nil /*bitcoinManager*/, params)
+	blockTemplate, err := templateProducer.ProduceBlockTemplate(senderPkBytes, 0 /*tstampSecs*/)
+	require.NoError(err)
+
+	// The high fee txn goes first but its parent has to come before it.
+	block := blockTemplate.Block
+	require.Equal(4, len(block.Txns))
+	assert.Equal(senderLowFeeTxn.Hash, block.Txns[1].Hash())
+	assert.Equal(senderHighFeeTxn.Hash, block.Txns[2].Hash())
+	assert.Equal(recipientTxn.Hash, block.Txns[3].Hash())
+	assert.Equal(0, len(blockTemplate.FailedTxns))
+	totalFeeNanos := senderLowFeeTxn.Fee + senderHighFeeTxn.Fee + recipientTxn.Fee
+	assert.Equal(totalFeeNanos, blockTemplate.TotalFeeNanos)
+	assert.Equal(CalcBlockRewardNanos(uint32(block.Header.Height))+totalFeeNanos,
+		block.Txns[0].TxOutputs[0].AmountNanos)
+	assert.Equal(chain.blockTip().Hash, block.Header.PrevBlockHash)
+	assert.Equal(uint64(chain.blockTip().Header.TstampSecs)+1, block.Header.TstampSecs)
+
+	// The same mempool and timestamp always produce the same block.
+	otherBlockTemplate, err := templateProducer.ProduceBlockTemplate(senderPkBytes, 0 /*tstampSecs*/)
+	require.NoError(err)
+	blockBytes, err := block.ToBytes(false)
+	require.NoError(err)
+	otherBlockBytes, err := otherBlockTemplate.Block.ToBytes(false)
+	require.NoError(err)
+	assert.Equal(blockBytes, otherBlockBytes)
+
+	// When the sender's txns don't fit together, the smaller txn that does fit
+	// still goes in.
+	mempoolTxns, _, err := mempool.GetTransactionsOrderedByTimeAdded()
+	require.NoError(err)
+	selectedTxns, feeNanos, failedTxns, err := templateProducer._selectTxns(
+		mempoolTxns, uint32(block.Header.Height), recipientTxn.TxSizeBytes+MaxVarintLen64)
+	require.NoError(err)
+	assert.Equal([]*MempoolTx{recipientTxn}, selectedTxns)
+	assert.Equal(recipientTxn.Fee, feeNanos)
+	assert.Equal(0, len(failedTxns))
+
+	// When a package fails partway through, the txns in it that did connect
+	// don't stay in the view, so they can still go in on their own.
+	badTxn := *senderHighFeeTxn.Tx
+	badTxn.Signature = senderLowFeeTxn.Tx.Signature
+	badMempoolTx := *senderHighFeeTxn
+	badMempoolTx.Tx = &badTxn
+	selectedTxns, feeNanos, failedTxns, err = templateProducer._selectTxns(
+		[]*MempoolTx{senderLowFeeTxn, recipientTxn, &badMempoolTx}, uint32(block.Header.Height),
+		params.MinerMaxBlockSizeBytes)
+	require.NoError(err)
+	assert.Equal([]*MempoolTx{recipientTxn, senderLowFeeTxn}, selectedTxns)
+	assert.Equal(recipientTxn.Fee+senderLowFeeTxn.Fee, feeNanos)
+	require.Equal(1, len(failedTxns))
+	assert.Equal(&badMempoolTx, failedTxns[0].MempoolTx)
+}
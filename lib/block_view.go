@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -166,6 +167,44 @@ type MessageEntry struct {
 	isDeleted bool
 }
 
+// The longest name a messaging group can have.
+const MaxMessagingGroupKeyNameLength = 32
+
+// MessagingGroupMember is a member of a messaging group along with the group's
+// private key encrypted to the member's public key.
+type MessagingGroupMember struct {
+	MemberPublicKey []byte
+	EncryptedKey    []byte
+}
+
+// MessagingGroupEntry describes an encrypted group chat. A group is identified
+// by its owner and a name that is unique among the owner's groups. Messages to
+// the group are encrypted to MessagingPublicKey, and each member can decrypt
+// them using the group's private key from their MessagingGroupMember.
+type MessagingGroupEntry struct {
+	GroupOwnerPublicKey   []byte
+	MessagingGroupKeyName []byte
+	MessagingPublicKey    []byte
+	MessagingGroupMembers []*MessagingGroupMember
+}
+
+// GroupID returns a fixed-size id for the group derived from its owner and name.
+func (group *MessagingGroupEntry) GroupID() *BlockHash {
+	return MessagingGroupID(group.GroupOwnerPublicKey, group.MessagingGroupKeyName)
+}
+
+func MessagingGroupID(groupOwnerPublicKey []byte, groupKeyName []byte) *BlockHash {
+	return Sha256DoubleHash(append(append([]byte{}, groupOwnerPublicKey...), groupKeyName...))
+}
+
+// GroupMessageEntry is a message sent to a messaging group.
+type GroupMessageEntry struct {
+	GroupID         *BlockHash
+	SenderPublicKey []byte
+	EncryptedText   []byte
+	TstampNanos     uint64
+}
+
 // Entry for a public key forbidden from signing blocks.
 type ForbiddenPubKeyEntry struct {
 	PubKey []byte
@@ -174,6 +213,20 @@ type ForbiddenPubKeyEntry struct {
 	isDeleted bool
 }
 
+// Entry for a username that was recently given up by the profile that owned it.
+// While the entry is within Params.UsernameReleaseProtectionWindowBlocks of
+// ReleasedAtHeight, only the PKID that released the username can claim it again.
+// This stops someone from grabbing a username the moment its owner renames.
+type ReleasedUsernameEntry struct {
+	// Always stored lowercase.
+	Username         []byte
+	ReleasedByPKID   *PKID
+	ReleasedAtHeight uint32
+
+	// Whether or not this entry is deleted in the view.
+	isDeleted bool
+}
+
 func MakeLikeKey(userPk []byte, LikedPostHash BlockHash) LikeKey {
 	return LikeKey{
 		LikerPubKey:   MakePkMapKey(userPk),
@@ -195,6 +248,72 @@ type LikeEntry struct {
 	isDeleted bool
 }
 
+// PollEntry stores a poll attached to a post and the votes it has received.
+type PollEntry struct {
+	PostHash    *BlockHash
+	CreatorPKID *PKID
+	Options     [][]byte
+
+	// VoteCounts[ii] is the number of votes for Options[ii].
+	VoteCounts []uint64
+
+	// Whether or not this entry is deleted in the view.
+	isDeleted bool
+}
+
+func MakePollVoteKey(voterPKID *PKID, postHash BlockHash) PollVoteKey {
+	return PollVoteKey{
+		VoterPKID: *voterPKID,
+		PostHash:  postHash,
+	}
+}
+
+type PollVoteKey struct {
+	VoterPKID PKID
+	PostHash  BlockHash
+}
+
+// PollVoteEntry stores the option a user voted for in a poll.
+type PollVoteEntry struct {
+	VoterPKID   *PKID
+	PostHash    *BlockHash
+	OptionIndex uint64
+
+	// Whether or not this entry is deleted in the view.
+	isDeleted bool
+}
+
+func MakeDerivedKeyMapKey(ownerPKID *PKID, derivedPublicKey []byte) DerivedKeyMapKey {
+	return DerivedKeyMapKey{
+		OwnerPKID:        *ownerPKID,
+		DerivedPublicKey: MakePkMapKey(derivedPublicKey),
+	}
+}
+
+type DerivedKeyMapKey struct {
+	OwnerPKID        PKID
+	DerivedPublicKey PkMapKey
+}
+
+// DerivedKeyEntry stores a key that an owner has authorized to sign
+// transactions on their behalf.
+type DerivedKeyEntry struct {
+	OwnerPKID        *PKID
+	DerivedPublicKey []byte
+
+	// The derived key can sign transactions in blocks below this height.
+	ExpirationBlock uint64
+
+	// Whether the key is currently authorized or has been revoked.
+	OperationType AuthorizeDerivedKeyOperationType
+
+	// What the derived key has left to spend, or nil if it isn't limited.
+	TransactionSpendingLimit *TransactionSpendingLimit
+
+	// Whether or not this entry is deleted in the view.
+	isDeleted bool
+}
+
 func MakeFollowKey(followerPKID *PKID, followedPKID *PKID) FollowKey {
 	return FollowKey{
 		FollowerPKID: *followerPKID,
@@ -599,6 +718,24 @@ type BalanceEntry struct {
 	isDeleted bool
 }
 
+type BalanceSnapshotKey struct {
+	PublicKey   PkMapKey
+	BlockHeight uint32
+}
+
+// BalanceSnapshotEntry is a public key's balance as of the block at a given
+// height. In the database, we store it as the value in a mapping that looks as
+// follows:
+// <PublicKey, BlockHeight> -> BalanceNanos
+type BalanceSnapshotEntry struct {
+	PublicKey    []byte
+	BlockHeight  uint32
+	BalanceNanos uint64
+
+	// Whether or not this entry is deleted in the view.
+	isDeleted bool
+}
+
 // This struct contains all the information required to support coin
 // buy/sell transactions on profiles.
 type CoinEntry struct {
@@ -632,6 +769,10 @@ type CoinEntry struct {
 	// beyond the watermark, we allocate a percentage of the coins being
 	// minted to the creator as a "founder reward."
 	CoinWatermarkNanos uint64
+
+	// Who the coin can be transferred between. Set by the creator with an
+	// UpdateTransferRestriction transaction.
+	TransferRestrictionStatus TransferRestrictionStatus
 }
 
 type PKIDEntry struct {
@@ -738,6 +879,13 @@ type UtxoView struct {
 	// Reclout data
 	RecloutKeyToRecloutEntry map[RecloutKey]*RecloutEntry
 
+	// Poll data
+	PostHashToPollEntry        map[BlockHash]*PollEntry
+	PollVoteKeyToPollVoteEntry map[PollVoteKey]*PollVoteEntry
+
+	// Derived key data
+	DerivedKeyMapKeyToDerivedKeyEntry map[DerivedKeyMapKey]*DerivedKeyEntry
+
 	// Post data
 	PostHashToPostEntry map[BlockHash]*PostEntry
 
@@ -748,16 +896,50 @@ type UtxoView struct {
 	ProfilePKIDToProfileEntry     map[PKID]*ProfileEntry
 	ProfileUsernameToProfileEntry map[UsernameMapKey]*ProfileEntry
 
+	// Recently-released usernames
+	ReleasedUsernameToReleasedUsernameEntry map[UsernameMapKey]*ReleasedUsernameEntry
+
+	// The posts and profiles whose images were set by a txn connected in the
+	// view. These are the only ones that have to be checked against the content
+	// hash index when the view is flushed.
+	ContentHashPostHashes   map[BlockHash]bool
+	ContentHashProfilePKIDs map[PKID]bool
+
 	// Coin balance entries
 	HODLerPKIDCreatorPKIDToBalanceEntry map[BalanceEntryMapKey]*BalanceEntry
 
+	// Balance snapshots for the blocks connected and disconnected in the view.
+	// Only filled in when the node is keeping them. See DbGetBalanceAtHeight.
+	BalanceSnapshotKeyToBalanceSnapshotEntry map[BalanceSnapshotKey]*BalanceSnapshotEntry
+	// Set when a block at or below the height the balance snapshots were seeded
+	// at is disconnected, which means they have to be seeded again.
+	invalidateBalanceSnapshots bool
+
+	// The lowest height of a block disconnected in the view, or zero if none
+	// were. The state commitments from there up are deleted on flush since they
+	// were for blocks that are no longer on the main chain.
+	stateCommitmentsStaleFromHeight uint32
+
 	// The hash of the tip the view is currently referencing. Mainly used
 	// for error-checking when doing a bulk operation on the view.
 	TipHash *BlockHash
 
+	// The latest post or message timestamp the flush in progress can put in the
+	// time-ordered indexes. It's set from the tip's timestamp at the start of
+	// every flush. See DbGetMaxIndexedTstampNanosWithTxn.
+	flushMaxIndexedTstampNanos uint64
+
+	// The activation heights of the forks the view has looked up. See
+	// _getForkActivationHeight.
+	forkActivationHeights map[string]uint32
+
 	BitcoinManager *BitcoinManager
 	Handle         *badger.DB
 	Params         *BitCloutParams
+	// Store is where the view looks up posts, profiles, follows, and balances it
+	// doesn't have yet. It's a BadgerChainStore on Handle since the view has to
+	// see exactly what it flushed.
+	Store ChainStore
 }
 
 type OperationType uint
@@ -781,8 +963,12 @@ const (
 	OperationTypeSwapIdentity                 OperationType = 12
 	OperationTypeUpdateGlobalParams           OperationType = 13
 	OperationTypeCreatorCoinTransfer          OperationType = 14
+	OperationTypePoll                         OperationType = 15
+	OperationTypeAuthorizeDerivedKey          OperationType = 16
+	OperationTypeSpendDerivedKeyLimit         OperationType = 17
+	OperationTypeUpdateTransferRestriction    OperationType = 18
 
-	// NEXT_TAG = 15
+	// NEXT_TAG = 19
 )
 
 func (op OperationType) String() string {
@@ -827,6 +1013,22 @@ func (op OperationType) String() string {
 		{
 			return "OperationTypeCreatorCoin"
 		}
+	case OperationTypePoll:
+		{
+			return "OperationTypePoll"
+		}
+	case OperationTypeAuthorizeDerivedKey:
+		{
+			return "OperationTypeAuthorizeDerivedKey"
+		}
+	case OperationTypeSpendDerivedKeyLimit:
+		{
+			return "OperationTypeSpendDerivedKeyLimit"
+		}
+	case OperationTypeUpdateTransferRestriction:
+		{
+			return "OperationTypeUpdateTransferRestriction"
+		}
 	}
 	return "OperationTypeUNKNOWN"
 }
@@ -875,6 +1077,9 @@ type UtxoOperation struct {
 
 	// Save the previous profile entry when making an update.
 	PrevProfileEntry *ProfileEntry
+	// Save the previous released username entry for the username a profile
+	// update gave up, if any.
+	PrevReleasedUsernameEntry *ReleasedUsernameEntry
 
 	// Save the previous like entry and like count when making an update.
 	PrevLikeEntry *LikeEntry
@@ -887,6 +1092,15 @@ type UtxoOperation struct {
 	PrevRecloutEntry *RecloutEntry
 	PrevRecloutCount uint64
 
+	// Save the previous poll entry and the voter's previous vote when creating
+	// or voting in a poll.
+	PrevPollEntry     *PollEntry
+	PrevPollVoteEntry *PollVoteEntry
+
+	// Save the owner's previous entry for a derived key when authorizing or
+	// revoking it, or when a txn it signs uses up part of its spending limit.
+	PrevDerivedKeyEntry *DerivedKeyEntry
+
 	// Save the state of a creator coin prior to updating it due to a
 	// buy/sell/add transaction.
 	PrevCoinEntry *CoinEntry
@@ -929,6 +1143,9 @@ func (bav *UtxoView) _ResetViewMappingsAfterFlush() {
 	bav.PKIDToPublicKey = make(map[PKID]*PKIDEntry)
 	bav.ProfilePKIDToProfileEntry = make(map[PKID]*ProfileEntry)
 	bav.ProfileUsernameToProfileEntry = make(map[UsernameMapKey]*ProfileEntry)
+	bav.ReleasedUsernameToReleasedUsernameEntry = make(map[UsernameMapKey]*ReleasedUsernameEntry)
+	bav.ContentHashPostHashes = make(map[BlockHash]bool)
+	bav.ContentHashProfilePKIDs = make(map[PKID]bool)
 
 	// Messages data
 	bav.MessageKeyToMessageEntry = make(map[MessageKey]*MessageEntry)
@@ -945,8 +1162,20 @@ func (bav *UtxoView) _ResetViewMappingsAfterFlush() {
 	// Reclout data
 	bav.RecloutKeyToRecloutEntry = make(map[RecloutKey]*RecloutEntry)
 
+	// Poll data
+	bav.PostHashToPollEntry = make(map[BlockHash]*PollEntry)
+	bav.PollVoteKeyToPollVoteEntry = make(map[PollVoteKey]*PollVoteEntry)
+
+	// Derived key data
+	bav.DerivedKeyMapKeyToDerivedKeyEntry = make(map[DerivedKeyMapKey]*DerivedKeyEntry)
+
 	// Coin balance entries
 	bav.HODLerPKIDCreatorPKIDToBalanceEntry = make(map[BalanceEntryMapKey]*BalanceEntry)
+
+	// Balance snapshots
+	bav.BalanceSnapshotKeyToBalanceSnapshotEntry = make(map[BalanceSnapshotKey]*BalanceSnapshotEntry)
+	bav.invalidateBalanceSnapshots = false
+	bav.stateCommitmentsStaleFromHeight = 0
 }
 
 func (bav *UtxoView) CopyUtxoView() (*UtxoView, error) {
@@ -954,6 +1183,7 @@ func (bav *UtxoView) CopyUtxoView() (*UtxoView, error) {
 	if err != nil {
 		return nil, err
 	}
+	newView.Store = bav.Store
 
 	// Copy the UtxoEntry data
 	// Note that using _setUtxoMappings is dangerous because the Pos within
@@ -1008,6 +1238,20 @@ func (bav *UtxoView) CopyUtxoView() (*UtxoView, error) {
 		newProfileEntry := *profileEntry
 		newView.ProfileUsernameToProfileEntry[profilePKID] = &newProfileEntry
 	}
+	newView.ReleasedUsernameToReleasedUsernameEntry = make(
+		map[UsernameMapKey]*ReleasedUsernameEntry, len(bav.ReleasedUsernameToReleasedUsernameEntry))
+	for usernameMapKey, releasedUsernameEntry := range bav.ReleasedUsernameToReleasedUsernameEntry {
+		newReleasedUsernameEntry := *releasedUsernameEntry
+		newView.ReleasedUsernameToReleasedUsernameEntry[usernameMapKey] = &newReleasedUsernameEntry
+	}
+	newView.ContentHashPostHashes = make(map[BlockHash]bool, len(bav.ContentHashPostHashes))
+	for postHash := range bav.ContentHashPostHashes {
+		newView.ContentHashPostHashes[postHash] = true
+	}
+	newView.ContentHashProfilePKIDs = make(map[PKID]bool, len(bav.ContentHashProfilePKIDs))
+	for profilePKID := range bav.ContentHashProfilePKIDs {
+		newView.ContentHashProfilePKIDs[profilePKID] = true
+	}
 
 	// Copy the message data
 	newView.MessageKeyToMessageEntry = make(map[MessageKey]*MessageEntry, len(bav.MessageKeyToMessageEntry))
@@ -1037,6 +1281,30 @@ func (bav *UtxoView) CopyUtxoView() (*UtxoView, error) {
 		newView.RecloutKeyToRecloutEntry[recloutKey] = &newRecloutEntry
 	}
 
+	// Copy the poll data. The vote counts are copied too since connecting a
+	// vote modifies them.
+	newView.PostHashToPollEntry = make(map[BlockHash]*PollEntry, len(bav.PostHashToPollEntry))
+	for postHash, pollEntry := range bav.PostHashToPollEntry {
+		newPollEntry := *pollEntry
+		newPollEntry.VoteCounts = append([]uint64{}, pollEntry.VoteCounts...)
+		newView.PostHashToPollEntry[postHash] = &newPollEntry
+	}
+	newView.PollVoteKeyToPollVoteEntry = make(
+		map[PollVoteKey]*PollVoteEntry, len(bav.PollVoteKeyToPollVoteEntry))
+	for pollVoteKey, pollVoteEntry := range bav.PollVoteKeyToPollVoteEntry {
+		newPollVoteEntry := *pollVoteEntry
+		newView.PollVoteKeyToPollVoteEntry[pollVoteKey] = &newPollVoteEntry
+	}
+
+	// Copy the derived key data
+	newView.DerivedKeyMapKeyToDerivedKeyEntry = make(
+		map[DerivedKeyMapKey]*DerivedKeyEntry, len(bav.DerivedKeyMapKeyToDerivedKeyEntry))
+	for derivedKeyMapKey, derivedKeyEntry := range bav.DerivedKeyMapKeyToDerivedKeyEntry {
+		newDerivedKeyEntry := *derivedKeyEntry
+		newDerivedKeyEntry.TransactionSpendingLimit = derivedKeyEntry.TransactionSpendingLimit.Copy()
+		newView.DerivedKeyMapKeyToDerivedKeyEntry[derivedKeyMapKey] = &newDerivedKeyEntry
+	}
+
 	// Copy the balance entry data
 	newView.HODLerPKIDCreatorPKIDToBalanceEntry = make(
 		map[BalanceEntryMapKey]*BalanceEntry, len(bav.HODLerPKIDCreatorPKIDToBalanceEntry))
@@ -1045,6 +1313,21 @@ func (bav *UtxoView) CopyUtxoView() (*UtxoView, error) {
 		newView.HODLerPKIDCreatorPKIDToBalanceEntry[balanceEntryMapKey] = &newBalanceEntry
 	}
 
+	// Copy the balance snapshots
+	newView.BalanceSnapshotKeyToBalanceSnapshotEntry = make(
+		map[BalanceSnapshotKey]*BalanceSnapshotEntry, len(bav.BalanceSnapshotKeyToBalanceSnapshotEntry))
+	for snapshotKey, snapshotEntry := range bav.BalanceSnapshotKeyToBalanceSnapshotEntry {
+		newSnapshotEntry := *snapshotEntry
+		newView.BalanceSnapshotKeyToBalanceSnapshotEntry[snapshotKey] = &newSnapshotEntry
+	}
+	newView.invalidateBalanceSnapshots = bav.invalidateBalanceSnapshots
+	newView.stateCommitmentsStaleFromHeight = bav.stateCommitmentsStaleFromHeight
+
+	// Copy the fork activation heights so the new view doesn't look them up again
+	for forkName, activationHeight := range bav.forkActivationHeights {
+		newView.forkActivationHeights[forkName] = activationHeight
+	}
+
 	// Copy the Diamond data
 	newView.DiamondKeyToDiamondEntry = make(
 		map[DiamondKey]*DiamondEntry, len(bav.DiamondKeyToDiamondEntry))
@@ -1063,6 +1346,7 @@ func NewUtxoView(
 		Handle:         _handle,
 		Params:         _params,
 		BitcoinManager: _bitcoinManager,
+		Store:          NewBadgerChainStore(_handle, _params),
 		// Note that the TipHash does not get reset as part of
 		// _ResetViewMappingsAfterFlush because it is not something that is affected by a
 		// flush operation. Moreover, its value is consistent with the view regardless of
@@ -1071,6 +1355,8 @@ func NewUtxoView(
 		// info on that).
 		TipHash: DbGetBestHash(_handle, ChainTypeBitCloutBlock /* don't get the header chain */),
 
+		forkActivationHeights: make(map[string]uint32),
+
 		// Set everything else in _ResetViewMappings()
 	}
 	// This function is generally used to reset the view after a flush has been performed
@@ -1080,6 +1366,34 @@ func NewUtxoView(
 	return &view, nil
 }
 
+// _getForkActivationHeight returns the height at which the fork activates
+// according to the fork registry in the db. A db the forks haven't been written
+// to yet, like a test db that isn't backing a Blockchain, falls back to the
+// params. Activation heights only change at startup so they're cached.
+func (bav *UtxoView) _getForkActivationHeight(forkName string) uint32 {
+	if activationHeight, exists := bav.forkActivationHeights[forkName]; exists {
+		return activationHeight
+	}
+
+	activationHeight, err := DbGetForkActivationHeight(bav.Handle, forkName)
+	if err != nil {
+		activationHeight = math.MaxUint32
+		if protocolFork := bav.Params.GetProtocolFork(forkName); protocolFork != nil {
+			activationHeight = protocolFork.ActivationHeight
+		} else {
+			glog.Errorf("UtxoView._getForkActivationHeight: Treating unknown fork %v as "+
+				"inactive", forkName)
+		}
+	}
+	bav.forkActivationHeights[forkName] = activationHeight
+	return activationHeight
+}
+
+// _isForkActive returns true if the fork applies to a block at blockHeight.
+func (bav *UtxoView) _isForkActive(forkName string, blockHeight uint32) bool {
+	return blockHeight >= bav._getForkActivationHeight(forkName)
+}
+
 func (bav *UtxoView) _deleteUtxoMappings(utxoEntry *UtxoEntry) error {
 	if utxoEntry.UtxoKey == nil {
 		return fmt.Errorf("_deleteUtxoMappings: utxoKey missing for utxoEntry %+v", utxoEntry)
@@ -1290,6 +1604,21 @@ func (bav *UtxoView) _disconnectBasicTransfer(currentTxn *MsgBitCloutTxn, txnHas
 	//
 	// Loop backwards over the utxo operations as we go along.
 	operationIndex := len(utxoOpsForTxn) - 1
+
+	// If the txn used up part of a derived key's spending limit then that was
+	// the last operation, so put the limit back first.
+	if operationIndex >= 0 &&
+		utxoOpsForTxn[operationIndex].Type == OperationTypeSpendDerivedKeyLimit {
+
+		prevDerivedKeyEntry := utxoOpsForTxn[operationIndex].PrevDerivedKeyEntry
+		if prevDerivedKeyEntry == nil {
+			return fmt.Errorf("_disconnectBasicTransfer: PrevDerivedKeyEntry is missing " +
+				"for OperationTypeSpendDerivedKeyLimit; this should never happen")
+		}
+		bav._setDerivedKeyEntryMappings(prevDerivedKeyEntry)
+		operationIndex--
+	}
+
 	for outputIndex := len(currentTxn.TxOutputs) - 1; outputIndex >= 0; outputIndex-- {
 		currentOutput := currentTxn.TxOutputs[outputIndex]
 
@@ -1592,6 +1921,173 @@ func (bav *UtxoView) _disconnectPrivateMessage(
 		currentTxn, txnHash, utxoOpsForTxn[:operationIndex], blockHeight)
 }
 
+func (bav *UtxoView) _disconnectPoll(
+	operationType OperationType, currentTxn *MsgBitCloutTxn, txnHash *BlockHash,
+	utxoOpsForTxn []*UtxoOperation, blockHeight uint32) error {
+
+	// Verify that the last operation is a Poll operation
+	if len(utxoOpsForTxn) == 0 {
+		return fmt.Errorf("_disconnectPoll: utxoOperations are missing")
+	}
+	operationIndex := len(utxoOpsForTxn) - 1
+	if utxoOpsForTxn[operationIndex].Type != OperationTypePoll {
+		return fmt.Errorf("_disconnectPoll: Trying to revert "+
+			"OperationTypePoll but found type %v",
+			utxoOpsForTxn[operationIndex].Type)
+	}
+
+	// Now we know the txMeta is a Poll
+	txMeta := currentTxn.TxnMeta.(*PollMetadata)
+
+	// The poll must exist whether we're reverting its creation or a vote in it.
+	pollEntry := bav.GetPollEntryForPostHash(txMeta.PostHash)
+	if pollEntry == nil || pollEntry.isDeleted {
+		return fmt.Errorf("_disconnectPoll: PollEntry for post %v was found to be "+
+			"nil or isDeleted not set appropriately: %v", txMeta.PostHash, pollEntry)
+	}
+
+	if txMeta.OperationType == PollOperationTypeCreate {
+		// Sanity check: a poll can't have any votes by the time the txn that
+		// created it is disconnected.
+		for optionIndex, voteCount := range pollEntry.VoteCounts {
+			if voteCount != 0 {
+				return fmt.Errorf("_disconnectPoll: Option %d of poll %v has %d "+
+					"votes when reverting its creation", optionIndex, txMeta.PostHash, voteCount)
+			}
+		}
+		bav._deletePollEntryMappings(pollEntry)
+	} else {
+		// Get the PollVoteEntry. If we don't find it or isDeleted=true, that's an error.
+		voterPKID := bav.GetPKIDForPublicKey(currentTxn.PublicKey)
+		if voterPKID == nil || voterPKID.isDeleted {
+			return fmt.Errorf("_disconnectPoll: voterPKID was nil or deleted; this should never happen")
+		}
+		pollVoteKey := MakePollVoteKey(voterPKID.PKID, *txMeta.PostHash)
+		pollVoteEntry := bav._getPollVoteEntryForPollVoteKey(&pollVoteKey)
+		if pollVoteEntry == nil || pollVoteEntry.isDeleted {
+			return fmt.Errorf("_disconnectPoll: PollVoteEntry for "+
+				"pollVoteKey %v was found to be nil or isDeleted not set appropriately: %v",
+				&pollVoteKey, pollVoteEntry)
+		}
+
+		// Sanity check: verify that the vote matches the transaction's.
+		if pollVoteEntry.OptionIndex != txMeta.OptionIndex {
+			return fmt.Errorf("_disconnectPoll: OptionIndex on PollVoteEntry was %d "+
+				"but the OptionIndex on the txn was %d", pollVoteEntry.OptionIndex, txMeta.OptionIndex)
+		}
+
+		// Delete the vote and set the poll back to its previous vote counts.
+		bav._deletePollVoteEntryMappings(pollVoteEntry)
+		prevPollEntry := utxoOpsForTxn[operationIndex].PrevPollEntry
+		if prevPollEntry == nil {
+			return fmt.Errorf("_disconnectPoll: PrevPollEntry is missing for vote in poll %v",
+				txMeta.PostHash)
+		}
+		bav._setPollEntryMappings(prevPollEntry)
+	}
+
+	// Now revert the basic transfer with the remaining operations. Cut off
+	// the Poll operation at the end since we just reverted it.
+	return bav._disconnectBasicTransfer(
+		currentTxn, txnHash, utxoOpsForTxn[:operationIndex], blockHeight)
+}
+
+func (bav *UtxoView) _disconnectAuthorizeDerivedKey(
+	operationType OperationType, currentTxn *MsgBitCloutTxn, txnHash *BlockHash,
+	utxoOpsForTxn []*UtxoOperation, blockHeight uint32) error {
+
+	// Verify that the last operation is an AuthorizeDerivedKey operation
+	if len(utxoOpsForTxn) == 0 {
+		return fmt.Errorf("_disconnectAuthorizeDerivedKey: utxoOperations are missing")
+	}
+	operationIndex := len(utxoOpsForTxn) - 1
+	if utxoOpsForTxn[operationIndex].Type != OperationTypeAuthorizeDerivedKey {
+		return fmt.Errorf("_disconnectAuthorizeDerivedKey: Trying to revert "+
+			"OperationTypeAuthorizeDerivedKey but found type %v",
+			utxoOpsForTxn[operationIndex].Type)
+	}
+
+	// Now we know the txMeta is AuthorizeDerivedKey
+	txMeta := currentTxn.TxnMeta.(*AuthorizeDerivedKeyMetadata)
+
+	// Get the DerivedKeyEntry. If we don't find it or isDeleted=true, that's an error.
+	ownerPKID := bav.GetPKIDForPublicKey(currentTxn.PublicKey)
+	if ownerPKID == nil || ownerPKID.isDeleted {
+		return fmt.Errorf("_disconnectAuthorizeDerivedKey: ownerPKID was nil or deleted; this should never happen")
+	}
+	derivedKeyEntry := bav._getDerivedKeyEntryForDerivedKeyMapKey(
+		MakeDerivedKeyMapKey(ownerPKID.PKID, txMeta.DerivedPublicKey))
+	if derivedKeyEntry == nil || derivedKeyEntry.isDeleted {
+		return fmt.Errorf("_disconnectAuthorizeDerivedKey: DerivedKeyEntry for derived key %v "+
+			"was found to be nil or isDeleted not set appropriately: %v",
+			PkToStringBoth(txMeta.DerivedPublicKey), derivedKeyEntry)
+	}
+
+	// Sanity check: verify that the entry matches the transaction's.
+	if derivedKeyEntry.OperationType != txMeta.OperationType {
+		return fmt.Errorf("_disconnectAuthorizeDerivedKey: OperationType on DerivedKeyEntry "+
+			"was %v but the OperationType on the txn was %v",
+			derivedKeyEntry.OperationType, txMeta.OperationType)
+	}
+
+	// Delete the entry and restore the one it replaced, if any.
+	bav._deleteDerivedKeyEntryMappings(derivedKeyEntry)
+	if prevDerivedKeyEntry := utxoOpsForTxn[operationIndex].PrevDerivedKeyEntry; prevDerivedKeyEntry != nil {
+		bav._setDerivedKeyEntryMappings(prevDerivedKeyEntry)
+	}
+
+	// Now revert the basic transfer with the remaining operations. Cut off
+	// the AuthorizeDerivedKey operation at the end since we just reverted it.
+	return bav._disconnectBasicTransfer(
+		currentTxn, txnHash, utxoOpsForTxn[:operationIndex], blockHeight)
+}
+
+func (bav *UtxoView) _disconnectUpdateTransferRestriction(
+	operationType OperationType, currentTxn *MsgBitCloutTxn, txnHash *BlockHash,
+	utxoOpsForTxn []*UtxoOperation, blockHeight uint32) error {
+
+	// Verify that the last operation is an UpdateTransferRestriction operation
+	if len(utxoOpsForTxn) == 0 {
+		return fmt.Errorf("_disconnectUpdateTransferRestriction: utxoOperations are missing")
+	}
+	operationIndex := len(utxoOpsForTxn) - 1
+	operationData := utxoOpsForTxn[operationIndex]
+	if operationData.Type != OperationTypeUpdateTransferRestriction {
+		return fmt.Errorf("_disconnectUpdateTransferRestriction: Trying to revert "+
+			"OperationTypeUpdateTransferRestriction but found type %v", operationData.Type)
+	}
+	if operationData.PrevProfileEntry == nil {
+		return fmt.Errorf("_disconnectUpdateTransferRestriction: PrevProfileEntry is missing; " +
+			"this should never happen")
+	}
+
+	// Now we know the txMeta is UpdateTransferRestriction
+	txMeta := currentTxn.TxnMeta.(*UpdateTransferRestrictionMetadata)
+
+	// Get the profile. If we don't find it or isDeleted=true, that's an error.
+	existingProfileEntry := bav.GetProfileEntryForPublicKey(currentTxn.PublicKey)
+	if existingProfileEntry == nil || existingProfileEntry.isDeleted {
+		return fmt.Errorf("_disconnectUpdateTransferRestriction: ProfileEntry for "+
+			"public key %v was found to be nil or isDeleted not set appropriately: %v",
+			PkToStringBoth(currentTxn.PublicKey), existingProfileEntry)
+	}
+
+	// Sanity check: verify that the profile has the status the txn set.
+	if existingProfileEntry.TransferRestrictionStatus != txMeta.TransferRestrictionStatus {
+		return fmt.Errorf("_disconnectUpdateTransferRestriction: TransferRestrictionStatus on "+
+			"ProfileEntry was %v but the txn set %v",
+			existingProfileEntry.TransferRestrictionStatus, txMeta.TransferRestrictionStatus)
+	}
+
+	// Put the profile back the way it was.
+	bav._setProfileEntryMappings(operationData.PrevProfileEntry)
+
+	// Now revert the basic transfer with the remaining operations. Cut off
+	// the UpdateTransferRestriction operation at the end since we just reverted it.
+	return bav._disconnectBasicTransfer(
+		currentTxn, txnHash, utxoOpsForTxn[:operationIndex], blockHeight)
+}
+
 func (bav *UtxoView) _disconnectLike(
 	operationType OperationType, currentTxn *MsgBitCloutTxn, txnHash *BlockHash,
 	utxoOpsForTxn []*UtxoOperation, blockHeight uint32) error {
@@ -1879,6 +2375,21 @@ func (bav *UtxoView) _disconnectUpdateProfile(
 			profileEntry)
 	}
 
+	// If the update released a username, restore whatever released username entry
+	// we had for it before. If there wasn't one, delete the entry we added.
+	if bav.Params.UsernameReleaseProtectionWindowBlocks != 0 &&
+		_profileUpdateReleasesUsername(currentOperation.PrevProfileEntry, profileEntry) {
+
+		if currentOperation.PrevReleasedUsernameEntry != nil {
+			bav._setReleasedUsernameEntryMappings(currentOperation.PrevReleasedUsernameEntry)
+		} else {
+			releasedUsernameEntry := bav.GetReleasedUsernameEntry(currentOperation.PrevProfileEntry.Username)
+			if releasedUsernameEntry != nil {
+				bav._deleteReleasedUsernameEntryMappings(releasedUsernameEntry)
+			}
+		}
+	}
+
 	// Now that we are confident the ProfileEntry lines up with the transaction we're
 	// rolling back, set the mappings to be equal to whatever we had previously.
 	// We need to do this to prevent a fetch from a db later on.
@@ -2025,10 +2536,10 @@ func (bav *UtxoView) _disconnectCreatorCoin(
 
 			// Sanity-check that the watermark delta equates to what the creator received.
 			deltaNanos := uint64(0)
-			if blockHeight > BitCloutFounderRewardBlockHeight {
+			if bav._isForkActive(ForkNameBitCloutFounderReward, blockHeight) {
 				// Do nothing.  After the BitCloutFounderRewardBlockHeight, creator coins are not
 				// minted as a founder's reward, just BitClout (see utxo reverted later).
-			} else if blockHeight > SalomonFixBlockHeight {
+			} else if bav._isForkActive(ForkNameSalomonFix, blockHeight) {
 				// Following the SalomonFixBlockHeight block, we calculate a founders reward
 				// on every buy, not just the ones that push a creator to a new all time high.
 				deltaNanos = existingProfileEntry.CoinsInCirculationNanos - operationData.PrevCoinEntry.CoinsInCirculationNanos
@@ -2330,11 +2841,134 @@ func (bav *UtxoView) DisconnectTransaction(currentTxn *MsgBitCloutTxn, txnHash *
 		return bav._disconnectSwapIdentity(
 			OperationTypeSwapIdentity, currentTxn, txnHash, utxoOpsForTxn, blockHeight)
 
+	} else if currentTxn.TxnMeta.GetTxnType() == TxnTypePoll {
+		return bav._disconnectPoll(
+			OperationTypePoll, currentTxn, txnHash, utxoOpsForTxn, blockHeight)
+
+	} else if currentTxn.TxnMeta.GetTxnType() == TxnTypeAuthorizeDerivedKey {
+		return bav._disconnectAuthorizeDerivedKey(
+			OperationTypeAuthorizeDerivedKey, currentTxn, txnHash, utxoOpsForTxn, blockHeight)
+
+	} else if currentTxn.TxnMeta.GetTxnType() == TxnTypeUpdateTransferRestriction {
+		return bav._disconnectUpdateTransferRestriction(
+			OperationTypeUpdateTransferRestriction, currentTxn, txnHash, utxoOpsForTxn, blockHeight)
+
 	}
 
 	return fmt.Errorf("DisconnectBlock: Unimplemented txn type %v", currentTxn.TxnMeta.GetTxnType().String())
 }
 
+// _publicKeysForUtxoOps returns the public keys whose UTXOs were added or
+// spent by the operations.
+func _publicKeysForUtxoOps(utxoOps [][]*UtxoOperation) map[PkMapKey]bool {
+	publicKeys := make(map[PkMapKey]bool)
+	for _, utxoOpsForTxn := range utxoOps {
+		for _, op := range utxoOpsForTxn {
+			if (op.Type == OperationTypeSpendUtxo || op.Type == OperationTypeAddUtxo) &&
+				op.Entry != nil {
+
+				publicKeys[MakePkMapKey(op.Entry.PublicKey)] = true
+			}
+		}
+	}
+	return publicKeys
+}
+
+// _getBalanceNanosForPublicKeys returns each public key's balance as of the
+// view, which is its balance in the db plus the UTXOs the view has added and
+// minus the ones it has spent.
+func (bav *UtxoView) _getBalanceNanosForPublicKeys(
+	publicKeys map[PkMapKey]bool) (map[PkMapKey]uint64, error) {
+
+	balances := make(map[PkMapKey]uint64, len(publicKeys))
+	err := DbView(bav.Handle, func(txn KVTxn) error {
+		balanceDeltas := make(map[PkMapKey]int64)
+		for utxoKeyIter, utxoEntry := range bav.UtxoKeyToUtxoEntry {
+			// Make a copy of the iterator since we take references to it below.
+			utxoKey := utxoKeyIter
+
+			pkMapKey := MakePkMapKey(utxoEntry.PublicKey)
+			if !publicKeys[pkMapKey] {
+				continue
+			}
+			inDb := DbGetUtxoEntryForUtxoKeyWithTxn(txn, &utxoKey) != nil
+			if utxoEntry.isSpent && inDb {
+				balanceDeltas[pkMapKey] -= int64(utxoEntry.AmountNanos)
+			} else if !utxoEntry.isSpent && !inDb {
+				balanceDeltas[pkMapKey] += int64(utxoEntry.AmountNanos)
+			}
+		}
+
+		for pkMapKey := range publicKeys {
+			balanceNanos := int64(DbGetBalanceForPublicKeyWithTxn(txn, pkMapKey[:])) +
+				balanceDeltas[pkMapKey]
+			if balanceNanos < 0 {
+				return fmt.Errorf("Balance for public key %v would be negative: %d",
+					PkToStringBoth(pkMapKey[:]), balanceNanos)
+			}
+			balances[pkMapKey] = uint64(balanceNanos)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "_getBalanceNanosForPublicKeys: ")
+	}
+	return balances, nil
+}
+
+// _setBalanceSnapshotsForBlock records the balance of every public key the
+// block's operations touched as of the block. It does nothing unless the node
+// is keeping balance snapshots.
+func (bav *UtxoView) _setBalanceSnapshotsForBlock(
+	blockHeight uint32, utxoOps [][]*UtxoOperation) error {
+
+	if _, exists := DbGetBalanceSnapshotsStartHeight(bav.Handle); !exists ||
+		bav.invalidateBalanceSnapshots {
+
+		return nil
+	}
+
+	balances, err := bav._getBalanceNanosForPublicKeys(_publicKeysForUtxoOps(utxoOps))
+	if err != nil {
+		return errors.Wrapf(err, "_setBalanceSnapshotsForBlock: ")
+	}
+	for pkMapKey, balanceNanos := range balances {
+		bav.BalanceSnapshotKeyToBalanceSnapshotEntry[BalanceSnapshotKey{pkMapKey, blockHeight}] =
+			&BalanceSnapshotEntry{
+				PublicKey:    append([]byte{}, pkMapKey[:]...),
+				BlockHeight:  blockHeight,
+				BalanceNanos: balanceNanos,
+			}
+	}
+	return nil
+}
+
+// _deleteBalanceSnapshotsForBlock undoes _setBalanceSnapshotsForBlock for a
+// block being disconnected. Disconnecting a block at or below the height the
+// snapshots were seeded at leaves the seeded balances wrong, so in that case the
+// snapshots are marked to be seeded again instead.
+func (bav *UtxoView) _deleteBalanceSnapshotsForBlock(
+	blockHeight uint32, utxoOps [][]*UtxoOperation) {
+
+	startHeight, exists := DbGetBalanceSnapshotsStartHeight(bav.Handle)
+	if !exists || bav.invalidateBalanceSnapshots {
+		return
+	}
+	if blockHeight <= startHeight {
+		bav.invalidateBalanceSnapshots = true
+		return
+	}
+
+	for pkMapKey := range _publicKeysForUtxoOps(utxoOps) {
+		bav.BalanceSnapshotKeyToBalanceSnapshotEntry[BalanceSnapshotKey{pkMapKey, blockHeight}] =
+			&BalanceSnapshotEntry{
+				PublicKey:   append([]byte{}, pkMapKey[:]...),
+				BlockHeight: blockHeight,
+				isDeleted:   true,
+			}
+	}
+}
+
 func (bav *UtxoView) DisconnectBlock(
 	bitcloutBlock *MsgBitCloutBlock, txHashes []*BlockHash, utxoOps [][]*UtxoOperation) error {
 
@@ -2403,6 +3037,16 @@ func (bav *UtxoView) DisconnectBlock(
 	// reversed and the view should therefore be in the state it was in before
 	// this block was applied.
 
+	// Drop the balance snapshots the block wrote if the node is keeping them.
+	bav._deleteBalanceSnapshotsForBlock(uint32(bitcloutBlock.Header.Height), utxoOps)
+
+	// The state commitment for the block's height no longer matches the chain.
+	if bav.stateCommitmentsStaleFromHeight == 0 ||
+		uint32(bitcloutBlock.Header.Height) < bav.stateCommitmentsStaleFromHeight {
+
+		bav.stateCommitmentsStaleFromHeight = uint32(bitcloutBlock.Header.Height)
+	}
+
 	// Update the tip to point to the parent of this block since we've managed
 	// to successfully disconnect it.
 	bav.TipHash = bitcloutBlock.Header.PrevBlockHash
@@ -2425,42 +3069,149 @@ func _isEntryImmatureBlockReward(utxoEntry *UtxoEntry, blockHeight uint32, param
 	return false
 }
 
-func _verifySignature(txn *MsgBitCloutTxn) error {
+func _verifySignature(txn *MsgBitCloutTxn, signerPublicKey []byte) error {
 	// Compute a hash of the transaction
 	txBytes, err := txn.ToBytes(true /*preSignature*/)
 	if err != nil {
 		return errors.Wrapf(err, "_verifySignature: Problem serializing txn without signature: ")
 	}
 	txHash := Sha256DoubleHash(txBytes)
-	// Convert the txn public key into a *btcec.PublicKey
-	txnPk, err := btcec.ParsePubKey(txn.PublicKey, btcec.S256())
+	// Convert the signer's public key into a *btcec.PublicKey
+	signerPk, err := btcec.ParsePubKey(signerPublicKey, btcec.S256())
 	if err != nil {
 		return errors.Wrapf(err, "_verifySignature: Problem parsing public key: ")
 	}
 	// Verify that the transaction is signed by the specified key.
-	if txn.Signature == nil || !txn.Signature.Verify(txHash[:], txnPk) {
+	if txn.Signature == nil || !txn.Signature.Verify(txHash[:], signerPk) {
 		return RuleErrorInvalidTransactionSignature
 	}
 
 	return nil
 }
 
-func (bav *UtxoView) _connectBasicTransfer(
-	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
-	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
+// _verifyTxnSignature checks that the txn is signed by its public key or, if
+// its ExtraData names a derived key, by a derived key the owner has
+// authorized and that hasn't expired as of blockHeight.
+func (bav *UtxoView) _verifyTxnSignature(txn *MsgBitCloutTxn, blockHeight uint32) error {
+	derivedPublicKey, isDerivedKeySignature := txn.ExtraData[DerivedPublicKeyExtraDataKey]
+	if !isDerivedKeySignature {
+		return _verifySignature(txn, txn.PublicKey)
+	}
 
-	var utxoOpsForTxn []*UtxoOperation
+	if !bav._isForkActive(ForkNameDerivedKeys, blockHeight) {
+		return errors.Wrapf(RuleErrorDerivedKeysNotYetEnabled,
+			"_verifyTxnSignature: Block height %d is below %d",
+			blockHeight, bav._getForkActivationHeight(ForkNameDerivedKeys))
+	}
+	if len(derivedPublicKey) != btcec.PubKeyBytesLenCompressed {
+		return errors.Wrapf(RuleErrorDerivedKeyInvalidPublicKey,
+			"_verifyTxnSignature: Derived public key has length %d", len(derivedPublicKey))
+	}
+	ownerPKID := bav.GetPKIDForPublicKey(txn.PublicKey)
+	if ownerPKID == nil || ownerPKID.isDeleted {
+		return fmt.Errorf("_verifyTxnSignature: ownerPKID was nil or deleted; this should never happen")
+	}
+	derivedKeyEntry := bav._getDerivedKeyEntryForDerivedKeyMapKey(
+		MakeDerivedKeyMapKey(ownerPKID.PKID, derivedPublicKey))
+	if derivedKeyEntry == nil || derivedKeyEntry.isDeleted ||
+		derivedKeyEntry.OperationType != AuthorizeDerivedKeyOperationValid {
 
-	// Loop through all the inputs and validate them.
-	var totalInput uint64
-	// Each input should have a UtxoEntry corresponding to it if the transaction
-	// is legitimate. These should all have back-pointers to their UtxoKeys as well.
-	utxoEntriesForInputs := []*UtxoEntry{}
-	for _, bitcloutInput := range txn.TxInputs {
-		// Fetch the utxoEntry for this input from the view. Make a copy to
-		// avoid having the iterator change under our feet.
-		utxoKey := UtxoKey(*bitcloutInput)
-		utxoEntry := bav.GetUtxoEntryForUtxoKey(&utxoKey)
+		return errors.Wrapf(RuleErrorDerivedKeyNotAuthorized,
+			"_verifyTxnSignature: Derived key %v for owner %v",
+			PkToStringBoth(derivedPublicKey), PkToStringBoth(txn.PublicKey))
+	}
+	if uint64(blockHeight) >= derivedKeyEntry.ExpirationBlock {
+		return errors.Wrapf(RuleErrorDerivedKeyExpired,
+			"_verifyTxnSignature: Derived key %v expired at block %d",
+			PkToStringBoth(derivedPublicKey), derivedKeyEntry.ExpirationBlock)
+	}
+	return _verifySignature(txn, derivedPublicKey)
+}
+
+// _spendDerivedKeyLimit uses up part of the spending limit of the derived key
+// that signed the txn, if it has one. The nanos the txn spends are its inputs
+// minus whatever goes back to the owner as change, which includes the fee and
+// anything the txn spends implicitly, e.g. buying a creator coin.
+//
+// The limits are part of the state so this runs whether or not signatures are
+// being verified. It leaves checking that the derived key is authorized to
+// _verifyTxnSignature and does nothing for keys that aren't.
+func (bav *UtxoView) _spendDerivedKeyLimit(
+	txn *MsgBitCloutTxn, totalInput uint64, blockHeight uint32) (*UtxoOperation, error) {
+
+	derivedPublicKey, isDerivedKeySignature := txn.ExtraData[DerivedPublicKeyExtraDataKey]
+	if !isDerivedKeySignature || !bav._isForkActive(ForkNameDerivedKeys, blockHeight) ||
+		len(derivedPublicKey) != btcec.PubKeyBytesLenCompressed {
+
+		return nil, nil
+	}
+	ownerPKID := bav.GetPKIDForPublicKey(txn.PublicKey)
+	if ownerPKID == nil || ownerPKID.isDeleted {
+		return nil, fmt.Errorf("_spendDerivedKeyLimit: ownerPKID was nil or deleted; this should never happen")
+	}
+	derivedKeyEntry := bav._getDerivedKeyEntryForDerivedKeyMapKey(
+		MakeDerivedKeyMapKey(ownerPKID.PKID, derivedPublicKey))
+	if derivedKeyEntry == nil || derivedKeyEntry.isDeleted ||
+		derivedKeyEntry.OperationType != AuthorizeDerivedKeyOperationValid ||
+		derivedKeyEntry.TransactionSpendingLimit == nil {
+
+		return nil, nil
+	}
+	spendingLimit := derivedKeyEntry.TransactionSpendingLimit
+
+	txnType := txn.TxnMeta.GetTxnType()
+	if spendingLimit.TransactionCountLimitMap[txnType] == 0 {
+		return nil, errors.Wrapf(RuleErrorDerivedKeyTxnTypeNotAuthorized,
+			"_spendDerivedKeyLimit: Derived key %v has no %v txns left",
+			PkToStringBoth(derivedPublicKey), txnType)
+	}
+
+	var changeNanos uint64
+	for _, bitcloutOutput := range txn.TxOutputs {
+		if reflect.DeepEqual(bitcloutOutput.PublicKey, txn.PublicKey) {
+			changeNanos += bitcloutOutput.AmountNanos
+		}
+	}
+	var spentNanos uint64
+	if totalInput > changeNanos {
+		spentNanos = totalInput - changeNanos
+	}
+	if spentNanos > spendingLimit.GlobalBitCloutLimit {
+		return nil, errors.Wrapf(RuleErrorDerivedKeyTxnSpendsMoreThanGlobalLimit,
+			"_spendDerivedKeyLimit: Txn spends %d nanos but derived key %v only has %d left",
+			spentNanos, PkToStringBoth(derivedPublicKey), spendingLimit.GlobalBitCloutLimit)
+	}
+
+	// Replace the entry rather than modifying it so the UtxoOperation keeps the
+	// limit from before the txn.
+	newDerivedKeyEntry := *derivedKeyEntry
+	newDerivedKeyEntry.TransactionSpendingLimit = spendingLimit.Copy()
+	newDerivedKeyEntry.TransactionSpendingLimit.TransactionCountLimitMap[txnType]--
+	newDerivedKeyEntry.TransactionSpendingLimit.GlobalBitCloutLimit -= spentNanos
+	bav._setDerivedKeyEntryMappings(&newDerivedKeyEntry)
+
+	return &UtxoOperation{
+		Type:                OperationTypeSpendDerivedKeyLimit,
+		PrevDerivedKeyEntry: derivedKeyEntry,
+	}, nil
+}
+
+func (bav *UtxoView) _connectBasicTransfer(
+	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
+	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
+
+	var utxoOpsForTxn []*UtxoOperation
+
+	// Loop through all the inputs and validate them.
+	var totalInput uint64
+	// Each input should have a UtxoEntry corresponding to it if the transaction
+	// is legitimate. These should all have back-pointers to their UtxoKeys as well.
+	utxoEntriesForInputs := []*UtxoEntry{}
+	for _, bitcloutInput := range txn.TxInputs {
+		// Fetch the utxoEntry for this input from the view. Make a copy to
+		// avoid having the iterator change under our feet.
+		utxoKey := UtxoKey(*bitcloutInput)
+		utxoEntry := bav.GetUtxoEntryForUtxoKey(&utxoKey)
 		// If the utxo doesn't exist mark the block as invalid and return an error.
 		if utxoEntry == nil {
 			return 0, 0, nil, RuleErrorInputSpendsNonexistentUtxo
@@ -2585,6 +3336,17 @@ func (bav *UtxoView) _connectBasicTransfer(
 		utxoOpsForTxn = append(utxoOpsForTxn, newUtxoOp)
 	}
 
+	// If a derived key with a spending limit signed the txn then use up part
+	// of its limit. This has to be the last operation for the basic transfer
+	// since _disconnectBasicTransfer reverts it first.
+	spendLimitOp, err := bav._spendDerivedKeyLimit(txn, totalInput, blockHeight)
+	if err != nil {
+		return 0, 0, nil, errors.Wrapf(err, "_connectBasicTransfer: ")
+	}
+	if spendLimitOp != nil {
+		utxoOpsForTxn = append(utxoOpsForTxn, spendLimitOp)
+	}
+
 	// If signature verification is requested then do that as well.
 	if verifySignatures {
 		// When we looped through the inputs we verified that all of them belong
@@ -2605,7 +3367,7 @@ func (bav *UtxoView) _connectBasicTransfer(
 				return 0, 0, nil, RuleErrorBlockRewardTxnNotAllowedToHaveSignature
 			}
 		} else {
-			if err := _verifySignature(txn); err != nil {
+			if err := bav._verifyTxnSignature(txn, blockHeight); err != nil {
 				return 0, 0, nil, errors.Wrapf(err, "_connectBasicTransfer: Problem verifying txn signature: ")
 			}
 		}
@@ -2721,6 +3483,134 @@ func (bav *UtxoView) _deleteLikeEntryMappings(likeEntry *LikeEntry) {
 	bav._setLikeEntryMappings(&tombstoneLikeEntry)
 }
 
+func (bav *UtxoView) GetPollEntryForPostHash(postHash *BlockHash) *PollEntry {
+	// If an entry exists in the in-memory map, return the value of that mapping.
+	mapValue, existsMapValue := bav.PostHashToPollEntry[*postHash]
+	if existsMapValue {
+		return mapValue
+	}
+
+	// If we get here it means no value exists in our in-memory map. In this case,
+	// defer to the db. If a mapping exists in the db, return it. If not, return
+	// nil.
+	dbPollEntry := DbGetPollEntry(bav.Handle, postHash)
+	if dbPollEntry != nil {
+		bav._setPollEntryMappings(dbPollEntry)
+	}
+	return dbPollEntry
+}
+
+func (bav *UtxoView) _setPollEntryMappings(pollEntry *PollEntry) {
+	// This function shouldn't be called with nil.
+	if pollEntry == nil {
+		glog.Errorf("_setPollEntryMappings: Called with nil PollEntry; " +
+			"this should never happen.")
+		return
+	}
+
+	bav.PostHashToPollEntry[*pollEntry.PostHash] = pollEntry
+}
+
+func (bav *UtxoView) _deletePollEntryMappings(pollEntry *PollEntry) {
+
+	// Create a tombstone entry.
+	tombstonePollEntry := *pollEntry
+	tombstonePollEntry.isDeleted = true
+
+	// Set the mappings to point to the tombstone entry.
+	bav._setPollEntryMappings(&tombstonePollEntry)
+}
+
+func (bav *UtxoView) _getPollVoteEntryForPollVoteKey(pollVoteKey *PollVoteKey) *PollVoteEntry {
+	// If an entry exists in the in-memory map, return the value of that mapping.
+	mapValue, existsMapValue := bav.PollVoteKeyToPollVoteEntry[*pollVoteKey]
+	if existsMapValue {
+		return mapValue
+	}
+
+	// If we get here it means no value exists in our in-memory map. In this case,
+	// defer to the db. If a mapping exists in the db, return it. If not, return
+	// nil.
+	dbPollVoteEntry := DbGetPollVoteEntry(bav.Handle, &pollVoteKey.PostHash, &pollVoteKey.VoterPKID)
+	if dbPollVoteEntry != nil {
+		bav._setPollVoteEntryMappings(dbPollVoteEntry)
+	}
+	return dbPollVoteEntry
+}
+
+func (bav *UtxoView) _setPollVoteEntryMappings(pollVoteEntry *PollVoteEntry) {
+	// This function shouldn't be called with nil.
+	if pollVoteEntry == nil {
+		glog.Errorf("_setPollVoteEntryMappings: Called with nil PollVoteEntry; " +
+			"this should never happen.")
+		return
+	}
+
+	pollVoteKey := MakePollVoteKey(pollVoteEntry.VoterPKID, *pollVoteEntry.PostHash)
+	bav.PollVoteKeyToPollVoteEntry[pollVoteKey] = pollVoteEntry
+}
+
+func (bav *UtxoView) _deletePollVoteEntryMappings(pollVoteEntry *PollVoteEntry) {
+
+	// Create a tombstone entry.
+	tombstonePollVoteEntry := *pollVoteEntry
+	tombstonePollVoteEntry.isDeleted = true
+
+	// Set the mappings to point to the tombstone entry.
+	bav._setPollVoteEntryMappings(&tombstonePollVoteEntry)
+}
+
+func (bav *UtxoView) _getDerivedKeyEntryForDerivedKeyMapKey(derivedKeyMapKey DerivedKeyMapKey) *DerivedKeyEntry {
+	// If an entry exists in the in-memory map, return the value of that mapping.
+	mapValue, existsMapValue := bav.DerivedKeyMapKeyToDerivedKeyEntry[derivedKeyMapKey]
+	if existsMapValue {
+		return mapValue
+	}
+
+	// If we get here it means no value exists in our in-memory map. In this case,
+	// defer to the db. If a mapping exists in the db, return it. If not, return
+	// nil.
+	dbDerivedKeyEntry := DbGetDerivedKeyEntry(
+		bav.Handle, &derivedKeyMapKey.OwnerPKID, derivedKeyMapKey.DerivedPublicKey[:])
+	if dbDerivedKeyEntry != nil {
+		bav._setDerivedKeyEntryMappings(dbDerivedKeyEntry)
+	}
+	return dbDerivedKeyEntry
+}
+
+// GetDerivedKeyEntry returns the owner's entry for the derived key, or nil if
+// the owner never authorized it.
+func (bav *UtxoView) GetDerivedKeyEntry(ownerPKID *PKID, derivedPublicKey []byte) *DerivedKeyEntry {
+	derivedKeyEntry := bav._getDerivedKeyEntryForDerivedKeyMapKey(
+		MakeDerivedKeyMapKey(ownerPKID, derivedPublicKey))
+	if derivedKeyEntry == nil || derivedKeyEntry.isDeleted {
+		return nil
+	}
+	return derivedKeyEntry
+}
+
+func (bav *UtxoView) _setDerivedKeyEntryMappings(derivedKeyEntry *DerivedKeyEntry) {
+	// This function shouldn't be called with nil.
+	if derivedKeyEntry == nil {
+		glog.Errorf("_setDerivedKeyEntryMappings: Called with nil DerivedKeyEntry; " +
+			"this should never happen.")
+		return
+	}
+
+	derivedKeyMapKey := MakeDerivedKeyMapKey(derivedKeyEntry.OwnerPKID, derivedKeyEntry.DerivedPublicKey)
+	bav.DerivedKeyMapKeyToDerivedKeyEntry[derivedKeyMapKey] = derivedKeyEntry
+}
+
+func (bav *UtxoView) _deleteDerivedKeyEntryMappings(derivedKeyEntry *DerivedKeyEntry) {
+
+	// Create a tombstone entry.
+	tombstoneDerivedKeyEntry := *derivedKeyEntry
+	tombstoneDerivedKeyEntry.isDeleted = true
+
+	// Set the mappings to point to the tombstone entry.
+	bav._setDerivedKeyEntryMappings(&tombstoneDerivedKeyEntry)
+}
+
 func (bav *UtxoView) _setRecloutEntryMappings(recloutEntry *RecloutEntry) {
 	// This function shouldn't be called with nil.
 	if recloutEntry == nil {
@@ -2758,8 +3648,11 @@ func (bav *UtxoView) _getFollowEntryForFollowKey(followKey *FollowKey) *FollowEn
 	// If we get here it means no value exists in our in-memory map. In this case,
 	// defer to the db. If a mapping exists in the db, return it. If not, return
 	// nil. Either way, save the value to the in-memory view mapping got later.
-	if DbGetFollowerToFollowedMapping(
-		bav.Handle, &followKey.FollowerPKID, &followKey.FollowedPKID) != nil {
+	isFollowing, err := bav.Store.IsFollowing(&followKey.FollowerPKID, &followKey.FollowedPKID)
+	if err != nil {
+		glog.Errorf("_getFollowEntryForFollowKey: Problem reading follow: %v", err)
+	}
+	if isFollowing {
 		followEntry := FollowEntry{
 			FollowerPKID: &followKey.FollowerPKID,
 			FollowedPKID: &followKey.FollowedPKID,
@@ -2842,9 +3735,9 @@ func (bav *UtxoView) GetFollowEntriesForPublicKey(publicKey []byte, getEntriesFo
 	var dbPKIDs []*PKID
 	var err error
 	if getEntriesFollowingPublicKey {
-		dbPKIDs, err = DbGetPKIDsFollowingYou(bav.Handle, pkidForPublicKey.PKID)
+		dbPKIDs, err = bav.Store.GetPKIDsFollowingYou(pkidForPublicKey.PKID)
 	} else {
-		dbPKIDs, err = DbGetPKIDsYouFollow(bav.Handle, pkidForPublicKey.PKID)
+		dbPKIDs, err = bav.Store.GetPKIDsYouFollow(pkidForPublicKey.PKID)
 	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "GetFollowsForUser: Problem fetching FollowEntrys from db: ")
@@ -2946,7 +3839,10 @@ func (bav *UtxoView) GetPostEntryForPostHash(postHash *BlockHash) *PostEntry {
 	// If we get here it means no value exists in our in-memory map. In this case,
 	// defer to the db. If a mapping exists in the db, return it. If not, return
 	// nil.
-	dbPostEntry := DBGetPostEntryByPostHash(bav.Handle, postHash)
+	dbPostEntry, err := bav.Store.GetPostEntry(postHash)
+	if err != nil {
+		glog.Errorf("GetPostEntryForPostHash: Problem reading post: %v", err)
+	}
 	if dbPostEntry != nil {
 		bav._setPostEntryMappings(dbPostEntry)
 	}
@@ -3074,8 +3970,10 @@ func (bav *UtxoView) _getBalanceEntryForHODLerPKIDAndCreatorPKID(
 	// If we get here it means no value exists in our in-memory map. In this case,
 	// defer to the db. If a mapping exists in the db, return it. If not, return
 	// nil.
-	dbBalanceEntry := DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDs(
-		bav.Handle, hodlerPKID, creatorPKID)
+	dbBalanceEntry, err := bav.Store.GetBalanceEntry(hodlerPKID, creatorPKID)
+	if err != nil {
+		glog.Errorf("_getBalanceEntryForHODLerPKIDAndCreatorPKID: Problem reading balance: %v", err)
+	}
 	if dbBalanceEntry != nil {
 		bav._setBalanceEntryMappingsWithPKIDs(dbBalanceEntry, hodlerPKID, creatorPKID)
 	}
@@ -3246,7 +4144,10 @@ func (bav *UtxoView) GetProfileEntryForPKID(pkid *PKID) *ProfileEntry {
 	// If we get here it means no value exists in our in-memory map. In this case,
 	// defer to the db. If a mapping exists in the db, return it. If not, return
 	// nil.
-	dbProfileEntry := DBGetProfileEntryForPKID(bav.Handle, pkid)
+	dbProfileEntry, err := bav.Store.GetProfileEntry(pkid)
+	if err != nil {
+		glog.Errorf("GetProfileEntryForPKID: Problem reading profile: %v", err)
+	}
 	if dbProfileEntry != nil {
 		bav._setProfileEntryMappings(dbProfileEntry)
 	}
@@ -3285,6 +4186,45 @@ func (bav *UtxoView) _deleteProfileEntryMappings(profileEntry *ProfileEntry) {
 	bav._setProfileEntryMappings(&tombstoneProfileEntry)
 }
 
+func (bav *UtxoView) GetReleasedUsernameEntry(nonLowercaseUsername []byte) *ReleasedUsernameEntry {
+	// If an entry exists in the in-memory map, return the value of that mapping.
+	usernameMapKey := MakeUsernameMapKey(nonLowercaseUsername)
+	mapValue, existsMapValue := bav.ReleasedUsernameToReleasedUsernameEntry[usernameMapKey]
+	if existsMapValue {
+		return mapValue
+	}
+
+	// If we get here it means no value exists in our in-memory map. In this case,
+	// defer to the db. If a mapping exists in the db, return it. If not, return
+	// nil.
+	dbReleasedUsernameEntry := DbGetReleasedUsernameEntry(bav.Handle, nonLowercaseUsername)
+	if dbReleasedUsernameEntry != nil {
+		bav._setReleasedUsernameEntryMappings(dbReleasedUsernameEntry)
+	}
+	return dbReleasedUsernameEntry
+}
+
+func (bav *UtxoView) _setReleasedUsernameEntryMappings(releasedUsernameEntry *ReleasedUsernameEntry) {
+	// This function shouldn't be called with nil.
+	if releasedUsernameEntry == nil {
+		glog.Errorf("_setReleasedUsernameEntryMappings: Called with nil ReleasedUsernameEntry; " +
+			"this should never happen.")
+		return
+	}
+
+	bav.ReleasedUsernameToReleasedUsernameEntry[MakeUsernameMapKey(releasedUsernameEntry.Username)] =
+		releasedUsernameEntry
+}
+
+func (bav *UtxoView) _deleteReleasedUsernameEntryMappings(releasedUsernameEntry *ReleasedUsernameEntry) {
+	// Create a tombstone entry.
+	tombstoneReleasedUsernameEntry := *releasedUsernameEntry
+	tombstoneReleasedUsernameEntry.isDeleted = true
+
+	// Set the mappings to point to the tombstone entry.
+	bav._setReleasedUsernameEntryMappings(&tombstoneReleasedUsernameEntry)
+}
+
 func (bav *UtxoView) _existsBitcoinTxIDMapping(bitcoinBurnTxID *BlockHash) bool {
 	// If an entry exists in the in-memory map, return the value of that mapping.
 	mapValue, existsMapValue := bav.BitcoinBurnTxIDs[*bitcoinBurnTxID]
@@ -3396,9 +4336,7 @@ func (bav *UtxoView) _connectBitcoinExchange(
 	checkMerkleProof bool, minBitcoinBurnWork int64) (
 	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
 
-	if bav.Params.DeflationBombBlockHeight != 0 &&
-		uint64(blockHeight) >= bav.Params.DeflationBombBlockHeight {
-
+	if bav._isForkActive(ForkNameDeflationBomb, blockHeight) {
 		return 0, 0, nil, RuleErrorDeflationBombForbidsMintingAnyMoreBitClout
 	}
 
@@ -3951,83 +4889,383 @@ func (bav *UtxoView) _connectLike(
 		return 0, 0, nil, fmt.Errorf("_connectLike: called with bad TxnType %s",
 			txn.TxnMeta.GetTxnType().String())
 	}
-	txMeta := txn.TxnMeta.(*LikeMetadata)
+	txMeta := txn.TxnMeta.(*LikeMetadata)
+
+	// Connect basic txn to get the total input and the total output without
+	// considering the transaction metadata.
+	totalInput, totalOutput, utxoOpsForTxn, err := bav._connectBasicTransfer(
+		txn, txHash, blockHeight, verifySignatures)
+	if err != nil {
+		return 0, 0, nil, errors.Wrapf(err, "_connectLike: ")
+	}
+
+	if verifySignatures {
+		// _connectBasicTransfer has already checked that the transaction is
+		// signed by the top-level public key, which we take to be the sender's
+		// public key so there is no need to verify anything further.
+	}
+
+	// At this point the inputs and outputs have been processed. Now we need to handle
+	// the metadata.
+
+	// There are two main checks that need to be done before allowing a like:
+	//  - Check that the post exists
+	//  - Check that the person hasn't already liked the post
+
+	//	Check that the post to like actually exists.
+	existingPostEntry := bav.GetPostEntryForPostHash(txMeta.LikedPostHash)
+	if existingPostEntry == nil || existingPostEntry.isDeleted {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorCannotLikeNonexistentPost,
+			"_connectLike: Post hash: %v", txMeta.LikedPostHash)
+	}
+
+	// At this point the code diverges and considers the like / unlike flows differently
+	// since the presence of an existing like entry has a different effect in either case.
+
+	likeKey := MakeLikeKey(txn.PublicKey, *txMeta.LikedPostHash)
+	existingLikeEntry := bav._getLikeEntryForLikeKey(&likeKey)
+	// We don't need to make a copy of the post entry because all we're modifying is the like count,
+	// which isn't stored in any of our mappings. But we make a copy here just because it's a little bit
+	// more foolproof.
+	updatedPostEntry := *existingPostEntry
+	if txMeta.IsUnlike {
+		// Ensure that there *is* an existing like entry to delete.
+		if existingLikeEntry == nil || existingLikeEntry.isDeleted {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorCannotUnlikeWithoutAnExistingLike,
+				"_connectLike: Like key: %v", &likeKey)
+		}
+
+		// Now that we know there is a like entry, we delete it and decrement the like count.
+		bav._deleteLikeEntryMappings(existingLikeEntry)
+		updatedPostEntry.LikeCount -= 1
+	} else {
+		// Ensure that there *is not* an existing like entry.
+		if existingLikeEntry != nil && !existingLikeEntry.isDeleted {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorLikeEntryAlreadyExists,
+				"_connectLike: Like key: %v", &likeKey)
+		}
+
+		// Now that we know there is no pre-existing like entry, we can create one and
+		// increment the likes on the liked post.
+		likeEntry := &LikeEntry{
+			LikerPubKey:   txn.PublicKey,
+			LikedPostHash: txMeta.LikedPostHash,
+		}
+		bav._setLikeEntryMappings(likeEntry)
+		updatedPostEntry.LikeCount += 1
+	}
+
+	// Set the updated post entry so it has the new like count.
+	bav._setPostEntryMappings(&updatedPostEntry)
+
+	// Add an operation to the list at the end indicating we've added a follow.
+	utxoOpsForTxn = append(utxoOpsForTxn, &UtxoOperation{
+		Type:          OperationTypeLike,
+		PrevLikeEntry: existingLikeEntry,
+		PrevLikeCount: existingPostEntry.LikeCount,
+	})
+
+	return totalInput, totalOutput, utxoOpsForTxn, nil
+}
+
+func (bav *UtxoView) _connectPoll(
+	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
+	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
+
+	// Check that the transaction has the right TxnType.
+	if txn.TxnMeta.GetTxnType() != TxnTypePoll {
+		return 0, 0, nil, fmt.Errorf("_connectPoll: called with bad TxnType %s",
+			txn.TxnMeta.GetTxnType().String())
+	}
+	txMeta := txn.TxnMeta.(*PollMetadata)
+
+	if !bav._isForkActive(ForkNamePolls, blockHeight) {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorPollsNotYetEnabled,
+			"_connectPoll: Block height %d is below %d", blockHeight,
+			bav._getForkActivationHeight(ForkNamePolls))
+	}
+
+	// Connect basic txn to get the total input and the total output without
+	// considering the transaction metadata.
+	totalInput, totalOutput, utxoOpsForTxn, err := bav._connectBasicTransfer(
+		txn, txHash, blockHeight, verifySignatures)
+	if err != nil {
+		return 0, 0, nil, errors.Wrapf(err, "_connectPoll: ")
+	}
+
+	if verifySignatures {
+		// _connectBasicTransfer has already checked that the transaction is
+		// signed by the top-level public key, which we take to be the creator
+		// or voter so there is no need to verify anything further.
+	}
+
+	// Check that the post the poll is attached to actually exists.
+	postEntry := bav.GetPostEntryForPostHash(txMeta.PostHash)
+	if postEntry == nil || postEntry.isDeleted {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorPollOnNonexistentPost,
+			"_connectPoll: Post hash: %v", txMeta.PostHash)
+	}
+
+	transactorPKID := bav.GetPKIDForPublicKey(txn.PublicKey)
+	if transactorPKID == nil || transactorPKID.isDeleted {
+		return 0, 0, nil, fmt.Errorf("_connectPoll: transactorPKID was nil or deleted; this should never happen")
+	}
+
+	existingPollEntry := bav.GetPollEntryForPostHash(txMeta.PostHash)
+	var existingPollVoteEntry *PollVoteEntry
+	if txMeta.OperationType == PollOperationTypeCreate {
+		// Only the poster can attach a poll to a post, and only once.
+		if !reflect.DeepEqual(postEntry.PosterPublicKey, txn.PublicKey) {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollCreatorNotPoster,
+				"_connectPoll: Poster %v, creator %v",
+				PkToStringBoth(postEntry.PosterPublicKey), PkToStringBoth(txn.PublicKey))
+		}
+		if existingPollEntry != nil && !existingPollEntry.isDeleted {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollAlreadyExists,
+				"_connectPoll: Post hash: %v", txMeta.PostHash)
+		}
+
+		// Check the options.
+		if len(txMeta.Options) < MinPollOptions {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollTooFewOptions,
+				"_connectPoll: %d options is less than %d", len(txMeta.Options), MinPollOptions)
+		}
+		if len(txMeta.Options) > MaxPollOptions {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollTooManyOptions,
+				"_connectPoll: %d options is more than %d", len(txMeta.Options), MaxPollOptions)
+		}
+		for optionIndex, option := range txMeta.Options {
+			if len(option) == 0 || len(option) > MaxPollOptionLengthBytes {
+				return 0, 0, nil, errors.Wrapf(
+					RuleErrorPollOptionLength,
+					"_connectPoll: Option %d has length %d", optionIndex, len(option))
+			}
+		}
+
+		bav._setPollEntryMappings(&PollEntry{
+			PostHash:    txMeta.PostHash,
+			CreatorPKID: transactorPKID.PKID,
+			Options:     txMeta.Options,
+			VoteCounts:  make([]uint64, len(txMeta.Options)),
+		})
+
+	} else if txMeta.OperationType == PollOperationTypeVote {
+		if existingPollEntry == nil || existingPollEntry.isDeleted {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollDoesNotExist,
+				"_connectPoll: Post hash: %v", txMeta.PostHash)
+		}
+		if txMeta.OptionIndex >= uint64(len(existingPollEntry.Options)) {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollVoteInvalidOptionIndex,
+				"_connectPoll: Option index %d for poll with %d options",
+				txMeta.OptionIndex, len(existingPollEntry.Options))
+		}
+
+		// Users get one vote per poll.
+		pollVoteKey := MakePollVoteKey(transactorPKID.PKID, *txMeta.PostHash)
+		existingPollVoteEntry = bav._getPollVoteEntryForPollVoteKey(&pollVoteKey)
+		if existingPollVoteEntry != nil && !existingPollVoteEntry.isDeleted {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorPollVoteAlreadyExists,
+				"_connectPoll: Poll vote key: %v", &pollVoteKey)
+		}
+
+		bav._setPollVoteEntryMappings(&PollVoteEntry{
+			VoterPKID:   transactorPKID.PKID,
+			PostHash:    txMeta.PostHash,
+			OptionIndex: txMeta.OptionIndex,
+		})
+
+		// Copy the vote counts rather than modifying them in place so the
+		// entry saved in the UtxoOperation keeps the previous counts.
+		updatedPollEntry := *existingPollEntry
+		updatedPollEntry.VoteCounts = append([]uint64{}, existingPollEntry.VoteCounts...)
+		updatedPollEntry.VoteCounts[txMeta.OptionIndex] += 1
+		bav._setPollEntryMappings(&updatedPollEntry)
+
+	} else {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorPollInvalidOperationType,
+			"_connectPoll: Operation type: %v", txMeta.OperationType)
+	}
+
+	// Add an operation to the list at the end indicating we've connected a poll.
+	utxoOpsForTxn = append(utxoOpsForTxn, &UtxoOperation{
+		Type:              OperationTypePoll,
+		PrevPollEntry:     existingPollEntry,
+		PrevPollVoteEntry: existingPollVoteEntry,
+	})
+
+	return totalInput, totalOutput, utxoOpsForTxn, nil
+}
+
+func (bav *UtxoView) _connectAuthorizeDerivedKey(
+	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
+	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
+
+	// Check that the transaction has the right TxnType.
+	if txn.TxnMeta.GetTxnType() != TxnTypeAuthorizeDerivedKey {
+		return 0, 0, nil, fmt.Errorf("_connectAuthorizeDerivedKey: called with bad TxnType %s",
+			txn.TxnMeta.GetTxnType().String())
+	}
+	txMeta := txn.TxnMeta.(*AuthorizeDerivedKeyMetadata)
+
+	if !bav._isForkActive(ForkNameDerivedKeys, blockHeight) {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorDerivedKeysNotYetEnabled,
+			"_connectAuthorizeDerivedKey: Block height %d is below %d",
+			blockHeight, bav._getForkActivationHeight(ForkNameDerivedKeys))
+	}
+
+	// Derived keys can't authorize other keys. Otherwise a leaked derived key
+	// could be used to authorize keys that never expire.
+	if _, isDerivedKeySignature := txn.ExtraData[DerivedPublicKeyExtraDataKey]; isDerivedKeySignature {
+		return 0, 0, nil, RuleErrorAuthorizeDerivedKeySignedByDerivedKey
+	}
+
+	// Connect basic txn to get the total input and the total output without
+	// considering the transaction metadata.
+	totalInput, totalOutput, utxoOpsForTxn, err := bav._connectBasicTransfer(
+		txn, txHash, blockHeight, verifySignatures)
+	if err != nil {
+		return 0, 0, nil, errors.Wrapf(err, "_connectAuthorizeDerivedKey: ")
+	}
+
+	if verifySignatures {
+		// _connectBasicTransfer has already checked that the transaction is
+		// signed by the top-level public key, which we take to be the owner
+		// so there is no need to verify anything further.
+	}
+
+	// The derived key must be a valid public key that isn't the owner's.
+	if _, err := btcec.ParsePubKey(txMeta.DerivedPublicKey, btcec.S256()); err != nil {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorAuthorizeDerivedKeyInvalidPublicKey, "_connectAuthorizeDerivedKey: %v", err)
+	}
+	if reflect.DeepEqual(txMeta.DerivedPublicKey, txn.PublicKey) {
+		return 0, 0, nil, RuleErrorAuthorizeDerivedKeyOwnerIsDerivedKey
+	}
+
+	ownerPKID := bav.GetPKIDForPublicKey(txn.PublicKey)
+	if ownerPKID == nil || ownerPKID.isDeleted {
+		return 0, 0, nil, fmt.Errorf("_connectAuthorizeDerivedKey: ownerPKID was nil or deleted; this should never happen")
+	}
+	existingDerivedKeyEntry := bav._getDerivedKeyEntryForDerivedKeyMapKey(
+		MakeDerivedKeyMapKey(ownerPKID.PKID, txMeta.DerivedPublicKey))
+	if existingDerivedKeyEntry != nil && existingDerivedKeyEntry.isDeleted {
+		existingDerivedKeyEntry = nil
+	}
+
+	if txMeta.OperationType == AuthorizeDerivedKeyOperationValid {
+		// Revoking a key is permanent so a key that leaked can't be brought back.
+		if existingDerivedKeyEntry != nil &&
+			existingDerivedKeyEntry.OperationType == AuthorizeDerivedKeyOperationNotValid {
+
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorAuthorizeDerivedKeyRevoked,
+				"_connectAuthorizeDerivedKey: Derived key %v", PkToStringBoth(txMeta.DerivedPublicKey))
+		}
+		if txMeta.ExpirationBlock <= uint64(blockHeight) {
+			return 0, 0, nil, errors.Wrapf(
+				RuleErrorAuthorizeDerivedKeyExpired,
+				"_connectAuthorizeDerivedKey: Expiration block %d is not after block %d",
+				txMeta.ExpirationBlock, blockHeight)
+		}
+	} else if txMeta.OperationType != AuthorizeDerivedKeyOperationNotValid {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorAuthorizeDerivedKeyInvalidOperationType,
+			"_connectAuthorizeDerivedKey: Operation type: %v", txMeta.OperationType)
+	}
+
+	bav._setDerivedKeyEntryMappings(&DerivedKeyEntry{
+		OwnerPKID:                ownerPKID.PKID,
+		DerivedPublicKey:         txMeta.DerivedPublicKey,
+		ExpirationBlock:          txMeta.ExpirationBlock,
+		OperationType:            txMeta.OperationType,
+		TransactionSpendingLimit: txMeta.TransactionSpendingLimit.Copy(),
+	})
+
+	// Add an operation to the list at the end indicating we've authorized or
+	// revoked a derived key.
+	utxoOpsForTxn = append(utxoOpsForTxn, &UtxoOperation{
+		Type:                OperationTypeAuthorizeDerivedKey,
+		PrevDerivedKeyEntry: existingDerivedKeyEntry,
+	})
+
+	return totalInput, totalOutput, utxoOpsForTxn, nil
+}
+
+func (bav *UtxoView) _connectUpdateTransferRestriction(
+	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
+	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
+
+	// Check that the transaction has the right TxnType.
+	if txn.TxnMeta.GetTxnType() != TxnTypeUpdateTransferRestriction {
+		return 0, 0, nil, fmt.Errorf("_connectUpdateTransferRestriction: called with bad TxnType %s",
+			txn.TxnMeta.GetTxnType().String())
+	}
+	txMeta := txn.TxnMeta.(*UpdateTransferRestrictionMetadata)
+
+	if !bav._isForkActive(ForkNameTransferRestrictions, blockHeight) {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorTransferRestrictionsNotYetEnabled,
+			"_connectUpdateTransferRestriction: Block height %d is below %d",
+			blockHeight, bav._getForkActivationHeight(ForkNameTransferRestrictions))
+	}
 
 	// Connect basic txn to get the total input and the total output without
 	// considering the transaction metadata.
 	totalInput, totalOutput, utxoOpsForTxn, err := bav._connectBasicTransfer(
 		txn, txHash, blockHeight, verifySignatures)
 	if err != nil {
-		return 0, 0, nil, errors.Wrapf(err, "_connectLike: ")
+		return 0, 0, nil, errors.Wrapf(err, "_connectUpdateTransferRestriction: ")
 	}
 
 	if verifySignatures {
 		// _connectBasicTransfer has already checked that the transaction is
-		// signed by the top-level public key, which we take to be the sender's
-		// public key so there is no need to verify anything further.
+		// signed by the top-level public key, which we take to be the profile
+		// owner so there is no need to verify anything further.
 	}
 
-	// At this point the inputs and outputs have been processed. Now we need to handle
-	// the metadata.
-
-	// There are two main checks that need to be done before allowing a like:
-	//  - Check that the post exists
-	//  - Check that the person hasn't already liked the post
-
-	//	Check that the post to like actually exists.
-	existingPostEntry := bav.GetPostEntryForPostHash(txMeta.LikedPostHash)
-	if existingPostEntry == nil || existingPostEntry.isDeleted {
+	switch txMeta.TransferRestrictionStatus {
+	case TransferRestrictionStatusUnrestricted, TransferRestrictionStatusProfileOwnerOnly,
+		TransferRestrictionStatusDAOMembersOnly:
+	default:
 		return 0, 0, nil, errors.Wrapf(
-			RuleErrorCannotLikeNonexistentPost,
-			"_connectLike: Post hash: %v", txMeta.LikedPostHash)
+			RuleErrorUpdateTransferRestrictionInvalidStatus,
+			"_connectUpdateTransferRestriction: Status: %v", txMeta.TransferRestrictionStatus)
 	}
 
-	// At this point the code diverges and considers the like / unlike flows differently
-	// since the presence of an existing like entry has a different effect in either case.
-
-	likeKey := MakeLikeKey(txn.PublicKey, *txMeta.LikedPostHash)
-	existingLikeEntry := bav._getLikeEntryForLikeKey(&likeKey)
-	// We don't need to make a copy of the post entry because all we're modifying is the like count,
-	// which isn't stored in any of our mappings. But we make a copy here just because it's a little bit
-	// more foolproof.
-	updatedPostEntry := *existingPostEntry
-	if txMeta.IsUnlike {
-		// Ensure that there *is* an existing like entry to delete.
-		if existingLikeEntry == nil || existingLikeEntry.isDeleted {
-			return 0, 0, nil, errors.Wrapf(
-				RuleErrorCannotUnlikeWithoutAnExistingLike,
-				"_connectLike: Like key: %v", &likeKey)
-		}
-
-		// Now that we know there is a like entry, we delete it and decrement the like count.
-		bav._deleteLikeEntryMappings(existingLikeEntry)
-		updatedPostEntry.LikeCount -= 1
-	} else {
-		// Ensure that there *is not* an existing like entry.
-		if existingLikeEntry != nil && !existingLikeEntry.isDeleted {
-			return 0, 0, nil, errors.Wrapf(
-				RuleErrorLikeEntryAlreadyExists,
-				"_connectLike: Like key: %v", &likeKey)
-		}
-
-		// Now that we know there is no pre-existing like entry, we can create one and
-		// increment the likes on the liked post.
-		likeEntry := &LikeEntry{
-			LikerPubKey:   txn.PublicKey,
-			LikedPostHash: txMeta.LikedPostHash,
-		}
-		bav._setLikeEntryMappings(likeEntry)
-		updatedPostEntry.LikeCount += 1
+	// Only a creator with a profile has a coin to restrict.
+	existingProfileEntry := bav.GetProfileEntryForPublicKey(txn.PublicKey)
+	if existingProfileEntry == nil || existingProfileEntry.isDeleted {
+		return 0, 0, nil, errors.Wrapf(
+			RuleErrorUpdateTransferRestrictionOnNonexistentProfile,
+			"_connectUpdateTransferRestriction: Profile pub key: %v", PkToStringBoth(txn.PublicKey))
 	}
 
-	// Set the updated post entry so it has the new like count.
-	bav._setPostEntryMappings(&updatedPostEntry)
+	// The existing entry may be shared with the view's mappings and the db
+	// caches, so update a copy of it and save the original for the disconnect.
+	prevProfileEntry := *existingProfileEntry
+	newProfileEntry := *existingProfileEntry
+	newProfileEntry.TransferRestrictionStatus = txMeta.TransferRestrictionStatus
+	bav._setProfileEntryMappings(&newProfileEntry)
 
-	// Add an operation to the list at the end indicating we've added a follow.
+	// Add an operation to the list at the end indicating we've updated the
+	// transfer restriction.
 	utxoOpsForTxn = append(utxoOpsForTxn, &UtxoOperation{
-		Type:          OperationTypeLike,
-		PrevLikeEntry: existingLikeEntry,
-		PrevLikeCount: existingPostEntry.LikeCount,
+		Type:             OperationTypeUpdateTransferRestriction,
+		PrevProfileEntry: &prevProfileEntry,
 	})
 
 	return totalInput, totalOutput, utxoOpsForTxn, nil
@@ -4482,6 +5720,7 @@ func (bav *UtxoView) _connectSubmitPost(
 	// Set the mappings for the entry regardless of whether we modified it or
 	// created it from scratch.
 	bav._setPostEntryMappings(newPostEntry)
+	bav.ContentHashPostHashes[*newPostEntry.PostHash] = true
 	if newParentPostEntry != nil {
 		bav._setPostEntryMappings(newParentPostEntry)
 	}
@@ -4641,6 +5880,24 @@ func (bav *UtxoView) _connectUpdateProfile(
 		}
 	}
 
+	// If the username was recently given up by another profile then it can't be
+	// claimed by anyone else until the protection window has passed.
+	if bav.Params.UsernameReleaseProtectionWindowBlocks != 0 && len(txMeta.NewUsername) != 0 {
+		releasedUsernameEntry := bav.GetReleasedUsernameEntry(txMeta.NewUsername)
+		if releasedUsernameEntry != nil && !releasedUsernameEntry.isDeleted &&
+			uint64(blockHeight) < uint64(releasedUsernameEntry.ReleasedAtHeight)+
+				uint64(bav.Params.UsernameReleaseProtectionWindowBlocks) {
+
+			claimerPKID := bav.GetPKIDForPublicKey(profilePublicKey)
+			if claimerPKID == nil || *claimerPKID.PKID != *releasedUsernameEntry.ReleasedByPKID {
+				return 0, 0, nil, errors.Wrapf(
+					RuleErrorProfileUsernameRecentlyReleased, "Username: %v, released "+
+						"at height: %v, current height: %v", string(txMeta.NewUsername),
+					releasedUsernameEntry.ReleasedAtHeight, blockHeight)
+			}
+		}
+	}
+
 	// Connect basic txn to get the total input and the total output without
 	// considering the transaction metadata.
 	//
@@ -4770,6 +6027,21 @@ func (bav *UtxoView) _connectUpdateProfile(
 		// public key.
 	}
 
+	// If this update changes the username of an existing profile, record that the
+	// old username was released so that nobody else can grab it right away. The
+	// record is only needed while the protection is on.
+	var prevReleasedUsernameEntry *ReleasedUsernameEntry
+	if bav.Params.UsernameReleaseProtectionWindowBlocks != 0 &&
+		_profileUpdateReleasesUsername(prevProfileEntry, &newProfileEntry) {
+
+		prevReleasedUsernameEntry = bav.GetReleasedUsernameEntry(prevProfileEntry.Username)
+		bav._setReleasedUsernameEntryMappings(&ReleasedUsernameEntry{
+			Username:         []byte(strings.ToLower(string(prevProfileEntry.Username))),
+			ReleasedByPKID:   bav.GetPKIDForPublicKey(prevProfileEntry.PublicKey).PKID,
+			ReleasedAtHeight: blockHeight,
+		})
+	}
+
 	// Delete the old profile mappings. Not doing this could cause a username
 	// change to have outdated mappings, among other things.
 	if prevProfileEntry != nil {
@@ -4778,16 +6050,30 @@ func (bav *UtxoView) _connectUpdateProfile(
 
 	// Save the profile entry now that we've updated it or created it from scratch.
 	bav._setProfileEntryMappings(&newProfileEntry)
+	if len(txMeta.NewProfilePic) != 0 {
+		profilePKID := bav.GetPKIDForPublicKey(newProfileEntry.PublicKey)
+		bav.ContentHashProfilePKIDs[*profilePKID.PKID] = true
+	}
 
 	// Add an operation to the list at the end indicating we've updated a profile.
 	utxoOpsForTxn = append(utxoOpsForTxn, &UtxoOperation{
-		Type:             OperationTypeUpdateProfile,
-		PrevProfileEntry: prevProfileEntry,
+		Type:                      OperationTypeUpdateProfile,
+		PrevProfileEntry:          prevProfileEntry,
+		PrevReleasedUsernameEntry: prevReleasedUsernameEntry,
 	})
 
 	return totalInput, totalOutput, utxoOpsForTxn, nil
 }
 
+// _profileUpdateReleasesUsername returns true if going from prevProfileEntry to
+// newProfileEntry gives up a username. Changes in case alone don't count.
+func _profileUpdateReleasesUsername(prevProfileEntry *ProfileEntry, newProfileEntry *ProfileEntry) bool {
+	if prevProfileEntry == nil || prevProfileEntry.isDeleted || len(prevProfileEntry.Username) == 0 {
+		return false
+	}
+	return MakeUsernameMapKey(prevProfileEntry.Username) != MakeUsernameMapKey(newProfileEntry.Username)
+}
+
 func (bav *UtxoView) _connectSwapIdentity(
 	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
 	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
@@ -5010,6 +6296,23 @@ func CalculateBitCloutToReturn(
 	return retNanos
 }
 
+// CalculateCreatorCoinPriceBitCloutNanos returns the spot price of one whole
+// creator coin in BitClout nanos, which is zero for a coin with nothing in
+// circulation. On the Bancor curve the price is B / (RR * S), where B is the
+// BitClout locked, S is the number of whole coins in circulation, and RR is
+// params.CreatorCoinReserveRatio.
+func CalculateCreatorCoinPriceBitCloutNanos(coinEntry *CoinEntry, params *BitCloutParams) uint64 {
+	if coinEntry.CoinsInCirculationNanos == 0 {
+		return 0
+	}
+	bigNanosPerUnit := NewFloat().SetUint64(NanosPerUnit)
+	bigCoinsInCirculation := Div(NewFloat().SetUint64(coinEntry.CoinsInCirculationNanos), bigNanosPerUnit)
+	bigRet := Div(NewFloat().SetUint64(coinEntry.BitCloutLockedNanos),
+		Mul(params.CreatorCoinReserveRatio, bigCoinsInCirculation))
+	retNanos, _ := bigRet.Uint64()
+	return retNanos
+}
+
 func CalculateCreatorCoinToMint(
 	bitcloutToSellNanos uint64,
 	coinsInCirculationNanos uint64, bitcloutLockedNanos uint64,
@@ -5077,6 +6380,14 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 	// exists that corresponds to the profile public key the user
 	// provided.
 
+	// A buy mints coins to the buyer so it's restricted like a transfer to
+	// them. Otherwise anyone could get around a restriction by buying.
+	if err := bav._checkCreatorCoinTransferRestriction(
+		existingProfileEntry, nil /*senderPublicKey*/, txn.PublicKey); err != nil {
+
+		return 0, 0, 0, 0, nil, errors.Wrapf(err, "_connectCreatorCoin: Buy: ")
+	}
+
 	// Check that the amount of BitClout being traded for creator coin is
 	// non-zero.
 	bitCloutBeforeFeesNanos := txMeta.BitCloutToSellNanos
@@ -5129,7 +6440,7 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 	// profile being bought, we do not cut a founder reward.
 	bitcloutRemainingNanos := uint64(0)
 	bitcloutFounderRewardNanos := uint64(0)
-	if blockHeight > BitCloutFounderRewardBlockHeight &&
+	if bav._isForkActive(ForkNameBitCloutFounderReward, blockHeight) &&
 		!reflect.DeepEqual(txn.PublicKey, existingProfileEntry.PublicKey) {
 
 		// This formula is equal to:
@@ -5176,7 +6487,7 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 	// This makes it prohibitively expensive for a user to buy themself above the
 	// CreatorCoinAutoSellThresholdNanos and then spam tiny nano BitClout creator
 	// coin purchases causing the effective Bancor Creator Coin Reserve Ratio to drift.
-	if blockHeight > SalomonFixBlockHeight {
+	if bav._isForkActive(ForkNameSalomonFix, blockHeight) {
 		if creatorCoinToMintNanos < bav.Params.CreatorCoinAutoSellThresholdNanos {
 			return 0, 0, 0, 0, nil, RuleErrorCreatorCoinBuyMustSatisfyAutoSellThresholdNanos
 		}
@@ -5211,11 +6522,11 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 
 	// Calculate the *Creator Coin nanos* to give as a founder reward.
 	creatorCoinFounderRewardNanos := uint64(0)
-	if blockHeight > BitCloutFounderRewardBlockHeight {
+	if bav._isForkActive(ForkNameBitCloutFounderReward, blockHeight) {
 		// Do nothing. The chain stopped minting creator coins as a founder reward for
 		// creators at this blockheight.  It gives BitClout as a founder reward now instead.
 
-	} else if blockHeight > SalomonFixBlockHeight {
+	} else if bav._isForkActive(ForkNameSalomonFix, blockHeight) {
 		// Following the SalomonFixBlockHeight block, creator coin buys continuously mint
 		// a founders reward based on the CreatorBasisPoints.
 
@@ -5335,7 +6646,7 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 	// Check that if the buyer is receiving nanos for the first time, it's enough
 	// to push them above the CreatorCoinAutoSellThresholdNanos threshold. This helps
 	// prevent tiny amounts of nanos from drifting the ratio of creator coins to BitClout locked.
-	if blockHeight > SalomonFixBlockHeight {
+	if bav._isForkActive(ForkNameSalomonFix, blockHeight) {
 		if buyerBalanceEntry.BalanceNanos == 0 && coinsBuyerGetsNanos != 0 &&
 			coinsBuyerGetsNanos < bav.Params.CreatorCoinAutoSellThresholdNanos {
 			return 0, 0, 0, 0, nil, RuleErrorCreatorCoinBuyMustSatisfyAutoSellThresholdNanosForBuyer
@@ -5369,7 +6680,7 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 	if creatorBalanceEntry.BalanceNanos == 0 &&
 		creatorCoinFounderRewardNanos != 0 &&
 		creatorCoinFounderRewardNanos < bav.Params.CreatorCoinAutoSellThresholdNanos &&
-		blockHeight > SalomonFixBlockHeight {
+		bav._isForkActive(ForkNameSalomonFix, blockHeight) {
 
 		return 0, 0, 0, 0, nil, RuleErrorCreatorCoinBuyMustSatisfyAutoSellThresholdNanosForCreator
 	}
@@ -5393,7 +6704,7 @@ func (bav *UtxoView) HelpConnectCreatorCoinBuy(
 
 	// Finally, if the creator is getting a bitclout founder reward, add a UTXO for it.
 	var outputKey *UtxoKey
-	if blockHeight > BitCloutFounderRewardBlockHeight {
+	if bav._isForkActive(ForkNameBitCloutFounderReward, blockHeight) {
 		if bitcloutFounderRewardNanos > 0 {
 			// Create a new entry for this output and add it to the view. It should be
 			// added at the end of the utxo list.
@@ -5521,7 +6832,7 @@ func (bav *UtxoView) HelpConnectCreatorCoinSell(
 
 	bitCloutBeforeFeesNanos := uint64(0)
 	// Compute the amount of BitClout to return.
-	if blockHeight > SalomonFixBlockHeight {
+	if bav._isForkActive(ForkNameSalomonFix, blockHeight) {
 		// Following the SalomonFixBlockHeight block, if a user would be left with less than
 		// bav.Params.CreatorCoinAutoSellThresholdNanos, we clear all their remaining holdings
 		// to prevent 1 or 2 lingering creator coin nanos from staying in their wallet.
@@ -5805,6 +7116,39 @@ func (bav *UtxoView) ValidateDiamondsAndGetNumCreatorCoinNanos(
 	return creatorCoinToTransferNanos, netNewDiamonds, nil
 }
 
+// _checkCreatorCoinTransferRestriction returns an error if the profile's
+// TransferRestrictionStatus doesn't allow its coin to be transferred from the
+// sender to the receiver. The sender is nil for a buy since the coins come from
+// the bonding curve rather than another holder. Sells aren't restricted so
+// holders can always get out of a coin.
+func (bav *UtxoView) _checkCreatorCoinTransferRestriction(
+	profileEntry *ProfileEntry, senderPublicKey []byte, receiverPublicKey []byte) error {
+
+	if reflect.DeepEqual(senderPublicKey, profileEntry.PublicKey) ||
+		reflect.DeepEqual(receiverPublicKey, profileEntry.PublicKey) {
+
+		return nil
+	}
+
+	switch profileEntry.TransferRestrictionStatus {
+	case TransferRestrictionStatusProfileOwnerOnly:
+		return errors.Wrapf(RuleErrorCreatorCoinTransferRestrictedToProfileOwner,
+			"_checkCreatorCoinTransferRestriction: Profile %v", PkToStringBoth(profileEntry.PublicKey))
+
+	case TransferRestrictionStatusDAOMembersOnly:
+		receiverBalanceEntry, _, _ := bav._getBalanceEntryForHODLerPubKeyAndCreatorPubKey(
+			receiverPublicKey, profileEntry.PublicKey)
+		if receiverBalanceEntry == nil || receiverBalanceEntry.isDeleted ||
+			receiverBalanceEntry.BalanceNanos == 0 {
+
+			return errors.Wrapf(RuleErrorCreatorCoinTransferRestrictedToDAOMembers,
+				"_checkCreatorCoinTransferRestriction: Receiver %v doesn't hold the coin of profile %v",
+				PkToStringBoth(receiverPublicKey), PkToStringBoth(profileEntry.PublicKey))
+		}
+	}
+	return nil
+}
+
 func (bav *UtxoView) _connectCreatorCoinTransfer(
 	txn *MsgBitCloutTxn, txHash *BlockHash, blockHeight uint32, verifySignatures bool) (
 	_totalInput uint64, _totalOutput uint64, _utxoOps []*UtxoOperation, _err error) {
@@ -5885,6 +7229,14 @@ func (bav *UtxoView) _connectCreatorCoinTransfer(
 			txMeta.CreatorCoinToTransferNanos, senderBalanceEntry.BalanceNanos)
 	}
 
+	// Check that the creator allows this transfer. Transfers to or from the
+	// profile owner are always allowed, which is how a DAO takes on new members.
+	if err := bav._checkCreatorCoinTransferRestriction(
+		existingProfileEntry, txn.PublicKey, txMeta.ReceiverPublicKey); err != nil {
+
+		return 0, 0, nil, errors.Wrapf(err, "_connectCreatorCoinTransfer: ")
+	}
+
 	// Now that we have validated this transaction, let's build the new BalanceEntry state.
 
 	// Look up a BalanceEntry for the receiver.
@@ -6158,6 +7510,18 @@ func (bav *UtxoView) _connectTransaction(txn *MsgBitCloutTxn, txHash *BlockHash,
 			bav._connectSwapIdentity(
 				txn, txHash, blockHeight, verifySignatures)
 
+	} else if txn.TxnMeta.GetTxnType() == TxnTypePoll {
+		totalInput, totalOutput, utxoOpsForTxn, err =
+			bav._connectPoll(txn, txHash, blockHeight, verifySignatures)
+
+	} else if txn.TxnMeta.GetTxnType() == TxnTypeAuthorizeDerivedKey {
+		totalInput, totalOutput, utxoOpsForTxn, err =
+			bav._connectAuthorizeDerivedKey(txn, txHash, blockHeight, verifySignatures)
+
+	} else if txn.TxnMeta.GetTxnType() == TxnTypeUpdateTransferRestriction {
+		totalInput, totalOutput, utxoOpsForTxn, err =
+			bav._connectUpdateTransferRestriction(txn, txHash, blockHeight, verifySignatures)
+
 	} else {
 		err = fmt.Errorf("ConnectTransaction: Unimplemented txn type %v", txn.TxnMeta.GetTxnType().String())
 	}
@@ -6276,6 +7640,12 @@ func (bav *UtxoView) ConnectBlock(
 		return nil, RuleErrorBlockRewardExceedsMaxAllowed
 	}
 
+	// Record the balance of every public key the block touched if the node is
+	// keeping balance snapshots.
+	if err := bav._setBalanceSnapshotsForBlock(uint32(blockHeader.Height), utxoOps); err != nil {
+		return nil, errors.Wrapf(err, "ConnectBlock: ")
+	}
+
 	// If we made it to the end and this block is valid, advance the tip
 	// of the view to reflect that.
 	blockHash, err := bitcloutBlock.Header.Hash()
@@ -6532,10 +7902,10 @@ func (bav *UtxoView) GetPostsPaginatedForPublicKeyOrderedByTimestamp(publicKey [
 	}
 	timestampSizeBytes := 8
 	var posts []*PostEntry
-	err := handle.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
 
-		opts.PrefetchValues = false
+		opts.KeysOnly = true
 
 		// Go in reverse order
 		opts.Reverse = true
@@ -6548,7 +7918,7 @@ func (bav *UtxoView) GetPostsPaginatedForPublicKeyOrderedByTimestamp(publicKey [
 			it.Next()
 		}
 		for ; it.ValidForPrefix(dbPrefix) && uint64(len(posts)) < limit; it.Next() {
-			rawKey := it.Item().Key()
+			rawKey := it.Key()
 
 			keyWithoutPrefix := rawKey[1:]
 			//posterPublicKey := keyWithoutPrefix[:HashSizeBytes]
@@ -6778,7 +8148,7 @@ func (bav *UtxoView) GetUnspentUtxoEntrysForPublicKey(pkBytes []byte) ([]*UtxoEn
 	return utxoEntriesToReturn, nil
 }
 
-func (bav *UtxoView) _flushUtxosToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushUtxosToDbWithTxn(txn KVTxn) error {
 	glog.Debugf("_flushUtxosToDbWithTxn: flushing %d mappings", len(bav.UtxoKeyToUtxoEntry))
 
 	for utxoKeyIter, utxoEntry := range bav.UtxoKeyToUtxoEntry {
@@ -6833,7 +8203,7 @@ func (bav *UtxoView) _flushUtxosToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushGlobalParamsEntryToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushGlobalParamsEntryToDbWithTxn(txn KVTxn) error {
 	globalParamsEntry := bav.GlobalParamsEntry
 	if err := DbPutGlobalParamsEntryWithTxn(txn, *globalParamsEntry); err != nil {
 		return errors.Wrapf(err, "_flushGlobalParamsEntryToDbWithTxn: Problem putting global params entry in DB")
@@ -6841,7 +8211,7 @@ func (bav *UtxoView) _flushGlobalParamsEntryToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushForbiddenPubKeyEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushForbiddenPubKeyEntriesToDbWithTxn(txn KVTxn) error {
 
 	// Go through all the entries in the KeyTorecloutEntry map.
 	for _, forbiddenPubKeyEntry := range bav.ForbiddenPubKeyToForbiddenPubKeyEntry {
@@ -6871,7 +8241,7 @@ func (bav *UtxoView) _flushForbiddenPubKeyEntriesToDbWithTxn(txn *badger.Txn) er
 	return nil
 }
 
-func (bav *UtxoView) _flushBitcoinExchangeDataWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushBitcoinExchangeDataWithTxn(txn KVTxn) error {
 	// Iterate through our in-memory map. If anything has a value of false it means
 	// that particular mapping should be expunged from the db. If anything has a value
 	// of true it means that mapping should be added to the db.
@@ -6910,7 +8280,7 @@ func (bav *UtxoView) _flushBitcoinExchangeDataWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushMessageEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushMessageEntriesToDbWithTxn(txn KVTxn) error {
 	// Go through all the entries in the MessageKeyToMessageEntry map.
 	for messageKeyIter, messageEntry := range bav.MessageKeyToMessageEntry {
 		// Make a copy of the iterator since we take references to it below.
@@ -6947,7 +8317,8 @@ func (bav *UtxoView) _flushMessageEntriesToDbWithTxn(txn *badger.Txn) error {
 		} else {
 			// If the MessageEntry has (isDeleted = false) then we put the corresponding
 			// mappings for it into the db.
-			if err := DbPutMessageEntryWithTxn(txn, messageEntry); err != nil {
+			if err := DbPutMessageEntryWithTxn(
+				txn, messageEntry, bav.flushMaxIndexedTstampNanos); err != nil {
 
 				return err
 			}
@@ -6959,7 +8330,7 @@ func (bav *UtxoView) _flushMessageEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushRecloutEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushRecloutEntriesToDbWithTxn(txn KVTxn) error {
 
 	// Go through all the entries in the recloutKeyTorecloutEntry map.
 	for recloutKeyIter, recloutEntry := range bav.RecloutKeyToRecloutEntry {
@@ -7003,7 +8374,7 @@ func (bav *UtxoView) _flushRecloutEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushLikeEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushLikeEntriesToDbWithTxn(txn KVTxn) error {
 
 	// Go through all the entries in the LikeKeyToLikeEntry map.
 	for likeKeyIter, likeEntry := range bav.LikeKeyToLikeEntry {
@@ -7052,7 +8423,115 @@ func (bav *UtxoView) _flushLikeEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushFollowEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushPollEntriesToDbWithTxn(txn KVTxn) error {
+
+	// Go through all the entries in the PostHashToPollEntry map.
+	for postHashIter, pollEntry := range bav.PostHashToPollEntry {
+		// Make a copy of the iterator since we make references to it below.
+		postHash := postHashIter
+
+		// Sanity-check that the post hash in the PollEntry is equal to the
+		// post hash that maps to that entry.
+		if *pollEntry.PostHash != postHash {
+			return fmt.Errorf("_flushPollEntriesToDbWithTxn: PollEntry has "+
+				"PostHash: %v, which doesn't match the PostHashToPollEntry map key %v",
+				pollEntry.PostHash, &postHash)
+		}
+
+		// Delete the existing mappings in the db for this poll. They will be re-added
+		// if the corresponding entry in memory has isDeleted=false. A poll's
+		// options never change so the entry knows which vote counts to delete.
+		if err := DbDeletePollEntryWithTxn(txn, pollEntry); err != nil {
+			return errors.Wrapf(
+				err, "_flushPollEntriesToDbWithTxn: Problem deleting mappings "+
+					"for poll: %v: ", &postHash)
+		}
+	}
+	for _, pollEntry := range bav.PostHashToPollEntry {
+		if pollEntry.isDeleted {
+			// If the PollEntry has isDeleted=true then there's nothing to do because
+			// we already deleted the entry above.
+		} else {
+			if err := DbPutPollEntryWithTxn(txn, pollEntry); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Do the same for the votes.
+	for pollVoteKeyIter, pollVoteEntry := range bav.PollVoteKeyToPollVoteEntry {
+		// Make a copy of the iterator since we make references to it below.
+		pollVoteKey := pollVoteKeyIter
+
+		// Sanity-check that the PollVoteKey computed from the PollVoteEntry is
+		// equal to the PollVoteKey that maps to that entry.
+		pollVoteKeyInEntry := MakePollVoteKey(pollVoteEntry.VoterPKID, *pollVoteEntry.PostHash)
+		if pollVoteKeyInEntry != pollVoteKey {
+			return fmt.Errorf("_flushPollEntriesToDbWithTxn: PollVoteEntry has "+
+				"PollVoteKey: %v, which doesn't match the PollVoteKeyToPollVoteEntry map key %v",
+				&pollVoteKeyInEntry, &pollVoteKey)
+		}
+
+		if err := DbDeletePollVoteEntryWithTxn(txn, pollVoteEntry); err != nil {
+			return errors.Wrapf(
+				err, "_flushPollEntriesToDbWithTxn: Problem deleting mappings "+
+					"for PollVoteKey: %v: ", &pollVoteKey)
+		}
+	}
+	for _, pollVoteEntry := range bav.PollVoteKeyToPollVoteEntry {
+		if pollVoteEntry.isDeleted {
+			// If the PollVoteEntry has isDeleted=true then there's nothing to do because
+			// we already deleted the entry above.
+		} else {
+			if err := DbPutPollVoteEntryWithTxn(txn, pollVoteEntry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (bav *UtxoView) _flushDerivedKeyEntriesToDbWithTxn(txn KVTxn) error {
+
+	// Go through all the entries in the DerivedKeyMapKeyToDerivedKeyEntry map.
+	for derivedKeyMapKeyIter, derivedKeyEntry := range bav.DerivedKeyMapKeyToDerivedKeyEntry {
+		// Make a copy of the iterator since we make references to it below.
+		derivedKeyMapKey := derivedKeyMapKeyIter
+
+		// Sanity-check that the DerivedKeyMapKey computed from the DerivedKeyEntry
+		// is equal to the DerivedKeyMapKey that maps to that entry.
+		derivedKeyMapKeyInEntry := MakeDerivedKeyMapKey(
+			derivedKeyEntry.OwnerPKID, derivedKeyEntry.DerivedPublicKey)
+		if derivedKeyMapKeyInEntry != derivedKeyMapKey {
+			return fmt.Errorf("_flushDerivedKeyEntriesToDbWithTxn: DerivedKeyEntry has "+
+				"DerivedKeyMapKey: %v, which doesn't match the DerivedKeyMapKeyToDerivedKeyEntry "+
+				"map key %v", &derivedKeyMapKeyInEntry, &derivedKeyMapKey)
+		}
+
+		// Delete the existing mappings in the db for this DerivedKeyMapKey. They
+		// will be re-added if the corresponding entry in memory has isDeleted=false.
+		if err := DbDeleteDerivedKeyEntryWithTxn(txn, derivedKeyEntry); err != nil {
+			return errors.Wrapf(
+				err, "_flushDerivedKeyEntriesToDbWithTxn: Problem deleting mappings "+
+					"for DerivedKeyMapKey: %v: ", &derivedKeyMapKey)
+		}
+	}
+	for _, derivedKeyEntry := range bav.DerivedKeyMapKeyToDerivedKeyEntry {
+		if derivedKeyEntry.isDeleted {
+			// If the DerivedKeyEntry has isDeleted=true then there's nothing to do
+			// because we already deleted the entry above.
+		} else {
+			if err := DbPutDerivedKeyEntryWithTxn(txn, derivedKeyEntry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (bav *UtxoView) _flushFollowEntriesToDbWithTxn(txn KVTxn) error {
 
 	// Go through all the entries in the FollowKeyToFollowEntry map.
 	for followKeyIter, followEntry := range bav.FollowKeyToFollowEntry {
@@ -7101,7 +8580,7 @@ func (bav *UtxoView) _flushFollowEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushDiamondEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushDiamondEntriesToDbWithTxn(txn KVTxn) error {
 
 	// Go through and delete all the entries so they can be added back fresh.
 	for diamondKeyIter, diamondEntry := range bav.DiamondKeyToDiamondEntry {
@@ -7150,7 +8629,7 @@ func (bav *UtxoView) _flushDiamondEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushPostEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushPostEntriesToDbWithTxn(txn KVTxn) error {
 	// TODO(DELETEME): Remove flush logging after debugging MarkBlockInvalid bug.
 	glog.Debugf("_flushPostEntriesToDbWithTxn: flushing %d mappings", len(bav.PostHashToPostEntry))
 
@@ -7187,7 +8666,8 @@ func (bav *UtxoView) _flushPostEntriesToDbWithTxn(txn *badger.Txn) error {
 			numPut++
 			// If the PostEntry has (isDeleted = false) then we put the corresponding
 			// mappings for it into the db.
-			if err := DBPutPostEntryMappingsWithTxn(txn, postEntry, bav.Params); err != nil {
+			if err := DBPutPostEntryMappingsWithTxn(
+				txn, postEntry, bav.Params, bav.flushMaxIndexedTstampNanos); err != nil {
 
 				return err
 			}
@@ -7201,7 +8681,7 @@ func (bav *UtxoView) _flushPostEntriesToDbWithTxn(txn *badger.Txn) error {
 
 	return nil
 }
-func (bav *UtxoView) _flushPKIDEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushPKIDEntriesToDbWithTxn(txn KVTxn) error {
 	for pubKeyIter, pkidEntry := range bav.PublicKeyToPKIDEntry {
 		pubKeyCopy := make([]byte, btcec.PubKeyBytesLenCompressed)
 		copy(pubKeyCopy, pubKeyIter[:])
@@ -7254,7 +8734,7 @@ func (bav *UtxoView) _flushPKIDEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushProfileEntriesToDbWithTxn(txn *badger.Txn) error {
+func (bav *UtxoView) _flushProfileEntriesToDbWithTxn(txn KVTxn) error {
 	glog.Debugf("_flushProfilesToDbWithTxn: flushing %d mappings", len(bav.ProfilePKIDToProfileEntry))
 
 	// Go through all the entries in the ProfilePublicKeyToProfileEntry map.
@@ -7310,7 +8790,136 @@ func (bav *UtxoView) _flushProfileEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) _flushBalanceEntriesToDbWithTxn(txn *badger.Txn) error {
+// _tipHeightWithTxn returns the height of the block the view is currently
+// referencing, or zero if the view doesn't reference a block yet (e.g. while
+// seed txns are being connected at genesis).
+func (bav *UtxoView) _tipHeightWithTxn(txn KVTxn) uint32 {
+	if bav.TipHash == nil {
+		return 0
+	}
+	tipBlock := GetBlockWithTxn(txn, bav.TipHash)
+	if tipBlock == nil || tipBlock.Header == nil {
+		return 0
+	}
+	return uint32(tipBlock.Header.Height)
+}
+
+// _maxIndexedTstampNanosWithTxn returns the latest post or message timestamp a
+// flush can put in the time-ordered indexes given the block the view is
+// currently referencing. Nothing is quarantined if the view doesn't reference a
+// block yet.
+func (bav *UtxoView) _maxIndexedTstampNanosWithTxn(txn KVTxn) uint64 {
+	if bav.TipHash == nil {
+		return math.MaxUint64
+	}
+	tipBlock := GetBlockWithTxn(txn, bav.TipHash)
+	if tipBlock == nil || tipBlock.Header == nil {
+		return math.MaxUint64
+	}
+	return DbGetMaxIndexedTstampNanosWithTxn(txn, tipBlock.Header.TstampSecs)
+}
+
+func (bav *UtxoView) _flushContentHashesToDbWithTxn(txn KVTxn) error {
+	// Record the image URLs in the posts submitted in the view. Posts carry their
+	// own confirmation height so we use that. The posts are visited in order of
+	// height and then post hash so that when two posts in the same block share an
+	// image, the same one is recorded no matter how the map is iterated.
+	postEntries := []*PostEntry{}
+	for postHash := range bav.ContentHashPostHashes {
+		postEntry := bav.PostHashToPostEntry[postHash]
+		if postEntry == nil || postEntry.isDeleted || len(postEntry.Body) == 0 {
+			continue
+		}
+		postEntries = append(postEntries, postEntry)
+	}
+	sort.Slice(postEntries, func(ii, jj int) bool {
+		return _postEntryFirstSeenLess(postEntries[ii], postEntries[jj])
+	})
+	for _, postEntry := range postEntries {
+		posterPKID := bav.GetPKIDForPublicKey(postEntry.PosterPublicKey)
+		for _, contentHash := range ContentHashesForPostBody(postEntry.Body) {
+			err := DbPutContentHashFirstSeenEntryIfAbsentWithTxn(txn, &ContentHashFirstSeenEntry{
+				ContentHash: contentHash,
+				PostHash:    postEntry.PostHash,
+				OwnerPKID:   posterPKID.PKID,
+				BlockHeight: postEntry.ConfirmationBlockHeight,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "_flushContentHashesToDbWithTxn: Problem "+
+					"recording image for post %v: ", postEntry.PostHash)
+			}
+		}
+	}
+
+	// Record the profile pics set in the view. Profiles don't track a height so
+	// use the height of the tip, which is only looked up if we need it.
+	profilePKIDs := []PKID{}
+	for profilePKID := range bav.ContentHashProfilePKIDs {
+		profilePKIDs = append(profilePKIDs, profilePKID)
+	}
+	sort.Slice(profilePKIDs, func(ii, jj int) bool {
+		return bytes.Compare(profilePKIDs[ii][:], profilePKIDs[jj][:]) < 0
+	})
+	var tipHeight *uint32
+	for _, profilePKIDIter := range profilePKIDs {
+		// Make a copy of the iterator since we take references to it below.
+		profilePKID := profilePKIDIter
+
+		profileEntry := bav.ProfilePKIDToProfileEntry[profilePKID]
+		if profileEntry == nil || profileEntry.isDeleted || len(profileEntry.ProfilePic) == 0 {
+			continue
+		}
+		contentHash := ContentHashForProfilePic(profileEntry.ProfilePic)
+		if DbGetContentHashFirstSeenEntryWithTxn(txn, contentHash) != nil {
+			continue
+		}
+		if tipHeight == nil {
+			height := bav._tipHeightWithTxn(txn)
+			tipHeight = &height
+		}
+		err := DbPutContentHashFirstSeenEntryIfAbsentWithTxn(txn, &ContentHashFirstSeenEntry{
+			ContentHash: contentHash,
+			ProfilePKID: &profilePKID,
+			OwnerPKID:   &profilePKID,
+			BlockHeight: *tipHeight,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "_flushContentHashesToDbWithTxn: Problem "+
+				"recording profile pic for pkid %v: ", PkToString(profilePKID[:], bav.Params))
+		}
+	}
+
+	return nil
+}
+
+func (bav *UtxoView) _flushReleasedUsernameEntriesToDbWithTxn(txn KVTxn) error {
+	// Go through all the entries in the map.
+	for _, releasedUsernameEntry := range bav.ReleasedUsernameToReleasedUsernameEntry {
+		// Delete the existing mappings in the db for this entry. They will be re-added
+		// if the corresponding entry in memory has isDeleted=false.
+		if err := DbDeleteReleasedUsernameEntryWithTxn(txn, releasedUsernameEntry.Username); err != nil {
+			return errors.Wrapf(
+				err, "_flushReleasedUsernameEntriesToDbWithTxn: Problem deleting "+
+					"released username: %v: ", string(releasedUsernameEntry.Username))
+		}
+	}
+	for _, releasedUsernameEntry := range bav.ReleasedUsernameToReleasedUsernameEntry {
+		if releasedUsernameEntry.isDeleted {
+			// If the entry has isDeleted=true then there's nothing to do because
+			// we already deleted the entry above.
+		} else {
+			// If the entry has (isDeleted = false) then we put the corresponding
+			// mappings for it into the db.
+			if err := DbPutReleasedUsernameEntryWithTxn(txn, releasedUsernameEntry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (bav *UtxoView) _flushBalanceEntriesToDbWithTxn(txn KVTxn) error {
 	glog.Debugf("_flushBalanceEntriesToDbWithTxn: flushing %d mappings", len(bav.HODLerPKIDCreatorPKIDToBalanceEntry))
 
 	// Go through all the entries in the HODLerPubKeyCreatorPubKeyToBalanceEntry map.
@@ -7367,69 +8976,171 @@ func (bav *UtxoView) _flushBalanceEntriesToDbWithTxn(txn *badger.Txn) error {
 	return nil
 }
 
-func (bav *UtxoView) FlushToDbWithTxn(txn *badger.Txn) error {
-	// Flush the utxos to the db.
-	if err := bav._flushUtxosToDbWithTxn(txn); err != nil {
-		return err
-	}
+func (bav *UtxoView) _flushBalanceSnapshotsToDbWithTxn(txn KVTxn) error {
+	glog.Debugf("_flushBalanceSnapshotsToDbWithTxn: flushing %d mappings",
+		len(bav.BalanceSnapshotKeyToBalanceSnapshotEntry))
 
-	if err := bav._flushBitcoinExchangeDataWithTxn(txn); err != nil {
-		return err
+	// The snapshots left in the db get cleared out when they're seeded again.
+	if bav.invalidateBalanceSnapshots {
+		glog.Warningf("_flushBalanceSnapshotsToDbWithTxn: A block at or below the " +
+			"height balance snapshots were seeded at was disconnected; they will " +
+			"be seeded again when the node restarts")
+		return DbDeleteBalanceSnapshotsStartHeightWithTxn(txn)
 	}
 
-	if err := bav._flushGlobalParamsEntryToDbWithTxn(txn); err != nil {
-		return err
-	}
+	for _, snapshotEntry := range bav.BalanceSnapshotKeyToBalanceSnapshotEntry {
+		if snapshotEntry.isDeleted {
+			if err := DbDeleteBalanceSnapshotWithTxn(
+				txn, snapshotEntry.PublicKey, snapshotEntry.BlockHeight); err != nil {
 
-	if err := bav._flushForbiddenPubKeyEntriesToDbWithTxn(txn); err != nil {
-		return err
+				return errors.Wrapf(err, "_flushBalanceSnapshotsToDbWithTxn: ")
+			}
+		} else {
+			if err := DbPutBalanceSnapshotWithTxn(txn, snapshotEntry.PublicKey,
+				snapshotEntry.BlockHeight, snapshotEntry.BalanceNanos); err != nil {
+
+				return errors.Wrapf(err, "_flushBalanceSnapshotsToDbWithTxn: ")
+			}
+		}
 	}
 
-	if err := bav._flushMessageEntriesToDbWithTxn(txn); err != nil {
-		return err
+	return nil
+}
+
+// _flushFuncs returns the functions that flush each part of the view to the db,
+// in the order they have to run.
+func (bav *UtxoView) _flushFuncs() []func(txn KVTxn) error {
+	return []func(txn KVTxn) error{
+		bav._flushUtxosToDbWithTxn,
+		bav._flushBitcoinExchangeDataWithTxn,
+		bav._flushGlobalParamsEntryToDbWithTxn,
+		bav._flushForbiddenPubKeyEntriesToDbWithTxn,
+		bav._flushMessageEntriesToDbWithTxn,
+		bav._flushLikeEntriesToDbWithTxn,
+		bav._flushFollowEntriesToDbWithTxn,
+		bav._flushDiamondEntriesToDbWithTxn,
+		bav._flushRecloutEntriesToDbWithTxn,
+		bav._flushPollEntriesToDbWithTxn,
+		bav._flushDerivedKeyEntriesToDbWithTxn,
+		bav._flushPostEntriesToDbWithTxn,
+		bav._flushProfileEntriesToDbWithTxn,
+		bav._flushReleasedUsernameEntriesToDbWithTxn,
+		bav._flushContentHashesToDbWithTxn,
+		bav._flushBalanceEntriesToDbWithTxn,
+		bav._flushPKIDEntriesToDbWithTxn,
+		bav._flushBalanceSnapshotsToDbWithTxn,
+	}
+}
+
+// _flushStateCommitmentToDbWithTxn stores the state accumulator the flush moved
+// along with the committed keys it wrote and records the commitment for the tip.
+// It does nothing unless the node is keeping state commitments, in which case
+// stateAccumulator is the one the flush went through.
+func (bav *UtxoView) _flushStateCommitmentToDbWithTxn(txn KVTxn,
+	stateAccumulator *StateAccumulator) error {
+
+	if stateAccumulator == nil {
+		return nil
 	}
 
-	if err := bav._flushLikeEntriesToDbWithTxn(txn); err != nil {
-		return err
+	if bav.stateCommitmentsStaleFromHeight != 0 {
+		if err := DbDeleteStateCommitmentsFromHeightWithTxn(
+			txn, bav.stateCommitmentsStaleFromHeight); err != nil {
+
+			return errors.Wrapf(err, "_flushStateCommitmentToDbWithTxn: Problem "+
+				"deleting stale commitments")
+		}
 	}
+	if err := DbPutStateCommitmentWithTxn(
+		txn, bav._tipHeightWithTxn(txn), stateAccumulator.Commitment()); err != nil {
 
-	if err := bav._flushFollowEntriesToDbWithTxn(txn); err != nil {
-		return err
+		return errors.Wrapf(err, "_flushStateCommitmentToDbWithTxn: ")
 	}
+	return DbPutStateAccumulatorWithTxn(txn, stateAccumulator)
+}
 
-	if err := bav._flushDiamondEntriesToDbWithTxn(txn); err != nil {
-		return err
+func (bav *UtxoView) FlushToDbWithTxn(txn KVTxn) error {
+	// When the node is keeping state commitments the view is flushed through a
+	// txn that moves the state accumulator along with every committed key the
+	// view writes.
+	stateAccumulator, err := DbGetStateAccumulatorWithTxn(txn)
+	if err != nil {
+		return errors.Wrapf(err, "FlushToDbWithTxn: ")
+	}
+	flushTxn := txn
+	if stateAccumulator != nil {
+		flushTxn = &stateCommitmentKVTxn{KVTxn: txn, acc: stateAccumulator}
 	}
 
-	if err := bav._flushRecloutEntriesToDbWithTxn(txn); err != nil {
-		return err
+	bav.flushMaxIndexedTstampNanos = bav._maxIndexedTstampNanosWithTxn(txn)
+	for _, flushFunc := range bav._flushFuncs() {
+		if err := flushFunc(flushTxn); err != nil {
+			return err
+		}
 	}
 
-	if err := bav._flushPostEntriesToDbWithTxn(txn); err != nil {
-		return err
+	return bav._flushStateCommitmentToDbWithTxn(txn, stateAccumulator)
+}
+
+// FlushToDbWithWriteBatch flushes the view through a DbWriteBatch, so it works for
+// a view with more writes than fit in a single txn. The writes are worked out
+// against a read-only txn first and then written in batches, so unlike FlushToDb
+// they don't land atomically and nothing else should write to the db while it
+// runs. onProgress is passed through to the DbWriteBatch.
+func (bav *UtxoView) FlushToDbWithWriteBatch(
+	progressInterval uint64, onProgress func(numWrites uint64)) error {
+
+	if err := DbPutCrashBreadcrumb(
+		bav.Handle, CrashBreadcrumbPhaseBatchedFlushView, bav.TipHash); err != nil {
+
+		return errors.Wrapf(err, "FlushToDbWithWriteBatch: Problem recording crash breadcrumb")
 	}
-	if err := bav._flushProfileEntriesToDbWithTxn(txn); err != nil {
-		return err
+
+	defer DbCacheFinishWrites()
+	var writeSetTxn *kvWriteSetTxn
+	err := DbView(bav.Handle, func(txn KVTxn) error {
+		writeSetTxn = newKVWriteSetTxn(txn)
+		return bav.FlushToDbWithTxn(writeSetTxn)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "FlushToDbWithWriteBatch: ")
 	}
-	if err := bav._flushBalanceEntriesToDbWithTxn(txn); err != nil {
-		return err
+	err = DbUpdateWithWriteBatch(bav.Handle, progressInterval, onProgress, writeSetTxn.writeTo)
+	if err != nil {
+		return errors.Wrapf(err, "FlushToDbWithWriteBatch: Problem writing batch")
 	}
-	if err := bav._flushPKIDEntriesToDbWithTxn(txn); err != nil {
-		return err
+
+	if err := DbDeleteCrashBreadcrumb(bav.Handle); err != nil {
+		return errors.Wrapf(err, "FlushToDbWithWriteBatch: Problem clearing crash breadcrumb")
 	}
 
+	// Reset the view the same way FlushToDb does.
+	bav._ResetViewMappingsAfterFlush()
+
 	return nil
 }
 
 func (bav *UtxoView) FlushToDb() error {
-	// Make sure everything happens inside a single transaction.
-	err := bav.Handle.Update(func(txn *badger.Txn) error {
-		return bav.FlushToDbWithTxn(txn)
-	})
+	if err := DbPutCrashBreadcrumb(bav.Handle, CrashBreadcrumbPhaseFlushView, bav.TipHash); err != nil {
+		return errors.Wrapf(err, "FlushToDb: Problem recording crash breadcrumb")
+	}
+
+	// Make sure everything happens inside a single transaction. A view with more
+	// writes than fit in one is flushed through a write batch instead.
+	err := DbAtomicUpdate(bav.Handle, bav.FlushToDbWithTxn)
+	if errors.Cause(err) == badger.ErrTxnTooBig {
+		glog.Warningf("FlushToDb: View at tip %v doesn't fit in a txn; flushing "+
+			"it through a write batch", bav.TipHash)
+		return bav.FlushToDbWithWriteBatch(0, nil)
+	}
 	if err != nil {
 		return err
 	}
 
+	if err := DbDeleteCrashBreadcrumb(bav.Handle); err != nil {
+		return errors.Wrapf(err, "FlushToDb: Problem clearing crash breadcrumb")
+	}
+
 	// After a successful flush, reset the in-memory mappings for the view
 	// so that it can be re-used if desired.
 	//
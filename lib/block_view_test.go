@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -1013,6 +1014,181 @@ func _doLikeTxn(t *testing.T, chain *Blockchain, db *badger.DB,
 	return utxoOps, txn, blockHeight, nil
 }
 
+func _doPollTxn(t *testing.T, chain *Blockchain, db *badger.DB,
+	params *BitCloutParams, feeRateNanosPerKB uint64, senderPkBase58Check string,
+	postHash BlockHash, operationType PollOperationType, options [][]byte,
+	optionIndex uint64, senderPrivBase58Check string) (
+	_utxoOps []*UtxoOperation, _txn *MsgBitCloutTxn, _height uint32, _err error) {
+
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	senderPkBytes, _, err := Base58CheckDecode(senderPkBase58Check)
+	require.NoError(err)
+
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+
+	txn, totalInputMake, changeAmountMake, feesMake, err := chain.CreatePollTxn(
+		senderPkBytes, postHash, operationType, options, optionIndex, feeRateNanosPerKB, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	require.Equal(totalInputMake, changeAmountMake+feesMake)
+
+	// Sign the transaction now that its inputs are set up.
+	_signTxn(t, txn, senderPrivBase58Check)
+
+	txHash := txn.Hash()
+	// Always use height+1 for validation since it's assumed the transaction will
+	// get mined into the next block.
+	blockHeight := chain.blockTip().Height + 1
+	utxoOps, totalInput, totalOutput, fees, err :=
+		utxoView.ConnectTransaction(txn, txHash, getTxnSize(*txn), blockHeight, true, /*verifySignature*/
+			false /*ignoreUtxos*/)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	require.Equal(totalInput, totalOutput+fees)
+	require.Equal(totalInput, totalInputMake)
+
+	// We should have one SPEND UtxoOperation for each input, one ADD operation
+	// for each output, and one OperationTypePoll operation at the end.
+	require.Equal(len(txn.TxInputs)+len(txn.TxOutputs)+1, len(utxoOps))
+	for ii := 0; ii < len(txn.TxInputs); ii++ {
+		require.Equal(OperationTypeSpendUtxo, utxoOps[ii].Type)
+	}
+	require.Equal(OperationTypePoll, utxoOps[len(utxoOps)-1].Type)
+
+	require.NoError(utxoView.FlushToDb())
+
+	return utxoOps, txn, blockHeight, nil
+}
+
+func _doAuthorizeDerivedKeyTxn(t *testing.T, chain *Blockchain, db *badger.DB,
+	params *BitCloutParams, feeRateNanosPerKB uint64, ownerPkBase58Check string,
+	derivedPublicKey []byte, expirationBlock uint64,
+	operationType AuthorizeDerivedKeyOperationType,
+	transactionSpendingLimit *TransactionSpendingLimit, ownerPrivBase58Check string) (
+	_utxoOps []*UtxoOperation, _txn *MsgBitCloutTxn, _height uint32, _err error) {
+
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	ownerPkBytes, _, err := Base58CheckDecode(ownerPkBase58Check)
+	require.NoError(err)
+
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+
+	txn, totalInputMake, changeAmountMake, feesMake, err := chain.CreateAuthorizeDerivedKeyTxn(
+		ownerPkBytes, derivedPublicKey, expirationBlock, operationType,
+		transactionSpendingLimit, feeRateNanosPerKB, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	require.Equal(totalInputMake, changeAmountMake+feesMake)
+
+	// Sign the transaction now that its inputs are set up.
+	_signTxn(t, txn, ownerPrivBase58Check)
+
+	txHash := txn.Hash()
+	// Always use height+1 for validation since it's assumed the transaction will
+	// get mined into the next block.
+	blockHeight := chain.blockTip().Height + 1
+	utxoOps, totalInput, totalOutput, fees, err :=
+		utxoView.ConnectTransaction(txn, txHash, getTxnSize(*txn), blockHeight, true, /*verifySignature*/
+			false /*ignoreUtxos*/)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	require.Equal(totalInput, totalOutput+fees)
+	require.Equal(totalInput, totalInputMake)
+
+	// We should have one SPEND UtxoOperation for each input, one ADD operation
+	// for each output, and one OperationTypeAuthorizeDerivedKey operation at the end.
+	require.Equal(len(txn.TxInputs)+len(txn.TxOutputs)+1, len(utxoOps))
+	for ii := 0; ii < len(txn.TxInputs); ii++ {
+		require.Equal(OperationTypeSpendUtxo, utxoOps[ii].Type)
+	}
+	require.Equal(OperationTypeAuthorizeDerivedKey, utxoOps[len(utxoOps)-1].Type)
+
+	require.NoError(utxoView.FlushToDb())
+
+	return utxoOps, txn, blockHeight, nil
+}
+
+func _doUpdateTransferRestrictionTxn(t *testing.T, chain *Blockchain, db *badger.DB,
+	params *BitCloutParams, feeRateNanosPerKB uint64, profilePkBase58Check string,
+	transferRestrictionStatus TransferRestrictionStatus, profilePrivBase58Check string) (
+	_utxoOps []*UtxoOperation, _txn *MsgBitCloutTxn, _height uint32, _err error) {
+
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	profilePkBytes, _, err := Base58CheckDecode(profilePkBase58Check)
+	require.NoError(err)
+
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+
+	txn, totalInputMake, changeAmountMake, feesMake, err := chain.CreateUpdateTransferRestrictionTxn(
+		profilePkBytes, transferRestrictionStatus, feeRateNanosPerKB, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	require.Equal(totalInputMake, changeAmountMake+feesMake)
+
+	// Sign the transaction now that its inputs are set up.
+	_signTxn(t, txn, profilePrivBase58Check)
+
+	// Hold on to the entry the view has before the update so we can check that
+	// the update doesn't change it in place.
+	prevProfileEntry := utxoView.GetProfileEntryForPublicKey(profilePkBytes)
+	var prevStatus TransferRestrictionStatus
+	if prevProfileEntry != nil {
+		prevStatus = prevProfileEntry.TransferRestrictionStatus
+	}
+
+	txHash := txn.Hash()
+	// Always use height+1 for validation since it's assumed the transaction will
+	// get mined into the next block.
+	blockHeight := chain.blockTip().Height + 1
+	utxoOps, totalInput, totalOutput, fees, err :=
+		utxoView.ConnectTransaction(txn, txHash, getTxnSize(*txn), blockHeight, true, /*verifySignature*/
+			false /*ignoreUtxos*/)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	require.Equal(totalInput, totalOutput+fees)
+	require.Equal(totalInput, totalInputMake)
+
+	// We should have one SPEND UtxoOperation for each input, one ADD operation
+	// for each output, and one OperationTypeUpdateTransferRestriction operation at the end.
+	require.Equal(len(txn.TxInputs)+len(txn.TxOutputs)+1, len(utxoOps))
+	for ii := 0; ii < len(txn.TxInputs); ii++ {
+		require.Equal(OperationTypeSpendUtxo, utxoOps[ii].Type)
+	}
+	require.Equal(OperationTypeUpdateTransferRestriction, utxoOps[len(utxoOps)-1].Type)
+	require.Equal(prevStatus, prevProfileEntry.TransferRestrictionStatus)
+	require.Equal(prevStatus, utxoOps[len(utxoOps)-1].PrevProfileEntry.TransferRestrictionStatus)
+	require.Equal(transferRestrictionStatus,
+		utxoView.GetProfileEntryForPublicKey(profilePkBytes).TransferRestrictionStatus)
+
+	require.NoError(utxoView.FlushToDb())
+
+	return utxoOps, txn, blockHeight, nil
+}
+
 func _doFollowTxn(t *testing.T, chain *Blockchain, db *badger.DB,
 	params *BitCloutParams, feeRateNanosPerKB uint64, senderPkBase58Check string,
 	followedPkBase58Check string, senderPrivBase58Check string, isUnfollow bool) (
@@ -4397,6 +4573,571 @@ func TestLikeTxns(t *testing.T) {
 	testDisconnectedState()
 }
 
+func TestPollTxns(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+
+	// Mine a few blocks to give the senderPkString some money.
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+
+	txnOps := [][]*UtxoOperation{}
+	txns := []*MsgBitCloutTxn{}
+	savedHeight := chain.blockTip().Height + 1
+
+	// Fund all the keys.
+	for _, pk := range []string{m0Pub, m1Pub, m2Pub} {
+		currentOps, currentTxn, _ := _doBasicTransferWithViewFlush(
+			t, chain, db, params, senderPkString, pk,
+			senderPrivString, 70 /*amount to send*/, 11 /*feerate*/)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+
+	currentOps, currentTxn, _, err := _submitPost(
+		t, chain, db, params, 10, /*feeRateNanosPerKB*/
+		m0Pub, m0Priv, []byte{}, []byte{},
+		&BitCloutBodySchema{Body: "which is best?"},
+		[]byte{}, 1602947011*1e9 /*tstampNanos*/, false /*isHidden*/)
+	require.NoError(err)
+	txnOps = append(txnOps, currentOps)
+	txns = append(txns, currentTxn)
+	postHash := *currentTxn.Hash()
+
+	doPollTxn := func(senderPk string, senderPriv string,
+		operationType PollOperationType, options [][]byte, optionIndex uint64) error {
+
+		currentOps, currentTxn, _, err := _doPollTxn(
+			t, chain, db, params, 10 /*feeRateNanosPerKB*/, senderPk,
+			postHash, operationType, options, optionIndex, senderPriv)
+		if err != nil {
+			return err
+		}
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+		return nil
+	}
+	options := [][]byte{[]byte("red"), []byte("green"), []byte("blue")}
+
+	// Voting before the poll exists should fail.
+	err = doPollTxn(m1Pub, m1Priv, PollOperationTypeVote, nil, 0)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollDoesNotExist)
+
+	// Only the poster can create the poll, and it needs a sane set of options.
+	err = doPollTxn(m1Pub, m1Priv, PollOperationTypeCreate, options, 0)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollCreatorNotPoster)
+	err = doPollTxn(m0Pub, m0Priv, PollOperationTypeCreate, options[:1], 0)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollTooFewOptions)
+	err = doPollTxn(m0Pub, m0Priv, PollOperationTypeCreate, [][]byte{[]byte("a"), {}}, 0)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollOptionLength)
+
+	require.NoError(doPollTxn(m0Pub, m0Priv, PollOperationTypeCreate, options, 0))
+	err = doPollTxn(m0Pub, m0Priv, PollOperationTypeCreate, options, 0)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollAlreadyExists)
+
+	voteCounts, err := DbGetPollResults(db, &postHash)
+	require.NoError(err)
+	require.Equal([]uint64{0, 0, 0}, voteCounts)
+
+	// m1 and m2 vote for blue and m0 votes for red.
+	require.NoError(doPollTxn(m1Pub, m1Priv, PollOperationTypeVote, nil, 2))
+	require.NoError(doPollTxn(m2Pub, m2Priv, PollOperationTypeVote, nil, 2))
+	require.NoError(doPollTxn(m0Pub, m0Priv, PollOperationTypeVote, nil, 0))
+
+	err = doPollTxn(m1Pub, m1Priv, PollOperationTypeVote, nil, 1)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollVoteAlreadyExists)
+	err = doPollTxn(m1Pub, m1Priv, PollOperationTypeVote, nil, 3)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorPollVoteInvalidOptionIndex)
+
+	voteCounts, err = DbGetPollResults(db, &postHash)
+	require.NoError(err)
+	require.Equal([]uint64{1, 0, 2}, voteCounts)
+
+	pollEntry := DbGetPollEntry(db, &postHash)
+	require.NotNil(pollEntry)
+	require.Equal(options, pollEntry.Options)
+	require.Equal([]uint64{1, 0, 2}, pollEntry.VoteCounts)
+	m1PKID := DBGetPKIDEntryForPublicKey(db, _strToPk(t, m1Pub)).PKID
+	pollVoteEntry := DbGetPollVoteEntry(db, &postHash, m1PKID)
+	require.NotNil(pollVoteEntry)
+	require.Equal(uint64(2), pollVoteEntry.OptionIndex)
+
+	// Roll back all of the above using the utxoOps from each.
+	for ii := len(txnOps) - 1; ii >= 0; ii-- {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		require.NoError(utxoView.DisconnectTransaction(txns[ii], txns[ii].Hash(), txnOps[ii], savedHeight))
+		require.NoError(utxoView.FlushToDb())
+	}
+
+	require.Nil(DbGetPollEntry(db, &postHash))
+	require.Nil(DbGetPollVoteEntry(db, &postHash, m1PKID))
+	_, err = DbGetPollResults(db, &postHash)
+	require.True(errors.Is(err, ErrEntryNotFound))
+}
+
+func TestAuthorizeDerivedKeyTxns(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+
+	// Mine a few blocks to give the senderPkString some money.
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+
+	txnOps := [][]*UtxoOperation{}
+	txns := []*MsgBitCloutTxn{}
+	savedHeight := chain.blockTip().Height + 1
+
+	// Fund all the keys.
+	for _, pk := range []string{m0Pub, m1Pub} {
+		currentOps, currentTxn, _ := _doBasicTransferWithViewFlush(
+			t, chain, db, params, senderPkString, pk,
+			senderPrivString, 70 /*amount to send*/, 11 /*feerate*/)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+
+	derivedPriv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	derivedPk := derivedPriv.PubKey().SerializeCompressed()
+	expirationBlock := uint64(savedHeight) + 100
+
+	doAuthorizeDerivedKeyTxn := func(ownerPk string, ownerPriv string, derivedPublicKey []byte,
+		expirationBlock uint64, operationType AuthorizeDerivedKeyOperationType) error {
+
+		currentOps, currentTxn, _, err := _doAuthorizeDerivedKeyTxn(
+			t, chain, db, params, 10 /*feeRateNanosPerKB*/, ownerPk,
+			derivedPublicKey, expirationBlock, operationType, nil /*transactionSpendingLimit*/, ownerPriv)
+		if err != nil {
+			return err
+		}
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+		return nil
+	}
+	// Follows m1 from m0 with a txn signed by the derived key.
+	doFollowSignedByDerivedKey := func(blockHeight uint32, isUnfollow bool) error {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		txn, _, _, _, err := chain.CreateFollowTxn(
+			_strToPk(t, m0Pub), _strToPk(t, m1Pub), isUnfollow, 10 /*feeRateNanosPerKB*/, nil)
+		require.NoError(err)
+		txn.ExtraData = map[string][]byte{DerivedPublicKeyExtraDataKey: derivedPk}
+		txnSignature, err := txn.Sign(derivedPriv)
+		require.NoError(err)
+		txn.Signature = txnSignature
+
+		utxoOps, _, _, _, err := utxoView.ConnectTransaction(
+			txn, txn.Hash(), getTxnSize(*txn), blockHeight, true /*verifySignature*/, false /*ignoreUtxos*/)
+		if err != nil {
+			return err
+		}
+		require.NoError(utxoView.FlushToDb())
+		txnOps = append(txnOps, utxoOps)
+		txns = append(txns, txn)
+		return nil
+	}
+
+	// The derived key can't sign for m0 until m0 authorizes it.
+	err = doFollowSignedByDerivedKey(savedHeight, false /*isUnfollow*/)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorDerivedKeyNotAuthorized)
+
+	// Bad authorizations.
+	err = doAuthorizeDerivedKeyTxn(m0Pub, m0Priv, derivedPk, uint64(savedHeight), AuthorizeDerivedKeyOperationValid)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorAuthorizeDerivedKeyExpired)
+	err = doAuthorizeDerivedKeyTxn(m0Pub, m0Priv, _strToPk(t, m0Pub), expirationBlock, AuthorizeDerivedKeyOperationValid)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorAuthorizeDerivedKeyOwnerIsDerivedKey)
+	err = doAuthorizeDerivedKeyTxn(m0Pub, m0Priv, derivedPk, expirationBlock, AuthorizeDerivedKeyOperationType(2))
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorAuthorizeDerivedKeyInvalidOperationType)
+
+	require.NoError(doAuthorizeDerivedKeyTxn(m0Pub, m0Priv, derivedPk, expirationBlock, AuthorizeDerivedKeyOperationValid))
+	m0PKID := DBGetPKIDEntryForPublicKey(db, _strToPk(t, m0Pub)).PKID
+	derivedKeyEntry := DbGetDerivedKeyEntry(db, m0PKID, derivedPk)
+	require.NotNil(derivedKeyEntry)
+	require.Equal(expirationBlock, derivedKeyEntry.ExpirationBlock)
+	require.Equal(AuthorizeDerivedKeyOperationValid, derivedKeyEntry.OperationType)
+
+	// Now the derived key can sign for m0 but not for m1, and only until it expires.
+	require.NoError(doFollowSignedByDerivedKey(savedHeight, false /*isUnfollow*/))
+	require.NotNil(DbGetFollowerToFollowedMapping(db, m0PKID, DBGetPKIDEntryForPublicKey(db, _strToPk(t, m1Pub)).PKID))
+	err = doFollowSignedByDerivedKey(uint32(expirationBlock), true /*isUnfollow*/)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorDerivedKeyExpired)
+	err = doAuthorizeDerivedKeyTxn(m1Pub, m1Priv, derivedPk, expirationBlock, AuthorizeDerivedKeyOperationNotValid)
+	require.NoError(err)
+	entries, err := DbGetDerivedKeyEntriesForOwner(db, m0PKID)
+	require.NoError(err)
+	require.Equal(1, len(entries))
+
+	// Revoking the key stops it from signing and it can't be authorized again.
+	require.NoError(doAuthorizeDerivedKeyTxn(m0Pub, m0Priv, derivedPk, 0, AuthorizeDerivedKeyOperationNotValid))
+	err = doFollowSignedByDerivedKey(savedHeight, true /*isUnfollow*/)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorDerivedKeyNotAuthorized)
+	err = doAuthorizeDerivedKeyTxn(m0Pub, m0Priv, derivedPk, expirationBlock, AuthorizeDerivedKeyOperationValid)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorAuthorizeDerivedKeyRevoked)
+
+	// Roll back all of the above using the utxoOps from each.
+	for ii := len(txnOps) - 1; ii >= 0; ii-- {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		require.NoError(utxoView.DisconnectTransaction(txns[ii], txns[ii].Hash(), txnOps[ii], savedHeight))
+		require.NoError(utxoView.FlushToDb())
+	}
+
+	require.Nil(DbGetDerivedKeyEntry(db, m0PKID, derivedPk))
+	entries, err = DbGetDerivedKeyEntriesForOwner(db, m0PKID)
+	require.NoError(err)
+	require.Equal(0, len(entries))
+}
+
+func TestDerivedKeySpendingLimits(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+
+	// Mine a few blocks to give the senderPkString some money.
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+
+	txnOps := [][]*UtxoOperation{}
+	txns := []*MsgBitCloutTxn{}
+	savedHeight := chain.blockTip().Height + 1
+
+	// Fund all the keys.
+	for _, pk := range []string{m0Pub, m1Pub} {
+		currentOps, currentTxn, _ := _doBasicTransferWithViewFlush(
+			t, chain, db, params, senderPkString, pk,
+			senderPrivString, 10000 /*amount to send*/, 11 /*feerate*/)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+
+	derivedPriv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	derivedPk := derivedPriv.PubKey().SerializeCompressed()
+	expirationBlock := uint64(savedHeight) + 100
+	m0PKID := DBGetPKIDEntryForPublicKey(db, _strToPk(t, m0Pub)).PKID
+
+	authorizeDerivedKey := func(transactionSpendingLimit *TransactionSpendingLimit) {
+		currentOps, currentTxn, _, err := _doAuthorizeDerivedKeyTxn(
+			t, chain, db, params, 10 /*feeRateNanosPerKB*/, m0Pub, derivedPk, expirationBlock,
+			AuthorizeDerivedKeyOperationValid, transactionSpendingLimit, m0Priv)
+		require.NoError(err)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+	// Follows m1 from m0 with a txn signed by the derived key and returns the
+	// nanos it spent.
+	followSignedByDerivedKey := func(isUnfollow bool) (uint64, error) {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		txn, _, _, fees, err := chain.CreateFollowTxn(
+			_strToPk(t, m0Pub), _strToPk(t, m1Pub), isUnfollow, 100 /*feeRateNanosPerKB*/, nil)
+		require.NoError(err)
+		txn.ExtraData = map[string][]byte{DerivedPublicKeyExtraDataKey: derivedPk}
+		txnSignature, err := txn.Sign(derivedPriv)
+		require.NoError(err)
+		txn.Signature = txnSignature
+
+		utxoOps, _, _, _, err := utxoView.ConnectTransaction(
+			txn, txn.Hash(), getTxnSize(*txn), savedHeight, true /*verifySignature*/, false /*ignoreUtxos*/)
+		if err != nil {
+			return 0, err
+		}
+		require.NoError(utxoView.FlushToDb())
+		txnOps = append(txnOps, utxoOps)
+		txns = append(txns, txn)
+		return fees, nil
+	}
+
+	// A key that can only like can't follow.
+	authorizeDerivedKey(&TransactionSpendingLimit{
+		GlobalBitCloutLimit:      1000,
+		TransactionCountLimitMap: map[TxnType]uint64{TxnTypeLike: 5},
+	})
+	_, err = followSignedByDerivedKey(false /*isUnfollow*/)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorDerivedKeyTxnTypeNotAuthorized)
+
+	// A key that can follow once can't follow twice, and the fee comes out of
+	// its global limit.
+	authorizeDerivedKey(&TransactionSpendingLimit{
+		GlobalBitCloutLimit:      1000,
+		TransactionCountLimitMap: map[TxnType]uint64{TxnTypeFollow: 1},
+	})
+	fees, err := followSignedByDerivedKey(false /*isUnfollow*/)
+	require.NoError(err)
+	require.Greater(fees, uint64(0))
+	derivedKeyEntry := DbGetDerivedKeyEntry(db, m0PKID, derivedPk)
+	require.NotNil(derivedKeyEntry)
+	require.NotNil(derivedKeyEntry.TransactionSpendingLimit)
+	assert.Equal(1000-fees, derivedKeyEntry.TransactionSpendingLimit.GlobalBitCloutLimit)
+	assert.Equal(uint64(0), derivedKeyEntry.TransactionSpendingLimit.TransactionCountLimitMap[TxnTypeFollow])
+	_, err = followSignedByDerivedKey(true /*isUnfollow*/)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorDerivedKeyTxnTypeNotAuthorized)
+
+	// A key can't spend more than its global limit.
+	authorizeDerivedKey(&TransactionSpendingLimit{
+		GlobalBitCloutLimit:      0,
+		TransactionCountLimitMap: map[TxnType]uint64{TxnTypeFollow: 10},
+	})
+	_, err = followSignedByDerivedKey(true /*isUnfollow*/)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorDerivedKeyTxnSpendsMoreThanGlobalLimit)
+
+	// A key without a limit can sign anything.
+	authorizeDerivedKey(nil)
+	_, err = followSignedByDerivedKey(true /*isUnfollow*/)
+	require.NoError(err)
+
+	// Roll back all of the above using the utxoOps from each, checking that
+	// the limit is put back when the follow that used it is disconnected.
+	for ii := len(txnOps) - 1; ii >= 0; ii-- {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		require.NoError(utxoView.DisconnectTransaction(txns[ii], txns[ii].Hash(), txnOps[ii], savedHeight))
+		require.NoError(utxoView.FlushToDb())
+
+		numOps := len(txnOps[ii])
+		if numOps >= 2 && txnOps[ii][numOps-2].Type == OperationTypeSpendDerivedKeyLimit {
+			derivedKeyEntry := DbGetDerivedKeyEntry(db, m0PKID, derivedPk)
+			require.NotNil(derivedKeyEntry)
+			assert.Equal(uint64(1000), derivedKeyEntry.TransactionSpendingLimit.GlobalBitCloutLimit)
+			assert.Equal(uint64(1), derivedKeyEntry.TransactionSpendingLimit.TransactionCountLimitMap[TxnTypeFollow])
+		}
+	}
+
+	require.Nil(DbGetDerivedKeyEntry(db, m0PKID, derivedPk))
+}
+
+func TestUsernameReleaseProtection(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	feeRateNanosPerKB := uint64(11)
+
+	txnOps := [][]*UtxoOperation{}
+	txns := []*MsgBitCloutTxn{}
+	savedHeight := chain.blockTip().Height + 1
+
+	for _, pk := range []string{m0Pub, m1Pub} {
+		currentOps, currentTxn, _ := _doBasicTransferWithViewFlush(
+			t, chain, db, params, moneyPkString, pk,
+			moneyPrivString, 6*NanosPerUnit /*amount to send*/, feeRateNanosPerKB /*feerate*/)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+	updateProfile := func(pk string, priv string, username string) error {
+		currentOps, currentTxn, _, err := _updateProfile(
+			t, chain, db, params, feeRateNanosPerKB, pk, priv, []byte{}, username,
+			"i am "+username, "", 2500 /*CreatorBasisPoints*/, 12500, /*StakeMultipleBasisPoints*/
+			false /*isHidden*/)
+		if err != nil {
+			return err
+		}
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+		return nil
+	}
+
+	// Without a protection window, renames don't record the username they give
+	// up and anyone can take it.
+	params.UsernameReleaseProtectionWindowBlocks = 0
+	require.NoError(updateProfile(m0Pub, m0Priv, "m0"))
+	require.NoError(updateProfile(m0Pub, m0Priv, "m0renamed"))
+	assert.Nil(DbGetReleasedUsernameEntry(db, []byte("m0")))
+	require.NoError(updateProfile(m1Pub, m1Priv, "m0"))
+
+	// With one, the username is held for the profile that gave it up.
+	params.UsernameReleaseProtectionWindowBlocks = 10
+	require.NoError(updateProfile(m0Pub, m0Priv, "m0again"))
+	releasedUsernameEntry := DbGetReleasedUsernameEntry(db, []byte("m0renamed"))
+	require.NotNil(releasedUsernameEntry)
+	assert.Equal(savedHeight, releasedUsernameEntry.ReleasedAtHeight)
+	err := updateProfile(m1Pub, m1Priv, "m0renamed")
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorProfileUsernameRecentlyReleased)
+
+	// Roll back all of the above using the utxoOps from each.
+	for ii := len(txnOps) - 1; ii >= 0; ii-- {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		require.NoError(utxoView.DisconnectTransaction(txns[ii], txns[ii].Hash(), txnOps[ii], savedHeight))
+		require.NoError(utxoView.FlushToDb())
+	}
+	assert.Nil(DbGetReleasedUsernameEntry(db, []byte("m0renamed")))
+}
+
+func TestTransferRestrictions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	feeRateNanosPerKB := uint64(11)
+
+	txnOps := [][]*UtxoOperation{}
+	txns := []*MsgBitCloutTxn{}
+	savedHeight := chain.blockTip().Height + 1
+
+	// Fund all the keys.
+	for _, pk := range []string{m0Pub, m1Pub, m2Pub, m3Pub, m4Pub} {
+		currentOps, currentTxn, _ := _doBasicTransferWithViewFlush(
+			t, chain, db, params, moneyPkString, pk,
+			moneyPrivString, 6*NanosPerUnit /*amount to send*/, feeRateNanosPerKB /*feerate*/)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+	appendTxn := func(currentOps []*UtxoOperation, currentTxn *MsgBitCloutTxn, err error) {
+		require.NoError(err)
+		txnOps = append(txnOps, currentOps)
+		txns = append(txns, currentTxn)
+	}
+	updateTransferRestriction := func(pk string, priv string, status TransferRestrictionStatus) error {
+		currentOps, currentTxn, _, err := _doUpdateTransferRestrictionTxn(
+			t, chain, db, params, feeRateNanosPerKB, pk, status, priv)
+		if err != nil {
+			return err
+		}
+		appendTxn(currentOps, currentTxn, nil)
+		return nil
+	}
+	transferM0Coin := func(senderPk string, senderPriv string, receiverPk string) error {
+		currentOps, currentTxn, _, err := _doCreatorCoinTransferTxn(
+			t, chain, db, params, feeRateNanosPerKB, senderPk, senderPriv, m0Pub, receiverPk,
+			100000 /*CreatorCoinToTransferNanos*/)
+		if err != nil {
+			return err
+		}
+		appendTxn(currentOps, currentTxn, nil)
+		return nil
+	}
+	buyM0Coin := func(pk string, priv string) error {
+		currentOps, currentTxn, _, err := _creatorCoinTxn(
+			t, chain, db, params, feeRateNanosPerKB, pk, priv, m0Pub,
+			CreatorCoinOperationTypeBuy, NanosPerUnit /*BitCloutToSellNanos*/, 0, 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		appendTxn(currentOps, currentTxn, nil)
+		return nil
+	}
+	getM0Status := func() TransferRestrictionStatus {
+		profileEntry := DBGetProfileEntryForPKID(db, DBGetPKIDEntryForPublicKey(db, m0PkBytes).PKID)
+		require.NotNil(profileEntry)
+		return profileEntry.TransferRestrictionStatus
+	}
+
+	// Only a creator with a profile has a coin to restrict.
+	err := updateTransferRestriction(m0Pub, m0Priv, TransferRestrictionStatusProfileOwnerOnly)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorUpdateTransferRestrictionOnNonexistentProfile)
+
+	// Create a profile for m0 and have m1 and m2 buy some of m0's coins.
+	currentOps, currentTxn, _, err := _updateProfile(
+		t, chain, db, params, feeRateNanosPerKB, m0Pub, m0Priv, []byte{}, "m0",
+		"i am m0", "m0 profile pic", 2500 /*CreatorBasisPoints*/, 12500, /*StakeMultipleBasisPoints*/
+		false /*isHidden*/)
+	appendTxn(currentOps, currentTxn, err)
+	for _, buyer := range [][]string{{m1Pub, m1Priv}, {m2Pub, m2Priv}} {
+		currentOps, currentTxn, _, err := _creatorCoinTxn(
+			t, chain, db, params, feeRateNanosPerKB, buyer[0], buyer[1], m0Pub,
+			CreatorCoinOperationTypeBuy, NanosPerUnit /*BitCloutToSellNanos*/, 0, 0, 0, 0)
+		appendTxn(currentOps, currentTxn, err)
+	}
+	assert.Equal(TransferRestrictionStatusUnrestricted, getM0Status())
+
+	err = updateTransferRestriction(m0Pub, m0Priv, TransferRestrictionStatus(3))
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorUpdateTransferRestrictionInvalidStatus)
+
+	// When only the profile owner can transfer, transfers between other
+	// holders fail but transfers to and from m0 work.
+	require.NoError(updateTransferRestriction(m0Pub, m0Priv, TransferRestrictionStatusProfileOwnerOnly))
+	assert.Equal(TransferRestrictionStatusProfileOwnerOnly, getM0Status())
+	err = transferM0Coin(m1Pub, m1Priv, m2Pub)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorCreatorCoinTransferRestrictedToProfileOwner)
+
+	// Buys are restricted the same way, except for the profile owner's.
+	err = buyM0Coin(m2Pub, m2Priv)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorCreatorCoinTransferRestrictedToProfileOwner)
+	require.NoError(buyM0Coin(m0Pub, m0Priv))
+	require.NoError(transferM0Coin(m1Pub, m1Priv, m0Pub))
+	require.NoError(transferM0Coin(m0Pub, m0Priv, m3Pub))
+
+	// When only DAO members can receive, m3 is now a member but m4 isn't.
+	require.NoError(updateTransferRestriction(m0Pub, m0Priv, TransferRestrictionStatusDAOMembersOnly))
+	assert.Equal(TransferRestrictionStatusDAOMembersOnly, getM0Status())
+	require.NoError(buyM0Coin(m3Pub, m3Priv))
+	err = buyM0Coin(m4Pub, m4Priv)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorCreatorCoinTransferRestrictedToDAOMembers)
+	require.NoError(transferM0Coin(m1Pub, m1Priv, m3Pub))
+	err = transferM0Coin(m2Pub, m2Priv, m4Pub)
+	require.Error(err)
+	require.Contains(err.Error(), RuleErrorCreatorCoinTransferRestrictedToDAOMembers)
+
+	// Lifting the restriction lets anyone receive the coin again.
+	require.NoError(updateTransferRestriction(m0Pub, m0Priv, TransferRestrictionStatusUnrestricted))
+	require.NoError(transferM0Coin(m2Pub, m2Priv, m4Pub))
+
+	// Roll back all of the above using the utxoOps from each.
+	for ii := len(txnOps) - 1; ii >= 0; ii-- {
+		utxoView, err := NewUtxoView(db, params, nil)
+		require.NoError(err)
+		require.NoError(utxoView.DisconnectTransaction(txns[ii], txns[ii].Hash(), txnOps[ii], savedHeight))
+		require.NoError(utxoView.FlushToDb())
+
+		if txns[ii].TxnMeta.GetTxnType() == TxnTypeUpdateTransferRestriction &&
+			ii > 0 && txns[ii-1].TxnMeta.GetTxnType() == TxnTypeCreatorCoin {
+
+			// Disconnecting the first update puts the coin back to unrestricted.
+			assert.Equal(TransferRestrictionStatusUnrestricted, getM0Status())
+		}
+	}
+	assert.Nil(DBGetProfileEntryForPKID(db, DBGetPKIDEntryForPublicKey(db, m0PkBytes).PKID))
+}
+
 func TestFollowTxns(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
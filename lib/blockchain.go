@@ -46,6 +46,12 @@ const (
 	// each node takes up 100 bytes of space this amounts to around 500MB, which also seems
 	// like a reasonable size.
 	MaxBlockIndexNodes = 5000000
+
+	// MinRecentBlockHeaders is the fewest headers kept in memory below the tip when
+	// the rest are read from the db as needed. Retargeting difficulty reads the
+	// headers of the blocks in one retarget window, so the window has to fit in
+	// it with room to spare for the forks the node is willing to follow.
+	MinRecentBlockHeaders = 5000
 )
 
 type BlockStatus uint32
@@ -154,7 +160,7 @@ func (nn *BlockNode) String() string {
 		tstamp = uint32(nn.Header.TstampSecs)
 	}
 	return fmt.Sprintf("< TstampSecs: %d, Height: %d, Hash: %s, ParentHash %s, Status: %s, CumWork: %v>",
-		tstamp, nn.Header.Height, nn.Hash, parentHash, nn.Status, nn.CumWork)
+		tstamp, nn.Height, nn.Hash, parentHash, nn.Status, nn.CumWork)
 }
 
 // TODO: Height not needed in this since it's in the header.
@@ -245,6 +251,10 @@ func CalcNextDifficultyTarget(
 			"beginning of retarget interval at height %d during retarget from height %d",
 			firstNodeHeight, lastNode.Height)
 	}
+	if firstNode.Header == nil {
+		return nil, fmt.Errorf("CalcNextDifficultyTarget: Header of block at beginning "+
+			"of retarget interval at height %d is no longer kept in memory", firstNodeHeight)
+	}
 
 	actualTimeDiffSecs := int64(lastNode.Header.TstampSecs - firstNode.Header.TstampSecs)
 	clippedTimeDiffSecs := actualTimeDiffSecs
@@ -292,6 +302,18 @@ type Blockchain struct {
 	// easiest way to achieve this.
 	server *Server
 
+	// Sends block and view flush events to whoever is following the chain. See
+	// EventManager.
+	eventManager *EventManager
+
+	// The operation that was in flight when the node last stopped, if it didn't
+	// stop cleanly. Read once at startup.
+	crashBreadcrumb *DbCrashBreadcrumb
+
+	// When set, VerifyBlockConservation is run on every block connected to the
+	// main chain and any violation is logged as an error.
+	verifyBlockConservation bool
+
 	// Protects most of the fields below this point.
 	ChainLock deadlock.RWMutex
 
@@ -308,6 +330,18 @@ type Blockchain struct {
 	bestHeaderChain    []*BlockNode
 	bestHeaderChainMap map[BlockHash]*BlockNode
 
+	// When nonzero, the headers of the nodes on the main chain more than this many
+	// blocks below the tip are dropped from memory and read from the db when
+	// they're needed. Every node at a height below headersEvictedBelowHeight has
+	// had its header dropped.
+	recentBlockHeaders        uint32
+	headersEvictedBelowHeight uint32
+
+	// When nonzero, the utxo operations of the blocks more than this many blocks
+	// below the tip are deleted as new blocks are connected. See
+	// NodeConfigEntry.UtxoOpsRetention.
+	utxoOpsKeepBlocks uint64
+
 	// We keep track of orphan blocks with the following data structures. Orphans
 	// are not written to disk and are only cached in memory. Moreover we only keep
 	// up to MaxOrphansInMemory of them in order to prevent memory exhaustion.
@@ -349,6 +383,24 @@ func (bc *Blockchain) CopyBestHeaderChain() ([]*BlockNode, map[BlockHash]*BlockN
 // then _initChain will initialize it to contain only the genesis block before
 // proceeding to read from it.
 func (bc *Blockchain) _initChain() error {
+	// If the node died in the middle of writing to the db, say what it was doing
+	// so the operator can tell what the recovery below is recovering from. This
+	// has to be read before the genesis recovery since that can wipe the db.
+	bc.crashBreadcrumb = DbGetCrashBreadcrumb(bc.db)
+	if bc.crashBreadcrumb != nil {
+		glog.Errorf("_initChain: The node stopped in the middle of an operation "+
+			"on the db: %v", bc.crashBreadcrumb)
+		if err := DbDeleteCrashBreadcrumb(bc.db); err != nil {
+			return errors.Wrapf(err, "_initChain: Problem clearing crash breadcrumb")
+		}
+	}
+
+	// If a previous attempt to initialize the db with the genesis block failed
+	// part-way through, wipe what it left behind so we can start over cleanly.
+	if _, err := DbResetIncompleteGenesisInit(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem recovering from incomplete genesis initialization")
+	}
+
 	// See if we have a best chain hash stored in the db.
 	bestBlockHash := DbGetBestHash(bc.db, ChainTypeBitCloutBlock)
 	// When we load up initially, the best header hash is just the tip of the best
@@ -370,6 +422,12 @@ func (bc *Blockchain) _initChain() error {
 		bestHeaderHash = bestBlockHash
 	}
 
+	// Make sure the tip we're about to load is actually backed by the rest of
+	// the chain state in the db before doing anything with it.
+	if err := VerifyTipConsistency(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Tip consistency check failed")
+	}
+
 	// At this point we should have bestHashes set and the db should have been
 	// initialized to contain a block index and a best chain that we can read
 	// in.
@@ -426,9 +484,217 @@ func (bc *Blockchain) _initChain() error {
 		}
 	}
 
+	// Rewrite any keys stored in a legacy layout before the backfills below read
+	// them.
+	if reports, err := DbRunLegacyKeyNormalization(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem normalizing legacy keys")
+	} else {
+		for _, report := range reports {
+			if report.NumAnomalous > 0 || report.NumMalformed > 0 {
+				glog.Infof("_initChain: Legacy key normalization: %+v", report)
+			}
+		}
+	}
+
+	// Index any messages that were stored before the conversation index existed.
+	if numIndexed, err := DbBackfillConversationIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling conversation index")
+	} else if numIndexed > 0 {
+		glog.Infof("_initChain: Added %d messages to the conversation index", numIndexed)
+	}
+
+	// Count the likes, comments, and reclouts stored before the counts existed.
+	if numPosts, err := DbBackfillPostEngagementCounts(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling post engagement counts")
+	} else if numPosts > 0 {
+		glog.Infof("_initChain: Set engagement counts for %d posts", numPosts)
+	}
+
+	// Count the follows stored before the follow counts existed.
+	if numFollows, err := DbBackfillFollowCounts(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling follow counts")
+	} else if numFollows > 0 {
+		glog.Infof("_initChain: Counted %d follows", numFollows)
+	}
+
+	// Count the diamonds stored before the diamond totals existed.
+	if numDiamonds, err := DbBackfillDiamondTotals(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling diamond totals")
+	} else if numDiamonds > 0 {
+		glog.Infof("_initChain: Counted %d diamonds", numDiamonds)
+	}
+
+	// Index any quote reclouts stored before the quote reclout index existed.
+	if numIndexed, err := DbBackfillQuoteRecloutIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling quote reclout index")
+	} else if numIndexed > 0 {
+		glog.Infof("_initChain: Added %d quote reclouts to the quote reclout index", numIndexed)
+	}
+
+	// Index any reclouts stored before the reverse reclout index existed.
+	if numIndexed, err := DbBackfillRecloutReverseIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling reverse reclout index")
+	} else if numIndexed > 0 {
+		glog.Infof("_initChain: Added %d reclouts to the reverse reclout index", numIndexed)
+	}
+
+	// Index any balance entries stored before the balance indexes existed.
+	if numIndexed, err := DbBackfillBalanceIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling balance index")
+	} else if numIndexed > 0 {
+		glog.Infof("_initChain: Added %d balance entries to the balance index", numIndexed)
+	}
+	if numIndexed, err := DbBackfillTopHoldersIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling top holders index")
+	} else if numIndexed > 0 {
+		glog.Infof("_initChain: Added %d balance entries to the top holders index", numIndexed)
+	}
+
+	// Index any profiles stored before the normalized username index existed.
+	if err := DbBackfillNormalizedUsernameIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling normalized username index")
+	}
+
+	// Index the images in any posts stored before the content hash index existed.
+	if numPosts, err := DbBackfillContentHashIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling content hash index")
+	} else if numPosts > 0 {
+		glog.Infof("_initChain: Checked %d posts for images to add to the content hash index", numPosts)
+	}
+
+	// Add up the balances of any UTXOs stored before the wallet balance index
+	// existed.
+	if numBalances, err := DbBackfillWalletBalanceIndex(bc.db); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem backfilling wallet balance index")
+	} else if numBalances > 0 {
+		glog.Infof("_initChain: Set the balances of %d public keys", numBalances)
+	}
+
+	// Quarantine posts and messages stored with timestamps too far in the future
+	// before they were checked. StartTimestampIndexRestorer restores them once
+	// their time comes.
+	if numQuarantined, err := DbRepairTimestampIndexes(
+		bc.db, DbGetMaxIndexedTstampNanosForTip(bc.db)); err != nil {
+
+		return errors.Wrapf(err, "_initChain: Problem repairing timestamp indexes")
+	} else if numQuarantined > 0 {
+		glog.Infof("_initChain: Quarantined %d timestamp index entries", numQuarantined)
+	}
+
+	// Start or stop keeping balance snapshots to match the node config.
+	nodeConfig, err := DbGetNodeConfig(bc.db)
+	if err != nil {
+		return errors.Wrapf(err, "_initChain: Problem reading node config")
+	}
+	if numSeeded, err := DbInitBalanceSnapshots(
+		bc.db, nodeConfig.BalanceSnapshots, uint32(bc.blockTip().Height)); err != nil {
+
+		return errors.Wrapf(err, "_initChain: Problem initializing balance snapshots")
+	} else if numSeeded > 0 {
+		glog.Infof("_initChain: Seeded balance snapshots for %d public keys", numSeeded)
+	}
+
+	// Start or stop keeping state commitments to match the node config.
+	if started, err := DbInitStateCommitments(
+		bc.db, nodeConfig.StateCommitments, uint32(bc.blockTip().Height)); err != nil {
+
+		return errors.Wrapf(err, "_initChain: Problem initializing state commitments")
+	} else if started {
+		glog.Infof("_initChain: Started keeping state commitments at height %d",
+			bc.blockTip().Height)
+	}
+
+	// Make sure the db knows about every fork in the params.
+	if err := DbInitForkStates(bc.db, bc.params, bc.bestChain); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem initializing fork states")
+	}
+
+	// Drop the headers of old blocks from memory if the node is configured to.
+	if nodeConfig.RecentBlockHeaders != 0 {
+		bc.recentBlockHeaders = nodeConfig.RecentBlockHeaders
+		if bc.recentBlockHeaders < MinRecentBlockHeaders {
+			glog.Warningf("_initChain: Keeping %d recent block headers in memory "+
+				"rather than %d", MinRecentBlockHeaders, bc.recentBlockHeaders)
+			bc.recentBlockHeaders = MinRecentBlockHeaders
+		}
+		if numEvicted := bc._evictOldBlockHeaders(); numEvicted > 0 {
+			glog.Infof("_initChain: Dropped the headers of %d old blocks from memory", numEvicted)
+		}
+	}
+
+	// Delete the utxo operations that are outside the retention window. The first
+	// time this runs it goes through the whole chain.
+	bc.utxoOpsKeepBlocks = nodeConfig.GetUtxoOpsKeepBlocks(bc.params)
+	if numDeleted, err := bc._deleteExpiredUtxoOps(); err != nil {
+		return errors.Wrapf(err, "_initChain: Problem deleting expired utxo operations")
+	} else if numDeleted > 0 {
+		glog.Infof("_initChain: Deleted the utxo operations of %d old blocks", numDeleted)
+	}
+
 	return nil
 }
 
+// _deleteExpiredUtxoOps deletes the utxo operations of the blocks that are more
+// than utxoOpsKeepBlocks blocks below the tip by applying a blocks policy to the
+// utxo-ops retention index. It returns the number of blocks swept.
+//
+// Caller must acquire the ChainLock for writing prior to calling this.
+func (bc *Blockchain) _deleteExpiredUtxoOps() (uint64, error) {
+	if bc.utxoOpsKeepBlocks == 0 || len(bc.bestChain) == 0 {
+		return 0, nil
+	}
+	policies := map[string]*DbRetentionPolicy{
+		"utxo-ops": {Type: DbRetentionKeepBlocks, N: bc.utxoOpsKeepBlocks},
+	}
+	numSweptForIndex, err := DbRetentionSweep(bc.db, policies, uint64(bc.blockTip().Height), time.Now())
+	if err != nil {
+		return 0, errors.Wrapf(err, "_deleteExpiredUtxoOps: ")
+	}
+	return numSweptForIndex["utxo-ops"], nil
+}
+
+// _evictOldBlockHeaders drops the headers of the nodes on the main chain that are
+// more than recentBlockHeaders blocks below the tip. The nodes themselves stay in
+// the block index so the chain keeps its shape, and headerForNode reads the
+// headers back from the db. Nodes off the main chain keep their headers. It
+// returns the number of headers dropped.
+//
+// Caller must acquire the ChainLock for writing prior to calling this.
+func (bc *Blockchain) _evictOldBlockHeaders() int {
+	if bc.recentBlockHeaders == 0 || len(bc.bestChain) == 0 {
+		return 0
+	}
+	tipHeight := bc.blockTip().Height
+	if tipHeight < bc.recentBlockHeaders {
+		return 0
+	}
+	evictBelowHeight := tipHeight - bc.recentBlockHeaders
+
+	numEvicted := 0
+	for height := bc.headersEvictedBelowHeight; height < evictBelowHeight; height++ {
+		node := bc.bestChain[height]
+		if node.Header != nil {
+			node.Header = nil
+			numEvicted++
+		}
+	}
+	if evictBelowHeight > bc.headersEvictedBelowHeight {
+		bc.headersEvictedBelowHeight = evictBelowHeight
+	}
+	return numEvicted
+}
+
+// headerForNode returns the node's header, reading it from the db if it was
+// dropped from memory by _evictOldBlockHeaders.
+//
+// Caller must acquire the ChainLock prior to calling this.
+func (bc *Blockchain) headerForNode(node *BlockNode) (*MsgBitCloutHeader, error) {
+	if node.Header != nil {
+		return node.Header, nil
+	}
+	return DbGetBlockHeaderForNode(bc.db, node, false /*bitcoinNodes*/)
+}
+
 // NewBlockchain returns a new blockchain object. It initializes some in-memory
 // data structures by reading from the db. It also initializes the db if it hasn't
 // been initialized in the past. This function should only be called once per
@@ -458,6 +724,7 @@ func NewBlockchain(
 		trustedBlockProducerStartHeight: _trustedBlockProducerStartHeight,
 		params:                          _params,
 		server:                          _server,
+		eventManager:                    NewEventManager(),
 
 		blockIndex:   make(map[BlockHash]*BlockNode),
 		bestChainMap: make(map[BlockHash]*BlockNode),
@@ -547,7 +814,7 @@ func locateInventory(locator []*BlockHash, stopHash *BlockHash, maxEntries uint3
 	// Start at the block after the most recently known block. When there
 	// is no next block it means the most recently known block is the tip of
 	// the best chain, so there is nothing more to do.
-	nextNodeHeight := uint32(startNode.Header.Height) + 1
+	nextNodeHeight := startNode.Height + 1
 	if uint32(len(bestChainList)) <= nextNodeHeight {
 		return nil, 0
 	}
@@ -555,12 +822,12 @@ func locateInventory(locator []*BlockHash, stopHash *BlockHash, maxEntries uint3
 
 	// Calculate how many entries are needed.
 	tip := bestChainList[len(bestChainList)-1]
-	total := uint32((tip.Header.Height - startNode.Header.Height) + 1)
-	if stopNodeExists && stopNode.Header.Height >= startNode.Header.Height {
+	total := (tip.Height - startNode.Height) + 1
+	if stopNodeExists && stopNode.Height >= startNode.Height {
 
 		_, bestChainContainsStopNode := bestChainMap[*stopNode.Hash]
 		if bestChainContainsStopNode {
-			total = uint32((stopNode.Header.Height - startNode.Header.Height) + 1)
+			total = (stopNode.Height - startNode.Height) + 1
 		}
 	}
 	if total > maxEntries {
@@ -579,7 +846,8 @@ func locateInventory(locator []*BlockHash, stopHash *BlockHash, maxEntries uint3
 // This function MUST be called with the ChainLock held (for reads).
 func locateHeaders(locator []*BlockHash, stopHash *BlockHash, maxHeaders uint32,
 	blockIndex map[BlockHash]*BlockNode, bestChainList []*BlockNode,
-	bestChainMap map[BlockHash]*BlockNode) []*MsgBitCloutHeader {
+	bestChainMap map[BlockHash]*BlockNode,
+	headerForNode func(*BlockNode) (*MsgBitCloutHeader, error)) []*MsgBitCloutHeader {
 
 	// Find the node after the first known block in the locator and the
 	// total number of nodes after it needed while respecting the stop hash
@@ -593,11 +861,17 @@ func locateHeaders(locator []*BlockHash, stopHash *BlockHash, maxHeaders uint32,
 	// Populate and return the found headers.
 	headers := make([]*MsgBitCloutHeader, 0, total)
 	for ii := uint32(0); ii < total; ii++ {
-		headers = append(headers, node.Header)
+		header, err := headerForNode(node)
+		if err != nil {
+			// Return the headers we have so far rather than a gap.
+			glog.Errorf("locateHeaders: Problem getting header: %v", err)
+			break
+		}
+		headers = append(headers, header)
 		if uint32(len(headers)) == total {
 			break
 		}
-		node = bestChainList[node.Header.Height+1]
+		node = bestChainList[node.Height+1]
 	}
 	return headers
 }
@@ -621,7 +895,7 @@ func locateHeaders(locator []*BlockHash, stopHash *BlockHash, maxHeaders uint32,
 // This function is safe for concurrent access.
 func (bc *Blockchain) LocateBestBlockChainHeaders(locator []*BlockHash, stopHash *BlockHash) []*MsgBitCloutHeader {
 	headers := locateHeaders(locator, stopHash, MaxHeadersPerMsg,
-		bc.blockIndex, bc.bestChain, bc.bestChainMap)
+		bc.blockIndex, bc.bestChain, bc.bestChainMap, bc.headerForNode)
 
 	return headers
 }
@@ -819,6 +1093,12 @@ func (bc *Blockchain) GetBlock(blockHash *BlockHash) *MsgBitCloutBlock {
 	return blk
 }
 
+// PruneHeight returns the height below which blocks have been pruned from the db,
+// or zero if nothing has been pruned. See db_prune.go.
+func (bc *Blockchain) PruneHeight() uint64 {
+	return DbGetPruneHeight(bc.db)
+}
+
 func (bc *Blockchain) GetBlockAtHeight(height uint32) *MsgBitCloutBlock {
 	numBlocks := uint32(len(bc.bestChain))
 
@@ -945,6 +1225,11 @@ func (bc *Blockchain) DB() *badger.DB {
 	return bc.db
 }
 
+// EventManager is where to register for events about the chain and the mempool.
+func (bc *Blockchain) EventManager() *EventManager {
+	return bc.eventManager
+}
+
 // blockTip returns the tip of the main block chain. We fetch headers first
 // and then, once the header chain looks good, we fetch blocks. As such, we
 // store two separate "best" chains: One containing the best headers, and
@@ -975,6 +1260,26 @@ func (bc *Blockchain) BestChain() []*BlockNode {
 	return bc.bestChain
 }
 
+// CrashBreadcrumb returns the operation that was in flight on the db when the
+// node last stopped or nil if it stopped cleanly.
+func (bc *Blockchain) CrashBreadcrumb() *DbCrashBreadcrumb {
+	return bc.crashBreadcrumb
+}
+
+func (bc *Blockchain) SetVerifyBlockConservation(verifyBlockConservation bool) {
+	bc.verifyBlockConservation = verifyBlockConservation
+}
+
+func (bc *Blockchain) _maybeVerifyBlockConservation(blockHash *BlockHash) {
+	if !bc.verifyBlockConservation {
+		return
+	}
+	if _, err := VerifyBlockConservation(bc.db, bc.params, blockHash); err != nil {
+		glog.Errorf("Blockchain._maybeVerifyBlockConservation: Block %v failed "+
+			"conservation check: %v", blockHash, err)
+	}
+}
+
 func (bc *Blockchain) SetBestChain(bestChain []*BlockNode) {
 	bc.bestChain = bestChain
 }
@@ -1344,6 +1649,15 @@ func (bc *Blockchain) processHeader(blockHeader *MsgBitCloutHeader, headerHash *
 		return false, true, nil
 	}
 
+	// Don't follow forks off of blocks whose headers were dropped from memory.
+	// They're too far below the tip to matter and retargeting difficulty on them
+	// would need the dropped headers.
+	if parentNode.Header == nil && parentNode.Height < bc.headersEvictedBelowHeight {
+		return false, false, errors.Wrapf(
+			HeaderErrorInvalidParent, "Parent at height %d is more than %d blocks below the tip",
+			parentNode.Height, bc.recentBlockHeaders)
+	}
+
 	// If the parent node is invalid then this header is invalid as well. Note that
 	// if the parent node exists then its header must either be Validated or
 	// ValidateFailed.
@@ -1635,9 +1949,9 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 	}
 
 	// Reject the block if any of the following apply to the parent:
-	// - Its header is nil.
+	// - Its header is neither in memory nor in the db.
 	// - Its header or its block validation failed.
-	if parentNode.Header == nil ||
+	if _, err := bc.headerForNode(parentNode); err != nil ||
 		(parentNode.Status&(StatusHeaderValidateFailed|StatusBlockValidateFailed)) != 0 {
 
 		bc.MarkBlockInvalid(nodeToValidate, RuleErrorPreviousBlockInvalid)
@@ -1714,7 +2028,7 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 	// Try and store the block and its corresponding node info since it has passed
 	// basic validation.
 	nodeToValidate.Status |= StatusBlockStored
-	err = bc.db.Update(func(txn *badger.Txn) error {
+	err = DbUpdate(bc.db, func(txn KVTxn) error {
 		// Store the new block in the db under the
 		//   <blockHash> -> <serialized block>
 		// index.
@@ -1786,7 +2100,10 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 		// Now that we have a valid block that we know is connecting to the tip,
 		// update our data structures to actually make this connection. Do this
 		// in a transaction so that it is atomic.
-		err = bc.db.Update(func(txn *badger.Txn) error {
+		if err := DbPutCrashBreadcrumb(bc.db, CrashBreadcrumbPhaseConnectBlock, blockHash); err != nil {
+			return false, false, errors.Wrapf(err, "ProcessBlock: Problem recording crash breadcrumb on simple add to tip")
+		}
+		err = DbAtomicUpdate(bc.db, func(txn KVTxn) error {
 			// This will update the node's status.
 			if err := PutHeightHashToNodeInfoWithTxn(txn, nodeToValidate, false /*bitcoinNodes*/); err != nil {
 				return errors.Wrapf(
@@ -1810,12 +2127,44 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 				return errors.Wrapf(err, "ProcessBlock: Problem writing utxo operations to db on simple add to tip")
 			}
 
+			// Add the block's txns to the daily txn stats.
+			if err := DbUpdateTxnDailyStatsForBlockWithTxn(
+				txn, bitcloutBlock, utxoOpsForBlock, true /*isConnect*/); err != nil {
+
+				return errors.Wrapf(err, "ProcessBlock: Problem updating txn stats on simple add to tip")
+			}
+
+			// Record which txn spent each of the block's inputs.
+			if err := DbPutUtxoSpendEntriesForBlockWithTxn(txn, bitcloutBlock); err != nil {
+				return errors.Wrapf(err, "ProcessBlock: Problem putting utxo spend entries on simple add to tip")
+			}
+
+			// Count the block's fork signals and note any forks it activates.
+			if err := DbUpdateForkStatesForBlockWithTxn(txn, bitcloutBlock, true /*isConnect*/); err != nil {
+				return errors.Wrapf(err, "ProcessBlock: Problem updating fork states on simple add to tip")
+			}
+
+			// Tell the recipients of the block's txns about them. This looks up the
+			// posts the txns refer to so it has to happen after the view is flushed.
+			if err := DbPutNotificationsForBlockWithTxn(txn, bitcloutBlock); err != nil {
+				return errors.Wrapf(err, "ProcessBlock: Problem putting notifications on simple add to tip")
+			}
+
+			// Index the block's diamonds by time. Like the notifications this reads
+			// the PKIDs the view flushed.
+			if err := DbPutDiamondTimeIndexForBlockWithTxn(txn, bitcloutBlock); err != nil {
+				return errors.Wrapf(err, "ProcessBlock: Problem putting diamond time index on simple add to tip")
+			}
+
 			return nil
 		})
 
 		if err != nil {
 			return false, false, errors.Wrapf(err, "ProcessBlock: Problem writing block info to db on simple add to tip")
 		}
+		if err := DbDeleteCrashBreadcrumb(bc.db); err != nil {
+			return false, false, errors.Wrapf(err, "ProcessBlock: Problem clearing crash breadcrumb on simple add to tip")
+		}
 
 		// Now that we've set the best chain in the db, update our in-memory data
 		// structure to reflect this. Do a quick check first to make sure it's consistent.
@@ -1832,6 +2181,10 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 		newBestChain = append(newBestChain, nodeToValidate)
 		newBestChainMap[*nodeToValidate.Hash] = nodeToValidate
 		bc.bestChain, bc.bestChainMap = newBestChain, newBestChainMap
+		bc._evictOldBlockHeaders()
+		if _, err := bc._deleteExpiredUtxoOps(); err != nil {
+			glog.Errorf("ProcessBlock: Problem deleting expired utxo operations on simple add to tip: %v", err)
+		}
 
 		// This node is on the main chain so set this variable.
 		isMainChain = true
@@ -1849,6 +2202,11 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 		//   - The utxo operations performed for this block should also be stored so we
 		//     can roll the block back in the future if needed.
 
+		bc._maybeVerifyBlockConservation(nodeToValidate.Hash)
+
+		bc.eventManager.viewFlushed(utxoView)
+		bc.eventManager.blockConnected(bitcloutBlock, utxoOpsForBlock)
+
 		// If a Server object is set, then call its function.
 		if bc.server != nil {
 			bc.server._handleBlockMainChainConnectedd(bitcloutBlock)
@@ -1904,6 +2262,10 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 		// Go through and detach all of the blocks down to the common ancestor. We
 		// shouldn't encounter any errors but if we do, return without marking the
 		// block as invalid.
+		//
+		// Keep track of the utxo operations of the detached blocks for the events
+		// sent once the reorg is done.
+		utxoOpsForDetachBlocks := [][][]*UtxoOperation{}
 		for _, nodeToDetach := range detachBlocks {
 			// Fetch the utxo operations for the block we're detaching. We need these
 			// in order to be able to detach the block.
@@ -1934,6 +2296,7 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 				return false, false, errors.Wrapf(err, "ProcessBlock: Problem rolling back "+
 					"block (%v) during detachment in reorg", nodeToDetach)
 			}
+			utxoOpsForDetachBlocks = append(utxoOpsForDetachBlocks, utxoOps)
 			// Double-check that the view's hash is now at the block's parent.
 			if *utxoView.TipHash != *blockToDetach.Header.PrevBlockHash {
 				return false, false, fmt.Errorf("ProcessBlock: Block hash in utxo view (%v) "+
@@ -2036,13 +2399,49 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 		// the state after applying the reorg. With this information, it is possible to
 		// roll back the blocks and fast forward the db to the post-reorg state with a
 		// single transaction.
-		err = bc.db.Update(func(txn *badger.Txn) error {
+		if err := DbPutCrashBreadcrumb(bc.db, CrashBreadcrumbPhaseReorg, newTipNode.Hash); err != nil {
+			return false, false, errors.Wrapf(err, "ProcessBlock: Problem recording crash breadcrumb for reorg")
+		}
+		err = DbAtomicUpdate(bc.db, func(txn KVTxn) error {
 			// Set the best node hash to the new tip.
 			if err := PutBestHashWithTxn(txn, newTipNode.Hash, ChainTypeBitCloutBlock); err != nil {
 				return err
 			}
 
 			for _, detachNode := range detachBlocks {
+				// Remove the block's txns from the daily txn stats. This needs the
+				// utxo operations so it has to happen before they're deleted.
+				blockToDetach := GetBlockWithTxn(txn, detachNode.Hash)
+				if blockToDetach == nil {
+					return fmt.Errorf("ProcessBlock: Problem fetching block %v to update indexes", detachNode.Hash)
+				}
+				detachUtxoOps, err := GetUtxoOperationsForBlockWithTxn(txn, detachNode.Hash)
+				if err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem fetching utxo operations to update txn stats")
+				}
+				if err := DbUpdateTxnDailyStatsForBlockWithTxn(
+					txn, blockToDetach, detachUtxoOps, false /*isConnect*/); err != nil {
+
+					return errors.Wrapf(err, "ProcessBlock: Problem updating txn stats for detached block")
+				}
+
+				// The block's inputs are no longer spent by it.
+				if err := DbDeleteUtxoSpendEntriesForBlockWithTxn(txn, blockToDetach); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem deleting utxo spend entries for detached block")
+				}
+
+				if err := DbUpdateForkStatesForBlockWithTxn(txn, blockToDetach, false /*isConnect*/); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem updating fork states for detached block")
+				}
+
+				if err := DbDeleteNotificationsForBlockWithTxn(txn, blockToDetach); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem deleting notifications for detached block")
+				}
+
+				if err := DbDeleteDiamondTimeIndexForBlockWithTxn(txn, blockToDetach); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem deleting diamond time index for detached block")
+				}
+
 				// Delete the utxo operations for the blocks we're detaching since we don't need
 				// them anymore.
 				if err := DeleteUtxoOperationsForBlockWithTxn(txn, detachNode.Hash); err != nil {
@@ -2061,6 +2460,26 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 				if err := PutUtxoOperationsForBlockWithTxn(txn, attachNode.Hash, utxoOpsForAttachBlocks[ii]); err != nil {
 					return errors.Wrapf(err, "ProcessBlock: Problem putting utxo operations for block")
 				}
+
+				// Add the block's txns to the daily txn stats.
+				blockToAttach := GetBlockWithTxn(txn, attachNode.Hash)
+				if blockToAttach == nil {
+					return fmt.Errorf("ProcessBlock: Problem fetching block %v to update indexes", attachNode.Hash)
+				}
+				if err := DbUpdateTxnDailyStatsForBlockWithTxn(
+					txn, blockToAttach, utxoOpsForAttachBlocks[ii], true /*isConnect*/); err != nil {
+
+					return errors.Wrapf(err, "ProcessBlock: Problem updating txn stats for attached block")
+				}
+
+				// Record which txn spent each of the block's inputs.
+				if err := DbPutUtxoSpendEntriesForBlockWithTxn(txn, blockToAttach); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem putting utxo spend entries for attached block")
+				}
+
+				if err := DbUpdateForkStatesForBlockWithTxn(txn, blockToAttach, true /*isConnect*/); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem updating fork states for attached block")
+				}
 			}
 
 			// Write the modified utxo set to the view.
@@ -2068,11 +2487,30 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 				return errors.Wrapf(err, "ProcessBlock: Problem flushing to db")
 			}
 
+			// The notifications look up the posts the txns refer to, and the diamond
+			// time index looks up PKIDs, so they have to be added after the view is
+			// flushed.
+			for _, attachNode := range attachBlocks {
+				blockToAttach := GetBlockWithTxn(txn, attachNode.Hash)
+				if blockToAttach == nil {
+					return fmt.Errorf("ProcessBlock: Problem fetching block %v to add notifications", attachNode.Hash)
+				}
+				if err := DbPutNotificationsForBlockWithTxn(txn, blockToAttach); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem putting notifications for attached block")
+				}
+				if err := DbPutDiamondTimeIndexForBlockWithTxn(txn, blockToAttach); err != nil {
+					return errors.Wrapf(err, "ProcessBlock: Problem putting diamond time index for attached block")
+				}
+			}
+
 			return nil
 		})
 		if err != nil {
 			return false, false, errors.Errorf("ProcessBlock: Problem updating: %v", err)
 		}
+		if err := DbDeleteCrashBreadcrumb(bc.db); err != nil {
+			return false, false, errors.Wrapf(err, "ProcessBlock: Problem clearing crash breadcrumb for reorg")
+		}
 
 		// Now the the db has been updated, update our in-memory best chain. Note that there
 		// is no need to update the node index because it was updated as we went along.
@@ -2080,15 +2518,21 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 		newBestChain, newBestChainMap = updateBestChainInMemory(
 			newBestChain, newBestChainMap, detachBlocks, attachBlocks)
 		bc.bestChain, bc.bestChainMap = newBestChain, newBestChainMap
+		bc._evictOldBlockHeaders()
+		if _, err := bc._deleteExpiredUtxoOps(); err != nil {
+			glog.Errorf("ProcessBlock: Problem deleting expired utxo operations for reorg: %v", err)
+		}
 
 		// If we made it here then this block is on the main chain.
 		isMainChain = true
 
+		bc.eventManager.viewFlushed(utxoView)
+
 		// Signal to the server about all the blocks that were disconnected and
 		// connected as a result of this operation. Do this in a goroutine so that
 		// if ProcessBlock is called by a consumer of incomingMessages we don't
 		// have any risk of deadlocking.
-		for _, nodeToDetach := range detachBlocks {
+		for ii, nodeToDetach := range detachBlocks {
 			// Fetch the block itself since we need some info from it to roll
 			// it back.
 			blockToDetach, err := GetBlock(nodeToDetach.Hash, bc.db)
@@ -2097,12 +2541,14 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 					"block (%v) during detach in server signal", nodeToDetach)
 			}
 
+			bc.eventManager.blockDisconnected(blockToDetach, utxoOpsForDetachBlocks[ii])
+
 			// If we have a Server object then call its function
 			if bc.server != nil {
 				bc.server._handleBlockMainChainDisconnectedd(blockToDetach)
 			}
 		}
-		for _, attachNode := range attachBlocks {
+		for ii, attachNode := range attachBlocks {
 
 			// Fetch the block itself since we need some info from it to try and
 			// connect it.
@@ -2111,6 +2557,8 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 				return false, false, errors.Wrapf(err, "ProcessBlock: Problem fetching "+
 					"block (%v) during attach in server signal", attachNode)
 			}
+			bc._maybeVerifyBlockConservation(attachNode.Hash)
+			bc.eventManager.blockConnected(blockToAttach, utxoOpsForAttachBlocks[ii])
 			// If we have a Server object then call its function
 			if bc.server != nil {
 				bc.server._handleBlockMainChainConnectedd(blockToAttach)
@@ -2131,6 +2579,13 @@ func (bc *Blockchain) ProcessBlock(bitcloutBlock *MsgBitCloutBlock, verifySignat
 	// Now that we've done all of the above, we need to signal to the server that we've
 	// accepted the block
 
+	// Cached query results are tied to the old tip so free up the space they use.
+	if isMainChain {
+		if err := DbInvalidateQueryCache(bc.db); err != nil {
+			glog.Errorf("ProcessBlock: Problem invalidating query cache: %v", err)
+		}
+	}
+
 	// Signal the server that we've accepted this block in some way.
 	if bc.server != nil {
 		go func() {
@@ -2450,6 +2905,114 @@ func (bc *Blockchain) CreateLikeTxn(
 	return txn, totalInput, changeAmount, fees, nil
 }
 
+func (bc *Blockchain) CreatePollTxn(
+	userPublicKey []byte, postHash BlockHash, operationType PollOperationType,
+	options [][]byte, optionIndex uint64,
+	minFeeRateNanosPerKB uint64, mempool *BitCloutMempool) (
+	_txn *MsgBitCloutTxn, _totalInput uint64, _changeAmount uint64, _fees uint64,
+	_err error) {
+
+	// A Poll transaction doesn't need any inputs or outputs.
+	txn := &MsgBitCloutTxn{
+		PublicKey: userPublicKey,
+		TxnMeta: &PollMetadata{
+			PostHash:      &postHash,
+			OperationType: operationType,
+			Options:       options,
+			OptionIndex:   optionIndex,
+		},
+
+		// We wait to compute the signature until we've added all the
+		// inputs and change.
+	}
+
+	totalInput, spendAmount, changeAmount, fees, err :=
+		bc.AddInputsAndChangeToTransaction(txn, minFeeRateNanosPerKB, mempool)
+	if err != nil {
+		return nil, 0, 0, 0, errors.Wrapf(
+			err, "CreatePollTxn: Problem adding inputs: ")
+	}
+
+	// Sanity-check that the spendAmount is zero.
+	if spendAmount != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("CreatePollTxn: Spend amount "+
+			"should be zero but was %d instead: ", spendAmount)
+	}
+
+	return txn, totalInput, changeAmount, fees, nil
+}
+
+func (bc *Blockchain) CreateAuthorizeDerivedKeyTxn(
+	ownerPublicKey []byte, derivedPublicKey []byte, expirationBlock uint64,
+	operationType AuthorizeDerivedKeyOperationType,
+	transactionSpendingLimit *TransactionSpendingLimit,
+	minFeeRateNanosPerKB uint64, mempool *BitCloutMempool) (
+	_txn *MsgBitCloutTxn, _totalInput uint64, _changeAmount uint64, _fees uint64,
+	_err error) {
+
+	// An AuthorizeDerivedKey transaction doesn't need any inputs or outputs.
+	txn := &MsgBitCloutTxn{
+		PublicKey: ownerPublicKey,
+		TxnMeta: &AuthorizeDerivedKeyMetadata{
+			DerivedPublicKey:         derivedPublicKey,
+			ExpirationBlock:          expirationBlock,
+			OperationType:            operationType,
+			TransactionSpendingLimit: transactionSpendingLimit,
+		},
+
+		// We wait to compute the signature until we've added all the
+		// inputs and change.
+	}
+
+	totalInput, spendAmount, changeAmount, fees, err :=
+		bc.AddInputsAndChangeToTransaction(txn, minFeeRateNanosPerKB, mempool)
+	if err != nil {
+		return nil, 0, 0, 0, errors.Wrapf(
+			err, "CreateAuthorizeDerivedKeyTxn: Problem adding inputs: ")
+	}
+
+	// Sanity-check that the spendAmount is zero.
+	if spendAmount != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("CreateAuthorizeDerivedKeyTxn: Spend amount "+
+			"should be zero but was %d instead: ", spendAmount)
+	}
+
+	return txn, totalInput, changeAmount, fees, nil
+}
+
+func (bc *Blockchain) CreateUpdateTransferRestrictionTxn(
+	profilePublicKey []byte, transferRestrictionStatus TransferRestrictionStatus,
+	minFeeRateNanosPerKB uint64, mempool *BitCloutMempool) (
+	_txn *MsgBitCloutTxn, _totalInput uint64, _changeAmount uint64, _fees uint64,
+	_err error) {
+
+	// An UpdateTransferRestriction transaction doesn't need any inputs or outputs.
+	txn := &MsgBitCloutTxn{
+		PublicKey: profilePublicKey,
+		TxnMeta: &UpdateTransferRestrictionMetadata{
+			TransferRestrictionStatus: transferRestrictionStatus,
+		},
+
+		// We wait to compute the signature until we've added all the
+		// inputs and change.
+	}
+
+	totalInput, spendAmount, changeAmount, fees, err :=
+		bc.AddInputsAndChangeToTransaction(txn, minFeeRateNanosPerKB, mempool)
+	if err != nil {
+		return nil, 0, 0, 0, errors.Wrapf(
+			err, "CreateUpdateTransferRestrictionTxn: Problem adding inputs: ")
+	}
+
+	// Sanity-check that the spendAmount is zero.
+	if spendAmount != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("CreateUpdateTransferRestrictionTxn: Spend amount "+
+			"should be zero but was %d instead: ", spendAmount)
+	}
+
+	return txn, totalInput, changeAmount, fees, nil
+}
+
 func (bc *Blockchain) CreateFollowTxn(
 	senderPublicKey []byte, followedPublicKey []byte, isUnfollow bool,
 	minFeeRateNanosPerKB uint64, mempool *BitCloutMempool) (
@@ -205,6 +205,15 @@ func NewLowDifficultyBlockchainWithParams(params *BitCloutParams) (
 	paramsCopy.BlockRewardMaturity = time.Second * 4
 	paramsCopy.TimeBetweenDifficultyRetargets = 100 * time.Second
 	paramsCopy.MaxDifficultyRetargetFactor = 2
+	// Enable the txns that are only scheduled on testnet from genesis so the
+	// tests can use them.
+	paramsCopy.ProtocolForks = append([]ProtocolFork{}, params.ProtocolForks...)
+	for ii := range paramsCopy.ProtocolForks {
+		switch paramsCopy.ProtocolForks[ii].Name {
+		case ForkNamePolls, ForkNameDerivedKeys, ForkNameTransferRestrictions:
+			paramsCopy.ProtocolForks[ii].ActivationHeight = 0
+		}
+	}
 	paramsCopy.SeedBalances = []*BitCloutOutput{
 		{
 			PublicKey:   MustBase58CheckDecode(moneyPkString),
@@ -1522,3 +1531,147 @@ func TestForbiddenBlockSignaturePubKey(t *testing.T) {
 	require.Error(err)
 	require.Contains(err.Error(), RuleErrorForbiddenBlockProducerPublicKey)
 }
+
+func TestRecentBlockHeaders(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, _ = assert, require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 5; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	require.Equal(uint32(5), chain.blockTip().Height)
+
+	SetDbCacheConfig(&DbCacheConfig{MaxBlockHeaderEntries: 10})
+	defer SetDbCacheConfig(&DbCacheConfig{})
+
+	// Only keep the headers of the two blocks below the tip. This is set directly
+	// to get around MinRecentBlockHeaders.
+	chain.ChainLock.Lock()
+	chain.recentBlockHeaders = 2
+	assert.Equal(3, chain._evictOldBlockHeaders())
+	chain.ChainLock.Unlock()
+	for height, node := range chain.bestChain {
+		assert.Equal(height >= 3, node.Header != nil)
+	}
+
+	// Headers are still served for every block, whether they're in memory or not.
+	genesisHash := chain.bestChain[0].Hash
+	headers := chain.LocateBestBlockChainHeaders([]*BlockHash{genesisHash}, &BlockHash{})
+	require.Equal(5, len(headers))
+	for ii, header := range headers {
+		assert.Equal(uint64(ii+1), header.Height)
+		headerHash, err := header.Hash()
+		require.NoError(err)
+		assert.Equal(*chain.bestChain[ii+1].Hash, *headerHash)
+	}
+
+	// Mining another block drops the next header.
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	assert.Nil(chain.bestChain[3].Header)
+	assert.NotNil(chain.bestChain[4].Header)
+
+	// A node whose header was dropped can still be written, and keeps the
+	// header stored for it.
+	evictedNode := chain.bestChain[1]
+	require.NoError(PutHeightHashToNodeInfo(evictedNode, db, false /*bitcoinNodes*/))
+	assert.Nil(evictedNode.Header)
+	dbNode := GetHeightHashToNodeInfo(db, evictedNode.Height, evictedNode.Hash, false /*bitcoinNodes*/)
+	require.NotNil(dbNode)
+	require.NotNil(dbNode.Header)
+	assert.Equal(uint64(1), dbNode.Header.Height)
+
+	// Headers that fork off of a block whose header was dropped are rejected.
+	chain.ChainLock.RLock()
+	oldHeader, err := chain.headerForNode(chain.bestChain[2])
+	chain.ChainLock.RUnlock()
+	require.NoError(err)
+	forkHeader := *oldHeader
+	forkHeader.Nonce++
+	forkHash, err := forkHeader.Hash()
+	require.NoError(err)
+	_, _, err = chain.ProcessHeader(&forkHeader, forkHash)
+	require.Error(err)
+	assert.Contains(err.Error(), HeaderErrorInvalidParent)
+}
+
+func TestUtxoOpsRetention(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, _ = assert, require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 5; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	hasUtxoOps := func(height int) bool {
+		_, err := GetUtxoOperationsForBlock(db, chain.bestChain[height].Hash)
+		return err == nil
+	}
+	for height := 1; height <= 5; height++ {
+		assert.True(hasUtxoOps(height))
+	}
+
+	// Keeping the last two blocks deletes everything older in one pass. The
+	// genesis block is never swept.
+	chain.ChainLock.Lock()
+	chain.utxoOpsKeepBlocks = 2
+	numDeleted, err := chain._deleteExpiredUtxoOps()
+	chain.ChainLock.Unlock()
+	require.NoError(err)
+	assert.Equal(uint64(3), numDeleted)
+	assert.Equal(uint64(4), DbGetUtxoOpsDeletedBelowHeight(db))
+	for height := 1; height <= 5; height++ {
+		assert.Equal(height >= 4, hasUtxoOps(height))
+	}
+
+	// Connecting a block deletes the utxo operations of the block that's no
+	// longer in the window.
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	assert.Equal(uint64(5), DbGetUtxoOpsDeletedBelowHeight(db))
+	assert.False(hasUtxoOps(4))
+	assert.True(hasUtxoOps(5))
+	assert.True(hasUtxoOps(6))
+}
+
+func TestParseUtxoOpsRetention(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, _ = assert, require
+
+	params := &BitCloutTestnetParams
+	retention, nn, err := ParseUtxoOpsRetention("keep-all", params)
+	require.NoError(err)
+	assert.Equal(UtxoOpsRetentionKeepAll, retention)
+
+	keepLastStr := fmt.Sprintf("keep-last:%d", params.FinalityDepthBlocks+10)
+	retention, nn, err = ParseUtxoOpsRetention(keepLastStr, params)
+	require.NoError(err)
+	assert.Equal(UtxoOpsRetentionKeepLastN, retention)
+	assert.Equal(params.FinalityDepthBlocks+10, nn)
+	nodeConfig := &NodeConfigEntry{UtxoOpsRetention: retention, UtxoOpsRetentionBlocks: nn}
+	assert.Equal(params.FinalityDepthBlocks+10, nodeConfig.GetUtxoOpsKeepBlocks(params))
+
+	// A saved config that keeps fewer blocks than the finality depth keeps the
+	// finality depth.
+	nodeConfig = &NodeConfigEntry{UtxoOpsRetention: UtxoOpsRetentionKeepLastN, UtxoOpsRetentionBlocks: 1}
+	assert.Equal(params.FinalityDepthBlocks, nodeConfig.GetUtxoOpsKeepBlocks(params))
+
+	retention, _, err = ParseUtxoOpsRetention("keep-none-after-finality", params)
+	require.NoError(err)
+	nodeConfig = &NodeConfigEntry{UtxoOpsRetention: retention}
+	assert.Equal(params.FinalityDepthBlocks, nodeConfig.GetUtxoOpsKeepBlocks(params))
+
+	tooFewStr := fmt.Sprintf("keep-last:%d", params.FinalityDepthBlocks-1)
+	for _, badRetention := range []string{"keep-last:0", "keep-last:1", tooFewStr, "keep-last", "keep-some:5", "forever"} {
+		_, _, err = ParseUtxoOpsRetention(badRetention, params)
+		assert.Error(err, badRetention)
+	}
+}
@@ -0,0 +1,407 @@
+package lib
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// A ChainStore is somewhere the chain's state can be read and written without the
+// caller knowing how it's stored. BadgerChainStore is the node's own badger db and
+// PostgresChainStore keeps posts, profiles, follows, and balances in relational
+// tables so services built on the node can query them with SQL.
+//
+// A UtxoView reads the entries it doesn't have through its Store rather than
+// the Db* functions. The chain itself always connects blocks against badger, so
+// that's a BadgerChainStore. A node started with --chain-store=postgres keeps a
+// PostgresChainStore in sync with the entries the chain flushes to badger. See
+// ChainStoreMirror.
+type ChainStore interface {
+	// Get returns nil if the key isn't set.
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, val []byte) error
+	Delete(key []byte) error
+	// Scan calls handler with every key under prefix, in key order. The slices
+	// passed to handler are only valid until it returns.
+	Scan(prefix []byte, handler func(key []byte, val []byte) error) error
+
+	// The typed getters return nil if the entry doesn't exist.
+	GetPostEntry(postHash *BlockHash) (*PostEntry, error)
+	PutPostEntry(postEntry *PostEntry) error
+	DeletePostEntry(postHash *BlockHash) error
+	GetProfileEntry(pkid *PKID) (*ProfileEntry, error)
+	PutProfileEntry(profileEntry *ProfileEntry, pkid *PKID) error
+	DeleteProfileEntry(pkid *PKID) error
+	IsFollowing(followerPKID *PKID, followedPKID *PKID) (bool, error)
+	PutFollow(followerPKID *PKID, followedPKID *PKID) error
+	DeleteFollow(followerPKID *PKID, followedPKID *PKID) error
+	GetPKIDsYouFollow(pkid *PKID) ([]*PKID, error)
+	GetPKIDsFollowingYou(pkid *PKID) ([]*PKID, error)
+	GetBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) (*BalanceEntry, error)
+	PutBalanceEntry(balanceEntry *BalanceEntry) error
+	DeleteBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) error
+
+	Close() error
+}
+
+const (
+	ChainStoreTypeBadger   = "badger"
+	ChainStoreTypePostgres = "postgres"
+)
+
+// BadgerChainStore is a ChainStore on top of the Db* functions. Its typed methods
+// keep every index the entries have in badger just like a UtxoView flush does.
+type BadgerChainStore struct {
+	handle *badger.DB
+	params *BitCloutParams
+}
+
+func NewBadgerChainStore(handle *badger.DB, params *BitCloutParams) *BadgerChainStore {
+	return &BadgerChainStore{
+		handle: handle,
+		params: params,
+	}
+}
+
+func (bcs *BadgerChainStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := DbView(bcs.handle, func(txn KVTxn) error {
+		var err error
+		val, err = txn.Get(key)
+		if err == ErrKVKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "BadgerChainStore.Get: ")
+	}
+	return val, nil
+}
+
+func (bcs *BadgerChainStore) Put(key []byte, val []byte) error {
+	return DbUpdate(bcs.handle, func(txn KVTxn) error {
+		return txn.Set(key, val)
+	})
+}
+
+func (bcs *BadgerChainStore) Delete(key []byte) error {
+	return DbUpdate(bcs.handle, func(txn KVTxn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (bcs *BadgerChainStore) Scan(prefix []byte, handler func(key []byte, val []byte) error) error {
+	return DbView(bcs.handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		opts.Prefix = prefix
+		nodeIterator := txn.NewIterator(opts)
+		defer nodeIterator.Close()
+		for nodeIterator.Seek(prefix); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+			valBytes, err := nodeIterator.Value()
+			if err != nil {
+				return err
+			}
+			if err := handler(nodeIterator.Key(), valBytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bcs *BadgerChainStore) GetPostEntry(postHash *BlockHash) (*PostEntry, error) {
+	return DBGetPostEntryByPostHash(bcs.handle, postHash), nil
+}
+
+func (bcs *BadgerChainStore) PutPostEntry(postEntry *PostEntry) error {
+	return DbAtomicUpdate(bcs.handle, func(txn KVTxn) error {
+		// The old post's indexes, like its timestamp, have to go first.
+		if err := DBDeletePostEntryMappingsWithTxn(txn, postEntry.PostHash, bcs.params); err != nil {
+			return err
+		}
+		return DBPutPostEntryMappingsWithTxn(
+			txn, postEntry, bcs.params, DbGetMaxIndexedTstampNanosForTipWithTxn(txn))
+	})
+}
+
+func (bcs *BadgerChainStore) DeletePostEntry(postHash *BlockHash) error {
+	return DBDeletePostEntryMappings(bcs.handle, postHash, bcs.params)
+}
+
+func (bcs *BadgerChainStore) GetProfileEntry(pkid *PKID) (*ProfileEntry, error) {
+	return DBGetProfileEntryForPKID(bcs.handle, pkid), nil
+}
+
+func (bcs *BadgerChainStore) PutProfileEntry(profileEntry *ProfileEntry, pkid *PKID) error {
+	return DbAtomicUpdate(bcs.handle, func(txn KVTxn) error {
+		// The old username and locked nanos mappings have to go first.
+		if err := DBDeleteProfileEntryMappingsWithTxn(txn, pkid, bcs.params); err != nil {
+			return err
+		}
+		return DBPutProfileEntryMappingsWithTxn(txn, profileEntry, pkid, bcs.params)
+	})
+}
+
+func (bcs *BadgerChainStore) DeleteProfileEntry(pkid *PKID) error {
+	return DBDeleteProfileEntryMappings(bcs.handle, pkid, bcs.params)
+}
+
+func (bcs *BadgerChainStore) IsFollowing(followerPKID *PKID, followedPKID *PKID) (bool, error) {
+	return DbGetFollowerToFollowedMapping(bcs.handle, followerPKID, followedPKID) != nil, nil
+}
+
+func (bcs *BadgerChainStore) PutFollow(followerPKID *PKID, followedPKID *PKID) error {
+	return DbAtomicUpdate(bcs.handle, func(txn KVTxn) error {
+		// Putting a follow that's already there would count it twice.
+		if DbGetFollowerToFollowedMappingWithTxn(txn, followerPKID, followedPKID) != nil {
+			return nil
+		}
+		return DbPutFollowMappingsWithTxn(txn, followerPKID, followedPKID)
+	})
+}
+
+func (bcs *BadgerChainStore) DeleteFollow(followerPKID *PKID, followedPKID *PKID) error {
+	return DbDeleteFollowMappings(bcs.handle, followerPKID, followedPKID)
+}
+
+func (bcs *BadgerChainStore) GetPKIDsYouFollow(pkid *PKID) ([]*PKID, error) {
+	return DbGetPKIDsYouFollow(bcs.handle, pkid, 0 /*limit*/, nil /*startPKID*/)
+}
+
+func (bcs *BadgerChainStore) GetPKIDsFollowingYou(pkid *PKID) ([]*PKID, error) {
+	return DbGetPKIDsFollowingYou(bcs.handle, pkid, 0 /*limit*/, nil /*startPKID*/)
+}
+
+func (bcs *BadgerChainStore) GetBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) (*BalanceEntry, error) {
+	return DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDs(bcs.handle, hodlerPKID, creatorPKID), nil
+}
+
+func (bcs *BadgerChainStore) PutBalanceEntry(balanceEntry *BalanceEntry) error {
+	return DbAtomicUpdate(bcs.handle, func(txn KVTxn) error {
+		return DBPutCreatorCoinBalanceEntryMappingsWithTxn(txn, balanceEntry, bcs.params)
+	})
+}
+
+func (bcs *BadgerChainStore) DeleteBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) error {
+	return DBDeleteCreatorCoinBalanceEntryMappings(bcs.handle, hodlerPKID, creatorPKID, bcs.params)
+}
+
+// Close doesn't close the db since the node owns it.
+func (bcs *BadgerChainStore) Close() error {
+	return nil
+}
+
+// ChainStoreMirrorQueueSize is how many writes a ChainStoreMirror can fall
+// behind the chain before it gives up on the store.
+const ChainStoreMirrorQueueSize = 100000
+
+// chainStoreMirrorWrite is a single write a ChainStoreMirror makes to its store.
+type chainStoreMirrorWrite func(store ChainStore) error
+
+// chainStoreMirrorOp is either a write or, for Wait, a channel to close once
+// every write before it has been made.
+type chainStoreMirrorOp struct {
+	write      chainStoreMirrorWrite
+	writesMade chan struct{}
+}
+
+// _chainStoreWriteForFlushedEntry returns the write for a single entry a view
+// flushed to badger, or nil if the store doesn't have a place for it. It runs
+// with the chain locked, so anything it needs from badger is read here, and the
+// entry is copied since the write is made later.
+func _chainStoreWriteForFlushedEntry(handle *badger.DB, event *EntryFlushedEvent) chainStoreMirrorWrite {
+	isDeleted := event.IsDeleted
+	switch entry := event.Entry.(type) {
+	case *PostEntry:
+		postEntry := *entry
+		return func(store ChainStore) error {
+			if isDeleted {
+				return store.DeletePostEntry(postEntry.PostHash)
+			}
+			return store.PutPostEntry(&postEntry)
+		}
+
+	case *ProfileEntry:
+		// Profiles are keyed by PKID in the view but the entry only has the
+		// public key. The PKID mapping is flushed along with the profile.
+		profileEntry := *entry
+		pkidEntry := DBGetPKIDEntryForPublicKey(handle, profileEntry.PublicKey)
+		return func(store ChainStore) error {
+			if pkidEntry == nil {
+				return errors.Errorf("No PKID for profile %v", PkToStringBoth(profileEntry.PublicKey))
+			}
+			if isDeleted {
+				return store.DeleteProfileEntry(pkidEntry.PKID)
+			}
+			return store.PutProfileEntry(&profileEntry, pkidEntry.PKID)
+		}
+
+	case *FollowEntry:
+		followerPKID, followedPKID := entry.FollowerPKID, entry.FollowedPKID
+		return func(store ChainStore) error {
+			if isDeleted {
+				return store.DeleteFollow(followerPKID, followedPKID)
+			}
+			return store.PutFollow(followerPKID, followedPKID)
+		}
+
+	case *BalanceEntry:
+		balanceEntry := *entry
+		return func(store ChainStore) error {
+			if isDeleted {
+				return store.DeleteBalanceEntry(balanceEntry.HODLerPKID, balanceEntry.CreatorPKID)
+			}
+			return store.PutBalanceEntry(&balanceEntry)
+		}
+	}
+	return nil
+}
+
+// ChainStoreMirror keeps a store up to date with the posts, profiles, follows,
+// and balances the chain flushes to badger, and with its tip. The EventManager
+// calls its handlers with the chain locked, so they only queue the writes and a
+// goroutine of its own makes them. That way a slow store, like Postgres, never
+// holds up connecting blocks.
+//
+// If a write fails, or the store falls more than ChainStoreMirrorQueueSize
+// writes behind, the mirror clears the store's tip and stops writing to it. The
+// store no longer matches the db, so ChainStoreIsCurrent is false for it and the
+// node copies the db into it again on its next start.
+type ChainStoreMirror struct {
+	store ChainStore
+
+	mtx     sync.Mutex
+	ops     chan chainStoreMirrorOp
+	stopped bool
+	// Set once the store has missed a write. It's read by the goroutine and set
+	// by whichever side notices.
+	diverged int32
+	done     chan struct{}
+}
+
+// MirrorEntriesToChainStore starts a ChainStoreMirror for store. The store has
+// to match the db when it's called. See PostgresChainStore.CopyFromDb.
+func MirrorEntriesToChainStore(eventManager *EventManager, handle *badger.DB, store ChainStore) *ChainStoreMirror {
+	mirror := &ChainStoreMirror{
+		store: store,
+		ops:   make(chan chainStoreMirrorOp, ChainStoreMirrorQueueSize),
+		done:  make(chan struct{}),
+	}
+	go mirror.run()
+
+	eventManager.OnEntryFlushed(func(event *EntryFlushedEvent) {
+		if write := _chainStoreWriteForFlushedEntry(handle, event); write != nil {
+			mirror.enqueue(write)
+		}
+	})
+	putTip := func(tipHash *BlockHash) {
+		mirror.enqueue(func(store ChainStore) error {
+			return errors.Wrapf(store.Put(_KeyBestBitCloutBlockHash, tipHash[:]),
+				"Problem putting tip %v", tipHash)
+		})
+	}
+	eventManager.OnBlockConnected(func(event *BlockEvent) {
+		blockHash, _ := event.Block.Header.Hash()
+		putTip(blockHash)
+	})
+	eventManager.OnBlockDisconnected(func(event *BlockEvent) {
+		putTip(event.Block.Header.PrevBlockHash)
+	})
+	return mirror
+}
+
+// enqueue never blocks since it's called with the chain locked.
+func (mirror *ChainStoreMirror) enqueue(write chainStoreMirrorWrite) {
+	mirror.mtx.Lock()
+	defer mirror.mtx.Unlock()
+	if mirror.stopped || atomic.LoadInt32(&mirror.diverged) != 0 {
+		return
+	}
+	select {
+	case mirror.ops <- chainStoreMirrorOp{write: write}:
+	default:
+		glog.Errorf("ChainStoreMirror: Store is %d writes behind; it won't be "+
+			"updated again until the node restarts and copies the db into it",
+			ChainStoreMirrorQueueSize)
+		atomic.StoreInt32(&mirror.diverged, 1)
+	}
+}
+
+func (mirror *ChainStoreMirror) run() {
+	defer close(mirror.done)
+
+	tipCleared := false
+	for op := range mirror.ops {
+		if op.writesMade != nil {
+			close(op.writesMade)
+			continue
+		}
+		if atomic.LoadInt32(&mirror.diverged) == 0 {
+			err := op.write(mirror.store)
+			if err == nil {
+				continue
+			}
+			glog.Errorf("ChainStoreMirror: Problem writing to store; it won't be "+
+				"updated again until the node restarts and copies the db into it: %v", err)
+			atomic.StoreInt32(&mirror.diverged, 1)
+		}
+		if !tipCleared {
+			mirror._clearTip()
+			tipCleared = true
+		}
+	}
+	if atomic.LoadInt32(&mirror.diverged) != 0 && !tipCleared {
+		mirror._clearTip()
+	}
+}
+
+// _clearTip makes sure the store isn't taken for current once it's missed a
+// write, even if the chain comes back to the tip it has.
+func (mirror *ChainStoreMirror) _clearTip() {
+	if err := mirror.store.Delete(_KeyBestBitCloutBlockHash); err != nil {
+		glog.Errorf("ChainStoreMirror: Problem clearing tip: %v", err)
+	}
+}
+
+// Wait blocks until every write queued so far has been made or skipped. It
+// holds up queueing while the queue is full, so it's meant for tests.
+func (mirror *ChainStoreMirror) Wait() {
+	writesMade := make(chan struct{})
+	mirror.mtx.Lock()
+	if mirror.stopped {
+		mirror.mtx.Unlock()
+		return
+	}
+	mirror.ops <- chainStoreMirrorOp{writesMade: writesMade}
+	mirror.mtx.Unlock()
+	<-writesMade
+}
+
+// Stop makes the writes that are still queued and stops the goroutine. The
+// store can be closed once it returns.
+func (mirror *ChainStoreMirror) Stop() {
+	mirror.mtx.Lock()
+	if mirror.stopped {
+		mirror.mtx.Unlock()
+		return
+	}
+	mirror.stopped = true
+	close(mirror.ops)
+	mirror.mtx.Unlock()
+	<-mirror.done
+}
+
+// ChainStoreIsCurrent returns whether the store's tip matches the db's.
+func ChainStoreIsCurrent(handle *badger.DB, store ChainStore) (bool, error) {
+	storeTip, err := store.Get(_KeyBestBitCloutBlockHash)
+	if err != nil {
+		return false, errors.Wrapf(err, "ChainStoreIsCurrent: ")
+	}
+	dbTip := DbGetBestHash(handle, ChainTypeBitCloutBlock)
+	return dbTip != nil && bytes.Equal(storeTip, dbTip[:]), nil
+}
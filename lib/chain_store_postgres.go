@@ -0,0 +1,473 @@
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// PostgresChainStore is a ChainStore on top of Postgres. Posts, profiles, follows,
+// and balances each get a table with a column for every field worth querying on,
+// along with the entry in the same encoding badger has so Get returns exactly
+// what was Put. Everything else goes in a plain key/value table.
+//
+// lib doesn't link a Postgres driver itself. The node binary registers
+// github.com/lib/pq with database/sql under the name "postgres", and anything
+// else that opens one has to do the same.
+//
+// Postgres doesn't have unsigned integers so uint64 fields are stored as BIGINT.
+// None of them get anywhere near 2^63 in practice. Post bodies and descriptions
+// are BYTEA since TEXT can't hold every byte string a txn can.
+type PostgresChainStore struct {
+	db     *sql.DB
+	params *BitCloutParams
+}
+
+// _postgresSchema is run every time the store is opened so it only creates what
+// isn't there.
+var _postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS kv (
+		key BYTEA PRIMARY KEY,
+		value BYTEA NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS posts (
+		post_hash BYTEA PRIMARY KEY,
+		poster_public_key BYTEA NOT NULL,
+		parent_stake_id BYTEA,
+		body BYTEA NOT NULL,
+		reclouted_post_hash BYTEA,
+		is_quoted_reclout BOOLEAN NOT NULL,
+		timestamp_nanos BIGINT NOT NULL,
+		confirmation_block_height BIGINT NOT NULL,
+		is_hidden BOOLEAN NOT NULL,
+		is_pinned BOOLEAN NOT NULL,
+		like_count BIGINT NOT NULL,
+		reclout_count BIGINT NOT NULL,
+		diamond_count BIGINT NOT NULL,
+		comment_count BIGINT NOT NULL,
+		entry BYTEA NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS posts_poster_timestamp ON posts (poster_public_key, timestamp_nanos)`,
+	`CREATE INDEX IF NOT EXISTS posts_parent_stake_id ON posts (parent_stake_id)`,
+	`CREATE INDEX IF NOT EXISTS posts_timestamp ON posts (timestamp_nanos)`,
+	`CREATE TABLE IF NOT EXISTS profiles (
+		pkid BYTEA PRIMARY KEY,
+		public_key BYTEA NOT NULL,
+		username TEXT NOT NULL,
+		description BYTEA NOT NULL,
+		is_hidden BOOLEAN NOT NULL,
+		creator_basis_points BIGINT NOT NULL,
+		bitclout_locked_nanos BIGINT NOT NULL,
+		number_of_holders BIGINT NOT NULL,
+		coins_in_circulation_nanos BIGINT NOT NULL,
+		entry BYTEA NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS profiles_username ON profiles (LOWER(username))`,
+	`CREATE INDEX IF NOT EXISTS profiles_bitclout_locked_nanos ON profiles (bitclout_locked_nanos)`,
+	`CREATE TABLE IF NOT EXISTS follows (
+		follower_pkid BYTEA NOT NULL,
+		followed_pkid BYTEA NOT NULL,
+		PRIMARY KEY (follower_pkid, followed_pkid)
+	)`,
+	`CREATE INDEX IF NOT EXISTS follows_followed_pkid ON follows (followed_pkid)`,
+	`CREATE TABLE IF NOT EXISTS balances (
+		hodler_pkid BYTEA NOT NULL,
+		creator_pkid BYTEA NOT NULL,
+		balance_nanos BIGINT NOT NULL,
+		has_purchased BOOLEAN NOT NULL,
+		PRIMARY KEY (hodler_pkid, creator_pkid)
+	)`,
+	`CREATE INDEX IF NOT EXISTS balances_creator_balance ON balances (creator_pkid, balance_nanos)`,
+}
+
+// _postgresExecer is satisfied by both *sql.DB and *sql.Tx so the same writes can
+// be made on their own or as part of CopyFromDb.
+type _postgresExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// NewPostgresChainStore connects to the db at dataSourceName, a Postgres
+// connection string, and creates the tables if they don't exist.
+func NewPostgresChainStore(dataSourceName string, params *BitCloutParams) (*PostgresChainStore, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewPostgresChainStore: Problem opening db; make sure "+
+			"the binary registers a Postgres driver: ")
+	}
+	for _, statement := range _postgresSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, errors.Wrapf(err, "NewPostgresChainStore: Problem creating tables: ")
+		}
+	}
+	return &PostgresChainStore{
+		db:     db,
+		params: params,
+	}, nil
+}
+
+// _postgresPrefixEnd returns the smallest key that's greater than every key under
+// prefix, or nil if there isn't one.
+func _postgresPrefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for ii := len(end) - 1; ii >= 0; ii-- {
+		if end[ii] < 0xff {
+			end[ii]++
+			return end[:ii+1]
+		}
+	}
+	return nil
+}
+
+func (pgs *PostgresChainStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := pgs.db.QueryRow(`SELECT value FROM kv WHERE key = $1`, key).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "PostgresChainStore.Get: ")
+	}
+	return val, nil
+}
+
+func (pgs *PostgresChainStore) Put(key []byte, val []byte) error {
+	_, err := pgs.db.Exec(`INSERT INTO kv (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, key, val)
+	return errors.Wrapf(err, "PostgresChainStore.Put: ")
+}
+
+func (pgs *PostgresChainStore) Delete(key []byte) error {
+	_, err := pgs.db.Exec(`DELETE FROM kv WHERE key = $1`, key)
+	return errors.Wrapf(err, "PostgresChainStore.Delete: ")
+}
+
+// Scan only covers the keys that were Put. The typed entries aren't in kv.
+func (pgs *PostgresChainStore) Scan(prefix []byte, handler func(key []byte, val []byte) error) error {
+	var rows *sql.Rows
+	var err error
+	if prefixEnd := _postgresPrefixEnd(prefix); prefixEnd != nil {
+		rows, err = pgs.db.Query(`SELECT key, value FROM kv WHERE key >= $1 AND key < $2
+			ORDER BY key`, prefix, prefixEnd)
+	} else {
+		rows, err = pgs.db.Query(`SELECT key, value FROM kv WHERE key >= $1 ORDER BY key`, prefix)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "PostgresChainStore.Scan: ")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, val []byte
+		if err := rows.Scan(&key, &val); err != nil {
+			return errors.Wrapf(err, "PostgresChainStore.Scan: ")
+		}
+		if err := handler(key, val); err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(rows.Err(), "PostgresChainStore.Scan: ")
+}
+
+// _postgresGetEntry reads the entry column of the single row the query returns,
+// or nil if there isn't one.
+func (pgs *PostgresChainStore) _postgresGetEntry(query string, args ...interface{}) ([]byte, error) {
+	var entryBytes []byte
+	err := pgs.db.QueryRow(query, args...).Scan(&entryBytes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entryBytes, err
+}
+
+func (pgs *PostgresChainStore) GetPostEntry(postHash *BlockHash) (*PostEntry, error) {
+	entryBytes, err := pgs._postgresGetEntry(`SELECT entry FROM posts WHERE post_hash = $1`, postHash[:])
+	if err != nil || entryBytes == nil {
+		return nil, errors.Wrapf(err, "PostgresChainStore.GetPostEntry: ")
+	}
+	postEntry := &PostEntry{}
+	if err := _DbDecodePostEntry(entryBytes, postEntry); err != nil {
+		return nil, errors.Wrapf(err, "PostgresChainStore.GetPostEntry: ")
+	}
+	return postEntry, nil
+}
+
+func _postgresPutPostEntry(execer _postgresExecer, postEntry *PostEntry) error {
+	var recloutedPostHash []byte
+	if postEntry.RecloutedPostHash != nil {
+		recloutedPostHash = postEntry.RecloutedPostHash[:]
+	}
+	_, err := execer.Exec(`INSERT INTO posts (post_hash, poster_public_key, parent_stake_id,
+			body, reclouted_post_hash, is_quoted_reclout, timestamp_nanos,
+			confirmation_block_height, is_hidden, is_pinned, like_count, reclout_count,
+			diamond_count, comment_count, entry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (post_hash) DO UPDATE SET poster_public_key = EXCLUDED.poster_public_key,
+			parent_stake_id = EXCLUDED.parent_stake_id, body = EXCLUDED.body,
+			reclouted_post_hash = EXCLUDED.reclouted_post_hash,
+			is_quoted_reclout = EXCLUDED.is_quoted_reclout,
+			timestamp_nanos = EXCLUDED.timestamp_nanos,
+			confirmation_block_height = EXCLUDED.confirmation_block_height,
+			is_hidden = EXCLUDED.is_hidden, is_pinned = EXCLUDED.is_pinned,
+			like_count = EXCLUDED.like_count, reclout_count = EXCLUDED.reclout_count,
+			diamond_count = EXCLUDED.diamond_count, comment_count = EXCLUDED.comment_count,
+			entry = EXCLUDED.entry`,
+		postEntry.PostHash[:], postEntry.PosterPublicKey, postEntry.ParentStakeID,
+		postEntry.Body, recloutedPostHash, postEntry.IsQuotedReclout,
+		int64(postEntry.TimestampNanos), int64(postEntry.ConfirmationBlockHeight),
+		postEntry.IsHidden, postEntry.IsPinned, int64(postEntry.LikeCount),
+		int64(postEntry.RecloutCount), int64(postEntry.DiamondCount),
+		int64(postEntry.CommentCount), _DbBufForPostEntry(postEntry))
+	return err
+}
+
+func (pgs *PostgresChainStore) PutPostEntry(postEntry *PostEntry) error {
+	return errors.Wrapf(_postgresPutPostEntry(pgs.db, postEntry), "PostgresChainStore.PutPostEntry: ")
+}
+
+func (pgs *PostgresChainStore) DeletePostEntry(postHash *BlockHash) error {
+	_, err := pgs.db.Exec(`DELETE FROM posts WHERE post_hash = $1`, postHash[:])
+	return errors.Wrapf(err, "PostgresChainStore.DeletePostEntry: ")
+}
+
+func (pgs *PostgresChainStore) GetProfileEntry(pkid *PKID) (*ProfileEntry, error) {
+	entryBytes, err := pgs._postgresGetEntry(`SELECT entry FROM profiles WHERE pkid = $1`, pkid[:])
+	if err != nil || entryBytes == nil {
+		return nil, errors.Wrapf(err, "PostgresChainStore.GetProfileEntry: ")
+	}
+	profileEntry := &ProfileEntry{}
+	if err := _DbDecodeProfileEntry(entryBytes, profileEntry); err != nil {
+		return nil, errors.Wrapf(err, "PostgresChainStore.GetProfileEntry: ")
+	}
+	return profileEntry, nil
+}
+
+func _postgresPutProfileEntry(execer _postgresExecer, profileEntry *ProfileEntry, pkid *PKID) error {
+	_, err := execer.Exec(`INSERT INTO profiles (pkid, public_key, username, description,
+			is_hidden, creator_basis_points, bitclout_locked_nanos, number_of_holders,
+			coins_in_circulation_nanos, entry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (pkid) DO UPDATE SET public_key = EXCLUDED.public_key,
+			username = EXCLUDED.username, description = EXCLUDED.description,
+			is_hidden = EXCLUDED.is_hidden,
+			creator_basis_points = EXCLUDED.creator_basis_points,
+			bitclout_locked_nanos = EXCLUDED.bitclout_locked_nanos,
+			number_of_holders = EXCLUDED.number_of_holders,
+			coins_in_circulation_nanos = EXCLUDED.coins_in_circulation_nanos,
+			entry = EXCLUDED.entry`,
+		pkid[:], profileEntry.PublicKey, string(profileEntry.Username),
+		profileEntry.Description, profileEntry.IsHidden,
+		int64(profileEntry.CreatorBasisPoints), int64(profileEntry.BitCloutLockedNanos),
+		int64(profileEntry.NumberOfHolders), int64(profileEntry.CoinsInCirculationNanos),
+		_DbBufForProfileEntry(profileEntry))
+	return err
+}
+
+func (pgs *PostgresChainStore) PutProfileEntry(profileEntry *ProfileEntry, pkid *PKID) error {
+	return errors.Wrapf(_postgresPutProfileEntry(pgs.db, profileEntry, pkid),
+		"PostgresChainStore.PutProfileEntry: ")
+}
+
+func (pgs *PostgresChainStore) DeleteProfileEntry(pkid *PKID) error {
+	_, err := pgs.db.Exec(`DELETE FROM profiles WHERE pkid = $1`, pkid[:])
+	return errors.Wrapf(err, "PostgresChainStore.DeleteProfileEntry: ")
+}
+
+func (pgs *PostgresChainStore) IsFollowing(followerPKID *PKID, followedPKID *PKID) (bool, error) {
+	var exists bool
+	err := pgs.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM follows
+		WHERE follower_pkid = $1 AND followed_pkid = $2)`, followerPKID[:], followedPKID[:]).Scan(&exists)
+	return exists, errors.Wrapf(err, "PostgresChainStore.IsFollowing: ")
+}
+
+func _postgresPutFollow(execer _postgresExecer, followerPKID *PKID, followedPKID *PKID) error {
+	_, err := execer.Exec(`INSERT INTO follows (follower_pkid, followed_pkid) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, followerPKID[:], followedPKID[:])
+	return err
+}
+
+func (pgs *PostgresChainStore) PutFollow(followerPKID *PKID, followedPKID *PKID) error {
+	return errors.Wrapf(_postgresPutFollow(pgs.db, followerPKID, followedPKID),
+		"PostgresChainStore.PutFollow: ")
+}
+
+func (pgs *PostgresChainStore) DeleteFollow(followerPKID *PKID, followedPKID *PKID) error {
+	_, err := pgs.db.Exec(`DELETE FROM follows WHERE follower_pkid = $1 AND followed_pkid = $2`,
+		followerPKID[:], followedPKID[:])
+	return errors.Wrapf(err, "PostgresChainStore.DeleteFollow: ")
+}
+
+func (pgs *PostgresChainStore) GetPKIDsYouFollow(pkid *PKID) ([]*PKID, error) {
+	pkids, err := pgs._postgresGetPKIDs(`SELECT followed_pkid FROM follows WHERE follower_pkid = $1
+		ORDER BY followed_pkid`, pkid[:])
+	return pkids, errors.Wrapf(err, "PostgresChainStore.GetPKIDsYouFollow: ")
+}
+
+func (pgs *PostgresChainStore) GetPKIDsFollowingYou(pkid *PKID) ([]*PKID, error) {
+	pkids, err := pgs._postgresGetPKIDs(`SELECT follower_pkid FROM follows WHERE followed_pkid = $1
+		ORDER BY follower_pkid`, pkid[:])
+	return pkids, errors.Wrapf(err, "PostgresChainStore.GetPKIDsFollowingYou: ")
+}
+
+// _postgresGetPKIDs reads the single PKID column of every row the query returns.
+func (pgs *PostgresChainStore) _postgresGetPKIDs(query string, args ...interface{}) ([]*PKID, error) {
+	rows, err := pgs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pkids := []*PKID{}
+	for rows.Next() {
+		var pkidBytes []byte
+		if err := rows.Scan(&pkidBytes); err != nil {
+			return nil, err
+		}
+		pkids = append(pkids, PublicKeyToPKID(pkidBytes))
+	}
+	return pkids, rows.Err()
+}
+
+func (pgs *PostgresChainStore) GetBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) (*BalanceEntry, error) {
+	var balanceNanos int64
+	var hasPurchased bool
+	err := pgs.db.QueryRow(`SELECT balance_nanos, has_purchased FROM balances
+		WHERE hodler_pkid = $1 AND creator_pkid = $2`, hodlerPKID[:], creatorPKID[:]).Scan(
+		&balanceNanos, &hasPurchased)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "PostgresChainStore.GetBalanceEntry: ")
+	}
+	return &BalanceEntry{
+		HODLerPKID:   PublicKeyToPKID(hodlerPKID[:]),
+		CreatorPKID:  PublicKeyToPKID(creatorPKID[:]),
+		BalanceNanos: uint64(balanceNanos),
+		HasPurchased: hasPurchased,
+	}, nil
+}
+
+func _postgresPutBalanceEntry(execer _postgresExecer, balanceEntry *BalanceEntry) error {
+	_, err := execer.Exec(`INSERT INTO balances (hodler_pkid, creator_pkid, balance_nanos,
+			has_purchased)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (hodler_pkid, creator_pkid) DO UPDATE SET
+			balance_nanos = EXCLUDED.balance_nanos, has_purchased = EXCLUDED.has_purchased`,
+		balanceEntry.HODLerPKID[:], balanceEntry.CreatorPKID[:],
+		int64(balanceEntry.BalanceNanos), balanceEntry.HasPurchased)
+	return err
+}
+
+func (pgs *PostgresChainStore) PutBalanceEntry(balanceEntry *BalanceEntry) error {
+	return errors.Wrapf(_postgresPutBalanceEntry(pgs.db, balanceEntry), "PostgresChainStore.PutBalanceEntry: ")
+}
+
+func (pgs *PostgresChainStore) DeleteBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) error {
+	_, err := pgs.db.Exec(`DELETE FROM balances WHERE hodler_pkid = $1 AND creator_pkid = $2`,
+		hodlerPKID[:], creatorPKID[:])
+	return errors.Wrapf(err, "PostgresChainStore.DeleteBalanceEntry: ")
+}
+
+func (pgs *PostgresChainStore) Close() error {
+	return pgs.db.Close()
+}
+
+// CopyFromDb replaces everything in the store with the posts, profiles, follows,
+// and balances in handle, along with its tip, in a single Postgres transaction.
+// It's run when the node starts and the store's tip doesn't match the db's, so
+// the chain can't be changing while it runs.
+func (pgs *PostgresChainStore) CopyFromDb(handle *badger.DB) error {
+	sqlTxn, err := pgs.db.Begin()
+	if err != nil {
+		return errors.Wrapf(err, "PostgresChainStore.CopyFromDb: ")
+	}
+	defer sqlTxn.Rollback()
+
+	if _, err := sqlTxn.Exec(`TRUNCATE kv, posts, profiles, follows, balances`); err != nil {
+		return errors.Wrapf(err, "PostgresChainStore.CopyFromDb: Problem clearing tables: ")
+	}
+
+	numEntries := 0
+	err = DbView(handle, func(txn KVTxn) error {
+		copyPrefix := func(prefix []byte, copyEntry func(key []byte, val []byte) error) error {
+			opts := KVIteratorOptions{}
+			opts.Prefix = prefix
+			nodeIterator := txn.NewIterator(opts)
+			defer nodeIterator.Close()
+			for nodeIterator.Seek(prefix); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+				valBytes, err := nodeIterator.Value()
+				if err == nil {
+					err = copyEntry(nodeIterator.Key(), valBytes)
+				}
+				if err != nil {
+					return errors.Wrapf(err, "Problem copying key %v", nodeIterator.Key())
+				}
+				numEntries++
+				if numEntries%100000 == 0 {
+					glog.Infof("PostgresChainStore.CopyFromDb: Copied %d entries", numEntries)
+				}
+			}
+			return nil
+		}
+
+		err := copyPrefix(_PrefixPostHashToPostEntry, func(key []byte, val []byte) error {
+			postEntry := &PostEntry{}
+			if err := _DbDecodePostEntry(val, postEntry); err != nil {
+				return err
+			}
+			return _postgresPutPostEntry(sqlTxn, postEntry)
+		})
+		if err != nil {
+			return err
+		}
+		err = copyPrefix(_PrefixPKIDToProfileEntry, func(key []byte, val []byte) error {
+			profileEntry := &ProfileEntry{}
+			if err := _DbDecodeProfileEntry(val, profileEntry); err != nil {
+				return err
+			}
+			return _postgresPutProfileEntry(sqlTxn, profileEntry, PublicKeyToPKID(key[1:]))
+		})
+		if err != nil {
+			return err
+		}
+		err = copyPrefix(_PrefixFollowerPKIDToFollowedPKID, func(key []byte, val []byte) error {
+			pkidLen := (len(key) - 1) / 2
+			return _postgresPutFollow(sqlTxn,
+				PublicKeyToPKID(key[1:1+pkidLen]), PublicKeyToPKID(key[1+pkidLen:]))
+		})
+		if err != nil {
+			return err
+		}
+		err = copyPrefix(_PrefixHODLerPKIDCreatorPKIDToBalanceEntry, func(key []byte, val []byte) error {
+			balanceEntry := &BalanceEntry{}
+			if err := _DbDecodeBalanceEntry(val, balanceEntry); err != nil {
+				return err
+			}
+			return _postgresPutBalanceEntry(sqlTxn, balanceEntry)
+		})
+		if err != nil {
+			return err
+		}
+
+		tipHash := _getBlockHashForPrefixWithTxn(txn, _KeyBestBitCloutBlockHash)
+		if tipHash == nil {
+			return fmt.Errorf("The db doesn't have a chain")
+		}
+		_, err = sqlTxn.Exec(`INSERT INTO kv (key, value) VALUES ($1, $2)`,
+			_KeyBestBitCloutBlockHash, tipHash[:])
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "PostgresChainStore.CopyFromDb: ")
+	}
+
+	if err := sqlTxn.Commit(); err != nil {
+		return errors.Wrapf(err, "PostgresChainStore.CopyFromDb: ")
+	}
+	glog.Infof("PostgresChainStore.CopyFromDb: Copied %d entries", numEntries)
+	return nil
+}
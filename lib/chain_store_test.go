@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	params := &BitCloutTestnetParams
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	store := NewBadgerChainStore(db, params)
+
+	// Scan only returns the keys under the prefix, in order.
+	require.NoError(store.Put([]byte{200, 2}, []byte("b")))
+	require.NoError(store.Put([]byte{200, 1}, []byte("a")))
+	require.NoError(store.Put([]byte{201, 1}, []byte("c")))
+	val, err := store.Get([]byte{200, 1})
+	require.NoError(err)
+	assert.Equal([]byte("a"), val)
+	scannedVals := []string{}
+	require.NoError(store.Scan([]byte{200}, func(key []byte, val []byte) error {
+		scannedVals = append(scannedVals, string(val))
+		return nil
+	}))
+	assert.Equal([]string{"a", "b"}, scannedVals)
+	require.NoError(store.Delete([]byte{200, 1}))
+	val, err = store.Get([]byte{200, 1})
+	require.NoError(err)
+	assert.Nil(val)
+
+	// A store mirroring the db picks up the entries the chain flushes.
+	mirrorDb, mirrorDir := GetTestBadgerDb()
+	defer os.RemoveAll(mirrorDir)
+	mirrorStore := NewBadgerChainStore(mirrorDb, params)
+	eventManager := NewEventManager()
+	mirror := MirrorEntriesToChainStore(eventManager, db, mirrorStore)
+	defer mirror.Stop()
+
+	followerPKID := &PKID{1}
+	followedPKID := &PKID{2}
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+	utxoView._setFollowEntryMappings(&FollowEntry{
+		FollowerPKID: followerPKID,
+		FollowedPKID: followedPKID,
+	})
+	utxoView._setBalanceEntryMappings(&BalanceEntry{
+		HODLerPKID:   followerPKID,
+		CreatorPKID:  followedPKID,
+		BalanceNanos: 100,
+	})
+	require.NoError(utxoView.FlushToDb())
+	eventManager.viewFlushed(utxoView)
+	mirror.Wait()
+
+	isFollowing, err := mirrorStore.IsFollowing(followerPKID, followedPKID)
+	require.NoError(err)
+	assert.True(isFollowing)
+	followedPKIDs, err := mirrorStore.GetPKIDsYouFollow(followerPKID)
+	require.NoError(err)
+	assert.Equal([]*PKID{followedPKID}, followedPKIDs)
+	balanceEntry, err := mirrorStore.GetBalanceEntry(followerPKID, followedPKID)
+	require.NoError(err)
+	require.NotNil(balanceEntry)
+	assert.Equal(uint64(100), balanceEntry.BalanceNanos)
+
+	utxoView, err = NewUtxoView(db, params, nil)
+	require.NoError(err)
+	utxoView._setFollowEntryMappings(&FollowEntry{
+		FollowerPKID: followerPKID,
+		FollowedPKID: followedPKID,
+		isDeleted:    true,
+	})
+	require.NoError(utxoView.FlushToDb())
+	eventManager.viewFlushed(utxoView)
+	mirror.Wait()
+	isFollowing, err = mirrorStore.IsFollowing(followerPKID, followedPKID)
+	require.NoError(err)
+	assert.False(isFollowing)
+
+	// The store is current once it has the db's tip.
+	genesisHash, err := params.GenesisBlock.Header.Hash()
+	require.NoError(err)
+	require.NoError(PutBestHash(genesisHash, db, ChainTypeBitCloutBlock))
+	isCurrent, err := ChainStoreIsCurrent(db, mirrorStore)
+	require.NoError(err)
+	assert.False(isCurrent)
+	eventManager.blockConnected(params.GenesisBlock, nil)
+	mirror.Wait()
+	isCurrent, err = ChainStoreIsCurrent(db, mirrorStore)
+	require.NoError(err)
+	assert.True(isCurrent)
+
+	// A view reads the entries it doesn't have through its store.
+	utxoView, err = NewUtxoView(db, params, nil)
+	require.NoError(err)
+	require.NoError(mirrorStore.PutFollow(followerPKID, followedPKID))
+	followKey := MakeFollowKey(followerPKID, followedPKID)
+	assert.Nil(utxoView._getFollowEntryForFollowKey(&followKey))
+	utxoView.Store = mirrorStore
+	assert.NotNil(utxoView._getFollowEntryForFollowKey(&followKey))
+
+	// Once a write fails the store's tip is cleared and never moves again, so the
+	// store isn't taken for current until it's copied again.
+	failingStore := &failingFollowChainStore{ChainStore: mirrorStore}
+	failingEventManager := NewEventManager()
+	failingMirror := MirrorEntriesToChainStore(failingEventManager, db, failingStore)
+	defer failingMirror.Stop()
+	utxoView, err = NewUtxoView(db, params, nil)
+	require.NoError(err)
+	utxoView._setFollowEntryMappings(&FollowEntry{
+		FollowerPKID: &PKID{3},
+		FollowedPKID: followedPKID,
+	})
+	require.NoError(utxoView.FlushToDb())
+	failingEventManager.viewFlushed(utxoView)
+	failingEventManager.blockConnected(params.GenesisBlock, nil)
+	failingMirror.Wait()
+	tipBytes, err := mirrorStore.Get(_KeyBestBitCloutBlockHash)
+	require.NoError(err)
+	assert.Nil(tipBytes)
+	isCurrent, err = ChainStoreIsCurrent(db, mirrorStore)
+	require.NoError(err)
+	assert.False(isCurrent)
+}
+
+// failingFollowChainStore fails every PutFollow.
+type failingFollowChainStore struct {
+	ChainStore
+}
+
+func (store *failingFollowChainStore) PutFollow(followerPKID *PKID, followedPKID *PKID) error {
+	return fmt.Errorf("PutFollow failed")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"math"
 	"math/big"
 	"os"
 	"path/filepath"
@@ -30,9 +31,33 @@ const (
 	SecondsIn3Days int32 = 24 * 60 * 60 * 3
 	SecondsIn4Days int32 = 24 * 60 * 60 * 4
 
-	// MessagesToFetchPerCall is used to limit the number of messages to fetch
-	// when getting a user's inbox.
+	// MessagesToFetchPerInboxCall is the default limit on the number of
+	// messages to fetch when getting a user's inbox. Operators can change it
+	// with the node config. See NodeConfigEntry.
 	MessagesToFetchPerInboxCall = 10000
+
+	// DecodeFailureAlertThreshold is the default number of values under a
+	// prefix that can fail to decode before the prefix is flagged as unhealthy.
+	// Operators can change it with the node config. See DbGetDecodeFailureAlerts.
+	DecodeFailureAlertThreshold = 10
+	// How often the server saves the decode failure counts and reports them.
+	DecodeFailureReportIntervalSeconds = 60
+
+	// MaxIndexedTimestampSkewSeconds is the default for how far past the time of
+	// the block it's flushed with a post or message timestamp can be before it's
+	// quarantined instead of being added to the time-ordered indexes. Operators
+	// can change it with the node config. See DbGetMaxIndexedTstampNanosWithTxn.
+	MaxIndexedTimestampSkewSeconds = 24 * 60 * 60
+	// How often quarantined index entries are checked to see whether their
+	// time has come. See StartTimestampIndexRestorer.
+	TimestampIndexRestoreIntervalSeconds = 60
+
+	// PruneHeightProtocolVersion is the first protocol version that knows
+	// about PRUNE_HEIGHT messages.
+	PruneHeightProtocolVersion = 2
+	// How often the server checks whether it has pruned more blocks than it
+	// has told its peers about. See StartPruneHeightAdvertiser.
+	PruneHeightAdvertiseIntervalSeconds = 60
 )
 
 type NetworkType uint64
@@ -90,8 +115,65 @@ var (
 	// BitCloutFounderRewardBlockHeight defines a block height where the protocol switches from
 	// paying the founder reward in the founder's own creator coin to paying in BitClout instead.
 	BitCloutFounderRewardBlockHeight = uint32(21869)
+
+	// MainnetDeflationBombBlockHeight defines the block height on mainnet from which
+	// BitcoinExchange transactions can no longer mint BitClout. It triggers
+	// approximately Saturday June 12th at 8pm PT.
+	MainnetDeflationBombBlockHeight = uint32(33783)
+
+	// TestnetPollsBlockHeight, TestnetDerivedKeysBlockHeight, and
+	// TestnetTransferRestrictionsBlockHeight define the block heights on testnet
+	// from which poll, derived key, and transfer restriction txns are accepted.
+	// They're scheduled past the testnet tip at the time of the release that
+	// added the txns so that testnet nodes have time to upgrade before blocks
+	// with the new txns can be mined.
+	TestnetPollsBlockHeight                = uint32(450000)
+	TestnetDerivedKeysBlockHeight          = uint32(450000)
+	TestnetTransferRestrictionsBlockHeight = uint32(450000)
+)
+
+// The names of the forks above as they're stored in the db. See ProtocolFork.
+const (
+	ForkNameSalomonFix            = "salomon-fix"
+	ForkNameBitCloutFounderReward = "bitclout-founder-reward"
+	ForkNameDeflationBomb         = "deflation-bomb"
+	ForkNamePolls                 = "polls"
+	ForkNameDerivedKeys           = "derived-keys"
+	ForkNameTransferRestrictions  = "transfer-restrictions"
 )
 
+// ProtocolFork names a change to the consensus rules and the first block height
+// at which it applies. The forks in the params are written to the db at startup
+// so that code can check whether a fork is active using DbIsForkActive rather
+// than comparing against one of the heights above.
+type ProtocolFork struct {
+	Name             string
+	ActivationHeight uint32
+}
+
+// GetProtocolForks returns every fork that applies to the network: the founder
+// reward forks, which are the same on every network, followed by ProtocolForks.
+// The founder reward forks are built from the heights above on each call so
+// tests can move them.
+func (params *BitCloutParams) GetProtocolForks() []ProtocolFork {
+	// Note the founder reward forks take effect on the block after their height.
+	return append([]ProtocolFork{
+		{Name: ForkNameSalomonFix, ActivationHeight: SalomonFixBlockHeight + 1},
+		{Name: ForkNameBitCloutFounderReward, ActivationHeight: BitCloutFounderRewardBlockHeight + 1},
+	}, params.ProtocolForks...)
+}
+
+// GetProtocolFork returns the fork with the given name or nil if it doesn't
+// apply to the network.
+func (params *BitCloutParams) GetProtocolFork(forkName string) *ProtocolFork {
+	for _, protocolFork := range params.GetProtocolForks() {
+		if protocolFork.Name == forkName {
+			return &protocolFork
+		}
+	}
+	return nil
+}
+
 func (nt NetworkType) String() string {
 	switch nt {
 	case NetworkType_UNSET:
@@ -107,6 +189,12 @@ func (nt NetworkType) String() string {
 
 const (
 	MaxUsernameLengthBytes = 25
+
+	// Polls need at least two options and can have at most MaxPollOptions,
+	// each of which must be between one and MaxPollOptionLengthBytes long.
+	MinPollOptions           = 2
+	MaxPollOptions           = 10
+	MaxPollOptionLengthBytes = 100
 )
 
 var (
@@ -316,6 +404,12 @@ type BitCloutParams struct {
 	MaxDifficultyRetargetFactor int64
 	// Amount of time one must wait before a block reward can be spent.
 	BlockRewardMaturity time.Duration
+	// How many blocks behind the tip a block has to be before it's considered
+	// final. Nodes that drop the utxo operations of final blocks can't process
+	// reorgs deeper than this, so it's also the fewest blocks a retention policy
+	// can keep. See UtxoOpsRetentionKeepNoneAfterFinality and
+	// CheckRetentionKeepBlocks.
+	FinalityDepthBlocks uint64
 	// When shifting from v0 blocks to v1 blocks, we changed the hash function to
 	// CloutHash, which is technically easier. Thus we needed to apply an adjustment
 	// factor in order to phase it in.
@@ -407,8 +501,23 @@ type BitCloutParams struct {
 	// attack the bancor curve to any meaningful measure.
 	CreatorCoinAutoSellThresholdNanos uint64
 
-	// The most deflationary event in BitClout history has yet to come...
-	DeflationBombBlockHeight uint64
+	// The number of blocks after a profile gives up its username during which no
+	// other profile may claim that username. Setting this to zero disables the
+	// protection, and released usernames aren't recorded at all. Note that
+	// changing this value changes consensus rules.
+	UsernameReleaseProtectionWindowBlocks uint32
+
+	// The forks that apply to this network on top of the founder reward forks.
+	// See GetProtocolForks. Note that changing an activation height changes
+	// consensus rules:
+	//   - ForkNameDeflationBomb: BitcoinExchange txns are rejected from this
+	//     height on. The most deflationary event in BitClout history...
+	//   - ForkNamePolls: Poll txns are rejected below this height.
+	//   - ForkNameDerivedKeys: AuthorizeDerivedKey txns and txns signed by
+	//     derived keys are rejected below this height.
+	//   - ForkNameTransferRestrictions: UpdateTransferRestriction txns are
+	//     rejected below this height.
+	ProtocolForks []ProtocolFork
 }
 
 // GenesisBlock defines the genesis block used for the BitClout maainnet and testnet
@@ -461,7 +570,7 @@ var (
 // BitCloutMainnetParams defines the BitClout parameters for the mainnet.
 var BitCloutMainnetParams = BitCloutParams{
 	NetworkType:        NetworkType_MAINNET,
-	ProtocolVersion:    1,
+	ProtocolVersion:    2,
 	MinProtocolVersion: 1,
 	UserAgent:          "Architect",
 	DNSSeeds: []string{
@@ -617,6 +726,9 @@ var BitCloutMainnetParams = BitCloutParams{
 
 	BlockRewardMaturity: time.Hour * 3,
 
+	// A day's worth of blocks.
+	FinalityDepthBlocks: 288,
+
 	V1DifficultyAdjustmentFactor: 10,
 
 	// Use a five-minute block time. Although a shorter block time seems like
@@ -704,8 +816,14 @@ var BitCloutMainnetParams = BitCloutParams{
 	// reserve ratios.
 	CreatorCoinAutoSellThresholdNanos: uint64(10),
 
-	// Triggers approximately Saturday June 12th at 8pm PT
-	DeflationBombBlockHeight: 33783,
+	// Polls, derived keys, and transfer restrictions aren't scheduled on
+	// mainnet yet.
+	ProtocolForks: []ProtocolFork{
+		{Name: ForkNameDeflationBomb, ActivationHeight: MainnetDeflationBombBlockHeight},
+		{Name: ForkNamePolls, ActivationHeight: math.MaxUint32},
+		{Name: ForkNameDerivedKeys, ActivationHeight: math.MaxUint32},
+		{Name: ForkNameTransferRestrictions, ActivationHeight: math.MaxUint32},
+	},
 }
 
 func mustDecodeHexBlockHashBitcoin(ss string) *BlockHash {
@@ -736,7 +854,7 @@ func mustDecodeHexBlockHash(ss string) *BlockHash {
 // BitCloutTestnetParams defines the BitClout parameters for the testnet.
 var BitCloutTestnetParams = BitCloutParams{
 	NetworkType:        NetworkType_TESTNET,
-	ProtocolVersion:    0,
+	ProtocolVersion:    2,
 	MinProtocolVersion: 0,
 	UserAgent:          "Architect",
 	DNSSeeds:           []string{},
@@ -859,6 +977,8 @@ var BitCloutTestnetParams = BitCloutParams{
 	// is more useful for local testing.
 	BlockRewardMaturity: 0,
 
+	FinalityDepthBlocks: 100,
+
 	V1DifficultyAdjustmentFactor: 10,
 
 	// Reject blocks that are more than two hours in the future.
@@ -923,6 +1043,14 @@ var BitCloutTestnetParams = BitCloutParams{
 	// It's just high enough where you avoid drifting creating coin
 	// reserve ratios.
 	CreatorCoinAutoSellThresholdNanos: uint64(10),
+
+	// The deflation bomb never triggers on testnet.
+	ProtocolForks: []ProtocolFork{
+		{Name: ForkNameDeflationBomb, ActivationHeight: math.MaxUint32},
+		{Name: ForkNamePolls, ActivationHeight: TestnetPollsBlockHeight},
+		{Name: ForkNameDerivedKeys, ActivationHeight: TestnetDerivedKeysBlockHeight},
+		{Name: ForkNameTransferRestrictions, ActivationHeight: TestnetTransferRestrictionsBlockHeight},
+	},
 }
 
 // GetDataDir gets the user data directory where we store files
@@ -953,6 +1081,10 @@ const (
 
 	DiamondLevelKey    = "DiamondLevel"
 	DiamondPostHashKey = "DiamondPostHash"
+
+	// Key in transaction's extra data map -- The presence of this key indicates that the
+	// transaction is signed by this derived key rather than the transactor's own key.
+	DerivedPublicKeyExtraDataKey = "DerivedPublicKey"
 )
 
 // Defines values that may exist in a transaction's ExtraData map
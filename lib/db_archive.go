@@ -0,0 +1,422 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/sasha-s/go-deadlock"
+)
+
+// DbArchive is an append-only store for db entries that are rarely read, like
+// the utxo operations and spend entries of old blocks. Moving them out of badger
+// keeps the hot db small while still allowing them to be looked up.
+//
+// The archive is made of two files. The data file holds records of the form
+// <key len uvarint, key, value len uvarint, value>. The index file holds, for
+// each record, <key len uvarint, key, value offset uint64, value len uint32> and
+// is loaded into memory when the archive is opened. Records are always written
+// to the data file first so the index can be rebuilt from the end of the data
+// file if the node dies before the index is written.
+type DbArchive struct {
+	dir string
+
+	// mtx protects everything below.
+	mtx       deadlock.RWMutex
+	dataFile  *os.File
+	indexFile *os.File
+	dataSize  int64
+	locations map[string]dbArchiveLocation
+}
+
+type dbArchiveLocation struct {
+	ValueOffset int64
+	ValueLen    uint32
+}
+
+const (
+	dbArchiveDataFileName  = "archive.dat"
+	dbArchiveIndexFileName = "archive.idx"
+)
+
+// OpenDbArchive opens the archive in dir, creating it if it doesn't exist.
+func OpenDbArchive(dir string) (*DbArchive, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "OpenDbArchive: Problem creating dir %v", dir)
+	}
+	dataFile, err := os.OpenFile(filepath.Join(dir, dbArchiveDataFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "OpenDbArchive: Problem opening data file")
+	}
+	indexFile, err := os.OpenFile(filepath.Join(dir, dbArchiveIndexFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		dataFile.Close()
+		return nil, errors.Wrapf(err, "OpenDbArchive: Problem opening index file")
+	}
+
+	archive := &DbArchive{
+		dir:       dir,
+		dataFile:  dataFile,
+		indexFile: indexFile,
+		locations: make(map[string]dbArchiveLocation),
+	}
+	if err := archive._load(); err != nil {
+		archive.Close()
+		return nil, errors.Wrapf(err, "OpenDbArchive: Problem loading archive in %v", dir)
+	}
+	return archive, nil
+}
+
+// _load reads the index into memory and indexes any records at the end of the
+// data file that didn't make it into the index.
+func (archive *DbArchive) _load() error {
+	indexedEnd := int64(0)
+	indexReader := bufio.NewReader(archive.indexFile)
+	validIndexSize := int64(0)
+	for {
+		key, err := _readDbArchiveBytes(indexReader)
+		if err == io.EOF {
+			break
+		}
+		var locationBytes [12]byte
+		if err == nil {
+			_, err = io.ReadFull(indexReader, locationBytes[:])
+		}
+		if err != nil {
+			// A partial entry at the end is left over from a crash. The record
+			// it points to is recovered from the data file below.
+			glog.Errorf("DbArchive._load: Ignoring partial index entry at offset %d: %v",
+				validIndexSize, err)
+			break
+		}
+		location := dbArchiveLocation{
+			ValueOffset: int64(DecodeUint64(locationBytes[:8])),
+			ValueLen:    DecodeUint32(locationBytes[8:]),
+		}
+		archive.locations[string(key)] = location
+		if end := location.ValueOffset + int64(location.ValueLen); end > indexedEnd {
+			indexedEnd = end
+		}
+		validIndexSize += int64(len(UintToBuf(uint64(len(key))))+len(key)) + int64(len(locationBytes))
+	}
+	if err := archive.indexFile.Truncate(validIndexSize); err != nil {
+		return err
+	}
+	if _, err := archive.indexFile.Seek(validIndexSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	dataInfo, err := archive.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	archive.dataSize = dataInfo.Size()
+	if indexedEnd > archive.dataSize {
+		return errors.Wrapf(ErrEntryCorrupt, "Index points past the end of the data file")
+	}
+
+	// Index the records written after the last one in the index.
+	dataReader := bufio.NewReader(io.NewSectionReader(
+		archive.dataFile, indexedEnd, archive.dataSize-indexedEnd))
+	offset := indexedEnd
+	keys := [][]byte{}
+	locations := []dbArchiveLocation{}
+	for offset < archive.dataSize {
+		key, keyErr := _readDbArchiveBytes(dataReader)
+		valLen, valErr := ReadUvarint(dataReader)
+		if keyErr != nil || valErr != nil {
+			break
+		}
+		valOffset := offset + int64(len(UintToBuf(uint64(len(key))))+len(key)+len(UintToBuf(valLen)))
+		if valOffset+int64(valLen) > archive.dataSize {
+			break
+		}
+		if _, err := dataReader.Discard(int(valLen)); err != nil {
+			break
+		}
+		keys = append(keys, key)
+		locations = append(locations, dbArchiveLocation{ValueOffset: valOffset, ValueLen: uint32(valLen)})
+		offset = valOffset + int64(valLen)
+	}
+	if offset < archive.dataSize {
+		glog.Errorf("DbArchive._load: Truncating partial record at offset %d of %d",
+			offset, archive.dataSize)
+		if err := archive.dataFile.Truncate(offset); err != nil {
+			return err
+		}
+		archive.dataSize = offset
+	}
+	if len(keys) > 0 {
+		glog.Infof("DbArchive._load: Recovered %d records missing from the index", len(keys))
+		if err := archive._appendIndexEntries(keys, locations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func _readDbArchiveBytes(reader *bufio.Reader) ([]byte, error) {
+	numBytes, err := ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if numBytes > MaxMessagePayload {
+		return nil, errors.Wrapf(ErrEntryCorrupt, "Length %d is too large", numBytes)
+	}
+	buf := make([]byte, numBytes)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// _appendIndexEntries must be called with the mtx held for writing.
+func (archive *DbArchive) _appendIndexEntries(keys [][]byte, locations []dbArchiveLocation) error {
+	indexBuf := bytes.NewBuffer([]byte{})
+	for ii, key := range keys {
+		indexBuf.Write(UintToBuf(uint64(len(key))))
+		indexBuf.Write(key)
+		indexBuf.Write(EncodeUint64(uint64(locations[ii].ValueOffset)))
+		indexBuf.Write(_EncodeUint32(locations[ii].ValueLen))
+	}
+	if _, err := archive.indexFile.Write(indexBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "Problem writing index")
+	}
+	if err := archive.indexFile.Sync(); err != nil {
+		return errors.Wrapf(err, "Problem syncing index")
+	}
+	for ii, key := range keys {
+		archive.locations[string(key)] = locations[ii]
+	}
+	return nil
+}
+
+// Append adds the entries to the archive. They're on disk by the time it
+// returns so it's safe to delete them from the db. Appending a key that's
+// already archived replaces it.
+func (archive *DbArchive) Append(keys [][]byte, vals [][]byte) error {
+	if len(keys) != len(vals) {
+		return fmt.Errorf("DbArchive.Append: Got %d keys but %d values", len(keys), len(vals))
+	}
+
+	archive.mtx.Lock()
+	defer archive.mtx.Unlock()
+
+	if archive.dataFile == nil {
+		return errors.Wrapf(ErrDBClosed, "DbArchive.Append: Archive is closed")
+	}
+
+	dataBuf := bytes.NewBuffer([]byte{})
+	locations := []dbArchiveLocation{}
+	for ii, key := range keys {
+		dataBuf.Write(UintToBuf(uint64(len(key))))
+		dataBuf.Write(key)
+		dataBuf.Write(UintToBuf(uint64(len(vals[ii]))))
+		locations = append(locations, dbArchiveLocation{
+			ValueOffset: archive.dataSize + int64(dataBuf.Len()),
+			ValueLen:    uint32(len(vals[ii])),
+		})
+		dataBuf.Write(vals[ii])
+	}
+	if _, err := archive.dataFile.WriteAt(dataBuf.Bytes(), archive.dataSize); err != nil {
+		return errors.Wrapf(err, "DbArchive.Append: Problem writing data")
+	}
+	if err := archive.dataFile.Sync(); err != nil {
+		return errors.Wrapf(err, "DbArchive.Append: Problem syncing data")
+	}
+	archive.dataSize += int64(dataBuf.Len())
+
+	if err := archive._appendIndexEntries(keys, locations); err != nil {
+		return errors.Wrapf(err, "DbArchive.Append: ")
+	}
+	return nil
+}
+
+// Get returns the archived value for the key or an error wrapping
+// ErrEntryNotFound if it isn't in the archive.
+func (archive *DbArchive) Get(key []byte) ([]byte, error) {
+	archive.mtx.RLock()
+	defer archive.mtx.RUnlock()
+
+	if archive.dataFile == nil {
+		return nil, errors.Wrapf(ErrDBClosed, "DbArchive.Get: Archive is closed")
+	}
+	location, exists := archive.locations[string(key)]
+	if !exists {
+		return nil, errors.Wrapf(ErrEntryNotFound, "DbArchive.Get: Key %x", key)
+	}
+	val := make([]byte, location.ValueLen)
+	if _, err := archive.dataFile.ReadAt(val, location.ValueOffset); err != nil {
+		return nil, errors.Wrapf(err, "DbArchive.Get: Problem reading key %x", key)
+	}
+	return val, nil
+}
+
+// NumKeys returns the number of keys in the archive.
+func (archive *DbArchive) NumKeys() int {
+	archive.mtx.RLock()
+	defer archive.mtx.RUnlock()
+
+	return len(archive.locations)
+}
+
+// Close closes the archive's files. Calling it more than once is a no-op.
+func (archive *DbArchive) Close() error {
+	archive.mtx.Lock()
+	defer archive.mtx.Unlock()
+
+	if archive.dataFile == nil {
+		return nil
+	}
+	dataErr := archive.dataFile.Close()
+	indexErr := archive.indexFile.Close()
+	archive.dataFile = nil
+	archive.indexFile = nil
+	if dataErr != nil {
+		return errors.Wrapf(dataErr, "DbArchive.Close: Problem closing data file")
+	}
+	if indexErr != nil {
+		return errors.Wrapf(indexErr, "DbArchive.Close: Problem closing index file")
+	}
+	return nil
+}
+
+// DbArchivableIndexes are the retention indexes that can be moved to an archive
+// rather than deleted. They only hold history that's needed for deep reorgs and
+// for looking up old blocks.
+var DbArchivableIndexes = []string{"utxo-ops", "utxo-spends"}
+
+// DbArchiveSweep moves the entries of DbArchivableIndexes that are more than
+// keepBlocks blocks behind the tip out of the db and into the archive. It
+// returns the number of keys archived for each index.
+func DbArchiveSweep(handle *badger.DB, archive *DbArchive, keepBlocks uint64, tipHeight uint64) (
+	_numArchivedForIndex map[string]uint64, _err error) {
+
+	if keepBlocks == 0 {
+		return nil, fmt.Errorf("DbArchiveSweep: keepBlocks must be positive")
+	}
+	policy := &DbRetentionPolicy{Type: DbRetentionKeepBlocks, N: keepBlocks}
+
+	numArchivedForIndex := make(map[string]uint64)
+	for _, retentionIndex := range DbRetentionIndexes {
+		archivable := false
+		for _, indexName := range DbArchivableIndexes {
+			if indexName == retentionIndex.Name {
+				archivable = true
+				break
+			}
+		}
+		if !archivable {
+			continue
+		}
+
+		err := _dbForEachExpiredKeyBatch(handle, retentionIndex, policy, tipHeight, time.Now(), func(keys [][]byte) error {
+			// Read the values, write them to the archive, and only then delete
+			// them. If the node dies in between they're in both places, which
+			// is fine since the db is checked first.
+			vals := [][]byte{}
+			err := DbView(handle, func(txn KVTxn) error {
+				for _, key := range keys {
+					val, err := txn.Get(key)
+					if err != nil {
+						return err
+					}
+					vals = append(vals, val)
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "Problem reading keys for index %s", retentionIndex.Name)
+			}
+			if err := archive.Append(keys, vals); err != nil {
+				return errors.Wrapf(err, "Problem archiving keys for index %s", retentionIndex.Name)
+			}
+			err = DbUpdate(handle, func(txn KVTxn) error {
+				for _, key := range keys {
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "Problem deleting archived keys for index %s", retentionIndex.Name)
+			}
+			numArchivedForIndex[retentionIndex.Name] += uint64(len(keys))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "DbArchiveSweep: ")
+		}
+	}
+
+	return numArchivedForIndex, nil
+}
+
+// StartDbArchiveSweeper periodically moves old history into the archive until
+// the lifecycle is stopped. The archive should be closed after the lifecycle.
+func StartDbArchiveSweeper(lifecycle *CoreDBLifecycle, archive *DbArchive, keepBlocks uint64,
+	tipHeight func() uint64, interval time.Duration) error {
+
+	return lifecycle.GoPeriodic("archive-sweeper", interval, func() {
+		numArchivedForIndex, err := DbArchiveSweep(lifecycle.DB(), archive, keepBlocks, tipHeight())
+		if err != nil {
+			glog.Errorf("StartDbArchiveSweeper: Problem sweeping db: %v", err)
+		} else {
+			glog.Infof("StartDbArchiveSweeper: Archived keys per index: %v", numArchivedForIndex)
+		}
+	})
+}
+
+// _dbGetWithArchive returns the value for the key from the db, falling back to
+// the archive if it isn't in the db. The archive can be nil.
+func _dbGetWithArchive(handle *badger.DB, archive *DbArchive, key []byte) ([]byte, error) {
+	var val []byte
+	err := DbView(handle, func(txn KVTxn) error {
+		var err error
+		val, err = txn.Get(key)
+		return err
+	})
+	if err == nil {
+		return val, nil
+	}
+	if err != ErrKVKeyNotFound || archive == nil {
+		return nil, _wrapDbError(err, "_dbGetWithArchive: Key %x", key)
+	}
+	return archive.Get(key)
+}
+
+// GetUtxoOperationsForBlockWithArchive is like GetUtxoOperationsForBlock but
+// also finds utxo operations that have been moved to the archive.
+func GetUtxoOperationsForBlockWithArchive(handle *badger.DB, archive *DbArchive, blockHash *BlockHash) (
+	[][]*UtxoOperation, error) {
+
+	valBytes, err := _dbGetWithArchive(handle, archive, _DbKeyForUtxoOps(blockHash))
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetUtxoOperationsForBlockWithArchive: Block %v", blockHash)
+	}
+	return _DecodeUtxoOperations(valBytes)
+}
+
+// DbGetUtxoSpendEntryWithArchive is like DbGetUtxoSpendEntry but also finds
+// spend entries that have been moved to the archive.
+func DbGetUtxoSpendEntryWithArchive(handle *badger.DB, archive *DbArchive, utxoKey *UtxoKey) *UtxoSpendEntry {
+	valBytes, err := _dbGetWithArchive(handle, archive, _dbKeyForUtxoSpendEntry(utxoKey))
+	if err != nil {
+		return nil
+	}
+	spendEntry := &UtxoSpendEntry{}
+	if err := _decodeLegacyGobDbBuf(valBytes, spendEntry); err != nil {
+		glog.Errorf("DbGetUtxoSpendEntryWithArchive: Problem reading "+
+			"UtxoSpendEntry for utxo %v: %v", utxoKey, err)
+		return nil
+	}
+	return spendEntry
+}
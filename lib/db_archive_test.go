@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbArchive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	archive, err := OpenDbArchive(dir)
+	require.NoError(err)
+	require.NoError(archive.Append(
+		[][]byte{{1}, {2}}, [][]byte{[]byte("one"), []byte("two")}))
+	require.NoError(archive.Append(
+		[][]byte{{1}}, [][]byte{[]byte("uno")}))
+
+	val, err := archive.Get([]byte{1})
+	require.NoError(err)
+	assert.Equal([]byte("uno"), val)
+	_, err = archive.Get([]byte{3})
+	assert.True(errors.Is(err, ErrEntryNotFound))
+	assert.Equal(2, archive.NumKeys())
+	require.NoError(archive.Close())
+	require.NoError(archive.Close())
+	_, err = archive.Get([]byte{1})
+	assert.True(errors.Is(err, ErrDBClosed))
+
+	// Lose the index and leave a partial record at the end of the data file as
+	// if the node died in the middle of an append. Reopening recovers every
+	// complete record.
+	require.NoError(os.Remove(filepath.Join(dir, dbArchiveIndexFileName)))
+	dataFile, err := os.OpenFile(filepath.Join(dir, dbArchiveDataFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(err)
+	_, err = dataFile.Write([]byte{5, 1, 2})
+	require.NoError(err)
+	require.NoError(dataFile.Close())
+
+	archive, err = OpenDbArchive(dir)
+	require.NoError(err)
+	defer archive.Close()
+	assert.Equal(2, archive.NumKeys())
+	val, err = archive.Get([]byte{1})
+	require.NoError(err)
+	assert.Equal([]byte("uno"), val)
+	val, err = archive.Get([]byte{2})
+	require.NoError(err)
+	assert.Equal([]byte("two"), val)
+
+	// Appends after the recovery land after the last complete record.
+	require.NoError(archive.Append([][]byte{{4}}, [][]byte{[]byte("four")}))
+	val, err = archive.Get([]byte{4})
+	require.NoError(err)
+	assert.Equal([]byte("four"), val)
+}
+
+func TestDbArchiveSweep(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	archiveDir, err := ioutil.TempDir("", "archive")
+	require.NoError(err)
+	defer os.RemoveAll(archiveDir)
+	archive, err := OpenDbArchive(archiveDir)
+	require.NoError(err)
+	defer archive.Close()
+
+	// One utxo spent at each of a few heights.
+	spendingTxns := []*MsgBitCloutTxn{}
+	for height := uint64(1); height <= 3; height++ {
+		spendingTxn := &MsgBitCloutTxn{
+			TxInputs:  []*BitCloutInput{{TxID: BlockHash{byte(height)}, Index: 0}},
+			TxOutputs: []*BitCloutOutput{},
+			TxnMeta:   &BasicTransferMetadata{},
+		}
+		spendingTxns = append(spendingTxns, spendingTxn)
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return DbPutUtxoSpendEntriesForBlockWithTxn(txn, &MsgBitCloutBlock{
+				Header: &MsgBitCloutHeader{Height: height},
+				Txns:   []*MsgBitCloutTxn{spendingTxn},
+			})
+		}))
+	}
+
+	// Keeping two blocks at a tip of 3 archives the spend at height 1.
+	numArchivedForIndex, err := DbArchiveSweep(db, archive, 2 /*keepBlocks*/, 3 /*tipHeight*/)
+	require.NoError(err)
+	assert.Equal(uint64(1), numArchivedForIndex["utxo-spends"])
+
+	utxoKey := &UtxoKey{TxID: BlockHash{1}, Index: 0}
+	assert.Nil(DbGetUtxoSpendEntry(db, utxoKey))
+	spendEntry := DbGetUtxoSpendEntryWithArchive(db, archive, utxoKey)
+	require.NotNil(spendEntry)
+	assert.Equal(uint64(1), spendEntry.SpendHeight)
+	assert.Equal(spendingTxns[0].Hash(), spendEntry.SpendingTxID)
+
+	// Entries still in the db are read from it.
+	spendEntry = DbGetUtxoSpendEntryWithArchive(db, archive, &UtxoKey{TxID: BlockHash{3}, Index: 0})
+	require.NotNil(spendEntry)
+	assert.Equal(uint64(3), spendEntry.SpendHeight)
+	assert.Nil(DbGetUtxoSpendEntryWithArchive(db, archive, &UtxoKey{TxID: BlockHash{9}, Index: 0}))
+}
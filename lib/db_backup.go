@@ -0,0 +1,429 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// A db backup is badger's own backup stream of the db, which can be taken while
+// the node is running, plus a manifest describing it. The stream is what
+// badger.DB.Backup writes: every key, including node-local ones, written since a
+// version, as length-prefixed KVLists. A backup since version 0 is a full backup
+// and a backup since the NextSinceVersion of the previous one is an incremental
+// backup. Restoring a full backup and then each incremental backup after it in
+// order gives back the db as of the last one.
+//
+// The manifest is built from the stream as it's written so it describes exactly
+// what's in the backup even if blocks were connected while it was taken. Unlike a
+// snapshot it's meant for restoring the same node, not for bootstrapping others.
+
+const (
+	DbBackupVersion = 1
+	// DbSchemaVersion should be bumped whenever the encoding of an existing
+	// prefix changes. A node won't restore a backup with a newer schema version
+	// than its own. Adding a prefix doesn't need a bump.
+	DbSchemaVersion = 1
+
+	// Badger splits the stream into lists of at most a few MB so anything much
+	// bigger means the backup is corrupt.
+	MaxDbBackupListBytes = 1 << 30
+	// The name of the checksum of the keys that aren't under a registered prefix.
+	dbBackupUnknownPrefixName = "Unknown"
+	dbBackupFilePrefix        = "backup-"
+)
+
+type DbBackupManifest struct {
+	Version       uint64
+	SchemaVersion uint64
+	NetworkType   NetworkType
+	// The backup has the keys written at or after SinceVersion. Zero means it's
+	// a full backup. The next incremental backup should be taken since
+	// NextSinceVersion.
+	SinceVersion     uint64
+	NextSinceVersion uint64
+	// The tip of the chain in the db the backup restores.
+	BlockHeight uint64
+	BlockHash   *BlockHash
+	StartTime   time.Time
+	EndTime     time.Time
+	NumBytes    uint64
+	// One entry per prefix with keys in the backup, in registry order.
+	Prefixes []*DbBackupPrefix
+}
+
+type DbBackupPrefix struct {
+	Name   string
+	Prefix []byte
+	// The number of versions of keys under the prefix in the backup, including
+	// deletions.
+	NumEntries uint64
+	// The hex-encoded sha256 of the entries in the order they're in the stream.
+	Checksum string
+}
+
+// _dbBackupDigest computes the manifest fields that come from the backup stream.
+type _dbBackupDigest struct {
+	prefixes map[string]*DbBackupPrefix
+	hashers  map[string]hash.Hash
+	// The newest best block hash in the stream, or nil if it wasn't written
+	// since the backup's since version.
+	bestHash        *BlockHash
+	bestHashVersion uint64
+	numBytes        uint64
+}
+
+func _newDbBackupDigest() *_dbBackupDigest {
+	return &_dbBackupDigest{
+		prefixes: make(map[string]*DbBackupPrefix),
+		hashers:  make(map[string]hash.Hash),
+	}
+}
+
+func (digest *_dbBackupDigest) addKV(kv *pb.KV) {
+	prefixName := dbBackupUnknownPrefixName
+	var prefix []byte
+	if prefixInfo := GetDbPrefixInfoForKey(kv.Key); prefixInfo != nil {
+		prefixName = prefixInfo.Name
+		prefix = prefixInfo.Prefix
+	}
+	backupPrefix, exists := digest.prefixes[prefixName]
+	if !exists {
+		backupPrefix = &DbBackupPrefix{
+			Name:   prefixName,
+			Prefix: prefix,
+		}
+		digest.prefixes[prefixName] = backupPrefix
+		digest.hashers[prefixName] = sha256.New()
+	}
+	backupPrefix.NumEntries++
+	hasher := digest.hashers[prefixName]
+	hasher.Write(_dbSnapshotRecord(kv.Key, kv.Value))
+	hasher.Write(append(append(EncodeUint64(kv.Version), kv.Meta...), kv.UserMeta...))
+
+	if bytes.Equal(kv.Key, _KeyBestBitCloutBlockHash) && len(kv.Value) == HashSizeBytes &&
+		kv.Version >= digest.bestHashVersion {
+
+		digest.bestHash = &BlockHash{}
+		copy(digest.bestHash[:], kv.Value)
+		digest.bestHashVersion = kv.Version
+	}
+}
+
+// consume reads a backup stream until EOF.
+func (digest *_dbBackupDigest) consume(reader io.Reader) error {
+	var sizeBuf [8]byte
+	for {
+		if _, err := io.ReadFull(reader, sizeBuf[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "Problem reading list size")
+		}
+		listSize := binary.LittleEndian.Uint64(sizeBuf[:])
+		if listSize > MaxDbBackupListBytes {
+			return fmt.Errorf("List has %d bytes, which is more than the max of %d",
+				listSize, MaxDbBackupListBytes)
+		}
+		listBytes := make([]byte, listSize)
+		if _, err := io.ReadFull(reader, listBytes); err != nil {
+			return errors.Wrapf(err, "Problem reading list")
+		}
+		list := &pb.KVList{}
+		if err := list.Unmarshal(listBytes); err != nil {
+			return errors.Wrapf(err, "Problem decoding list")
+		}
+		for _, kv := range list.Kv {
+			digest.addKV(kv)
+		}
+		digest.numBytes += uint64(len(sizeBuf) + len(listBytes))
+	}
+}
+
+// backupPrefixes returns the prefixes with their checksums filled in, in
+// registry order with the unknown prefix last.
+func (digest *_dbBackupDigest) backupPrefixes() []*DbBackupPrefix {
+	backupPrefixes := []*DbBackupPrefix{}
+	prefixNames := []string{}
+	for _, prefixInfo := range DbPrefixRegistry {
+		prefixNames = append(prefixNames, prefixInfo.Name)
+	}
+	prefixNames = append(prefixNames, dbBackupUnknownPrefixName)
+	for _, prefixName := range prefixNames {
+		backupPrefix, exists := digest.prefixes[prefixName]
+		if !exists {
+			continue
+		}
+		backupPrefix.Checksum = hex.EncodeToString(digest.hashers[prefixName].Sum(nil))
+		backupPrefixes = append(backupPrefixes, backupPrefix)
+	}
+	return backupPrefixes
+}
+
+// _consumeDbBackupStream returns a writer that feeds what's written to it to a
+// digest in the background, and a function that closes the writer and waits for
+// the digest to finish.
+func _consumeDbBackupStream(digest *_dbBackupDigest) (io.Writer, func() error) {
+	pipeReader, pipeWriter := io.Pipe()
+	doneChan := make(chan error, 1)
+	go func() {
+		err := digest.consume(pipeReader)
+		// Unblock the writer if the digest gave up early.
+		pipeReader.CloseWithError(err)
+		doneChan <- err
+	}()
+	return pipeWriter, func() error {
+		pipeWriter.Close()
+		return <-doneChan
+	}
+}
+
+// DbBackup writes a backup of every key written to the db at or after
+// sinceVersion to writer and returns its manifest, which should be stored with
+// it. It can be called while the node is running. Pass zero for a full backup
+// or the NextSinceVersion of the last backup for an incremental one.
+func DbBackup(handle *badger.DB, params *BitCloutParams, writer io.Writer, sinceVersion uint64) (
+	*DbBackupManifest, error) {
+
+	manifest := &DbBackupManifest{
+		Version:       DbBackupVersion,
+		SchemaVersion: DbSchemaVersion,
+		NetworkType:   params.NetworkType,
+		SinceVersion:  sinceVersion,
+		StartTime:     time.Now(),
+	}
+	// If the tip didn't change since sinceVersion it isn't in the stream, and
+	// then it's the same as it is now.
+	tipBeforeBackup := DbGetBestHash(handle, ChainTypeBitCloutBlock)
+
+	digest := _newDbBackupDigest()
+	digestWriter, finishDigest := _consumeDbBackupStream(digest)
+	maxVersion, err := handle.Backup(io.MultiWriter(writer, digestWriter), sinceVersion)
+	if digestErr := finishDigest(); err == nil && digestErr != nil {
+		err = errors.Wrapf(digestErr, "Problem reading backup stream")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbBackup: ")
+	}
+
+	manifest.EndTime = time.Now()
+	manifest.NextSinceVersion = maxVersion + 1
+	if manifest.NextSinceVersion < sinceVersion {
+		manifest.NextSinceVersion = sinceVersion
+	}
+	manifest.NumBytes = digest.numBytes
+	manifest.Prefixes = digest.backupPrefixes()
+	manifest.BlockHash = digest.bestHash
+	if manifest.BlockHash == nil {
+		manifest.BlockHash = tipBeforeBackup
+	}
+	if manifest.BlockHash != nil {
+		// Blocks are never rewritten so the tip's height can be read after the
+		// backup is done.
+		tipBlock, err := GetBlock(manifest.BlockHash, handle)
+		if err != nil || tipBlock == nil {
+			return nil, fmt.Errorf("DbBackup: Problem fetching tip block %v: %v", manifest.BlockHash, err)
+		}
+		manifest.BlockHeight = tipBlock.Header.Height
+	}
+	return manifest, nil
+}
+
+// DbRestore loads a backup written by DbBackup into the db. A full backup must be
+// restored into an empty db and an incremental backup on top of the backup it
+// was taken after. The node must not be running. The stream is checked against
+// the manifest as it's loaded, so if DbRestore fails partway the db should be
+// discarded.
+func DbRestore(handle *badger.DB, params *BitCloutParams, reader io.Reader, manifest *DbBackupManifest) error {
+	if manifest.Version != DbBackupVersion {
+		return fmt.Errorf("DbRestore: Backup has version %d but only version %d "+
+			"is supported", manifest.Version, DbBackupVersion)
+	}
+	if manifest.SchemaVersion > DbSchemaVersion {
+		return fmt.Errorf("DbRestore: Backup has schema version %d but the node "+
+			"only supports up to %d", manifest.SchemaVersion, DbSchemaVersion)
+	}
+	if manifest.NetworkType != params.NetworkType {
+		return fmt.Errorf("DbRestore: Backup is for network %v but the node is on %v",
+			manifest.NetworkType, params.NetworkType)
+	}
+	dbHasChain := DbGetBestHash(handle, ChainTypeBitCloutBlock) != nil
+	if manifest.SinceVersion == 0 && dbHasChain {
+		return fmt.Errorf("DbRestore: Can't restore a full backup into a db that has a chain")
+	}
+	if manifest.SinceVersion > 0 && !dbHasChain {
+		return fmt.Errorf("DbRestore: Can't restore an incremental backup into an " +
+			"empty db; restore the full backup it follows first")
+	}
+
+	digest := _newDbBackupDigest()
+	digestWriter, finishDigest := _consumeDbBackupStream(digest)
+	err := handle.Load(io.TeeReader(reader, digestWriter), 256)
+	if digestErr := finishDigest(); err == nil && digestErr != nil {
+		err = errors.Wrapf(digestErr, "Problem reading backup stream")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "DbRestore: ")
+	}
+
+	restoredPrefixes := digest.backupPrefixes()
+	if len(restoredPrefixes) != len(manifest.Prefixes) {
+		return fmt.Errorf("DbRestore: Backup has %d prefixes but the manifest says %d",
+			len(restoredPrefixes), len(manifest.Prefixes))
+	}
+	for ii, restoredPrefix := range restoredPrefixes {
+		manifestPrefix := manifest.Prefixes[ii]
+		if restoredPrefix.Name != manifestPrefix.Name ||
+			restoredPrefix.NumEntries != manifestPrefix.NumEntries ||
+			restoredPrefix.Checksum != manifestPrefix.Checksum {
+
+			return fmt.Errorf("DbRestore: Prefix %s has %d entries with checksum %s but "+
+				"the manifest says %s has %d with checksum %s", restoredPrefix.Name,
+				restoredPrefix.NumEntries, restoredPrefix.Checksum, manifestPrefix.Name,
+				manifestPrefix.NumEntries, manifestPrefix.Checksum)
+		}
+	}
+	return nil
+}
+
+// =====================================================================================
+// Backup directories
+// =====================================================================================
+
+// A backup directory holds a chain of backups: a full backup followed by the
+// incremental backups taken after it, each as a stream file and a manifest named
+// after the backup's since version so they sort in the order they're restored.
+
+func _dbBackupFileNames(sinceVersion uint64) (_streamFileName string, _manifestFileName string) {
+	baseName := fmt.Sprintf("%s%020d", dbBackupFilePrefix, sinceVersion)
+	return baseName + ".bak", baseName + ".json"
+}
+
+// ReadDbBackupManifests returns the manifests of the backups in dir in the order
+// they should be restored.
+func ReadDbBackupManifests(dir string) ([]*DbBackupManifest, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ReadDbBackupManifests: Problem reading dir %v", dir)
+	}
+	manifests := []*DbBackupManifest{}
+	for _, fileInfo := range fileInfos {
+		if !strings.HasPrefix(fileInfo.Name(), dbBackupFilePrefix) ||
+			!strings.HasSuffix(fileInfo.Name(), ".json") {
+			continue
+		}
+		manifestBytes, err := ioutil.ReadFile(filepath.Join(dir, fileInfo.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "ReadDbBackupManifests: Problem reading %s", fileInfo.Name())
+		}
+		manifest := &DbBackupManifest{}
+		if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+			return nil, errors.Wrapf(err, "ReadDbBackupManifests: Problem decoding %s", fileInfo.Name())
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(ii, jj int) bool {
+		return manifests[ii].SinceVersion < manifests[jj].SinceVersion
+	})
+	return manifests, nil
+}
+
+// DbBackupToDir writes a backup to dir, which is incremental if dir already has
+// backups, and returns its manifest. The manifest is written last so a backup
+// that was only partly written is ignored.
+func DbBackupToDir(handle *badger.DB, params *BitCloutParams, dir string) (*DbBackupManifest, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "DbBackupToDir: Problem creating dir %v", dir)
+	}
+	manifests, err := ReadDbBackupManifests(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbBackupToDir: ")
+	}
+	sinceVersion := uint64(0)
+	if len(manifests) > 0 {
+		sinceVersion = manifests[len(manifests)-1].NextSinceVersion
+	}
+
+	streamFileName, manifestFileName := _dbBackupFileNames(sinceVersion)
+	streamFile, err := os.Create(filepath.Join(dir, streamFileName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbBackupToDir: ")
+	}
+	manifest, err := DbBackup(handle, params, streamFile, sinceVersion)
+	if closeErr := streamFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbBackupToDir: ")
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbBackupToDir: Problem encoding manifest")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, manifestFileName), manifestBytes, 0644); err != nil {
+		return nil, errors.Wrapf(err, "DbBackupToDir: Problem writing manifest")
+	}
+	return manifest, nil
+}
+
+// DbRestoreFromDir restores every backup in dir into an empty db, in order, and
+// returns the manifest of the last one.
+func DbRestoreFromDir(handle *badger.DB, params *BitCloutParams, dir string) (*DbBackupManifest, error) {
+	manifests, err := ReadDbBackupManifests(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbRestoreFromDir: ")
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("DbRestoreFromDir: %v doesn't have any backups", dir)
+	}
+	for ii, manifest := range manifests {
+		if ii > 0 && manifest.SinceVersion != manifests[ii-1].NextSinceVersion {
+			return nil, fmt.Errorf("DbRestoreFromDir: Backup since version %d doesn't "+
+				"follow the one before it, which ends at %d", manifest.SinceVersion,
+				manifests[ii-1].NextSinceVersion)
+		}
+		streamFileName, _ := _dbBackupFileNames(manifest.SinceVersion)
+		streamFile, err := os.Open(filepath.Join(dir, streamFileName))
+		if err != nil {
+			return nil, errors.Wrapf(err, "DbRestoreFromDir: ")
+		}
+		err = DbRestore(handle, params, streamFile, manifest)
+		streamFile.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "DbRestoreFromDir: Problem restoring %s", streamFileName)
+		}
+		glog.Infof("DbRestoreFromDir: Restored %s at height %d", streamFileName, manifest.BlockHeight)
+	}
+	return manifests[len(manifests)-1], nil
+}
+
+// StartDbBackups backs the db up to dir every interval until the lifecycle is
+// stopped. The first backup in an empty dir is a full one and the rest are
+// incremental.
+func StartDbBackups(lifecycle *CoreDBLifecycle, params *BitCloutParams, dir string, interval time.Duration) error {
+	return lifecycle.GoPeriodic("db-backups", interval, func() {
+		manifest, err := DbBackupToDir(lifecycle.DB(), params, dir)
+		if err != nil {
+			glog.Errorf("StartDbBackups: Problem backing up db: %v", err)
+			return
+		}
+		glog.Infof("StartDbBackups: Backed up %d bytes written since version %d at height %d",
+			manifest.NumBytes, manifest.SinceVersion, manifest.BlockHeight)
+	})
+}
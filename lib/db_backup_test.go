@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbBackup(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{BalanceSnapshots: true}))
+
+	// Returns every key and value in the db, including node-local ones.
+	dbState := func(handle *badger.DB) map[string][]byte {
+		state := make(map[string][]byte)
+		require.NoError(DbView(handle, func(txn KVTxn) error {
+			it := txn.NewIterator(KVIteratorOptions{})
+			defer it.Close()
+			for it.Seek(nil); it.Valid(); it.Next() {
+				val, err := it.Value()
+				require.NoError(err)
+				state[string(it.Key())] = val
+			}
+			return nil
+		}))
+		return state
+	}
+
+	backupDir, err := ioutil.TempDir("", "backup")
+	require.NoError(err)
+	defer os.RemoveAll(backupDir)
+	fullManifest, err := DbBackupToDir(db, params, backupDir)
+	require.NoError(err)
+	assert.Equal(uint64(0), fullManifest.SinceVersion)
+	assert.Equal(uint64(2), fullManifest.BlockHeight)
+	assert.Equal(*chain.blockTip().Hash, *fullManifest.BlockHash)
+
+	// The next backup only has what changed since the first one, which includes
+	// deleting the node config.
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_KeyNodeConfig)
+	}))
+	incrementalManifest, err := DbBackupToDir(db, params, backupDir)
+	require.NoError(err)
+	assert.Equal(fullManifest.NextSinceVersion, incrementalManifest.SinceVersion)
+	assert.Equal(uint64(3), incrementalManifest.BlockHeight)
+	assert.Less(incrementalManifest.NumBytes, fullManifest.NumBytes)
+
+	// Restoring both gives back the db.
+	restoredDb, restoredDir := GetTestBadgerDb()
+	defer os.RemoveAll(restoredDir)
+	restoredManifest, err := DbRestoreFromDir(restoredDb, params, backupDir)
+	require.NoError(err)
+	assert.Equal(incrementalManifest.BlockHash, restoredManifest.BlockHash)
+	assert.Equal(dbState(db), dbState(restoredDb))
+	_, err = DbRestoreFromDir(restoredDb, params, backupDir)
+	assert.Error(err)
+
+	// A stream that doesn't match its manifest is rejected.
+	backupBuf := bytes.NewBuffer([]byte{})
+	manifest, err := DbBackup(db, params, backupBuf, 0)
+	require.NoError(err)
+	manifest.Prefixes[0].Checksum = "00"
+	corruptDb, corruptDir := GetTestBadgerDb()
+	defer os.RemoveAll(corruptDir)
+	assert.Error(DbRestore(corruptDb, params, backupBuf, manifest))
+	manifest.NetworkType = NetworkType_MAINNET
+	assert.Error(DbRestore(corruptDb, params, bytes.NewBuffer([]byte{}), manifest))
+}
@@ -0,0 +1,846 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// This file contains the binary encodings used to store entries in the db. Each
+// encoded value starts with DbEntryCodecMagicByte followed by a version byte for
+// the entry type, which lets the encoding change in the future without breaking
+// values that are already stored.
+//
+// Values written before these encodings existed were gob-encoded. A gob stream
+// always starts with the length of its first message, which is encoded either as a
+// single byte below 0x80 or as a byte of 0xf8 or above. So DbEntryCodecMagicByte
+// can never be the first byte of a gob value and we fall back to gob when it's
+// missing. This lets nodes upgrade in place: legacy values are still readable and
+// are rewritten in the new encoding the next time they are flushed.
+
+const (
+	DbEntryCodecMagicByte = byte(0x80)
+
+	MessageEntryCodecVersion = byte(1)
+	PostEntryCodecVersion    = byte(1)
+	ProfileEntryCodecVersion = byte(2)
+	BalanceEntryCodecVersion = byte(1)
+	DiamondEntryCodecVersion = byte(1)
+
+	TransactionMetadataCodecVersion = byte(1)
+)
+
+func _isLegacyGobDbBuf(buf []byte) bool {
+	return len(buf) == 0 || buf[0] != DbEntryCodecMagicByte
+}
+
+// _dbEntryWriter appends fields to a byte slice. Variable-length fields are
+// prefixed with their length.
+type _dbEntryWriter struct {
+	data []byte
+}
+
+func _newDbEntryWriter(version byte) *_dbEntryWriter {
+	return &_dbEntryWriter{data: []byte{DbEntryCodecMagicByte, version}}
+}
+
+func (ww *_dbEntryWriter) writeUint(xx uint64) {
+	ww.data = append(ww.data, UintToBuf(xx)...)
+}
+
+func (ww *_dbEntryWriter) writeInt(xx int64) {
+	ww.data = append(ww.data, IntToBuf(xx)...)
+}
+
+func (ww *_dbEntryWriter) writeBool(bb bool) {
+	if bb {
+		ww.data = append(ww.data, 1)
+	} else {
+		ww.data = append(ww.data, 0)
+	}
+}
+
+func (ww *_dbEntryWriter) writeBytes(bb []byte) {
+	ww.writeUint(uint64(len(bb)))
+	ww.data = append(ww.data, bb...)
+}
+
+// writeFixed writes an optional fixed-size value like a BlockHash or PKID. A nil
+// value is written as a single zero byte.
+func (ww *_dbEntryWriter) writeFixed(bb []byte, isNil bool) {
+	ww.writeBool(!isNil)
+	if !isNil {
+		ww.data = append(ww.data, bb...)
+	}
+}
+
+func (ww *_dbEntryWriter) writeBlockHash(hash *BlockHash) {
+	if hash == nil {
+		ww.writeFixed(nil, true)
+		return
+	}
+	ww.writeFixed(hash[:], false)
+}
+
+func (ww *_dbEntryWriter) writePKID(pkid *PKID) {
+	if pkid == nil {
+		ww.writeFixed(nil, true)
+		return
+	}
+	ww.writeFixed(pkid[:], false)
+}
+
+func (ww *_dbEntryWriter) writeExtraData(extraData map[string][]byte) {
+	ww.writeUint(uint64(len(extraData)))
+	// Sort the keys so the encoding is deterministic.
+	keys := make([]string, 0, len(extraData))
+	for key := range extraData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ww.writeBytes([]byte(key))
+		ww.writeBytes(extraData[key])
+	}
+}
+
+func (ww *_dbEntryWriter) writeStakeEntry(stakeEntry *StakeEntry) {
+	ww.writeBool(stakeEntry != nil)
+	if stakeEntry == nil {
+		return
+	}
+	ww.writeUint(uint64(len(stakeEntry.StakeList)))
+	for _, singleStake := range stakeEntry.StakeList {
+		ww.writeUint(singleStake.InitialStakeNanos)
+		ww.writeUint(singleStake.BlockHeight)
+		ww.writeUint(singleStake.InitialStakeMultipleBasisPoints)
+		ww.writeUint(singleStake.InitialCreatorPercentageBasisPoints)
+		ww.writeUint(singleStake.RemainingStakeOwedNanos)
+		ww.writeBytes(singleStake.PublicKey)
+	}
+	ww.writeUint(stakeEntry.TotalPostStake)
+}
+
+// _dbEntryReader reads fields written by a _dbEntryWriter. The first error
+// encountered is kept and all subsequent reads are no-ops, so callers only need
+// to check err once at the end.
+type _dbEntryReader struct {
+	rr  *bytes.Reader
+	err error
+}
+
+// _newDbEntryReader checks the magic byte and returns a reader positioned after
+// the version byte, along with the version.
+func _newDbEntryReader(buf []byte) (*_dbEntryReader, byte, error) {
+	if len(buf) < 2 || buf[0] != DbEntryCodecMagicByte {
+		return nil, 0, errors.Wrapf(ErrEntryCorrupt, "_newDbEntryReader: Buf is not a versioned entry")
+	}
+	return &_dbEntryReader{rr: bytes.NewReader(buf[2:])}, buf[1], nil
+}
+
+func (rr *_dbEntryReader) readUint() uint64 {
+	if rr.err != nil {
+		return 0
+	}
+	var xx uint64
+	xx, rr.err = ReadUvarint(rr.rr)
+	return xx
+}
+
+func (rr *_dbEntryReader) readInt() int64 {
+	if rr.err != nil {
+		return 0
+	}
+	var xx int64
+	xx, rr.err = ReadVarint(rr.rr)
+	return xx
+}
+
+func (rr *_dbEntryReader) readBool() bool {
+	if rr.err != nil {
+		return false
+	}
+	var bb byte
+	bb, rr.err = rr.rr.ReadByte()
+	return bb != 0
+}
+
+// readBytes returns nil for an empty value, which is what gob does as well.
+func (rr *_dbEntryReader) readBytes() []byte {
+	length := rr.readUint()
+	if rr.err != nil || length == 0 {
+		return nil
+	}
+	if length > uint64(rr.rr.Len()) {
+		rr.err = fmt.Errorf("_dbEntryReader.readBytes: Length %d exceeds "+
+			"remaining %d bytes", length, rr.rr.Len())
+		return nil
+	}
+	bb := make([]byte, length)
+	_, rr.err = io.ReadFull(rr.rr, bb)
+	return bb
+}
+
+func (rr *_dbEntryReader) readFixed(bb []byte) bool {
+	if !rr.readBool() || rr.err != nil {
+		return false
+	}
+	_, rr.err = io.ReadFull(rr.rr, bb)
+	return rr.err == nil
+}
+
+func (rr *_dbEntryReader) readBlockHash() *BlockHash {
+	hash := &BlockHash{}
+	if !rr.readFixed(hash[:]) {
+		return nil
+	}
+	return hash
+}
+
+func (rr *_dbEntryReader) readPKID() *PKID {
+	pkid := &PKID{}
+	if !rr.readFixed(pkid[:]) {
+		return nil
+	}
+	return pkid
+}
+
+func (rr *_dbEntryReader) readExtraData() map[string][]byte {
+	numKeys := rr.readUint()
+	if rr.err != nil || numKeys == 0 {
+		return nil
+	}
+	if numKeys > uint64(rr.rr.Len()) {
+		rr.err = fmt.Errorf("_dbEntryReader.readExtraData: Num keys %d exceeds "+
+			"remaining %d bytes", numKeys, rr.rr.Len())
+		return nil
+	}
+	extraData := make(map[string][]byte, numKeys)
+	for ii := uint64(0); ii < numKeys; ii++ {
+		key := string(rr.readBytes())
+		extraData[key] = rr.readBytes()
+	}
+	return extraData
+}
+
+func (rr *_dbEntryReader) readStakeEntry() *StakeEntry {
+	if !rr.readBool() {
+		return nil
+	}
+	numStakes := rr.readUint()
+	if rr.err != nil {
+		return nil
+	}
+	if numStakes > uint64(rr.rr.Len()) {
+		rr.err = fmt.Errorf("_dbEntryReader.readStakeEntry: Num stakes %d exceeds "+
+			"remaining %d bytes", numStakes, rr.rr.Len())
+		return nil
+	}
+	stakeEntry := &StakeEntry{}
+	for ii := uint64(0); ii < numStakes; ii++ {
+		stakeEntry.StakeList = append(stakeEntry.StakeList, &SingleStake{
+			InitialStakeNanos:                   rr.readUint(),
+			BlockHeight:                         rr.readUint(),
+			InitialStakeMultipleBasisPoints:     rr.readUint(),
+			InitialCreatorPercentageBasisPoints: rr.readUint(),
+			RemainingStakeOwedNanos:             rr.readUint(),
+			PublicKey:                           rr.readBytes(),
+		})
+	}
+	stakeEntry.TotalPostStake = rr.readUint()
+	return stakeEntry
+}
+
+func (rr *_dbEntryReader) finish(entryName string, version byte) error {
+	if rr.err != nil {
+		return _corruptDbEntryError(rr.err, "Problem decoding %s version %d", entryName, version)
+	}
+	if rr.rr.Len() != 0 {
+		return errors.Wrapf(ErrEntryCorrupt, "Problem decoding %s version %d: %d trailing bytes",
+			entryName, version, rr.rr.Len())
+	}
+	return nil
+}
+
+// _decodeLegacyGobDbBuf decodes an entry that was stored before it had a
+// versioned encoding.
+func _decodeLegacyGobDbBuf(buf []byte, entry interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(entry); err != nil {
+		return _corruptDbEntryError(err, "Problem decoding legacy %T", entry)
+	}
+	return nil
+}
+
+func _unknownDbEntryVersionError(entryName string, version byte) error {
+	return fmt.Errorf("Unknown %s encoding version %d. This node may need to be "+
+		"upgraded in order to read it.", entryName, version)
+}
+
+// -------------------------------------------------------------------------------------
+// MessageEntry
+// -------------------------------------------------------------------------------------
+
+func _DbBufForMessageEntry(messageEntry *MessageEntry) []byte {
+	ww := _newDbEntryWriter(MessageEntryCodecVersion)
+	ww.writeBytes(messageEntry.SenderPublicKey)
+	ww.writeBytes(messageEntry.RecipientPublicKey)
+	ww.writeBytes(messageEntry.EncryptedText)
+	ww.writeUint(messageEntry.TstampNanos)
+	return ww.data
+}
+
+func _DbDecodeMessageEntry(buf []byte, messageEntry *MessageEntry) error {
+	if _isLegacyGobDbBuf(buf) {
+		return _decodeLegacyGobDbBuf(buf, messageEntry)
+	}
+	rr, version, err := _newDbEntryReader(buf)
+	if err != nil {
+		return err
+	}
+	if version != MessageEntryCodecVersion {
+		return _unknownDbEntryVersionError("MessageEntry", version)
+	}
+	messageEntry.SenderPublicKey = rr.readBytes()
+	messageEntry.RecipientPublicKey = rr.readBytes()
+	messageEntry.EncryptedText = rr.readBytes()
+	messageEntry.TstampNanos = rr.readUint()
+	return rr.finish("MessageEntry", version)
+}
+
+// -------------------------------------------------------------------------------------
+// PostEntry
+// -------------------------------------------------------------------------------------
+
+func _DbBufForPostEntry(postEntry *PostEntry) []byte {
+	ww := _newDbEntryWriter(PostEntryCodecVersion)
+	ww.writeBlockHash(postEntry.PostHash)
+	ww.writeBytes(postEntry.PosterPublicKey)
+	ww.writeBytes(postEntry.ParentStakeID)
+	ww.writeBytes(postEntry.Body)
+	ww.writeBlockHash(postEntry.RecloutedPostHash)
+	ww.writeBool(postEntry.IsQuotedReclout)
+	ww.writeUint(postEntry.CreatorBasisPoints)
+	ww.writeUint(postEntry.StakeMultipleBasisPoints)
+	ww.writeUint(uint64(postEntry.ConfirmationBlockHeight))
+	ww.writeUint(postEntry.TimestampNanos)
+	ww.writeBool(postEntry.IsHidden)
+	ww.writeStakeEntry(postEntry.StakeEntry)
+	ww.writeUint(postEntry.LikeCount)
+	ww.writeUint(postEntry.RecloutCount)
+	ww.writeUint(postEntry.DiamondCount)
+	ww.writeUint(postEntry.CommentCount)
+	ww.writeBool(postEntry.IsPinned)
+	ww.writeExtraData(postEntry.PostExtraData)
+	return ww.data
+}
+
+func _DbDecodePostEntry(buf []byte, postEntry *PostEntry) error {
+	if _isLegacyGobDbBuf(buf) {
+		return _decodeLegacyGobDbBuf(buf, postEntry)
+	}
+	rr, version, err := _newDbEntryReader(buf)
+	if err != nil {
+		return err
+	}
+	if version != PostEntryCodecVersion {
+		return _unknownDbEntryVersionError("PostEntry", version)
+	}
+	postEntry.PostHash = rr.readBlockHash()
+	postEntry.PosterPublicKey = rr.readBytes()
+	postEntry.ParentStakeID = rr.readBytes()
+	postEntry.Body = rr.readBytes()
+	postEntry.RecloutedPostHash = rr.readBlockHash()
+	postEntry.IsQuotedReclout = rr.readBool()
+	postEntry.CreatorBasisPoints = rr.readUint()
+	postEntry.StakeMultipleBasisPoints = rr.readUint()
+	postEntry.ConfirmationBlockHeight = uint32(rr.readUint())
+	postEntry.TimestampNanos = rr.readUint()
+	postEntry.IsHidden = rr.readBool()
+	postEntry.StakeEntry = rr.readStakeEntry()
+	postEntry.LikeCount = rr.readUint()
+	postEntry.RecloutCount = rr.readUint()
+	postEntry.DiamondCount = rr.readUint()
+	postEntry.CommentCount = rr.readUint()
+	postEntry.IsPinned = rr.readBool()
+	postEntry.PostExtraData = rr.readExtraData()
+	return rr.finish("PostEntry", version)
+}
+
+// -------------------------------------------------------------------------------------
+// ProfileEntry
+// -------------------------------------------------------------------------------------
+
+func _DbBufForProfileEntry(profileEntry *ProfileEntry) []byte {
+	ww := _newDbEntryWriter(ProfileEntryCodecVersion)
+	ww.writeBytes(profileEntry.PublicKey)
+	ww.writeBytes(profileEntry.Username)
+	ww.writeBytes(profileEntry.Description)
+	ww.writeBytes(profileEntry.ProfilePic)
+	ww.writeBool(profileEntry.IsHidden)
+	ww.writeUint(profileEntry.CreatorBasisPoints)
+	ww.writeUint(profileEntry.BitCloutLockedNanos)
+	ww.writeUint(profileEntry.NumberOfHolders)
+	ww.writeUint(profileEntry.CoinsInCirculationNanos)
+	ww.writeUint(profileEntry.CoinWatermarkNanos)
+	ww.writeUint(profileEntry.StakeMultipleBasisPoints)
+	ww.writeStakeEntry(profileEntry.StakeEntry)
+	ww.writeUint(uint64(profileEntry.TransferRestrictionStatus))
+	return ww.data
+}
+
+func _DbDecodeProfileEntry(buf []byte, profileEntry *ProfileEntry) error {
+	if _isLegacyGobDbBuf(buf) {
+		return _decodeLegacyGobDbBuf(buf, profileEntry)
+	}
+	rr, version, err := _newDbEntryReader(buf)
+	if err != nil {
+		return err
+	}
+	// Version 1 is the same as version 2 without the TransferRestrictionStatus.
+	if version != 1 && version != ProfileEntryCodecVersion {
+		return _unknownDbEntryVersionError("ProfileEntry", version)
+	}
+	profileEntry.PublicKey = rr.readBytes()
+	profileEntry.Username = rr.readBytes()
+	profileEntry.Description = rr.readBytes()
+	profileEntry.ProfilePic = rr.readBytes()
+	profileEntry.IsHidden = rr.readBool()
+	profileEntry.CreatorBasisPoints = rr.readUint()
+	profileEntry.BitCloutLockedNanos = rr.readUint()
+	profileEntry.NumberOfHolders = rr.readUint()
+	profileEntry.CoinsInCirculationNanos = rr.readUint()
+	profileEntry.CoinWatermarkNanos = rr.readUint()
+	profileEntry.StakeMultipleBasisPoints = rr.readUint()
+	profileEntry.StakeEntry = rr.readStakeEntry()
+	if version >= 2 {
+		profileEntry.TransferRestrictionStatus = TransferRestrictionStatus(rr.readUint())
+	}
+	return rr.finish("ProfileEntry", version)
+}
+
+// -------------------------------------------------------------------------------------
+// BalanceEntry
+// -------------------------------------------------------------------------------------
+
+func _DbBufForBalanceEntry(balanceEntry *BalanceEntry) []byte {
+	ww := _newDbEntryWriter(BalanceEntryCodecVersion)
+	ww.writePKID(balanceEntry.HODLerPKID)
+	ww.writePKID(balanceEntry.CreatorPKID)
+	ww.writeUint(balanceEntry.BalanceNanos)
+	ww.writeBool(balanceEntry.HasPurchased)
+	return ww.data
+}
+
+func _DbDecodeBalanceEntry(buf []byte, balanceEntry *BalanceEntry) error {
+	if _isLegacyGobDbBuf(buf) {
+		return _decodeLegacyGobDbBuf(buf, balanceEntry)
+	}
+	rr, version, err := _newDbEntryReader(buf)
+	if err != nil {
+		return err
+	}
+	if version != BalanceEntryCodecVersion {
+		return _unknownDbEntryVersionError("BalanceEntry", version)
+	}
+	balanceEntry.HODLerPKID = rr.readPKID()
+	balanceEntry.CreatorPKID = rr.readPKID()
+	balanceEntry.BalanceNanos = rr.readUint()
+	balanceEntry.HasPurchased = rr.readBool()
+	return rr.finish("BalanceEntry", version)
+}
+
+// -------------------------------------------------------------------------------------
+// DiamondEntry
+// -------------------------------------------------------------------------------------
+
+func _DbBufForDiamondEntry(diamondEntry *DiamondEntry) []byte {
+	ww := _newDbEntryWriter(DiamondEntryCodecVersion)
+	ww.writePKID(diamondEntry.SenderPKID)
+	ww.writePKID(diamondEntry.ReceiverPKID)
+	ww.writeBlockHash(diamondEntry.DiamondPostHash)
+	ww.writeInt(diamondEntry.DiamondLevel)
+	return ww.data
+}
+
+func _DbDecodeDiamondEntry(buf []byte, diamondEntry *DiamondEntry) error {
+	if _isLegacyGobDbBuf(buf) {
+		return _decodeLegacyGobDbBuf(buf, diamondEntry)
+	}
+	rr, version, err := _newDbEntryReader(buf)
+	if err != nil {
+		return err
+	}
+	if version != DiamondEntryCodecVersion {
+		return _unknownDbEntryVersionError("DiamondEntry", version)
+	}
+	diamondEntry.SenderPKID = rr.readPKID()
+	diamondEntry.ReceiverPKID = rr.readPKID()
+	diamondEntry.DiamondPostHash = rr.readBlockHash()
+	diamondEntry.DiamondLevel = rr.readInt()
+	return rr.finish("DiamondEntry", version)
+}
+
+// -------------------------------------------------------------------------------------
+// TransactionMetadata
+// -------------------------------------------------------------------------------------
+
+// Unlike the entries above, TransactionMetadata's fields are written after the
+// version byte as protobuf-style fields, each with its own tag. A decoder skips
+// the tags it doesn't know, so fields can be added without bumping the version
+// and a node that's behind can still read metadata written by a newer one. The
+// version only changes if an existing field changes meaning. Tags can't be
+// reused once they've been assigned.
+
+func _txindexUtxoToBytes(utxo *TxindexUtxo) []byte {
+	data := []byte{}
+	data = _protoAppendStringField(data, 1, utxo.TxIDHex)
+	data = _protoAppendVarintField(data, 2, uint64(utxo.Index))
+	data = _protoAppendStringField(data, 3, utxo.PublicKeyBase58Check)
+	data = _protoAppendVarintField(data, 4, utxo.AmountNanos)
+	data = _protoAppendStringField(data, 5, utxo.UtxoType)
+	return data
+}
+
+func _txindexUtxoFromBytes(data []byte) (*TxindexUtxo, error) {
+	utxo := &TxindexUtxo{}
+	err := _protoDecodeFields(data, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+		switch fieldNum {
+		case 1:
+			utxo.TxIDHex = string(bytesVal)
+		case 2:
+			utxo.Index = uint32(varintVal)
+		case 3:
+			utxo.PublicKeyBase58Check = string(bytesVal)
+		case 4:
+			utxo.AmountNanos = varintVal
+		case 5:
+			utxo.UtxoType = string(bytesVal)
+		}
+		return nil
+	})
+	return utxo, err
+}
+
+func (txnMeta *TransactionMetadata) ToBytes() []byte {
+	data := []byte{DbEntryCodecMagicByte, TransactionMetadataCodecVersion}
+	data = _protoAppendStringField(data, 1, txnMeta.BlockHashHex)
+	data = _protoAppendVarintField(data, 2, txnMeta.TxnIndexInBlock)
+	data = _protoAppendStringField(data, 3, txnMeta.TxnType)
+	data = _protoAppendVarintField(data, 4, uint64(txnMeta.BlockHeight))
+	data = _protoAppendStringField(data, 5, txnMeta.TransactorPublicKeyBase58Check)
+	for _, affectedPublicKey := range txnMeta.AffectedPublicKeys {
+		affectedData := []byte{}
+		affectedData = _protoAppendStringField(affectedData, 1, affectedPublicKey.PublicKeyBase58Check)
+		affectedData = _protoAppendStringField(affectedData, 2, affectedPublicKey.Metadata)
+		data = _protoAppendBytesField(data, 6, affectedData)
+	}
+	for _, output := range txnMeta.TxnOutputs {
+		outputData := []byte{}
+		if len(output.PublicKey) > 0 {
+			outputData = _protoAppendBytesField(outputData, 1, output.PublicKey)
+		}
+		outputData = _protoAppendVarintField(outputData, 2, output.AmountNanos)
+		data = _protoAppendBytesField(data, 7, outputData)
+	}
+
+	// The type-specific metadata is written whenever it's set, even if all of
+	// its fields are zero, so whether it was set survives the round trip.
+	if meta := txnMeta.BasicTransferTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendVarintField(metaData, 1, meta.TotalInputNanos)
+		metaData = _protoAppendVarintField(metaData, 2, meta.TotalOutputNanos)
+		metaData = _protoAppendVarintField(metaData, 3, meta.FeeNanos)
+		// Tag 4 held UtxoOpsDump, which was replaced by the inputs and outputs.
+		for _, input := range meta.Inputs {
+			metaData = _protoAppendBytesField(metaData, 5, _txindexUtxoToBytes(input))
+		}
+		for _, output := range meta.Outputs {
+			metaData = _protoAppendBytesField(metaData, 6, _txindexUtxoToBytes(output))
+		}
+		data = _protoAppendBytesField(data, 8, metaData)
+	}
+	if meta := txnMeta.BitcoinExchangeTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendStringField(metaData, 1, meta.BitcoinSpendAddress)
+		metaData = _protoAppendVarintField(metaData, 2, meta.SatoshisBurned)
+		metaData = _protoAppendVarintField(metaData, 3, meta.NanosCreated)
+		metaData = _protoAppendVarintField(metaData, 4, meta.TotalNanosPurchasedBefore)
+		metaData = _protoAppendVarintField(metaData, 5, meta.TotalNanosPurchasedAfter)
+		metaData = _protoAppendStringField(metaData, 6, meta.BitcoinTxnHash)
+		data = _protoAppendBytesField(data, 9, metaData)
+	}
+	if meta := txnMeta.CreatorCoinTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendStringField(metaData, 1, meta.OperationType)
+		metaData = _protoAppendVarintField(metaData, 2, meta.BitCloutToSellNanos)
+		metaData = _protoAppendVarintField(metaData, 3, meta.CreatorCoinToSellNanos)
+		metaData = _protoAppendVarintField(metaData, 4, meta.BitCloutToAddNanos)
+		data = _protoAppendBytesField(data, 10, metaData)
+	}
+	if meta := txnMeta.CreatorCoinTransferTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendStringField(metaData, 1, meta.CreatorUsername)
+		metaData = _protoAppendVarintField(metaData, 2, meta.CreatorCoinToTransferNanos)
+		// Negative levels are written as their two's complement like protobuf's
+		// int64.
+		metaData = _protoAppendVarintField(metaData, 3, uint64(meta.DiamondLevel))
+		metaData = _protoAppendStringField(metaData, 4, meta.PostHashHex)
+		data = _protoAppendBytesField(data, 11, metaData)
+	}
+	if meta := txnMeta.UpdateProfileTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendStringField(metaData, 1, meta.ProfilePublicKeyBase58Check)
+		metaData = _protoAppendStringField(metaData, 2, meta.NewUsername)
+		metaData = _protoAppendStringField(metaData, 3, meta.NewDescription)
+		metaData = _protoAppendStringField(metaData, 4, meta.NewProfilePic)
+		metaData = _protoAppendVarintField(metaData, 5, meta.NewCreatorBasisPoints)
+		metaData = _protoAppendVarintField(metaData, 6, meta.NewStakeMultipleBasisPoints)
+		metaData = _protoAppendBoolField(metaData, 7, meta.IsHidden)
+		data = _protoAppendBytesField(data, 12, metaData)
+	}
+	if meta := txnMeta.SubmitPostTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendStringField(metaData, 1, meta.PostHashBeingModifiedHex)
+		metaData = _protoAppendStringField(metaData, 2, meta.ParentPostHashHex)
+		data = _protoAppendBytesField(data, 13, metaData)
+	}
+	if meta := txnMeta.LikeTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendBoolField(metaData, 1, meta.IsUnlike)
+		metaData = _protoAppendStringField(metaData, 2, meta.PostHashHex)
+		data = _protoAppendBytesField(data, 14, metaData)
+	}
+	if meta := txnMeta.FollowTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendBoolField(metaData, 1, meta.IsUnfollow)
+		data = _protoAppendBytesField(data, 15, metaData)
+	}
+	if meta := txnMeta.PrivateMessageTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendVarintField(metaData, 1, meta.TimestampNanos)
+		data = _protoAppendBytesField(data, 16, metaData)
+	}
+	if meta := txnMeta.SwapIdentityTxindexMetadata; meta != nil {
+		metaData := []byte{}
+		metaData = _protoAppendStringField(metaData, 1, meta.FromPublicKeyBase58Check)
+		metaData = _protoAppendStringField(metaData, 2, meta.ToPublicKeyBase58Check)
+		data = _protoAppendBytesField(data, 17, metaData)
+	}
+	return data
+}
+
+// FromBytes decodes metadata written by ToBytes, or gob-encoded metadata that
+// was written before ToBytes existed.
+func (txnMeta *TransactionMetadata) FromBytes(data []byte) error {
+	if _isLegacyGobDbBuf(data) {
+		return _decodeLegacyGobDbBuf(data, txnMeta)
+	}
+	if len(data) < 2 {
+		return errors.Wrapf(ErrEntryCorrupt, "TransactionMetadata.FromBytes: Buf is not a versioned entry")
+	}
+	if version := data[1]; version != TransactionMetadataCodecVersion {
+		return _unknownDbEntryVersionError("TransactionMetadata", version)
+	}
+
+	err := _protoDecodeFields(data[2:], func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+		switch fieldNum {
+		case 1:
+			txnMeta.BlockHashHex = string(bytesVal)
+		case 2:
+			txnMeta.TxnIndexInBlock = varintVal
+		case 3:
+			txnMeta.TxnType = string(bytesVal)
+		case 4:
+			txnMeta.BlockHeight = uint32(varintVal)
+		case 5:
+			txnMeta.TransactorPublicKeyBase58Check = string(bytesVal)
+		case 6:
+			affectedPublicKey := &AffectedPublicKey{}
+			txnMeta.AffectedPublicKeys = append(txnMeta.AffectedPublicKeys, affectedPublicKey)
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					affectedPublicKey.PublicKeyBase58Check = string(bytesVal)
+				case 2:
+					affectedPublicKey.Metadata = string(bytesVal)
+				}
+				return nil
+			})
+		case 7:
+			output := &BitCloutOutput{}
+			txnMeta.TxnOutputs = append(txnMeta.TxnOutputs, output)
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					output.PublicKey = append([]byte{}, bytesVal...)
+				case 2:
+					output.AmountNanos = varintVal
+				}
+				return nil
+			})
+		case 8:
+			meta := &BasicTransferTxindexMetadata{}
+			txnMeta.BasicTransferTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.TotalInputNanos = varintVal
+				case 2:
+					meta.TotalOutputNanos = varintVal
+				case 3:
+					meta.FeeNanos = varintVal
+				case 5:
+					input, err := _txindexUtxoFromBytes(bytesVal)
+					if err != nil {
+						return err
+					}
+					meta.Inputs = append(meta.Inputs, input)
+				case 6:
+					output, err := _txindexUtxoFromBytes(bytesVal)
+					if err != nil {
+						return err
+					}
+					meta.Outputs = append(meta.Outputs, output)
+				}
+				return nil
+			})
+		case 9:
+			meta := &BitcoinExchangeTxindexMetadata{}
+			txnMeta.BitcoinExchangeTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.BitcoinSpendAddress = string(bytesVal)
+				case 2:
+					meta.SatoshisBurned = varintVal
+				case 3:
+					meta.NanosCreated = varintVal
+				case 4:
+					meta.TotalNanosPurchasedBefore = varintVal
+				case 5:
+					meta.TotalNanosPurchasedAfter = varintVal
+				case 6:
+					meta.BitcoinTxnHash = string(bytesVal)
+				}
+				return nil
+			})
+		case 10:
+			meta := &CreatorCoinTxindexMetadata{}
+			txnMeta.CreatorCoinTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.OperationType = string(bytesVal)
+				case 2:
+					meta.BitCloutToSellNanos = varintVal
+				case 3:
+					meta.CreatorCoinToSellNanos = varintVal
+				case 4:
+					meta.BitCloutToAddNanos = varintVal
+				}
+				return nil
+			})
+		case 11:
+			meta := &CreatorCoinTransferTxindexMetadata{}
+			txnMeta.CreatorCoinTransferTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.CreatorUsername = string(bytesVal)
+				case 2:
+					meta.CreatorCoinToTransferNanos = varintVal
+				case 3:
+					meta.DiamondLevel = int64(varintVal)
+				case 4:
+					meta.PostHashHex = string(bytesVal)
+				}
+				return nil
+			})
+		case 12:
+			meta := &UpdateProfileTxindexMetadata{}
+			txnMeta.UpdateProfileTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.ProfilePublicKeyBase58Check = string(bytesVal)
+				case 2:
+					meta.NewUsername = string(bytesVal)
+				case 3:
+					meta.NewDescription = string(bytesVal)
+				case 4:
+					meta.NewProfilePic = string(bytesVal)
+				case 5:
+					meta.NewCreatorBasisPoints = varintVal
+				case 6:
+					meta.NewStakeMultipleBasisPoints = varintVal
+				case 7:
+					meta.IsHidden = varintVal != 0
+				}
+				return nil
+			})
+		case 13:
+			meta := &SubmitPostTxindexMetadata{}
+			txnMeta.SubmitPostTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.PostHashBeingModifiedHex = string(bytesVal)
+				case 2:
+					meta.ParentPostHashHex = string(bytesVal)
+				}
+				return nil
+			})
+		case 14:
+			meta := &LikeTxindexMetadata{}
+			txnMeta.LikeTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.IsUnlike = varintVal != 0
+				case 2:
+					meta.PostHashHex = string(bytesVal)
+				}
+				return nil
+			})
+		case 15:
+			meta := &FollowTxindexMetadata{}
+			txnMeta.FollowTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				if fieldNum == 1 {
+					meta.IsUnfollow = varintVal != 0
+				}
+				return nil
+			})
+		case 16:
+			meta := &PrivateMessageTxindexMetadata{}
+			txnMeta.PrivateMessageTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				if fieldNum == 1 {
+					meta.TimestampNanos = varintVal
+				}
+				return nil
+			})
+		case 17:
+			meta := &SwapIdentityTxindexMetadata{}
+			txnMeta.SwapIdentityTxindexMetadata = meta
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				switch fieldNum {
+				case 1:
+					meta.FromPublicKeyBase58Check = string(bytesVal)
+				case 2:
+					meta.ToPublicKeyBase58Check = string(bytesVal)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return _corruptDbEntryError(err, "Problem decoding TransactionMetadata version %d", data[1])
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbEntryCodecs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	gobBytes := func(entry interface{}) []byte {
+		buf := bytes.NewBuffer([]byte{})
+		require.NoError(gob.NewEncoder(buf).Encode(entry))
+		// Make sure the legacy value can't be mistaken for a versioned one.
+		require.True(_isLegacyGobDbBuf(buf.Bytes()))
+		return buf.Bytes()
+	}
+
+	pkid1 := &PKID{1}
+	pkid2 := &PKID{2}
+	postHash := &BlockHash{3}
+
+	{
+		messageEntry := &MessageEntry{
+			SenderPublicKey:    pkid1[:],
+			RecipientPublicKey: pkid2[:],
+			EncryptedText:      []byte("hello"),
+			TstampNanos:        12345,
+		}
+		decoded := &MessageEntry{}
+		require.NoError(_DbDecodeMessageEntry(_DbBufForMessageEntry(messageEntry), decoded))
+		assert.Equal(messageEntry, decoded)
+
+		legacyDecoded := &MessageEntry{}
+		require.NoError(_DbDecodeMessageEntry(gobBytes(messageEntry), legacyDecoded))
+		assert.Equal(messageEntry, legacyDecoded)
+	}
+
+	{
+		postEntry := &PostEntry{
+			PostHash:                 postHash,
+			PosterPublicKey:          pkid1[:],
+			Body:                     []byte("body"),
+			RecloutedPostHash:        &BlockHash{4},
+			IsQuotedReclout:          true,
+			CreatorBasisPoints:       1,
+			StakeMultipleBasisPoints: 2,
+			ConfirmationBlockHeight:  3,
+			TimestampNanos:           4,
+			StakeEntry: &StakeEntry{
+				StakeList: []*SingleStake{
+					{InitialStakeNanos: 5, PublicKey: pkid2[:]},
+				},
+				TotalPostStake: 6,
+			},
+			LikeCount:     7,
+			RecloutCount:  8,
+			DiamondCount:  9,
+			CommentCount:  10,
+			IsPinned:      true,
+			PostExtraData: map[string][]byte{"b": []byte("2"), "a": []byte("1")},
+		}
+		postBytes := _DbBufForPostEntry(postEntry)
+		decoded := &PostEntry{}
+		require.NoError(_DbDecodePostEntry(postBytes, decoded))
+		assert.Equal(postEntry, decoded)
+
+		// The encoding of the extra data shouldn't depend on map order.
+		assert.Equal(postBytes, _DbBufForPostEntry(decoded))
+
+		legacyDecoded := &PostEntry{}
+		require.NoError(_DbDecodePostEntry(gobBytes(postEntry), legacyDecoded))
+		assert.Equal(postEntry, legacyDecoded)
+
+		// Truncated values and unknown versions are errors.
+		require.Error(_DbDecodePostEntry(postBytes[:len(postBytes)-1], &PostEntry{}))
+		futureBytes := append([]byte{}, postBytes...)
+		futureBytes[1] = PostEntryCodecVersion + 1
+		require.Error(_DbDecodePostEntry(futureBytes, &PostEntry{}))
+	}
+
+	{
+		profileEntry := &ProfileEntry{
+			PublicKey:   pkid1[:],
+			Username:    []byte("user"),
+			Description: []byte("desc"),
+			IsHidden:    true,
+			CoinEntry: CoinEntry{
+				CreatorBasisPoints:      1,
+				BitCloutLockedNanos:     2,
+				NumberOfHolders:         3,
+				CoinsInCirculationNanos: 4,
+				CoinWatermarkNanos:      5,
+			},
+			StakeMultipleBasisPoints: 6,
+			StakeEntry:               &StakeEntry{TotalPostStake: 7},
+		}
+		profileBytes := _DbBufForProfileEntry(profileEntry)
+		decoded := &ProfileEntry{}
+		require.NoError(_DbDecodeProfileEntry(profileBytes, decoded))
+		assert.Equal(profileEntry, decoded)
+
+		legacyDecoded := &ProfileEntry{}
+		require.NoError(_DbDecodeProfileEntry(gobBytes(profileEntry), legacyDecoded))
+		assert.Equal(profileEntry, legacyDecoded)
+
+		// Version 1 values don't have a TransferRestrictionStatus.
+		version1Bytes := append([]byte{}, profileBytes[:len(profileBytes)-1]...)
+		version1Bytes[1] = 1
+		version1Decoded := &ProfileEntry{}
+		require.NoError(_DbDecodeProfileEntry(version1Bytes, version1Decoded))
+		assert.Equal(profileEntry, version1Decoded)
+
+		profileEntry.TransferRestrictionStatus = TransferRestrictionStatusDAOMembersOnly
+		decoded = &ProfileEntry{}
+		require.NoError(_DbDecodeProfileEntry(_DbBufForProfileEntry(profileEntry), decoded))
+		assert.Equal(profileEntry, decoded)
+	}
+
+	{
+		balanceEntry := &BalanceEntry{
+			HODLerPKID:   pkid1,
+			CreatorPKID:  pkid2,
+			BalanceNanos: 100,
+			HasPurchased: true,
+		}
+		decoded := &BalanceEntry{}
+		require.NoError(_DbDecodeBalanceEntry(_DbBufForBalanceEntry(balanceEntry), decoded))
+		assert.Equal(balanceEntry, decoded)
+
+		legacyDecoded := &BalanceEntry{}
+		require.NoError(_DbDecodeBalanceEntry(gobBytes(balanceEntry), legacyDecoded))
+		assert.Equal(balanceEntry, legacyDecoded)
+	}
+
+	{
+		diamondEntry := &DiamondEntry{
+			SenderPKID:      pkid1,
+			ReceiverPKID:    pkid2,
+			DiamondPostHash: postHash,
+			DiamondLevel:    3,
+		}
+		assert.Equal(diamondEntry, _DbDiamondEntryForDbBuf(_DbBufForDiamondEntry(diamondEntry)))
+		assert.Equal(diamondEntry, _DbDiamondEntryForDbBuf(gobBytes(diamondEntry)))
+	}
+}
+
+func TestTransactionMetadataCodec(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	txnMeta := &TransactionMetadata{
+		BlockHashHex:                   "abcd",
+		TxnIndexInBlock:                3,
+		TxnType:                        TxnTypeCreatorCoinTransfer.String(),
+		BlockHeight:                    12,
+		TransactorPublicKeyBase58Check: "transactor",
+		AffectedPublicKeys: []*AffectedPublicKey{
+			{PublicKeyBase58Check: "receiver", Metadata: "ReceiverPublicKey"},
+			{PublicKeyBase58Check: "transactor"},
+		},
+		TxnOutputs: []*BitCloutOutput{
+			{PublicKey: []byte{2, 1}, AmountNanos: 5},
+			{AmountNanos: 6},
+		},
+		BasicTransferTxindexMetadata: &BasicTransferTxindexMetadata{
+			TotalInputNanos:  11,
+			TotalOutputNanos: 10,
+			FeeNanos:         1,
+			Inputs: []*TxindexUtxo{
+				{TxIDHex: "ab01", Index: 1, PublicKeyBase58Check: "transactor", AmountNanos: 11, UtxoType: "UtxoTypeOutput"},
+			},
+			Outputs: []*TxindexUtxo{
+				{TxIDHex: "cd02", PublicKeyBase58Check: "receiver", AmountNanos: 5, UtxoType: "UtxoTypeOutput"},
+				{TxIDHex: "cd02", Index: 1, PublicKeyBase58Check: "transactor", AmountNanos: 5, UtxoType: "UtxoTypeOutput"},
+			},
+		},
+		CreatorCoinTransferTxindexMetadata: &CreatorCoinTransferTxindexMetadata{
+			CreatorUsername:            "creator",
+			CreatorCoinToTransferNanos: 7,
+			DiamondLevel:               -1,
+			PostHashHex:                "ef01",
+		},
+		UpdateProfileTxindexMetadata: &UpdateProfileTxindexMetadata{
+			NewUsername: "new",
+			IsHidden:    true,
+		},
+		LikeTxindexMetadata: &LikeTxindexMetadata{IsUnlike: true, PostHashHex: "ef01"},
+	}
+	txnMetaBytes := txnMeta.ToBytes()
+	decoded := &TransactionMetadata{}
+	require.NoError(decoded.FromBytes(txnMetaBytes))
+	assert.Equal(txnMeta, decoded)
+
+	// Type metadata that's set is kept even if all of its fields are zero.
+	emptyMeta := &TransactionMetadata{FollowTxindexMetadata: &FollowTxindexMetadata{}}
+	decoded = &TransactionMetadata{}
+	require.NoError(decoded.FromBytes(emptyMeta.ToBytes()))
+	assert.Equal(emptyMeta, decoded)
+
+	// Metadata written before the versioned encoding is gob.
+	gobBuf := bytes.NewBuffer([]byte{})
+	require.NoError(gob.NewEncoder(gobBuf).Encode(txnMeta))
+	require.True(_isLegacyGobDbBuf(gobBuf.Bytes()))
+	decoded = &TransactionMetadata{}
+	require.NoError(decoded.FromBytes(gobBuf.Bytes()))
+	assert.Equal(txnMeta, decoded)
+
+	// Fields added by a newer node are skipped.
+	futureFieldBytes := _protoAppendStringField(append([]byte{}, txnMetaBytes...), 1000, "new field")
+	futureFieldBytes = _protoAppendVarintField(futureFieldBytes, 1001, 42)
+	decoded = &TransactionMetadata{}
+	require.NoError(decoded.FromBytes(futureFieldBytes))
+	assert.Equal(txnMeta, decoded)
+
+	// Truncated values and unknown versions are errors.
+	require.Error((&TransactionMetadata{}).FromBytes(txnMetaBytes[:len(txnMetaBytes)-1]))
+	futureVersionBytes := append([]byte{}, txnMetaBytes...)
+	futureVersionBytes[1] = TransactionMetadataCodecVersion + 1
+	require.Error((&TransactionMetadata{}).FromBytes(futureVersionBytes))
+}
@@ -0,0 +1,402 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+// DbExport writes the entries under some prefixes as typed records, decoded with
+// the entry codecs, so they can be loaded into analytics tools or copied into
+// another node's db with DbImport. Keys are exported as they're stored.
+//
+// Records can be line-delimited JSON, with the entry as a JSON object, or
+// uvarint-length-delimited protobuf DbExportRecord messages (see
+// db_export.proto), with the entry in its current binary encoding. Values that
+// were still gob-encoded are exported in the current encoding either way.
+
+const (
+	DbExportFormatJSON  = "json"
+	DbExportFormatProto = "proto"
+
+	// The most records DbImport writes in one txn.
+	DbImportBatchSize = 1000
+	// Anything bigger than this can't be a record DbExport wrote.
+	MaxDbExportRecordBytes = 64 << 20
+)
+
+// DbExportCodec is how the entries under a prefix are decoded, encoded, and
+// written back to the db.
+type DbExportCodec struct {
+	EntryType string
+	NewEntry  func() interface{}
+	Decode    func(buf []byte, entry interface{}) error
+	Encode    func(entry interface{}) []byte
+	// Put writes the entry along with the indexes derived from it. key is the
+	// key it was exported under. Entries with a timestamp past
+	// maxIndexedTstampNanos are quarantined out of the time-ordered indexes.
+	Put func(txn KVTxn, key []byte, entry interface{}, params *BitCloutParams,
+		maxIndexedTstampNanos uint64) error
+}
+
+var (
+	_postEntryExportCodec = &DbExportCodec{
+		EntryType: "PostEntry",
+		NewEntry:  func() interface{} { return &PostEntry{} },
+		Decode: func(buf []byte, entry interface{}) error {
+			return _DbDecodePostEntry(buf, entry.(*PostEntry))
+		},
+		Encode: func(entry interface{}) []byte {
+			return _DbBufForPostEntry(entry.(*PostEntry))
+		},
+		Put: func(txn KVTxn, key []byte, entry interface{}, params *BitCloutParams,
+			maxIndexedTstampNanos uint64) error {
+
+			return DBPutPostEntryMappingsWithTxn(txn, entry.(*PostEntry), params, maxIndexedTstampNanos)
+		},
+	}
+	_profileEntryExportCodec = &DbExportCodec{
+		EntryType: "ProfileEntry",
+		NewEntry:  func() interface{} { return &ProfileEntry{} },
+		Decode: func(buf []byte, entry interface{}) error {
+			return _DbDecodeProfileEntry(buf, entry.(*ProfileEntry))
+		},
+		Encode: func(entry interface{}) []byte {
+			return _DbBufForProfileEntry(entry.(*ProfileEntry))
+		},
+		Put: func(txn KVTxn, key []byte, entry interface{}, params *BitCloutParams,
+			maxIndexedTstampNanos uint64) error {
+
+			pkidBytes := key[len(_PrefixPKIDToProfileEntry):]
+			if len(pkidBytes) != len(PKID{}) {
+				return fmt.Errorf("Profile key %v doesn't end in a PKID", key)
+			}
+			pkid := &PKID{}
+			copy(pkid[:], pkidBytes)
+			return DBPutProfileEntryMappingsWithTxn(txn, entry.(*ProfileEntry), pkid, params)
+		},
+	}
+	_balanceEntryExportCodec = &DbExportCodec{
+		EntryType: "BalanceEntry",
+		NewEntry:  func() interface{} { return &BalanceEntry{} },
+		Decode: func(buf []byte, entry interface{}) error {
+			return _DbDecodeBalanceEntry(buf, entry.(*BalanceEntry))
+		},
+		Encode: func(entry interface{}) []byte {
+			return _DbBufForBalanceEntry(entry.(*BalanceEntry))
+		},
+		Put: func(txn KVTxn, key []byte, entry interface{}, params *BitCloutParams,
+			maxIndexedTstampNanos uint64) error {
+
+			return DBPutCreatorCoinBalanceEntryMappingsWithTxn(txn, entry.(*BalanceEntry), params)
+		},
+	}
+	_messageEntryExportCodec = &DbExportCodec{
+		EntryType: "MessageEntry",
+		NewEntry:  func() interface{} { return &MessageEntry{} },
+		Decode: func(buf []byte, entry interface{}) error {
+			return _DbDecodeMessageEntry(buf, entry.(*MessageEntry))
+		},
+		Encode: func(entry interface{}) []byte {
+			return _DbBufForMessageEntry(entry.(*MessageEntry))
+		},
+		Put: func(txn KVTxn, key []byte, entry interface{}, params *BitCloutParams,
+			maxIndexedTstampNanos uint64) error {
+
+			return DbPutMessageEntryWithTxn(txn, entry.(*MessageEntry), maxIndexedTstampNanos)
+		},
+	}
+	_diamondEntryExportCodec = &DbExportCodec{
+		EntryType: "DiamondEntry",
+		NewEntry:  func() interface{} { return &DiamondEntry{} },
+		Decode: func(buf []byte, entry interface{}) error {
+			return _DbDecodeDiamondEntry(buf, entry.(*DiamondEntry))
+		},
+		Encode: func(entry interface{}) []byte {
+			return _DbBufForDiamondEntry(entry.(*DiamondEntry))
+		},
+		Put: func(txn KVTxn, key []byte, entry interface{}, params *BitCloutParams,
+			maxIndexedTstampNanos uint64) error {
+
+			return DbPutDiamondMappingsWithTxn(txn, entry.(*DiamondEntry))
+		},
+	}
+)
+
+// DbExportCodecs maps the names of the prefixes in DbPrefixRegistry that can be
+// exported to their codecs. A prefix and its reverse index share a codec, and
+// importing either one writes both.
+var DbExportCodecs = map[string]*DbExportCodec{
+	"PostHashToPostEntry":                          _postEntryExportCodec,
+	"PKIDToProfileEntry":                           _profileEntryExportCodec,
+	"HODLerPKIDCreatorPKIDToBalanceEntry":          _balanceEntryExportCodec,
+	"CreatorPKIDHODLerPKIDToBalanceEntry":          _balanceEntryExportCodec,
+	"PublicKeyTimestampToPrivateMessage":           _messageEntryExportCodec,
+	"DiamondReceiverPKIDDiamondSenderPKIDPostHash": _diamondEntryExportCodec,
+	"DiamondSenderPKIDDiamondReciverPKIDPostHash":  _diamondEntryExportCodec,
+}
+
+// DbExportRecord is one exported entry. In the JSON format Key is hex-encoded
+// and Entry is the typed entry.
+type DbExportRecord struct {
+	Prefix    string
+	Key       []byte
+	EntryType string
+	Entry     interface{}
+}
+
+type _dbExportJSONRecord struct {
+	Prefix    string
+	Key       string
+	EntryType string
+	Entry     json.RawMessage
+}
+
+const (
+	_dbExportRecordFieldPrefix    = 1
+	_dbExportRecordFieldKey       = 2
+	_dbExportRecordFieldEntryType = 3
+	_dbExportRecordFieldEntry     = 4
+)
+
+func _getDbExportPrefix(prefixName string) (*DbPrefixInfo, *DbExportCodec, error) {
+	codec, exists := DbExportCodecs[prefixName]
+	if !exists {
+		return nil, nil, fmt.Errorf("Prefix %s can't be exported", prefixName)
+	}
+	for _, prefixInfo := range DbPrefixRegistry {
+		if prefixInfo.Name == prefixName {
+			return prefixInfo, codec, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("Prefix %s isn't in the registry", prefixName)
+}
+
+func _writeDbExportRecord(writer io.Writer, format string, record *DbExportRecord,
+	codec *DbExportCodec) error {
+
+	switch format {
+	case DbExportFormatJSON:
+		entryBytes, err := json.Marshal(record.Entry)
+		if err != nil {
+			return err
+		}
+		recordBytes, err := json.Marshal(&_dbExportJSONRecord{
+			Prefix:    record.Prefix,
+			Key:       hex.EncodeToString(record.Key),
+			EntryType: record.EntryType,
+			Entry:     entryBytes,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(append(recordBytes, '\n'))
+		return err
+	case DbExportFormatProto:
+		recordBytes := _protoAppendStringField(nil, _dbExportRecordFieldPrefix, record.Prefix)
+		recordBytes = _protoAppendBytesField(recordBytes, _dbExportRecordFieldKey, record.Key)
+		recordBytes = _protoAppendStringField(recordBytes, _dbExportRecordFieldEntryType, record.EntryType)
+		recordBytes = _protoAppendBytesField(recordBytes, _dbExportRecordFieldEntry, codec.Encode(record.Entry))
+		_, err := writer.Write(append(UintToBuf(uint64(len(recordBytes))), recordBytes...))
+		return err
+	}
+	return fmt.Errorf("Unknown format %v; must be %v or %v", format, DbExportFormatJSON, DbExportFormatProto)
+}
+
+// _readDbExportRecord returns io.EOF once there are no more records.
+func _readDbExportRecord(reader *bufio.Reader, format string) (*DbExportRecord, error) {
+	switch format {
+	case DbExportFormatJSON:
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			return _readDbExportRecord(reader, format)
+		}
+		jsonRecord := &_dbExportJSONRecord{}
+		if err := json.Unmarshal(line, jsonRecord); err != nil {
+			return nil, err
+		}
+		codec, exists := DbExportCodecs[jsonRecord.Prefix]
+		if !exists {
+			return nil, fmt.Errorf("Prefix %s can't be imported", jsonRecord.Prefix)
+		}
+		key, err := hex.DecodeString(jsonRecord.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Problem decoding key")
+		}
+		entry := codec.NewEntry()
+		if err := json.Unmarshal(jsonRecord.Entry, entry); err != nil {
+			return nil, errors.Wrapf(err, "Problem decoding %s", jsonRecord.EntryType)
+		}
+		return &DbExportRecord{
+			Prefix:    jsonRecord.Prefix,
+			Key:       key,
+			EntryType: jsonRecord.EntryType,
+			Entry:     entry,
+		}, nil
+
+	case DbExportFormatProto:
+		numBytes, err := ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if numBytes > MaxDbExportRecordBytes {
+			return nil, fmt.Errorf("Record has %d bytes, which is more than the max of %d",
+				numBytes, MaxDbExportRecordBytes)
+		}
+		recordBytes := make([]byte, numBytes)
+		if _, err := io.ReadFull(reader, recordBytes); err != nil {
+			return nil, errors.Wrapf(err, "Problem reading record")
+		}
+		record := &DbExportRecord{}
+		var entryBytes []byte
+		err = _protoDecodeFields(recordBytes, func(
+			fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+
+			switch fieldNum {
+			case _dbExportRecordFieldPrefix:
+				record.Prefix = string(bytesVal)
+			case _dbExportRecordFieldKey:
+				record.Key = append([]byte{}, bytesVal...)
+			case _dbExportRecordFieldEntryType:
+				record.EntryType = string(bytesVal)
+			case _dbExportRecordFieldEntry:
+				entryBytes = bytesVal
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		codec, exists := DbExportCodecs[record.Prefix]
+		if !exists {
+			return nil, fmt.Errorf("Prefix %s can't be imported", record.Prefix)
+		}
+		record.Entry = codec.NewEntry()
+		if err := codec.Decode(entryBytes, record.Entry); err != nil {
+			return nil, errors.Wrapf(err, "Problem decoding %s", record.EntryType)
+		}
+		return record, nil
+	}
+	return nil, fmt.Errorf("Unknown format %v; must be %v or %v", format, DbExportFormatJSON, DbExportFormatProto)
+}
+
+// DbExport writes every entry under the named prefixes to writer in the format
+// and returns the number written. No prefix names exports every prefix in
+// DbExportCodecs. Everything is read in one txn so the export is consistent.
+func DbExport(handle *badger.DB, prefixNames []string, format string, writer io.Writer) (uint64, error) {
+	if len(prefixNames) == 0 {
+		for _, prefixInfo := range DbPrefixRegistry {
+			if _, exists := DbExportCodecs[prefixInfo.Name]; exists {
+				prefixNames = append(prefixNames, prefixInfo.Name)
+			}
+		}
+	}
+
+	bufWriter := bufio.NewWriter(writer)
+	numRecords := uint64(0)
+	err := DbView(handle, func(txn KVTxn) error {
+		for _, prefixName := range prefixNames {
+			prefixInfo, codec, err := _getDbExportPrefix(prefixName)
+			if err != nil {
+				return err
+			}
+			err = EnumerateKeysForPrefixWithCallbackWithTxn(txn, prefixInfo.Prefix, func(key []byte, val []byte) (bool, error) {
+				entry := codec.NewEntry()
+				if err := codec.Decode(val, entry); err != nil {
+					return false, errors.Wrapf(err, "Problem decoding %s under key %v", codec.EntryType, key)
+				}
+				record := &DbExportRecord{
+					Prefix:    prefixName,
+					Key:       key,
+					EntryType: codec.EntryType,
+					Entry:     entry,
+				}
+				if err := _writeDbExportRecord(bufWriter, format, record, codec); err != nil {
+					return false, err
+				}
+				numRecords++
+				return true, nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "Problem exporting prefix %s", prefixName)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	if err != nil {
+		return numRecords, errors.Wrapf(err, "DbExport: ")
+	}
+	return numRecords, nil
+}
+
+// DbImport writes the records DbExport wrote to the db, along with the indexes
+// derived from them, and returns the number imported. Records are written
+// DbImportBatchSize at a time so if DbImport fails partway the earlier batches
+// stay written. The node must not be running.
+func DbImport(handle *badger.DB, params *BitCloutParams, format string, reader io.Reader) (uint64, error) {
+	bufReader := bufio.NewReader(reader)
+	numRecords := uint64(0)
+	batch := []*DbExportRecord{}
+	maxIndexedTstampNanos := DbGetMaxIndexedTstampNanosForTip(handle)
+	flushBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := DbAtomicUpdate(handle, func(txn KVTxn) error {
+			for _, record := range batch {
+				prefixInfo, codec, err := _getDbExportPrefix(record.Prefix)
+				if err != nil {
+					return err
+				}
+				if !bytes.HasPrefix(record.Key, prefixInfo.Prefix) {
+					return fmt.Errorf("Key %v isn't under prefix %s", record.Key, record.Prefix)
+				}
+				if err := codec.Put(txn, record.Key, record.Entry, params, maxIndexedTstampNanos); err != nil {
+					return errors.Wrapf(err, "Problem putting %s under key %v", codec.EntryType, record.Key)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		numRecords += uint64(len(batch))
+		batch = []*DbExportRecord{}
+		return nil
+	}
+
+	for {
+		record, err := _readDbExportRecord(bufReader, format)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return numRecords, errors.Wrapf(err, "DbImport: Problem reading record %d", numRecords+uint64(len(batch)))
+		}
+		batch = append(batch, record)
+		if len(batch) >= DbImportBatchSize {
+			if err := flushBatch(); err != nil {
+				return numRecords, errors.Wrapf(err, "DbImport: ")
+			}
+		}
+	}
+	if err := flushBatch(); err != nil {
+		return numRecords, errors.Wrapf(err, "DbImport: ")
+	}
+	return numRecords, nil
+}
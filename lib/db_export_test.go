@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbExport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	params := &BitCloutTestnetParams
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkid1 := &PKID{1}
+	pkid2 := &PKID{2}
+	postHash := &BlockHash{3}
+	require.NoError(DbAtomicUpdate(db, func(txn KVTxn) error {
+		if err := DBPutPostEntryMappingsWithTxn(txn, &PostEntry{
+			PostHash:        postHash,
+			PosterPublicKey: pkid1[:],
+			Body:            []byte("body"),
+			TimestampNanos:  1,
+			PostExtraData:   map[string][]byte{"a": []byte("1")},
+		}, params, math.MaxUint64); err != nil {
+			return err
+		}
+		profileEntry := &ProfileEntry{
+			PublicKey:   pkid2[:],
+			Username:    []byte("bob"),
+			Description: []byte("hi"),
+		}
+		profileEntry.BitCloutLockedNanos = 10
+		if err := DBPutProfileEntryMappingsWithTxn(txn, profileEntry, pkid2, params); err != nil {
+			return err
+		}
+		if err := DBPutCreatorCoinBalanceEntryMappingsWithTxn(txn, &BalanceEntry{
+			HODLerPKID:   pkid1,
+			CreatorPKID:  pkid2,
+			BalanceNanos: 100,
+		}, params); err != nil {
+			return err
+		}
+		return DbPutDiamondMappingsWithTxn(txn, &DiamondEntry{
+			SenderPKID:      pkid1,
+			ReceiverPKID:    pkid2,
+			DiamondPostHash: postHash,
+			DiamondLevel:    2,
+		})
+	}))
+
+	// Returns every key and value in the db.
+	dbState := func(handle *badger.DB) map[string][]byte {
+		state := make(map[string][]byte)
+		require.NoError(DbView(handle, func(txn KVTxn) error {
+			it := txn.NewIterator(KVIteratorOptions{})
+			defer it.Close()
+			for it.Seek(nil); it.Valid(); it.Next() {
+				val, err := it.Value()
+				require.NoError(err)
+				state[string(it.Key())] = val
+			}
+			return nil
+		}))
+		return state
+	}
+
+	// Importing everything in either format rebuilds the db, indexes included.
+	for _, format := range []string{DbExportFormatJSON, DbExportFormatProto} {
+		exportBuf := bytes.NewBuffer([]byte{})
+		numExported, err := DbExport(db, nil, format, exportBuf)
+		require.NoError(err)
+		// The balance and diamond entries are each under two prefixes.
+		assert.Equal(uint64(6), numExported, format)
+		if format == DbExportFormatJSON {
+			assert.Contains(exportBuf.String(), `"Username":"Ym9i"`)
+			assert.Equal(6, strings.Count(exportBuf.String(), "\n"))
+		}
+
+		importedDb, importedDir := GetTestBadgerDb()
+		defer os.RemoveAll(importedDir)
+		numImported, err := DbImport(importedDb, params, format, exportBuf)
+		require.NoError(err)
+		assert.Equal(numExported, numImported)
+		assert.Equal(dbState(db), dbState(importedDb), format)
+	}
+
+	// Only the named prefixes are exported and they must have a codec.
+	exportBuf := bytes.NewBuffer([]byte{})
+	numExported, err := DbExport(db, []string{"PKIDToProfileEntry"}, DbExportFormatJSON, exportBuf)
+	require.NoError(err)
+	assert.Equal(uint64(1), numExported)
+	assert.Contains(exportBuf.String(), `"EntryType":"ProfileEntry"`)
+	_, err = DbExport(db, []string{"NodeConfig"}, DbExportFormatJSON, exportBuf)
+	assert.Error(err)
+	_, err = DbExport(db, nil, "csv", exportBuf)
+	assert.Error(err)
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/sasha-s/go-deadlock"
+)
+
+// CoreDBLifecycle owns the shutdown of the core db. Background loops that use
+// the db, like the summary snapshots, the retention sweeper, the scheduled post
+// publisher, and the decode failure reporter, are started through it so Stop
+// can tell them to quit and wait for them. Other writes made outside of block
+// processing, like the node config saved at startup, go through Update so Stop
+// can wait for the ones in flight before it syncs and closes the db.
+//
+// Block processing and the repairs and backfills run while the Blockchain is
+// being created write to the db directly. Stop should be called after the
+// Server has been stopped so those are finished.
+type CoreDBLifecycle struct {
+	db *badger.DB
+
+	// mtx protects started and stopped.
+	mtx     deadlock.Mutex
+	started bool
+	stopped bool
+
+	// writeLock is held for reading by every write in flight and for writing
+	// by Stop while it drains them.
+	writeLock deadlock.RWMutex
+
+	quit      chan struct{}
+	waitGroup sync.WaitGroup
+}
+
+func NewCoreDBLifecycle(db *badger.DB) *CoreDBLifecycle {
+	return &CoreDBLifecycle{
+		db:   db,
+		quit: make(chan struct{}),
+	}
+}
+
+// DB returns the db the lifecycle manages.
+func (lc *CoreDBLifecycle) DB() *badger.DB {
+	return lc.db
+}
+
+// Start allows background tasks to be run. It returns an error if the
+// lifecycle has already been stopped since a closed db can't be reopened.
+func (lc *CoreDBLifecycle) Start() error {
+	lc.mtx.Lock()
+	defer lc.mtx.Unlock()
+
+	if lc.stopped {
+		return fmt.Errorf("CoreDBLifecycle.Start: Already stopped")
+	}
+	lc.started = true
+	return nil
+}
+
+// Go runs task in the background. The task should return soon after quit is
+// closed. Tasks can only be added between Start and Stop.
+func (lc *CoreDBLifecycle) Go(name string, task func(quit <-chan struct{})) error {
+	lc.mtx.Lock()
+	defer lc.mtx.Unlock()
+
+	if !lc.started || lc.stopped {
+		return fmt.Errorf("CoreDBLifecycle.Go: Can't start task %v unless running", name)
+	}
+
+	lc.waitGroup.Add(1)
+	go func() {
+		defer lc.waitGroup.Done()
+		task(lc.quit)
+		glog.V(1).Infof("CoreDBLifecycle: Task %v finished", name)
+	}()
+	return nil
+}
+
+// GoPeriodic runs fn right away and then every interval until Stop is called.
+func (lc *CoreDBLifecycle) GoPeriodic(name string, interval time.Duration, fn func()) error {
+	return lc.Go(name, func(quit <-chan struct{}) {
+		for {
+			fn()
+			select {
+			case <-quit:
+				return
+			case <-time.After(interval):
+			}
+		}
+	})
+}
+
+// Update runs fn in a read-write txn unless Stop has been called, in which case
+// it returns ErrDBClosed without running it.
+func (lc *CoreDBLifecycle) Update(fn func(txn KVTxn) error) error {
+	lc.writeLock.RLock()
+	defer lc.writeLock.RUnlock()
+
+	lc.mtx.Lock()
+	stopped := lc.stopped
+	lc.mtx.Unlock()
+	if stopped {
+		return errors.Wrapf(ErrDBClosed, "CoreDBLifecycle.Update: Db is shutting down")
+	}
+
+	return _wrapDbError(DbUpdate(lc.db, fn), "CoreDBLifecycle.Update")
+}
+
+// Stop tells the background tasks to quit and waits for them, waits for any
+// writes in flight, syncs the db to disk, and closes it, which releases the
+// lock on the db directory. Calling it more than once is a no-op.
+func (lc *CoreDBLifecycle) Stop() error {
+	lc.mtx.Lock()
+	if lc.stopped {
+		lc.mtx.Unlock()
+		return nil
+	}
+	lc.stopped = true
+	lc.mtx.Unlock()
+
+	glog.Info("CoreDBLifecycle.Stop: Waiting for background tasks to finish")
+	close(lc.quit)
+	lc.waitGroup.Wait()
+
+	// New writes are refused now that stopped is set so this only waits for
+	// the ones that already started.
+	glog.Info("CoreDBLifecycle.Stop: Draining pending writes")
+	lc.writeLock.Lock()
+	defer lc.writeLock.Unlock()
+
+	if err := lc.db.Sync(); err != nil {
+		return fmt.Errorf("CoreDBLifecycle.Stop: Problem syncing db: %v", err)
+	}
+	if err := lc.db.Close(); err != nil {
+		return fmt.Errorf("CoreDBLifecycle.Stop: Problem closing db: %v", err)
+	}
+	glog.Info("CoreDBLifecycle.Stop: Db closed")
+	return nil
+}
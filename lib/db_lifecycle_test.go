@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoreDBLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	lifecycle := NewCoreDBLifecycle(db)
+
+	// Tasks can't be added before the lifecycle is started.
+	require.Error(lifecycle.Go("early", func(quit <-chan struct{}) {}))
+	require.NoError(lifecycle.Start())
+
+	var numRuns int32
+	require.NoError(lifecycle.GoPeriodic("counter", time.Millisecond, func() {
+		atomic.AddInt32(&numRuns, 1)
+	}))
+	taskQuit := make(chan struct{})
+	require.NoError(lifecycle.Go("waiter", func(quit <-chan struct{}) {
+		<-quit
+		close(taskQuit)
+	}))
+
+	require.NoError(lifecycle.Update(func(txn KVTxn) error {
+		return txn.Set([]byte{0xf0}, []byte{1})
+	}))
+
+	require.NoError(lifecycle.Stop())
+	// Every task has returned by the time Stop does.
+	select {
+	case <-taskQuit:
+	default:
+		t.Fatal("Task still running after Stop")
+	}
+	runsAtStop := atomic.LoadInt32(&numRuns)
+	assert.True(runsAtStop > 0)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(runsAtStop, atomic.LoadInt32(&numRuns))
+
+	// Nothing can be started or written once stopped and stopping again is fine.
+	require.Error(lifecycle.Go("late", func(quit <-chan struct{}) {}))
+	err := lifecycle.Update(func(txn KVTxn) error { return nil })
+	assert.True(errors.Is(err, ErrDBClosed))
+	require.Error(lifecycle.Start())
+	require.NoError(lifecycle.Stop())
+
+	// The directory lock was released and the write made it to disk.
+	opts := badger.DefaultOptions(dir)
+	var reopenedDb *badger.DB
+	reopenedDb, err = badger.Open(opts)
+	require.NoError(err)
+	defer reopenedDb.Close()
+	require.NoError(DbView(reopenedDb, func(txn KVTxn) error {
+		_, err := txn.Get([]byte{0xf0})
+		return err
+	}))
+}
@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/sasha-s/go-deadlock"
+)
+
+// DbManager owns the badger dbs a node opens: the chain db, the txindex db when
+// the txindex is on, and the directory the mempool dumps its txns to. Each db is
+// wrapped in a CoreDBLifecycle so the background tasks that use it are stopped
+// and its writes are drained before it's closed. The dbs can live in different
+// directories, e.g. to put the txindex on a bigger, slower disk than the chain.
+//
+// The mempool opens and closes its own dump dbs as it rotates them, through
+// OpenBadgerDb, since a dump is only ever written once and read back on restart.
+// They're opened with DefaultDbOptions rather than the chain db's options.
+type DbManager struct {
+	config *DbManagerConfig
+
+	chain *CoreDBLifecycle
+
+	// mtx protects txindex, which is only opened when the txindex is started,
+	// and the value log GC config and stats.
+	mtx     deadlock.Mutex
+	txindex *CoreDBLifecycle
+	// Nil until StartValueLogGC is called.
+	gcConfig *DbValueLogGCConfig
+	gcStats  map[string]*DbValueLogGCStats
+}
+
+type DbManagerConfig struct {
+	// The node's data directory. The chain db goes in its badger directory.
+	DataDir string
+	// Where the txindex db goes. When empty it goes under the chain db's
+	// directory, which is where it's always been.
+	TxindexDir string
+	// Where the mempool dumps its txns. When empty the mempool isn't dumped.
+	MempoolDir string
+	// The options the chain and txindex dbs are opened with. Nil uses
+	// DefaultDbOptions.
+	DbOptions *DbOptions
+	// When set, the DbOptions are checked against the params' MaxBlockSizeBytes
+	// before the chain db is opened. See DbOptions.ValidateForBlockSize.
+	Params *BitCloutParams
+}
+
+// OpenBadgerDb opens the badger db in dir, creating it if it doesn't exist. Nil
+// dbOptions opens it with DefaultDbOptions.
+func OpenBadgerDb(dir string, dbOptions *DbOptions) (*badger.DB, error) {
+	return _openBadgerDb(dir, dir, dbOptions)
+}
+
+func _openBadgerDb(dir string, valueDir string, dbOptions *DbOptions) (*badger.DB, error) {
+	if dbOptions == nil {
+		dbOptions = DefaultDbOptions()
+	}
+	if err := dbOptions.Validate(); err != nil {
+		return nil, err
+	}
+	return badger.Open(dbOptions.BadgerOptions(dir, valueDir))
+}
+
+// NewDbManager opens the chain db. The txindex db is opened by OpenTxindexDb.
+func NewDbManager(config *DbManagerConfig) (*DbManager, error) {
+	chainDir := GetBadgerDbPath(config.DataDir)
+	glog.Infof("DbManager: Chain BadgerDB Dir: %v", chainDir)
+	if config.Params != nil {
+		dbOptions := config.DbOptions
+		if dbOptions == nil {
+			dbOptions = DefaultDbOptions()
+		}
+		if err := dbOptions.ValidateForBlockSize(config.Params.MaxBlockSizeBytes); err != nil {
+			return nil, errors.Wrapf(err, "NewDbManager: ")
+		}
+	}
+	chainDb, err := OpenBadgerDb(chainDir, config.DbOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewDbManager: Problem opening chain db: ")
+	}
+	chainLifecycle := NewCoreDBLifecycle(chainDb)
+	if err := chainLifecycle.Start(); err != nil {
+		chainDb.Close()
+		return nil, errors.Wrapf(err, "NewDbManager: ")
+	}
+
+	return &DbManager{
+		config:  config,
+		chain:   chainLifecycle,
+		gcStats: make(map[string]*DbValueLogGCStats),
+	}, nil
+}
+
+func (dbm *DbManager) ChainDB() *badger.DB {
+	return dbm.chain.DB()
+}
+
+func (dbm *DbManager) ChainLifecycle() *CoreDBLifecycle {
+	return dbm.chain
+}
+
+// TxindexDir returns the directory the txindex db is in, whether or not it's open.
+func (dbm *DbManager) TxindexDir() string {
+	if dbm.config.TxindexDir != "" {
+		return dbm.config.TxindexDir
+	}
+	return filepath.Join(GetBadgerDbPath(dbm.config.DataDir), "txindex")
+}
+
+// OpenTxindexDb opens the txindex db, or returns it if it's already open.
+func (dbm *DbManager) OpenTxindexDb() (*CoreDBLifecycle, error) {
+	dbm.mtx.Lock()
+	defer dbm.mtx.Unlock()
+
+	if dbm.txindex != nil {
+		return dbm.txindex, nil
+	}
+	// The txindex has always kept its value log in a subdirectory of its dir.
+	txindexDir := dbm.TxindexDir()
+	txindexValueDir := GetBadgerDbPath(txindexDir)
+	glog.Infof("DbManager: TxIndex BadgerDB Dir: %v", txindexDir)
+	glog.Infof("DbManager: TxIndex BadgerDB ValueDir: %v", txindexValueDir)
+	txindexDb, err := _openBadgerDb(txindexDir, txindexValueDir, dbm.config.DbOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbManager.OpenTxindexDb: ")
+	}
+	txindexLifecycle := NewCoreDBLifecycle(txindexDb)
+	if err := txindexLifecycle.Start(); err != nil {
+		txindexDb.Close()
+		return nil, errors.Wrapf(err, "DbManager.OpenTxindexDb: ")
+	}
+	dbm.txindex = txindexLifecycle
+	if dbm.gcConfig != nil {
+		if err := dbm._startValueLogGC("txindex", txindexLifecycle, dbm.gcConfig); err != nil {
+			return nil, errors.Wrapf(err, "DbManager.OpenTxindexDb: ")
+		}
+	}
+	return dbm.txindex, nil
+}
+
+// TxindexDB returns the txindex db, or nil if it hasn't been opened.
+func (dbm *DbManager) TxindexDB() *badger.DB {
+	dbm.mtx.Lock()
+	defer dbm.mtx.Unlock()
+
+	if dbm.txindex == nil {
+		return nil
+	}
+	return dbm.txindex.DB()
+}
+
+func (dbm *DbManager) MempoolDir() string {
+	return dbm.config.MempoolDir
+}
+
+// ForEachDb calls fn with the name and lifecycle of every open db, e.g. to start
+// the same background task on each of them.
+func (dbm *DbManager) ForEachDb(fn func(name string, lifecycle *CoreDBLifecycle) error) error {
+	if err := fn("chain", dbm.chain); err != nil {
+		return err
+	}
+	dbm.mtx.Lock()
+	txindex := dbm.txindex
+	dbm.mtx.Unlock()
+	if txindex != nil {
+		if err := fn("txindex", txindex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops and closes the txindex db and then the chain db. The Server and
+// the TXIndex should be stopped first so nothing is writing to them.
+func (dbm *DbManager) Close() error {
+	dbm.mtx.Lock()
+	txindex := dbm.txindex
+	dbm.mtx.Unlock()
+
+	var firstErr error
+	if txindex != nil {
+		if err := txindex.Stop(); err != nil {
+			firstErr = errors.Wrapf(err, "DbManager.Close: Problem closing txindex db: ")
+		}
+	}
+	if err := dbm.chain.Stop(); err != nil && firstErr == nil {
+		firstErr = errors.Wrapf(err, "DbManager.Close: Problem closing chain db: ")
+	}
+	return firstErr
+}
+
+// =====================================================================================
+// Value log GC
+// =====================================================================================
+
+// Badger never reclaims the space taken by deleted or overwritten values on its
+// own. Values bigger than a few bytes live in the value log and a value log file
+// is only rewritten when RunValueLogGC is called and enough of the file is stale.
+
+type DbValueLogGCConfig struct {
+	// How often each db is GC'd.
+	Interval time.Duration
+	// A value log file is rewritten when at least this fraction of it is stale.
+	// Lower ratios reclaim more space but rewrite more data. Badger recommends 0.5.
+	DiscardRatio float64
+	// If set, the reclaimed space is reported as a gauge per db.
+	StatsdClient *statsd.Client
+}
+
+// DbValueLogGCStats is how much the value log GC has done on one db since the
+// node started.
+type DbValueLogGCStats struct {
+	Name string
+	// The number of times GC ran and the number of value log files it rewrote.
+	NumRuns     uint64
+	NumRewrites uint64
+	// The drop in the size of the value log across all runs. It can be negative
+	// when a lot was written while GC ran.
+	ReclaimedBytes int64
+	LastRun        time.Time
+	LastErr        error
+}
+
+// RunValueLogGC rewrites value log files until none of them has discardRatio
+// stale data, and returns how many it rewrote and the drop in the size of the
+// value log.
+func RunValueLogGC(handle *badger.DB, discardRatio float64) (
+	_numRewrites uint64, _reclaimedBytes int64, _err error) {
+
+	_, vlogSizeBefore := handle.Size()
+	numRewrites := uint64(0)
+	for {
+		err := handle.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite {
+			break
+		}
+		if err != nil {
+			return numRewrites, 0, errors.Wrapf(err, "RunValueLogGC: Problem after %d rewrites: ", numRewrites)
+		}
+		numRewrites++
+	}
+	_, vlogSizeAfter := handle.Size()
+	return numRewrites, vlogSizeBefore - vlogSizeAfter, nil
+}
+
+// StartValueLogGC GCs the value log of every db the manager has open, and of the
+// txindex db when it's opened, every config.Interval until the dbs are closed.
+func (dbm *DbManager) StartValueLogGC(config *DbValueLogGCConfig) error {
+	if config.Interval <= 0 {
+		return fmt.Errorf("DbManager.StartValueLogGC: Interval must be positive")
+	}
+	if config.DiscardRatio <= 0 || config.DiscardRatio >= 1 {
+		return fmt.Errorf("DbManager.StartValueLogGC: DiscardRatio %v must be "+
+			"between 0 and 1", config.DiscardRatio)
+	}
+
+	dbm.mtx.Lock()
+	if dbm.gcConfig != nil {
+		dbm.mtx.Unlock()
+		return fmt.Errorf("DbManager.StartValueLogGC: Already started")
+	}
+	dbm.gcConfig = config
+	dbm.mtx.Unlock()
+
+	return dbm.ForEachDb(func(name string, lifecycle *CoreDBLifecycle) error {
+		dbm.mtx.Lock()
+		defer dbm.mtx.Unlock()
+		return dbm._startValueLogGC(name, lifecycle, config)
+	})
+}
+
+// _startValueLogGC must be called with mtx held. Starting it twice on the same
+// db is a no-op.
+func (dbm *DbManager) _startValueLogGC(name string, lifecycle *CoreDBLifecycle,
+	config *DbValueLogGCConfig) error {
+
+	if _, exists := dbm.gcStats[name]; exists {
+		return nil
+	}
+	dbm.gcStats[name] = &DbValueLogGCStats{Name: name}
+
+	// The first run waits an interval so GC doesn't compete with startup.
+	startTime := time.Now()
+	return lifecycle.GoPeriodic("value-log-gc-"+name, config.Interval, func() {
+		if time.Since(startTime) < config.Interval {
+			return
+		}
+		numRewrites, reclaimedBytes, err := RunValueLogGC(lifecycle.DB(), config.DiscardRatio)
+		if err != nil {
+			glog.Errorf("DbManager: Problem running value log GC on %v db: %v", name, err)
+		} else {
+			glog.V(1).Infof("DbManager: Value log GC on %v db rewrote %d files and "+
+				"reclaimed %d bytes", name, numRewrites, reclaimedBytes)
+		}
+
+		dbm.mtx.Lock()
+		gcStats := dbm.gcStats[name]
+		gcStats.NumRuns++
+		gcStats.NumRewrites += numRewrites
+		gcStats.ReclaimedBytes += reclaimedBytes
+		gcStats.LastRun = time.Now()
+		gcStats.LastErr = err
+		totalReclaimedBytes := gcStats.ReclaimedBytes
+		dbm.mtx.Unlock()
+
+		if config.StatsdClient != nil {
+			tags := []string{}
+			config.StatsdClient.Gauge(fmt.Sprintf("DB.VALUE_LOG_GC.%s.RECLAIMED_BYTES", name),
+				float64(totalReclaimedBytes), tags, 1)
+			config.StatsdClient.Count(fmt.Sprintf("DB.VALUE_LOG_GC.%s.REWRITES", name),
+				int64(numRewrites), tags, 1)
+		}
+	})
+}
+
+// GetValueLogGCStats returns the GC stats for each db, ordered by name.
+func (dbm *DbManager) GetValueLogGCStats() []*DbValueLogGCStats {
+	dbm.mtx.Lock()
+	defer dbm.mtx.Unlock()
+
+	stats := []*DbValueLogGCStats{}
+	for _, gcStats := range dbm.gcStats {
+		gcStatsCopy := *gcStats
+		stats = append(stats, &gcStatsCopy)
+	}
+	sort.Slice(stats, func(ii, jj int) bool {
+		return stats[ii].Name < stats[jj].Name
+	})
+	return stats
+}
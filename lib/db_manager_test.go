@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbManager(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	dataDir, err := ioutil.TempDir("", "dbmanager")
+	require.NoError(err)
+	defer os.RemoveAll(dataDir)
+	txindexDir, err := ioutil.TempDir("", "dbmanager-txindex")
+	require.NoError(err)
+	defer os.RemoveAll(txindexDir)
+
+	dbManager, err := NewDbManager(&DbManagerConfig{
+		DataDir:    dataDir,
+		TxindexDir: txindexDir,
+	})
+	require.NoError(err)
+	assert.Nil(dbManager.TxindexDB())
+	assert.Equal(txindexDir, dbManager.TxindexDir())
+
+	// The txindex db is only opened once and lives in its own dir.
+	txindexLifecycle, err := dbManager.OpenTxindexDb()
+	require.NoError(err)
+	txindexLifecycle2, err := dbManager.OpenTxindexDb()
+	require.NoError(err)
+	assert.Equal(txindexLifecycle, txindexLifecycle2)
+	assert.Equal(txindexLifecycle.DB(), dbManager.TxindexDB())
+	assert.NotEqual(dbManager.ChainDB(), dbManager.TxindexDB())
+	require.NoError(txindexLifecycle.Update(func(txn KVTxn) error {
+		return txn.Set([]byte{1}, []byte{2})
+	}))
+	_, err = os.Stat(filepath.Join(txindexDir, "MANIFEST"))
+	assert.NoError(err)
+
+	// GC runs on every db once an interval has passed.
+	assert.Error(dbManager.StartValueLogGC(&DbValueLogGCConfig{
+		Interval:     10 * time.Millisecond,
+		DiscardRatio: 1,
+	}))
+	require.NoError(dbManager.StartValueLogGC(&DbValueLogGCConfig{
+		Interval:     10 * time.Millisecond,
+		DiscardRatio: 0.5,
+	}))
+	assert.Error(dbManager.StartValueLogGC(&DbValueLogGCConfig{
+		Interval:     10 * time.Millisecond,
+		DiscardRatio: 0.5,
+	}))
+	require.Eventually(func() bool {
+		gcStats := dbManager.GetValueLogGCStats()
+		return len(gcStats) == 2 && gcStats[0].NumRuns > 0 && gcStats[1].NumRuns > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	gcStats := dbManager.GetValueLogGCStats()
+	assert.Equal("chain", gcStats[0].Name)
+	assert.Equal("txindex", gcStats[1].Name)
+	assert.NoError(gcStats[0].LastErr)
+
+	dbNames := []string{}
+	require.NoError(dbManager.ForEachDb(func(name string, lifecycle *CoreDBLifecycle) error {
+		dbNames = append(dbNames, name)
+		return nil
+	}))
+	assert.Equal([]string{"chain", "txindex"}, dbNames)
+
+	// Close stops both lifecycles so they can't start tasks anymore.
+	require.NoError(dbManager.Close())
+	assert.Error(dbManager.ChainLifecycle().GoPeriodic("test", 0, func() {}))
+	assert.Error(txindexLifecycle.GoPeriodic("test", 0, func() {}))
+}
+
+func TestDbOptions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	for _, profile := range []string{
+		DbOptionsProfileDefault, DbOptionsProfileLowMemory, DbOptionsProfileHighThroughput} {
+
+		dbOptions, err := GetDbOptionsProfile(profile)
+		require.NoError(err)
+		assert.NoError(dbOptions.Validate(), profile)
+		assert.NoError(dbOptions.ValidateForBlockSize(BitCloutMainnetParams.MaxBlockSizeBytes), profile)
+	}
+	_, err := GetDbOptionsProfile("tiny")
+	assert.Error(err)
+
+	// Changing a profile's options doesn't change the profile.
+	dbOptions, err := GetDbOptionsProfile(DbOptionsProfileLowMemory)
+	require.NoError(err)
+	dbOptions.MemTableSize = 1
+	dbOptions, err = GetDbOptionsProfile(DbOptionsProfileLowMemory)
+	require.NoError(err)
+	assert.Equal(int64(512<<20), dbOptions.MemTableSize)
+
+	// Zero fields keep badger's defaults.
+	badgerOpts := dbOptions.BadgerOptions("dir", "valuedir")
+	assert.Equal(int64(512<<20), badgerOpts.MemTableSize)
+	assert.Equal(2, badgerOpts.NumCompactors)
+	assert.Equal("valuedir", badgerOpts.ValueDir)
+	assert.Equal(badger.DefaultOptions("").NumLevelZeroTables, badgerOpts.NumLevelZeroTables)
+
+	assert.Error((&DbOptions{NumCompactors: 1}).Validate())
+	assert.Error((&DbOptions{Compression: "lz4"}).Validate())
+	assert.Error((&DbOptions{NumLevelZeroTables: 10, NumLevelZeroTablesStall: 5}).Validate())
+
+	// A db opens with a profile's options.
+	dir, err := ioutil.TempDir("", "dboptions")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	dbOptions.Compression = DbCompressionSnappy
+	db, err := OpenBadgerDb(dir, dbOptions)
+	require.NoError(err)
+	assert.Equal(int64(512<<20), db.Opts().MemTableSize)
+	require.NoError(db.Close())
+	_, err = OpenBadgerDb(dir, &DbOptions{NumCompactors: 1})
+	assert.Error(err)
+
+	// A memtable too small to connect the biggest block is rejected, and so is
+	// badger's default for mainnet.
+	assert.Error((&DbOptions{MemTableSize: 128 << 20}).ValidateForBlockSize(
+		BitCloutMainnetParams.MaxBlockSizeBytes))
+	assert.Error((&DbOptions{}).ValidateForBlockSize(BitCloutMainnetParams.MaxBlockSizeBytes))
+	assert.NoError((&DbOptions{}).ValidateForBlockSize(BitCloutTestnetParams.MaxBlockSizeBytes))
+	_, err = NewDbManager(&DbManagerConfig{
+		DataDir:   dir,
+		DbOptions: &DbOptions{MemTableSize: 128 << 20},
+		Params:    &BitCloutMainnetParams,
+	})
+	assert.Error(err)
+}
+
+func TestDbMinMemTableSize(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// A txn with as much as connecting a block of maxBlockSizeBytes can write
+	// fits in a memtable of the minimum size but not in one half as big.
+	maxBlockSizeBytes := uint64(64 << 10)
+	writeConnectSizedTxn := func(memTableSize int64) error {
+		dir, err := ioutil.TempDir("", "dbminmemtable")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		db, err := OpenBadgerDb(dir, &DbOptions{MemTableSize: memTableSize})
+		require.NoError(err)
+		defer db.Close()
+
+		// Badger counts each entry as its key and value plus 12 bytes.
+		val := bytes.Repeat([]byte{1}, 200)
+		entrySize := 8 + len(val) + 12
+		return DbUpdate(db, func(txn KVTxn) error {
+			for ii := 0; ii < int(maxBlockSizeBytes)*DbBlockConnectWriteFanOut/entrySize; ii++ {
+				if err := txn.Set(EncodeUint64(uint64(ii)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	minMemTableSize := DbMinMemTableSize(maxBlockSizeBytes)
+	assert.NoError(writeConnectSizedTxn(minMemTableSize))
+	assert.Equal(badger.ErrTxnTooBig, writeConnectSizedTxn(minMemTableSize/2))
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+)
+
+// DbOptions are the badger options operators can tune. A zero field keeps
+// badger's default for it. Start from a profile and override what's needed.
+//
+// Badger rejects a txn bigger than about 15% of MemTableSize, and connecting a
+// block writes all of its entries in one txn, so MemTableSize can't go below
+// DbMinMemTableSize for the chain's MaxBlockSizeBytes. ValidateForBlockSize
+// checks it.
+type DbOptions struct {
+	// The size of each memtable and how many can be in memory at once. Writes
+	// stall while all of them are full and waiting to be flushed.
+	MemTableSize int64
+	NumMemtables int
+	// The number of goroutines compacting the LSM tree. Badger needs at least 2.
+	NumCompactors int
+	// The number of level 0 tables before they're compacted, and before writes
+	// stall until they are.
+	NumLevelZeroTables      int
+	NumLevelZeroTablesStall int
+	// The sizes of the caches of decompressed blocks and of table indexes.
+	BlockCacheSize int64
+	IndexCacheSize int64
+	// The size of each value log file. Value log GC rewrites a file at a time so
+	// smaller files reclaim space sooner.
+	ValueLogFileSize int64
+	// One of DbCompressionNone, DbCompressionSnappy, or DbCompressionZSTD.
+	Compression string
+}
+
+// DbBlockConnectWriteFanOut is about the most the txn that connects a block can
+// hold for every byte in the block, counting badger's overhead for each entry. A
+// block's txns end up in its utxo operations, the view's entries and the
+// indexes on them, the notifications, and the spend entries.
+const DbBlockConnectWriteFanOut = 4
+
+// Badger limits a txn to this percent of MemTableSize.
+const badgerMaxTxnPercentOfMemTable = 15
+
+// DbMinMemTableSize returns the smallest MemTableSize whose txns can hold a block
+// of maxBlockSizeBytes, rounded up to a MB.
+func DbMinMemTableSize(maxBlockSizeBytes uint64) int64 {
+	minSize := int64(maxBlockSizeBytes) * DbBlockConnectWriteFanOut * 100 /
+		badgerMaxTxnPercentOfMemTable
+	return (minSize>>20 + 1) << 20
+}
+
+const (
+	DbCompressionNone   = "none"
+	DbCompressionSnappy = "snappy"
+	DbCompressionZSTD   = "zstd"
+)
+
+const (
+	// What the node has always used.
+	DbOptionsProfileDefault = "default"
+	// Small caches and only two memtables, each just big enough to connect a
+	// mainnet block, for machines with a few GB of memory. Writes stall more
+	// often under load.
+	DbOptionsProfileLowMemory = "low-memory"
+	// More and bigger memtables, more compactors, and bigger caches for machines
+	// with plenty of memory and cores, e.g. nodes serving a lot of API traffic.
+	DbOptionsProfileHighThroughput = "high-throughput"
+)
+
+// DefaultDbOptions returns the options of the default profile.
+func DefaultDbOptions() *DbOptions {
+	return &DbOptions{
+		MemTableSize: 1024 << 20,
+	}
+}
+
+// GetDbOptionsProfile returns a copy of the options for a profile, which can be
+// changed without affecting the profile.
+func GetDbOptionsProfile(profile string) (*DbOptions, error) {
+	switch profile {
+	case "", DbOptionsProfileDefault:
+		return DefaultDbOptions(), nil
+	case DbOptionsProfileLowMemory:
+		return &DbOptions{
+			MemTableSize:     512 << 20,
+			NumMemtables:     2,
+			NumCompactors:    2,
+			BlockCacheSize:   32 << 20,
+			IndexCacheSize:   16 << 20,
+			ValueLogFileSize: 256 << 20,
+		}, nil
+	case DbOptionsProfileHighThroughput:
+		return &DbOptions{
+			MemTableSize:            1024 << 20,
+			NumMemtables:            8,
+			NumCompactors:           8,
+			NumLevelZeroTables:      10,
+			NumLevelZeroTablesStall: 30,
+			BlockCacheSize:          2048 << 20,
+			IndexCacheSize:          512 << 20,
+		}, nil
+	}
+	return nil, fmt.Errorf("GetDbOptionsProfile: Unknown profile %v; must be %v, %v, or %v",
+		profile, DbOptionsProfileDefault, DbOptionsProfileLowMemory, DbOptionsProfileHighThroughput)
+}
+
+// Validate catches the options badger would reject or misbehave with.
+func (dbo *DbOptions) Validate() error {
+	if dbo.MemTableSize < 0 || dbo.NumMemtables < 0 || dbo.NumLevelZeroTables < 0 ||
+		dbo.NumLevelZeroTablesStall < 0 || dbo.BlockCacheSize < 0 ||
+		dbo.IndexCacheSize < 0 || dbo.ValueLogFileSize < 0 {
+
+		return fmt.Errorf("DbOptions.Validate: Sizes and counts can't be negative: %+v", dbo)
+	}
+	if dbo.NumCompactors < 0 || dbo.NumCompactors == 1 {
+		return fmt.Errorf("DbOptions.Validate: NumCompactors %d must be at least 2",
+			dbo.NumCompactors)
+	}
+	if dbo.NumLevelZeroTables != 0 && dbo.NumLevelZeroTablesStall != 0 &&
+		dbo.NumLevelZeroTablesStall <= dbo.NumLevelZeroTables {
+
+		return fmt.Errorf("DbOptions.Validate: NumLevelZeroTablesStall %d must be more "+
+			"than NumLevelZeroTables %d", dbo.NumLevelZeroTablesStall, dbo.NumLevelZeroTables)
+	}
+	switch dbo.Compression {
+	case "", DbCompressionNone, DbCompressionSnappy, DbCompressionZSTD:
+	default:
+		return fmt.Errorf("DbOptions.Validate: Unknown compression %v; must be %v, %v, or %v",
+			dbo.Compression, DbCompressionNone, DbCompressionSnappy, DbCompressionZSTD)
+	}
+	return nil
+}
+
+// ValidateForBlockSize is like Validate but also checks that connecting a block of
+// maxBlockSizeBytes won't be too big for a single txn. A zero MemTableSize is
+// checked as badger's default.
+func (dbo *DbOptions) ValidateForBlockSize(maxBlockSizeBytes uint64) error {
+	if err := dbo.Validate(); err != nil {
+		return err
+	}
+	memTableSize := dbo.MemTableSize
+	if memTableSize == 0 {
+		memTableSize = badger.DefaultOptions("").MemTableSize
+	}
+	if minSize := DbMinMemTableSize(maxBlockSizeBytes); memTableSize < minSize {
+		return fmt.Errorf("DbOptions.ValidateForBlockSize: MemTableSize %d MB is too "+
+			"small to connect a block of %d bytes in one txn; it must be at least %d MB",
+			memTableSize>>20, maxBlockSizeBytes, minSize>>20)
+	}
+	return nil
+}
+
+// BadgerOptions returns the badger options for a db in dir with its value log in
+// valueDir. The options should be validated first.
+func (dbo *DbOptions) BadgerOptions(dir string, valueDir string) badger.Options {
+	opts := badger.DefaultOptions(dir)
+	opts.ValueDir = valueDir
+	if dbo.MemTableSize != 0 {
+		opts.MemTableSize = dbo.MemTableSize
+	}
+	if dbo.NumMemtables != 0 {
+		opts.NumMemtables = dbo.NumMemtables
+	}
+	if dbo.NumCompactors != 0 {
+		opts.NumCompactors = dbo.NumCompactors
+	}
+	if dbo.NumLevelZeroTables != 0 {
+		opts.NumLevelZeroTables = dbo.NumLevelZeroTables
+	}
+	if dbo.NumLevelZeroTablesStall != 0 {
+		opts.NumLevelZeroTablesStall = dbo.NumLevelZeroTablesStall
+	}
+	if dbo.BlockCacheSize != 0 {
+		opts.BlockCacheSize = dbo.BlockCacheSize
+	}
+	if dbo.IndexCacheSize != 0 {
+		opts.IndexCacheSize = dbo.IndexCacheSize
+	}
+	if dbo.ValueLogFileSize != 0 {
+		opts.ValueLogFileSize = dbo.ValueLogFileSize
+	}
+	switch dbo.Compression {
+	case DbCompressionNone:
+		opts.Compression = options.None
+	case DbCompressionSnappy:
+		opts.Compression = options.Snappy
+	case DbCompressionZSTD:
+		opts.Compression = options.ZSTD
+	}
+	return opts
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+// Pruning lets a node that doesn't need to serve history drop the bodies and
+// utxo operations of blocks that are far enough behind the tip. Headers, the
+// block index, and all of the state derived from the pruned blocks are kept,
+// so the node can keep validating new blocks as usual. What it can no longer
+// do is serve the pruned blocks to peers or disconnect them in a reorg, which
+// is why CheckRetentionKeepBlocks puts a floor on how much history is kept.
+//
+// Pruning is a blocks policy on the "blocks" retention index, so it's applied
+// by the retention sweeper like any other policy. Indexes with an entry per
+// block are swept with _dbSweepBlockIndex below. Everything below the height
+// stored at the index's SweptHeightKey, which for pruning is _KeyPruneHeight,
+// has been swept. That height is written before any block is swept so a node
+// that dies mid-prune never advertises blocks it may no longer have.
+
+// dbSweepBlocksPerBatch is the max number of blocks swept in a single txn.
+const dbSweepBlocksPerBatch = 100
+
+// _dbGetSweptHeightWithTxn returns the height stored under an index's
+// SweptHeightKey, or zero if nothing has been swept.
+func _dbGetSweptHeightWithTxn(txn KVTxn, sweptHeightKey []byte) uint64 {
+	sweptHeightBytes, err := txn.Get(sweptHeightKey)
+	if err != nil {
+		return 0
+	}
+	if len(sweptHeightBytes) != 8 {
+		return 0
+	}
+	return DecodeUint64(sweptHeightBytes)
+}
+
+// DbGetPruneHeightWithTxn returns the height below which block bodies and utxo
+// operations have been pruned. Zero means nothing has been pruned.
+func DbGetPruneHeightWithTxn(txn KVTxn) uint64 {
+	return _dbGetSweptHeightWithTxn(txn, _KeyPruneHeight)
+}
+
+func DbGetPruneHeight(handle *badger.DB) uint64 {
+	var pruneHeight uint64
+	DbView(handle, func(txn KVTxn) error {
+		pruneHeight = DbGetPruneHeightWithTxn(txn)
+		return nil
+	})
+	return pruneHeight
+}
+
+func DbPutPruneHeightWithTxn(txn KVTxn, pruneHeight uint64) error {
+	return txn.Set(_KeyPruneHeight, EncodeUint64(pruneHeight))
+}
+
+// _dbGetBlockHashesInHeightRange returns the hashes of the block nodes with a
+// height in [startHeight, endHeight), lowest height first, along with the height
+// of the last node returned. It stops at the first height boundary after
+// maxHashes hashes so a batch never ends partway through a height.
+func _dbGetBlockHashesInHeightRange(handle *badger.DB, startHeight uint32,
+	endHeight uint32, maxHashes int) (_hashes []*BlockHash, _lastHeight uint32, _err error) {
+
+	prefix := _heightHashToNodeIndexPrefix(false /*bitcoinNodes*/)
+	startKey := append(append([]byte{}, prefix...), _EncodeUint32(startHeight)...)
+
+	hashes := []*BlockHash{}
+	lastHeight := startHeight
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		opts.KeysOnly = true
+		nodeIterator := txn.NewIterator(opts)
+		defer nodeIterator.Close()
+
+		for nodeIterator.Seek(startKey); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+			key := nodeIterator.Key()
+			if len(key) != len(prefix)+4+HashSizeBytes {
+				return fmt.Errorf("Found node index key with invalid length %d", len(key))
+			}
+			height := binary.BigEndian.Uint32(key[len(prefix) : len(prefix)+4])
+			if height >= endHeight || (len(hashes) >= maxHashes && height != lastHeight) {
+				return nil
+			}
+			hash := &BlockHash{}
+			copy(hash[:], key[len(prefix)+4:])
+			hashes = append(hashes, hash)
+			lastHeight = height
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "_dbGetBlockHashesInHeightRange: ")
+	}
+	return hashes, lastHeight, nil
+}
+
+// _dbSweepBlockIndex deletes the index's entries for every block more than
+// keepBlocks behind the tip, including blocks that aren't on the main chain, and
+// returns the number of blocks swept. The genesis block is never swept.
+func _dbSweepBlockIndex(handle *badger.DB, retentionIndex *DbRetentionIndex,
+	keepBlocks uint64, tipHeight uint64) (_numSwept uint64, _err error) {
+
+	if tipHeight < keepBlocks {
+		return 0, nil
+	}
+	newSweptHeight := tipHeight - keepBlocks + 1
+
+	var oldSweptHeight uint64
+	DbView(handle, func(txn KVTxn) error {
+		oldSweptHeight = _dbGetSweptHeightWithTxn(txn, retentionIndex.SweptHeightKey)
+		return nil
+	})
+	if oldSweptHeight >= newSweptHeight {
+		return 0, nil
+	}
+	if err := DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(retentionIndex.SweptHeightKey, EncodeUint64(newSweptHeight))
+	}); err != nil {
+		return 0, errors.Wrapf(err, "_dbSweepBlockIndex: Problem putting swept "+
+			"height for index %s", retentionIndex.Name)
+	}
+
+	startHeight := uint32(oldSweptHeight)
+	if startHeight == 0 {
+		startHeight = 1
+	}
+	numSwept := uint64(0)
+	for {
+		hashes, lastHeight, err := _dbGetBlockHashesInHeightRange(
+			handle, startHeight, uint32(newSweptHeight), dbSweepBlocksPerBatch)
+		if err != nil {
+			return numSwept, errors.Wrapf(err, "_dbSweepBlockIndex: ")
+		}
+		if len(hashes) == 0 {
+			return numSwept, nil
+		}
+
+		err = DbUpdate(handle, func(txn KVTxn) error {
+			for _, hash := range hashes {
+				if err := retentionIndex.DeleteForBlockWithTxn(txn, hash); err != nil {
+					return errors.Wrapf(err, "Problem deleting entries for block %v", hash)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return numSwept, errors.Wrapf(err, "_dbSweepBlockIndex: Problem sweeping "+
+				"index %s", retentionIndex.Name)
+		}
+		numSwept += uint64(len(hashes))
+
+		if len(hashes) < dbSweepBlocksPerBatch {
+			return numSwept, nil
+		}
+		startHeight = lastHeight + 1
+	}
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbPruneBlocks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// A block at each of heights 0 through 3 plus a competing block at height 2,
+	// each with its node and its utxo ops.
+	putBlock := func(height uint64, nonce uint64) *BlockHash {
+		header := *expectedBlockHeader
+		header.Height = height
+		header.Nonce = nonce
+		block := &MsgBitCloutBlock{
+			Header: &header,
+			Txns:   []*MsgBitCloutTxn{{TxnMeta: &BasicTransferMetadata{}}},
+		}
+		hash, err := header.Hash()
+		require.NoError(err)
+		node := NewBlockNode(nil, hash, uint32(height), &BlockHash{},
+			big.NewInt(0), &header, StatusBlockStored)
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			if err := PutBlockWithTxn(txn, block); err != nil {
+				return err
+			}
+			if err := PutHeightHashToNodeInfoWithTxn(txn, node, false /*bitcoinNodes*/); err != nil {
+				return err
+			}
+			return PutUtxoOperationsForBlockWithTxn(txn, hash, [][]*UtxoOperation{{}})
+		}))
+		return hash
+	}
+	hashes := []*BlockHash{}
+	for height := uint64(0); height <= 3; height++ {
+		hashes = append(hashes, putBlock(height, 0))
+	}
+	forkHash := putBlock(2, 1)
+
+	isPruned := func(hash *BlockHash) bool {
+		_, blockErr := GetBlock(hash, db)
+		_, utxoOpsErr := GetUtxoOperationsForBlock(db, hash)
+		require.Equal(blockErr != nil, utxoOpsErr != nil)
+		return blockErr != nil
+	}
+
+	// Pruning keeps at least the finality depth.
+	_, err := ParseDbRetentionPolicies([]string{fmt.Sprintf(
+		"blocks=blocks:%d", BitCloutTestnetParams.FinalityDepthBlocks-1)}, &BitCloutTestnetParams)
+	require.Error(err)
+
+	keepBlocks := BitCloutTestnetParams.FinalityDepthBlocks
+	prune := func(tipHeight uint64) uint64 {
+		policies, err := ParseDbRetentionPolicies([]string{fmt.Sprintf(
+			"blocks=blocks:%d", keepBlocks)}, &BitCloutTestnetParams)
+		require.NoError(err)
+		numSweptForIndex, err := DbRetentionSweep(db, policies, tipHeight, time.Now())
+		require.NoError(err)
+		return numSweptForIndex["blocks"]
+	}
+
+	// Nothing is pruned while the chain is shorter than the blocks to keep.
+	assert.Equal(uint64(0), prune(3))
+	assert.Equal(uint64(0), DbGetPruneHeight(db))
+
+	// Pruning everything below height 3 keeps the genesis block.
+	assert.Equal(uint64(3), prune(keepBlocks+2))
+	assert.Equal(uint64(3), DbGetPruneHeight(db))
+	assert.False(isPruned(hashes[0]))
+	assert.True(isPruned(hashes[1]))
+	assert.True(isPruned(hashes[2]))
+	assert.True(isPruned(forkHash))
+	assert.False(isPruned(hashes[3]))
+
+	// The nodes are kept.
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		for height, hash := range hashes {
+			assert.NotNil(GetHeightHashToNodeInfoWithTxn(txn, uint32(height), hash, false /*bitcoinNodes*/))
+		}
+		return nil
+	}))
+
+	// Pruning again at the same tip is a no-op.
+	assert.Equal(uint64(0), prune(keepBlocks+2))
+
+	// The next prune picks up where the last one stopped.
+	assert.Equal(uint64(1), prune(keepBlocks+3))
+	assert.Equal(uint64(4), DbGetPruneHeight(db))
+	assert.True(isPruned(hashes[3]))
+	assert.False(isPruned(hashes[0]))
+}
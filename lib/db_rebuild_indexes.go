@@ -0,0 +1,285 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// The derived indexes are the ones that can be regenerated entirely from the
+// primary entries they index, e.g. the tstamp->post index from the post entries.
+// If one of them drifts from its entries, say because a bug wrote a bad key or a
+// write was lost, RebuildIndexes drops it and writes it again from scratch.
+
+type DbIndexName string
+
+const (
+	// <poster public key, tstamp, post hash> and <tstamp, post hash> for each
+	// post that isn't a comment.
+	DbIndexPostTstamp DbIndexName = "post-tstamp"
+	// <creator bps, post hash> for each post that isn't a comment.
+	DbIndexPostCreatorBps DbIndexName = "post-creator-bps"
+	// <stake multiple bps, post hash> for each post that isn't a comment.
+	DbIndexPostStakeMultipleBps DbIndexName = "post-stake-multiple-bps"
+	// <username> -> <PKID> and <normalized username, PKID> for each profile.
+	DbIndexUsernamePKID DbIndexName = "username-pkid"
+	// <bitclout locked nanos, PKID> for each profile.
+	DbIndexCoinLockedPKID DbIndexName = "coin-locked-pkid"
+	// The like, comment, and reclout counts of each post.
+	DbIndexPostEngagementCounts DbIndexName = "post-engagement-counts"
+	// The diamond totals of each post and of each sender and receiver.
+	DbIndexDiamondTotals DbIndexName = "diamond-totals"
+)
+
+// AllDbIndexNames is every index RebuildIndexes can rebuild, in the order it
+// rebuilds them.
+var AllDbIndexNames = []DbIndexName{
+	DbIndexPostTstamp,
+	DbIndexPostCreatorBps,
+	DbIndexPostStakeMultipleBps,
+	DbIndexUsernamePKID,
+	DbIndexCoinLockedPKID,
+	DbIndexPostEngagementCounts,
+	DbIndexDiamondTotals,
+}
+
+type dbRebuildableIndex struct {
+	// The prefixes that hold the index. They're dropped before it's rebuilt.
+	prefixes [][]byte
+	// rebuild writes the index and returns the number of keys it wrote.
+	rebuild func(handle *badger.DB) (int, error)
+}
+
+var dbRebuildableIndexes = map[DbIndexName]*dbRebuildableIndex{
+	DbIndexPostTstamp: {
+		prefixes: [][]byte{
+			_PrefixPosterPublicKeyTimestampPostHash,
+			_PrefixTstampNanosPostHash,
+			_dbKeyForQuarantinedTimestampIndexEntry(_PrefixPosterPublicKeyTimestampPostHash),
+			_dbKeyForQuarantinedTimestampIndexEntry(_PrefixTstampNanosPostHash),
+		},
+		rebuild: func(handle *badger.DB) (int, error) {
+			maxIndexedTstampNanos := DbGetMaxIndexedTstampNanosForTip(handle)
+			return _dbRebuildPostIndex(handle, func(txn KVTxn, postEntry *PostEntry) (int, error) {
+				if err := _dbSetTimestampIndexEntryWithTxn(txn, _dbKeyForPosterPublicKeyTimestampPostHash(
+					postEntry.PosterPublicKey, postEntry.TimestampNanos, postEntry.PostHash), []byte{},
+					postEntry.TimestampNanos, maxIndexedTstampNanos); err != nil {
+
+					return 0, err
+				}
+				if err := _dbSetTimestampIndexEntryWithTxn(txn, _dbKeyForTstampPostHash(
+					postEntry.TimestampNanos, postEntry.PostHash), []byte{}, postEntry.TimestampNanos,
+					maxIndexedTstampNanos); err != nil {
+
+					return 0, err
+				}
+				return 2, nil
+			})
+		},
+	},
+	DbIndexPostCreatorBps: {
+		prefixes: [][]byte{_PrefixCreatorBpsPostHash},
+		rebuild: func(handle *badger.DB) (int, error) {
+			return _dbRebuildPostIndex(handle, func(txn KVTxn, postEntry *PostEntry) (int, error) {
+				return 1, txn.Set(_dbKeyForCreatorBpsPostHash(
+					postEntry.CreatorBasisPoints, postEntry.PostHash), []byte{})
+			})
+		},
+	},
+	DbIndexPostStakeMultipleBps: {
+		prefixes: [][]byte{_PrefixMultipleBpsPostHash},
+		rebuild: func(handle *badger.DB) (int, error) {
+			return _dbRebuildPostIndex(handle, func(txn KVTxn, postEntry *PostEntry) (int, error) {
+				return 1, txn.Set(_dbKeyForStakeMultipleBpsPostHash(
+					postEntry.StakeMultipleBasisPoints, postEntry.PostHash), []byte{})
+			})
+		},
+	},
+	DbIndexUsernamePKID: {
+		prefixes: [][]byte{_PrefixProfileUsernameToPKID, _PrefixNormalizedUsernamePKID},
+		rebuild: func(handle *badger.DB) (int, error) {
+			return _dbRebuildProfileIndex(handle, func(txn KVTxn, profileEntry *ProfileEntry, pkid *PKID) (int, error) {
+				if err := txn.Set(_dbKeyForProfileUsernameToPKID(profileEntry.Username), pkid[:]); err != nil {
+					return 0, err
+				}
+				if err := txn.Set(_dbKeyForNormalizedUsernamePKID(profileEntry.Username, pkid), []byte{}); err != nil {
+					return 0, err
+				}
+				return 2, nil
+			})
+		},
+	},
+	DbIndexCoinLockedPKID: {
+		prefixes: [][]byte{_PrefixCreatorBitCloutLockedNanosCreatorPKID},
+		rebuild: func(handle *badger.DB) (int, error) {
+			return _dbRebuildProfileIndex(handle, func(txn KVTxn, profileEntry *ProfileEntry, pkid *PKID) (int, error) {
+				return 1, txn.Set(_dbKeyForCreatorBitCloutLockedNanosCreatorPKID(
+					profileEntry.BitCloutLockedNanos, pkid), []byte{})
+			})
+		},
+	},
+	DbIndexPostEngagementCounts: {
+		prefixes: [][]byte{_PrefixPostHashToEngagementCounts},
+		rebuild:  _dbWritePostEngagementCounts,
+	},
+	DbIndexDiamondTotals: {
+		prefixes: [][]byte{_PrefixPostHashToDiamondTotals, _PrefixSenderPKIDReceiverPKIDToDiamondTotals},
+		rebuild:  _dbRebuildDiamondTotals,
+	},
+}
+
+type IndexRebuildReport struct {
+	Name DbIndexName
+	// NumWritten is the number of index keys written.
+	NumWritten int
+}
+
+// RebuildIndexes drops each of the named indexes and regenerates it from the
+// primary entries. Nothing else can be writing to the db while it runs, so it
+// should only be run on startup before the node starts processing blocks. An
+// index that fails to rebuild is left partially written and should be rebuilt
+// again.
+func RebuildIndexes(handle *badger.DB, indexNames []DbIndexName) (
+	_reports []*IndexRebuildReport, _err error) {
+
+	for _, indexName := range indexNames {
+		if _, exists := dbRebuildableIndexes[indexName]; !exists {
+			return nil, fmt.Errorf("RebuildIndexes: Unknown index %v; must be one of %v",
+				indexName, AllDbIndexNames)
+		}
+	}
+
+	// The indexes are written without going through a UtxoView flush.
+	if err := DbUpdate(handle, DbDropStateAccumulatorWithTxn); err != nil {
+		return nil, errors.Wrapf(err, "RebuildIndexes: Problem dropping state accumulator")
+	}
+
+	reports := []*IndexRebuildReport{}
+	for _, indexName := range indexNames {
+		index := dbRebuildableIndexes[indexName]
+		if err := handle.DropPrefix(index.prefixes...); err != nil {
+			return nil, errors.Wrapf(err, "RebuildIndexes: Problem dropping index %v", indexName)
+		}
+		numWritten, err := index.rebuild(handle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "RebuildIndexes: Problem rebuilding index %v", indexName)
+		}
+		glog.Infof("RebuildIndexes: Rebuilt index %v with %d keys", indexName, numWritten)
+		reports = append(reports, &IndexRebuildReport{
+			Name:       indexName,
+			NumWritten: numWritten,
+		})
+	}
+	return reports, nil
+}
+
+// _dbRebuildPostIndex calls fn on every post that isn't a comment.
+func _dbRebuildPostIndex(
+	handle *badger.DB, fn func(txn KVTxn, postEntry *PostEntry) (int, error)) (int, error) {
+
+	numWritten := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		return EnumerateKeysForPrefixWithCallback(handle, _PrefixPostHashToPostEntry, func(key []byte, val []byte) (bool, error) {
+			postEntry := &PostEntry{}
+			if err := _DbDecodePostEntry(val, postEntry); err != nil {
+				return false, errors.Wrapf(err, "Problem decoding post %x", key)
+			}
+			if len(postEntry.ParentStakeID) != 0 {
+				return true, nil
+			}
+			// Count the keys once the write is in, since it can be run again.
+			numKeys := 0
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				var err error
+				numKeys, err = fn(txn, postEntry)
+				return err
+			}); err != nil {
+				return false, err
+			}
+			numWritten += numKeys
+			return true, nil
+		})
+	})
+	return numWritten, err
+}
+
+// _dbRebuildProfileIndex calls fn on every profile and the PKID it belongs to.
+func _dbRebuildProfileIndex(
+	handle *badger.DB, fn func(txn KVTxn, profileEntry *ProfileEntry, pkid *PKID) (int, error)) (int, error) {
+
+	numWritten := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		return EnumerateKeysForPrefixWithCallback(handle, _PrefixPKIDToProfileEntry, func(key []byte, val []byte) (bool, error) {
+			pkidBytes := key[len(_PrefixPKIDToProfileEntry):]
+			if len(pkidBytes) != len(PKID{}) {
+				return false, fmt.Errorf("Profile key %x has a PKID of length %d", key, len(pkidBytes))
+			}
+			pkid := &PKID{}
+			copy(pkid[:], pkidBytes)
+			profileEntry := &ProfileEntry{}
+			if err := _DbDecodeProfileEntry(val, profileEntry); err != nil {
+				return false, errors.Wrapf(err, "Problem decoding profile %x", key)
+			}
+			// Count the keys once the write is in, since it can be run again.
+			numKeys := 0
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				var err error
+				numKeys, err = fn(txn, profileEntry, pkid)
+				return err
+			}); err != nil {
+				return false, err
+			}
+			numWritten += numKeys
+			return true, nil
+		})
+	})
+	return numWritten, err
+}
+
+// _dbRebuildDiamondTotals sums the diamond entries into the totals of each post
+// and of each sender and receiver.
+func _dbRebuildDiamondTotals(handle *badger.DB) (int, error) {
+	totalsForKey := make(map[string]*DiamondTotals)
+	totalsFor := func(key []byte) *DiamondTotals {
+		if _, exists := totalsForKey[string(key)]; !exists {
+			totalsForKey[string(key)] = &DiamondTotals{}
+		}
+		return totalsForKey[string(key)]
+	}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixDiamondReceiverPKIDDiamondSenderPKIDPostHash, func(key []byte, val []byte) (bool, error) {
+		diamondEntry := &DiamondEntry{}
+		if err := _DbDecodeDiamondEntry(val, diamondEntry); err != nil {
+			return false, errors.Wrapf(err, "Problem decoding diamond %x", key)
+		}
+		for _, totalsKey := range [][]byte{
+			_dbKeyForPostDiamondTotals(diamondEntry.DiamondPostHash),
+			_dbKeyForPKIDPairDiamondTotals(diamondEntry.SenderPKID, diamondEntry.ReceiverPKID),
+		} {
+			totals := totalsFor(totalsKey)
+			totals.NumDiamonds++
+			totals.TotalDiamondLevel = _addToCount(totals.TotalDiamondLevel, diamondEntry.DiamondLevel)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Problem summing diamonds")
+	}
+
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for key, totals := range totalsForKey {
+			totalsKey, totals := []byte(key), totals
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				return _dbPutDiamondTotalsWithTxn(txn, totalsKey, totals)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Problem writing totals")
+	}
+	return len(totalsForKey), nil
+}
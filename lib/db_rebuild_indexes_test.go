@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildIndexes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+	postHash := &BlockHash{9}
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:                 postHash,
+		PosterPublicKey:          pkB,
+		TimestampNanos:           1,
+		CreatorBasisPoints:       100,
+		StakeMultipleBasisPoints: 12500,
+		StakeEntry:               NewStakeEntry(),
+	}, params))
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:        &BlockHash{10},
+		PosterPublicKey: pkA,
+		ParentStakeID:   postHash[:],
+		TimestampNanos:  2,
+		StakeEntry:      NewStakeEntry(),
+	}, params))
+	require.NoError(DbPutLikeMappings(db, pkA, *postHash))
+	require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+		PublicKey:           pkA,
+		Username:            []byte("Alice"),
+		BitCloutLockedNanos: 5,
+	}, PublicKeyToPKID(pkA), params))
+	require.NoError(DbPutDiamondMappings(db, &DiamondEntry{
+		SenderPKID:      PublicKeyToPKID(pkA),
+		ReceiverPKID:    PublicKeyToPKID(pkB),
+		DiamondPostHash: postHash,
+		DiamondLevel:    2,
+	}))
+
+	indexPrefixes := [][]byte{}
+	for _, indexName := range AllDbIndexNames {
+		indexPrefixes = append(indexPrefixes, dbRebuildableIndexes[indexName].prefixes...)
+	}
+	snapshot := func() [][][]byte {
+		snapshot := [][][]byte{}
+		for _, prefix := range indexPrefixes {
+			keys, vals := EnumerateKeysForPrefix(db, prefix)
+			snapshot = append(snapshot, keys, vals)
+		}
+		return snapshot
+	}
+	expected := snapshot()
+
+	// Lose a tstamp key, add a stray creator bps key, and throw off the counts.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := txn.Delete(_dbKeyForTstampPostHash(1, postHash)); err != nil {
+			return err
+		}
+		if err := txn.Set(_dbKeyForCreatorBpsPostHash(7, &BlockHash{11}), []byte{}); err != nil {
+			return err
+		}
+		if err := txn.Delete(_dbKeyForProfileUsernameToPKID([]byte("Alice"))); err != nil {
+			return err
+		}
+		if err := _dbAdjustPostEngagementCountsWithTxn(txn, *postHash, 3, 0, 0); err != nil {
+			return err
+		}
+		return _dbPutDiamondTotalsWithTxn(txn, _dbKeyForPostDiamondTotals(postHash),
+			&DiamondTotals{NumDiamonds: 4, TotalDiamondLevel: 4})
+	}))
+	assert.NotEqual(expected, snapshot())
+	assert.Nil(DBGetPKIDForUsername(db, []byte("alice")))
+
+	_, err := RebuildIndexes(db, []DbIndexName{DbIndexPostTstamp, "not-an-index"})
+	assert.Error(err)
+
+	reports, err := RebuildIndexes(db, AllDbIndexNames)
+	require.NoError(err)
+	require.Equal(len(AllDbIndexNames), len(reports))
+	// The comment isn't in the post indexes.
+	assert.Equal(&IndexRebuildReport{Name: DbIndexPostTstamp, NumWritten: 2}, reports[0])
+	assert.Equal(&IndexRebuildReport{Name: DbIndexPostCreatorBps, NumWritten: 1}, reports[1])
+	assert.Equal(&IndexRebuildReport{Name: DbIndexUsernamePKID, NumWritten: 2}, reports[3])
+	assert.Equal(&IndexRebuildReport{Name: DbIndexDiamondTotals, NumWritten: 2}, reports[6])
+	assert.Equal(expected, snapshot())
+	assert.Equal(PublicKeyToPKID(pkA), DBGetPKIDForUsername(db, []byte("alice")))
+
+	counts, err := DBGetPostEngagementCounts(db, *postHash)
+	require.NoError(err)
+	assert.Equal(&PostEngagementCounts{LikeCount: 1, CommentCount: 1}, counts)
+	totals, err := DbGetDiamondTotalsForPost(db, postHash)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{NumDiamonds: 1, TotalDiamondLevel: 2}, totals)
+}
@@ -0,0 +1,450 @@
+package lib
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// A db snapshot is a copy of the chain state as of a block, which a new node can
+// load instead of downloading and connecting every block since genesis. It's
+// made of one file per prefix in DbPrefixRegistry, holding records of the form
+// <key len uvarint, key, value len uvarint, value> in key order, and a manifest
+// with the sha256 of each file. Node-local prefixes are left out. Everything is
+// read in a single badger txn so the snapshot is consistent even if the node is
+// connecting blocks while it's taken.
+
+const (
+	DbSnapshotVersion          = 1
+	dbSnapshotManifestFileName = "manifest.json"
+)
+
+type DbSnapshotManifest struct {
+	Version     uint64
+	NetworkType NetworkType
+	// The tip of the chain the snapshot was taken at.
+	BlockHeight uint64
+	BlockHash   *BlockHash
+	// The height below which the node the snapshot came from had pruned its
+	// blocks. A node that loads the snapshot is pruned to the same height.
+	PruneHeight uint64
+	Prefixes    []*DbSnapshotPrefix
+}
+
+type DbSnapshotPrefix struct {
+	Name     string
+	Prefix   []byte
+	FileName string
+	NumKeys  uint64
+	NumBytes uint64
+	// The hex-encoded sha256 of the file.
+	Checksum string
+}
+
+func _dbSnapshotFileName(prefixInfo *DbPrefixInfo) string {
+	return fmt.Sprintf("%s-%s.dat", hex.EncodeToString(prefixInfo.Prefix), prefixInfo.Name)
+}
+
+// _dbSnapshotRecord encodes a key and its value the way they're stored in a
+// snapshot file.
+func _dbSnapshotRecord(key []byte, val []byte) []byte {
+	record := append(UintToBuf(uint64(len(key))), key...)
+	record = append(record, UintToBuf(uint64(len(val)))...)
+	return append(record, val...)
+}
+
+// _dbWriteSnapshotPrefixWithTxn writes the records for every key under the prefix
+// to writer and fills in the counts and checksum of the snapshot prefix.
+func _dbWriteSnapshotPrefixWithTxn(txn KVTxn, snapshotPrefix *DbSnapshotPrefix, writer io.Writer) error {
+	hasher := sha256.New()
+	bufWriter := bufio.NewWriter(io.MultiWriter(writer, hasher))
+
+	opts := KVIteratorOptions{}
+	opts.Prefix = snapshotPrefix.Prefix
+	nodeIterator := txn.NewIterator(opts)
+	defer nodeIterator.Close()
+	for nodeIterator.Seek(snapshotPrefix.Prefix); nodeIterator.ValidForPrefix(snapshotPrefix.Prefix); nodeIterator.Next() {
+		key := nodeIterator.Key()
+		if IsLocalOnlyDbKey(key) {
+			continue
+		}
+		val, err := nodeIterator.Value()
+		if err != nil {
+			return errors.Wrapf(err, "Problem reading value for key %v", key)
+		}
+		record := _dbSnapshotRecord(key, val)
+		if _, err := bufWriter.Write(record); err != nil {
+			return err
+		}
+		snapshotPrefix.NumKeys++
+		snapshotPrefix.NumBytes += uint64(len(record))
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return err
+	}
+	snapshotPrefix.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	return nil
+}
+
+// _dbWriteSnapshot reads the whole chain state in one txn and calls writePrefix
+// for each prefix. writePrefix should call writeRecords with the writer the
+// prefix's file should go to. Prefixes without any keys are left out of the
+// manifest so writePrefix can drop their files.
+func _dbWriteSnapshot(handle *badger.DB, params *BitCloutParams,
+	writePrefix func(snapshotPrefix *DbSnapshotPrefix, writeRecords func(io.Writer) error) error) (
+	*DbSnapshotManifest, error) {
+
+	manifest := &DbSnapshotManifest{
+		Version:     DbSnapshotVersion,
+		NetworkType: params.NetworkType,
+	}
+	err := DbView(handle, func(txn KVTxn) error {
+		manifest.BlockHash = _getBlockHashForPrefixWithTxn(txn, _KeyBestBitCloutBlockHash)
+		if manifest.BlockHash == nil {
+			return fmt.Errorf("The db doesn't have a chain to snapshot")
+		}
+		tipBlock := GetBlockWithTxn(txn, manifest.BlockHash)
+		if tipBlock == nil {
+			return fmt.Errorf("Problem fetching tip block %v", manifest.BlockHash)
+		}
+		manifest.BlockHeight = tipBlock.Header.Height
+		manifest.PruneHeight = DbGetPruneHeightWithTxn(txn)
+
+		for _, prefixInfo := range DbPrefixRegistry {
+			if IsLocalOnlyDbKey(prefixInfo.Prefix) {
+				continue
+			}
+			snapshotPrefix := &DbSnapshotPrefix{
+				Name:     prefixInfo.Name,
+				Prefix:   prefixInfo.Prefix,
+				FileName: _dbSnapshotFileName(prefixInfo),
+			}
+			err := writePrefix(snapshotPrefix, func(writer io.Writer) error {
+				return _dbWriteSnapshotPrefixWithTxn(txn, snapshotPrefix, writer)
+			})
+			if err != nil {
+				return errors.Wrapf(err, "Problem writing prefix %s", prefixInfo.Name)
+			}
+			if snapshotPrefix.NumKeys > 0 {
+				manifest.Prefixes = append(manifest.Prefixes, snapshotPrefix)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// DbCreateSnapshot writes a snapshot of the chain state at the current tip to dir,
+// which must not already hold a snapshot.
+func DbCreateSnapshot(handle *badger.DB, params *BitCloutParams, dir string) (*DbSnapshotManifest, error) {
+	if _, err := os.Stat(filepath.Join(dir, dbSnapshotManifestFileName)); err == nil {
+		return nil, fmt.Errorf("DbCreateSnapshot: %v already has a snapshot", dir)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "DbCreateSnapshot: Problem creating dir %v", dir)
+	}
+
+	manifest, err := _dbWriteSnapshot(handle, params, func(
+		snapshotPrefix *DbSnapshotPrefix, writeRecords func(io.Writer) error) error {
+
+		filePath := filepath.Join(dir, snapshotPrefix.FileName)
+		prefixFile, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		if err := writeRecords(prefixFile); err != nil {
+			prefixFile.Close()
+			return err
+		}
+		if err := prefixFile.Close(); err != nil {
+			return err
+		}
+		if snapshotPrefix.NumKeys == 0 {
+			return os.Remove(filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbCreateSnapshot: ")
+	}
+
+	// The manifest is written last so a snapshot that was only partly written
+	// can't be loaded.
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbCreateSnapshot: Problem encoding manifest")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, dbSnapshotManifestFileName), manifestBytes, 0644); err != nil {
+		return nil, errors.Wrapf(err, "DbCreateSnapshot: Problem writing manifest")
+	}
+	return manifest, nil
+}
+
+// DbGetSnapshotManifest returns the manifest a snapshot taken at the current tip
+// would have without writing any files. State sync checks what it fetches from
+// peers against a manifest like this one.
+func DbGetSnapshotManifest(handle *badger.DB, params *BitCloutParams) (*DbSnapshotManifest, error) {
+	manifest, err := _dbWriteSnapshot(handle, params, func(
+		snapshotPrefix *DbSnapshotPrefix, writeRecords func(io.Writer) error) error {
+
+		return writeRecords(ioutil.Discard)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetSnapshotManifest: ")
+	}
+	return manifest, nil
+}
+
+// DbWriteSnapshotTar writes a snapshot of the chain state at the current tip to
+// writer as a tar stream with the same files DbCreateSnapshot would write. Each
+// prefix is staged in a temp file since tar needs to know its size up front.
+func DbWriteSnapshotTar(handle *badger.DB, params *BitCloutParams, writer io.Writer) (*DbSnapshotManifest, error) {
+	tarWriter := tar.NewWriter(writer)
+	manifest, err := _dbWriteSnapshot(handle, params, func(
+		snapshotPrefix *DbSnapshotPrefix, writeRecords func(io.Writer) error) error {
+
+		tempFile, err := ioutil.TempFile("", "snapshot")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tempFile.Name())
+		defer tempFile.Close()
+
+		if err := writeRecords(tempFile); err != nil {
+			return err
+		}
+		if snapshotPrefix.NumKeys == 0 {
+			return nil
+		}
+		if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		err = tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     snapshotPrefix.FileName,
+			Mode:     0644,
+			Size:     int64(snapshotPrefix.NumBytes),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tarWriter, tempFile)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbWriteSnapshotTar: ")
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbWriteSnapshotTar: Problem encoding manifest")
+	}
+	err = tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     dbSnapshotManifestFileName,
+		Mode:     0644,
+		Size:     int64(len(manifestBytes)),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbWriteSnapshotTar: Problem writing manifest header")
+	}
+	if _, err := tarWriter.Write(manifestBytes); err != nil {
+		return nil, errors.Wrapf(err, "DbWriteSnapshotTar: Problem writing manifest")
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, errors.Wrapf(err, "DbWriteSnapshotTar: Problem closing tar stream")
+	}
+	return manifest, nil
+}
+
+// ExtractSnapshotTar writes the files in a tar stream made by DbWriteSnapshotTar
+// to dir so the snapshot can be loaded with InitDbFromSnapshot.
+func ExtractSnapshotTar(reader io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "ExtractSnapshotTar: Problem creating dir %v", dir)
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "ExtractSnapshotTar: Problem reading tar stream")
+		}
+		// Snapshots are flat so anything with a path in it didn't come from
+		// DbWriteSnapshotTar.
+		if header.Typeflag != tar.TypeReg || header.Name != filepath.Base(header.Name) ||
+			strings.HasPrefix(header.Name, ".") {
+
+			return fmt.Errorf("ExtractSnapshotTar: Unexpected entry %s in tar stream", header.Name)
+		}
+		snapshotFile, err := os.Create(filepath.Join(dir, header.Name))
+		if err != nil {
+			return errors.Wrapf(err, "ExtractSnapshotTar: Problem creating %s", header.Name)
+		}
+		_, err = io.Copy(snapshotFile, tarReader)
+		snapshotFile.Close()
+		if err != nil {
+			return errors.Wrapf(err, "ExtractSnapshotTar: Problem writing %s", header.Name)
+		}
+	}
+}
+
+// ReadDbSnapshotManifest reads the manifest of the snapshot in dir.
+func ReadDbSnapshotManifest(dir string) (*DbSnapshotManifest, error) {
+	return ReadDbSnapshotManifestFile(filepath.Join(dir, dbSnapshotManifestFileName))
+}
+
+// ReadDbSnapshotManifestFile reads a manifest on its own, e.g. one that's
+// handed out for state sync without the rest of the snapshot.
+func ReadDbSnapshotManifestFile(manifestPath string) (*DbSnapshotManifest, error) {
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ReadDbSnapshotManifestFile: Problem reading %v", manifestPath)
+	}
+	manifest := &DbSnapshotManifest{}
+	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+		return nil, errors.Wrapf(err, "ReadDbSnapshotManifestFile: Problem decoding %v", manifestPath)
+	}
+	return manifest, nil
+}
+
+// _verifyDbSnapshotPrefix checks the size and checksum of a prefix's file.
+func _verifyDbSnapshotPrefix(dir string, snapshotPrefix *DbSnapshotPrefix) error {
+	if snapshotPrefix.FileName != filepath.Base(snapshotPrefix.FileName) {
+		return fmt.Errorf("Invalid file name %s", snapshotPrefix.FileName)
+	}
+	prefixFile, err := os.Open(filepath.Join(dir, snapshotPrefix.FileName))
+	if err != nil {
+		return err
+	}
+	defer prefixFile.Close()
+
+	hasher := sha256.New()
+	numBytes, err := io.Copy(hasher, prefixFile)
+	if err != nil {
+		return err
+	}
+	if uint64(numBytes) != snapshotPrefix.NumBytes {
+		return fmt.Errorf("File %s has %d bytes but the manifest says %d",
+			snapshotPrefix.FileName, numBytes, snapshotPrefix.NumBytes)
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != snapshotPrefix.Checksum {
+		return fmt.Errorf("File %s has checksum %s but the manifest says %s",
+			snapshotPrefix.FileName, checksum, snapshotPrefix.Checksum)
+	}
+	return nil
+}
+
+// _dbLoadSnapshotPrefix writes the records in a prefix's file to the db.
+func _dbLoadSnapshotPrefix(handle *badger.DB, dir string, snapshotPrefix *DbSnapshotPrefix) error {
+	prefixFile, err := os.Open(filepath.Join(dir, snapshotPrefix.FileName))
+	if err != nil {
+		return err
+	}
+	defer prefixFile.Close()
+
+	writeBatch := handle.NewWriteBatch()
+	defer writeBatch.Cancel()
+
+	reader := bufio.NewReader(prefixFile)
+	numKeys := uint64(0)
+	for {
+		key, err := _readDbArchiveBytes(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Problem reading key %d", numKeys)
+		}
+		val, err := _readDbArchiveBytes(reader)
+		if err != nil {
+			return errors.Wrapf(err, "Problem reading value for key %d", numKeys)
+		}
+		if !bytes.HasPrefix(key, snapshotPrefix.Prefix) {
+			return fmt.Errorf("Key %v isn't under prefix %v", key, snapshotPrefix.Prefix)
+		}
+		if err := writeBatch.Set(key, val); err != nil {
+			return err
+		}
+		numKeys++
+	}
+	if numKeys != snapshotPrefix.NumKeys {
+		return fmt.Errorf("File %s has %d keys but the manifest says %d",
+			snapshotPrefix.FileName, numKeys, snapshotPrefix.NumKeys)
+	}
+	return writeBatch.Flush()
+}
+
+// InitDbFromSnapshot loads the snapshot in dir into a db that doesn't have a chain
+// yet. Every file is checked against the manifest before anything is written. The
+// node picks up from the snapshot's tip when the chain is initialized.
+func InitDbFromSnapshot(handle *badger.DB, params *BitCloutParams, dir string) (*DbSnapshotManifest, error) {
+	if DbGetBestHash(handle, ChainTypeBitCloutBlock) != nil {
+		return nil, fmt.Errorf("InitDbFromSnapshot: The db already has a chain")
+	}
+	manifest, err := ReadDbSnapshotManifest(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "InitDbFromSnapshot: ")
+	}
+	if manifest.Version != DbSnapshotVersion {
+		return nil, fmt.Errorf("InitDbFromSnapshot: Snapshot has version %d but "+
+			"only version %d is supported", manifest.Version, DbSnapshotVersion)
+	}
+	if manifest.NetworkType != params.NetworkType {
+		return nil, fmt.Errorf("InitDbFromSnapshot: Snapshot is for network %v "+
+			"but the node is on %v", manifest.NetworkType, params.NetworkType)
+	}
+
+	for _, snapshotPrefix := range manifest.Prefixes {
+		if err := _verifyDbSnapshotPrefix(dir, snapshotPrefix); err != nil {
+			return nil, errors.Wrapf(err, "InitDbFromSnapshot: Problem verifying prefix %s", snapshotPrefix.Name)
+		}
+	}
+
+	// The best hash is what marks the db as having a chain so it's loaded last.
+	// That way a node that dies partway through can load the snapshot again.
+	var bestHashPrefix *DbSnapshotPrefix
+	for _, snapshotPrefix := range manifest.Prefixes {
+		if bytes.Equal(snapshotPrefix.Prefix, _KeyBestBitCloutBlockHash) {
+			bestHashPrefix = snapshotPrefix
+			continue
+		}
+		if err := _dbLoadSnapshotPrefix(handle, dir, snapshotPrefix); err != nil {
+			return nil, errors.Wrapf(err, "InitDbFromSnapshot: Problem loading prefix %s", snapshotPrefix.Name)
+		}
+		glog.Infof("InitDbFromSnapshot: Loaded %d keys for %s", snapshotPrefix.NumKeys, snapshotPrefix.Name)
+	}
+	if bestHashPrefix == nil {
+		return nil, fmt.Errorf("InitDbFromSnapshot: Snapshot doesn't have a best block hash")
+	}
+	if manifest.PruneHeight > 0 {
+		err := DbUpdate(handle, func(txn KVTxn) error {
+			return DbPutPruneHeightWithTxn(txn, manifest.PruneHeight)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "InitDbFromSnapshot: Problem putting prune height")
+		}
+	}
+	if err := _dbLoadSnapshotPrefix(handle, dir, bestHashPrefix); err != nil {
+		return nil, errors.Wrapf(err, "InitDbFromSnapshot: Problem loading best block hash")
+	}
+	return manifest, nil
+}
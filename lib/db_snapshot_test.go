@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	chainlib "github.com/btcsuite/btcd/blockchain"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 3; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{BalanceSnapshots: true}))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbPutPruneHeightWithTxn(txn, 2)
+	}))
+
+	// Returns every key and value in the db that isn't node-local.
+	chainState := func(handle *badger.DB) map[string][]byte {
+		state := make(map[string][]byte)
+		require.NoError(DbView(handle, func(txn KVTxn) error {
+			it := txn.NewIterator(KVIteratorOptions{})
+			defer it.Close()
+			for it.Seek(nil); it.Valid(); it.Next() {
+				if IsLocalOnlyDbKey(it.Key()) {
+					continue
+				}
+				val, err := it.Value()
+				require.NoError(err)
+				state[string(it.Key())] = val
+			}
+			return nil
+		}))
+		return state
+	}
+
+	snapshotDir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(err)
+	defer os.RemoveAll(snapshotDir)
+	manifest, err := DbCreateSnapshot(db, params, snapshotDir)
+	require.NoError(err)
+	assert.Equal(uint64(3), manifest.BlockHeight)
+	assert.Equal(*chain.blockTip().Hash, *manifest.BlockHash)
+	assert.Equal(uint64(2), manifest.PruneHeight)
+
+	// A snapshot can't be written over another one.
+	_, err = DbCreateSnapshot(db, params, snapshotDir)
+	require.Error(err)
+
+	// Loading the snapshot reproduces the chain state but not the node's own
+	// settings, other than how far it's pruned.
+	restoredDb, restoredDir := GetTestBadgerDb()
+	defer os.RemoveAll(restoredDir)
+	_, err = InitDbFromSnapshot(restoredDb, params, snapshotDir)
+	require.NoError(err)
+	assert.Equal(chainState(db), chainState(restoredDb))
+	restoredConfig, err := DbGetNodeConfig(restoredDb)
+	require.NoError(err)
+	assert.False(restoredConfig.BalanceSnapshots)
+	assert.Equal(uint64(2), DbGetPruneHeight(restoredDb))
+
+	// The restored db has a chain so it can't be loaded into again, and the
+	// chain picks up from the snapshot's tip.
+	_, err = InitDbFromSnapshot(restoredDb, params, snapshotDir)
+	require.Error(err)
+	restoredChain, err := NewBlockchain([]string{blockSignerPk}, 0, params, chainlib.NewMedianTime(),
+		restoredDb, nil, nil)
+	require.NoError(err)
+	assert.Equal(*manifest.BlockHash, *restoredChain.blockTip().Hash)
+
+	// Snapshots for another network are rejected.
+	otherDb, otherDir := GetTestBadgerDb()
+	defer os.RemoveAll(otherDir)
+	_, err = InitDbFromSnapshot(otherDb, &BitCloutMainnetParams, snapshotDir)
+	require.Error(err)
+
+	// A tar stream holds the same snapshot.
+	tarBuf := bytes.NewBuffer([]byte{})
+	_, err = DbWriteSnapshotTar(db, params, tarBuf)
+	require.NoError(err)
+	extractDir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(err)
+	defer os.RemoveAll(extractDir)
+	require.NoError(ExtractSnapshotTar(tarBuf, extractDir))
+	tarDb, tarDir := GetTestBadgerDb()
+	defer os.RemoveAll(tarDir)
+	_, err = InitDbFromSnapshot(tarDb, params, extractDir)
+	require.NoError(err)
+	assert.Equal(chainState(db), chainState(tarDb))
+
+	// A file that doesn't match its checksum is caught before anything is loaded.
+	prefixFile := filepath.Join(snapshotDir, manifest.Prefixes[0].FileName)
+	prefixBytes, err := ioutil.ReadFile(prefixFile)
+	require.NoError(err)
+	prefixBytes[len(prefixBytes)-1] ^= 0xff
+	require.NoError(ioutil.WriteFile(prefixFile, prefixBytes, 0644))
+	corruptDb, corruptDir := GetTestBadgerDb()
+	defer os.RemoveAll(corruptDir)
+	_, err = InitDbFromSnapshot(corruptDb, params, snapshotDir)
+	require.Error(err)
+	assert.Contains(err.Error(), "checksum")
+	assert.Empty(chainState(corruptDb))
+}
+
+func TestDbSnapshotManifestSkipsLocalData(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	blocks := []*MsgBitCloutBlock{}
+	for ii := 0; ii < 3; ii++ {
+		block, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+		blocks = append(blocks, block)
+	}
+
+	// Another node processes the same blocks.
+	otherChain, _, otherDb := NewLowDifficultyBlockchain()
+	for _, block := range blocks {
+		_, _, err := otherChain.ProcessBlock(block, true /*verifySignatures*/)
+		require.NoError(err)
+	}
+	require.Equal(*chain.blockTip().Hash, *otherChain.blockTip().Hash)
+
+	// Only the first node has a mempool, a migration in progress, and the
+	// markers left behind by a crash.
+	txn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 11, senderPkString,
+		recipientPkString, senderPrivString, mempool)
+	_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+	require.NoError(err)
+	mempoolTxns, _, err := mempool.GetTransactionsOrderedByTimeAdded()
+	require.NoError(err)
+	require.NoError(FlushMempoolToDb(db, mempoolTxns, 0, nil))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := DbPutIndexMigrationStateWithTxn(txn, "test", IndexMigrationStateDualWrite); err != nil {
+			return err
+		}
+		if err := txn.Set(_KeyCrashBreadcrumb, []byte{1}); err != nil {
+			return err
+		}
+		return txn.Set(_KeyGenesisInitInProgress, []byte{})
+	}))
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{BalanceSnapshots: true}))
+
+	// Nodes at the same tip have the same manifest.
+	manifest, err := DbGetSnapshotManifest(db, params)
+	require.NoError(err)
+	otherManifest, err := DbGetSnapshotManifest(otherDb, params)
+	require.NoError(err)
+	assert.Equal(otherManifest, manifest)
+}
@@ -0,0 +1,358 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+// State commitments let a light client or a node restored from a snapshot check
+// that its state matches the one a node it trusts had at a given height.
+//
+// The commitment is the sha256 of a StateAccumulator over every record under a
+// committed prefix, which is every prefix the UtxoView flushes to other than the
+// ones IsStateCommitmentDbKey leaves out. The accumulator is a lattice hash: each
+// key and value is expanded to StateAccumulatorLanes uint16 lanes which are added
+// to the accumulator lane by lane, wrapping on overflow. Removing a record
+// subtracts the same lanes, so the accumulator only depends on which records are
+// in the set and a UtxoView can update it with just the records it changes. See
+// UtxoView.FlushToDbWithTxn.
+
+const (
+	// StateAccumulatorLanes is the number of uint16 lanes in a StateAccumulator.
+	StateAccumulatorLanes = 1024
+	// StateAccumulatorBytes is the size of an encoded StateAccumulator.
+	StateAccumulatorBytes = 2 * StateAccumulatorLanes
+)
+
+// StateAccumulator is a hash over a set of key/value records that records can be
+// added to and removed from in any order.
+type StateAccumulator struct {
+	lanes [StateAccumulatorLanes]uint16
+}
+
+// _stateAccumulatorLanesForRecord expands a record into lanes by hashing it and
+// then running sha256 over the hash and a counter until every lane is filled.
+func _stateAccumulatorLanesForRecord(key []byte, val []byte) *[StateAccumulatorLanes]uint16 {
+	recordHash := sha256.Sum256(_dbSnapshotRecord(key, val))
+	lanes := &[StateAccumulatorLanes]uint16{}
+	blockInput := make([]byte, len(recordHash)+4)
+	copy(blockInput, recordHash[:])
+	for blockIndex := 0; blockIndex*16 < StateAccumulatorLanes; blockIndex++ {
+		binary.BigEndian.PutUint32(blockInput[len(recordHash):], uint32(blockIndex))
+		block := sha256.Sum256(blockInput)
+		for ii := 0; ii < 16; ii++ {
+			lanes[blockIndex*16+ii] = binary.BigEndian.Uint16(block[2*ii:])
+		}
+	}
+	return lanes
+}
+
+// _stateCommitmentExcludedPrefixes are the prefixes besides LocalOnlyDbPrefixes
+// that state commitments leave out:
+//   - The chain storage and the txindex, which depend on what the node keeps
+//     and on how it's configured rather than on the state as of the tip.
+//   - The indexes the Blockchain builds from each block next to the view rather
+//     than through it, so a flush can't keep the accumulator in step with them.
+//   - The time-ordered indexes in _timestampIndexes, whose entries can be
+//     quarantined by a timestamp skew that each node sets for itself.
+var _stateCommitmentExcludedPrefixes = [][]byte{
+	_PrefixBlockHashToBlock,
+	_PrefixHeightHashToNodeInfo,
+	_PrefixBitcoinHeightHashToNodeInfo,
+	_KeyBestBitCloutBlockHash,
+	_KeyBestBitcoinHeaderHash,
+	_PrefixBlockHashToUtxoOperations,
+	_PrefixBlockHashToDedupedBlock,
+	_PrefixTxnHashToBlockTxn,
+	_PrefixSeedTxnIndexToReport,
+
+	_KeyTransactionIndexTip,
+	_PrefixTransactionIDToMetadata,
+	_PrefixPublicKeyIndexToTransactionIDs,
+	_PrefixPublicKeyToNextIndex,
+	_PrefixPublicKeyHeightTxnIndexTxID,
+	_PrefixTransactionIDToTxnBytes,
+	_PrefixTxindexHeightTxnIndexToTxID,
+	_PrefixTxindexTxIDToBlockHeight,
+	_PrefixPublicKeyToActivity,
+
+	_PrefixUtxoKeyToUtxoSpendEntry,
+	_PrefixDayTxnTypeToTxnDailyStats,
+	_PrefixPKIDTstampTypeTxIDToNotification,
+	_PrefixTxIDToNotificationKeys,
+	_PrefixReceiverPKIDTstampSenderPKIDPostHashToDiamond,
+	_PrefixTxIDToDiamondTimeKey,
+	_PrefixForkNameToForkState,
+	_PrefixForkNameToSignalCount,
+	_PrefixPublicKeyToUnreadMessageCount,
+}
+
+// IsStateCommitmentDbKey returns whether a key is covered by state commitments.
+func IsStateCommitmentDbKey(key []byte) bool {
+	if IsLocalOnlyDbKey(key) {
+		return false
+	}
+	for _, prefix := range _stateCommitmentExcludedPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	for _, indexInfo := range _timestampIndexes {
+		if bytes.HasPrefix(key, indexInfo.prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds a record to the set.
+func (acc *StateAccumulator) Add(key []byte, val []byte) {
+	lanes := _stateAccumulatorLanesForRecord(key, val)
+	for ii := range acc.lanes {
+		acc.lanes[ii] += lanes[ii]
+	}
+}
+
+// Remove removes a record that was added before.
+func (acc *StateAccumulator) Remove(key []byte, val []byte) {
+	lanes := _stateAccumulatorLanesForRecord(key, val)
+	for ii := range acc.lanes {
+		acc.lanes[ii] -= lanes[ii]
+	}
+}
+
+func (acc *StateAccumulator) ToBytes() []byte {
+	data := make([]byte, StateAccumulatorBytes)
+	for ii, lane := range acc.lanes {
+		binary.BigEndian.PutUint16(data[2*ii:], lane)
+	}
+	return data
+}
+
+func (acc *StateAccumulator) FromBytes(data []byte) error {
+	if len(data) != StateAccumulatorBytes {
+		return fmt.Errorf("StateAccumulator.FromBytes: Expected %d bytes but got %d",
+			StateAccumulatorBytes, len(data))
+	}
+	for ii := range acc.lanes {
+		acc.lanes[ii] = binary.BigEndian.Uint16(data[2*ii:])
+	}
+	return nil
+}
+
+// Commitment returns the sha256 of the encoded accumulator.
+func (acc *StateAccumulator) Commitment() *BlockHash {
+	commitment := BlockHash(sha256.Sum256(acc.ToBytes()))
+	return &commitment
+}
+
+// DbGetStateAccumulatorWithTxn returns the accumulator over the committed state as
+// of the last flush, or nil if the node isn't keeping state commitments.
+func DbGetStateAccumulatorWithTxn(txn KVTxn) (*StateAccumulator, error) {
+	valBytes, err := txn.Get(_KeyStateAccumulator)
+	if err == ErrKVKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, _wrapDbError(err, "DbGetStateAccumulatorWithTxn")
+	}
+	acc := &StateAccumulator{}
+	if err := acc.FromBytes(valBytes); err != nil {
+		return nil, _corruptDbEntryError(err, "DbGetStateAccumulatorWithTxn")
+	}
+	return acc, nil
+}
+
+func DbPutStateAccumulatorWithTxn(txn KVTxn, acc *StateAccumulator) error {
+	return txn.Set(_KeyStateAccumulator, acc.ToBytes())
+}
+
+// stateCommitmentKVTxn is the txn a UtxoView is flushed through when the node is
+// keeping state commitments. It moves the accumulator off of the old value of
+// every committed key that's written and onto the new one.
+type stateCommitmentKVTxn struct {
+	KVTxn
+	acc *StateAccumulator
+}
+
+func (txn *stateCommitmentKVTxn) _removeOldRecord(key []byte) error {
+	oldVal, err := txn.KVTxn.Get(key)
+	if err == ErrKVKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	txn.acc.Remove(key, oldVal)
+	return nil
+}
+
+func (txn *stateCommitmentKVTxn) Set(key []byte, val []byte) error {
+	if IsStateCommitmentDbKey(key) {
+		if err := txn._removeOldRecord(key); err != nil {
+			return err
+		}
+		txn.acc.Add(key, val)
+	}
+	return txn.KVTxn.Set(key, val)
+}
+
+func (txn *stateCommitmentKVTxn) Delete(key []byte) error {
+	if IsStateCommitmentDbKey(key) {
+		if err := txn._removeOldRecord(key); err != nil {
+			return err
+		}
+	}
+	return txn.KVTxn.Delete(key)
+}
+
+// DbDropStateAccumulatorWithTxn deletes the accumulator after state was written
+// without going through a UtxoView flush. The next DbInitStateCommitments builds
+// it again if the node is keeping state commitments.
+func DbDropStateAccumulatorWithTxn(txn KVTxn) error {
+	return txn.Delete(_KeyStateAccumulator)
+}
+
+func _dbKeyForStateCommitment(blockHeight uint32) []byte {
+	return append(append([]byte{}, _PrefixHeightToStateCommitment...), _EncodeUint32(blockHeight)...)
+}
+
+func DbPutStateCommitmentWithTxn(txn KVTxn, blockHeight uint32, commitment *BlockHash) error {
+	return txn.Set(_dbKeyForStateCommitment(blockHeight), commitment[:])
+}
+
+// DbDeleteStateCommitmentsFromHeightWithTxn deletes the commitments for every
+// height at or above the given one.
+func DbDeleteStateCommitmentsFromHeightWithTxn(txn KVTxn, blockHeight uint32) error {
+	opts := KVIteratorOptions{}
+	opts.KeysOnly = true
+	opts.Prefix = _PrefixHeightToStateCommitment
+	nodeIterator := txn.NewIterator(opts)
+	keysToDelete := [][]byte{}
+	for nodeIterator.Seek(_dbKeyForStateCommitment(blockHeight)); nodeIterator.ValidForPrefix(
+		_PrefixHeightToStateCommitment); nodeIterator.Next() {
+
+		keysToDelete = append(keysToDelete, append([]byte{}, nodeIterator.Key()...))
+	}
+	nodeIterator.Close()
+
+	for _, key := range keysToDelete {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DbGetStateCommitmentWithTxn(txn KVTxn, blockHeight uint32) *BlockHash {
+	return _getBlockHashForPrefixWithTxn(txn, _dbKeyForStateCommitment(blockHeight))
+}
+
+// DbGetStateCommitment returns the commitment to the state as of the block at
+// the given height on the main chain, or nil if there isn't one. Heights from
+// before the node started keeping commitments don't have one, and neither do the
+// blocks of a reorg other than the new tip.
+func DbGetStateCommitment(handle *badger.DB, blockHeight uint32) *BlockHash {
+	var commitment *BlockHash
+	DbView(handle, func(txn KVTxn) error {
+		commitment = DbGetStateCommitmentWithTxn(txn, blockHeight)
+		return nil
+	})
+	return commitment
+}
+
+// DbComputeStateAccumulator builds the accumulator over the committed state in
+// the db from scratch. A node that got its state from a snapshot or from peers can
+// compare its commitment to the one a node it trusts has for the same height.
+func DbComputeStateAccumulator(handle *badger.DB) (*StateAccumulator, error) {
+	acc := &StateAccumulator{}
+	err := DbView(handle, func(txn KVTxn) error {
+		nodeIterator := txn.NewIterator(KVIteratorOptions{})
+		defer nodeIterator.Close()
+		for nodeIterator.Seek(nil); nodeIterator.Valid(); nodeIterator.Next() {
+			if !IsStateCommitmentDbKey(nodeIterator.Key()) {
+				continue
+			}
+			valBytes, err := nodeIterator.Value()
+			if err != nil {
+				return err
+			}
+			acc.Add(nodeIterator.Key(), valBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbComputeStateAccumulator: ")
+	}
+	return acc, nil
+}
+
+// stateCommitmentPrefixesMigrationName marks whether the stored accumulator
+// covers every committed prefix. Accumulators from before it only covered the
+// utxo set.
+const stateCommitmentPrefixesMigrationName = "state-commitment-prefixes"
+
+// DbInitStateCommitments starts or stops keeping state commitments to match the
+// node config. Starting builds the accumulator over the committed state and
+// records the commitment for the tip. It also rebuilds an accumulator that was
+// dropped or that predates stateCommitmentPrefixesMigrationName. Stopping deletes
+// the accumulator and every commitment.
+func DbInitStateCommitments(handle *badger.DB, enabled bool, tipHeight uint32) (_started bool, _err error) {
+	if !enabled {
+		// An accumulator that was dropped can leave commitments behind, so this
+		// doesn't check whether there's anything to delete first.
+		err := DbUpdate(handle, func(txn KVTxn) error {
+			if err := txn.Delete(_KeyStateAccumulator); err != nil {
+				return err
+			}
+			return DbDeleteStateCommitmentsFromHeightWithTxn(txn, 0)
+		})
+		if err != nil {
+			return false, errors.Wrapf(err, "DbInitStateCommitments: Problem deleting commitments")
+		}
+		return false, nil
+	}
+
+	var upToDate bool
+	DbView(handle, func(txn KVTxn) error {
+		acc, _ := DbGetStateAccumulatorWithTxn(txn)
+		upToDate = acc != nil && DbGetIndexMigrationStateWithTxn(
+			txn, stateCommitmentPrefixesMigrationName) == IndexMigrationStateBackfillComplete
+		return nil
+	})
+	if upToDate {
+		return false, nil
+	}
+
+	// This runs before the chain starts connecting blocks so the state can't
+	// change between building the accumulator and storing it.
+	acc, err := DbComputeStateAccumulator(handle)
+	if err != nil {
+		return false, errors.Wrapf(err, "DbInitStateCommitments: ")
+	}
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		if err := DbDeleteStateCommitmentsFromHeightWithTxn(txn, 0); err != nil {
+			return err
+		}
+		if err := DbPutStateCommitmentWithTxn(txn, tipHeight, acc.Commitment()); err != nil {
+			return err
+		}
+		// The accumulator has to be stored after the marker since setting a
+		// migration state drops it.
+		if err := DbPutIndexMigrationStateWithTxn(txn, stateCommitmentPrefixesMigrationName,
+			IndexMigrationStateBackfillComplete); err != nil {
+
+			return err
+		}
+		return DbPutStateAccumulatorWithTxn(txn, acc)
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "DbInitStateCommitments: Problem storing accumulator")
+	}
+	return true, nil
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateCommitments(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Records can be added and removed in any order.
+	acc1 := &StateAccumulator{}
+	acc1.Add([]byte("a"), []byte("1"))
+	acc1.Add([]byte("b"), []byte("2"))
+	acc2 := &StateAccumulator{}
+	acc2.Add([]byte("b"), []byte("2"))
+	acc2.Add([]byte("c"), []byte("3"))
+	acc2.Add([]byte("a"), []byte("1"))
+	assert.NotEqual(acc1.Commitment(), acc2.Commitment())
+	acc2.Remove([]byte("c"), []byte("3"))
+	assert.Equal(acc1.Commitment(), acc2.Commitment())
+	acc3 := &StateAccumulator{}
+	require.NoError(acc3.FromBytes(acc2.ToBytes()))
+	assert.Equal(acc1.Commitment(), acc3.Commitment())
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+
+	// Nothing is kept until the node starts keeping commitments.
+	assert.Nil(DbGetStateCommitment(db, uint32(chain.blockTip().Height)))
+	started, err := DbInitStateCommitments(db, true, uint32(chain.blockTip().Height))
+	require.NoError(err)
+	assert.True(started)
+	started, err = DbInitStateCommitments(db, true, uint32(chain.blockTip().Height))
+	require.NoError(err)
+	assert.False(started)
+
+	// The commitment kept for every block matches the utxo set as of the block.
+	expectedCommitment := func() *BlockHash {
+		acc, err := DbComputeStateAccumulator(db)
+		require.NoError(err)
+		return acc.Commitment()
+	}
+	commitments := make(map[uint32]*BlockHash)
+	for ii := 0; ii < 3; ii++ {
+		if ii > 0 {
+			_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+			require.NoError(err)
+		}
+		tipHeight := uint32(chain.blockTip().Height)
+		commitments[tipHeight] = DbGetStateCommitment(db, tipHeight)
+		assert.Equal(expectedCommitment(), commitments[tipHeight])
+	}
+	assert.Equal(3, len(commitments))
+
+	// The tip's commitment has to match the accumulator for the tip to pass the
+	// consistency check.
+	require.NoError(VerifyTipConsistency(db))
+	tipHeight := uint32(chain.blockTip().Height)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbPutStateCommitmentWithTxn(txn, tipHeight, commitments[tipHeight-1])
+	}))
+	err = VerifyTipConsistency(db)
+	require.Error(err)
+	assert.Contains(err.Error(), "state commitment")
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbPutStateCommitmentWithTxn(txn, tipHeight, commitments[tipHeight])
+	}))
+	require.NoError(VerifyTipConsistency(db))
+
+	// Disconnecting the tip puts the accumulator back and drops the commitment
+	// for the block.
+	block, err := GetBlock(chain.blockTip().Hash, db)
+	require.NoError(err)
+	utxoOps, err := GetUtxoOperationsForBlock(db, chain.blockTip().Hash)
+	require.NoError(err)
+	txHashes, err := ComputeTransactionHashes(block.Txns)
+	require.NoError(err)
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+	require.NoError(utxoView.DisconnectBlock(block, txHashes, utxoOps))
+	require.NoError(utxoView.FlushToDb())
+	assert.Nil(DbGetStateCommitment(db, tipHeight))
+	assert.Equal(commitments[tipHeight-1], DbGetStateCommitment(db, tipHeight-1))
+	assert.Equal(expectedCommitment(), DbGetStateCommitment(db, tipHeight-1))
+
+	// Every committed key the view flushes moves the accumulator, not just the
+	// utxos. The time-ordered indexes aren't committed to.
+	senderPkBytes, _, err := Base58CheckDecode(senderPkString)
+	require.NoError(err)
+	postEntry := &PostEntry{
+		PostHash:        &BlockHash{1},
+		PosterPublicKey: senderPkBytes,
+		Body:            []byte("{}"),
+		TimestampNanos:  1,
+	}
+	tstampKey := _dbKeyForTstampPostHash(postEntry.TimestampNanos, postEntry.PostHash)
+	assert.True(IsStateCommitmentDbKey(_dbKeyForPostEntryHash(postEntry.PostHash)))
+	assert.False(IsStateCommitmentDbKey(tstampKey))
+	assert.False(IsStateCommitmentDbKey(_KeyStateAccumulator))
+	assert.False(IsStateCommitmentDbKey(_PrefixBlockHashToBlock))
+	utxoView._setPostEntryMappings(postEntry)
+	require.NoError(utxoView.FlushToDb())
+	assert.NotEqual(commitments[tipHeight-1], DbGetStateCommitment(db, tipHeight-1))
+	assert.Equal(expectedCommitment(), DbGetStateCommitment(db, tipHeight-1))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		_, err := txn.Get(tstampKey)
+		require.NoError(err)
+		return txn.Delete(tstampKey)
+	}))
+	assert.Equal(expectedCommitment(), DbGetStateCommitment(db, tipHeight-1))
+
+	// A view flushed through a write batch moves the accumulator the same way.
+	postEntry.isDeleted = true
+	utxoView._setPostEntryMappings(postEntry)
+	numWrites := uint64(0)
+	require.NoError(utxoView.FlushToDbWithWriteBatch(1, func(numWritesSoFar uint64) {
+		numWrites = numWritesSoFar
+	}))
+	assert.NotZero(numWrites)
+	assert.Equal(expectedCommitment(), DbGetStateCommitment(db, tipHeight-1))
+	assert.Nil(DBGetPostEntryByPostHash(db, postEntry.PostHash))
+	assert.Nil(DbGetCrashBreadcrumb(db))
+
+	// Recording a migration drops the accumulator since migrations write state
+	// without flushing a view, and starting up again builds it.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, "test-migration", IndexMigrationStateBackfillComplete)
+	}))
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		acc, err := DbGetStateAccumulatorWithTxn(txn)
+		assert.Nil(acc)
+		return err
+	}))
+	started, err = DbInitStateCommitments(db, true, tipHeight-1)
+	require.NoError(err)
+	assert.True(started)
+	assert.Equal(expectedCommitment(), DbGetStateCommitment(db, tipHeight-1))
+
+	// An accumulator from before every prefix was committed to is built again.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForIndexMigrationState(stateCommitmentPrefixesMigrationName))
+	}))
+	started, err = DbInitStateCommitments(db, true, tipHeight-1)
+	require.NoError(err)
+	assert.True(started)
+
+	// Stopping deletes every commitment.
+	started, err = DbInitStateCommitments(db, false, tipHeight-1)
+	require.NoError(err)
+	assert.False(started)
+	assert.Nil(DbGetStateCommitment(db, tipHeight-1))
+}
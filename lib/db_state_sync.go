@@ -0,0 +1,475 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// State sync lets a node fetch the chain state from a peer a chunk at a time
+// instead of downloading and connecting every block. It uses the same per-prefix
+// layout as a db snapshot: a peer serves the keys under one prefix at a time, in
+// key order, starting from wherever the last chunk left off, and the node keeps a
+// rolling sha256 of the snapshot records for each prefix as it applies them. Once
+// a prefix is done the checksum has to match the one in the DbSnapshotManifest
+// the sync was started with, which the node gets from somewhere it trusts.
+//
+// A sync takes many chunks and the chain keeps moving while it runs, so peers
+// don't serve chunks from their live db. A DbStateChunkServer pins the state at
+// every block whose height is a multiple of StateSyncSnapshotPeriodBlocks and
+// serves chunks from the pinned state a request names, so manifests made at those
+// heights line up with what every peer serves. SyncStateFromPeer drives a sync
+// against one peer before the node starts.
+
+const (
+	// MaxStateChunkKeys is the most keys a peer will put in a single chunk.
+	MaxStateChunkKeys = 10000
+	// MaxStateChunkBytes is roughly the most key and value bytes a peer will put
+	// in a single chunk. A chunk always has at least one key.
+	MaxStateChunkBytes = 10 * 1024 * 1024
+
+	// StateSyncSnapshotPeriodBlocks is how often, in blocks, a DbStateChunkServer
+	// pins the state it serves.
+	StateSyncSnapshotPeriodBlocks = 1000
+
+	// StateChunkRequestsPerSecond is how many GET_STATE_CHUNK requests a peer can
+	// make per second on average, and StateChunkRequestBurst is how many it can
+	// make at once. Requests past that are dropped. See
+	// Peer.AllowStateChunkRequest.
+	StateChunkRequestsPerSecond = 4
+	StateChunkRequestBurst      = 8
+
+	// StateSyncChunkTimeout is how long SyncStateFromPeer waits for each chunk.
+	StateSyncChunkTimeout = 60 * time.Second
+)
+
+// DbStateChunk is a run of consecutive keys under a prefix.
+type DbStateChunk struct {
+	// The tip of the chain the chunk was read at.
+	BlockHash *BlockHash
+	Prefix    []byte
+	Keys      [][]byte
+	Values    [][]byte
+	// The key the next chunk starts at, or nil if this is the last chunk for
+	// the prefix.
+	NextKey []byte
+}
+
+// DbServeStateChunk reads up to limit keys under prefix starting at startKey, or
+// at the start of the prefix if startKey is empty, from the live db. Peers serve
+// chunks from a DbStateChunkServer instead.
+func DbServeStateChunk(handle *badger.DB, prefix []byte, startKey []byte, limit int) (*DbStateChunk, error) {
+	var chunk *DbStateChunk
+	err := DbView(handle, func(txn KVTxn) error {
+		var err error
+		chunk, err = DbServeStateChunkWithTxn(txn, prefix, startKey, limit)
+		return err
+	})
+	return chunk, err
+}
+
+// DbServeStateChunkWithTxn is DbServeStateChunk for the state a txn sees. The
+// prefix has to be one of the prefixes in DbPrefixRegistry that aren't
+// node-local.
+func DbServeStateChunkWithTxn(txn KVTxn, prefix []byte, startKey []byte, limit int) (*DbStateChunk, error) {
+	prefixFound := false
+	for _, prefixInfo := range DbPrefixRegistry {
+		if bytes.Equal(prefixInfo.Prefix, prefix) && !IsLocalOnlyDbKey(prefix) {
+			prefixFound = true
+			break
+		}
+	}
+	if !prefixFound {
+		return nil, fmt.Errorf("DbServeStateChunkWithTxn: Prefix %v can't be synced", prefix)
+	}
+	if len(startKey) == 0 {
+		startKey = prefix
+	}
+	if !bytes.HasPrefix(startKey, prefix) {
+		return nil, fmt.Errorf("DbServeStateChunkWithTxn: Start key %v isn't under prefix %v", startKey, prefix)
+	}
+	if limit <= 0 || limit > MaxStateChunkKeys {
+		limit = MaxStateChunkKeys
+	}
+
+	chunk := &DbStateChunk{
+		Prefix: prefix,
+	}
+	err := func() error {
+		chunk.BlockHash = _getBlockHashForPrefixWithTxn(txn, _KeyBestBitCloutBlockHash)
+		if chunk.BlockHash == nil {
+			return fmt.Errorf("The db doesn't have a chain to serve")
+		}
+
+		opts := KVIteratorOptions{}
+		opts.Prefix = prefix
+		nodeIterator := txn.NewIterator(opts)
+		defer nodeIterator.Close()
+
+		numBytes := 0
+		for nodeIterator.Seek(startKey); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+			if IsLocalOnlyDbKey(nodeIterator.Key()) {
+				continue
+			}
+			if len(chunk.Keys) >= limit || (len(chunk.Keys) > 0 && numBytes >= MaxStateChunkBytes) {
+				chunk.NextKey = append([]byte{}, nodeIterator.Key()...)
+				return nil
+			}
+			val, err := nodeIterator.Value()
+			if err != nil {
+				return errors.Wrapf(err, "Problem reading value for key %v", nodeIterator.Key())
+			}
+			chunk.Keys = append(chunk.Keys, append([]byte{}, nodeIterator.Key()...))
+			chunk.Values = append(chunk.Values, val)
+			numBytes += len(nodeIterator.Key()) + len(val)
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbServeStateChunkWithTxn: ")
+	}
+	return chunk, nil
+}
+
+// dbPinnedState is a read-only txn held open at the block it was pinned at.
+type dbPinnedState struct {
+	blockHash *BlockHash
+	txn       *badger.Txn
+}
+
+// DbStateChunkServer serves state chunks from read-only txns pinned at the blocks
+// whose heights are multiples of its period, so a peer can keep syncing against
+// the same state while the node connects new blocks. Badger can't throw away the
+// versions a pinned txn can still see, so it only keeps the last two pins: the
+// newest, and the one before it so syncs that started on it can finish. A node
+// that just started doesn't serve anything until it connects the next block at
+// one of the heights.
+type DbStateChunkServer struct {
+	handle       *badger.DB
+	periodBlocks uint32
+
+	mtx    sync.Mutex
+	pinned []*dbPinnedState
+}
+
+func NewDbStateChunkServer(handle *badger.DB, periodBlocks uint32) *DbStateChunkServer {
+	return &DbStateChunkServer{
+		handle:       handle,
+		periodBlocks: periodBlocks,
+	}
+}
+
+// MaybePin pins the state if blockHash is the tip and its height is a multiple of
+// the period. It should be called as soon as the block is connected, with the
+// chain lock still held so the tip can't move first.
+func (chunkServer *DbStateChunkServer) MaybePin(blockHash *BlockHash, blockHeight uint32) error {
+	if chunkServer.periodBlocks == 0 || blockHeight%chunkServer.periodBlocks != 0 {
+		return nil
+	}
+
+	txn := chunkServer.handle.NewTransaction(false)
+	bestHash := _getBlockHashForPrefixWithTxn(NewBadgerKVTxn(txn), _KeyBestBitCloutBlockHash)
+	if bestHash == nil || *bestHash != *blockHash {
+		txn.Discard()
+		return fmt.Errorf("DbStateChunkServer.MaybePin: Block %v isn't the tip %v",
+			blockHash, bestHash)
+	}
+
+	chunkServer.mtx.Lock()
+	defer chunkServer.mtx.Unlock()
+	chunkServer.pinned = append(chunkServer.pinned, &dbPinnedState{
+		blockHash: blockHash,
+		txn:       txn,
+	})
+	if len(chunkServer.pinned) > 2 {
+		chunkServer.pinned[0].txn.Discard()
+		chunkServer.pinned = chunkServer.pinned[1:]
+	}
+	return nil
+}
+
+// ServeStateChunk serves a chunk from the state pinned at blockHash.
+func (chunkServer *DbStateChunkServer) ServeStateChunk(blockHash *BlockHash, prefix []byte,
+	startKey []byte, limit int) (*DbStateChunk, error) {
+
+	chunkServer.mtx.Lock()
+	defer chunkServer.mtx.Unlock()
+	for _, pinnedState := range chunkServer.pinned {
+		if blockHash != nil && *pinnedState.blockHash == *blockHash {
+			return DbServeStateChunkWithTxn(NewBadgerKVTxn(pinnedState.txn), prefix, startKey, limit)
+		}
+	}
+	return nil, fmt.Errorf("DbStateChunkServer.ServeStateChunk: No state pinned at %v", blockHash)
+}
+
+// Close discards the pinned txns.
+func (chunkServer *DbStateChunkServer) Close() {
+	chunkServer.mtx.Lock()
+	defer chunkServer.mtx.Unlock()
+	for _, pinnedState := range chunkServer.pinned {
+		pinnedState.txn.Discard()
+	}
+	chunkServer.pinned = nil
+}
+
+// dbStateSyncPrefix is where a DbStateSyncer is in a single prefix.
+type dbStateSyncPrefix struct {
+	snapshotPrefix *DbSnapshotPrefix
+	nextKey        []byte
+	numKeys        uint64
+	hasher         hash.Hash
+	done           bool
+}
+
+// DbStateSyncer applies state chunks from peers to a db that doesn't have a chain
+// yet, checking each prefix against a snapshot manifest. It isn't safe for
+// concurrent use.
+type DbStateSyncer struct {
+	handle   *badger.DB
+	manifest *DbSnapshotManifest
+	prefixes map[string]*dbStateSyncPrefix
+}
+
+func NewDbStateSyncer(handle *badger.DB, params *BitCloutParams, manifest *DbSnapshotManifest) (*DbStateSyncer, error) {
+	if DbGetBestHash(handle, ChainTypeBitCloutBlock) != nil {
+		return nil, fmt.Errorf("NewDbStateSyncer: The db already has a chain")
+	}
+	if manifest.Version != DbSnapshotVersion {
+		return nil, fmt.Errorf("NewDbStateSyncer: Manifest has version %d but "+
+			"only version %d is supported", manifest.Version, DbSnapshotVersion)
+	}
+	if manifest.NetworkType != params.NetworkType {
+		return nil, fmt.Errorf("NewDbStateSyncer: Manifest is for network %v "+
+			"but the node is on %v", manifest.NetworkType, params.NetworkType)
+	}
+
+	syncer := &DbStateSyncer{
+		handle:   handle,
+		manifest: manifest,
+		prefixes: make(map[string]*dbStateSyncPrefix),
+	}
+	for _, snapshotPrefix := range manifest.Prefixes {
+		syncer.prefixes[string(snapshotPrefix.Prefix)] = &dbStateSyncPrefix{
+			snapshotPrefix: snapshotPrefix,
+			hasher:         sha256.New(),
+		}
+	}
+	return syncer, nil
+}
+
+// NextChunkToRequest returns a prefix that hasn't been synced yet along with the
+// key to request the next chunk from. It returns false once every prefix is done.
+func (syncer *DbStateSyncer) NextChunkToRequest() (_prefix []byte, _startKey []byte, _ok bool) {
+	for _, snapshotPrefix := range syncer.manifest.Prefixes {
+		syncPrefix := syncer.prefixes[string(snapshotPrefix.Prefix)]
+		if !syncPrefix.done {
+			return snapshotPrefix.Prefix, syncPrefix.nextKey, true
+		}
+	}
+	return nil, nil, false
+}
+
+// ApplyStateChunk writes a chunk to the db and returns whether its prefix is done.
+// Chunks for a prefix have to be applied in order. The best block hash is held
+// back until Finish so a node that dies partway through doesn't look synced. Once
+// it returns an error the sync has to start over with a fresh db.
+func (syncer *DbStateSyncer) ApplyStateChunk(chunk *DbStateChunk) (_prefixDone bool, _err error) {
+	if chunk.BlockHash == nil || *chunk.BlockHash != *syncer.manifest.BlockHash {
+		return false, fmt.Errorf("ApplyStateChunk: Chunk was read at tip %v but "+
+			"the manifest is for tip %v", chunk.BlockHash, syncer.manifest.BlockHash)
+	}
+	syncPrefix, exists := syncer.prefixes[string(chunk.Prefix)]
+	if !exists {
+		return false, fmt.Errorf("ApplyStateChunk: Prefix %v isn't in the manifest", chunk.Prefix)
+	}
+	if syncPrefix.done {
+		return false, fmt.Errorf("ApplyStateChunk: Prefix %s is already done",
+			syncPrefix.snapshotPrefix.Name)
+	}
+	if len(chunk.Keys) != len(chunk.Values) {
+		return false, fmt.Errorf("ApplyStateChunk: Chunk has %d keys but %d values",
+			len(chunk.Keys), len(chunk.Values))
+	}
+	if len(chunk.Keys) == 0 && chunk.NextKey != nil {
+		return false, fmt.Errorf("ApplyStateChunk: Chunk is empty but isn't the last one")
+	}
+
+	// The chunk has to start where the last one left off and its keys have to
+	// be in order so the checksum covers the records in the same order the
+	// snapshot file would have them.
+	var lastKey []byte
+	for ii, key := range chunk.Keys {
+		if !bytes.HasPrefix(key, chunk.Prefix) || IsLocalOnlyDbKey(key) {
+			return false, fmt.Errorf("ApplyStateChunk: Key %v can't be synced under "+
+				"prefix %v", key, chunk.Prefix)
+		}
+		if (ii == 0 && syncPrefix.nextKey != nil && !bytes.Equal(key, syncPrefix.nextKey)) ||
+			(ii > 0 && bytes.Compare(key, lastKey) <= 0) {
+
+			return false, fmt.Errorf("ApplyStateChunk: Key %v is out of order", key)
+		}
+		lastKey = key
+	}
+	if chunk.NextKey != nil && bytes.Compare(chunk.NextKey, lastKey) <= 0 {
+		return false, fmt.Errorf("ApplyStateChunk: Next key %v is out of order", chunk.NextKey)
+	}
+
+	isBestHash := bytes.Equal(chunk.Prefix, _KeyBestBitCloutBlockHash)
+	err := DbUpdateWithWriteBatch(syncer.handle, 0, nil, func(dbWriteBatch *DbWriteBatch) error {
+		for ii, key := range chunk.Keys {
+			syncPrefix.hasher.Write(_dbSnapshotRecord(key, chunk.Values[ii]))
+			syncPrefix.numKeys++
+			if isBestHash {
+				continue
+			}
+			if err := dbWriteBatch.Set(key, chunk.Values[ii]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "ApplyStateChunk: Problem writing chunk")
+	}
+	syncPrefix.nextKey = chunk.NextKey
+	if chunk.NextKey != nil {
+		return false, nil
+	}
+
+	if syncPrefix.numKeys != syncPrefix.snapshotPrefix.NumKeys {
+		return false, fmt.Errorf("ApplyStateChunk: Prefix %s has %d keys but the "+
+			"manifest says %d", syncPrefix.snapshotPrefix.Name, syncPrefix.numKeys,
+			syncPrefix.snapshotPrefix.NumKeys)
+	}
+	if checksum := hex.EncodeToString(syncPrefix.hasher.Sum(nil)); checksum != syncPrefix.snapshotPrefix.Checksum {
+		return false, fmt.Errorf("ApplyStateChunk: Prefix %s has checksum %s but the "+
+			"manifest says %s", syncPrefix.snapshotPrefix.Name, checksum,
+			syncPrefix.snapshotPrefix.Checksum)
+	}
+	syncPrefix.done = true
+	return true, nil
+}
+
+// Finish writes the prune height and the best block hash once every prefix is
+// done. The node picks up from the manifest's tip when the chain is initialized.
+func (syncer *DbStateSyncer) Finish() error {
+	if prefix, _, ok := syncer.NextChunkToRequest(); ok {
+		return fmt.Errorf("DbStateSyncer.Finish: Prefix %v isn't done", prefix)
+	}
+	err := DbUpdate(syncer.handle, func(txn KVTxn) error {
+		if syncer.manifest.PruneHeight > 0 {
+			if err := DbPutPruneHeightWithTxn(txn, syncer.manifest.PruneHeight); err != nil {
+				return err
+			}
+		}
+		return PutBestHashWithTxn(txn, syncer.manifest.BlockHash, ChainTypeBitCloutBlock)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "DbStateSyncer.Finish: ")
+	}
+	return nil
+}
+
+// SyncStateFromPeer syncs the state in manifest from the peer at addr into a db
+// that doesn't have a chain yet. It runs before the Server starts and talks to
+// the peer directly, one chunk at a time, never asking faster than the peer's
+// rate limit allows. The peer has to have pinned the state at the manifest's
+// tip, so manifests should be made at a multiple of
+// StateSyncSnapshotPeriodBlocks.
+func SyncStateFromPeer(handle *badger.DB, params *BitCloutParams,
+	manifest *DbSnapshotManifest, addr string) error {
+
+	syncer, err := NewDbStateSyncer(handle, params, manifest)
+	if err != nil {
+		return errors.Wrapf(err, "SyncStateFromPeer: ")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, params.DialTimeout)
+	if err != nil {
+		return errors.Wrapf(err, "SyncStateFromPeer: Problem connecting to %s", addr)
+	}
+	// The peer isn't managed by a ConnectionManager or a Server, so it only
+	// needs enough set up to negotiate a version and trade messages.
+	pp := NewPeer(conn, true /*isOutbound*/, nil, false, 0, false, "", 0, params, nil, nil, nil)
+	defer pp.Disconnect()
+	if err := pp.NegotiateVersion(params.VersionNegotiationTimeout); err != nil {
+		return errors.Wrapf(err, "SyncStateFromPeer: ")
+	}
+
+	requestTicker := time.NewTicker(time.Second / StateChunkRequestsPerSecond)
+	defer requestTicker.Stop()
+	numPrefixesDone := 0
+	for {
+		prefix, startKey, ok := syncer.NextChunkToRequest()
+		if !ok {
+			break
+		}
+		<-requestTicker.C
+
+		err := pp.WriteBitCloutMessage(&MsgBitCloutGetStateChunk{
+			BlockHash: manifest.BlockHash,
+			Prefix:    prefix,
+			StartKey:  startKey,
+			Limit:     MaxStateChunkKeys,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "SyncStateFromPeer: Problem requesting chunk")
+		}
+		chunk, err := _readStateChunkFromPeer(pp)
+		if err != nil {
+			return errors.Wrapf(err, "SyncStateFromPeer: ")
+		}
+		if !bytes.Equal(chunk.Prefix, prefix) {
+			return fmt.Errorf("SyncStateFromPeer: Asked for prefix %v but got %v",
+				prefix, chunk.Prefix)
+		}
+		prefixDone, err := syncer.ApplyStateChunk(chunk)
+		if err != nil {
+			return errors.Wrapf(err, "SyncStateFromPeer: ")
+		}
+		if prefixDone {
+			numPrefixesDone++
+			glog.Infof("SyncStateFromPeer: Synced %d of %d prefixes",
+				numPrefixesDone, len(manifest.Prefixes))
+		}
+	}
+
+	if err := syncer.Finish(); err != nil {
+		return errors.Wrapf(err, "SyncStateFromPeer: ")
+	}
+	return nil
+}
+
+// _readStateChunkFromPeer reads messages from the peer until it sends a chunk,
+// answering pings and ignoring everything else a node sends a new peer.
+func _readStateChunkFromPeer(pp *Peer) (*DbStateChunk, error) {
+	for {
+		var msg BitCloutMessage
+		err := pp.readWithTimeout(func() error {
+			var err error
+			msg, err = pp.ReadBitCloutMessage()
+			return err
+		}, StateSyncChunkTimeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Problem reading chunk from Peer %v", pp)
+		}
+
+		switch msg := msg.(type) {
+		case *MsgBitCloutStateChunk:
+			return msg.Chunk, nil
+		case *MsgBitCloutPing:
+			if err := pp.WriteBitCloutMessage(&MsgBitCloutPong{Nonce: msg.Nonce}); err != nil {
+				return nil, errors.Wrapf(err, "Problem answering ping from Peer %v", pp)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbStateSync(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, db := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 3; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+
+	// Returns every key and value in the db that isn't node-local.
+	chainState := func(handle *badger.DB) map[string][]byte {
+		state := make(map[string][]byte)
+		require.NoError(DbView(handle, func(txn KVTxn) error {
+			it := txn.NewIterator(KVIteratorOptions{})
+			defer it.Close()
+			for it.Seek(nil); it.Valid(); it.Next() {
+				if IsLocalOnlyDbKey(it.Key()) {
+					continue
+				}
+				val, err := it.Value()
+				require.NoError(err)
+				state[string(it.Key())] = val
+			}
+			return nil
+		}))
+		return state
+	}
+
+	manifest, err := DbGetSnapshotManifest(db, params)
+	require.NoError(err)
+	assert.Equal(*chain.blockTip().Hash, *manifest.BlockHash)
+	pinnedState := chainState(db)
+
+	// Node-local prefixes aren't served.
+	_, err = DbServeStateChunk(db, _KeyNodeConfig, nil, 10)
+	require.Error(err)
+
+	// Pin the state at the tip, then move the chain on so the live db no longer
+	// matches the manifest. Only the tip can be pinned, and only at the period.
+	chunkServer := NewDbStateChunkServer(db, 1)
+	defer chunkServer.Close()
+	pinnedHash := chain.blockTip().Hash
+	require.NoError(chunkServer.MaybePin(pinnedHash, chain.blockTip().Height))
+	require.NoError(NewDbStateChunkServer(db, 1000).MaybePin(pinnedHash, chain.blockTip().Height))
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	require.Error(chunkServer.MaybePin(pinnedHash, chain.blockTip().Height-1))
+	_, err = chunkServer.ServeStateChunk(chain.blockTip().Hash, _PrefixBlockHashToBlock, nil, 2)
+	require.Error(err)
+
+	// Sync two keys at a time, sending each chunk over the wire.
+	syncedDb, syncedDir := GetTestBadgerDb()
+	defer os.RemoveAll(syncedDir)
+	syncer, err := NewDbStateSyncer(syncedDb, params, manifest)
+	require.NoError(err)
+	numChunks := 0
+	for {
+		prefix, startKey, ok := syncer.NextChunkToRequest()
+		if !ok {
+			break
+		}
+		requestBytes, err := (&MsgBitCloutGetStateChunk{
+			BlockHash: manifest.BlockHash,
+			Prefix:    prefix,
+			StartKey:  startKey,
+			Limit:     2,
+		}).ToBytes(false)
+		require.NoError(err)
+		requestMsg := &MsgBitCloutGetStateChunk{}
+		require.NoError(requestMsg.FromBytes(requestBytes))
+		chunk, err := chunkServer.ServeStateChunk(requestMsg.BlockHash, requestMsg.Prefix,
+			requestMsg.StartKey, int(requestMsg.Limit))
+		require.NoError(err)
+		chunkBytes, err := (&MsgBitCloutStateChunk{Chunk: chunk}).ToBytes(false)
+		require.NoError(err)
+		chunkMsg := &MsgBitCloutStateChunk{}
+		require.NoError(chunkMsg.FromBytes(chunkBytes))
+		assert.Equal(chunk.BlockHash, chunkMsg.Chunk.BlockHash)
+		assert.Equal(chunk.Keys, chunkMsg.Chunk.Keys)
+		assert.Equal(chunk.NextKey, chunkMsg.Chunk.NextKey)
+
+		_, err = syncer.ApplyStateChunk(chunkMsg.Chunk)
+		require.NoError(err)
+		numChunks++
+
+		// The synced db doesn't look like it has a chain until it's done.
+		assert.Nil(DbGetBestHash(syncedDb, ChainTypeBitCloutBlock))
+	}
+	assert.True(numChunks > len(manifest.Prefixes))
+	require.NoError(syncer.Finish())
+	assert.Equal(pinnedState, chainState(syncedDb))
+
+	// Only the last two pins are kept.
+	for ii := 0; ii < 2; ii++ {
+		_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+		require.NoError(chunkServer.MaybePin(chain.blockTip().Hash, chain.blockTip().Height))
+	}
+	_, err = chunkServer.ServeStateChunk(pinnedHash, _PrefixBlockHashToBlock, nil, 2)
+	require.Error(err)
+	_, err = chunkServer.ServeStateChunk(chain.blockTip().Hash, _PrefixBlockHashToBlock, nil, 2)
+	require.NoError(err)
+
+	// A chunk with a value that doesn't match the manifest fails the prefix's
+	// checksum, and one read at another tip is rejected outright.
+	badDb, badDir := GetTestBadgerDb()
+	defer os.RemoveAll(badDir)
+	syncer, err = NewDbStateSyncer(badDb, params, manifest)
+	require.NoError(err)
+	chunk, err := DbServeStateChunk(db, _PrefixBlockHashToBlock, nil, MaxStateChunkKeys)
+	require.NoError(err)
+	chunk.Values[0] = append([]byte{}, chunk.Values[0]...)
+	chunk.Values[0][0]++
+	_, err = syncer.ApplyStateChunk(chunk)
+	require.Error(err)
+	chunk.BlockHash = &BlockHash{}
+	_, err = syncer.ApplyStateChunk(chunk)
+	require.Error(err)
+}
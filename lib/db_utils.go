@@ -2,7 +2,9 @@ package lib
 
 import (
 	"bytes"
+	"container/list"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
@@ -12,14 +14,19 @@ import (
 	"log"
 	"math"
 	"math/big"
+	"math/bits"
+	mrand "math/rand"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/btcsuite/btcd/btcec"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -102,8 +109,11 @@ var (
 	// Tracks the tip of the transaction index. This is used to determine
 	// which blocks need to be processed in order to update the index.
 	_KeyTransactionIndexTip = []byte{14}
-	// <prefix, transactionID BlockHash> -> <TransactionMetadata struct>
+	// <prefix, transactionID BlockHash> -> <TransactionMetadata>
 	_PrefixTransactionIDToMetadata = []byte{15}
+	// The old public key index, numbered per public key. Replaced by
+	// _PrefixPublicKeyHeightTxnIndexTxID and only read by
+	// DbMigrateTxindexPublicKeyIndex.
 	// <prefix, publicKey []byte, index uint32> -> <txid BlockHash>
 	_PrefixPublicKeyIndexToTransactionIDs = []byte{16}
 	// <prefx, publicKey []byte> -> <index uint32>
@@ -126,7 +136,8 @@ var (
 
 	// Comments are just posts that have their ParentStakeID set, and
 	// so we have a separate index that allows us to return all the
-	// comments for a given StakeID
+	// comments for a given StakeID. Parent post hashes are padded with a
+	// zero byte to 33 bytes.
 	// <prefix, parent stakeID [33]byte, tstampnanos uint64, post hash> -> <>
 	_PrefixCommentParentStakeIDToPostHash = []byte{22}
 
@@ -144,7 +155,8 @@ var (
 	// the amount of BitClout locked in a profile is proportional to coin price).
 	_PrefixCreatorBitCloutLockedNanosCreatorPKID = []byte{32}
 
-	// The StakeID is a post hash for posts and a public key for users.
+	// The StakeID is a post hash for posts and a public key for users. Post
+	// hashes are stored as-is, without the padding HashToStakeID adds.
 	// <StakeIDType | AmountNanos uint64 | StakeID [var]byte> -> <>
 	_PrefixStakeIDTypeAmountStakeIDIndex = []byte{26}
 
@@ -176,16 +188,15 @@ var (
 	_PrefixPKIDToPublicKey = []byte{37}
 
 	// Prefix for storing mempool transactions in badger. These stored transactions are
-	// used to restore the state of a node after it is shutdown.
-	// <prefix, tx hash BlockHash> -> <*MsgBitCloutTxn>
+	// used to restore the state of a node after it is shutdown. The time the txn
+	// was added is kept in the value so a txn that's written again overwrites
+	// its entry rather than adding a second one.
+	// <prefix, tx hash BlockHash> -> <time added uint64, *MsgBitCloutTxn>
 	_PrefixMempoolTxnHashToMsgBitCloutTxn = []byte{38}
 
 	// Prefixes for Reclouts:
-	// <prefix, user pub key [39]byte, reclouted post hash [39]byte> -> RecloutEntry
+	// <prefix, user pub key [33]byte, reclouted post hash [32]byte> -> RecloutEntry
 	_PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash = []byte{39}
-	// TODO: This process is a bit error-prone. We should come up with a test or
-	// something to at least catch cases where people have two prefixes with the
-	// same ID.
 
 	// Prefixes for diamonds:
 	//  <prefix, DiamondReceiverPKID [33]byte, DiamondSenderPKID [33]byte, posthash> -> <gob-encoded DiamondEntry>
@@ -197,9 +208,490 @@ var (
 	// <prefix, ForbiddenPublicKey [33]byte> -> <>
 	_PrefixForbiddenBlockSignaturePubKeys = []byte{44}
 
-	// NEXT_TAG: 45
+	// Set at the start of InitDbWithBitCloutGenesisBlock and removed once every
+	// step of the initialization has succeeded. If this key is present at startup
+	// it means a previous initialization failed part-way through.
+	// <key> -> <>
+	_KeyGenesisInitInProgress = []byte{45}
+
+	// A report for each seed txn that was connected at genesis. This lets people
+	// bootstrapping a chain verify that the seed txns were applied the way they
+	// expected without having to re-derive everything from the hex in the params.
+	// <prefix, txn index uint32 (big-endian)> -> <SeedTxnReport gob serialized>
+	_PrefixSeedTxnIndexToReport = []byte{46}
+
+	// When an index is moved to a new key format, this tracks how far along the
+	// migration is. See DbIndexMigration for how this is used.
+	// <prefix, migration name []byte> -> <DbIndexMigrationState uint8>
+	_PrefixIndexMigrationNameToState = []byte{47}
+
+	// Usernames that were recently given up by the profile that owned them. The
+	// username is always lowercased.
+	// <prefix, username> -> <ReleasedUsernameEntry gob serialized>
+	_PrefixReleasedUsernameToReleasedUsernameEntry = []byte{48}
+
+	// Records the first post or profile that used a particular image. This makes
+	// it easy to spot a stolen avatar or the same image being spammed over and
+	// over. For posts the hash is computed over each image URL and for profiles
+	// it is computed over the profile pic bytes.
+	// <prefix, content hash [32]byte> -> <ContentHashFirstSeenEntry gob serialized>
+	_PrefixContentHashToFirstSeenEntry = []byte{49}
+
+	// Profiles indexed by a normalized form of their username in which characters
+	// that are easy to confuse with each other are folded together. All of the
+	// PKIDs whose usernames normalize to the same value share a seek prefix, which
+	// makes it cheap to look for accounts impersonating a given username. The zero
+	// byte separates the variable-length name from the PKID and can't appear in a
+	// normalized username.
+	// <prefix, normalized username, 0x00, PKID [33]byte> -> <>
+	_PrefixNormalizedUsernamePKID = []byte{50}
+
+	// Daily aggregates of the txns connected to the main chain, broken down by
+	// txn type. The day is the number of days since the unix epoch according to
+	// the timestamp in the block header.
+	// <prefix, day uint64 (big-endian), TxnType uint8> -> <TxnDailyStatsEntry gob serialized>
+	_PrefixDayTxnTypeToTxnDailyStats = []byte{51}
+
+	// Signed post txns that are held by the node until they should be published,
+	// at which point they are submitted to the mempool and removed. The draft hash
+	// is the hash of the txn.
+	// <prefix, publishAtTstampNanos uint64 (big-endian), draftHash BlockHash> -> <MsgBitCloutTxn bytes>
+	_PrefixPublishAtTstampDraftHashToScheduledPostTxn = []byte{52}
+
+	// Content that is stored locally on behalf of a public key, like drafts and
+	// bookmarks. This is never touched when connecting or flushing txns and is not
+	// part of the chain state. See LocalOnlyDbPrefixes.
+	// <prefix, public key, len(namespace) uvarint, namespace, key> -> <LocalContentEntry gob serialized>
+	_PrefixPublicKeyNamespaceKeyToLocalContent = []byte{53}
+
+	// Records the txn that spent each utxo on the main chain. The txn that created
+	// the utxo is the TxID in the key. Entries are removed when the spending block
+	// is disconnected.
+	// <prefix, txid BlockHash, output index uint32 (big-endian)> -> <UtxoSpendEntry gob serialized>
+	_PrefixUtxoKeyToUtxoSpendEntry = []byte{54}
+
+	// Set before a multi-step write to the db, like connecting a block or
+	// flushing a view, and deleted once it succeeds. If this key is present at
+	// startup it means the node died in the middle of the operation it names.
+	// See DbCrashBreadcrumb.
+	// <key> -> <DbCrashBreadcrumb gob serialized>
+	_KeyCrashBreadcrumb = []byte{55}
+
+	// The activation height of each protocol fork along with how many main chain
+	// blocks have signaled support for it. See ForkState.
+	// <prefix, fork name []byte> -> <ForkState gob serialized>
+	_PrefixForkNameToForkState = []byte{56}
+
+	// Messages indexed by conversation so that a thread between two public keys
+	// can be loaded with a single prefix scan. The smaller public key always
+	// comes first so that each message is stored once per conversation.
+	// <prefix, smaller public key, larger public key, tstampNanos> -> <MessageEntry>
+	_PrefixPublicKeyPairTimestampToPrivateMessage = []byte{57}
+
+	// Disbursements made by a faucet service running against this node, indexed
+	// by the public key that received them and by a hash of the IP address that
+	// requested them. These are node-local. See LocalOnlyDbPrefixes.
+	// <prefix, public key, tstampNanos uint64> -> <FaucetDisbursement gob serialized>
+	// <prefix, ip hash [32]byte, tstampNanos uint64> -> <FaucetDisbursement gob serialized>
+	_PrefixPublicKeyTimestampToFaucetDisbursement = []byte{58}
+	_PrefixIPHashTimestampToFaucetDisbursement    = []byte{59}
+
+	// Messaging groups by owner and name. The name is at the end so that all of
+	// an owner's groups can be found with a prefix scan.
+	// <prefix, group owner public key, group key name> -> <MessagingGroupEntry gob serialized>
+	_PrefixGroupOwnerKeyNameToMessagingGroupEntry = []byte{60}
+
+	// Group messages stored once for each member of the group, including the
+	// owner, so a member can load a group's messages with a single prefix scan.
+	// <prefix, member public key, group id BlockHash, tstampNanos uint64> -> <GroupMessageEntry gob serialized>
+	_PrefixMemberGroupIDTimestampToGroupMessage = []byte{61}
+
+	// A private key generated the first time the node starts that identifies the
+	// node across restarts and upgrades. See DbGetOrCreateNodeIdentity.
+	// <key> -> <private key [32]byte>
+	_KeyNodeIdentity = []byte{62}
+
+	// Every version of the node that has run against this db.
+	// <prefix, tstampNanos uint64> -> <NodeVersionRecord gob serialized>
+	_PrefixTstampNanosToNodeVersion = []byte{63}
+
+	// Whether the operator has opted in to sharing anonymous network statistics.
+	// Absent means they haven't.
+	// <key> -> <bool byte>
+	_KeyTelemetryOptIn = []byte{64}
+
+	// Results of expensive read-only queries, like leaderboards, cached until the
+	// tip changes. See CacheGetOrCompute.
+	// <prefix, query hash [32]byte> -> <QueryCacheEntry gob serialized>
+	_PrefixQueryHashToQueryCacheEntry = []byte{65}
+
+	// The number of messages a public key has received after the last time it
+	// marked its messages as read, along with the tstamp it read up to. Kept up to
+	// date by DbPutMessageEntryWithTxn and DbDeleteMessageEntryMappingsWithTxn.
+	// <prefix, recipient public key> -> <unread count uint64, read up to tstampNanos uint64>
+	_PrefixPublicKeyToUnreadMessageCount = []byte{66}
+
+	// Things that happened to a PKID on the main chain, like being followed or
+	// receiving a diamond. Added when a block is connected and removed when it's
+	// disconnected. See DbGetNotificationsForPKID.
+	// <prefix, recipient PKID, tstampNanos uint64, type byte, txID BlockHash> -> <NotificationEntry gob serialized>
+	_PrefixPKIDTstampTypeTxIDToNotification = []byte{67}
+
+	// The notification keys each txn added so they can be removed exactly when
+	// its block is disconnected.
+	// <prefix, txID BlockHash> -> <[][]byte gob serialized>
+	_PrefixTxIDToNotificationKeys = []byte{68}
+
+	// How many likes, comments, and reclouts each post has. Kept up to date by the
+	// like, comment, and reclout mapping functions. See DBGetPostEngagementCounts.
+	// <prefix, post hash BlockHash> -> <likes uint64, comments uint64, reclouts uint64>
+	_PrefixPostHashToEngagementCounts = []byte{69}
+
+	// How many PKIDs each PKID follows and how many follow it. Kept up to date by
+	// DbPutFollowMappingsWithTxn and DbDeleteFollowMappingsWithTxn. See
+	// DbGetFollowCountsForPKID.
+	// <prefix, follower PKID [33]byte> -> <count uint64>
+	_PrefixPKIDToFollowingCount = []byte{70}
+	// <prefix, followed PKID [33]byte> -> <count uint64>
+	_PrefixPKIDToFollowerCount = []byte{71}
+
+	// The heights of the first and most recent txns involving each public key.
+	// Maintained by the txindex in its own db. See PublicKeyActivity.
+	// <prefix, public key [33]byte> -> <first seen height uint32, last active height uint32>
+	_PrefixPublicKeyToActivity = []byte{72}
+
+	// The number of diamonds and the sum of their levels for each post and for
+	// each pair of sender and receiver. Kept up to date by DbPutDiamondMappingsWithTxn
+	// and DbDeleteDiamondMappingsWithTxn. See DiamondTotals.
+	// <prefix, post hash BlockHash> -> <num diamonds uint64, total diamond level uint64>
+	_PrefixPostHashToDiamondTotals = []byte{73}
+	// <prefix, sender PKID [33]byte, receiver PKID [33]byte> -> <num diamonds uint64, total diamond level uint64>
+	_PrefixSenderPKIDReceiverPKIDToDiamondTotals = []byte{74}
+
+	// Every diamond given on the main chain, newest last for each receiver, so
+	// the diamonds a PKID received can be paged through by time. There's one
+	// entry per txn so upgrading a diamond adds an entry with the new level.
+	// Maintained by DbPutDiamondTimeIndexForBlockWithTxn and
+	// DbDeleteDiamondTimeIndexForBlockWithTxn. See DbGetRecentDiamondsReceived.
+	// <prefix, receiver PKID [33]byte, tstampNanos uint64, sender PKID [33]byte, post hash BlockHash> -> <DiamondEntry>
+	_PrefixReceiverPKIDTstampSenderPKIDPostHashToDiamond = []byte{75}
+	// The diamond time index key each txn added so the block can be disconnected
+	// even if a PKID changes in the meantime.
+	// <prefix, txID BlockHash> -> <diamond time index key>
+	_PrefixTxIDToDiamondTimeKey = []byte{76}
+
+	// Quote reclouts of each post ordered by when they were posted. Vanilla
+	// reclouts are in the reclout index instead. Maintained by
+	// DBPutPostEntryMappingsWithTxn and DBDeletePostEntryMappingsWithTxn. See
+	// DBGetQuoteRecloutsOfPost.
+	// <prefix, reclouted post hash BlockHash, tstampNanos uint64, quoting post hash BlockHash> -> <>
+	_PrefixRecloutedPostHashTstampQuotingPostHash = []byte{77}
+
+	// Settings the operator can tune for this node, like fetch limits. Absent
+	// means every setting has its default. See DbGetNodeConfig.
+	// <key> -> <NodeConfigEntry gob serialized>
+	_KeyNodeConfig = []byte{78}
+
+	// The reverse of _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash so
+	// the reclouters of a post can be listed without a full scan. See
+	// DbGetReclouterPubKeysForPostHash.
+	// <prefix, reclouted post hash BlockHash, reclouter public key [33]byte> -> <RecloutEntry>
+	_PrefixRecloutedPostHashReclouterPubKeyToRecloutEntry = []byte{79}
+
+	// What the legacy key normalization found and fixed the one time it ran.
+	// See DbNormalizeLegacyKeys.
+	// <key> -> <[]*KeyNormalizationReport gob serialized>
+	_KeyLegacyKeyNormalizationReports = []byte{80}
+
+	// Polls attached to posts. The vote counts aren't stored with the poll
+	// since they change on every vote. See DbGetPollEntry.
+	// <prefix, post hash BlockHash> -> <PollEntry gob serialized>
+	_PrefixPostHashToPollEntry = []byte{81}
+
+	// The number of votes for each option of a poll. Every option has an
+	// entry, starting at zero, from the moment the poll is created. See
+	// DbGetPollResults.
+	// <prefix, post hash BlockHash, option index uint64> -> <vote count uint64>
+	_PrefixPostHashOptionIndexToPollVoteCount = []byte{82}
+
+	// The option each user voted for in a poll. Users get one vote per poll.
+	// <prefix, post hash BlockHash, voter PKID [33]byte> -> <option index uint64>
+	_PrefixPostHashVoterPKIDToPollVote = []byte{83}
+
+	// The number of values under each prefix that this node has failed to
+	// decode. See DbGetDecodeFailureCounts.
+	// <prefix, db prefix []byte> -> <count uint64>
+	_PrefixDbPrefixToDecodeFailureCount = []byte{84}
+
+	// Blocks stored when the node config has DedupeBlockTxns set. A deduped
+	// block is the block without its txns followed by the hashes of its txns,
+	// and each txn is stored once under its hash no matter how many blocks
+	// contain it. See PutBlockWithTxn.
+	// <prefix, block hash BlockHash> -> <block without txns, txn hashes>
+	_PrefixBlockHashToDedupedBlock = []byte{85}
+	// <prefix, txn hash BlockHash> -> <num deduped blocks uint64, MsgBitCloutTxn>
+	_PrefixTxnHashToBlockTxn = []byte{86}
+
+	// Derived keys that an owner has authorized to sign transactions on their
+	// behalf, including ones that have since been revoked.
+	// <prefix, owner PKID [33]byte, derived public key [33]byte> -> <DerivedKeyEntry gob serialized>
+	_PrefixOwnerPKIDDerivedPublicKeyToDerivedKeyEntry = []byte{87}
+
+	// The creator coins each HODLer has a nonzero balance in, sorted by
+	// balance, and how many there are. Kept up to date by
+	// DBPutCreatorCoinBalanceEntryMappingsWithTxn and
+	// DBDeleteCreatorCoinBalanceEntryMappingsWithTxn. See
+	// DbGetPaginatedBalanceEntriesYouHodl.
+	// <prefix, HODLer PKID [33]byte, balance uint64, creator PKID [33]byte> -> <>
+	_PrefixHODLerPKIDBalanceNanosCreatorPKID = []byte{88}
+	// <prefix, HODLer PKID [33]byte> -> <count uint64>
+	_PrefixHODLerPKIDToHoldingsCount = []byte{89}
+
+	// The HODLers of each creator coin with a nonzero balance, largest balance
+	// first. The balance is stored as math.MaxUint64 minus the balance so a
+	// forward scan returns the top holders. Kept up to date alongside the
+	// HODLer balance index. See DbGetPaginatedTopHolders.
+	// <prefix, creator PKID [33]byte, inverted balance uint64, HODLer PKID [33]byte> -> <>
+	_PrefixCreatorPKIDBalanceNanosHODLerPKID = []byte{90}
+
+	// Entries that would have gone into one of the time-ordered post or message
+	// indexes but have a timestamp too far in the future, keyed by the index
+	// key they would have had. See DbRepairTimestampIndexes.
+	// <prefix, index key> -> <index value>
+	_PrefixQuarantinedTimestampIndexEntry = []byte{91}
+
+	// The total of the unspent UTXOs each public key has, so a wallet balance
+	// doesn't require fetching and summing every UTXO. Kept up to date by
+	// PutMappingsForUtxoWithTxn and DeleteUnmodifiedMappingsForUtxoWithTxn.
+	// <prefix, public key [33]byte> -> <balance nanos uint64>
+	_PrefixPublicKeyToBalanceNanos = []byte{92}
+
+	// Each public key's balance as of every block that changed it, for nodes
+	// that have BalanceSnapshots set in their node config. Written when a
+	// UtxoView that connected the block is flushed. See DbGetBalanceAtHeight.
+	// <prefix, public key [33]byte, block height uint32> -> <balance nanos uint64>
+	_PrefixPublicKeyHeightToBalanceSnapshot = []byte{93}
+
+	// The height balance snapshots were seeded at. Absent means the node isn't
+	// keeping snapshots. See DbInitBalanceSnapshots.
+	// <key> -> <block height uint32>
+	_KeyBalanceSnapshotsStartHeight = []byte{94}
+
+	// The height below which block bodies and utxo operations have been pruned.
+	// Absent means nothing has been pruned. See db_prune.go.
+	// <key> -> <block height uint64>
+	_KeyPruneHeight = []byte{95}
+
+	// The height below which the utxo operations of blocks have been deleted
+	// under the node's utxo ops retention or a utxo-ops blocks policy. Absent
+	// means none have been deleted. See _dbSweepBlockIndex.
+	// <key> -> <block height uint64>
+	_KeyUtxoOpsDeletedBelowHeight = []byte{96}
+
+	// The accumulator over the committed state as of the last flush, for nodes
+	// that have StateCommitments set in their node config. Absent means the node
+	// isn't keeping state commitments or that state was written outside of a
+	// flush since it was built. See db_state_commitment.go.
+	// <key> -> <StateAccumulator>
+	_KeyStateAccumulator = []byte{97}
+
+	// The commitment to the state as of the block at each height, which is
+	// the sha256 of the accumulator. See DbGetStateCommitment.
+	// <prefix, block height uint32> -> <commitment [32]byte>
+	_PrefixHeightToStateCommitment = []byte{98}
+
+	// The txns each public key is involved in, in chain order. Only used by the
+	// txindex db. See DbGetTxindexTxnsForPublicKey.
+	// <prefix, public key [33]byte, block height uint32, txn index uint32, txid BlockHash> -> <>
+	_PrefixPublicKeyHeightTxnIndexTxID = []byte{99}
+
+	// The bytes of each indexed txn, kept when the node config has
+	// TxindexTxnBytes set so a txn can be loaded without its block. Only used
+	// by the txindex db. See DbGetTxindexFullTransactionByTxID.
+	// <prefix, txid BlockHash> -> <MsgBitCloutTxn>
+	_PrefixTransactionIDToTxnBytes = []byte{100}
+
+	// The metadata of the txns in the mempool and the public keys they involve,
+	// kept when the txindex's mempool view is stored in the db rather than in
+	// memory. Only used by the txindex db and cleared whenever the view is
+	// created. See TxindexMempoolView.
+	// <prefix, txid BlockHash> -> <TransactionMetadata>
+	_PrefixMempoolTxIDToMetadata = []byte{101}
+	// <prefix, public key [33]byte, txid BlockHash> -> <>
+	_PrefixMempoolPublicKeyTxID = []byte{102}
+
+	// The txns of each indexed block by their position in it, and the height of
+	// each indexed txn's block, so a block explorer can list a block's txns
+	// without loading and hashing the block. Only used by the txindex db. See
+	// DbGetTxindexTxIDsForBlockHeight.
+	// <prefix, block height uint32, txn index uint32> -> <txid BlockHash>
+	_PrefixTxindexHeightTxnIndexToTxID = []byte{103}
+	// <prefix, txid BlockHash> -> <block height uint32>
+	_PrefixTxindexTxIDToBlockHeight = []byte{104}
+
+	// How many main chain blocks carry each fork signal, counting signals for
+	// forks that aren't in the params yet. See DbGetForkSignalCountWithTxn.
+	// <prefix, fork name []byte> -> <signal count uint64>
+	_PrefixForkNameToSignalCount = []byte{105}
+
+	// NEXT_TAG: 106
+	//
+	// Every new prefix must also be added to DbPrefixRegistry below, which
+	// panics at init if two prefixes share an ID.
 )
 
+// DbPrefixInfo describes a key prefix in the db.
+type DbPrefixInfo struct {
+	Name   string
+	Prefix []byte
+	// A short description of the key and value format.
+	Schema string
+}
+
+// DbPrefixRegistry lists every prefix used in the db, including the ones only
+// used by the txindex db. Tools can use it to enumerate all known prefixes.
+var DbPrefixRegistry = []*DbPrefixInfo{
+	{"BlockHashToBlock", _PrefixBlockHashToBlock, "<hash BlockHash> -> <MsgBitCloutBlock>"},
+	{"HeightHashToNodeInfo", _PrefixHeightHashToNodeInfo, "<height uint32, hash BlockHash> -> <BlockNode>"},
+	{"BitcoinHeightHashToNodeInfo", _PrefixBitcoinHeightHashToNodeInfo, "<height uint32, hash BlockHash> -> <BlockNode>"},
+	{"BestBitCloutBlockHash", _KeyBestBitCloutBlockHash, "<> -> <BlockHash>"},
+	{"BestBitcoinHeaderHash", _KeyBestBitcoinHeaderHash, "<> -> <BlockHash>"},
+	{"UtxoKeyToUtxoEntry", _PrefixUtxoKeyToUtxoEntry, "<txid BlockHash, output index> -> <UtxoEntry>"},
+	{"PubKeyUtxoKey", _PrefixPubKeyUtxoKey, "<public key, txid BlockHash, output index> -> <>"},
+	{"UtxoNumEntries", _KeyUtxoNumEntries, "<> -> <uint64>"},
+	{"BlockHashToUtxoOperations", _PrefixBlockHashToUtxoOperations, "<hash BlockHash> -> <[][]UtxoOperation>"},
+	{"NanosPurchased", _KeyNanosPurchased, "<> -> <uint64>"},
+	{"BitcoinBurnTxIDs", _PrefixBitcoinBurnTxIDs, "<BitcoinTxID BlockHash> -> <>"},
+	{"PublicKeyTimestampToPrivateMessage", _PrefixPublicKeyTimestampToPrivateMessage, "<public key, tstampNanos uint64> -> <MessageEntry>"},
+	{"TransactionIndexTip", _KeyTransactionIndexTip, "<> -> <BlockHash>"},
+	{"TransactionIDToMetadata", _PrefixTransactionIDToMetadata, "<txid BlockHash> -> <TransactionMetadata>"},
+	{"PublicKeyIndexToTransactionIDs", _PrefixPublicKeyIndexToTransactionIDs, "<public key, index uint32> -> <txid BlockHash>"},
+	{"PostHashToPostEntry", _PrefixPostHashToPostEntry, "<post hash BlockHash> -> <PostEntry>"},
+	{"PosterPublicKeyPostHash", _PrefixPosterPublicKeyPostHash, "<public key, post hash> -> <>"},
+	{"TstampNanosPostHash", _PrefixTstampNanosPostHash, "<tstampNanos uint64, post hash> -> <>"},
+	{"CreatorBpsPostHash", _PrefixCreatorBpsPostHash, "<creator bps uint64, post hash> -> <>"},
+	{"MultipleBpsPostHash", _PrefixMultipleBpsPostHash, "<stake multiple bps uint64, post hash> -> <>"},
+	{"CommentParentStakeIDToPostHash", _PrefixCommentParentStakeIDToPostHash, "<parent stake id, tstampNanos uint64, post hash> -> <>"},
+	{"PKIDToProfileEntry", _PrefixPKIDToProfileEntry, "<PKID> -> <ProfileEntry>"},
+	{"ProfileUsernameToPKID", _PrefixProfileUsernameToPKID, "<lowercase username> -> <PKID>"},
+	{"StakeIDTypeAmountStakeIDIndex", _PrefixStakeIDTypeAmountStakeIDIndex, "<stake id type, amount uint64, stake id> -> <>"},
+	{"USDCentsPerBitcoinExchangeRate", _KeyUSDCentsPerBitcoinExchangeRate, "<> -> <uint64>"},
+	{"FollowerPKIDToFollowedPKID", _PrefixFollowerPKIDToFollowedPKID, "<follower PKID, followed PKID> -> <>"},
+	{"FollowedPKIDToFollowerPKID", _PrefixFollowedPKIDToFollowerPKID, "<followed PKID, follower PKID> -> <>"},
+	{"LikerPubKeyToLikedPostHash", _PrefixLikerPubKeyToLikedPostHash, "<liker public key, post hash> -> <>"},
+	{"LikedPostHashToLikerPubKey", _PrefixLikedPostHashToLikerPubKey, "<post hash, liker public key> -> <>"},
+	{"CreatorBitCloutLockedNanosCreatorPKID", _PrefixCreatorBitCloutLockedNanosCreatorPKID, "<locked nanos uint64, creator PKID> -> <>"},
+	{"HODLerPKIDCreatorPKIDToBalanceEntry", _PrefixHODLerPKIDCreatorPKIDToBalanceEntry, "<HODLer PKID, creator PKID> -> <BalanceEntry>"},
+	{"CreatorPKIDHODLerPKIDToBalanceEntry", _PrefixCreatorPKIDHODLerPKIDToBalanceEntry, "<creator PKID, HODLer PKID> -> <BalanceEntry>"},
+	{"PosterPublicKeyTimestampPostHash", _PrefixPosterPublicKeyTimestampPostHash, "<public key, tstampNanos uint64, post hash> -> <>"},
+	{"PublicKeyToPKID", _PrefixPublicKeyToPKID, "<public key> -> <PKID>"},
+	{"PKIDToPublicKey", _PrefixPKIDToPublicKey, "<PKID> -> <public key>"},
+	{"MempoolTxnHashToMsgBitCloutTxn", _PrefixMempoolTxnHashToMsgBitCloutTxn, "<txn hash> -> <time added uint64, MsgBitCloutTxn>"},
+	{"ReclouterPubKeyRecloutedPostHashToRecloutPostHash", _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash, "<public key, reclouted post hash> -> <RecloutEntry>"},
+	{"GlobalParams", _KeyGlobalParams, "<> -> <GlobalParamsEntry>"},
+	{"DiamondReceiverPKIDDiamondSenderPKIDPostHash", _PrefixDiamondReceiverPKIDDiamondSenderPKIDPostHash, "<receiver PKID, sender PKID, post hash> -> <DiamondEntry>"},
+	{"PublicKeyToNextIndex", _PrefixPublicKeyToNextIndex, "<public key> -> <next index uint32>"},
+	{"DiamondSenderPKIDDiamondReciverPKIDPostHash", _PrefixDiamondSenderPKIDDiamondReciverPKIDPostHash, "<sender PKID, receiver PKID, post hash> -> <DiamondEntry>"},
+	{"ForbiddenBlockSignaturePubKeys", _PrefixForbiddenBlockSignaturePubKeys, "<public key> -> <>"},
+	{"GenesisInitInProgress", _KeyGenesisInitInProgress, "<> -> <>"},
+	{"SeedTxnIndexToReport", _PrefixSeedTxnIndexToReport, "<txn index uint32> -> <SeedTxnReport>"},
+	{"IndexMigrationNameToState", _PrefixIndexMigrationNameToState, "<migration name> -> <DbIndexMigrationState>"},
+	{"ReleasedUsernameToReleasedUsernameEntry", _PrefixReleasedUsernameToReleasedUsernameEntry, "<lowercase username> -> <ReleasedUsernameEntry>"},
+	{"ContentHashToFirstSeenEntry", _PrefixContentHashToFirstSeenEntry, "<content hash BlockHash> -> <ContentHashFirstSeenEntry>"},
+	{"NormalizedUsernamePKID", _PrefixNormalizedUsernamePKID, "<normalized username, 0x00, PKID> -> <>"},
+	{"DayTxnTypeToTxnDailyStats", _PrefixDayTxnTypeToTxnDailyStats, "<day uint64, txn type uint8> -> <TxnDailyStatsEntry>"},
+	{"PublishAtTstampDraftHashToScheduledPostTxn", _PrefixPublishAtTstampDraftHashToScheduledPostTxn, "<publish at tstampNanos uint64, draft hash> -> <MsgBitCloutTxn>"},
+	{"PublicKeyNamespaceKeyToLocalContent", _PrefixPublicKeyNamespaceKeyToLocalContent, "<public key, namespace, key> -> <LocalContentEntry>"},
+	{"UtxoKeyToUtxoSpendEntry", _PrefixUtxoKeyToUtxoSpendEntry, "<txid BlockHash, output index uint32> -> <UtxoSpendEntry>"},
+	{"CrashBreadcrumb", _KeyCrashBreadcrumb, "<> -> <DbCrashBreadcrumb>"},
+	{"ForkNameToForkState", _PrefixForkNameToForkState, "<fork name> -> <ForkState>"},
+	{"PublicKeyPairTimestampToPrivateMessage", _PrefixPublicKeyPairTimestampToPrivateMessage, "<pkA, pkB, tstampNanos uint64> -> <MessageEntry>"},
+	{"PublicKeyTimestampToFaucetDisbursement", _PrefixPublicKeyTimestampToFaucetDisbursement, "<public key, tstampNanos uint64> -> <FaucetDisbursement>"},
+	{"IPHashTimestampToFaucetDisbursement", _PrefixIPHashTimestampToFaucetDisbursement, "<ip hash [32]byte, tstampNanos uint64> -> <FaucetDisbursement>"},
+	{"GroupOwnerKeyNameToMessagingGroupEntry", _PrefixGroupOwnerKeyNameToMessagingGroupEntry, "<owner public key, key name> -> <MessagingGroupEntry>"},
+	{"MemberGroupIDTimestampToGroupMessage", _PrefixMemberGroupIDTimestampToGroupMessage, "<member public key, group id BlockHash, tstampNanos uint64> -> <GroupMessageEntry>"},
+	{"NodeIdentity", _KeyNodeIdentity, "<> -> <private key [32]byte>"},
+	{"TstampNanosToNodeVersion", _PrefixTstampNanosToNodeVersion, "<tstampNanos uint64> -> <NodeVersionRecord>"},
+	{"TelemetryOptIn", _KeyTelemetryOptIn, "<> -> <bool byte>"},
+	{"QueryHashToQueryCacheEntry", _PrefixQueryHashToQueryCacheEntry, "<query hash [32]byte> -> <QueryCacheEntry>"},
+	{"PublicKeyToUnreadMessageCount", _PrefixPublicKeyToUnreadMessageCount, "<public key> -> <count uint64, read up to tstampNanos uint64>"},
+	{"PKIDTstampTypeTxIDToNotification", _PrefixPKIDTstampTypeTxIDToNotification, "<recipient PKID, tstampNanos uint64, type byte, txID BlockHash> -> <NotificationEntry>"},
+	{"TxIDToNotificationKeys", _PrefixTxIDToNotificationKeys, "<txID BlockHash> -> <[][]byte>"},
+	{"PostHashToEngagementCounts", _PrefixPostHashToEngagementCounts, "<post hash BlockHash> -> <likes uint64, comments uint64, reclouts uint64>"},
+	{"PKIDToFollowingCount", _PrefixPKIDToFollowingCount, "<follower PKID> -> <count uint64>"},
+	{"PKIDToFollowerCount", _PrefixPKIDToFollowerCount, "<followed PKID> -> <count uint64>"},
+	{"PublicKeyToActivity", _PrefixPublicKeyToActivity, "<public key> -> <first seen height uint32, last active height uint32>"},
+	{"PostHashToDiamondTotals", _PrefixPostHashToDiamondTotals, "<post hash BlockHash> -> <num diamonds uint64, total diamond level uint64>"},
+	{"SenderPKIDReceiverPKIDToDiamondTotals", _PrefixSenderPKIDReceiverPKIDToDiamondTotals, "<sender PKID, receiver PKID> -> <num diamonds uint64, total diamond level uint64>"},
+	{"ReceiverPKIDTstampSenderPKIDPostHashToDiamond", _PrefixReceiverPKIDTstampSenderPKIDPostHashToDiamond, "<receiver PKID, tstampNanos uint64, sender PKID, post hash BlockHash> -> <DiamondEntry>"},
+	{"TxIDToDiamondTimeKey", _PrefixTxIDToDiamondTimeKey, "<txID BlockHash> -> <diamond time index key>"},
+	{"RecloutedPostHashTstampQuotingPostHash", _PrefixRecloutedPostHashTstampQuotingPostHash, "<reclouted post hash, tstampNanos uint64, quoting post hash> -> <>"},
+	{"NodeConfig", _KeyNodeConfig, "<> -> <NodeConfigEntry>"},
+	{"RecloutedPostHashReclouterPubKeyToRecloutEntry", _PrefixRecloutedPostHashReclouterPubKeyToRecloutEntry, "<reclouted post hash, public key> -> <RecloutEntry>"},
+	{"LegacyKeyNormalizationReports", _KeyLegacyKeyNormalizationReports, "<> -> <[]*KeyNormalizationReport>"},
+	{"PostHashToPollEntry", _PrefixPostHashToPollEntry, "<post hash> -> <PollEntry>"},
+	{"PostHashOptionIndexToPollVoteCount", _PrefixPostHashOptionIndexToPollVoteCount, "<post hash, option index> -> <vote count>"},
+	{"PostHashVoterPKIDToPollVote", _PrefixPostHashVoterPKIDToPollVote, "<post hash, voter PKID> -> <option index>"},
+	{"DbPrefixToDecodeFailureCount", _PrefixDbPrefixToDecodeFailureCount, "<db prefix> -> <count>"},
+	{"BlockHashToDedupedBlock", _PrefixBlockHashToDedupedBlock, "<hash BlockHash> -> <block without txns, txn hashes>"},
+	{"TxnHashToBlockTxn", _PrefixTxnHashToBlockTxn, "<txn hash BlockHash> -> <num deduped blocks, MsgBitCloutTxn>"},
+	{"OwnerPKIDDerivedPublicKeyToDerivedKeyEntry", _PrefixOwnerPKIDDerivedPublicKeyToDerivedKeyEntry, "<owner PKID, derived public key> -> <DerivedKeyEntry>"},
+	{"HODLerPKIDBalanceNanosCreatorPKID", _PrefixHODLerPKIDBalanceNanosCreatorPKID, "<HODLer PKID, balance, creator PKID> -> <>"},
+	{"HODLerPKIDToHoldingsCount", _PrefixHODLerPKIDToHoldingsCount, "<HODLer PKID> -> <count>"},
+	{"CreatorPKIDBalanceNanosHODLerPKID", _PrefixCreatorPKIDBalanceNanosHODLerPKID, "<creator PKID, inverted balance, HODLer PKID> -> <>"},
+	{"QuarantinedTimestampIndexEntry", _PrefixQuarantinedTimestampIndexEntry, "<index key> -> <index value>"},
+	{"PublicKeyToBalanceNanos", _PrefixPublicKeyToBalanceNanos, "<public key> -> <balance nanos>"},
+	{"PublicKeyHeightToBalanceSnapshot", _PrefixPublicKeyHeightToBalanceSnapshot, "<public key, block height> -> <balance nanos>"},
+	{"BalanceSnapshotsStartHeight", _KeyBalanceSnapshotsStartHeight, "<key> -> <block height>"},
+	{"PruneHeight", _KeyPruneHeight, "<key> -> <block height>"},
+	{"UtxoOpsDeletedBelowHeight", _KeyUtxoOpsDeletedBelowHeight, "<key> -> <block height>"},
+	{"StateAccumulator", _KeyStateAccumulator, "<key> -> <StateAccumulator>"},
+	{"HeightToStateCommitment", _PrefixHeightToStateCommitment, "<block height> -> <commitment>"},
+	{"PublicKeyHeightTxnIndexTxID", _PrefixPublicKeyHeightTxnIndexTxID, "<public key, block height uint32, txn index uint32, txid BlockHash> -> <>"},
+	{"TransactionIDToTxnBytes", _PrefixTransactionIDToTxnBytes, "<txid BlockHash> -> <MsgBitCloutTxn>"},
+	{"MempoolTxIDToMetadata", _PrefixMempoolTxIDToMetadata, "<txid BlockHash> -> <TransactionMetadata>"},
+	{"MempoolPublicKeyTxID", _PrefixMempoolPublicKeyTxID, "<public key, txid BlockHash> -> <>"},
+	{"TxindexHeightTxnIndexToTxID", _PrefixTxindexHeightTxnIndexToTxID, "<block height uint32, txn index uint32> -> <txid BlockHash>"},
+	{"TxindexTxIDToBlockHeight", _PrefixTxindexTxIDToBlockHeight, "<txid BlockHash> -> <block height uint32>"},
+	{"ForkNameToSignalCount", _PrefixForkNameToSignalCount, "<fork name> -> <signal count uint64>"},
+}
+
+func init() {
+	if err := _checkDbPrefixRegistry(DbPrefixRegistry); err != nil {
+		panic(err)
+	}
+}
+
+// _checkDbPrefixRegistry makes sure no two registered prefixes can produce the
+// same key, which happens when one prefix is a prefix of another.
+func _checkDbPrefixRegistry(registry []*DbPrefixInfo) error {
+	for ii, prefixInfo := range registry {
+		if len(prefixInfo.Prefix) == 0 {
+			return fmt.Errorf("_checkDbPrefixRegistry: Prefix %s is empty", prefixInfo.Name)
+		}
+		for _, otherInfo := range registry[ii+1:] {
+			if bytes.HasPrefix(prefixInfo.Prefix, otherInfo.Prefix) ||
+				bytes.HasPrefix(otherInfo.Prefix, prefixInfo.Prefix) {
+
+				return fmt.Errorf("_checkDbPrefixRegistry: Prefixes %s %v and %s %v "+
+					"collide", prefixInfo.Name, prefixInfo.Prefix, otherInfo.Name, otherInfo.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// GetDbPrefixInfoForKey returns the registered prefix a key belongs to, or nil if
+// it doesn't belong to any of them.
+func GetDbPrefixInfoForKey(key []byte) *DbPrefixInfo {
+	for _, prefixInfo := range DbPrefixRegistry {
+		if bytes.HasPrefix(key, prefixInfo.Prefix) {
+			return prefixInfo
+		}
+	}
+	return nil
+}
+
 // A PKID is an ID associated with a public key. In the DB, various fields are
 // indexed using the PKID rather than the user's public key directly in order to
 // create one layer of indirection between the public key and the user's data. This
@@ -222,13 +714,14 @@ func PKIDToPublicKey(pkid *PKID) []byte {
 	return pkid[:]
 }
 
-func DBGetPKIDEntryForPublicKeyWithTxn(txn *badger.Txn, publicKey []byte) *PKIDEntry {
+func DBGetPKIDEntryForPublicKeyWithTxn(txn KVTxn, publicKey []byte) *PKIDEntry {
 	if len(publicKey) == 0 {
 		return nil
 	}
 
 	prefix := append([]byte{}, _PrefixPublicKeyToPKID...)
-	pkidItem, err := txn.Get(append(prefix, publicKey...))
+	key := append(prefix, publicKey...)
+	valBytes, err := txn.Get(key)
 
 	if err != nil {
 		// If we don't have a mapping from public key to PKID in the db,
@@ -244,10 +737,9 @@ func DBGetPKIDEntryForPublicKeyWithTxn(txn *badger.Txn, publicKey []byte) *PKIDE
 	// If we get here then it means we actually had a PKID in the DB.
 	// So return that pkid.
 	pkidEntryObj := &PKIDEntry{}
-	err = pkidItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(pkidEntryObj)
-	})
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(pkidEntryObj)
 	if err != nil {
+		RecordDbDecodeFailure(key)
 		glog.Errorf("DBGetPKIDEntryForPublicKeyWithTxn: Problem reading "+
 			"PKIDEntry for public key %s",
 			PkToStringMainnet(publicKey))
@@ -257,17 +749,41 @@ func DBGetPKIDEntryForPublicKeyWithTxn(txn *badger.Txn, publicKey []byte) *PKIDE
 }
 
 func DBGetPKIDEntryForPublicKey(db *badger.DB, publicKey []byte) *PKIDEntry {
+	prefix := append([]byte{}, _PrefixPublicKeyToPKID...)
+	cacheKey := string(append(prefix, publicKey...))
+	cachedEntry, generation, found := pkidEntryCache.get(db, cacheKey)
+	if found {
+		return _copyPKIDEntry(cachedEntry.(*PKIDEntry))
+	}
+
 	var pkid *PKIDEntry
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		pkid = DBGetPKIDEntryForPublicKeyWithTxn(txn, publicKey)
 		return nil
 	})
+	if pkid != nil {
+		pkidEntryCache.add(db, cacheKey, _copyPKIDEntry(pkid), generation)
+	}
 	return pkid
 }
 
-func DBGetPublicKeyForPKIDWithTxn(txn *badger.Txn, pkidd *PKID) []byte {
+// _copyPKIDEntry copies the PKID and public key along with the entry so that a
+// caller changing the entry it gets back can't change the one that's cached.
+func _copyPKIDEntry(pkidEntry *PKIDEntry) *PKIDEntry {
+	pkidEntryCopy := *pkidEntry
+	if pkidEntry.PKID != nil {
+		pkidCopy := *pkidEntry.PKID
+		pkidEntryCopy.PKID = &pkidCopy
+	}
+	if pkidEntry.PublicKey != nil {
+		pkidEntryCopy.PublicKey = append([]byte{}, pkidEntry.PublicKey...)
+	}
+	return &pkidEntryCopy
+}
+
+func DBGetPublicKeyForPKIDWithTxn(txn KVTxn, pkidd *PKID) []byte {
 	prefix := append([]byte{}, _PrefixPKIDToPublicKey...)
-	pkidItem, err := txn.Get(append(prefix, pkidd[:]...))
+	pkRet, err := txn.Get(append(prefix, pkidd[:]...))
 
 	if err != nil {
 		// If we don't have a mapping in the db then return the pkid itself
@@ -277,29 +793,31 @@ func DBGetPublicKeyForPKIDWithTxn(txn *badger.Txn, pkidd *PKID) []byte {
 
 	// If we get here then it means we actually had a public key mapping in the DB.
 	// So return that public key.
-	pkRet, err := pkidItem.ValueCopy(nil)
-	if err != nil {
-		// If we had a problem reading the mapping then log an error and return nil.
-		glog.Errorf("DBGetPublicKeyForPKIDWithTxn: Problem reading "+
-			"public key for pkid %s",
-			PkToStringMainnet(pkidd[:]))
-		return nil
-	}
-
 	return pkRet
 }
 
 func DBGetPublicKeyForPKID(db *badger.DB, pkidd *PKID) []byte {
+	// The reverse mappings share the PKID cache with the forward ones.
+	prefix := append([]byte{}, _PrefixPKIDToPublicKey...)
+	cacheKey := string(append(prefix, pkidd[:]...))
+	cachedPublicKey, generation, found := pkidEntryCache.get(db, cacheKey)
+	if found {
+		return append([]byte{}, cachedPublicKey.([]byte)...)
+	}
+
 	var publicKey []byte
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		publicKey = DBGetPublicKeyForPKIDWithTxn(txn, pkidd)
 		return nil
 	})
+	if publicKey != nil {
+		pkidEntryCache.add(db, cacheKey, append([]byte{}, publicKey...), generation)
+	}
 	return publicKey
 }
 
 func DBPutPKIDMappingsWithTxn(
-	txn *badger.Txn, publicKey []byte, pkidEntry *PKIDEntry, params *BitCloutParams) error {
+	txn KVTxn, publicKey []byte, pkidEntry *PKIDEntry, params *BitCloutParams) error {
 
 	// Set the main pub key -> pkid mapping.
 	{
@@ -308,6 +826,7 @@ func DBPutPKIDMappingsWithTxn(
 
 		prefix := append([]byte{}, _PrefixPublicKeyToPKID...)
 		pubKeyToPkidKey := append(prefix, publicKey...)
+		pkidEntryCache.invalidate(pubKeyToPkidKey)
 		if err := txn.Set(pubKeyToPkidKey, pkidDataBuf.Bytes()); err != nil {
 
 			return errors.Wrapf(err, "DBPutPKIDMappingsWithTxn: Problem "+
@@ -320,6 +839,7 @@ func DBPutPKIDMappingsWithTxn(
 	{
 		prefix := append([]byte{}, _PrefixPKIDToPublicKey...)
 		pkidToPubKey := append(prefix, pkidEntry.PKID[:]...)
+		pkidEntryCache.invalidate(pkidToPubKey)
 		if err := txn.Set(pkidToPubKey, publicKey); err != nil {
 
 			return errors.Wrapf(err, "DBPutPKIDMappingsWithTxn: Problem "+
@@ -332,7 +852,7 @@ func DBPutPKIDMappingsWithTxn(
 }
 
 func DBDeletePKIDMappingsWithTxn(
-	txn *badger.Txn, publicKey []byte, params *BitCloutParams) error {
+	txn KVTxn, publicKey []byte, params *BitCloutParams) error {
 
 	// Look up the pkid for the public key.
 	pkidEntry := DBGetPKIDEntryForPublicKeyWithTxn(txn, publicKey)
@@ -340,6 +860,7 @@ func DBDeletePKIDMappingsWithTxn(
 	{
 		prefix := append([]byte{}, _PrefixPublicKeyToPKID...)
 		pubKeyToPkidKey := append(prefix, publicKey...)
+		pkidEntryCache.invalidate(pubKeyToPkidKey)
 		if err := txn.Delete(pubKeyToPkidKey); err != nil {
 
 			return errors.Wrapf(err, "DBDeletePKIDMappingsWithTxn: Problem "+
@@ -351,6 +872,7 @@ func DBDeletePKIDMappingsWithTxn(
 	{
 		prefix := append([]byte{}, _PrefixPKIDToPublicKey...)
 		pubKeyToPkidKey := append(prefix, pkidEntry.PKID[:]...)
+		pkidEntryCache.invalidate(pubKeyToPkidKey)
 		if err := txn.Delete(pubKeyToPkidKey); err != nil {
 
 			return errors.Wrapf(err, "DBDeletePKIDMappingsWithTxn: Problem "+
@@ -371,7 +893,7 @@ func _enumerateKeysForPrefix(db *badger.DB, dbPrefix []byte) (_keysFound [][]byt
 	keysFound := [][]byte{}
 	valsFound := [][]byte{}
 
-	dbErr := db.View(func(txn *badger.Txn) error {
+	dbErr := DbView(db, func(txn KVTxn) error {
 		var err error
 		keysFound, valsFound, err = _enumerateKeysForPrefixWithTxn(txn, dbPrefix)
 		if err != nil {
@@ -387,20 +909,20 @@ func _enumerateKeysForPrefix(db *badger.DB, dbPrefix []byte) (_keysFound [][]byt
 	return keysFound, valsFound
 }
 
-func _enumerateKeysForPrefixWithTxn(dbTxn *badger.Txn, dbPrefix []byte) (_keysFound [][]byte, _valsFound [][]byte, _err error) {
+func _enumerateKeysForPrefixWithTxn(dbTxn KVTxn, dbPrefix []byte) (_keysFound [][]byte, _valsFound [][]byte, _err error) {
 	keysFound := [][]byte{}
 	valsFound := [][]byte{}
 
-	opts := badger.DefaultIteratorOptions
+	opts := KVIteratorOptions{}
 	nodeIterator := dbTxn.NewIterator(opts)
 	defer nodeIterator.Close()
 	prefix := dbPrefix
 	for nodeIterator.Seek(prefix); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
-		key := nodeIterator.Item().Key()
+		key := nodeIterator.Key()
 		keyCopy := make([]byte, len(key))
 		copy(keyCopy[:], key[:])
 
-		valCopy, err := nodeIterator.Item().ValueCopy(nil)
+		valCopy, err := nodeIterator.Value()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -410,12 +932,267 @@ func _enumerateKeysForPrefixWithTxn(dbTxn *badger.Txn, dbPrefix []byte) (_keysFo
 	return keysFound, valsFound, nil
 }
 
+// EnumerateKeysForPrefixWithCallback calls fn on each key and value that starts
+// with dbPrefix in order without loading them all into memory, which matters for
+// prefixes that can get very large like a popular account's followers. The
+// enumeration stops early if fn returns false or an error.
+//
+// The key and value passed to fn are only valid until fn returns so fn must copy
+// anything it wants to keep.
+func EnumerateKeysForPrefixWithCallback(
+	db *badger.DB, dbPrefix []byte, fn func(_key []byte, _val []byte) (_keepGoing bool, _err error)) error {
+
+	err := DbView(db, func(txn KVTxn) error {
+		return EnumerateKeysForPrefixWithCallbackWithTxn(txn, dbPrefix, fn)
+	})
+	return _wrapDbError(err, "EnumerateKeysForPrefixWithCallback")
+}
+
+func EnumerateKeysForPrefixWithCallbackWithTxn(
+	dbTxn KVTxn, dbPrefix []byte, fn func(_key []byte, _val []byte) (_keepGoing bool, _err error)) error {
+
+	opts := KVIteratorOptions{}
+	opts.Prefix = dbPrefix
+	nodeIterator := dbTxn.NewIterator(opts)
+	defer nodeIterator.Close()
+	for nodeIterator.Seek(dbPrefix); nodeIterator.ValidForPrefix(dbPrefix); nodeIterator.Next() {
+		valBytes, err := nodeIterator.Value()
+		if err != nil {
+			return err
+		}
+		keepGoing, err := fn(nodeIterator.Key(), valBytes)
+		if err != nil {
+			return err
+		}
+		if !keepGoing {
+			break
+		}
+	}
+	return nil
+}
+
+// DBSamplePrefix returns up to n keys and values that start with prefix, chosen
+// uniformly at random in a single pass with reservoir sampling. The sample only
+// depends on the seed and the db's contents so an audit can be reproduced by
+// anyone with the same seed. The sample is returned in key order.
+func DBSamplePrefix(db *badger.DB, prefix []byte, n int, seed int64) (
+	_keysFound [][]byte, _valsFound [][]byte, _err error) {
+
+	if n <= 0 {
+		return [][]byte{}, [][]byte{}, nil
+	}
+
+	rng := mrand.New(mrand.NewSource(seed))
+	keysFound := [][]byte{}
+	valsFound := [][]byte{}
+	numSeen := 0
+	err := EnumerateKeysForPrefixWithCallback(db, prefix, func(key []byte, val []byte) (bool, error) {
+		numSeen++
+		if len(keysFound) < n {
+			keysFound = append(keysFound, append([]byte{}, key...))
+			valsFound = append(valsFound, append([]byte{}, val...))
+			return true, nil
+		}
+		// Keep the entry with probability n/numSeen by replacing a random slot.
+		if slot := rng.Intn(numSeen); slot < n {
+			keysFound[slot] = append([]byte{}, key...)
+			valsFound[slot] = append([]byte{}, val...)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "DBSamplePrefix: Problem scanning prefix %v", prefix)
+	}
+
+	sort.Sort(_keysAndValsByKey{keys: keysFound, vals: valsFound})
+	return keysFound, valsFound, nil
+}
+
+// _keysAndValsByKey sorts keys and their values together.
+type _keysAndValsByKey struct {
+	keys [][]byte
+	vals [][]byte
+}
+
+func (kv _keysAndValsByKey) Len() int { return len(kv.keys) }
+func (kv _keysAndValsByKey) Less(ii, jj int) bool {
+	return bytes.Compare(kv.keys[ii], kv.keys[jj]) < 0
+}
+func (kv _keysAndValsByKey) Swap(ii, jj int) {
+	kv.keys[ii], kv.keys[jj] = kv.keys[jj], kv.keys[ii]
+	kv.vals[ii], kv.vals[jj] = kv.vals[jj], kv.vals[ii]
+}
+
+// maxDBScanShards is the most shards DBParallelScanPrefix splits a prefix into.
+const maxDBScanShards = 256
+
+// DBScanShardCount returns how many shards DBParallelScanPrefix uses when asked
+// for numShards, which is one per CPU when numShards is zero or less. Callers
+// can use it to size their per-shard results before the scan starts.
+func DBScanShardCount(numShards int) int {
+	if numShards <= 0 {
+		numShards = runtime.NumCPU()
+	}
+	if numShards > maxDBScanShards {
+		numShards = maxDBScanShards
+	}
+	return numShards
+}
+
+// _dbFirstAndLastKeysForPrefix returns the smallest and largest keys under the
+// prefix, or nil if there are none.
+func _dbFirstAndLastKeysForPrefix(db *badger.DB, prefix []byte) (
+	_firstKey []byte, _lastKey []byte, _err error) {
+
+	keys := [][]byte{}
+	for _, reverse := range []bool{false, true} {
+		dbIter := NewDBIterator(db, prefix, reverse, false /*fetchValues*/)
+		if dbIter.Next() {
+			keys = append(keys, append([]byte{}, dbIter.Key()...))
+		}
+		err := dbIter.Err()
+		dbIter.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(keys) != 2 {
+		return nil, nil, nil
+	}
+	return keys[0], keys[1], nil
+}
+
+// _dbScanShardBoundaries splits the keys from firstKey to lastKey into up to
+// numShards contiguous ranges and returns the key each range starts at, after
+// the first, which starts at the beginning of the prefix. The ranges are split
+// evenly on the two bytes after the bytes firstKey and lastKey have in common.
+func _dbScanShardBoundaries(firstKey []byte, lastKey []byte, numShards int) [][]byte {
+	commonLen := 0
+	for commonLen < len(firstKey) && commonLen < len(lastKey) &&
+		firstKey[commonLen] == lastKey[commonLen] {
+
+		commonLen++
+	}
+	leadingUint16 := func(key []byte) uint64 {
+		leadingBytes := make([]byte, 2)
+		if commonLen < len(key) {
+			copy(leadingBytes, key[commonLen:])
+		}
+		return uint64(binary.BigEndian.Uint16(leadingBytes))
+	}
+	lo := leadingUint16(firstKey)
+	span := leadingUint16(lastKey) + 1 - lo
+
+	boundaries := [][]byte{}
+	prevBoundary := lo
+	for ii := 1; ii < numShards; ii++ {
+		boundary := lo + span*uint64(ii)/uint64(numShards)
+		if boundary == prevBoundary {
+			continue
+		}
+		prevBoundary = boundary
+		boundaryBytes := make([]byte, 2)
+		binary.BigEndian.PutUint16(boundaryBytes, uint16(boundary))
+		boundaries = append(boundaries, append(append([]byte{}, firstKey[:commonLen]...), boundaryBytes...))
+	}
+	return boundaries
+}
+
+// DBParallelScanPrefix calls fn on every key and value under prefix, splitting
+// the keys into contiguous ranges that are scanned concurrently, each in its
+// own txn. See DBScanShardCount for how many ranges there are. The ranges are
+// split on the leading bytes where the keys under the prefix start to differ,
+// so keys that all start the same way, like public keys, still spread out.
+//
+// Calls for the same shard are made in key order from one goroutine and shard
+// indexes increase with the keys in them. That lets fn keep results per shard
+// without locking and lets the caller merge them in shard order once the scan
+// returns, as DBParallelCountPrefix does. The key and value are only valid
+// during the call. The scan stops at the first error fn returns.
+func DBParallelScanPrefix(db *badger.DB, prefix []byte, numShards int,
+	fn func(_shardIndex int, _key []byte, _val []byte) error) error {
+
+	numShards = DBScanShardCount(numShards)
+	firstKey, lastKey, err := _dbFirstAndLastKeysForPrefix(db, prefix)
+	if err != nil {
+		return errors.Wrapf(err, "DBParallelScanPrefix: Problem finding key range")
+	}
+	if firstKey == nil {
+		return nil
+	}
+	startKeys := append([][]byte{prefix}, _dbScanShardBoundaries(firstKey, lastKey, numShards)...)
+
+	// Once any shard fails the others stop at their next key.
+	var stopped int32
+	errs := make([]error, len(startKeys))
+	var waitGroup sync.WaitGroup
+	for ii := range startKeys {
+		var endKey []byte
+		if ii+1 < len(startKeys) {
+			endKey = startKeys[ii+1]
+		}
+		waitGroup.Add(1)
+		go func(shardIndex int, startKey []byte, endKey []byte) {
+			defer waitGroup.Done()
+			errs[shardIndex] = DbView(db, func(txn KVTxn) error {
+				opts := KVIteratorOptions{}
+				opts.Prefix = prefix
+				it := txn.NewIterator(opts)
+				defer it.Close()
+				for it.Seek(startKey); it.ValidForPrefix(prefix); it.Next() {
+					if atomic.LoadInt32(&stopped) != 0 {
+						return nil
+					}
+					if endKey != nil && bytes.Compare(it.Key(), endKey) >= 0 {
+						return nil
+					}
+					valBytes, err := it.Value()
+					if err == nil {
+						err = fn(shardIndex, it.Key(), valBytes)
+					}
+					if err != nil {
+						atomic.StoreInt32(&stopped, 1)
+						return err
+					}
+				}
+				return nil
+			})
+		}(ii, startKeys[ii], endKey)
+	}
+	waitGroup.Wait()
+
+	for ii, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "DBParallelScanPrefix: Problem scanning shard %d", ii)
+		}
+	}
+	return nil
+}
+
+// DBParallelCountPrefix counts the keys under prefix with DBParallelScanPrefix.
+func DBParallelCountPrefix(db *badger.DB, prefix []byte, numShards int) (uint64, error) {
+	shardCounts := make([]uint64, DBScanShardCount(numShards))
+	err := DBParallelScanPrefix(db, prefix, numShards, func(shardIndex int, _ []byte, _ []byte) error {
+		shardCounts[shardIndex]++
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DBParallelCountPrefix: ")
+	}
+
+	count := uint64(0)
+	for _, shardCount := range shardCounts {
+		count += shardCount
+	}
+	return count, nil
+}
+
 // A helper function to enumerate a limited number of the values for a particular prefix.
 func _enumerateLimitedKeysReversedForPrefix(db *badger.DB, dbPrefix []byte, limit uint64) (_keysFound [][]byte, _valsFound [][]byte) {
 	keysFound := [][]byte{}
 	valsFound := [][]byte{}
 
-	dbErr := db.View(func(txn *badger.Txn) error {
+	dbErr := DbView(db, func(txn KVTxn) error {
 		var err error
 		keysFound, valsFound, err = _enumerateLimitedKeysReversedForPrefixWithTxn(txn, dbPrefix, limit)
 		return err
@@ -428,11 +1205,11 @@ func _enumerateLimitedKeysReversedForPrefix(db *badger.DB, dbPrefix []byte, limi
 	return keysFound, valsFound
 }
 
-func _enumerateLimitedKeysReversedForPrefixWithTxn(dbTxn *badger.Txn, dbPrefix []byte, limit uint64) (_keysFound [][]byte, _valsFound [][]byte, _err error) {
+func _enumerateLimitedKeysReversedForPrefixWithTxn(dbTxn KVTxn, dbPrefix []byte, limit uint64) (_keysFound [][]byte, _valsFound [][]byte, _err error) {
 	keysFound := [][]byte{}
 	valsFound := [][]byte{}
 
-	opts := badger.DefaultIteratorOptions
+	opts := KVIteratorOptions{}
 
 	// Go in reverse order
 	opts.Reverse = true
@@ -448,11 +1225,11 @@ func _enumerateLimitedKeysReversedForPrefixWithTxn(dbTxn *badger.Txn, dbPrefix [
 		}
 		counter++
 
-		key := nodeIterator.Item().Key()
+		key := nodeIterator.Key()
 		keyCopy := make([]byte, len(key))
 		copy(keyCopy[:], key[:])
 
-		valCopy, err := nodeIterator.Item().ValueCopy(nil)
+		valCopy, err := nodeIterator.Value()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -482,9 +1259,26 @@ func _dbSeekPrefixForMessagePublicKey(publicKey []byte) []byte {
 	return append(prefixCopy, publicKey...)
 }
 
-// Note that this adds a mapping for the sender *and* the recipient.
+func _dbSeekPrefixForConversation(publicKeyA []byte, publicKeyB []byte) []byte {
+	// Order the keys so that both participants map to the same conversation.
+	if bytes.Compare(publicKeyA, publicKeyB) > 0 {
+		publicKeyA, publicKeyB = publicKeyB, publicKeyA
+	}
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPublicKeyPairTimestampToPrivateMessage...)
+	key := append(prefixCopy, publicKeyA...)
+	return append(key, publicKeyB...)
+}
+
+func _dbKeyForConversationMessage(publicKeyA []byte, publicKeyB []byte, tstampNanos uint64) []byte {
+	return append(_dbSeekPrefixForConversation(publicKeyA, publicKeyB), EncodeUint64(tstampNanos)...)
+}
+
+// Note that this adds a mapping for the sender *and* the recipient. A message
+// with a timestamp past maxIndexedTstampNanos is quarantined out of the
+// conversation index. See DbGetMaxIndexedTstampNanosWithTxn.
 func DbPutMessageEntryWithTxn(
-	txn *badger.Txn, messageEntry *MessageEntry) error {
+	txn KVTxn, messageEntry *MessageEntry, maxIndexedTstampNanos uint64) error {
 
 	if len(messageEntry.SenderPublicKey) != btcec.PubKeyBytesLenCompressed {
 		return fmt.Errorf("DbPutPrivateMessageWithTxn: Sender public key "+
@@ -501,43 +1295,57 @@ func DbPutMessageEntryWithTxn(
 		TstampNanos:        messageEntry.TstampNanos,
 	}
 
-	messageDataBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(messageDataBuf).Encode(messageData)
+	messageDataBytes := _DbBufForMessageEntry(messageData)
+
+	// Only count the message as unread the first time it's stored.
+	if DbGetMessageEntryWithTxn(txn, messageEntry.RecipientPublicKey, messageEntry.TstampNanos) == nil {
+		if err := _dbUpdateUnreadMessageCountWithTxn(txn, messageEntry, true /*isAdd*/); err != nil {
+			return errors.Wrapf(err, "DbPutMessageEntryWithTxn: ")
+		}
+	}
 
+	// The mappings for the sender and recipient are where messages are stored,
+	// so they're never quarantined. Only the conversation index can be.
 	if err := txn.Set(_dbKeyForMessageEntry(
-		messageEntry.SenderPublicKey, messageEntry.TstampNanos), messageDataBuf.Bytes()); err != nil {
+		messageEntry.SenderPublicKey, messageEntry.TstampNanos), messageDataBytes); err != nil {
 
 		return errors.Wrapf(err, "DbPutMessageEntryWithTxn: Problem adding mapping for sender: ")
 	}
 	if err := txn.Set(_dbKeyForMessageEntry(
-		messageEntry.RecipientPublicKey, messageEntry.TstampNanos), messageDataBuf.Bytes()); err != nil {
+		messageEntry.RecipientPublicKey, messageEntry.TstampNanos), messageDataBytes); err != nil {
 
 		return errors.Wrapf(err, "DbPutMessageEntryWithTxn: Problem adding mapping for recipient: ")
 	}
+	if err := _dbSetTimestampIndexEntryWithTxn(txn, _dbKeyForConversationMessage(messageEntry.SenderPublicKey,
+		messageEntry.RecipientPublicKey, messageEntry.TstampNanos), messageDataBytes,
+		messageEntry.TstampNanos, maxIndexedTstampNanos); err != nil {
+
+		return errors.Wrapf(err, "DbPutMessageEntryWithTxn: Problem adding mapping for conversation: ")
+	}
 
 	return nil
 }
 
 func DbPutMessageEntry(handle *badger.DB, messageEntry *MessageEntry) error {
 
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbPutMessageEntryWithTxn(txn, messageEntry)
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutMessageEntryWithTxn(
+			txn, messageEntry, DbGetMaxIndexedTstampNanosForTipWithTxn(txn))
 	})
 }
 
 func DbGetMessageEntryWithTxn(
-	txn *badger.Txn, publicKey []byte, tstampNanos uint64) *MessageEntry {
+	txn KVTxn, publicKey []byte, tstampNanos uint64) *MessageEntry {
 
 	key := _dbKeyForMessageEntry(publicKey, tstampNanos)
 	privateMessageObj := &MessageEntry{}
-	privateMessageItem, err := txn.Get(key)
+	valBytes, err := txn.Get(key)
 	if err != nil {
 		return nil
 	}
-	err = privateMessageItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(privateMessageObj)
-	})
+	err = _DbDecodeMessageEntry(valBytes, privateMessageObj)
 	if err != nil {
+		RecordDbDecodeFailure(key)
 		glog.Errorf("DbGetMessageEntryWithTxn: Problem reading "+
 			"MessageEntry for public key %s with tstampnanos %d",
 			PkToStringMainnet(publicKey), tstampNanos)
@@ -548,7 +1356,7 @@ func DbGetMessageEntryWithTxn(
 
 func DbGetMessageEntry(db *badger.DB, publicKey []byte, tstampNanos uint64) *MessageEntry {
 	var ret *MessageEntry
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		ret = DbGetMessageEntryWithTxn(txn, publicKey, tstampNanos)
 		return nil
 	})
@@ -558,7 +1366,7 @@ func DbGetMessageEntry(db *badger.DB, publicKey []byte, tstampNanos uint64) *Mes
 // Note this deletes the message for the sender *and* receiver since a mapping
 // should exist for each.
 func DbDeleteMessageEntryMappingsWithTxn(
-	txn *badger.Txn, publicKey []byte, tstampNanos uint64) error {
+	txn KVTxn, publicKey []byte, tstampNanos uint64) error {
 
 	// First pull up the mapping that exists for the public key passed in.
 	// If one doesn't exist then there's nothing to do.
@@ -567,6 +1375,10 @@ func DbDeleteMessageEntryMappingsWithTxn(
 		return nil
 	}
 
+	if err := _dbUpdateUnreadMessageCountWithTxn(txn, existingMessage, false /*isAdd*/); err != nil {
+		return errors.Wrapf(err, "DbDeleteMessageEntryMappingsWithTxn: ")
+	}
+
 	// When a message exists, delete the mapping for the sender and receiver.
 	if err := txn.Delete(_dbKeyForMessageEntry(existingMessage.SenderPublicKey, tstampNanos)); err != nil {
 		return errors.Wrapf(err, "DbDeleteMessageEntryMappingsWithTxn: Deleting "+
@@ -578,12 +1390,18 @@ func DbDeleteMessageEntryMappingsWithTxn(
 			"recipient mapping for public key %s and tstamp %d failed",
 			PkToStringMainnet(existingMessage.RecipientPublicKey), tstampNanos)
 	}
+	if err := _dbDeleteTimestampIndexEntryWithTxn(txn, _dbKeyForConversationMessage(existingMessage.SenderPublicKey,
+		existingMessage.RecipientPublicKey, tstampNanos)); err != nil {
+
+		return errors.Wrapf(err, "DbDeleteMessageEntryMappingsWithTxn: Deleting "+
+			"conversation mapping for tstamp %d failed", tstampNanos)
+	}
 
 	return nil
 }
 
 func DbDeleteMessageEntryMappings(handle *badger.DB, publicKey []byte, tstampNanos uint64) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbDeleteMessageEntryMappingsWithTxn(txn, publicKey, tstampNanos)
 	})
 }
@@ -596,19 +1414,19 @@ func DbGetMessageEntriesForPublicKey(handle *badger.DB, publicKey []byte) (
 	// the db.
 	prefix := _dbSeekPrefixForMessagePublicKey(publicKey)
 
-	// Goes backwards to get messages in time sorted order.
-	// Limit the number of keys to speed up load times.
-	_, valuesFound := _enumerateKeysForPrefix(handle, prefix)
-
 	privateMessages := []*MessageEntry{}
-	for _, valBytes := range valuesFound {
+	err := EnumerateKeysForPrefixWithCallback(handle, prefix, func(_ []byte, valBytes []byte) (bool, error) {
 		privateMessageObj := &MessageEntry{}
-		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(privateMessageObj); err != nil {
-			return nil, errors.Wrapf(
+		if err := _DbDecodeMessageEntry(valBytes, privateMessageObj); err != nil {
+			return false, errors.Wrapf(
 				err, "DbGetMessageEntriesForPublicKey: Problem decoding value: ")
 		}
 
 		privateMessages = append(privateMessages, privateMessageObj)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return privateMessages, nil
@@ -624,12 +1442,12 @@ func DbGetLimitedMessageEntriesForPublicKey(handle *badger.DB, publicKey []byte)
 
 	// Goes backwards to get messages in time sorted order.
 	// Limit the number of keys to speed up load times.
-	_, valuesFound := _enumerateLimitedKeysReversedForPrefix(handle, prefix, uint64(MessagesToFetchPerInboxCall))
+	_, valuesFound := _enumerateLimitedKeysReversedForPrefix(handle, prefix, DbGetMessagesToFetchPerInboxCall(handle))
 
 	privateMessages := []*MessageEntry{}
 	for _, valBytes := range valuesFound {
 		privateMessageObj := &MessageEntry{}
-		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(privateMessageObj); err != nil {
+		if err := _DbDecodeMessageEntry(valBytes, privateMessageObj); err != nil {
 			return nil, errors.Wrapf(
 				err, "DbGetMessageEntriesForPublicKey: Problem decoding value: ")
 		}
@@ -640,127 +1458,608 @@ func DbGetLimitedMessageEntriesForPublicKey(handle *badger.DB, publicKey []byte)
 	return privateMessages, nil
 }
 
-// -------------------------------------------------------------------------------------
-// Forbidden block signature public key functions
-// <prefix, public key> -> <>
-// -------------------------------------------------------------------------------------
-
-func _dbKeyForForbiddenBlockSignaturePubKeys(publicKey []byte) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixForbiddenBlockSignaturePubKeys...)
-	key := append(prefixCopy, publicKey...)
-	return key
-}
+// DbGetPaginatedMessageEntriesForPublicKey fetches up to limit of the messages
+// sent or received by publicKey, starting right after startTstampNanos. If
+// reverse is set it returns the messages sent before startTstampNanos from
+// newest to oldest, otherwise it returns the ones sent after it from oldest to
+// newest. A startTstampNanos of zero starts from the newest message when going in
+// reverse and the oldest one otherwise. To fetch the next page, pass the
+// TstampNanos of the last message returned.
+//
+// A limit of zero fetches every message in the given direction.
+func DbGetPaginatedMessageEntriesForPublicKey(
+	handle *badger.DB, publicKey []byte, startTstampNanos uint64, limit int, reverse bool) (
+	_privateMessages []*MessageEntry, _err error) {
 
-func DbPutForbiddenBlockSignaturePubKeyWithTxn(txn *badger.Txn, publicKey []byte) error {
+	prefix := _dbSeekPrefixForMessagePublicKey(publicKey)
+	startKey := _dbKeyForMessageEntry(publicKey, startTstampNanos)
 
-	if len(publicKey) != btcec.PubKeyBytesLenCompressed {
-		return fmt.Errorf("DbPutForbiddenBlockSignaturePubKeyWithTxn: Forbidden public key "+
-			"length %d != %d", len(publicKey), btcec.PubKeyBytesLenCompressed)
+	dbIter := NewDBIterator(handle, prefix, reverse, true /*fetchValues*/)
+	defer dbIter.Close()
+	if startTstampNanos != 0 {
+		dbIter.Seek(startKey)
 	}
 
-	if err := txn.Set(_dbKeyForForbiddenBlockSignaturePubKeys(publicKey), []byte{}); err != nil {
-		return errors.Wrapf(err, "DbPutForbiddenBlockSignaturePubKeyWithTxn: Problem adding mapping for sender: ")
+	privateMessages := []*MessageEntry{}
+	for (limit == 0 || len(privateMessages) < limit) && dbIter.Next() {
+		// The start tstamp is exclusive so that the last message of a page
+		// isn't returned again as the first message of the next one.
+		if startTstampNanos != 0 && bytes.Equal(dbIter.Key(), startKey) {
+			continue
+		}
+
+		privateMessageObj := &MessageEntry{}
+		if err := _DbDecodeMessageEntry(dbIter.Value(), privateMessageObj); err != nil {
+			return nil, errors.Wrapf(
+				err, "DbGetPaginatedMessageEntriesForPublicKey: Problem decoding value: ")
+		}
+		privateMessages = append(privateMessages, privateMessageObj)
+	}
+	if dbIter.Err() != nil {
+		return nil, errors.Wrapf(dbIter.Err(), "DbGetPaginatedMessageEntriesForPublicKey: ")
 	}
 
-	return nil
+	return privateMessages, nil
 }
 
-func DbPutForbiddenBlockSignaturePubKey(handle *badger.DB, publicKey []byte) error {
-
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbPutForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
-	})
+func _dbKeyForUnreadMessageCount(publicKey []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPublicKeyToUnreadMessageCount...)
+	return append(prefixCopy, publicKey...)
 }
 
-func DbGetForbiddenBlockSignaturePubKeyWithTxn(txn *badger.Txn, publicKey []byte) []byte {
+func _dbGetUnreadMessageCountWithTxn(txn KVTxn, publicKey []byte) (
+	_unreadCount uint64, _readUpToTstampNanos uint64) {
 
-	key := _dbKeyForForbiddenBlockSignaturePubKeys(publicKey)
-	_, err := txn.Get(key)
+	valBytes, err := txn.Get(_dbKeyForUnreadMessageCount(publicKey))
 	if err != nil {
-		return nil
+		return 0, 0
 	}
-
-	// Typically we return a DB entry here but we don't store anything for this mapping.
-	// We use this function instead of one returning true / false for feature consistency.
-	return []byte{}
+	if len(valBytes) != 16 {
+		return 0, 0
+	}
+	return DecodeUint64(valBytes[:8]), DecodeUint64(valBytes[8:])
 }
 
-func DbGetForbiddenBlockSignaturePubKey(db *badger.DB, publicKey []byte) []byte {
-	var ret []byte
-	db.View(func(txn *badger.Txn) error {
-		ret = DbGetForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
-		return nil
-	})
-	return ret
+func _dbPutUnreadMessageCountWithTxn(txn KVTxn, publicKey []byte,
+	unreadCount uint64, readUpToTstampNanos uint64) error {
+
+	return txn.Set(_dbKeyForUnreadMessageCount(publicKey),
+		append(EncodeUint64(unreadCount), EncodeUint64(readUpToTstampNanos)...))
 }
 
-func DbDeleteForbiddenBlockSignaturePubKeyWithTxn(txn *badger.Txn, publicKey []byte) error {
+// _isUnreadMessage returns true if the message counts towards the recipient's
+// unread count given the tstamp the recipient has read up to.
+func _isUnreadMessage(messageEntry *MessageEntry, readUpToTstampNanos uint64) bool {
+	return messageEntry.TstampNanos > readUpToTstampNanos &&
+		!bytes.Equal(messageEntry.SenderPublicKey, messageEntry.RecipientPublicKey)
+}
 
-	existingEntry := DbGetForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
-	if existingEntry == nil {
+func _dbUpdateUnreadMessageCountWithTxn(txn KVTxn, messageEntry *MessageEntry, isAdd bool) error {
+	unreadCount, readUpToTstampNanos := _dbGetUnreadMessageCountWithTxn(txn, messageEntry.RecipientPublicKey)
+	if !_isUnreadMessage(messageEntry, readUpToTstampNanos) {
 		return nil
 	}
-
-	if err := txn.Delete(_dbKeyForForbiddenBlockSignaturePubKeys(publicKey)); err != nil {
-		return errors.Wrapf(err, "DbDeleteForbiddenBlockSignaturePubKeyWithTxn: Deleting "+
-			"sender mapping for public key %s failed", PkToStringMainnet(publicKey))
+	if isAdd {
+		unreadCount++
+	} else if unreadCount > 0 {
+		unreadCount--
 	}
-
-	return nil
+	return _dbPutUnreadMessageCountWithTxn(txn, messageEntry.RecipientPublicKey, unreadCount, readUpToTstampNanos)
 }
 
-func DbDeleteForbiddenBlockSignaturePubKey(handle *badger.DB, publicKey []byte) error {
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbDeleteForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
+// DbGetUnreadMessageCount returns the number of messages the public key has
+// received that it hasn't marked as read. Messages stored before the count was
+// introduced aren't included.
+func DbGetUnreadMessageCount(handle *badger.DB, publicKey []byte) uint64 {
+	var unreadCount uint64
+	DbView(handle, func(txn KVTxn) error {
+		unreadCount, _ = _dbGetUnreadMessageCountWithTxn(txn, publicKey)
+		return nil
 	})
+	return unreadCount
 }
 
-// -------------------------------------------------------------------------------------
-// Likes mapping functions
-// 		<prefix, user pub key [33]byte, liked post BlockHash> -> <>
-// 		<prefix, liked post BlockHash, user pub key [33]byte> -> <>
-// -------------------------------------------------------------------------------------
+// DbMarkMessagesRead marks every message the public key received at or before
+// readUpToTstampNanos as read. Pass math.MaxUint64 to mark everything as read.
+// Marking messages read never makes a read message unread again.
+func DbMarkMessagesRead(handle *badger.DB, publicKey []byte, readUpToTstampNanos uint64) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		_, prevReadUpToTstampNanos := _dbGetUnreadMessageCountWithTxn(txn, publicKey)
+		if readUpToTstampNanos <= prevReadUpToTstampNanos {
+			return nil
+		}
 
-func _dbKeyForLikerPubKeyToLikedPostHashMapping(
-	userPubKey []byte, likedPostHash BlockHash) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixLikerPubKeyToLikedPostHash...)
-	key := append(prefixCopy, userPubKey...)
-	key = append(key, likedPostHash[:]...)
-	return key
-}
+		// Count the messages received after the new read point. These are the
+		// newest messages so this is usually a short scan.
+		unreadCount := uint64(0)
+		if readUpToTstampNanos != math.MaxUint64 {
+			_, valsFound, err := DBGetPaginatedKeysAndValuesForPrefixWithTxn(
+				txn, _dbKeyForMessageEntry(publicKey, readUpToTstampNanos+1),
+				_dbSeekPrefixForMessagePublicKey(publicKey), 0 /*maxKeyLen*/, 0, /*numToFetch*/
+				false /*reverse*/, true /*fetchValues*/)
+			if err != nil {
+				return errors.Wrapf(err, "DbMarkMessagesRead: Problem fetching messages")
+			}
+			for _, valBytes := range valsFound {
+				messageEntry := &MessageEntry{}
+				if err := _DbDecodeMessageEntry(valBytes, messageEntry); err != nil {
+					return errors.Wrapf(err, "DbMarkMessagesRead: Problem decoding message")
+				}
+				if bytes.Equal(messageEntry.RecipientPublicKey, publicKey) &&
+					_isUnreadMessage(messageEntry, readUpToTstampNanos) {
 
-func _dbKeyForLikedPostHashToLikerPubKeyMapping(
-	likedPostHash BlockHash, userPubKey []byte) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixLikedPostHashToLikerPubKey...)
-	key := append(prefixCopy, likedPostHash[:]...)
-	key = append(key, userPubKey...)
-	return key
-}
+					unreadCount++
+				}
+			}
+		}
 
-func _dbSeekPrefixForPostHashesYouLike(yourPubKey []byte) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixLikerPubKeyToLikedPostHash...)
-	return append(prefixCopy, yourPubKey...)
+		return _dbPutUnreadMessageCountWithTxn(txn, publicKey, unreadCount, readUpToTstampNanos)
+	})
 }
 
-func _dbSeekPrefixForLikerPubKeysLikingAPostHash(likedPostHash BlockHash) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixLikedPostHashToLikerPubKey...)
-	return append(prefixCopy, likedPostHash[:]...)
-}
+// DbGetConversation fetches up to limit of the messages exchanged between two
+// public keys from newest to oldest, starting with the newest message sent
+// before beforeTstampNanos. A beforeTstampNanos of zero starts from the newest
+// message and a limit of zero fetches the whole conversation. The order of the
+// public keys doesn't matter.
+func DbGetConversation(handle *badger.DB, publicKeyA []byte, publicKeyB []byte,
+	limit int, beforeTstampNanos uint64) (_privateMessages []*MessageEntry, _err error) {
 
-// Note that this adds a mapping for the user *and* the liked post.
-func DbPutLikeMappingsWithTxn(
-	txn *badger.Txn, userPubKey []byte, likedPostHash BlockHash) error {
+	prefix := _dbSeekPrefixForConversation(publicKeyA, publicKeyB)
 
-	if len(userPubKey) != btcec.PubKeyBytesLenCompressed {
-		return fmt.Errorf("DbPutLikeMappingsWithTxn: User public key "+
+	dbIter := NewDBIterator(handle, prefix, true /*reverse*/, true /*fetchValues*/)
+	defer dbIter.Close()
+	if beforeTstampNanos != 0 {
+		// Seeking to the tstamp just before makes the start exclusive.
+		dbIter.Seek(_dbKeyForConversationMessage(publicKeyA, publicKeyB, beforeTstampNanos-1))
+	}
+
+	privateMessages := []*MessageEntry{}
+	for (limit == 0 || len(privateMessages) < limit) && dbIter.Next() {
+		privateMessageObj := &MessageEntry{}
+		if err := _DbDecodeMessageEntry(dbIter.Value(), privateMessageObj); err != nil {
+			return nil, errors.Wrapf(err, "DbGetConversation: Problem decoding value: ")
+		}
+		privateMessages = append(privateMessages, privateMessageObj)
+	}
+	if dbIter.Err() != nil {
+		return nil, errors.Wrapf(dbIter.Err(), "DbGetConversation: ")
+	}
+
+	return privateMessages, nil
+}
+
+// conversationIndexMigrationName marks whether messages stored before the
+// conversation index existed have been added to it.
+const conversationIndexMigrationName = "conversation-index"
+
+// DbBackfillConversationIndex adds the messages that were stored before the
+// conversation index existed to it. It only does the work once per db and
+// returns the number of messages it indexed.
+func DbBackfillConversationIndex(handle *badger.DB) (_numIndexed int, _err error) {
+	if DbGetIndexMigrationState(handle, conversationIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	// Each message is stored under both the sender and the recipient so only
+	// index it from the sender's side.
+	keysToIndex := [][]byte{}
+	valsToIndex := [][]byte{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixPublicKeyTimestampToPrivateMessage, func(_ []byte, valBytes []byte) (bool, error) {
+		messageEntry := &MessageEntry{}
+		if err := _DbDecodeMessageEntry(valBytes, messageEntry); err != nil {
+			return false, err
+		}
+		if messageEntry.SenderPublicKey == nil || bytes.Equal(messageEntry.SenderPublicKey, messageEntry.RecipientPublicKey) {
+			return true, nil
+		}
+		keysToIndex = append(keysToIndex, _dbKeyForConversationMessage(
+			messageEntry.SenderPublicKey, messageEntry.RecipientPublicKey, messageEntry.TstampNanos))
+		valsToIndex = append(valsToIndex, append([]byte{}, valBytes...))
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillConversationIndex: Problem reading messages")
+	}
+
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for ii := range keysToIndex {
+			if err := txnWriter.Set(keysToIndex[ii], valsToIndex[ii]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillConversationIndex: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, conversationIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillConversationIndex: Problem marking backfill complete")
+	}
+
+	return len(keysToIndex), nil
+}
+
+// -------------------------------------------------------------------------------------
+// Messaging group functions
+// <prefix, group owner public key, group key name> -> <MessagingGroupEntry>
+// <prefix, member public key, group id BlockHash, tstampNanos uint64> -> <GroupMessageEntry>
+// -------------------------------------------------------------------------------------
+
+func _dbKeyForMessagingGroupEntry(groupOwnerPublicKey []byte, groupKeyName []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixGroupOwnerKeyNameToMessagingGroupEntry...)
+	key := append(prefixCopy, groupOwnerPublicKey...)
+	return append(key, groupKeyName...)
+}
+
+func _dbSeekPrefixForGroupMessages(memberPublicKey []byte, groupID *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixMemberGroupIDTimestampToGroupMessage...)
+	key := append(prefixCopy, memberPublicKey...)
+	return append(key, groupID[:]...)
+}
+
+func _dbKeyForGroupMessage(memberPublicKey []byte, groupID *BlockHash, tstampNanos uint64) []byte {
+	return append(_dbSeekPrefixForGroupMessages(memberPublicKey, groupID), EncodeUint64(tstampNanos)...)
+}
+
+// _messagingGroupRecipients returns the owner followed by every member that isn't
+// the owner, which are the public keys a group message is stored under.
+func _messagingGroupRecipients(group *MessagingGroupEntry) [][]byte {
+	recipients := [][]byte{group.GroupOwnerPublicKey}
+	for _, member := range group.MessagingGroupMembers {
+		if !bytes.Equal(member.MemberPublicKey, group.GroupOwnerPublicKey) {
+			recipients = append(recipients, member.MemberPublicKey)
+		}
+	}
+	return recipients
+}
+
+func DbPutMessagingGroupEntryWithTxn(txn KVTxn, group *MessagingGroupEntry) error {
+	if len(group.GroupOwnerPublicKey) != btcec.PubKeyBytesLenCompressed {
+		return fmt.Errorf("DbPutMessagingGroupEntryWithTxn: Owner public key "+
+			"length %d != %d", len(group.GroupOwnerPublicKey), btcec.PubKeyBytesLenCompressed)
+	}
+	if len(group.MessagingGroupKeyName) == 0 ||
+		len(group.MessagingGroupKeyName) > MaxMessagingGroupKeyNameLength {
+
+		return fmt.Errorf("DbPutMessagingGroupEntryWithTxn: Group key name "+
+			"length %d must be between 1 and %d", len(group.MessagingGroupKeyName),
+			MaxMessagingGroupKeyNameLength)
+	}
+	for _, member := range group.MessagingGroupMembers {
+		if len(member.MemberPublicKey) != btcec.PubKeyBytesLenCompressed {
+			return fmt.Errorf("DbPutMessagingGroupEntryWithTxn: Member public key "+
+				"length %d != %d", len(member.MemberPublicKey), btcec.PubKeyBytesLenCompressed)
+		}
+	}
+
+	groupBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(groupBuf).Encode(group); err != nil {
+		return errors.Wrapf(err, "DbPutMessagingGroupEntryWithTxn: Problem encoding group")
+	}
+	return txn.Set(_dbKeyForMessagingGroupEntry(
+		group.GroupOwnerPublicKey, group.MessagingGroupKeyName), groupBuf.Bytes())
+}
+
+func DbPutMessagingGroupEntry(handle *badger.DB, group *MessagingGroupEntry) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutMessagingGroupEntryWithTxn(txn, group)
+	})
+}
+
+func DbGetMessagingGroupEntryWithTxn(
+	txn KVTxn, groupOwnerPublicKey []byte, groupKeyName []byte) *MessagingGroupEntry {
+
+	key := _dbKeyForMessagingGroupEntry(groupOwnerPublicKey, groupKeyName)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	groupObj := &MessagingGroupEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(groupObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetMessagingGroupEntryWithTxn: Problem reading group %s "+
+			"for owner %s", groupKeyName, PkToStringMainnet(groupOwnerPublicKey))
+		return nil
+	}
+	return groupObj
+}
+
+func DbGetMessagingGroupEntry(
+	handle *badger.DB, groupOwnerPublicKey []byte, groupKeyName []byte) *MessagingGroupEntry {
+
+	var ret *MessagingGroupEntry
+	DbView(handle, func(txn KVTxn) error {
+		ret = DbGetMessagingGroupEntryWithTxn(txn, groupOwnerPublicKey, groupKeyName)
+		return nil
+	})
+	return ret
+}
+
+// DbGetMessagingGroupEntriesForOwner returns every group the public key owns
+// ordered by name.
+func DbGetMessagingGroupEntriesForOwner(
+	handle *badger.DB, groupOwnerPublicKey []byte) ([]*MessagingGroupEntry, error) {
+
+	prefix := _dbKeyForMessagingGroupEntry(groupOwnerPublicKey, nil)
+	groups := []*MessagingGroupEntry{}
+	err := EnumerateKeysForPrefixWithCallback(handle, prefix, func(_ []byte, valBytes []byte) (bool, error) {
+		groupObj := &MessagingGroupEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(groupObj); err != nil {
+			return false, _corruptDbEntryError(err, "DbGetMessagingGroupEntriesForOwner: Problem decoding group")
+		}
+		groups = append(groups, groupObj)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// DbDeleteMessagingGroupEntryWithTxn deletes the group along with every message
+// stored for it under its current members.
+func DbDeleteMessagingGroupEntryWithTxn(
+	txn KVTxn, groupOwnerPublicKey []byte, groupKeyName []byte) error {
+
+	group := DbGetMessagingGroupEntryWithTxn(txn, groupOwnerPublicKey, groupKeyName)
+	if group == nil {
+		return nil
+	}
+
+	groupID := group.GroupID()
+	for _, recipient := range _messagingGroupRecipients(group) {
+		messageKeys, _, err := _enumerateKeysForPrefixWithTxn(txn, _dbSeekPrefixForGroupMessages(recipient, groupID))
+		if err != nil {
+			return errors.Wrapf(err, "DbDeleteMessagingGroupEntryWithTxn: Problem fetching messages")
+		}
+		for _, messageKey := range messageKeys {
+			if err := txn.Delete(messageKey); err != nil {
+				return errors.Wrapf(err, "DbDeleteMessagingGroupEntryWithTxn: Problem deleting message")
+			}
+		}
+	}
+
+	if err := txn.Delete(_dbKeyForMessagingGroupEntry(groupOwnerPublicKey, groupKeyName)); err != nil {
+		return errors.Wrapf(err, "DbDeleteMessagingGroupEntryWithTxn: Deleting group %s "+
+			"for owner %s failed", groupKeyName, PkToStringMainnet(groupOwnerPublicKey))
+	}
+	return nil
+}
+
+func DbDeleteMessagingGroupEntry(
+	handle *badger.DB, groupOwnerPublicKey []byte, groupKeyName []byte) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteMessagingGroupEntryWithTxn(txn, groupOwnerPublicKey, groupKeyName)
+	})
+}
+
+// DbPutGroupMessageEntryWithTxn stores the message for the owner and every member
+// of the group. The message's GroupID must match the group.
+func DbPutGroupMessageEntryWithTxn(
+	txn KVTxn, group *MessagingGroupEntry, messageEntry *GroupMessageEntry) error {
+
+	groupID := group.GroupID()
+	if messageEntry.GroupID == nil || *messageEntry.GroupID != *groupID {
+		return fmt.Errorf("DbPutGroupMessageEntryWithTxn: Message group id %v "+
+			"doesn't match group %v", messageEntry.GroupID, groupID)
+	}
+
+	messageBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(messageBuf).Encode(messageEntry); err != nil {
+		return errors.Wrapf(err, "DbPutGroupMessageEntryWithTxn: Problem encoding message")
+	}
+	for _, recipient := range _messagingGroupRecipients(group) {
+		if err := txn.Set(_dbKeyForGroupMessage(
+			recipient, groupID, messageEntry.TstampNanos), messageBuf.Bytes()); err != nil {
+
+			return errors.Wrapf(err, "DbPutGroupMessageEntryWithTxn: Problem adding "+
+				"mapping for member %s", PkToStringMainnet(recipient))
+		}
+	}
+	return nil
+}
+
+func DbPutGroupMessageEntry(
+	handle *badger.DB, group *MessagingGroupEntry, messageEntry *GroupMessageEntry) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutGroupMessageEntryWithTxn(txn, group, messageEntry)
+	})
+}
+
+// DbGetGroupMessageEntries fetches up to limit of a group's messages as stored
+// for the member from newest to oldest, starting with the newest message sent
+// before beforeTstampNanos. A beforeTstampNanos of zero starts from the newest
+// message and a limit of zero fetches every message.
+func DbGetGroupMessageEntries(handle *badger.DB, memberPublicKey []byte, groupID *BlockHash,
+	limit int, beforeTstampNanos uint64) ([]*GroupMessageEntry, error) {
+
+	dbIter := NewDBIterator(handle, _dbSeekPrefixForGroupMessages(memberPublicKey, groupID),
+		true /*reverse*/, true /*fetchValues*/)
+	defer dbIter.Close()
+	if beforeTstampNanos != 0 {
+		// Seeking to the tstamp just before makes the start exclusive.
+		dbIter.Seek(_dbKeyForGroupMessage(memberPublicKey, groupID, beforeTstampNanos-1))
+	}
+
+	messages := []*GroupMessageEntry{}
+	for (limit == 0 || len(messages) < limit) && dbIter.Next() {
+		messageObj := &GroupMessageEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(dbIter.Value())).Decode(messageObj); err != nil {
+			return nil, _corruptDbEntryError(err, "DbGetGroupMessageEntries: Problem decoding message")
+		}
+		messages = append(messages, messageObj)
+	}
+	if dbIter.Err() != nil {
+		return nil, errors.Wrapf(dbIter.Err(), "DbGetGroupMessageEntries: ")
+	}
+	return messages, nil
+}
+
+// DbDeleteGroupMessageEntryWithTxn deletes the message for the owner and every
+// member of the group.
+func DbDeleteGroupMessageEntryWithTxn(
+	txn KVTxn, group *MessagingGroupEntry, tstampNanos uint64) error {
+
+	groupID := group.GroupID()
+	for _, recipient := range _messagingGroupRecipients(group) {
+		if err := txn.Delete(_dbKeyForGroupMessage(recipient, groupID, tstampNanos)); err != nil {
+			return errors.Wrapf(err, "DbDeleteGroupMessageEntryWithTxn: Deleting "+
+				"mapping for member %s failed", PkToStringMainnet(recipient))
+		}
+	}
+	return nil
+}
+
+func DbDeleteGroupMessageEntry(
+	handle *badger.DB, group *MessagingGroupEntry, tstampNanos uint64) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteGroupMessageEntryWithTxn(txn, group, tstampNanos)
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// Forbidden block signature public key functions
+// <prefix, public key> -> <>
+// -------------------------------------------------------------------------------------
+
+func _dbKeyForForbiddenBlockSignaturePubKeys(publicKey []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixForbiddenBlockSignaturePubKeys...)
+	key := append(prefixCopy, publicKey...)
+	return key
+}
+
+func DbPutForbiddenBlockSignaturePubKeyWithTxn(txn KVTxn, publicKey []byte) error {
+
+	if len(publicKey) != btcec.PubKeyBytesLenCompressed {
+		return fmt.Errorf("DbPutForbiddenBlockSignaturePubKeyWithTxn: Forbidden public key "+
+			"length %d != %d", len(publicKey), btcec.PubKeyBytesLenCompressed)
+	}
+
+	if err := txn.Set(_dbKeyForForbiddenBlockSignaturePubKeys(publicKey), []byte{}); err != nil {
+		return errors.Wrapf(err, "DbPutForbiddenBlockSignaturePubKeyWithTxn: Problem adding mapping for sender: ")
+	}
+
+	return nil
+}
+
+func DbPutForbiddenBlockSignaturePubKey(handle *badger.DB, publicKey []byte) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
+	})
+}
+
+func DbGetForbiddenBlockSignaturePubKeyWithTxn(txn KVTxn, publicKey []byte) []byte {
+
+	key := _dbKeyForForbiddenBlockSignaturePubKeys(publicKey)
+	_, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	// Typically we return a DB entry here but we don't store anything for this mapping.
+	// We use this function instead of one returning true / false for feature consistency.
+	return []byte{}
+}
+
+func DbGetForbiddenBlockSignaturePubKey(db *badger.DB, publicKey []byte) []byte {
+	var ret []byte
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
+		return nil
+	})
+	return ret
+}
+
+func DbDeleteForbiddenBlockSignaturePubKeyWithTxn(txn KVTxn, publicKey []byte) error {
+
+	existingEntry := DbGetForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
+	if existingEntry == nil {
+		return nil
+	}
+
+	if err := txn.Delete(_dbKeyForForbiddenBlockSignaturePubKeys(publicKey)); err != nil {
+		return errors.Wrapf(err, "DbDeleteForbiddenBlockSignaturePubKeyWithTxn: Deleting "+
+			"sender mapping for public key %s failed", PkToStringMainnet(publicKey))
+	}
+
+	return nil
+}
+
+func DbDeleteForbiddenBlockSignaturePubKey(handle *badger.DB, publicKey []byte) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteForbiddenBlockSignaturePubKeyWithTxn(txn, publicKey)
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// Likes mapping functions
+// 		<prefix, user pub key [33]byte, liked post BlockHash> -> <>
+// 		<prefix, liked post BlockHash, user pub key [33]byte> -> <>
+// -------------------------------------------------------------------------------------
+
+func _dbKeyForLikerPubKeyToLikedPostHashMapping(
+	userPubKey []byte, likedPostHash BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixLikerPubKeyToLikedPostHash...)
+	key := append(prefixCopy, userPubKey...)
+	key = append(key, likedPostHash[:]...)
+	return key
+}
+
+func _dbKeyForLikedPostHashToLikerPubKeyMapping(
+	likedPostHash BlockHash, userPubKey []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixLikedPostHashToLikerPubKey...)
+	key := append(prefixCopy, likedPostHash[:]...)
+	key = append(key, userPubKey...)
+	return key
+}
+
+func _dbSeekPrefixForPostHashesYouLike(yourPubKey []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixLikerPubKeyToLikedPostHash...)
+	return append(prefixCopy, yourPubKey...)
+}
+
+func _dbSeekPrefixForLikerPubKeysLikingAPostHash(likedPostHash BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixLikedPostHashToLikerPubKey...)
+	return append(prefixCopy, likedPostHash[:]...)
+}
+
+// Note that this adds a mapping for the user *and* the liked post.
+func DbPutLikeMappingsWithTxn(
+	txn KVTxn, userPubKey []byte, likedPostHash BlockHash) error {
+
+	if len(userPubKey) != btcec.PubKeyBytesLenCompressed {
+		return fmt.Errorf("DbPutLikeMappingsWithTxn: User public key "+
 			"length %d != %d", len(userPubKey), btcec.PubKeyBytesLenCompressed)
 	}
 
+	// Only count the like if it's new.
+	if DbGetLikerPubKeyToLikedPostHashMappingWithTxn(txn, userPubKey, likedPostHash) == nil {
+		if err := _dbAdjustPostEngagementCountsWithTxn(txn, likedPostHash, 1, 0, 0); err != nil {
+			return errors.Wrapf(err, "DbPutLikeMappingsWithTxn: ")
+		}
+	}
+
 	if err := txn.Set(_dbKeyForLikerPubKeyToLikedPostHashMapping(
 		userPubKey, likedPostHash), []byte{}); err != nil {
 
@@ -780,13 +2079,13 @@ func DbPutLikeMappingsWithTxn(
 func DbPutLikeMappings(
 	handle *badger.DB, userPubKey []byte, likedPostHash BlockHash) error {
 
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbPutLikeMappingsWithTxn(txn, userPubKey, likedPostHash)
 	})
 }
 
 func DbGetLikerPubKeyToLikedPostHashMappingWithTxn(
-	txn *badger.Txn, userPubKey []byte, likedPostHash BlockHash) []byte {
+	txn KVTxn, userPubKey []byte, likedPostHash BlockHash) []byte {
 
 	key := _dbKeyForLikerPubKeyToLikedPostHashMapping(userPubKey, likedPostHash)
 	_, err := txn.Get(key)
@@ -802,7 +2101,7 @@ func DbGetLikerPubKeyToLikedPostHashMappingWithTxn(
 func DbGetLikerPubKeyToLikedPostHashMapping(
 	db *badger.DB, userPubKey []byte, likedPostHash BlockHash) []byte {
 	var ret []byte
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		ret = DbGetLikerPubKeyToLikedPostHashMappingWithTxn(txn, userPubKey, likedPostHash)
 		return nil
 	})
@@ -812,7 +2111,7 @@ func DbGetLikerPubKeyToLikedPostHashMapping(
 // Note this deletes the like for the user *and* the liked post since a mapping
 // should exist for each.
 func DbDeleteLikeMappingsWithTxn(
-	txn *badger.Txn, userPubKey []byte, likedPostHash BlockHash) error {
+	txn KVTxn, userPubKey []byte, likedPostHash BlockHash) error {
 
 	// First check that a mapping exists. If one doesn't exist then there's nothing to do.
 	existingMapping := DbGetLikerPubKeyToLikedPostHashMappingWithTxn(
@@ -834,13 +2133,16 @@ func DbDeleteLikeMappingsWithTxn(
 			"likedPostHash %s and userPubKey %s failed",
 			PkToStringBoth(likedPostHash[:]), PkToStringBoth(userPubKey))
 	}
+	if err := _dbAdjustPostEngagementCountsWithTxn(txn, likedPostHash, -1, 0, 0); err != nil {
+		return errors.Wrapf(err, "DbDeleteLikeMappingsWithTxn: ")
+	}
 
 	return nil
 }
 
 func DbDeleteLikeMappings(
 	handle *badger.DB, userPubKey []byte, likedPostHash BlockHash) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbDeleteLikeMappingsWithTxn(txn, userPubKey, likedPostHash)
 	})
 }
@@ -849,15 +2151,18 @@ func DbGetPostHashesYouLike(handle *badger.DB, yourPublicKey []byte) (
 	_postHashes []*BlockHash, _err error) {
 
 	prefix := _dbSeekPrefixForPostHashesYouLike(yourPublicKey)
-	keysFound, _ := _enumerateKeysForPrefix(handle, prefix)
 
 	postHashesYouLike := []*BlockHash{}
-	for _, keyBytes := range keysFound {
+	err := EnumerateKeysForPrefixWithCallback(handle, prefix, func(keyBytes []byte, _ []byte) (bool, error) {
 		// We must slice off the first byte and userPubKey to get the likedPostHash.
 		postHash := &BlockHash{}
 		copy(postHash[:], keyBytes[1+btcec.PubKeyBytesLenCompressed:])
 		postHashesYouLike = append(postHashesYouLike, postHash)
-	}
+		return true, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetPostHashesYouLike: ")
+	}
 
 	return postHashesYouLike, nil
 }
@@ -866,13 +2171,16 @@ func DbGetLikerPubKeysLikingAPostHash(handle *badger.DB, likedPostHash BlockHash
 	_pubKeys [][]byte, _err error) {
 
 	prefix := _dbSeekPrefixForLikerPubKeysLikingAPostHash(likedPostHash)
-	keysFound, _ := _enumerateKeysForPrefix(handle, prefix)
 
 	userPubKeys := [][]byte{}
-	for _, keyBytes := range keysFound {
+	err := EnumerateKeysForPrefixWithCallback(handle, prefix, func(keyBytes []byte, _ []byte) (bool, error) {
 		// We must slice off the first byte and likedPostHash to get the userPubKey.
-		userPubKey := keyBytes[1+HashSizeBytes:]
+		userPubKey := append([]byte{}, keyBytes[1+HashSizeBytes:]...)
 		userPubKeys = append(userPubKeys, userPubKey)
+		return true, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetLikerPubKeysLikingAPostHash: ")
 	}
 
 	return userPubKeys, nil
@@ -880,8 +2188,8 @@ func DbGetLikerPubKeysLikingAPostHash(handle *badger.DB, likedPostHash BlockHash
 
 // -------------------------------------------------------------------------------------
 // Reclouts mapping functions
-// 		<prefix, user pub key [33]byte, reclouted post BlockHash> -> <>
-// 		<prefix, reclouted post BlockHash, user pub key [33]byte> -> <>
+// 		<prefix, user pub key [33]byte, reclouted post BlockHash> -> <RecloutEntry>
+// 		<prefix, reclouted post BlockHash, user pub key [33]byte> -> <RecloutEntry>
 // -------------------------------------------------------------------------------------
 //_PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash
 func _dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(userPubKey []byte, recloutedPostHash BlockHash) []byte {
@@ -892,6 +2200,52 @@ func _dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(userPubKey []byt
 	return key
 }
 
+// _PrefixRecloutedPostHashReclouterPubKeyToRecloutEntry
+func _dbKeyForRecloutedPostHashReclouterPubKey(recloutedPostHash BlockHash, userPubKey []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _dbSeekPrefixForReclouterPubKeysOfPostHash(recloutedPostHash)...)
+	return append(key, userPubKey...)
+}
+
+func _dbSeekPrefixForReclouterPubKeysOfPostHash(recloutedPostHash BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixRecloutedPostHashReclouterPubKeyToRecloutEntry...)
+	return append(prefixCopy, recloutedPostHash[:]...)
+}
+
+// _dbSetRecloutMappingsWithTxn sets the reclout entry under the reclouter and
+// under the reclouted post.
+func _dbSetRecloutMappingsWithTxn(txn KVTxn, userPubKey []byte, recloutedPostHash BlockHash,
+	recloutEntry RecloutEntry) error {
+
+	recloutDataBuf := bytes.NewBuffer([]byte{})
+	gob.NewEncoder(recloutDataBuf).Encode(recloutEntry)
+
+	if err := txn.Set(_dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(
+		userPubKey, recloutedPostHash), recloutDataBuf.Bytes()); err != nil {
+
+		return errors.Wrapf(err, "Problem adding user to reclouted post mapping: ")
+	}
+	if err := txn.Set(_dbKeyForRecloutedPostHashReclouterPubKey(
+		recloutedPostHash, userPubKey), recloutDataBuf.Bytes()); err != nil {
+
+		return errors.Wrapf(err, "Problem adding reclouted post to user mapping: ")
+	}
+	return nil
+}
+
+// _dbDeleteRecloutMappingsWithTxn deletes both of the keys set by
+// _dbSetRecloutMappingsWithTxn.
+func _dbDeleteRecloutMappingsWithTxn(txn KVTxn, userPubKey []byte, recloutedPostHash BlockHash) error {
+	if err := txn.Delete(_dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(userPubKey, recloutedPostHash)); err != nil {
+		return errors.Wrapf(err, "Problem deleting user to reclouted post mapping: ")
+	}
+	if err := txn.Delete(_dbKeyForRecloutedPostHashReclouterPubKey(recloutedPostHash, userPubKey)); err != nil {
+		return errors.Wrapf(err, "Problem deleting reclouted post to user mapping: ")
+	}
+	return nil
+}
+
 func _dbSeekPrefixForPostHashesYouReclout(yourPubKey []byte) []byte {
 	// Make a copy to avoid multiple calls to this function re-using the same slice.
 	prefixCopy := append([]byte{}, _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash...)
@@ -900,21 +2254,19 @@ func _dbSeekPrefixForPostHashesYouReclout(yourPubKey []byte) []byte {
 
 // Note that this adds a mapping for the user *and* the reclouted post.
 func DbPutRecloutMappingsWithTxn(
-	txn *badger.Txn, userPubKey []byte, recloutedPostHash BlockHash, recloutEntry RecloutEntry) error {
+	txn KVTxn, userPubKey []byte, recloutedPostHash BlockHash, recloutEntry RecloutEntry) error {
 
 	if len(userPubKey) != btcec.PubKeyBytesLenCompressed {
 		return fmt.Errorf("DbPutRecloutMappingsWithTxn: User public key "+
 			"length %d != %d", len(userPubKey), btcec.PubKeyBytesLenCompressed)
 	}
 
-	recloutDataBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(recloutDataBuf).Encode(recloutEntry)
-
-	if err := txn.Set(_dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(
-		userPubKey, recloutedPostHash), recloutDataBuf.Bytes()); err != nil {
+	if err := _dbCountNewRecloutWithTxn(txn, userPubKey, recloutedPostHash); err != nil {
+		return errors.Wrapf(err, "DbPutRecloutMappingsWithTxn: ")
+	}
 
-		return errors.Wrapf(
-			err, "DbPutRecloutMappingsWithTxn: Problem adding user to reclouted post mapping: ")
+	if err := _dbSetRecloutMappingsWithTxn(txn, userPubKey, recloutedPostHash, recloutEntry); err != nil {
+		return errors.Wrapf(err, "DbPutRecloutMappingsWithTxn: ")
 	}
 
 	return nil
@@ -923,24 +2275,23 @@ func DbPutRecloutMappingsWithTxn(
 func DbPutRecloutMappings(
 	handle *badger.DB, userPubKey []byte, recloutedPostHash BlockHash, recloutEntry RecloutEntry) error {
 
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbPutRecloutMappingsWithTxn(txn, userPubKey, recloutedPostHash, recloutEntry)
 	})
 }
 
 func DbGetReclouterPubKeyRecloutedPostHashToRecloutEntryWithTxn(
-	txn *badger.Txn, userPubKey []byte, recloutedPostHash BlockHash) *RecloutEntry {
+	txn KVTxn, userPubKey []byte, recloutedPostHash BlockHash) *RecloutEntry {
 
 	key := _dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(userPubKey, recloutedPostHash)
 	recloutEntryObj := &RecloutEntry{}
-	recloutEntryItem, err := txn.Get(key)
+	valBytes, err := txn.Get(key)
 	if err != nil {
 		return nil
 	}
-	err = recloutEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(recloutEntryObj)
-	})
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(recloutEntryObj)
 	if err != nil {
+		RecordDbDecodeFailure(key)
 		glog.Errorf("DbGetReclouterPubKeyRecloutedPostHashToRecloutedPostMappingWithTxn: Problem reading "+
 			"RecloutEntry for postHash %v", recloutedPostHash)
 		return nil
@@ -951,7 +2302,7 @@ func DbGetReclouterPubKeyRecloutedPostHashToRecloutEntryWithTxn(
 func DbReclouterPubKeyRecloutedPostHashToRecloutEntry(
 	db *badger.DB, userPubKey []byte, recloutedPostHash BlockHash) *RecloutEntry {
 	var ret *RecloutEntry
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		ret = DbGetReclouterPubKeyRecloutedPostHashToRecloutEntryWithTxn(txn, userPubKey, recloutedPostHash)
 		return nil
 	})
@@ -961,7 +2312,7 @@ func DbReclouterPubKeyRecloutedPostHashToRecloutEntry(
 // Note this deletes the reclout for the user *and* the reclouted post since a mapping
 // should exist for each.
 func DbDeleteRecloutMappingsWithTxn(
-	txn *badger.Txn, userPubKey []byte, recloutedPostHash BlockHash) error {
+	txn KVTxn, userPubKey []byte, recloutedPostHash BlockHash) error {
 
 	// First check that a mapping exists. If one doesn't exist then there's nothing to do.
 	existingMapping := DbGetReclouterPubKeyRecloutedPostHashToRecloutEntryWithTxn(
@@ -970,18 +2321,30 @@ func DbDeleteRecloutMappingsWithTxn(
 		return nil
 	}
 
-	// When a reclout exists, delete the reclout entry mapping.
-	if err := txn.Delete(_dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(userPubKey, recloutedPostHash)); err != nil {
+	// When a reclout exists, delete the reclout entry mappings.
+	if err := _dbDeleteRecloutMappingsWithTxn(txn, userPubKey, recloutedPostHash); err != nil {
 		return errors.Wrapf(err, "DbDeleteRecloutMappingsWithTxn: Deleting "+
 			"user public key %s and reclouted post hash %s failed",
 			PkToStringMainnet(userPubKey[:]), PkToStringMainnet(recloutedPostHash[:]))
 	}
+	if err := _dbAdjustPostEngagementCountsWithTxn(txn, recloutedPostHash, 0, 0, -1); err != nil {
+		return errors.Wrapf(err, "DbDeleteRecloutMappingsWithTxn: ")
+	}
 	return nil
 }
 
+// _dbCountNewRecloutWithTxn counts a reclout mapping that's about to be added
+// unless it already exists.
+func _dbCountNewRecloutWithTxn(txn KVTxn, userPubKey []byte, recloutedPostHash BlockHash) error {
+	if DbGetReclouterPubKeyRecloutedPostHashToRecloutEntryWithTxn(txn, userPubKey, recloutedPostHash) != nil {
+		return nil
+	}
+	return _dbAdjustPostEngagementCountsWithTxn(txn, recloutedPostHash, 0, 0, 1)
+}
+
 func DbDeleteRecloutMappings(
 	handle *badger.DB, userPubKey []byte, recloutedPostHash BlockHash) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbDeleteRecloutMappingsWithTxn(txn, userPubKey, recloutedPostHash)
 	})
 }
@@ -1003,6 +2366,261 @@ func DbGetPostHashesYouReclout(handle *badger.DB, yourPublicKey []byte) (
 	return postHashesYouReclout, nil
 }
 
+// DbGetReclouterPubKeysForPostHash returns up to limit public keys that
+// vanilla reclouted the post, starting at startPubKey if it's set. Pass the
+// public key after the last one returned as the next startPubKey to fetch the
+// next page. A limit of zero returns all of them.
+func DbGetReclouterPubKeysForPostHash(handle *badger.DB, recloutedPostHash BlockHash,
+	limit int, startPubKey []byte) (_reclouterPubKeys [][]byte, _err error) {
+
+	prefix := _dbSeekPrefixForReclouterPubKeysOfPostHash(recloutedPostHash)
+	startPrefix := append(append([]byte{}, prefix...), startPubKey...)
+	keysFound, _, err := DBGetPaginatedKeysAndValuesForPrefix(
+		handle, startPrefix, prefix, /*validForPrefix*/
+		0 /*keyLen*/, limit, false /*reverse*/, false /*fetchValues*/)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetReclouterPubKeysForPostHash: ")
+	}
+
+	reclouterPubKeys := [][]byte{}
+	for _, keyBytes := range keysFound {
+		// We must slice off the prefix and the post hash to get the public key.
+		reclouterPubKeys = append(reclouterPubKeys, append([]byte{}, keyBytes[len(prefix):]...))
+	}
+	return reclouterPubKeys, nil
+}
+
+// recloutReverseIndexMigrationName marks whether the reclouts stored before
+// the reverse reclout index existed have been added to it.
+const recloutReverseIndexMigrationName = "reclout-reverse-index"
+
+// DbBackfillRecloutReverseIndex adds the reclouts that were stored before the
+// reverse reclout index existed to it by repairing the reclouts reverse
+// mapping pair. It only does the work once per db and returns the number of
+// reclouts it indexed.
+func DbBackfillRecloutReverseIndex(handle *badger.DB) (_numIndexed int, _err error) {
+	if DbGetIndexMigrationState(handle, recloutReverseIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	reports, err := DbRepairReverseMappings(
+		handle, []*ReverseMappingPair{recloutsReverseMappingPair}, false /*dryRun*/)
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillRecloutReverseIndex: Problem writing reverse mappings")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, recloutReverseIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillRecloutReverseIndex: Problem marking backfill complete")
+	}
+
+	return reports[0].NumRepaired, nil
+}
+
+// -------------------------------------------------------------------------------------
+// Post engagement count functions
+// 		<prefix, post hash BlockHash> -> <likes uint64, comments uint64, reclouts uint64>
+//
+// The counts are kept up to date by the like, comment, and reclout mapping
+// functions so they never need to enumerate those indexes. A mapping is only
+// counted when it's added for the first time and only uncounted when one that
+// exists is deleted, which keeps the counts right when a flush deletes and then
+// re-adds the same mapping.
+// -------------------------------------------------------------------------------------
+
+// PostEngagementCounts is how many likes, comments, and vanilla reclouts a post
+// has on the main chain.
+type PostEngagementCounts struct {
+	LikeCount    uint64
+	CommentCount uint64
+	RecloutCount uint64
+}
+
+func _dbKeyForPostEngagementCounts(postHash BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPostHashToEngagementCounts...)
+	return append(prefixCopy, postHash[:]...)
+}
+
+// DBGetPostEngagementCountsWithTxn returns all zeros for a post nobody has
+// engaged with.
+func DBGetPostEngagementCountsWithTxn(txn KVTxn, postHash BlockHash) (*PostEngagementCounts, error) {
+	counts := &PostEngagementCounts{}
+	valBytes, err := txn.Get(_dbKeyForPostEngagementCounts(postHash))
+	if err == ErrKVKeyNotFound {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, _wrapDbError(err, "DBGetPostEngagementCountsWithTxn: Problem fetching "+
+			"counts for post %v", postHash)
+	}
+	if len(valBytes) != 24 {
+		return nil, errors.Wrapf(ErrEntryCorrupt, "DBGetPostEngagementCountsWithTxn: Counts "+
+			"for post %v have length %d", postHash, len(valBytes))
+	}
+	counts.LikeCount = DecodeUint64(valBytes[0:8])
+	counts.CommentCount = DecodeUint64(valBytes[8:16])
+	counts.RecloutCount = DecodeUint64(valBytes[16:24])
+	return counts, nil
+}
+
+func DBGetPostEngagementCounts(handle *badger.DB, postHash BlockHash) (*PostEngagementCounts, error) {
+	var counts *PostEngagementCounts
+	err := DbView(handle, func(txn KVTxn) error {
+		var err error
+		counts, err = DBGetPostEngagementCountsWithTxn(txn, postHash)
+		return err
+	})
+	if err != nil {
+		return nil, _wrapDbError(err, "DBGetPostEngagementCounts")
+	}
+	return counts, nil
+}
+
+func _dbPutPostEngagementCountsWithTxn(txn KVTxn, postHash BlockHash, counts *PostEngagementCounts) error {
+	if counts.LikeCount == 0 && counts.CommentCount == 0 && counts.RecloutCount == 0 {
+		return txn.Delete(_dbKeyForPostEngagementCounts(postHash))
+	}
+	valBytes := append([]byte{}, EncodeUint64(counts.LikeCount)...)
+	valBytes = append(valBytes, EncodeUint64(counts.CommentCount)...)
+	valBytes = append(valBytes, EncodeUint64(counts.RecloutCount)...)
+	return txn.Set(_dbKeyForPostEngagementCounts(postHash), valBytes)
+}
+
+// _addToCount adds delta to count without going below zero.
+func _addToCount(count uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > count {
+		return 0
+	}
+	return uint64(int64(count) + delta)
+}
+
+func _dbAdjustPostEngagementCountsWithTxn(txn KVTxn, postHash BlockHash,
+	likeDelta int64, commentDelta int64, recloutDelta int64) error {
+
+	counts, err := DBGetPostEngagementCountsWithTxn(txn, postHash)
+	if err != nil {
+		return err
+	}
+	counts.LikeCount = _addToCount(counts.LikeCount, likeDelta)
+	counts.CommentCount = _addToCount(counts.CommentCount, commentDelta)
+	counts.RecloutCount = _addToCount(counts.RecloutCount, recloutDelta)
+	if err := _dbPutPostEngagementCountsWithTxn(txn, postHash, counts); err != nil {
+		return errors.Wrapf(err, "_dbAdjustPostEngagementCountsWithTxn: Problem "+
+			"updating counts for post %v", postHash)
+	}
+	return nil
+}
+
+// postEngagementCountsMigrationName marks whether the likes, comments, and
+// reclouts stored before the engagement counts existed have been counted.
+const postEngagementCountsMigrationName = "post-engagement-counts"
+
+// DbBackfillPostEngagementCounts counts the likes, comments, and reclouts that
+// were stored before the engagement counts existed. It only does the work once
+// per db and returns the number of posts it set counts for.
+func DbBackfillPostEngagementCounts(handle *badger.DB) (_numPosts int, _err error) {
+	if DbGetIndexMigrationState(handle, postEngagementCountsMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	numPosts, err := _dbWritePostEngagementCounts(handle)
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillPostEngagementCounts: ")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, postEngagementCountsMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillPostEngagementCounts: Problem marking backfill complete")
+	}
+
+	return numPosts, nil
+}
+
+// _dbWritePostEngagementCounts counts the likes, comments, and reclouts of every
+// post and writes the counts. It returns the number of posts it wrote counts for.
+func _dbWritePostEngagementCounts(handle *badger.DB) (_numPosts int, _err error) {
+	countsForPost := make(map[BlockHash]*PostEngagementCounts)
+	countsFor := func(postHash BlockHash) *PostEngagementCounts {
+		if _, exists := countsForPost[postHash]; !exists {
+			countsForPost[postHash] = &PostEngagementCounts{}
+		}
+		return countsForPost[postHash]
+	}
+
+	// <prefix, liked post hash, liker public key>
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixLikedPostHashToLikerPubKey, func(key []byte, _ []byte) (bool, error) {
+		postHash := BlockHash{}
+		copy(postHash[:], key[1:1+HashSizeBytes])
+		countsFor(postHash).LikeCount++
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Problem counting likes")
+	}
+
+	// <prefix, reclouter public key, reclouted post hash>
+	err = EnumerateKeysForPrefixWithCallback(handle, _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash, func(key []byte, _ []byte) (bool, error) {
+		postHash := BlockHash{}
+		copy(postHash[:], key[1+btcec.PubKeyBytesLenCompressed:])
+		countsFor(postHash).RecloutCount++
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Problem counting reclouts")
+	}
+
+	// <prefix, extended parent stake ID, tstamp, comment post hash>. Only
+	// comments on posts are counted but the comments on profiles are in the
+	// same index, so check the parent post exists.
+	err = DbView(handle, func(txn KVTxn) error {
+		return EnumerateKeysForPrefixWithCallbackWithTxn(txn, _PrefixCommentParentStakeIDToPostHash, func(key []byte, _ []byte) (bool, error) {
+			if key[1+HashSizeBytes] != 0x00 {
+				return true, nil
+			}
+			postHash := BlockHash{}
+			copy(postHash[:], key[1:1+HashSizeBytes])
+			if DBGetPostEntryByPostHashWithTxn(txn, &postHash) != nil {
+				countsFor(postHash).CommentCount++
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Problem counting comments")
+	}
+
+	postHashes := []BlockHash{}
+	for postHash := range countsForPost {
+		postHashes = append(postHashes, postHash)
+	}
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, postHashIter := range postHashes {
+			postHash := postHashIter
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				return _dbPutPostEngagementCountsWithTxn(txn, postHash, countsForPost[postHash])
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Problem writing counts")
+	}
+	return len(postHashes), nil
+}
+
 // -------------------------------------------------------------------------------------
 // Follows mapping functions
 // 		<prefix, follower pub key [33]byte, followed pub key [33]byte> -> <>
@@ -1041,7 +2659,7 @@ func _dbSeekPrefixForPKIDsFollowingYou(yourPKID *PKID) []byte {
 
 // Note that this adds a mapping for the follower *and* the pub key being followed.
 func DbPutFollowMappingsWithTxn(
-	txn *badger.Txn, followerPKID *PKID, followedPKID *PKID) error {
+	txn KVTxn, followerPKID *PKID, followedPKID *PKID) error {
 
 	if len(followerPKID) != btcec.PubKeyBytesLenCompressed {
 		return fmt.Errorf("DbPutFollowMappingsWithTxn: Follower PKID "+
@@ -1052,6 +2670,13 @@ func DbPutFollowMappingsWithTxn(
 			"length %d != %d", len(followerPKID), btcec.PubKeyBytesLenCompressed)
 	}
 
+	// Only count the follow if it's new.
+	if DbGetFollowerToFollowedMappingWithTxn(txn, followerPKID, followedPKID) == nil {
+		if err := _dbAddToFollowCountsWithTxn(txn, followerPKID, followedPKID, 1); err != nil {
+			return errors.Wrapf(err, "DbPutFollowMappingsWithTxn: ")
+		}
+	}
+
 	if err := txn.Set(_dbKeyForFollowerToFollowedMapping(
 		followerPKID, followedPKID), []byte{}); err != nil {
 
@@ -1071,13 +2696,13 @@ func DbPutFollowMappingsWithTxn(
 func DbPutFollowMappings(
 	handle *badger.DB, followerPKID *PKID, followedPKID *PKID) error {
 
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbPutFollowMappingsWithTxn(txn, followerPKID, followedPKID)
 	})
 }
 
 func DbGetFollowerToFollowedMappingWithTxn(
-	txn *badger.Txn, followerPKID *PKID, followedPKID *PKID) []byte {
+	txn KVTxn, followerPKID *PKID, followedPKID *PKID) []byte {
 
 	key := _dbKeyForFollowerToFollowedMapping(followerPKID, followedPKID)
 	_, err := txn.Get(key)
@@ -1092,7 +2717,7 @@ func DbGetFollowerToFollowedMappingWithTxn(
 
 func DbGetFollowerToFollowedMapping(db *badger.DB, followerPKID *PKID, followedPKID *PKID) []byte {
 	var ret []byte
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		ret = DbGetFollowerToFollowedMappingWithTxn(txn, followerPKID, followedPKID)
 		return nil
 	})
@@ -1102,7 +2727,7 @@ func DbGetFollowerToFollowedMapping(db *badger.DB, followerPKID *PKID, followedP
 // Note this deletes the follow for the follower *and* followed since a mapping
 // should exist for each.
 func DbDeleteFollowMappingsWithTxn(
-	txn *badger.Txn, followerPKID *PKID, followedPKID *PKID) error {
+	txn KVTxn, followerPKID *PKID, followedPKID *PKID) error {
 
 	// First check that a mapping exists for the PKIDs passed in.
 	// If one doesn't exist then there's nothing to do.
@@ -1123,59 +2748,228 @@ func DbDeleteFollowMappingsWithTxn(
 			"followedPKID %s and followerPKID %s failed",
 			PkToStringMainnet(followedPKID[:]), PkToStringMainnet(followerPKID[:]))
 	}
+	if err := _dbAddToFollowCountsWithTxn(txn, followerPKID, followedPKID, -1); err != nil {
+		return errors.Wrapf(err, "DbDeleteFollowMappingsWithTxn: ")
+	}
 
 	return nil
 }
 
 func DbDeleteFollowMappings(
 	handle *badger.DB, followerPKID *PKID, followedPKID *PKID) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbDeleteFollowMappingsWithTxn(txn, followerPKID, followedPKID)
 	})
 }
 
-func DbGetPKIDsYouFollow(handle *badger.DB, yourPKID *PKID) (
+// _dbGetPaginatedFollowPKIDs returns the PKIDs in the second half of the follow
+// keys under prefix, starting at startPKID if it's set. A limit of zero returns
+// all of them.
+func _dbGetPaginatedFollowPKIDs(handle *badger.DB, prefix []byte, limit int, startPKID *PKID) (
 	_pkids []*PKID, _err error) {
 
-	prefix := _dbSeekPrefixForPKIDsYouFollow(yourPKID)
-	keysFound, _ := _enumerateKeysForPrefix(handle, prefix)
+	startPrefix := append([]byte{}, prefix...)
+	if startPKID != nil {
+		startPrefix = append(startPrefix, startPKID[:]...)
+	}
+	keysFound, _, err := DBGetPaginatedKeysAndValuesForPrefix(
+		handle, startPrefix, prefix, /*validForPrefix*/
+		0 /*keyLen*/, limit, false /*reverse*/, false /*fetchValues*/)
+	if err != nil {
+		return nil, err
+	}
 
-	pkidsYouFollow := []*PKID{}
+	pkids := []*PKID{}
 	for _, keyBytes := range keysFound {
-		// We must slice off the first byte and followerPKID to get the followedPKID.
-		followedPKIDBytes := keyBytes[1+btcec.PubKeyBytesLenCompressed:]
-		followedPKID := &PKID{}
-		copy(followedPKID[:], followedPKIDBytes)
-		pkidsYouFollow = append(pkidsYouFollow, followedPKID)
+		// We must slice off the first byte and the PKID we searched for to get
+		// the other PKID.
+		pkid := &PKID{}
+		copy(pkid[:], keyBytes[1+btcec.PubKeyBytesLenCompressed:])
+		pkids = append(pkids, pkid)
+	}
+	return pkids, nil
+}
+
+// DbGetPKIDsYouFollow returns up to limit PKIDs that yourPKID follows, starting
+// at startPKID if it's set. Pass the PKID after the last one returned as the
+// next startPKID to fetch the next page. A limit of zero returns all of them.
+func DbGetPKIDsYouFollow(handle *badger.DB, yourPKID *PKID, limit int, startPKID *PKID) (
+	_pkids []*PKID, _err error) {
+
+	pkidsYouFollow, err := _dbGetPaginatedFollowPKIDs(
+		handle, _dbSeekPrefixForPKIDsYouFollow(yourPKID), limit, startPKID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetPKIDsYouFollow: ")
 	}
 
 	return pkidsYouFollow, nil
 }
 
-func DbGetPKIDsFollowingYou(handle *badger.DB, yourPKID *PKID) (
+// DbGetPKIDsFollowingYou returns up to limit PKIDs that follow yourPKID, starting
+// at startPKID if it's set. It pages the same way as DbGetPKIDsYouFollow.
+func DbGetPKIDsFollowingYou(handle *badger.DB, yourPKID *PKID, limit int, startPKID *PKID) (
 	_pkids []*PKID, _err error) {
 
-	prefix := _dbSeekPrefixForPKIDsFollowingYou(yourPKID)
-	keysFound, _ := _enumerateKeysForPrefix(handle, prefix)
-
-	pkidsFollowingYou := []*PKID{}
-	for _, keyBytes := range keysFound {
-		// We must slice off the first byte and followedPKID to get the followerPKID.
-		followerPKIDBytes := keyBytes[1+btcec.PubKeyBytesLenCompressed:]
-		followerPKID := &PKID{}
-		copy(followerPKID[:], followerPKIDBytes)
-		pkidsFollowingYou = append(pkidsFollowingYou, followerPKID)
+	pkidsFollowingYou, err := _dbGetPaginatedFollowPKIDs(
+		handle, _dbSeekPrefixForPKIDsFollowingYou(yourPKID), limit, startPKID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetPKIDsFollowingYou: ")
 	}
 
 	return pkidsFollowingYou, nil
 }
 
+// -------------------------------------------------------------------------------------
+// Follow count functions
+// 		<prefix, follower PKID [33]byte> -> <number of PKIDs it follows uint64>
+// 		<prefix, followed PKID [33]byte> -> <number of PKIDs following it uint64>
+//
+// Like the post engagement counts, a follow is only counted when its mapping is
+// added for the first time and only uncounted when an existing one is deleted.
+// -------------------------------------------------------------------------------------
+
+func _dbKeyForFollowingCount(pkid *PKID) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPKIDToFollowingCount...)
+	return append(prefixCopy, pkid[:]...)
+}
+
+func _dbKeyForFollowerCount(pkid *PKID) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPKIDToFollowerCount...)
+	return append(prefixCopy, pkid[:]...)
+}
+
+// _dbGetCountWithTxn returns zero if the count doesn't exist.
+func _dbGetCountWithTxn(txn KVTxn, key []byte) uint64 {
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return 0
+	}
+	if len(valBytes) != 8 {
+		return 0
+	}
+	return DecodeUint64(valBytes)
+}
+
+// _dbAddToCountWithTxn adds delta to the count without going below zero. Counts
+// that reach zero are deleted.
+func _dbAddToCountWithTxn(txn KVTxn, key []byte, delta int64) error {
+	count := _addToCount(_dbGetCountWithTxn(txn, key), delta)
+	if count == 0 {
+		return txn.Delete(key)
+	}
+	return txn.Set(key, EncodeUint64(count))
+}
+
+func _dbAddToFollowCountsWithTxn(txn KVTxn, followerPKID *PKID, followedPKID *PKID, delta int64) error {
+	if err := _dbAddToCountWithTxn(txn, _dbKeyForFollowingCount(followerPKID), delta); err != nil {
+		return errors.Wrapf(err, "_dbAddToFollowCountsWithTxn: Problem updating following "+
+			"count for %v", PkToStringMainnet(followerPKID[:]))
+	}
+	if err := _dbAddToCountWithTxn(txn, _dbKeyForFollowerCount(followedPKID), delta); err != nil {
+		return errors.Wrapf(err, "_dbAddToFollowCountsWithTxn: Problem updating follower "+
+			"count for %v", PkToStringMainnet(followedPKID[:]))
+	}
+	return nil
+}
+
+// DbGetFollowCountsForPKIDWithTxn returns how many PKIDs follow the PKID and how
+// many it follows without enumerating either.
+func DbGetFollowCountsForPKIDWithTxn(txn KVTxn, pkid *PKID) (
+	_numFollowers uint64, _numFollowing uint64) {
+
+	return _dbGetCountWithTxn(txn, _dbKeyForFollowerCount(pkid)),
+		_dbGetCountWithTxn(txn, _dbKeyForFollowingCount(pkid))
+}
+
+func DbGetFollowCountsForPKID(handle *badger.DB, pkid *PKID) (
+	_numFollowers uint64, _numFollowing uint64) {
+
+	var numFollowers, numFollowing uint64
+	DbView(handle, func(txn KVTxn) error {
+		numFollowers, numFollowing = DbGetFollowCountsForPKIDWithTxn(txn, pkid)
+		return nil
+	})
+	return numFollowers, numFollowing
+}
+
+// followCountsMigrationName marks whether the follows stored before the follow
+// counts existed have been counted.
+const followCountsMigrationName = "follow-counts"
+
+// DbBackfillFollowCounts counts the follows that were stored before the follow
+// counts existed. It only does the work once per db and returns the number of
+// follows it counted.
+func DbBackfillFollowCounts(handle *badger.DB) (_numFollows int, _err error) {
+	if DbGetIndexMigrationState(handle, followCountsMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	followingCounts := make(map[PKID]uint64)
+	followerCounts := make(map[PKID]uint64)
+	numFollows := 0
+	// <prefix, follower PKID, followed PKID>
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixFollowerPKIDToFollowedPKID, func(key []byte, _ []byte) (bool, error) {
+		if len(key) != 1+2*btcec.PubKeyBytesLenCompressed {
+			return true, nil
+		}
+		followerPKID := PKID{}
+		copy(followerPKID[:], key[1:1+btcec.PubKeyBytesLenCompressed])
+		followedPKID := PKID{}
+		copy(followedPKID[:], key[1+btcec.PubKeyBytesLenCompressed:])
+		followingCounts[followerPKID]++
+		followerCounts[followedPKID]++
+		numFollows++
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillFollowCounts: Problem counting follows")
+	}
+
+	keysToSet := [][]byte{}
+	valsToSet := [][]byte{}
+	for pkid, count := range followingCounts {
+		pkidCopy := pkid
+		keysToSet = append(keysToSet, _dbKeyForFollowingCount(&pkidCopy))
+		valsToSet = append(valsToSet, EncodeUint64(count))
+	}
+	for pkid, count := range followerCounts {
+		pkidCopy := pkid
+		keysToSet = append(keysToSet, _dbKeyForFollowerCount(&pkidCopy))
+		valsToSet = append(valsToSet, EncodeUint64(count))
+	}
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for ii := range keysToSet {
+			if err := txnWriter.Set(keysToSet[ii], valsToSet[ii]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillFollowCounts: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, followCountsMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillFollowCounts: Problem marking backfill complete")
+	}
+
+	return numFollows, nil
+}
+
 func DbGetPubKeysYouFollow(handle *badger.DB, yourPubKey []byte) (
 	_pubKeys [][]byte, _err error) {
 
 	// Get the PKID for the pub key
 	yourPKID := DBGetPKIDEntryForPublicKey(handle, yourPubKey)
-	followPKIDs, err := DbGetPKIDsYouFollow(handle, yourPKID.PKID)
+	followPKIDs, err := DbGetPKIDsYouFollow(handle, yourPKID.PKID, 0 /*limit*/, nil /*startPKID*/)
 	if err != nil {
 		return nil, errors.Wrap(err, "DbGetPubKeysYouFollow: ")
 	}
@@ -1195,7 +2989,7 @@ func DbGetPubKeysFollowingYou(handle *badger.DB, yourPubKey []byte) (
 
 	// Get the PKID for the pub key
 	yourPKID := DBGetPKIDEntryForPublicKey(handle, yourPubKey)
-	followPKIDs, err := DbGetPKIDsFollowingYou(handle, yourPKID.PKID)
+	followPKIDs, err := DbGetPKIDsFollowingYou(handle, yourPKID.PKID, 0 /*limit*/, nil /*startPKID*/)
 	if err != nil {
 		return nil, errors.Wrap(err, "DbGetPubKeysFollowingYou: ")
 	}
@@ -1254,18 +3048,12 @@ func _dbSeekPrefixForReceiverPKIDAndSenderPKID(receiverPKID *PKID, senderPKID *P
 	return append(key, senderPKID[:]...)
 }
 
-func _DbBufForDiamondEntry(diamondEntry *DiamondEntry) []byte {
-	diamondEntryBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(diamondEntryBuf).Encode(diamondEntry)
-	return diamondEntryBuf.Bytes()
-}
-
 func _DbDiamondEntryForDbBuf(buf []byte) *DiamondEntry {
 	if len(buf) == 0 {
 		return nil
 	}
 	ret := &DiamondEntry{}
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&ret); err != nil {
+	if err := _DbDecodeDiamondEntry(buf, ret); err != nil {
 		glog.Errorf("Error decoding DiamondEntry from DB: %v", err)
 		return nil
 	}
@@ -1274,7 +3062,7 @@ func _DbDiamondEntryForDbBuf(buf []byte) *DiamondEntry {
 
 // Note that this adds a mapping for the follower *and* the pub key being followed.
 func DbPutDiamondMappingsWithTxn(
-	txn *badger.Txn,
+	txn KVTxn,
 	diamondEntry *DiamondEntry) error {
 
 	if len(diamondEntry.ReceiverPKID) != btcec.PubKeyBytesLenCompressed {
@@ -1285,6 +3073,20 @@ func DbPutDiamondMappingsWithTxn(
 		return fmt.Errorf("DbPutDiamondMappingsWithTxn: Sender PKID "+
 			"length %d != %d", len(diamondEntry.SenderPKID), btcec.PubKeyBytesLenCompressed)
 	}
+
+	// Replace the existing entry's contribution to the totals, if there is one,
+	// with the new entry's.
+	existingEntry := DbGetDiamondMappingsWithTxn(
+		txn, diamondEntry.ReceiverPKID, diamondEntry.SenderPKID, diamondEntry.DiamondPostHash)
+	if existingEntry != nil {
+		if err := _dbAdjustDiamondTotalsWithTxn(txn, existingEntry, -1); err != nil {
+			return errors.Wrapf(err, "DbPutDiamondMappingsWithTxn: Problem removing existing entry from totals: ")
+		}
+	}
+	if err := _dbAdjustDiamondTotalsWithTxn(txn, diamondEntry, 1); err != nil {
+		return errors.Wrapf(err, "DbPutDiamondMappingsWithTxn: Problem adding entry to totals: ")
+	}
+
 	diamondEntryBytes := _DbBufForDiamondEntry(diamondEntry)
 	if err := txn.Set(_dbKeyForDiamondReceiverToDiamondSenderMapping(
 		diamondEntry.ReceiverPKID, diamondEntry.SenderPKID, diamondEntry.DiamondPostHash),
@@ -1307,22 +3109,17 @@ func DbPutDiamondMappings(
 	handle *badger.DB,
 	diamondEntry *DiamondEntry) error {
 
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbPutDiamondMappingsWithTxn(
 			txn, diamondEntry)
 	})
 }
 
 func DbGetDiamondMappingsWithTxn(
-	txn *badger.Txn, diamondReceiverPKID *PKID, diamondSenderPKID *PKID, diamondPostHash *BlockHash) *DiamondEntry {
+	txn KVTxn, diamondReceiverPKID *PKID, diamondSenderPKID *PKID, diamondPostHash *BlockHash) *DiamondEntry {
 
 	key := _dbKeyForDiamondReceiverToDiamondSenderMapping(diamondReceiverPKID, diamondSenderPKID, diamondPostHash)
-	item, err := txn.Get(key)
-	if err != nil {
-		return nil
-	}
-
-	diamondEntryBuf, err := item.ValueCopy(nil)
+	diamondEntryBuf, err := txn.Get(key)
 	if err != nil {
 		return nil
 	}
@@ -1336,7 +3133,7 @@ func DbGetDiamondMappingsWithTxn(
 func DbGetDiamondMappings(
 	db *badger.DB, diamondReceiverPKID *PKID, diamondSenderPKID *PKID, diamondPostHash *BlockHash) *DiamondEntry {
 	var ret *DiamondEntry
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		ret = DbGetDiamondMappingsWithTxn(
 			txn, diamondReceiverPKID, diamondSenderPKID, diamondPostHash)
 		return nil
@@ -1347,7 +3144,7 @@ func DbGetDiamondMappings(
 // This currently only deletes one index mapping for diamonds. However, we will likely
 // add additional index mappings in the future.
 func DbDeleteDiamondMappingsWithTxn(
-	txn *badger.Txn, diamondReceiverPKID *PKID, diamondSenderPKID *PKID, diamondPostHash *BlockHash) error {
+	txn KVTxn, diamondReceiverPKID *PKID, diamondSenderPKID *PKID, diamondPostHash *BlockHash) error {
 
 	// First check that a mapping exists for the PKIDs passed in.
 	// If one doesn't exist then there's nothing to do.
@@ -1378,28 +3175,228 @@ func DbDeleteDiamondMappingsWithTxn(
 		)
 	}
 
+	if err := _dbAdjustDiamondTotalsWithTxn(txn, existingMapping, -1); err != nil {
+		return errors.Wrapf(err, "DbDeleteDiamondMappingsWithTxn: Problem removing entry from totals: ")
+	}
+
 	return nil
 }
 
 func DbDeleteDiamondMappings(
 	handle *badger.DB, diamondReceiverPKID *PKID, diamondGiverPKID *PKID, diamondPostHash *BlockHash) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbDeleteDiamondMappingsWithTxn(txn, diamondReceiverPKID, diamondGiverPKID, diamondPostHash)
 	})
 }
 
-// This function returns a map of PKIDs that gave diamonds to a list of DiamondEntrys
-// that contain post hashes.
-func DbGetPKIDsThatDiamondedYouMap(handle *badger.DB, yourPKID *PKID, fetchYouDiamonded bool) (
-	_pkidToDiamondsMap map[PKID][]*DiamondEntry, _err error) {
+// -------------------------------------------------------------------------------------
+// Diamond totals functions
+// 		<prefix, post hash BlockHash> -> <num diamonds uint64, total diamond level uint64>
+// 		<prefix, sender PKID [33]byte, receiver PKID [33]byte> -> <num diamonds uint64, total diamond level uint64>
+//
+// Kept up to date by DbPutDiamondMappingsWithTxn and DbDeleteDiamondMappingsWithTxn
+// so the diamonds on a post or between two PKIDs can be read without scanning
+// every diamond entry.
+// -------------------------------------------------------------------------------------
 
-	prefix := _dbSeekPrefixForPKIDsThatDiamondedYou(yourPKID)
-	diamondSenderStartIdx := 1 + btcec.PubKeyBytesLenCompressed
-	diamondSenderEndIdx := 1 + 2*btcec.PubKeyBytesLenCompressed
-	diamondReceiverStartIdx := 1
-	diamondReceiverEndIdx := 1 + btcec.PubKeyBytesLenCompressed
-	if fetchYouDiamonded {
-		prefix = _dbSeekPrefixForPKIDsThatYouDiamonded(yourPKID)
+type DiamondTotals struct {
+	// The number of diamond entries, one per sender and post.
+	NumDiamonds uint64
+	// The sum of the levels of the diamond entries.
+	TotalDiamondLevel uint64
+}
+
+func _dbKeyForPostDiamondTotals(postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPostHashToDiamondTotals...)
+	return append(prefixCopy, postHash[:]...)
+}
+
+func _dbKeyForPKIDPairDiamondTotals(senderPKID *PKID, receiverPKID *PKID) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixSenderPKIDReceiverPKIDToDiamondTotals...)
+	key := append(prefixCopy, senderPKID[:]...)
+	return append(key, receiverPKID[:]...)
+}
+
+// _dbGetDiamondTotalsWithTxn returns empty totals if there aren't any.
+func _dbGetDiamondTotalsWithTxn(txn KVTxn, key []byte) (*DiamondTotals, error) {
+	valBytes, err := txn.Get(key)
+	if err == ErrKVKeyNotFound {
+		return &DiamondTotals{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(valBytes) != 16 {
+		return nil, errors.Wrapf(ErrEntryCorrupt, "_dbGetDiamondTotalsWithTxn: Value "+
+			"has length %d != 16", len(valBytes))
+	}
+	return &DiamondTotals{
+		NumDiamonds:       DecodeUint64(valBytes[:8]),
+		TotalDiamondLevel: DecodeUint64(valBytes[8:]),
+	}, nil
+}
+
+func _dbPutDiamondTotalsWithTxn(txn KVTxn, key []byte, totals *DiamondTotals) error {
+	if totals.NumDiamonds == 0 && totals.TotalDiamondLevel == 0 {
+		return txn.Delete(key)
+	}
+	return txn.Set(key, append(EncodeUint64(totals.NumDiamonds), EncodeUint64(totals.TotalDiamondLevel)...))
+}
+
+// _dbAdjustDiamondTotalsWithTxn adds or removes a diamond of the given level from
+// the totals of its post and of its sender and receiver.
+func _dbAdjustDiamondTotalsWithTxn(txn KVTxn, diamondEntry *DiamondEntry, sign int64) error {
+	for _, key := range [][]byte{
+		_dbKeyForPostDiamondTotals(diamondEntry.DiamondPostHash),
+		_dbKeyForPKIDPairDiamondTotals(diamondEntry.SenderPKID, diamondEntry.ReceiverPKID),
+	} {
+		totals, err := _dbGetDiamondTotalsWithTxn(txn, key)
+		if err != nil {
+			return err
+		}
+		totals.NumDiamonds = _addToCount(totals.NumDiamonds, sign)
+		totals.TotalDiamondLevel = _addToCount(totals.TotalDiamondLevel, sign*diamondEntry.DiamondLevel)
+		if err := _dbPutDiamondTotalsWithTxn(txn, key, totals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DbGetDiamondTotalsForPostWithTxn(txn KVTxn, postHash *BlockHash) (*DiamondTotals, error) {
+	totals, err := _dbGetDiamondTotalsWithTxn(txn, _dbKeyForPostDiamondTotals(postHash))
+	if err != nil {
+		return nil, _wrapDbError(err, "DbGetDiamondTotalsForPostWithTxn: Post %v", postHash)
+	}
+	return totals, nil
+}
+
+// DbGetDiamondTotalsForPost returns how many diamonds a post has received and
+// the sum of their levels.
+func DbGetDiamondTotalsForPost(handle *badger.DB, postHash *BlockHash) (*DiamondTotals, error) {
+	var totals *DiamondTotals
+	err := DbView(handle, func(txn KVTxn) error {
+		var err error
+		totals, err = DbGetDiamondTotalsForPostWithTxn(txn, postHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+func DbGetDiamondTotalsForPKIDPairWithTxn(txn KVTxn, senderPKID *PKID, receiverPKID *PKID) (
+	*DiamondTotals, error) {
+
+	totals, err := _dbGetDiamondTotalsWithTxn(txn, _dbKeyForPKIDPairDiamondTotals(senderPKID, receiverPKID))
+	if err != nil {
+		return nil, _wrapDbError(err, "DbGetDiamondTotalsForPKIDPairWithTxn: Sender %v receiver %v",
+			PkToStringMainnet(senderPKID[:]), PkToStringMainnet(receiverPKID[:]))
+	}
+	return totals, nil
+}
+
+// DbGetDiamondTotalsForPKIDPair returns how many diamonds senderPKID has given
+// receiverPKID across all of its posts and the sum of their levels.
+func DbGetDiamondTotalsForPKIDPair(handle *badger.DB, senderPKID *PKID, receiverPKID *PKID) (
+	*DiamondTotals, error) {
+
+	var totals *DiamondTotals
+	err := DbView(handle, func(txn KVTxn) error {
+		var err error
+		totals, err = DbGetDiamondTotalsForPKIDPairWithTxn(txn, senderPKID, receiverPKID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// diamondTotalsMigrationName marks whether the diamonds stored before the
+// diamond totals existed have been counted.
+const diamondTotalsMigrationName = "diamond-totals"
+
+// DbBackfillDiamondTotals counts the diamonds that were stored before the
+// diamond totals existed. It only does the work once per db and returns the
+// number of diamonds it counted.
+func DbBackfillDiamondTotals(handle *badger.DB) (_numDiamonds int, _err error) {
+	if DbGetIndexMigrationState(handle, diamondTotalsMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	totalsForKey := make(map[string]*DiamondTotals)
+	addTo := func(key []byte, diamondLevel int64) {
+		if _, exists := totalsForKey[string(key)]; !exists {
+			totalsForKey[string(key)] = &DiamondTotals{}
+		}
+		totals := totalsForKey[string(key)]
+		totals.NumDiamonds++
+		totals.TotalDiamondLevel = _addToCount(totals.TotalDiamondLevel, diamondLevel)
+	}
+	numDiamonds := 0
+	// <prefix, receiver PKID, sender PKID, post hash> -> <DiamondEntry>
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixDiamondReceiverPKIDDiamondSenderPKIDPostHash, func(_ []byte, val []byte) (bool, error) {
+		diamondEntry := _DbDiamondEntryForDbBuf(val)
+		if diamondEntry == nil {
+			return true, nil
+		}
+		addTo(_dbKeyForPostDiamondTotals(diamondEntry.DiamondPostHash), diamondEntry.DiamondLevel)
+		addTo(_dbKeyForPKIDPairDiamondTotals(diamondEntry.SenderPKID, diamondEntry.ReceiverPKID), diamondEntry.DiamondLevel)
+		numDiamonds++
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillDiamondTotals: Problem counting diamonds")
+	}
+
+	keys := []string{}
+	for key := range totalsForKey {
+		keys = append(keys, key)
+	}
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, keyIter := range keys {
+			key := keyIter
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				return _dbPutDiamondTotalsWithTxn(txn, []byte(key), totalsForKey[key])
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillDiamondTotals: Problem writing totals")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, diamondTotalsMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillDiamondTotals: Problem marking backfill complete")
+	}
+
+	return numDiamonds, nil
+}
+
+// This function returns a map of PKIDs that gave diamonds to a list of DiamondEntrys
+// that contain post hashes.
+func DbGetPKIDsThatDiamondedYouMap(handle *badger.DB, yourPKID *PKID, fetchYouDiamonded bool) (
+	_pkidToDiamondsMap map[PKID][]*DiamondEntry, _err error) {
+
+	prefix := _dbSeekPrefixForPKIDsThatDiamondedYou(yourPKID)
+	diamondSenderStartIdx := 1 + btcec.PubKeyBytesLenCompressed
+	diamondSenderEndIdx := 1 + 2*btcec.PubKeyBytesLenCompressed
+	diamondReceiverStartIdx := 1
+	diamondReceiverEndIdx := 1 + btcec.PubKeyBytesLenCompressed
+	if fetchYouDiamonded {
+		prefix = _dbSeekPrefixForPKIDsThatYouDiamonded(yourPKID)
 		diamondSenderStartIdx = 1
 		diamondSenderEndIdx = 1 + btcec.PubKeyBytesLenCompressed
 		diamondReceiverStartIdx = 1 + btcec.PubKeyBytesLenCompressed
@@ -1539,11 +3536,11 @@ func _keyForBitcoinBurnTxID(bitcoinBurnTxID *BlockHash) []byte {
 	return append(prefixCopy, bitcoinBurnTxID[:]...)
 }
 
-func DbPutBitcoinBurnTxIDWithTxn(txn *badger.Txn, bitcoinBurnTxID *BlockHash) error {
+func DbPutBitcoinBurnTxIDWithTxn(txn KVTxn, bitcoinBurnTxID *BlockHash) error {
 	return txn.Set(_keyForBitcoinBurnTxID(bitcoinBurnTxID), []byte{})
 }
 
-func DbExistsBitcoinBurnTxIDWithTxn(txn *badger.Txn, bitcoinBurnTxID *BlockHash) bool {
+func DbExistsBitcoinBurnTxIDWithTxn(txn KVTxn, bitcoinBurnTxID *BlockHash) bool {
 	// We don't care about the value because we're just checking to see if the key exists.
 	if _, err := txn.Get(_keyForBitcoinBurnTxID(bitcoinBurnTxID)); err != nil {
 		return false
@@ -1553,14 +3550,14 @@ func DbExistsBitcoinBurnTxIDWithTxn(txn *badger.Txn, bitcoinBurnTxID *BlockHash)
 
 func DbExistsBitcoinBurnTxID(db *badger.DB, bitcoinBurnTxID *BlockHash) bool {
 	var exists bool
-	db.View(func(txn *badger.Txn) error {
+	DbView(db, func(txn KVTxn) error {
 		exists = DbExistsBitcoinBurnTxIDWithTxn(txn, bitcoinBurnTxID)
 		return nil
 	})
 	return exists
 }
 
-func DbDeleteBitcoinBurnTxIDWithTxn(txn *badger.Txn, bitcoinBurnTxID *BlockHash) error {
+func DbDeleteBitcoinBurnTxIDWithTxn(txn KVTxn, bitcoinBurnTxID *BlockHash) error {
 	return txn.Delete(_keyForBitcoinBurnTxID(bitcoinBurnTxID))
 }
 
@@ -1576,23 +3573,20 @@ func DbGetAllBitcoinBurnTxIDs(handle *badger.DB) (_bitcoinBurnTxIDs []*BlockHash
 	return bitcoinBurnTxIDs
 }
 
-func _getBlockHashForPrefixWithTxn(txn *badger.Txn, prefix []byte) *BlockHash {
+func _getBlockHashForPrefixWithTxn(txn KVTxn, prefix []byte) *BlockHash {
 	var ret BlockHash
-	bhItem, err := txn.Get(prefix)
-	if err != nil {
-		return nil
-	}
-	_, err = bhItem.ValueCopy(ret[:])
+	bhBytes, err := txn.Get(prefix)
 	if err != nil {
 		return nil
 	}
+	copy(ret[:], bhBytes)
 
 	return &ret
 }
 
 func _getBlockHashForPrefix(handle *badger.DB, prefix []byte) *BlockHash {
 	var ret *BlockHash
-	err := handle.View(func(txn *badger.Txn) error {
+	err := DbView(handle, func(txn KVTxn) error {
 		ret = _getBlockHashForPrefixWithTxn(txn, prefix)
 		return nil
 	})
@@ -1627,22 +3621,18 @@ func DecodeUint64(scoreBytes []byte) uint64 {
 	return binary.BigEndian.Uint64(scoreBytes)
 }
 
-func DbPutNanosPurchasedWithTxn(txn *badger.Txn, nanosPurchased uint64) error {
+func DbPutNanosPurchasedWithTxn(txn KVTxn, nanosPurchased uint64) error {
 	return txn.Set(_KeyNanosPurchased, EncodeUint64(nanosPurchased))
 }
 
 func DbPutNanosPurchased(handle *badger.DB, nanosPurchased uint64) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbPutNanosPurchasedWithTxn(txn, nanosPurchased)
 	})
 }
 
-func DbGetNanosPurchasedWithTxn(txn *badger.Txn) uint64 {
-	nanosPurchasedItem, err := txn.Get(_KeyNanosPurchased)
-	if err != nil {
-		return 0
-	}
-	nanosPurchasedBuf, err := nanosPurchasedItem.ValueCopy(nil)
+func DbGetNanosPurchasedWithTxn(txn KVTxn) uint64 {
+	nanosPurchasedBuf, err := txn.Get(_KeyNanosPurchased)
 	if err != nil {
 		return 0
 	}
@@ -1652,7 +3642,7 @@ func DbGetNanosPurchasedWithTxn(txn *badger.Txn) uint64 {
 
 func DbGetNanosPurchased(handle *badger.DB) uint64 {
 	var nanosPurchased uint64
-	handle.View(func(txn *badger.Txn) error {
+	DbView(handle, func(txn KVTxn) error {
 		nanosPurchased = DbGetNanosPurchasedWithTxn(txn)
 		return nil
 	})
@@ -1661,12 +3651,12 @@ func DbGetNanosPurchased(handle *badger.DB) uint64 {
 }
 
 func DbPutGlobalParamsEntry(handle *badger.DB, globalParamsEntry GlobalParamsEntry) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return DbPutGlobalParamsEntryWithTxn(txn, globalParamsEntry)
 	})
 }
 
-func DbPutGlobalParamsEntryWithTxn(txn *badger.Txn, globalParamsEntry GlobalParamsEntry) error {
+func DbPutGlobalParamsEntryWithTxn(txn KVTxn, globalParamsEntry GlobalParamsEntry) error {
 	globalParamsDataBuf := bytes.NewBuffer([]byte{})
 	err := gob.NewEncoder(globalParamsDataBuf).Encode(globalParamsEntry)
 	if err != nil {
@@ -1680,16 +3670,15 @@ func DbPutGlobalParamsEntryWithTxn(txn *badger.Txn, globalParamsEntry GlobalPara
 	return nil
 }
 
-func DbGetGlobalParamsEntryWithTxn(txn *badger.Txn) *GlobalParamsEntry {
-	globalParamsEntryItem, err := txn.Get(_KeyGlobalParams)
+func DbGetGlobalParamsEntryWithTxn(txn KVTxn) *GlobalParamsEntry {
+	valBytes, err := txn.Get(_KeyGlobalParams)
 	if err != nil {
 		return &InitialGlobalParamsEntry
 	}
 	globalParamsEntryObj := &GlobalParamsEntry{}
-	err = globalParamsEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(globalParamsEntryObj)
-	})
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(globalParamsEntryObj)
 	if err != nil {
+		RecordDbDecodeFailure(_KeyGlobalParams)
 		glog.Errorf("DbGetGlobalParamsEntryWithTxn: Problem reading "+
 			"GlobalParamsEntry: %v", err)
 		return &InitialGlobalParamsEntry
@@ -1700,35 +3689,29 @@ func DbGetGlobalParamsEntryWithTxn(txn *badger.Txn) *GlobalParamsEntry {
 
 func DbGetGlobalParamsEntry(handle *badger.DB) *GlobalParamsEntry {
 	var globalParamsEntry *GlobalParamsEntry
-	handle.View(func(txn *badger.Txn) error {
+	DbView(handle, func(txn KVTxn) error {
 		globalParamsEntry = DbGetGlobalParamsEntryWithTxn(txn)
 		return nil
 	})
 	return globalParamsEntry
 }
 
-func DbPutUSDCentsPerBitcoinExchangeRateWithTxn(txn *badger.Txn, usdCentsPerBitcoinExchangeRate uint64) error {
+func DbPutUSDCentsPerBitcoinExchangeRateWithTxn(txn KVTxn, usdCentsPerBitcoinExchangeRate uint64) error {
 	return txn.Set(_KeyUSDCentsPerBitcoinExchangeRate, EncodeUint64(usdCentsPerBitcoinExchangeRate))
 }
 
-func DbGetUSDCentsPerBitcoinExchangeRateWithTxn(txn *badger.Txn) uint64 {
-	usdCentsPerBitcoinExchangeRateItem, err := txn.Get(_KeyUSDCentsPerBitcoinExchangeRate)
+func DbGetUSDCentsPerBitcoinExchangeRateWithTxn(txn KVTxn) uint64 {
+	usdCentsPerBitcoinExchangeRateBuf, err := txn.Get(_KeyUSDCentsPerBitcoinExchangeRate)
 	if err != nil {
 		return InitialUSDCentsPerBitcoinExchangeRate
 	}
-	usdCentsPerBitcoinExchangeRateBuf, err := usdCentsPerBitcoinExchangeRateItem.ValueCopy(nil)
-	if err != nil {
-		glog.Error("DbGetUSDCentsPerBitcoinExchangeRateWithTxn: Error parsing DB " +
-			"value; this shouldn't really happen ever")
-		return InitialUSDCentsPerBitcoinExchangeRate
-	}
 
 	return DecodeUint64(usdCentsPerBitcoinExchangeRateBuf)
 }
 
 func DbGetUSDCentsPerBitcoinExchangeRate(handle *badger.DB) uint64 {
 	var usdCentsPerBitcoinExchangeRate uint64
-	handle.View(func(txn *badger.Txn) error {
+	DbView(handle, func(txn KVTxn) error {
 		usdCentsPerBitcoinExchangeRate = DbGetUSDCentsPerBitcoinExchangeRateWithTxn(txn)
 		return nil
 	})
@@ -1736,16 +3719,12 @@ func DbGetUSDCentsPerBitcoinExchangeRate(handle *badger.DB) uint64 {
 	return usdCentsPerBitcoinExchangeRate
 }
 
-func GetUtxoNumEntriesWithTxn(txn *badger.Txn) uint64 {
-	indexItem, err := txn.Get(_KeyUtxoNumEntries)
+func GetUtxoNumEntriesWithTxn(txn KVTxn) uint64 {
+	indexBytes, err := txn.Get(_KeyUtxoNumEntries)
 	if err != nil {
 		return 0
 	}
 	// Get the current index.
-	indexBytes, err := indexItem.ValueCopy(nil)
-	if err != nil {
-		return 0
-	}
 	numEntries := DecodeUint64(indexBytes)
 
 	return numEntries
@@ -1753,7 +3732,7 @@ func GetUtxoNumEntriesWithTxn(txn *badger.Txn) uint64 {
 
 func GetUtxoNumEntries(handle *badger.DB) uint64 {
 	var numEntries uint64
-	handle.View(func(txn *badger.Txn) error {
+	DbView(handle, func(txn KVTxn) error {
 		numEntries = GetUtxoNumEntriesWithTxn(txn)
 
 		return nil
@@ -1796,33 +3775,25 @@ func _DbBufForUtxoEntry(utxoEntry *UtxoEntry) []byte {
 	return utxoEntryBuf.Bytes()
 }
 
-func PutUtxoNumEntriesWithTxn(txn *badger.Txn, newNumEntries uint64) error {
+func PutUtxoNumEntriesWithTxn(txn KVTxn, newNumEntries uint64) error {
 	return txn.Set(_KeyUtxoNumEntries, EncodeUint64(newNumEntries))
 }
 
-func PutUtxoEntryForUtxoKeyWithTxn(txn *badger.Txn, utxoKey *UtxoKey, utxoEntry *UtxoEntry) error {
+func PutUtxoEntryForUtxoKeyWithTxn(txn KVTxn, utxoKey *UtxoKey, utxoEntry *UtxoEntry) error {
 	return txn.Set(_DbKeyForUtxoKey(utxoKey), _DbBufForUtxoEntry(utxoEntry))
 }
 
-func DbGetUtxoEntryForUtxoKeyWithTxn(txn *badger.Txn, utxoKey *UtxoKey) *UtxoEntry {
+func DbGetUtxoEntryForUtxoKeyWithTxn(txn KVTxn, utxoKey *UtxoKey) *UtxoEntry {
 	var ret UtxoEntry
 	utxoDbKey := _DbKeyForUtxoKey(utxoKey)
-	item, err := txn.Get(utxoDbKey)
+	valBytes, err := txn.Get(utxoDbKey)
 	if err != nil {
 		return nil
 	}
 
-	err = item.Value(func(valBytes []byte) error {
-		// TODO: Storing with gob is very slow due to reflection. Would be
-		// better if we serialized/deserialized manually.
-		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(&ret); err != nil {
-			return err
-		}
-
-		return nil
-	})
-
-	if err != nil {
+	// TODO: Storing with gob is very slow due to reflection. Would be
+	// better if we serialized/deserialized manually.
+	if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(&ret); err != nil {
 		return nil
 	}
 
@@ -1831,7 +3802,7 @@ func DbGetUtxoEntryForUtxoKeyWithTxn(txn *badger.Txn, utxoKey *UtxoKey) *UtxoEnt
 
 func DbGetUtxoEntryForUtxoKey(handle *badger.DB, utxoKey *UtxoKey) *UtxoEntry {
 	var ret *UtxoEntry
-	handle.View(func(txn *badger.Txn) error {
+	DbView(handle, func(txn KVTxn) error {
 		ret = DbGetUtxoEntryForUtxoKeyWithTxn(txn, utxoKey)
 		return nil
 	})
@@ -1839,11 +3810,11 @@ func DbGetUtxoEntryForUtxoKey(handle *badger.DB, utxoKey *UtxoKey) *UtxoEntry {
 	return ret
 }
 
-func DeleteUtxoEntryForKeyWithTxn(txn *badger.Txn, utxoKey *UtxoKey) error {
+func DeleteUtxoEntryForKeyWithTxn(txn KVTxn, utxoKey *UtxoKey) error {
 	return txn.Delete(_DbKeyForUtxoKey(utxoKey))
 }
 
-func DeletePubKeyUtxoKeyMappingWithTxn(txn *badger.Txn, publicKey []byte, utxoKey *UtxoKey) error {
+func DeletePubKeyUtxoKeyMappingWithTxn(txn KVTxn, publicKey []byte, utxoKey *UtxoKey) error {
 	if len(publicKey) != btcec.PubKeyBytesLenCompressed {
 		return fmt.Errorf("DeletePubKeyUtxoKeyMappingWithTxn: Public key has improper length %d != %d", len(publicKey), btcec.PubKeyBytesLenCompressed)
 	}
@@ -1860,7 +3831,7 @@ func DbBufForUtxoKey(utxoKey *UtxoKey) []byte {
 	return utxoKeyBuf.Bytes()
 }
 
-func PutPubKeyUtxoKeyWithTxn(txn *badger.Txn, publicKey []byte, utxoKey *UtxoKey) error {
+func PutPubKeyUtxoKeyWithTxn(txn KVTxn, publicKey []byte, utxoKey *UtxoKey) error {
 	if len(publicKey) != btcec.PubKeyBytesLenCompressed {
 		return fmt.Errorf("PutPubKeyUtxoKeyWithTxn: Public key has improper length %d != %d", len(publicKey), btcec.PubKeyBytesLenCompressed)
 	}
@@ -1882,16 +3853,16 @@ func DbGetUtxosForPubKey(publicKey []byte, handle *badger.DB) ([]*UtxoEntry, err
 	}
 	// Look up the utxo keys for this public key.
 	utxoEntriesFound := []*UtxoEntry{}
-	err := handle.View(func(txn *badger.Txn) error {
+	err := DbView(handle, func(txn KVTxn) error {
 		// Start by looping through to find all the UtxoKeys.
 		utxoKeysFound := []*UtxoKey{}
-		opts := badger.DefaultIteratorOptions
+		opts := KVIteratorOptions{}
 		nodeIterator := txn.NewIterator(opts)
 		defer nodeIterator.Close()
 		prefix := append(append([]byte{}, _PrefixPubKeyUtxoKey...), publicKey...)
 		for nodeIterator.Seek(prefix); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
 			// Strip the prefix off the key. What's left should be the UtxoKey.
-			pkUtxoKey := nodeIterator.Item().Key()
+			pkUtxoKey := nodeIterator.Key()
 			utxoKeyBytes := pkUtxoKey[len(prefix):]
 			// The size of the utxo key bytes should be equal to the size of a
 			// standard hash (the txid) plus the size of a uint32.
@@ -1934,7 +3905,7 @@ func DbGetUtxosForPubKey(publicKey []byte, handle *badger.DB) ([]*UtxoEntry, err
 	return utxoEntriesFound, nil
 }
 
-func DeleteUnmodifiedMappingsForUtxoWithTxn(txn *badger.Txn, utxoKey *UtxoKey) error {
+func DeleteUnmodifiedMappingsForUtxoWithTxn(txn KVTxn, utxoKey *UtxoKey) error {
 	// Get the entry for the utxoKey from the db.
 	utxoEntry := DbGetUtxoEntryForUtxoKeyWithTxn(txn, utxoKey)
 	if utxoEntry == nil {
@@ -1955,10 +3926,32 @@ func DeleteUnmodifiedMappingsForUtxoWithTxn(txn *badger.Txn, utxoKey *UtxoKey) e
 		return err
 	}
 
+	// Take the entry out of the public key's balance.
+	if err := _dbAddToCountWithTxn(txn, _dbKeyForPublicKeyBalance(utxoEntry.PublicKey),
+		-int64(utxoEntry.AmountNanos)); err != nil {
+
+		return errors.Wrapf(err, "DeleteUnmodifiedMappingsForUtxoWithTxn: Problem updating balance")
+	}
+
 	return nil
 }
 
-func PutMappingsForUtxoWithTxn(txn *badger.Txn, utxoKey *UtxoKey, utxoEntry *UtxoEntry) error {
+func PutMappingsForUtxoWithTxn(txn KVTxn, utxoKey *UtxoKey, utxoEntry *UtxoEntry) error {
+	// If an entry is being overwritten, take it out of its public key's balance
+	// before adding the new one.
+	if prevUtxoEntry := DbGetUtxoEntryForUtxoKeyWithTxn(txn, utxoKey); prevUtxoEntry != nil {
+		if err := _dbAddToCountWithTxn(txn, _dbKeyForPublicKeyBalance(prevUtxoEntry.PublicKey),
+			-int64(prevUtxoEntry.AmountNanos)); err != nil {
+
+			return errors.Wrapf(err, "PutMappingsForUtxoWithTxn: Problem updating balance")
+		}
+	}
+	if err := _dbAddToCountWithTxn(txn, _dbKeyForPublicKeyBalance(utxoEntry.PublicKey),
+		int64(utxoEntry.AmountNanos)); err != nil {
+
+		return errors.Wrapf(err, "PutMappingsForUtxoWithTxn: Problem updating balance")
+	}
+
 	// Put the <utxoKey -> utxoEntry> mapping.
 	if err := PutUtxoEntryForUtxoKeyWithTxn(txn, utxoKey, utxoEntry); err != nil {
 		return nil
@@ -1972,10 +3965,228 @@ func PutMappingsForUtxoWithTxn(txn *badger.Txn, utxoKey *UtxoKey, utxoEntry *Utx
 	return nil
 }
 
+func _dbKeyForPublicKeyBalance(publicKey []byte) []byte {
+	return append(append([]byte{}, _PrefixPublicKeyToBalanceNanos...), publicKey...)
+}
+
+// DbGetBalanceForPublicKeyWithTxn returns the total of the public key's unspent
+// UTXOs, which is the same as summing the entries from DbGetUtxosForPubKey.
+func DbGetBalanceForPublicKeyWithTxn(txn KVTxn, publicKey []byte) uint64 {
+	return _dbGetCountWithTxn(txn, _dbKeyForPublicKeyBalance(publicKey))
+}
+
+func DbGetBalanceForPublicKey(handle *badger.DB, publicKey []byte) uint64 {
+	var balanceNanos uint64
+	DbView(handle, func(txn KVTxn) error {
+		balanceNanos = DbGetBalanceForPublicKeyWithTxn(txn, publicKey)
+		return nil
+	})
+	return balanceNanos
+}
+
+// walletBalanceIndexMigrationName marks whether the balances of the UTXOs stored
+// before the wallet balance index existed have been added up.
+const walletBalanceIndexMigrationName = "wallet-balance-index"
+
+// DbBackfillWalletBalanceIndex sets each public key's balance from the UTXOs
+// stored before the wallet balance index existed. It only does the work once
+// per db and returns the number of balances it set. Balances are set rather
+// than added to so an interrupted backfill can simply run again.
+func DbBackfillWalletBalanceIndex(handle *badger.DB) (_numBalances int, _err error) {
+	if DbGetIndexMigrationState(handle, walletBalanceIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	balances := make(map[PkMapKey]uint64)
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixUtxoKeyToUtxoEntry, func(_ []byte, valBytes []byte) (bool, error) {
+		utxoEntry := &UtxoEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(utxoEntry); err != nil {
+			return false, err
+		}
+		balances[MakePkMapKey(utxoEntry.PublicKey)] += utxoEntry.AmountNanos
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillWalletBalanceIndex: Problem reading UTXOs")
+	}
+
+	keysToSet := [][]byte{}
+	valsToSet := [][]byte{}
+	for pkMapKey, balanceNanos := range balances {
+		if balanceNanos == 0 {
+			continue
+		}
+		keysToSet = append(keysToSet, _dbKeyForPublicKeyBalance(pkMapKey[:]))
+		valsToSet = append(valsToSet, EncodeUint64(balanceNanos))
+	}
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for ii := range keysToSet {
+			if err := txnWriter.Set(keysToSet[ii], valsToSet[ii]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillWalletBalanceIndex: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, walletBalanceIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillWalletBalanceIndex: Problem marking backfill complete")
+	}
+
+	return len(keysToSet), nil
+}
+
+func _dbKeyForBalanceSnapshot(publicKey []byte, blockHeight uint32) []byte {
+	key := append([]byte{}, _PrefixPublicKeyHeightToBalanceSnapshot...)
+	key = append(key, publicKey...)
+	return append(key, _EncodeUint32(blockHeight)...)
+}
+
+func DbPutBalanceSnapshotWithTxn(
+	txn KVTxn, publicKey []byte, blockHeight uint32, balanceNanos uint64) error {
+
+	return txn.Set(_dbKeyForBalanceSnapshot(publicKey, blockHeight), EncodeUint64(balanceNanos))
+}
+
+func DbDeleteBalanceSnapshotWithTxn(txn KVTxn, publicKey []byte, blockHeight uint32) error {
+	return txn.Delete(_dbKeyForBalanceSnapshot(publicKey, blockHeight))
+}
+
+// DbGetBalanceSnapshotsStartHeightWithTxn returns the height balance snapshots
+// were seeded at and whether the node is keeping them at all.
+func DbGetBalanceSnapshotsStartHeightWithTxn(txn KVTxn) (_startHeight uint32, _exists bool) {
+	startHeightBytes, err := txn.Get(_KeyBalanceSnapshotsStartHeight)
+	if err != nil {
+		return 0, false
+	}
+	if len(startHeightBytes) != 4 {
+		return 0, false
+	}
+	return DecodeUint32(startHeightBytes), true
+}
+
+func DbDeleteBalanceSnapshotsStartHeightWithTxn(txn KVTxn) error {
+	return txn.Delete(_KeyBalanceSnapshotsStartHeight)
+}
+
+func DbGetBalanceSnapshotsStartHeight(handle *badger.DB) (_startHeight uint32, _exists bool) {
+	DbView(handle, func(txn KVTxn) error {
+		_startHeight, _exists = DbGetBalanceSnapshotsStartHeightWithTxn(txn)
+		return nil
+	})
+	return _startHeight, _exists
+}
+
+// DbGetBalanceAtHeight returns the public key's balance as of the block at the
+// given height, which is the latest snapshot at or below it. A public key with
+// no such snapshot had a zero balance. Heights before the snapshots were seeded
+// can't be answered.
+func DbGetBalanceAtHeight(handle *badger.DB, publicKey []byte, blockHeight uint32) (uint64, error) {
+	var balanceNanos uint64
+	err := DbView(handle, func(txn KVTxn) error {
+		startHeight, exists := DbGetBalanceSnapshotsStartHeightWithTxn(txn)
+		if !exists {
+			return fmt.Errorf("Balance snapshots are not enabled on this node")
+		}
+		if blockHeight < startHeight {
+			return fmt.Errorf("Height %d is before balance snapshots start at height %d",
+				blockHeight, startHeight)
+		}
+
+		opts := KVIteratorOptions{}
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		pkPrefix := append(append([]byte{}, _PrefixPublicKeyHeightToBalanceSnapshot...), publicKey...)
+		it.Seek(_dbKeyForBalanceSnapshot(publicKey, blockHeight))
+		if !it.ValidForPrefix(pkPrefix) {
+			return nil
+		}
+		balanceBytes, err := it.Value()
+		if err != nil {
+			return err
+		}
+		balanceNanos = DecodeUint64(balanceBytes)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbGetBalanceAtHeight: ")
+	}
+	return balanceNanos, nil
+}
+
+// DbInitBalanceSnapshots starts or stops keeping balance snapshots to match the
+// node config. Starting seeds a snapshot of every nonzero wallet balance at the
+// tip height and returns the number seeded. Stopping deletes every snapshot.
+//
+// A UtxoView that disconnects a block at or below the seeded height deletes the
+// start height since the seeded snapshots no longer match the chain, in which
+// case this reseeds them.
+func DbInitBalanceSnapshots(handle *badger.DB, enabled bool, tipHeight uint32) (_numSeeded int, _err error) {
+	_, started := DbGetBalanceSnapshotsStartHeight(handle)
+	if enabled == started {
+		return 0, nil
+	}
+
+	// Clear out any snapshots left over from before, whether we're stopping or
+	// reseeding.
+	staleKeys, _ := _enumerateKeysForPrefix(handle, _PrefixPublicKeyHeightToBalanceSnapshot)
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, key := range staleKeys {
+			if err := txnWriter.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbInitBalanceSnapshots: Problem deleting snapshots")
+	}
+	if !enabled {
+		if err := handle.Update(DbDeleteBalanceSnapshotsStartHeightWithTxn); err != nil {
+			return 0, errors.Wrapf(err, "DbInitBalanceSnapshots: Problem deleting start height")
+		}
+		return 0, nil
+	}
+
+	balanceKeys, balanceVals := _enumerateKeysForPrefix(handle, _PrefixPublicKeyToBalanceNanos)
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for ii := range balanceKeys {
+			publicKey := balanceKeys[ii][len(_PrefixPublicKeyToBalanceNanos):]
+			if err := txnWriter.Set(_dbKeyForBalanceSnapshot(publicKey, tipHeight), balanceVals[ii]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbInitBalanceSnapshots: Problem seeding snapshots")
+	}
+
+	// Only mark the snapshots as started once they've all been seeded so an
+	// interrupted seed starts over.
+	if err := DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_KeyBalanceSnapshotsStartHeight, _EncodeUint32(tipHeight))
+	}); err != nil {
+		return 0, errors.Wrapf(err, "DbInitBalanceSnapshots: Problem setting start height")
+	}
+
+	return len(balanceKeys), nil
+}
+
 func _DecodeUtxoOperations(data []byte) ([][]*UtxoOperation, error) {
 	ret := [][]*UtxoOperation{}
 	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&ret); err != nil {
-		return nil, err
+		return nil, _corruptDbEntryError(err, "_DecodeUtxoOperations")
 	}
 	return ret, nil
 }
@@ -1990,21 +4201,14 @@ func _DbKeyForUtxoOps(blockHash *BlockHash) []byte {
 	return append(append([]byte{}, _PrefixBlockHashToUtxoOperations...), blockHash[:]...)
 }
 
-func GetUtxoOperationsForBlockWithTxn(txn *badger.Txn, blockHash *BlockHash) ([][]*UtxoOperation, error) {
+func GetUtxoOperationsForBlockWithTxn(txn KVTxn, blockHash *BlockHash) ([][]*UtxoOperation, error) {
 	var retOps [][]*UtxoOperation
-	utxoOpsItem, err := txn.Get(_DbKeyForUtxoOps(blockHash))
+	utxoOpsBytes, err := txn.Get(_DbKeyForUtxoOps(blockHash))
 	if err != nil {
-		return nil, err
+		return nil, _wrapDbError(err, "GetUtxoOperationsForBlockWithTxn: Problem fetching "+
+			"utxo operations for block %v", blockHash)
 	}
-	err = utxoOpsItem.Value(func(valBytes []byte) error {
-		retOps, err = _DecodeUtxoOperations(valBytes)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	})
-
+	retOps, err = _DecodeUtxoOperations(utxoOpsBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -2014,7 +4218,7 @@ func GetUtxoOperationsForBlockWithTxn(txn *badger.Txn, blockHash *BlockHash) ([]
 
 func GetUtxoOperationsForBlock(handle *badger.DB, blockHash *BlockHash) ([][]*UtxoOperation, error) {
 	var ops [][]*UtxoOperation
-	err := handle.View(func(txn *badger.Txn) error {
+	err := DbView(handle, func(txn KVTxn) error {
 		var err error
 		ops, err = GetUtxoOperationsForBlockWithTxn(txn, blockHash)
 		return err
@@ -2023,11 +4227,11 @@ func GetUtxoOperationsForBlock(handle *badger.DB, blockHash *BlockHash) ([][]*Ut
 	return ops, err
 }
 
-func PutUtxoOperationsForBlockWithTxn(txn *badger.Txn, blockHash *BlockHash, utxoOpsForBlock [][]*UtxoOperation) error {
+func PutUtxoOperationsForBlockWithTxn(txn KVTxn, blockHash *BlockHash, utxoOpsForBlock [][]*UtxoOperation) error {
 	return txn.Set(_DbKeyForUtxoOps(blockHash), _EncodeUtxoOperations(utxoOpsForBlock))
 }
 
-func DeleteUtxoOperationsForBlockWithTxn(txn *badger.Txn, blockHash *BlockHash) error {
+func DeleteUtxoOperationsForBlockWithTxn(txn KVTxn, blockHash *BlockHash) error {
 	return txn.Delete(_DbKeyForUtxoOps(blockHash))
 }
 
@@ -2053,6 +4257,9 @@ func SerializeBlockNode(blockNode *BlockNode) ([]byte, error) {
 	data = append(data, BigintToHash(blockNode.CumWork)[:]...)
 
 	// Header
+	if blockNode.Header == nil {
+		return nil, fmt.Errorf("SerializeBlockNode: Header cannot be nil")
+	}
 	serializedHeader, err := blockNode.Header.ToBytes(false)
 	if err != nil {
 		return nil, errors.Wrapf(err, "SerializeBlockNode: Problem serializing header")
@@ -2078,60 +4285,68 @@ func DeserializeBlockNode(data []byte) (*BlockNode, error) {
 		StatusNone,   // Status
 
 	)
+	if err := _deserializeBlockNodeInto(data, blockNode); err != nil {
+		return nil, err
+	}
+	return blockNode, nil
+}
 
+// _deserializeBlockNodeInto is DeserializeBlockNode for a node that's already
+// allocated, with its Hash and DifficultyTarget pointing at hashes to fill in.
+func _deserializeBlockNodeInto(data []byte, blockNode *BlockNode) error {
 	rr := bytes.NewReader(data)
 
 	// Hash
 	_, err := io.ReadFull(rr, blockNode.Hash[:])
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Hash")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Hash")
 	}
 
 	// Height
 	height, err := ReadUvarint(rr)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Height")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Height")
 	}
 	blockNode.Height = uint32(height)
 
 	// DifficultyTarget
 	_, err = io.ReadFull(rr, blockNode.DifficultyTarget[:])
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem decoding DifficultyTarget")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem decoding DifficultyTarget")
 	}
 
 	// CumWork
 	tmp := BlockHash{}
 	_, err = io.ReadFull(rr, tmp[:])
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem decoding CumWork")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem decoding CumWork")
 	}
 	blockNode.CumWork = HashToBigint(&tmp)
 
 	// Header
 	payloadLen, err := ReadVarint(rr)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Header length")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Header length")
 	}
 	headerBytes := make([]byte, payloadLen)
 	_, err = io.ReadFull(rr, headerBytes[:])
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem reading Header bytes")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem reading Header bytes")
 	}
 	blockNode.Header = NewMessage(MsgTypeHeader).(*MsgBitCloutHeader)
 	err = blockNode.Header.FromBytes(headerBytes)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem parsing Header bytes")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem parsing Header bytes")
 	}
 
 	// Status
 	status, err := ReadUvarint(rr)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Status")
+		return errors.Wrapf(err, "DeserializeBlockNode: Problem decoding Status")
 	}
 	blockNode.Status = BlockStatus(uint32(status))
 
-	return blockNode, nil
+	return nil
 }
 
 type ChainType uint8
@@ -2165,7 +4380,7 @@ func DbGetBestHash(handle *badger.DB, chainType ChainType) *BlockHash {
 	return _getBlockHashForPrefix(handle, prefix)
 }
 
-func PutBestHashWithTxn(txn *badger.Txn, bh *BlockHash, chainType ChainType) error {
+func PutBestHashWithTxn(txn KVTxn, bh *BlockHash, chainType ChainType) error {
 	prefix := _prefixForChainType(chainType)
 	if len(prefix) == 0 {
 		glog.Errorf("PutBestHashWithTxn: Problem getting prefix for ChainType: %d", chainType)
@@ -2175,7 +4390,7 @@ func PutBestHashWithTxn(txn *badger.Txn, bh *BlockHash, chainType ChainType) err
 }
 
 func PutBestHash(bh *BlockHash, handle *badger.DB, chainType ChainType) error {
-	return handle.Update(func(txn *badger.Txn) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
 		return PutBestHashWithTxn(txn, bh, chainType)
 	})
 }
@@ -2184,64 +4399,197 @@ func BlockHashToBlockKey(blockHash *BlockHash) []byte {
 	return append(append([]byte{}, _PrefixBlockHashToBlock...), blockHash[:]...)
 }
 
-func GetBlockWithTxn(txn *badger.Txn, blockHash *BlockHash) *MsgBitCloutBlock {
-	hashKey := BlockHashToBlockKey(blockHash)
-	var blockRet *MsgBitCloutBlock
+func _dbKeyForDedupedBlock(blockHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixBlockHashToDedupedBlock...)
+	return append(prefixCopy, blockHash[:]...)
+}
 
-	item, err := txn.Get(hashKey)
+func _dbKeyForBlockTxn(txnHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixTxnHashToBlockTxn...)
+	return append(prefixCopy, txnHash[:]...)
+}
+
+// A deduped block is stored as the block without its txns followed by the
+// hashes of its txns. Each txn is stored once under its hash along with the
+// number of deduped blocks that contain it, so blocks on competing forks that
+// share most of their txns only pay for the txns they don't share.
+func _encodeDedupedBlock(bitcloutBlock *MsgBitCloutBlock) ([]byte, []*BlockHash, error) {
+	blockWithoutTxns := *bitcloutBlock
+	blockWithoutTxns.Txns = nil
+	blockBytes, err := blockWithoutTxns.ToBytes(false)
 	if err != nil {
-		return nil
+		return nil, nil, errors.Wrapf(err, "_encodeDedupedBlock: Problem encoding block: ")
 	}
 
-	err = item.Value(func(valBytes []byte) error {
-		ret := NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
-		if err := ret.FromBytes(valBytes); err != nil {
-			return err
+	data := append([]byte{}, UintToBuf(uint64(len(blockBytes)))...)
+	data = append(data, blockBytes...)
+	data = append(data, UintToBuf(uint64(len(bitcloutBlock.Txns)))...)
+	txnHashes := []*BlockHash{}
+	for _, txn := range bitcloutBlock.Txns {
+		txnHash := txn.Hash()
+		if txnHash == nil {
+			return nil, nil, fmt.Errorf("_encodeDedupedBlock: Problem hashing txn %v", txn)
 		}
-		blockRet = ret
+		data = append(data, txnHash[:]...)
+		txnHashes = append(txnHashes, txnHash)
+	}
+	return data, txnHashes, nil
+}
 
-		return nil
-	})
+func _decodeDedupedBlock(data []byte) (*MsgBitCloutBlock, []*BlockHash, error) {
+	rr := bytes.NewReader(data)
+	blockLen, err := ReadUvarint(rr)
 	if err != nil {
-		return nil
+		return nil, nil, errors.Wrapf(err, "_decodeDedupedBlock: Problem decoding block length")
+	}
+	if blockLen > uint64(rr.Len()) {
+		return nil, nil, fmt.Errorf("_decodeDedupedBlock: Block length %d longer than data", blockLen)
+	}
+	blockBytes := make([]byte, blockLen)
+	if _, err := io.ReadFull(rr, blockBytes); err != nil {
+		return nil, nil, errors.Wrapf(err, "_decodeDedupedBlock: Problem reading block")
+	}
+	block := NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
+	if err := block.FromBytes(blockBytes); err != nil {
+		return nil, nil, errors.Wrapf(err, "_decodeDedupedBlock: Problem decoding block")
 	}
 
-	return blockRet
+	numTxns, err := ReadUvarint(rr)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "_decodeDedupedBlock: Problem decoding num txns")
+	}
+	if numTxns*HashSizeBytes != uint64(rr.Len()) {
+		return nil, nil, fmt.Errorf("_decodeDedupedBlock: %d bytes left for %d txn hashes", rr.Len(), numTxns)
+	}
+	txnHashes := []*BlockHash{}
+	for ii := uint64(0); ii < numTxns; ii++ {
+		txnHash := &BlockHash{}
+		if _, err := io.ReadFull(rr, txnHash[:]); err != nil {
+			return nil, nil, errors.Wrapf(err, "_decodeDedupedBlock: Problem reading txn hash %d", ii)
+		}
+		txnHashes = append(txnHashes, txnHash)
+	}
+	return block, txnHashes, nil
 }
 
-func GetBlock(blockHash *BlockHash, handle *badger.DB) (*MsgBitCloutBlock, error) {
-	hashKey := BlockHashToBlockKey(blockHash)
-	var blockRet *MsgBitCloutBlock
-	err := handle.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(hashKey)
+// _dbGetBlockTxnWithTxn returns the txn stored under the hash along with the
+// number of deduped blocks that contain it.
+func _dbGetBlockTxnWithTxn(txn KVTxn, txnHash *BlockHash) (*MsgBitCloutTxn, uint64, error) {
+	valBytes, err := txn.Get(_dbKeyForBlockTxn(txnHash))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(valBytes) < 8 {
+		return nil, 0, _corruptDbEntryError(fmt.Errorf("value has length %d", len(valBytes)),
+			"_dbGetBlockTxnWithTxn: Problem decoding txn %v", txnHash)
+	}
+	blockTxn := &MsgBitCloutTxn{}
+	if err := blockTxn.FromBytes(valBytes[8:]); err != nil {
+		return nil, 0, _corruptDbEntryError(err, "_dbGetBlockTxnWithTxn: Problem decoding txn %v", txnHash)
+	}
+	return blockTxn, DecodeUint64(valBytes[:8]), nil
+}
+
+func _dbGetDedupedBlockWithTxn(txn KVTxn, blockHash *BlockHash) (*MsgBitCloutBlock, error) {
+	valBytes, err := txn.Get(_dbKeyForDedupedBlock(blockHash))
+	if err != nil {
+		return nil, err
+	}
+	block, txnHashes, err := _decodeDedupedBlock(valBytes)
+	if err != nil {
+		return nil, _corruptDbEntryError(err, "_dbGetDedupedBlockWithTxn: Problem decoding block %v", blockHash)
+	}
+	block.Txns = []*MsgBitCloutTxn{}
+	for _, txnHash := range txnHashes {
+		blockTxn, _, err := _dbGetBlockTxnWithTxn(txn, txnHash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "_dbGetDedupedBlockWithTxn: Problem fetching "+
+				"txn %v in block %v: ", txnHash, blockHash)
+		}
+		block.Txns = append(block.Txns, blockTxn)
+	}
+	return block, nil
+}
+
+func _dbPutDedupedBlockWithTxn(txn KVTxn, blockHash *BlockHash, bitcloutBlock *MsgBitCloutBlock) error {
+	data, txnHashes, err := _encodeDedupedBlock(bitcloutBlock)
+	if err != nil {
+		return err
+	}
+	for ii, txnHash := range txnHashes {
+		_, numBlocks, err := _dbGetBlockTxnWithTxn(txn, txnHash)
+		if err == ErrKVKeyNotFound {
+			numBlocks = 0
+		} else if err != nil {
+			return errors.Wrapf(err, "_dbPutDedupedBlockWithTxn: Problem fetching txn %v: ", txnHash)
+		}
+		txnBytes, err := bitcloutBlock.Txns[ii].ToBytes(false /*preSignature*/)
 		if err != nil {
+			return errors.Wrapf(err, "_dbPutDedupedBlockWithTxn: Problem encoding txn %v: ", txnHash)
+		}
+		val := append(EncodeUint64(numBlocks+1), txnBytes...)
+		if err := txn.Set(_dbKeyForBlockTxn(txnHash), val); err != nil {
 			return err
 		}
+	}
+	return txn.Set(_dbKeyForDedupedBlock(blockHash), data)
+}
 
-		err = item.Value(func(valBytes []byte) error {
-			ret := NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
-			if err := ret.FromBytes(valBytes); err != nil {
-				return err
-			}
-			blockRet = ret
+func GetBlockWithTxn(txn KVTxn, blockHash *BlockHash) *MsgBitCloutBlock {
+	hashKey := BlockHashToBlockKey(blockHash)
+	var blockRet *MsgBitCloutBlock
 
+	valBytes, err := txn.Get(hashKey)
+	if err == ErrKVKeyNotFound {
+		blockRet, err = _dbGetDedupedBlockWithTxn(txn, blockHash)
+		if err != nil {
 			return nil
-		})
+		}
+		return blockRet
+	}
+	if err != nil {
+		return nil
+	}
+
+	blockRet = NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
+	if err := blockRet.FromBytes(valBytes); err != nil {
+		return nil
+	}
 
+	return blockRet
+}
+
+func GetBlock(blockHash *BlockHash, handle *badger.DB) (*MsgBitCloutBlock, error) {
+	hashKey := BlockHashToBlockKey(blockHash)
+	var blockRet *MsgBitCloutBlock
+	err := DbView(handle, func(txn KVTxn) error {
+		valBytes, err := txn.Get(hashKey)
+		if err == ErrKVKeyNotFound {
+			blockRet, err = _dbGetDedupedBlockWithTxn(txn, blockHash)
+			return err
+		}
 		if err != nil {
 			return err
 		}
 
+		ret := NewMessage(MsgTypeBlock).(*MsgBitCloutBlock)
+		if err := ret.FromBytes(valBytes); err != nil {
+			return _corruptDbEntryError(err, "GetBlock: Problem decoding block %v", blockHash)
+		}
+		blockRet = ret
+
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, _wrapDbError(err, "GetBlock: Problem fetching block %v", blockHash)
 	}
 
 	return blockRet, nil
 }
 
-func PutBlockWithTxn(txn *badger.Txn, bitcloutBlock *MsgBitCloutBlock) error {
+func PutBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
 	if bitcloutBlock.Header == nil {
 		return fmt.Errorf("PutBlockWithTxn: Header was nil in block %v", bitcloutBlock)
 	}
@@ -2250,17 +4598,30 @@ func PutBlockWithTxn(txn *badger.Txn, bitcloutBlock *MsgBitCloutBlock) error {
 		return errors.Wrapf(err, "PutBlockWithTxn: Problem hashing header: ")
 	}
 	blockKey := BlockHashToBlockKey(blockHash)
-	data, err := bitcloutBlock.ToBytes(false)
-	if err != nil {
-		return err
-	}
-	// First check to see if the block is already in the db.
+	// First check to see if the block is already in the db in either form.
 	if _, err := txn.Get(blockKey); err == nil {
 		// err == nil means the block already exists in the db so
 		// no need to store it.
 		return nil
 	}
-	// If the block is not in the db then set it.
+	if _, err := txn.Get(_dbKeyForDedupedBlock(blockHash)); err == nil {
+		return nil
+	}
+
+	// If the block is not in the db then set it. Blocks are only deduped when
+	// the node is configured to do so, but blocks stored either way can always
+	// be read.
+	nodeConfig, err := DbGetNodeConfigWithTxn(txn)
+	if err != nil {
+		return errors.Wrapf(err, "PutBlockWithTxn: ")
+	}
+	if nodeConfig.DedupeBlockTxns {
+		return _dbPutDedupedBlockWithTxn(txn, blockHash, bitcloutBlock)
+	}
+	data, err := bitcloutBlock.ToBytes(false)
+	if err != nil {
+		return err
+	}
 	if err := txn.Set(blockKey, data); err != nil {
 		return err
 	}
@@ -2268,7 +4629,7 @@ func PutBlockWithTxn(txn *badger.Txn, bitcloutBlock *MsgBitCloutBlock) error {
 }
 
 func PutBlock(bitcloutBlock *MsgBitCloutBlock, handle *badger.DB) error {
-	err := handle.Update(func(txn *badger.Txn) error {
+	err := DbUpdate(handle, func(txn KVTxn) error {
 		return PutBlockWithTxn(txn, bitcloutBlock)
 	})
 	if err != nil {
@@ -2278,6 +4639,66 @@ func PutBlock(bitcloutBlock *MsgBitCloutBlock, handle *badger.DB) error {
 	return nil
 }
 
+// DeleteBlockWithTxn deletes the block however it was stored. The txns of a
+// deduped block are only deleted once no other deduped block contains them.
+func DeleteBlockWithTxn(txn KVTxn, blockHash *BlockHash) error {
+	if err := txn.Delete(BlockHashToBlockKey(blockHash)); err != nil {
+		return err
+	}
+
+	dedupedBlockKey := _dbKeyForDedupedBlock(blockHash)
+	valBytes, err := txn.Get(dedupedBlockKey)
+	if err == ErrKVKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, txnHashes, err := _decodeDedupedBlock(valBytes)
+	if err != nil {
+		return _corruptDbEntryError(err, "DeleteBlockWithTxn: Problem decoding block %v", blockHash)
+	}
+	for _, txnHash := range txnHashes {
+		blockTxn, numBlocks, err := _dbGetBlockTxnWithTxn(txn, txnHash)
+		if err == ErrKVKeyNotFound {
+			// The txn appears in the block more than once and was already deleted.
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "DeleteBlockWithTxn: Problem fetching txn %v: ", txnHash)
+		}
+		if numBlocks <= 1 {
+			if err := txn.Delete(_dbKeyForBlockTxn(txnHash)); err != nil {
+				return err
+			}
+			continue
+		}
+		txnBytes, err := blockTxn.ToBytes(false /*preSignature*/)
+		if err != nil {
+			return errors.Wrapf(err, "DeleteBlockWithTxn: Problem encoding txn %v: ", txnHash)
+		}
+		if err := txn.Set(_dbKeyForBlockTxn(txnHash), append(EncodeUint64(numBlocks-1), txnBytes...)); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(dedupedBlockKey)
+}
+
+// DbGetBlockTxn returns a txn stored by PutBlockWithTxn for a deduped block, or
+// nil if no deduped block contains it.
+func DbGetBlockTxn(handle *badger.DB, txnHash *BlockHash) *MsgBitCloutTxn {
+	var blockTxn *MsgBitCloutTxn
+	DbView(handle, func(txn KVTxn) error {
+		var err error
+		blockTxn, _, err = _dbGetBlockTxnWithTxn(txn, txnHash)
+		if err != nil && err != ErrKVKeyNotFound {
+			glog.Errorf("DbGetBlockTxn: Problem fetching txn %v: %v", txnHash, err)
+		}
+		return nil
+	})
+	return blockTxn
+}
+
 func _heightHashToNodeIndexPrefix(bitcoinNodes bool) []byte {
 	prefix := append([]byte{}, _PrefixHeightHashToNodeInfo...)
 	if bitcoinNodes {
@@ -2299,21 +4720,14 @@ func _heightHashToNodeIndexKey(height uint32, hash *BlockHash, bitcoinNodes bool
 }
 
 func GetHeightHashToNodeInfoWithTxn(
-	txn *badger.Txn, height uint32, hash *BlockHash, bitcoinNodes bool) *BlockNode {
+	txn KVTxn, height uint32, hash *BlockHash, bitcoinNodes bool) *BlockNode {
 
 	key := _heightHashToNodeIndexKey(height, hash, bitcoinNodes)
-	nodeValue, err := txn.Get(key)
+	nodeBytes, err := txn.Get(key)
 	if err != nil {
 		return nil
 	}
-	var blockNode *BlockNode
-	nodeValue.Value(func(nodeBytes []byte) error {
-		blockNode, err = DeserializeBlockNode(nodeBytes)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+	blockNode, err := DeserializeBlockNode(nodeBytes)
 	if err != nil {
 		return nil
 	}
@@ -2324,16 +4738,72 @@ func GetHeightHashToNodeInfo(
 	handle *badger.DB, height uint32, hash *BlockHash, bitcoinNodes bool) *BlockNode {
 
 	var blockNode *BlockNode
-	handle.View(func(txn *badger.Txn) error {
+	DbView(handle, func(txn KVTxn) error {
 		blockNode = GetHeightHashToNodeInfoWithTxn(txn, height, hash, bitcoinNodes)
 		return nil
 	})
 	return blockNode
 }
 
-func PutHeightHashToNodeInfoWithTxn(txn *badger.Txn, node *BlockNode, bitcoinNodes bool) error {
+// DbGetBlockHeaderForNode returns the header of a node whose header isn't kept in
+// memory by reading the node back from the db. A node's header never changes, so
+// the headers it reads are cached without being invalidated when the node's
+// status is written.
+func DbGetBlockHeaderForNode(handle *badger.DB, node *BlockNode, bitcoinNodes bool) (
+	*MsgBitCloutHeader, error) {
+
+	cacheKey := string(_heightHashToNodeIndexKey(node.Height, node.Hash, bitcoinNodes))
+	cachedHeader, generation, found := blockHeaderCache.get(handle, cacheKey)
+	if found {
+		return _copyBlockHeader(cachedHeader.(*MsgBitCloutHeader)), nil
+	}
+
+	dbNode := GetHeightHashToNodeInfo(handle, node.Height, node.Hash, bitcoinNodes)
+	if dbNode == nil || dbNode.Header == nil {
+		return nil, fmt.Errorf("DbGetBlockHeaderForNode: Node for hash %v at "+
+			"height %d is not in the db", node.Hash, node.Height)
+	}
+	blockHeaderCache.add(handle, cacheKey, _copyBlockHeader(dbNode.Header), generation)
+	return dbNode.Header, nil
+}
+
+// _copyBlockHeader copies the hashes along with the header so the header that's
+// cached can't be changed through one that was returned.
+func _copyBlockHeader(header *MsgBitCloutHeader) *MsgBitCloutHeader {
+	headerCopy := *header
+	if header.PrevBlockHash != nil {
+		prevBlockHash := *header.PrevBlockHash
+		headerCopy.PrevBlockHash = &prevBlockHash
+	}
+	if header.TransactionMerkleRoot != nil {
+		merkleRoot := *header.TransactionMerkleRoot
+		headerCopy.TransactionMerkleRoot = &merkleRoot
+	}
+	return &headerCopy
+}
+
+// PutHeightHashToNodeInfoWithTxn writes the node to the block index. A node
+// whose header was dropped from memory, see Blockchain.headerForNode, is written
+// with the header already stored for it so that its status can still be updated.
+func PutHeightHashToNodeInfoWithTxn(txn KVTxn, node *BlockNode, bitcoinNodes bool) error {
 
 	key := _heightHashToNodeIndexKey(node.Height, node.Hash, bitcoinNodes)
+	if node.Header == nil {
+		valBytes, err := txn.Get(key)
+		if err != nil {
+			return _wrapDbError(err, "PutHeightHashToNodeInfoWithTxn: Header of node %v "+
+				"isn't in memory and the node isn't in the db", node.Hash)
+		}
+		dbNode := NewBlockNode(nil, &BlockHash{}, 0, &BlockHash{}, nil, nil, StatusNone)
+		err = _deserializeBlockNodeInto(valBytes, dbNode)
+		if err != nil {
+			return _corruptDbEntryError(err, "PutHeightHashToNodeInfoWithTxn: Problem decoding "+
+				"stored node %v", node.Hash)
+		}
+		nodeWithHeader := *node
+		nodeWithHeader.Header = dbNode.Header
+		node = &nodeWithHeader
+	}
 	serializedNode, err := SerializeBlockNode(node)
 	if err != nil {
 		return errors.Wrapf(err, "PutHeightHashToNodeInfoWithTxn: Problem serializing node")
@@ -2346,7 +4816,7 @@ func PutHeightHashToNodeInfoWithTxn(txn *badger.Txn, node *BlockNode, bitcoinNod
 }
 
 func PutHeightHashToNodeInfo(node *BlockNode, handle *badger.DB, bitcoinNodes bool) error {
-	err := handle.Update(func(txn *badger.Txn) error {
+	err := DbUpdate(handle, func(txn KVTxn) error {
 		return PutHeightHashToNodeInfoWithTxn(txn, node, bitcoinNodes)
 	})
 
@@ -2358,7 +4828,7 @@ func PutHeightHashToNodeInfo(node *BlockNode, handle *badger.DB, bitcoinNodes bo
 }
 
 func DbDeleteHeightHashToNodeInfoWithTxn(
-	node *BlockNode, txn *badger.Txn, bitcoinNodes bool) error {
+	node *BlockNode, txn KVTxn, bitcoinNodes bool) error {
 
 	return txn.Delete(_heightHashToNodeIndexKey(node.Height, node.Hash, bitcoinNodes))
 }
@@ -2366,9 +4836,12 @@ func DbDeleteHeightHashToNodeInfoWithTxn(
 func DbBulkDeleteHeightHashToNodeInfo(
 	nodes []*BlockNode, handle *badger.DB, bitcoinNodes bool) error {
 
-	err := handle.Update(func(txn *badger.Txn) error {
-		for _, nn := range nodes {
-			if err := DbDeleteHeightHashToNodeInfoWithTxn(nn, txn, bitcoinNodes); err != nil {
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, nodeIter := range nodes {
+			nn := nodeIter
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				return DbDeleteHeightHashToNodeInfoWithTxn(nn, txn, bitcoinNodes)
+			}); err != nil {
 				return err
 			}
 		}
@@ -2382,8 +4855,141 @@ func DbBulkDeleteHeightHashToNodeInfo(
 	return nil
 }
 
+// The phases recorded in a DbCrashBreadcrumb.
+const (
+	CrashBreadcrumbPhaseConnectBlock = "connect-block"
+	CrashBreadcrumbPhaseReorg        = "reorg"
+	CrashBreadcrumbPhaseFlushView    = "flush-view"
+	// Unlike the other phases, a crash during this one can leave the view
+	// half-written. See UtxoView.FlushToDbWithWriteBatch.
+	CrashBreadcrumbPhaseBatchedFlushView = "batched-flush-view"
+)
+
+// DbCrashBreadcrumb records an operation that was in flight on the db. Badger
+// txns are atomic so a crash can't leave most operations half-written, but a
+// breadcrumb found at startup tells us exactly which block the node was working
+// on when it died, which is otherwise very hard to reconstruct from the logs.
+type DbCrashBreadcrumb struct {
+	Phase string
+	// The block being connected, or the new tip for a reorg or flush.
+	BlockHash        *BlockHash
+	StartTstampNanos uint64
+}
+
+func (breadcrumb *DbCrashBreadcrumb) String() string {
+	return fmt.Sprintf("< Phase: %v, BlockHash: %v, Started: %v >", breadcrumb.Phase,
+		breadcrumb.BlockHash, time.Unix(0, int64(breadcrumb.StartTstampNanos)))
+}
+
+// DbPutCrashBreadcrumb records that an operation is starting. This has to be
+// written in its own txn ahead of the operation since a breadcrumb written in the
+// same txn would never be visible after a crash.
+func DbPutCrashBreadcrumb(handle *badger.DB, phase string, blockHash *BlockHash) error {
+	breadcrumb := &DbCrashBreadcrumb{
+		Phase:            phase,
+		BlockHash:        blockHash,
+		StartTstampNanos: uint64(time.Now().UnixNano()),
+	}
+	breadcrumbBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(breadcrumbBuf).Encode(breadcrumb); err != nil {
+		return errors.Wrapf(err, "DbPutCrashBreadcrumb: Problem encoding breadcrumb")
+	}
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_KeyCrashBreadcrumb, breadcrumbBuf.Bytes())
+	})
+}
+
+// DbGetCrashBreadcrumb returns the breadcrumb left by an operation that never
+// finished or nil if there isn't one.
+func DbGetCrashBreadcrumb(handle *badger.DB) *DbCrashBreadcrumb {
+	var breadcrumb *DbCrashBreadcrumb
+	DbView(handle, func(txn KVTxn) error {
+		valBytes, err := txn.Get(_KeyCrashBreadcrumb)
+		if err != nil {
+			return nil
+		}
+		breadcrumbObj := &DbCrashBreadcrumb{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(breadcrumbObj); err != nil {
+			RecordDbDecodeFailure(_KeyCrashBreadcrumb)
+			glog.Errorf("DbGetCrashBreadcrumb: Problem decoding breadcrumb: %v", err)
+			return nil
+		}
+		breadcrumb = breadcrumbObj
+		return nil
+	})
+	return breadcrumb
+}
+
+// DbDeleteCrashBreadcrumb records that the in-flight operation finished.
+func DbDeleteCrashBreadcrumb(handle *badger.DB) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Delete(_KeyCrashBreadcrumb)
+	})
+}
+
+// DbGenesisInitIncomplete returns true if a previous call to
+// InitDbWithBitCloutGenesisBlock started but never finished.
+func DbGenesisInitIncomplete(handle *badger.DB) bool {
+	var incomplete bool
+	DbView(handle, func(txn KVTxn) error {
+		_, err := txn.Get(_KeyGenesisInitInProgress)
+		incomplete = (err == nil)
+		return nil
+	})
+	return incomplete
+}
+
+// DbResetIncompleteGenesisInit wipes the chain state from the db if a previous
+// genesis initialization failed part-way through so that it can be retried from
+// a clean slate. It returns true if the db was wiped. This should be called
+// before anything else is read from or written to the db.
+//
+// Only the prefixes in DbPrefixRegistry that hold chain state are dropped. The
+// node-local prefixes in LocalOnlyDbPrefixes, like the node's identity and
+// config, survive the wipe, and so do the seed txn reports since they're what
+// explains why the previous initialization failed.
+func DbResetIncompleteGenesisInit(handle *badger.DB) (_wasReset bool, _err error) {
+	if !DbGenesisInitIncomplete(handle) {
+		return false, nil
+	}
+
+	prefixesToDrop := [][]byte{}
+	for _, prefixInfo := range DbPrefixRegistry {
+		if IsLocalOnlyDbKey(prefixInfo.Prefix) ||
+			bytes.Equal(prefixInfo.Prefix, _PrefixSeedTxnIndexToReport) {
+
+			continue
+		}
+		prefixesToDrop = append(prefixesToDrop, prefixInfo.Prefix)
+	}
+
+	glog.Warningf("DbResetIncompleteGenesisInit: Found an incomplete genesis " +
+		"initialization; wiping the chain state so it can be initialized again")
+	if err := handle.DropPrefix(prefixesToDrop...); err != nil {
+		return false, errors.Wrapf(err, "DbResetIncompleteGenesisInit: Problem "+
+			"wiping db after incomplete genesis initialization")
+	}
+
+	// The marker may be node-local, so clear it explicitly now that the partial
+	// state is gone.
+	err := DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Delete(_KeyGenesisInitInProgress)
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "DbResetIncompleteGenesisInit: Problem "+
+			"clearing genesis init marker")
+	}
+	return true, nil
+}
+
 // InitDbWithGenesisBlock initializes the database to contain only the genesis
 // block.
+//
+// The initialization is staged: _KeyGenesisInitInProgress is set before anything
+// else is written and the best hash is only set, along with the removal of the
+// marker, once every other step has succeeded. This way a failure at any point
+// leaves the db without a best hash, and DbResetIncompleteGenesisInit can detect
+// and wipe the partial state on the next startup.
 func InitDbWithBitCloutGenesisBlock(params *BitCloutParams, handle *badger.DB) error {
 	// Construct a node for the genesis block. Its height is zero and it has
 	// no parents. Its difficulty should be set to the initial
@@ -2402,14 +5008,16 @@ func InitDbWithBitCloutGenesisBlock(params *BitCloutParams, handle *badger.DB) e
 		StatusHeaderValidated|StatusBlockProcessed|StatusBlockStored|StatusBlockValidated, // Status
 	)
 
+	// Mark the initialization as in progress before writing anything else.
+	err := DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_KeyGenesisInitInProgress, []byte{})
+	})
+	if err != nil {
+		return errors.Wrapf(err, "InitDbWithGenesisBlock: Problem marking genesis initialization as in progress")
+	}
+
 	// Set the fields in the db to reflect the current state of our chain.
 	//
-	// Set the best hash to the genesis block in the db since its the only node
-	// we're currently aware of. Set it for both the header chain and the block
-	// chain.
-	if err := PutBestHash(blockHash, handle, ChainTypeBitCloutBlock); err != nil {
-		return errors.Wrapf(err, "InitDbWithGenesisBlock: Problem putting genesis block hash into db for block chain")
-	}
 	// Add the genesis block to the (hash -> block) index.
 	if err := PutBlock(genesisBlock, handle); err != nil {
 		return errors.Wrapf(err, "InitDbWithGenesisBlock: Problem putting genesis block into db")
@@ -2428,12 +5036,6 @@ func InitDbWithBitCloutGenesisBlock(params *BitCloutParams, handle *badger.DB) e
 	// We apply seed transactions here. This step is useful for setting
 	// up the blockchain with a particular set of transactions, e.g. when
 	// hard forking the chain.
-	//
-	// TODO: Right now there's an issue where if we hit an errur during this
-	// step of the initialization, the next time we run the program it will
-	// think things are initialized because we set the best block hash at the
-	// top. We should fix this at some point so that an error in this step
-	// wipes out the best hash.
 	utxoView, err := NewUtxoView(handle, params, nil)
 	if err != nil {
 		return fmt.Errorf(
@@ -2463,10 +5065,23 @@ func InitDbWithBitCloutGenesisBlock(params *BitCloutParams, handle *badger.DB) e
 		}
 	}
 
-	// Add the seed txns to the view
+	// Add the seed txns to the view, keeping a report for each one. If a seed txn
+	// fails, the reports up to and including the failing txn are persisted before
+	// returning so that the failure can be inspected.
+	seedTxnReports := []*SeedTxnReport{}
 	for txnIndex, txnHex := range params.SeedTxns {
+		report := &SeedTxnReport{
+			TxnIndex: uint32(txnIndex),
+		}
+		seedTxnReports = append(seedTxnReports, report)
+
 		txnBytes, err := hex.DecodeString(txnHex)
 		if err != nil {
+			report.Error = err.Error()
+			if putErr := DbPutSeedTxnReports(handle, seedTxnReports); putErr != nil {
+				return errors.Wrapf(putErr, "InitDbWithBitCloutGenesisBlock: Problem "+
+					"persisting seed txn reports after txn index %v failed: %v", txnIndex, report.Error)
+			}
 			return fmt.Errorf(
 				"InitDbWithBitCloutGenesisBlock: Error decoding seed "+
 					"txn HEX: %v, txn index: %v, txn hex: %v",
@@ -2474,23 +5089,39 @@ func InitDbWithBitCloutGenesisBlock(params *BitCloutParams, handle *badger.DB) e
 		}
 		txn := &MsgBitCloutTxn{}
 		if err := txn.FromBytes(txnBytes); err != nil {
+			report.Error = err.Error()
+			if putErr := DbPutSeedTxnReports(handle, seedTxnReports); putErr != nil {
+				return errors.Wrapf(putErr, "InitDbWithBitCloutGenesisBlock: Problem "+
+					"persisting seed txn reports after txn index %v failed: %v", txnIndex, report.Error)
+			}
 			return fmt.Errorf(
 				"InitDbWithBitCloutGenesisBlock: Error decoding seed "+
 					"txn BYTES: %v, txn index: %v, txn hex: %v",
 				err, txnIndex, txnHex)
 		}
+		report.TxnHash = txn.Hash()
+		report.TxnType = txn.TxnMeta.GetTxnType()
+		report.NumOutputs = uint64(len(txn.TxOutputs))
+
 		// Important: ignoreUtxos makes it so that the inputs/outputs aren't
 		// processed, which is important.
 		// Set txnSizeBytes to 0 here as the minimum network fee is 0 at genesis block, so there is no need to serialize
 		// these transactions to check if they meet the minimum network fee requirement.
-		_, _, _, _, err = utxoView.ConnectTransaction(
+		utxoOps, _, totalOutput, _, err := utxoView.ConnectTransaction(
 			txn, txn.Hash(), 0, 0 /*blockHeight*/, false /*verifySignatures*/, true /*ignoreUtxos*/)
 		if err != nil {
+			report.Error = err.Error()
+			if putErr := DbPutSeedTxnReports(handle, seedTxnReports); putErr != nil {
+				return errors.Wrapf(putErr, "InitDbWithBitCloutGenesisBlock: Problem "+
+					"persisting seed txn reports after txn index %v failed: %v", txnIndex, report.Error)
+			}
 			return fmt.Errorf(
 				"InitDbWithBitCloutGenesisBlock: Error connecting transaction: %v, "+
 					"txn index: %v, txn hex: %v",
 				err, txnIndex, txnHex)
 		}
+		report.TotalOutputNanos = totalOutput
+		report.NumUtxoOps = uint64(len(utxoOps))
 	}
 	// Flush all the data in the view.
 	err = utxoView.FlushToDb()
@@ -2499,2235 +5130,9422 @@ func InitDbWithBitCloutGenesisBlock(params *BitCloutParams, handle *badger.DB) e
 			"InitDbWithBitCloutGenesisBlock: Error flushing seed txns to DB: %v", err)
 	}
 
+	// Everything else succeeded so persist the seed txn reports, set the best
+	// hash to the genesis block, and clear the in-progress marker in one shot.
+	// The genesis block is the only node we're currently aware of at this point.
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		for _, report := range seedTxnReports {
+			if err := DbPutSeedTxnReportWithTxn(txn, report); err != nil {
+				return err
+			}
+		}
+		if err := PutBestHashWithTxn(txn, blockHash, ChainTypeBitCloutBlock); err != nil {
+			return err
+		}
+		return txn.Delete(_KeyGenesisInitInProgress)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "InitDbWithGenesisBlock: Problem putting genesis block hash into db for block chain")
+	}
+
 	return nil
 }
 
-func GetBlockIndex(handle *badger.DB, bitcoinNodes bool) (map[BlockHash]*BlockNode, error) {
-	blockIndex := make(map[BlockHash]*BlockNode)
-
-	prefix := _heightHashToNodeIndexPrefix(bitcoinNodes)
+// -------------------------------------------------------------------------------------
+// Index migration functions
+// <prefix, migration name []byte> -> <DbIndexMigrationState uint8>
+// -------------------------------------------------------------------------------------
 
-	err := handle.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		nodeIterator := txn.NewIterator(opts)
-		defer nodeIterator.Close()
-		for nodeIterator.Seek(prefix); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
-			var blockNode *BlockNode
+type DbIndexMigrationState uint8
 
-			// Don't bother checking the key. We assume that the key lines up
-			// with what we've stored in the value in terms of (height, block hash).
-			item := nodeIterator.Item()
-			err := item.Value(func(blockNodeBytes []byte) error {
-				// Deserialize the block node.
-				var err error
-				// TODO: There is room for optimization here by pre-allocating a
-				// contiguous list of block nodes and then populating that list
-				// rather than having each blockNode be a stand-alone allocation.
-				blockNode, err = DeserializeBlockNode(blockNodeBytes)
-				if err != nil {
-					return err
-				}
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+const (
+	// No migration has been started. Only the old prefix is used.
+	IndexMigrationStateNone DbIndexMigrationState = iota
+	// Writes go to both the old and the new prefix. Reads prefer the new prefix
+	// and fall back to the old one for entries that haven't been backfilled yet.
+	IndexMigrationStateDualWrite
+	// Every entry under the old prefix has been copied to the new prefix. Reads
+	// and writes behave the same as in the dual-write state.
+	IndexMigrationStateBackfillComplete
+	// The old prefix has been deleted. Only the new prefix is used.
+	IndexMigrationStateFinalized
+)
 
-			// If we got hear it means we read a blockNode successfully. Store it
-			// into our node index.
-			blockIndex[*blockNode.Hash] = blockNode
-
-			// Find the parent of this block, which should already have been read
-			// in and connect it. Skip the genesis block, which has height 0. Also
-			// skip the block if its PrevBlockHash is empty, which will be true for
-			// the BitcoinStartBlockNode.
-			//
-			// TODO: There is room for optimization here by keeping a reference to
-			// the last node we've iterated over and checking if that node is the
-			// parent. Doing this would avoid an expensive hashmap check to get
-			// the parent by its block hash.
-			if blockNode.Height == 0 || (*blockNode.Header.PrevBlockHash == BlockHash{}) {
-				continue
-			}
-			if parent, ok := blockIndex[*blockNode.Header.PrevBlockHash]; ok {
-				// We found the parent node so connect it.
-				blockNode.Parent = parent
-			} else {
-				// In this case we didn't find the parent so error. There shouldn't
-				// be any unconnectedTxns in our block index.
-				return fmt.Errorf("GetBlockIndex: Could not find parent for blockNode: %+v", blockNode)
+// TxnWriter writes to the db through a sequence of badger txns, committing the
+// current one and opening another whenever the next write won't fit in it. This
+// lets callers write more than badger allows in a single txn without picking a
+// batch size, at the cost of the writes not landing atomically.
+//
+// Each write is a function that's given the current txn. Badger refuses a write
+// that would make a txn too big before applying it, but a function that made
+// other writes first has already left them in the txn. So when a function fails
+// with badger.ErrTxnTooBig, the txn is thrown away, the functions before it are
+// run again in a fresh txn that's committed, and the function is retried in a
+// txn of its own. Write functions therefore have to do the same thing when run
+// again: they can read and write the db through the txn they're given but
+// shouldn't change anything else. A function that doesn't fit in a txn of its
+// own fails with ErrTxnTooBig, so each one should only write a bounded amount.
+//
+// Writes that have to land together, like the ones made when connecting a block,
+// shouldn't go through a TxnWriter. They use DbAtomicUpdate instead, which relies
+// on the db being opened with a memtable big enough for badger to allow them.
+type TxnWriter struct {
+	db  *badger.DB
+	txn *badger.Txn
+
+	// The functions that have written to txn, in order, so they can be run
+	// again if it has to be thrown away.
+	pendingWrites []func(txn KVTxn) error
+	numCommits    int
+}
+
+func NewTxnWriter(db *badger.DB) *TxnWriter {
+	return &TxnWriter{
+		db:  db,
+		txn: db.NewTransaction(true),
+	}
+}
+
+// Write runs fn in the current txn, committing what came before it first if fn
+// doesn't fit.
+func (txnWriter *TxnWriter) Write(fn func(txn KVTxn) error) error {
+	err := fn(NewBadgerKVTxn(txnWriter.txn))
+	if errors.Cause(err) == badger.ErrTxnTooBig && len(txnWriter.pendingWrites) > 0 {
+		txnWriter.txn.Discard()
+		txnWriter.txn = txnWriter.db.NewTransaction(true)
+		for _, pendingWrite := range txnWriter.pendingWrites {
+			if err := pendingWrite(NewBadgerKVTxn(txnWriter.txn)); err != nil {
+				return errors.Wrapf(err, "TxnWriter.Write: Problem redoing writes in a new txn")
 			}
 		}
-		return nil
-	})
+		if err := txnWriter.Commit(); err != nil {
+			return err
+		}
+		err = fn(NewBadgerKVTxn(txnWriter.txn))
+	}
+	if errors.Cause(err) == badger.ErrTxnTooBig {
+		return errors.Wrapf(err, "TxnWriter.Write: A single write doesn't fit in a txn "+
+			"of its own and has to be broken up by the caller")
+	}
 	if err != nil {
-		return nil, errors.Wrapf(err, "GetBlockIndex: Problem reading block index from db")
+		return err
 	}
 
-	return blockIndex, nil
+	txnWriter.pendingWrites = append(txnWriter.pendingWrites, fn)
+	return nil
 }
 
-func GetBestChain(tipNode *BlockNode, blockIndex map[BlockHash]*BlockNode) ([]*BlockNode, error) {
-	reversedBestChain := []*BlockNode{}
-	for tipNode != nil {
-		if (tipNode.Status&StatusBlockValidated) == 0 &&
-			(tipNode.Status&StatusBitcoinHeaderValidated) == 0 {
+func (txnWriter *TxnWriter) Set(key []byte, value []byte) error {
+	return txnWriter.Write(func(txn KVTxn) error {
+		return txn.Set(key, value)
+	})
+}
 
-			return nil, fmt.Errorf("GetBestChain: Invalid node found in main chain: %+v", tipNode)
-		}
+func (txnWriter *TxnWriter) Delete(key []byte) error {
+	return txnWriter.Write(func(txn KVTxn) error {
+		return txn.Delete(key)
+	})
+}
 
-		reversedBestChain = append(reversedBestChain, tipNode)
-		tipNode = tipNode.Parent
+// Commit commits everything written since the last commit. The writer can keep
+// being used afterward.
+func (txnWriter *TxnWriter) Commit() error {
+	if err := txnWriter.txn.Commit(); err != nil {
+		return errors.Wrapf(err, "TxnWriter.Commit: ")
 	}
+	txnWriter.numCommits++
+	txnWriter.txn = txnWriter.db.NewTransaction(true)
+	txnWriter.pendingWrites = nil
+	return nil
+}
 
-	bestChain := make([]*BlockNode, len(reversedBestChain))
-	for ii := 0; ii < len(reversedBestChain); ii++ {
-		bestChain[ii] = reversedBestChain[len(reversedBestChain)-1-ii]
-	}
+// Discard throws away everything written since the last commit. The writer
+// can't be used afterward.
+func (txnWriter *TxnWriter) Discard() {
+	txnWriter.txn.Discard()
+	txnWriter.pendingWrites = nil
+}
 
-	return bestChain, nil
+// NumCommits returns the number of txns the writer has committed.
+func (txnWriter *TxnWriter) NumCommits() int {
+	return txnWriter.numCommits
 }
 
-// RandomBytes returns a []byte with random values.
-func RandomBytes(numBytes int32) []byte {
-	randomBytes := make([]byte, numBytes)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		glog.Errorf("Problem reading random bytes: %v", err)
+// DbUpdateWithTxnWriter is like handle.Update except fn writes through a
+// TxnWriter, so what it writes can be split across several txns. If fn returns
+// an error, only what was committed to make room stays in the db.
+func DbUpdateWithTxnWriter(handle *badger.DB, fn func(txnWriter *TxnWriter) error) error {
+	txnWriter := NewTxnWriter(handle)
+	defer func() {
+		txnWriter.Discard()
+		// Whatever fn wrote has either been committed or discarded by now.
+		DbCacheFinishWrites()
+	}()
+
+	if err := fn(txnWriter); err != nil {
+		return err
 	}
-	return randomBytes
+	return txnWriter.Commit()
 }
 
-// RandomBytesHex returns a hex string representing numBytes of
-// entropy.
-func RandomBytesHex(numBytes int32) string {
-	return hex.EncodeToString(RandomBytes(numBytes))
+// DbView runs fn in a read-only badger txn.
+func DbView(handle *badger.DB, fn func(txn KVTxn) error) error {
+	return handle.View(func(txn *badger.Txn) error {
+		return fn(NewBadgerKVTxn(txn))
+	})
 }
 
-// RandInt64 returns a random 64-bit int.
-func RandInt64(max int64) int64 {
-	val, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
-	if err != nil {
-		glog.Errorf("Problem generating random int64: %v", err)
-	}
-	return val.Int64()
+// DbUpdate runs fn in a read-write badger txn that's committed if fn returns nil
+// and discarded otherwise.
+func DbUpdate(handle *badger.DB, fn func(txn KVTxn) error) error {
+	return handle.Update(func(txn *badger.Txn) error {
+		return fn(NewBadgerKVTxn(txn))
+	})
 }
 
-// RandInt32 returns a random 32-bit int.
-func RandInt32(max int32) int32 {
-	val, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
-	if err != nil {
-		glog.Errorf("Problem generating random int32: %v", err)
-	}
-	if val.Int64() > math.MaxInt32 {
-		glog.Errorf("Generated a random number out of range: %d (max: %d)", val.Int64(), math.MaxInt32)
-	}
-	// This cast is OK since we initialized the number to be
-	// < MaxInt32 above.
-	return int32(val.Int64())
+// DbAtomicUpdate is like DbUpdate except it lets the db caches resume caching
+// once fn's writes have committed or been discarded. See DbCacheFinishWrites.
+func DbAtomicUpdate(handle *badger.DB, fn func(txn KVTxn) error) error {
+	defer DbCacheFinishWrites()
+	return DbUpdate(handle, fn)
 }
 
-// PPrintJSON prints a JSON object but pretty.
-func PPrintJSON(xx interface{}) {
-	yy, _ := json.MarshalIndent(xx, "", "  ")
-	log.Println(string(yy))
-}
+// DbWriteBatch writes to the db through a badger WriteBatch, which commits on its
+// own whenever it fills up. It can take more writes than fit in a single txn, so
+// its writes don't land atomically, and it can't read the db. It's much faster
+// than a txn for writing a lot of keys whose values are already known, like a
+// mempool dump.
+//
+// When onProgress is set it's called with the number of writes so far after
+// every progressInterval writes and once more when the batch is flushed.
+type DbWriteBatch struct {
+	writeBatch *badger.WriteBatch
 
-func BlocksPerDuration(duration time.Duration, timeBetweenBlocks time.Duration) uint32 {
-	return uint32(int64(duration) / int64(timeBetweenBlocks))
+	numWrites        uint64
+	progressInterval uint64
+	onProgress       func(numWrites uint64)
 }
 
-func PkToString(pk []byte, params *BitCloutParams) string {
-	return Base58CheckEncode(pk, false, params)
-}
+func NewDbWriteBatch(handle *badger.DB, progressInterval uint64,
+	onProgress func(numWrites uint64)) *DbWriteBatch {
 
-func PrivToString(priv []byte, params *BitCloutParams) string {
-	return Base58CheckEncode(priv, true, params)
+	return &DbWriteBatch{
+		writeBatch:       handle.NewWriteBatch(),
+		progressInterval: progressInterval,
+		onProgress:       onProgress,
+	}
 }
 
-func PkToStringMainnet(pk []byte) string {
-	return Base58CheckEncode(pk, false, &BitCloutMainnetParams)
-}
+func (dbWriteBatch *DbWriteBatch) _wrote() {
+	dbWriteBatch.numWrites++
+	if dbWriteBatch.onProgress != nil && dbWriteBatch.progressInterval != 0 &&
+		dbWriteBatch.numWrites%dbWriteBatch.progressInterval == 0 {
 
-func PkToStringBoth(pk []byte) string {
-	return PkToStringMainnet(pk) + ":" + PkToStringTestnet(pk)
+		dbWriteBatch.onProgress(dbWriteBatch.numWrites)
+	}
 }
 
-func PkToStringTestnet(pk []byte) string {
-	return Base58CheckEncode(pk, false, &BitCloutTestnetParams)
+func (dbWriteBatch *DbWriteBatch) Set(key []byte, value []byte) error {
+	if err := dbWriteBatch.writeBatch.Set(key, value); err != nil {
+		return errors.Wrapf(err, "DbWriteBatch.Set: ")
+	}
+	dbWriteBatch._wrote()
+	return nil
 }
 
-func DbGetTxindexTip(handle *badger.DB) *BlockHash {
-	return _getBlockHashForPrefix(handle, _KeyTransactionIndexTip)
+func (dbWriteBatch *DbWriteBatch) Delete(key []byte) error {
+	if err := dbWriteBatch.writeBatch.Delete(key); err != nil {
+		return errors.Wrapf(err, "DbWriteBatch.Delete: ")
+	}
+	dbWriteBatch._wrote()
+	return nil
 }
 
-func DbPutTxindexTipWithTxn(dbTxn *badger.Txn, tipHash *BlockHash) error {
-	return dbTxn.Set(_KeyTransactionIndexTip, tipHash[:])
+// Flush commits whatever hasn't been committed yet and waits for all of it to
+// land. The batch can't be used afterward.
+func (dbWriteBatch *DbWriteBatch) Flush() error {
+	if err := dbWriteBatch.writeBatch.Flush(); err != nil {
+		return errors.Wrapf(err, "DbWriteBatch.Flush: ")
+	}
+	if dbWriteBatch.onProgress != nil {
+		dbWriteBatch.onProgress(dbWriteBatch.numWrites)
+	}
+	return nil
 }
 
-func DbPutTxindexTip(handle *badger.DB, tipHash *BlockHash) error {
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbPutTxindexTipWithTxn(txn, tipHash)
-	})
+// Cancel throws away whatever hasn't been committed yet. It's safe to call
+// after Flush.
+func (dbWriteBatch *DbWriteBatch) Cancel() {
+	dbWriteBatch.writeBatch.Cancel()
 }
 
-func _DbTxindexPublicKeyNextIndexPrefix(publicKey []byte) []byte {
-	return append(append([]byte{}, _PrefixPublicKeyToNextIndex...), publicKey...)
+// NumWrites returns the number of writes made through the batch.
+func (dbWriteBatch *DbWriteBatch) NumWrites() uint64 {
+	return dbWriteBatch.numWrites
 }
 
-func DbTxindexPublicKeyPrefix(publicKey []byte) []byte {
-	return append(append([]byte{}, _PrefixPublicKeyIndexToTransactionIDs...), publicKey...)
-}
+// DbUpdateWithWriteBatch is like DbUpdateWithTxnWriter except fn writes through a
+// DbWriteBatch. If fn returns an error, whatever the batch already committed stays
+// in the db.
+func DbUpdateWithWriteBatch(handle *badger.DB, progressInterval uint64,
+	onProgress func(numWrites uint64), fn func(dbWriteBatch *DbWriteBatch) error) error {
+
+	dbWriteBatch := NewDbWriteBatch(handle, progressInterval, onProgress)
+	defer dbWriteBatch.Cancel()
 
-func DbTxindexPublicKeyIndexToTxnKey(publicKey []byte, index uint32) []byte {
-	prefix := DbTxindexPublicKeyPrefix(publicKey)
-	return append(prefix, _EncodeUint32(index)...)
+	if err := fn(dbWriteBatch); err != nil {
+		return err
+	}
+	return dbWriteBatch.Flush()
+}
+
+// DbIndexMigration moves an index from one key format to another without taking
+// the node offline. Once StartDualWrite is called, code that writes to the index
+// should go through SetWithTxn and DeleteWithTxn, and code that reads from it
+// should go through GetWithTxn. Backfill then copies over the existing entries and
+// Finalize deletes the old prefix once that's done.
+type DbIndexMigration struct {
+	// A unique name for the migration, used as the key for its state.
+	Name string
+	// The prefixes for the old and new key formats.
+	OldPrefix []byte
+	NewPrefix []byte
+	// ConvertKey maps a full key under OldPrefix to the corresponding full key
+	// under NewPrefix. It's used during the backfill.
+	ConvertKey func(oldKey []byte) ([]byte, error)
+	// ConvertEntry is used instead of ConvertKey when the new index is derived
+	// from the old one rather than replacing it, so that the new entry depends on
+	// the old value too. The old index stays in use in that case, so migrations
+	// like this are never finalized.
+	ConvertEntry func(oldKey []byte, oldVal []byte) (_newKey []byte, _newVal []byte, _err error)
+}
+
+func _dbKeyForIndexMigrationState(migrationName string) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixIndexMigrationNameToState...)
+	return append(prefixCopy, []byte(migrationName)...)
 }
 
-func DbGetTxindexTxnsForPublicKeyWithTxn(dbTxn *badger.Txn, publicKey []byte) []*BlockHash {
-	txIDs := []*BlockHash{}
-	_, valsFound, err := _enumerateKeysForPrefixWithTxn(dbTxn, DbTxindexPublicKeyPrefix(publicKey))
+func DbGetIndexMigrationStateWithTxn(txn KVTxn, migrationName string) DbIndexMigrationState {
+	stateBytes, err := txn.Get(_dbKeyForIndexMigrationState(migrationName))
 	if err != nil {
-		return txIDs
+		return IndexMigrationStateNone
 	}
-	for _, txIDBytes := range valsFound {
-		blockHash := &BlockHash{}
-		copy(blockHash[:], txIDBytes[:])
-		txIDs = append(txIDs, blockHash)
+	if len(stateBytes) != 1 {
+		glog.Errorf("DbGetIndexMigrationStateWithTxn: Problem reading state "+
+			"for migration %s", migrationName)
+		return IndexMigrationStateNone
 	}
-
-	return txIDs
+	return DbIndexMigrationState(stateBytes[0])
 }
 
-func DbGetTxindexTxnsForPublicKey(handle *badger.DB, publicKey []byte) []*BlockHash {
-	txIDs := []*BlockHash{}
-	handle.Update(func(dbTxn *badger.Txn) error {
-		txIDs = DbGetTxindexTxnsForPublicKeyWithTxn(dbTxn, publicKey)
+func DbGetIndexMigrationState(handle *badger.DB, migrationName string) DbIndexMigrationState {
+	var state DbIndexMigrationState
+	DbView(handle, func(txn KVTxn) error {
+		state = DbGetIndexMigrationStateWithTxn(txn, migrationName)
 		return nil
 	})
-	return txIDs
+	return state
 }
 
-func _DbGetTxindexNextIndexForPublicKeBySeekWithTxn(dbTxn *badger.Txn, publicKey []byte) uint64 {
-	dbPrefixx := DbTxindexPublicKeyPrefix(publicKey)
-
-	opts := badger.DefaultIteratorOptions
-
-	opts.PrefetchValues = false
-
-	// Go in reverse order.
-	opts.Reverse = true
-
-	it := dbTxn.NewIterator(opts)
-	defer it.Close()
-	// Since we iterate backwards, the prefix must be bigger than all possible
-	// counts that could actually exist. We use four bytes since the index is
-	// encoded as a 32-bit big-endian byte slice, which will be four bytes long.
-	maxBigEndianUint32Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF}
-	prefix := append([]byte{}, dbPrefixx...)
-	prefix = append(prefix, maxBigEndianUint32Bytes...)
-	for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
-		countKey := it.Item().Key()
-
-		// Strip the prefix off the key and check its length. If it contains
-		// a big-endian uint32 then it should be at least four bytes.
-		countKey = countKey[len(dbPrefixx):]
-		if len(countKey) < len(maxBigEndianUint32Bytes) {
-			glog.Errorf("DbGetTxindexNextIndexForPublicKey: Invalid public key "+
-				"index key length %d should be at least %d",
-				len(countKey), len(maxBigEndianUint32Bytes))
-			return 0
-		}
+// DbPutIndexMigrationStateWithTxn records the state of a migration. Migrations
+// write state without going through a UtxoView flush, so this also drops the
+// state accumulator for DbInitStateCommitments to build again.
+func DbPutIndexMigrationStateWithTxn(
+	txn KVTxn, migrationName string, state DbIndexMigrationState) error {
 
-		countVal := DecodeUint32(countKey[:len(maxBigEndianUint32Bytes)])
-		return uint64(countVal + 1)
+	if err := DbDropStateAccumulatorWithTxn(txn); err != nil {
+		return err
 	}
-	// If we get here it means we didn't find anything in the db so return zero.
-	return 0
+	return txn.Set(_dbKeyForIndexMigrationState(migrationName), []byte{byte(state)})
 }
 
-func DbGetTxindexNextIndexForPublicKey(handle *badger.DB, publicKey []byte) *uint64 {
-	var nextIndex *uint64
-	handle.View(func(txn *badger.Txn) error {
-		nextIndex = _DbGetTxindexNextIndexForPublicKeyWithTxn(txn, publicKey)
-		return nil
-	})
-	return nextIndex
-}
+func (migration *DbIndexMigration) _convertEntry(oldKey []byte, oldVal []byte) (
+	_newKey []byte, _newVal []byte, _err error) {
 
-func _DbGetTxindexNextIndexForPublicKeyWithTxn(txn *badger.Txn, publicKey []byte) *uint64 {
-	key := _DbTxindexPublicKeyNextIndexPrefix(publicKey)
-	valItem, err := txn.Get(key)
-	if err != nil {
-		// If we haven't seen this public key yet, we won't have a next index for this key yet, so return 0.
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			nextIndexVal := _DbGetTxindexNextIndexForPublicKeBySeekWithTxn(txn, publicKey)
-			return &nextIndexVal
-		} else {
-			return nil
-		}
+	if migration.ConvertEntry != nil {
+		return migration.ConvertEntry(oldKey, oldVal)
 	}
-	valBytes, err := valItem.ValueCopy(nil)
+	newKey, err := migration.ConvertKey(oldKey)
 	if err != nil {
-		return nil
-	}
-	nextIndexVal, bytesRead := Uvarint(valBytes)
-	if bytesRead <= 0 {
-		return nil
+		return nil, nil, err
 	}
-	return &nextIndexVal
-
+	return newKey, oldVal, nil
 }
 
-func DbPutTxindexNextIndexForPublicKeyWithTxn(txn *badger.Txn, publicKey []byte, nextIndex uint64) error {
-	key := _DbTxindexPublicKeyNextIndexPrefix(publicKey)
-	valBuf := UintToBuf(nextIndex)
-
-	return txn.Set(key, valBuf)
+func (migration *DbIndexMigration) _isDualWrite(state DbIndexMigrationState) bool {
+	return state == IndexMigrationStateDualWrite ||
+		state == IndexMigrationStateBackfillComplete
 }
 
-func DbDeleteTxindexNextIndexForPublicKeyWithTxn(txn *badger.Txn, publicKey []byte) error {
-	key := _DbTxindexPublicKeyNextIndexPrefix(publicKey)
-	return txn.Delete(key)
+// StartDualWrite flips the migration into dual-write mode. It's a no-op if the
+// migration has already been started.
+func (migration *DbIndexMigration) StartDualWrite(handle *badger.DB) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		if DbGetIndexMigrationStateWithTxn(txn, migration.Name) != IndexMigrationStateNone {
+			return nil
+		}
+		return DbPutIndexMigrationStateWithTxn(txn, migration.Name, IndexMigrationStateDualWrite)
+	})
 }
 
-func DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(
-	dbTxn *badger.Txn, publicKey []byte, txID *BlockHash) error {
+// SetWithTxn writes an entry under whichever prefixes are live for the current
+// state of the migration. The caller must pass the key in both formats.
+func (migration *DbIndexMigration) SetWithTxn(
+	txn KVTxn, oldKey []byte, newKey []byte, value []byte) error {
 
-	nextIndex := _DbGetTxindexNextIndexForPublicKeyWithTxn(dbTxn, publicKey)
-	if nextIndex == nil {
-		return fmt.Errorf("Error getting next index")
+	state := DbGetIndexMigrationStateWithTxn(txn, migration.Name)
+	if state == IndexMigrationStateNone || migration._isDualWrite(state) {
+		if err := txn.Set(oldKey, value); err != nil {
+			return errors.Wrapf(err, "DbIndexMigration.SetWithTxn: Problem "+
+				"setting old key for migration %s", migration.Name)
+		}
 	}
-	key := DbTxindexPublicKeyIndexToTxnKey(publicKey, uint32(*nextIndex))
-	err := DbPutTxindexNextIndexForPublicKeyWithTxn(dbTxn, publicKey, uint64(*nextIndex+1))
-	if err != nil {
-		return err
+	if state != IndexMigrationStateNone {
+		if err := txn.Set(newKey, value); err != nil {
+			return errors.Wrapf(err, "DbIndexMigration.SetWithTxn: Problem "+
+				"setting new key for migration %s", migration.Name)
+		}
 	}
-	return dbTxn.Set(key, txID[:])
+	return nil
 }
 
-func DbDeleteTxindexPublicKeyToTxnMappingSingleWithTxn(
-	dbTxn *badger.Txn, publicKey []byte, txID *BlockHash) error {
-
-	// Get all the mappings corresponding to the public key passed in.
-	// TODO: This is inefficient but reorgs are rare so whatever.
-	txIDsInDB := DbGetTxindexTxnsForPublicKeyWithTxn(dbTxn, publicKey)
-	numMappingsInDB := len(txIDsInDB)
-
-	// Loop over the list of txIDs and delete the one
-	// corresponding to the passed-in transaction. Note we can assume that
-	// only one occurrence exists in the list.
-	// TODO: Looping backwards would be more efficient.
-	for ii, singleTxID := range txIDsInDB {
-		if *singleTxID == *txID {
-			// If we get here it means the transaction we need to delete is at
-			// this index.
-			txIDsInDB = append(txIDsInDB[:ii], txIDsInDB[ii+1:]...)
-			break
+// DeleteWithTxn deletes an entry from whichever prefixes are live for the
+// current state of the migration.
+func (migration *DbIndexMigration) DeleteWithTxn(
+	txn KVTxn, oldKey []byte, newKey []byte) error {
+
+	state := DbGetIndexMigrationStateWithTxn(txn, migration.Name)
+	if state != IndexMigrationStateFinalized {
+		if err := txn.Delete(oldKey); err != nil {
+			return errors.Wrapf(err, "DbIndexMigration.DeleteWithTxn: Problem "+
+				"deleting old key for migration %s", migration.Name)
 		}
 	}
-
-	// Delete all the mappings from the db.
-	for pkIndex := 0; pkIndex < numMappingsInDB; pkIndex++ {
-		key := DbTxindexPublicKeyIndexToTxnKey(publicKey, uint32(pkIndex))
-		if err := dbTxn.Delete(key); err != nil {
-			return err
+	if state != IndexMigrationStateNone {
+		if err := txn.Delete(newKey); err != nil {
+			return errors.Wrapf(err, "DbIndexMigration.DeleteWithTxn: Problem "+
+				"deleting new key for migration %s", migration.Name)
 		}
 	}
+	return nil
+}
 
-	// Delete the next index for this public key
-	err := DbDeleteTxindexNextIndexForPublicKeyWithTxn(dbTxn, publicKey)
-	if err != nil {
-		return err
-	}
+// GetWithTxn reads an entry, preferring the new prefix and falling back to the
+// old prefix while the old prefix is still live. It returns nil if the entry
+// doesn't exist under either prefix.
+func (migration *DbIndexMigration) GetWithTxn(
+	txn KVTxn, oldKey []byte, newKey []byte) []byte {
 
-	// Re-add all the mappings to the db except the one we just deleted.
-	for _, singleTxID := range txIDsInDB {
-		if err := DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(dbTxn, publicKey, singleTxID); err != nil {
-			return err
+	state := DbGetIndexMigrationStateWithTxn(txn, migration.Name)
+	keysToTry := [][]byte{}
+	if state != IndexMigrationStateNone {
+		keysToTry = append(keysToTry, newKey)
+	}
+	if state != IndexMigrationStateFinalized {
+		keysToTry = append(keysToTry, oldKey)
+	}
+	for _, key := range keysToTry {
+		value, err := txn.Get(key)
+		if err != nil {
+			continue
 		}
+		return value
 	}
-
-	// At this point the db should contain all transactions except the one
-	// that was deleted.
 	return nil
 }
 
-func DbTxindexTxIDKey(txID *BlockHash) []byte {
-	return append(append([]byte{}, _PrefixTransactionIDToMetadata...), txID[:]...)
+// Backfill copies every entry under the old prefix that doesn't exist under the
+// new prefix yet. Entries are written in batches so that large indexes don't
+// exceed badger's txn size limit, which means Backfill can safely be re-run if it
+// is interrupted. Once it finishes, the migration is marked as backfill complete.
+//
+// Each entry is re-read from the old prefix in the txn that copies it, so an
+// entry the dual-write path deletes after the old prefix was enumerated doesn't
+// get put back. If the delete lands after that read, badger fails the commit with
+// a conflict and Backfill can just be run again.
+func (migration *DbIndexMigration) Backfill(handle *badger.DB) error {
+	state := DbGetIndexMigrationState(handle, migration.Name)
+	if state == IndexMigrationStateBackfillComplete || state == IndexMigrationStateFinalized {
+		return nil
+	}
+	if state != IndexMigrationStateDualWrite {
+		return fmt.Errorf("DbIndexMigration.Backfill: Migration %s must be in "+
+			"dual-write mode before backfilling; state is %d", migration.Name, state)
+	}
+
+	oldKeys, _ := _enumerateKeysForPrefix(handle, migration.OldPrefix)
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, oldKeyIter := range oldKeys {
+			oldKey := oldKeyIter
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				// Don't resurrect anything that was deleted after we
+				// enumerated the old prefix.
+				oldVal, err := txn.Get(oldKey)
+				if err == ErrKVKeyNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				newKey, newVal, err := migration._convertEntry(oldKey, oldVal)
+				if err != nil {
+					return errors.Wrapf(err, "Problem converting key %#v", oldKey)
+				}
+				// Don't clobber anything that was dual-written after we
+				// enumerated the old prefix either.
+				if _, err := txn.Get(newKey); err == nil {
+					return nil
+				}
+				return txn.Set(newKey, newVal)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "DbIndexMigration.Backfill: Problem backfilling "+
+			"migration %s", migration.Name)
+	}
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(txn, migration.Name, IndexMigrationStateBackfillComplete)
+	})
 }
 
-type AffectedPublicKey struct {
-	PublicKeyBase58Check string
-	// Metadata about how this public key was affected by the transaction.
-	Metadata string
+// Finalize deletes the old prefix and marks the migration as finalized. It can
+// only be called after Backfill has completed.
+func (migration *DbIndexMigration) Finalize(handle *badger.DB) error {
+	state := DbGetIndexMigrationState(handle, migration.Name)
+	if state == IndexMigrationStateFinalized {
+		return nil
+	}
+	if state != IndexMigrationStateBackfillComplete {
+		return fmt.Errorf("DbIndexMigration.Finalize: Migration %s must finish "+
+			"backfilling before it can be finalized; state is %d", migration.Name, state)
+	}
+
+	// Drop the old prefix before marking the migration as finalized. If the node
+	// dies in between, the migration is still backfill complete and the reads
+	// still fall back to the old prefix, which is fine since everything in it
+	// was copied to the new one. Marking it finalized first would leave the old
+	// prefix in the db for good if the drop failed.
+	if err := handle.DropPrefix(migration.OldPrefix); err != nil {
+		return errors.Wrapf(err, "DbIndexMigration.Finalize: Problem dropping old "+
+			"prefix for migration %s", migration.Name)
+	}
+
+	// Dual writes can land in the old prefix between the drop and the state
+	// change, so delete those in the same txn that marks the migration
+	// finalized. The dual-write path reads the state in its txn, so a write that
+	// races with this one fails with a conflict instead of sneaking in.
+	err := DbUpdate(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		opts.KeysOnly = true
+		opts.Prefix = migration.OldPrefix
+		nodeIterator := txn.NewIterator(opts)
+		oldKeys := [][]byte{}
+		for nodeIterator.Seek(migration.OldPrefix); nodeIterator.ValidForPrefix(migration.OldPrefix); nodeIterator.Next() {
+			oldKeys = append(oldKeys, append([]byte{}, nodeIterator.Key()...))
+		}
+		nodeIterator.Close()
+		for _, oldKey := range oldKeys {
+			if err := txn.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+		return DbPutIndexMigrationStateWithTxn(txn, migration.Name, IndexMigrationStateFinalized)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "DbIndexMigration.Finalize: Problem updating state "+
+			"for migration %s", migration.Name)
+	}
+	return nil
 }
 
-type BasicTransferTxindexMetadata struct {
-	TotalInputNanos  uint64
+// -------------------------------------------------------------------------------------
+// Seed txn report functions
+// <prefix, txn index uint32 (big-endian)> -> <SeedTxnReport gob serialized>
+// -------------------------------------------------------------------------------------
+
+// SeedTxnReport records what happened when a particular seed txn was connected
+// by InitDbWithBitCloutGenesisBlock.
+type SeedTxnReport struct {
+	// The index of the txn in params.SeedTxns.
+	TxnIndex uint32
+	// These are only set if the txn could be decoded.
+	TxnHash *BlockHash
+	TxnType TxnType
+	// The number of outputs on the txn and the total nanos they add up to.
+	NumOutputs       uint64
 	TotalOutputNanos uint64
-	FeeNanos         uint64
-	UtxoOpsDump      string
-}
-type BitcoinExchangeTxindexMetadata struct {
-	BitcoinSpendAddress string
-	// BitCloutOutputPubKeyBase58Check = TransactorPublicKeyBase58Check
-	SatoshisBurned uint64
-	// NanosCreated = 0 OR TotalOutputNanos+FeeNanos
-	NanosCreated uint64
-	// TotalNanosPurchasedBefore = TotalNanosPurchasedAfter - NanosCreated
-	TotalNanosPurchasedBefore uint64
-	TotalNanosPurchasedAfter  uint64
-	BitcoinTxnHash            string
+	// The number of UtxoOperations generated by connecting the txn.
+	NumUtxoOps uint64
+	// Empty if the txn was connected successfully.
+	Error string
 }
-type CreatorCoinTxindexMetadata struct {
-	OperationType string
-	// TransactorPublicKeyBase58Check = TransactorPublicKeyBase58Check
-	// CreatorPublicKeyBase58Check in AffectedPublicKeys
 
-	// Differs depending on OperationType.
-	BitCloutToSellNanos    uint64
-	CreatorCoinToSellNanos uint64
-	BitCloutToAddNanos     uint64
+func _dbKeyForSeedTxnReport(txnIndex uint32) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixSeedTxnIndexToReport...)
+	return append(prefixCopy, _EncodeUint32(txnIndex)...)
 }
 
-type CreatorCoinTransferTxindexMetadata struct {
-	CreatorUsername            string
-	CreatorCoinToTransferNanos uint64
-	DiamondLevel               int64
-	PostHashHex                string
+func DbPutSeedTxnReportWithTxn(txn KVTxn, report *SeedTxnReport) error {
+	reportBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(reportBuf).Encode(report); err != nil {
+		return errors.Wrapf(err, "DbPutSeedTxnReportWithTxn: Problem encoding "+
+			"report for seed txn %d", report.TxnIndex)
+	}
+	if err := txn.Set(_dbKeyForSeedTxnReport(report.TxnIndex), reportBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "DbPutSeedTxnReportWithTxn: Problem adding "+
+			"report for seed txn %d", report.TxnIndex)
+	}
+	return nil
 }
 
-type UpdateProfileTxindexMetadata struct {
-	ProfilePublicKeyBase58Check string
-
-	NewUsername    string
-	NewDescription string
-	NewProfilePic  string
+func DbPutSeedTxnReports(handle *badger.DB, reports []*SeedTxnReport) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		for _, report := range reports {
+			if err := DbPutSeedTxnReportWithTxn(txn, report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	NewCreatorBasisPoints uint64
+// DbGetSeedTxnReports returns the reports for all the seed txns connected at
+// genesis, sorted by their index in params.SeedTxns.
+func DbGetSeedTxnReports(handle *badger.DB) ([]*SeedTxnReport, error) {
+	_, valsFound := _enumerateKeysForPrefix(handle, _PrefixSeedTxnIndexToReport)
 
-	NewStakeMultipleBasisPoints uint64
+	reports := []*SeedTxnReport{}
+	for _, valBytes := range valsFound {
+		report := &SeedTxnReport{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(report); err != nil {
+			return nil, _corruptDbEntryError(err, "DbGetSeedTxnReports: Problem decoding report")
+		}
+		reports = append(reports, report)
+	}
 
-	IsHidden bool
+	return reports, nil
 }
-type SubmitPostTxindexMetadata struct {
-	PostHashBeingModifiedHex string
-	// PosterPublicKeyBase58Check = TransactorPublicKeyBase58Check
-
-	// If this is a reply to an existing post, then the ParentPostHashHex
-	ParentPostHashHex string
-	// ParentPosterPublicKeyBase58Check in AffectedPublicKeys
 
-	// The profiles that are mentioned are in the AffectedPublicKeys
-	// MentionedPublicKeyBase58Check in AffectedPublicKeys
+func GetBlockIndex(handle *badger.DB, bitcoinNodes bool) (map[BlockHash]*BlockNode, error) {
+	return GetBlockIndexParallel(handle, bitcoinNodes, 0 /*numWorkers*/)
 }
-type LikeTxindexMetadata struct {
-	// LikerPublicKeyBase58Check = TransactorPublicKeyBase58Check
-	IsUnlike bool
 
-	PostHashHex string
-	// PosterPublicKeyBase58Check in AffectedPublicKeys
-}
-type FollowTxindexMetadata struct {
-	// FollowerPublicKeyBase58Check = TransactorPublicKeyBase58Check
-	// FollowedPublicKeyBase58Check in AffectedPublicKeys
+// GetBlockIndexParallel is GetBlockIndex with the nodes decoded across numWorkers
+// goroutines, or one per CPU when numWorkers is zero or less. The raw nodes are
+// read in a single txn, decoded into one contiguous allocation, and then linked
+// to their parents in height order once they've all been decoded.
+func GetBlockIndexParallel(handle *badger.DB, bitcoinNodes bool, numWorkers int) (
+	map[BlockHash]*BlockNode, error) {
 
-	IsUnfollow bool
-}
-type PrivateMessageTxindexMetadata struct {
-	// SenderPublicKeyBase58Check = TransactorPublicKeyBase58Check
-	// RecipientPublicKeyBase58Check in AffectedPublicKeys
+	prefix := _heightHashToNodeIndexPrefix(bitcoinNodes)
 
-	TimestampNanos uint64
-}
-type SwapIdentityTxindexMetadata struct {
-	// ParamUpdater = TransactorPublicKeyBase58Check
+	// The keys are ordered by height so parents always come before their
+	// children.
+	blockNodesBytes := [][]byte{}
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		nodeIterator := txn.NewIterator(opts)
+		defer nodeIterator.Close()
+		for nodeIterator.Seek(prefix); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+			// Don't bother checking the key. We assume that the key lines up
+			// with what we've stored in the value in terms of (height, block hash).
+			blockNodeBytes, err := nodeIterator.Value()
+			if err != nil {
+				return err
+			}
+			blockNodesBytes = append(blockNodesBytes, blockNodeBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetBlockIndex: Problem reading block index from db")
+	}
 
-	FromPublicKeyBase58Check string
+	// Decode the nodes. Each worker takes a contiguous range of them and the
+	// nodes and their hashes are allocated all at once rather than one by one.
+	numNodes := len(blockNodesBytes)
+	blockNodes := make([]BlockNode, numNodes)
+	blockHashes := make([]BlockHash, 2*numNodes)
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	if numWorkers > numNodes {
+		numWorkers = numNodes
+	}
+	workerErrs := make([]error, numWorkers)
+	var wg sync.WaitGroup
+	for workerIndex := 0; workerIndex < numWorkers; workerIndex++ {
+		wg.Add(1)
+		go func(workerIndex int) {
+			defer wg.Done()
+			startIndex := numNodes * workerIndex / numWorkers
+			endIndex := numNodes * (workerIndex + 1) / numWorkers
+			for ii := startIndex; ii < endIndex; ii++ {
+				blockNode := &blockNodes[ii]
+				blockNode.Hash = &blockHashes[2*ii]
+				blockNode.DifficultyTarget = &blockHashes[2*ii+1]
+				if err := _deserializeBlockNodeInto(blockNodesBytes[ii], blockNode); err != nil {
+					workerErrs[workerIndex] = err
+					return
+				}
+			}
+		}(workerIndex)
+	}
+	wg.Wait()
+	for _, err := range workerErrs {
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetBlockIndex: Problem reading block index from db")
+		}
+	}
 
-	ToPublicKeyBase58Check string
-}
+	blockIndex := make(map[BlockHash]*BlockNode, numNodes)
+	for ii := range blockNodes {
+		blockIndex[*blockNodes[ii].Hash] = &blockNodes[ii]
+	}
 
-type TransactionMetadata struct {
-	BlockHashHex    string
-	TxnIndexInBlock uint64
-	TxnType         string
-	// All transactions have a public key who executed the transaction and some
-	// public keys that are affected by the transaction. Notifications are created
-	// for the affected public keys. _getPublicKeysForTxn uses this to set entries in the
-	// database.
-	TransactorPublicKeyBase58Check string
-	AffectedPublicKeys             []*AffectedPublicKey
-
-	// We store these outputs so we don't have to load the full transaction from disk
-	// when looking up output amounts
-	TxnOutputs []*BitCloutOutput
+	// Find the parent of each block and connect it. Skip the genesis block, which
+	// has height 0. Also skip the block if its PrevBlockHash is empty, which will
+	// be true for the BitcoinStartBlockNode. The parent is usually the node right
+	// before this one, so check that before falling back to the map.
+	for ii := range blockNodes {
+		blockNode := &blockNodes[ii]
+		if blockNode.Height == 0 || (*blockNode.Header.PrevBlockHash == BlockHash{}) {
+			continue
+		}
+		if ii > 0 && *blockNodes[ii-1].Hash == *blockNode.Header.PrevBlockHash {
+			blockNode.Parent = &blockNodes[ii-1]
+		} else if parent, ok := blockIndex[*blockNode.Header.PrevBlockHash]; ok {
+			// We found the parent node so connect it.
+			blockNode.Parent = parent
+		} else {
+			// In this case we didn't find the parent so error. There shouldn't
+			// be any unconnectedTxns in our block index.
+			return nil, fmt.Errorf("GetBlockIndex: Could not find parent for blockNode: %+v", blockNode)
+		}
+	}
 
-	BasicTransferTxindexMetadata       *BasicTransferTxindexMetadata
-	BitcoinExchangeTxindexMetadata     *BitcoinExchangeTxindexMetadata
-	CreatorCoinTxindexMetadata         *CreatorCoinTxindexMetadata
-	CreatorCoinTransferTxindexMetadata *CreatorCoinTransferTxindexMetadata
-	UpdateProfileTxindexMetadata       *UpdateProfileTxindexMetadata
-	SubmitPostTxindexMetadata          *SubmitPostTxindexMetadata
-	LikeTxindexMetadata                *LikeTxindexMetadata
-	FollowTxindexMetadata              *FollowTxindexMetadata
-	PrivateMessageTxindexMetadata      *PrivateMessageTxindexMetadata
-	SwapIdentityTxindexMetadata        *SwapIdentityTxindexMetadata
+	return blockIndex, nil
 }
 
-func DbGetTxindexTransactionRefByTxIDWithTxn(txn *badger.Txn, txID *BlockHash) *TransactionMetadata {
-	key := DbTxindexTxIDKey(txID)
-	valObj := TransactionMetadata{}
+func GetBestChain(tipNode *BlockNode, blockIndex map[BlockHash]*BlockNode) ([]*BlockNode, error) {
+	reversedBestChain := []*BlockNode{}
+	for tipNode != nil {
+		if (tipNode.Status&StatusBlockValidated) == 0 &&
+			(tipNode.Status&StatusBitcoinHeaderValidated) == 0 {
 
-	valItem, err := txn.Get(key)
-	if err != nil {
-		return nil
-	}
-	valBytes, err := valItem.ValueCopy(nil)
-	if err != nil {
-		return nil
+			return nil, fmt.Errorf("GetBestChain: Invalid node found in main chain: %+v", tipNode)
+		}
+
+		reversedBestChain = append(reversedBestChain, tipNode)
+		tipNode = tipNode.Parent
 	}
-	if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(&valObj); err != nil {
-		return nil
+
+	bestChain := make([]*BlockNode, len(reversedBestChain))
+	for ii := 0; ii < len(reversedBestChain); ii++ {
+		bestChain[ii] = reversedBestChain[len(reversedBestChain)-1-ii]
 	}
-	return &valObj
+
+	return bestChain, nil
 }
 
-func DbGetTxindexTransactionRefByTxID(handle *badger.DB, txID *BlockHash) *TransactionMetadata {
-	var valObj *TransactionMetadata
-	handle.View(func(txn *badger.Txn) error {
-		valObj = DbGetTxindexTransactionRefByTxIDWithTxn(txn, txID)
+// VerifyTipConsistency checks that the best block hash stored in the db lines up
+// with the rest of the chain state before we try to load it. In particular, it
+// confirms that the best hash has a block stored for it, that it is present in the
+// (height, hash -> node) index with StatusBlockValidated set, that its state
+// commitment matches the state accumulator when commitments are on, and that
+// UtxoOperations exist for it so that it can be disconnected if a reorg occurs. A
+// db that has never been initialized has no best hash and is considered consistent.
+//
+// Without this check, a db that was left in a bad state (e.g. by a crash in the
+// middle of a write) tends to fail much later with errors that make it hard to tell
+// what went wrong. The errors returned here try to be explicit about the fix.
+func VerifyTipConsistency(handle *badger.DB) error {
+	bestHash := DbGetBestHash(handle, ChainTypeBitCloutBlock)
+	if bestHash == nil {
 		return nil
-	})
-	return valObj
-}
-func DbPutTxindexTransactionWithTxn(
-	txn *badger.Txn, txID *BlockHash, txnMeta *TransactionMetadata) error {
+	}
 
-	key := append(append([]byte{}, _PrefixTransactionIDToMetadata...), txID[:]...)
-	valBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(valBuf).Encode(txnMeta)
+	return DbView(handle, func(txn KVTxn) error {
+		tipBlock := GetBlockWithTxn(txn, bestHash)
+		if tipBlock == nil || tipBlock.Header == nil {
+			return fmt.Errorf("VerifyTipConsistency: Best hash %v has no block "+
+				"stored for it; the db is likely corrupted and should be deleted "+
+				"and resynced", bestHash)
+		}
+		tipHeight := uint32(tipBlock.Header.Height)
 
-	return txn.Set(key, valBuf.Bytes())
-}
+		tipNode := GetHeightHashToNodeInfoWithTxn(txn, tipHeight, bestHash, false /*bitcoinNodes*/)
+		if tipNode == nil {
+			return fmt.Errorf("VerifyTipConsistency: Best hash %v at height %d is "+
+				"missing from the block index; the db is likely corrupted and should "+
+				"be deleted and resynced", bestHash, tipHeight)
+		}
+		if tipNode.Status&StatusBlockValidated == 0 {
+			return fmt.Errorf("VerifyTipConsistency: Best hash %v at height %d has "+
+				"status %v, which does not include StatusBlockValidated; the tip was "+
+				"likely written before validation finished and the db should be "+
+				"deleted and resynced", bestHash, tipHeight, tipNode.Status)
+		}
 
-func DbPutTxindexTransaction(
-	handle *badger.DB, txID *BlockHash, txnMeta *TransactionMetadata) error {
+		// When the node keeps state commitments, the commitment for the tip has to
+		// match the accumulator, since both are written in the same txn as the
+		// tip. A mismatch means the state was changed outside of a flush.
+		acc, err := DbGetStateAccumulatorWithTxn(txn)
+		if err != nil {
+			return errors.Wrapf(err, "VerifyTipConsistency: Problem reading the "+
+				"state accumulator")
+		}
+		if acc != nil {
+			tipCommitment := DbGetStateCommitmentWithTxn(txn, tipHeight)
+			if tipCommitment == nil {
+				return fmt.Errorf("VerifyTipConsistency: Best hash %v at height %d "+
+					"has no state commitment even though state commitments are on; "+
+					"turn them off and on again to rebuild them", bestHash, tipHeight)
+			}
+			if *tipCommitment != *acc.Commitment() {
+				return fmt.Errorf("VerifyTipConsistency: The state commitment %v for "+
+					"best hash %v at height %d doesn't match the state accumulator's "+
+					"%v; the db should be deleted and resynced", tipCommitment,
+					bestHash, tipHeight, acc.Commitment())
+			}
+		}
 
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbPutTxindexTransactionWithTxn(txn, txID, txnMeta)
+		// The genesis block is written directly by InitDbWithBitCloutGenesisBlock
+		// and never has UtxoOperations stored for it since it can't be disconnected.
+		if tipHeight == 0 {
+			return nil
+		}
+		if _, err := GetUtxoOperationsForBlockWithTxn(txn, bestHash); err != nil {
+			return errors.Wrapf(err, "VerifyTipConsistency: Best hash %v at height "+
+				"%d has no UtxoOperations stored for it, which means it could not be "+
+				"disconnected in a reorg; the db should be deleted and resynced",
+				bestHash, tipHeight)
+		}
+
+		return nil
 	})
 }
 
-func _getPublicKeysForTxn(
-	txn *MsgBitCloutTxn, txnMeta *TransactionMetadata, params *BitCloutParams) map[PkMapKey]bool {
-
-	// Collect the public keys in the transaction.
-	publicKeys := make(map[PkMapKey]bool)
+// RandomBytes returns a []byte with random values.
+func RandomBytes(numBytes int32) []byte {
+	randomBytes := make([]byte, numBytes)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		glog.Errorf("Problem reading random bytes: %v", err)
+	}
+	return randomBytes
+}
 
-	// TODO: For AddStake transactions, we don't have a way of getting the implicit
-	// outputs. This means that if you get paid from someone else staking to a post
-	// after you, the output won't be explicitly included in the transaction, and so
-	// it won't be added to our index. We should fix this at some point. I think the
-	// "right way" to fix this problem is to index UTXOs rather than transactions (or
-	// in addition to them).
-	// TODO(updated): We can fix this by populating AffectedPublicKeys
+// RandomBytesHex returns a hex string representing numBytes of
+// entropy.
+func RandomBytesHex(numBytes int32) string {
+	return hex.EncodeToString(RandomBytes(numBytes))
+}
 
-	// Add the TransactorPublicKey
-	{
-		res, _, err := Base58CheckDecode(txnMeta.TransactorPublicKeyBase58Check)
-		if err != nil {
-			glog.Errorf("_getPublicKeysForTxn: Error decoding "+
-				"TransactorPublicKeyBase58Check: %v %v",
-				txnMeta.TransactorPublicKeyBase58Check, err)
-		} else {
-			publicKeys[MakePkMapKey(res)] = true
-		}
+// RandInt64 returns a random 64-bit int.
+func RandInt64(max int64) int64 {
+	val, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		glog.Errorf("Problem generating random int64: %v", err)
 	}
+	return val.Int64()
+}
 
-	// Add each AffectedPublicKey
-	for _, affectedPk := range txnMeta.AffectedPublicKeys {
-		res, _, err := Base58CheckDecode(affectedPk.PublicKeyBase58Check)
-		if err != nil {
-			glog.Errorf("_getPublicKeysForTxn: Error decoding AffectedPublicKey: %v %v %v",
-				affectedPk.PublicKeyBase58Check, affectedPk.Metadata, err)
-		} else {
-			publicKeys[MakePkMapKey(res)] = true
-		}
+// RandInt32 returns a random 32-bit int.
+func RandInt32(max int32) int32 {
+	val, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+	if err != nil {
+		glog.Errorf("Problem generating random int32: %v", err)
+	}
+	if val.Int64() > math.MaxInt32 {
+		glog.Errorf("Generated a random number out of range: %d (max: %d)", val.Int64(), math.MaxInt32)
 	}
+	// This cast is OK since we initialized the number to be
+	// < MaxInt32 above.
+	return int32(val.Int64())
+}
 
-	return publicKeys
+// PPrintJSON prints a JSON object but pretty.
+func PPrintJSON(xx interface{}) {
+	yy, _ := json.MarshalIndent(xx, "", "  ")
+	log.Println(string(yy))
 }
 
-func DbPutTxindexTransactionMappingsWithTxn(
-	dbTx *badger.Txn, txn *MsgBitCloutTxn, params *BitCloutParams, txnMeta *TransactionMetadata) error {
+func BlocksPerDuration(duration time.Duration, timeBetweenBlocks time.Duration) uint32 {
+	return uint32(int64(duration) / int64(timeBetweenBlocks))
+}
 
-	txID := txn.Hash()
+func PkToString(pk []byte, params *BitCloutParams) string {
+	return Base58CheckEncode(pk, false, params)
+}
 
-	if err := DbPutTxindexTransactionWithTxn(dbTx, txID, txnMeta); err != nil {
-		return fmt.Errorf("Problem adding txn to txindex transaction index: %v", err)
-	}
+func PrivToString(priv []byte, params *BitCloutParams) string {
+	return Base58CheckEncode(priv, true, params)
+}
 
-	// Get the public keys involved with this transaction.
-	publicKeys := _getPublicKeysForTxn(txn, txnMeta, params)
+func PkToStringMainnet(pk []byte) string {
+	return Base58CheckEncode(pk, false, &BitCloutMainnetParams)
+}
 
-	// For each public key found, add the txID from its list.
-	for pkFound := range publicKeys {
-		// Simply add a new entry for each of the public keys found.
-		if err := DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(dbTx, pkFound[:], txID); err != nil {
-			return err
-		}
-	}
+func PkToStringBoth(pk []byte) string {
+	return PkToStringMainnet(pk) + ":" + PkToStringTestnet(pk)
+}
 
-	// If we get here, it means everything went smoothly.
-	return nil
+func PkToStringTestnet(pk []byte) string {
+	return Base58CheckEncode(pk, false, &BitCloutTestnetParams)
 }
 
-func DbPutTxindexTransactionMappings(
-	handle *badger.DB, bitcloutTxn *MsgBitCloutTxn, params *BitCloutParams, txnMeta *TransactionMetadata) error {
+func DbGetTxindexTip(handle *badger.DB) *BlockHash {
+	return _getBlockHashForPrefix(handle, _KeyTransactionIndexTip)
+}
 
-	return handle.Update(func(dbTx *badger.Txn) error {
-		return DbPutTxindexTransactionMappingsWithTxn(
-			dbTx, bitcloutTxn, params, txnMeta)
+func DbPutTxindexTipWithTxn(dbTxn KVTxn, tipHash *BlockHash) error {
+	return dbTxn.Set(_KeyTransactionIndexTip, tipHash[:])
+}
+
+func DbPutTxindexTip(handle *badger.DB, tipHash *BlockHash) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutTxindexTipWithTxn(txn, tipHash)
 	})
 }
 
-func DbDeleteTxindexTransactionMappingsWithTxn(
-	dbTxn *badger.Txn, txn *MsgBitCloutTxn, params *BitCloutParams) error {
+// -------------------------------------------------------------------------------------
+// Txindex public key functions
+// <prefix, public key [33]byte, block height uint32, txn index uint32, txid BlockHash> -> <>
+//
+// The txns each public key is involved in, in the order they appear in the chain.
+// Every mapping can be found from the txn's metadata, so adding or removing one
+// is a single key write regardless of how many txns the public key has.
+// -------------------------------------------------------------------------------------
 
-	txID := txn.Hash()
+func DbTxindexPublicKeyPrefix(publicKey []byte) []byte {
+	return append(append([]byte{}, _PrefixPublicKeyHeightTxnIndexTxID...), publicKey...)
+}
 
-	// If the txnMeta isn't in the db then that's an error.
-	txnMeta := DbGetTxindexTransactionRefByTxIDWithTxn(dbTxn, txID)
-	if txnMeta == nil {
-		return fmt.Errorf("DbDeleteTxindexTransactionMappingsWithTxn: Missing txnMeta for txID %v", txID)
-	}
+func _dbKeyForTxindexPublicKeyTxn(
+	publicKey []byte, blockHeight uint32, txnIndexInBlock uint32, txID *BlockHash) []byte {
 
-	// Get the public keys involved with this transaction.
-	publicKeys := _getPublicKeysForTxn(txn, txnMeta, params)
+	key := DbTxindexPublicKeyPrefix(publicKey)
+	key = append(key, _EncodeUint32(blockHeight)...)
+	key = append(key, _EncodeUint32(txnIndexInBlock)...)
+	return append(key, txID[:]...)
+}
 
-	// For each public key found, delete the txID mapping from the db.
-	for pkFound := range publicKeys {
-		if err := DbDeleteTxindexPublicKeyToTxnMappingSingleWithTxn(dbTxn, pkFound[:], txID); err != nil {
-			return err
-		}
-	}
+// _dbKeyForTxindexPublicKeyTxnMetaWithTxn returns the key of the mapping from the
+// public key to the txn described by txnMeta.
+func _dbKeyForTxindexPublicKeyTxnMetaWithTxn(
+	dbTxn KVTxn, publicKey []byte, txID *BlockHash, txnMeta *TransactionMetadata) ([]byte, error) {
 
-	// Delete the metadata
-	transactionIndexKey := DbTxindexTxIDKey(txID)
-	if err := dbTxn.Delete(transactionIndexKey); err != nil {
-		return fmt.Errorf("Problem deleting transaction index key: %v", err)
+	blockHeight, err := _dbTxindexHeightForTxnMetaWithTxn(dbTxn, txnMeta)
+	if err != nil {
+		return nil, err
 	}
+	return _dbKeyForTxindexPublicKeyTxn(publicKey, blockHeight, uint32(txnMeta.TxnIndexInBlock), txID), nil
+}
 
-	// If we get here, it means everything went smoothly.
-	return nil
+// _txIDForTxindexPublicKeyTxnKey returns the txid at the end of a public key
+// mapping key, or nil if the key is the wrong length.
+func _txIDForTxindexPublicKeyTxnKey(key []byte) *BlockHash {
+	if len(key) != len(_PrefixPublicKeyHeightTxnIndexTxID)+btcec.PubKeyBytesLenCompressed+4+4+HashSizeBytes {
+		return nil
+	}
+	txID := &BlockHash{}
+	copy(txID[:], key[len(key)-HashSizeBytes:])
+	return txID
 }
 
-func DbDeleteTxindexTransactionMappings(
-	handle *badger.DB, txn *MsgBitCloutTxn, params *BitCloutParams) error {
+func DbGetTxindexTxnsForPublicKeyWithTxn(dbTxn KVTxn, publicKey []byte) []*BlockHash {
+	txIDs := []*BlockHash{}
+	keysFound, _, err := _enumerateKeysForPrefixWithTxn(dbTxn, DbTxindexPublicKeyPrefix(publicKey))
+	if err != nil {
+		return txIDs
+	}
+	for _, key := range keysFound {
+		txID := _txIDForTxindexPublicKeyTxnKey(key)
+		if txID == nil {
+			glog.Errorf("DbGetTxindexTxnsForPublicKeyWithTxn: Invalid key length %d", len(key))
+			continue
+		}
+		txIDs = append(txIDs, txID)
+	}
 
-	return handle.Update(func(dbTx *badger.Txn) error {
-		return DbDeleteTxindexTransactionMappingsWithTxn(dbTx, txn, params)
+	return txIDs
+}
+
+func DbGetTxindexTxnsForPublicKey(handle *badger.DB, publicKey []byte) []*BlockHash {
+	txIDs := []*BlockHash{}
+	DbView(handle, func(dbTxn KVTxn) error {
+		txIDs = DbGetTxindexTxnsForPublicKeyWithTxn(dbTxn, publicKey)
+		return nil
 	})
+	return txIDs
 }
 
-// DbGetTxindexFullTransactionByTxID
-// TODO: This makes lookups inefficient when blocks are large. Shouldn't be a
-// problem for a while, but keep an eye on it.
-func DbGetTxindexFullTransactionByTxID(
-	txindexDBHandle *badger.DB, blockchainDBHandle *badger.DB, txID *BlockHash) (
-	_txn *MsgBitCloutTxn, _txnMeta *TransactionMetadata) {
+// DbGetPaginatedTxindexTxnsForPublicKey fetches up to limit of the txns the
+// public key is involved in, oldest first, or newest first if reverse is set.
+// It starts right after the txn the cursor was taken at, so in reverse a page
+// holds the txns before the cursor. An empty cursor starts from the oldest txn,
+// or the newest in reverse. The next page starts at the cursor it returns, which
+// is empty once there are no more txns.
+//
+// A limit of zero fetches every txn in the given direction.
+func DbGetPaginatedTxindexTxnsForPublicKey(
+	handle *badger.DB, publicKey []byte, cursor string, limit int, reverse bool) (
+	_txIDs []*BlockHash, _nextCursor string, _err error) {
 
-	var txnFound *MsgBitCloutTxn
-	var txnMeta *TransactionMetadata
-	err := txindexDBHandle.View(func(dbTxn *badger.Txn) error {
-		txnMeta = DbGetTxindexTransactionRefByTxIDWithTxn(dbTxn, txID)
-		if txnMeta == nil {
-			return fmt.Errorf("DbGetTxindexFullTransactionByTxID: Transaction not found")
-		}
-		blockHashBytes, err := hex.DecodeString(txnMeta.BlockHashHex)
-		if err != nil {
-			return fmt.Errorf("DbGetTxindexFullTransactionByTxID: Error parsing block "+
-				"hash hex: %v %v", txnMeta.BlockHashHex, err)
-		}
-		blockHash := &BlockHash{}
-		copy(blockHash[:], blockHashBytes)
-		blockFound, err := GetBlock(blockHash, blockchainDBHandle)
-		if blockFound == nil || err != nil {
-			return fmt.Errorf("DbGetTxindexFullTransactionByTxID: Block corresponding to txn not found")
+	dbIter := NewDBIterator(handle, DbTxindexPublicKeyPrefix(publicKey), reverse, false /*fetchValues*/)
+	defer dbIter.Close()
+	if err := dbIter.Resume(cursor); err != nil {
+		return nil, "", errors.Wrapf(err, "DbGetPaginatedTxindexTxnsForPublicKey: ")
+	}
+
+	txIDs := []*BlockHash{}
+	for (limit == 0 || len(txIDs) < limit) && dbIter.Next() {
+		txID := _txIDForTxindexPublicKeyTxnKey(dbIter.Key())
+		if txID == nil {
+			glog.Errorf("DbGetPaginatedTxindexTxnsForPublicKey: Invalid key length %d", len(dbIter.Key()))
+			continue
 		}
+		txIDs = append(txIDs, txID)
+	}
+	if dbIter.Err() != nil {
+		return nil, "", errors.Wrapf(dbIter.Err(), "DbGetPaginatedTxindexTxnsForPublicKey: ")
+	}
+	nextCursor := ""
+	if limit != 0 && len(txIDs) == limit {
+		nextCursor = dbIter.Cursor()
+	}
+	return txIDs, nextCursor, nil
+}
 
-		txnFound = blockFound.Txns[txnMeta.TxnIndexInBlock]
-		return nil
+func DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(
+	dbTxn KVTxn, publicKey []byte, txID *BlockHash, txnMeta *TransactionMetadata) error {
+
+	key, err := _dbKeyForTxindexPublicKeyTxnMetaWithTxn(dbTxn, publicKey, txID, txnMeta)
+	if err != nil {
+		return err
+	}
+	return dbTxn.Set(key, []byte{})
+}
+
+func DbDeleteTxindexPublicKeyToTxnMappingSingleWithTxn(
+	dbTxn KVTxn, publicKey []byte, txID *BlockHash, txnMeta *TransactionMetadata) error {
+
+	key, err := _dbKeyForTxindexPublicKeyTxnMetaWithTxn(dbTxn, publicKey, txID, txnMeta)
+	if err != nil {
+		return err
+	}
+	return dbTxn.Delete(key)
+}
+
+// txindexPublicKeyIndexMigrationName marks whether the public key mappings of a
+// txindex built before they were keyed by the txn's position in the chain have
+// been moved over. Those mappings were numbered per public key, so removing one
+// meant renumbering all of the ones after it.
+const txindexPublicKeyIndexMigrationName = "txindex-public-key-index"
+
+// DbMigrateTxindexPublicKeyIndex moves the public key mappings from the old
+// numbered index to the current one and drops the old index. It's run against
+// the txindex db before the txindex starts, only does the work once, and returns
+// the number of mappings it moved. Mappings whose txn has no metadata are dropped.
+func DbMigrateTxindexPublicKeyIndex(handle *badger.DB) (_numMappings int, _err error) {
+	if DbGetIndexMigrationState(handle, txindexPublicKeyIndexMigrationName) ==
+		IndexMigrationStateFinalized {
+
+		return 0, nil
+	}
+
+	// <prefix, public key [33]byte, index uint32> -> <txid BlockHash>
+	numMappings := 0
+	numDropped := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		return EnumerateKeysForPrefixWithCallback(handle, _PrefixPublicKeyIndexToTransactionIDs, func(key []byte, val []byte) (bool, error) {
+			if len(key) != 1+btcec.PubKeyBytesLenCompressed+4 || len(val) != HashSizeBytes {
+				numDropped++
+				return true, nil
+			}
+			publicKey := append([]byte{}, key[1:1+btcec.PubKeyBytesLenCompressed]...)
+			txID := &BlockHash{}
+			copy(txID[:], val)
+			// Count the mapping once the write is in, since it can be run again.
+			moved := false
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				txnMeta := DbGetTxindexTransactionRefByTxIDWithTxn(txn, txID)
+				moved = txnMeta != nil
+				if txnMeta == nil {
+					return nil
+				}
+				return DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(txn, publicKey, txID, txnMeta)
+			}); err != nil {
+				return false, err
+			}
+			if moved {
+				numMappings++
+			} else {
+				numDropped++
+			}
+			return true, nil
+		})
 	})
 	if err != nil {
-		return nil, nil
+		return 0, errors.Wrapf(err, "DbMigrateTxindexPublicKeyIndex: Problem moving mappings")
+	}
+	if numDropped > 0 {
+		glog.Errorf("DbMigrateTxindexPublicKeyIndex: Dropped %d malformed mappings or "+
+			"mappings to txns without metadata", numDropped)
 	}
 
-	return txnFound, txnMeta
+	if err := handle.DropPrefix(_PrefixPublicKeyIndexToTransactionIDs, _PrefixPublicKeyToNextIndex); err != nil {
+		return 0, errors.Wrapf(err, "DbMigrateTxindexPublicKeyIndex: Problem dropping the old index")
+	}
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, txindexPublicKeyIndexMigrationName, IndexMigrationStateFinalized)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbMigrateTxindexPublicKeyIndex: Problem marking migration complete")
+	}
+
+	return numMappings, nil
 }
 
-// =======================================================================================
-// BitClout app code start
-// =======================================================================================
+func DbTxindexTxIDKey(txID *BlockHash) []byte {
+	return append(append([]byte{}, _PrefixTransactionIDToMetadata...), txID[:]...)
+}
 
-func _dbKeyForPostEntryHash(postHash *BlockHash) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixPostHashToPostEntry...)
-	key := append(prefixCopy, postHash[:]...)
-	return key
+type AffectedPublicKey struct {
+	PublicKeyBase58Check string
+	// Metadata about how this public key was affected by the transaction.
+	Metadata string
 }
-func _dbKeyForPublicKeyPostHash(publicKey []byte, postHash *BlockHash) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	key := append([]byte{}, _PrefixPosterPublicKeyPostHash...)
-	key = append(key, publicKey...)
-	key = append(key, postHash[:]...)
-	return key
+
+// TxindexUtxo is a utxo a txn spent or created.
+type TxindexUtxo struct {
+	TxIDHex              string
+	Index                uint32
+	PublicKeyBase58Check string
+	AmountNanos          uint64
+	UtxoType             string
 }
-func _dbKeyForPosterPublicKeyTimestampPostHash(publicKey []byte, timestampNanos uint64, postHash *BlockHash) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	key := append([]byte{}, _PrefixPosterPublicKeyTimestampPostHash...)
-	key = append(key, publicKey...)
-	key = append(key, EncodeUint64(timestampNanos)...)
-	key = append(key, postHash[:]...)
-	return key
+
+type BasicTransferTxindexMetadata struct {
+	TotalInputNanos  uint64
+	TotalOutputNanos uint64
+	FeeNanos         uint64
+	// The utxos the txn spent and the ones it created, including implicit
+	// outputs like those of a BitcoinExchange txn.
+	Inputs  []*TxindexUtxo
+	Outputs []*TxindexUtxo
 }
-func _dbKeyForTstampPostHash(tstampNanos uint64, postHash *BlockHash) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	key := append([]byte{}, _PrefixTstampNanosPostHash...)
-	key = append(key, EncodeUint64(tstampNanos)...)
-	key = append(key, postHash[:]...)
-	return key
+type BitcoinExchangeTxindexMetadata struct {
+	BitcoinSpendAddress string
+	// BitCloutOutputPubKeyBase58Check = TransactorPublicKeyBase58Check
+	SatoshisBurned uint64
+	// NanosCreated = 0 OR TotalOutputNanos+FeeNanos
+	NanosCreated uint64
+	// TotalNanosPurchasedBefore = TotalNanosPurchasedAfter - NanosCreated
+	TotalNanosPurchasedBefore uint64
+	TotalNanosPurchasedAfter  uint64
+	BitcoinTxnHash            string
 }
-func _dbKeyForCreatorBpsPostHash(creatorBps uint64, postHash *BlockHash) []byte {
-	key := append([]byte{}, _PrefixCreatorBpsPostHash...)
-	key = append(key, EncodeUint64(creatorBps)...)
-	key = append(key, postHash[:]...)
-	return key
+type CreatorCoinTxindexMetadata struct {
+	OperationType string
+	// TransactorPublicKeyBase58Check = TransactorPublicKeyBase58Check
+	// CreatorPublicKeyBase58Check in AffectedPublicKeys
+
+	// Differs depending on OperationType.
+	BitCloutToSellNanos    uint64
+	CreatorCoinToSellNanos uint64
+	BitCloutToAddNanos     uint64
 }
-func _dbKeyForStakeMultipleBpsPostHash(stakeMultipleBps uint64, postHash *BlockHash) []byte {
-	key := append([]byte{}, _PrefixMultipleBpsPostHash...)
-	key = append(key, EncodeUint64(stakeMultipleBps)...)
-	key = append(key, postHash[:]...)
-	return key
+
+type CreatorCoinTransferTxindexMetadata struct {
+	CreatorUsername            string
+	CreatorCoinToTransferNanos uint64
+	DiamondLevel               int64
+	PostHashHex                string
 }
-func _dbKeyForCommentParentStakeIDToPostHash(
-	stakeID []byte, tstampNanos uint64, postHash *BlockHash) []byte {
-	key := append([]byte{}, _PrefixCommentParentStakeIDToPostHash...)
-	key = append(key, stakeID[:]...)
-	key = append(key, EncodeUint64(tstampNanos)...)
-	key = append(key, postHash[:]...)
-	return key
+
+type UpdateProfileTxindexMetadata struct {
+	ProfilePublicKeyBase58Check string
+
+	NewUsername    string
+	NewDescription string
+	NewProfilePic  string
+
+	NewCreatorBasisPoints uint64
+
+	NewStakeMultipleBasisPoints uint64
+
+	IsHidden bool
 }
+type SubmitPostTxindexMetadata struct {
+	PostHashBeingModifiedHex string
+	// PosterPublicKeyBase58Check = TransactorPublicKeyBase58Check
 
-func DBGetPostEntryByPostHashWithTxn(
-	txn *badger.Txn, postHash *BlockHash) *PostEntry {
+	// If this is a reply to an existing post, then the ParentPostHashHex
+	ParentPostHashHex string
+	// ParentPosterPublicKeyBase58Check in AffectedPublicKeys
 
-	key := _dbKeyForPostEntryHash(postHash)
-	postEntryObj := &PostEntry{}
-	postEntryItem, err := txn.Get(key)
+	// The profiles that are mentioned are in the AffectedPublicKeys
+	// MentionedPublicKeyBase58Check in AffectedPublicKeys
+}
+type LikeTxindexMetadata struct {
+	// LikerPublicKeyBase58Check = TransactorPublicKeyBase58Check
+	IsUnlike bool
+
+	PostHashHex string
+	// PosterPublicKeyBase58Check in AffectedPublicKeys
+}
+type FollowTxindexMetadata struct {
+	// FollowerPublicKeyBase58Check = TransactorPublicKeyBase58Check
+	// FollowedPublicKeyBase58Check in AffectedPublicKeys
+
+	IsUnfollow bool
+}
+type PrivateMessageTxindexMetadata struct {
+	// SenderPublicKeyBase58Check = TransactorPublicKeyBase58Check
+	// RecipientPublicKeyBase58Check in AffectedPublicKeys
+
+	TimestampNanos uint64
+}
+type SwapIdentityTxindexMetadata struct {
+	// ParamUpdater = TransactorPublicKeyBase58Check
+
+	FromPublicKeyBase58Check string
+
+	ToPublicKeyBase58Check string
+}
+
+type TransactionMetadata struct {
+	BlockHashHex    string
+	TxnIndexInBlock uint64
+	TxnType         string
+	// The height of the block containing the txn. This is zero for txns in the
+	// genesis block and for metadata written before the field was added.
+	BlockHeight uint32
+	// All transactions have a public key who executed the transaction and some
+	// public keys that are affected by the transaction. Notifications are created
+	// for the affected public keys. _getPublicKeysForTxn uses this to set entries in the
+	// database.
+	TransactorPublicKeyBase58Check string
+	AffectedPublicKeys             []*AffectedPublicKey
+
+	// We store these outputs so we don't have to load the full transaction from disk
+	// when looking up output amounts
+	TxnOutputs []*BitCloutOutput
+
+	BasicTransferTxindexMetadata       *BasicTransferTxindexMetadata
+	BitcoinExchangeTxindexMetadata     *BitcoinExchangeTxindexMetadata
+	CreatorCoinTxindexMetadata         *CreatorCoinTxindexMetadata
+	CreatorCoinTransferTxindexMetadata *CreatorCoinTransferTxindexMetadata
+	UpdateProfileTxindexMetadata       *UpdateProfileTxindexMetadata
+	SubmitPostTxindexMetadata          *SubmitPostTxindexMetadata
+	LikeTxindexMetadata                *LikeTxindexMetadata
+	FollowTxindexMetadata              *FollowTxindexMetadata
+	PrivateMessageTxindexMetadata      *PrivateMessageTxindexMetadata
+	SwapIdentityTxindexMetadata        *SwapIdentityTxindexMetadata
+}
+
+func DbGetTxindexTransactionRefByTxIDWithTxn(txn KVTxn, txID *BlockHash) *TransactionMetadata {
+	key := DbTxindexTxIDKey(txID)
+	valObj := TransactionMetadata{}
+
+	valBytes, err := txn.Get(key)
 	if err != nil {
 		return nil
 	}
-	err = postEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(postEntryObj)
-	})
-	if err != nil {
-		glog.Errorf("DBGetPostEntryByPostHashWithTxn: Problem reading "+
-			"PostEntry for postHash %v", postHash)
+	if err := valObj.FromBytes(valBytes); err != nil {
 		return nil
 	}
-	return postEntryObj
+	return &valObj
 }
 
-func DBGetPostEntryByPostHash(db *badger.DB, postHash *BlockHash) *PostEntry {
-	var ret *PostEntry
-	db.View(func(txn *badger.Txn) error {
-		ret = DBGetPostEntryByPostHashWithTxn(txn, postHash)
+func DbGetTxindexTransactionRefByTxID(handle *badger.DB, txID *BlockHash) *TransactionMetadata {
+	var valObj *TransactionMetadata
+	DbView(handle, func(txn KVTxn) error {
+		valObj = DbGetTxindexTransactionRefByTxIDWithTxn(txn, txID)
 		return nil
 	})
-	return ret
+	return valObj
 }
+func DbPutTxindexTransactionWithTxn(
+	txn KVTxn, txID *BlockHash, txnMeta *TransactionMetadata) error {
 
-func _dbGetStakeIDPostDBKey(postHash *BlockHash, totalAmountStakedNanos uint64) []byte {
-	// <prefix, StakeIDType | AmountNanos uint64 | PostHash BlockHash> -> <>
-	key := append(_PrefixStakeIDTypeAmountStakeIDIndex, []byte{byte(StakeIDTypePost)}...)
-	key = append(key, EncodeUint64(totalAmountStakedNanos)...)
-	key = append(key, postHash[:]...)
-	return key
+	return txn.Set(DbTxindexTxIDKey(txID), txnMeta.ToBytes())
 }
 
-func HashToStakeID(hash *BlockHash) []byte {
-	stakeID := make([]byte, btcec.PubKeyBytesLenCompressed)
-	// We need to make the post hash into a uniform 33-byte thing so that
-	// it doesn't conflict with public key stake ids.
-	copy(stakeID, hash[:])
-	stakeID[btcec.PubKeyBytesLenCompressed-1] = 0x00
+func DbPutTxindexTransaction(
+	handle *badger.DB, txID *BlockHash, txnMeta *TransactionMetadata) error {
 
-	return stakeID
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutTxindexTransactionWithTxn(txn, txID, txnMeta)
+	})
 }
 
-func StakeIDToHash(stakeID []byte) *BlockHash {
-	hash := &BlockHash{}
-	copy(hash[:], stakeID[:HashSizeBytes])
-	return hash
+func _dbKeyForTxindexTxnBytes(txID *BlockHash) []byte {
+	return append(append([]byte{}, _PrefixTransactionIDToTxnBytes...), txID[:]...)
 }
 
-func DBDeletePostEntryMappingsWithTxn(
-	txn *badger.Txn, postHash *BlockHash, params *BitCloutParams) error {
+// DbPutTxindexTxnBytesWithTxn stores the txn's bytes in the txindex so
+// DbGetTxindexFullTransactionByTxID can load it without loading its block.
+func DbPutTxindexTxnBytesWithTxn(dbTxn KVTxn, txn *MsgBitCloutTxn) error {
+	txnBytes, err := txn.ToBytes(false /*preSignature*/)
+	if err != nil {
+		return errors.Wrapf(err, "DbPutTxindexTxnBytesWithTxn: Problem encoding txn: ")
+	}
+	return dbTxn.Set(_dbKeyForTxindexTxnBytes(txn.Hash()), txnBytes)
+}
 
-	// First pull up the mapping that texists for the post hash passed in.
-	// If one doesn't exist then there's nothing to do.
-	postEntry := DBGetPostEntryByPostHashWithTxn(txn, postHash)
-	if postEntry == nil {
-		return nil
+func _dbGetTxindexTxnBytesWithTxn(dbTxn KVTxn, txID *BlockHash) (*MsgBitCloutTxn, error) {
+	valBytes, err := dbTxn.Get(_dbKeyForTxindexTxnBytes(txID))
+	if err != nil {
+		return nil, err
+	}
+	txn := &MsgBitCloutTxn{}
+	if err := txn.FromBytes(valBytes); err != nil {
+		return nil, _corruptDbEntryError(err, "_dbGetTxindexTxnBytesWithTxn: Problem decoding txn %v", txID)
 	}
+	return txn, nil
+}
 
-	// When a post exists, delete the mapping for the post.
-	if err := txn.Delete(_dbKeyForPostEntryHash(postHash)); err != nil {
-		return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
-			"post mapping for post hash %v", postHash)
+func _getPublicKeysForTxn(
+	txn *MsgBitCloutTxn, txnMeta *TransactionMetadata, params *BitCloutParams) map[PkMapKey]bool {
+
+	// Collect the public keys in the transaction.
+	publicKeys := make(map[PkMapKey]bool)
+
+	// TODO: For AddStake transactions, we don't have a way of getting the implicit
+	// outputs. This means that if you get paid from someone else staking to a post
+	// after you, the output won't be explicitly included in the transaction, and so
+	// it won't be added to our index. We should fix this at some point. I think the
+	// "right way" to fix this problem is to index UTXOs rather than transactions (or
+	// in addition to them).
+	// TODO(updated): We can fix this by populating AffectedPublicKeys
+
+	// Add the TransactorPublicKey
+	{
+		res, _, err := Base58CheckDecode(txnMeta.TransactorPublicKeyBase58Check)
+		if err != nil {
+			glog.Errorf("_getPublicKeysForTxn: Error decoding "+
+				"TransactorPublicKeyBase58Check: %v %v",
+				txnMeta.TransactorPublicKeyBase58Check, err)
+		} else {
+			publicKeys[MakePkMapKey(res)] = true
+		}
 	}
 
-	// If the post is a comment we store it in a separate index. Comments are
-	// technically posts but they really should be treated as their own entity.
-	// The only reason they're not actually implemented that way is so that we
-	// get code re-use.
-	isComment := len(postEntry.ParentStakeID) == HashSizeBytes
-	if isComment {
-		// Extend the parent stake ID, which is a block hash, to 33 bytes, which
-		// is the length of a public key and the standard length we use for this
-		// key.
-		extendedStakeID := append([]byte{}, postEntry.ParentStakeID...)
-		extendedStakeID = append(extendedStakeID, 0x00)
-		parentStakeIDKey := _dbKeyForCommentParentStakeIDToPostHash(
-			extendedStakeID, postEntry.TimestampNanos, postEntry.PostHash)
-		if err := txn.Delete(parentStakeIDKey); err != nil {
+	// Add each AffectedPublicKey
+	for _, affectedPk := range txnMeta.AffectedPublicKeys {
+		res, _, err := Base58CheckDecode(affectedPk.PublicKeyBase58Check)
+		if err != nil {
+			glog.Errorf("_getPublicKeysForTxn: Error decoding AffectedPublicKey: %v %v %v",
+				affectedPk.PublicKeyBase58Check, affectedPk.Metadata, err)
+		} else {
+			publicKeys[MakePkMapKey(res)] = true
+		}
+	}
 
-			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Problem "+
-				"deleting mapping for comment: %v: %v", postEntry, err)
+	return publicKeys
+}
+
+func DbPutTxindexTransactionMappingsWithTxn(
+	dbTx KVTxn, txn *MsgBitCloutTxn, params *BitCloutParams, txnMeta *TransactionMetadata) error {
+
+	txID := txn.Hash()
+
+	if err := DbPutTxindexTransactionWithTxn(dbTx, txID, txnMeta); err != nil {
+		return fmt.Errorf("Problem adding txn to txindex transaction index: %v", err)
+	}
+	if err := _dbPutTxindexBlockPositionWithTxn(dbTx, txID, txnMeta); err != nil {
+		return fmt.Errorf("Problem adding txn to txindex block explorer indexes: %v", err)
+	}
+
+	// Get the public keys involved with this transaction.
+	publicKeys := _getPublicKeysForTxn(txn, txnMeta, params)
+
+	// For each public key found, add the txID from its list.
+	for pkFound := range publicKeys {
+		// Simply add a new entry for each of the public keys found.
+		if err := DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(dbTx, pkFound[:], txID, txnMeta); err != nil {
+			return err
 		}
-	} else {
-		if err := txn.Delete(_dbKeyForPosterPublicKeyTimestampPostHash(
-			postEntry.PosterPublicKey, postEntry.TimestampNanos, postEntry.PostHash)); err != nil {
+		if err := _dbRecordPublicKeyActivityWithTxn(dbTx, pkFound[:], txnMeta.BlockHeight); err != nil {
+			return fmt.Errorf("Problem updating activity for public key %v: %v",
+				PkToString(pkFound[:], params), err)
+		}
+	}
 
-			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
-				"public key mapping for post hash %v: %v", postHash, err)
+	// If we get here, it means everything went smoothly.
+	return nil
+}
+
+func DbPutTxindexTransactionMappings(
+	handle *badger.DB, bitcloutTxn *MsgBitCloutTxn, params *BitCloutParams, txnMeta *TransactionMetadata) error {
+
+	return DbUpdate(handle, func(dbTx KVTxn) error {
+		return DbPutTxindexTransactionMappingsWithTxn(
+			dbTx, bitcloutTxn, params, txnMeta)
+	})
+}
+
+func DbDeleteTxindexTransactionMappingsWithTxn(
+	dbTxn KVTxn, txn *MsgBitCloutTxn, params *BitCloutParams) error {
+
+	txID := txn.Hash()
+
+	// If the txnMeta isn't in the db then that's an error.
+	txnMeta := DbGetTxindexTransactionRefByTxIDWithTxn(dbTxn, txID)
+	if txnMeta == nil {
+		return fmt.Errorf("DbDeleteTxindexTransactionMappingsWithTxn: Missing txnMeta for txID %v", txID)
+	}
+
+	// Get the public keys involved with this transaction.
+	publicKeys := _getPublicKeysForTxn(txn, txnMeta, params)
+
+	// For each public key found, delete the txID mapping from the db.
+	for pkFound := range publicKeys {
+		if err := DbDeleteTxindexPublicKeyToTxnMappingSingleWithTxn(dbTxn, pkFound[:], txID, txnMeta); err != nil {
+			return err
 		}
-		if err := txn.Delete(_dbKeyForTstampPostHash(
-			postEntry.TimestampNanos, postEntry.PostHash)); err != nil {
+	}
 
-			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
-				"tstamp mapping for post hash %v: %v", postHash, err)
+	if err := _dbDeleteTxindexBlockPositionWithTxn(dbTxn, txID, txnMeta); err != nil {
+		return fmt.Errorf("Problem deleting txn from txindex block explorer indexes: %v", err)
+	}
+
+	// Delete the metadata
+	transactionIndexKey := DbTxindexTxIDKey(txID)
+	if err := dbTxn.Delete(transactionIndexKey); err != nil {
+		return fmt.Errorf("Problem deleting transaction index key: %v", err)
+	}
+	// The txn's bytes are only there if the txindex was storing them when it
+	// was added but deleting a missing key is a no-op.
+	if err := dbTxn.Delete(_dbKeyForTxindexTxnBytes(txID)); err != nil {
+		return fmt.Errorf("Problem deleting txn bytes: %v", err)
+	}
+
+	// Roll back the activity of each public key now that the txn is gone.
+	for pkFound := range publicKeys {
+		if err := _dbRecomputePublicKeyActivityWithTxn(dbTxn, pkFound[:]); err != nil {
+			return fmt.Errorf("Problem updating activity for public key %v: %v",
+				PkToString(pkFound[:], params), err)
 		}
-		if err := txn.Delete(_dbKeyForCreatorBpsPostHash(
-			postEntry.CreatorBasisPoints, postEntry.PostHash)); err != nil {
+	}
 
-			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
-				"creatorBps mapping for post hash %v: %v", postHash, err)
+	// If we get here, it means everything went smoothly.
+	return nil
+}
+
+func DbDeleteTxindexTransactionMappings(
+	handle *badger.DB, txn *MsgBitCloutTxn, params *BitCloutParams) error {
+
+	return DbUpdate(handle, func(dbTx KVTxn) error {
+		return DbDeleteTxindexTransactionMappingsWithTxn(dbTx, txn, params)
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// Public key activity functions
+// 		<prefix, public key [33]byte> -> <first seen height uint32, last active height uint32>
+//
+// Kept up to date by the txindex as it adds and removes transaction mappings so
+// the age of an account and how recently it was used can be read without
+// loading its transactions.
+// -------------------------------------------------------------------------------------
+
+type PublicKeyActivity struct {
+	PublicKey []byte
+
+	// The heights of the blocks containing the first and the most recent
+	// transactions involving the public key.
+	FirstSeenHeight  uint32
+	LastActiveHeight uint32
+}
+
+func _dbKeyForPublicKeyActivity(publicKey []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPublicKeyToActivity...)
+	return append(prefixCopy, publicKey...)
+}
+
+func _encodePublicKeyActivity(activity *PublicKeyActivity) []byte {
+	return append(_EncodeUint32(activity.FirstSeenHeight), _EncodeUint32(activity.LastActiveHeight)...)
+}
+
+func _decodePublicKeyActivity(publicKey []byte, valBytes []byte) (*PublicKeyActivity, error) {
+	if len(valBytes) != 8 {
+		return nil, errors.Wrapf(ErrEntryCorrupt, "_decodePublicKeyActivity: Value "+
+			"for %v has length %d != 8", PkToStringMainnet(publicKey), len(valBytes))
+	}
+	return &PublicKeyActivity{
+		PublicKey:        publicKey,
+		FirstSeenHeight:  DecodeUint32(valBytes[:4]),
+		LastActiveHeight: DecodeUint32(valBytes[4:]),
+	}, nil
+}
+
+// DbGetPublicKeyActivityWithTxn returns nil if the public key hasn't been
+// involved in any transactions.
+func DbGetPublicKeyActivityWithTxn(txn KVTxn, publicKey []byte) *PublicKeyActivity {
+	valBytes, err := txn.Get(_dbKeyForPublicKeyActivity(publicKey))
+	if err != nil {
+		return nil
+	}
+	activity, err := _decodePublicKeyActivity(publicKey, valBytes)
+	if err != nil {
+		glog.Errorf("DbGetPublicKeyActivityWithTxn: %v", err)
+		return nil
+	}
+	return activity
+}
+
+func DbGetPublicKeyActivity(handle *badger.DB, publicKey []byte) *PublicKeyActivity {
+	var activity *PublicKeyActivity
+	DbView(handle, func(txn KVTxn) error {
+		activity = DbGetPublicKeyActivityWithTxn(txn, publicKey)
+		return nil
+	})
+	return activity
+}
+
+func _dbPutPublicKeyActivityWithTxn(txn KVTxn, activity *PublicKeyActivity) error {
+	return txn.Set(_dbKeyForPublicKeyActivity(activity.PublicKey), _encodePublicKeyActivity(activity))
+}
+
+// _dbTxindexHeightForTxnMetaWithTxn returns the height of the block containing
+// the txn. Metadata written before BlockHeight was added falls back to the block
+// stored in the txindex db.
+func _dbTxindexHeightForTxnMetaWithTxn(txn KVTxn, txnMeta *TransactionMetadata) (uint32, error) {
+	if txnMeta.BlockHeight != 0 || txnMeta.BlockHashHex == GenesisBlockHashHex {
+		return txnMeta.BlockHeight, nil
+	}
+	blockHashBytes, err := hex.DecodeString(txnMeta.BlockHashHex)
+	if err != nil || len(blockHashBytes) != HashSizeBytes {
+		return 0, errors.Wrapf(ErrEntryCorrupt, "_dbTxindexHeightForTxnMetaWithTxn: "+
+			"Bad block hash hex %v", txnMeta.BlockHashHex)
+	}
+	blockHash := &BlockHash{}
+	copy(blockHash[:], blockHashBytes)
+	block := GetBlockWithTxn(txn, blockHash)
+	if block == nil {
+		return 0, errors.Wrapf(ErrEntryNotFound, "_dbTxindexHeightForTxnMetaWithTxn: "+
+			"Missing block %v", blockHash)
+	}
+	return uint32(block.Header.Height), nil
+}
+
+// _dbRecordPublicKeyActivityWithTxn notes that the public key was involved in a
+// txn at blockHeight.
+func _dbRecordPublicKeyActivityWithTxn(txn KVTxn, publicKey []byte, blockHeight uint32) error {
+	activity := DbGetPublicKeyActivityWithTxn(txn, publicKey)
+	if activity == nil {
+		activity = &PublicKeyActivity{
+			PublicKey:        publicKey,
+			FirstSeenHeight:  blockHeight,
+			LastActiveHeight: blockHeight,
 		}
-		if err := txn.Delete(_dbKeyForStakeMultipleBpsPostHash(
-			postEntry.StakeMultipleBasisPoints, postEntry.PostHash)); err != nil {
+	}
+	if blockHeight < activity.FirstSeenHeight {
+		activity.FirstSeenHeight = blockHeight
+	}
+	if blockHeight > activity.LastActiveHeight {
+		activity.LastActiveHeight = blockHeight
+	}
+	return _dbPutPublicKeyActivityWithTxn(txn, activity)
+}
 
-			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
-				"stakeMultiple mapping for post hash %v: %v", postHash, err)
+// _dbRecomputePublicKeyActivityWithTxn resets the last active height to the
+// height of the public key's most recent remaining txn after a txn is removed.
+// Txns are only removed from the tip so the first seen height can only change
+// when none remain.
+func _dbRecomputePublicKeyActivityWithTxn(txn KVTxn, publicKey []byte) error {
+	activity := DbGetPublicKeyActivityWithTxn(txn, publicKey)
+	if activity == nil {
+		return nil
+	}
+	txIDs := DbGetTxindexTxnsForPublicKeyWithTxn(txn, publicKey)
+	if len(txIDs) == 0 {
+		return txn.Delete(_dbKeyForPublicKeyActivity(publicKey))
+	}
+	lastTxnMeta := DbGetTxindexTransactionRefByTxIDWithTxn(txn, txIDs[len(txIDs)-1])
+	if lastTxnMeta == nil {
+		return errors.Wrapf(ErrEntryNotFound, "_dbRecomputePublicKeyActivityWithTxn: "+
+			"Missing metadata for txn %v", txIDs[len(txIDs)-1])
+	}
+	lastActiveHeight, err := _dbTxindexHeightForTxnMetaWithTxn(txn, lastTxnMeta)
+	if err != nil {
+		return errors.Wrapf(err, "_dbRecomputePublicKeyActivityWithTxn: ")
+	}
+	activity.LastActiveHeight = lastActiveHeight
+	if activity.FirstSeenHeight > lastActiveHeight {
+		activity.FirstSeenHeight = lastActiveHeight
+	}
+	return _dbPutPublicKeyActivityWithTxn(txn, activity)
+}
+
+// DbGetDormantPublicKeys returns up to limit public keys whose last transaction
+// was in a block below inactiveSinceHeight. A limit of zero returns all of them.
+// It scans every public key with activity so it's meant for analytics rather
+// than for serving requests.
+func DbGetDormantPublicKeys(handle *badger.DB, inactiveSinceHeight uint32, limit int) (
+	_dormant []*PublicKeyActivity, _err error) {
+
+	dormant := []*PublicKeyActivity{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixPublicKeyToActivity, func(key []byte, val []byte) (bool, error) {
+		publicKey := append([]byte{}, key[len(_PrefixPublicKeyToActivity):]...)
+		activity, err := _decodePublicKeyActivity(publicKey, val)
+		if err != nil {
+			return false, err
 		}
+		if activity.LastActiveHeight < inactiveSinceHeight {
+			dormant = append(dormant, activity)
+		}
+		return limit == 0 || len(dormant) < limit, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetDormantPublicKeys: ")
+	}
+	return dormant, nil
+}
 
-		// Delete the stats for the post.
-		stakeStats := GetStakeEntryStats(postEntry.StakeEntry, params)
-		if err := txn.Delete(_dbGetStakeIDPostDBKey(
-			postEntry.PostHash, stakeStats.TotalStakeNanos)); err != nil {
+// publicKeyActivityMigrationName marks whether the txns indexed before public
+// key activity was tracked have been accounted for.
+const publicKeyActivityMigrationName = "public-key-activity"
 
-			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
-				"StakeAmountNanos mapping for post hash %v", postHash)
+// DbBackfillPublicKeyActivity computes the activity of the public keys that
+// were indexed before it was tracked. It's run against the txindex db, only does
+// the work once, and returns the number of public keys it updated.
+func DbBackfillPublicKeyActivity(handle *badger.DB) (_numPublicKeys int, _err error) {
+	if DbGetIndexMigrationState(handle, publicKeyActivityMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	// The mappings for each public key are stored in the order their txns appear
+	// in the chain so the first and last ones are the oldest and newest txns.
+	type txnRange struct {
+		firstTxID *BlockHash
+		lastTxID  *BlockHash
+	}
+	publicKeys := [][]byte{}
+	txnRanges := make(map[PkMapKey]*txnRange)
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixPublicKeyHeightTxnIndexTxID, func(key []byte, val []byte) (bool, error) {
+		txID := _txIDForTxindexPublicKeyTxnKey(key)
+		if txID == nil {
+			return true, nil
+		}
+		publicKey := append([]byte{}, key[1:1+btcec.PubKeyBytesLenCompressed]...)
+		pkMapKey := MakePkMapKey(publicKey)
+		if existingRange, exists := txnRanges[pkMapKey]; exists {
+			existingRange.lastTxID = txID
+		} else {
+			publicKeys = append(publicKeys, publicKey)
+			txnRanges[pkMapKey] = &txnRange{firstTxID: txID, lastTxID: txID}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillPublicKeyActivity: Problem scanning txn mappings")
+	}
+
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, publicKeyIter := range publicKeys {
+			publicKey := publicKeyIter
+			pkRange := txnRanges[MakePkMapKey(publicKey)]
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				for _, txID := range []*BlockHash{pkRange.firstTxID, pkRange.lastTxID} {
+					txnMeta := DbGetTxindexTransactionRefByTxIDWithTxn(txn, txID)
+					if txnMeta == nil {
+						return errors.Wrapf(ErrEntryNotFound, "Missing metadata for txn %v", txID)
+					}
+					blockHeight, err := _dbTxindexHeightForTxnMetaWithTxn(txn, txnMeta)
+					if err != nil {
+						return err
+					}
+					if err := _dbRecordPublicKeyActivityWithTxn(txn, publicKey, blockHeight); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillPublicKeyActivity: Problem recording activity")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, publicKeyActivityMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillPublicKeyActivity: Problem marking backfill complete")
+	}
+
+	return len(publicKeys), nil
+}
+
+// -------------------------------------------------------------------------------------
+// Txindex block explorer functions
+// <prefix, block height uint32, txn index uint32> -> <txid BlockHash>
+// <prefix, txid BlockHash> -> <block height uint32>
+//
+// The seed txns aren't in a block so they aren't in either index.
+// -------------------------------------------------------------------------------------
+
+func _dbKeyForTxindexHeightTxnIndex(blockHeight uint32, txnIndexInBlock uint32) []byte {
+	key := append([]byte{}, _PrefixTxindexHeightTxnIndexToTxID...)
+	key = append(key, _EncodeUint32(blockHeight)...)
+	return append(key, _EncodeUint32(txnIndexInBlock)...)
+}
+
+func _dbKeyForTxindexTxIDToBlockHeight(txID *BlockHash) []byte {
+	return append(append([]byte{}, _PrefixTxindexTxIDToBlockHeight...), txID[:]...)
+}
+
+func _dbPutTxindexBlockPositionWithTxn(
+	dbTxn KVTxn, txID *BlockHash, txnMeta *TransactionMetadata) error {
+
+	if txnMeta.BlockHashHex == GenesisBlockHashHex {
+		return nil
+	}
+	blockHeight, err := _dbTxindexHeightForTxnMetaWithTxn(dbTxn, txnMeta)
+	if err != nil {
+		return err
+	}
+	if err := dbTxn.Set(_dbKeyForTxindexHeightTxnIndex(
+		blockHeight, uint32(txnMeta.TxnIndexInBlock)), txID[:]); err != nil {
+
+		return err
+	}
+	return dbTxn.Set(_dbKeyForTxindexTxIDToBlockHeight(txID), _EncodeUint32(blockHeight))
+}
+
+func _dbDeleteTxindexBlockPositionWithTxn(
+	dbTxn KVTxn, txID *BlockHash, txnMeta *TransactionMetadata) error {
+
+	blockHeight, exists, err := _dbGetTxindexTxnBlockHeightWithTxn(dbTxn, txID)
+	if err != nil || !exists {
+		return err
+	}
+	if err := dbTxn.Delete(_dbKeyForTxindexHeightTxnIndex(
+		blockHeight, uint32(txnMeta.TxnIndexInBlock))); err != nil {
+
+		return err
+	}
+	return dbTxn.Delete(_dbKeyForTxindexTxIDToBlockHeight(txID))
+}
+
+func _dbGetTxindexTxnBlockHeightWithTxn(dbTxn KVTxn, txID *BlockHash) (
+	_blockHeight uint32, _exists bool, _err error) {
+
+	valBytes, err := dbTxn.Get(_dbKeyForTxindexTxIDToBlockHeight(txID))
+	if err == ErrKVKeyNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(valBytes) != 4 {
+		return 0, false, _corruptDbEntryError(fmt.Errorf("value has length %d", len(valBytes)),
+			"_dbGetTxindexTxnBlockHeightWithTxn: Problem decoding height of txn %v", txID)
+	}
+	return DecodeUint32(valBytes), true, nil
+}
+
+// DbGetTxindexTxnBlockHeight returns the height of the block an indexed txn is
+// in, or false if the txn isn't indexed or is a seed txn.
+func DbGetTxindexTxnBlockHeight(handle *badger.DB, txID *BlockHash) (
+	_blockHeight uint32, _exists bool, _err error) {
+
+	var blockHeight uint32
+	var exists bool
+	err := DbView(handle, func(dbTxn KVTxn) error {
+		var err error
+		blockHeight, exists, err = _dbGetTxindexTxnBlockHeightWithTxn(dbTxn, txID)
+		return err
+	})
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "DbGetTxindexTxnBlockHeight: ")
+	}
+	return blockHeight, exists, nil
+}
+
+// DbGetTxindexTxIDsForBlockHeight returns the txids of the txns in the indexed
+// block at the height, in the order they appear in the block.
+func DbGetTxindexTxIDsForBlockHeight(handle *badger.DB, blockHeight uint32) ([]*BlockHash, error) {
+	prefix := append(append([]byte{}, _PrefixTxindexHeightTxnIndexToTxID...), _EncodeUint32(blockHeight)...)
+	txIDs := []*BlockHash{}
+	err := EnumerateKeysForPrefixWithCallback(handle, prefix, func(key []byte, val []byte) (bool, error) {
+		if len(val) != HashSizeBytes {
+			return false, _corruptDbEntryError(fmt.Errorf("value has length %d", len(val)),
+				"Problem decoding txid at %x", key)
+		}
+		txID := &BlockHash{}
+		copy(txID[:], val)
+		txIDs = append(txIDs, txID)
+		return true, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetTxindexTxIDsForBlockHeight: ")
+	}
+	return txIDs, nil
+}
+
+// txindexExplorerIndexMigrationName marks whether the txns indexed before the
+// block explorer indexes existed have been added to them.
+const txindexExplorerIndexMigrationName = "txindex-explorer-index"
+
+// DbBackfillTxindexExplorerIndexes adds the txns that were indexed before the
+// block explorer indexes existed to them. It's run against the txindex db, only
+// does the work once, and returns the number of txns it added.
+func DbBackfillTxindexExplorerIndexes(handle *badger.DB) (_numTxns int, _err error) {
+	if DbGetIndexMigrationState(handle, txindexExplorerIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	numTxns := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		return EnumerateKeysForPrefixWithCallback(handle, _PrefixTransactionIDToMetadata, func(key []byte, val []byte) (bool, error) {
+			if len(key) != len(_PrefixTransactionIDToMetadata)+HashSizeBytes {
+				return true, nil
+			}
+			txID := &BlockHash{}
+			copy(txID[:], key[len(_PrefixTransactionIDToMetadata):])
+			txnMeta := &TransactionMetadata{}
+			if err := txnMeta.FromBytes(val); err != nil {
+				return false, errors.Wrapf(err, "Problem decoding metadata of txn %v", txID)
+			}
+			if txnMeta.BlockHashHex == GenesisBlockHashHex {
+				return true, nil
+			}
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				return _dbPutTxindexBlockPositionWithTxn(txn, txID, txnMeta)
+			}); err != nil {
+				return false, err
+			}
+			numTxns++
+			return true, nil
+		})
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillTxindexExplorerIndexes: Problem indexing txns")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, txindexExplorerIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillTxindexExplorerIndexes: Problem marking backfill complete")
+	}
+
+	return numTxns, nil
+}
+
+// txindexUtxoOpsDumpMigrationName marks whether the txn metadata written while
+// BasicTransferTxindexMetadata had a UtxoOpsDump has been rewritten without it.
+const txindexUtxoOpsDumpMigrationName = "txindex-strip-utxo-ops-dump"
+
+// DbStripTxindexUtxoOpsDumps rewrites the txindex's txn metadata in the current
+// encoding, which drops the UtxoOpsDump of the txns indexed before it was
+// replaced by typed inputs and outputs. The dumps made up most of the size of
+// the txindex. It's only done once and returns the number of txns rewritten and
+// the number of bytes it saved.
+func DbStripTxindexUtxoOpsDumps(handle *badger.DB) (_numTxns int, _numBytesSaved int, _err error) {
+	if DbGetIndexMigrationState(handle, txindexUtxoOpsDumpMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, 0, nil
+	}
+
+	numTxns := 0
+	numBytesSaved := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		return EnumerateKeysForPrefixWithCallback(handle, _PrefixTransactionIDToMetadata, func(key []byte, val []byte) (bool, error) {
+			txnMeta := &TransactionMetadata{}
+			if err := txnMeta.FromBytes(val); err != nil {
+				return false, errors.Wrapf(err, "Problem decoding metadata for key %#v", key)
+			}
+			newVal := txnMeta.ToBytes()
+			if bytes.Equal(newVal, val) {
+				return true, nil
+			}
+			keyCopy := append([]byte{}, key...)
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				return txn.Set(keyCopy, newVal)
+			}); err != nil {
+				return false, err
+			}
+			numTxns++
+			numBytesSaved += len(val) - len(newVal)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "DbStripTxindexUtxoOpsDumps: Problem rewriting txn metadata")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, txindexUtxoOpsDumpMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "DbStripTxindexUtxoOpsDumps: Problem marking migration complete")
+	}
+
+	return numTxns, numBytesSaved, nil
+}
+
+// DbGetTxindexFullTransactionByTxID looks the txn up by its bytes in the txindex
+// when the txindex stored them, then in the deduped blocks, and only then loads
+// its whole block. Set TxindexTxnBytes in the node config to store the bytes.
+func DbGetTxindexFullTransactionByTxID(
+	txindexDBHandle *badger.DB, blockchainDBHandle *badger.DB, txID *BlockHash) (
+	_txn *MsgBitCloutTxn, _txnMeta *TransactionMetadata) {
+
+	var txnFound *MsgBitCloutTxn
+	var txnMeta *TransactionMetadata
+	err := DbView(txindexDBHandle, func(dbTxn KVTxn) error {
+		txnMeta = DbGetTxindexTransactionRefByTxIDWithTxn(dbTxn, txID)
+		if txnMeta == nil {
+			return fmt.Errorf("DbGetTxindexFullTransactionByTxID: Transaction not found")
+		}
+		var err error
+		txnFound, err = _dbGetTxindexTxnBytesWithTxn(dbTxn, txID)
+		if err == nil {
+			return nil
+		}
+		if err != ErrKVKeyNotFound {
+			glog.Errorf("DbGetTxindexFullTransactionByTxID: Problem fetching txn bytes "+
+				"for %v, loading it from its block: %v", txID, err)
+		}
+		blockHashBytes, err := hex.DecodeString(txnMeta.BlockHashHex)
+		if err != nil {
+			return fmt.Errorf("DbGetTxindexFullTransactionByTxID: Error parsing block "+
+				"hash hex: %v %v", txnMeta.BlockHashHex, err)
+		}
+		// Deduped blocks store their txns individually so there's no need to
+		// load the whole block.
+		if txnFound = DbGetBlockTxn(blockchainDBHandle, txID); txnFound != nil {
+			return nil
+		}
+		blockHash := &BlockHash{}
+		copy(blockHash[:], blockHashBytes)
+		blockFound, err := GetBlock(blockHash, blockchainDBHandle)
+		if blockFound == nil || err != nil {
+			return fmt.Errorf("DbGetTxindexFullTransactionByTxID: Block corresponding to txn not found")
+		}
+
+		txnFound = blockFound.Txns[txnMeta.TxnIndexInBlock]
+		return nil
+	})
+	if err != nil {
+		return nil, nil
+	}
+
+	return txnFound, txnMeta
+}
+
+type BlockSummaryTxn struct {
+	TxnHash *BlockHash
+	Txn     *MsgBitCloutTxn
+	// Nil if there is no txindex or the txindex hasn't processed the block yet.
+	TxnMeta *TransactionMetadata
+
+	FeeNanos              uint64
+	NumAffectedPublicKeys int
+}
+
+type BlockSummary struct {
+	BlockHash *BlockHash
+	Header    *MsgBitCloutHeader
+	Txns      []*BlockSummaryTxn
+
+	TotalFeeNanos uint64
+	// The number of distinct public keys affected by any txn in the block.
+	NumAffectedPublicKeys int
+}
+
+// GetBlockSummary returns a block along with the txindex metadata for each of its
+// txns. All reads happen within a single txn on each db so the summary is
+// consistent even if blocks are being connected concurrently. txindexDBHandle may
+// be nil, in which case TxnMeta is not set.
+//
+// A txn's fee comes from the txindex when it's available. Otherwise it's computed
+// from the block's utxo operations, which counts burned nanos as fees, and it's
+// zero if the utxo operations aren't available either, e.g. because the block
+// isn't on the main chain.
+func GetBlockSummary(blockchainDBHandle *badger.DB, txindexDBHandle *badger.DB,
+	blockHash *BlockHash) (*BlockSummary, error) {
+
+	var summary *BlockSummary
+	err := DbView(blockchainDBHandle, func(chainTxn KVTxn) error {
+		block := GetBlockWithTxn(chainTxn, blockHash)
+		if block == nil {
+			return fmt.Errorf("GetBlockSummary: Block %v not found", blockHash)
+		}
+		utxoOpsForBlock, err := GetUtxoOperationsForBlockWithTxn(chainTxn, blockHash)
+		if err != nil || len(utxoOpsForBlock) != len(block.Txns) {
+			utxoOpsForBlock = nil
+		}
+
+		summary = &BlockSummary{
+			BlockHash: blockHash,
+			Header:    block.Header,
+		}
+		for txnIndex, bitcloutTxn := range block.Txns {
+			summaryTxn := &BlockSummaryTxn{
+				TxnHash: bitcloutTxn.Hash(),
+				Txn:     bitcloutTxn,
+			}
+			if utxoOpsForBlock != nil {
+				summaryTxn.FeeNanos = _txnFeeFromUtxoOps(bitcloutTxn, utxoOpsForBlock[txnIndex])
+			}
+			summary.Txns = append(summary.Txns, summaryTxn)
+		}
+
+		if txindexDBHandle == nil {
+			return nil
+		}
+		return DbView(txindexDBHandle, func(txindexTxn KVTxn) error {
+			for _, summaryTxn := range summary.Txns {
+				summaryTxn.TxnMeta = DbGetTxindexTransactionRefByTxIDWithTxn(txindexTxn, summaryTxn.TxnHash)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	affectedPublicKeys := make(map[string]bool)
+	for _, summaryTxn := range summary.Txns {
+		if summaryTxn.TxnMeta != nil {
+			if summaryTxn.TxnMeta.BasicTransferTxindexMetadata != nil {
+				summaryTxn.FeeNanos = summaryTxn.TxnMeta.BasicTransferTxindexMetadata.FeeNanos
+			}
+			txnAffectedPublicKeys := make(map[string]bool)
+			for _, affectedPublicKey := range summaryTxn.TxnMeta.AffectedPublicKeys {
+				txnAffectedPublicKeys[affectedPublicKey.PublicKeyBase58Check] = true
+				affectedPublicKeys[affectedPublicKey.PublicKeyBase58Check] = true
+			}
+			summaryTxn.NumAffectedPublicKeys = len(txnAffectedPublicKeys)
+		}
+		summary.TotalFeeNanos += summaryTxn.FeeNanos
+	}
+	summary.NumAffectedPublicKeys = len(affectedPublicKeys)
+
+	return summary, nil
+}
+
+// BlockConservationReport breaks down the nanos moved by a connected block.
+type BlockConservationReport struct {
+	// Nanos in the utxos spent by the block.
+	TotalInputNanos uint64
+	// Nanos in all the utxos created by the block, including implicit ones.
+	TotalOutputNanos uint64
+
+	// Nanos created out of thin air by the block reward and BitcoinExchange txns.
+	BlockRewardNanos     uint64
+	BitcoinMintedNanos   uint64
+	CreatorCoinSaleNanos uint64
+
+	// An upper bound on the fees paid by the block's txns. It's only an upper
+	// bound because some burns, like the create profile fee, can't be told apart
+	// from fees using the stored operations alone.
+	MaxTotalFeeNanos uint64
+}
+
+// VerifyBlockConservation recomputes where the nanos in a connected block came
+// from and went to using its stored utxo operations. It checks that each txn
+// spent exactly the utxos named by its inputs and created its explicit outputs,
+// that no txn creates more nanos than it consumes other than the ones that mint
+// or unlock nanos (block reward, BitcoinExchange, and creator coin sells), and
+// that the block reward doesn't exceed the base reward plus the fees.
+//
+// The block must be on the main chain since otherwise its utxo operations aren't
+// stored.
+func VerifyBlockConservation(handle *badger.DB, params *BitCloutParams, blockHash *BlockHash) (
+	*BlockConservationReport, error) {
+
+	var block *MsgBitCloutBlock
+	var utxoOpsForBlock [][]*UtxoOperation
+	err := DbView(handle, func(txn KVTxn) error {
+		block = GetBlockWithTxn(txn, blockHash)
+		if block == nil {
+			return fmt.Errorf("Block not found")
+		}
+		var err error
+		utxoOpsForBlock, err = GetUtxoOperationsForBlockWithTxn(txn, blockHash)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "VerifyBlockConservation: Problem fetching block %v", blockHash)
+	}
+	if len(utxoOpsForBlock) != len(block.Txns) {
+		return nil, fmt.Errorf("VerifyBlockConservation: Block %v has %d txns but %d "+
+			"sets of utxo operations", blockHash, len(block.Txns), len(utxoOpsForBlock))
+	}
+
+	report := &BlockConservationReport{}
+	var blockRewardOutputNanos uint64
+	for txnIndex, bitcloutTxn := range block.Txns {
+		txnType := bitcloutTxn.TxnMeta.GetTxnType()
+
+		// Tally the utxos this txn spent and created.
+		spentKeys := []UtxoKey{}
+		var spentNanos, regularOutputNanos, founderRewardNanos, bitcoinBurnNanos uint64
+		for _, utxoOp := range utxoOpsForBlock[txnIndex] {
+			if utxoOp.Entry == nil {
+				continue
+			}
+			switch utxoOp.Type {
+			case OperationTypeSpendUtxo:
+				if utxoOp.Key != nil {
+					spentKeys = append(spentKeys, *utxoOp.Key)
+				}
+				spentNanos += utxoOp.Entry.AmountNanos
+			case OperationTypeAddUtxo:
+				report.TotalOutputNanos += utxoOp.Entry.AmountNanos
+				switch utxoOp.Entry.UtxoType {
+				case UtxoTypeOutput:
+					regularOutputNanos += utxoOp.Entry.AmountNanos
+				case UtxoTypeBlockReward:
+					blockRewardOutputNanos += utxoOp.Entry.AmountNanos
+				case UtxoTypeBitcoinBurn:
+					bitcoinBurnNanos += utxoOp.Entry.AmountNanos
+				case UtxoTypeCreatorCoinSale:
+					report.CreatorCoinSaleNanos += utxoOp.Entry.AmountNanos
+				case UtxoTypeCreatorCoinFounderReward:
+					founderRewardNanos += utxoOp.Entry.AmountNanos
+				}
+			}
+		}
+		report.TotalInputNanos += spentNanos
+		report.BitcoinMintedNanos += bitcoinBurnNanos
+
+		if len(spentKeys) != len(bitcloutTxn.TxInputs) {
+			return nil, fmt.Errorf("VerifyBlockConservation: Txn %d spent %d utxos "+
+				"but has %d inputs", txnIndex, len(spentKeys), len(bitcloutTxn.TxInputs))
+		}
+		for inputIndex, txInput := range bitcloutTxn.TxInputs {
+			if spentKeys[inputIndex] != UtxoKey(*txInput) {
+				return nil, fmt.Errorf("VerifyBlockConservation: Txn %d input %d "+
+					"spent utxo %v instead of %v", txnIndex, inputIndex,
+					spentKeys[inputIndex], txInput)
+			}
+		}
+
+		var explicitOutputNanos uint64
+		for _, txOutput := range bitcloutTxn.TxOutputs {
+			explicitOutputNanos += txOutput.AmountNanos
+		}
+
+		switch txnType {
+		case TxnTypeBlockReward:
+			if txnIndex != 0 || len(bitcloutTxn.TxInputs) != 0 {
+				return nil, fmt.Errorf("VerifyBlockConservation: Block reward txn %d "+
+					"must be first and have no inputs", txnIndex)
+			}
+			continue
+
+		case TxnTypeBitcoinExchange:
+			// The fee is a fixed fraction of the nanos created and the user gets
+			// the rest, so it's bounded by the user's share.
+			feeBps := params.BitcoinExchangeFeeBasisPoints
+			if feeBps < 10000 {
+				report.MaxTotalFeeNanos += IntDiv(
+					big.NewInt(0).Mul(big.NewInt(int64(bitcoinBurnNanos)), big.NewInt(int64(feeBps))),
+					big.NewInt(int64(10000-feeBps))).Uint64() + 1
+			}
+			continue
+		}
+
+		if regularOutputNanos < explicitOutputNanos {
+			return nil, fmt.Errorf("VerifyBlockConservation: Txn %d created %d nanos of "+
+				"outputs but its explicit outputs total %d", txnIndex, regularOutputNanos,
+				explicitOutputNanos)
+		}
+
+		// Nanos that leave the txn without becoming a regular output.
+		consumedNanos := regularOutputNanos
+		if txnType == TxnTypeCreatorCoin {
+			txMeta := bitcloutTxn.TxnMeta.(*CreatorCoinMetadataa)
+			if txMeta.OperationType == CreatorCoinOperationTypeBuy {
+				if founderRewardNanos > txMeta.BitCloutToSellNanos {
+					return nil, fmt.Errorf("VerifyBlockConservation: Txn %d paid a "+
+						"founder reward of %d out of %d nanos sold", txnIndex,
+						founderRewardNanos, txMeta.BitCloutToSellNanos)
+				}
+				consumedNanos += txMeta.BitCloutToSellNanos
+			}
+		}
+		if spentNanos < consumedNanos {
+			return nil, fmt.Errorf("VerifyBlockConservation: Txn %d spent %d nanos "+
+				"but consumed %d", txnIndex, spentNanos, consumedNanos)
+		}
+		report.MaxTotalFeeNanos += spentNanos - consumedNanos
+	}
+
+	report.BlockRewardNanos = blockRewardOutputNanos
+	maxBlockReward := CalcBlockRewardNanos(uint32(block.Header.Height)) + report.MaxTotalFeeNanos
+	if blockRewardOutputNanos > maxBlockReward {
+		return nil, fmt.Errorf("VerifyBlockConservation: Block reward %d exceeds "+
+			"max %d", blockRewardOutputNanos, maxBlockReward)
+	}
+
+	return report, nil
+}
+
+// =======================================================================================
+// BitClout app code start
+// =======================================================================================
+
+func _dbKeyForPostEntryHash(postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPostHashToPostEntry...)
+	key := append(prefixCopy, postHash[:]...)
+	return key
+}
+func _dbKeyForPublicKeyPostHash(publicKey []byte, postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixPosterPublicKeyPostHash...)
+	key = append(key, publicKey...)
+	key = append(key, postHash[:]...)
+	return key
+}
+func _dbKeyForPosterPublicKeyTimestampPostHash(publicKey []byte, timestampNanos uint64, postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixPosterPublicKeyTimestampPostHash...)
+	key = append(key, publicKey...)
+	key = append(key, EncodeUint64(timestampNanos)...)
+	key = append(key, postHash[:]...)
+	return key
+}
+func _dbKeyForTstampPostHash(tstampNanos uint64, postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixTstampNanosPostHash...)
+	key = append(key, EncodeUint64(tstampNanos)...)
+	key = append(key, postHash[:]...)
+	return key
+}
+func _dbKeyForCreatorBpsPostHash(creatorBps uint64, postHash *BlockHash) []byte {
+	key := append([]byte{}, _PrefixCreatorBpsPostHash...)
+	key = append(key, EncodeUint64(creatorBps)...)
+	key = append(key, postHash[:]...)
+	return key
+}
+func _dbKeyForStakeMultipleBpsPostHash(stakeMultipleBps uint64, postHash *BlockHash) []byte {
+	key := append([]byte{}, _PrefixMultipleBpsPostHash...)
+	key = append(key, EncodeUint64(stakeMultipleBps)...)
+	key = append(key, postHash[:]...)
+	return key
+}
+func _dbKeyForCommentParentStakeIDToPostHash(
+	stakeID []byte, tstampNanos uint64, postHash *BlockHash) []byte {
+	key := append([]byte{}, _PrefixCommentParentStakeIDToPostHash...)
+	key = append(key, stakeID[:]...)
+	key = append(key, EncodeUint64(tstampNanos)...)
+	key = append(key, postHash[:]...)
+	return key
+}
+func _dbKeyForQuoteReclout(recloutedPostHash *BlockHash, tstampNanos uint64, quotingPostHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixRecloutedPostHashTstampQuotingPostHash...)
+	key = append(key, recloutedPostHash[:]...)
+	key = append(key, EncodeUint64(tstampNanos)...)
+	key = append(key, quotingPostHash[:]...)
+	return key
+}
+
+// _isQuoteReclout returns true if the post quotes another post, as opposed to
+// being a vanilla reclout or not a reclout at all.
+func _isQuoteReclout(postEntry *PostEntry) bool {
+	return postEntry.IsQuotedReclout && postEntry.RecloutedPostHash != nil
+}
+
+func DBGetPostEntryByPostHashWithTxn(
+	txn KVTxn, postHash *BlockHash) *PostEntry {
+
+	key := _dbKeyForPostEntryHash(postHash)
+	postEntryObj := &PostEntry{}
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	err = _DbDecodePostEntry(valBytes, postEntryObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DBGetPostEntryByPostHashWithTxn: Problem reading "+
+			"PostEntry for postHash %v", postHash)
+		return nil
+	}
+	return postEntryObj
+}
+
+func DBGetPostEntryByPostHash(db *badger.DB, postHash *BlockHash) *PostEntry {
+	cacheKey := string(_dbKeyForPostEntryHash(postHash))
+	cachedEntry, generation, found := postEntryCache.get(db, cacheKey)
+	if found {
+		if postEntry := _postEntryFromCache(cachedEntry); postEntry != nil {
+			return postEntry
+		}
+	}
+
+	var ret *PostEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DBGetPostEntryByPostHashWithTxn(txn, postHash)
+		return nil
+	})
+	if ret != nil {
+		postEntryCache.add(db, cacheKey, _DbBufForPostEntry(ret), generation)
+	}
+	return ret
+}
+
+// _postEntryFromCache decodes a PostEntry cached by DBGetPostEntryByPostHash.
+// Posts are cached encoded and decoded fresh for every caller so that none of
+// them share the slices, maps, and pointers in the entry. It returns nil if the
+// entry can't be decoded, in which case the caller reads it from the db.
+func _postEntryFromCache(cachedEntry interface{}) *PostEntry {
+	postEntry := &PostEntry{}
+	if err := _DbDecodePostEntry(cachedEntry.([]byte), postEntry); err != nil {
+		glog.Errorf("_postEntryFromCache: Problem decoding cached PostEntry: %v", err)
+		return nil
+	}
+	return postEntry
+}
+
+// DBGetPostEntriesByPostHashesWithTxn returns the PostEntry for each of the post
+// hashes, in the same order, with nil for any that aren't in the db.
+func DBGetPostEntriesByPostHashesWithTxn(
+	txn KVTxn, postHashes []*BlockHash) []*PostEntry {
+
+	postEntries := make([]*PostEntry, len(postHashes))
+	for ii, postHash := range postHashes {
+		postEntries[ii] = DBGetPostEntryByPostHashWithTxn(txn, postHash)
+	}
+	return postEntries
+}
+
+// DBGetPostEntriesByPostHashes is like DBGetPostEntryByPostHash for many post
+// hashes at once. Everything that isn't cached is read in a single txn.
+func DBGetPostEntriesByPostHashes(db *badger.DB, postHashes []*BlockHash) []*PostEntry {
+	postEntries := make([]*PostEntry, len(postHashes))
+	uncachedIndexes := []int{}
+	uncachedPostHashes := []*BlockHash{}
+	generations := []uint64{}
+	for ii, postHash := range postHashes {
+		cachedEntry, generation, found := postEntryCache.get(
+			db, string(_dbKeyForPostEntryHash(postHash)))
+		if found {
+			if postEntries[ii] = _postEntryFromCache(cachedEntry); postEntries[ii] != nil {
+				continue
+			}
+		}
+		uncachedIndexes = append(uncachedIndexes, ii)
+		uncachedPostHashes = append(uncachedPostHashes, postHash)
+		generations = append(generations, generation)
+	}
+	if len(uncachedPostHashes) == 0 {
+		return postEntries
+	}
+
+	var uncachedEntries []*PostEntry
+	DbView(db, func(txn KVTxn) error {
+		uncachedEntries = DBGetPostEntriesByPostHashesWithTxn(txn, uncachedPostHashes)
+		return nil
+	})
+	for jj, postEntry := range uncachedEntries {
+		postEntries[uncachedIndexes[jj]] = postEntry
+		if postEntry != nil {
+			postEntryCache.add(db, string(_dbKeyForPostEntryHash(uncachedPostHashes[jj])),
+				_DbBufForPostEntry(postEntry), generations[jj])
+		}
+	}
+	return postEntries
+}
+
+func _dbGetStakeIDPostDBKey(postHash *BlockHash, totalAmountStakedNanos uint64) []byte {
+	// <prefix, StakeIDType | AmountNanos uint64 | PostHash BlockHash> -> <>
+	key := append(_PrefixStakeIDTypeAmountStakeIDIndex, []byte{byte(StakeIDTypePost)}...)
+	key = append(key, EncodeUint64(totalAmountStakedNanos)...)
+	key = append(key, postHash[:]...)
+	return key
+}
+
+func HashToStakeID(hash *BlockHash) []byte {
+	stakeID := make([]byte, btcec.PubKeyBytesLenCompressed)
+	// We need to make the post hash into a uniform 33-byte thing so that
+	// it doesn't conflict with public key stake ids.
+	copy(stakeID, hash[:])
+	stakeID[btcec.PubKeyBytesLenCompressed-1] = 0x00
+
+	return stakeID
+}
+
+func StakeIDToHash(stakeID []byte) *BlockHash {
+	hash := &BlockHash{}
+	copy(hash[:], stakeID[:HashSizeBytes])
+	return hash
+}
+
+func DBDeletePostEntryMappingsWithTxn(
+	txn KVTxn, postHash *BlockHash, params *BitCloutParams) error {
+
+	postEntryCache.invalidate(_dbKeyForPostEntryHash(postHash))
+
+	// First pull up the mapping that texists for the post hash passed in.
+	// If one doesn't exist then there's nothing to do.
+	postEntry := DBGetPostEntryByPostHashWithTxn(txn, postHash)
+	if postEntry == nil {
+		return nil
+	}
+
+	// When a post exists, delete the mapping for the post.
+	if err := txn.Delete(_dbKeyForPostEntryHash(postHash)); err != nil {
+		return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+			"post mapping for post hash %v", postHash)
+	}
+
+	// If the post is a comment we store it in a separate index. Comments are
+	// technically posts but they really should be treated as their own entity.
+	// The only reason they're not actually implemented that way is so that we
+	// get code re-use.
+	isComment := len(postEntry.ParentStakeID) == HashSizeBytes
+	if isComment {
+		// Extend the parent stake ID, which is a block hash, to 33 bytes, which
+		// is the length of a public key and the standard length we use for this
+		// key.
+		extendedStakeID := append([]byte{}, postEntry.ParentStakeID...)
+		extendedStakeID = append(extendedStakeID, 0x00)
+		parentStakeIDKey := _dbKeyForCommentParentStakeIDToPostHash(
+			extendedStakeID, postEntry.TimestampNanos, postEntry.PostHash)
+		if _, err := txn.Get(parentStakeIDKey); err == nil {
+			parentPostHash := StakeIDToHash(postEntry.ParentStakeID)
+			if err := _dbAdjustPostEngagementCountsWithTxn(txn, *parentPostHash, 0, -1, 0); err != nil {
+				return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: ")
+			}
+		}
+		if err := txn.Delete(parentStakeIDKey); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Problem "+
+				"deleting mapping for comment: %v: %v", postEntry, err)
+		}
+	} else {
+		if err := _dbDeleteTimestampIndexEntryWithTxn(txn, _dbKeyForPosterPublicKeyTimestampPostHash(
+			postEntry.PosterPublicKey, postEntry.TimestampNanos, postEntry.PostHash)); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+				"public key mapping for post hash %v: %v", postHash, err)
+		}
+		if err := _dbDeleteTimestampIndexEntryWithTxn(txn, _dbKeyForTstampPostHash(
+			postEntry.TimestampNanos, postEntry.PostHash)); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+				"tstamp mapping for post hash %v: %v", postHash, err)
+		}
+		if err := txn.Delete(_dbKeyForCreatorBpsPostHash(
+			postEntry.CreatorBasisPoints, postEntry.PostHash)); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+				"creatorBps mapping for post hash %v: %v", postHash, err)
+		}
+		if err := txn.Delete(_dbKeyForStakeMultipleBpsPostHash(
+			postEntry.StakeMultipleBasisPoints, postEntry.PostHash)); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+				"stakeMultiple mapping for post hash %v: %v", postHash, err)
+		}
+
+		// Delete the stats for the post.
+		stakeStats := GetStakeEntryStats(postEntry.StakeEntry, params)
+		if err := txn.Delete(_dbGetStakeIDPostDBKey(
+			postEntry.PostHash, stakeStats.TotalStakeNanos)); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+				"StakeAmountNanos mapping for post hash %v", postHash)
+		}
+
+		// Delete the reclout entries for the post.
+		if IsVanillaReclout(postEntry) {
+			if DbGetReclouterPubKeyRecloutedPostHashToRecloutEntryWithTxn(
+				txn, postEntry.PosterPublicKey, *postEntry.RecloutedPostHash) != nil {
+
+				if err := _dbAdjustPostEngagementCountsWithTxn(txn, *postEntry.RecloutedPostHash, 0, 0, -1); err != nil {
+					return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: ")
+				}
+			}
+			if err := _dbDeleteRecloutMappingsWithTxn(
+				txn, postEntry.PosterPublicKey, *postEntry.RecloutedPostHash); err != nil {
+				return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Error problem deleting mapping for recloutPostHash to ReclouterPubKey: %v", err)
+			}
+		}
+	}
+	// Comments can quote posts too.
+	if _isQuoteReclout(postEntry) {
+		if err := txn.Delete(_dbKeyForQuoteReclout(
+			postEntry.RecloutedPostHash, postEntry.TimestampNanos, postEntry.PostHash)); err != nil {
+
+			return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Deleting "+
+				"quote reclout mapping for post hash %v", postHash)
+		}
+	}
+
+	return nil
+}
+
+func DBDeletePostEntryMappings(
+	handle *badger.DB, postHash *BlockHash, params *BitCloutParams) error {
+
+	defer DbCacheFinishWrites()
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DBDeletePostEntryMappingsWithTxn(txn, postHash, params)
+	})
+}
+
+// DBPutPostEntryMappingsWithTxn quarantines a post with a timestamp past
+// maxIndexedTstampNanos out of the time-ordered indexes. See
+// DbGetMaxIndexedTstampNanosWithTxn.
+func DBPutPostEntryMappingsWithTxn(txn KVTxn, postEntry *PostEntry,
+	params *BitCloutParams, maxIndexedTstampNanos uint64) error {
+
+	postDataBytes := _DbBufForPostEntry(postEntry)
+
+	postEntryCache.invalidate(_dbKeyForPostEntryHash(postEntry.PostHash))
+	if err := txn.Set(_dbKeyForPostEntryHash(
+		postEntry.PostHash), postDataBytes); err != nil {
+
+		return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+			"adding mapping for post: %v", postEntry.PostHash)
+	}
+
+	// If the post is a comment we store it in a separate index. Comments are
+	// technically posts but they really should be treated as their own entity.
+	// The only reason they're not actually implemented that way is so that we
+	// get code re-use.
+	isComment := len(postEntry.ParentStakeID) != 0
+	if isComment {
+		// Extend the parent stake ID, which is a block hash, to 33 bytes, which
+		// is the length of a public key and the standard length we use for this
+		// key.
+		extendedStakeID := append([]byte{}, postEntry.ParentStakeID...)
+		if len(extendedStakeID) == HashSizeBytes {
+			extendedStakeID = append(extendedStakeID, 0x00)
+		}
+		if len(extendedStakeID) != btcec.PubKeyBytesLenCompressed {
+			return fmt.Errorf("DbPutPostEntryMappingsWithTxn: extended "+
+				"ParentStakeID %#v must have length %v",
+				extendedStakeID, btcec.PubKeyBytesLenCompressed)
+		}
+		parentStakeIDKey := _dbKeyForCommentParentStakeIDToPostHash(
+			extendedStakeID, postEntry.TimestampNanos, postEntry.PostHash)
+		// Only comments on posts are counted and only if they're new.
+		if _, err := txn.Get(parentStakeIDKey); err == ErrKVKeyNotFound &&
+			len(postEntry.ParentStakeID) == HashSizeBytes {
+
+			parentPostHash := StakeIDToHash(postEntry.ParentStakeID)
+			if err := _dbAdjustPostEngagementCountsWithTxn(txn, *parentPostHash, 0, 1, 0); err != nil {
+				return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: ")
+			}
+		}
+		if err := txn.Set(parentStakeIDKey, []byte{}); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding mapping for comment: %v: %v", postEntry, err)
+		}
+
+	} else {
+		if err := _dbSetTimestampIndexEntryWithTxn(txn, _dbKeyForPosterPublicKeyTimestampPostHash(
+			postEntry.PosterPublicKey, postEntry.TimestampNanos, postEntry.PostHash), []byte{},
+			postEntry.TimestampNanos, maxIndexedTstampNanos); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding mapping for public key: %v: %v", postEntry, err)
+		}
+		if err := _dbSetTimestampIndexEntryWithTxn(txn, _dbKeyForTstampPostHash(
+			postEntry.TimestampNanos, postEntry.PostHash), []byte{}, postEntry.TimestampNanos,
+			maxIndexedTstampNanos); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding mapping for tstamp: %v", postEntry)
+		}
+		if err := txn.Set(_dbKeyForCreatorBpsPostHash(
+			postEntry.CreatorBasisPoints, postEntry.PostHash), []byte{}); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding mapping for creatorBps: %v", postEntry)
+		}
+		if err := txn.Set(_dbKeyForStakeMultipleBpsPostHash(
+			postEntry.StakeMultipleBasisPoints, postEntry.PostHash), []byte{}); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding mapping for stakeMultipleBps: %v", postEntry)
+		}
+
+		// Get stats for the post.
+		// <prefix | PostType | AmountStaked | PostHash> -> <>
+		stakeStats := GetStakeEntryStats(postEntry.StakeEntry, params)
+		if err := txn.Set(
+			_dbGetStakeIDPostDBKey(
+				postEntry.PostHash, stakeStats.TotalStakeNanos), []byte{}); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding mapping for stakeMultipleBps: %v", postEntry)
+		}
+	}
+	// We treat reclouting the same for both comments and posts.
+	// We only store reclout entry mappings for vanilla reclouts
+	if IsVanillaReclout(postEntry) {
+		recloutEntry := RecloutEntry{
+			RecloutPostHash:   postEntry.PostHash,
+			RecloutedPostHash: postEntry.RecloutedPostHash,
+			ReclouterPubKey:   postEntry.PosterPublicKey,
+		}
+		if err := _dbCountNewRecloutWithTxn(txn, postEntry.PosterPublicKey, *postEntry.RecloutedPostHash); err != nil {
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: ")
+		}
+		if err := _dbSetRecloutMappingsWithTxn(
+			txn, postEntry.PosterPublicKey, *postEntry.RecloutedPostHash, recloutEntry); err != nil {
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Error problem adding mapping for recloutPostHash to ReclouterPubKey: %v", err)
+		}
+	}
+	if _isQuoteReclout(postEntry) {
+		if err := txn.Set(_dbKeyForQuoteReclout(
+			postEntry.RecloutedPostHash, postEntry.TimestampNanos, postEntry.PostHash), []byte{}); err != nil {
+
+			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
+				"adding quote reclout mapping: %v", postEntry.PostHash)
+		}
+	}
+	return nil
+}
+
+func DBPutPostEntryMappings(handle *badger.DB, postEntry *PostEntry, params *BitCloutParams) error {
+
+	defer DbCacheFinishWrites()
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DBPutPostEntryMappingsWithTxn(
+			txn, postEntry, params, DbGetMaxIndexedTstampNanosForTipWithTxn(txn))
+	})
+}
+
+// DBGetQuoteRecloutsOfPost returns up to limit of the posts quoting
+// recloutedPostHash from newest to oldest, starting right before
+// beforeTstampNanos. A limit of zero returns all of them and a
+// beforeTstampNanos of zero starts from the newest. Hidden quotes are included
+// so callers can decide whether to show them.
+func DBGetQuoteRecloutsOfPost(handle *badger.DB, recloutedPostHash *BlockHash, limit int,
+	beforeTstampNanos uint64) (_quotingPostEntries []*PostEntry, _err error) {
+
+	prefix := append([]byte{}, _PrefixRecloutedPostHashTstampQuotingPostHash...)
+	prefix = append(prefix, recloutedPostHash[:]...)
+
+	quotingPostEntries := []*PostEntry{}
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		opts.KeysOnly = true
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Iterating backwards from a bare tstamp skips every key with that tstamp
+		// since they're longer, which makes the start exclusive.
+		seekKey := append(append([]byte{}, prefix...), EncodeUint64(math.MaxUint64)...)
+		if beforeTstampNanos != 0 {
+			seekKey = append(append([]byte{}, prefix...), EncodeUint64(beforeTstampNanos)...)
+		}
+		for it.Seek(seekKey); it.ValidForPrefix(prefix); it.Next() {
+			if limit != 0 && len(quotingPostEntries) >= limit {
+				break
+			}
+			quotingPostHash := &BlockHash{}
+			copy(quotingPostHash[:], it.Key()[len(prefix)+8:])
+			quotingPostEntry := DBGetPostEntryByPostHashWithTxn(txn, quotingPostHash)
+			if quotingPostEntry == nil {
+				return fmt.Errorf("quoting post %v is missing", quotingPostHash)
+			}
+			quotingPostEntries = append(quotingPostEntries, quotingPostEntry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, _wrapDbError(err, "DBGetQuoteRecloutsOfPost")
+	}
+
+	return quotingPostEntries, nil
+}
+
+// quoteRecloutIndexMigrationName marks whether the quote reclouts stored
+// before the quote reclout index existed have been added to it.
+const quoteRecloutIndexMigrationName = "quote-reclout-index"
+
+// DbBackfillQuoteRecloutIndex adds the quote reclouts that were stored before
+// the quote reclout index existed to it. It only does the work once per db and
+// returns the number of quote reclouts it indexed.
+func DbBackfillQuoteRecloutIndex(handle *badger.DB) (_numIndexed int, _err error) {
+	if DbGetIndexMigrationState(handle, quoteRecloutIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	keysToIndex := [][]byte{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixPostHashToPostEntry, func(_ []byte, valBytes []byte) (bool, error) {
+		postEntry := &PostEntry{}
+		if err := _DbDecodePostEntry(valBytes, postEntry); err != nil {
+			return false, err
+		}
+		if _isQuoteReclout(postEntry) {
+			keysToIndex = append(keysToIndex, _dbKeyForQuoteReclout(
+				postEntry.RecloutedPostHash, postEntry.TimestampNanos, postEntry.PostHash))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillQuoteRecloutIndex: Problem reading posts")
+	}
+
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, key := range keysToIndex {
+			if err := txnWriter.Set(key, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillQuoteRecloutIndex: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, quoteRecloutIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillQuoteRecloutIndex: Problem marking backfill complete")
+	}
+
+	return len(keysToIndex), nil
+}
+
+// Specifying minTimestampNanos gives you all posts after minTimestampNanos
+// Pass minTimestampNanos = 0 && maxTimestampNanos = 0 if you want all posts
+// Setting maxTimestampNanos = 0, will default maxTimestampNanos to the current time.
+func DBGetAllPostsAndCommentsForPublicKeyOrderedByTimestamp(
+	handle *badger.DB, publicKey []byte, fetchEntries bool, minTimestampNanos uint64, maxTimestampNanos uint64) (
+	_tstamps []uint64, _postAndCommentHashes []*BlockHash, _postAndCommentEntries []*PostEntry, _err error) {
+
+	tstampsFetched := []uint64{}
+	postAndCommentHashesFetched := []*BlockHash{}
+	postAndCommentEntriesFetched := []*PostEntry{}
+	dbPrefixx := append([]byte{}, _PrefixPosterPublicKeyTimestampPostHash...)
+	dbPrefixx = append(dbPrefixx, publicKey...)
+
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+
+		opts.KeysOnly = true
+
+		// Go in reverse order since a larger count is better.
+		opts.Reverse = true
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Since we iterate backwards, the prefix must be bigger than all possible
+		// timestamps that could actually exist. We use eight bytes since the timestamp is
+		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
+		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+		prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
+
+		// If we have a maxTimeStamp, we use that instead of the maxBigEndianUint64.
+		if maxTimestampNanos != 0 {
+			prefix = append(dbPrefixx, EncodeUint64(maxTimestampNanos)...)
+		}
+
+		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
+			rawKey := it.Key()
+
+			// Key should be
+			// [prefix][posterPublicKey][Timestamp][PostHash]
+
+			// Pull out the relevant fields
+			timestampSizeBytes := 8
+			keyWithoutPrefix := rawKey[1:]
+			//posterPublicKey := keyWithoutPrefix[:HashSizeBytes]
+			publicKeySizeBytes := HashSizeBytes + 1
+			tstampNanos := DecodeUint64(keyWithoutPrefix[publicKeySizeBytes:(publicKeySizeBytes + timestampSizeBytes)])
+
+			postHash := &BlockHash{}
+			copy(postHash[:], keyWithoutPrefix[(publicKeySizeBytes+timestampSizeBytes):])
+
+			if tstampNanos < minTimestampNanos {
+				break
+			}
+
+			tstampsFetched = append(tstampsFetched, tstampNanos)
+			postAndCommentHashesFetched = append(postAndCommentHashesFetched, postHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !fetchEntries {
+		return tstampsFetched, postAndCommentHashesFetched, nil, nil
+	}
+
+	postEntries := DBGetPostEntriesByPostHashes(handle, postAndCommentHashesFetched)
+	for ii, postEntry := range postEntries {
+		if postEntry == nil {
+			return nil, nil, nil, fmt.Errorf("DBGetPostEntryByPostHash: "+
+				"PostHash %v does not have corresponding entry", postAndCommentHashesFetched[ii])
+		}
+		postAndCommentEntriesFetched = append(postAndCommentEntriesFetched, postEntry)
+	}
+
+	return tstampsFetched, postAndCommentHashesFetched, postAndCommentEntriesFetched, nil
+}
+
+// DBGetAllPostsByTstamp returns all the posts in the db with the newest
+// posts first.
+//
+// TODO(performance): This currently fetches all posts. We should implement
+// some kind of pagination instead though.
+func DBGetAllPostsByTstamp(handle *badger.DB, fetchEntries bool) (
+	_tstamps []uint64, _postHashes []*BlockHash, _postEntries []*PostEntry, _err error) {
+
+	tstampsFetched := []uint64{}
+	postHashesFetched := []*BlockHash{}
+	postEntriesFetched := []*PostEntry{}
+	dbPrefixx := append([]byte{}, _PrefixTstampNanosPostHash...)
+
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+
+		opts.KeysOnly = true
+
+		// Go in reverse order since a larger count is better.
+		opts.Reverse = true
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Since we iterate backwards, the prefix must be bigger than all possible
+		// timestamps that could actually exist. We use eight bytes since the timestamp is
+		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
+		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+		prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
+		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
+			rawKey := it.Key()
+
+			// Strip the prefix off the key and check its length. If it contains
+			// a big-endian uint64 then it should be at least eight bytes.
+			tstampPostHashKey := rawKey[1:]
+			uint64BytesLen := len(maxBigEndianUint64Bytes)
+			if len(tstampPostHashKey) != uint64BytesLen+HashSizeBytes {
+				return fmt.Errorf("DBGetAllPostsByTstamp: Invalid key "+
+					"length %d should be at least %d", len(tstampPostHashKey),
+					uint64BytesLen+HashSizeBytes)
+			}
+
+			tstampNanos := DecodeUint64(tstampPostHashKey[:uint64BytesLen])
+
+			// Appended to the tstamp should be the post hash so extract it here.
+			postHash := &BlockHash{}
+			copy(postHash[:], tstampPostHashKey[uint64BytesLen:])
+
+			tstampsFetched = append(tstampsFetched, tstampNanos)
+			postHashesFetched = append(postHashesFetched, postHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !fetchEntries {
+		return tstampsFetched, postHashesFetched, nil, nil
+	}
+
+	postEntries := DBGetPostEntriesByPostHashes(handle, postHashesFetched)
+	for ii, postEntry := range postEntries {
+		if postEntry == nil {
+			return nil, nil, nil, fmt.Errorf("DBGetPostEntryByPostHash: "+
+				"PostHash %v does not have corresponding entry", postHashesFetched[ii])
+		}
+		postEntriesFetched = append(postEntriesFetched, postEntry)
+	}
+
+	return tstampsFetched, postHashesFetched, postEntriesFetched, nil
+}
+
+// DBGetCommentPostHashesForParentStakeID returns all the comments, which are indexed by their
+// stake ID rather than by their timestamp.
+//
+// TODO(performance): This currently fetches all comments. We should implement
+// something where we only get the comments for particular posts instead.
+func DBGetCommentPostHashesForParentStakeID(
+	handle *badger.DB, stakeIDXXX []byte, fetchEntries bool) (
+	_tstamps []uint64, _commentPostHashes []*BlockHash, _commentPostEntryes []*PostEntry, _err error) {
+
+	tstampsFetched := []uint64{}
+	commentPostHashes := []*BlockHash{}
+	commentEntriesFetched := []*PostEntry{}
+	dbPrefixx := append([]byte{}, _PrefixCommentParentStakeIDToPostHash...)
+	dbPrefixx = append(dbPrefixx, stakeIDXXX...)
+
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+
+		opts.KeysOnly = true
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Since we iterate backwards, the prefix must be bigger than all possible
+		// counts that could actually exist. We use eight bytes since the count is
+		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
+		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+		//prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
+		prefix := dbPrefixx
+		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
+			rawKey := it.Key()
+
+			// Strip the prefix off the key and check its length. It should contain
+			// a 33-byte stake id, an 8 byte tstamp, and a 32 byte comment hash.
+			stakeIDTstampPostHashKey := rawKey[1:]
+			uint64BytesLen := len(maxBigEndianUint64Bytes)
+			if len(stakeIDTstampPostHashKey) != btcec.PubKeyBytesLenCompressed+uint64BytesLen+HashSizeBytes {
+				return fmt.Errorf("DBGetCommentPostHashesForParentStakeID: Invalid key "+
+					"length %d should be at least %d", len(stakeIDTstampPostHashKey),
+					btcec.PubKeyBytesLenCompressed+uint64BytesLen+HashSizeBytes)
+			}
+
+			//stakeID := stakeIDTstampPostHashKey[:btcec.PubKeyBytesLenCompressed]
+			tstampNanos := DecodeUint64(stakeIDTstampPostHashKey[btcec.PubKeyBytesLenCompressed : btcec.PubKeyBytesLenCompressed+uint64BytesLen])
+
+			commentPostHashBytes := stakeIDTstampPostHashKey[btcec.PubKeyBytesLenCompressed+uint64BytesLen:]
+			commentPostHash := &BlockHash{}
+			copy(commentPostHash[:], commentPostHashBytes)
+
+			//stakeIDsFetched = append(stakeIDsFetched, stakeID)
+			tstampsFetched = append(tstampsFetched, tstampNanos)
+			commentPostHashes = append(commentPostHashes, commentPostHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !fetchEntries {
+		return tstampsFetched, commentPostHashes, nil, nil
+	}
+
+	postEntries := DBGetPostEntriesByPostHashes(handle, commentPostHashes)
+	for ii, postEntry := range postEntries {
+		if postEntry == nil {
+			return nil, nil, nil, fmt.Errorf("DBGetCommentPostHashesForParentStakeID: "+
+				"PostHash %v does not have corresponding entry", commentPostHashes[ii])
+		}
+		commentEntriesFetched = append(commentEntriesFetched, postEntry)
+	}
+
+	return tstampsFetched, commentPostHashes, commentEntriesFetched, nil
+}
+
+// ======================================================================================
+// Profile code
+// ======================================================================================
+func _dbKeyForPKIDToProfileEntry(pkid *PKID) []byte {
+	prefixCopy := append([]byte{}, _PrefixPKIDToProfileEntry...)
+	key := append(prefixCopy, pkid[:]...)
+	return key
+}
+func _dbKeyForProfileUsernameToPKID(nonLowercaseUsername []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixProfileUsernameToPKID...)
+	// Always lowercase the username when we use it as a key in our db. This allows
+	// us to check uniqueness in a case-insensitive way.
+	lowercaseUsername := []byte(strings.ToLower(string(nonLowercaseUsername)))
+	key = append(key, lowercaseUsername...)
+	return key
+}
+
+// usernameConfusables maps characters that are commonly swapped in for one
+// another when impersonating a username to a single canonical character.
+var usernameConfusables = map[rune]rune{
+	'0': 'o',
+	'1': 'l',
+	'i': 'l',
+	'|': 'l',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'9': 'g',
+}
+
+// usernameConfusableSequences maps multi-character sequences that render like a
+// single character to that character. They're applied after lowercasing and
+// before the single-character folding above.
+var usernameConfusableSequences = []struct {
+	From string
+	To   string
+}{
+	{"rn", "m"},
+	{"vv", "w"},
+	{"cl", "d"},
+}
+
+// NormalizeUsernameForSimilarity folds a username down to a canonical form so that
+// usernames which look alike map to the same value, e.g. "Elon_Musk" and "e1onmusk".
+// It lowercases the name, drops underscores, and folds confusable characters.
+func NormalizeUsernameForSimilarity(nonLowercaseUsername []byte) []byte {
+	username := strings.ToLower(string(nonLowercaseUsername))
+	username = strings.Replace(username, "_", "", -1)
+	for _, sequence := range usernameConfusableSequences {
+		username = strings.Replace(username, sequence.From, sequence.To, -1)
+	}
+
+	normalized := []rune{}
+	for _, char := range username {
+		if folded, exists := usernameConfusables[char]; exists {
+			char = folded
+		}
+		normalized = append(normalized, char)
+	}
+	return []byte(string(normalized))
+}
+
+func _dbSeekPrefixForNormalizedUsername(nonLowercaseUsername []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixNormalizedUsernamePKID...)
+	key = append(key, NormalizeUsernameForSimilarity(nonLowercaseUsername)...)
+	return append(key, 0x00)
+}
+
+func _dbKeyForNormalizedUsernamePKID(nonLowercaseUsername []byte, pkid *PKID) []byte {
+	return append(_dbSeekPrefixForNormalizedUsername(nonLowercaseUsername), pkid[:]...)
+}
+
+// normalizedUsernameIndexMigration builds the normalized username index from the
+// username index for the profiles that were stored before it existed. The
+// profile mappings write to both indexes so the migration is never finalized.
+var normalizedUsernameIndexMigration = &DbIndexMigration{
+	Name:      "normalized-username-index",
+	OldPrefix: _PrefixProfileUsernameToPKID,
+	NewPrefix: _PrefixNormalizedUsernamePKID,
+	ConvertEntry: func(oldKey []byte, oldVal []byte) (_newKey []byte, _newVal []byte, _err error) {
+		if len(oldVal) != btcec.PubKeyBytesLenCompressed {
+			return nil, nil, fmt.Errorf("Invalid PKID length %d should be %d",
+				len(oldVal), btcec.PubKeyBytesLenCompressed)
+		}
+		username := oldKey[len(_PrefixProfileUsernameToPKID):]
+		return _dbKeyForNormalizedUsernamePKID(username, PublicKeyToPKID(oldVal)), []byte{}, nil
+	},
+}
+
+// DbBackfillNormalizedUsernameIndex adds the profiles that were stored before
+// the normalized username index existed to it. It only does the work once per db.
+func DbBackfillNormalizedUsernameIndex(handle *badger.DB) error {
+	if err := normalizedUsernameIndexMigration.StartDualWrite(handle); err != nil {
+		return errors.Wrapf(err, "DbBackfillNormalizedUsernameIndex: ")
+	}
+	if err := normalizedUsernameIndexMigration.Backfill(handle); err != nil {
+		return errors.Wrapf(err, "DbBackfillNormalizedUsernameIndex: ")
+	}
+	return nil
+}
+
+// DbGetSimilarUsernames returns the PKIDs of all the profiles whose usernames
+// normalize to the same value as the username passed in, including the profile
+// that owns the username itself if there is one. If fetchEntries is set then the
+// corresponding ProfileEntrys are returned as well.
+func DbGetSimilarUsernames(handle *badger.DB, nonLowercaseUsername []byte, fetchEntries bool) (
+	_pkids []*PKID, _profileEntries []*ProfileEntry, _err error) {
+
+	seekPrefix := _dbSeekPrefixForNormalizedUsername(nonLowercaseUsername)
+	keysFound, _ := _enumerateKeysForPrefix(handle, seekPrefix)
+
+	pkidsFound := []*PKID{}
+	for _, key := range keysFound {
+		pkidBytes := key[len(seekPrefix):]
+		if len(pkidBytes) != btcec.PubKeyBytesLenCompressed {
+			return nil, nil, fmt.Errorf("DbGetSimilarUsernames: Invalid PKID "+
+				"length %d should be %d", len(pkidBytes), btcec.PubKeyBytesLenCompressed)
+		}
+		pkidsFound = append(pkidsFound, PublicKeyToPKID(pkidBytes))
+	}
+
+	if !fetchEntries {
+		return pkidsFound, nil, nil
+	}
+
+	profileEntriesFound := []*ProfileEntry{}
+	for ii, profileEntry := range DBGetProfileEntriesForPKIDs(handle, pkidsFound) {
+		if profileEntry == nil {
+			return nil, nil, fmt.Errorf("DbGetSimilarUsernames: PKID %v does not "+
+				"have corresponding entry", PkToStringBoth(pkidsFound[ii][:]))
+		}
+		profileEntriesFound = append(profileEntriesFound, profileEntry)
+	}
+
+	return pkidsFound, profileEntriesFound, nil
+}
+
+// This is the key we use to sort profiles by their amount of BitClout locked
+func _dbKeyForCreatorBitCloutLockedNanosCreatorPKID(bitCloutLockedNanos uint64, pkid *PKID) []byte {
+	key := append([]byte{}, _PrefixCreatorBitCloutLockedNanosCreatorPKID...)
+	key = append(key, EncodeUint64(bitCloutLockedNanos)...)
+	key = append(key, pkid[:]...)
+	return key
+}
+
+func DBGetPKIDForUsernameWithTxn(
+	txn KVTxn, username []byte) *PKID {
+
+	key := _dbKeyForProfileUsernameToPKID(username)
+	pkidBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	return PublicKeyToPKID(pkidBytes)
+}
+
+func DBGetPKIDForUsername(db *badger.DB, username []byte) *PKID {
+	var ret *PKID
+	DbView(db, func(txn KVTxn) error {
+		ret = DBGetPKIDForUsernameWithTxn(txn, username)
+		return nil
+	})
+	return ret
+}
+
+func DBGetProfileEntryForUsernameWithTxn(
+	txn KVTxn, username []byte) *ProfileEntry {
+
+	pkid := DBGetPKIDForUsernameWithTxn(txn, username)
+	if pkid == nil {
+		return nil
+	}
+
+	return DBGetProfileEntryForPKIDWithTxn(txn, pkid)
+}
+
+func DBGetProfileEntryForUsername(db *badger.DB, username []byte) *ProfileEntry {
+	var ret *ProfileEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DBGetProfileEntryForUsernameWithTxn(txn, username)
+		return nil
+	})
+	return ret
+}
+
+func DBGetProfileEntryForPKIDWithTxn(
+	txn KVTxn, pkid *PKID) *ProfileEntry {
+
+	key := _dbKeyForPKIDToProfileEntry(pkid)
+	profileEntryObj := &ProfileEntry{}
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	err = _DbDecodeProfileEntry(valBytes, profileEntryObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DBGetProfileEntryForPubKeyWithTxnhWithTxn: Problem reading "+
+			"ProfileEntry for PKID %v", pkid)
+		return nil
+	}
+	return profileEntryObj
+}
+
+func DBGetProfileEntryForPKID(db *badger.DB, pkid *PKID) *ProfileEntry {
+	cacheKey := string(_dbKeyForPKIDToProfileEntry(pkid))
+	cachedEntry, generation, found := profileEntryCache.get(db, cacheKey)
+	if found {
+		if profileEntry := _profileEntryFromCache(cachedEntry); profileEntry != nil {
+			return profileEntry
+		}
+	}
+
+	var ret *ProfileEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DBGetProfileEntryForPKIDWithTxn(txn, pkid)
+		return nil
+	})
+	if ret != nil {
+		profileEntryCache.add(db, cacheKey, _DbBufForProfileEntry(ret), generation)
+	}
+	return ret
+}
+
+// _profileEntryFromCache decodes a ProfileEntry cached by
+// DBGetProfileEntryForPKID. Like posts, profiles are cached encoded so that
+// every caller gets its own copy. It returns nil if the entry can't be decoded.
+func _profileEntryFromCache(cachedEntry interface{}) *ProfileEntry {
+	profileEntry := &ProfileEntry{}
+	if err := _DbDecodeProfileEntry(cachedEntry.([]byte), profileEntry); err != nil {
+		glog.Errorf("_profileEntryFromCache: Problem decoding cached ProfileEntry: %v", err)
+		return nil
+	}
+	return profileEntry
+}
+
+// DBGetProfileEntriesForPKIDsWithTxn returns the ProfileEntry for each of the
+// PKIDs, in the same order, with nil for any that don't have a profile.
+func DBGetProfileEntriesForPKIDsWithTxn(
+	txn KVTxn, pkids []*PKID) []*ProfileEntry {
+
+	profileEntries := make([]*ProfileEntry, len(pkids))
+	for ii, pkid := range pkids {
+		profileEntries[ii] = DBGetProfileEntryForPKIDWithTxn(txn, pkid)
+	}
+	return profileEntries
+}
+
+// DBGetProfileEntriesForPKIDs is like DBGetProfileEntryForPKID for many PKIDs at
+// once. Everything that isn't cached is read in a single txn.
+func DBGetProfileEntriesForPKIDs(db *badger.DB, pkids []*PKID) []*ProfileEntry {
+	profileEntries := make([]*ProfileEntry, len(pkids))
+	uncachedIndexes := []int{}
+	uncachedPKIDs := []*PKID{}
+	generations := []uint64{}
+	for ii, pkid := range pkids {
+		cachedEntry, generation, found := profileEntryCache.get(
+			db, string(_dbKeyForPKIDToProfileEntry(pkid)))
+		if found {
+			if profileEntries[ii] = _profileEntryFromCache(cachedEntry); profileEntries[ii] != nil {
+				continue
+			}
+		}
+		uncachedIndexes = append(uncachedIndexes, ii)
+		uncachedPKIDs = append(uncachedPKIDs, pkid)
+		generations = append(generations, generation)
+	}
+	if len(uncachedPKIDs) == 0 {
+		return profileEntries
+	}
+
+	var uncachedEntries []*ProfileEntry
+	DbView(db, func(txn KVTxn) error {
+		uncachedEntries = DBGetProfileEntriesForPKIDsWithTxn(txn, uncachedPKIDs)
+		return nil
+	})
+	for jj, profileEntry := range uncachedEntries {
+		profileEntries[uncachedIndexes[jj]] = profileEntry
+		if profileEntry != nil {
+			profileEntryCache.add(db, string(_dbKeyForPKIDToProfileEntry(uncachedPKIDs[jj])),
+				_DbBufForProfileEntry(profileEntry), generations[jj])
+		}
+	}
+	return profileEntries
+}
+
+func DBDeleteProfileEntryMappingsWithTxn(
+	txn KVTxn, pkid *PKID, params *BitCloutParams) error {
+
+	profileEntryCache.invalidate(_dbKeyForPKIDToProfileEntry(pkid))
+
+	// First pull up the mapping that exists for the profile pub key passed in.
+	// If one doesn't exist then there's nothing to do.
+	profileEntry := DBGetProfileEntryForPKIDWithTxn(txn, pkid)
+	if profileEntry == nil {
+		return nil
+	}
+
+	// When a profile exists, delete the pkid mapping for the profile.
+	if err := txn.Delete(_dbKeyForPKIDToProfileEntry(pkid)); err != nil {
+		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
+			"profile mapping for profile PKID: %v",
+			PkToString(pkid[:], params))
+	}
+
+	if err := txn.Delete(
+		_dbKeyForProfileUsernameToPKID(profileEntry.Username)); err != nil {
+
+		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
+			"username mapping for profile username %v", string(profileEntry.Username))
+	}
+
+	// The normalized username mapping
+	if err := txn.Delete(
+		_dbKeyForNormalizedUsernamePKID(profileEntry.Username, pkid)); err != nil {
+
+		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
+			"normalized username mapping for profile username %v", string(profileEntry.Username))
+	}
+
+	// The coin clout mapping
+	if err := txn.Delete(
+		_dbKeyForCreatorBitCloutLockedNanosCreatorPKID(
+			profileEntry.BitCloutLockedNanos, pkid)); err != nil {
+
+		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
+			"coin mapping for profile username %v", string(profileEntry.Username))
+	}
+
+	return nil
+}
+
+func DBDeleteProfileEntryMappings(
+	handle *badger.DB, pkid *PKID, params *BitCloutParams) error {
+
+	defer DbCacheFinishWrites()
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DBDeleteProfileEntryMappingsWithTxn(txn, pkid, params)
+	})
+}
+
+func DBPutProfileEntryMappingsWithTxn(
+	txn KVTxn, profileEntry *ProfileEntry, pkid *PKID, params *BitCloutParams) error {
+
+	profileDataBytes := _DbBufForProfileEntry(profileEntry)
+
+	// Set the main PKID -> profile entry mapping.
+	profileEntryCache.invalidate(_dbKeyForPKIDToProfileEntry(pkid))
+	if err := txn.Set(_dbKeyForPKIDToProfileEntry(pkid), profileDataBytes); err != nil {
+
+		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
+			"adding mapping for profile: %v", PkToString(pkid[:], params))
+	}
+
+	// Username
+	if err := txn.Set(
+		_dbKeyForProfileUsernameToPKID(profileEntry.Username),
+		pkid[:]); err != nil {
+
+		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
+			"adding mapping for profile with username: %v", string(profileEntry.Username))
+	}
+
+	// Normalized username
+	if err := txn.Set(
+		_dbKeyForNormalizedUsernamePKID(profileEntry.Username, pkid), []byte{}); err != nil {
+
+		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
+			"adding normalized mapping for profile with username: %v", string(profileEntry.Username))
+	}
+
+	// The coin clout mapping
+	if err := txn.Set(
+		_dbKeyForCreatorBitCloutLockedNanosCreatorPKID(
+			profileEntry.BitCloutLockedNanos, pkid), []byte{}); err != nil {
+
+		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
+			"adding mapping for profile coin: ")
+	}
+
+	return nil
+}
+
+func DBPutProfileEntryMappings(
+	handle *badger.DB, profileEntry *ProfileEntry, pkid *PKID, params *BitCloutParams) error {
+
+	defer DbCacheFinishWrites()
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DBPutProfileEntryMappingsWithTxn(txn, profileEntry, pkid, params)
+	})
+}
+
+// DBGetAllProfilesByCoinValue returns all the profiles in the db with the
+// highest coin values first.
+//
+// TODO(performance): This currently fetches all profiles. We should implement
+// some kind of pagination instead though.
+func DBGetAllProfilesByCoinValue(handle *badger.DB, fetchEntries bool) (
+	_lockedBitCloutNanos []uint64, _profilePublicKeys []*PKID,
+	_profileEntries []*ProfileEntry, _err error) {
+
+	lockedBitCloutNanosFetched := []uint64{}
+	profilePublicKeysFetched := []*PKID{}
+	profileEntriesFetched := []*ProfileEntry{}
+	dbPrefixx := append([]byte{}, _PrefixCreatorBitCloutLockedNanosCreatorPKID...)
+
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+
+		opts.KeysOnly = true
+
+		// Go in reverse order since a larger count is better.
+		opts.Reverse = true
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Since we iterate backwards, the prefix must be bigger than all possible
+		// counts that could actually exist. We use eight bytes since the count is
+		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
+		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+		prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
+		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
+			rawKey := it.Key()
+
+			// Strip the prefix off the key and check its length. If it contains
+			// a big-endian uint64 then it should be at least eight bytes.
+			lockedBitCloutPubKeyConcatKey := rawKey[1:]
+			uint64BytesLen := len(maxBigEndianUint64Bytes)
+			expectedLength := uint64BytesLen + btcec.PubKeyBytesLenCompressed
+			if len(lockedBitCloutPubKeyConcatKey) != expectedLength {
+				return fmt.Errorf("DBGetAllProfilesByLockedBitClout: Invalid key "+
+					"length %d should be at least %d", len(lockedBitCloutPubKeyConcatKey),
+					expectedLength)
+			}
+
+			lockedBitCloutNanos := DecodeUint64(lockedBitCloutPubKeyConcatKey[:uint64BytesLen])
+
+			// Appended to the stake should be the profile pub key so extract it here.
+			profilePKID := make([]byte, btcec.PubKeyBytesLenCompressed)
+			copy(profilePKID[:], lockedBitCloutPubKeyConcatKey[uint64BytesLen:])
+
+			lockedBitCloutNanosFetched = append(lockedBitCloutNanosFetched, lockedBitCloutNanos)
+			profilePublicKeysFetched = append(profilePublicKeysFetched, PublicKeyToPKID(profilePKID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !fetchEntries {
+		return lockedBitCloutNanosFetched, profilePublicKeysFetched, nil, nil
+	}
+
+	profileEntries := DBGetProfileEntriesForPKIDs(handle, profilePublicKeysFetched)
+	for ii, profileEntry := range profileEntries {
+		if profileEntry == nil {
+			return nil, nil, nil, fmt.Errorf("DBGetAllProfilesByLockedBitClout: "+
+				"ProfilePubKey %v does not have corresponding entry",
+				PkToStringBoth(profilePublicKeysFetched[ii][:]))
+		}
+		profileEntriesFetched = append(profileEntriesFetched, profileEntry)
+	}
+
+	return lockedBitCloutNanosFetched, profilePublicKeysFetched, profileEntriesFetched, nil
+}
+
+// =====================================================================================
+// Content hash first-seen code
+// =====================================================================================
+
+// ContentHashFirstSeenEntry records where an image was first seen. Exactly one
+// of PostHash or ProfilePKID is set.
+//
+// Note that this index is not consensus-critical and is not rolled back when a
+// block is disconnected, so after a reorg an entry can point to a post or profile
+// that is no longer on the main chain.
+type ContentHashFirstSeenEntry struct {
+	ContentHash *BlockHash
+	// Set when the image was first seen in a post.
+	PostHash *BlockHash
+	// Set when the image was first seen as a profile pic.
+	ProfilePKID *PKID
+	// The PKID of the poster or of the profile that used the image.
+	OwnerPKID   *PKID
+	BlockHeight uint32
+}
+
+// ContentHashForImageURL returns the content hash used to index an image URL
+// found in a post body.
+func ContentHashForImageURL(imageURL string) *BlockHash {
+	return Sha256DoubleHash([]byte(imageURL))
+}
+
+// ContentHashForProfilePic returns the content hash used to index a profile pic.
+func ContentHashForProfilePic(profilePic []byte) *BlockHash {
+	return Sha256DoubleHash(profilePic)
+}
+
+// ContentHashesForPostBody returns the content hashes of the image URLs in a
+// post body. Bodies that aren't valid JSON don't have any.
+func ContentHashesForPostBody(body []byte) []*BlockHash {
+	bodyJSONObj := BitCloutBodySchema{}
+	if err := json.Unmarshal(body, &bodyJSONObj); err != nil {
+		return nil
+	}
+	contentHashes := []*BlockHash{}
+	for _, imageURL := range bodyJSONObj.ImageURLs {
+		if imageURL == "" {
+			continue
+		}
+		contentHashes = append(contentHashes, ContentHashForImageURL(imageURL))
+	}
+	return contentHashes
+}
+
+// _postEntryFirstSeenLess orders posts by confirmation height and then by post
+// hash, which is the order their images are recorded in.
+func _postEntryFirstSeenLess(postEntry1 *PostEntry, postEntry2 *PostEntry) bool {
+	if postEntry1.ConfirmationBlockHeight != postEntry2.ConfirmationBlockHeight {
+		return postEntry1.ConfirmationBlockHeight < postEntry2.ConfirmationBlockHeight
+	}
+	return bytes.Compare(postEntry1.PostHash[:], postEntry2.PostHash[:]) < 0
+}
+
+func _dbKeyForContentHashFirstSeenEntry(contentHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixContentHashToFirstSeenEntry...)
+	return append(prefixCopy, contentHash[:]...)
+}
+
+// DbPutContentHashFirstSeenEntryIfAbsentWithTxn only writes the entry if nothing
+// has been recorded for its content hash yet, so the first sighting always wins.
+func DbPutContentHashFirstSeenEntryIfAbsentWithTxn(txn KVTxn, entry *ContentHashFirstSeenEntry) error {
+	key := _dbKeyForContentHashFirstSeenEntry(entry.ContentHash)
+	if _, err := txn.Get(key); err == nil {
+		return nil
+	}
+
+	entryBuf := bytes.NewBuffer([]byte{})
+	gob.NewEncoder(entryBuf).Encode(entry)
+	if err := txn.Set(key, entryBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "DbPutContentHashFirstSeenEntryIfAbsentWithTxn: Problem "+
+			"adding mapping for content hash %v", entry.ContentHash)
+	}
+	return nil
+}
+
+func DbGetContentHashFirstSeenEntryWithTxn(txn KVTxn, contentHash *BlockHash) *ContentHashFirstSeenEntry {
+	key := _dbKeyForContentHashFirstSeenEntry(contentHash)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	entry := &ContentHashFirstSeenEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(entry)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetContentHashFirstSeenEntryWithTxn: Problem reading "+
+			"ContentHashFirstSeenEntry for content hash %v", contentHash)
+		return nil
+	}
+	return entry
+}
+
+// DbGetContentHashFirstSeenEntry returns where the content with the given hash
+// was first seen, or nil if it has never been seen.
+func DbGetContentHashFirstSeenEntry(db *badger.DB, contentHash *BlockHash) *ContentHashFirstSeenEntry {
+	var ret *ContentHashFirstSeenEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetContentHashFirstSeenEntryWithTxn(txn, contentHash)
+		return nil
+	})
+	return ret
+}
+
+// contentHashIndexMigrationName marks whether the images in posts stored
+// before the content hash index existed have been added to it.
+const contentHashIndexMigrationName = "content-hash-index"
+
+// DbBackfillContentHashIndex adds the images in the posts that were stored
+// before the content hash index existed to it. Posts are visited in the same
+// order the view flushes them in, so the post recorded for an image is the same
+// one a node that had the index all along would have. It only does the work
+// once per db and returns the number of posts it looked at.
+//
+// Profile pics aren't backfilled since profiles don't record when their pic was
+// set, so there's no way to tell which profile used a pic first.
+func DbBackfillContentHashIndex(handle *badger.DB) (_numPosts int, _err error) {
+	if DbGetIndexMigrationState(handle, contentHashIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	postEntries := []*PostEntry{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixPostHashToPostEntry, func(_ []byte, valBytes []byte) (bool, error) {
+		postEntry := &PostEntry{}
+		if err := _DbDecodePostEntry(valBytes, postEntry); err != nil {
+			return false, err
+		}
+		if len(postEntry.Body) != 0 {
+			postEntries = append(postEntries, postEntry)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillContentHashIndex: Problem reading posts")
+	}
+	sort.Slice(postEntries, func(ii, jj int) bool {
+		return _postEntryFirstSeenLess(postEntries[ii], postEntries[jj])
+	})
+
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, postEntryIter := range postEntries {
+			postEntry := postEntryIter
+			contentHashes := ContentHashesForPostBody(postEntry.Body)
+			if len(contentHashes) == 0 {
+				continue
+			}
+			err := txnWriter.Write(func(txn KVTxn) error {
+				posterPKID := DBGetPKIDEntryForPublicKeyWithTxn(txn, postEntry.PosterPublicKey)
+				if posterPKID == nil {
+					return fmt.Errorf("Problem reading PKID for poster of post %v", postEntry.PostHash)
+				}
+				for _, contentHash := range contentHashes {
+					err := DbPutContentHashFirstSeenEntryIfAbsentWithTxn(txn, &ContentHashFirstSeenEntry{
+						ContentHash: contentHash,
+						PostHash:    postEntry.PostHash,
+						OwnerPKID:   posterPKID.PKID,
+						BlockHeight: postEntry.ConfirmationBlockHeight,
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillContentHashIndex: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, contentHashIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillContentHashIndex: Problem marking backfill complete")
+	}
+
+	return len(postEntries), nil
+}
+
+// =====================================================================================
+// Txn daily stats code
+// =====================================================================================
+
+// TxnStatsNumHistogramBuckets is the number of buckets in the size and fee
+// histograms of a TxnDailyStatsEntry. Bucket zero counts values of zero and
+// bucket i counts values in [2^(i-1), 2^i).
+const TxnStatsNumHistogramBuckets = 65
+
+// TxnDailyStatsEntry aggregates all the txns of a particular type that were
+// connected in blocks with a timestamp on a particular day.
+type TxnDailyStatsEntry struct {
+	// Days since the unix epoch.
+	Day     uint64
+	TxnType TxnType
+
+	NumTxns        uint64
+	TotalSizeBytes uint64
+	// The fee of a txn is computed as its total input minus its total output,
+	// so nanos a txn burns (e.g. a create profile fee) are included.
+	TotalFeeNanos uint64
+
+	SizeHistogram []uint64
+	FeeHistogram  []uint64
+}
+
+func _txnStatsHistogramBucket(value uint64) int {
+	return bits.Len64(value)
+}
+
+// TxnStatsDayForTstampSecs returns the day used to key a TxnDailyStatsEntry.
+func TxnStatsDayForTstampSecs(tstampSecs uint64) uint64 {
+	return tstampSecs / uint64((24 * time.Hour).Seconds())
+}
+
+func _dbKeyForTxnDailyStats(day uint64, txnType TxnType) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixDayTxnTypeToTxnDailyStats...)
+	key = append(key, EncodeUint64(day)...)
+	return append(key, byte(txnType))
+}
+
+func DbGetTxnDailyStatsWithTxn(txn KVTxn, day uint64, txnType TxnType) *TxnDailyStatsEntry {
+	key := _dbKeyForTxnDailyStats(day, txnType)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	statsEntry := &TxnDailyStatsEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(statsEntry)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetTxnDailyStatsWithTxn: Problem reading "+
+			"TxnDailyStatsEntry for day %d and txn type %v", day, txnType)
+		return nil
+	}
+	return statsEntry
+}
+
+func DbPutTxnDailyStatsWithTxn(txn KVTxn, statsEntry *TxnDailyStatsEntry) error {
+	statsBuf := bytes.NewBuffer([]byte{})
+	gob.NewEncoder(statsBuf).Encode(statsEntry)
+	if err := txn.Set(_dbKeyForTxnDailyStats(statsEntry.Day, statsEntry.TxnType), statsBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "DbPutTxnDailyStatsWithTxn: Problem adding "+
+			"stats for day %d and txn type %v", statsEntry.Day, statsEntry.TxnType)
+	}
+	return nil
+}
+
+// _txnFeeFromUtxoOps computes the total input of a txn from the utxos it spent
+// and subtracts the txn's outputs. Txns without inputs, like block rewards, are
+// counted as having no fee.
+func _txnFeeFromUtxoOps(bitcloutTxn *MsgBitCloutTxn, utxoOpsForTxn []*UtxoOperation) uint64 {
+	totalInput := uint64(0)
+	for _, utxoOp := range utxoOpsForTxn {
+		if utxoOp.Type == OperationTypeSpendUtxo && utxoOp.Entry != nil {
+			totalInput += utxoOp.Entry.AmountNanos
+		}
+	}
+	totalOutput := uint64(0)
+	for _, txOutput := range bitcloutTxn.TxOutputs {
+		totalOutput += txOutput.AmountNanos
+	}
+	if totalOutput > totalInput {
+		return 0
+	}
+	return totalInput - totalOutput
+}
+
+// DbUpdateTxnDailyStatsForBlockWithTxn adds the txns in a block to the daily stats
+// when the block is connected and removes them when it is disconnected. The utxo
+// operations must be the ones generated when the block was connected.
+func DbUpdateTxnDailyStatsForBlockWithTxn(
+	txn KVTxn, bitcloutBlock *MsgBitCloutBlock, utxoOpsForBlock [][]*UtxoOperation,
+	isConnect bool) error {
+
+	if len(utxoOpsForBlock) != len(bitcloutBlock.Txns) {
+		return fmt.Errorf("DbUpdateTxnDailyStatsForBlockWithTxn: Number of utxo "+
+			"operations %d does not match number of txns %d", len(utxoOpsForBlock),
+			len(bitcloutBlock.Txns))
+	}
+
+	day := TxnStatsDayForTstampSecs(bitcloutBlock.Header.TstampSecs)
+	statsForType := make(map[TxnType]*TxnDailyStatsEntry)
+	for txnIndex, bitcloutTxn := range bitcloutBlock.Txns {
+		txnType := bitcloutTxn.TxnMeta.GetTxnType()
+		statsEntry, exists := statsForType[txnType]
+		if !exists {
+			statsEntry = DbGetTxnDailyStatsWithTxn(txn, day, txnType)
+			if statsEntry == nil {
+				statsEntry = &TxnDailyStatsEntry{
+					Day:     day,
+					TxnType: txnType,
+				}
+			}
+			if len(statsEntry.SizeHistogram) != TxnStatsNumHistogramBuckets {
+				statsEntry.SizeHistogram = make([]uint64, TxnStatsNumHistogramBuckets)
+			}
+			if len(statsEntry.FeeHistogram) != TxnStatsNumHistogramBuckets {
+				statsEntry.FeeHistogram = make([]uint64, TxnStatsNumHistogramBuckets)
+			}
+			statsForType[txnType] = statsEntry
+		}
+
+		txnBytes, err := bitcloutTxn.ToBytes(false /*preSignature*/)
+		if err != nil {
+			return errors.Wrapf(err, "DbUpdateTxnDailyStatsForBlockWithTxn: Problem "+
+				"serializing txn %d", txnIndex)
+		}
+		sizeBytes := uint64(len(txnBytes))
+		feeNanos := _txnFeeFromUtxoOps(bitcloutTxn, utxoOpsForBlock[txnIndex])
+		sizeBucket := _txnStatsHistogramBucket(sizeBytes)
+		feeBucket := _txnStatsHistogramBucket(feeNanos)
+
+		if isConnect {
+			statsEntry.NumTxns++
+			statsEntry.TotalSizeBytes += sizeBytes
+			statsEntry.TotalFeeNanos += feeNanos
+			statsEntry.SizeHistogram[sizeBucket]++
+			statsEntry.FeeHistogram[feeBucket]++
+		} else {
+			// The stats should always contain the block being disconnected, but
+			// guard against underflow anyway.
+			if statsEntry.NumTxns == 0 || statsEntry.TotalSizeBytes < sizeBytes ||
+				statsEntry.TotalFeeNanos < feeNanos || statsEntry.SizeHistogram[sizeBucket] == 0 ||
+				statsEntry.FeeHistogram[feeBucket] == 0 {
+
+				glog.Errorf("DbUpdateTxnDailyStatsForBlockWithTxn: Stats for day %d and "+
+					"txn type %v are missing txn %d being disconnected", day, txnType, txnIndex)
+				continue
+			}
+			statsEntry.NumTxns--
+			statsEntry.TotalSizeBytes -= sizeBytes
+			statsEntry.TotalFeeNanos -= feeNanos
+			statsEntry.SizeHistogram[sizeBucket]--
+			statsEntry.FeeHistogram[feeBucket]--
+		}
+	}
+
+	for _, statsEntry := range statsForType {
+		if err := DbPutTxnDailyStatsWithTxn(txn, statsEntry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DbGetTxnDailyStatsForDayRange returns the stats for every txn type for each day
+// in [startDay, endDay], sorted by day and then by txn type.
+func DbGetTxnDailyStatsForDayRange(handle *badger.DB, startDay uint64, endDay uint64) (
+	_statsEntries []*TxnDailyStatsEntry, _err error) {
+
+	statsEntries := []*TxnDailyStatsEntry{}
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := _PrefixDayTxnTypeToTxnDailyStats
+		startKey := append(append([]byte{}, prefix...), EncodeUint64(startDay)...)
+		for it.Seek(startKey); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Key()
+			if len(key) != len(prefix)+8+1 {
+				return fmt.Errorf("DbGetTxnDailyStatsForDayRange: Invalid key length %d", len(key))
+			}
+			if DecodeUint64(key[len(prefix):len(prefix)+8]) > endDay {
+				break
+			}
+
+			statsEntry := &TxnDailyStatsEntry{}
+			valBytes, err := it.Value()
+			if err == nil {
+				err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(statsEntry)
+			}
+			if err != nil {
+				return _corruptDbEntryError(err, "DbGetTxnDailyStatsForDayRange: Problem decoding stats")
+			}
+			statsEntries = append(statsEntries, statsEntry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return statsEntries, nil
+}
+
+// =====================================================================================
+// Utxo spend code
+// =====================================================================================
+
+// UtxoSpendEntry records where a utxo went. The txn that created the utxo is
+// CreatingTxID, which is always the TxID of the utxo's key.
+type UtxoSpendEntry struct {
+	CreatingTxID *BlockHash
+	SpendingTxID *BlockHash
+	SpendHeight  uint64
+}
+
+func _dbKeyForUtxoSpendEntry(utxoKey *UtxoKey) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixUtxoKeyToUtxoSpendEntry...)
+	key = append(key, utxoKey.TxID[:]...)
+	return append(key, _EncodeUint32(utxoKey.Index)...)
+}
+
+// DbPutUtxoSpendEntriesForBlockWithTxn records the block's txns as the spenders
+// of all of their inputs.
+func DbPutUtxoSpendEntriesForBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
+	for _, bitcloutTxn := range bitcloutBlock.Txns {
+		spendingTxID := bitcloutTxn.Hash()
+		for _, txInput := range bitcloutTxn.TxInputs {
+			utxoKey := (*UtxoKey)(txInput)
+			spendEntry := &UtxoSpendEntry{
+				CreatingTxID: &BlockHash{},
+				SpendingTxID: spendingTxID,
+				SpendHeight:  bitcloutBlock.Header.Height,
+			}
+			*spendEntry.CreatingTxID = utxoKey.TxID
+
+			entryBuf := bytes.NewBuffer([]byte{})
+			gob.NewEncoder(entryBuf).Encode(spendEntry)
+			if err := txn.Set(_dbKeyForUtxoSpendEntry(utxoKey), entryBuf.Bytes()); err != nil {
+				return errors.Wrapf(err, "DbPutUtxoSpendEntriesForBlockWithTxn: Problem "+
+					"adding spend entry for utxo %v", utxoKey)
+			}
+		}
+	}
+	return nil
+}
+
+// DbDeleteUtxoSpendEntriesForBlockWithTxn removes the spend entries added when the
+// block was connected.
+func DbDeleteUtxoSpendEntriesForBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
+	for _, bitcloutTxn := range bitcloutBlock.Txns {
+		for _, txInput := range bitcloutTxn.TxInputs {
+			utxoKey := (*UtxoKey)(txInput)
+			if err := txn.Delete(_dbKeyForUtxoSpendEntry(utxoKey)); err != nil {
+				return errors.Wrapf(err, "DbDeleteUtxoSpendEntriesForBlockWithTxn: Problem "+
+					"deleting spend entry for utxo %v", utxoKey)
+			}
+		}
+	}
+	return nil
+}
+
+// DbGetUtxoSpendEntryWithTxn returns nil if the utxo hasn't been spent on the
+// main chain.
+func DbGetUtxoSpendEntryWithTxn(txn KVTxn, utxoKey *UtxoKey) *UtxoSpendEntry {
+	key := _dbKeyForUtxoSpendEntry(utxoKey)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	spendEntry := &UtxoSpendEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(spendEntry)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetUtxoSpendEntryWithTxn: Problem reading "+
+			"UtxoSpendEntry for utxo %v", utxoKey)
+		return nil
+	}
+	return spendEntry
+}
+
+func DbGetUtxoSpendEntry(handle *badger.DB, utxoKey *UtxoKey) *UtxoSpendEntry {
+	var ret *UtxoSpendEntry
+	DbView(handle, func(txn KVTxn) error {
+		ret = DbGetUtxoSpendEntryWithTxn(txn, utxoKey)
+		return nil
+	})
+	return ret
+}
+
+// =====================================================================================
+// Notification code
+// =====================================================================================
+
+// NotificationType says what happened to the recipient of a notification.
+type NotificationType uint8
+
+const (
+	NotificationTypeUnset               NotificationType = 0
+	NotificationTypeBasicTransfer       NotificationType = 1
+	NotificationTypeLike                NotificationType = 2
+	NotificationTypeFollow              NotificationType = 3
+	NotificationTypeComment             NotificationType = 4
+	NotificationTypeReclout             NotificationType = 5
+	NotificationTypeDiamond             NotificationType = 6
+	NotificationTypeCreatorCoin         NotificationType = 7
+	NotificationTypeCreatorCoinTransfer NotificationType = 8
+	NotificationTypePrivateMessage      NotificationType = 9
+)
+
+func (nt NotificationType) String() string {
+	switch nt {
+	case NotificationTypeBasicTransfer:
+		return "BASIC_TRANSFER"
+	case NotificationTypeLike:
+		return "LIKE"
+	case NotificationTypeFollow:
+		return "FOLLOW"
+	case NotificationTypeComment:
+		return "COMMENT"
+	case NotificationTypeReclout:
+		return "RECLOUT"
+	case NotificationTypeDiamond:
+		return "DIAMOND"
+	case NotificationTypeCreatorCoin:
+		return "CREATOR_COIN"
+	case NotificationTypeCreatorCoinTransfer:
+		return "CREATOR_COIN_TRANSFER"
+	case NotificationTypePrivateMessage:
+		return "PRIVATE_MESSAGE"
+	default:
+		return "UNSET"
+	}
+}
+
+// NotificationEntry is a txn in a block on the main chain that affected
+// RecipientPKID. ActorPublicKey is the public key that signed the txn.
+type NotificationEntry struct {
+	RecipientPKID  *PKID
+	TstampNanos    uint64
+	Type           NotificationType
+	TxID           *BlockHash
+	ActorPublicKey []byte
+	// PostHash is set for notifications about a post, like likes and comments.
+	PostHash *BlockHash
+	// AmountNanos is set for notifications that move BitClout or creator coins.
+	AmountNanos uint64
+}
+
+func _dbKeyForNotification(recipientPKID *PKID, tstampNanos uint64,
+	notificationType NotificationType, txID *BlockHash) []byte {
+
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixPKIDTstampTypeTxIDToNotification...)
+	key = append(key, recipientPKID[:]...)
+	key = append(key, EncodeUint64(tstampNanos)...)
+	key = append(key, byte(notificationType))
+	return append(key, txID[:]...)
+}
+
+func _dbKeyForTxIDNotificationKeys(txID *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixTxIDToNotificationKeys...)
+	return append(key, txID[:]...)
+}
+
+// _posterForPostHashWithTxn returns nil if the post doesn't exist.
+func _posterForPostHashWithTxn(txn KVTxn, postHash *BlockHash) []byte {
+	postEntry := DBGetPostEntryByPostHashWithTxn(txn, postHash)
+	if postEntry == nil {
+		return nil
+	}
+	return postEntry.PosterPublicKey
+}
+
+// _notificationsForTxnWithTxn returns the notifications a txn generates, keyed
+// by the recipient's public key. It must be called after the block's utxo view
+// has been flushed so the posts the txn refers to can be found.
+func _notificationsForTxnWithTxn(txn KVTxn, bitcloutTxn *MsgBitCloutTxn,
+	tstampNanos uint64) []*NotificationEntry {
+
+	notifications := []*NotificationEntry{}
+	addNotification := func(recipientPublicKey []byte, notificationType NotificationType,
+		postHash *BlockHash, amountNanos uint64) {
+
+		// Nobody needs to be told about what they did themselves.
+		if len(recipientPublicKey) == 0 || bytes.Equal(recipientPublicKey, bitcloutTxn.PublicKey) {
+			return
+		}
+		// The recipient is resolved to a PKID when the notification is stored.
+		notifications = append(notifications, &NotificationEntry{
+			RecipientPKID:  PublicKeyToPKID(recipientPublicKey),
+			TstampNanos:    tstampNanos,
+			Type:           notificationType,
+			ActorPublicKey: bitcloutTxn.PublicKey,
+			PostHash:       postHash,
+			AmountNanos:    amountNanos,
+		})
+	}
+
+	switch txMeta := bitcloutTxn.TxnMeta.(type) {
+	case *BasicTransferMetadata:
+		for _, output := range bitcloutTxn.TxOutputs {
+			addNotification(output.PublicKey, NotificationTypeBasicTransfer, nil, output.AmountNanos)
+		}
+
+	case *PrivateMessageMetadata:
+		addNotification(txMeta.RecipientPublicKey, NotificationTypePrivateMessage, nil, 0)
+
+	case *LikeMetadata:
+		if !txMeta.IsUnlike {
+			addNotification(_posterForPostHashWithTxn(txn, txMeta.LikedPostHash),
+				NotificationTypeLike, txMeta.LikedPostHash, 0)
+		}
+
+	case *FollowMetadata:
+		if !txMeta.IsUnfollow {
+			addNotification(txMeta.FollowedPublicKey, NotificationTypeFollow, nil, 0)
+		}
+
+	case *SubmitPostMetadata:
+		// Edits don't notify anyone.
+		if len(txMeta.PostHashToModify) != 0 {
+			break
+		}
+		postHash := bitcloutTxn.Hash()
+		if len(txMeta.ParentStakeID) == HashSizeBytes {
+			parentPostHash := &BlockHash{}
+			copy(parentPostHash[:], txMeta.ParentStakeID)
+			addNotification(_posterForPostHashWithTxn(txn, parentPostHash),
+				NotificationTypeComment, postHash, 0)
+		} else if len(txMeta.ParentStakeID) == btcec.PubKeyBytesLenCompressed {
+			// A comment on a profile.
+			addNotification(txMeta.ParentStakeID, NotificationTypeComment, postHash, 0)
+		}
+		if recloutedPostHashBytes, isReclout := bitcloutTxn.ExtraData[RecloutedPostHash]; isReclout &&
+			len(recloutedPostHashBytes) == HashSizeBytes {
+
+			recloutedPostHash := &BlockHash{}
+			copy(recloutedPostHash[:], recloutedPostHashBytes)
+			addNotification(_posterForPostHashWithTxn(txn, recloutedPostHash),
+				NotificationTypeReclout, postHash, 0)
+		}
+
+	case *CreatorCoinMetadataa:
+		addNotification(txMeta.ProfilePublicKey, NotificationTypeCreatorCoin, nil, 0)
+
+	case *CreatorCoinTransferMetadataa:
+		// Diamonds are creator coin transfers that point at a post.
+		if diamondPostHashBytes, hasDiamondPostHash := bitcloutTxn.ExtraData[DiamondPostHashKey]; hasDiamondPostHash &&
+			len(diamondPostHashBytes) == HashSizeBytes {
+
+			diamondPostHash := &BlockHash{}
+			copy(diamondPostHash[:], diamondPostHashBytes)
+			addNotification(txMeta.ReceiverPublicKey, NotificationTypeDiamond,
+				diamondPostHash, txMeta.CreatorCoinToTransferNanos)
+		} else {
+			addNotification(txMeta.ReceiverPublicKey, NotificationTypeCreatorCoinTransfer,
+				nil, txMeta.CreatorCoinToTransferNanos)
+		}
+	}
+
+	return notifications
+}
+
+// DbPutNotificationsForBlockWithTxn adds a notification for every recipient of
+// the block's txns. Each txn also records the keys it added so the block can be
+// disconnected even if a recipient's PKID changes in the meantime.
+func DbPutNotificationsForBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
+	tstampNanos := uint64(bitcloutBlock.Header.TstampSecs) * 1e9
+	for _, bitcloutTxn := range bitcloutBlock.Txns {
+		notifications := _notificationsForTxnWithTxn(txn, bitcloutTxn, tstampNanos)
+		if len(notifications) == 0 {
+			continue
+		}
+
+		txID := bitcloutTxn.Hash()
+		notificationKeys := [][]byte{}
+		for _, notification := range notifications {
+			if pkidEntry := DBGetPKIDEntryForPublicKeyWithTxn(txn, notification.RecipientPKID[:]); pkidEntry != nil {
+				notification.RecipientPKID = pkidEntry.PKID
+			}
+			notification.TxID = txID
+
+			entryBuf := bytes.NewBuffer([]byte{})
+			gob.NewEncoder(entryBuf).Encode(notification)
+			notificationKey := _dbKeyForNotification(
+				notification.RecipientPKID, notification.TstampNanos, notification.Type, txID)
+			if err := txn.Set(notificationKey, entryBuf.Bytes()); err != nil {
+				return errors.Wrapf(err, "DbPutNotificationsForBlockWithTxn: Problem "+
+					"adding notification for txn %v", txID)
+			}
+			notificationKeys = append(notificationKeys, notificationKey)
+		}
+
+		keysBuf := bytes.NewBuffer([]byte{})
+		gob.NewEncoder(keysBuf).Encode(notificationKeys)
+		if err := txn.Set(_dbKeyForTxIDNotificationKeys(txID), keysBuf.Bytes()); err != nil {
+			return errors.Wrapf(err, "DbPutNotificationsForBlockWithTxn: Problem "+
+				"adding notification keys for txn %v", txID)
+		}
+	}
+	return nil
+}
+
+// DbDeleteNotificationsForBlockWithTxn removes the notifications added when the
+// block was connected.
+func DbDeleteNotificationsForBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
+	for _, bitcloutTxn := range bitcloutBlock.Txns {
+		txID := bitcloutTxn.Hash()
+		valBytes, err := txn.Get(_dbKeyForTxIDNotificationKeys(txID))
+		if err == ErrKVKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return _wrapDbError(err, "DbDeleteNotificationsForBlockWithTxn: Problem "+
+				"fetching notification keys for txn %v", txID)
+		}
+		notificationKeys := [][]byte{}
+		err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(&notificationKeys)
+		if err != nil {
+			return _corruptDbEntryError(err, "DbDeleteNotificationsForBlockWithTxn: Problem "+
+				"decoding notification keys for txn %v", txID)
+		}
+
+		for _, notificationKey := range notificationKeys {
+			if err := txn.Delete(notificationKey); err != nil {
+				return errors.Wrapf(err, "DbDeleteNotificationsForBlockWithTxn: Problem "+
+					"deleting notification for txn %v", txID)
+			}
+		}
+		if err := txn.Delete(_dbKeyForTxIDNotificationKeys(txID)); err != nil {
+			return errors.Wrapf(err, "DbDeleteNotificationsForBlockWithTxn: Problem "+
+				"deleting notification keys for txn %v", txID)
+		}
+	}
+	return nil
+}
+
+// DbGetNotificationsForPKID returns up to limit of the PKID's notifications from
+// newest to oldest, starting right before beforeTstampNanos. A limit of zero
+// returns all of them and a beforeTstampNanos of zero starts from the newest. If
+// types is non-empty only notifications of those types are returned.
+func DbGetNotificationsForPKID(handle *badger.DB, pkid *PKID, limit int,
+	beforeTstampNanos uint64, types []NotificationType) (_notifications []*NotificationEntry, _err error) {
+
+	prefix := append([]byte{}, _PrefixPKIDTstampTypeTxIDToNotification...)
+	prefix = append(prefix, pkid[:]...)
+
+	typesToInclude := make(map[NotificationType]bool)
+	for _, notificationType := range types {
+		typesToInclude[notificationType] = true
+	}
+
+	dbIter := NewDBIterator(handle, prefix, true /*reverse*/, true /*fetchValues*/)
+	defer dbIter.Close()
+	if beforeTstampNanos != 0 {
+		// Seeking to the tstamp just before makes the start exclusive.
+		dbIter.Seek(append(append([]byte{}, prefix...), EncodeUint64(beforeTstampNanos-1)...))
+	}
+
+	notifications := []*NotificationEntry{}
+	for (limit == 0 || len(notifications) < limit) && dbIter.Next() {
+		// The type comes right after the tstamp so it can be checked without
+		// decoding the value.
+		key := dbIter.Key()
+		notificationType := NotificationType(key[len(prefix)+8])
+		if len(typesToInclude) != 0 && !typesToInclude[notificationType] {
+			continue
+		}
+
+		notification := &NotificationEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(dbIter.Value())).Decode(notification); err != nil {
+			return nil, _corruptDbEntryError(err, "DbGetNotificationsForPKID: Problem decoding value")
+		}
+		notifications = append(notifications, notification)
+	}
+	if dbIter.Err() != nil {
+		return nil, errors.Wrapf(dbIter.Err(), "DbGetNotificationsForPKID: ")
+	}
+
+	return notifications, nil
+}
+
+// =====================================================================================
+// Diamond time index code
+// =====================================================================================
+
+func _dbKeyForDiamondTimeIndex(receiverPKID *PKID, tstampNanos uint64,
+	senderPKID *PKID, postHash *BlockHash) []byte {
+
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixReceiverPKIDTstampSenderPKIDPostHashToDiamond...)
+	key = append(key, receiverPKID[:]...)
+	key = append(key, EncodeUint64(tstampNanos)...)
+	key = append(key, senderPKID[:]...)
+	return append(key, postHash[:]...)
+}
+
+func _dbKeyForTxIDDiamondTimeKey(txID *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixTxIDToDiamondTimeKey...)
+	return append(key, txID[:]...)
+}
+
+// _diamondEntryForTxnWithTxn returns the diamond a txn gives, or nil if it
+// doesn't give one. It must be called after the block's utxo view has been
+// flushed so the PKIDs are the ones the txn was connected with.
+func _diamondEntryForTxnWithTxn(txn KVTxn, bitcloutTxn *MsgBitCloutTxn) *DiamondEntry {
+	txMeta, isCreatorCoinTransfer := bitcloutTxn.TxnMeta.(*CreatorCoinTransferMetadataa)
+	if !isCreatorCoinTransfer {
+		return nil
+	}
+	diamondPostHashBytes, hasDiamondPostHash := bitcloutTxn.ExtraData[DiamondPostHashKey]
+	diamondLevelBytes, hasDiamondLevel := bitcloutTxn.ExtraData[DiamondLevelKey]
+	if !hasDiamondPostHash || !hasDiamondLevel || len(diamondPostHashBytes) != HashSizeBytes {
+		return nil
+	}
+	diamondLevel, bytesRead := Varint(diamondLevelBytes)
+	if bytesRead <= 0 {
+		return nil
+	}
+	diamondPostHash := &BlockHash{}
+	copy(diamondPostHash[:], diamondPostHashBytes)
+
+	pkidForPublicKey := func(publicKey []byte) *PKID {
+		if pkidEntry := DBGetPKIDEntryForPublicKeyWithTxn(txn, publicKey); pkidEntry != nil {
+			return pkidEntry.PKID
+		}
+		return PublicKeyToPKID(publicKey)
+	}
+	return &DiamondEntry{
+		SenderPKID:      pkidForPublicKey(bitcloutTxn.PublicKey),
+		ReceiverPKID:    pkidForPublicKey(txMeta.ReceiverPublicKey),
+		DiamondPostHash: diamondPostHash,
+		DiamondLevel:    diamondLevel,
+	}
+}
+
+// DbPutDiamondTimeIndexForBlockWithTxn adds the diamonds given by the block's
+// txns to the diamond time index, using the block's tstamp. It has to be called
+// after the block's utxo view is flushed.
+func DbPutDiamondTimeIndexForBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
+	tstampNanos := uint64(bitcloutBlock.Header.TstampSecs) * 1e9
+	for _, bitcloutTxn := range bitcloutBlock.Txns {
+		diamondEntry := _diamondEntryForTxnWithTxn(txn, bitcloutTxn)
+		if diamondEntry == nil {
+			continue
+		}
+
+		txID := bitcloutTxn.Hash()
+		diamondKey := _dbKeyForDiamondTimeIndex(diamondEntry.ReceiverPKID, tstampNanos,
+			diamondEntry.SenderPKID, diamondEntry.DiamondPostHash)
+		if err := txn.Set(diamondKey, _DbBufForDiamondEntry(diamondEntry)); err != nil {
+			return errors.Wrapf(err, "DbPutDiamondTimeIndexForBlockWithTxn: Problem "+
+				"adding diamond for txn %v", txID)
+		}
+		if err := txn.Set(_dbKeyForTxIDDiamondTimeKey(txID), diamondKey); err != nil {
+			return errors.Wrapf(err, "DbPutDiamondTimeIndexForBlockWithTxn: Problem "+
+				"adding diamond key for txn %v", txID)
+		}
+	}
+	return nil
+}
+
+// DbDeleteDiamondTimeIndexForBlockWithTxn removes the diamonds added when the
+// block was connected.
+func DbDeleteDiamondTimeIndexForBlockWithTxn(txn KVTxn, bitcloutBlock *MsgBitCloutBlock) error {
+	for _, bitcloutTxn := range bitcloutBlock.Txns {
+		txID := bitcloutTxn.Hash()
+		diamondKey, err := txn.Get(_dbKeyForTxIDDiamondTimeKey(txID))
+		if err == ErrKVKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return _wrapDbError(err, "DbDeleteDiamondTimeIndexForBlockWithTxn: Problem "+
+				"fetching diamond key for txn %v", txID)
+		}
+
+		if err := txn.Delete(diamondKey); err != nil {
+			return errors.Wrapf(err, "DbDeleteDiamondTimeIndexForBlockWithTxn: Problem "+
+				"deleting diamond for txn %v", txID)
+		}
+		if err := txn.Delete(_dbKeyForTxIDDiamondTimeKey(txID)); err != nil {
+			return errors.Wrapf(err, "DbDeleteDiamondTimeIndexForBlockWithTxn: Problem "+
+				"deleting diamond key for txn %v", txID)
+		}
+	}
+	return nil
+}
+
+// ReceivedDiamond is a diamond given to a PKID along with the tstamp of the
+// block that gave it.
+type ReceivedDiamond struct {
+	DiamondEntry *DiamondEntry
+	TstampNanos  uint64
+}
+
+// DbGetRecentDiamondsReceived returns up to limit of the diamonds the PKID
+// received from newest to oldest, starting right before beforeTstampNanos. A
+// limit of zero returns all of them and a beforeTstampNanos of zero starts from
+// the newest. Only diamonds connected since the index was added are returned.
+func DbGetRecentDiamondsReceived(handle *badger.DB, receiverPKID *PKID, limit int,
+	beforeTstampNanos uint64) (_diamonds []*ReceivedDiamond, _err error) {
+
+	prefix := append([]byte{}, _PrefixReceiverPKIDTstampSenderPKIDPostHashToDiamond...)
+	prefix = append(prefix, receiverPKID[:]...)
+
+	dbIter := NewDBIterator(handle, prefix, true /*reverse*/, true /*fetchValues*/)
+	defer dbIter.Close()
+	if beforeTstampNanos != 0 {
+		// Seeking to the tstamp just before makes the start exclusive.
+		dbIter.Seek(append(append([]byte{}, prefix...), EncodeUint64(beforeTstampNanos-1)...))
+	}
+
+	diamonds := []*ReceivedDiamond{}
+	for (limit == 0 || len(diamonds) < limit) && dbIter.Next() {
+		diamondEntry := _DbDiamondEntryForDbBuf(dbIter.Value())
+		if diamondEntry == nil {
+			return nil, _corruptDbEntryError(fmt.Errorf("empty or undecodable entry"),
+				"DbGetRecentDiamondsReceived: Problem decoding value")
+		}
+		diamonds = append(diamonds, &ReceivedDiamond{
+			DiamondEntry: diamondEntry,
+			TstampNanos:  DecodeUint64(dbIter.Key()[len(prefix) : len(prefix)+8]),
+		})
+	}
+	if dbIter.Err() != nil {
+		return nil, errors.Wrapf(dbIter.Err(), "DbGetRecentDiamondsReceived: ")
+	}
+
+	return diamonds, nil
+}
+
+// =====================================================================================
+// Fork activation code
+// =====================================================================================
+
+// ForkSignalPrefix is what a block producer puts in the ExtraData of a block
+// reward, followed by a fork's name, to signal support for the fork. Several
+// signals are separated by ForkSignalSeparator, e.g. "fork:polls,fork:derived-keys".
+// Signals are only counted; they don't change when a fork activates.
+const (
+	ForkSignalPrefix    = "fork:"
+	ForkSignalSeparator = ","
+)
+
+// ForkState is the db's view of a ProtocolFork.
+type ForkState struct {
+	Name             string
+	ActivationHeight uint32
+
+	// The number of blocks on the main chain that have signaled for the fork.
+	SignalCount uint64
+	// Set once SignalCount includes the blocks that were already on the main
+	// chain when the fork was added to the db.
+	SignalsBackfilled bool
+	// The hash of the main chain block at ActivationHeight, or nil if the chain
+	// hasn't gotten there yet.
+	ActivationBlockHash *BlockHash
+}
+
+func _dbKeyForForkState(forkName string) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixForkNameToForkState...)
+	return append(prefixCopy, []byte(forkName)...)
+}
+
+func DbPutForkStateWithTxn(txn KVTxn, forkState *ForkState) error {
+	forkStateBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(forkStateBuf).Encode(forkState); err != nil {
+		return errors.Wrapf(err, "DbPutForkStateWithTxn: Problem encoding fork state")
+	}
+	return txn.Set(_dbKeyForForkState(forkState.Name), forkStateBuf.Bytes())
+}
+
+func DbGetForkStateWithTxn(txn KVTxn, forkName string) *ForkState {
+	key := _dbKeyForForkState(forkName)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	forkStateObj := &ForkState{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(forkStateObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetForkStateWithTxn: Problem decoding fork state for %v: %v", forkName, err)
+		return nil
+	}
+	return forkStateObj
+}
+
+func DbGetForkState(handle *badger.DB, forkName string) *ForkState {
+	var forkState *ForkState
+	DbView(handle, func(txn KVTxn) error {
+		forkState = DbGetForkStateWithTxn(txn, forkName)
+		return nil
+	})
+	return forkState
+}
+
+// DbGetForkStates returns the state of every fork in the db ordered by name.
+func DbGetForkStates(handle *badger.DB) ([]*ForkState, error) {
+	forkStates := []*ForkState{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixForkNameToForkState, func(_ []byte, valBytes []byte) (bool, error) {
+		forkStateObj := &ForkState{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(forkStateObj); err != nil {
+			return false, _corruptDbEntryError(err, "DbGetForkStates: Problem decoding fork state")
+		}
+		forkStates = append(forkStates, forkStateObj)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return forkStates, nil
+}
+
+// DbGetForkActivationHeight returns the height at which the fork activates. It
+// returns an error if the fork isn't in the db, which usually means it's missing
+// from the params.
+func DbGetForkActivationHeight(handle *badger.DB, forkName string) (uint32, error) {
+	forkState := DbGetForkState(handle, forkName)
+	if forkState == nil {
+		return 0, fmt.Errorf("DbGetForkActivationHeight: Unknown fork %v", forkName)
+	}
+	return forkState.ActivationHeight, nil
+}
+
+// DbIsForkActive returns true if the fork applies to a block at blockHeight. It
+// returns an error if the fork isn't in the db, which usually means it's missing
+// from the params.
+func DbIsForkActive(handle *badger.DB, forkName string, blockHeight uint32) (bool, error) {
+	activationHeight, err := DbGetForkActivationHeight(handle, forkName)
+	if err != nil {
+		return false, errors.Wrapf(err, "DbIsForkActive: ")
+	}
+	return blockHeight >= activationHeight, nil
+}
+
+// DbInitForkStates writes the forks in the params to the db. Forks that are
+// already in the db keep their signal counts, but take the activation height from
+// the params in case a new release moved it. The activation block is taken from
+// bestChain, which must be the main chain currently in the db. Forks that are new
+// to the db start with the signals already counted for them, so a fork's signals
+// count even if it was added to the params after they were mined. This should be
+// called at startup before any blocks are connected.
+func DbInitForkStates(handle *badger.DB, params *BitCloutParams, bestChain []*BlockNode) error {
+	if err := _dbBackfillForkSignalCounts(handle, bestChain); err != nil {
+		return errors.Wrapf(err, "DbInitForkStates: ")
+	}
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		for _, protocolFork := range params.GetProtocolForks() {
+			forkState := DbGetForkStateWithTxn(txn, protocolFork.Name)
+			if forkState == nil {
+				forkState = &ForkState{Name: protocolFork.Name}
+			}
+			forkState.ActivationHeight = protocolFork.ActivationHeight
+			forkState.ActivationBlockHash = nil
+			if int(protocolFork.ActivationHeight) < len(bestChain) {
+				forkState.ActivationBlockHash = bestChain[protocolFork.ActivationHeight].Hash
+			}
+			if !forkState.SignalsBackfilled {
+				forkState.SignalCount = DbGetForkSignalCountWithTxn(txn, forkState.Name)
+				forkState.SignalsBackfilled = true
+			}
+			if err := DbPutForkStateWithTxn(txn, forkState); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func _dbKeyForForkSignalCount(forkName string) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixForkNameToSignalCount...)
+	return append(prefixCopy, []byte(forkName)...)
+}
+
+// DbGetForkSignalCountWithTxn returns the number of main chain blocks that have
+// signaled for the fork, whether or not the fork is in the params.
+func DbGetForkSignalCountWithTxn(txn KVTxn, forkName string) uint64 {
+	key := _dbKeyForForkSignalCount(forkName)
+	countBytes, err := txn.Get(key)
+	if err != nil {
+		return 0
+	}
+	if len(countBytes) != 8 {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetForkSignalCountWithTxn: Problem reading signal count for %v", forkName)
+		return 0
+	}
+	return DecodeUint64(countBytes)
+}
+
+func _dbPutForkSignalCountWithTxn(txn KVTxn, forkName string, signalCount uint64) error {
+	if signalCount == 0 {
+		return txn.Delete(_dbKeyForForkSignalCount(forkName))
+	}
+	return txn.Set(_dbKeyForForkSignalCount(forkName), EncodeUint64(signalCount))
+}
+
+// forkSignalCountsMigrationName marks whether the signals of the blocks that
+// were on the main chain before signal counts were kept have been counted.
+const forkSignalCountsMigrationName = "fork-signal-counts"
+
+// _dbBackfillForkSignalCounts counts the signals of the blocks on bestChain the
+// first time a db is started with a version that keeps signal counts. After
+// that the counts are kept up to date by DbUpdateForkStatesForBlockWithTxn.
+func _dbBackfillForkSignalCounts(handle *badger.DB, bestChain []*BlockNode) error {
+	if DbGetIndexMigrationState(handle, forkSignalCountsMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return nil
+	}
+
+	signalCounts, numMissingBlocks, err := _countForkSignals(handle, bestChain)
+	if err != nil {
+		return errors.Wrapf(err, "_dbBackfillForkSignalCounts: ")
+	}
+	if numMissingBlocks > 0 {
+		glog.Warningf("_dbBackfillForkSignalCounts: Skipped %d main chain blocks that "+
+			"aren't in the db when counting fork signals", numMissingBlocks)
+	}
+	return DbUpdate(handle, func(txn KVTxn) error {
+		for forkName, signalCount := range signalCounts {
+			if err := _dbPutForkSignalCountWithTxn(txn, forkName, signalCount); err != nil {
+				return err
+			}
+		}
+		return DbPutIndexMigrationStateWithTxn(
+			txn, forkSignalCountsMigrationName, IndexMigrationStateBackfillComplete)
+	})
+}
+
+// _countForkSignals returns the number of blocks on bestChain that signal for
+// each fork, along with the number of blocks that were skipped because they
+// aren't in the db, e.g. because they were pruned. The genesis block is never
+// counted.
+func _countForkSignals(handle *badger.DB, bestChain []*BlockNode) (
+	_signalCounts map[string]uint64, _numMissingBlocks int, _err error) {
+
+	signalCounts := make(map[string]uint64)
+	numMissingBlocks := 0
+	for ii := 1; ii < len(bestChain); ii++ {
+		block, err := GetBlock(bestChain[ii].Hash, handle)
+		if errors.Is(err, ErrEntryNotFound) {
+			numMissingBlocks++
+			continue
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "_countForkSignals: Problem fetching block %v",
+				bestChain[ii].Hash)
+		}
+		for forkName := range _blockForkSignals(block) {
+			signalCounts[forkName]++
+		}
+	}
+	return signalCounts, numMissingBlocks, nil
+}
+
+// _blockForkSignals returns the names of the forks the block's reward signals
+// for in its ExtraData. A signal only counts once per block, and has to start
+// with ForkSignalPrefix exactly so e.g. "miner:polls" isn't a signal for polls.
+func _blockForkSignals(block *MsgBitCloutBlock) map[string]bool {
+	forkNames := make(map[string]bool)
+	if len(block.Txns) == 0 {
+		return forkNames
+	}
+	blockRewardMeta, ok := block.Txns[0].TxnMeta.(*BlockRewardMetadataa)
+	if !ok {
+		return forkNames
+	}
+	for _, signal := range strings.Split(string(blockRewardMeta.ExtraData), ForkSignalSeparator) {
+		signal = strings.TrimSpace(signal)
+		if !strings.HasPrefix(signal, ForkSignalPrefix) || len(signal) == len(ForkSignalPrefix) {
+			continue
+		}
+		forkNames[strings.TrimPrefix(signal, ForkSignalPrefix)] = true
+	}
+	return forkNames
+}
+
+// DbUpdateForkStatesForBlockWithTxn counts the block's fork signals and records
+// it as the activation block of any fork that activates at its height. When
+// isConnect is false the block is being disconnected and both are undone.
+func DbUpdateForkStatesForBlockWithTxn(txn KVTxn, block *MsgBitCloutBlock, isConnect bool) error {
+	blockHash, err := block.Header.Hash()
+	if err != nil {
+		return errors.Wrapf(err, "DbUpdateForkStatesForBlockWithTxn: Problem hashing block")
+	}
+
+	forkSignals := _blockForkSignals(block)
+	for forkName := range forkSignals {
+		signalCount := DbGetForkSignalCountWithTxn(txn, forkName)
+		if isConnect {
+			signalCount++
+		} else if signalCount > 0 {
+			signalCount--
+		}
+		if err := _dbPutForkSignalCountWithTxn(txn, forkName, signalCount); err != nil {
+			return err
+		}
+	}
+
+	forkKeys, forkVals, err := _enumerateKeysForPrefixWithTxn(txn, _PrefixForkNameToForkState)
+	if err != nil {
+		return errors.Wrapf(err, "DbUpdateForkStatesForBlockWithTxn: Problem fetching fork states")
+	}
+	for ii := range forkKeys {
+		forkState := &ForkState{}
+		if err := gob.NewDecoder(bytes.NewReader(forkVals[ii])).Decode(forkState); err != nil {
+			return _corruptDbEntryError(err, "DbUpdateForkStatesForBlockWithTxn: Problem decoding fork state")
+		}
+
+		if forkSignals[forkState.Name] {
+			if isConnect {
+				forkState.SignalCount++
+			} else if forkState.SignalCount > 0 {
+				forkState.SignalCount--
+			}
+		}
+		if block.Header.Height == uint64(forkState.ActivationHeight) {
+			if isConnect {
+				forkState.ActivationBlockHash = blockHash
+			} else {
+				forkState.ActivationBlockHash = nil
+			}
+		}
+
+		if err := DbPutForkStateWithTxn(txn, forkState); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// =====================================================================================
+// Released username code
+// =====================================================================================
+func _dbKeyForReleasedUsername(nonLowercaseUsername []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixReleasedUsernameToReleasedUsernameEntry...)
+	// Always lowercase the username when we use it as a key in the db. This
+	// keeps it consistent with the username -> PKID mapping.
+	return append(prefixCopy, []byte(strings.ToLower(string(nonLowercaseUsername)))...)
+}
+
+func DbPutReleasedUsernameEntryWithTxn(txn KVTxn, releasedUsernameEntry *ReleasedUsernameEntry) error {
+	entryBuf := bytes.NewBuffer([]byte{})
+	gob.NewEncoder(entryBuf).Encode(releasedUsernameEntry)
+
+	if err := txn.Set(_dbKeyForReleasedUsername(releasedUsernameEntry.Username), entryBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "DbPutReleasedUsernameEntryWithTxn: Problem adding "+
+			"mapping for username %v", string(releasedUsernameEntry.Username))
+	}
+	return nil
+}
+
+func DbGetReleasedUsernameEntryWithTxn(txn KVTxn, nonLowercaseUsername []byte) *ReleasedUsernameEntry {
+	key := _dbKeyForReleasedUsername(nonLowercaseUsername)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	releasedUsernameEntry := &ReleasedUsernameEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(releasedUsernameEntry)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetReleasedUsernameEntryWithTxn: Problem reading "+
+			"ReleasedUsernameEntry for username %v", string(nonLowercaseUsername))
+		return nil
+	}
+	return releasedUsernameEntry
+}
+
+func DbGetReleasedUsernameEntry(db *badger.DB, nonLowercaseUsername []byte) *ReleasedUsernameEntry {
+	var ret *ReleasedUsernameEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetReleasedUsernameEntryWithTxn(txn, nonLowercaseUsername)
+		return nil
+	})
+	return ret
+}
+
+func DbDeleteReleasedUsernameEntryWithTxn(txn KVTxn, nonLowercaseUsername []byte) error {
+	return txn.Delete(_dbKeyForReleasedUsername(nonLowercaseUsername))
+}
+
+// =====================================================================================
+// Poll code
+// =====================================================================================
+func _dbKeyForPollEntry(postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPostHashToPollEntry...)
+	return append(prefixCopy, postHash[:]...)
+}
+
+func _dbSeekPrefixForPollVoteCounts(postHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPostHashOptionIndexToPollVoteCount...)
+	return append(prefixCopy, postHash[:]...)
+}
+
+func _dbKeyForPollVoteCount(postHash *BlockHash, optionIndex uint64) []byte {
+	return append(_dbSeekPrefixForPollVoteCounts(postHash), EncodeUint64(optionIndex)...)
+}
+
+func _dbKeyForPollVote(postHash *BlockHash, voterPKID *PKID) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixPostHashVoterPKIDToPollVote...)
+	key := append(prefixCopy, postHash[:]...)
+	return append(key, voterPKID[:]...)
+}
+
+// DbPutPollEntryWithTxn writes the poll along with a vote count for each of
+// its options.
+func DbPutPollEntryWithTxn(txn KVTxn, pollEntry *PollEntry) error {
+	if len(pollEntry.VoteCounts) != len(pollEntry.Options) {
+		return fmt.Errorf("DbPutPollEntryWithTxn: Poll %v has %d vote counts "+
+			"for %d options", pollEntry.PostHash, len(pollEntry.VoteCounts), len(pollEntry.Options))
+	}
+
+	// The vote counts are stored separately so strip them from the definition.
+	pollDefinition := *pollEntry
+	pollDefinition.VoteCounts = nil
+	entryBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(entryBuf).Encode(&pollDefinition); err != nil {
+		return errors.Wrapf(err, "DbPutPollEntryWithTxn: Problem encoding poll %v", pollEntry.PostHash)
+	}
+	if err := txn.Set(_dbKeyForPollEntry(pollEntry.PostHash), entryBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "DbPutPollEntryWithTxn: Problem adding "+
+			"mapping for poll %v", pollEntry.PostHash)
+	}
+
+	for optionIndex, voteCount := range pollEntry.VoteCounts {
+		if err := txn.Set(_dbKeyForPollVoteCount(pollEntry.PostHash, uint64(optionIndex)),
+			EncodeUint64(voteCount)); err != nil {
+
+			return errors.Wrapf(err, "DbPutPollEntryWithTxn: Problem adding "+
+				"vote count for option %d of poll %v", optionIndex, pollEntry.PostHash)
+		}
+	}
+	return nil
+}
+
+// DbDeletePollEntryWithTxn removes the poll and its vote counts. It doesn't
+// touch the votes themselves.
+func DbDeletePollEntryWithTxn(txn KVTxn, pollEntry *PollEntry) error {
+	if err := txn.Delete(_dbKeyForPollEntry(pollEntry.PostHash)); err != nil {
+		return errors.Wrapf(err, "DbDeletePollEntryWithTxn: Problem deleting "+
+			"mapping for poll %v", pollEntry.PostHash)
+	}
+	for optionIndex := range pollEntry.Options {
+		if err := txn.Delete(_dbKeyForPollVoteCount(pollEntry.PostHash, uint64(optionIndex))); err != nil {
+			return errors.Wrapf(err, "DbDeletePollEntryWithTxn: Problem deleting "+
+				"vote count for option %d of poll %v", optionIndex, pollEntry.PostHash)
+		}
+	}
+	return nil
+}
+
+func _dbGetPollVoteCountsWithTxn(txn KVTxn, postHash *BlockHash) ([]uint64, error) {
+	_, valsFound, err := _enumerateKeysForPrefixWithTxn(txn, _dbSeekPrefixForPollVoteCounts(postHash))
+	if err != nil {
+		return nil, err
+	}
+	voteCounts := make([]uint64, 0, len(valsFound))
+	for _, valBytes := range valsFound {
+		if len(valBytes) != 8 {
+			return nil, _corruptDbEntryError(fmt.Errorf("vote count has length %d", len(valBytes)),
+				"_dbGetPollVoteCountsWithTxn: Problem decoding vote count for poll %v", postHash)
+		}
+		voteCounts = append(voteCounts, DecodeUint64(valBytes))
+	}
+	return voteCounts, nil
+}
+
+// DbGetPollEntryWithTxn returns the poll attached to the post, with its vote
+// counts filled in, or nil if the post doesn't have a poll.
+func DbGetPollEntryWithTxn(txn KVTxn, postHash *BlockHash) *PollEntry {
+	key := _dbKeyForPollEntry(postHash)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	pollEntry := &PollEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(pollEntry)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetPollEntryWithTxn: Problem reading PollEntry for post %v: %v", postHash, err)
+		return nil
+	}
+	pollEntry.VoteCounts, err = _dbGetPollVoteCountsWithTxn(txn, postHash)
+	if err != nil || len(pollEntry.VoteCounts) != len(pollEntry.Options) {
+		glog.Errorf("DbGetPollEntryWithTxn: Problem reading vote counts for post %v: "+
+			"%d counts for %d options: %v", postHash, len(pollEntry.VoteCounts), len(pollEntry.Options), err)
+		return nil
+	}
+	return pollEntry
+}
+
+func DbGetPollEntry(db *badger.DB, postHash *BlockHash) *PollEntry {
+	var ret *PollEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetPollEntryWithTxn(txn, postHash)
+		return nil
+	})
+	return ret
+}
+
+// DbGetPollResults returns the number of votes for each option of the poll
+// attached to the post, in the order the options were given when the poll
+// was created. It only reads the vote counts, not the poll itself. If the
+// post doesn't have a poll, the error wraps ErrEntryNotFound.
+func DbGetPollResults(db *badger.DB, postHash *BlockHash) ([]uint64, error) {
+	var voteCounts []uint64
+	err := DbView(db, func(txn KVTxn) error {
+		var err error
+		voteCounts, err = _dbGetPollVoteCountsWithTxn(txn, postHash)
+		return err
+	})
+	if err != nil {
+		return nil, _wrapDbError(err, "DbGetPollResults: Problem reading vote counts for post %v", postHash)
+	}
+	if len(voteCounts) == 0 {
+		return nil, _wrapDbError(ErrEntryNotFound, "DbGetPollResults: No poll for post %v", postHash)
+	}
+	return voteCounts, nil
+}
+
+func DbPutPollVoteEntryWithTxn(txn KVTxn, pollVoteEntry *PollVoteEntry) error {
+	if err := txn.Set(_dbKeyForPollVote(pollVoteEntry.PostHash, pollVoteEntry.VoterPKID),
+		EncodeUint64(pollVoteEntry.OptionIndex)); err != nil {
+
+		return errors.Wrapf(err, "DbPutPollVoteEntryWithTxn: Problem adding vote "+
+			"by %v in poll %v", PkToStringMainnet(pollVoteEntry.VoterPKID[:]), pollVoteEntry.PostHash)
+	}
+	return nil
+}
+
+func DbDeletePollVoteEntryWithTxn(txn KVTxn, pollVoteEntry *PollVoteEntry) error {
+	return txn.Delete(_dbKeyForPollVote(pollVoteEntry.PostHash, pollVoteEntry.VoterPKID))
+}
+
+// DbGetPollVoteEntryWithTxn returns the voter's vote in the poll attached to
+// the post, or nil if they haven't voted.
+func DbGetPollVoteEntryWithTxn(txn KVTxn, postHash *BlockHash, voterPKID *PKID) *PollVoteEntry {
+	key := _dbKeyForPollVote(postHash, voterPKID)
+	voteBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	if len(voteBytes) != 8 {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetPollVoteEntryWithTxn: Problem reading vote by %v in poll %v",
+			PkToStringMainnet(voterPKID[:]), postHash)
+		return nil
+	}
+	return &PollVoteEntry{
+		VoterPKID:   voterPKID,
+		PostHash:    postHash,
+		OptionIndex: DecodeUint64(voteBytes),
+	}
+}
+
+func DbGetPollVoteEntry(db *badger.DB, postHash *BlockHash, voterPKID *PKID) *PollVoteEntry {
+	var ret *PollVoteEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetPollVoteEntryWithTxn(txn, postHash, voterPKID)
+		return nil
+	})
+	return ret
+}
+
+// =====================================================================================
+// Derived key code
+// =====================================================================================
+
+func _dbSeekPrefixForDerivedKeyEntries(ownerPKID *PKID) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixOwnerPKIDDerivedPublicKeyToDerivedKeyEntry...)
+	return append(prefixCopy, ownerPKID[:]...)
+}
+
+func _dbKeyForDerivedKeyEntry(ownerPKID *PKID, derivedPublicKey []byte) []byte {
+	return append(_dbSeekPrefixForDerivedKeyEntries(ownerPKID), derivedPublicKey...)
+}
+
+func DbPutDerivedKeyEntryWithTxn(txn KVTxn, derivedKeyEntry *DerivedKeyEntry) error {
+	entryBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(entryBuf).Encode(derivedKeyEntry); err != nil {
+		return errors.Wrapf(err, "DbPutDerivedKeyEntryWithTxn: Problem encoding derived key %v",
+			PkToStringMainnet(derivedKeyEntry.DerivedPublicKey))
+	}
+	if err := txn.Set(_dbKeyForDerivedKeyEntry(
+		derivedKeyEntry.OwnerPKID, derivedKeyEntry.DerivedPublicKey), entryBuf.Bytes()); err != nil {
+
+		return errors.Wrapf(err, "DbPutDerivedKeyEntryWithTxn: Problem adding derived key %v",
+			PkToStringMainnet(derivedKeyEntry.DerivedPublicKey))
+	}
+	return nil
+}
+
+func DbDeleteDerivedKeyEntryWithTxn(txn KVTxn, derivedKeyEntry *DerivedKeyEntry) error {
+	return txn.Delete(_dbKeyForDerivedKeyEntry(derivedKeyEntry.OwnerPKID, derivedKeyEntry.DerivedPublicKey))
+}
+
+// DbGetDerivedKeyEntryWithTxn returns the owner's entry for the derived key,
+// or nil if the owner never authorized it.
+func DbGetDerivedKeyEntryWithTxn(txn KVTxn, ownerPKID *PKID, derivedPublicKey []byte) *DerivedKeyEntry {
+	key := _dbKeyForDerivedKeyEntry(ownerPKID, derivedPublicKey)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	derivedKeyEntry := &DerivedKeyEntry{}
+	err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(derivedKeyEntry)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetDerivedKeyEntryWithTxn: Problem reading derived key %v for owner %v: %v",
+			PkToStringMainnet(derivedPublicKey), PkToStringMainnet(ownerPKID[:]), err)
+		return nil
+	}
+	return derivedKeyEntry
+}
+
+func DbGetDerivedKeyEntry(db *badger.DB, ownerPKID *PKID, derivedPublicKey []byte) *DerivedKeyEntry {
+	var ret *DerivedKeyEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetDerivedKeyEntryWithTxn(txn, ownerPKID, derivedPublicKey)
+		return nil
+	})
+	return ret
+}
+
+// DbGetDerivedKeyEntriesForOwner returns every derived key the owner has
+// authorized, including expired and revoked ones.
+func DbGetDerivedKeyEntriesForOwner(db *badger.DB, ownerPKID *PKID) ([]*DerivedKeyEntry, error) {
+	_, valsFound := _enumerateKeysForPrefix(db, _dbSeekPrefixForDerivedKeyEntries(ownerPKID))
+	derivedKeyEntries := []*DerivedKeyEntry{}
+	for _, valBytes := range valsFound {
+		derivedKeyEntry := &DerivedKeyEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(derivedKeyEntry); err != nil {
+			return nil, _corruptDbEntryError(err,
+				"DbGetDerivedKeyEntriesForOwner: Problem decoding derived key for owner %v",
+				PkToStringMainnet(ownerPKID[:]))
+		}
+		derivedKeyEntries = append(derivedKeyEntries, derivedKeyEntry)
+	}
+	return derivedKeyEntries, nil
+}
+
+// =====================================================================================
+// Creator coin balance entry code
+// =====================================================================================
+func _dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) []byte {
+	key := append([]byte{}, _PrefixHODLerPKIDCreatorPKIDToBalanceEntry...)
+	key = append(key, hodlerPKID[:]...)
+	key = append(key, creatorPKID[:]...)
+	return key
+}
+func _dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creatorPKID *PKID, hodlerPKID *PKID) []byte {
+	key := append([]byte{}, _PrefixCreatorPKIDHODLerPKIDToBalanceEntry...)
+	key = append(key, creatorPKID[:]...)
+	key = append(key, hodlerPKID[:]...)
+	return key
+}
+
+func _dbKeyForHODLerPKIDBalanceNanosCreatorPKID(
+	hodlerPKID *PKID, balanceNanos uint64, creatorPKID *PKID) []byte {
+
+	key := append([]byte{}, _PrefixHODLerPKIDBalanceNanosCreatorPKID...)
+	key = append(key, hodlerPKID[:]...)
+	key = append(key, EncodeUint64(balanceNanos)...)
+	key = append(key, creatorPKID[:]...)
+	return key
+}
+func _dbKeyForCreatorPKIDBalanceNanosHODLerPKID(
+	creatorPKID *PKID, balanceNanos uint64, hodlerPKID *PKID) []byte {
+
+	key := append([]byte{}, _PrefixCreatorPKIDBalanceNanosHODLerPKID...)
+	key = append(key, creatorPKID[:]...)
+	key = append(key, EncodeUint64(math.MaxUint64-balanceNanos)...)
+	key = append(key, hodlerPKID[:]...)
+	return key
+}
+func _dbKeyForHoldingsCount(hodlerPKID *PKID) []byte {
+	key := append([]byte{}, _PrefixHODLerPKIDToHoldingsCount...)
+	key = append(key, hodlerPKID[:]...)
+	return key
+}
+
+// _dbUpdateBalanceIndexWithTxn moves a HODLer's entry in the balance index from
+// prevBalanceEntry to balanceEntry and adjusts their holdings count. Either may
+// be nil, and zero balances aren't indexed.
+func _dbUpdateBalanceIndexWithTxn(
+	txn KVTxn, prevBalanceEntry *BalanceEntry, balanceEntry *BalanceEntry) error {
+
+	delta := int64(0)
+	if prevBalanceEntry != nil && prevBalanceEntry.BalanceNanos > 0 {
+		if err := txn.Delete(_dbKeyForHODLerPKIDBalanceNanosCreatorPKID(
+			prevBalanceEntry.HODLerPKID, prevBalanceEntry.BalanceNanos,
+			prevBalanceEntry.CreatorPKID)); err != nil {
+
+			return errors.Wrapf(err, "_dbUpdateBalanceIndexWithTxn: Problem deleting "+
+				"index entry for %v %v", PkToStringBoth(prevBalanceEntry.HODLerPKID[:]),
+				PkToStringBoth(prevBalanceEntry.CreatorPKID[:]))
+		}
+		delta--
+	}
+	if balanceEntry != nil && balanceEntry.BalanceNanos > 0 {
+		if err := txn.Set(_dbKeyForHODLerPKIDBalanceNanosCreatorPKID(
+			balanceEntry.HODLerPKID, balanceEntry.BalanceNanos,
+			balanceEntry.CreatorPKID), []byte{}); err != nil {
+
+			return errors.Wrapf(err, "_dbUpdateBalanceIndexWithTxn: Problem adding "+
+				"index entry for %v %v", PkToStringBoth(balanceEntry.HODLerPKID[:]),
+				PkToStringBoth(balanceEntry.CreatorPKID[:]))
+		}
+		delta++
+	}
+	if delta == 0 {
+		return nil
+	}
+
+	var hodlerPKID *PKID
+	if balanceEntry != nil {
+		hodlerPKID = balanceEntry.HODLerPKID
+	} else {
+		hodlerPKID = prevBalanceEntry.HODLerPKID
+	}
+	if err := _dbAddToCountWithTxn(txn, _dbKeyForHoldingsCount(hodlerPKID), delta); err != nil {
+		return errors.Wrapf(err, "_dbUpdateBalanceIndexWithTxn: Problem updating "+
+			"holdings count for %v", PkToStringBoth(hodlerPKID[:]))
+	}
+	return nil
+}
+
+// _dbUpdateTopHoldersIndexWithTxn moves a HODLer's entry in the creator's top
+// holders index from prevBalanceEntry to balanceEntry. Either may be nil, and
+// zero balances aren't indexed.
+func _dbUpdateTopHoldersIndexWithTxn(
+	txn KVTxn, prevBalanceEntry *BalanceEntry, balanceEntry *BalanceEntry) error {
+
+	if prevBalanceEntry != nil && prevBalanceEntry.BalanceNanos > 0 {
+		if err := txn.Delete(_dbKeyForCreatorPKIDBalanceNanosHODLerPKID(
+			prevBalanceEntry.CreatorPKID, prevBalanceEntry.BalanceNanos,
+			prevBalanceEntry.HODLerPKID)); err != nil {
+
+			return errors.Wrapf(err, "_dbUpdateTopHoldersIndexWithTxn: Problem deleting "+
+				"index entry for %v %v", PkToStringBoth(prevBalanceEntry.CreatorPKID[:]),
+				PkToStringBoth(prevBalanceEntry.HODLerPKID[:]))
+		}
+	}
+	if balanceEntry != nil && balanceEntry.BalanceNanos > 0 {
+		if err := txn.Set(_dbKeyForCreatorPKIDBalanceNanosHODLerPKID(
+			balanceEntry.CreatorPKID, balanceEntry.BalanceNanos,
+			balanceEntry.HODLerPKID), []byte{}); err != nil {
+
+			return errors.Wrapf(err, "_dbUpdateTopHoldersIndexWithTxn: Problem adding "+
+				"index entry for %v %v", PkToStringBoth(balanceEntry.CreatorPKID[:]),
+				PkToStringBoth(balanceEntry.HODLerPKID[:]))
+		}
+	}
+	return nil
+}
+
+func DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
+	txn KVTxn, hodlerPKID *PKID, creatorPKID *PKID) *BalanceEntry {
+
+	key := _dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(hodlerPKID, creatorPKID)
+	balanceEntryObj := &BalanceEntry{}
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	err = _DbDecodeBalanceEntry(valBytes, balanceEntryObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPubKeysWithTxn: Problem reading "+
+			"BalanceEntry for PKIDs %v %v",
+			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
+		return nil
+	}
+	return balanceEntryObj
+}
+
+func DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDs(
+	handle *badger.DB, hodlerPKID *PKID, creatorPKID *PKID) *BalanceEntry {
+
+	var ret *BalanceEntry
+	DbView(handle, func(txn KVTxn) error {
+		ret = DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
+			txn, hodlerPKID, creatorPKID)
+		return nil
+	})
+	return ret
+}
+
+func DBGetCreatorCoinBalanceEntryForCreatorPKIDAndHODLerPubKeyWithTxn(
+	txn KVTxn, creatorPKID *PKID, hodlerPKID *PKID) *BalanceEntry {
+
+	key := _dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creatorPKID, hodlerPKID)
+	balanceEntryObj := &BalanceEntry{}
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	err = _DbDecodeBalanceEntry(valBytes, balanceEntryObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DBGetCreatorCoinBalanceEntryForCreatorPubKeyAndHODLerPubKeyWithTxn: Problem reading "+
+			"BalanceEntry for PKIDs %v %v",
+			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
+		return nil
+	}
+	return balanceEntryObj
+}
+
+func DBDeleteCreatorCoinBalanceEntryMappingsWithTxn(
+	txn KVTxn, hodlerPKID *PKID, creatorPKID *PKID,
+	params *BitCloutParams) error {
+
+	// First pull up the mappings that exists for the keys passed in.
+	// If one doesn't exist then there's nothing to do.
+	balanceEntry := DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
+		txn, hodlerPKID, creatorPKID)
+	if balanceEntry == nil {
+		return nil
+	}
+
+	// When an entry exists, delete the mappings for it.
+	if err := txn.Delete(_dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(hodlerPKID, creatorPKID)); err != nil {
+		return errors.Wrapf(err, "DbDeleteCreatorCoinBalanceEntryMappingsWithTxn: Deleting "+
+			"mappings with keys: %v %v",
+			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
+	}
+	if err := txn.Delete(_dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creatorPKID, hodlerPKID)); err != nil {
+		return errors.Wrapf(err, "DbDeleteCreatorCoinBalanceEntryMappingsWithTxn: Deleting "+
+			"mappings with keys: %v %v",
+			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
+	}
+
+	if err := _dbUpdateBalanceIndexWithTxn(txn, balanceEntry, nil); err != nil {
+		return errors.Wrapf(err, "DbDeleteCreatorCoinBalanceEntryMappingsWithTxn: ")
+	}
+	if err := _dbUpdateTopHoldersIndexWithTxn(txn, balanceEntry, nil); err != nil {
+		return errors.Wrapf(err, "DbDeleteCreatorCoinBalanceEntryMappingsWithTxn: ")
+	}
+
+	// Note: We don't update the CreatorBitCloutLockedNanosCreatorPubKeyIIndex
+	// because we expect that the caller is keeping the individual holdings in
+	// sync with the "total" coins stored in the profile.
+
+	return nil
+}
+
+func DBDeleteCreatorCoinBalanceEntryMappings(
+	handle *badger.DB, hodlerPKID *PKID, creatorPKID *PKID,
+	params *BitCloutParams) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DBDeleteCreatorCoinBalanceEntryMappingsWithTxn(
+			txn, hodlerPKID, creatorPKID, params)
+	})
+}
+
+func DBPutCreatorCoinBalanceEntryMappingsWithTxn(
+	txn KVTxn, balanceEntry *BalanceEntry,
+	params *BitCloutParams) error {
+
+	// Pull up the existing entry, if any, so its spot in the balance indexes
+	// can be moved.
+	prevBalanceEntry := DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
+		txn, balanceEntry.HODLerPKID, balanceEntry.CreatorPKID)
+	if err := _dbUpdateBalanceIndexWithTxn(txn, prevBalanceEntry, balanceEntry); err != nil {
+		return errors.Wrapf(err, "DbPutCreatorCoinBalanceEntryMappingsWithTxn: ")
+	}
+	if err := _dbUpdateTopHoldersIndexWithTxn(txn, prevBalanceEntry, balanceEntry); err != nil {
+		return errors.Wrapf(err, "DbPutCreatorCoinBalanceEntryMappingsWithTxn: ")
+	}
+
+	balanceEntryDataBytes := _DbBufForBalanceEntry(balanceEntry)
+
+	// Set the forward direction for the HODLer
+	if err := txn.Set(_dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(
+		balanceEntry.HODLerPKID, balanceEntry.CreatorPKID),
+		balanceEntryDataBytes); err != nil {
+
+		return errors.Wrapf(err, "DbPutCreatorCoinBalanceEntryMappingsWithTxn: Problem "+
+			"adding forward mappings for pub keys: %v %v",
+			PkToStringBoth(balanceEntry.HODLerPKID[:]),
+			PkToStringBoth(balanceEntry.CreatorPKID[:]))
+	}
+
+	// Set the reverse direction for the creator
+	if err := txn.Set(_dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(
+		balanceEntry.CreatorPKID, balanceEntry.HODLerPKID),
+		balanceEntryDataBytes); err != nil {
+
+		return errors.Wrapf(err, "DbPutCreatorCoinBalanceEntryMappingsWithTxn: Problem "+
+			"adding reverse mappings for pub keys: %v %v",
+			PkToStringBoth(balanceEntry.HODLerPKID[:]),
+			PkToStringBoth(balanceEntry.CreatorPKID[:]))
+	}
+
+	return nil
+}
+
+func DBPutCreatorCoinBalanceEntryMappings(
+	handle *badger.DB, balanceEntry *BalanceEntry, params *BitCloutParams) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DBPutCreatorCoinBalanceEntryMappingsWithTxn(
+			txn, balanceEntry, params)
+	})
+}
+
+// GetSingleBalanceEntryFromPublicKeys fetchs a single balance entry of a holder's creator coin.
+// Returns nil if the balance entry never existed.
+// _viewOverlayRead consults a UtxoView before falling back to the db. viewLookup
+// reports whether the view holds an entry for the key and, if so, whether that
+// entry is a tombstone. dbLookup is only invoked when the view has no entry at
+// all, so changes made earlier in the block always shadow the db. Unlike the
+// UtxoView getters, nothing read from the db is cached in the view. Returns
+// whether an entry exists.
+func _viewOverlayRead(viewLookup func() (_inView bool, _isDeleted bool), dbLookup func() bool) bool {
+	if inView, isDeleted := viewLookup(); inView {
+		return !isDeleted
+	}
+	return dbLookup()
+}
+
+// GetPostEntryFromPostHash returns the post for postHash as of the view, or nil
+// if it doesn't exist or was deleted in the view.
+func GetPostEntryFromPostHash(postHash *BlockHash, utxoView *UtxoView) *PostEntry {
+	var postEntry *PostEntry
+	exists := _viewOverlayRead(func() (bool, bool) {
+		postEntry = utxoView.PostHashToPostEntry[*postHash]
+		return postEntry != nil, postEntry != nil && postEntry.isDeleted
+	}, func() bool {
+		var err error
+		postEntry, err = utxoView.Store.GetPostEntry(postHash)
+		if err != nil {
+			glog.Errorf("GetPostEntryFromPostHash: Problem reading post: %v", err)
+		}
+		return postEntry != nil
+	})
+	if !exists {
+		return nil
+	}
+	return postEntry
+}
+
+// GetProfileEntryFromPKID returns the profile for pkid as of the view, or nil
+// if it doesn't exist or was deleted in the view.
+func GetProfileEntryFromPKID(pkid *PKID, utxoView *UtxoView) *ProfileEntry {
+	var profileEntry *ProfileEntry
+	exists := _viewOverlayRead(func() (bool, bool) {
+		profileEntry = utxoView.ProfilePKIDToProfileEntry[*pkid]
+		return profileEntry != nil, profileEntry != nil && profileEntry.isDeleted
+	}, func() bool {
+		var err error
+		profileEntry, err = utxoView.Store.GetProfileEntry(pkid)
+		if err != nil {
+			glog.Errorf("GetProfileEntryFromPKID: Problem reading profile: %v", err)
+		}
+		return profileEntry != nil
+	})
+	if !exists {
+		return nil
+	}
+	return profileEntry
+}
+
+// GetFollowExistsFromPKIDs returns whether followerPKID follows followedPKID as
+// of the view.
+func GetFollowExistsFromPKIDs(followerPKID *PKID, followedPKID *PKID, utxoView *UtxoView) bool {
+	return _viewOverlayRead(func() (bool, bool) {
+		followEntry := utxoView.FollowKeyToFollowEntry[MakeFollowKey(followerPKID, followedPKID)]
+		return followEntry != nil, followEntry != nil && followEntry.isDeleted
+	}, func() bool {
+		isFollowing, err := utxoView.Store.IsFollowing(followerPKID, followedPKID)
+		if err != nil {
+			glog.Errorf("GetFollowExistsFromPKIDs: Problem reading follow: %v", err)
+		}
+		return isFollowing
+	})
+}
+
+// GetLikeExistsFromPublicKey returns whether likerPubKey likes likedPostHash as
+// of the view.
+func GetLikeExistsFromPublicKey(likerPubKey []byte, likedPostHash *BlockHash, utxoView *UtxoView) bool {
+	return _viewOverlayRead(func() (bool, bool) {
+		likeEntry := utxoView.LikeKeyToLikeEntry[MakeLikeKey(likerPubKey, *likedPostHash)]
+		return likeEntry != nil, likeEntry != nil && likeEntry.isDeleted
+	}, func() bool {
+		return DbGetLikerPubKeyToLikedPostHashMapping(utxoView.Handle, likerPubKey, *likedPostHash) != nil
+	})
+}
+
+func GetSingleBalanceEntryFromPublicKeys(holder []byte, creator []byte, utxoView *UtxoView) (*BalanceEntry, error){
+	holderPKIDEntry := utxoView.GetPKIDForPublicKey(holder)
+	if holderPKIDEntry == nil || holderPKIDEntry.isDeleted {
+		return nil, fmt.Errorf("DbGetSingleBalanceEntryFromPublicKeys: holderPKID was nil or deleted; this should never happen")
+	}
+	holderPKID := holderPKIDEntry.PKID
+	creatorPKIDEntry := utxoView.GetPKIDForPublicKey(creator)
+	if creatorPKIDEntry == nil || creatorPKIDEntry.isDeleted {
+		return nil, fmt.Errorf("DbGetSingleBalanceEntryFromPublicKeys: creatorPKID was nil or deleted; this should never happen")
+	}
+	creatorPKID := creatorPKIDEntry.PKID
+
+	// Check if there's a balance entry in the view before checking the database.
+	var balanceEntry *BalanceEntry
+	exists := _viewOverlayRead(func() (bool, bool) {
+		balanceEntryMapKey := BalanceEntryMapKey{HODLerPKID: *holderPKID, CreatorPKID: *creatorPKID}
+		balanceEntry = utxoView.HODLerPKIDCreatorPKIDToBalanceEntry[balanceEntryMapKey]
+		return balanceEntry != nil, balanceEntry != nil && balanceEntry.isDeleted
+	}, func() bool {
+		balanceEntry = DbGetBalanceEntry(utxoView.Handle, holderPKID, creatorPKID)
+		return balanceEntry != nil
+	})
+	if !exists {
+		return nil, nil
+	}
+	return balanceEntry, nil
+}
+
+// DbGetBalanceEntry returns a balance entry from the database
+func DbGetBalanceEntry(db *badger.DB, holder *PKID, creator *PKID) *BalanceEntry {
+	var ret *BalanceEntry
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetHolderPKIDCreatorPKIDToBalanceEntryWithTxn(txn, holder, creator)
+		return nil
+	})
+	return ret
+}
+
+func DbGetHolderPKIDCreatorPKIDToBalanceEntryWithTxn(txn KVTxn, holder *PKID, creator *PKID) *BalanceEntry {
+	key := _dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creator, holder)
+	balanceEntryObj := &BalanceEntry{}
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	err = _DbDecodeBalanceEntry(valBytes, balanceEntryObj)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetReclouterPubKeyRecloutedPostHashToRecloutedPostMappingWithTxn: Problem decoding "+
+			"balance entry for holder %v and creator %v", PkToStringMainnet(PKIDToPublicKey(holder)), PkToStringMainnet(PKIDToPublicKey(creator)))
+		return nil
+	}
+	return balanceEntryObj
+}
+
+// DbGetBalanceEntriesHodlingYou fetchs the BalanceEntries that the passed in pkid hodls.
+// It decodes every entry so use DbGetPaginatedBalanceEntriesYouHodl for HODLers
+// that hold a lot of coins.
+func DbGetBalanceEntriesYouHodl(pkid *PKIDEntry, fetchProfiles bool, filterOutZeroBalances bool, utxoView *UtxoView) (
+	_entriesYouHodl []*BalanceEntry,
+	_profilesYouHodl []*ProfileEntry,
+	_err error) {
+	handle := utxoView.Handle
+	// Get the balance entries for the coins that *you hodl*
+	balanceEntriesYouHodl := []*BalanceEntry{}
+	{
+		prefix := append([]byte{}, _PrefixHODLerPKIDCreatorPKIDToBalanceEntry...)
+		keyPrefix := append(prefix, pkid.PKID[:]...)
+		_, entryByteStringsFound := _enumerateKeysForPrefix(
+			handle, keyPrefix)
+		for _, byteString := range entryByteStringsFound {
+			currentEntry := &BalanceEntry{}
+			_DbDecodeBalanceEntry(byteString, currentEntry)
+			if filterOutZeroBalances && currentEntry.BalanceNanos == 0 {
+				continue
+			}
+			balanceEntriesYouHodl = append(balanceEntriesYouHodl, currentEntry)
+		}
+	}
+	// Optionally fetch all the profile entries as well.
+	profilesYouHodl := []*ProfileEntry{}
+	if fetchProfiles {
+		for _, balanceEntry := range balanceEntriesYouHodl {
+			// In this case you're the hodler so the creator is the one whose
+			// profile we need to fetch.
+			currentProfileEntry := utxoView.GetProfileEntryForPKID(balanceEntry.CreatorPKID)
+			profilesYouHodl = append(profilesYouHodl, currentProfileEntry)
+		}
+	}
+	return balanceEntriesYouHodl, profilesYouHodl, nil
+}
+
+// HoldingsSortType is the order DbGetPaginatedBalanceEntriesYouHodl returns a
+// HODLer's creator coins in and DbGetPaginatedBalanceEntriesHodlingYou returns
+// a creator's HODLers in.
+type HoldingsSortType uint8
+
+const (
+	// Largest balance first.
+	HoldingsSortTypeBalance HoldingsSortType = iota
+	// Highest creator coin price first. When paging through a creator's
+	// HODLers this is the price of each HODLer's own coin.
+	HoldingsSortTypeCoinPrice
+)
+
+func (sortType HoldingsSortType) String() string {
+	switch sortType {
+	case HoldingsSortTypeBalance:
+		return "balance"
+	case HoldingsSortTypeCoinPrice:
+		return "coin_price"
+	default:
+		return fmt.Sprintf("HoldingsSortType(%d)", uint8(sortType))
+	}
+}
+
+// DbGetHoldingsCountWithTxn returns how many creator coins the HODLer has a
+// nonzero balance in without enumerating them.
+func DbGetHoldingsCountWithTxn(txn KVTxn, hodlerPKID *PKID) uint64 {
+	return _dbGetCountWithTxn(txn, _dbKeyForHoldingsCount(hodlerPKID))
+}
+
+func DbGetHoldingsCount(handle *badger.DB, hodlerPKID *PKID) uint64 {
+	var count uint64
+	DbView(handle, func(txn KVTxn) error {
+		count = DbGetHoldingsCountWithTxn(txn, hodlerPKID)
+		return nil
+	})
+	return count
+}
+
+// _dbGetBalanceEntriesForIndexKeysWithTxn looks up the BalanceEntry for each
+// <HODLer PKID, creator PKID> pair.
+func _dbGetBalanceEntriesForIndexKeysWithTxn(
+	txn KVTxn, hodlerPKID *PKID, creatorPKIDs []*PKID) ([]*BalanceEntry, error) {
+
+	balanceEntries := []*BalanceEntry{}
+	for _, creatorPKID := range creatorPKIDs {
+		balanceEntry := DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
+			txn, hodlerPKID, creatorPKID)
+		if balanceEntry == nil {
+			return nil, fmt.Errorf("Balance index has entry for %v %v but there is "+
+				"no BalanceEntry", PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
+		}
+		balanceEntries = append(balanceEntries, balanceEntry)
+	}
+	return balanceEntries, nil
+}
+
+// DbGetPaginatedBalanceEntriesYouHodl returns up to limit of the BalanceEntries
+// with a nonzero balance that the HODLer holds, in the order given by sortType,
+// starting right after the entry the cursor was taken at. An empty cursor
+// starts from the top and a limit of zero returns everything. The returned
+// cursor is empty once there are no more entries.
+//
+// Unlike DbGetBalanceEntriesYouHodl this only decodes the entries on the page
+// when sorting by balance. Sorting by coin price still has to look up every
+// creator the HODLer holds but it only reads keys from the balance index.
+func DbGetPaginatedBalanceEntriesYouHodl(
+	utxoView *UtxoView, hodlerPKID *PKID, sortType HoldingsSortType, cursor string,
+	limit int, fetchProfiles bool) (
+	_entriesYouHodl []*BalanceEntry, _profilesYouHodl []*ProfileEntry,
+	_nextCursor string, _err error) {
+
+	var balanceEntriesYouHodl []*BalanceEntry
+	var nextCursor string
+	var err error
+	switch sortType {
+	case HoldingsSortTypeBalance:
+		balanceEntriesYouHodl, nextCursor, err = _dbGetBalanceEntriesYouHodlByBalance(
+			utxoView.Handle, hodlerPKID, cursor, limit)
+	case HoldingsSortTypeCoinPrice:
+		balanceEntriesYouHodl, nextCursor, err = _dbGetBalanceEntriesYouHodlByCoinPrice(
+			utxoView, hodlerPKID, cursor, limit)
+	default:
+		err = fmt.Errorf("Unknown sort type %v", sortType)
+	}
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "DbGetPaginatedBalanceEntriesYouHodl: ")
+	}
+
+	// Optionally fetch all the profile entries as well.
+	profilesYouHodl := []*ProfileEntry{}
+	if fetchProfiles {
+		for _, balanceEntry := range balanceEntriesYouHodl {
+			profilesYouHodl = append(profilesYouHodl,
+				utxoView.GetProfileEntryForPKID(balanceEntry.CreatorPKID))
+		}
+	}
+	return balanceEntriesYouHodl, profilesYouHodl, nextCursor, nil
+}
+
+func _dbGetBalanceEntriesYouHodlByBalance(
+	handle *badger.DB, hodlerPKID *PKID, cursor string, limit int) (
+	_entriesYouHodl []*BalanceEntry, _nextCursor string, _err error) {
+
+	// <prefix, HODLer PKID, balance uint64, creator PKID>
+	prefix := append([]byte{}, _PrefixHODLerPKIDBalanceNanosCreatorPKID...)
+	prefix = append(prefix, hodlerPKID[:]...)
+	creatorPKIDs, nextCursor, err := _dbGetPKIDsByIndexOrder(
+		handle, prefix, true /*reverse*/, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var balanceEntries []*BalanceEntry
+	err = DbView(handle, func(txn KVTxn) error {
+		var err error
+		balanceEntries, err = _dbGetBalanceEntriesForIndexKeysWithTxn(txn, hodlerPKID, creatorPKIDs)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return balanceEntries, nextCursor, nil
+}
+
+// _pkidByCoinPrice is a PKID along with the price of its creator coin, which is
+// what HoldingsSortTypeCoinPrice cursors point at.
+type _pkidByCoinPrice struct {
+	priceNanos uint64
+	pkid       *PKID
+}
+
+// _isAfter returns true if pkidByPrice comes after other when sorting by coin
+// price. Ties are broken by PKID, largest first, so the order is total.
+func (pkidByPrice *_pkidByCoinPrice) _isAfter(other *_pkidByCoinPrice) bool {
+	if pkidByPrice.priceNanos != other.priceNanos {
+		return pkidByPrice.priceNanos < other.priceNanos
+	}
+	return bytes.Compare(pkidByPrice.pkid[:], other.pkid[:]) < 0
+}
+
+func (pkidByPrice *_pkidByCoinPrice) _cursor() string {
+	return hex.EncodeToString(append(EncodeUint64(pkidByPrice.priceNanos), pkidByPrice.pkid[:]...))
+}
+
+func _decodePKIDByCoinPriceCursor(cursor string) (*_pkidByCoinPrice, error) {
+	cursorBytes, err := hex.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid cursor")
+	}
+	if len(cursorBytes) != 8+btcec.PubKeyBytesLenCompressed {
+		return nil, fmt.Errorf("Invalid cursor: Has length %d", len(cursorBytes))
+	}
+	pkid := &PKID{}
+	copy(pkid[:], cursorBytes[8:])
+	return &_pkidByCoinPrice{
+		priceNanos: DecodeUint64(cursorBytes[:8]),
+		pkid:       pkid,
+	}, nil
+}
+
+// _dbGetPKIDsByCoinPrice reads the PKIDs at the end of the keys in one of the
+// balance indexes under indexPrefix and sorts them by the price of their
+// creator coin. Both balance indexes have keys of the form <prefix, PKID,
+// balance uint64, PKID> so this works for either.
+func _dbGetPKIDsByCoinPrice(
+	utxoView *UtxoView, indexPrefix []byte, cursor string, limit int) (
+	_pkids []*PKID, _nextCursor string, _err error) {
+
+	var lastPKIDByPrice *_pkidByCoinPrice
+	if cursor != "" {
+		var err error
+		lastPKIDByPrice, err = _decodePKIDByCoinPriceCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	keysFound, _ := _enumerateKeysForPrefix(utxoView.Handle, indexPrefix)
+	pkidsByPrice := []*_pkidByCoinPrice{}
+	for _, key := range keysFound {
+		if len(key) != len(indexPrefix)+8+btcec.PubKeyBytesLenCompressed {
+			continue
+		}
+		pkid := &PKID{}
+		copy(pkid[:], key[len(indexPrefix)+8:])
+		pkidByPrice := &_pkidByCoinPrice{pkid: pkid}
+		if profileEntry := utxoView.GetProfileEntryForPKID(pkid); profileEntry != nil {
+			pkidByPrice.priceNanos = CalculateCreatorCoinPriceBitCloutNanos(
+				&profileEntry.CoinEntry, utxoView.Params)
+		}
+		if lastPKIDByPrice != nil && !pkidByPrice._isAfter(lastPKIDByPrice) {
+			continue
+		}
+		pkidsByPrice = append(pkidsByPrice, pkidByPrice)
+	}
+	sort.Slice(pkidsByPrice, func(ii, jj int) bool {
+		return pkidsByPrice[jj]._isAfter(pkidsByPrice[ii])
+	})
+
+	nextCursor := ""
+	if limit != 0 && len(pkidsByPrice) > limit {
+		pkidsByPrice = pkidsByPrice[:limit]
+		nextCursor = pkidsByPrice[limit-1]._cursor()
+	}
+
+	pkids := []*PKID{}
+	for _, pkidByPrice := range pkidsByPrice {
+		pkids = append(pkids, pkidByPrice.pkid)
+	}
+	return pkids, nextCursor, nil
+}
+
+func _dbGetBalanceEntriesYouHodlByCoinPrice(
+	utxoView *UtxoView, hodlerPKID *PKID, cursor string, limit int) (
+	_entriesYouHodl []*BalanceEntry, _nextCursor string, _err error) {
+
+	// <prefix, HODLer PKID, balance uint64, creator PKID>
+	prefix := append([]byte{}, _PrefixHODLerPKIDBalanceNanosCreatorPKID...)
+	prefix = append(prefix, hodlerPKID[:]...)
+	creatorPKIDs, nextCursor, err := _dbGetPKIDsByCoinPrice(utxoView, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var balanceEntries []*BalanceEntry
+	err = DbView(utxoView.Handle, func(txn KVTxn) error {
+		var err error
+		balanceEntries, err = _dbGetBalanceEntriesForIndexKeysWithTxn(txn, hodlerPKID, creatorPKIDs)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return balanceEntries, nextCursor, nil
+}
+
+// balanceIndexMigrationName marks whether the balance entries stored before the
+// balance index and holdings counts existed have been indexed.
+const balanceIndexMigrationName = "balance-index"
+
+// DbBackfillBalanceIndex adds the balance entries that were stored before the
+// balance index existed to it and counts them. It only does the work once per
+// db and returns the number of entries it indexed.
+func DbBackfillBalanceIndex(handle *badger.DB) (_numIndexed int, _err error) {
+	if DbGetIndexMigrationState(handle, balanceIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	keysToSet := [][]byte{}
+	valsToSet := [][]byte{}
+	holdingsCounts := make(map[PKID]uint64)
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixHODLerPKIDCreatorPKIDToBalanceEntry, func(_ []byte, valBytes []byte) (bool, error) {
+		balanceEntry := &BalanceEntry{}
+		if err := _DbDecodeBalanceEntry(valBytes, balanceEntry); err != nil {
+			return true, nil
+		}
+		if balanceEntry.HODLerPKID == nil || balanceEntry.CreatorPKID == nil ||
+			balanceEntry.BalanceNanos == 0 {
+
+			return true, nil
+		}
+		keysToSet = append(keysToSet, _dbKeyForHODLerPKIDBalanceNanosCreatorPKID(
+			balanceEntry.HODLerPKID, balanceEntry.BalanceNanos, balanceEntry.CreatorPKID))
+		valsToSet = append(valsToSet, []byte{})
+		holdingsCounts[*balanceEntry.HODLerPKID]++
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillBalanceIndex: Problem enumerating balance entries")
+	}
+	numIndexed := len(keysToSet)
+
+	for pkid, count := range holdingsCounts {
+		pkidCopy := pkid
+		keysToSet = append(keysToSet, _dbKeyForHoldingsCount(&pkidCopy))
+		valsToSet = append(valsToSet, EncodeUint64(count))
+	}
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for ii := range keysToSet {
+			if err := txnWriter.Set(keysToSet[ii], valsToSet[ii]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillBalanceIndex: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, balanceIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillBalanceIndex: Problem marking backfill complete")
+	}
+
+	return numIndexed, nil
+}
+
+// DbGetPaginatedBalanceEntriesHodlingYou returns up to limit of the
+// BalanceEntries with a nonzero balance in the creator's coin, in the order
+// given by sortType, starting right after the entry the cursor was taken at. An
+// empty cursor starts from the top and a limit of zero returns everything. The
+// returned cursor is empty once there are no more entries. When fetchProfiles
+// is set the HODLers' profiles are returned as well.
+//
+// Unlike DbGetBalanceEntriesHodlingYou this only decodes the entries on the
+// page. Sorting by coin price still has to look up the profile of every HODLer
+// but it only reads keys from the top holders index.
+func DbGetPaginatedBalanceEntriesHodlingYou(
+	utxoView *UtxoView, creatorPKID *PKID, sortType HoldingsSortType, cursor string,
+	limit int, fetchProfiles bool) (
+	_entriesHodlingYou []*BalanceEntry, _profilesHodlingYou []*ProfileEntry,
+	_nextCursor string, _err error) {
+
+	// <prefix, creator PKID, inverted balance uint64, HODLer PKID>
+	prefix := append([]byte{}, _PrefixCreatorPKIDBalanceNanosHODLerPKID...)
+	prefix = append(prefix, creatorPKID[:]...)
+
+	var hodlerPKIDs []*PKID
+	var nextCursor string
+	var err error
+	switch sortType {
+	case HoldingsSortTypeBalance:
+		hodlerPKIDs, nextCursor, err = _dbGetPKIDsByIndexOrder(
+			utxoView.Handle, prefix, false /*reverse*/, cursor, limit)
+	case HoldingsSortTypeCoinPrice:
+		hodlerPKIDs, nextCursor, err = _dbGetPKIDsByCoinPrice(utxoView, prefix, cursor, limit)
+	default:
+		err = fmt.Errorf("Unknown sort type %v", sortType)
+	}
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "DbGetPaginatedBalanceEntriesHodlingYou: ")
+	}
+
+	balanceEntries := []*BalanceEntry{}
+	err = DbView(utxoView.Handle, func(txn KVTxn) error {
+		for _, hodlerPKID := range hodlerPKIDs {
+			balanceEntry := DBGetCreatorCoinBalanceEntryForCreatorPKIDAndHODLerPubKeyWithTxn(
+				txn, creatorPKID, hodlerPKID)
+			if balanceEntry == nil {
+				return fmt.Errorf("Top holders index has entry for %v %v but there is "+
+					"no BalanceEntry", PkToStringBoth(creatorPKID[:]), PkToStringBoth(hodlerPKID[:]))
+			}
+			balanceEntries = append(balanceEntries, balanceEntry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "DbGetPaginatedBalanceEntriesHodlingYou: ")
+	}
+
+	// Optionally fetch all the profile entries as well.
+	profilesHodlingYou := []*ProfileEntry{}
+	if fetchProfiles {
+		for _, balanceEntry := range balanceEntries {
+			profilesHodlingYou = append(profilesHodlingYou,
+				utxoView.GetProfileEntryForPKID(balanceEntry.HODLerPKID))
+		}
+	}
+	return balanceEntries, profilesHodlingYou, nextCursor, nil
+}
+
+// DbGetPaginatedTopHolders returns a page of the creator's HODLers, largest
+// balance first. See DbGetPaginatedBalanceEntriesHodlingYou.
+func DbGetPaginatedTopHolders(
+	utxoView *UtxoView, creatorPKID *PKID, cursor string, limit int, fetchProfiles bool) (
+	_entriesHodlingYou []*BalanceEntry, _profilesHodlingYou []*ProfileEntry,
+	_nextCursor string, _err error) {
+
+	return DbGetPaginatedBalanceEntriesHodlingYou(
+		utxoView, creatorPKID, HoldingsSortTypeBalance, cursor, limit, fetchProfiles)
+}
+
+// _dbGetPKIDsByIndexOrder reads up to limit of the PKIDs at the end of the keys
+// in one of the balance indexes under indexPrefix, in key order or in reverse,
+// starting right after the key the cursor was taken at.
+func _dbGetPKIDsByIndexOrder(
+	handle *badger.DB, indexPrefix []byte, reverse bool, cursor string, limit int) (
+	_pkids []*PKID, _nextCursor string, _err error) {
+
+	dbIter := NewDBIterator(handle, indexPrefix, reverse, false /*fetchValues*/)
+	defer dbIter.Close()
+	if err := dbIter.Resume(cursor); err != nil {
+		return nil, "", err
+	}
+
+	pkids := []*PKID{}
+	for (limit == 0 || len(pkids) < limit) && dbIter.Next() {
+		key := dbIter.Key()
+		if len(key) != len(indexPrefix)+8+btcec.PubKeyBytesLenCompressed {
+			continue
+		}
+		pkid := &PKID{}
+		copy(pkid[:], key[len(indexPrefix)+8:])
+		pkids = append(pkids, pkid)
+	}
+	if dbIter.Err() != nil {
+		return nil, "", dbIter.Err()
+	}
+	nextCursor := ""
+	if limit != 0 && len(pkids) == limit {
+		nextCursor = dbIter.Cursor()
+	}
+	return pkids, nextCursor, nil
+}
+
+// topHoldersIndexMigrationName marks whether the balance entries stored before
+// the top holders index existed have been indexed.
+const topHoldersIndexMigrationName = "top-holders-index"
+
+// DbBackfillTopHoldersIndex adds the balance entries that were stored before
+// the top holders index existed to it. It only does the work once per db and
+// returns the number of entries it indexed.
+func DbBackfillTopHoldersIndex(handle *badger.DB) (_numIndexed int, _err error) {
+	if DbGetIndexMigrationState(handle, topHoldersIndexMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
+	}
+
+	keysToSet := [][]byte{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixCreatorPKIDHODLerPKIDToBalanceEntry, func(_ []byte, valBytes []byte) (bool, error) {
+		balanceEntry := &BalanceEntry{}
+		if err := _DbDecodeBalanceEntry(valBytes, balanceEntry); err != nil {
+			return true, nil
+		}
+		if balanceEntry.HODLerPKID == nil || balanceEntry.CreatorPKID == nil ||
+			balanceEntry.BalanceNanos == 0 {
+
+			return true, nil
+		}
+		keysToSet = append(keysToSet, _dbKeyForCreatorPKIDBalanceNanosHODLerPKID(
+			balanceEntry.CreatorPKID, balanceEntry.BalanceNanos, balanceEntry.HODLerPKID))
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillTopHoldersIndex: Problem enumerating balance entries")
+	}
+
+	err = DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for _, key := range keysToSet {
+			if err := txnWriter.Set(key, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillTopHoldersIndex: Problem writing index")
+	}
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, topHoldersIndexMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbBackfillTopHoldersIndex: Problem marking backfill complete")
+	}
+
+	return len(keysToSet), nil
+}
+
+// DbGetBalanceEntriesHodlingYou fetchs the BalanceEntries that hodl the pkid passed in.
+// It decodes every entry so use DbGetPaginatedBalanceEntriesHodlingYou for creators
+// with a lot of HODLers.
+func DbGetBalanceEntriesHodlingYou(pkid *PKIDEntry, fetchProfiles bool, filterOutZeroBalances bool, utxoView *UtxoView) (
+	_entriesHodlingYou []*BalanceEntry,
+	_profilesHodlingYou []*ProfileEntry,
+	_err error) {
+	handle := utxoView.Handle
+	// Get the balance entries for the coins that *hodl you*
+	balanceEntriesThatHodlYou := []*BalanceEntry{}
+	{
+		prefix := append([]byte{}, _PrefixCreatorPKIDHODLerPKIDToBalanceEntry...)
+		keyPrefix := append(prefix, pkid.PKID[:]...)
+		_, entryByteStringsFound := _enumerateKeysForPrefix(
+			handle, keyPrefix)
+		for _, byteString := range entryByteStringsFound {
+			currentEntry := &BalanceEntry{}
+			_DbDecodeBalanceEntry(byteString, currentEntry)
+			if filterOutZeroBalances && currentEntry.BalanceNanos == 0 {
+				continue
+			}
+			balanceEntriesThatHodlYou = append(balanceEntriesThatHodlYou, currentEntry)
+		}
+	}
+	// Optionally fetch all the profile entries as well.
+	profilesThatHodlYou := []*ProfileEntry{}
+	if fetchProfiles {
+		for _, balanceEntry := range balanceEntriesThatHodlYou {
+			// In this case you're the creator and the hodler is the one whose
+			// profile we need to fetch.
+			currentProfileEntry := utxoView.GetProfileEntryForPKID(balanceEntry.HODLerPKID)
+			profilesThatHodlYou = append(profilesThatHodlYou, currentProfileEntry)
+		}
+	}
+	return balanceEntriesThatHodlYou, profilesThatHodlYou, nil
+}
+
+// DbGetCreatorCoinBalanceEntriesForPubKeyWithTxn finds the BalanceEntries corresponding
+// to the public key passed in. It fetched both the entries corresponding to the
+// profiles that *you HODL* and the entries corresponding to the profiles that
+// *HODL you*.
+func DbGetCreatorCoinBalanceEntriesForPubKey(
+	pkid *PKIDEntry, fetchProfiles bool, filterOutZeroBalances bool, utxoView *UtxoView) (
+	_entriesYouHodl []*BalanceEntry, _entriesThatHodlYou []*BalanceEntry,
+	_profilesYouHodl []*ProfileEntry, _profilesThatHodlYou []*ProfileEntry,
+	_err error) {
+
+	balanceEntriesYouHodl, profilesYouHodl, err := DbGetBalanceEntriesYouHodl(pkid, fetchProfiles, filterOutZeroBalances, utxoView)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	balanceEntriesThatHodlYou, profilesThatHodlYou, err := DbGetBalanceEntriesHodlingYou(pkid, fetchProfiles, filterOutZeroBalances, utxoView)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// If there are no errors, return everything we found.
+	return balanceEntriesYouHodl, balanceEntriesThatHodlYou, profilesYouHodl, profilesThatHodlYou, nil
+}
+
+// =====================================================================================
+// End coin balance entry code
+// =====================================================================================
+
+// startPrefix specifies a point in the DB at which the iteration should start.
+// It doesn't have to map to an exact key because badger will just binary search
+// and start right before/after that location.
+//
+// validForPrefix helps determine when the iteration should stop. The iteration
+// stops at the last entry that has this prefix. Setting it to
+// an empty byte string would cause the iteration to seek to the beginning of the db,
+// whereas setting it to one of the _Prefix bytes would cause the iteration to stop
+// at the last entry with that prefix.
+//
+// maxKeyLen is required so we can pad the key with FF in the case the user wants
+// to seek backwards. This is required due to a quirk of badgerdb. It is ignored
+// if reverse == false.
+//
+// numToFetch specifies the number of entries to fetch. If set to zero then it
+// fetches all entries that match the validForPrefix passed in.
+// DBScanExplanation describes the work a paginated prefix scan did. It's meant
+// for checking that a new index lets a query stop early rather than walk every
+// key under a prefix.
+type DBScanExplanation struct {
+	// KeysVisited is the number of keys the iterator landed on, including any
+	// that were read and then rejected.
+	KeysVisited int
+	// BytesRead is the total size of the keys visited and the values fetched.
+	BytesRead int
+	Reverse   bool
+	// Bounded is set when the scan was limited to a number of entries.
+	Bounded bool
+	// SeekedIntoPrefix is set when the scan started part way into the prefix
+	// rather than at one of its ends.
+	SeekedIntoPrefix bool
+	// ExhaustedPrefix is set when the scan stopped because it ran out of keys
+	// rather than because it hit its limit. A scan that's bounded but still
+	// exhausts a large prefix usually means the index isn't doing its job.
+	ExhaustedPrefix bool
+}
+
+func (explanation *DBScanExplanation) String() string {
+	return fmt.Sprintf("< KeysVisited: %d, BytesRead: %d, Reverse: %v, Bounded: %v, "+
+		"SeekedIntoPrefix: %v, ExhaustedPrefix: %v >",
+		explanation.KeysVisited, explanation.BytesRead, explanation.Reverse,
+		explanation.Bounded, explanation.SeekedIntoPrefix, explanation.ExhaustedPrefix)
+}
+
+func DBGetPaginatedKeysAndValuesForPrefixWithTxn(
+	dbTxn KVTxn, startPrefix []byte, validForPrefix []byte,
+	maxKeyLen int, numToFetch int, reverse bool, fetchValues bool) (
+
+	_keysFound [][]byte, _valsFound [][]byte, _err error) {
+
+	return _dbGetPaginatedKeysAndValuesForPrefixWithTxn(
+		dbTxn, startPrefix, validForPrefix, maxKeyLen, numToFetch, reverse, fetchValues, nil)
+}
+
+// _dbGetPaginatedKeysAndValuesForPrefixWithTxn fills in explanation as it goes
+// if it's set.
+func _dbGetPaginatedKeysAndValuesForPrefixWithTxn(
+	dbTxn KVTxn, startPrefix []byte, validForPrefix []byte,
+	maxKeyLen int, numToFetch int, reverse bool, fetchValues bool,
+	explanation *DBScanExplanation) (
+
+	_keysFound [][]byte, _valsFound [][]byte, _err error) {
+
+	if explanation != nil {
+		*explanation = DBScanExplanation{
+			Reverse:          reverse,
+			Bounded:          numToFetch != 0,
+			SeekedIntoPrefix: !bytes.Equal(startPrefix, validForPrefix),
+			// Cleared below if the scan stops at its limit.
+			ExhaustedPrefix: true,
+		}
+	}
+
+	keysFound := [][]byte{}
+	valsFound := [][]byte{}
+
+	opts := KVIteratorOptions{}
+
+	opts.KeysOnly = !fetchValues
+
+	// Optionally go in reverse order.
+	opts.Reverse = reverse
+
+	it := dbTxn.NewIterator(opts)
+	defer it.Close()
+	prefix := startPrefix
+	if reverse {
+		// When we iterate backwards, the prefix must be bigger than all possible
+		// keys that could actually exist with this prefix. We achieve this by
+		// padding the end of the dbPrefixx passed in up to the key length.
+		prefix = make([]byte, maxKeyLen)
+		for ii := 0; ii < maxKeyLen; ii++ {
+			if ii < len(startPrefix) {
+				prefix[ii] = startPrefix[ii]
+			} else {
+				prefix[ii] = 0xFF
+			}
+		}
+	}
+	for it.Seek(prefix); it.ValidForPrefix(validForPrefix); it.Next() {
+		keyCopy := append([]byte{}, it.Key()...)
+		if explanation != nil {
+			explanation.KeysVisited++
+			explanation.BytesRead += len(keyCopy)
+		}
+		if maxKeyLen != 0 && len(keyCopy) != maxKeyLen {
+			return nil, nil, fmt.Errorf(
+				"DBGetPaginatedKeysAndValuesForPrefixWithTxn: Invalid key length %v != %v",
+				len(keyCopy), maxKeyLen)
+		}
+
+		var valCopy []byte
+		if fetchValues {
+			var err error
+			valCopy, err = it.Value()
+			if err != nil {
+				return nil, nil, _wrapDbError(err, "DBGetPaginatedKeysAndValuesForPrefixWithTxn: "+
+					"Error fetching value")
+			}
+			if explanation != nil {
+				explanation.BytesRead += len(valCopy)
+			}
+		}
+
+		keysFound = append(keysFound, keyCopy)
+		valsFound = append(valsFound, valCopy)
+
+		if numToFetch != 0 && len(keysFound) == numToFetch {
+			if explanation != nil {
+				// Peek at the next key to tell a limit that happened to line up
+				// with the end of the prefix from one that cut the scan short.
+				it.Next()
+				explanation.ExhaustedPrefix = !it.ValidForPrefix(validForPrefix)
+			}
+			break
+		}
+	}
+
+	// Return whatever we found.
+	return keysFound, valsFound, nil
+}
+
+func DBGetPaginatedKeysAndValuesForPrefix(
+	db *badger.DB, startPrefix []byte, validForPrefix []byte,
+	keyLen int, numToFetch int, reverse bool, fetchValues bool) (
+	_keysFound [][]byte, _valsFound [][]byte, _err error) {
+
+	keysFound := [][]byte{}
+	valsFound := [][]byte{}
+
+	dbErr := DbView(db, func(txn KVTxn) error {
+		var err error
+		keysFound, valsFound, err = DBGetPaginatedKeysAndValuesForPrefixWithTxn(
+			txn, startPrefix, validForPrefix, keyLen,
+			numToFetch, reverse, fetchValues)
+		return err
+	})
+	if dbErr != nil {
+		return nil, nil, _wrapDbError(dbErr, "DBGetPaginatedKeysAndValuesForPrefix")
+	}
+
+	return keysFound, valsFound, nil
+}
+
+// DBExplainPaginatedKeysAndValuesForPrefix runs the same scan as
+// DBGetPaginatedKeysAndValuesForPrefix and also reports how much work it did.
+func DBExplainPaginatedKeysAndValuesForPrefix(
+	db *badger.DB, startPrefix []byte, validForPrefix []byte,
+	keyLen int, numToFetch int, reverse bool, fetchValues bool) (
+	_keysFound [][]byte, _valsFound [][]byte, _explanation *DBScanExplanation, _err error) {
+
+	keysFound := [][]byte{}
+	valsFound := [][]byte{}
+	explanation := &DBScanExplanation{}
+
+	dbErr := DbView(db, func(txn KVTxn) error {
+		var err error
+		keysFound, valsFound, err = _dbGetPaginatedKeysAndValuesForPrefixWithTxn(
+			txn, startPrefix, validForPrefix, keyLen,
+			numToFetch, reverse, fetchValues, explanation)
+		return err
+	})
+	if dbErr != nil {
+		return nil, nil, nil, _wrapDbError(dbErr, "DBExplainPaginatedKeysAndValuesForPrefix")
+	}
+
+	return keysFound, valsFound, explanation, nil
+}
+
+// DBIterator pages through every key under a prefix using a single read-only
+// txn. Unlike DBGetPaginatedKeysAndValuesForPrefix, which fetches a fixed number
+// of entries per call, a DBIterator can hand back a Cursor after any entry and a
+// new DBIterator can Resume from it later without re-scanning from the top. This
+// is what feed-style endpoints should use to page through posts, profiles, and
+// messages.
+//
+// Typical usage:
+//
+//	it := NewDBIterator(db, _PrefixPostHashToPostEntry, false, true)
+//	defer it.Close()
+//	if err := it.Resume(cursor); err != nil { ... }
+//	for ii := 0; ii < pageSize && it.Next(); ii++ {
+//		... it.Key(), it.Value() ...
+//	}
+//	if it.Err() != nil { ... }
+//	nextCursor := it.Cursor()
+//
+// A DBIterator holds a badger txn open until it's closed so it should not be
+// kept around between requests; hand the Cursor to the caller instead.
+type DBIterator struct {
+	txn         *badger.Txn
+	it          KVIterator
+	prefix      []byte
+	reverse     bool
+	fetchValues bool
+
+	// Set when the next call to Next should seek rather than advance.
+	seekKey []byte
+	// When set, the first key found after seeking is skipped if it equals this.
+	skipKey []byte
+
+	key []byte
+	val []byte
+	err error
+}
+
+// NewDBIterator creates an iterator over all the keys that start with prefix.
+// In reverse, keys are returned from largest to smallest. Values are only read
+// if fetchValues is set.
+func NewDBIterator(db *badger.DB, prefix []byte, reverse bool, fetchValues bool) *DBIterator {
+	txn := db.NewTransaction(false)
+	dbIter := &DBIterator{
+		txn: txn,
+		it: NewBadgerKVTxn(txn).NewIterator(KVIteratorOptions{
+			Prefix:   prefix,
+			Reverse:  reverse,
+			KeysOnly: !fetchValues,
+		}),
+		prefix:      append([]byte{}, prefix...),
+		reverse:     reverse,
+		fetchValues: fetchValues,
+	}
+	dbIter.Seek(prefix)
+	return dbIter
+}
+
+// _dbKeyUpperBound returns the smallest key that is bigger than every key that
+// starts with key, or nil if there is no such key.
+func _dbKeyUpperBound(key []byte) []byte {
+	upperBound := append([]byte{}, key...)
+	for ii := len(upperBound) - 1; ii >= 0; ii-- {
+		if upperBound[ii] != 0xFF {
+			upperBound[ii]++
+			return upperBound[:ii+1]
+		}
+	}
+	return nil
+}
+
+// Seek makes the next call to Next return the first entry at or after key. In
+// reverse, it returns the last entry that is at or before key, counting keys
+// that start with key as being at key.
+func (dbIter *DBIterator) Seek(key []byte) {
+	if !dbIter.reverse {
+		dbIter.seekKey = append([]byte{}, key...)
+		dbIter.skipKey = nil
+		return
+	}
+
+	// A reverse iterator seeks to the largest key that is <= the key passed so
+	// seek to just past everything that starts with key.
+	upperBound := _dbKeyUpperBound(key)
+	if upperBound == nil {
+		// Every byte is 0xFF so pad the key out past any realistic key length.
+		upperBound = append(append([]byte{}, key...), bytes.Repeat([]byte{0xFF}, 256)...)
+	}
+	dbIter.seekKey = upperBound
+	dbIter.skipKey = upperBound
+}
+
+// Next advances to the next entry and returns false once there are no more
+// entries or an error has occurred. It must be called before the first entry is
+// available.
+func (dbIter *DBIterator) Next() bool {
+	if dbIter.err != nil {
+		return false
+	}
+
+	if dbIter.seekKey != nil {
+		dbIter.it.Seek(dbIter.seekKey)
+		if dbIter.skipKey != nil && dbIter.it.Valid() &&
+			bytes.Equal(dbIter.it.Key(), dbIter.skipKey) {
+
+			dbIter.it.Next()
+		}
+		dbIter.seekKey = nil
+		dbIter.skipKey = nil
+	} else if dbIter.key != nil {
+		dbIter.it.Next()
+	}
+
+	if !dbIter.it.ValidForPrefix(dbIter.prefix) {
+		dbIter.key = nil
+		dbIter.val = nil
+		return false
+	}
+
+	dbIter.key = append([]byte{}, dbIter.it.Key()...)
+	dbIter.val = nil
+	if dbIter.fetchValues {
+		val, err := dbIter.it.Value()
+		if err != nil {
+			dbIter.err = errors.Wrapf(err, "DBIterator.Next: Problem fetching value "+
+				"for key %v", hex.EncodeToString(dbIter.key))
+			dbIter.key = nil
+			return false
+		}
+		dbIter.val = val
+	}
+	return true
+}
+
+// Key returns the key of the current entry or nil if there isn't one.
+func (dbIter *DBIterator) Key() []byte {
+	return dbIter.key
+}
+
+// Value returns the value of the current entry. It's nil unless the iterator
+// was created with fetchValues set.
+func (dbIter *DBIterator) Value() []byte {
+	return dbIter.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (dbIter *DBIterator) Err() error {
+	return dbIter.err
+}
+
+// Cursor returns an opaque string that a DBIterator over the same prefix and in
+// the same direction can Resume from to continue right after the current entry.
+// It returns an empty string if there is no current entry.
+func (dbIter *DBIterator) Cursor() string {
+	if dbIter.key == nil {
+		return ""
+	}
+	return hex.EncodeToString(dbIter.key)
+}
+
+// Resume continues the iteration right after the entry the cursor was taken at,
+// even if that entry has since been deleted. An empty cursor starts from the top.
+func (dbIter *DBIterator) Resume(cursor string) error {
+	if cursor == "" {
+		dbIter.Seek(dbIter.prefix)
+		return nil
+	}
+	lastKey, err := hex.DecodeString(cursor)
+	if err != nil {
+		return errors.Wrapf(err, "DBIterator.Resume: Invalid cursor")
+	}
+	if !bytes.HasPrefix(lastKey, dbIter.prefix) {
+		return fmt.Errorf("DBIterator.Resume: Cursor is for a different prefix")
+	}
+	dbIter.seekKey = lastKey
+	dbIter.skipKey = lastKey
+	dbIter.key = nil
+	dbIter.val = nil
+	return nil
+}
+
+// Close releases the iterator and its txn. The iterator can't be used after.
+func (dbIter *DBIterator) Close() {
+	dbIter.it.Close()
+	dbIter.txn.Discard()
+}
+
+func DBGetPaginatedPostsOrderedByTime(
+	db *badger.DB, startPostTimestampNanos uint64, startPostHash *BlockHash,
+	numToFetch int, fetchPostEntries bool, reverse bool) (
+	_postHashes []*BlockHash, _tstampNanos []uint64, _postEntries []*PostEntry,
+	_err error) {
+
+	startPostPrefix := append([]byte{}, _PrefixTstampNanosPostHash...)
+
+	if startPostTimestampNanos > 0 {
+		startTstampBytes := EncodeUint64(startPostTimestampNanos)
+		startPostPrefix = append(startPostPrefix, startTstampBytes...)
+	}
+
+	if startPostHash != nil {
+		startPostPrefix = append(startPostPrefix, startPostHash[:]...)
+	}
+
+	// We fetch in reverse to get the latest posts.
+	maxUint64Tstamp := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	postIndexKeys, _, err := DBGetPaginatedKeysAndValuesForPrefix(
+		db, startPostPrefix, _PrefixTstampNanosPostHash, /*validForPrefix*/
+		len(_PrefixTstampNanosPostHash)+len(maxUint64Tstamp)+HashSizeBytes, /*keyLen*/
+		numToFetch, reverse /*reverse*/, false /*fetchValues*/)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("DBGetPaginatedPostsOrderedByTime: %v", err)
+	}
+
+	// Cut the post hashes and timestamps out of the returned keys.
+	postHashes := []*BlockHash{}
+	tstamps := []uint64{}
+	startTstampIndex := len(_PrefixTstampNanosPostHash)
+	hashStartIndex := len(_PrefixTstampNanosPostHash) + len(maxUint64Tstamp)
+	hashEndIndex := hashStartIndex + HashSizeBytes
+	for _, postKeyBytes := range postIndexKeys {
+		currentPostHash := &BlockHash{}
+		copy(currentPostHash[:], postKeyBytes[hashStartIndex:hashEndIndex])
+		postHashes = append(postHashes, currentPostHash)
+
+		tstamps = append(tstamps, DecodeUint64(
+			postKeyBytes[startTstampIndex:hashStartIndex]))
+	}
+
+	// Fetch the PostEntries if desired.
+	var postEntries []*PostEntry
+	if fetchPostEntries {
+		postEntries = DBGetPostEntriesByPostHashes(db, postHashes)
+		for ii, postEntry := range postEntries {
+			if postEntry == nil {
+				return nil, nil, nil, fmt.Errorf("DBGetPaginatedPostsOrderedByTime: "+
+					"PostHash %v does not have corresponding entry", postHashes[ii])
+			}
+		}
+	}
+
+	return postHashes, tstamps, postEntries, nil
+}
+
+func DBGetProfilesByUsernamePrefixAndBitCloutLocked(
+	db *badger.DB, usernamePrefix string, utxoView *UtxoView) (
+	_profileEntries []*ProfileEntry, _err error) {
+
+	startPrefix := append([]byte{}, _PrefixProfileUsernameToPKID...)
+	lowercaseUsernamePrefixString := strings.ToLower(usernamePrefix)
+	lowercaseUsernamePrefix := []byte(lowercaseUsernamePrefixString)
+	startPrefix = append(startPrefix, lowercaseUsernamePrefix...)
+
+	_, pkidsFound, err := DBGetPaginatedKeysAndValuesForPrefix(
+		db /*db*/, startPrefix, /*startPrefix*/
+		startPrefix /*validForPrefix*/, 0, /*keyLen (ignored when reverse == false)*/
+		0 /*numToFetch (zero fetches all)*/, false, /*reverse*/
+		true /*fetchValues*/)
+	if err != nil {
+		return nil, fmt.Errorf("DBGetProfilesByUsernamePrefixAndBitCloutLocked: %v", err)
+	}
+
+	// Have to do this to convert the PKIDs back into public keys
+	// TODO: We should clean things up around public keys vs PKIDs
+	pubKeysMap := make(map[PkMapKey][]byte)
+	for _, pkidBytes := range pkidsFound {
+		if len(pkidBytes) != btcec.PubKeyBytesLenCompressed {
+			continue
+		}
+		pkid := &PKID{}
+		copy(pkid[:], pkidBytes)
+		pubKey := DBGetPublicKeyForPKID(db, pkid)
+		if len(pubKey) != 0 {
+			pubKeysMap[MakePkMapKey(pubKey)] = pubKey
+		}
+	}
+
+	for username, profileEntry := range utxoView.ProfileUsernameToProfileEntry {
+		if strings.HasPrefix(string(username[:]), lowercaseUsernamePrefixString) {
+			pkMapKey := MakePkMapKey(profileEntry.PublicKey)
+			pubKeysMap[pkMapKey] = profileEntry.PublicKey
+		}
+	}
+
+	// Sigh.. convert the public keys *back* into PKIDs...
+	profilesFound := []*ProfileEntry{}
+	for _, pk := range pubKeysMap {
+		pkid := utxoView.GetPKIDForPublicKey(pk).PKID
+		profile := utxoView.GetProfileEntryForPKID(pkid)
+		// Double-check that a username matches the prefix.
+		// If a user had the handle "elon" and then changed to "jeff" and that transaction hadn't mined yet,
+		// we would return the profile for "jeff" when we search for "elon" which is incorrect.
+		if profile != nil && strings.HasPrefix(strings.ToLower(string(profile.Username[:])), lowercaseUsernamePrefixString) {
+			profilesFound = append(profilesFound, profile)
+		}
+	}
+
+	// If there is no error, sort and return numToFetch. Username searches are always
+	// sorted by coin value.
+	sort.Slice(profilesFound, func(ii, jj int) bool {
+		return profilesFound[ii].CoinEntry.BitCloutLockedNanos > profilesFound[jj].CoinEntry.BitCloutLockedNanos
+	})
+
+	return profilesFound, nil
+}
+
+// DBGetPaginatedProfilesByBitCloutLocked returns up to 'numToFetch' profiles from the db.
+func DBGetPaginatedProfilesByBitCloutLocked(
+	db *badger.DB, startBitCloutLockedNanos uint64,
+	startProfilePubKeyy []byte, numToFetch int, fetchProfileEntries bool) (
+	_profilePublicKeys [][]byte, _profileEntries []*ProfileEntry, _err error) {
+
+	// Convert the start public key to a PKID.
+	pkidEntry := DBGetPKIDEntryForPublicKey(db, startProfilePubKeyy)
+
+	startProfilePrefix := append([]byte{}, _PrefixCreatorBitCloutLockedNanosCreatorPKID...)
+	var startBitCloutLockedBytes []byte
+	if pkidEntry != nil {
+		startBitCloutLockedBytes = EncodeUint64(startBitCloutLockedNanos)
+		startProfilePrefix = append(startProfilePrefix, startBitCloutLockedBytes...)
+		startProfilePrefix = append(startProfilePrefix, pkidEntry.PKID[:]...)
+	} else {
+		// If no pub key is provided, we just max out bitclout locked and start at the top of the list.
+		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+		startBitCloutLockedBytes = maxBigEndianUint64Bytes
+		startProfilePrefix = append(startProfilePrefix, startBitCloutLockedBytes...)
+	}
+
+	keyLen := len(_PrefixCreatorBitCloutLockedNanosCreatorPKID) + len(startBitCloutLockedBytes) + btcec.PubKeyBytesLenCompressed
+	// We fetch in reverse to get the profiles with the most BitClout locked.
+	profileIndexKeys, _, err := DBGetPaginatedKeysAndValuesForPrefix(
+		db, startProfilePrefix, _PrefixCreatorBitCloutLockedNanosCreatorPKID, /*validForPrefix*/
+		keyLen /*keyLen*/, numToFetch,
+		true /*reverse*/, false /*fetchValues*/)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DBGetPaginatedProfilesByBitCloutLocked: %v", err)
+	}
+
+	// Cut the pkids out of the returned keys.
+	profilePKIDs := [][]byte{}
+	startPKIDIndex := len(_PrefixCreatorBitCloutLockedNanosCreatorPKID) + len(startBitCloutLockedBytes)
+	endPKIDIndex := startPKIDIndex + btcec.PubKeyBytesLenCompressed
+	for _, profileKeyBytes := range profileIndexKeys {
+		currentPKID := make([]byte, btcec.PubKeyBytesLenCompressed)
+		copy(currentPKID[:], profileKeyBytes[startPKIDIndex:endPKIDIndex][:])
+		profilePKIDs = append(profilePKIDs, currentPKID)
+	}
+
+	profilePubKeys := [][]byte{}
+	for _, pkidBytes := range profilePKIDs {
+		pkid := &PKID{}
+		copy(pkid[:], pkidBytes)
+		profilePubKeys = append(profilePubKeys, DBGetPublicKeyForPKID(db, pkid))
+	}
+
+	if !fetchProfileEntries {
+		return profilePubKeys, nil, nil
+	}
 
-		// Delete the reclout entries for the post.
-		if IsVanillaReclout(postEntry) {
-			if err := txn.Delete(
-				_dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(postEntry.PosterPublicKey, *postEntry.RecloutedPostHash)); err != nil {
-				return errors.Wrapf(err, "DbDeletePostEntryMappingsWithTxn: Error problem deleting mapping for recloutPostHash to ReclouterPubKey: %v", err)
-			}
+	// Fetch the ProfileEntries if desired.
+	pkids := []*PKID{}
+	for _, profilePKID := range profilePKIDs {
+		pkid := &PKID{}
+		copy(pkid[:], profilePKID)
+		pkids = append(pkids, pkid)
+	}
+	profileEntries := DBGetProfileEntriesForPKIDs(db, pkids)
+	for ii, profileEntry := range profileEntries {
+		if profileEntry == nil {
+			return nil, nil, fmt.Errorf("DBGetAllProfilesByLockedBitClout: "+
+				"ProfilePKID %v does not have corresponding entry",
+				PkToStringBoth(profilePKIDs[ii]))
 		}
 	}
 
-	return nil
+	return profilePubKeys, profileEntries, nil
 }
 
-func DBDeletePostEntryMappings(
-	handle *badger.DB, postHash *BlockHash, params *BitCloutParams) error {
+// -------------------------------------------------------------------------------------
+// Mempool Txn mapping funcions
+// <prefix, txn hash BlockHash> -> <*MsgBitCloutTxn>
+// -------------------------------------------------------------------------------------
 
-	return handle.Update(func(txn *badger.Txn) error {
-		return DBDeletePostEntryMappingsWithTxn(txn, postHash, params)
-	})
+func _dbKeyForMempoolTxn(txHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixMempoolTxnHashToMsgBitCloutTxn...)
+	return append(prefixCopy, txHash[:]...)
 }
 
-func DBPutPostEntryMappingsWithTxn(
-	txn *badger.Txn, postEntry *PostEntry, params *BitCloutParams) error {
-
-	postDataBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(postDataBuf).Encode(postEntry)
-
-	if err := txn.Set(_dbKeyForPostEntryHash(
-		postEntry.PostHash), postDataBuf.Bytes()); err != nil {
-
-		return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-			"adding mapping for post: %v", postEntry.PostHash)
+func _dbBufForMempoolTxn(mempoolTx *MempoolTx) ([]byte, error) {
+	mempoolTxnBytes, err := mempoolTx.Tx.ToBytes(false /*preSignatureBool*/)
+	if err != nil {
+		return nil, err
 	}
+	return append(EncodeUint64(uint64(mempoolTx.Added.UnixNano())), mempoolTxnBytes...), nil
+}
 
-	// If the post is a comment we store it in a separate index. Comments are
-	// technically posts but they really should be treated as their own entity.
-	// The only reason they're not actually implemented that way is so that we
-	// get code re-use.
-	isComment := len(postEntry.ParentStakeID) != 0
-	if isComment {
-		// Extend the parent stake ID, which is a block hash, to 33 bytes, which
-		// is the length of a public key and the standard length we use for this
-		// key.
-		extendedStakeID := append([]byte{}, postEntry.ParentStakeID...)
-		if len(extendedStakeID) == HashSizeBytes {
-			extendedStakeID = append(extendedStakeID, 0x00)
-		}
-		if len(extendedStakeID) != btcec.PubKeyBytesLenCompressed {
-			return fmt.Errorf("DbPutPostEntryMappingsWithTxn: extended "+
-				"ParentStakeID %#v must have length %v",
-				extendedStakeID, btcec.PubKeyBytesLenCompressed)
-		}
-		parentStakeIDKey := _dbKeyForCommentParentStakeIDToPostHash(
-			extendedStakeID, postEntry.TimestampNanos, postEntry.PostHash)
-		if err := txn.Set(parentStakeIDKey, []byte{}); err != nil {
+func _dbDecodeMempoolTxnBuf(buf []byte) (_timeAdded time.Time, _txn *MsgBitCloutTxn, _err error) {
+	if len(buf) < 8 {
+		return time.Time{}, nil, fmt.Errorf("_dbDecodeMempoolTxnBuf: Value has length %d, "+
+			"which is too short to hold the time added", len(buf))
+	}
+	timeAdded := time.Unix(0, int64(DecodeUint64(buf[:8])))
+	mempoolTxn := &MsgBitCloutTxn{}
+	if err := mempoolTxn.FromBytes(buf[8:]); err != nil {
+		return time.Time{}, nil, err
+	}
+	return timeAdded, mempoolTxn, nil
+}
 
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-				"adding mapping for comment: %v: %v", postEntry, err)
-		}
+func DbPutMempoolTxnWithTxn(txn KVTxn, mempoolTx *MempoolTx) error {
 
-	} else {
-		if err := txn.Set(_dbKeyForPosterPublicKeyTimestampPostHash(
-			postEntry.PosterPublicKey, postEntry.TimestampNanos, postEntry.PostHash), []byte{}); err != nil {
+	mempoolTxnBuf, err := _dbBufForMempoolTxn(mempoolTx)
+	if err != nil {
+		return errors.Wrapf(err, "DbPutMempoolTxnWithTxn: Problem encoding mempoolTxn to bytes.")
+	}
 
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-				"adding mapping for public key: %v: %v", postEntry, err)
-		}
-		if err := txn.Set(_dbKeyForTstampPostHash(
-			postEntry.TimestampNanos, postEntry.PostHash), []byte{}); err != nil {
+	if err := txn.Set(_dbKeyForMempoolTxn(mempoolTx.Hash), mempoolTxnBuf); err != nil {
+		return errors.Wrapf(err, "DbPutMempoolTxnWithTxn: Problem putting mapping for txn hash: %s", mempoolTx.Hash.String())
+	}
 
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-				"adding mapping for tstamp: %v", postEntry)
-		}
-		if err := txn.Set(_dbKeyForCreatorBpsPostHash(
-			postEntry.CreatorBasisPoints, postEntry.PostHash), []byte{}); err != nil {
+	return nil
+}
 
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-				"adding mapping for creatorBps: %v", postEntry)
-		}
-		if err := txn.Set(_dbKeyForStakeMultipleBpsPostHash(
-			postEntry.StakeMultipleBasisPoints, postEntry.PostHash), []byte{}); err != nil {
+func DbPutMempoolTxn(handle *badger.DB, mempoolTx *MempoolTx) error {
 
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-				"adding mapping for stakeMultipleBps: %v", postEntry)
-		}
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutMempoolTxnWithTxn(txn, mempoolTx)
+	})
+}
 
-		// Get stats for the post.
-		// <prefix | PostType | AmountStaked | PostHash> -> <>
-		stakeStats := GetStakeEntryStats(postEntry.StakeEntry, params)
-		if err := txn.Set(
-			_dbGetStakeIDPostDBKey(
-				postEntry.PostHash, stakeStats.TotalStakeNanos), []byte{}); err != nil {
+func DbGetMempoolTxnWithTxn(txn KVTxn, mempoolTx *MempoolTx) *MsgBitCloutTxn {
 
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Problem "+
-				"adding mapping for stakeMultipleBps: %v", postEntry)
-		}
+	key := _dbKeyForMempoolTxn(mempoolTx.Hash)
+	valBytes, err := txn.Get(key)
+	if err != nil {
+		return nil
 	}
-	// We treat reclouting the same for both comments and posts.
-	// We only store reclout entry mappings for vanilla reclouts
-	if IsVanillaReclout(postEntry) {
-		recloutEntry := RecloutEntry{
-			RecloutPostHash:   postEntry.PostHash,
-			RecloutedPostHash: postEntry.RecloutedPostHash,
-			ReclouterPubKey:   postEntry.PosterPublicKey,
-		}
-		recloutDataBuf := bytes.NewBuffer([]byte{})
-		gob.NewEncoder(recloutDataBuf).Encode(recloutEntry)
-		if err := txn.Set(
-			_dbKeyForReclouterPubKeyRecloutedPostHashToRecloutPostHash(postEntry.PosterPublicKey, *postEntry.RecloutedPostHash),
-			recloutDataBuf.Bytes()); err != nil {
-			return errors.Wrapf(err, "DbPutPostEntryMappingsWithTxn: Error problem adding mapping for recloutPostHash to ReclouterPubKey: %v", err)
-		}
+	_, mempoolTxnObj, err := _dbDecodeMempoolTxnBuf(valBytes)
+	if err != nil {
+		RecordDbDecodeFailure(key)
+		glog.Errorf("DbGetMempoolTxnWithTxn: Problem reading "+
+			"Tx for tx hash %s: %v", mempoolTx.Hash.String(), err)
+		return nil
 	}
-	return nil
+	return mempoolTxnObj
 }
 
-func DBPutPostEntryMappings(handle *badger.DB, postEntry *PostEntry, params *BitCloutParams) error {
-
-	return handle.Update(func(txn *badger.Txn) error {
-		return DBPutPostEntryMappingsWithTxn(txn, postEntry, params)
+func DbGetMempoolTxn(db *badger.DB, mempoolTx *MempoolTx) *MsgBitCloutTxn {
+	var ret *MsgBitCloutTxn
+	DbView(db, func(txn KVTxn) error {
+		ret = DbGetMempoolTxnWithTxn(txn, mempoolTx)
+		return nil
 	})
+	return ret
 }
 
-// Specifying minTimestampNanos gives you all posts after minTimestampNanos
-// Pass minTimestampNanos = 0 && maxTimestampNanos = 0 if you want all posts
-// Setting maxTimestampNanos = 0, will default maxTimestampNanos to the current time.
-func DBGetAllPostsAndCommentsForPublicKeyOrderedByTimestamp(
-	handle *badger.DB, publicKey []byte, fetchEntries bool, minTimestampNanos uint64, maxTimestampNanos uint64) (
-	_tstamps []uint64, _postAndCommentHashes []*BlockHash, _postAndCommentEntries []*PostEntry, _err error) {
-
-	tstampsFetched := []uint64{}
-	postAndCommentHashesFetched := []*BlockHash{}
-	postAndCommentEntriesFetched := []*PostEntry{}
-	dbPrefixx := append([]byte{}, _PrefixPosterPublicKeyTimestampPostHash...)
-	dbPrefixx = append(dbPrefixx, publicKey...)
-
-	err := handle.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		opts.PrefetchValues = false
-
-		// Go in reverse order since a larger count is better.
-		opts.Reverse = true
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		// Since we iterate backwards, the prefix must be bigger than all possible
-		// timestamps that could actually exist. We use eight bytes since the timestamp is
-		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
-		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-		prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
+func DbGetAllMempoolTxnsSortedByTimeAdded(handle *badger.DB) (_mempoolTxns []*MsgBitCloutTxn, _error error) {
+	keysFound, valuesFound := _enumerateKeysForPrefix(handle, _PrefixMempoolTxnHashToMsgBitCloutTxn)
 
-		// If we have a maxTimeStamp, we use that instead of the maxBigEndianUint64.
-		if maxTimestampNanos != 0 {
-			prefix = append(dbPrefixx, EncodeUint64(maxTimestampNanos)...)
+	type mempoolTxnWithTimeAdded struct {
+		timeAdded time.Time
+		txn       *MsgBitCloutTxn
+	}
+	mempoolTxnsWithTimeAdded := []*mempoolTxnWithTimeAdded{}
+	for ii, mempoolTxnBuf := range valuesFound {
+		timeAdded, mempoolTxn, err := _dbDecodeMempoolTxnBuf(mempoolTxnBuf)
+		if err != nil {
+			RecordDbDecodeFailure(keysFound[ii])
+			return nil, errors.Wrapf(err, "DbGetAllMempoolTxnsSortedByTimeAdded: failed to decode mempoolTxnBytes.")
 		}
+		mempoolTxnsWithTimeAdded = append(mempoolTxnsWithTimeAdded, &mempoolTxnWithTimeAdded{
+			timeAdded: timeAdded,
+			txn:       mempoolTxn,
+		})
+	}
 
-		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
-			rawKey := it.Item().Key()
-
-			// Key should be
-			// [prefix][posterPublicKey][Timestamp][PostHash]
+	// The keys are ordered by hash so the txns have to be sorted by the time they
+	// were added. Txns added at the same time stay in hash order.
+	sort.SliceStable(mempoolTxnsWithTimeAdded, func(ii, jj int) bool {
+		return mempoolTxnsWithTimeAdded[ii].timeAdded.Before(mempoolTxnsWithTimeAdded[jj].timeAdded)
+	})
+	mempoolTxns := []*MsgBitCloutTxn{}
+	for _, mempoolTxn := range mempoolTxnsWithTimeAdded {
+		mempoolTxns = append(mempoolTxns, mempoolTxn.txn)
+	}
 
-			// Pull out the relevant fields
-			timestampSizeBytes := 8
-			keyWithoutPrefix := rawKey[1:]
-			//posterPublicKey := keyWithoutPrefix[:HashSizeBytes]
-			publicKeySizeBytes := HashSizeBytes + 1
-			tstampNanos := DecodeUint64(keyWithoutPrefix[publicKeySizeBytes:(publicKeySizeBytes + timestampSizeBytes)])
+	return mempoolTxns, nil
+}
 
-			postHash := &BlockHash{}
-			copy(postHash[:], keyWithoutPrefix[(publicKeySizeBytes+timestampSizeBytes):])
+// DbMigrateMempoolTxnsToHashKeys rewrites the mempool txns stored when they
+// were keyed by <time added, txn hash> under their txn hash alone, with the time
+// added moved into the value. A txn stored more than once under the old keys is
+// kept with the earliest time it was added. It returns the number of old keys
+// it rewrote.
+func DbMigrateMempoolTxnsToHashKeys(handle *badger.DB) (_numKeys int, _err error) {
+	oldKeyLen := len(_PrefixMempoolTxnHashToMsgBitCloutTxn) + 8 + HashSizeBytes
 
-			if tstampNanos < minTimestampNanos {
-				break
+	numKeys := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		return EnumerateKeysForPrefixWithCallback(handle, _PrefixMempoolTxnHashToMsgBitCloutTxn, func(key []byte, val []byte) (bool, error) {
+			if len(key) != oldKeyLen {
+				return true, nil
 			}
-
-			tstampsFetched = append(tstampsFetched, tstampNanos)
-			postAndCommentHashesFetched = append(postAndCommentHashesFetched, postHash)
-		}
-		return nil
+			oldKey := append([]byte{}, key...)
+			txHash := &BlockHash{}
+			copy(txHash[:], oldKey[len(oldKey)-HashSizeBytes:])
+			timeAddedBytes := oldKey[len(_PrefixMempoolTxnHashToMsgBitCloutTxn) : len(_PrefixMempoolTxnHashToMsgBitCloutTxn)+8]
+			newKey := _dbKeyForMempoolTxn(txHash)
+			newVal := append(append([]byte{}, timeAddedBytes...), val...)
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				// The old keys are in order of time added so the first one
+				// found for a txn is the earliest.
+				if _, err := txn.Get(newKey); err == ErrKVKeyNotFound {
+					if err := txn.Set(newKey, newVal); err != nil {
+						return err
+					}
+				} else if err != nil {
+					return err
+				}
+				return txn.Delete(oldKey)
+			}); err != nil {
+				return false, err
+			}
+			numKeys++
+			return true, nil
+		})
 	})
 	if err != nil {
-		return nil, nil, nil, err
+		return 0, errors.Wrapf(err, "DbMigrateMempoolTxnsToHashKeys: ")
 	}
 
-	if !fetchEntries {
-		return tstampsFetched, postAndCommentHashesFetched, nil, nil
+	return numKeys, nil
+}
+
+func DbDeleteAllMempoolTxnsWithTxn(txn KVTxn) error {
+	txnKeysFound, _, err := _enumerateKeysForPrefixWithTxn(txn, _PrefixMempoolTxnHashToMsgBitCloutTxn)
+	if err != nil {
+		return errors.Wrapf(err, "DbDeleteAllMempoolTxnsWithTxn: ")
 	}
 
-	for _, postHash := range postAndCommentHashesFetched {
-		postEntry := DBGetPostEntryByPostHash(handle, postHash)
-		if postEntry == nil {
-			return nil, nil, nil, fmt.Errorf("DBGetPostEntryByPostHash: "+
-				"PostHash %v does not have corresponding entry", postHash)
+	for _, txnKey := range txnKeysFound {
+		err := DbDeleteMempoolTxnKeyWithTxn(txn, txnKey)
+		if err != nil {
+			return errors.Wrapf(err, "DbDeleteAllMempoolTxMappings: Deleting mempool txnKey failed.")
 		}
-		postAndCommentEntriesFetched = append(postAndCommentEntriesFetched, postEntry)
 	}
 
-	return tstampsFetched, postAndCommentHashesFetched, postAndCommentEntriesFetched, nil
+	return nil
 }
 
-// DBGetAllPostsByTstamp returns all the posts in the db with the newest
-// posts first.
-//
-// TODO(performance): This currently fetches all posts. We should implement
-// some kind of pagination instead though.
-func DBGetAllPostsByTstamp(handle *badger.DB, fetchEntries bool) (
-	_tstamps []uint64, _postHashes []*BlockHash, _postEntries []*PostEntry, _err error) {
-
-	tstampsFetched := []uint64{}
-	postHashesFetched := []*BlockHash{}
-	postEntriesFetched := []*PostEntry{}
-	dbPrefixx := append([]byte{}, _PrefixTstampNanosPostHash...)
-
-	err := handle.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		opts.PrefetchValues = false
-
-		// Go in reverse order since a larger count is better.
-		opts.Reverse = true
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		// Since we iterate backwards, the prefix must be bigger than all possible
-		// timestamps that could actually exist. We use eight bytes since the timestamp is
-		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
-		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-		prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
-		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
-			rawKey := it.Item().Key()
+// _dedupMempoolTxns returns allTxns with each txn only once, with the earliest
+// time it was added, so a flush doesn't write a txn over itself.
+func _dedupMempoolTxns(allTxns []*MempoolTx) []*MempoolTx {
+	txnIndexForHash := make(map[BlockHash]int, len(allTxns))
+	dedupedTxns := []*MempoolTx{}
+	for _, mempoolTx := range allTxns {
+		txnIndex, exists := txnIndexForHash[*mempoolTx.Hash]
+		if !exists {
+			txnIndexForHash[*mempoolTx.Hash] = len(dedupedTxns)
+			dedupedTxns = append(dedupedTxns, mempoolTx)
+			continue
+		}
+		if mempoolTx.Added.Before(dedupedTxns[txnIndex].Added) {
+			dedupedTxns[txnIndex] = mempoolTx
+		}
+	}
+	return dedupedTxns
+}
 
-			// Strip the prefix off the key and check its length. If it contains
-			// a big-endian uint64 then it should be at least eight bytes.
-			tstampPostHashKey := rawKey[1:]
-			uint64BytesLen := len(maxBigEndianUint64Bytes)
-			if len(tstampPostHashKey) != uint64BytesLen+HashSizeBytes {
-				return fmt.Errorf("DBGetAllPostsByTstamp: Invalid key "+
-					"length %d should be at least %d", len(tstampPostHashKey),
-					uint64BytesLen+HashSizeBytes)
-			}
+func FlushMempoolToDbWithTxn(txn KVTxn, allTxns []*MempoolTx) error {
+	for _, mempoolTx := range _dedupMempoolTxns(allTxns) {
+		err := DbPutMempoolTxnWithTxn(txn, mempoolTx)
+		if err != nil {
+			return errors.Wrapf(err, "FlushMempoolToDb: Putting "+
+				"mempool tx hash %s failed.", mempoolTx.Hash.String())
+		}
+	}
 
-			tstampNanos := DecodeUint64(tstampPostHashKey[:uint64BytesLen])
+	return nil
+}
 
-			// Appended to the tstamp should be the post hash so extract it here.
-			postHash := &BlockHash{}
-			copy(postHash[:], tstampPostHashKey[uint64BytesLen:])
+// FlushMempoolToDb writes allTxns to the db through a DbWriteBatch so a large
+// mempool doesn't have to fit in a single txn. When onProgress is set it's called
+// with the number of txns written after every progressInterval txns.
+func FlushMempoolToDb(handle *badger.DB, allTxns []*MempoolTx, progressInterval uint64,
+	onProgress func(numTxns uint64)) error {
 
-			tstampsFetched = append(tstampsFetched, tstampNanos)
-			postHashesFetched = append(postHashesFetched, postHash)
+	return DbUpdateWithWriteBatch(handle, progressInterval, onProgress, func(dbWriteBatch *DbWriteBatch) error {
+		for _, mempoolTx := range _dedupMempoolTxns(allTxns) {
+			mempoolTxnBuf, err := _dbBufForMempoolTxn(mempoolTx)
+			if err != nil {
+				return errors.Wrapf(err, "FlushMempoolToDb: Problem encoding "+
+					"mempool tx hash %s", mempoolTx.Hash.String())
+			}
+			if err := dbWriteBatch.Set(_dbKeyForMempoolTxn(mempoolTx.Hash), mempoolTxnBuf); err != nil {
+				return errors.Wrapf(err, "FlushMempoolToDb: Putting "+
+					"mempool tx hash %s failed.", mempoolTx.Hash.String())
+			}
 		}
 		return nil
 	})
-	if err != nil {
-		return nil, nil, nil, err
-	}
+}
 
-	if !fetchEntries {
-		return tstampsFetched, postHashesFetched, nil, nil
-	}
+func DbDeleteAllMempoolTxns(handle *badger.DB) error {
+	DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteAllMempoolTxnsWithTxn(txn)
+	})
 
-	for _, postHash := range postHashesFetched {
-		postEntry := DBGetPostEntryByPostHash(handle, postHash)
-		if postEntry == nil {
-			return nil, nil, nil, fmt.Errorf("DBGetPostEntryByPostHash: "+
-				"PostHash %v does not have corresponding entry", postHash)
-		}
-		postEntriesFetched = append(postEntriesFetched, postEntry)
+	return nil
+}
+
+func DbDeleteMempoolTxnWithTxn(txn KVTxn, mempoolTx *MempoolTx) error {
+
+	// When a mapping exists, delete it.
+	if err := txn.Delete(_dbKeyForMempoolTxn(mempoolTx.Hash)); err != nil {
+		return errors.Wrapf(err, "DbDeleteMempoolTxMappingWithTxn: Deleting "+
+			"mempool tx key failed.")
 	}
 
-	return tstampsFetched, postHashesFetched, postEntriesFetched, nil
+	return nil
 }
 
-// DBGetCommentPostHashesForParentStakeID returns all the comments, which are indexed by their
-// stake ID rather than by their timestamp.
-//
-// TODO(performance): This currently fetches all comments. We should implement
-// something where we only get the comments for particular posts instead.
-func DBGetCommentPostHashesForParentStakeID(
-	handle *badger.DB, stakeIDXXX []byte, fetchEntries bool) (
-	_tstamps []uint64, _commentPostHashes []*BlockHash, _commentPostEntryes []*PostEntry, _err error) {
+func DbDeleteMempoolTxn(handle *badger.DB, mempoolTx *MempoolTx) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteMempoolTxnWithTxn(txn, mempoolTx)
+	})
+}
 
-	tstampsFetched := []uint64{}
-	commentPostHashes := []*BlockHash{}
-	commentEntriesFetched := []*PostEntry{}
-	dbPrefixx := append([]byte{}, _PrefixCommentParentStakeIDToPostHash...)
-	dbPrefixx = append(dbPrefixx, stakeIDXXX...)
+func DbDeleteMempoolTxnKey(handle *badger.DB, txnKey []byte) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteMempoolTxnKeyWithTxn(txn, txnKey)
+	})
+}
 
-	err := handle.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+func DbDeleteMempoolTxnKeyWithTxn(txn KVTxn, txnKey []byte) error {
 
-		opts.PrefetchValues = false
+	// When a mapping exists, delete it.
+	if err := txn.Delete(txnKey); err != nil {
+		return errors.Wrapf(err, "DbDeleteMempoolTxMappingWithTxn: Deleting "+
+			"mempool tx key failed.")
+	}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		// Since we iterate backwards, the prefix must be bigger than all possible
-		// counts that could actually exist. We use eight bytes since the count is
-		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
-		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-		//prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
-		prefix := dbPrefixx
-		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
-			rawKey := it.Item().Key()
+	return nil
+}
 
-			// Strip the prefix off the key and check its length. It should contain
-			// a 33-byte stake id, an 8 byte tstamp, and a 32 byte comment hash.
-			stakeIDTstampPostHashKey := rawKey[1:]
-			uint64BytesLen := len(maxBigEndianUint64Bytes)
-			if len(stakeIDTstampPostHashKey) != btcec.PubKeyBytesLenCompressed+uint64BytesLen+HashSizeBytes {
-				return fmt.Errorf("DBGetCommentPostHashesForParentStakeID: Invalid key "+
-					"length %d should be at least %d", len(stakeIDTstampPostHashKey),
-					btcec.PubKeyBytesLenCompressed+uint64BytesLen+HashSizeBytes)
+// DbPrefixStats is how much is stored under a prefix in DbPrefixRegistry.
+type DbPrefixStats struct {
+	Name            string
+	Prefix          []byte
+	NumKeys         uint64
+	TotalValueBytes uint64
+	// AvgValueBytes is zero for a prefix with no keys.
+	AvgValueBytes uint64
+}
+
+// DBStats returns the number of keys and value bytes under every prefix in
+// DbPrefixRegistry, in registry order. Value sizes are the ones badger keeps
+// alongside the keys so no values are read.
+func DBStats(db *badger.DB) ([]*DbPrefixStats, error) {
+	allStats := []*DbPrefixStats{}
+	err := DbView(db, func(txn KVTxn) error {
+		for _, prefixInfo := range DbPrefixRegistry {
+			prefixStats := &DbPrefixStats{
+				Name:   prefixInfo.Name,
+				Prefix: prefixInfo.Prefix,
 			}
 
-			//stakeID := stakeIDTstampPostHashKey[:btcec.PubKeyBytesLenCompressed]
-			tstampNanos := DecodeUint64(stakeIDTstampPostHashKey[btcec.PubKeyBytesLenCompressed : btcec.PubKeyBytesLenCompressed+uint64BytesLen])
-
-			commentPostHashBytes := stakeIDTstampPostHashKey[btcec.PubKeyBytesLenCompressed+uint64BytesLen:]
-			commentPostHash := &BlockHash{}
-			copy(commentPostHash[:], commentPostHashBytes)
+			opts := KVIteratorOptions{}
+			opts.KeysOnly = true
+			opts.Prefix = prefixInfo.Prefix
+			nodeIterator := txn.NewIterator(opts)
+			for nodeIterator.Seek(prefixInfo.Prefix); nodeIterator.ValidForPrefix(prefixInfo.Prefix); nodeIterator.Next() {
+				prefixStats.NumKeys++
+				prefixStats.TotalValueBytes += uint64(nodeIterator.ValueSize())
+			}
+			nodeIterator.Close()
 
-			//stakeIDsFetched = append(stakeIDsFetched, stakeID)
-			tstampsFetched = append(tstampsFetched, tstampNanos)
-			commentPostHashes = append(commentPostHashes, commentPostHash)
+			if prefixStats.NumKeys > 0 {
+				prefixStats.AvgValueBytes = prefixStats.TotalValueBytes / prefixStats.NumKeys
+			}
+			allStats = append(allStats, prefixStats)
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, errors.Wrapf(err, "DBStats: ")
 	}
+	return allStats, nil
+}
 
-	if !fetchEntries {
-		return tstampsFetched, commentPostHashes, nil, nil
+func LogDBSummarySnapshot(db *badger.DB) {
+	allStats, err := DBStats(db)
+	if err != nil {
+		glog.Errorf("LogDBSummarySnapshot: %v", err)
+		return
 	}
-
-	for _, postHash := range commentPostHashes {
-		postEntry := DBGetPostEntryByPostHash(handle, postHash)
-		if postEntry == nil {
-			return nil, nil, nil, fmt.Errorf("DBGetCommentPostHashesForParentStakeID: "+
-				"PostHash %v does not have corresponding entry", postHash)
+	for _, prefixStats := range allStats {
+		if prefixStats.NumKeys == 0 {
+			continue
+		}
+		glog.Infof("LogDBSummarySnapshot: %s: %d keys, %d value bytes, %d avg value bytes",
+			prefixStats.Name, prefixStats.NumKeys, prefixStats.TotalValueBytes,
+			prefixStats.AvgValueBytes)
+	}
+}
+
+// LocalOnlyDbPrefixes are the prefixes holding data that is specific to this node
+// rather than derived from the chain. Anything that exports or compares chain state
+// should skip these.
+var LocalOnlyDbPrefixes = [][]byte{
+	_PrefixPublishAtTstampDraftHashToScheduledPostTxn,
+	_PrefixPublicKeyNamespaceKeyToLocalContent,
+	_PrefixPublicKeyTimestampToFaucetDisbursement,
+	_PrefixIPHashTimestampToFaucetDisbursement,
+	_KeyNodeIdentity,
+	_PrefixTstampNanosToNodeVersion,
+	_KeyTelemetryOptIn,
+	_PrefixQueryHashToQueryCacheEntry,
+	_KeyNodeConfig,
+	_KeyLegacyKeyNormalizationReports,
+	_PrefixDbPrefixToDecodeFailureCount,
+	_PrefixQuarantinedTimestampIndexEntry,
+	_PrefixPublicKeyHeightToBalanceSnapshot,
+	_KeyBalanceSnapshotsStartHeight,
+	_KeyPruneHeight,
+	_KeyUtxoOpsDeletedBelowHeight,
+	_KeyStateAccumulator,
+	_PrefixHeightToStateCommitment,
+	_KeyCrashBreadcrumb,
+	_KeyGenesisInitInProgress,
+	_PrefixIndexMigrationNameToState,
+	_PrefixMempoolTxnHashToMsgBitCloutTxn,
+	_PrefixMempoolTxIDToMetadata,
+	_PrefixMempoolPublicKeyTxID,
+}
+
+func IsLocalOnlyDbKey(key []byte) bool {
+	for _, prefix := range LocalOnlyDbPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
 		}
-		commentEntriesFetched = append(commentEntriesFetched, postEntry)
 	}
-
-	return tstampsFetched, commentPostHashes, commentEntriesFetched, nil
+	return false
 }
 
-// ======================================================================================
-// Profile code
-// ======================================================================================
-func _dbKeyForPKIDToProfileEntry(pkid *PKID) []byte {
-	prefixCopy := append([]byte{}, _PrefixPKIDToProfileEntry...)
-	key := append(prefixCopy, pkid[:]...)
-	return key
+// =====================================================================================
+// Local content code
+// =====================================================================================
+
+// MaxLocalContentNamespaceLength is the max length of a namespace like "drafts".
+const MaxLocalContentNamespaceLength = 64
+
+type LocalContentEntry struct {
+	PublicKey []byte
+	Namespace string
+	Key       []byte
+	Value     []byte
+
+	LastUpdatedTstampNanos uint64
 }
-func _dbKeyForProfileUsernameToPKID(nonLowercaseUsername []byte) []byte {
+
+func _dbSeekPrefixForLocalContentNamespace(publicKey []byte, namespace string) []byte {
 	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	key := append([]byte{}, _PrefixProfileUsernameToPKID...)
-	// Always lowercase the username when we use it as a key in our db. This allows
-	// us to check uniqueness in a case-insensitive way.
-	lowercaseUsername := []byte(strings.ToLower(string(nonLowercaseUsername)))
-	key = append(key, lowercaseUsername...)
-	return key
+	key := append([]byte{}, _PrefixPublicKeyNamespaceKeyToLocalContent...)
+	key = append(key, publicKey...)
+	key = append(key, UintToBuf(uint64(len(namespace)))...)
+	return append(key, []byte(namespace)...)
 }
 
-// This is the key we use to sort profiles by their amount of BitClout locked
-func _dbKeyForCreatorBitCloutLockedNanosCreatorPKID(bitCloutLockedNanos uint64, pkid *PKID) []byte {
-	key := append([]byte{}, _PrefixCreatorBitCloutLockedNanosCreatorPKID...)
-	key = append(key, EncodeUint64(bitCloutLockedNanos)...)
-	key = append(key, pkid[:]...)
-	return key
+func _dbKeyForLocalContent(publicKey []byte, namespace string, contentKey []byte) []byte {
+	return append(_dbSeekPrefixForLocalContentNamespace(publicKey, namespace), contentKey...)
 }
 
-func DBGetPKIDForUsernameWithTxn(
-	txn *badger.Txn, username []byte) *PKID {
+func _validateLocalContentKey(publicKey []byte, namespace string) error {
+	if len(publicKey) != btcec.PubKeyBytesLenCompressed {
+		return fmt.Errorf("Public key has length %d but should have length %d",
+			len(publicKey), btcec.PubKeyBytesLenCompressed)
+	}
+	if len(namespace) == 0 || len(namespace) > MaxLocalContentNamespaceLength {
+		return fmt.Errorf("Namespace %s must have length between 1 and %d",
+			namespace, MaxLocalContentNamespaceLength)
+	}
+	return nil
+}
 
-	key := _dbKeyForProfileUsernameToPKID(username)
-	profileEntryItem, err := txn.Get(key)
-	if err != nil {
-		return nil
+func DbPutLocalContent(handle *badger.DB, publicKey []byte, namespace string,
+	contentKey []byte, value []byte) error {
+
+	if err := _validateLocalContentKey(publicKey, namespace); err != nil {
+		return errors.Wrapf(err, "DbPutLocalContent: ")
 	}
-	pkidBytes, err := profileEntryItem.ValueCopy(nil)
-	if err != nil {
-		glog.Errorf("DBGetProfileEntryForUsernameWithTxn: Problem reading "+
-			"public key for username %v: %v", string(username), err)
-		return nil
+	if len(contentKey) == 0 {
+		return fmt.Errorf("DbPutLocalContent: Key must be non-empty")
 	}
 
-	return PublicKeyToPKID(pkidBytes)
+	entryBuf := bytes.NewBuffer([]byte{})
+	gob.NewEncoder(entryBuf).Encode(&LocalContentEntry{
+		PublicKey:              publicKey,
+		Namespace:              namespace,
+		Key:                    contentKey,
+		Value:                  value,
+		LastUpdatedTstampNanos: uint64(time.Now().UnixNano()),
+	})
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_dbKeyForLocalContent(publicKey, namespace, contentKey), entryBuf.Bytes())
+	})
 }
 
-func DBGetPKIDForUsername(db *badger.DB, username []byte) *PKID {
-	var ret *PKID
-	db.View(func(txn *badger.Txn) error {
-		ret = DBGetPKIDForUsernameWithTxn(txn, username)
+func DbGetLocalContent(handle *badger.DB, publicKey []byte, namespace string,
+	contentKey []byte) *LocalContentEntry {
+
+	var ret *LocalContentEntry
+	DbView(handle, func(txn KVTxn) error {
+		key := _dbKeyForLocalContent(publicKey, namespace, contentKey)
+		valBytes, err := txn.Get(key)
+		if err != nil {
+			return nil
+		}
+		entry := &LocalContentEntry{}
+		err = gob.NewDecoder(bytes.NewReader(valBytes)).Decode(entry)
+		if err != nil {
+			RecordDbDecodeFailure(key)
+			glog.Errorf("DbGetLocalContent: Problem decoding local content: %v", err)
+			return nil
+		}
+		ret = entry
 		return nil
 	})
 	return ret
 }
 
-func DBGetProfileEntryForUsernameWithTxn(
-	txn *badger.Txn, username []byte) *ProfileEntry {
+// DbListLocalContent returns all the content stored for a public key in a
+// namespace, sorted by key.
+func DbListLocalContent(handle *badger.DB, publicKey []byte, namespace string) (
+	_entries []*LocalContentEntry, _err error) {
 
-	pkid := DBGetPKIDForUsernameWithTxn(txn, username)
-	if pkid == nil {
-		return nil
+	if err := _validateLocalContentKey(publicKey, namespace); err != nil {
+		return nil, errors.Wrapf(err, "DbListLocalContent: ")
 	}
 
-	return DBGetProfileEntryForPKIDWithTxn(txn, pkid)
+	_, valsFound := _enumerateKeysForPrefix(
+		handle, _dbSeekPrefixForLocalContentNamespace(publicKey, namespace))
+	entries := []*LocalContentEntry{}
+	for _, valBytes := range valsFound {
+		entry := &LocalContentEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(entry); err != nil {
+			return nil, _corruptDbEntryError(err, "DbListLocalContent: Problem decoding local content")
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
 }
 
-func DBGetProfileEntryForUsername(db *badger.DB, username []byte) *ProfileEntry {
-	var ret *ProfileEntry
-	db.View(func(txn *badger.Txn) error {
-		ret = DBGetProfileEntryForUsernameWithTxn(txn, username)
-		return nil
+func DbDeleteLocalContent(handle *badger.DB, publicKey []byte, namespace string,
+	contentKey []byte) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForLocalContent(publicKey, namespace, contentKey))
 	})
-	return ret
 }
 
-func DBGetProfileEntryForPKIDWithTxn(
-	txn *badger.Txn, pkid *PKID) *ProfileEntry {
+// =====================================================================================
+// Scheduled post code
+// =====================================================================================
 
-	key := _dbKeyForPKIDToProfileEntry(pkid)
-	profileEntryObj := &ProfileEntry{}
-	profileEntryItem, err := txn.Get(key)
+type ScheduledPostTxn struct {
+	PublishAtTstampNanos uint64
+	DraftHash            *BlockHash
+	Txn                  *MsgBitCloutTxn
+}
+
+func _dbKeyForScheduledPostTxn(publishAtTstampNanos uint64, draftHash *BlockHash) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixPublishAtTstampDraftHashToScheduledPostTxn...)
+	key = append(key, EncodeUint64(publishAtTstampNanos)...)
+	return append(key, draftHash[:]...)
+}
+
+// DbPutScheduledPostTxn stores a signed submit post txn to be published at the given
+// time and returns its draft hash.
+func DbPutScheduledPostTxn(handle *badger.DB, publishAtTstampNanos uint64,
+	postTxn *MsgBitCloutTxn) (_draftHash *BlockHash, _err error) {
+
+	if postTxn.TxnMeta == nil || postTxn.TxnMeta.GetTxnType() != TxnTypeSubmitPost {
+		return nil, fmt.Errorf("DbPutScheduledPostTxn: Only submit post txns can be scheduled")
+	}
+	if postTxn.Signature == nil {
+		return nil, fmt.Errorf("DbPutScheduledPostTxn: Scheduled txns must be signed")
+	}
+	txnBytes, err := postTxn.ToBytes(false /*preSignature*/)
 	if err != nil {
-		return nil
+		return nil, errors.Wrapf(err, "DbPutScheduledPostTxn: Problem serializing txn")
 	}
-	err = profileEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(profileEntryObj)
+	draftHash := postTxn.Hash()
+
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_dbKeyForScheduledPostTxn(publishAtTstampNanos, draftHash), txnBytes)
 	})
 	if err != nil {
-		glog.Errorf("DBGetProfileEntryForPubKeyWithTxnhWithTxn: Problem reading "+
-			"ProfileEntry for PKID %v", pkid)
-		return nil
+		return nil, errors.Wrapf(err, "DbPutScheduledPostTxn: Problem adding "+
+			"scheduled post %v", draftHash)
 	}
-	return profileEntryObj
+	return draftHash, nil
 }
 
-func DBGetProfileEntryForPKID(db *badger.DB, pkid *PKID) *ProfileEntry {
-	var ret *ProfileEntry
-	db.View(func(txn *badger.Txn) error {
-		ret = DBGetProfileEntryForPKIDWithTxn(txn, pkid)
-		return nil
-	})
-	return ret
-}
+// DbGetScheduledPostTxns returns all the scheduled posts that should be published at
+// or before maxPublishAtTstampNanos, sorted by publish time. Pass math.MaxUint64 to
+// get all of them.
+func DbGetScheduledPostTxns(handle *badger.DB, maxPublishAtTstampNanos uint64) (
+	_scheduledPosts []*ScheduledPostTxn, _err error) {
 
-func DBDeleteProfileEntryMappingsWithTxn(
-	txn *badger.Txn, pkid *PKID, params *BitCloutParams) error {
+	scheduledPosts := []*ScheduledPostTxn{}
+	err := DbView(handle, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		it := txn.NewIterator(opts)
+		defer it.Close()
 
-	// First pull up the mapping that exists for the profile pub key passed in.
-	// If one doesn't exist then there's nothing to do.
-	profileEntry := DBGetProfileEntryForPKIDWithTxn(txn, pkid)
-	if profileEntry == nil {
+		prefix := _PrefixPublishAtTstampDraftHashToScheduledPostTxn
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Key()
+			if len(key) != len(prefix)+8+HashSizeBytes {
+				return fmt.Errorf("DbGetScheduledPostTxns: Invalid key length %d", len(key))
+			}
+			publishAtTstampNanos := DecodeUint64(key[len(prefix) : len(prefix)+8])
+			if publishAtTstampNanos > maxPublishAtTstampNanos {
+				break
+			}
+			draftHash := &BlockHash{}
+			copy(draftHash[:], key[len(prefix)+8:])
+
+			postTxn := &MsgBitCloutTxn{}
+			valBytes, err := it.Value()
+			if err == nil {
+				err = postTxn.FromBytes(valBytes)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "DbGetScheduledPostTxns: Problem decoding "+
+					"scheduled post %v", draftHash)
+			}
+			scheduledPosts = append(scheduledPosts, &ScheduledPostTxn{
+				PublishAtTstampNanos: publishAtTstampNanos,
+				DraftHash:            draftHash,
+				Txn:                  postTxn,
+			})
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return scheduledPosts, nil
+}
 
-	// When a profile exists, delete the pkid mapping for the profile.
-	if err := txn.Delete(_dbKeyForPKIDToProfileEntry(pkid)); err != nil {
-		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
-			"profile mapping for profile PKID: %v",
-			PkToString(pkid[:], params))
+func DbDeleteScheduledPostTxnWithTxn(txn KVTxn, publishAtTstampNanos uint64, draftHash *BlockHash) error {
+	if err := txn.Delete(_dbKeyForScheduledPostTxn(publishAtTstampNanos, draftHash)); err != nil {
+		return errors.Wrapf(err, "DbDeleteScheduledPostTxnWithTxn: Problem deleting "+
+			"scheduled post %v", draftHash)
 	}
+	return nil
+}
 
-	if err := txn.Delete(
-		_dbKeyForProfileUsernameToPKID(profileEntry.Username)); err != nil {
+func DbDeleteScheduledPostTxn(handle *badger.DB, publishAtTstampNanos uint64, draftHash *BlockHash) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbDeleteScheduledPostTxnWithTxn(txn, publishAtTstampNanos, draftHash)
+	})
+}
 
-		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
-			"username mapping for profile username %v", string(profileEntry.Username))
+// DbRescheduleScheduledPostTxn moves a scheduled post to a new publish time.
+func DbRescheduleScheduledPostTxn(handle *badger.DB, publishAtTstampNanos uint64,
+	draftHash *BlockHash, newPublishAtTstampNanos uint64) error {
+
+	return DbUpdate(handle, func(txn KVTxn) error {
+		oldKey := _dbKeyForScheduledPostTxn(publishAtTstampNanos, draftHash)
+		txnBytes, err := txn.Get(oldKey)
+		if err != nil {
+			return _wrapDbError(err, "DbRescheduleScheduledPostTxn: Problem fetching "+
+				"scheduled post %v", draftHash)
+		}
+		if err := txn.Delete(oldKey); err != nil {
+			return err
+		}
+		return txn.Set(_dbKeyForScheduledPostTxn(newPublishAtTstampNanos, draftHash), txnBytes)
+	})
+}
+
+// =====================================================================================
+// Query cache code
+// =====================================================================================
+
+// QueryCacheEntry is a cached query result along with the tip it was computed at.
+type QueryCacheEntry struct {
+	ComputedAtHeight    uint64
+	ComputedAtBlockHash *BlockHash
+	Result              []byte
+}
+
+func _dbKeyForQueryCacheEntry(queryKey string) []byte {
+	queryHash := sha256.Sum256([]byte(queryKey))
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, _PrefixQueryHashToQueryCacheEntry...)
+	return append(key, queryHash[:]...)
+}
+
+// DbGetQueryCacheEntry returns the cached result for the query or nil if there
+// isn't one. The entry may be stale; check it against the tip before using it.
+func DbGetQueryCacheEntry(handle *badger.DB, queryKey string) *QueryCacheEntry {
+	var cacheEntry *QueryCacheEntry
+	DbView(handle, func(txn KVTxn) error {
+		key := _dbKeyForQueryCacheEntry(queryKey)
+		valBytes, err := txn.Get(key)
+		if err != nil {
+			return nil
+		}
+		cacheEntryObj := &QueryCacheEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(cacheEntryObj); err != nil {
+			RecordDbDecodeFailure(key)
+			glog.Errorf("DbGetQueryCacheEntry: Problem decoding entry for %v: %v", queryKey, err)
+			return nil
+		}
+		cacheEntry = cacheEntryObj
+		return nil
+	})
+	return cacheEntry
+}
+
+func DbPutQueryCacheEntry(handle *badger.DB, queryKey string, cacheEntry *QueryCacheEntry) error {
+	cacheEntryBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(cacheEntryBuf).Encode(cacheEntry); err != nil {
+		return errors.Wrapf(err, "DbPutQueryCacheEntry: Problem encoding entry")
 	}
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_dbKeyForQueryCacheEntry(queryKey), cacheEntryBuf.Bytes())
+	})
+}
+
+// CacheGetOrCompute returns the result of the query identified by queryKey as of
+// the tip passed in. If the result was already computed at that tip it's read from
+// the db, otherwise compute is called and its result is cached. The queryKey
+// should include every parameter of the query, e.g. "leaderboard:coin-price:100".
+//
+// Results are tied to the tip's hash rather than its height so that a reorg
+// can't serve a result computed on the old chain. Errors from compute aren't
+// cached and a failure to write the cache is only logged.
+func CacheGetOrCompute(handle *badger.DB, queryKey string, tip *BlockNode,
+	compute func() ([]byte, error)) ([]byte, error) {
 
-	// The coin clout mapping
-	if err := txn.Delete(
-		_dbKeyForCreatorBitCloutLockedNanosCreatorPKID(
-			profileEntry.BitCloutLockedNanos, pkid)); err != nil {
+	cacheEntry := DbGetQueryCacheEntry(handle, queryKey)
+	if cacheEntry != nil && cacheEntry.ComputedAtBlockHash != nil &&
+		*cacheEntry.ComputedAtBlockHash == *tip.Hash {
 
-		return errors.Wrapf(err, "DbDeleteProfileEntryMappingsWithTxn: Deleting "+
-			"coin mapping for profile username %v", string(profileEntry.Username))
+		return cacheEntry.Result, nil
 	}
 
-	return nil
+	result, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	err = DbPutQueryCacheEntry(handle, queryKey, &QueryCacheEntry{
+		ComputedAtHeight:    uint64(tip.Height),
+		ComputedAtBlockHash: tip.Hash,
+		Result:              result,
+	})
+	if err != nil {
+		glog.Errorf("CacheGetOrCompute: Problem caching result for %v: %v", queryKey, err)
+	}
+	return result, nil
 }
 
-func DBDeleteProfileEntryMappings(
-	handle *badger.DB, pkid *PKID, params *BitCloutParams) error {
-
-	return handle.Update(func(txn *badger.Txn) error {
-		return DBDeleteProfileEntryMappingsWithTxn(txn, pkid, params)
+// DbInvalidateQueryCache deletes every cached query result. CacheGetOrCompute
+// never serves stale results so this only exists to free up space, and it's
+// called whenever the tip changes.
+func DbInvalidateQueryCache(handle *badger.DB) error {
+	cacheKeys, _, err := DBGetPaginatedKeysAndValuesForPrefix(
+		handle, _PrefixQueryHashToQueryCacheEntry, _PrefixQueryHashToQueryCacheEntry,
+		0 /*keyLen*/, 0 /*numToFetch*/, false /*reverse*/, false /*fetchValues*/)
+	if err != nil {
+		return errors.Wrapf(err, "DbInvalidateQueryCache: Problem fetching keys")
+	}
+	return DbUpdate(handle, func(txn KVTxn) error {
+		for _, cacheKey := range cacheKeys {
+			if err := txn.Delete(cacheKey); err != nil {
+				return errors.Wrapf(err, "DbInvalidateQueryCache: Problem deleting key")
+			}
+		}
+		return nil
 	})
 }
 
-func DBPutProfileEntryMappingsWithTxn(
-	txn *badger.Txn, profileEntry *ProfileEntry, pkid *PKID, params *BitCloutParams) error {
-
-	profileDataBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(profileDataBuf).Encode(profileEntry)
+// =====================================================================================
+// Node identity code
+// =====================================================================================
 
-	// Set the main PKID -> profile entry mapping.
-	if err := txn.Set(_dbKeyForPKIDToProfileEntry(pkid), profileDataBuf.Bytes()); err != nil {
+// DbGetOrCreateNodeIdentity returns the node's identity key, generating and
+// storing one if the db doesn't have one yet. The key should only be used to
+// identify the node, never to hold funds.
+func DbGetOrCreateNodeIdentity(handle *badger.DB) (*btcec.PrivateKey, error) {
+	var identityKey *btcec.PrivateKey
+	err := DbUpdate(handle, func(txn KVTxn) error {
+		keyBytes, err := txn.Get(_KeyNodeIdentity)
+		if err == nil {
+			identityKey, _ = btcec.PrivKeyFromBytes(btcec.S256(), keyBytes)
+			return nil
+		}
+		if err != ErrKVKeyNotFound {
+			return err
+		}
 
-		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
-			"adding mapping for profile: %v", PkToString(pkid[:], params))
+		identityKey, err = btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return errors.Wrapf(err, "Problem generating key")
+		}
+		return txn.Set(_KeyNodeIdentity, identityKey.Serialize())
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbGetOrCreateNodeIdentity: ")
 	}
+	return identityKey, nil
+}
 
-	// Username
-	if err := txn.Set(
-		_dbKeyForProfileUsernameToPKID(profileEntry.Username),
-		pkid[:]); err != nil {
+// NodeVersionRecord notes when a version of the node first started with this db.
+type NodeVersionRecord struct {
+	UserAgent       string
+	ProtocolVersion uint64
+	TstampNanos     uint64
+}
 
-		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
-			"adding mapping for profile with username: %v", string(profileEntry.Username))
+// DbGetNodeVersionHistory returns every version of the node that has run against
+// the db from oldest to newest.
+func DbGetNodeVersionHistory(handle *badger.DB) ([]*NodeVersionRecord, error) {
+	versionRecords := []*NodeVersionRecord{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixTstampNanosToNodeVersion, func(_ []byte, valBytes []byte) (bool, error) {
+		versionRecord := &NodeVersionRecord{}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(versionRecord); err != nil {
+			return false, _corruptDbEntryError(err, "DbGetNodeVersionHistory: Problem decoding version")
+		}
+		versionRecords = append(versionRecords, versionRecord)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return versionRecords, nil
+}
 
-	// The coin clout mapping
-	if err := txn.Set(
-		_dbKeyForCreatorBitCloutLockedNanosCreatorPKID(
-			profileEntry.BitCloutLockedNanos, pkid), []byte{}); err != nil {
+// DbRecordNodeVersion adds the version in the params to the version history if
+// it differs from the last version recorded. It returns the previous version,
+// or nil if this is the first time the node has run, so that callers can tell
+// when the node was upgraded.
+func DbRecordNodeVersion(handle *badger.DB, params *BitCloutParams, now time.Time) (
+	_prevVersion *NodeVersionRecord, _err error) {
 
-		return errors.Wrapf(err, "DbPutProfileEntryMappingsWithTxn: Problem "+
-			"adding mapping for profile coin: ")
+	versionRecords, err := DbGetNodeVersionHistory(handle)
+	if err != nil {
+		return nil, err
 	}
+	var prevVersion *NodeVersionRecord
+	if len(versionRecords) > 0 {
+		prevVersion = versionRecords[len(versionRecords)-1]
+		if prevVersion.UserAgent == params.UserAgent &&
+			prevVersion.ProtocolVersion == params.ProtocolVersion {
 
-	return nil
-}
-
-func DBPutProfileEntryMappings(
-	handle *badger.DB, profileEntry *ProfileEntry, pkid *PKID, params *BitCloutParams) error {
+			return prevVersion, nil
+		}
+	}
 
-	return handle.Update(func(txn *badger.Txn) error {
-		return DBPutProfileEntryMappingsWithTxn(txn, profileEntry, pkid, params)
+	versionRecord := &NodeVersionRecord{
+		UserAgent:       params.UserAgent,
+		ProtocolVersion: params.ProtocolVersion,
+		TstampNanos:     uint64(now.UnixNano()),
+	}
+	versionBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(versionBuf).Encode(versionRecord); err != nil {
+		return nil, errors.Wrapf(err, "DbRecordNodeVersion: Problem encoding version")
+	}
+	key := append(append([]byte{}, _PrefixTstampNanosToNodeVersion...), EncodeUint64(versionRecord.TstampNanos)...)
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(key, versionBuf.Bytes())
 	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbRecordNodeVersion: Problem storing version")
+	}
+	return prevVersion, nil
 }
 
-// DBGetAllProfilesByCoinValue returns all the profiles in the db with the
-// highest coin values first.
-//
-// TODO(performance): This currently fetches all profiles. We should implement
-// some kind of pagination instead though.
-func DBGetAllProfilesByCoinValue(handle *badger.DB, fetchEntries bool) (
-	_lockedBitCloutNanos []uint64, _profilePublicKeys []*PKID,
-	_profileEntries []*ProfileEntry, _err error) {
-
-	lockedBitCloutNanosFetched := []uint64{}
-	profilePublicKeysFetched := []*PKID{}
-	profileEntriesFetched := []*ProfileEntry{}
-	dbPrefixx := append([]byte{}, _PrefixCreatorBitCloutLockedNanosCreatorPKID...)
-
-	err := handle.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+// DbGetTelemetryOptIn returns true if the operator has opted in to sharing
+// anonymous network statistics.
+func DbGetTelemetryOptIn(handle *badger.DB) bool {
+	var optIn bool
+	DbView(handle, func(txn KVTxn) error {
+		valBytes, err := txn.Get(_KeyTelemetryOptIn)
+		if err != nil {
+			return nil
+		}
+		optIn = len(valBytes) == 1 && valBytes[0] != 0
+		return nil
+	})
+	return optIn
+}
 
-		opts.PrefetchValues = false
+func DbPutTelemetryOptIn(handle *badger.DB, optIn bool) error {
+	optInByte := byte(0)
+	if optIn {
+		optInByte = 1
+	}
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return txn.Set(_KeyTelemetryOptIn, []byte{optInByte})
+	})
+}
 
-		// Go in reverse order since a larger count is better.
-		opts.Reverse = true
+// NodeConfigEntry holds the settings an operator can tune for this node without
+// a code change. A zero field means the setting hasn't been set so fields can be
+// added without migrating existing entries. Read settings through the getters,
+// which fill in the defaults.
+type NodeConfigEntry struct {
+	// The most messages DbGetLimitedMessageEntriesForPublicKey fetches for an
+	// inbox.
+	MessagesToFetchPerInboxCall uint64
+	// The number of decode failures under a prefix at which
+	// DbGetDecodeFailureAlerts flags it.
+	DecodeFailureAlertThreshold uint64
+	// When set, new blocks are stored as a list of txn hashes with each txn
+	// stored once by its hash. See PutBlockWithTxn.
+	DedupeBlockTxns bool
+	// How far past the time of the block it's flushed with a post or message
+	// timestamp can be before it's kept out of the time-ordered indexes.
+	MaxIndexedTimestampSkewSeconds uint64
+	// When set, the node keeps each public key's balance as of every block
+	// that changed it. See DbGetBalanceAtHeight.
+	BalanceSnapshots bool
+	// When set, the node keeps a commitment to its state as of every block.
+	// See DbGetStateCommitment.
+	StateCommitments bool
+	// When nonzero, only the headers of the blocks within this many blocks of
+	// the tip are kept in memory. See Blockchain.headerForNode.
+	RecentBlockHeaders uint32
+	// How long the utxo operations of connected blocks are kept. N is only
+	// used by UtxoOpsRetentionKeepLastN.
+	UtxoOpsRetention       UtxoOpsRetention
+	UtxoOpsRetentionBlocks uint64
+	// When set, the txindex stores the bytes of each txn it indexes so a txn
+	// can be loaded without its block. See DbGetTxindexFullTransactionByTxID.
+	TxindexTxnBytes bool
+}
+
+// GetUtxoOpsKeepBlocks returns how many blocks of utxo operations to keep behind
+// the tip, or zero if they should all be kept. It never returns less than the
+// finality depth, even for a config saved before that was enforced.
+func (nodeConfig *NodeConfigEntry) GetUtxoOpsKeepBlocks(params *BitCloutParams) uint64 {
+	switch nodeConfig.UtxoOpsRetention {
+	case UtxoOpsRetentionKeepLastN:
+		if nodeConfig.UtxoOpsRetentionBlocks < params.FinalityDepthBlocks {
+			return params.FinalityDepthBlocks
+		}
+		return nodeConfig.UtxoOpsRetentionBlocks
+	case UtxoOpsRetentionKeepNoneAfterFinality:
+		return params.FinalityDepthBlocks
+	default:
+		return 0
+	}
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		// Since we iterate backwards, the prefix must be bigger than all possible
-		// counts that could actually exist. We use eight bytes since the count is
-		// encoded as a 64-bit big-endian byte slice, which will be eight bytes long.
-		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-		prefix := append(dbPrefixx, maxBigEndianUint64Bytes...)
-		for it.Seek(prefix); it.ValidForPrefix(dbPrefixx); it.Next() {
-			rawKey := it.Item().Key()
+// GetMessagesToFetchPerInboxCall defaults to MessagesToFetchPerInboxCall.
+func (nodeConfig *NodeConfigEntry) GetMessagesToFetchPerInboxCall() uint64 {
+	if nodeConfig.MessagesToFetchPerInboxCall == 0 {
+		return MessagesToFetchPerInboxCall
+	}
+	return nodeConfig.MessagesToFetchPerInboxCall
+}
 
-			// Strip the prefix off the key and check its length. If it contains
-			// a big-endian uint64 then it should be at least eight bytes.
-			lockedBitCloutPubKeyConcatKey := rawKey[1:]
-			uint64BytesLen := len(maxBigEndianUint64Bytes)
-			expectedLength := uint64BytesLen + btcec.PubKeyBytesLenCompressed
-			if len(lockedBitCloutPubKeyConcatKey) != expectedLength {
-				return fmt.Errorf("DBGetAllProfilesByLockedBitClout: Invalid key "+
-					"length %d should be at least %d", len(lockedBitCloutPubKeyConcatKey),
-					expectedLength)
-			}
+// GetDecodeFailureAlertThreshold defaults to DecodeFailureAlertThreshold.
+func (nodeConfig *NodeConfigEntry) GetDecodeFailureAlertThreshold() uint64 {
+	if nodeConfig.DecodeFailureAlertThreshold == 0 {
+		return DecodeFailureAlertThreshold
+	}
+	return nodeConfig.DecodeFailureAlertThreshold
+}
 
-			lockedBitCloutNanos := DecodeUint64(lockedBitCloutPubKeyConcatKey[:uint64BytesLen])
+// GetMaxIndexedTimestampSkewSeconds defaults to MaxIndexedTimestampSkewSeconds.
+func (nodeConfig *NodeConfigEntry) GetMaxIndexedTimestampSkewSeconds() uint64 {
+	if nodeConfig.MaxIndexedTimestampSkewSeconds == 0 {
+		return MaxIndexedTimestampSkewSeconds
+	}
+	return nodeConfig.MaxIndexedTimestampSkewSeconds
+}
 
-			// Appended to the stake should be the profile pub key so extract it here.
-			profilePKID := make([]byte, btcec.PubKeyBytesLenCompressed)
-			copy(profilePKID[:], lockedBitCloutPubKeyConcatKey[uint64BytesLen:])
+// DbGetNodeConfig returns the node's settings as they're stored. An empty entry
+// is returned if nothing has been stored.
+func DbGetNodeConfigWithTxn(txn KVTxn) (*NodeConfigEntry, error) {
+	nodeConfig := &NodeConfigEntry{}
+	valBytes, err := txn.Get(_KeyNodeConfig)
+	if err == ErrKVKeyNotFound {
+		return nodeConfig, nil
+	}
+	if err != nil {
+		return nil, _wrapDbError(err, "DbGetNodeConfigWithTxn")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(nodeConfig); err != nil {
+		return nil, _wrapDbError(_corruptDbEntryError(err, "Problem decoding node config"),
+			"DbGetNodeConfigWithTxn")
+	}
+	return nodeConfig, nil
+}
 
-			lockedBitCloutNanosFetched = append(lockedBitCloutNanosFetched, lockedBitCloutNanos)
-			profilePublicKeysFetched = append(profilePublicKeysFetched, PublicKeyToPKID(profilePKID))
-		}
-		return nil
+func DbGetNodeConfig(handle *badger.DB) (*NodeConfigEntry, error) {
+	var nodeConfig *NodeConfigEntry
+	err := DbView(handle, func(txn KVTxn) error {
+		var err error
+		nodeConfig, err = DbGetNodeConfigWithTxn(txn)
+		return err
 	})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, _wrapDbError(err, "DbGetNodeConfig")
 	}
+	return nodeConfig, nil
+}
 
-	if !fetchEntries {
-		return lockedBitCloutNanosFetched, profilePublicKeysFetched, nil, nil
+func DbPutNodeConfigWithTxn(txn KVTxn, nodeConfig *NodeConfigEntry) error {
+	configBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(configBuf).Encode(nodeConfig); err != nil {
+		return errors.Wrapf(err, "DbPutNodeConfigWithTxn: Problem encoding node config")
 	}
+	return txn.Set(_KeyNodeConfig, configBuf.Bytes())
+}
 
-	for _, profilePKID := range profilePublicKeysFetched {
-		profileEntry := DBGetProfileEntryForPKID(handle, profilePKID)
-		if profileEntry == nil {
-			return nil, nil, nil, fmt.Errorf("DBGetAllProfilesByLockedBitClout: "+
-				"ProfilePubKey %v does not have corresponding entry",
-				PkToStringBoth(profilePKID[:]))
-		}
-		profileEntriesFetched = append(profileEntriesFetched, profileEntry)
-	}
+func DbPutNodeConfig(handle *badger.DB, nodeConfig *NodeConfigEntry) error {
+	return DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutNodeConfigWithTxn(txn, nodeConfig)
+	})
+}
 
-	return lockedBitCloutNanosFetched, profilePublicKeysFetched, profileEntriesFetched, nil
+// DbGetMessagesToFetchPerInboxCall returns the most messages to fetch for an
+// inbox. It falls back to the default if the node config can't be read so a
+// bad entry doesn't stop inboxes from loading.
+func DbGetMessagesToFetchPerInboxCall(handle *badger.DB) uint64 {
+	nodeConfig, err := DbGetNodeConfig(handle)
+	if err != nil {
+		glog.Errorf("DbGetMessagesToFetchPerInboxCall: Using default: %v", err)
+		return MessagesToFetchPerInboxCall
+	}
+	return nodeConfig.GetMessagesToFetchPerInboxCall()
 }
 
 // =====================================================================================
-// Creator coin balance entry code
+// Timestamp index quarantine code
 // =====================================================================================
-func _dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(hodlerPKID *PKID, creatorPKID *PKID) []byte {
-	key := append([]byte{}, _PrefixHODLerPKIDCreatorPKIDToBalanceEntry...)
-	key = append(key, hodlerPKID[:]...)
-	key = append(key, creatorPKID[:]...)
-	return key
+
+// Post and message timestamps are set by whoever creates them, so nothing stops
+// someone from picking one far in the future. Left alone, those entries would
+// sit at the top of every time-ordered index forever. Instead, entries whose
+// timestamp is more than the node config's max skew past the time of the block
+// they're flushed with are stored under _PrefixQuarantinedTimestampIndexEntry,
+// keyed by the index key they would have had, until the chain catches up with
+// them. The bound comes from the block rather than the node's clock so that
+// every node flushing the same block with the same setting quarantines the
+// same entries.
+//
+// The per-public-key message index isn't one of the indexes entries are
+// quarantined from since it's where messages are stored and looked up.
+
+// _timestampIndexInfo describes where the timestamp sits in the keys of one of
+// the time-ordered indexes that entries can be quarantined from.
+type _timestampIndexInfo struct {
+	prefix []byte
+	// The number of bytes between the prefix and the timestamp.
+	tstampOffset int
 }
-func _dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creatorPKID *PKID, hodlerPKID *PKID) []byte {
-	key := append([]byte{}, _PrefixCreatorPKIDHODLerPKIDToBalanceEntry...)
-	key = append(key, creatorPKID[:]...)
-	key = append(key, hodlerPKID[:]...)
+
+var _timestampIndexes = []*_timestampIndexInfo{
+	{_PrefixTstampNanosPostHash, 0},
+	{_PrefixPosterPublicKeyTimestampPostHash, btcec.PubKeyBytesLenCompressed},
+	{_PrefixPublicKeyPairTimestampToPrivateMessage, 2 * btcec.PubKeyBytesLenCompressed},
+}
+
+func _dbKeyForQuarantinedTimestampIndexEntry(indexKey []byte) []byte {
+	key := append([]byte{}, _PrefixQuarantinedTimestampIndexEntry...)
+	key = append(key, indexKey...)
 	return key
 }
 
-func DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
-	txn *badger.Txn, hodlerPKID *PKID, creatorPKID *PKID) *BalanceEntry {
+// _timestampForIndexKey returns the timestamp in a key from one of the
+// _timestampIndexes, or false if the key isn't from one of them.
+func _timestampForIndexKey(indexKey []byte) (uint64, bool) {
+	for _, indexInfo := range _timestampIndexes {
+		if !bytes.HasPrefix(indexKey, indexInfo.prefix) {
+			continue
+		}
+		tstampStart := len(indexInfo.prefix) + indexInfo.tstampOffset
+		if len(indexKey) < tstampStart+8 {
+			return 0, false
+		}
+		return DecodeUint64(indexKey[tstampStart : tstampStart+8]), true
+	}
+	return 0, false
+}
 
-	key := _dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(hodlerPKID, creatorPKID)
-	balanceEntryObj := &BalanceEntry{}
-	balanceEntryItem, err := txn.Get(key)
+// DbGetMaxIndexedTstampNanosWithTxn returns the latest timestamp that can go
+// into the time-ordered indexes along with a block whose timestamp is
+// blockTstampSecs. It falls back to the default skew if the node config can't
+// be read. It's meant to be called once per flush rather than for every entry.
+func DbGetMaxIndexedTstampNanosWithTxn(txn KVTxn, blockTstampSecs uint64) uint64 {
+	maxSkewSeconds := uint64(MaxIndexedTimestampSkewSeconds)
+	nodeConfig, err := DbGetNodeConfigWithTxn(txn)
 	if err != nil {
-		return nil
+		glog.Errorf("DbGetMaxIndexedTstampNanosWithTxn: Using default: %v", err)
+	} else {
+		maxSkewSeconds = nodeConfig.GetMaxIndexedTimestampSkewSeconds()
 	}
-	err = balanceEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(balanceEntryObj)
-	})
-	if err != nil {
-		glog.Errorf("DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPubKeysWithTxn: Problem reading "+
-			"BalanceEntry for PKIDs %v %v",
-			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
-		return nil
+	if blockTstampSecs+maxSkewSeconds < blockTstampSecs ||
+		blockTstampSecs+maxSkewSeconds > math.MaxUint64/uint64(time.Second) {
+
+		return math.MaxUint64
 	}
-	return balanceEntryObj
+	return (blockTstampSecs + maxSkewSeconds) * uint64(time.Second)
 }
 
-func DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDs(
-	handle *badger.DB, hodlerPKID *PKID, creatorPKID *PKID) *BalanceEntry {
+// DbGetMaxIndexedTstampNanosForTipWithTxn is DbGetMaxIndexedTstampNanosWithTxn
+// for the block at the tip of the best chain. Nothing is quarantined before the
+// chain has a tip.
+func DbGetMaxIndexedTstampNanosForTipWithTxn(txn KVTxn) uint64 {
+	bestHashBytes, err := txn.Get(_KeyBestBitCloutBlockHash)
+	if err != nil {
+		return math.MaxUint64
+	}
+	bestHash := &BlockHash{}
+	copy(bestHash[:], bestHashBytes)
+	tipBlock := GetBlockWithTxn(txn, bestHash)
+	if tipBlock == nil || tipBlock.Header == nil {
+		return math.MaxUint64
+	}
+	return DbGetMaxIndexedTstampNanosWithTxn(txn, tipBlock.Header.TstampSecs)
+}
 
-	var ret *BalanceEntry
-	handle.View(func(txn *badger.Txn) error {
-		ret = DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
-			txn, hodlerPKID, creatorPKID)
+func DbGetMaxIndexedTstampNanosForTip(handle *badger.DB) uint64 {
+	var maxIndexedTstampNanos uint64
+	DbView(handle, func(txn KVTxn) error {
+		maxIndexedTstampNanos = DbGetMaxIndexedTstampNanosForTipWithTxn(txn)
 		return nil
 	})
-	return ret
+	return maxIndexedTstampNanos
 }
 
-func DBGetCreatorCoinBalanceEntryForCreatorPKIDAndHODLerPubKeyWithTxn(
-	txn *badger.Txn, creatorPKID *PKID, hodlerPKID *PKID) *BalanceEntry {
+// _dbSetTimestampIndexEntryWithTxn sets the index key to val, or quarantines it
+// if tstampNanos is past maxIndexedTstampNanos.
+func _dbSetTimestampIndexEntryWithTxn(txn KVTxn, indexKey []byte, val []byte,
+	tstampNanos uint64, maxIndexedTstampNanos uint64) error {
 
-	key := _dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creatorPKID, hodlerPKID)
-	balanceEntryObj := &BalanceEntry{}
-	balanceEntryItem, err := txn.Get(key)
-	if err != nil {
-		return nil
+	if tstampNanos > maxIndexedTstampNanos {
+		glog.V(1).Infof("_dbSetTimestampIndexEntryWithTxn: Quarantining index "+
+			"entry with tstamp %d", tstampNanos)
+		return txn.Set(_dbKeyForQuarantinedTimestampIndexEntry(indexKey), val)
+	}
+	return txn.Set(indexKey, val)
+}
+
+// _dbDeleteTimestampIndexEntryWithTxn deletes the index key whether or not it
+// was quarantined.
+func _dbDeleteTimestampIndexEntryWithTxn(txn KVTxn, indexKey []byte) error {
+	if err := txn.Delete(indexKey); err != nil {
+		return err
 	}
-	err = balanceEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(balanceEntryObj)
+	return txn.Delete(_dbKeyForQuarantinedTimestampIndexEntry(indexKey))
+}
+
+// _dbMoveTimestampIndexEntries moves each key in fromKeys to the key at the same
+// position in toKeys along with its value. A key that's no longer there when
+// it's moved is skipped. Each key is read in the txn that moves it, so a block
+// flushed at the same time that changes one makes the move fail with a
+// conflict rather than be undone by it.
+func _dbMoveTimestampIndexEntries(
+	handle *badger.DB, fromKeys [][]byte, toKeys [][]byte) (_numMoved int, _err error) {
+
+	numMoved := 0
+	err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+		for ii := range fromKeys {
+			fromKey, toKey := fromKeys[ii], toKeys[ii]
+			err := txnWriter.Write(func(txn KVTxn) error {
+				val, err := txn.Get(fromKey)
+				if err == ErrKVKeyNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := txn.Set(toKey, val); err != nil {
+					return err
+				}
+				return txn.Delete(fromKey)
+			})
+			if err != nil {
+				return err
+			}
+			numMoved++
+		}
+		return nil
 	})
 	if err != nil {
-		glog.Errorf("DBGetCreatorCoinBalanceEntryForCreatorPubKeyAndHODLerPubKeyWithTxn: Problem reading "+
-			"BalanceEntry for PKIDs %v %v",
-			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
-		return nil
+		return 0, err
 	}
-	return balanceEntryObj
+	return numMoved, nil
 }
 
-func DBDeleteCreatorCoinBalanceEntryMappingsWithTxn(
-	txn *badger.Txn, hodlerPKID *PKID, creatorPKID *PKID,
-	params *BitCloutParams) error {
+// timestampIndexRepairMigrationName marks whether the index entries stored
+// before timestamps were checked at index time have been scanned.
+const timestampIndexRepairMigrationName = "timestamp-index-repair"
 
-	// First pull up the mappings that exists for the keys passed in.
-	// If one doesn't exist then there's nothing to do.
-	balanceEntry := DBGetCreatorCoinBalanceEntryForHODLerAndCreatorPKIDsWithTxn(
-		txn, hodlerPKID, creatorPKID)
-	if balanceEntry == nil {
-		return nil
-	}
+// DbRepairTimestampIndexes scans the time-ordered indexes for entries that were
+// stored before timestamps were checked and quarantines the ones past
+// maxIndexedTstampNanos. It only scans a db once, and returns how many entries
+// it quarantined.
+func DbRepairTimestampIndexes(handle *badger.DB, maxIndexedTstampNanos uint64) (
+	_numQuarantined int, _err error) {
 
-	// When an entry exists, delete the mappings for it.
-	if err := txn.Delete(_dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(hodlerPKID, creatorPKID)); err != nil {
-		return errors.Wrapf(err, "DbDeleteCreatorCoinBalanceEntryMappingsWithTxn: Deleting "+
-			"mappings with keys: %v %v",
-			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
-	}
-	if err := txn.Delete(_dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creatorPKID, hodlerPKID)); err != nil {
-		return errors.Wrapf(err, "DbDeleteCreatorCoinBalanceEntryMappingsWithTxn: Deleting "+
-			"mappings with keys: %v %v",
-			PkToStringBoth(hodlerPKID[:]), PkToStringBoth(creatorPKID[:]))
+	if DbGetIndexMigrationState(handle, timestampIndexRepairMigrationName) ==
+		IndexMigrationStateBackfillComplete {
+
+		return 0, nil
 	}
 
-	// Note: We don't update the CreatorBitCloutLockedNanosCreatorPubKeyIIndex
-	// because we expect that the caller is keeping the individual holdings in
-	// sync with the "total" coins stored in the profile.
+	numQuarantined := 0
+	for _, indexInfo := range _timestampIndexes {
+		indexKeys := [][]byte{}
+		quarantineKeys := [][]byte{}
+		err := EnumerateKeysForPrefixWithCallback(handle, indexInfo.prefix, func(key []byte, valBytes []byte) (bool, error) {
+			tstampNanos, ok := _timestampForIndexKey(key)
+			if !ok || tstampNanos <= maxIndexedTstampNanos {
+				return true, nil
+			}
+			indexKeys = append(indexKeys, append([]byte{}, key...))
+			quarantineKeys = append(quarantineKeys, _dbKeyForQuarantinedTimestampIndexEntry(key))
+			return true, nil
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "DbRepairTimestampIndexes: Problem scanning index")
+		}
+		numMoved, err := _dbMoveTimestampIndexEntries(handle, indexKeys, quarantineKeys)
+		if err != nil {
+			return 0, errors.Wrapf(err, "DbRepairTimestampIndexes: Problem quarantining entries")
+		}
+		numQuarantined += numMoved
+	}
 
-	return nil
+	err := DbUpdate(handle, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(
+			txn, timestampIndexRepairMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbRepairTimestampIndexes: Problem marking scan complete")
+	}
+	return numQuarantined, nil
 }
 
-func DBDeleteCreatorCoinBalanceEntryMappings(
-	handle *badger.DB, hodlerPKID *PKID, creatorPKID *PKID,
-	params *BitCloutParams) error {
+// DbRestoreQuarantinedTimestampIndexEntries moves the quarantined entries whose
+// timestamp is no longer past maxIndexedTstampNanos back into their index, along
+// with any from an index that entries are no longer quarantined from. It
+// returns how many entries it restored.
+func DbRestoreQuarantinedTimestampIndexEntries(handle *badger.DB, maxIndexedTstampNanos uint64) (
+	_numRestored int, _err error) {
 
-	return handle.Update(func(txn *badger.Txn) error {
-		return DBDeleteCreatorCoinBalanceEntryMappingsWithTxn(
-			txn, hodlerPKID, creatorPKID, params)
+	quarantineKeys := [][]byte{}
+	indexKeys := [][]byte{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixQuarantinedTimestampIndexEntry, func(key []byte, valBytes []byte) (bool, error) {
+		indexKey := key[len(_PrefixQuarantinedTimestampIndexEntry):]
+		tstampNanos, ok := _timestampForIndexKey(indexKey)
+		if ok && tstampNanos > maxIndexedTstampNanos {
+			return true, nil
+		}
+		quarantineKeys = append(quarantineKeys, append([]byte{}, key...))
+		indexKeys = append(indexKeys, append([]byte{}, indexKey...))
+		return true, nil
 	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbRestoreQuarantinedTimestampIndexEntries: Problem scanning quarantine")
+	}
+	numRestored, err := _dbMoveTimestampIndexEntries(handle, quarantineKeys, indexKeys)
+	if err != nil {
+		return 0, errors.Wrapf(err, "DbRestoreQuarantinedTimestampIndexEntries: Problem restoring entries")
+	}
+	return numRestored, nil
 }
 
-func DBPutCreatorCoinBalanceEntryMappingsWithTxn(
-	txn *badger.Txn, balanceEntry *BalanceEntry,
-	params *BitCloutParams) error {
-
-	balanceEntryDataBuf := bytes.NewBuffer([]byte{})
-	gob.NewEncoder(balanceEntryDataBuf).Encode(balanceEntry)
-
-	// Set the forward direction for the HODLer
-	if err := txn.Set(_dbKeyForHODLerPKIDCreatorPKIDToBalanceEntry(
-		balanceEntry.HODLerPKID, balanceEntry.CreatorPKID),
-		balanceEntryDataBuf.Bytes()); err != nil {
+// StartTimestampIndexRestorer periodically restores the quarantined index
+// entries whose time has come, as of the tip of the best chain, until the
+// lifecycle is stopped. A restore that conflicts with a block being connected
+// is tried again the next time around.
+func StartTimestampIndexRestorer(lifecycle *CoreDBLifecycle, interval time.Duration) error {
+	return lifecycle.GoPeriodic("timestamp-index-restorer", interval, func() {
+		numRestored, err := DbRestoreQuarantinedTimestampIndexEntries(
+			lifecycle.DB(), DbGetMaxIndexedTstampNanosForTip(lifecycle.DB()))
+		if err != nil {
+			glog.Errorf("StartTimestampIndexRestorer: Problem restoring entries: %v", err)
+		} else if numRestored > 0 {
+			glog.Infof("StartTimestampIndexRestorer: Restored %d timestamp index entries", numRestored)
+		}
+	})
+}
 
-		return errors.Wrapf(err, "DbPutCreatorCoinBalanceEntryMappingsWithTxn: Problem "+
-			"adding forward mappings for pub keys: %v %v",
-			PkToStringBoth(balanceEntry.HODLerPKID[:]),
-			PkToStringBoth(balanceEntry.CreatorPKID[:]))
-	}
+// DbGetNumQuarantinedTimestampIndexEntries returns how many index entries are
+// currently quarantined.
+func DbGetNumQuarantinedTimestampIndexEntries(handle *badger.DB) int {
+	keys, _ := _enumerateKeysForPrefix(handle, _PrefixQuarantinedTimestampIndexEntry)
+	return len(keys)
+}
 
-	// Set the reverse direction for the creator
-	if err := txn.Set(_dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(
-		balanceEntry.CreatorPKID, balanceEntry.HODLerPKID),
-		balanceEntryDataBuf.Bytes()); err != nil {
+// =====================================================================================
+// Decode failure code
+// =====================================================================================
 
-		return errors.Wrapf(err, "DbPutCreatorCoinBalanceEntryMappingsWithTxn: Problem "+
-			"adding reverse mappings for pub keys: %v %v",
-			PkToStringBoth(balanceEntry.HODLerPKID[:]),
-			PkToStringBoth(balanceEntry.CreatorPKID[:]))
-	}
+// Most decode failures happen while reading in a read-only txn, so they're
+// counted in memory by RecordDbDecodeFailure and added to the counts in the db
+// by DbFlushDecodeFailureCounts. The pending counts are keyed by the
+// registered prefix of the key that failed, or its first byte if the key
+// doesn't belong to a registered prefix.
+var (
+	pendingDecodeFailureCountsLock sync.Mutex
+	pendingDecodeFailureCounts     = make(map[string]uint64)
+)
 
-	return nil
+// DecodeFailureCount is the number of values under a prefix that failed to
+// decode.
+type DecodeFailureCount struct {
+	PrefixName string
+	Prefix     []byte
+	Count      uint64
 }
 
-func DBPutCreatorCoinBalanceEntryMappings(
-	handle *badger.DB, balanceEntry *BalanceEntry, params *BitCloutParams) error {
-
-	return handle.Update(func(txn *badger.Txn) error {
-		return DBPutCreatorCoinBalanceEntryMappingsWithTxn(
-			txn, balanceEntry, params)
-	})
+func _dbKeyForDecodeFailureCount(dbPrefix []byte) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	prefixCopy := append([]byte{}, _PrefixDbPrefixToDecodeFailureCount...)
+	return append(prefixCopy, dbPrefix...)
 }
 
-// GetSingleBalanceEntryFromPublicKeys fetchs a single balance entry of a holder's creator coin.
-// Returns nil if the balance entry never existed.
-func GetSingleBalanceEntryFromPublicKeys(holder []byte, creator []byte, utxoView *UtxoView) (*BalanceEntry, error){
-	holderPKIDEntry := utxoView.GetPKIDForPublicKey(holder)
-	if holderPKIDEntry == nil || holderPKIDEntry.isDeleted {
-		return nil, fmt.Errorf("DbGetSingleBalanceEntryFromPublicKeys: holderPKID was nil or deleted; this should never happen")
-	}
-	holderPKID := holderPKIDEntry.PKID
-	creatorPKIDEntry := utxoView.GetPKIDForPublicKey(creator)
-	if creatorPKIDEntry == nil || creatorPKIDEntry.isDeleted {
-		return nil, fmt.Errorf("DbGetSingleBalanceEntryFromPublicKeys: creatorPKID was nil or deleted; this should never happen")
+// RecordDbDecodeFailure counts a value stored under key that couldn't be
+// decoded. It doesn't touch the db so it's safe to call from inside a txn.
+func RecordDbDecodeFailure(key []byte) {
+	if len(key) == 0 {
+		return
 	}
-	creatorPKID := creatorPKIDEntry.PKID
-
-	// Check if there's a balance entry in the view
-	balanceEntryMapKey := BalanceEntryMapKey{HODLerPKID: *holderPKID, CreatorPKID: *creatorPKID}
-	balanceEntryFromView, _ := utxoView.HODLerPKIDCreatorPKIDToBalanceEntry[balanceEntryMapKey]
-	if balanceEntryFromView != nil {
-		return balanceEntryFromView, nil
+	dbPrefix := key[:1]
+	if prefixInfo := GetDbPrefixInfoForKey(key); prefixInfo != nil {
+		dbPrefix = prefixInfo.Prefix
 	}
 
-	// Check if there's a balance entry in the database
-	balanceEntryFromDb := DbGetBalanceEntry(utxoView.Handle, holderPKID, creatorPKID)
-	return balanceEntryFromDb, nil
+	pendingDecodeFailureCountsLock.Lock()
+	defer pendingDecodeFailureCountsLock.Unlock()
+	pendingDecodeFailureCounts[string(dbPrefix)]++
 }
 
-// DbGetBalanceEntry returns a balance entry from the database
-func DbGetBalanceEntry(db *badger.DB, holder *PKID, creator *PKID) *BalanceEntry {
-	var ret *BalanceEntry
-	db.View(func(txn *badger.Txn) error {
-		ret = DbGetHolderPKIDCreatorPKIDToBalanceEntryWithTxn(txn, holder, creator)
-		return nil
-	})
-	return ret
+// DbFlushDecodeFailureCounts adds the decode failures recorded since the last
+// flush to the counts in the db.
+func DbFlushDecodeFailureCounts(handle *badger.DB) error {
+	return DbFlushDecodeFailureCountsWithUpdate(handle.Update)
 }
 
-func DbGetHolderPKIDCreatorPKIDToBalanceEntryWithTxn(txn *badger.Txn, holder *PKID, creator *PKID) *BalanceEntry {
-	key := _dbKeyForCreatorPKIDHODLerPKIDToBalanceEntry(creator, holder)
-	balanceEntryObj := &BalanceEntry{}
-	balanceEntryItem, err := txn.Get(key)
-	if err != nil {
+// DbFlushDecodeFailureCountsWithUpdate is DbFlushDecodeFailureCounts with the
+// counts written through update, e.g. CoreDBLifecycle.Update.
+func DbFlushDecodeFailureCountsWithUpdate(update func(fn func(txn KVTxn) error) error) error {
+	pendingDecodeFailureCountsLock.Lock()
+	pendingCounts := pendingDecodeFailureCounts
+	pendingDecodeFailureCounts = make(map[string]uint64)
+	pendingDecodeFailureCountsLock.Unlock()
+
+	if len(pendingCounts) == 0 {
 		return nil
 	}
-	err = balanceEntryItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(balanceEntryObj)
+	err := update(func(txn KVTxn) error {
+		for dbPrefix, pendingCount := range pendingCounts {
+			key := _dbKeyForDecodeFailureCount([]byte(dbPrefix))
+			count := uint64(0)
+			countBytes, err := txn.Get(key)
+			if err == nil {
+				if len(countBytes) == 8 {
+					count = DecodeUint64(countBytes)
+				}
+			} else if err != ErrKVKeyNotFound {
+				return err
+			}
+			if err := txn.Set(key, EncodeUint64(count+pendingCount)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		glog.Errorf("DbGetReclouterPubKeyRecloutedPostHashToRecloutedPostMappingWithTxn: Problem decoding "+
-			"balance entry for holder %v and creator %v", PkToStringMainnet(PKIDToPublicKey(holder)), PkToStringMainnet(PKIDToPublicKey(creator)))
-		return nil
+		// Put the counts back so the next flush picks them up.
+		pendingDecodeFailureCountsLock.Lock()
+		for dbPrefix, pendingCount := range pendingCounts {
+			pendingDecodeFailureCounts[dbPrefix] += pendingCount
+		}
+		pendingDecodeFailureCountsLock.Unlock()
+		return _wrapDbError(err, "DbFlushDecodeFailureCounts")
 	}
-	return balanceEntryObj
+	return nil
 }
 
-// DbGetBalanceEntriesHodlingYou fetchs the BalanceEntries that the passed in pkid hodls.
-func DbGetBalanceEntriesYouHodl(pkid *PKIDEntry, fetchProfiles bool, filterOutZeroBalances bool, utxoView *UtxoView) (
-	_entriesYouHodl []*BalanceEntry,
-	_profilesYouHodl []*ProfileEntry,
-	_err error) {
-	handle := utxoView.Handle
-	// Get the balance entries for the coins that *you hodl*
-	balanceEntriesYouHodl := []*BalanceEntry{}
-	{
-		prefix := append([]byte{}, _PrefixHODLerPKIDCreatorPKIDToBalanceEntry...)
-		keyPrefix := append(prefix, pkid.PKID[:]...)
-		_, entryByteStringsFound := _enumerateKeysForPrefix(
-			handle, keyPrefix)
-		for _, byteString := range entryByteStringsFound {
-			currentEntry := &BalanceEntry{}
-			gob.NewDecoder(bytes.NewReader(byteString)).Decode(currentEntry)
-			if filterOutZeroBalances && currentEntry.BalanceNanos == 0 {
-				continue
-			}
-			balanceEntriesYouHodl = append(balanceEntriesYouHodl, currentEntry)
+// DbGetDecodeFailureCounts returns the count for every prefix that has had a
+// decode failure, ordered by prefix. Failures that haven't been flushed yet
+// aren't included.
+func DbGetDecodeFailureCounts(handle *badger.DB) ([]*DecodeFailureCount, error) {
+	decodeFailureCounts := []*DecodeFailureCount{}
+	err := EnumerateKeysForPrefixWithCallback(handle, _PrefixDbPrefixToDecodeFailureCount, func(key []byte, valBytes []byte) (bool, error) {
+		if len(valBytes) != 8 {
+			return false, _corruptDbEntryError(fmt.Errorf("count has length %d", len(valBytes)),
+				"DbGetDecodeFailureCounts: Problem decoding count for key %v", key)
 		}
-	}
-	// Optionally fetch all the profile entries as well.
-	profilesYouHodl := []*ProfileEntry{}
-	if fetchProfiles {
-		for _, balanceEntry := range balanceEntriesYouHodl {
-			// In this case you're the hodler so the creator is the one whose
-			// profile we need to fetch.
-			currentProfileEntry := utxoView.GetProfileEntryForPKID(balanceEntry.CreatorPKID)
-			profilesYouHodl = append(profilesYouHodl, currentProfileEntry)
+		dbPrefix := append([]byte{}, key[len(_PrefixDbPrefixToDecodeFailureCount):]...)
+		prefixName := fmt.Sprintf("Unregistered%v", dbPrefix)
+		if prefixInfo := GetDbPrefixInfoForKey(dbPrefix); prefixInfo != nil {
+			prefixName = prefixInfo.Name
 		}
+		decodeFailureCounts = append(decodeFailureCounts, &DecodeFailureCount{
+			PrefixName: prefixName,
+			Prefix:     dbPrefix,
+			Count:      DecodeUint64(valBytes),
+		})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return balanceEntriesYouHodl, profilesYouHodl, nil
+	return decodeFailureCounts, nil
 }
 
-// DbGetBalanceEntriesHodlingYou fetchs the BalanceEntries that hodl the pkid passed in.
-func DbGetBalanceEntriesHodlingYou(pkid *PKIDEntry, fetchProfiles bool, filterOutZeroBalances bool, utxoView *UtxoView) (
-	_entriesHodlingYou []*BalanceEntry,
-	_profilesHodlingYou []*ProfileEntry,
-	_err error) {
-	handle := utxoView.Handle
-	// Get the balance entries for the coins that *hodl you*
-	balanceEntriesThatHodlYou := []*BalanceEntry{}
-	{
-		prefix := append([]byte{}, _PrefixCreatorPKIDHODLerPKIDToBalanceEntry...)
-		keyPrefix := append(prefix, pkid.PKID[:]...)
-		_, entryByteStringsFound := _enumerateKeysForPrefix(
-			handle, keyPrefix)
-		for _, byteString := range entryByteStringsFound {
-			currentEntry := &BalanceEntry{}
-			gob.NewDecoder(bytes.NewReader(byteString)).Decode(currentEntry)
-			if filterOutZeroBalances && currentEntry.BalanceNanos == 0 {
-				continue
-			}
-			balanceEntriesThatHodlYou = append(balanceEntriesThatHodlYou, currentEntry)
-		}
+// DbGetDecodeFailureAlerts flushes the pending decode failures and returns the
+// prefixes whose count has reached the threshold in the node config. Lots of
+// values that can't be decoded under one prefix usually means the db is
+// corrupt or was written by an incompatible version of the node.
+func DbGetDecodeFailureAlerts(handle *badger.DB) ([]*DecodeFailureCount, error) {
+	if err := DbFlushDecodeFailureCounts(handle); err != nil {
+		return nil, err
 	}
-	// Optionally fetch all the profile entries as well.
-	profilesThatHodlYou := []*ProfileEntry{}
-	if fetchProfiles {
-		for _, balanceEntry := range balanceEntriesThatHodlYou {
-			// In this case you're the creator and the hodler is the one whose
-			// profile we need to fetch.
-			currentProfileEntry := utxoView.GetProfileEntryForPKID(balanceEntry.HODLerPKID)
-			profilesThatHodlYou = append(profilesThatHodlYou, currentProfileEntry)
-		}
+	nodeConfig, err := DbGetNodeConfig(handle)
+	if err != nil {
+		return nil, err
 	}
-	return balanceEntriesThatHodlYou, profilesThatHodlYou, nil
-}
-
-// DbGetCreatorCoinBalanceEntriesForPubKeyWithTxn finds the BalanceEntries corresponding
-// to the public key passed in. It fetched both the entries corresponding to the
-// profiles that *you HODL* and the entries corresponding to the profiles that
-// *HODL you*.
-func DbGetCreatorCoinBalanceEntriesForPubKey(
-	pkid *PKIDEntry, fetchProfiles bool, filterOutZeroBalances bool, utxoView *UtxoView) (
-	_entriesYouHodl []*BalanceEntry, _entriesThatHodlYou []*BalanceEntry,
-	_profilesYouHodl []*ProfileEntry, _profilesThatHodlYou []*ProfileEntry,
-	_err error) {
+	threshold := nodeConfig.GetDecodeFailureAlertThreshold()
 
-	balanceEntriesYouHodl, profilesYouHodl, err := DbGetBalanceEntriesYouHodl(pkid, fetchProfiles, filterOutZeroBalances, utxoView)
+	decodeFailureCounts, err := DbGetDecodeFailureCounts(handle)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, err
 	}
-	balanceEntriesThatHodlYou, profilesThatHodlYou, err := DbGetBalanceEntriesHodlingYou(pkid, fetchProfiles, filterOutZeroBalances, utxoView)
-	if err != nil {
-		return nil, nil, nil, nil, err
+	alerts := []*DecodeFailureCount{}
+	for _, decodeFailureCount := range decodeFailureCounts {
+		if decodeFailureCount.Count >= threshold {
+			alerts = append(alerts, decodeFailureCount)
+		}
 	}
-	// If there are no errors, return everything we found.
-	return balanceEntriesYouHodl, balanceEntriesThatHodlYou, profilesYouHodl, profilesThatHodlYou, nil
+	return alerts, nil
 }
 
 // =====================================================================================
-// End coin balance entry code
+// Faucet ledger code
 // =====================================================================================
 
-// startPrefix specifies a point in the DB at which the iteration should start.
-// It doesn't have to map to an exact key because badger will just binary search
-// and start right before/after that location.
-//
-// validForPrefix helps determine when the iteration should stop. The iteration
-// stops at the last entry that has this prefix. Setting it to
-// an empty byte string would cause the iteration to seek to the beginning of the db,
-// whereas setting it to one of the _Prefix bytes would cause the iteration to stop
-// at the last entry with that prefix.
-//
-// maxKeyLen is required so we can pad the key with FF in the case the user wants
-// to seek backwards. This is required due to a quirk of badgerdb. It is ignored
-// if reverse == false.
-//
-// numToFetch specifies the number of entries to fetch. If set to zero then it
-// fetches all entries that match the validForPrefix passed in.
-func DBGetPaginatedKeysAndValuesForPrefixWithTxn(
-	dbTxn *badger.Txn, startPrefix []byte, validForPrefix []byte,
-	maxKeyLen int, numToFetch int, reverse bool, fetchValues bool) (
+// FaucetDisbursement records nanos sent by a faucet.
+type FaucetDisbursement struct {
+	PublicKey   []byte
+	IPHash      [32]byte
+	AmountNanos uint64
+	TstampNanos uint64
+	// The txn that sent the nanos, if the faucet has one yet.
+	TxnHash *BlockHash
+}
 
-	_keysFound [][]byte, _valsFound [][]byte, _err error) {
+// FaucetRateLimit caps what a single public key or IP can get from a faucet
+// within a sliding window. A zero max means there's no cap of that kind.
+type FaucetRateLimit struct {
+	Window           time.Duration
+	MaxDisbursements int
+	MaxNanos         uint64
+}
 
-	keysFound := [][]byte{}
-	valsFound := [][]byte{}
+// FaucetIPHash hashes an IP address so the faucet ledger doesn't store raw IPs.
+// The salt should be a secret specific to the faucet so the hashes can't be
+// reversed by enumerating the address space.
+func FaucetIPHash(ipAddr string, salt []byte) [32]byte {
+	return sha256.Sum256(append(append([]byte{}, salt...), []byte(ipAddr)...))
+}
 
-	opts := badger.DefaultIteratorOptions
+func _dbKeyForFaucetDisbursement(prefix []byte, id []byte, tstampNanos uint64) []byte {
+	// Make a copy to avoid multiple calls to this function re-using the same slice.
+	key := append([]byte{}, prefix...)
+	key = append(key, id...)
+	return append(key, EncodeUint64(tstampNanos)...)
+}
 
-	opts.PrefetchValues = fetchValues
+// DbPutFaucetDisbursement records a disbursement under both the public key and the
+// IP hash. Two disbursements with the same tstamp for the same key overwrite each
+// other so callers should use the current time in nanos.
+func DbPutFaucetDisbursement(handle *badger.DB, disbursement *FaucetDisbursement) error {
+	if len(disbursement.PublicKey) != btcec.PubKeyBytesLenCompressed {
+		return fmt.Errorf("DbPutFaucetDisbursement: Public key length %d != %d",
+			len(disbursement.PublicKey), btcec.PubKeyBytesLenCompressed)
+	}
+	disbursementBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(disbursementBuf).Encode(disbursement); err != nil {
+		return errors.Wrapf(err, "DbPutFaucetDisbursement: Problem encoding disbursement")
+	}
 
-	// Optionally go in reverse order.
-	opts.Reverse = reverse
+	return DbUpdate(handle, func(txn KVTxn) error {
+		if err := txn.Set(_dbKeyForFaucetDisbursement(_PrefixPublicKeyTimestampToFaucetDisbursement,
+			disbursement.PublicKey, disbursement.TstampNanos), disbursementBuf.Bytes()); err != nil {
 
-	it := dbTxn.NewIterator(opts)
-	defer it.Close()
-	prefix := startPrefix
-	if reverse {
-		// When we iterate backwards, the prefix must be bigger than all possible
-		// keys that could actually exist with this prefix. We achieve this by
-		// padding the end of the dbPrefixx passed in up to the key length.
-		prefix = make([]byte, maxKeyLen)
-		for ii := 0; ii < maxKeyLen; ii++ {
-			if ii < len(startPrefix) {
-				prefix[ii] = startPrefix[ii]
-			} else {
-				prefix[ii] = 0xFF
-			}
+			return errors.Wrapf(err, "DbPutFaucetDisbursement: Problem adding mapping for public key")
+		}
+		if err := txn.Set(_dbKeyForFaucetDisbursement(_PrefixIPHashTimestampToFaucetDisbursement,
+			disbursement.IPHash[:], disbursement.TstampNanos), disbursementBuf.Bytes()); err != nil {
+
+			return errors.Wrapf(err, "DbPutFaucetDisbursement: Problem adding mapping for ip hash")
 		}
+		return nil
+	})
+}
+
+func _dbGetFaucetDisbursementsSince(handle *badger.DB, prefix []byte, id []byte,
+	sinceTstampNanos uint64) ([]*FaucetDisbursement, error) {
+
+	dbIter := NewDBIterator(handle, append(append([]byte{}, prefix...), id...), false /*reverse*/, true /*fetchValues*/)
+	defer dbIter.Close()
+	dbIter.Seek(_dbKeyForFaucetDisbursement(prefix, id, sinceTstampNanos))
+
+	disbursements := []*FaucetDisbursement{}
+	for dbIter.Next() {
+		disbursement := &FaucetDisbursement{}
+		if err := gob.NewDecoder(bytes.NewReader(dbIter.Value())).Decode(disbursement); err != nil {
+			return nil, _corruptDbEntryError(err, "_dbGetFaucetDisbursementsSince: Problem decoding disbursement")
+		}
+		disbursements = append(disbursements, disbursement)
+	}
+	if dbIter.Err() != nil {
+		return nil, dbIter.Err()
+	}
+	return disbursements, nil
+}
+
+// DbGetFaucetDisbursementsForPublicKey returns the disbursements to a public key
+// at or after sinceTstampNanos from oldest to newest.
+func DbGetFaucetDisbursementsForPublicKey(handle *badger.DB, publicKey []byte,
+	sinceTstampNanos uint64) ([]*FaucetDisbursement, error) {
+
+	return _dbGetFaucetDisbursementsSince(
+		handle, _PrefixPublicKeyTimestampToFaucetDisbursement, publicKey, sinceTstampNanos)
+}
+
+// DbGetFaucetDisbursementsForIPHash returns the disbursements requested from an
+// IP at or after sinceTstampNanos from oldest to newest.
+func DbGetFaucetDisbursementsForIPHash(handle *badger.DB, ipHash [32]byte,
+	sinceTstampNanos uint64) ([]*FaucetDisbursement, error) {
+
+	return _dbGetFaucetDisbursementsSince(
+		handle, _PrefixIPHashTimestampToFaucetDisbursement, ipHash[:], sinceTstampNanos)
+}
+
+func _checkFaucetRateLimit(disbursements []*FaucetDisbursement, amountNanos uint64,
+	limit *FaucetRateLimit) error {
+
+	if limit.MaxDisbursements > 0 && len(disbursements)+1 > limit.MaxDisbursements {
+		return fmt.Errorf("%d disbursements in the last %v exceeds max of %d",
+			len(disbursements)+1, limit.Window, limit.MaxDisbursements)
+	}
+	totalNanos := amountNanos
+	for _, disbursement := range disbursements {
+		totalNanos += disbursement.AmountNanos
+	}
+	if limit.MaxNanos > 0 && totalNanos > limit.MaxNanos {
+		return fmt.Errorf("%d nanos in the last %v exceeds max of %d",
+			totalNanos, limit.Window, limit.MaxNanos)
+	}
+	return nil
+}
+
+// DbCheckFaucetRateLimit returns an error if disbursing amountNanos to the public
+// key at the request of the IP would exceed the limit for either of them.
+func DbCheckFaucetRateLimit(handle *badger.DB, publicKey []byte, ipHash [32]byte,
+	amountNanos uint64, limit *FaucetRateLimit, now time.Time) error {
+
+	sinceTstampNanos := uint64(0)
+	if windowStart := now.Add(-limit.Window).UnixNano(); windowStart > 0 {
+		sinceTstampNanos = uint64(windowStart)
+	}
+
+	publicKeyDisbursements, err := DbGetFaucetDisbursementsForPublicKey(handle, publicKey, sinceTstampNanos)
+	if err != nil {
+		return errors.Wrapf(err, "DbCheckFaucetRateLimit: ")
+	}
+	if err := _checkFaucetRateLimit(publicKeyDisbursements, amountNanos, limit); err != nil {
+		return errors.Wrapf(err, "DbCheckFaucetRateLimit: Public key %v", PkToStringBoth(publicKey))
+	}
+
+	ipDisbursements, err := DbGetFaucetDisbursementsForIPHash(handle, ipHash, sinceTstampNanos)
+	if err != nil {
+		return errors.Wrapf(err, "DbCheckFaucetRateLimit: ")
 	}
-	for it.Seek(prefix); it.ValidForPrefix(validForPrefix); it.Next() {
-		keyCopy := it.Item().KeyCopy(nil)
-		if maxKeyLen != 0 && len(keyCopy) != maxKeyLen {
-			return nil, nil, fmt.Errorf(
-				"DBGetPaginatedKeysAndValuesForPrefixWithTxn: Invalid key length %v != %v",
-				len(keyCopy), maxKeyLen)
+	if err := _checkFaucetRateLimit(ipDisbursements, amountNanos, limit); err != nil {
+		return errors.Wrapf(err, "DbCheckFaucetRateLimit: IP hash %v", hex.EncodeToString(ipHash[:]))
+	}
+
+	return nil
+}
+
+// =====================================================================================
+// Reverse mapping repair code
+// =====================================================================================
+
+// ReverseMappingPair is an index that's stored twice, once under each of two
+// IDs, so it can be looked up from either side. A forward key is
+// <ForwardPrefix, first ID, second ID, rest> and its reverse key is
+// <ReversePrefix, second ID, first ID, rest>. Both keys hold the same value.
+type ReverseMappingPair struct {
+	Name          string
+	ForwardPrefix []byte
+	ReversePrefix []byte
+	FirstIDLen    int
+	SecondIDLen   int
+	// RestLen is the length of whatever follows the two IDs in the key.
+	RestLen int
+}
+
+// ReverseMappingPairs are all of the indexes that are stored in both directions.
+var ReverseMappingPairs = []*ReverseMappingPair{
+	{
+		Name:          "follows",
+		ForwardPrefix: _PrefixFollowerPKIDToFollowedPKID,
+		ReversePrefix: _PrefixFollowedPKIDToFollowerPKID,
+		FirstIDLen:    btcec.PubKeyBytesLenCompressed,
+		SecondIDLen:   btcec.PubKeyBytesLenCompressed,
+	},
+	{
+		Name:          "likes",
+		ForwardPrefix: _PrefixLikerPubKeyToLikedPostHash,
+		ReversePrefix: _PrefixLikedPostHashToLikerPubKey,
+		FirstIDLen:    btcec.PubKeyBytesLenCompressed,
+		SecondIDLen:   HashSizeBytes,
+	},
+	{
+		Name:          "diamonds",
+		ForwardPrefix: _PrefixDiamondReceiverPKIDDiamondSenderPKIDPostHash,
+		ReversePrefix: _PrefixDiamondSenderPKIDDiamondReciverPKIDPostHash,
+		FirstIDLen:    btcec.PubKeyBytesLenCompressed,
+		SecondIDLen:   btcec.PubKeyBytesLenCompressed,
+		RestLen:       HashSizeBytes,
+	},
+	{
+		Name:          "balances",
+		ForwardPrefix: _PrefixHODLerPKIDCreatorPKIDToBalanceEntry,
+		ReversePrefix: _PrefixCreatorPKIDHODLerPKIDToBalanceEntry,
+		FirstIDLen:    btcec.PubKeyBytesLenCompressed,
+		SecondIDLen:   btcec.PubKeyBytesLenCompressed,
+	},
+	recloutsReverseMappingPair,
+}
+
+var recloutsReverseMappingPair = &ReverseMappingPair{
+	Name:          "reclouts",
+	ForwardPrefix: _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash,
+	ReversePrefix: _PrefixRecloutedPostHashReclouterPubKeyToRecloutEntry,
+	FirstIDLen:    btcec.PubKeyBytesLenCompressed,
+	SecondIDLen:   HashSizeBytes,
+}
+
+// _reverseKey returns nil if the forward key isn't the length the pair expects.
+func (pair *ReverseMappingPair) _reverseKey(forwardKey []byte) []byte {
+	prefixLen := len(pair.ForwardPrefix)
+	if len(forwardKey) != prefixLen+pair.FirstIDLen+pair.SecondIDLen+pair.RestLen {
+		return nil
+	}
+	firstID := forwardKey[prefixLen : prefixLen+pair.FirstIDLen]
+	secondID := forwardKey[prefixLen+pair.FirstIDLen : prefixLen+pair.FirstIDLen+pair.SecondIDLen]
+	rest := forwardKey[prefixLen+pair.FirstIDLen+pair.SecondIDLen:]
+
+	reverseKey := append([]byte{}, pair.ReversePrefix...)
+	reverseKey = append(reverseKey, secondID...)
+	reverseKey = append(reverseKey, firstID...)
+	return append(reverseKey, rest...)
+}
+
+// ReverseMappingRepairReport is what DbRepairReverseMappings found for a pair.
+type ReverseMappingRepairReport struct {
+	Name string
+	// NumScanned is the number of forward keys checked.
+	NumScanned int
+	// NumMalformed is the number of forward keys that weren't the expected
+	// length. They're left alone.
+	NumMalformed int
+	// NumMissing is the number of forward keys without a reverse key.
+	NumMissing int
+	// NumRepaired is the number of reverse keys that were written. It's zero
+	// when nothing was written because of a dry run.
+	NumRepaired int
+}
+
+// DbRepairReverseMappings scans the forward keys of each pair and writes the
+// reverse keys that are missing, in batches. With dryRun set it only reports
+// what it would have fixed. It should only be run while no blocks are being
+// processed.
+func DbRepairReverseMappings(handle *badger.DB, pairs []*ReverseMappingPair, dryRun bool) (
+	_reports []*ReverseMappingRepairReport, _err error) {
+
+	reports := []*ReverseMappingRepairReport{}
+	for _, pair := range pairs {
+		report := &ReverseMappingRepairReport{Name: pair.Name}
+
+		missingKeys := [][]byte{}
+		missingVals := [][]byte{}
+		err := DbView(handle, func(txn KVTxn) error {
+			return EnumerateKeysForPrefixWithCallbackWithTxn(txn, pair.ForwardPrefix, func(key []byte, val []byte) (bool, error) {
+				report.NumScanned++
+				reverseKey := pair._reverseKey(key)
+				if reverseKey == nil {
+					report.NumMalformed++
+					return true, nil
+				}
+				_, err := txn.Get(reverseKey)
+				if err == ErrKVKeyNotFound {
+					report.NumMissing++
+					missingKeys = append(missingKeys, reverseKey)
+					missingVals = append(missingVals, append([]byte{}, val...))
+					return true, nil
+				}
+				return err == nil, err
+			})
+		})
+		if err != nil {
+			return nil, _wrapDbError(err, "DbRepairReverseMappings: Problem scanning %v", pair.Name)
 		}
 
-		var valCopy []byte
-		if fetchValues {
-			var err error
-			valCopy, err = it.Item().ValueCopy(nil)
+		if !dryRun && len(missingKeys) > 0 {
+			err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+				if err := txnWriter.Write(DbDropStateAccumulatorWithTxn); err != nil {
+					return err
+				}
+				for ii := range missingKeys {
+					if err := txnWriter.Set(missingKeys[ii], missingVals[ii]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
 			if err != nil {
-				return nil, nil, fmt.Errorf("DBGetPaginatedKeysAndValuesForPrefixWithTxn: "+
-					"Error fetching value: %v", err)
+				return nil, _wrapDbError(err, "DbRepairReverseMappings: Problem writing "+
+					"mappings for %v", pair.Name)
 			}
+			report.NumRepaired += len(missingKeys)
 		}
 
-		keysFound = append(keysFound, keyCopy)
-		valsFound = append(valsFound, valCopy)
-
-		if numToFetch != 0 && len(keysFound) == numToFetch {
-			break
-		}
+		reports = append(reports, report)
 	}
 
-	// Return whatever we found.
-	return keysFound, valsFound, nil
+	return reports, nil
 }
 
-func DBGetPaginatedKeysAndValuesForPrefix(
-	db *badger.DB, startPrefix []byte, validForPrefix []byte,
-	keyLen int, numToFetch int, reverse bool, fetchValues bool) (
-	_keysFound [][]byte, _valsFound [][]byte, _err error) {
+// =====================================================================================
+// Integrity check code
+// =====================================================================================
 
-	keysFound := [][]byte{}
-	valsFound := [][]byte{}
+// DbIntegrityReport is what VerifyDbIntegrity found for one of its checks.
+type DbIntegrityReport struct {
+	Name string
+	// NumScanned is the number of keys checked.
+	NumScanned int
+	// NumMalformed is the number of keys or values that couldn't be parsed.
+	// They're left alone.
+	NumMalformed int
+	// NumMissing is the number of keys whose counterpart is missing or doesn't
+	// point back at them. The counterpart is written on repair.
+	NumMissing int
+	// NumOrphaned is the number of keys whose counterpart is gone. They're
+	// deleted on repair.
+	NumOrphaned int
+	// NumRepaired is the number of keys that were written or deleted. It's zero
+	// unless repair is set.
+	NumRepaired int
+}
+
+// dbIntegrityFixes are the writes that would repair what a check found. Deletes
+// are applied before sets so a counterpart that's rewritten isn't then deleted
+// as an orphan.
+type dbIntegrityFixes struct {
+	keysToDelete [][]byte
+	keysToSet    [][]byte
+	valsToSet    [][]byte
+}
+
+func (fixes *dbIntegrityFixes) set(key []byte, val []byte) {
+	fixes.keysToSet = append(fixes.keysToSet, append([]byte{}, key...))
+	fixes.valsToSet = append(fixes.valsToSet, append([]byte{}, val...))
+}
+
+func (fixes *dbIntegrityFixes) delete(key []byte) {
+	fixes.keysToDelete = append(fixes.keysToDelete, append([]byte{}, key...))
+}
+
+// _forwardKey is the inverse of _reverseKey. It returns nil if the reverse key
+// isn't the length the pair expects.
+func (pair *ReverseMappingPair) _forwardKey(reverseKey []byte) []byte {
+	prefixLen := len(pair.ReversePrefix)
+	if len(reverseKey) != prefixLen+pair.FirstIDLen+pair.SecondIDLen+pair.RestLen {
+		return nil
+	}
+	secondID := reverseKey[prefixLen : prefixLen+pair.SecondIDLen]
+	firstID := reverseKey[prefixLen+pair.SecondIDLen : prefixLen+pair.SecondIDLen+pair.FirstIDLen]
+	rest := reverseKey[prefixLen+pair.SecondIDLen+pair.FirstIDLen:]
 
-	dbErr := db.View(func(txn *badger.Txn) error {
-		var err error
-		keysFound, valsFound, err = DBGetPaginatedKeysAndValuesForPrefixWithTxn(
-			txn, startPrefix, validForPrefix, keyLen,
-			numToFetch, reverse, fetchValues)
-		if err != nil {
-			return fmt.Errorf("DBGetPaginatedKeysAndValuesForPrefix: %v", err)
+	forwardKey := append([]byte{}, pair.ForwardPrefix...)
+	forwardKey = append(forwardKey, firstID...)
+	forwardKey = append(forwardKey, secondID...)
+	return append(forwardKey, rest...)
+}
+
+// _dbCheckReverseMappingPairWithTxn checks that every forward key of the pair
+// has a reverse key and every reverse key has a forward key. The forward keys
+// are taken as the truth, the same as in DbRepairReverseMappings.
+func _dbCheckReverseMappingPairWithTxn(txn KVTxn, pair *ReverseMappingPair,
+	report *DbIntegrityReport, fixes *dbIntegrityFixes) error {
+
+	err := EnumerateKeysForPrefixWithCallbackWithTxn(txn, pair.ForwardPrefix, func(key []byte, val []byte) (bool, error) {
+		report.NumScanned++
+		reverseKey := pair._reverseKey(key)
+		if reverseKey == nil {
+			report.NumMalformed++
+			return true, nil
 		}
-		return nil
+		_, err := txn.Get(reverseKey)
+		if err == ErrKVKeyNotFound {
+			report.NumMissing++
+			fixes.set(reverseKey, val)
+			return true, nil
+		}
+		return err == nil, err
 	})
-	if dbErr != nil {
-		return nil, nil, dbErr
+	if err != nil {
+		return err
 	}
+	return EnumerateKeysForPrefixWithCallbackWithTxn(txn, pair.ReversePrefix, func(key []byte, _ []byte) (bool, error) {
+		report.NumScanned++
+		forwardKey := pair._forwardKey(key)
+		if forwardKey == nil {
+			report.NumMalformed++
+			return true, nil
+		}
+		_, err := txn.Get(forwardKey)
+		if err == ErrKVKeyNotFound {
+			report.NumOrphaned++
+			fixes.delete(key)
+			return true, nil
+		}
+		return err == nil, err
+	})
+}
 
-	return keysFound, valsFound, nil
+// _dbCheckPKIDMappingsWithTxn checks that every public key's PKID maps back to
+// the public key and every PKID's public key maps to the PKID. The public key to
+// PKID mappings are taken as the truth.
+func _dbCheckPKIDMappingsWithTxn(txn KVTxn, report *DbIntegrityReport, fixes *dbIntegrityFixes) error {
+	err := EnumerateKeysForPrefixWithCallbackWithTxn(txn, _PrefixPublicKeyToPKID, func(key []byte, val []byte) (bool, error) {
+		report.NumScanned++
+		pkidEntry := &PKIDEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(val)).Decode(pkidEntry); err != nil || pkidEntry.PKID == nil {
+			report.NumMalformed++
+			return true, nil
+		}
+		publicKey := key[len(_PrefixPublicKeyToPKID):]
+		pkidKey := append(append([]byte{}, _PrefixPKIDToPublicKey...), pkidEntry.PKID[:]...)
+		mappedPublicKey, err := txn.Get(pkidKey)
+		if err != nil && err != ErrKVKeyNotFound {
+			return false, err
+		}
+		if err == nil {
+			if bytes.Equal(mappedPublicKey, publicKey) {
+				return true, nil
+			}
+		}
+		report.NumMissing++
+		fixes.set(pkidKey, publicKey)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return EnumerateKeysForPrefixWithCallbackWithTxn(txn, _PrefixPKIDToPublicKey, func(key []byte, val []byte) (bool, error) {
+		report.NumScanned++
+		pkid := key[len(_PrefixPKIDToPublicKey):]
+		publicKeyKey := append(append([]byte{}, _PrefixPublicKeyToPKID...), val...)
+		valBytes, err := txn.Get(publicKeyKey)
+		if err != nil && err != ErrKVKeyNotFound {
+			return false, err
+		}
+		if err == nil {
+			pkidEntry := &PKIDEntry{}
+			err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(pkidEntry)
+			// A public key mapping that can't be decoded is counted above.
+			if err != nil || pkidEntry.PKID == nil || bytes.Equal(pkidEntry.PKID[:], pkid) {
+				return true, nil
+			}
+		}
+		report.NumOrphaned++
+		fixes.delete(key)
+		return true, nil
+	})
 }
 
-func DBGetPaginatedPostsOrderedByTime(
-	db *badger.DB, startPostTimestampNanos uint64, startPostHash *BlockHash,
-	numToFetch int, fetchPostEntries bool, reverse bool) (
-	_postHashes []*BlockHash, _tstampNanos []uint64, _postEntries []*PostEntry,
-	_err error) {
+// _dbCheckMessagesWithTxn checks that every message stored under one party's
+// public key is also stored under the other party's. Neither copy is more right
+// than the other so a missing one is written from the one that's there.
+func _dbCheckMessagesWithTxn(txn KVTxn, report *DbIntegrityReport, fixes *dbIntegrityFixes) error {
+	keyLen := len(_PrefixPublicKeyTimestampToPrivateMessage) + btcec.PubKeyBytesLenCompressed + 8
+	return EnumerateKeysForPrefixWithCallbackWithTxn(txn, _PrefixPublicKeyTimestampToPrivateMessage, func(key []byte, val []byte) (bool, error) {
+		report.NumScanned++
+		messageEntry := &MessageEntry{}
+		if len(key) != keyLen || _DbDecodeMessageEntry(val, messageEntry) != nil {
+			report.NumMalformed++
+			return true, nil
+		}
+		publicKey := key[len(_PrefixPublicKeyTimestampToPrivateMessage) : keyLen-8]
+		var otherPublicKey []byte
+		if bytes.Equal(publicKey, messageEntry.SenderPublicKey) {
+			otherPublicKey = messageEntry.RecipientPublicKey
+		} else if bytes.Equal(publicKey, messageEntry.RecipientPublicKey) {
+			otherPublicKey = messageEntry.SenderPublicKey
+		} else {
+			report.NumMalformed++
+			return true, nil
+		}
+		otherKey := _dbKeyForMessageEntry(otherPublicKey, messageEntry.TstampNanos)
+		_, err := txn.Get(otherKey)
+		if err == ErrKVKeyNotFound {
+			report.NumMissing++
+			fixes.set(otherKey, val)
+			return true, nil
+		}
+		return err == nil, err
+	})
+}
 
-	startPostPrefix := append([]byte{}, _PrefixTstampNanosPostHash...)
+// VerifyDbIntegrity cross-checks the indexes that are stored more than once:
+// every ReverseMappingPair, the PKID mappings in both directions, and the copies
+// of each message under its sender and recipient. With repair set it also writes
+// the missing counterparts and deletes the orphaned mappings. Like
+// DbRepairReverseMappings it should only be run while no blocks are being
+// processed.
+func VerifyDbIntegrity(handle *badger.DB, params *BitCloutParams, repair bool) (
+	_reports []*DbIntegrityReport, _err error) {
 
-	if startPostTimestampNanos > 0 {
-		startTstampBytes := EncodeUint64(startPostTimestampNanos)
-		startPostPrefix = append(startPostPrefix, startTstampBytes...)
+	type integrityCheck struct {
+		name  string
+		check func(txn KVTxn, report *DbIntegrityReport, fixes *dbIntegrityFixes) error
 	}
+	checks := []*integrityCheck{}
+	for _, pairIter := range ReverseMappingPairs {
+		pair := pairIter
+		checks = append(checks, &integrityCheck{pair.Name, func(
+			txn KVTxn, report *DbIntegrityReport, fixes *dbIntegrityFixes) error {
 
-	if startPostHash != nil {
-		startPostPrefix = append(startPostPrefix, startPostHash[:]...)
+			return _dbCheckReverseMappingPairWithTxn(txn, pair, report, fixes)
+		}})
 	}
+	checks = append(checks,
+		&integrityCheck{"pkids", _dbCheckPKIDMappingsWithTxn},
+		&integrityCheck{"messages", _dbCheckMessagesWithTxn},
+	)
 
-	// We fetch in reverse to get the latest posts.
-	maxUint64Tstamp := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-	postIndexKeys, _, err := DBGetPaginatedKeysAndValuesForPrefix(
-		db, startPostPrefix, _PrefixTstampNanosPostHash, /*validForPrefix*/
-		len(_PrefixTstampNanosPostHash)+len(maxUint64Tstamp)+HashSizeBytes, /*keyLen*/
-		numToFetch, reverse /*reverse*/, false /*fetchValues*/)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("DBGetPaginatedPostsOrderedByTime: %v", err)
-	}
+	reports := []*DbIntegrityReport{}
+	for _, check := range checks {
+		report := &DbIntegrityReport{Name: check.name}
+		fixes := &dbIntegrityFixes{}
+		if err := DbView(handle, func(txn KVTxn) error {
+			return check.check(txn, report, fixes)
+		}); err != nil {
+			return nil, _wrapDbError(err, "VerifyDbIntegrity: Problem checking %v", check.name)
+		}
+		if report.NumMissing > 0 || report.NumOrphaned > 0 {
+			glog.Warningf("VerifyDbIntegrity: Found %d missing and %d orphaned %v mappings "+
+				"on %v", report.NumMissing, report.NumOrphaned, check.name, params.NetworkType)
+		}
 
-	// Cut the post hashes and timestamps out of the returned keys.
-	postHashes := []*BlockHash{}
-	tstamps := []uint64{}
-	startTstampIndex := len(_PrefixTstampNanosPostHash)
-	hashStartIndex := len(_PrefixTstampNanosPostHash) + len(maxUint64Tstamp)
-	hashEndIndex := hashStartIndex + HashSizeBytes
-	for _, postKeyBytes := range postIndexKeys {
-		currentPostHash := &BlockHash{}
-		copy(currentPostHash[:], postKeyBytes[hashStartIndex:hashEndIndex])
-		postHashes = append(postHashes, currentPostHash)
+		if repair && len(fixes.keysToDelete)+len(fixes.keysToSet) > 0 {
+			err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+				if err := txnWriter.Write(DbDropStateAccumulatorWithTxn); err != nil {
+					return err
+				}
+				for _, key := range fixes.keysToDelete {
+					pkidEntryCache.invalidate(key)
+					if err := txnWriter.Delete(key); err != nil {
+						return err
+					}
+				}
+				for ii, key := range fixes.keysToSet {
+					pkidEntryCache.invalidate(key)
+					if err := txnWriter.Set(key, fixes.valsToSet[ii]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			DbCacheFinishWrites()
+			if err != nil {
+				return nil, _wrapDbError(err, "VerifyDbIntegrity: Problem repairing %v", check.name)
+			}
+			report.NumRepaired = len(fixes.keysToDelete) + len(fixes.keysToSet)
+		}
 
-		tstamps = append(tstamps, DecodeUint64(
-			postKeyBytes[startTstampIndex:hashStartIndex]))
+		reports = append(reports, report)
 	}
 
-	// Fetch the PostEntries if desired.
-	var postEntries []*PostEntry
-	if fetchPostEntries {
-		for _, postHash := range postHashes {
-			postEntry := DBGetPostEntryByPostHash(db, postHash)
-			if postEntry == nil {
-				return nil, nil, nil, fmt.Errorf("DBGetPaginatedPostsOrderedByTime: "+
-					"PostHash %v does not have corresponding entry", postHash)
+	return reports, nil
+}
+
+// =====================================================================================
+// Legacy key normalization code
+// =====================================================================================
+
+// KeyNormalization describes the canonical layout of the keys under a prefix
+// whose layout was documented or written inconsistently in the past.
+type KeyNormalization struct {
+	Name   string
+	Prefix []byte
+	// CanonicalKey returns the key in the canonical layout, which is the key
+	// itself if it's already canonical, or nil if the key isn't in any known
+	// layout.
+	CanonicalKey func(key []byte) []byte
+}
+
+// KeyNormalizationReport is what DbNormalizeLegacyKeys found for a prefix.
+type KeyNormalizationReport struct {
+	Name string
+	// NumScanned is the number of keys checked.
+	NumScanned int
+	// NumAnomalous is the number of keys in a known non-canonical layout.
+	NumAnomalous int
+	// NumMalformed is the number of keys that aren't in any known layout.
+	// They're left alone.
+	NumMalformed int
+	// NumRewritten is the number of anomalous keys that were rewritten. It's
+	// zero when nothing was written because of a dry run.
+	NumRewritten int
+}
+
+// LegacyKeyNormalizations are the prefixes with historically inconsistent key
+// layouts.
+var LegacyKeyNormalizations = []*KeyNormalization{
+	{
+		// Reclout keys were once documented as two 39-byte fields. Only the
+		// 33-byte public key and 32-byte post hash layout has been written.
+		Name:   "reclouts",
+		Prefix: _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash,
+		CanonicalKey: func(key []byte) []byte {
+			if len(key) != 1+btcec.PubKeyBytesLenCompressed+HashSizeBytes {
+				return nil
 			}
-			postEntries = append(postEntries, postEntry)
+			return key
+		},
+	},
+	{
+		// A comment on a post has its parent post hash padded to 33 bytes like
+		// a public key. Pad any that aren't.
+		Name:   "comment-parent-stake-ids",
+		Prefix: _PrefixCommentParentStakeIDToPostHash,
+		CanonicalKey: func(key []byte) []byte {
+			switch len(key) {
+			case 1 + btcec.PubKeyBytesLenCompressed + 8 + HashSizeBytes:
+				return key
+			case 1 + HashSizeBytes + 8 + HashSizeBytes:
+				canonicalKey := append([]byte{}, key[:1+HashSizeBytes]...)
+				canonicalKey = append(canonicalKey, 0x00)
+				return append(canonicalKey, key[1+HashSizeBytes:]...)
+			}
+			return nil
+		},
+	},
+	{
+		// Post stake IDs are stored as the bare post hash. Strip the padding
+		// from any that were stored padded by HashToStakeID.
+		Name:   "stake-ids",
+		Prefix: _PrefixStakeIDTypeAmountStakeIDIndex,
+		CanonicalKey: func(key []byte) []byte {
+			headerLen := 1 + 1 + 8
+			if len(key) < headerLen {
+				return nil
+			}
+			switch StakeIDType(key[1]) {
+			case StakeIDTypePost:
+				if len(key) == headerLen+HashSizeBytes {
+					return key
+				}
+				if len(key) == headerLen+btcec.PubKeyBytesLenCompressed && key[len(key)-1] == 0x00 {
+					return append([]byte{}, key[:headerLen+HashSizeBytes]...)
+				}
+			case StakeIDTypeProfile:
+				if len(key) == headerLen+btcec.PubKeyBytesLenCompressed {
+					return key
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// DbNormalizeLegacyKeys rewrites the anomalous keys under each normalization's
+// prefix to their canonical layout, in batches. If the canonical key already
+// exists it's kept and the anomalous key is just deleted. With dryRun set it
+// only reports what it would have rewritten. It should only be run while no
+// blocks are being processed.
+func DbNormalizeLegacyKeys(handle *badger.DB, normalizations []*KeyNormalization, dryRun bool) (
+	_reports []*KeyNormalizationReport, _err error) {
+
+	reports := []*KeyNormalizationReport{}
+	for _, normalization := range normalizations {
+		report := &KeyNormalizationReport{Name: normalization.Name}
+
+		anomalousKeys := [][]byte{}
+		canonicalKeys := [][]byte{}
+		vals := [][]byte{}
+		err := EnumerateKeysForPrefixWithCallback(handle, normalization.Prefix, func(key []byte, val []byte) (bool, error) {
+			report.NumScanned++
+			canonicalKey := normalization.CanonicalKey(key)
+			if canonicalKey == nil {
+				report.NumMalformed++
+				return true, nil
+			}
+			if !bytes.Equal(canonicalKey, key) {
+				report.NumAnomalous++
+				anomalousKeys = append(anomalousKeys, append([]byte{}, key...))
+				canonicalKeys = append(canonicalKeys, canonicalKey)
+				vals = append(vals, append([]byte{}, val...))
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "DbNormalizeLegacyKeys: Problem scanning %v", normalization.Name)
+		}
+
+		if !dryRun {
+			err := DbUpdateWithTxnWriter(handle, func(txnWriter *TxnWriter) error {
+				for ii := range anomalousKeys {
+					canonicalKey, anomalousKey, val := canonicalKeys[ii], anomalousKeys[ii], vals[ii]
+					if err := txnWriter.Write(func(txn KVTxn) error {
+						_, err := txn.Get(canonicalKey)
+						if err == ErrKVKeyNotFound {
+							err = txn.Set(canonicalKey, val)
+						}
+						if err != nil {
+							return err
+						}
+						return txn.Delete(anomalousKey)
+					}); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, _wrapDbError(err, "DbNormalizeLegacyKeys: Problem writing "+
+					"keys for %v", normalization.Name)
+			}
+			report.NumRewritten += len(anomalousKeys)
 		}
+
+		reports = append(reports, report)
 	}
 
-	return postHashes, tstamps, postEntries, nil
+	return reports, nil
 }
 
-func DBGetProfilesByUsernamePrefixAndBitCloutLocked(
-	db *badger.DB, usernamePrefix string, utxoView *UtxoView) (
-	_profileEntries []*ProfileEntry, _err error) {
+// legacyKeyNormalizationMigrationName marks whether the legacy key
+// normalization has run.
+const legacyKeyNormalizationMigrationName = "legacy-key-normalization"
 
-	startPrefix := append([]byte{}, _PrefixProfileUsernameToPKID...)
-	lowercaseUsernamePrefixString := strings.ToLower(usernamePrefix)
-	lowercaseUsernamePrefix := []byte(lowercaseUsernamePrefixString)
-	startPrefix = append(startPrefix, lowercaseUsernamePrefix...)
+// DbRunLegacyKeyNormalization runs DbNormalizeLegacyKeys over
+// LegacyKeyNormalizations the first time it's called on a db and stores the
+// reports. It returns nil reports if the normalization already ran.
+func DbRunLegacyKeyNormalization(handle *badger.DB) (_reports []*KeyNormalizationReport, _err error) {
+	if DbGetIndexMigrationState(handle, legacyKeyNormalizationMigrationName) ==
+		IndexMigrationStateBackfillComplete {
 
-	_, pkidsFound, err := DBGetPaginatedKeysAndValuesForPrefix(
-		db /*db*/, startPrefix, /*startPrefix*/
-		startPrefix /*validForPrefix*/, 0, /*keyLen (ignored when reverse == false)*/
-		0 /*numToFetch (zero fetches all)*/, false, /*reverse*/
-		true /*fetchValues*/)
-	if err != nil {
-		return nil, fmt.Errorf("DBGetProfilesByUsernamePrefixAndBitCloutLocked: %v", err)
+		return nil, nil
 	}
 
-	// Have to do this to convert the PKIDs back into public keys
-	// TODO: We should clean things up around public keys vs PKIDs
-	pubKeysMap := make(map[PkMapKey][]byte)
-	for _, pkidBytes := range pkidsFound {
-		if len(pkidBytes) != btcec.PubKeyBytesLenCompressed {
-			continue
-		}
-		pkid := &PKID{}
-		copy(pkid[:], pkidBytes)
-		pubKey := DBGetPublicKeyForPKID(db, pkid)
-		if len(pubKey) != 0 {
-			pubKeysMap[MakePkMapKey(pubKey)] = pubKey
-		}
+	reports, err := DbNormalizeLegacyKeys(handle, LegacyKeyNormalizations, false /*dryRun*/)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbRunLegacyKeyNormalization: ")
 	}
 
-	for username, profileEntry := range utxoView.ProfileUsernameToProfileEntry {
-		if strings.HasPrefix(string(username[:]), lowercaseUsernamePrefixString) {
-			pkMapKey := MakePkMapKey(profileEntry.PublicKey)
-			pubKeysMap[pkMapKey] = profileEntry.PublicKey
-		}
+	reportsBuf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(reportsBuf).Encode(reports); err != nil {
+		return nil, errors.Wrapf(err, "DbRunLegacyKeyNormalization: Problem encoding reports")
 	}
-
-	// Sigh.. convert the public keys *back* into PKIDs...
-	profilesFound := []*ProfileEntry{}
-	for _, pk := range pubKeysMap {
-		pkid := utxoView.GetPKIDForPublicKey(pk).PKID
-		profile := utxoView.GetProfileEntryForPKID(pkid)
-		// Double-check that a username matches the prefix.
-		// If a user had the handle "elon" and then changed to "jeff" and that transaction hadn't mined yet,
-		// we would return the profile for "jeff" when we search for "elon" which is incorrect.
-		if profile != nil && strings.HasPrefix(strings.ToLower(string(profile.Username[:])), lowercaseUsernamePrefixString) {
-			profilesFound = append(profilesFound, profile)
+	err = DbUpdate(handle, func(txn KVTxn) error {
+		if err := txn.Set(_KeyLegacyKeyNormalizationReports, reportsBuf.Bytes()); err != nil {
+			return err
 		}
+		return DbPutIndexMigrationStateWithTxn(
+			txn, legacyKeyNormalizationMigrationName, IndexMigrationStateBackfillComplete)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "DbRunLegacyKeyNormalization: Problem marking normalization complete")
 	}
 
-	// If there is no error, sort and return numToFetch. Username searches are always
-	// sorted by coin value.
-	sort.Slice(profilesFound, func(ii, jj int) bool {
-		return profilesFound[ii].CoinEntry.BitCloutLockedNanos > profilesFound[jj].CoinEntry.BitCloutLockedNanos
-	})
+	return reports, nil
+}
 
-	return profilesFound, nil
+// DbGetLegacyKeyNormalizationReports returns the reports stored when the legacy
+// key normalization ran, or nil if it hasn't run.
+func DbGetLegacyKeyNormalizationReports(handle *badger.DB) ([]*KeyNormalizationReport, error) {
+	var reports []*KeyNormalizationReport
+	err := DbView(handle, func(txn KVTxn) error {
+		valBytes, err := txn.Get(_KeyLegacyKeyNormalizationReports)
+		if err == ErrKVKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(&reports); err != nil {
+			return _corruptDbEntryError(err, "Problem decoding reports")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, _wrapDbError(err, "DbGetLegacyKeyNormalizationReports")
+	}
+	return reports, nil
 }
 
-// DBGetPaginatedProfilesByBitCloutLocked returns up to 'numToFetch' profiles from the db.
-func DBGetPaginatedProfilesByBitCloutLocked(
-	db *badger.DB, startBitCloutLockedNanos uint64,
-	startProfilePubKeyy []byte, numToFetch int, fetchProfileEntries bool) (
-	_profilePublicKeys [][]byte, _profileEntries []*ProfileEntry, _err error) {
+// =====================================================================================
+// Entry cache code
+// =====================================================================================
 
-	// Convert the start public key to a PKID.
-	pkidEntry := DBGetPKIDEntryForPublicKey(db, startProfilePubKeyy)
+// DbCacheConfig sizes the in-memory caches that DBGetProfileEntryForPKID,
+// DBGetPostEntryByPostHash, DBGetPKIDEntryForPublicKey, DBGetPublicKeyForPKID,
+// and DbGetBlockHeaderForNode check before reading and decoding an entry from
+// the db. Each size is a number of entries and zero turns that cache off, which
+// is the default. PKIDs looked up in either direction count toward
+// MaxPKIDEntries. See SetDbCacheConfig.
+type DbCacheConfig struct {
+	MaxProfileEntries     int
+	MaxPostEntries        int
+	MaxPKIDEntries        int
+	MaxBlockHeaderEntries int
+}
+
+// _dbEntryCache is a size-bounded LRU cache of entries keyed by their db key.
+// Each entry remembers the db it was read from so a node with more than one db,
+// like one running a txindex, never gets one db's entry from another. Callers
+// always get their own copy of an entry, since views change the entries they
+// read in place. Posts and profiles are cached encoded and decoded on every hit.
+//
+// The Put and Delete functions for the cached entries invalidate them. They run
+// inside a txn that hasn't committed yet, so a reader could still read the old
+// entry from the db after the invalidation and cache it. To keep that from
+// happening, an invalidation also stops anything new from being cached until
+// DbCacheFinishWrites is called once the writes have committed or been
+// discarded. DbAtomicUpdate and DbUpdateWithTxnWriter call it, which covers
+// connecting blocks and flushing views. Writes made some other way only leave
+// caching paused until the next time it's called.
+type _dbEntryCache struct {
+	name string
+
+	mtx        sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lruList    *list.List
+	// Bumped by every invalidation so that an entry read before one isn't cached.
+	generation    uint64
+	writesPending bool
+
+	numHits   uint64
+	numMisses uint64
+}
+
+type _dbEntryCacheElement struct {
+	key   string
+	db    *badger.DB
+	entry interface{}
+}
 
-	startProfilePrefix := append([]byte{}, _PrefixCreatorBitCloutLockedNanosCreatorPKID...)
-	var startBitCloutLockedBytes []byte
-	if pkidEntry != nil {
-		startBitCloutLockedBytes = EncodeUint64(startBitCloutLockedNanos)
-		startProfilePrefix = append(startProfilePrefix, startBitCloutLockedBytes...)
-		startProfilePrefix = append(startProfilePrefix, pkidEntry.PKID[:]...)
-	} else {
-		// If no pub key is provided, we just max out bitclout locked and start at the top of the list.
-		maxBigEndianUint64Bytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-		startBitCloutLockedBytes = maxBigEndianUint64Bytes
-		startProfilePrefix = append(startProfilePrefix, startBitCloutLockedBytes...)
-	}
+var (
+	profileEntryCache = _newDbEntryCache("profiles")
+	postEntryCache    = _newDbEntryCache("posts")
+	pkidEntryCache    = _newDbEntryCache("pkids")
+	blockHeaderCache  = _newDbEntryCache("block-headers")
+)
 
-	keyLen := len(_PrefixCreatorBitCloutLockedNanosCreatorPKID) + len(startBitCloutLockedBytes) + btcec.PubKeyBytesLenCompressed
-	// We fetch in reverse to get the profiles with the most BitClout locked.
-	profileIndexKeys, _, err := DBGetPaginatedKeysAndValuesForPrefix(
-		db, startProfilePrefix, _PrefixCreatorBitCloutLockedNanosCreatorPKID, /*validForPrefix*/
-		keyLen /*keyLen*/, numToFetch,
-		true /*reverse*/, false /*fetchValues*/)
-	if err != nil {
-		return nil, nil, fmt.Errorf("DBGetPaginatedProfilesByBitCloutLocked: %v", err)
+func _newDbEntryCache(name string) *_dbEntryCache {
+	return &_dbEntryCache{
+		name:    name,
+		entries: make(map[string]*list.Element),
+		lruList: list.New(),
 	}
+}
 
-	// Cut the pkids out of the returned keys.
-	profilePKIDs := [][]byte{}
-	startPKIDIndex := len(_PrefixCreatorBitCloutLockedNanosCreatorPKID) + len(startBitCloutLockedBytes)
-	endPKIDIndex := startPKIDIndex + btcec.PubKeyBytesLenCompressed
-	for _, profileKeyBytes := range profileIndexKeys {
-		currentPKID := make([]byte, btcec.PubKeyBytesLenCompressed)
-		copy(currentPKID[:], profileKeyBytes[startPKIDIndex:endPKIDIndex][:])
-		profilePKIDs = append(profilePKIDs, currentPKID)
+// get returns the entry cached for the key in the db, if there is one, along
+// with the generation to pass to add if the caller reads it from the db instead.
+func (cache *_dbEntryCache) get(db *badger.DB, key string) (
+	_entry interface{}, _generation uint64, _found bool) {
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if cache.maxEntries == 0 {
+		return nil, cache.generation, false
 	}
+	element, exists := cache.entries[key]
+	if !exists || element.Value.(*_dbEntryCacheElement).db != db {
+		cache.numMisses++
+		return nil, cache.generation, false
+	}
+	cache.numHits++
+	cache.lruList.MoveToFront(element)
+	return element.Value.(*_dbEntryCacheElement).entry, cache.generation, true
+}
 
-	profilePubKeys := [][]byte{}
-	for _, pkidBytes := range profilePKIDs {
-		pkid := &PKID{}
-		copy(pkid[:], pkidBytes)
-		profilePubKeys = append(profilePubKeys, DBGetPublicKeyForPKID(db, pkid))
+// add caches an entry read from the db unless something was invalidated since
+// get returned the generation passed in.
+func (cache *_dbEntryCache) add(db *badger.DB, key string, entry interface{}, generation uint64) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if cache.maxEntries == 0 || cache.writesPending || generation != cache.generation {
+		return
 	}
+	if element, exists := cache.entries[key]; exists {
+		element.Value = &_dbEntryCacheElement{key: key, db: db, entry: entry}
+		cache.lruList.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.lruList.PushFront(&_dbEntryCacheElement{key: key, db: db, entry: entry})
+	for cache.lruList.Len() > cache.maxEntries {
+		oldest := cache.lruList.Back()
+		cache.lruList.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*_dbEntryCacheElement).key)
+	}
+}
 
-	if !fetchProfileEntries {
-		return profilePubKeys, nil, nil
+func (cache *_dbEntryCache) invalidate(key []byte) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if element, exists := cache.entries[string(key)]; exists {
+		cache.lruList.Remove(element)
+		delete(cache.entries, string(key))
 	}
+	cache.generation++
+	cache.writesPending = true
+}
 
-	// Fetch the ProfileEntries if desired.
-	var profileEntries []*ProfileEntry
-	for _, profilePKID := range profilePKIDs {
-		pkid := &PKID{}
-		copy(pkid[:], profilePKID)
-		profileEntry := DBGetProfileEntryForPKID(db, pkid)
-		if profileEntry == nil {
-			return nil, nil, fmt.Errorf("DBGetAllProfilesByLockedBitClout: "+
-				"ProfilePKID %v does not have corresponding entry",
-				PkToStringBoth(profilePKID))
-		}
-		profileEntries = append(profileEntries, profileEntry)
+func (cache *_dbEntryCache) finishWrites() {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if cache.writesPending {
+		cache.generation++
+		cache.writesPending = false
 	}
+}
 
-	return profilePubKeys, profileEntries, nil
+func (cache *_dbEntryCache) resize(maxEntries int) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	cache.maxEntries = maxEntries
+	cache.entries = make(map[string]*list.Element)
+	cache.lruList.Init()
+	cache.generation++
+	cache.numHits = 0
+	cache.numMisses = 0
 }
 
-// -------------------------------------------------------------------------------------
-// Mempool Txn mapping funcions
-// <prefix, txn hash BlockHash> -> <*MsgBitCloutTxn>
-// -------------------------------------------------------------------------------------
+// SetDbCacheConfig resizes the entry caches, emptying them. It's meant to be
+// called once when the node starts.
+func SetDbCacheConfig(config *DbCacheConfig) {
+	profileEntryCache.resize(config.MaxProfileEntries)
+	postEntryCache.resize(config.MaxPostEntries)
+	pkidEntryCache.resize(config.MaxPKIDEntries)
+	blockHeaderCache.resize(config.MaxBlockHeaderEntries)
+}
 
-func _dbKeyForMempoolTxn(mempoolTx *MempoolTx) []byte {
-	// Make a copy to avoid multiple calls to this function re-using the same slice.
-	prefixCopy := append([]byte{}, _PrefixMempoolTxnHashToMsgBitCloutTxn...)
-	timeAddedBytes := EncodeUint64(uint64(mempoolTx.Added.UnixNano()))
-	key := append(prefixCopy, timeAddedBytes...)
-	key = append(key, mempoolTx.Hash[:]...)
+// DbCacheFinishWrites lets the entry caches start caching again after the writes
+// that invalidated entries have committed or been discarded.
+func DbCacheFinishWrites() {
+	profileEntryCache.finishWrites()
+	postEntryCache.finishWrites()
+	pkidEntryCache.finishWrites()
+	blockHeaderCache.finishWrites()
+}
 
-	return key
+// DbCacheStats is how well one of the entry caches is doing.
+type DbCacheStats struct {
+	Name       string
+	NumEntries int
+	MaxEntries int
+	NumHits    uint64
+	NumMisses  uint64
 }
 
-func DbPutMempoolTxnWithTxn(txn *badger.Txn, mempoolTx *MempoolTx) error {
+// GetDbCacheStats returns the stats for each of the entry caches.
+func GetDbCacheStats() []*DbCacheStats {
+	stats := []*DbCacheStats{}
+	for _, cache := range []*_dbEntryCache{
+		profileEntryCache, postEntryCache, pkidEntryCache, blockHeaderCache} {
 
-	mempoolTxnBytes, err := mempoolTx.Tx.ToBytes(false /*preSignatureBool*/)
-	if err != nil {
-		return errors.Wrapf(err, "DbPutMempoolTxnWithTxn: Problem encoding mempoolTxn to bytes.")
+		cache.mtx.Lock()
+		stats = append(stats, &DbCacheStats{
+			Name:       cache.name,
+			NumEntries: cache.lruList.Len(),
+			MaxEntries: cache.maxEntries,
+			NumHits:    cache.numHits,
+			NumMisses:  cache.numMisses,
+		})
+		cache.mtx.Unlock()
 	}
+	return stats
+}
 
-	if err := txn.Set(_dbKeyForMempoolTxn(mempoolTx), mempoolTxnBytes); err != nil {
-		return errors.Wrapf(err, "DbPutMempoolTxnWithTxn: Problem putting mapping for txn hash: %s", mempoolTx.Hash.String())
-	}
+// =====================================================================================
+// Cache prewarm code
+// =====================================================================================
 
-	return nil
+// PrewarmPrefix is a range of keys worth reading before the node starts serving
+// traffic so that the first requests after a restart don't all go to disk.
+type PrewarmPrefix struct {
+	Name   string
+	Prefix []byte
+	// Reverse reads the largest keys first, which for tstamp and height indexes
+	// means the most recent ones.
+	Reverse bool
+	// MaxKeys limits how many keys are read. Zero reads the whole prefix.
+	MaxKeys int
+	// OnEntry, if set, is called with every entry read. It can use the txn to
+	// read the entries an index points to, or copy the entry into an in-memory
+	// cache. The key and value are only valid until it returns.
+	OnEntry func(txn KVTxn, key []byte, val []byte) error
+}
+
+// PrewarmResult is how much of a prefix PrewarmCaches read.
+type PrewarmResult struct {
+	Name      string
+	KeysRead  int
+	BytesRead int
+	Duration  time.Duration
+}
+
+// DefaultPrewarmPrefixes returns the prefixes the node reads most right after it
+// starts: every profile, the most recent posts, and the blocks at the tip.
+func DefaultPrewarmPrefixes(numRecentPosts int, numTipBlocks int) []*PrewarmPrefix {
+	return []*PrewarmPrefix{
+		{
+			Name:   "profiles",
+			Prefix: _PrefixPKIDToProfileEntry,
+		},
+		{
+			Name:    "recent-posts",
+			Prefix:  _PrefixTstampNanosPostHash,
+			Reverse: true,
+			MaxKeys: numRecentPosts,
+			OnEntry: func(txn KVTxn, key []byte, _ []byte) error {
+				// The post hash is at the end of the key.
+				postHash := &BlockHash{}
+				copy(postHash[:], key[len(key)-HashSizeBytes:])
+				DBGetPostEntryByPostHashWithTxn(txn, postHash)
+				return nil
+			},
+		},
+		{
+			Name:    "tip-blocks",
+			Prefix:  _PrefixHeightHashToNodeInfo,
+			Reverse: true,
+			MaxKeys: numTipBlocks,
+			OnEntry: func(txn KVTxn, key []byte, _ []byte) error {
+				// The block hash is at the end of the key.
+				blockHash := &BlockHash{}
+				copy(blockHash[:], key[len(key)-HashSizeBytes:])
+				GetBlockWithTxn(txn, blockHash)
+				return nil
+			},
+		},
+	}
 }
 
-func DbPutMempoolTxn(handle *badger.DB, mempoolTx *MempoolTx) error {
+// PrewarmCaches reads each of the prefixes concurrently so that badger's block
+// cache holds them, along with anything their OnEntry functions read or cache,
+// by the time it returns. Each prefix is read in its own txn. Results are
+// returned in the same order as prefixes.
+func PrewarmCaches(db *badger.DB, prefixes []*PrewarmPrefix) ([]*PrewarmResult, error) {
+	results := make([]*PrewarmResult, len(prefixes))
+	errs := make([]error, len(prefixes))
 
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbPutMempoolTxnWithTxn(txn, mempoolTx)
-	})
+	var waitGroup sync.WaitGroup
+	for ii, prewarmPrefix := range prefixes {
+		waitGroup.Add(1)
+		go func(ii int, prewarmPrefix *PrewarmPrefix) {
+			defer waitGroup.Done()
+			results[ii], errs[ii] = _prewarmPrefix(db, prewarmPrefix)
+		}(ii, prewarmPrefix)
+	}
+	waitGroup.Wait()
+
+	for ii, err := range errs {
+		if err != nil {
+			return nil, errors.Wrapf(err, "PrewarmCaches: Problem reading %v", prefixes[ii].Name)
+		}
+	}
+	return results, nil
 }
 
-func DbGetMempoolTxnWithTxn(txn *badger.Txn, mempoolTx *MempoolTx) *MsgBitCloutTxn {
+func _prewarmPrefix(db *badger.DB, prewarmPrefix *PrewarmPrefix) (*PrewarmResult, error) {
+	result := &PrewarmResult{Name: prewarmPrefix.Name}
+	startTime := time.Now()
 
-	mempoolTxnObj := &MsgBitCloutTxn{}
-	mempoolTxnItem, err := txn.Get(_dbKeyForMempoolTxn(mempoolTx))
-	if err != nil {
+	err := DbView(db, func(txn KVTxn) error {
+		opts := KVIteratorOptions{}
+		opts.Prefix = prewarmPrefix.Prefix
+		opts.Reverse = prewarmPrefix.Reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		seekKey := prewarmPrefix.Prefix
+		if prewarmPrefix.Reverse {
+			// A reverse iterator seeks to the largest key that is <= the key
+			// passed so seek to just past everything under the prefix.
+			seekKey = _dbKeyUpperBound(prewarmPrefix.Prefix)
+			if seekKey == nil {
+				seekKey = append(append([]byte{}, prewarmPrefix.Prefix...), bytes.Repeat([]byte{0xFF}, 256)...)
+			}
+		}
+		for it.Seek(seekKey); it.ValidForPrefix(prewarmPrefix.Prefix); it.Next() {
+			if prewarmPrefix.MaxKeys != 0 && result.KeysRead >= prewarmPrefix.MaxKeys {
+				break
+			}
+			valBytes, err := it.Value()
+			if err != nil {
+				return err
+			}
+			result.KeysRead++
+			result.BytesRead += len(it.Key()) + len(valBytes)
+			if prewarmPrefix.OnEntry != nil {
+				if err := prewarmPrefix.OnEntry(txn, it.Key(), valBytes); err != nil {
+					return err
+				}
+			}
+		}
 		return nil
-	}
-	err = mempoolTxnItem.Value(func(valBytes []byte) error {
-		return gob.NewDecoder(bytes.NewReader(valBytes)).Decode(mempoolTxnObj)
 	})
 	if err != nil {
-		glog.Errorf("DbGetMempoolTxnWithTxn: Problem reading "+
-			"Tx for tx hash %s: %v", mempoolTx.Hash.String(), err)
-		return nil
+		return nil, _wrapDbError(err, "_prewarmPrefix")
 	}
-	return mempoolTxnObj
-}
 
-func DbGetMempoolTxn(db *badger.DB, mempoolTx *MempoolTx) *MsgBitCloutTxn {
-	var ret *MsgBitCloutTxn
-	db.View(func(txn *badger.Txn) error {
-		ret = DbGetMempoolTxnWithTxn(txn, mempoolTx)
-		return nil
-	})
-	return ret
+	result.Duration = time.Since(startTime)
+	return result, nil
 }
 
-func DbGetAllMempoolTxnsSortedByTimeAdded(handle *badger.DB) (_mempoolTxns []*MsgBitCloutTxn, _error error) {
-	_, valuesFound := _enumerateKeysForPrefix(handle, _PrefixMempoolTxnHashToMsgBitCloutTxn)
+// =====================================================================================
+// Retention policy code
+// =====================================================================================
 
-	mempoolTxns := []*MsgBitCloutTxn{}
-	for _, mempoolTxnBytes := range valuesFound {
-		mempoolTxn := &MsgBitCloutTxn{}
-		err := mempoolTxn.FromBytes(mempoolTxnBytes)
-		if err != nil {
-			return nil, errors.Wrapf(err, "DbGetAllMempoolTxnsSortedByTimeAdded: failed to decode mempoolTxnBytes.")
-		}
-		mempoolTxns = append(mempoolTxns, mempoolTxn)
-	}
+type DbRetentionPolicyType uint8
 
-	// We don't need to sort the transactions because the DB keys include the time added and
-	// are therefore retrieved from badger in order.
+const (
+	DbRetentionKeepForever DbRetentionPolicyType = 0
+	DbRetentionKeepDays    DbRetentionPolicyType = 1
+	DbRetentionKeepBlocks  DbRetentionPolicyType = 2
+)
 
-	return mempoolTxns, nil
+// DbRetentionPolicy says how long the keys under a prefix should be kept around.
+// N is the number of days or blocks, depending on the Type.
+type DbRetentionPolicy struct {
+	Type DbRetentionPolicyType
+	N    uint64
 }
 
-func DbDeleteAllMempoolTxnsWithTxn(txn *badger.Txn) error {
-	txnKeysFound, _, err := _enumerateKeysForPrefixWithTxn(txn, _PrefixMempoolTxnHashToMsgBitCloutTxn)
+// ParseDbRetentionPolicy parses a policy of the form "forever", "days:<N>", or
+// "blocks:<N>".
+func ParseDbRetentionPolicy(policyStr string) (*DbRetentionPolicy, error) {
+	if policyStr == "forever" {
+		return &DbRetentionPolicy{Type: DbRetentionKeepForever}, nil
+	}
+
+	parts := strings.Split(policyStr, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("ParseDbRetentionPolicy: Policy %s must be one "+
+			"of forever, days:<N>, or blocks:<N>", policyStr)
+	}
+	nn, err := strconv.ParseUint(parts[1], 10, 64)
 	if err != nil {
-		return errors.Wrapf(err, "DbDeleteAllMempoolTxnsWithTxn: ")
+		return nil, errors.Wrapf(err, "ParseDbRetentionPolicy: Problem parsing "+
+			"N for policy %s", policyStr)
+	}
+	// Keeping zero days or blocks would delete data for the tip, which for
+	// things like utxo operations would leave the chain unable to disconnect it.
+	if nn == 0 {
+		return nil, fmt.Errorf("ParseDbRetentionPolicy: N must be positive for "+
+			"policy %s", policyStr)
 	}
 
-	for _, txnKey := range txnKeysFound {
-		err := DbDeleteMempoolTxnKeyWithTxn(txn, txnKey)
-		if err != nil {
-			return errors.Wrapf(err, "DbDeleteAllMempoolTxMappings: Deleting mempool txnKey failed.")
-		}
+	switch parts[0] {
+	case "days":
+		return &DbRetentionPolicy{Type: DbRetentionKeepDays, N: nn}, nil
+	case "blocks":
+		return &DbRetentionPolicy{Type: DbRetentionKeepBlocks, N: nn}, nil
+	default:
+		return nil, fmt.Errorf("ParseDbRetentionPolicy: Unknown policy type %s "+
+			"in policy %s", parts[0], policyStr)
 	}
+}
 
+// CheckRetentionKeepBlocks returns an error if keepBlocks is below the fewest
+// blocks that a blocks policy can keep, which is the finality depth. Dropping the
+// history of blocks that aren't final yet would leave the node unable to process
+// the reorgs it's expected to handle.
+func CheckRetentionKeepBlocks(params *BitCloutParams, keepBlocks uint64) error {
+	if keepBlocks < params.FinalityDepthBlocks {
+		return fmt.Errorf("CheckRetentionKeepBlocks: Must keep at least %d blocks "+
+			"but was asked to keep %d", params.FinalityDepthBlocks, keepBlocks)
+	}
 	return nil
 }
 
-func FlushMempoolToDbWithTxn(txn *badger.Txn, allTxns []*MempoolTx) error {
-	for _, mempoolTx := range allTxns {
-		err := DbPutMempoolTxnWithTxn(txn, mempoolTx)
+// DbRetentionIndex describes a prefix that a retention policy can be applied to.
+// Exactly one of TstampNanosForKey or HeightForKey should be set, depending on
+// whether the index has a time or a height component.
+//
+// Indexes with an entry per block also set SweptHeightKey and
+// DeleteForBlockWithTxn. A blocks policy on one of them walks the block index up
+// from the height stored under SweptHeightKey rather than scanning the prefix.
+// See _dbSweepBlockIndex.
+type DbRetentionIndex struct {
+	Name   string
+	Prefix []byte
+
+	TstampNanosForKey func(txn KVTxn, key []byte) (_tstampNanos uint64, _ok bool)
+	HeightForKey      func(txn KVTxn, key []byte) (_height uint64, _ok bool)
+
+	SweptHeightKey        []byte
+	DeleteForBlockWithTxn func(txn KVTxn, blockHash *BlockHash) error
+}
+
+// DbRetentionIndexes are all the indexes that a retention policy can be set for.
+// Prefixes not in this list are always kept forever.
+var DbRetentionIndexes = []*DbRetentionIndex{
+	{
+		// <prefix, block hash>. Sweeping a block prunes its body and its utxo
+		// operations. See db_prune.go.
+		Name:           "blocks",
+		Prefix:         _PrefixBlockHashToBlock,
+		SweptHeightKey: _KeyPruneHeight,
+		DeleteForBlockWithTxn: func(txn KVTxn, blockHash *BlockHash) error {
+			if err := DeleteBlockWithTxn(txn, blockHash); err != nil {
+				return err
+			}
+			return DeleteUtxoOperationsForBlockWithTxn(txn, blockHash)
+		},
+	},
+	{
+		// <prefix, public key, tstampNanos>
+		Name:   "faucet-public-keys",
+		Prefix: _PrefixPublicKeyTimestampToFaucetDisbursement,
+		TstampNanosForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixPublicKeyTimestampToFaucetDisbursement)+btcec.PubKeyBytesLenCompressed+8 {
+				return 0, false
+			}
+			return DecodeUint64(key[len(key)-8:]), true
+		},
+	},
+	{
+		// <prefix, ip hash, tstampNanos>
+		Name:   "faucet-ip-hashes",
+		Prefix: _PrefixIPHashTimestampToFaucetDisbursement,
+		TstampNanosForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixIPHashTimestampToFaucetDisbursement)+32+8 {
+				return 0, false
+			}
+			return DecodeUint64(key[len(key)-8:]), true
+		},
+	},
+	{
+		// <prefix, smaller public key, larger public key, tstampNanos>
+		Name:   "conversations",
+		Prefix: _PrefixPublicKeyPairTimestampToPrivateMessage,
+		TstampNanosForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixPublicKeyPairTimestampToPrivateMessage)+2*btcec.PubKeyBytesLenCompressed+8 {
+				return 0, false
+			}
+			return DecodeUint64(key[len(key)-8:]), true
+		},
+	},
+	{
+		// <prefix, public key, tstampNanos>
+		Name:   "private-messages",
+		Prefix: _PrefixPublicKeyTimestampToPrivateMessage,
+		TstampNanosForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixPublicKeyTimestampToPrivateMessage)+btcec.PubKeyBytesLenCompressed+8 {
+				return 0, false
+			}
+			return DecodeUint64(key[len(key)-8:]), true
+		},
+	},
+	{
+		// <prefix, block hash>. The utxo operations are what allow a block to be
+		// disconnected so keeping N blocks means reorgs deeper than N will fail.
+		// This is also the policy the node's UtxoOpsRetention applies as blocks
+		// are connected.
+		Name:                  "utxo-ops",
+		Prefix:                _PrefixBlockHashToUtxoOperations,
+		SweptHeightKey:        _KeyUtxoOpsDeletedBelowHeight,
+		DeleteForBlockWithTxn: DeleteUtxoOperationsForBlockWithTxn,
+		HeightForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixBlockHashToUtxoOperations)+HashSizeBytes {
+				return 0, false
+			}
+			blockHash := &BlockHash{}
+			copy(blockHash[:], key[len(_PrefixBlockHashToUtxoOperations):])
+			block := GetBlockWithTxn(txn, blockHash)
+			if block == nil {
+				return 0, false
+			}
+			return block.Header.Height, true
+		},
+	},
+	{
+		// <prefix, txid, output index>. The height is when the utxo was spent.
+		Name:   "utxo-spends",
+		Prefix: _PrefixUtxoKeyToUtxoSpendEntry,
+		HeightForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixUtxoKeyToUtxoSpendEntry)+HashSizeBytes+4 {
+				return 0, false
+			}
+			utxoKey := &UtxoKey{}
+			copy(utxoKey.TxID[:], key[len(_PrefixUtxoKeyToUtxoSpendEntry):])
+			utxoKey.Index = DecodeUint32(key[len(key)-4:])
+			spendEntry := DbGetUtxoSpendEntryWithTxn(txn, utxoKey)
+			if spendEntry == nil {
+				return 0, false
+			}
+			return spendEntry.SpendHeight, true
+		},
+	},
+	{
+		// <prefix, day, txn type>
+		Name:   "txn-daily-stats",
+		Prefix: _PrefixDayTxnTypeToTxnDailyStats,
+		TstampNanosForKey: func(txn KVTxn, key []byte) (uint64, bool) {
+			if len(key) != len(_PrefixDayTxnTypeToTxnDailyStats)+8+1 {
+				return 0, false
+			}
+			day := DecodeUint64(key[len(_PrefixDayTxnTypeToTxnDailyStats) : len(key)-1])
+			return uint64(time.Duration(day) * 24 * time.Hour), true
+		},
+	},
+}
+
+// ParseDbRetentionPolicies parses a list of "<index name>=<policy>" strings into a
+// map from index name to policy. Every index name must be in DbRetentionIndexes
+// and every blocks policy must pass CheckRetentionKeepBlocks.
+func ParseDbRetentionPolicies(policyStrs []string, params *BitCloutParams) (map[string]*DbRetentionPolicy, error) {
+	policies := make(map[string]*DbRetentionPolicy)
+	for _, policyStr := range policyStrs {
+		parts := strings.SplitN(policyStr, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("ParseDbRetentionPolicies: %s must be of the "+
+				"form <index name>=<policy>", policyStr)
+		}
+		indexFound := false
+		for _, retentionIndex := range DbRetentionIndexes {
+			if retentionIndex.Name == parts[0] {
+				indexFound = true
+				break
+			}
+		}
+		if !indexFound {
+			return nil, fmt.Errorf("ParseDbRetentionPolicies: Unknown index %s", parts[0])
+		}
+		policy, err := ParseDbRetentionPolicy(parts[1])
 		if err != nil {
-			return errors.Wrapf(err, "FlushMempoolToDb: Putting "+
-				"mempool tx hash %s failed.", mempoolTx.Hash.String())
+			return nil, err
+		}
+		if policy.Type == DbRetentionKeepBlocks {
+			if err := CheckRetentionKeepBlocks(params, policy.N); err != nil {
+				return nil, errors.Wrapf(err, "ParseDbRetentionPolicies: Policy "+
+					"for index %s", parts[0])
+			}
 		}
+		policies[parts[0]] = policy
 	}
-
-	return nil
+	return policies, nil
 }
 
-func FlushMempoolToDb(handle *badger.DB, allTxns []*MempoolTx) error {
-	err := handle.Update(func(txn *badger.Txn) error {
-		return FlushMempoolToDbWithTxn(txn, allTxns)
-	})
-	if err != nil {
-		return err
-	}
+// _isExpired returns true if the key should be deleted under the policy.
+func (policy *DbRetentionPolicy) _isExpired(
+	txn KVTxn, retentionIndex *DbRetentionIndex, key []byte,
+	tipHeight uint64, now time.Time) bool {
 
-	return nil
+	switch policy.Type {
+	case DbRetentionKeepDays:
+		if retentionIndex.TstampNanosForKey == nil {
+			return false
+		}
+		tstampNanos, ok := retentionIndex.TstampNanosForKey(txn, key)
+		if !ok {
+			return false
+		}
+		cutoff := now.Add(-time.Duration(policy.N) * 24 * time.Hour)
+		return int64(tstampNanos) < cutoff.UnixNano()
+	case DbRetentionKeepBlocks:
+		if retentionIndex.HeightForKey == nil {
+			return false
+		}
+		height, ok := retentionIndex.HeightForKey(txn, key)
+		if !ok {
+			return false
+		}
+		return height+policy.N <= tipHeight
+	default:
+		return false
+	}
 }
 
-func DbDeleteAllMempoolTxns(handle *badger.DB) error {
-	handle.Update(func(txn *badger.Txn) error {
-		return DbDeleteAllMempoolTxnsWithTxn(txn)
-	})
+// _dbForEachExpiredKeyBatch scans the index and calls handleBatch with the keys
+// that have expired under the policy, a batch at a time so a large sweep doesn't
+// exceed the max txn size. handleBatch is expected to remove the keys from the db.
+func _dbForEachExpiredKeyBatch(handle *badger.DB, retentionIndex *DbRetentionIndex,
+	policy *DbRetentionPolicy, tipHeight uint64, now time.Time,
+	handleBatch func(keys [][]byte) error) error {
 
-	return nil
+	maxKeysPerBatch := 1000
+
+	var lastKey []byte
+	for {
+		var expiredKeys [][]byte
+		var reachedEnd bool
+		err := DbView(handle, func(txn KVTxn) error {
+			opts := KVIteratorOptions{}
+			opts.KeysOnly = true
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			startKey := retentionIndex.Prefix
+			if lastKey != nil {
+				startKey = lastKey
+			}
+			numSeen := 0
+			for it.Seek(startKey); it.ValidForPrefix(retentionIndex.Prefix); it.Next() {
+				key := append([]byte{}, it.Key()...)
+				if lastKey != nil && bytes.Equal(key, lastKey) {
+					continue
+				}
+				numSeen++
+				lastKey = key
+				if policy._isExpired(txn, retentionIndex, key, tipHeight, now) {
+					expiredKeys = append(expiredKeys, key)
+				}
+				if numSeen >= maxKeysPerBatch {
+					return nil
+				}
+			}
+			reachedEnd = true
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Problem scanning index %s", retentionIndex.Name)
+		}
+
+		if len(expiredKeys) > 0 {
+			if err := handleBatch(expiredKeys); err != nil {
+				return err
+			}
+		}
+
+		if reachedEnd {
+			return nil
+		}
+	}
 }
 
-func DbDeleteMempoolTxnWithTxn(txn *badger.Txn, mempoolTx *MempoolTx) error {
+// DbRetentionSweep deletes every key that has expired under its index's policy and
+// returns the number of keys deleted for each index, or the number of blocks swept
+// for an index with an entry per block. Indexes without a policy are kept forever.
+// A policy that doesn't match the index, like keeping N blocks of an index that
+// only has a time component, keeps everything.
+func DbRetentionSweep(handle *badger.DB, policies map[string]*DbRetentionPolicy,
+	tipHeight uint64, now time.Time) (_numDeletedForIndex map[string]uint64, _err error) {
 
-	// When a mapping exists, delete it.
-	if err := txn.Delete(_dbKeyForMempoolTxn(mempoolTx)); err != nil {
-		return errors.Wrapf(err, "DbDeleteMempoolTxMappingWithTxn: Deleting "+
-			"mempool tx key failed.")
+	numDeletedForIndex := make(map[string]uint64)
+	for _, retentionIndex := range DbRetentionIndexes {
+		policy, exists := policies[retentionIndex.Name]
+		if !exists || policy.Type == DbRetentionKeepForever {
+			continue
+		}
+
+		if retentionIndex.SweptHeightKey != nil {
+			if policy.Type != DbRetentionKeepBlocks {
+				continue
+			}
+			numSwept, err := _dbSweepBlockIndex(handle, retentionIndex, policy.N, tipHeight)
+			numDeletedForIndex[retentionIndex.Name] += numSwept
+			if err != nil {
+				return nil, errors.Wrapf(err, "DbRetentionSweep: ")
+			}
+			continue
+		}
+
+		err := _dbForEachExpiredKeyBatch(handle, retentionIndex, policy, tipHeight, now, func(keys [][]byte) error {
+			err := DbUpdate(handle, func(txn KVTxn) error {
+				for _, key := range keys {
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "Problem deleting keys for index %s", retentionIndex.Name)
+			}
+			numDeletedForIndex[retentionIndex.Name] += uint64(len(keys))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "DbRetentionSweep: ")
+		}
 	}
 
-	return nil
+	return numDeletedForIndex, nil
 }
 
-func DbDeleteMempoolTxn(handle *badger.DB, mempoolTx *MempoolTx) error {
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbDeleteMempoolTxnWithTxn(txn, mempoolTx)
-	})
-}
+// StartDbRetentionSweeper periodically applies the retention policies to the db
+// until the lifecycle is stopped. The tipHeight function is used to get the
+// current height of the best chain.
+func StartDbRetentionSweeper(lifecycle *CoreDBLifecycle, policies map[string]*DbRetentionPolicy,
+	tipHeight func() uint64, interval time.Duration) error {
 
-func DbDeleteMempoolTxnKey(handle *badger.DB, txnKey []byte) error {
-	return handle.Update(func(txn *badger.Txn) error {
-		return DbDeleteMempoolTxnKeyWithTxn(txn, txnKey)
+	return lifecycle.GoPeriodic("retention-sweeper", interval, func() {
+		numDeletedForIndex, err := DbRetentionSweep(lifecycle.DB(), policies, tipHeight(), time.Now())
+		if err != nil {
+			glog.Errorf("StartDbRetentionSweeper: Problem sweeping db: %v", err)
+		} else {
+			glog.Infof("StartDbRetentionSweeper: Deleted keys per index: %v", numDeletedForIndex)
+		}
 	})
 }
 
-func DbDeleteMempoolTxnKeyWithTxn(txn *badger.Txn, txnKey []byte) error {
+// UtxoOpsRetention says how long the utxo operations of connected blocks are kept.
+// It's a blocks policy on the utxo-ops retention index that's applied as blocks
+// are connected rather than by the sweeper. Either way, a block whose utxo
+// operations are gone can't be disconnected so reorgs past it will fail.
+type UtxoOpsRetention uint8
 
-	// When a mapping exists, delete it.
-	if err := txn.Delete(txnKey); err != nil {
-		return errors.Wrapf(err, "DbDeleteMempoolTxMappingWithTxn: Deleting "+
-			"mempool tx key failed.")
+const (
+	UtxoOpsRetentionKeepAll               UtxoOpsRetention = 0
+	UtxoOpsRetentionKeepLastN             UtxoOpsRetention = 1
+	UtxoOpsRetentionKeepNoneAfterFinality UtxoOpsRetention = 2
+)
+
+// ParseUtxoOpsRetention parses a retention of the form "keep-all", "keep-last:<N>",
+// or "keep-none-after-finality" and returns it along with N. N must pass
+// CheckRetentionKeepBlocks.
+func ParseUtxoOpsRetention(retentionStr string, params *BitCloutParams) (
+	_retention UtxoOpsRetention, _nn uint64, _err error) {
+
+	switch retentionStr {
+	case "", "keep-all":
+		return UtxoOpsRetentionKeepAll, 0, nil
+	case "keep-none-after-finality":
+		return UtxoOpsRetentionKeepNoneAfterFinality, 0, nil
 	}
 
-	return nil
+	parts := strings.Split(retentionStr, ":")
+	if len(parts) != 2 || parts[0] != "keep-last" {
+		return 0, 0, fmt.Errorf("ParseUtxoOpsRetention: Retention %s must be one "+
+			"of keep-all, keep-last:<N>, or keep-none-after-finality", retentionStr)
+	}
+	nn, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "ParseUtxoOpsRetention: Problem parsing "+
+			"N for retention %s", retentionStr)
+	}
+	if err := CheckRetentionKeepBlocks(params, nn); err != nil {
+		return 0, 0, errors.Wrapf(err, "ParseUtxoOpsRetention: Retention %s", retentionStr)
+	}
+	return UtxoOpsRetentionKeepLastN, nn, nil
 }
 
-func LogDBSummarySnapshot(db *badger.DB) {
-	keyCountMap := make(map[byte]int)
-	for prefixByte := byte(0); prefixByte < byte(40); prefixByte++ {
-		keysForPrefix, _ := EnumerateKeysForPrefix(db, []byte{prefixByte})
-		keyCountMap[prefixByte] = len(keysForPrefix)
-	}
-	glog.Info(spew.Printf("LogDBSummarySnapshot: Current DB summary snapshot: %v", keyCountMap))
+func DbGetUtxoOpsDeletedBelowHeight(handle *badger.DB) uint64 {
+	var deletedBelowHeight uint64
+	DbView(handle, func(txn KVTxn) error {
+		deletedBelowHeight = _dbGetSweptHeightWithTxn(txn, _KeyUtxoOpsDeletedBelowHeight)
+		return nil
+	})
+	return deletedBelowHeight
 }
 
-func StartDBSummarySnapshots(db *badger.DB) {
-	// Periodically count the number of keys for each prefix in the DB and log.
-	go func() {
-		for {
-			// Figure out how many keys there are for each prefix and log.
-			glog.Info("StartDBSummarySnapshots: Counting DB keys...")
-			LogDBSummarySnapshot(db)
-			time.Sleep(30 * time.Second)
-		}
-	}()
+func StartDBSummarySnapshots(lifecycle *CoreDBLifecycle) error {
+	// Periodically count the number of keys for each prefix in the DB and log
+	// until the lifecycle is stopped.
+	return lifecycle.GoPeriodic("summary-snapshots", 30*time.Second, func() {
+		// Figure out how many keys there are for each prefix and log.
+		glog.Info("StartDBSummarySnapshots: Counting DB keys...")
+		LogDBSummarySnapshot(lifecycle.DB())
+	})
 }
@@ -1,8 +1,15 @@
 package lib
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/big"
 	"os"
 	"testing"
@@ -192,9 +199,3643 @@ func TestInitDbWithGenesisBlock(t *testing.T) {
 	require.NoError(err)
 	require.Len(bestChain, 1)
 	require.Equal(genesis, bestChain[0])
+
+	// The freshly-initialized tip should pass the consistency check.
+	require.NoError(VerifyTipConsistency(db))
+
+	// There should be a successful report for every seed txn.
+	reports, err := DbGetSeedTxnReports(db)
+	require.NoError(err)
+	require.Len(reports, len(BitCloutTestnetParams.SeedTxns))
+	for ii, report := range reports {
+		require.Equal(uint32(ii), report.TxnIndex)
+		require.NotNil(report.TxnHash)
+		require.Empty(report.Error)
+	}
+}
+
+func TestGetBlockSummary(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	require.NoError(InitDbWithBitCloutGenesisBlock(&BitCloutTestnetParams, db))
+
+	_, err := GetBlockSummary(db, nil, &BlockHash{})
+	require.Error(err)
+
+	genesisHash := NewBlockHash(BitCloutTestnetParams.GenesisBlockHashHex)
+	summary, err := GetBlockSummary(db, nil, genesisHash)
+	require.NoError(err)
+	assert.Equal(genesisHash, summary.BlockHash)
+	assert.Equal(uint64(0), summary.Header.Height)
+	require.Len(summary.Txns, len(BitCloutTestnetParams.GenesisBlock.Txns))
+	for ii, summaryTxn := range summary.Txns {
+		assert.Equal(BitCloutTestnetParams.GenesisBlock.Txns[ii].Hash(), summaryTxn.TxnHash)
+		assert.Nil(summaryTxn.TxnMeta)
+	}
+	assert.Equal(uint64(0), summary.TotalFeeNanos)
+}
+
+func TestResetIncompleteGenesisInit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Simulate an initialization that stopped after the genesis block was
+	// stored but before the best hash was set.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_KeyGenesisInitInProgress, []byte{})
+	}))
+	require.NoError(PutBlock(BitCloutTestnetParams.GenesisBlock, db))
+	require.NoError(DbPutSeedTxnReports(db, []*SeedTxnReport{
+		{TxnIndex: 0, Error: "seed txn failed"},
+	}))
+	nodeIdentity, err := DbGetOrCreateNodeIdentity(db)
+	require.NoError(err)
+	require.True(DbGenesisInitIncomplete(db))
+	require.Nil(DbGetBestHash(db, ChainTypeBitCloutBlock))
+
+	// The partial state should be wiped, except for the report explaining
+	// what went wrong and the node-local data.
+	wasReset, err := DbResetIncompleteGenesisInit(db)
+	require.NoError(err)
+	require.True(wasReset)
+	require.False(DbGenesisInitIncomplete(db))
+	_, err = GetBlock(NewBlockHash(BitCloutTestnetParams.GenesisBlockHashHex), db)
+	require.Error(err)
+	reports, err := DbGetSeedTxnReports(db)
+	require.NoError(err)
+	require.Len(reports, 1)
+	require.Equal("seed txn failed", reports[0].Error)
+	sameNodeIdentity, err := DbGetOrCreateNodeIdentity(db)
+	require.NoError(err)
+	require.Equal(nodeIdentity.Serialize(), sameNodeIdentity.Serialize())
+
+	// A full initialization should leave no marker behind.
+	require.NoError(InitDbWithBitCloutGenesisBlock(&BitCloutTestnetParams, db))
+	require.False(DbGenesisInitIncomplete(db))
+	require.NotNil(DbGetBestHash(db, ChainTypeBitCloutBlock))
+
+	// Resetting a fully-initialized db is a no-op.
+	wasReset, err = DbResetIncompleteGenesisInit(db)
+	require.NoError(err)
+	require.False(wasReset)
+	require.NotNil(DbGetBestHash(db, ChainTypeBitCloutBlock))
+}
+
+func TestExplainPaginatedKeysAndValuesForPrefix(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	prefix := []byte{0xf0, 0xff}
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for ii := byte(0); ii < 5; ii++ {
+			if err := txn.Set(append(append([]byte{}, prefix...), ii), []byte{ii, ii}); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte{0xf1}, []byte{})
+	}))
+
+	// An unbounded scan walks the whole prefix.
+	keys, _, explanation, err := DBExplainPaginatedKeysAndValuesForPrefix(
+		db, prefix, prefix, 3, 0, false, true)
+	require.NoError(err)
+	assert.Equal(5, len(keys))
+	assert.Equal(&DBScanExplanation{
+		KeysVisited:     5,
+		BytesRead:       5 * (3 + 2),
+		ExhaustedPrefix: true,
+	}, explanation)
+
+	// A bounded reverse scan that stops early doesn't exhaust the prefix.
+	keys, vals, explanation, err := DBExplainPaginatedKeysAndValuesForPrefix(
+		db, prefix, prefix, 3, 2, true, false)
+	require.NoError(err)
+	assert.Equal([][]byte{{0xf0, 0xff, 4}, {0xf0, 0xff, 3}}, keys)
+	assert.Equal([][]byte{nil, nil}, vals)
+	assert.Equal(&DBScanExplanation{
+		KeysVisited: 2,
+		BytesRead:   2 * 3,
+		Reverse:     true,
+		Bounded:     true,
+	}, explanation)
+
+	// A limit that lines up with the end of the prefix still exhausts it.
+	keys, _, explanation, err = DBExplainPaginatedKeysAndValuesForPrefix(
+		db, append(append([]byte{}, prefix...), 3), prefix, 3, 2, false, false)
+	require.NoError(err)
+	assert.Equal(2, len(keys))
+	assert.True(explanation.Bounded)
+	assert.True(explanation.SeekedIntoPrefix)
+	assert.True(explanation.ExhaustedPrefix)
+
+	// The explain mode returns the same results as the regular call.
+	expectedKeys, expectedVals, err := DBGetPaginatedKeysAndValuesForPrefix(
+		db, prefix, prefix, 3, 0, true, true)
+	require.NoError(err)
+	keys, vals, _, err = DBExplainPaginatedKeysAndValuesForPrefix(
+		db, prefix, prefix, 3, 0, true, true)
+	require.NoError(err)
+	assert.Equal(expectedKeys, keys)
+	assert.Equal(expectedVals, vals)
+}
+
+func TestDedupedBlocks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	requireBlockEqual := func(expected *MsgBitCloutBlock, blockHash *BlockHash) {
+		block, err := GetBlock(blockHash, db)
+		require.NoError(err)
+		expectedBytes, err := expected.ToBytes(false)
+		require.NoError(err)
+		blockBytes, err := block.ToBytes(false)
+		require.NoError(err)
+		require.Equal(expectedBytes, blockBytes)
+		require.NoError(DbView(db, func(txn KVTxn) error {
+			blockBytes, err := GetBlockWithTxn(txn, blockHash).ToBytes(false)
+			require.NoError(err)
+			require.Equal(expectedBytes, blockBytes)
+			return nil
+		}))
+	}
+	numBlocksForTxn := func(txnHash *BlockHash) uint64 {
+		var numBlocks uint64
+		require.NoError(DbView(db, func(txn KVTxn) error {
+			_, numBlocks, _ = _dbGetBlockTxnWithTxn(txn, txnHash)
+			return nil
+		}))
+		return numBlocks
+	}
+
+	// Two blocks on competing forks that share a txn.
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{DedupeBlockTxns: true}))
+	blockA := expectedBlock
+	headerB := *expectedBlockHeader
+	headerB.Nonce++
+	blockB := &MsgBitCloutBlock{
+		Header: &headerB,
+		Txns:   []*MsgBitCloutTxn{expectedBlock.Txns[0], {TxnMeta: &BasicTransferMetadata{}}},
+	}
+	hashA, err := blockA.Header.Hash()
+	require.NoError(err)
+	hashB, err := blockB.Header.Hash()
+	require.NoError(err)
+	require.NoError(PutBlock(blockA, db))
+	require.NoError(PutBlock(blockB, db))
+	// Storing a block again is a no-op.
+	require.NoError(PutBlock(blockA, db))
+
+	requireBlockEqual(blockA, hashA)
+	requireBlockEqual(blockB, hashB)
+	sharedTxnHash := blockA.Txns[0].Hash()
+	assert.Equal(uint64(2), numBlocksForTxn(sharedTxnHash))
+	assert.Equal(uint64(1), numBlocksForTxn(blockA.Txns[1].Hash()))
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		_, err := txn.Get(BlockHashToBlockKey(hashA))
+		assert.Equal(ErrKVKeyNotFound, err)
+		return nil
+	}))
+
+	// Txns can be fetched without their block.
+	sharedTxn := DbGetBlockTxn(db, sharedTxnHash)
+	require.NotNil(sharedTxn)
+	assert.Equal(sharedTxnHash, sharedTxn.Hash())
+	assert.Nil(DbGetBlockTxn(db, &BlockHash{1}))
+
+	// Deleting a block keeps the txns the other block still needs.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DeleteBlockWithTxn(txn, hashA)
+	}))
+	_, err = GetBlock(hashA, db)
+	assert.True(errors.Is(err, ErrEntryNotFound))
+	assert.Equal(uint64(1), numBlocksForTxn(sharedTxnHash))
+	assert.Nil(DbGetBlockTxn(db, blockA.Txns[1].Hash()))
+	requireBlockEqual(blockB, hashB)
+
+	// Blocks stored without deduping can still be read and deleted.
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{}))
+	require.NoError(PutBlock(blockA, db))
+	requireBlockEqual(blockA, hashA)
+	assert.Equal(uint64(1), numBlocksForTxn(sharedTxnHash))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DeleteBlockWithTxn(txn, hashA)
+	}))
+	_, err = GetBlock(hashA, db)
+	assert.True(errors.Is(err, ErrEntryNotFound))
+	requireBlockEqual(blockB, hashB)
+}
+
+func TestTypedDbErrors(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Missing entries.
+	_, err := GetBlock(&BlockHash{1}, db)
+	assert.True(errors.Is(err, ErrEntryNotFound))
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		_, err := GetUtxoOperationsForBlockWithTxn(txn, &BlockHash{1})
+		assert.True(errors.Is(err, ErrEntryNotFound))
+		return nil
+	}))
+
+	// Values that can't be decoded.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_DbKeyForUtxoOps(&BlockHash{2}), []byte{1, 2, 3})
+	}))
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		_, err := GetUtxoOperationsForBlockWithTxn(txn, &BlockHash{2})
+		assert.True(errors.Is(err, ErrEntryCorrupt))
+		assert.False(errors.Is(err, ErrEntryNotFound))
+		return nil
+	}))
+	postBytes := _DbBufForPostEntry(&PostEntry{PostHash: &BlockHash{3}})
+	err = _DbDecodePostEntry(postBytes[:len(postBytes)-1], &PostEntry{})
+	assert.True(errors.Is(err, ErrEntryCorrupt))
+	err = _DbDecodePostEntry(append(append([]byte{}, postBytes...), 0), &PostEntry{})
+	assert.True(errors.Is(err, ErrEntryCorrupt))
+
+	// A closed db.
+	require.NoError(db.Close())
+	_, err = GetBlock(&BlockHash{1}, db)
+	assert.True(errors.Is(err, ErrDBClosed))
+	_, _, err = DBGetPaginatedKeysAndValuesForPrefix(db, []byte{0xf0}, []byte{0xf0}, 0, 0, false, false)
+	assert.True(errors.Is(err, ErrDBClosed))
+}
+
+func TestPrewarmCaches(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	prefixA := []byte{0xf0}
+	prefixB := []byte{0xf1}
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for ii := byte(0); ii < 5; ii++ {
+			if err := txn.Set([]byte{0xf0, ii}, []byte{ii}); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte{0xf1, ii}, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	seenKeys := [][]byte{}
+	results, err := PrewarmCaches(db, []*PrewarmPrefix{
+		{Name: "a", Prefix: prefixA},
+		{
+			Name:    "b",
+			Prefix:  prefixB,
+			Reverse: true,
+			MaxKeys: 2,
+			OnEntry: func(txn KVTxn, key []byte, val []byte) error {
+				seenKeys = append(seenKeys, append([]byte{}, key...))
+				return nil
+			},
+		},
+	})
+	require.NoError(err)
+	require.Equal(2, len(results))
+	assert.Equal("a", results[0].Name)
+	assert.Equal(5, results[0].KeysRead)
+	assert.Equal(5*3, results[0].BytesRead)
+	assert.Equal("b", results[1].Name)
+	assert.Equal(2, results[1].KeysRead)
+	// The newest keys are read first.
+	assert.Equal([][]byte{{0xf1, 4}, {0xf1, 3}}, seenKeys)
+
+	// Errors from OnEntry stop the prewarm.
+	_, err = PrewarmCaches(db, []*PrewarmPrefix{{
+		Name:   "a",
+		Prefix: prefixA,
+		OnEntry: func(txn KVTxn, key []byte, val []byte) error {
+			return errors.New("stop")
+		},
+	}})
+	require.Error(err)
+
+	// The default prefixes work on an empty chain.
+	_, err = PrewarmCaches(db, DefaultPrewarmPrefixes(10, 10))
+	require.NoError(err)
+}
+
+func TestDBIterator(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Keys under the prefix are surrounded by keys that aren't.
+	prefix := []byte{0xf0, 0xff}
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for ii := byte(0); ii < 5; ii++ {
+			if err := txn.Set(append(append([]byte{}, prefix...), ii), []byte{ii}); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte{0xf0, 0xfe}, []byte{}); err != nil {
+			return err
+		}
+		return txn.Set([]byte{0xf1}, []byte{})
+	}))
+
+	readPage := func(reverse bool, cursor string, pageSize int) (_vals []byte, _cursor string) {
+		it := NewDBIterator(db, prefix, reverse, true)
+		defer it.Close()
+		require.NoError(it.Resume(cursor))
+		vals := []byte{}
+		for ii := 0; ii < pageSize && it.Next(); ii++ {
+			vals = append(vals, it.Value()[0])
+		}
+		require.NoError(it.Err())
+		return vals, it.Cursor()
+	}
+
+	// Page through in both directions.
+	vals, cursor := readPage(false, "", 2)
+	assert.Equal([]byte{0, 1}, vals)
+	vals, cursor = readPage(false, cursor, 2)
+	assert.Equal([]byte{2, 3}, vals)
+	vals, _ = readPage(false, cursor, 2)
+	assert.Equal([]byte{4}, vals)
+
+	vals, cursor = readPage(true, "", 3)
+	assert.Equal([]byte{4, 3, 2}, vals)
+	// Resuming still works if the entry the cursor points at was deleted.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(append(append([]byte{}, prefix...), 2))
+	}))
+	vals, _ = readPage(true, cursor, 3)
+	assert.Equal([]byte{1, 0}, vals)
+
+	// Seek in both directions.
+	{
+		it := NewDBIterator(db, prefix, false, false)
+		it.Seek(append(append([]byte{}, prefix...), 3))
+		require.True(it.Next())
+		assert.Equal(append(append([]byte{}, prefix...), 3), it.Key())
+		assert.Nil(it.Value())
+		it.Close()
+
+		it = NewDBIterator(db, prefix, true, false)
+		it.Seek(append(append([]byte{}, prefix...), 1))
+		require.True(it.Next())
+		assert.Equal(append(append([]byte{}, prefix...), 1), it.Key())
+		require.True(it.Next())
+		require.False(it.Next())
+		assert.Equal("", it.Cursor())
+		it.Close()
+	}
+
+	// Cursors for other prefixes are rejected.
+	it := NewDBIterator(db, prefix, false, false)
+	defer it.Close()
+	require.Error(it.Resume("f1"))
+	require.Error(it.Resume("zz"))
+}
+
+func TestCrashBreadcrumb(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	assert.Nil(DbGetCrashBreadcrumb(db))
+
+	blockHash := &BlockHash{1}
+	require.NoError(DbPutCrashBreadcrumb(db, CrashBreadcrumbPhaseConnectBlock, blockHash))
+	breadcrumb := DbGetCrashBreadcrumb(db)
+	require.NotNil(breadcrumb)
+	assert.Equal(CrashBreadcrumbPhaseConnectBlock, breadcrumb.Phase)
+	assert.Equal(blockHash, breadcrumb.BlockHash)
+	assert.NotZero(breadcrumb.StartTstampNanos)
+
+	require.NoError(DbDeleteCrashBreadcrumb(db))
+	assert.Nil(DbGetCrashBreadcrumb(db))
+
+	// A successful flush leaves no breadcrumb behind.
+	require.NoError(InitDbWithBitCloutGenesisBlock(&BitCloutTestnetParams, db))
+	utxoView, err := NewUtxoView(db, &BitCloutTestnetParams, nil)
+	require.NoError(err)
+	require.NoError(utxoView.FlushToDb())
+	assert.Nil(DbGetCrashBreadcrumb(db))
+}
+
+func TestEnumerateKeysForPrefixWithCallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for ii := byte(0); ii < 5; ii++ {
+			if err := txn.Set([]byte{0xf0, ii}, []byte{ii + 10}); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte{0xf1}, []byte{})
+	}))
+
+	keys := [][]byte{}
+	vals := []byte{}
+	require.NoError(EnumerateKeysForPrefixWithCallback(db, []byte{0xf0}, func(key []byte, val []byte) (bool, error) {
+		keys = append(keys, append([]byte{}, key...))
+		vals = append(vals, val[0])
+		return true, nil
+	}))
+	assert.Equal([][]byte{{0xf0, 0}, {0xf0, 1}, {0xf0, 2}, {0xf0, 3}, {0xf0, 4}}, keys)
+	assert.Equal([]byte{10, 11, 12, 13, 14}, vals)
+
+	// Stop early.
+	numSeen := 0
+	require.NoError(EnumerateKeysForPrefixWithCallback(db, []byte{0xf0}, func(key []byte, val []byte) (bool, error) {
+		numSeen++
+		return numSeen < 2, nil
+	}))
+	assert.Equal(2, numSeen)
+
+	// Errors from the callback are returned.
+	err := EnumerateKeysForPrefixWithCallback(db, []byte{0xf0}, func(key []byte, val []byte) (bool, error) {
+		return true, errors.New("stop")
+	})
+	require.Error(err)
+}
+
+func TestDBSamplePrefix(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for ii := byte(0); ii < 100; ii++ {
+			if err := txn.Set([]byte{0xf0, ii}, []byte{ii}); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte{0xf1}, []byte{})
+	}))
+
+	// The same seed gives the same sample, in key order, with matching values.
+	keys, vals, err := DBSamplePrefix(db, []byte{0xf0}, 10, 42)
+	require.NoError(err)
+	require.Equal(10, len(keys))
+	for ii := range keys {
+		assert.Equal([]byte{0xf0}, keys[ii][:1])
+		assert.Equal(keys[ii][1:], vals[ii])
+		if ii > 0 {
+			assert.True(bytes.Compare(keys[ii-1], keys[ii]) < 0)
+		}
+	}
+	sameKeys, sameVals, err := DBSamplePrefix(db, []byte{0xf0}, 10, 42)
+	require.NoError(err)
+	assert.Equal(keys, sameKeys)
+	assert.Equal(vals, sameVals)
+
+	// A different seed picks a different sample.
+	otherKeys, _, err := DBSamplePrefix(db, []byte{0xf0}, 10, 43)
+	require.NoError(err)
+	assert.NotEqual(keys, otherKeys)
+
+	// Asking for more than there are returns everything.
+	keys, _, err = DBSamplePrefix(db, []byte{0xf0}, 1000, 42)
+	require.NoError(err)
+	assert.Equal(100, len(keys))
+
+	keys, _, err = DBSamplePrefix(db, []byte{0xf0}, 0, 42)
+	require.NoError(err)
+	assert.Equal(0, len(keys))
+}
+
+func TestDBParallelScanPrefix(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Use keys that look like public keys, which all start with 0x02 or 0x03,
+	// so the shards have to split past the first byte.
+	numKeys := 1000
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for ii := 0; ii < numKeys; ii++ {
+			key := []byte{0xf0, byte(2 + ii%2)}
+			key = append(key, RandomBytes(32)...)
+			if err := txn.Set(key, []byte{byte(ii)}); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte{0xf1}, []byte{})
+	}))
+
+	for _, numShards := range []int{1, 4, 0, 1000} {
+		count, err := DBParallelCountPrefix(db, []byte{0xf0}, numShards)
+		require.NoError(err)
+		assert.Equal(uint64(numKeys), count)
+	}
+
+	// Each shard sees its keys in order and the shards are in key order.
+	shardKeys := make([][][]byte, DBScanShardCount(8))
+	require.NoError(DBParallelScanPrefix(db, []byte{0xf0}, 8, func(shardIndex int, key []byte, _ []byte) error {
+		shardKeys[shardIndex] = append(shardKeys[shardIndex], append([]byte{}, key...))
+		return nil
+	}))
+	allKeys := [][]byte{}
+	numNonEmptyShards := 0
+	for _, keys := range shardKeys {
+		if len(keys) > 0 {
+			numNonEmptyShards++
+		}
+		allKeys = append(allKeys, keys...)
+	}
+	assert.Equal(8, numNonEmptyShards)
+	require.Equal(numKeys, len(allKeys))
+	for ii := 1; ii < len(allKeys); ii++ {
+		assert.True(bytes.Compare(allKeys[ii-1], allKeys[ii]) < 0)
+	}
+
+	// The first error stops the scan and is returned.
+	err := DBParallelScanPrefix(db, []byte{0xf0}, 4, func(_ int, _ []byte, _ []byte) error {
+		return errors.New("stop")
+	})
+	require.Error(err)
+	assert.Contains(err.Error(), "stop")
+
+	// An empty prefix range is fine.
+	count, err := DBParallelCountPrefix(db, []byte{0xf2}, 4)
+	require.NoError(err)
+	assert.Equal(uint64(0), count)
+}
+
+func TestIndexMigration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Move keys from <0xf0, id> to <0xf1, id>.
+	migration := &DbIndexMigration{
+		Name:      "test",
+		OldPrefix: []byte{0xf0},
+		NewPrefix: []byte{0xf1},
+		ConvertKey: func(oldKey []byte) ([]byte, error) {
+			return append([]byte{0xf1}, oldKey[1:]...), nil
+		},
+	}
+	oldKey := func(id byte) []byte { return []byte{0xf0, id} }
+	newKey := func(id byte) []byte { return []byte{0xf1, id} }
+	get := func(id byte) []byte {
+		var val []byte
+		DbView(db, func(txn KVTxn) error {
+			val = migration.GetWithTxn(txn, oldKey(id), newKey(id))
+			return nil
+		})
+		return val
+	}
+	set := func(id byte, val []byte) {
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return migration.SetWithTxn(txn, oldKey(id), newKey(id), val)
+		}))
+	}
+
+	// Before the migration starts, only the old prefix is written.
+	set(1, []byte("one"))
+	keys, _ := EnumerateKeysForPrefix(db, migration.NewPrefix)
+	require.Len(keys, 0)
+	require.Equal([]byte("one"), get(1))
+
+	// Once dual-writing, new entries go to both prefixes and old entries are
+	// still readable.
+	require.NoError(migration.StartDualWrite(db))
+	set(2, []byte("two"))
+	keys, _ = EnumerateKeysForPrefix(db, migration.OldPrefix)
+	require.Len(keys, 2)
+	keys, _ = EnumerateKeysForPrefix(db, migration.NewPrefix)
+	require.Len(keys, 1)
+	require.Equal([]byte("one"), get(1))
+
+	// Finalizing before the backfill is done should fail.
+	require.Error(migration.Finalize(db))
+
+	// The backfill copies the remaining entries over.
+	require.NoError(migration.Backfill(db))
+	require.Equal(IndexMigrationStateBackfillComplete, DbGetIndexMigrationState(db, migration.Name))
+	keys, _ = EnumerateKeysForPrefix(db, migration.NewPrefix)
+	require.Len(keys, 2)
+
+	// Finalizing drops the old prefix and reads keep working.
+	require.NoError(migration.Finalize(db))
+	require.Equal(IndexMigrationStateFinalized, DbGetIndexMigrationState(db, migration.Name))
+	keys, _ = EnumerateKeysForPrefix(db, migration.OldPrefix)
+	require.Len(keys, 0)
+	require.Equal([]byte("one"), get(1))
+	require.Equal([]byte("two"), get(2))
+}
+
+func TestIndexMigrationBackfillDoesNotResurrectDeletes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Delete entry 2 through the dual-write path after the backfill has
+	// enumerated the old prefix but before it copies the entry over.
+	oldKey := func(id byte) []byte { return []byte{0xf0, id} }
+	newKey := func(id byte) []byte { return []byte{0xf1, id} }
+	var migration *DbIndexMigration
+	deleted := false
+	migration = &DbIndexMigration{
+		Name:      "test",
+		OldPrefix: []byte{0xf0},
+		NewPrefix: []byte{0xf1},
+		ConvertKey: func(key []byte) ([]byte, error) {
+			if !deleted {
+				deleted = true
+				require.NoError(DbUpdate(db, func(txn KVTxn) error {
+					return migration.DeleteWithTxn(txn, oldKey(2), newKey(2))
+				}))
+			}
+			return append([]byte{0xf1}, key[1:]...), nil
+		},
+	}
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for _, id := range []byte{1, 2, 3} {
+			if err := migration.SetWithTxn(txn, oldKey(id), newKey(id), []byte{id}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(migration.StartDualWrite(db))
+
+	// The delete lands after the backfill's txn started so it may have to be
+	// run again.
+	if err := migration.Backfill(db); err != nil {
+		require.True(errors.Is(err, badger.ErrConflict))
+		require.NoError(migration.Backfill(db))
+	}
+	require.True(deleted)
+
+	keys, _ := EnumerateKeysForPrefix(db, migration.NewPrefix)
+	require.Equal([][]byte{newKey(1), newKey(3)}, keys)
+}
+
+func TestRetentionSweep(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	_, err := ParseDbRetentionPolicies([]string{"private-messages=days:0"}, &BitCloutTestnetParams)
+	require.Error(err)
+	_, err = ParseDbRetentionPolicies([]string{"not-an-index=days:1"}, &BitCloutTestnetParams)
+	require.Error(err)
+	_, err = ParseDbRetentionPolicies([]string{"private-messages=weeks:1"}, &BitCloutTestnetParams)
+	require.Error(err)
+	// Blocks policies can't keep fewer blocks than the finality depth.
+	_, err = ParseDbRetentionPolicies([]string{"utxo-ops=blocks:1"}, &BitCloutTestnetParams)
+	require.Error(err)
+
+	priv1, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk1 := priv1.PubKey().SerializeCompressed()
+	priv2, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk2 := priv2.PubKey().SerializeCompressed()
+
+	now := time.Now()
+	oldTstamp := uint64(now.Add(-10 * 24 * time.Hour).UnixNano())
+	newTstamp := uint64(now.Add(-1 * time.Hour).UnixNano())
+	for _, tstamp := range []uint64{oldTstamp, newTstamp} {
+		require.NoError(DbPutMessageEntry(
+			db, &MessageEntry{
+				SenderPublicKey:    pk1,
+				TstampNanos:        tstamp,
+				RecipientPublicKey: pk2,
+				EncryptedText:      []byte("message"),
+			}))
+	}
+
+	// Without a policy nothing is deleted.
+	numDeleted, err := DbRetentionSweep(db, map[string]*DbRetentionPolicy{}, 0, now)
+	require.NoError(err)
+	assert.Equal(0, len(numDeleted))
+
+	// Keeping 7 days of messages deletes the old message for both the sender
+	// and the recipient.
+	policies, err := ParseDbRetentionPolicies([]string{"private-messages=days:7"}, &BitCloutTestnetParams)
+	require.NoError(err)
+	numDeleted, err = DbRetentionSweep(db, policies, 0, now)
+	require.NoError(err)
+	assert.Equal(uint64(2), numDeleted["private-messages"])
+
+	messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
+	require.NoError(err)
+	require.Equal(1, len(messages))
+	assert.Equal(newTstamp, messages[0].TstampNanos)
+
+	// A blocks policy doesn't apply to an index with only a time component.
+	policies, err = ParseDbRetentionPolicies([]string{fmt.Sprintf(
+		"private-messages=blocks:%d", BitCloutTestnetParams.FinalityDepthBlocks)}, &BitCloutTestnetParams)
+	require.NoError(err)
+	numDeleted, err = DbRetentionSweep(db, policies, 1000, now.Add(100*24*time.Hour))
+	require.NoError(err)
+	assert.Equal(uint64(0), numDeleted["private-messages"])
+}
+
+func TestScheduledPostTxns(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	newPostTxn := func(body string) *MsgBitCloutTxn {
+		postTxn := &MsgBitCloutTxn{
+			PublicKey: priv.PubKey().SerializeCompressed(),
+			TxnMeta: &SubmitPostMetadata{
+				Body: []byte(body),
+			},
+		}
+		postTxn.Signature, err = postTxn.Sign(priv)
+		require.NoError(err)
+		return postTxn
+	}
+
+	// Unsigned txns and txns that aren't posts can't be scheduled.
+	_, err = DbPutScheduledPostTxn(db, 1, &MsgBitCloutTxn{TxnMeta: &SubmitPostMetadata{}})
+	require.Error(err)
+	_, err = DbPutScheduledPostTxn(db, 1, &MsgBitCloutTxn{TxnMeta: &BasicTransferMetadata{}})
+	require.Error(err)
+
+	hash1, err := DbPutScheduledPostTxn(db, 200, newPostTxn("later"))
+	require.NoError(err)
+	hash2, err := DbPutScheduledPostTxn(db, 100, newPostTxn("sooner"))
+	require.NoError(err)
+
+	// Posts come back sorted by publish time.
+	allPosts, err := DbGetScheduledPostTxns(db, math.MaxUint64)
+	require.NoError(err)
+	require.Equal(2, len(allPosts))
+	assert.Equal(*hash2, *allPosts[0].DraftHash)
+	assert.Equal(*hash1, *allPosts[1].DraftHash)
+	assert.Equal(*hash1, *allPosts[1].Txn.Hash())
+
+	duePosts, err := DbGetScheduledPostTxns(db, 150)
+	require.NoError(err)
+	require.Equal(1, len(duePosts))
+	assert.Equal(*hash2, *duePosts[0].DraftHash)
+
+	// Moving the later post before the cutoff makes it due.
+	require.NoError(DbRescheduleScheduledPostTxn(db, 200, hash1, 50))
+	duePosts, err = DbGetScheduledPostTxns(db, 150)
+	require.NoError(err)
+	require.Equal(2, len(duePosts))
+	assert.Equal(*hash1, *duePosts[0].DraftHash)
+
+	require.NoError(DbDeleteScheduledPostTxn(db, 50, hash1))
+	allPosts, err = DbGetScheduledPostTxns(db, math.MaxUint64)
+	require.NoError(err)
+	require.Equal(1, len(allPosts))
+	assert.Equal(*hash2, *allPosts[0].DraftHash)
+}
+
+func TestLocalContent(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	priv1, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk1 := priv1.PubKey().SerializeCompressed()
+	priv2, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk2 := priv2.PubKey().SerializeCompressed()
+
+	require.Error(DbPutLocalContent(db, pk1[:10], "drafts", []byte("a"), []byte("x")))
+	require.Error(DbPutLocalContent(db, pk1, "", []byte("a"), []byte("x")))
+
+	require.NoError(DbPutLocalContent(db, pk1, "drafts", []byte("b"), []byte("draft b")))
+	require.NoError(DbPutLocalContent(db, pk1, "drafts", []byte("a"), []byte("draft a")))
+	require.NoError(DbPutLocalContent(db, pk1, "bookmarks", []byte("a"), []byte("bookmark a")))
+	require.NoError(DbPutLocalContent(db, pk2, "drafts", []byte("a"), []byte("other draft")))
+
+	entry := DbGetLocalContent(db, pk1, "drafts", []byte("a"))
+	require.NotNil(entry)
+	assert.Equal([]byte("draft a"), entry.Value)
+	assert.Nil(DbGetLocalContent(db, pk1, "drafts", []byte("c")))
+
+	// Listing is scoped to the public key and namespace and sorted by key.
+	entries, err := DbListLocalContent(db, pk1, "drafts")
+	require.NoError(err)
+	require.Equal(2, len(entries))
+	assert.Equal([]byte("a"), entries[0].Key)
+	assert.Equal([]byte("b"), entries[1].Key)
+
+	require.NoError(DbDeleteLocalContent(db, pk1, "drafts", []byte("a")))
+	entries, err = DbListLocalContent(db, pk1, "drafts")
+	require.NoError(err)
+	require.Equal(1, len(entries))
+	assert.Equal([]byte("draft b"), entries[0].Value)
+
+	assert.True(IsLocalOnlyDbKey(_dbKeyForLocalContent(pk1, "drafts", []byte("b"))))
+	assert.False(IsLocalOnlyDbKey(_dbKeyForMessageEntry(pk1, 1)))
+}
+
+func TestDbPrefixRegistry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	require.NoError(_checkDbPrefixRegistry(DbPrefixRegistry))
+
+	// Two prefixes sharing an ID, or one being a prefix of another, should fail.
+	require.Error(_checkDbPrefixRegistry([]*DbPrefixInfo{
+		{"a", []byte{1}, ""},
+		{"b", []byte{1}, ""},
+	}))
+	require.Error(_checkDbPrefixRegistry([]*DbPrefixInfo{
+		{"a", []byte{1}, ""},
+		{"b", []byte{1, 2}, ""},
+	}))
+	require.Error(_checkDbPrefixRegistry([]*DbPrefixInfo{
+		{"a", []byte{}, ""},
+	}))
+
+	prefixInfo := GetDbPrefixInfoForKey(_dbKeyForPostEntryHash(&BlockHash{}))
+	require.NotNil(prefixInfo)
+	assert.Equal("PostHashToPostEntry", prefixInfo.Name)
+	assert.Nil(GetDbPrefixInfoForKey([]byte{255}))
+}
+
+func TestUtxoSpendEntries(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	spentKey := &UtxoKey{TxID: BlockHash{1}, Index: 2}
+	unspentKey := &UtxoKey{TxID: BlockHash{1}, Index: 3}
+	spendingTxn := &MsgBitCloutTxn{
+		TxInputs: []*BitCloutInput{(*BitCloutInput)(spentKey)},
+		TxnMeta:  &BasicTransferMetadata{},
+	}
+	block := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{Height: 7},
+		Txns:   []*MsgBitCloutTxn{spendingTxn},
+	}
+
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbPutUtxoSpendEntriesForBlockWithTxn(txn, block)
+	}))
+	spendEntry := DbGetUtxoSpendEntry(db, spentKey)
+	require.NotNil(spendEntry)
+	assert.Equal(spentKey.TxID, *spendEntry.CreatingTxID)
+	assert.Equal(spendingTxn.Hash(), spendEntry.SpendingTxID)
+	assert.Equal(uint64(7), spendEntry.SpendHeight)
+	assert.Nil(DbGetUtxoSpendEntry(db, unspentKey))
+
+	// Disconnecting the block makes the utxo unspent again.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbDeleteUtxoSpendEntriesForBlockWithTxn(txn, block)
+	}))
+	assert.Nil(DbGetUtxoSpendEntry(db, spentKey))
+}
+
+func TestNotifications(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+	postHash := &BlockHash{9}
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:        postHash,
+		PosterPublicKey: pkB,
+		Body:            []byte("post"),
+	}, &BitCloutTestnetParams))
+
+	transferTxn := &MsgBitCloutTxn{
+		TxOutputs: []*BitCloutOutput{{PublicKey: pkB, AmountNanos: 5}, {PublicKey: pkA, AmountNanos: 1}},
+		TxnMeta:   &BasicTransferMetadata{},
+		PublicKey: pkA,
+	}
+	likeTxn := &MsgBitCloutTxn{
+		TxnMeta:   &LikeMetadata{LikedPostHash: postHash},
+		PublicKey: pkA,
+	}
+	unfollowTxn := &MsgBitCloutTxn{
+		TxnMeta:   &FollowMetadata{FollowedPublicKey: pkB, IsUnfollow: true},
+		PublicKey: pkA,
+	}
+	messageTxn := &MsgBitCloutTxn{
+		TxnMeta:   &PrivateMessageMetadata{RecipientPublicKey: pkA, TimestampNanos: 1},
+		PublicKey: pkB,
+	}
+	block1 := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{Height: 1, TstampSecs: 10},
+		Txns:   []*MsgBitCloutTxn{transferTxn, likeTxn, unfollowTxn, messageTxn},
+	}
+	followTxn := &MsgBitCloutTxn{
+		TxnMeta:   &FollowMetadata{FollowedPublicKey: pkB},
+		PublicKey: pkA,
+	}
+	block2 := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{Height: 2, TstampSecs: 20},
+		Txns:   []*MsgBitCloutTxn{followTxn},
+	}
+	for _, block := range []*MsgBitCloutBlock{block1, block2} {
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return DbPutNotificationsForBlockWithTxn(txn, block)
+		}))
+	}
+
+	// B hears about the follow, the like, and the transfer but not the unfollow
+	// or its own message. Newest come first.
+	notifications, err := DbGetNotificationsForPKID(db, PublicKeyToPKID(pkB), 0, 0, nil)
+	require.NoError(err)
+	require.Equal(3, len(notifications))
+	assert.Equal(NotificationTypeFollow, notifications[0].Type)
+	assert.Equal(uint64(20e9), notifications[0].TstampNanos)
+	assert.Equal(followTxn.Hash(), notifications[0].TxID)
+	assert.Equal(pkA, notifications[0].ActorPublicKey)
+	assert.Equal(uint64(10e9), notifications[1].TstampNanos)
+	assert.Equal(uint64(10e9), notifications[2].TstampNanos)
+
+	// A doesn't hear about its own change output.
+	notifications, err = DbGetNotificationsForPKID(db, PublicKeyToPKID(pkA), 0, 0, nil)
+	require.NoError(err)
+	require.Equal(1, len(notifications))
+	assert.Equal(NotificationTypePrivateMessage, notifications[0].Type)
+	assert.Equal(pkB, notifications[0].ActorPublicKey)
+
+	// Filtering by type.
+	notifications, err = DbGetNotificationsForPKID(db, PublicKeyToPKID(pkB), 0, 0,
+		[]NotificationType{NotificationTypeLike, NotificationTypeBasicTransfer})
+	require.NoError(err)
+	require.Equal(2, len(notifications))
+	for _, notification := range notifications {
+		if notification.Type == NotificationTypeLike {
+			assert.Equal(postHash, notification.PostHash)
+		} else {
+			assert.Equal(NotificationTypeBasicTransfer, notification.Type)
+			assert.Equal(uint64(5), notification.AmountNanos)
+		}
+	}
+
+	// Paging picks up right before the tstamp passed.
+	notifications, err = DbGetNotificationsForPKID(db, PublicKeyToPKID(pkB), 1, 0, nil)
+	require.NoError(err)
+	require.Equal(1, len(notifications))
+	notifications, err = DbGetNotificationsForPKID(db, PublicKeyToPKID(pkB), 0, notifications[0].TstampNanos, nil)
+	require.NoError(err)
+	assert.Equal(2, len(notifications))
+
+	// Disconnecting a block removes exactly its notifications.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbDeleteNotificationsForBlockWithTxn(txn, block1)
+	}))
+	notifications, err = DbGetNotificationsForPKID(db, PublicKeyToPKID(pkB), 0, 0, nil)
+	require.NoError(err)
+	require.Equal(1, len(notifications))
+	assert.Equal(NotificationTypeFollow, notifications[0].Type)
+	notifications, err = DbGetNotificationsForPKID(db, PublicKeyToPKID(pkA), 0, 0, nil)
+	require.NoError(err)
+	assert.Equal(0, len(notifications))
+}
+
+func TestDiamondTimeIndex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+	pkC := append([]byte{2}, bytes.Repeat([]byte{3}, 32)...)
+	postHash := &BlockHash{9}
+	diamondTxn := func(sender []byte, diamondLevel int64) *MsgBitCloutTxn {
+		return &MsgBitCloutTxn{
+			TxnMeta: &CreatorCoinTransferMetadataa{
+				ProfilePublicKey:           sender,
+				ReceiverPublicKey:          pkB,
+				CreatorCoinToTransferNanos: 1,
+			},
+			PublicKey: sender,
+			ExtraData: map[string][]byte{
+				DiamondPostHashKey: postHash[:],
+				DiamondLevelKey:    IntToBuf(diamondLevel),
+			},
+		}
+	}
+	plainTransferTxn := &MsgBitCloutTxn{
+		TxnMeta: &CreatorCoinTransferMetadataa{
+			ProfilePublicKey:           pkA,
+			ReceiverPublicKey:          pkB,
+			CreatorCoinToTransferNanos: 1,
+		},
+		PublicKey: pkA,
+	}
+	block1 := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{Height: 1, TstampSecs: 10},
+		Txns:   []*MsgBitCloutTxn{diamondTxn(pkA, 1), plainTransferTxn},
+	}
+	block2 := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{Height: 2, TstampSecs: 20},
+		Txns:   []*MsgBitCloutTxn{diamondTxn(pkC, 2), diamondTxn(pkA, 3)},
+	}
+	for _, block := range []*MsgBitCloutBlock{block1, block2} {
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return DbPutDiamondTimeIndexForBlockWithTxn(txn, block)
+		}))
+	}
+
+	// B received every diamond, including A's upgrade, newest first. The plain
+	// transfer isn't a diamond.
+	diamonds, err := DbGetRecentDiamondsReceived(db, PublicKeyToPKID(pkB), 0, 0)
+	require.NoError(err)
+	require.Equal(3, len(diamonds))
+	assert.Equal(uint64(20e9), diamonds[0].TstampNanos)
+	assert.Equal(uint64(20e9), diamonds[1].TstampNanos)
+	assert.Equal(uint64(10e9), diamonds[2].TstampNanos)
+	assert.Equal(PublicKeyToPKID(pkA), diamonds[2].DiamondEntry.SenderPKID)
+	assert.Equal(PublicKeyToPKID(pkB), diamonds[2].DiamondEntry.ReceiverPKID)
+	assert.Equal(postHash, diamonds[2].DiamondEntry.DiamondPostHash)
+	assert.Equal(int64(1), diamonds[2].DiamondEntry.DiamondLevel)
+
+	// Nobody gave A a diamond.
+	diamonds, err = DbGetRecentDiamondsReceived(db, PublicKeyToPKID(pkA), 0, 0)
+	require.NoError(err)
+	assert.Equal(0, len(diamonds))
+
+	// Paging picks up right before the tstamp passed.
+	diamonds, err = DbGetRecentDiamondsReceived(db, PublicKeyToPKID(pkB), 2, 0)
+	require.NoError(err)
+	require.Equal(2, len(diamonds))
+	diamonds, err = DbGetRecentDiamondsReceived(db, PublicKeyToPKID(pkB), 0, diamonds[1].TstampNanos)
+	require.NoError(err)
+	require.Equal(1, len(diamonds))
+	assert.Equal(uint64(10e9), diamonds[0].TstampNanos)
+
+	// Disconnecting a block removes exactly its diamonds.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbDeleteDiamondTimeIndexForBlockWithTxn(txn, block2)
+	}))
+	diamonds, err = DbGetRecentDiamondsReceived(db, PublicKeyToPKID(pkB), 0, 0)
+	require.NoError(err)
+	require.Equal(1, len(diamonds))
+	assert.Equal(uint64(10e9), diamonds[0].TstampNanos)
+}
+
+func TestVerifyBlockConservation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pk := []byte{2}
+	spentKey := &UtxoKey{TxID: BlockHash{1}, Index: 0}
+	transferTxn := &MsgBitCloutTxn{
+		TxInputs:  []*BitCloutInput{(*BitCloutInput)(spentKey)},
+		TxOutputs: []*BitCloutOutput{{PublicKey: pk, AmountNanos: 90}},
+		TxnMeta:   &BasicTransferMetadata{},
+		PublicKey: pk,
+	}
+	rewardTxn := &MsgBitCloutTxn{
+		TxOutputs: []*BitCloutOutput{{PublicKey: pk, AmountNanos: CalcBlockRewardNanos(1) + 10}},
+		TxnMeta:   &BlockRewardMetadataa{ExtraData: []byte{}},
+		PublicKey: pk,
+	}
+	block := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{
+			Version:               1,
+			PrevBlockHash:         &BlockHash{},
+			TransactionMerkleRoot: &BlockHash{},
+			Height:                1,
+		},
+		Txns: []*MsgBitCloutTxn{rewardTxn, transferTxn},
+	}
+	blockHash, err := block.Header.Hash()
+	require.NoError(err)
+
+	putBlock := func(rewardNanos uint64) {
+		utxoOps := [][]*UtxoOperation{
+			{{
+				Type: OperationTypeAddUtxo,
+				Entry: &UtxoEntry{
+					AmountNanos: rewardNanos,
+					UtxoType:    UtxoTypeBlockReward,
+				},
+			}},
+			{{
+				Type:  OperationTypeSpendUtxo,
+				Key:   spentKey,
+				Entry: &UtxoEntry{AmountNanos: 100, UtxoType: UtxoTypeOutput},
+			}, {
+				Type:  OperationTypeAddUtxo,
+				Entry: &UtxoEntry{AmountNanos: 90, UtxoType: UtxoTypeOutput},
+			}},
+		}
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			if err := PutBlockWithTxn(txn, block); err != nil {
+				return err
+			}
+			return PutUtxoOperationsForBlockWithTxn(txn, blockHash, utxoOps)
+		}))
+	}
+
+	// The transfer pays a fee of 10 which the block reward collects.
+	putBlock(CalcBlockRewardNanos(1) + 10)
+	report, err := VerifyBlockConservation(db, &BitCloutTestnetParams, blockHash)
+	require.NoError(err)
+	assert.Equal(uint64(100), report.TotalInputNanos)
+	assert.Equal(CalcBlockRewardNanos(1)+100, report.TotalOutputNanos)
+	assert.Equal(CalcBlockRewardNanos(1)+10, report.BlockRewardNanos)
+	assert.Equal(uint64(10), report.MaxTotalFeeNanos)
+
+	// A block reward that collects more than the fees is caught.
+	putBlock(CalcBlockRewardNanos(1) + 11)
+	_, err = VerifyBlockConservation(db, &BitCloutTestnetParams, blockHash)
+	require.Error(err)
+
+	// Unknown blocks are errors.
+	_, err = VerifyBlockConservation(db, &BitCloutTestnetParams, &BlockHash{})
+	require.Error(err)
+}
+
+func TestForkStates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	params := &BitCloutParams{
+		ProtocolForks: []ProtocolFork{
+			{Name: "past", ActivationHeight: 1},
+			{Name: "future", ActivationHeight: 2},
+		},
+	}
+	bestChain := []*BlockNode{{Hash: &BlockHash{0}}, {Hash: &BlockHash{1}}}
+	require.NoError(DbInitForkStates(db, params, bestChain))
+
+	pastFork := DbGetForkState(db, "past")
+	require.NotNil(pastFork)
+	assert.Equal(&BlockHash{1}, pastFork.ActivationBlockHash)
+	futureFork := DbGetForkState(db, "future")
+	require.NotNil(futureFork)
+	assert.Nil(futureFork.ActivationBlockHash)
+
+	isActive, err := DbIsForkActive(db, "future", 1)
+	require.NoError(err)
+	assert.False(isActive)
+	isActive, err = DbIsForkActive(db, "future", 2)
+	require.NoError(err)
+	assert.True(isActive)
+	_, err = DbIsForkActive(db, "unknown", 2)
+	require.Error(err)
+
+	// Connecting the block at the activation height records it and counts its signal.
+	block := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{
+			Version:               1,
+			PrevBlockHash:         &BlockHash{1},
+			TransactionMerkleRoot: &BlockHash{},
+			Height:                2,
+		},
+		Txns: []*MsgBitCloutTxn{{
+			TxnMeta: &BlockRewardMetadataa{ExtraData: []byte(ForkSignalPrefix + "past")},
+		}},
+	}
+	blockHash, err := block.Header.Hash()
+	require.NoError(err)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbUpdateForkStatesForBlockWithTxn(txn, block, true /*isConnect*/)
+	}))
+	assert.Equal(uint64(1), DbGetForkState(db, "past").SignalCount)
+	assert.Equal(blockHash, DbGetForkState(db, "future").ActivationBlockHash)
+	assert.Equal(uint64(0), DbGetForkState(db, "future").SignalCount)
+
+	// Re-initializing keeps the signal counts.
+	require.NoError(DbInitForkStates(db, params, bestChain))
+	assert.Equal(uint64(1), DbGetForkState(db, "past").SignalCount)
+
+	// Disconnecting undoes everything.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbUpdateForkStatesForBlockWithTxn(txn, block, false /*isConnect*/)
+	}))
+	assert.Equal(uint64(0), DbGetForkState(db, "past").SignalCount)
+	assert.Nil(DbGetForkState(db, "future").ActivationBlockHash)
+
+	// The founder reward forks are registered on every network.
+	forkStates, err := DbGetForkStates(db)
+	require.NoError(err)
+	require.Len(forkStates, 4)
+	assert.Equal(ForkNameBitCloutFounderReward, forkStates[0].Name)
+	assert.Equal("future", forkStates[1].Name)
+	assert.Equal("past", forkStates[2].Name)
+	assert.Equal(ForkNameSalomonFix, forkStates[3].Name)
+}
+
+func TestForkSignalBackfill(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Put a main chain whose blocks signal before the forks are in the db.
+	pk := []byte{2}
+	bestChain := []*BlockNode{{Hash: &BlockHash{0}}}
+	for ii, extraData := range []string{"fork:past", "fork:pastry, fork:future", "miner:past"} {
+		block := &MsgBitCloutBlock{
+			Header: &MsgBitCloutHeader{
+				Version:               1,
+				PrevBlockHash:         bestChain[ii].Hash,
+				TransactionMerkleRoot: &BlockHash{},
+				Height:                uint64(ii + 1),
+			},
+			Txns: []*MsgBitCloutTxn{{
+				TxOutputs: []*BitCloutOutput{{PublicKey: pk, AmountNanos: 1}},
+				TxnMeta:   &BlockRewardMetadataa{ExtraData: []byte(extraData)},
+				PublicKey: pk,
+			}},
+		}
+		blockHash, err := block.Header.Hash()
+		require.NoError(err)
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return PutBlockWithTxn(txn, block)
+		}))
+		bestChain = append(bestChain, &BlockNode{Hash: blockHash, Height: uint32(ii + 1)})
+	}
+	// Blocks that were pruned are skipped.
+	bestChain = append(bestChain, &BlockNode{Hash: &BlockHash{4}, Height: 4})
+
+	// Signals only count when they match exactly.
+	params := &BitCloutParams{
+		ProtocolForks: []ProtocolFork{
+			{Name: "past", ActivationHeight: 1},
+			{Name: "future", ActivationHeight: 10},
+		},
+	}
+	require.NoError(DbInitForkStates(db, params, bestChain))
+	assert.Equal(uint64(1), DbGetForkState(db, "past").SignalCount)
+	assert.True(DbGetForkState(db, "past").SignalsBackfilled)
+	assert.Equal(uint64(1), DbGetForkState(db, "future").SignalCount)
+
+	// The counts aren't backfilled again on the next start.
+	require.NoError(DbInitForkStates(db, params, bestChain[:1]))
+	assert.Equal(uint64(1), DbGetForkState(db, "past").SignalCount)
+	assert.Equal(uint64(1), DbGetForkState(db, "future").SignalCount)
+
+	// Signals for forks that aren't in the params are counted as blocks are
+	// connected, so a fork added later starts with them without rescanning the
+	// chain.
+	block := &MsgBitCloutBlock{
+		Header: &MsgBitCloutHeader{
+			Version:               1,
+			PrevBlockHash:         bestChain[3].Hash,
+			TransactionMerkleRoot: &BlockHash{},
+			Height:                4,
+		},
+		Txns: []*MsgBitCloutTxn{{
+			TxnMeta: &BlockRewardMetadataa{ExtraData: []byte("fork:later,fork:later,fork:")},
+		}},
+	}
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbUpdateForkStatesForBlockWithTxn(txn, block, true /*isConnect*/)
+	}))
+	params.ProtocolForks = append(params.ProtocolForks,
+		ProtocolFork{Name: "pastry", ActivationHeight: 10},
+		ProtocolFork{Name: "later", ActivationHeight: 10})
+	require.NoError(DbInitForkStates(db, params, bestChain[:1]))
+	assert.Equal(uint64(1), DbGetForkState(db, "pastry").SignalCount)
+	assert.Equal(uint64(1), DbGetForkState(db, "later").SignalCount)
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		assert.Equal(uint64(0), DbGetForkSignalCountWithTxn(txn, ""))
+		return nil
+	}))
+
+	// Disconnecting the block uncounts its signals.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbUpdateForkStatesForBlockWithTxn(txn, block, false /*isConnect*/)
+	}))
+	assert.Equal(uint64(0), DbGetForkState(db, "later").SignalCount)
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		assert.Equal(uint64(0), DbGetForkSignalCountWithTxn(txn, "later"))
+		assert.Equal(uint64(1), DbGetForkSignalCountWithTxn(txn, "pastry"))
+		return nil
+	}))
+}
+
+func TestBackfillConversationIndex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+	messageEntry := &MessageEntry{
+		SenderPublicKey:    pk1,
+		RecipientPublicKey: pk2,
+		EncryptedText:      []byte("message"),
+		TstampNanos:        1,
+	}
+	require.NoError(DbPutMessageEntry(db, messageEntry))
+
+	// Simulate a message stored before the conversation index existed.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForConversationMessage(pk1, pk2, 1))
+	}))
+	messages, err := DbGetConversation(db, pk1, pk2, 0, 0)
+	require.NoError(err)
+	require.Len(messages, 0)
+
+	numIndexed, err := DbBackfillConversationIndex(db)
+	require.NoError(err)
+	assert.Equal(1, numIndexed)
+	messages, err = DbGetConversation(db, pk1, pk2, 0, 0)
+	require.NoError(err)
+	assert.Equal([]*MessageEntry{messageEntry}, messages)
+
+	// The backfill only runs once.
+	numIndexed, err = DbBackfillConversationIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numIndexed)
+
+	// Deleting the message removes it from the conversation too.
+	require.NoError(DbDeleteMessageEntryMappings(db, pk2, 1))
+	messages, err = DbGetConversation(db, pk1, pk2, 0, 0)
+	require.NoError(err)
+	assert.Len(messages, 0)
+}
+
+func TestFaucetLedger(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+	salt := []byte("salt")
+	ipHash1 := FaucetIPHash("1.2.3.4", salt)
+	ipHash2 := FaucetIPHash("5.6.7.8", salt)
+	assert.NotEqual(ipHash1, ipHash2)
+	assert.NotEqual(ipHash1, FaucetIPHash("1.2.3.4", []byte("other salt")))
+
+	now := time.Unix(1000000, 0)
+	limit := &FaucetRateLimit{Window: time.Hour, MaxDisbursements: 2, MaxNanos: 100}
+
+	// An old disbursement doesn't count against the window.
+	require.NoError(DbPutFaucetDisbursement(db, &FaucetDisbursement{
+		PublicKey: pk1, IPHash: ipHash1, AmountNanos: 100,
+		TstampNanos: uint64(now.Add(-2 * time.Hour).UnixNano()),
+	}))
+	require.NoError(DbCheckFaucetRateLimit(db, pk1, ipHash1, 60, limit, now))
+
+	require.NoError(DbPutFaucetDisbursement(db, &FaucetDisbursement{
+		PublicKey: pk1, IPHash: ipHash1, AmountNanos: 60,
+		TstampNanos: uint64(now.Add(-time.Minute).UnixNano()),
+	}))
+	disbursements, err := DbGetFaucetDisbursementsForPublicKey(db, pk1, 0)
+	require.NoError(err)
+	assert.Len(disbursements, 2)
+	disbursements, err = DbGetFaucetDisbursementsForIPHash(db, ipHash1, uint64(now.Add(-time.Hour).UnixNano()))
+	require.NoError(err)
+	require.Len(disbursements, 1)
+	assert.Equal(uint64(60), disbursements[0].AmountNanos)
+
+	// The nanos limit applies to the public key and to the IP.
+	require.Error(DbCheckFaucetRateLimit(db, pk1, ipHash2, 50, limit, now))
+	require.Error(DbCheckFaucetRateLimit(db, pk2, ipHash1, 50, limit, now))
+	require.NoError(DbCheckFaucetRateLimit(db, pk2, ipHash2, 50, limit, now))
+	require.NoError(DbCheckFaucetRateLimit(db, pk1, ipHash1, 40, limit, now))
+
+	// So does the count limit.
+	require.NoError(DbPutFaucetDisbursement(db, &FaucetDisbursement{
+		PublicKey: pk1, IPHash: ipHash1, AmountNanos: 1,
+		TstampNanos: uint64(now.UnixNano()),
+	}))
+	require.Error(DbCheckFaucetRateLimit(db, pk1, ipHash2, 1, limit, now))
+
+	// The ledger is node-local.
+	assert.True(IsLocalOnlyDbKey(_dbKeyForFaucetDisbursement(
+		_PrefixPublicKeyTimestampToFaucetDisbursement, pk1, 0)))
+}
+
+func TestMessagingGroups(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	owner := append([]byte{2}, make([]byte, 32)...)
+	member1 := append([]byte{3}, make([]byte, 32)...)
+	member2 := append([]byte{3}, bytes.Repeat([]byte{1}, 32)...)
+	group := &MessagingGroupEntry{
+		GroupOwnerPublicKey:   owner,
+		MessagingGroupKeyName: []byte("friends"),
+		MessagingPublicKey:    member2,
+		MessagingGroupMembers: []*MessagingGroupMember{
+			{MemberPublicKey: member1, EncryptedKey: []byte("key1")},
+			{MemberPublicKey: member2, EncryptedKey: []byte("key2")},
+		},
+	}
+	require.NoError(DbPutMessagingGroupEntry(db, group))
+	require.NoError(DbPutMessagingGroupEntry(db, &MessagingGroupEntry{
+		GroupOwnerPublicKey:   owner,
+		MessagingGroupKeyName: []byte("family"),
+	}))
+
+	// Bad names are rejected.
+	require.Error(DbPutMessagingGroupEntry(db, &MessagingGroupEntry{
+		GroupOwnerPublicKey:   owner,
+		MessagingGroupKeyName: []byte{},
+	}))
+	require.Error(DbPutMessagingGroupEntry(db, &MessagingGroupEntry{
+		GroupOwnerPublicKey:   owner,
+		MessagingGroupKeyName: make([]byte, MaxMessagingGroupKeyNameLength+1),
+	}))
+
+	assert.Equal(group, DbGetMessagingGroupEntry(db, owner, []byte("friends")))
+	assert.Nil(DbGetMessagingGroupEntry(db, member1, []byte("friends")))
+	groups, err := DbGetMessagingGroupEntriesForOwner(db, owner)
+	require.NoError(err)
+	require.Len(groups, 2)
+	assert.Equal([]byte("family"), groups[0].MessagingGroupKeyName)
+	assert.Equal([]byte("friends"), groups[1].MessagingGroupKeyName)
+
+	// Messages are visible to the owner and every member.
+	groupID := group.GroupID()
+	message1 := &GroupMessageEntry{GroupID: groupID, SenderPublicKey: member1, EncryptedText: []byte("a"), TstampNanos: 1}
+	message2 := &GroupMessageEntry{GroupID: groupID, SenderPublicKey: owner, EncryptedText: []byte("b"), TstampNanos: 2}
+	require.NoError(DbPutGroupMessageEntry(db, group, message1))
+	require.NoError(DbPutGroupMessageEntry(db, group, message2))
+	require.Error(DbPutGroupMessageEntry(db, group, &GroupMessageEntry{GroupID: &BlockHash{}, TstampNanos: 3}))
+	for _, publicKey := range [][]byte{owner, member1, member2} {
+		messages, err := DbGetGroupMessageEntries(db, publicKey, groupID, 0, 0)
+		require.NoError(err)
+		assert.Equal([]*GroupMessageEntry{message2, message1}, messages)
+	}
+	messages, err := DbGetGroupMessageEntries(db, member1, groupID, 1, 2)
+	require.NoError(err)
+	assert.Equal([]*GroupMessageEntry{message1}, messages)
+
+	require.NoError(DbDeleteGroupMessageEntry(db, group, 2))
+	messages, err = DbGetGroupMessageEntries(db, member2, groupID, 0, 0)
+	require.NoError(err)
+	assert.Equal([]*GroupMessageEntry{message1}, messages)
+
+	// Deleting the group deletes its messages.
+	require.NoError(DbDeleteMessagingGroupEntry(db, owner, []byte("friends")))
+	assert.Nil(DbGetMessagingGroupEntry(db, owner, []byte("friends")))
+	messages, err = DbGetGroupMessageEntries(db, member1, groupID, 0, 0)
+	require.NoError(err)
+	assert.Len(messages, 0)
+}
+
+func TestNodeIdentity(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// The identity is generated once and then stays the same.
+	identityKey, err := DbGetOrCreateNodeIdentity(db)
+	require.NoError(err)
+	identityKey2, err := DbGetOrCreateNodeIdentity(db)
+	require.NoError(err)
+	assert.Equal(identityKey.Serialize(), identityKey2.Serialize())
+
+	// Versions are only recorded when they change.
+	params := &BitCloutParams{UserAgent: "a", ProtocolVersion: 1}
+	prevVersion, err := DbRecordNodeVersion(db, params, time.Unix(1, 0))
+	require.NoError(err)
+	assert.Nil(prevVersion)
+	prevVersion, err = DbRecordNodeVersion(db, params, time.Unix(2, 0))
+	require.NoError(err)
+	assert.Equal("a", prevVersion.UserAgent)
+	params = &BitCloutParams{UserAgent: "b", ProtocolVersion: 1}
+	prevVersion, err = DbRecordNodeVersion(db, params, time.Unix(3, 0))
+	require.NoError(err)
+	assert.Equal("a", prevVersion.UserAgent)
+
+	versionRecords, err := DbGetNodeVersionHistory(db)
+	require.NoError(err)
+	require.Len(versionRecords, 2)
+	assert.Equal(uint64(time.Unix(1, 0).UnixNano()), versionRecords[0].TstampNanos)
+	assert.Equal("b", versionRecords[1].UserAgent)
+
+	// Telemetry is off until the operator opts in.
+	assert.False(DbGetTelemetryOptIn(db))
+	require.NoError(DbPutTelemetryOptIn(db, true))
+	assert.True(DbGetTelemetryOptIn(db))
+	require.NoError(DbPutTelemetryOptIn(db, false))
+	assert.False(DbGetTelemetryOptIn(db))
+
+	assert.True(IsLocalOnlyDbKey(_KeyNodeIdentity))
+}
+
+func TestNodeConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Nothing stored means the defaults.
+	nodeConfig, err := DbGetNodeConfig(db)
+	require.NoError(err)
+	assert.Equal(&NodeConfigEntry{}, nodeConfig)
+	assert.Equal(uint64(MessagesToFetchPerInboxCall), nodeConfig.GetMessagesToFetchPerInboxCall())
+	assert.Equal(uint64(MessagesToFetchPerInboxCall), DbGetMessagesToFetchPerInboxCall(db))
+
+	// The limit is used once it's stored.
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{MessagesToFetchPerInboxCall: 2}))
+	assert.Equal(uint64(2), DbGetMessagesToFetchPerInboxCall(db))
+
+	pk := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	for ii := uint64(1); ii <= 3; ii++ {
+		require.NoError(DbPutMessageEntry(db, &MessageEntry{
+			SenderPublicKey:    pk,
+			RecipientPublicKey: pk,
+			EncryptedText:      []byte{byte(ii)},
+			TstampNanos:        ii,
+		}))
+	}
+	messages, err := DbGetLimitedMessageEntriesForPublicKey(db, pk)
+	require.NoError(err)
+	assert.Equal(2, len(messages))
+
+	// A corrupt entry falls back to the default.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_KeyNodeConfig, []byte{0xff})
+	}))
+	_, err = DbGetNodeConfig(db)
+	assert.True(errors.Is(err, ErrEntryCorrupt))
+	assert.Equal(uint64(MessagesToFetchPerInboxCall), DbGetMessagesToFetchPerInboxCall(db))
+
+	assert.True(IsLocalOnlyDbKey(_KeyNodeConfig))
+}
+
+func TestDecodeFailureCounts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Drop anything recorded by other tests.
+	pendingDecodeFailureCountsLock.Lock()
+	pendingDecodeFailureCounts = make(map[string]uint64)
+	pendingDecodeFailureCountsLock.Unlock()
+
+	// A corrupt global params entry falls back to the defaults and is counted.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_KeyGlobalParams, []byte{0xff})
+	}))
+	for ii := 0; ii < 3; ii++ {
+		assert.Equal(&InitialGlobalParamsEntry, DbGetGlobalParamsEntry(db))
+	}
+	RecordDbDecodeFailure([]byte{0xfe, 0x01})
+
+	// Nothing is in the db until the counts are flushed.
+	decodeFailureCounts, err := DbGetDecodeFailureCounts(db)
+	require.NoError(err)
+	assert.Equal(0, len(decodeFailureCounts))
+
+	require.NoError(DbFlushDecodeFailureCounts(db))
+	decodeFailureCounts, err = DbGetDecodeFailureCounts(db)
+	require.NoError(err)
+	assert.Equal([]*DecodeFailureCount{
+		{PrefixName: "GlobalParams", Prefix: _KeyGlobalParams, Count: 3},
+		{PrefixName: "Unregistered[254]", Prefix: []byte{0xfe}, Count: 1},
+	}, decodeFailureCounts)
+
+	// Nothing is over the default threshold yet.
+	alerts, err := DbGetDecodeFailureAlerts(db)
+	require.NoError(err)
+	assert.Equal(0, len(alerts))
+
+	// Later failures are added to the saved counts.
+	DbGetGlobalParamsEntry(db)
+	require.NoError(DbPutNodeConfig(db, &NodeConfigEntry{DecodeFailureAlertThreshold: 4}))
+	alerts, err = DbGetDecodeFailureAlerts(db)
+	require.NoError(err)
+	assert.Equal([]*DecodeFailureCount{
+		{PrefixName: "GlobalParams", Prefix: _KeyGlobalParams, Count: 4},
+	}, alerts)
+}
+
+func TestQueryCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	numComputes := 0
+	compute := func() ([]byte, error) {
+		numComputes++
+		return []byte{byte(numComputes)}, nil
+	}
+
+	// The result is computed once per tip.
+	tip1 := &BlockNode{Hash: &BlockHash{1}, Height: 1}
+	result, err := CacheGetOrCompute(db, "leaderboard", tip1, compute)
+	require.NoError(err)
+	assert.Equal([]byte{1}, result)
+	result, err = CacheGetOrCompute(db, "leaderboard", tip1, compute)
+	require.NoError(err)
+	assert.Equal([]byte{1}, result)
+	assert.Equal(1, numComputes)
+	assert.Equal(uint64(1), DbGetQueryCacheEntry(db, "leaderboard").ComputedAtHeight)
+
+	// A different tip at the same height, like after a reorg, recomputes.
+	tip2 := &BlockNode{Hash: &BlockHash{2}, Height: 1}
+	result, err = CacheGetOrCompute(db, "leaderboard", tip2, compute)
+	require.NoError(err)
+	assert.Equal([]byte{2}, result)
+
+	// Errors aren't cached.
+	_, err = CacheGetOrCompute(db, "other", tip2, func() ([]byte, error) {
+		return nil, errors.New("failed")
+	})
+	require.Error(err)
+	assert.Nil(DbGetQueryCacheEntry(db, "other"))
+
+	require.NoError(DbInvalidateQueryCache(db))
+	assert.Nil(DbGetQueryCacheEntry(db, "leaderboard"))
+	result, err = CacheGetOrCompute(db, "leaderboard", tip2, compute)
+	require.NoError(err)
+	assert.Equal([]byte{3}, result)
+}
+
+func TestUnreadMessageCount(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+	putMessage := func(sender []byte, recipient []byte, tstampNanos uint64) {
+		require.NoError(DbPutMessageEntry(db, &MessageEntry{
+			SenderPublicKey:    sender,
+			RecipientPublicKey: recipient,
+			EncryptedText:      []byte("message"),
+			TstampNanos:        tstampNanos,
+		}))
+	}
+
+	putMessage(pk1, pk2, 1)
+	putMessage(pk1, pk2, 2)
+	putMessage(pk1, pk2, 3)
+	putMessage(pk2, pk1, 4)
+	// Storing a message again doesn't count it twice.
+	putMessage(pk1, pk2, 3)
+	assert.Equal(uint64(3), DbGetUnreadMessageCount(db, pk2))
+	assert.Equal(uint64(1), DbGetUnreadMessageCount(db, pk1))
+
+	// Reading part of the inbox leaves the newer messages unread.
+	require.NoError(DbMarkMessagesRead(db, pk2, 2))
+	assert.Equal(uint64(1), DbGetUnreadMessageCount(db, pk2))
+	// Reading up to an earlier point doesn't change anything.
+	require.NoError(DbMarkMessagesRead(db, pk2, 1))
+	assert.Equal(uint64(1), DbGetUnreadMessageCount(db, pk2))
+
+	// Deleting a read message doesn't change the count but deleting an unread one does.
+	require.NoError(DbDeleteMessageEntryMappings(db, pk2, 1))
+	assert.Equal(uint64(1), DbGetUnreadMessageCount(db, pk2))
+	require.NoError(DbDeleteMessageEntryMappings(db, pk1, 3))
+	assert.Equal(uint64(0), DbGetUnreadMessageCount(db, pk2))
+
+	// New messages after the read point are counted.
+	putMessage(pk1, pk2, 5)
+	assert.Equal(uint64(1), DbGetUnreadMessageCount(db, pk2))
+	require.NoError(DbMarkMessagesRead(db, pk2, math.MaxUint64))
+	assert.Equal(uint64(0), DbGetUnreadMessageCount(db, pk2))
+}
+
+func TestPostEngagementCounts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+	postHash := BlockHash{9}
+	params := &BitCloutTestnetParams
+
+	counts, err := DBGetPostEngagementCounts(db, postHash)
+	require.NoError(err)
+	assert.Equal(&PostEngagementCounts{}, counts)
+
+	// Liking twice only counts once.
+	require.NoError(DbPutLikeMappings(db, pkA, postHash))
+	require.NoError(DbPutLikeMappings(db, pkA, postHash))
+	require.NoError(DbPutLikeMappings(db, pkB, postHash))
+
+	// A comment and a vanilla reclout.
+	comment := &PostEntry{
+		PostHash:        &BlockHash{10},
+		PosterPublicKey: pkA,
+		ParentStakeID:   postHash[:],
+		TimestampNanos:  1,
+	}
+	require.NoError(DBPutPostEntryMappings(db, comment, params))
+	require.NoError(DBPutPostEntryMappings(db, comment, params))
+	reclout := &PostEntry{
+		PostHash:          &BlockHash{11},
+		PosterPublicKey:   pkB,
+		RecloutedPostHash: &postHash,
+		TimestampNanos:    2,
+		StakeEntry:        NewStakeEntry(),
+	}
+	require.NoError(DBPutPostEntryMappings(db, reclout, params))
+	require.NoError(DbPutRecloutMappings(db, pkB, postHash, RecloutEntry{
+		RecloutPostHash: reclout.PostHash, RecloutedPostHash: &postHash, ReclouterPubKey: pkB}))
+
+	counts, err = DBGetPostEngagementCounts(db, postHash)
+	require.NoError(err)
+	assert.Equal(&PostEngagementCounts{LikeCount: 2, CommentCount: 1, RecloutCount: 1}, counts)
+
+	// Deleting and re-adding the same mappings, like a flush does, nets out.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := DbDeleteLikeMappingsWithTxn(txn, pkA, postHash); err != nil {
+			return err
+		}
+		if err := DbPutLikeMappingsWithTxn(txn, pkA, postHash); err != nil {
+			return err
+		}
+		if err := DBDeletePostEntryMappingsWithTxn(txn, comment.PostHash, params); err != nil {
+			return err
+		}
+		return DBPutPostEntryMappingsWithTxn(txn, comment, params, math.MaxUint64)
+	}))
+	counts, err = DBGetPostEngagementCounts(db, postHash)
+	require.NoError(err)
+	assert.Equal(&PostEngagementCounts{LikeCount: 2, CommentCount: 1, RecloutCount: 1}, counts)
+
+	// Deleting them takes them off and deleting twice doesn't go negative.
+	require.NoError(DbDeleteLikeMappings(db, pkB, postHash))
+	require.NoError(DbDeleteLikeMappings(db, pkB, postHash))
+	require.NoError(DBDeletePostEntryMappings(db, comment.PostHash, params))
+	require.NoError(DBDeletePostEntryMappings(db, reclout.PostHash, params))
+	counts, err = DBGetPostEngagementCounts(db, postHash)
+	require.NoError(err)
+	assert.Equal(&PostEngagementCounts{LikeCount: 1}, counts)
+
+	// The backfill recomputes the counts from the indexes.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForPostEngagementCounts(postHash))
+	}))
+	numPosts, err := DbBackfillPostEngagementCounts(db)
+	require.NoError(err)
+	assert.Equal(1, numPosts)
+	counts, err = DBGetPostEngagementCounts(db, postHash)
+	require.NoError(err)
+	assert.Equal(&PostEngagementCounts{LikeCount: 1}, counts)
+
+	// It only runs once.
+	numPosts, err = DbBackfillPostEngagementCounts(db)
+	require.NoError(err)
+	assert.Equal(0, numPosts)
+}
+
+func TestQuoteRecloutIndex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	postHash := BlockHash{9}
+	params := &BitCloutTestnetParams
+
+	// Two quotes, a quoting comment, and a vanilla reclout, which isn't indexed.
+	quoteAt := func(hashByte byte, tstampNanos uint64) *PostEntry {
+		return &PostEntry{
+			PostHash:          &BlockHash{hashByte},
+			PosterPublicKey:   pkA,
+			RecloutedPostHash: &postHash,
+			IsQuotedReclout:   true,
+			Body:              []byte("quote"),
+			TimestampNanos:    tstampNanos,
+			StakeEntry:        NewStakeEntry(),
+		}
+	}
+	quote1 := quoteAt(10, 1)
+	quote2 := quoteAt(11, 2)
+	quotingComment := quoteAt(12, 3)
+	quotingComment.ParentStakeID = (&BlockHash{8})[:]
+	vanillaReclout := &PostEntry{
+		PostHash:          &BlockHash{13},
+		PosterPublicKey:   pkA,
+		RecloutedPostHash: &postHash,
+		TimestampNanos:    4,
+		StakeEntry:        NewStakeEntry(),
+	}
+	for _, postEntry := range []*PostEntry{quote1, quote2, quotingComment, vanillaReclout} {
+		require.NoError(DBPutPostEntryMappings(db, postEntry, params))
+	}
+
+	// Newest first.
+	quotes, err := DBGetQuoteRecloutsOfPost(db, &postHash, 0, 0)
+	require.NoError(err)
+	require.Equal(3, len(quotes))
+	assert.Equal(quotingComment.PostHash, quotes[0].PostHash)
+	assert.Equal(quote2.PostHash, quotes[1].PostHash)
+	assert.Equal(quote1.PostHash, quotes[2].PostHash)
+
+	// Paging picks up right before the tstamp passed.
+	quotes, err = DBGetQuoteRecloutsOfPost(db, &postHash, 1, 0)
+	require.NoError(err)
+	require.Equal(1, len(quotes))
+	quotes, err = DBGetQuoteRecloutsOfPost(db, &postHash, 0, quotes[0].TimestampNanos)
+	require.NoError(err)
+	require.Equal(2, len(quotes))
+	assert.Equal(quote2.PostHash, quotes[0].PostHash)
+
+	// Deleting a quote removes it from the index.
+	require.NoError(DBDeletePostEntryMappings(db, quote2.PostHash, params))
+	quotes, err = DBGetQuoteRecloutsOfPost(db, &postHash, 0, 0)
+	require.NoError(err)
+	assert.Equal(2, len(quotes))
+
+	// The backfill adds the quotes from the post entries.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForQuoteReclout(&postHash, quote1.TimestampNanos, quote1.PostHash))
+	}))
+	numIndexed, err := DbBackfillQuoteRecloutIndex(db)
+	require.NoError(err)
+	assert.Equal(2, numIndexed)
+	quotes, err = DBGetQuoteRecloutsOfPost(db, &postHash, 0, 0)
+	require.NoError(err)
+	assert.Equal(2, len(quotes))
+
+	// It only runs once.
+	numIndexed, err = DbBackfillQuoteRecloutIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numIndexed)
+}
+
+func TestContentHashIndexBackfill(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	params := &BitCloutTestnetParams
+	imageURL := "https://images.bitclout.com/image.webp"
+	imageBody, err := json.Marshal(&BitCloutBodySchema{Body: "image", ImageURLs: []string{imageURL}})
+	require.NoError(err)
+
+	// Three posts share an image. The lowest height wins and the lower post hash
+	// breaks the tie between the two posts at that height.
+	postAt := func(hashByte byte, height uint32, body []byte) *PostEntry {
+		return &PostEntry{
+			PostHash:                &BlockHash{hashByte},
+			PosterPublicKey:         pkA,
+			Body:                    body,
+			ConfirmationBlockHeight: height,
+			StakeEntry:              NewStakeEntry(),
+		}
+	}
+	for _, postEntry := range []*PostEntry{
+		postAt(9, 5, imageBody),
+		postAt(7, 3, imageBody),
+		postAt(2, 3, imageBody),
+		postAt(4, 1, []byte("not json")),
+	} {
+		require.NoError(DBPutPostEntryMappings(db, postEntry, params))
+	}
+
+	numPosts, err := DbBackfillContentHashIndex(db)
+	require.NoError(err)
+	assert.Equal(4, numPosts)
+	firstSeen := DbGetContentHashFirstSeenEntry(db, ContentHashForImageURL(imageURL))
+	require.NotNil(firstSeen)
+	assert.Equal(&BlockHash{2}, firstSeen.PostHash)
+	assert.Equal(uint32(3), firstSeen.BlockHeight)
+
+	// It only runs once.
+	numPosts, err = DbBackfillContentHashIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numPosts)
+}
+
+func TestNormalizedUsernameIndexBackfill(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// A profile stored before the normalized username index existed only has
+	// the username mapping.
+	pkid := PublicKeyToPKID(append([]byte{2}, bytes.Repeat([]byte{1}, 32)...))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_dbKeyForProfileUsernameToPKID([]byte("Elon_Musk")), pkid[:])
+	}))
+	pkids, _, err := DbGetSimilarUsernames(db, []byte("e1onmusk"), false /*fetchEntries*/)
+	require.NoError(err)
+	assert.Empty(pkids)
+
+	require.NoError(DbBackfillNormalizedUsernameIndex(db))
+	pkids, _, err = DbGetSimilarUsernames(db, []byte("e1onmusk"), false /*fetchEntries*/)
+	require.NoError(err)
+	require.Equal([]*PKID{pkid}, pkids)
+	assert.Equal(IndexMigrationStateBackfillComplete,
+		DbGetIndexMigrationState(db, normalizedUsernameIndexMigration.Name))
+
+	// Running it again is a no-op.
+	require.NoError(DbBackfillNormalizedUsernameIndex(db))
+}
+
+func TestRepairReverseMappings(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkidA := &PKID{1}
+	pkidB := &PKID{2}
+	pkidC := &PKID{3}
+	require.NoError(DbPutFollowMappings(db, pkidA, pkidB))
+	require.NoError(DbPutFollowMappings(db, pkidA, pkidC))
+	require.NoError(DbPutDiamondMappings(db, &DiamondEntry{
+		SenderPKID:      pkidA,
+		ReceiverPKID:    pkidB,
+		DiamondPostHash: &BlockHash{4},
+		DiamondLevel:    2,
+	}))
+
+	// Lose some of the reverse keys.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := txn.Delete(_dbKeyForFollowedToFollowerMapping(pkidC, pkidA)); err != nil {
+			return err
+		}
+		return txn.Delete(_dbKeyForDiamondSenderToDiamondRecieverMapping(pkidB, pkidA, &BlockHash{4}))
+	}))
+
+	// A dry run only reports.
+	reports, err := DbRepairReverseMappings(db, ReverseMappingPairs, true /*dryRun*/)
+	require.NoError(err)
+	require.Equal(len(ReverseMappingPairs), len(reports))
+	assert.Equal(&ReverseMappingRepairReport{Name: "follows", NumScanned: 2, NumMissing: 1}, reports[0])
+	assert.Equal(&ReverseMappingRepairReport{Name: "diamonds", NumScanned: 1, NumMissing: 1}, reports[2])
+	pkids, err := DbGetPKIDsFollowingYou(db, pkidC, 0, nil)
+	require.NoError(err)
+	assert.Equal(0, len(pkids))
+
+	reports, err = DbRepairReverseMappings(db, ReverseMappingPairs, false /*dryRun*/)
+	require.NoError(err)
+	assert.Equal(&ReverseMappingRepairReport{Name: "follows", NumScanned: 2, NumMissing: 1, NumRepaired: 1}, reports[0])
+	assert.Equal(&ReverseMappingRepairReport{Name: "diamonds", NumScanned: 1, NumMissing: 1, NumRepaired: 1}, reports[2])
+
+	pkids, err = DbGetPKIDsFollowingYou(db, pkidC, 0, nil)
+	require.NoError(err)
+	assert.Equal([]*PKID{pkidA}, pkids)
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		valBytes, err := txn.Get(_dbKeyForDiamondSenderToDiamondRecieverMapping(pkidB, pkidA, &BlockHash{4}))
+		if err != nil {
+			return err
+		}
+		assert.Equal(int64(2), _DbDiamondEntryForDbBuf(valBytes).DiamondLevel)
+		return nil
+	}))
+
+	// Nothing is left to fix.
+	reports, err = DbRepairReverseMappings(db, ReverseMappingPairs, false /*dryRun*/)
+	require.NoError(err)
+	for _, report := range reports {
+		assert.Equal(0, report.NumMissing)
+	}
+}
+
+func TestVerifyDbIntegrity(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	pkidA := &PKID{1}
+	pkidB := &PKID{2}
+	pkidC := &PKID{3}
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+	require.NoError(DbPutFollowMappings(db, pkidA, pkidB))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := DBPutPKIDMappingsWithTxn(txn, pk1, &PKIDEntry{PKID: pkidA}, params); err != nil {
+			return err
+		}
+		return DbPutMessageEntryWithTxn(txn, &MessageEntry{
+			SenderPublicKey:    pk1,
+			RecipientPublicKey: pk2,
+			EncryptedText:      []byte("hi"),
+			TstampNanos:        1,
+		}, math.MaxUint64)
+	}))
+
+	// Lose one side of each index and leave a mapping with no other side.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := txn.Delete(_dbKeyForFollowedToFollowerMapping(pkidB, pkidA)); err != nil {
+			return err
+		}
+		if err := txn.Set(_dbKeyForFollowedToFollowerMapping(pkidA, pkidC), []byte{}); err != nil {
+			return err
+		}
+		if err := txn.Delete(append(append([]byte{}, _PrefixPKIDToPublicKey...), pkidA[:]...)); err != nil {
+			return err
+		}
+		if err := txn.Set(append(append([]byte{}, _PrefixPKIDToPublicKey...), pkidB[:]...), pk2); err != nil {
+			return err
+		}
+		return txn.Delete(_dbKeyForMessageEntry(pk2, 1))
+	}))
+	reportsByName := func(reports []*DbIntegrityReport) map[string]*DbIntegrityReport {
+		ret := make(map[string]*DbIntegrityReport)
+		for _, report := range reports {
+			ret[report.Name] = report
+		}
+		return ret
+	}
+
+	// Without repair nothing is written.
+	reports, err := VerifyDbIntegrity(db, params, false /*repair*/)
+	require.NoError(err)
+	require.Equal(len(ReverseMappingPairs)+2, len(reports))
+	byName := reportsByName(reports)
+	assert.Equal(&DbIntegrityReport{Name: "follows", NumScanned: 2, NumMissing: 1, NumOrphaned: 1}, byName["follows"])
+	assert.Equal(&DbIntegrityReport{Name: "pkids", NumScanned: 2, NumMissing: 1, NumOrphaned: 1}, byName["pkids"])
+	assert.Equal(&DbIntegrityReport{Name: "messages", NumScanned: 1, NumMissing: 1}, byName["messages"])
+	assert.Nil(DbGetMessageEntry(db, pk2, 1))
+
+	reports, err = VerifyDbIntegrity(db, params, true /*repair*/)
+	require.NoError(err)
+	byName = reportsByName(reports)
+	assert.Equal(2, byName["follows"].NumRepaired)
+	assert.Equal(2, byName["pkids"].NumRepaired)
+	assert.Equal(1, byName["messages"].NumRepaired)
+
+	pkids, err := DbGetPKIDsFollowingYou(db, pkidB, 0, nil)
+	require.NoError(err)
+	assert.Equal([]*PKID{pkidA}, pkids)
+	pkids, err = DbGetPKIDsFollowingYou(db, pkidA, 0, nil)
+	require.NoError(err)
+	assert.Equal(0, len(pkids))
+	assert.Equal(pk1, DBGetPublicKeyForPKID(db, pkidA))
+	assert.Equal(pkidB[:], DBGetPublicKeyForPKID(db, pkidB))
+	assert.Equal([]byte("hi"), DbGetMessageEntry(db, pk2, 1).EncryptedText)
+
+	// Nothing is left to fix.
+	reports, err = VerifyDbIntegrity(db, params, false /*repair*/)
+	require.NoError(err)
+	for _, report := range reports {
+		assert.Equal(0, report.NumMissing)
+		assert.Equal(0, report.NumOrphaned)
+	}
+}
+
+func TestReclouterPubKeysForPostHash(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+	pkC := append([]byte{2}, bytes.Repeat([]byte{3}, 32)...)
+	postHash := BlockHash{9}
+	params := &BitCloutTestnetParams
+
+	// A reclout through the post entry and two through the reclout mappings.
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:          &BlockHash{10},
+		PosterPublicKey:   pkA,
+		RecloutedPostHash: &postHash,
+		TimestampNanos:    1,
+		StakeEntry:        NewStakeEntry(),
+	}, params))
+	for ii, pk := range [][]byte{pkB, pkC} {
+		require.NoError(DbPutRecloutMappings(db, pk, postHash, RecloutEntry{
+			RecloutPostHash: &BlockHash{byte(11 + ii)}, RecloutedPostHash: &postHash, ReclouterPubKey: pk}))
+	}
+
+	reclouters, err := DbGetReclouterPubKeysForPostHash(db, postHash, 0, nil)
+	require.NoError(err)
+	assert.Equal([][]byte{pkA, pkB, pkC}, reclouters)
+
+	// Paging starts at the public key passed.
+	reclouters, err = DbGetReclouterPubKeysForPostHash(db, postHash, 2, nil)
+	require.NoError(err)
+	assert.Equal([][]byte{pkA, pkB}, reclouters)
+	reclouters, err = DbGetReclouterPubKeysForPostHash(db, postHash, 2, pkC)
+	require.NoError(err)
+	assert.Equal([][]byte{pkC}, reclouters)
+
+	// Deleting a reclout either way removes it.
+	require.NoError(DbDeleteRecloutMappings(db, pkB, postHash))
+	require.NoError(DBDeletePostEntryMappings(db, &BlockHash{10}, params))
+	reclouters, err = DbGetReclouterPubKeysForPostHash(db, postHash, 0, nil)
+	require.NoError(err)
+	assert.Equal([][]byte{pkC}, reclouters)
+
+	// The backfill writes the reverse keys from the forward ones.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForRecloutedPostHashReclouterPubKey(postHash, pkC))
+	}))
+	numIndexed, err := DbBackfillRecloutReverseIndex(db)
+	require.NoError(err)
+	assert.Equal(1, numIndexed)
+	reclouters, err = DbGetReclouterPubKeysForPostHash(db, postHash, 0, nil)
+	require.NoError(err)
+	assert.Equal([][]byte{pkC}, reclouters)
+
+	// It only runs once.
+	numIndexed, err = DbBackfillRecloutReverseIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numIndexed)
+}
+
+func TestNormalizeLegacyKeys(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pk := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	postHash := &BlockHash{9}
+	params := &BitCloutTestnetParams
+
+	// Canonical keys written the normal way.
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:        &BlockHash{10},
+		PosterPublicKey: pk,
+		ParentStakeID:   postHash[:],
+		TimestampNanos:  1,
+	}, params))
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:        &BlockHash{11},
+		PosterPublicKey: pk,
+		TimestampNanos:  2,
+		StakeEntry:      NewStakeEntry(),
+	}, params))
+	require.NoError(DbPutRecloutMappings(db, pk, *postHash, RecloutEntry{
+		RecloutPostHash: &BlockHash{12}, RecloutedPostHash: postHash, ReclouterPubKey: pk}))
+
+	// Anomalous keys: an unpadded comment parent, a padded post stake ID, and
+	// a reclout key that isn't in any known layout.
+	unpaddedCommentKey := append([]byte{}, _PrefixCommentParentStakeIDToPostHash...)
+	unpaddedCommentKey = append(unpaddedCommentKey, postHash[:]...)
+	unpaddedCommentKey = append(unpaddedCommentKey, EncodeUint64(3)...)
+	unpaddedCommentKey = append(unpaddedCommentKey, (&BlockHash{13})[:]...)
+	paddedStakeKey := append([]byte{}, _PrefixStakeIDTypeAmountStakeIDIndex...)
+	paddedStakeKey = append(paddedStakeKey, byte(StakeIDTypePost))
+	paddedStakeKey = append(paddedStakeKey, EncodeUint64(0)...)
+	paddedStakeKey = append(paddedStakeKey, HashToStakeID(&BlockHash{14})...)
+	malformedRecloutKey := append(append([]byte{}, _PrefixReclouterPubKeyRecloutedPostHashToRecloutPostHash...), 1, 2, 3)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for _, key := range [][]byte{unpaddedCommentKey, paddedStakeKey, malformedRecloutKey} {
+			if err := txn.Set(key, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// A dry run only reports.
+	reports, err := DbNormalizeLegacyKeys(db, LegacyKeyNormalizations, true /*dryRun*/)
+	require.NoError(err)
+	require.Equal(3, len(reports))
+	assert.Equal(&KeyNormalizationReport{Name: "reclouts", NumScanned: 2, NumMalformed: 1}, reports[0])
+	assert.Equal(&KeyNormalizationReport{Name: "comment-parent-stake-ids", NumScanned: 2, NumAnomalous: 1}, reports[1])
+	assert.Equal(&KeyNormalizationReport{Name: "stake-ids", NumScanned: 2, NumAnomalous: 1}, reports[2])
+
+	// The migration rewrites them and stores what it did.
+	reports, err = DbRunLegacyKeyNormalization(db)
+	require.NoError(err)
+	assert.Equal(1, reports[1].NumRewritten)
+	assert.Equal(1, reports[2].NumRewritten)
+	storedReports, err := DbGetLegacyKeyNormalizationReports(db)
+	require.NoError(err)
+	assert.Equal(reports, storedReports)
+
+	commentHashes := [][]byte{}
+	keysFound, _ := EnumerateKeysForPrefix(db, _PrefixCommentParentStakeIDToPostHash)
+	for _, key := range keysFound {
+		assert.Equal(1+btcec.PubKeyBytesLenCompressed+8+HashSizeBytes, len(key))
+		commentHashes = append(commentHashes, key[len(key)-HashSizeBytes:])
+	}
+	assert.Equal([][]byte{(&BlockHash{10})[:], (&BlockHash{13})[:]}, commentHashes)
+	keysFound, _ = EnumerateKeysForPrefix(db, _PrefixStakeIDTypeAmountStakeIDIndex)
+	require.Equal(2, len(keysFound))
+	for _, key := range keysFound {
+		assert.Equal(1+1+8+HashSizeBytes, len(key))
+	}
+	// Malformed keys are left alone.
+	keysFound, _ = EnumerateKeysForPrefix(db, malformedRecloutKey)
+	assert.Equal(1, len(keysFound))
+
+	// It only runs once.
+	reports, err = DbRunLegacyKeyNormalization(db)
+	require.NoError(err)
+	assert.Nil(reports)
+	reports, err = DbNormalizeLegacyKeys(db, LegacyKeyNormalizations, true /*dryRun*/)
+	require.NoError(err)
+	for _, report := range reports {
+		assert.Equal(0, report.NumAnomalous)
+	}
+}
+
+func TestFollowCounts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkidA := &PKID{1}
+	pkidB := &PKID{2}
+	pkidC := &PKID{3}
+
+	numFollowers, numFollowing := DbGetFollowCountsForPKID(db, pkidA)
+	assert.Equal(uint64(0), numFollowers)
+	assert.Equal(uint64(0), numFollowing)
+
+	// Following twice only counts once.
+	require.NoError(DbPutFollowMappings(db, pkidA, pkidB))
+	require.NoError(DbPutFollowMappings(db, pkidA, pkidB))
+	require.NoError(DbPutFollowMappings(db, pkidA, pkidC))
+	require.NoError(DbPutFollowMappings(db, pkidC, pkidB))
+
+	numFollowers, numFollowing = DbGetFollowCountsForPKID(db, pkidA)
+	assert.Equal(uint64(0), numFollowers)
+	assert.Equal(uint64(2), numFollowing)
+	numFollowers, numFollowing = DbGetFollowCountsForPKID(db, pkidB)
+	assert.Equal(uint64(2), numFollowers)
+	assert.Equal(uint64(0), numFollowing)
+	numFollowers, numFollowing = DbGetFollowCountsForPKID(db, pkidC)
+	assert.Equal(uint64(1), numFollowers)
+	assert.Equal(uint64(1), numFollowing)
+
+	// Unfollowing twice only uncounts once.
+	require.NoError(DbDeleteFollowMappings(db, pkidA, pkidB))
+	require.NoError(DbDeleteFollowMappings(db, pkidA, pkidB))
+	numFollowers, numFollowing = DbGetFollowCountsForPKID(db, pkidA)
+	assert.Equal(uint64(0), numFollowers)
+	assert.Equal(uint64(1), numFollowing)
+	numFollowers, _ = DbGetFollowCountsForPKID(db, pkidB)
+	assert.Equal(uint64(1), numFollowers)
+
+	// The backfill recounts everything when the counts are missing.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for _, pkid := range []*PKID{pkidA, pkidB, pkidC} {
+			if err := txn.Delete(_dbKeyForFollowerCount(pkid)); err != nil {
+				return err
+			}
+			if err := txn.Delete(_dbKeyForFollowingCount(pkid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	numFollows, err := DbBackfillFollowCounts(db)
+	require.NoError(err)
+	assert.Equal(2, numFollows)
+	numFollowers, numFollowing = DbGetFollowCountsForPKID(db, pkidC)
+	assert.Equal(uint64(1), numFollowers)
+	assert.Equal(uint64(1), numFollowing)
+	numFollowers, _ = DbGetFollowCountsForPKID(db, pkidB)
+	assert.Equal(uint64(1), numFollowers)
+
+	// It only runs once.
+	numFollows, err = DbBackfillFollowCounts(db)
+	require.NoError(err)
+	assert.Equal(0, numFollows)
+}
+
+func TestPaginatedBalanceEntriesYouHodl(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	hodlerPKID := &PKID{1}
+	creatorPKIDs := []*PKID{{2}, {3}, {4}, {5}}
+	putBalance := func(creatorPKID *PKID, balanceNanos uint64) {
+		require.NoError(DBPutCreatorCoinBalanceEntryMappings(db, &BalanceEntry{
+			HODLerPKID:   hodlerPKID,
+			CreatorPKID:  creatorPKID,
+			BalanceNanos: balanceNanos,
+			HasPurchased: true,
+		}, params))
+	}
+	putBalance(creatorPKIDs[0], 5)
+	putBalance(creatorPKIDs[1], 50)
+	putBalance(creatorPKIDs[2], 20)
+	// Zero balances aren't counted.
+	putBalance(creatorPKIDs[3], 0)
+	assert.Equal(uint64(3), DbGetHoldingsCount(db, hodlerPKID))
+
+	// The first creator's coin is the most expensive and the third creator
+	// doesn't have a profile so their coin is worth nothing.
+	putProfile := func(creatorPKID *PKID, username string, bitCloutLockedNanos uint64) {
+		require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+			PublicKey: creatorPKID[:],
+			Username:  []byte(username),
+			CoinEntry: CoinEntry{
+				BitCloutLockedNanos:     bitCloutLockedNanos,
+				CoinsInCirculationNanos: NanosPerUnit,
+			},
+		}, creatorPKID, params))
+	}
+	putProfile(creatorPKIDs[0], "a", 1000*NanosPerUnit)
+	putProfile(creatorPKIDs[1], "b", 10*NanosPerUnit)
+
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+
+	getPages := func(sortType HoldingsSortType, limit int) [][]*BalanceEntry {
+		pages := [][]*BalanceEntry{}
+		cursor := ""
+		for {
+			balanceEntries, profileEntries, nextCursor, err := DbGetPaginatedBalanceEntriesYouHodl(
+				utxoView, hodlerPKID, sortType, cursor, limit, true /*fetchProfiles*/)
+			require.NoError(err)
+			require.Equal(len(balanceEntries), len(profileEntries))
+			pages = append(pages, balanceEntries)
+			if nextCursor == "" {
+				return pages
+			}
+			cursor = nextCursor
+		}
+	}
+
+	pages := getPages(HoldingsSortTypeBalance, 2)
+	require.Equal(2, len(pages))
+	require.Equal(2, len(pages[0]))
+	require.Equal(1, len(pages[1]))
+	assert.Equal(uint64(50), pages[0][0].BalanceNanos)
+	assert.Equal(uint64(20), pages[0][1].BalanceNanos)
+	assert.Equal(uint64(5), pages[1][0].BalanceNanos)
+	assert.True(pages[1][0].HasPurchased)
+
+	pages = getPages(HoldingsSortTypeCoinPrice, 1)
+	require.Equal(3, len(pages))
+	assert.Equal(creatorPKIDs[0], pages[0][0].CreatorPKID)
+	assert.Equal(creatorPKIDs[1], pages[1][0].CreatorPKID)
+	assert.Equal(creatorPKIDs[2], pages[2][0].CreatorPKID)
+
+	// Changing a balance moves it in the index without changing the count and
+	// selling everything removes it.
+	putBalance(creatorPKIDs[0], 500)
+	putBalance(creatorPKIDs[1], 0)
+	assert.Equal(uint64(2), DbGetHoldingsCount(db, hodlerPKID))
+	pages = getPages(HoldingsSortTypeBalance, 0)
+	require.Equal(1, len(pages))
+	require.Equal(2, len(pages[0]))
+	assert.Equal(uint64(500), pages[0][0].BalanceNanos)
+	assert.Equal(creatorPKIDs[2], pages[0][1].CreatorPKID)
+
+	require.NoError(DBDeleteCreatorCoinBalanceEntryMappings(db, hodlerPKID, creatorPKIDs[2], params))
+	assert.Equal(uint64(1), DbGetHoldingsCount(db, hodlerPKID))
+
+	// Cursors from one sort can't be used with the other.
+	_, _, cursor, err := DbGetPaginatedBalanceEntriesYouHodl(
+		utxoView, hodlerPKID, HoldingsSortTypeBalance, "", 1, false /*fetchProfiles*/)
+	require.NoError(err)
+	_, _, _, err = DbGetPaginatedBalanceEntriesYouHodl(
+		utxoView, hodlerPKID, HoldingsSortTypeCoinPrice, cursor, 1, false /*fetchProfiles*/)
+	assert.Error(err)
+
+	// The backfill rebuilds the index and the counts when they're missing.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		keys, _ := _enumerateKeysForPrefix(db, _PrefixHODLerPKIDBalanceNanosCreatorPKID)
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(_dbKeyForHoldingsCount(hodlerPKID))
+	}))
+	assert.Equal(uint64(0), DbGetHoldingsCount(db, hodlerPKID))
+	numIndexed, err := DbBackfillBalanceIndex(db)
+	require.NoError(err)
+	assert.Equal(1, numIndexed)
+	assert.Equal(uint64(1), DbGetHoldingsCount(db, hodlerPKID))
+	pages = getPages(HoldingsSortTypeBalance, 0)
+	require.Equal(1, len(pages[0]))
+	assert.Equal(uint64(500), pages[0][0].BalanceNanos)
+
+	// It only runs once.
+	numIndexed, err = DbBackfillBalanceIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numIndexed)
+}
+
+func TestPaginatedTopHolders(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	creatorPKID := &PKID{1}
+	hodlerPKIDs := []*PKID{{2}, {3}, {4}, {5}}
+	putBalance := func(hodlerPKID *PKID, balanceNanos uint64) {
+		require.NoError(DBPutCreatorCoinBalanceEntryMappings(db, &BalanceEntry{
+			HODLerPKID:   hodlerPKID,
+			CreatorPKID:  creatorPKID,
+			BalanceNanos: balanceNanos,
+		}, params))
+	}
+	putBalance(hodlerPKIDs[0], 5)
+	putBalance(hodlerPKIDs[1], 50)
+	putBalance(hodlerPKIDs[2], 20)
+	// Zero balances aren't indexed.
+	putBalance(hodlerPKIDs[3], 0)
+	// Balances in other coins don't show up.
+	require.NoError(DBPutCreatorCoinBalanceEntryMappings(db, &BalanceEntry{
+		HODLerPKID:   hodlerPKIDs[0],
+		CreatorPKID:  &PKID{6},
+		BalanceNanos: 1000,
+	}, params))
+
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+
+	getBalances := func(limit int) [][]uint64 {
+		pages := [][]uint64{}
+		cursor := ""
+		for {
+			balanceEntries, profileEntries, nextCursor, err := DbGetPaginatedTopHolders(
+				utxoView, creatorPKID, cursor, limit, true /*fetchProfiles*/)
+			require.NoError(err)
+			require.Equal(len(balanceEntries), len(profileEntries))
+			page := []uint64{}
+			for _, balanceEntry := range balanceEntries {
+				assert.Equal(creatorPKID, balanceEntry.CreatorPKID)
+				page = append(page, balanceEntry.BalanceNanos)
+			}
+			pages = append(pages, page)
+			if nextCursor == "" {
+				return pages
+			}
+			cursor = nextCursor
+		}
+	}
+
+	assert.Equal([][]uint64{{50, 20}, {5}}, getBalances(2))
+	assert.Equal([][]uint64{{50, 20, 5}}, getBalances(0))
+
+	// Sorting by the price of each HODLer's own coin. The second HODLer doesn't
+	// have a profile so their coin is worth nothing.
+	putProfile := func(hodlerPKID *PKID, username string, bitCloutLockedNanos uint64) {
+		require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+			PublicKey: hodlerPKID[:],
+			Username:  []byte(username),
+			CoinEntry: CoinEntry{
+				BitCloutLockedNanos:     bitCloutLockedNanos,
+				CoinsInCirculationNanos: NanosPerUnit,
+			},
+		}, hodlerPKID, params))
+	}
+	putProfile(hodlerPKIDs[0], "a", 10*NanosPerUnit)
+	putProfile(hodlerPKIDs[2], "c", 1000*NanosPerUnit)
+	hodlersByPrice := []*PKID{}
+	cursor := ""
+	for {
+		balanceEntries, _, nextCursor, err := DbGetPaginatedBalanceEntriesHodlingYou(
+			utxoView, creatorPKID, HoldingsSortTypeCoinPrice, cursor, 1, false /*fetchProfiles*/)
+		require.NoError(err)
+		require.Equal(1, len(balanceEntries))
+		hodlersByPrice = append(hodlersByPrice, balanceEntries[0].HODLerPKID)
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	assert.Equal([]*PKID{hodlerPKIDs[2], hodlerPKIDs[0], hodlerPKIDs[1]}, hodlersByPrice)
+	_, _, _, err = DbGetPaginatedBalanceEntriesHodlingYou(
+		utxoView, creatorPKID, HoldingsSortType(2), "", 0, false /*fetchProfiles*/)
+	assert.Error(err)
+
+	// Changing a balance moves it in the index and selling everything or
+	// deleting the entry removes it.
+	putBalance(hodlerPKIDs[0], 500)
+	putBalance(hodlerPKIDs[1], 0)
+	assert.Equal([][]uint64{{500, 20}}, getBalances(0))
+	require.NoError(DBDeleteCreatorCoinBalanceEntryMappings(db, hodlerPKIDs[2], creatorPKID, params))
+	assert.Equal([][]uint64{{500}}, getBalances(0))
+
+	// The backfill rebuilds the index when it's missing.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		keys, _ := _enumerateKeysForPrefix(db, _PrefixCreatorPKIDBalanceNanosHODLerPKID)
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	assert.Equal([][]uint64{{}}, getBalances(0))
+	numIndexed, err := DbBackfillTopHoldersIndex(db)
+	require.NoError(err)
+	assert.Equal(2, numIndexed)
+	assert.Equal([][]uint64{{500}}, getBalances(0))
+
+	// It only runs once.
+	numIndexed, err = DbBackfillTopHoldersIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numIndexed)
+}
+
+func TestPaginatedFollows(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkidA := &PKID{1}
+	followers := []*PKID{{2}, {3}, {4}, {5}, {6}}
+	for _, follower := range followers {
+		require.NoError(DbPutFollowMappings(db, follower, pkidA))
+		require.NoError(DbPutFollowMappings(db, pkidA, follower))
+	}
+
+	// A limit of zero returns everything.
+	pkids, err := DbGetPKIDsFollowingYou(db, pkidA, 0 /*limit*/, nil /*startPKID*/)
+	require.NoError(err)
+	assert.Equal(followers, pkids)
+
+	// Page through two at a time, starting each page right after the last PKID
+	// from the previous one.
+	fetched := []*PKID{}
+	var startPKID *PKID
+	for {
+		page, err := DbGetPKIDsYouFollow(db, pkidA, 2 /*limit*/, startPKID)
+		require.NoError(err)
+		fetched = append(fetched, page...)
+		if len(page) < 2 {
+			break
+		}
+		nextPKID := *page[len(page)-1]
+		nextPKID[len(nextPKID)-1]++
+		startPKID = &nextPKID
+	}
+	assert.Equal(followers, fetched)
+
+	// The start PKID is included when it's followed.
+	pkids, err = DbGetPKIDsFollowingYou(db, pkidA, 2 /*limit*/, followers[3])
+	require.NoError(err)
+	assert.Equal(followers[3:], pkids)
+}
+
+func TestPublicKeyActivity(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	params := &BitCloutTestnetParams
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+
+	// Each txn is sent by pkA to pkB at a different height.
+	putTxn := func(amountNanos uint64, blockHeight uint32) *MsgBitCloutTxn {
+		txn := &MsgBitCloutTxn{
+			TxInputs:  []*BitCloutInput{},
+			TxOutputs: []*BitCloutOutput{{PublicKey: pkB, AmountNanos: amountNanos}},
+			TxnMeta:   &BasicTransferMetadata{},
+			PublicKey: pkA,
+		}
+		blockHash := BlockHash{byte(blockHeight)}
+		require.NoError(DbPutTxindexTransactionMappings(db, txn, params, &TransactionMetadata{
+			BlockHashHex:                   hex.EncodeToString(blockHash[:]),
+			BlockHeight:                    blockHeight,
+			TransactorPublicKeyBase58Check: PkToString(pkA, params),
+			AffectedPublicKeys: []*AffectedPublicKey{
+				{PublicKeyBase58Check: PkToString(pkB, params), Metadata: "BasicTransferOutput"},
+			},
+		}))
+		return txn
+	}
+
+	assert.Nil(DbGetPublicKeyActivity(db, pkA))
+	putTxn(1, 5)
+	putTxn(2, 9)
+	txn3 := putTxn(3, 12)
+	assert.Equal(&PublicKeyActivity{PublicKey: pkA, FirstSeenHeight: 5, LastActiveHeight: 12},
+		DbGetPublicKeyActivity(db, pkA))
+	assert.Equal(&PublicKeyActivity{PublicKey: pkB, FirstSeenHeight: 5, LastActiveHeight: 12},
+		DbGetPublicKeyActivity(db, pkB))
+
+	// Disconnecting the newest txn rolls back the last active height.
+	require.NoError(DbDeleteTxindexTransactionMappings(db, txn3, params))
+	assert.Equal(&PublicKeyActivity{PublicKey: pkA, FirstSeenHeight: 5, LastActiveHeight: 9},
+		DbGetPublicKeyActivity(db, pkA))
+
+	// Only pkB is dormant once pkA is active again.
+	putTxn(4, 20)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return _dbPutPublicKeyActivityWithTxn(txn, &PublicKeyActivity{
+			PublicKey: pkB, FirstSeenHeight: 5, LastActiveHeight: 9})
+	}))
+	dormant, err := DbGetDormantPublicKeys(db, 15 /*inactiveSinceHeight*/, 0 /*limit*/)
+	require.NoError(err)
+	require.Equal(1, len(dormant))
+	assert.Equal(pkB, dormant[0].PublicKey)
+	dormant, err = DbGetDormantPublicKeys(db, 25 /*inactiveSinceHeight*/, 1 /*limit*/)
+	require.NoError(err)
+	assert.Equal(1, len(dormant))
+
+	// The backfill recomputes the activity from the txn mappings.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := txn.Delete(_dbKeyForPublicKeyActivity(pkA)); err != nil {
+			return err
+		}
+		return txn.Delete(_dbKeyForPublicKeyActivity(pkB))
+	}))
+	numPublicKeys, err := DbBackfillPublicKeyActivity(db)
+	require.NoError(err)
+	assert.Equal(2, numPublicKeys)
+	assert.Equal(&PublicKeyActivity{PublicKey: pkB, FirstSeenHeight: 5, LastActiveHeight: 20},
+		DbGetPublicKeyActivity(db, pkB))
+
+	// It only runs once.
+	numPublicKeys, err = DbBackfillPublicKeyActivity(db)
+	require.NoError(err)
+	assert.Equal(0, numPublicKeys)
+}
+
+func TestTxindexPublicKeyIndex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	params := &BitCloutTestnetParams
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+
+	putTxn := func(amountNanos uint64, blockHeight uint32) *MsgBitCloutTxn {
+		txn := &MsgBitCloutTxn{
+			TxInputs:  []*BitCloutInput{},
+			TxOutputs: []*BitCloutOutput{{PublicKey: pkB, AmountNanos: amountNanos}},
+			TxnMeta:   &BasicTransferMetadata{},
+			PublicKey: pkA,
+		}
+		blockHash := BlockHash{byte(blockHeight)}
+		require.NoError(DbPutTxindexTransactionMappings(db, txn, params, &TransactionMetadata{
+			BlockHashHex:                   hex.EncodeToString(blockHash[:]),
+			BlockHeight:                    blockHeight,
+			TransactorPublicKeyBase58Check: PkToString(pkA, params),
+			AffectedPublicKeys: []*AffectedPublicKey{
+				{PublicKeyBase58Check: PkToString(pkB, params), Metadata: "BasicTransferOutput"},
+			},
+		}))
+		return txn
+	}
+
+	// The txns come back in chain order no matter the order they were added in.
+	txn12 := putTxn(1, 12)
+	txn5 := putTxn(2, 5)
+	txn9 := putTxn(3, 9)
+	assert.Equal([]*BlockHash{txn5.Hash(), txn9.Hash(), txn12.Hash()}, DbGetTxindexTxnsForPublicKey(db, pkA))
+	require.NoError(DbDeleteTxindexTransactionMappings(db, txn9, params))
+	assert.Equal([]*BlockHash{txn5.Hash(), txn12.Hash()}, DbGetTxindexTxnsForPublicKey(db, pkA))
+	assert.Equal([]*BlockHash{txn5.Hash(), txn12.Hash()}, DbGetTxindexTxnsForPublicKey(db, pkB))
+
+	// The numbered mappings of an old txindex are moved over. The ones without
+	// metadata are dropped.
+	require.NoError(db.DropPrefix(_PrefixPublicKeyHeightTxnIndexTxID))
+	assert.Equal(0, len(DbGetTxindexTxnsForPublicKey(db, pkA)))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		oldKey := func(publicKey []byte, index uint32) []byte {
+			key := append([]byte{}, _PrefixPublicKeyIndexToTransactionIDs...)
+			key = append(key, publicKey...)
+			return append(key, _EncodeUint32(index)...)
+		}
+		for _, mapping := range []struct {
+			key  []byte
+			txID *BlockHash
+		}{
+			{oldKey(pkA, 0), txn12.Hash()},
+			{oldKey(pkA, 1), txn5.Hash()},
+			{oldKey(pkA, 2), txn9.Hash()},
+			{oldKey(pkB, 0), txn5.Hash()},
+		} {
+			if err := txn.Set(mapping.key, mapping.txID[:]); err != nil {
+				return err
+			}
+		}
+		return txn.Set(append(append([]byte{}, _PrefixPublicKeyToNextIndex...), pkA...), UintToBuf(3))
+	}))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DbPutIndexMigrationStateWithTxn(txn, txindexPublicKeyIndexMigrationName, IndexMigrationStateNone)
+	}))
+	numMappings, err := DbMigrateTxindexPublicKeyIndex(db)
+	require.NoError(err)
+	assert.Equal(3, numMappings)
+	assert.Equal([]*BlockHash{txn5.Hash(), txn12.Hash()}, DbGetTxindexTxnsForPublicKey(db, pkA))
+	assert.Equal([]*BlockHash{txn5.Hash()}, DbGetTxindexTxnsForPublicKey(db, pkB))
+	oldKeys, _ := EnumerateKeysForPrefix(db, _PrefixPublicKeyIndexToTransactionIDs)
+	assert.Equal(0, len(oldKeys))
+	nextIndexKeys, _ := EnumerateKeysForPrefix(db, _PrefixPublicKeyToNextIndex)
+	assert.Equal(0, len(nextIndexKeys))
+
+	// It only runs once.
+	numMappings, err = DbMigrateTxindexPublicKeyIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numMappings)
+}
+
+func TestPaginatedTxindexTxnsForPublicKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	params := &BitCloutTestnetParams
+	pkA := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	pkB := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+
+	txIDs := []*BlockHash{}
+	for ii := uint32(1); ii <= 5; ii++ {
+		txn := &MsgBitCloutTxn{
+			TxInputs:  []*BitCloutInput{},
+			TxOutputs: []*BitCloutOutput{{PublicKey: pkB, AmountNanos: uint64(ii)}},
+			TxnMeta:   &BasicTransferMetadata{},
+			PublicKey: pkA,
+		}
+		blockHash := BlockHash{byte(ii)}
+		require.NoError(DbPutTxindexTransactionMappings(db, txn, params, &TransactionMetadata{
+			BlockHashHex:                   hex.EncodeToString(blockHash[:]),
+			BlockHeight:                    ii,
+			TransactorPublicKeyBase58Check: PkToString(pkA, params),
+		}))
+		txIDs = append(txIDs, txn.Hash())
+	}
+
+	// Page forward two at a time.
+	page, cursor, err := DbGetPaginatedTxindexTxnsForPublicKey(db, pkA, "", 2, false /*reverse*/)
+	require.NoError(err)
+	assert.Equal(txIDs[:2], page)
+	page, cursor, err = DbGetPaginatedTxindexTxnsForPublicKey(db, pkA, cursor, 2, false /*reverse*/)
+	require.NoError(err)
+	assert.Equal(txIDs[2:4], page)
+	page, cursor, err = DbGetPaginatedTxindexTxnsForPublicKey(db, pkA, cursor, 2, false /*reverse*/)
+	require.NoError(err)
+	assert.Equal(txIDs[4:], page)
+	assert.Equal("", cursor)
+
+	// Page back from the newest txn. A txn removed from under the cursor doesn't
+	// throw the next page off.
+	page, cursor, err = DbGetPaginatedTxindexTxnsForPublicKey(db, pkA, "", 2, true /*reverse*/)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txIDs[4], txIDs[3]}, page)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForTxindexPublicKeyTxn(pkA, 4, 0, txIDs[3]))
+	}))
+	page, cursor, err = DbGetPaginatedTxindexTxnsForPublicKey(db, pkA, cursor, 2, true /*reverse*/)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txIDs[2], txIDs[1]}, page)
+	page, _, err = DbGetPaginatedTxindexTxnsForPublicKey(db, pkA, cursor, 0, true /*reverse*/)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txIDs[0]}, page)
+
+	// A cursor from another public key is rejected.
+	_, _, err = DbGetPaginatedTxindexTxnsForPublicKey(db, pkB, cursor, 2, true /*reverse*/)
+	assert.Error(err)
+}
+
+func TestTxindexTxnBytes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	params := &BitCloutTestnetParams
+	pk := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	txn := &MsgBitCloutTxn{
+		TxInputs:  []*BitCloutInput{},
+		TxOutputs: []*BitCloutOutput{{PublicKey: pk, AmountNanos: 1}},
+		TxnMeta:   &BasicTransferMetadata{},
+		PublicKey: pk,
+	}
+	blockHash := BlockHash{7}
+	txnMeta := &TransactionMetadata{
+		BlockHashHex:                   hex.EncodeToString(blockHash[:]),
+		BlockHeight:                    7,
+		TransactorPublicKeyBase58Check: PkToString(pk, params),
+	}
+	require.NoError(DbPutTxindexTransactionMappings(db, txn, params, txnMeta))
+
+	// Without its bytes the txn can only be loaded from its block, which isn't
+	// there.
+	foundTxn, _ := DbGetTxindexFullTransactionByTxID(db, db, txn.Hash())
+	assert.Nil(foundTxn)
+
+	require.NoError(DbUpdate(db, func(dbTxn KVTxn) error {
+		return DbPutTxindexTxnBytesWithTxn(dbTxn, txn)
+	}))
+	foundTxn, foundTxnMeta := DbGetTxindexFullTransactionByTxID(db, db, txn.Hash())
+	require.NotNil(foundTxn)
+	assert.Equal(txn.Hash(), foundTxn.Hash())
+	assert.Equal(txnMeta, foundTxnMeta)
+
+	// The bytes go with the rest of the txn's mappings.
+	require.NoError(DbDeleteTxindexTransactionMappings(db, txn, params))
+	keys, _ := EnumerateKeysForPrefix(db, _PrefixTransactionIDToTxnBytes)
+	assert.Equal(0, len(keys))
+}
+
+func TestTxindexExplorerIndexes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	params := &BitCloutTestnetParams
+	pk := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	putTxn := func(amountNanos uint64, blockHashHex string, blockHeight uint32, txnIndexInBlock uint64) *MsgBitCloutTxn {
+		txn := &MsgBitCloutTxn{
+			TxInputs:  []*BitCloutInput{},
+			TxOutputs: []*BitCloutOutput{{PublicKey: pk, AmountNanos: amountNanos}},
+			TxnMeta:   &BasicTransferMetadata{},
+			PublicKey: pk,
+		}
+		require.NoError(DbPutTxindexTransactionMappings(db, txn, params, &TransactionMetadata{
+			BlockHashHex:                   blockHashHex,
+			BlockHeight:                    blockHeight,
+			TxnIndexInBlock:                txnIndexInBlock,
+			TransactorPublicKeyBase58Check: PkToString(pk, params),
+		}))
+		return txn
+	}
+
+	// Seed txns aren't in a block so they're left out.
+	seedTxn := putTxn(1, GenesisBlockHashHex, 0, 0)
+	block5Hash := BlockHash{5}
+	block5Hex := hex.EncodeToString(block5Hash[:])
+	txn5b := putTxn(2, block5Hex, 5, 1)
+	txn5a := putTxn(3, block5Hex, 5, 0)
+	block6Hash := BlockHash{6}
+	txn6 := putTxn(4, hex.EncodeToString(block6Hash[:]), 6, 0)
+
+	txIDs, err := DbGetTxindexTxIDsForBlockHeight(db, 5)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txn5a.Hash(), txn5b.Hash()}, txIDs)
+	txIDs, err = DbGetTxindexTxIDsForBlockHeight(db, 0)
+	require.NoError(err)
+	assert.Equal(0, len(txIDs))
+	blockHeight, exists, err := DbGetTxindexTxnBlockHeight(db, txn6.Hash())
+	require.NoError(err)
+	assert.True(exists)
+	assert.Equal(uint32(6), blockHeight)
+	_, exists, err = DbGetTxindexTxnBlockHeight(db, seedTxn.Hash())
+	require.NoError(err)
+	assert.False(exists)
+
+	require.NoError(DbDeleteTxindexTransactionMappings(db, txn5a, params))
+	txIDs, err = DbGetTxindexTxIDsForBlockHeight(db, 5)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txn5b.Hash()}, txIDs)
+	_, exists, err = DbGetTxindexTxnBlockHeight(db, txn5a.Hash())
+	require.NoError(err)
+	assert.False(exists)
+
+	// A txindex built before the indexes existed is backfilled once.
+	require.NoError(db.DropPrefix(_PrefixTxindexHeightTxnIndexToTxID, _PrefixTxindexTxIDToBlockHeight))
+	numTxns, err := DbBackfillTxindexExplorerIndexes(db)
+	require.NoError(err)
+	assert.Equal(2, numTxns)
+	txIDs, err = DbGetTxindexTxIDsForBlockHeight(db, 5)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txn5b.Hash()}, txIDs)
+	blockHeight, exists, err = DbGetTxindexTxnBlockHeight(db, txn6.Hash())
+	require.NoError(err)
+	assert.True(exists)
+	assert.Equal(uint32(6), blockHeight)
+	numTxns, err = DbBackfillTxindexExplorerIndexes(db)
+	require.NoError(err)
+	assert.Equal(0, numTxns)
+}
+
+func TestStripTxindexUtxoOpsDumps(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Metadata is written the way it was when it had a UtxoOpsDump.
+	type legacyBasicTransferTxindexMetadata struct {
+		TotalInputNanos  uint64
+		TotalOutputNanos uint64
+		FeeNanos         uint64
+		UtxoOpsDump      string
+	}
+	type legacyTransactionMetadata struct {
+		TxnType                      string
+		BasicTransferTxindexMetadata *legacyBasicTransferTxindexMetadata
+	}
+	legacyTxID := &BlockHash{1}
+	legacyBuf := bytes.NewBuffer([]byte{})
+	require.NoError(gob.NewEncoder(legacyBuf).Encode(&legacyTransactionMetadata{
+		TxnType: TxnTypeBasicTransfer.String(),
+		BasicTransferTxindexMetadata: &legacyBasicTransferTxindexMetadata{
+			TotalInputNanos:  11,
+			TotalOutputNanos: 10,
+			FeeNanos:         1,
+			UtxoOpsDump:      string(bytes.Repeat([]byte{'x'}, 10000)),
+		},
+	}))
+	legacyLen := legacyBuf.Len()
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(DbTxindexTxIDKey(legacyTxID), legacyBuf.Bytes())
+	}))
+
+	// Metadata that's already in the current encoding is left alone.
+	currentTxID := &BlockHash{2}
+	currentMeta := &TransactionMetadata{
+		TxnType: TxnTypeBasicTransfer.String(),
+		BasicTransferTxindexMetadata: &BasicTransferTxindexMetadata{
+			Outputs: []*TxindexUtxo{{TxIDHex: "ab01", AmountNanos: 5, UtxoType: "UtxoTypeOutput"}},
+		},
+	}
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(DbTxindexTxIDKey(currentTxID), currentMeta.ToBytes())
+	}))
+
+	numTxns, numBytesSaved, err := DbStripTxindexUtxoOpsDumps(db)
+	require.NoError(err)
+	assert.Equal(1, numTxns)
+	assert.Greater(numBytesSaved, 10000)
+	legacyMeta := DbGetTxindexTransactionRefByTxID(db, legacyTxID)
+	require.NotNil(legacyMeta)
+	assert.Equal(&BasicTransferTxindexMetadata{
+		TotalInputNanos:  11,
+		TotalOutputNanos: 10,
+		FeeNanos:         1,
+	}, legacyMeta.BasicTransferTxindexMetadata)
+	assert.Less(len(legacyMeta.ToBytes()), legacyLen)
+	assert.Equal(currentMeta, DbGetTxindexTransactionRefByTxID(db, currentTxID))
+
+	// It's only done once.
+	numTxns, _, err = DbStripTxindexUtxoOpsDumps(db)
+	require.NoError(err)
+	assert.Equal(0, numTxns)
+}
+
+func TestDiamondTotals(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pkidA := &PKID{1}
+	pkidB := &PKID{2}
+	pkidC := &PKID{3}
+	postHash1 := &BlockHash{4}
+	postHash2 := &BlockHash{5}
+
+	totals, err := DbGetDiamondTotalsForPost(db, postHash1)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{}, totals)
+
+	// A and C diamond B's first post and A diamonds B's second post.
+	require.NoError(DbPutDiamondMappings(db, &DiamondEntry{
+		SenderPKID: pkidA, ReceiverPKID: pkidB, DiamondPostHash: postHash1, DiamondLevel: 1}))
+	require.NoError(DbPutDiamondMappings(db, &DiamondEntry{
+		SenderPKID: pkidC, ReceiverPKID: pkidB, DiamondPostHash: postHash1, DiamondLevel: 2}))
+	require.NoError(DbPutDiamondMappings(db, &DiamondEntry{
+		SenderPKID: pkidA, ReceiverPKID: pkidB, DiamondPostHash: postHash2, DiamondLevel: 3}))
+
+	// Upgrading a diamond replaces its level rather than adding another one.
+	require.NoError(DbPutDiamondMappings(db, &DiamondEntry{
+		SenderPKID: pkidA, ReceiverPKID: pkidB, DiamondPostHash: postHash1, DiamondLevel: 4}))
+
+	totals, err = DbGetDiamondTotalsForPost(db, postHash1)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{NumDiamonds: 2, TotalDiamondLevel: 6}, totals)
+	totals, err = DbGetDiamondTotalsForPKIDPair(db, pkidA, pkidB)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{NumDiamonds: 2, TotalDiamondLevel: 7}, totals)
+	totals, err = DbGetDiamondTotalsForPKIDPair(db, pkidB, pkidA)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{}, totals)
+
+	// Deleting a diamond removes it from both totals, and deleting it again does nothing.
+	require.NoError(DbDeleteDiamondMappings(db, pkidB, pkidC, postHash1))
+	require.NoError(DbDeleteDiamondMappings(db, pkidB, pkidC, postHash1))
+	totals, err = DbGetDiamondTotalsForPost(db, postHash1)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{NumDiamonds: 1, TotalDiamondLevel: 4}, totals)
+	totals, err = DbGetDiamondTotalsForPKIDPair(db, pkidC, pkidB)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{}, totals)
+
+	// The backfill recounts everything when the totals are missing.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for _, key := range [][]byte{
+			_dbKeyForPostDiamondTotals(postHash1),
+			_dbKeyForPostDiamondTotals(postHash2),
+			_dbKeyForPKIDPairDiamondTotals(pkidA, pkidB),
+		} {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	numDiamonds, err := DbBackfillDiamondTotals(db)
+	require.NoError(err)
+	assert.Equal(2, numDiamonds)
+	totals, err = DbGetDiamondTotalsForPKIDPair(db, pkidA, pkidB)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{NumDiamonds: 2, TotalDiamondLevel: 7}, totals)
+	totals, err = DbGetDiamondTotalsForPost(db, postHash2)
+	require.NoError(err)
+	assert.Equal(&DiamondTotals{NumDiamonds: 1, TotalDiamondLevel: 3}, totals)
+
+	// It only runs once.
+	numDiamonds, err = DbBackfillDiamondTotals(db)
+	require.NoError(err)
+	assert.Equal(0, numDiamonds)
+}
+
+func TestPrivateMessages(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	priv1, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk1 := priv1.PubKey().SerializeCompressed()
+
+	priv2, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk2 := priv2.PubKey().SerializeCompressed()
+
+	priv3, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk3 := priv3.PubKey().SerializeCompressed()
+
+	tstamp1 := uint64(1)
+	tstamp2 := uint64(2)
+	tstamp3 := uint64(12345)
+	tstamp4 := uint64(time.Now().UnixNano())
+	tstamp5 := uint64(time.Now().UnixNano())
+
+	message1Str := []byte("message1: abcdef")
+	message2Str := []byte("message2: ghi")
+	message3Str := []byte("message3: klmn\123\000\000\000_")
+	message4Str := append([]byte("message4: "), RandomBytes(100)...)
+	message5Str := append([]byte("message5: "), RandomBytes(123)...)
+
+	// pk1 -> pk2: message1Str, tstamp1
+	require.NoError(DbPutMessageEntry(
+		db, &MessageEntry{
+			SenderPublicKey:    pk1,
+			TstampNanos:        tstamp1,
+			RecipientPublicKey: pk2,
+			EncryptedText:      message1Str,
+		}))
+	// pk2 -> pk1: message2Str, tstamp2
+	require.NoError(DbPutMessageEntry(
+		db, &MessageEntry{
+			SenderPublicKey:    pk2,
+			TstampNanos:        tstamp2,
+			RecipientPublicKey: pk1,
+			EncryptedText:      message2Str,
+		}))
+	// pk3 -> pk1: message3Str, tstamp3
+	require.NoError(DbPutMessageEntry(
+		db, &MessageEntry{
+			SenderPublicKey:    pk3,
+			TstampNanos:        tstamp3,
+			RecipientPublicKey: pk1,
+			EncryptedText:      message3Str,
+		}))
+	// pk2 -> pk1: message4Str, tstamp4
+	require.NoError(DbPutMessageEntry(
+		db, &MessageEntry{
+			SenderPublicKey:    pk2,
+			TstampNanos:        tstamp4,
+			RecipientPublicKey: pk1,
+			EncryptedText:      message4Str,
+		}))
+	// pk1 -> pk3: message5Str, tstamp5
+	require.NoError(DbPutMessageEntry(
+		db, &MessageEntry{
+			SenderPublicKey:    pk1,
+			TstampNanos:        tstamp5,
+			RecipientPublicKey: pk3,
+			EncryptedText:      message5Str,
+		}))
+
+	// Define all the messages as they appear in the db.
+	message1 := &MessageEntry{
+		SenderPublicKey:    pk1,
+		RecipientPublicKey: pk2,
+		EncryptedText:      message1Str,
+		TstampNanos:        tstamp1,
+	}
+	message2 := &MessageEntry{
+		SenderPublicKey:    pk2,
+		RecipientPublicKey: pk1,
+		EncryptedText:      message2Str,
+		TstampNanos:        tstamp2,
+	}
+	message3 := &MessageEntry{
+		SenderPublicKey:    pk3,
+		RecipientPublicKey: pk1,
+		EncryptedText:      message3Str,
+		TstampNanos:        tstamp3,
+	}
+	message4 := &MessageEntry{
+		SenderPublicKey:    pk2,
+		RecipientPublicKey: pk1,
+		EncryptedText:      message4Str,
+		TstampNanos:        tstamp4,
+	}
+	message5 := &MessageEntry{
+		SenderPublicKey:    pk1,
+		RecipientPublicKey: pk3,
+		EncryptedText:      message5Str,
+		TstampNanos:        tstamp5,
+	}
+
+	// Fetch message3 directly using both public keys.
+	{
+		msg := DbGetMessageEntry(db, pk3, tstamp3)
+		require.Equal(message3, msg)
+	}
+	{
+		msg := DbGetMessageEntry(db, pk1, tstamp3)
+		require.Equal(message3, msg)
+	}
+
+	// Fetch all messages for pk1
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
+		require.NoError(err)
+
+		require.Equal([]*MessageEntry{
+			message1,
+			message2,
+			message3,
+			message4,
+			message5,
+		}, messages)
+	}
+
+	// Page through the messages for pk1 in both directions.
+	{
+		messages, err := DbGetPaginatedMessageEntriesForPublicKey(db, pk1, 0, 2, false)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message1, message2}, messages)
+		messages, err = DbGetPaginatedMessageEntriesForPublicKey(db, pk1, tstamp2, 2, false)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message3, message4}, messages)
+		messages, err = DbGetPaginatedMessageEntriesForPublicKey(db, pk1, tstamp4, 2, false)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message5}, messages)
+
+		messages, err = DbGetPaginatedMessageEntriesForPublicKey(db, pk1, 0, 2, true)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message5, message4}, messages)
+		messages, err = DbGetPaginatedMessageEntriesForPublicKey(db, pk1, tstamp4, 0, true)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message3, message2, message1}, messages)
+
+		// Timestamps in between messages work too.
+		messages, err = DbGetPaginatedMessageEntriesForPublicKey(db, pk1, tstamp3-1, 1, true)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message2}, messages)
+	}
+
+	// Fetch conversations. The order of the public keys doesn't matter.
+	{
+		messages, err := DbGetConversation(db, pk1, pk2, 0, 0)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message4, message2, message1}, messages)
+		messages, err = DbGetConversation(db, pk2, pk1, 1, tstamp4)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message2}, messages)
+		messages, err = DbGetConversation(db, pk3, pk1, 0, 0)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{message5, message3}, messages)
+		messages, err = DbGetConversation(db, pk2, pk3, 0, 0)
+		require.NoError(err)
+		require.Equal([]*MessageEntry{}, messages)
+	}
+
+	// Fetch all messages for pk2
+	// Fetch all messages for pk2
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
+		require.NoError(err)
+
+		require.Equal([]*MessageEntry{
+			message1,
+			message2,
+			message4,
+		}, messages)
+	}
+
+	// Fetch all messages for pk3
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk3)
+		require.NoError(err)
+
+		require.Equal([]*MessageEntry{
+			message3,
+			message5,
+		}, messages)
+	}
+
+	// Delete message3
+	require.NoError(DbDeleteMessageEntryMappings(db, pk1, tstamp3))
+
+	// Now all the messages returned should exclude message3
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
+		require.NoError(err)
+
+		require.Equal([]*MessageEntry{
+			message1,
+			message2,
+			message4,
+			message5,
+		}, messages)
+	}
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
+		require.NoError(err)
+
+		require.Equal([]*MessageEntry{
+			message1,
+			message2,
+			message4,
+		}, messages)
+	}
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk3)
+		require.NoError(err)
+
+		require.Equal([]*MessageEntry{
+			message5,
+		}, messages)
+	}
+
+	// Delete all remaining messages, sometimes using the recipient rather
+	// than the sender public key
+	require.NoError(DbDeleteMessageEntryMappings(db, pk2, tstamp1))
+	require.NoError(DbDeleteMessageEntryMappings(db, pk1, tstamp2))
+	require.NoError(DbDeleteMessageEntryMappings(db, pk2, tstamp4))
+	require.NoError(DbDeleteMessageEntryMappings(db, pk1, tstamp5))
+
+	// Now all public keys should have zero messages.
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
+		require.NoError(err)
+		require.Equal(0, len(messages))
+	}
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
+		require.NoError(err)
+		require.Equal(0, len(messages))
+	}
+	{
+		messages, err := DbGetMessageEntriesForPublicKey(db, pk3)
+		require.NoError(err)
+		require.Equal(0, len(messages))
+	}
+}
+
+func TestFollows(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	priv1, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk1 := priv1.PubKey().SerializeCompressed()
+
+	priv2, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk2 := priv2.PubKey().SerializeCompressed()
+
+	priv3, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(err)
+	pk3 := priv3.PubKey().SerializeCompressed()
+
+	// Get the PKIDs for all the public keys
+	pkid1 := DBGetPKIDEntryForPublicKey(db, pk1).PKID
+	pkid2 := DBGetPKIDEntryForPublicKey(db, pk2).PKID
+	pkid3 := DBGetPKIDEntryForPublicKey(db, pk3).PKID
+
+	// PK2 follows everyone. Make sure "get" works properly.
+	require.Nil(DbGetFollowerToFollowedMapping(db, pkid2, pkid1))
+	require.NoError(DbPutFollowMappings(db, pkid2, pkid1))
+	require.NotNil(DbGetFollowerToFollowedMapping(db, pkid2, pkid1))
+	require.Nil(DbGetFollowerToFollowedMapping(db, pkid2, pkid3))
+	require.NoError(DbPutFollowMappings(db, pkid2, pkid3))
+	require.NotNil(DbGetFollowerToFollowedMapping(db, pkid2, pkid3))
+
+	// pkid3 only follows pkid1. Make sure "get" works properly.
+	require.Nil(DbGetFollowerToFollowedMapping(db, pkid3, pkid1))
+	require.NoError(DbPutFollowMappings(db, pkid3, pkid1))
+	require.NotNil(DbGetFollowerToFollowedMapping(db, pkid3, pkid1))
+
+	// Check PK1's followers.
+	{
+		pubKeys, err := DbGetPubKeysFollowingYou(db, pk1)
+		require.NoError(err)
+		for i := 0; i < len(pubKeys); i++ {
+			require.Contains([][]byte{pk2, pk3}, pubKeys[i])
+		}
+	}
+
+	// Check PK1's follows.
+	{
+		pubKeys, err := DbGetPubKeysYouFollow(db, pk1)
+		require.NoError(err)
+		require.Equal(len(pubKeys), 0)
+	}
+
+	// Check PK2's followers.
+	{
+		pubKeys, err := DbGetPubKeysFollowingYou(db, pk2)
+		require.NoError(err)
+		require.Equal(len(pubKeys), 0)
+	}
+
+	// Check PK2's follows.
+	{
+		pubKeys, err := DbGetPubKeysYouFollow(db, pk2)
+		require.NoError(err)
+		for i := 0; i < len(pubKeys); i++ {
+			require.Contains([][]byte{pk1, pk3}, pubKeys[i])
+		}
+	}
+
+	// Check PK3's followers.
+	{
+		pubKeys, err := DbGetPubKeysFollowingYou(db, pk3)
+		require.NoError(err)
+		for i := 0; i < len(pubKeys); i++ {
+			require.Contains([][]byte{pk2}, pubKeys[i])
+		}
+	}
+
+	// Check PK3's follows.
+	{
+		pubKeys, err := DbGetPubKeysYouFollow(db, pk3)
+		require.NoError(err)
+		for i := 0; i < len(pubKeys); i++ {
+			require.Contains([][]byte{pk1, pk1}, pubKeys[i])
+		}
+	}
+
+	// Delete PK2's follows.
+	require.NoError(DbDeleteFollowMappings(db, pkid2, pkid1))
+	require.NoError(DbDeleteFollowMappings(db, pkid2, pkid3))
+
+	// Check PK2's follows were actually deleted.
+	{
+		pubKeys, err := DbGetPubKeysYouFollow(db, pk2)
+		require.NoError(err)
+		require.Equal(len(pubKeys), 0)
+	}
 }
 
-func TestPrivateMessages(t *testing.T) {
+func TestViewOverlayGetters(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 	_ = assert
@@ -203,211 +3844,637 @@ func TestPrivateMessages(t *testing.T) {
 	// Create a test db and clean up the files at the end.
 	db, dir := GetTestBadgerDb()
 	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
 
-	priv1, err := btcec.NewPrivateKey(btcec.S256())
-	require.NoError(err)
-	pk1 := priv1.PubKey().SerializeCompressed()
+	pkid1 := &PKID{1}
+	pkid2 := &PKID{2}
+	posterPubKey := pkid1[:]
+	dbPostHash := &BlockHash{1}
+	viewPostHash := &BlockHash{2}
 
-	priv2, err := btcec.NewPrivateKey(btcec.S256())
+	// Put a post, a profile, a follow, and a like in the db.
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash:        dbPostHash,
+		PosterPublicKey: posterPubKey,
+		Body:            []byte("db post"),
+	}, params))
+	require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+		PublicKey: pkid1[:],
+		Username:  []byte("dbname"),
+	}, pkid1, params))
+	require.NoError(DbPutFollowMappings(db, pkid1, pkid2))
+	require.NoError(DbPutLikeMappings(db, posterPubKey, *dbPostHash))
+
+	// With an empty view everything comes straight from the db.
+	utxoView, err := NewUtxoView(db, params, nil)
 	require.NoError(err)
-	pk2 := priv2.PubKey().SerializeCompressed()
+	postEntry := GetPostEntryFromPostHash(dbPostHash, utxoView)
+	require.NotNil(postEntry)
+	assert.Equal([]byte("db post"), postEntry.Body)
+	profileEntry := GetProfileEntryFromPKID(pkid1, utxoView)
+	require.NotNil(profileEntry)
+	assert.Equal([]byte("dbname"), profileEntry.Username)
+	assert.True(GetFollowExistsFromPKIDs(pkid1, pkid2, utxoView))
+	assert.False(GetFollowExistsFromPKIDs(pkid2, pkid1, utxoView))
+	assert.True(GetLikeExistsFromPublicKey(posterPubKey, dbPostHash, utxoView))
+	assert.Nil(GetPostEntryFromPostHash(viewPostHash, utxoView))
 
-	priv3, err := btcec.NewPrivateKey(btcec.S256())
+	// Nothing read through the overlay is cached in the view.
+	assert.Equal(0, len(utxoView.PostHashToPostEntry))
+	assert.Equal(0, len(utxoView.ProfilePKIDToProfileEntry))
+
+	// Deletions in the view shadow the db.
+	utxoView.PostHashToPostEntry[*dbPostHash] = &PostEntry{PostHash: dbPostHash, isDeleted: true}
+	utxoView.FollowKeyToFollowEntry[MakeFollowKey(pkid1, pkid2)] = &FollowEntry{
+		FollowerPKID: pkid1, FollowedPKID: pkid2, isDeleted: true}
+	utxoView.LikeKeyToLikeEntry[MakeLikeKey(posterPubKey, *dbPostHash)] = &LikeEntry{
+		LikerPubKey: posterPubKey, LikedPostHash: dbPostHash, isDeleted: true}
+	assert.Nil(GetPostEntryFromPostHash(dbPostHash, utxoView))
+	assert.False(GetFollowExistsFromPKIDs(pkid1, pkid2, utxoView))
+	assert.False(GetLikeExistsFromPublicKey(posterPubKey, dbPostHash, utxoView))
+
+	// Updates and additions in the view are visible before they're flushed.
+	utxoView.ProfilePKIDToProfileEntry[*pkid1] = &ProfileEntry{
+		PublicKey: pkid1[:], Username: []byte("viewname")}
+	utxoView.PostHashToPostEntry[*viewPostHash] = &PostEntry{
+		PostHash: viewPostHash, PosterPublicKey: posterPubKey, Body: []byte("view post")}
+	utxoView.FollowKeyToFollowEntry[MakeFollowKey(pkid2, pkid1)] = &FollowEntry{
+		FollowerPKID: pkid2, FollowedPKID: pkid1}
+	profileEntry = GetProfileEntryFromPKID(pkid1, utxoView)
+	require.NotNil(profileEntry)
+	assert.Equal([]byte("viewname"), profileEntry.Username)
+	postEntry = GetPostEntryFromPostHash(viewPostHash, utxoView)
+	require.NotNil(postEntry)
+	assert.Equal([]byte("view post"), postEntry.Body)
+	assert.True(GetFollowExistsFromPKIDs(pkid2, pkid1, utxoView))
+	assert.Nil(DBGetPostEntryByPostHash(db, viewPostHash))
+
+	// A deleted balance entry in the view reads as missing.
+	holderPKIDEntry := utxoView.GetPKIDForPublicKey(posterPubKey)
+	creatorPKIDEntry := utxoView.GetPKIDForPublicKey(pkid2[:])
+	require.NoError(DBPutCreatorCoinBalanceEntryMappings(db, &BalanceEntry{
+		HODLerPKID:   holderPKIDEntry.PKID,
+		CreatorPKID:  creatorPKIDEntry.PKID,
+		BalanceNanos: 10,
+	}, params))
+	balanceEntry, err := GetSingleBalanceEntryFromPublicKeys(posterPubKey, pkid2[:], utxoView)
 	require.NoError(err)
-	pk3 := priv3.PubKey().SerializeCompressed()
+	require.NotNil(balanceEntry)
+	assert.Equal(uint64(10), balanceEntry.BalanceNanos)
+	utxoView.HODLerPKIDCreatorPKIDToBalanceEntry[BalanceEntryMapKey{
+		HODLerPKID: *holderPKIDEntry.PKID, CreatorPKID: *creatorPKIDEntry.PKID}] = &BalanceEntry{
+		HODLerPKID: holderPKIDEntry.PKID, CreatorPKID: creatorPKIDEntry.PKID, isDeleted: true}
+	balanceEntry, err = GetSingleBalanceEntryFromPublicKeys(posterPubKey, pkid2[:], utxoView)
+	require.NoError(err)
+	assert.Nil(balanceEntry)
+}
 
-	tstamp1 := uint64(1)
-	tstamp2 := uint64(2)
-	tstamp3 := uint64(12345)
-	tstamp4 := uint64(time.Now().UnixNano())
-	tstamp5 := uint64(time.Now().UnixNano())
+func TestTimestampIndexQuarantine(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
 
-	message1Str := []byte("message1: abcdef")
-	message2Str := []byte("message2: ghi")
-	message3Str := []byte("message3: klmn\123\000\000\000_")
-	message4Str := append([]byte("message4: "), RandomBytes(100)...)
-	message5Str := append([]byte("message5: "), RandomBytes(123)...)
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
 
-	// pk1 -> pk2: message1Str, tstamp1
-	require.NoError(DbPutMessageEntry(
-		db, &MessageEntry{
+	blockTstampSecs := uint64(1600000000)
+	nowNanos := blockTstampSecs * uint64(time.Second)
+	farFutureNanos := nowNanos + 10*24*uint64(time.Hour)
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+
+	// The bound is the block's time plus the skew in the node config, not the
+	// node's clock.
+	var maxIndexedTstampNanos uint64
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		maxIndexedTstampNanos = DbGetMaxIndexedTstampNanosWithTxn(txn, blockTstampSecs)
+		return nil
+	}))
+	assert.Equal(nowNanos+MaxIndexedTimestampSkewSeconds*uint64(time.Second), maxIndexedTstampNanos)
+	// Nothing is quarantined before the chain has a tip.
+	assert.Equal(uint64(math.MaxUint64), DbGetMaxIndexedTstampNanosForTip(db))
+
+	// A post and a message from the far future are kept out of the time-ordered
+	// indexes, except for the message's per-public-key index, which is where
+	// it's stored.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := DBPutPostEntryMappingsWithTxn(txn, &PostEntry{
+			PostHash:        &BlockHash{1},
+			PosterPublicKey: pk1,
+			TimestampNanos:  nowNanos,
+		}, params, maxIndexedTstampNanos); err != nil {
+			return err
+		}
+		if err := DBPutPostEntryMappingsWithTxn(txn, &PostEntry{
+			PostHash:        &BlockHash{2},
+			PosterPublicKey: pk1,
+			TimestampNanos:  farFutureNanos,
+		}, params, maxIndexedTstampNanos); err != nil {
+			return err
+		}
+		return DbPutMessageEntryWithTxn(txn, &MessageEntry{
 			SenderPublicKey:    pk1,
-			TstampNanos:        tstamp1,
 			RecipientPublicKey: pk2,
-			EncryptedText:      message1Str,
-		}))
-	// pk2 -> pk1: message2Str, tstamp2
-	require.NoError(DbPutMessageEntry(
-		db, &MessageEntry{
-			SenderPublicKey:    pk2,
-			TstampNanos:        tstamp2,
-			RecipientPublicKey: pk1,
-			EncryptedText:      message2Str,
-		}))
-	// pk3 -> pk1: message3Str, tstamp3
-	require.NoError(DbPutMessageEntry(
-		db, &MessageEntry{
-			SenderPublicKey:    pk3,
-			TstampNanos:        tstamp3,
-			RecipientPublicKey: pk1,
-			EncryptedText:      message3Str,
-		}))
-	// pk2 -> pk1: message4Str, tstamp4
-	require.NoError(DbPutMessageEntry(
-		db, &MessageEntry{
-			SenderPublicKey:    pk2,
-			TstampNanos:        tstamp4,
-			RecipientPublicKey: pk1,
-			EncryptedText:      message4Str,
+			EncryptedText:      []byte("message"),
+			TstampNanos:        farFutureNanos,
+		}, maxIndexedTstampNanos)
+	}))
+	_, postHashes, _, err := DBGetAllPostsByTstamp(db, false /*fetchEntries*/)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{{1}}, postHashes)
+	messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
+	require.NoError(err)
+	assert.Equal(1, len(messages))
+	// Two post keys and the conversation key.
+	assert.Equal(3, DbGetNumQuarantinedTimestampIndexEntries(db))
+	messageEntry := DbGetMessageEntry(db, pk2, farFutureNanos)
+	require.NotNil(messageEntry)
+	assert.Equal([]byte("message"), messageEntry.EncryptedText)
+
+	// Simulate a post stored before timestamps were checked. The repair
+	// quarantines it the first time it runs and leaves the db alone after that.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_dbKeyForTstampPostHash(farFutureNanos, &BlockHash{3}), []byte{})
+	}))
+	numQuarantined, err := DbRepairTimestampIndexes(db, maxIndexedTstampNanos)
+	require.NoError(err)
+	assert.Equal(1, numQuarantined)
+	assert.Equal(4, DbGetNumQuarantinedTimestampIndexEntries(db))
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Set(_dbKeyForTstampPostHash(farFutureNanos, &BlockHash{5}), []byte{})
+	}))
+	numQuarantined, err = DbRepairTimestampIndexes(db, maxIndexedTstampNanos)
+	require.NoError(err)
+	assert.Equal(0, numQuarantined)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForTstampPostHash(farFutureNanos, &BlockHash{5}))
+	}))
+
+	// Nothing is restored until the chain catches up with the entries.
+	numRestored, err := DbRestoreQuarantinedTimestampIndexEntries(db, maxIndexedTstampNanos)
+	require.NoError(err)
+	assert.Equal(0, numRestored)
+	numRestored, err = DbRestoreQuarantinedTimestampIndexEntries(db, farFutureNanos)
+	require.NoError(err)
+	assert.Equal(4, numRestored)
+	assert.Equal(0, DbGetNumQuarantinedTimestampIndexEntries(db))
+	_, postHashes, _, err = DBGetAllPostsByTstamp(db, false /*fetchEntries*/)
+	require.NoError(err)
+	assert.Equal(3, len(postHashes))
+
+	// Entries quarantined from the per-public-key message index before it
+	// stopped being quarantined are restored no matter their timestamp.
+	messageKey := _dbKeyForMessageEntry(pk1, farFutureNanos)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		val, err := txn.Get(messageKey)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(_dbKeyForQuarantinedTimestampIndexEntry(messageKey), val); err != nil {
+			return err
+		}
+		return txn.Delete(messageKey)
+	}))
+	numRestored, err = DbRestoreQuarantinedTimestampIndexEntries(db, maxIndexedTstampNanos)
+	require.NoError(err)
+	assert.Equal(1, numRestored)
+	require.NotNil(DbGetMessageEntry(db, pk1, farFutureNanos))
+
+	// Deleting a quarantined entry removes it from the quarantine.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return DBPutPostEntryMappingsWithTxn(txn, &PostEntry{
+			PostHash:        &BlockHash{4},
+			PosterPublicKey: pk1,
+			TimestampNanos:  farFutureNanos,
+		}, params, maxIndexedTstampNanos)
+	}))
+	assert.Equal(2, DbGetNumQuarantinedTimestampIndexEntries(db))
+	require.NoError(DBDeletePostEntryMappings(db, &BlockHash{4}, params))
+	assert.Equal(0, DbGetNumQuarantinedTimestampIndexEntries(db))
+	require.NoError(DbDeleteMessageEntryMappings(db, pk1, farFutureNanos))
+	messages, err = DbGetMessageEntriesForPublicKey(db, pk2)
+	require.NoError(err)
+	assert.Equal(0, len(messages))
+
+	// Once there's a tip, the bound comes from its block.
+	chain, _, chainDb := NewLowDifficultyBlockchain()
+	tipTstampSecs := uint64(chain.BlockTip().Header.TstampSecs)
+	assert.Equal((tipTstampSecs+MaxIndexedTimestampSkewSeconds)*uint64(time.Second),
+		DbGetMaxIndexedTstampNanosForTip(chainDb))
+}
+
+func TestWalletBalanceIndex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+	putUtxo := func(index uint32, publicKey []byte, amountNanos uint64) {
+		utxoKey := &UtxoKey{TxID: BlockHash{1}, Index: index}
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return PutMappingsForUtxoWithTxn(txn, utxoKey, &UtxoEntry{
+				PublicKey:   publicKey,
+				AmountNanos: amountNanos,
+				UtxoKey:     utxoKey,
+			})
 		}))
-	// pk1 -> pk3: message5Str, tstamp5
-	require.NoError(DbPutMessageEntry(
-		db, &MessageEntry{
-			SenderPublicKey:    pk1,
-			TstampNanos:        tstamp5,
-			RecipientPublicKey: pk3,
-			EncryptedText:      message5Str,
+	}
+	deleteUtxo := func(index uint32) {
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return DeleteUnmodifiedMappingsForUtxoWithTxn(txn, &UtxoKey{TxID: BlockHash{1}, Index: index})
 		}))
-
-	// Define all the messages as they appear in the db.
-	message1 := &MessageEntry{
-		SenderPublicKey:    pk1,
-		RecipientPublicKey: pk2,
-		EncryptedText:      message1Str,
-		TstampNanos:        tstamp1,
 	}
-	message2 := &MessageEntry{
-		SenderPublicKey:    pk2,
-		RecipientPublicKey: pk1,
-		EncryptedText:      message2Str,
-		TstampNanos:        tstamp2,
+	sumUtxos := func(publicKey []byte) uint64 {
+		utxoEntries, err := DbGetUtxosForPubKey(publicKey, db)
+		require.NoError(err)
+		total := uint64(0)
+		for _, utxoEntry := range utxoEntries {
+			total += utxoEntry.AmountNanos
+		}
+		return total
 	}
-	message3 := &MessageEntry{
-		SenderPublicKey:    pk3,
-		RecipientPublicKey: pk1,
-		EncryptedText:      message3Str,
-		TstampNanos:        tstamp3,
+
+	putUtxo(0, pk1, 100)
+	putUtxo(1, pk1, 20)
+	putUtxo(2, pk2, 3)
+	assert.Equal(uint64(120), DbGetBalanceForPublicKey(db, pk1))
+	assert.Equal(uint64(3), DbGetBalanceForPublicKey(db, pk2))
+
+	// Spending a UTXO takes it out of the balance and overwriting one replaces
+	// its amount, even when it moves to another public key.
+	deleteUtxo(0)
+	putUtxo(2, pk1, 7)
+	assert.Equal(uint64(27), DbGetBalanceForPublicKey(db, pk1))
+	assert.Equal(uint64(0), DbGetBalanceForPublicKey(db, pk2))
+	assert.Equal(sumUtxos(pk1), DbGetBalanceForPublicKey(db, pk1))
+	assert.Equal(sumUtxos(pk2), DbGetBalanceForPublicKey(db, pk2))
+
+	// Deleting a UTXO that isn't there doesn't change anything.
+	deleteUtxo(0)
+	assert.Equal(uint64(27), DbGetBalanceForPublicKey(db, pk1))
+
+	// The backfill rebuilds the balances when they're missing.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		return txn.Delete(_dbKeyForPublicKeyBalance(pk1))
+	}))
+	assert.Equal(uint64(0), DbGetBalanceForPublicKey(db, pk1))
+	numBalances, err := DbBackfillWalletBalanceIndex(db)
+	require.NoError(err)
+	assert.Equal(1, numBalances)
+	assert.Equal(uint64(27), DbGetBalanceForPublicKey(db, pk1))
+
+	// It only runs once.
+	numBalances, err = DbBackfillWalletBalanceIndex(db)
+	require.NoError(err)
+	assert.Equal(0, numBalances)
+}
+
+func TestBalanceSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pk2 := append([]byte{3}, make([]byte, 32)...)
+	for ii, utxoEntry := range []*UtxoEntry{
+		{PublicKey: pk1, AmountNanos: 10},
+		{PublicKey: pk2, AmountNanos: 5},
+	} {
+		utxoEntry.UtxoKey = &UtxoKey{TxID: BlockHash{1}, Index: uint32(ii)}
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return PutMappingsForUtxoWithTxn(txn, utxoEntry.UtxoKey, utxoEntry)
+		}))
 	}
-	message4 := &MessageEntry{
-		SenderPublicKey:    pk2,
-		RecipientPublicKey: pk1,
-		EncryptedText:      message4Str,
-		TstampNanos:        tstamp4,
+	balanceAt := func(publicKey []byte, blockHeight uint32) uint64 {
+		balanceNanos, err := DbGetBalanceAtHeight(db, publicKey, blockHeight)
+		require.NoError(err)
+		return balanceNanos
 	}
-	message5 := &MessageEntry{
-		SenderPublicKey:    pk1,
-		RecipientPublicKey: pk3,
-		EncryptedText:      message5Str,
-		TstampNanos:        tstamp5,
+	numSnapshots := func() int {
+		keys, _ := _enumerateKeysForPrefix(db, _PrefixPublicKeyHeightToBalanceSnapshot)
+		return len(keys)
+	}
+	flushView := func(utxoView *UtxoView) {
+		require.NoError(db.Update(utxoView._flushBalanceSnapshotsToDbWithTxn))
 	}
 
-	// Fetch message3 directly using both public keys.
-	{
-		msg := DbGetMessageEntry(db, pk3, tstamp3)
-		require.Equal(message3, msg)
-	}
-	{
-		msg := DbGetMessageEntry(db, pk1, tstamp3)
-		require.Equal(message3, msg)
+	// Nothing can be answered until the snapshots are seeded.
+	_, err := DbGetBalanceAtHeight(db, pk1, 10)
+	require.Error(err)
+	numSeeded, err := DbInitBalanceSnapshots(db, true, 10)
+	require.NoError(err)
+	assert.Equal(2, numSeeded)
+	numSeeded, err = DbInitBalanceSnapshots(db, true, 10)
+	require.NoError(err)
+	assert.Equal(0, numSeeded)
+
+	assert.Equal(uint64(10), balanceAt(pk1, 10))
+	assert.Equal(uint64(5), balanceAt(pk2, 10))
+	assert.Equal(uint64(10), balanceAt(pk1, 100))
+	_, err = DbGetBalanceAtHeight(db, pk1, 9)
+	require.Error(err)
+
+	// A block that moves pk1's UTXO and gives pk2 a new one records both
+	// balances at its height without touching the earlier ones.
+	utxoView, err := NewUtxoView(db, params, nil)
+	require.NoError(err)
+	spendOp, err := utxoView._spendUtxo(&UtxoKey{TxID: BlockHash{1}, Index: 0})
+	require.NoError(err)
+	addOp, err := utxoView._addUtxo(&UtxoEntry{
+		PublicKey:   pk2,
+		AmountNanos: 4,
+		UtxoKey:     &UtxoKey{TxID: BlockHash{2}, Index: 0},
+	})
+	require.NoError(err)
+	utxoOps := [][]*UtxoOperation{{spendOp, addOp}}
+	require.NoError(utxoView._setBalanceSnapshotsForBlock(11, utxoOps))
+	flushView(utxoView)
+	assert.Equal(uint64(0), balanceAt(pk1, 11))
+	assert.Equal(uint64(9), balanceAt(pk2, 11))
+	assert.Equal(uint64(10), balanceAt(pk1, 10))
+	assert.Equal(uint64(5), balanceAt(pk2, 10))
+	assert.Equal(4, numSnapshots())
+
+	// Disconnecting the block drops its snapshots.
+	utxoView, err = NewUtxoView(db, params, nil)
+	require.NoError(err)
+	utxoView._deleteBalanceSnapshotsForBlock(11, utxoOps)
+	flushView(utxoView)
+	assert.Equal(uint64(10), balanceAt(pk1, 11))
+	assert.Equal(uint64(5), balanceAt(pk2, 11))
+	assert.Equal(2, numSnapshots())
+
+	// Disconnecting the block the snapshots were seeded at stops them until
+	// they're seeded again.
+	utxoView, err = NewUtxoView(db, params, nil)
+	require.NoError(err)
+	utxoView._deleteBalanceSnapshotsForBlock(10, utxoOps)
+	flushView(utxoView)
+	_, err = DbGetBalanceAtHeight(db, pk1, 10)
+	require.Error(err)
+	numSeeded, err = DbInitBalanceSnapshots(db, true, 9)
+	require.NoError(err)
+	assert.Equal(2, numSeeded)
+	assert.Equal(2, numSnapshots())
+	assert.Equal(uint64(10), balanceAt(pk1, 9))
+
+	// Turning them off deletes them.
+	numSeeded, err = DbInitBalanceSnapshots(db, false, 9)
+	require.NoError(err)
+	assert.Equal(0, numSeeded)
+	assert.Equal(0, numSnapshots())
+	_, err = DbGetBalanceAtHeight(db, pk1, 9)
+	require.Error(err)
+}
+
+func TestTxnWriter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Open a db with a small memtable so a txn can only hold a small number of
+	// writes.
+	dir, err := ioutil.TempDir("", "badgerdb")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	opts := badger.DefaultOptions(dir)
+	opts.MemTableSize = 1 << 20
+	opts.ValueThreshold = 1 << 10
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	require.NoError(err)
+	defer db.Close()
+
+	numKeys := 5000
+	keyPrefix := []byte("key-")
+	countKey := []byte("count")
+	keyForIndex := func(ii int) []byte {
+		return append(append([]byte{}, keyPrefix...), EncodeUint64(uint64(ii))...)
 	}
+	val := bytes.Repeat([]byte{1}, 100)
 
-	// Fetch all messages for pk1
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
-		require.NoError(err)
+	// Writing everything in one txn is too big.
+	err = DbUpdate(db, func(txn KVTxn) error {
+		for ii := 0; ii < numKeys; ii++ {
+			if err := txn.Set(keyForIndex(ii), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.Equal(badger.ErrTxnTooBig, err)
 
-		require.Equal([]*MessageEntry{
-			message1,
-			message2,
-			message3,
-			message4,
-			message5,
-		}, messages)
-	}
+	// The TxnWriter splits it up. Each write also bumps a count, which would
+	// come out too high if the writes redone when a txn is split were counted
+	// twice.
+	err = DbUpdateWithTxnWriter(db, func(txnWriter *TxnWriter) error {
+		for ii := 0; ii < numKeys; ii++ {
+			key := keyForIndex(ii)
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				if err := txn.Set(key, val); err != nil {
+					return err
+				}
+				return _dbAddToCountWithTxn(txn, countKey, 1)
+			}); err != nil {
+				return err
+			}
+		}
+		assert.True(txnWriter.NumCommits() > 0)
+		return nil
+	})
+	require.NoError(err)
+	keys, _ := _enumerateKeysForPrefix(db, keyPrefix)
+	assert.Equal(numKeys, len(keys))
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		assert.Equal(uint64(numKeys), _dbGetCountWithTxn(txn, countKey))
+		return nil
+	}))
 
-	// Fetch all messages for pk2
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
-		require.NoError(err)
+	// A single write that's too big on its own can't be split up.
+	err = DbUpdateWithTxnWriter(db, func(txnWriter *TxnWriter) error {
+		return txnWriter.Write(func(txn KVTxn) error {
+			for ii := 0; ii < numKeys; ii++ {
+				if err := txn.Set(keyForIndex(ii), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	require.Error(err)
+	assert.True(errors.Is(err, badger.ErrTxnTooBig))
 
-		require.Equal([]*MessageEntry{
-			message1,
-			message2,
-			message4,
-		}, messages)
-	}
+	// Nothing is written when the update fails before anything was committed.
+	discardedKey := []byte("discarded")
+	err = DbUpdateWithTxnWriter(db, func(txnWriter *TxnWriter) error {
+		require.NoError(txnWriter.Set(discardedKey, val))
+		return errors.New("failed")
+	})
+	require.Error(err)
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		_, err := txn.Get(discardedKey)
+		assert.Equal(ErrKVKeyNotFound, err)
+		return nil
+	}))
+}
 
-	// Fetch all messages for pk3
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk3)
-		require.NoError(err)
+func TestDbWriteBatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
 
-		require.Equal([]*MessageEntry{
-			message3,
-			message5,
-		}, messages)
-	}
+	// Open a db with a small memtable so a txn can only hold a small number of
+	// writes.
+	dir, err := ioutil.TempDir("", "badgerdb")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	opts := badger.DefaultOptions(dir)
+	opts.MemTableSize = 1 << 20
+	opts.ValueThreshold = 1 << 10
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	require.NoError(err)
+	defer db.Close()
 
-	// Delete message3
-	require.NoError(DbDeleteMessageEntryMappings(db, pk1, tstamp3))
+	numKeys := 5000
+	keyPrefix := []byte("key-")
+	val := bytes.Repeat([]byte{1}, 100)
 
-	// Now all the messages returned should exclude message3
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
-		require.NoError(err)
+	// The write batch commits as it fills up and reports its progress every
+	// 1000 writes and once more at the end.
+	progress := []uint64{}
+	err = DbUpdateWithWriteBatch(db, 1000, func(numWrites uint64) {
+		progress = append(progress, numWrites)
+	}, func(dbWriteBatch *DbWriteBatch) error {
+		for ii := 0; ii < numKeys; ii++ {
+			key := append(append([]byte{}, keyPrefix...), EncodeUint64(uint64(ii))...)
+			if err := dbWriteBatch.Set(key, val); err != nil {
+				return err
+			}
+		}
+		assert.Equal(uint64(numKeys), dbWriteBatch.NumWrites())
+		return nil
+	})
+	require.NoError(err)
+	assert.Equal([]uint64{1000, 2000, 3000, 4000, 5000, 5000}, progress)
+	keys, _ := _enumerateKeysForPrefix(db, keyPrefix)
+	assert.Equal(numKeys, len(keys))
 
-		require.Equal([]*MessageEntry{
-			message1,
-			message2,
-			message4,
-			message5,
-		}, messages)
+	// A mempool dump goes through a write batch too.
+	mempoolTxns := []*MempoolTx{}
+	for ii := 0; ii < 3; ii++ {
+		txn := &MsgBitCloutTxn{
+			TxnMeta:   &BasicTransferMetadata{},
+			ExtraData: map[string][]byte{"index": UintToBuf(uint64(ii))},
+		}
+		mempoolTxns = append(mempoolTxns, &MempoolTx{
+			Tx:    txn,
+			Hash:  txn.Hash(),
+			Added: time.Unix(int64(ii), 0),
+		})
 	}
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
-		require.NoError(err)
-
-		require.Equal([]*MessageEntry{
-			message1,
-			message2,
-			message4,
-		}, messages)
+	require.NoError(FlushMempoolToDb(db, mempoolTxns, 0, nil))
+	dumpedTxns, err := DbGetAllMempoolTxnsSortedByTimeAdded(db)
+	require.NoError(err)
+	require.Equal(len(mempoolTxns), len(dumpedTxns))
+	for ii, mempoolTx := range mempoolTxns {
+		assert.Equal(mempoolTx.Hash, dumpedTxns[ii].Hash())
 	}
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk3)
-		require.NoError(err)
+}
 
-		require.Equal([]*MessageEntry{
-			message5,
-		}, messages)
-	}
+func TestMempoolTxnsKeyedByHash(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
 
-	// Delete all remaining messages, sometimes using the recipient rather
-	// than the sender public key
-	require.NoError(DbDeleteMessageEntryMappings(db, pk2, tstamp1))
-	require.NoError(DbDeleteMessageEntryMappings(db, pk1, tstamp2))
-	require.NoError(DbDeleteMessageEntryMappings(db, pk2, tstamp4))
-	require.NoError(DbDeleteMessageEntryMappings(db, pk1, tstamp5))
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
 
-	// Now all public keys should have zero messages.
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk1)
-		require.NoError(err)
-		require.Equal(0, len(messages))
-	}
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk2)
-		require.NoError(err)
-		require.Equal(0, len(messages))
+	makeMempoolTx := func(index uint64, added int64) *MempoolTx {
+		txn := &MsgBitCloutTxn{
+			TxnMeta:   &BasicTransferMetadata{},
+			ExtraData: map[string][]byte{"index": UintToBuf(index)},
+		}
+		return &MempoolTx{Tx: txn, Hash: txn.Hash(), Added: time.Unix(added, 0)}
 	}
-	{
-		messages, err := DbGetMessageEntriesForPublicKey(db, pk3)
+	txn0 := makeMempoolTx(0, 3)
+	txn1 := makeMempoolTx(1, 1)
+	txn2 := makeMempoolTx(2, 2)
+
+	// A txn that's in the flush twice is only written once, with the earliest
+	// time it was added, and the txns come back in the order they were added.
+	txn0Again := &MempoolTx{Tx: txn0.Tx, Hash: txn0.Hash, Added: time.Unix(4, 0)}
+	require.NoError(FlushMempoolToDb(db, []*MempoolTx{txn0, txn1, txn0Again, txn2}, 0, nil))
+	keys, _ := _enumerateKeysForPrefix(db, _PrefixMempoolTxnHashToMsgBitCloutTxn)
+	assert.Equal(3, len(keys))
+	dumpedTxns, err := DbGetAllMempoolTxnsSortedByTimeAdded(db)
+	require.NoError(err)
+	require.Equal(3, len(dumpedTxns))
+	assert.Equal(txn1.Hash, dumpedTxns[0].Hash())
+	assert.Equal(txn2.Hash, dumpedTxns[1].Hash())
+	assert.Equal(txn0.Hash, dumpedTxns[2].Hash())
+
+	// Flushing the same txns again doesn't add keys and a delete finds the txn.
+	require.NoError(FlushMempoolToDb(db, []*MempoolTx{txn0Again, txn1, txn2}, 0, nil))
+	keys, _ = _enumerateKeysForPrefix(db, _PrefixMempoolTxnHashToMsgBitCloutTxn)
+	assert.Equal(3, len(keys))
+	require.NoError(DbDeleteMempoolTxn(db, txn1))
+	assert.Nil(DbGetMempoolTxn(db, txn1))
+	assert.Equal(txn2.Hash, DbGetMempoolTxn(db, txn2).Hash())
+	require.NoError(DbDeleteAllMempoolTxns(db))
+
+	// Txns keyed by <time added, txn hash> are rekeyed by hash. A txn that was
+	// stored twice keeps the earliest time it was added.
+	putOldKey := func(mempoolTx *MempoolTx) {
+		key := append([]byte{}, _PrefixMempoolTxnHashToMsgBitCloutTxn...)
+		key = append(key, EncodeUint64(uint64(mempoolTx.Added.UnixNano()))...)
+		key = append(key, mempoolTx.Hash[:]...)
+		txnBytes, err := mempoolTx.Tx.ToBytes(false /*preSignature*/)
 		require.NoError(err)
-		require.Equal(0, len(messages))
+		require.NoError(DbUpdate(db, func(txn KVTxn) error {
+			return txn.Set(key, txnBytes)
+		}))
 	}
+	putOldKey(txn0Again)
+	putOldKey(txn0)
+	putOldKey(txn1)
+	putOldKey(txn2)
+	numKeys, err := DbMigrateMempoolTxnsToHashKeys(db)
+	require.NoError(err)
+	assert.Equal(4, numKeys)
+	keys, _ = _enumerateKeysForPrefix(db, _PrefixMempoolTxnHashToMsgBitCloutTxn)
+	assert.Equal(3, len(keys))
+	dumpedTxns, err = DbGetAllMempoolTxnsSortedByTimeAdded(db)
+	require.NoError(err)
+	require.Equal(3, len(dumpedTxns))
+	assert.Equal(txn1.Hash, dumpedTxns[0].Hash())
+	assert.Equal(txn2.Hash, dumpedTxns[1].Hash())
+	assert.Equal(txn0.Hash, dumpedTxns[2].Hash())
+	numKeys, err = DbMigrateMempoolTxnsToHashKeys(db)
+	require.NoError(err)
+	assert.Equal(0, numKeys)
 }
 
-func TestFollows(t *testing.T) {
+func TestDbEntryCache(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 	_ = assert
@@ -416,95 +4483,340 @@ func TestFollows(t *testing.T) {
 	// Create a test db and clean up the files at the end.
 	db, dir := GetTestBadgerDb()
 	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
 
-	priv1, err := btcec.NewPrivateKey(btcec.S256())
-	require.NoError(err)
-	pk1 := priv1.PubKey().SerializeCompressed()
+	SetDbCacheConfig(&DbCacheConfig{MaxProfileEntries: 2, MaxPostEntries: 1, MaxPKIDEntries: 2})
+	defer SetDbCacheConfig(&DbCacheConfig{})
+	statsForCache := func(name string) *DbCacheStats {
+		for _, stats := range GetDbCacheStats() {
+			if stats.Name == name {
+				return stats
+			}
+		}
+		return nil
+	}
 
-	priv2, err := btcec.NewPrivateKey(btcec.S256())
-	require.NoError(err)
-	pk2 := priv2.PubKey().SerializeCompressed()
+	// The second read comes from the cache, and changing what's returned doesn't
+	// change what's cached.
+	pk := append([]byte{2}, make([]byte, 32)...)
+	pkid := PublicKeyToPKID(pk)
+	require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+		PublicKey: pk, Username: []byte("alice"), Description: []byte("first")}, pkid, params))
+	profileEntry := DBGetProfileEntryForPKID(db, pkid)
+	require.NotNil(profileEntry)
+	profileEntry.Description = []byte("changed")
+	profileEntry = DBGetProfileEntryForPKID(db, pkid)
+	require.NotNil(profileEntry)
+	assert.Equal([]byte("first"), profileEntry.Description)
+	assert.Equal(uint64(1), statsForCache("profiles").NumHits)
+	assert.Equal(uint64(1), statsForCache("profiles").NumMisses)
 
-	priv3, err := btcec.NewPrivateKey(btcec.S256())
-	require.NoError(err)
-	pk3 := priv3.PubKey().SerializeCompressed()
+	// Neither does changing the slices and pointers in what's returned in place.
+	profileEntry.Description[0] = 'F'
+	profileEntry.Username[0] = 'A'
+	profileEntry.StakeEntry.StakeList = append(profileEntry.StakeEntry.StakeList, &SingleStake{})
+	profileEntry = DBGetProfileEntryForPKID(db, pkid)
+	require.NotNil(profileEntry)
+	assert.Equal([]byte("first"), profileEntry.Description)
+	assert.Equal([]byte("alice"), profileEntry.Username)
+	assert.Equal(0, len(profileEntry.StakeEntry.StakeList))
+	profileEntries := DBGetProfileEntriesForPKIDs(db, []*PKID{pkid})
+	require.NotNil(profileEntries[0])
+	profileEntries[0].Description[0] = 'F'
+	assert.Equal([]byte("first"), DBGetProfileEntryForPKID(db, pkid).Description)
 
-	// Get the PKIDs for all the public keys
-	pkid1 := DBGetPKIDEntryForPublicKey(db, pk1).PKID
-	pkid2 := DBGetPKIDEntryForPublicKey(db, pk2).PKID
-	pkid3 := DBGetPKIDEntryForPublicKey(db, pk3).PKID
+	// A put replaces the cached entry.
+	require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+		PublicKey: pk, Username: []byte("alice"), Description: []byte("second")}, pkid, params))
+	profileEntry = DBGetProfileEntryForPKID(db, pkid)
+	require.NotNil(profileEntry)
+	assert.Equal([]byte("second"), profileEntry.Description)
 
-	// PK2 follows everyone. Make sure "get" works properly.
-	require.Nil(DbGetFollowerToFollowedMapping(db, pkid2, pkid1))
-	require.NoError(DbPutFollowMappings(db, pkid2, pkid1))
-	require.NotNil(DbGetFollowerToFollowedMapping(db, pkid2, pkid1))
-	require.Nil(DbGetFollowerToFollowedMapping(db, pkid2, pkid3))
-	require.NoError(DbPutFollowMappings(db, pkid2, pkid3))
-	require.NotNil(DbGetFollowerToFollowedMapping(db, pkid2, pkid3))
+	// An entry read before a write commits isn't cached.
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := DBPutProfileEntryMappingsWithTxn(txn, &ProfileEntry{
+			PublicKey: pk, Username: []byte("alice"), Description: []byte("third")}, pkid, params); err != nil {
+			return err
+		}
+		profileEntry := DBGetProfileEntryForPKID(db, pkid)
+		require.NotNil(profileEntry)
+		assert.Equal([]byte("second"), profileEntry.Description)
+		return nil
+	}))
+	DbCacheFinishWrites()
+	profileEntry = DBGetProfileEntryForPKID(db, pkid)
+	require.NotNil(profileEntry)
+	assert.Equal([]byte("third"), profileEntry.Description)
 
-	// pkid3 only follows pkid1. Make sure "get" works properly.
-	require.Nil(DbGetFollowerToFollowedMapping(db, pkid3, pkid1))
-	require.NoError(DbPutFollowMappings(db, pkid3, pkid1))
-	require.NotNil(DbGetFollowerToFollowedMapping(db, pkid3, pkid1))
+	// A delete removes it.
+	require.NoError(DBDeleteProfileEntryMappings(db, pkid, params))
+	assert.Nil(DBGetProfileEntryForPKID(db, pkid))
 
-	// Check PK1's followers.
-	{
-		pubKeys, err := DbGetPubKeysFollowingYou(db, pk1)
-		require.NoError(err)
-		for i := 0; i < len(pubKeys); i++ {
-			require.Contains([][]byte{pk2, pk3}, pubKeys[i])
+	// Entries are only returned for the db they were read from.
+	db2, dir2 := GetTestBadgerDb()
+	defer os.RemoveAll(dir2)
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash: &BlockHash{1}, PosterPublicKey: pk, Body: []byte("post 1"),
+		StakeEntry: NewStakeEntry()}, params))
+	require.NotNil(DBGetPostEntryByPostHash(db, &BlockHash{1}))
+	assert.Nil(DBGetPostEntryByPostHash(db2, &BlockHash{1}))
+	postEntry := DBGetPostEntryByPostHash(db, &BlockHash{1})
+	require.NotNil(postEntry)
+	postEntry.Body[0] = 'P'
+	postEntry.PostHash[0] = 9
+	postEntry = DBGetPostEntriesByPostHashes(db, []*BlockHash{{1}})[0]
+	require.NotNil(postEntry)
+	assert.Equal([]byte("post 1"), postEntry.Body)
+	assert.Equal(&BlockHash{1}, postEntry.PostHash)
+
+	// The least recently used entry is dropped once the cache is full.
+	require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+		PostHash: &BlockHash{2}, PosterPublicKey: pk, Body: []byte("post 2"),
+		StakeEntry: NewStakeEntry()}, params))
+	require.NotNil(DBGetPostEntryByPostHash(db, &BlockHash{1}))
+	require.NotNil(DBGetPostEntryByPostHash(db, &BlockHash{2}))
+	assert.Equal(1, statsForCache("posts").NumEntries)
+	numHits := statsForCache("posts").NumHits
+	require.NotNil(DBGetPostEntryByPostHash(db, &BlockHash{2}))
+	require.NotNil(DBGetPostEntryByPostHash(db, &BlockHash{1}))
+	assert.Equal(numHits+1, statsForCache("posts").NumHits)
+
+	// Caching starts again once a TxnWriter is done, which is how views are flushed.
+	assert.Equal(pkid, DBGetPKIDEntryForPublicKey(db, pk).PKID)
+	otherPKID := PublicKeyToPKID(append([]byte{3}, make([]byte, 32)...))
+	require.NoError(DbUpdateWithTxnWriter(db, func(txnWriter *TxnWriter) error {
+		return txnWriter.Write(func(txn KVTxn) error {
+			return DBPutPKIDMappingsWithTxn(txn, pk, &PKIDEntry{PKID: otherPKID, PublicKey: pk}, params)
+		})
+	}))
+	assert.Equal(otherPKID, DBGetPKIDEntryForPublicKey(db, pk).PKID)
+	numHits = statsForCache("pkids").NumHits
+	assert.Equal(otherPKID, DBGetPKIDEntryForPublicKey(db, pk).PKID)
+	assert.Equal(numHits+1, statsForCache("pkids").NumHits)
+	pkidEntry := DBGetPKIDEntryForPublicKey(db, pk)
+	pkidEntry.PKID[0] = 0xff
+	pkidEntry.PublicKey[0] = 0xff
+	assert.Equal(otherPKID, DBGetPKIDEntryForPublicKey(db, pk).PKID)
+	assert.Equal(pk, DBGetPKIDEntryForPublicKey(db, pk).PublicKey)
+}
+
+func TestPublicKeyForPKIDCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	SetDbCacheConfig(&DbCacheConfig{MaxPKIDEntries: 10})
+	defer SetDbCacheConfig(&DbCacheConfig{})
+	pkidCacheHits := func() uint64 {
+		for _, stats := range GetDbCacheStats() {
+			if stats.Name == "pkids" {
+				return stats.NumHits
+			}
 		}
+		return 0
+	}
+	putPKIDMapping := func(publicKey []byte, pkid *PKID) {
+		require.NoError(DbUpdateWithTxnWriter(db, func(txnWriter *TxnWriter) error {
+			return txnWriter.Write(func(txn KVTxn) error {
+				return DBPutPKIDMappingsWithTxn(txn, publicKey, &PKIDEntry{PKID: pkid, PublicKey: publicKey}, params)
+			})
+		}))
 	}
 
-	// Check PK1's follows.
-	{
-		pubKeys, err := DbGetPubKeysYouFollow(db, pk1)
-		require.NoError(err)
-		require.Equal(len(pubKeys), 0)
+	// The second lookup comes from the cache, and changing what's returned
+	// doesn't change what's cached.
+	pk1 := append([]byte{2}, make([]byte, 32)...)
+	pkid := PublicKeyToPKID(append([]byte{3}, make([]byte, 32)...))
+	putPKIDMapping(pk1, pkid)
+	publicKey := DBGetPublicKeyForPKID(db, pkid)
+	assert.Equal(pk1, publicKey)
+	publicKey[1] = 0xff
+	assert.Equal(pk1, DBGetPublicKeyForPKID(db, pkid))
+	assert.Equal(uint64(1), pkidCacheHits())
+
+	// Pointing the PKID at another public key replaces the cached one.
+	pk2 := append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)
+	putPKIDMapping(pk2, pkid)
+	assert.Equal(pk2, DBGetPublicKeyForPKID(db, pkid))
+
+	// Follows are looked up through the cache.
+	followerPk := append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)
+	require.NoError(DbPutFollowMappings(db, PublicKeyToPKID(followerPk), pkid))
+	followPubKeys, err := DbGetPubKeysYouFollow(db, followerPk)
+	require.NoError(err)
+	assert.Equal([][]byte{pk2}, followPubKeys)
+	numHits := pkidCacheHits()
+	followPubKeys, err = DbGetPubKeysYouFollow(db, followerPk)
+	require.NoError(err)
+	assert.Equal([][]byte{pk2}, followPubKeys)
+	assert.Equal(numHits+2, pkidCacheHits())
+}
+
+func TestBulkEntryGetters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	params := &BitCloutTestnetParams
+
+	pk := append([]byte{2}, make([]byte, 32)...)
+	for ii := byte(1); ii <= 2; ii++ {
+		require.NoError(DBPutPostEntryMappings(db, &PostEntry{
+			PostHash: &BlockHash{ii}, PosterPublicKey: pk, TimestampNanos: uint64(ii),
+			StakeEntry: NewStakeEntry()}, params))
+		pkid := PublicKeyToPKID(append([]byte{2}, bytes.Repeat([]byte{ii}, 32)...))
+		require.NoError(DBPutProfileEntryMappings(db, &ProfileEntry{
+			PublicKey: pkid[:], Username: []byte{'a' + ii}}, pkid, params))
 	}
 
-	// Check PK2's followers.
-	{
-		pubKeys, err := DbGetPubKeysFollowingYou(db, pk2)
-		require.NoError(err)
-		require.Equal(len(pubKeys), 0)
+	// Entries come back in the order asked for with nils for the missing ones,
+	// whether or not some of them are cached.
+	checkEntries := func() {
+		postEntries := DBGetPostEntriesByPostHashes(
+			db, []*BlockHash{{2}, {3}, {1}})
+		require.Equal(3, len(postEntries))
+		assert.Equal(BlockHash{2}, *postEntries[0].PostHash)
+		assert.Nil(postEntries[1])
+		assert.Equal(BlockHash{1}, *postEntries[2].PostHash)
+
+		profileEntries := DBGetProfileEntriesForPKIDs(db, []*PKID{
+			PublicKeyToPKID(append([]byte{2}, bytes.Repeat([]byte{3}, 32)...)),
+			PublicKeyToPKID(append([]byte{2}, bytes.Repeat([]byte{2}, 32)...)),
+			PublicKeyToPKID(append([]byte{2}, bytes.Repeat([]byte{1}, 32)...)),
+		})
+		require.Equal(3, len(profileEntries))
+		assert.Nil(profileEntries[0])
+		assert.Equal([]byte("c"), profileEntries[1].Username)
+		assert.Equal([]byte("b"), profileEntries[2].Username)
 	}
+	checkEntries()
 
-	// Check PK2's follows.
-	{
-		pubKeys, err := DbGetPubKeysYouFollow(db, pk2)
-		require.NoError(err)
-		for i := 0; i < len(pubKeys); i++ {
-			require.Contains([][]byte{pk1, pk3}, pubKeys[i])
+	SetDbCacheConfig(&DbCacheConfig{MaxProfileEntries: 10, MaxPostEntries: 10})
+	defer SetDbCacheConfig(&DbCacheConfig{})
+	require.NotNil(DBGetPostEntryByPostHash(db, &BlockHash{1}))
+	require.NotNil(DBGetProfileEntryForPKID(
+		db, PublicKeyToPKID(append([]byte{2}, bytes.Repeat([]byte{2}, 32)...))))
+	checkEntries()
+	checkEntries()
+	for _, stats := range GetDbCacheStats() {
+		if stats.Name == "posts" || stats.Name == "profiles" {
+			assert.Equal(2, stats.NumEntries)
 		}
 	}
 
-	// Check PK3's followers.
-	{
-		pubKeys, err := DbGetPubKeysFollowingYou(db, pk3)
-		require.NoError(err)
-		for i := 0; i < len(pubKeys); i++ {
-			require.Contains([][]byte{pk2}, pubKeys[i])
+	// Nothing asked for, nothing returned.
+	assert.Equal(0, len(DBGetPostEntriesByPostHashes(db, nil)))
+	assert.Equal(0, len(DBGetProfileEntriesForPKIDs(db, nil)))
+}
+
+func TestGetBlockIndexParallel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	// Make a main chain with a one-block side chain off of every fifth block.
+	expectedParents := make(map[BlockHash]*BlockHash)
+	makeNode := func(height uint32, sideChain bool, parent *BlockNode) *BlockNode {
+		blockNode := _GetTestBlockNode()
+		blockNode.Hash = &BlockHash{}
+		copy(blockNode.Hash[:], _EncodeUint32(height))
+		if sideChain {
+			blockNode.Hash[4] = 1
+		}
+		blockNode.Height = height
+		blockNode.CumWork = big.NewInt(int64(height))
+		if parent != nil {
+			blockNode.Header.PrevBlockHash = parent.Hash
+			expectedParents[*blockNode.Hash] = parent.Hash
+		}
+		require.NoError(PutHeightHashToNodeInfo(blockNode, db, false /*bitcoinNodes*/))
+		return blockNode
+	}
+	var tipNode *BlockNode
+	for height := uint32(0); height < 40; height++ {
+		if height > 0 && height%5 == 0 {
+			makeNode(height, true /*sideChain*/, tipNode)
 		}
+		tipNode = makeNode(height, false /*sideChain*/, tipNode)
 	}
 
-	// Check PK3's follows.
-	{
-		pubKeys, err := DbGetPubKeysYouFollow(db, pk3)
+	for _, numWorkers := range []int{0, 1, 3, 100} {
+		blockIndex, err := GetBlockIndexParallel(db, false /*bitcoinNodes*/, numWorkers)
 		require.NoError(err)
-		for i := 0; i < len(pubKeys); i++ {
-			require.Contains([][]byte{pk1, pk1}, pubKeys[i])
+		require.Len(blockIndex, 47)
+		for blockHash, blockNode := range blockIndex {
+			assert.Equal(blockHash, *blockNode.Hash)
+			assert.Equal(int64(blockNode.Height), blockNode.CumWork.Int64())
+			assert.Equal(_GetTestBlockNode().DifficultyTarget, blockNode.DifficultyTarget)
+			if expectedParentHash, hasParent := expectedParents[blockHash]; hasParent {
+				require.NotNil(blockNode.Parent)
+				assert.Equal(expectedParentHash, blockNode.Parent.Hash)
+			} else {
+				assert.Nil(blockNode.Parent)
+			}
 		}
+		bestChain, err := GetBestChain(blockIndex[*tipNode.Hash], blockIndex)
+		require.NoError(err)
+		assert.Len(bestChain, 40)
 	}
 
-	// Delete PK2's follows.
-	require.NoError(DbDeleteFollowMappings(db, pkid2, pkid1))
-	require.NoError(DbDeleteFollowMappings(db, pkid2, pkid3))
+	// A node whose parent isn't in the index is an error.
+	orphanNode := _GetTestBlockNode()
+	orphanNode.Hash = &BlockHash{0xff}
+	orphanNode.Height = 50
+	orphanNode.Header.PrevBlockHash = &BlockHash{0xfe}
+	require.NoError(PutHeightHashToNodeInfo(orphanNode, db, false /*bitcoinNodes*/))
+	_, err := GetBlockIndexParallel(db, false /*bitcoinNodes*/, 2)
+	assert.Error(err)
+}
 
-	// Check PK2's follows were actually deleted.
-	{
-		pubKeys, err := DbGetPubKeysYouFollow(db, pk2)
-		require.NoError(err)
-		require.Equal(len(pubKeys), 0)
+func TestDBStats(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Create a test db and clean up the files at the end.
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		if err := txn.Set(_dbKeyForPKIDToProfileEntry(&PKID{1}), make([]byte, 10)); err != nil {
+			return err
+		}
+		if err := txn.Set(_dbKeyForPKIDToProfileEntry(&PKID{2}), make([]byte, 20)); err != nil {
+			return err
+		}
+		return txn.Set(_KeyNodeConfig, make([]byte, 5))
+	}))
+
+	allStats, err := DBStats(db)
+	require.NoError(err)
+	require.Equal(len(DbPrefixRegistry), len(allStats))
+	statsByName := make(map[string]*DbPrefixStats)
+	for ii, prefixStats := range allStats {
+		assert.Equal(DbPrefixRegistry[ii].Name, prefixStats.Name)
+		statsByName[prefixStats.Name] = prefixStats
 	}
+	assert.Equal(uint64(2), statsByName["PKIDToProfileEntry"].NumKeys)
+	assert.Equal(uint64(30), statsByName["PKIDToProfileEntry"].TotalValueBytes)
+	assert.Equal(uint64(15), statsByName["PKIDToProfileEntry"].AvgValueBytes)
+	assert.Equal(uint64(1), statsByName["NodeConfig"].NumKeys)
+	assert.Equal(uint64(0), statsByName["PostHashToPostEntry"].NumKeys)
+	assert.Equal(uint64(0), statsByName["PostHashToPostEntry"].AvgValueBytes)
 }
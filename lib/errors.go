@@ -1,6 +1,11 @@
 package lib
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
 
 // RuleError is an error type that specifies an error occurred during
 // block processing that is related to a consensus rule. By checking the
@@ -102,6 +107,35 @@ const (
 	RuleErrorCannotLikeNonexistentPost         RuleError = "RuleErrorCannotLikeNonexistentPost"
 	RuleErrorCannotUnlikeWithoutAnExistingLike RuleError = "RuleErrorCannotUnlikeWithoutAnExistingLike"
 
+	RuleErrorPollsNotYetEnabled         RuleError = "RuleErrorPollsNotYetEnabled"
+	RuleErrorPollInvalidOperationType   RuleError = "RuleErrorPollInvalidOperationType"
+	RuleErrorPollOnNonexistentPost      RuleError = "RuleErrorPollOnNonexistentPost"
+	RuleErrorPollCreatorNotPoster       RuleError = "RuleErrorPollCreatorNotPoster"
+	RuleErrorPollAlreadyExists          RuleError = "RuleErrorPollAlreadyExists"
+	RuleErrorPollTooFewOptions          RuleError = "RuleErrorPollTooFewOptions"
+	RuleErrorPollTooManyOptions         RuleError = "RuleErrorPollTooManyOptions"
+	RuleErrorPollOptionLength           RuleError = "RuleErrorPollOptionLength"
+	RuleErrorPollDoesNotExist           RuleError = "RuleErrorPollDoesNotExist"
+	RuleErrorPollVoteInvalidOptionIndex RuleError = "RuleErrorPollVoteInvalidOptionIndex"
+	RuleErrorPollVoteAlreadyExists      RuleError = "RuleErrorPollVoteAlreadyExists"
+
+	RuleErrorDerivedKeysNotYetEnabled                RuleError = "RuleErrorDerivedKeysNotYetEnabled"
+	RuleErrorAuthorizeDerivedKeyInvalidOperationType RuleError = "RuleErrorAuthorizeDerivedKeyInvalidOperationType"
+	RuleErrorAuthorizeDerivedKeyInvalidPublicKey     RuleError = "RuleErrorAuthorizeDerivedKeyInvalidPublicKey"
+	RuleErrorAuthorizeDerivedKeyOwnerIsDerivedKey    RuleError = "RuleErrorAuthorizeDerivedKeyOwnerIsDerivedKey"
+	RuleErrorAuthorizeDerivedKeyExpired              RuleError = "RuleErrorAuthorizeDerivedKeyExpired"
+	RuleErrorAuthorizeDerivedKeyRevoked              RuleError = "RuleErrorAuthorizeDerivedKeyRevoked"
+	RuleErrorAuthorizeDerivedKeySignedByDerivedKey   RuleError = "RuleErrorAuthorizeDerivedKeySignedByDerivedKey"
+	RuleErrorDerivedKeyNotAuthorized                 RuleError = "RuleErrorDerivedKeyNotAuthorized"
+	RuleErrorDerivedKeyExpired                       RuleError = "RuleErrorDerivedKeyExpired"
+	RuleErrorDerivedKeyInvalidPublicKey              RuleError = "RuleErrorDerivedKeyInvalidPublicKey"
+	RuleErrorDerivedKeyTxnTypeNotAuthorized          RuleError = "RuleErrorDerivedKeyTxnTypeNotAuthorized"
+	RuleErrorDerivedKeyTxnSpendsMoreThanGlobalLimit  RuleError = "RuleErrorDerivedKeyTxnSpendsMoreThanGlobalLimit"
+
+	RuleErrorTransferRestrictionsNotYetEnabled             RuleError = "RuleErrorTransferRestrictionsNotYetEnabled"
+	RuleErrorUpdateTransferRestrictionInvalidStatus        RuleError = "RuleErrorUpdateTransferRestrictionInvalidStatus"
+	RuleErrorUpdateTransferRestrictionOnNonexistentProfile RuleError = "RuleErrorUpdateTransferRestrictionOnNonexistentProfile"
+
 	RuleErrorProfileUsernameTooShort            RuleError = "RuleErrorProfileUsernameTooShort"
 	RuleErrorProfileDescriptionTooShort         RuleError = "RuleErrorProfileDescriptionTooShort"
 	RuleErrorProfileUsernameTooLong             RuleError = "RuleErrorProfileUsernameTooLong"
@@ -113,6 +147,7 @@ const (
 	RuleErrorProfileBadPublicKey                RuleError = "RuleErrorProfileBadPublicKey"
 	RuleErrorProfileModificationNotAuthorized   RuleError = "RuleErrorProfileModificationNotAuthorized"
 	RuleErrorProfileUsernameCannotContainZeros  RuleError = "RuleErrorProfileUsernameCannotContainZeros"
+	RuleErrorProfileUsernameRecentlyReleased    RuleError = "RuleErrorProfileUsernameRecentlyReleased"
 
 	RuleSubmitPostNilParentPostHash                  RuleError = "RuleSubmitPostNilParentPostHash"
 	RuleSubmitPostTitleLength                        RuleError = "RuleSubmitPostTitleLength"
@@ -173,6 +208,8 @@ const (
 	RuleErrorCreatorCoinTransferPostAlreadyHasSufficientDiamonds        RuleError = "RuleErrorCreatorCoinTransferPostAlreadyHasSufficientDiamonds"
 	RuleErrorCreatorCoinTransferDiamondsCantHaveNegativeNanos           RuleError = "RuleErrorCreatorCoinTransferDiamondsCantHaveNegativeNanos"
 	RuleErrorCreatorCoinTransferDiamondPostEntryDoesNotExist            RuleError = "RuleErrorCreatorCoinTransferDiamondPostEntryDoesNotExist"
+	RuleErrorCreatorCoinTransferRestrictedToProfileOwner                RuleError = "RuleErrorCreatorCoinTransferRestrictedToProfileOwner"
+	RuleErrorCreatorCoinTransferRestrictedToDAOMembers                  RuleError = "RuleErrorCreatorCoinTransferRestrictedToDAOMembers"
 
 	RuleErrorCreatorCoinRequiresNonZeroInput                           RuleError = "RuleErrorCreatorCoinRequiresNonZeroInput"
 	RuleErrorCreatorCoinInvalidPubKeySize                              RuleError = "RuleErrorCreatorCoinInvalidPubKeySize"
@@ -221,6 +258,10 @@ const (
 	TxErrorInsufficientFeePriorityQueue                             RuleError = "TxErrorInsufficientFeePriorityQueue"
 	TxErrorUnconnectedTxnNotAllowed                                 RuleError = "TxErrorUnconnectedTxnNotAllowed"
 	TxErrorCannotProcessBitcoinExchangeUntilBitcoinManagerIsCurrent RuleError = "TxErrorCannotProcessBitcoinExchangeUntilBitcoinManagerIsCurrent"
+	TxErrorTooManyTxnsForPublicKey                                  RuleError = "TxErrorTooManyTxnsForPublicKey"
+	TxErrorTooManyTxnsForSource                                     RuleError = "TxErrorTooManyTxnsForSource"
+	TxErrorSpamScoreTooHigh                                         RuleError = "TxErrorSpamScoreTooHigh"
+	TxErrorTooManyUnconnectedTxnsForPeer                            RuleError = "TxErrorTooManyUnconnectedTxnsForPeer"
 )
 
 func (e RuleError) Error() string {
@@ -240,3 +281,39 @@ func IsRuleError(err error) bool {
 		strings.Contains(err.Error(), "HeaderError") ||
 		strings.Contains(err.Error(), "TxError"))
 }
+
+// Errors returned by the db helpers. They're always wrapped with more context so
+// callers should check for them with errors.Is rather than comparing directly.
+var (
+	// ErrEntryNotFound means the key being looked up isn't in the db.
+	ErrEntryNotFound = errors.New("ErrEntryNotFound")
+	// ErrEntryCorrupt means a value was found but couldn't be decoded.
+	ErrEntryCorrupt = errors.New("ErrEntryCorrupt")
+	// ErrDBClosed means the db was closed, or is being closed, before the
+	// operation could run.
+	ErrDBClosed = errors.New("ErrDBClosed")
+)
+
+// _wrapDbError converts the errors badger returns into the sentinel errors above
+// and adds context to them. Errors that don't correspond to a sentinel are
+// wrapped as-is and nil is returned as nil.
+func _wrapDbError(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(err, ErrEntryNotFound), errors.Is(err, ErrEntryCorrupt), errors.Is(err, ErrDBClosed):
+		// Already converted further down the stack.
+	case errors.Is(err, ErrKVKeyNotFound):
+		err = ErrEntryNotFound
+	case errors.Is(err, badger.ErrDBClosed):
+		err = ErrDBClosed
+	}
+	return errors.Wrapf(err, format, args...)
+}
+
+// _corruptDbEntryError wraps ErrEntryCorrupt with the reason an entry couldn't be
+// decoded.
+func _corruptDbEntryError(err error, format string, args ...interface{}) error {
+	return errors.Wrapf(ErrEntryCorrupt, format+": %v", append(args, err)...)
+}
@@ -0,0 +1,483 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The event stream lets a service outside the node, like an indexer or a
+// notification service, follow blocks, txns, and the mempool as they change
+// without running the core in-process. It serves the EventManager's events to
+// anyone who connects to its listener.
+//
+// The messages are the protobuf messages in event_stream.proto. Every message is
+// prefixed with its length as a uvarint, which is the "delimited" format most
+// protobuf libraries can read and write directly. A client sends a single
+// SubscribeRequest after it connects and the server then sends a StreamEvent for
+// every event until either side closes the connection. This is the same exchange
+// as the proto file's EventStream.Subscribe, so a gRPC gateway can sit in front
+// of it.
+//
+// Events are queued for each client and a client that falls more than
+// EventStreamBufferSize events behind is disconnected so a slow client can't hold
+// up the chain. Clients that need every event have to reconnect and catch up from
+// the db or the txindex.
+
+const (
+	// EventStreamBufferSize is the number of events queued for a client before
+	// it's disconnected.
+	EventStreamBufferSize = 10000
+	// MaxEventStreamRequestBytes is the largest SubscribeRequest a client can send.
+	MaxEventStreamRequestBytes = 1024
+	// EventStreamRequestTimeoutSeconds is how long a client has to send its
+	// SubscribeRequest after connecting.
+	EventStreamRequestTimeoutSeconds = 10
+)
+
+// Protobuf wire types.
+const (
+	_protoWireVarint  = 0
+	_protoWireFixed64 = 1
+	_protoWireBytes   = 2
+	_protoWireFixed32 = 5
+)
+
+// The fields of the StreamEvent oneof.
+const (
+	StreamEventBlockConnected            = 1
+	StreamEventBlockDisconnected         = 2
+	StreamEventTransactionConnected      = 3
+	StreamEventTransactionIndexed        = 4
+	StreamEventMempoolTransactionAdded   = 5
+	StreamEventMempoolTransactionRemoved = 6
+)
+
+func _protoAppendTag(buf []byte, fieldNum uint64, wireType uint64) []byte {
+	return append(buf, UintToBuf(fieldNum<<3|wireType)...)
+}
+
+// _protoAppendVarintField leaves the field out when it's zero like proto3 does.
+func _protoAppendVarintField(buf []byte, fieldNum uint64, val uint64) []byte {
+	if val == 0 {
+		return buf
+	}
+	buf = _protoAppendTag(buf, fieldNum, _protoWireVarint)
+	return append(buf, UintToBuf(val)...)
+}
+
+func _protoAppendBoolField(buf []byte, fieldNum uint64, val bool) []byte {
+	if !val {
+		return buf
+	}
+	return _protoAppendVarintField(buf, fieldNum, 1)
+}
+
+// _protoAppendBytesField always writes the field so it can be used for repeated
+// fields and embedded messages, which have to be sent even when they're empty.
+func _protoAppendBytesField(buf []byte, fieldNum uint64, val []byte) []byte {
+	buf = _protoAppendTag(buf, fieldNum, _protoWireBytes)
+	buf = append(buf, UintToBuf(uint64(len(val)))...)
+	return append(buf, val...)
+}
+
+// _protoAppendStringField leaves the field out when it's empty like proto3 does.
+func _protoAppendStringField(buf []byte, fieldNum uint64, val string) []byte {
+	if val == "" {
+		return buf
+	}
+	return _protoAppendBytesField(buf, fieldNum, []byte(val))
+}
+
+// _protoDecodeFields calls handleField with each field in an encoded message.
+// varintVal is set for varint fields and bytesVal for length-delimited ones.
+// Fixed-size fields are skipped since none of our messages have any.
+func _protoDecodeFields(data []byte, handleField func(
+	fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error) error {
+
+	for len(data) > 0 {
+		tag, nn := Uvarint(data)
+		if nn <= 0 {
+			return fmt.Errorf("_protoDecodeFields: Problem reading tag")
+		}
+		data = data[nn:]
+		fieldNum, wireType := tag>>3, tag&7
+
+		var varintVal uint64
+		var bytesVal []byte
+		switch wireType {
+		case _protoWireVarint:
+			varintVal, nn = Uvarint(data)
+			if nn <= 0 {
+				return fmt.Errorf("_protoDecodeFields: Problem reading field %d", fieldNum)
+			}
+			data = data[nn:]
+		case _protoWireBytes:
+			length, nn := Uvarint(data)
+			if nn <= 0 || length > uint64(len(data)-nn) {
+				return fmt.Errorf("_protoDecodeFields: Problem reading field %d", fieldNum)
+			}
+			bytesVal = data[nn : nn+int(length)]
+			data = data[nn+int(length):]
+		case _protoWireFixed64, _protoWireFixed32:
+			size := 8
+			if wireType == _protoWireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return fmt.Errorf("_protoDecodeFields: Problem reading field %d", fieldNum)
+			}
+			data = data[size:]
+			continue
+		default:
+			return fmt.Errorf("_protoDecodeFields: Field %d has unknown wire type %d",
+				fieldNum, wireType)
+		}
+		if err := handleField(fieldNum, wireType, varintVal, bytesVal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventStreamSubscribeRequest is the Go side of SubscribeRequest.
+type EventStreamSubscribeRequest struct {
+	IncludeMempool         bool
+	IncludeTxindexMetadata bool
+}
+
+func (req *EventStreamSubscribeRequest) ToBytes() []byte {
+	data := []byte{}
+	data = _protoAppendBoolField(data, 1, req.IncludeMempool)
+	data = _protoAppendBoolField(data, 2, req.IncludeTxindexMetadata)
+	return data
+}
+
+func (req *EventStreamSubscribeRequest) FromBytes(data []byte) error {
+	return _protoDecodeFields(data, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+		switch fieldNum {
+		case 1:
+			req.IncludeMempool = varintVal != 0
+		case 2:
+			req.IncludeTxindexMetadata = varintVal != 0
+		}
+		return nil
+	})
+}
+
+// _encodeStreamBlock encodes a Block message.
+func _encodeStreamBlock(block *MsgBitCloutBlock) ([]byte, error) {
+	blockHash, err := block.Header.Hash()
+	if err != nil {
+		return nil, err
+	}
+	headerBytes, err := block.Header.ToBytes(false)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	data = _protoAppendBytesField(data, 1, blockHash[:])
+	data = _protoAppendVarintField(data, 2, block.Header.Height)
+	data = _protoAppendBytesField(data, 3, headerBytes)
+	for _, txn := range block.Txns {
+		data = _protoAppendBytesField(data, 4, txn.Hash()[:])
+	}
+	return data, nil
+}
+
+// _txindexTypeMetadata returns the part of the metadata specific to the txn's
+// type, or nil if there isn't any.
+func _txindexTypeMetadata(txnMeta *TransactionMetadata) interface{} {
+	switch {
+	case txnMeta.BasicTransferTxindexMetadata != nil:
+		return txnMeta.BasicTransferTxindexMetadata
+	case txnMeta.BitcoinExchangeTxindexMetadata != nil:
+		return txnMeta.BitcoinExchangeTxindexMetadata
+	case txnMeta.CreatorCoinTxindexMetadata != nil:
+		return txnMeta.CreatorCoinTxindexMetadata
+	case txnMeta.CreatorCoinTransferTxindexMetadata != nil:
+		return txnMeta.CreatorCoinTransferTxindexMetadata
+	case txnMeta.UpdateProfileTxindexMetadata != nil:
+		return txnMeta.UpdateProfileTxindexMetadata
+	case txnMeta.SubmitPostTxindexMetadata != nil:
+		return txnMeta.SubmitPostTxindexMetadata
+	case txnMeta.LikeTxindexMetadata != nil:
+		return txnMeta.LikeTxindexMetadata
+	case txnMeta.FollowTxindexMetadata != nil:
+		return txnMeta.FollowTxindexMetadata
+	case txnMeta.PrivateMessageTxindexMetadata != nil:
+		return txnMeta.PrivateMessageTxindexMetadata
+	case txnMeta.SwapIdentityTxindexMetadata != nil:
+		return txnMeta.SwapIdentityTxindexMetadata
+	}
+	return nil
+}
+
+// _encodeStreamTransactionMetadata encodes a TransactionMetadata message.
+func _encodeStreamTransactionMetadata(txnMeta *TransactionMetadata) ([]byte, error) {
+	data := []byte{}
+	data = _protoAppendStringField(data, 1, txnMeta.BlockHashHex)
+	data = _protoAppendVarintField(data, 2, txnMeta.TxnIndexInBlock)
+	data = _protoAppendStringField(data, 3, txnMeta.TxnType)
+	data = _protoAppendVarintField(data, 4, uint64(txnMeta.BlockHeight))
+	data = _protoAppendStringField(data, 5, txnMeta.TransactorPublicKeyBase58Check)
+	for _, affectedPublicKey := range txnMeta.AffectedPublicKeys {
+		affectedData := []byte{}
+		affectedData = _protoAppendStringField(affectedData, 1, affectedPublicKey.PublicKeyBase58Check)
+		affectedData = _protoAppendStringField(affectedData, 2, affectedPublicKey.Metadata)
+		data = _protoAppendBytesField(data, 6, affectedData)
+	}
+	for _, output := range txnMeta.TxnOutputs {
+		outputData := []byte{}
+		if len(output.PublicKey) > 0 {
+			outputData = _protoAppendBytesField(outputData, 1, output.PublicKey)
+		}
+		outputData = _protoAppendVarintField(outputData, 2, output.AmountNanos)
+		data = _protoAppendBytesField(data, 7, outputData)
+	}
+	if typeMetadata := _txindexTypeMetadata(txnMeta); typeMetadata != nil {
+		typeMetadataJSON, err := json.Marshal(typeMetadata)
+		if err != nil {
+			return nil, err
+		}
+		data = _protoAppendBytesField(data, 8, typeMetadataJSON)
+	}
+	return data, nil
+}
+
+// _encodeStreamTransaction encodes a Transaction message. blockHash and txnMeta
+// can be nil.
+func _encodeStreamTransaction(txn *MsgBitCloutTxn, blockHash *BlockHash, txnMeta *TransactionMetadata) ([]byte, error) {
+	txnBytes, err := txn.ToBytes(false)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	data = _protoAppendBytesField(data, 1, txn.Hash()[:])
+	if blockHash != nil {
+		data = _protoAppendBytesField(data, 2, blockHash[:])
+	}
+	data = _protoAppendBytesField(data, 3, txnBytes)
+	if txnMeta != nil {
+		metaData, err := _encodeStreamTransactionMetadata(txnMeta)
+		if err != nil {
+			return nil, err
+		}
+		data = _protoAppendBytesField(data, 4, metaData)
+	}
+	return data, nil
+}
+
+type eventStreamSubscriber struct {
+	conn    net.Conn
+	request *EventStreamSubscribeRequest
+	// Each event is a delimited StreamEvent ready to be written. The channel is
+	// closed when the subscriber is removed.
+	events chan []byte
+}
+
+// EventStreamServer serves the events from an EventManager to the clients that
+// connect to its listener.
+type EventStreamServer struct {
+	listener net.Listener
+
+	mtx         sync.Mutex
+	subscribers map[*eventStreamSubscriber]bool
+	stopped     bool
+}
+
+// NewEventStreamServer registers handlers for every event with the EventManager.
+// Nothing is served until Start is called.
+func NewEventStreamServer(eventManager *EventManager, listener net.Listener) *EventStreamServer {
+	ess := &EventStreamServer{
+		listener:    listener,
+		subscribers: make(map[*eventStreamSubscriber]bool),
+	}
+
+	all := func(*EventStreamSubscribeRequest) bool { return true }
+	mempool := func(req *EventStreamSubscribeRequest) bool { return req.IncludeMempool }
+	txindex := func(req *EventStreamSubscribeRequest) bool { return req.IncludeTxindexMetadata }
+
+	eventManager.OnBlockConnected(func(event *BlockEvent) {
+		ess.broadcast(StreamEventBlockConnected, all, func() ([]byte, error) {
+			return _encodeStreamBlock(event.Block)
+		})
+	})
+	eventManager.OnBlockDisconnected(func(event *BlockEvent) {
+		ess.broadcast(StreamEventBlockDisconnected, all, func() ([]byte, error) {
+			return _encodeStreamBlock(event.Block)
+		})
+	})
+	eventManager.OnTransactionConnected(func(event *TransactionEvent) {
+		ess.broadcast(StreamEventTransactionConnected, all, func() ([]byte, error) {
+			return _encodeStreamTransaction(event.Txn, event.BlockHash, nil)
+		})
+	})
+	eventManager.OnTransactionIndexed(func(event *TransactionIndexedEvent) {
+		ess.broadcast(StreamEventTransactionIndexed, txindex, func() ([]byte, error) {
+			return _encodeStreamTransaction(event.Txn, event.BlockHash, event.Metadata)
+		})
+	})
+	eventManager.OnMempoolTxnAdded(func(event *MempoolTxnEvent) {
+		ess.broadcast(StreamEventMempoolTransactionAdded, mempool, func() ([]byte, error) {
+			return _encodeStreamTransaction(event.MempoolTx.Tx, nil, nil)
+		})
+	})
+	eventManager.OnMempoolTxnRemoved(func(event *MempoolTxnEvent) {
+		ess.broadcast(StreamEventMempoolTransactionRemoved, mempool, func() ([]byte, error) {
+			return _encodeStreamTransaction(event.MempoolTx.Tx, nil, nil)
+		})
+	})
+
+	return ess
+}
+
+// broadcast queues an event for every subscriber that wants it. The event is only
+// encoded if someone does. It's called by the EventManager with the chain or the
+// mempool locked so it never blocks on a subscriber.
+func (ess *EventStreamServer) broadcast(eventField uint64,
+	wantsEvent func(*EventStreamSubscribeRequest) bool, encode func() ([]byte, error)) {
+
+	ess.mtx.Lock()
+	defer ess.mtx.Unlock()
+
+	var eventBytes []byte
+	for subscriber := range ess.subscribers {
+		if !wantsEvent(subscriber.request) {
+			continue
+		}
+		if eventBytes == nil {
+			messageBytes, err := encode()
+			if err != nil {
+				glog.Errorf("EventStreamServer.broadcast: Problem encoding event %d: %v",
+					eventField, err)
+				return
+			}
+			messageBytes = _protoAppendBytesField([]byte{}, eventField, messageBytes)
+			eventBytes = append(UintToBuf(uint64(len(messageBytes))), messageBytes...)
+		}
+
+		select {
+		case subscriber.events <- eventBytes:
+		default:
+			glog.Warningf("EventStreamServer.broadcast: Disconnecting %v since it's "+
+				"%d events behind", subscriber.conn.RemoteAddr(), EventStreamBufferSize)
+			ess._removeSubscriber(subscriber)
+		}
+	}
+}
+
+// _removeSubscriber has to be called with the lock held.
+func (ess *EventStreamServer) _removeSubscriber(subscriber *eventStreamSubscriber) {
+	if !ess.subscribers[subscriber] {
+		return
+	}
+	delete(ess.subscribers, subscriber)
+	close(subscriber.events)
+	subscriber.conn.Close()
+}
+
+func (ess *EventStreamServer) removeSubscriber(subscriber *eventStreamSubscriber) {
+	ess.mtx.Lock()
+	defer ess.mtx.Unlock()
+	ess._removeSubscriber(subscriber)
+}
+
+// Start accepts connections until Stop is called.
+func (ess *EventStreamServer) Start() {
+	glog.Infof("EventStreamServer: Listening on %v", ess.listener.Addr())
+	go func() {
+		for {
+			conn, err := ess.listener.Accept()
+			if err != nil {
+				ess.mtx.Lock()
+				stopped := ess.stopped
+				ess.mtx.Unlock()
+				if !stopped {
+					glog.Errorf("EventStreamServer: Problem accepting connection: %v", err)
+				}
+				return
+			}
+			go ess.handleConn(conn)
+		}
+	}()
+}
+
+// Stop closes the listener and disconnects every client.
+func (ess *EventStreamServer) Stop() {
+	ess.mtx.Lock()
+	defer ess.mtx.Unlock()
+	ess.stopped = true
+	ess.listener.Close()
+	for subscriber := range ess.subscribers {
+		ess._removeSubscriber(subscriber)
+	}
+}
+
+func (ess *EventStreamServer) handleConn(conn net.Conn) {
+	request, err := _readEventStreamSubscribeRequest(conn)
+	if err != nil {
+		glog.Debugf("EventStreamServer.handleConn: Dropping %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	subscriber := &eventStreamSubscriber{
+		conn:    conn,
+		request: request,
+		events:  make(chan []byte, EventStreamBufferSize),
+	}
+	ess.mtx.Lock()
+	if ess.stopped {
+		ess.mtx.Unlock()
+		conn.Close()
+		return
+	}
+	ess.subscribers[subscriber] = true
+	ess.mtx.Unlock()
+	glog.Debugf("EventStreamServer.handleConn: Subscribed %v: %+v", conn.RemoteAddr(), request)
+
+	// Clients don't send anything after the request so a read only returns once
+	// the client goes away.
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		ess.removeSubscriber(subscriber)
+	}()
+
+	for eventBytes := range subscriber.events {
+		if _, err := conn.Write(eventBytes); err != nil {
+			glog.Debugf("EventStreamServer.handleConn: Dropping %v: %v", conn.RemoteAddr(), err)
+			ess.removeSubscriber(subscriber)
+			return
+		}
+	}
+}
+
+func _readEventStreamSubscribeRequest(conn net.Conn) (*EventStreamSubscribeRequest, error) {
+	conn.SetReadDeadline(time.Now().Add(EventStreamRequestTimeoutSeconds * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	numBytes, err := ReadUvarint(conn)
+	if err != nil {
+		return nil, fmt.Errorf("_readEventStreamSubscribeRequest: Problem reading length: %v", err)
+	}
+	if numBytes > MaxEventStreamRequestBytes {
+		return nil, fmt.Errorf("_readEventStreamSubscribeRequest: Request has %d bytes but "+
+			"max is %d", numBytes, MaxEventStreamRequestBytes)
+	}
+	requestBytes := make([]byte, numBytes)
+	if _, err := io.ReadFull(conn, requestBytes); err != nil {
+		return nil, fmt.Errorf("_readEventStreamSubscribeRequest: Problem reading request: %v", err)
+	}
+	request := &EventStreamSubscribeRequest{}
+	if err := request.FromBytes(requestBytes); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
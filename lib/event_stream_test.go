@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventStream(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	request := &EventStreamSubscribeRequest{IncludeMempool: true}
+	decodedRequest := &EventStreamSubscribeRequest{}
+	require.NoError(decodedRequest.FromBytes(request.ToBytes()))
+	assert.Equal(request, decodedRequest)
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	mempool.eventManager = chain.EventManager()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	ess := NewEventStreamServer(chain.EventManager(), listener)
+	ess.Start()
+	defer ess.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	requestBytes := request.ToBytes()
+	_, err = conn.Write(append(UintToBuf(uint64(len(requestBytes))), requestBytes...))
+	require.NoError(err)
+	require.Eventually(func() bool {
+		ess.mtx.Lock()
+		defer ess.mtx.Unlock()
+		return len(ess.subscribers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// readEvent returns the field of the StreamEvent oneof that's set and the
+	// fields of the message in it.
+	readEvent := func() (uint64, map[uint64][]byte) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		numBytes, err := ReadUvarint(conn)
+		require.NoError(err)
+		eventBytes := make([]byte, numBytes)
+		_, err = io.ReadFull(conn, eventBytes)
+		require.NoError(err)
+
+		var eventField uint64
+		fields := make(map[uint64][]byte)
+		require.NoError(_protoDecodeFields(eventBytes, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+			eventField = fieldNum
+			return _protoDecodeFields(bytesVal, func(fieldNum uint64, wireType uint64, varintVal uint64, bytesVal []byte) error {
+				if wireType == _protoWireVarint {
+					bytesVal = UintToBuf(varintVal)
+				}
+				fields[fieldNum] = bytesVal
+				return nil
+			})
+		}))
+		return eventField, fields
+	}
+
+	// A block is followed by its txns.
+	block, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	blockHash, err := block.Header.Hash()
+	require.NoError(err)
+	eventField, fields := readEvent()
+	require.Equal(uint64(StreamEventBlockConnected), eventField)
+	assert.Equal(blockHash[:], fields[1])
+	assert.Equal(UintToBuf(block.Header.Height), fields[2])
+	eventField, fields = readEvent()
+	require.Equal(uint64(StreamEventTransactionConnected), eventField)
+	assert.Equal(block.Txns[0].Hash()[:], fields[1])
+	assert.Equal(blockHash[:], fields[2])
+	txnBytes, err := block.Txns[0].ToBytes(false)
+	require.NoError(err)
+	assert.Equal(txnBytes, fields[3])
+
+	// Mempool txns are sent since the client asked for them.
+	txn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 0,
+		senderPkString, recipientPkString, senderPrivString, mempool)
+	_, err = mempool.processTransaction(txn, false /*allowUnconnectedTxn*/, false, /*rateLimit*/
+		0 /*peerID*/, true /*verifySignatures*/)
+	require.NoError(err)
+	eventField, fields = readEvent()
+	require.Equal(uint64(StreamEventMempoolTransactionAdded), eventField)
+	assert.Equal(txn.Hash()[:], fields[1])
+	assert.Nil(fields[2])
+
+	// Once the client goes away it's dropped.
+	conn.Close()
+	require.Eventually(func() bool {
+		ess.mtx.Lock()
+		defer ess.mtx.Unlock()
+		return len(ess.subscribers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"sync"
+)
+
+// The EventManager lets code outside the core, like an indexer, follow the chain
+// and the mempool as they change instead of polling the db. Handlers are called
+// synchronously on the goroutine that made the change, after the change has been
+// committed to the db, and while that goroutine holds whatever locks it holds
+// (the ChainLock for block events and the mempool lock for mempool events). A
+// handler that does anything slow should hand the event off to its own goroutine.
+// Events must not be modified by handlers since they're shared with the caller.
+
+// BlockEvent is sent when a block is connected to or disconnected from the main
+// chain.
+type BlockEvent struct {
+	Block *MsgBitCloutBlock
+	// The utxo operations of each of the block's txns, in the same order.
+	UtxoOps [][]*UtxoOperation
+}
+
+// TransactionEvent is sent for each txn in a block connected to the main chain,
+// including the block reward.
+type TransactionEvent struct {
+	Txn       *MsgBitCloutTxn
+	TxnHash   *BlockHash
+	BlockHash *BlockHash
+	UtxoOps   []*UtxoOperation
+}
+
+// MempoolTxnEvent is sent when a txn is added to or removed from the mempool.
+type MempoolTxnEvent struct {
+	MempoolTx *MempoolTx
+}
+
+// TransactionIndexedEvent is sent for each txn the txindex adds, after the block
+// it's in has been connected to the main chain. The txindex follows the chain in
+// the background so these come some time after the TransactionEvent for the txn.
+type TransactionIndexedEvent struct {
+	Txn       *MsgBitCloutTxn
+	TxnHash   *BlockHash
+	BlockHash *BlockHash
+	Metadata  *TransactionMetadata
+}
+
+// EntryFlushedEvent is sent for each entry a UtxoView wrote to the db or deleted
+// from it when the view that connected or disconnected blocks is flushed. Entry
+// is one of *UtxoEntry, *MessageEntry, *FollowEntry, *DiamondEntry, *LikeEntry,
+// *RecloutEntry, *PostEntry, *ProfileEntry, *BalanceEntry, *PKIDEntry, or
+// *DerivedKeyEntry. A spent UtxoEntry counts as deleted.
+type EntryFlushedEvent struct {
+	Entry     interface{}
+	IsDeleted bool
+}
+
+type EventManager struct {
+	mtx sync.RWMutex
+
+	blockConnectedHandlers       []func(*BlockEvent)
+	blockDisconnectedHandlers    []func(*BlockEvent)
+	transactionConnectedHandlers []func(*TransactionEvent)
+	transactionIndexedHandlers   []func(*TransactionIndexedEvent)
+	mempoolTxnAddedHandlers      []func(*MempoolTxnEvent)
+	mempoolTxnRemovedHandlers    []func(*MempoolTxnEvent)
+	entryFlushedHandlers         []func(*EntryFlushedEvent)
+}
+
+func NewEventManager() *EventManager {
+	return &EventManager{}
+}
+
+func (em *EventManager) OnBlockConnected(handler func(*BlockEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.blockConnectedHandlers = append(em.blockConnectedHandlers, handler)
+}
+
+func (em *EventManager) OnBlockDisconnected(handler func(*BlockEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.blockDisconnectedHandlers = append(em.blockDisconnectedHandlers, handler)
+}
+
+func (em *EventManager) OnTransactionConnected(handler func(*TransactionEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.transactionConnectedHandlers = append(em.transactionConnectedHandlers, handler)
+}
+
+func (em *EventManager) OnTransactionIndexed(handler func(*TransactionIndexedEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.transactionIndexedHandlers = append(em.transactionIndexedHandlers, handler)
+}
+
+func (em *EventManager) OnMempoolTxnAdded(handler func(*MempoolTxnEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.mempoolTxnAddedHandlers = append(em.mempoolTxnAddedHandlers, handler)
+}
+
+func (em *EventManager) OnMempoolTxnRemoved(handler func(*MempoolTxnEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.mempoolTxnRemovedHandlers = append(em.mempoolTxnRemovedHandlers, handler)
+}
+
+func (em *EventManager) OnEntryFlushed(handler func(*EntryFlushedEvent)) {
+	em.mtx.Lock()
+	defer em.mtx.Unlock()
+	em.entryFlushedHandlers = append(em.entryFlushedHandlers, handler)
+}
+
+// blockConnected sends the block and then each of its txns.
+func (em *EventManager) blockConnected(block *MsgBitCloutBlock, utxoOps [][]*UtxoOperation) {
+	em.mtx.RLock()
+	blockHandlers := em.blockConnectedHandlers
+	txnHandlers := em.transactionConnectedHandlers
+	em.mtx.RUnlock()
+
+	blockEvent := &BlockEvent{Block: block, UtxoOps: utxoOps}
+	for _, handler := range blockHandlers {
+		handler(blockEvent)
+	}
+	if len(txnHandlers) == 0 {
+		return
+	}
+
+	blockHash, _ := block.Header.Hash()
+	for ii, txn := range block.Txns {
+		txnEvent := &TransactionEvent{
+			Txn:       txn,
+			TxnHash:   txn.Hash(),
+			BlockHash: blockHash,
+		}
+		if ii < len(utxoOps) {
+			txnEvent.UtxoOps = utxoOps[ii]
+		}
+		for _, handler := range txnHandlers {
+			handler(txnEvent)
+		}
+	}
+}
+
+func (em *EventManager) blockDisconnected(block *MsgBitCloutBlock, utxoOps [][]*UtxoOperation) {
+	em.mtx.RLock()
+	handlers := em.blockDisconnectedHandlers
+	em.mtx.RUnlock()
+
+	blockEvent := &BlockEvent{Block: block, UtxoOps: utxoOps}
+	for _, handler := range handlers {
+		handler(blockEvent)
+	}
+}
+
+func (em *EventManager) transactionIndexed(txn *MsgBitCloutTxn, blockHash *BlockHash, txnMeta *TransactionMetadata) {
+	em.mtx.RLock()
+	handlers := em.transactionIndexedHandlers
+	em.mtx.RUnlock()
+
+	indexedEvent := &TransactionIndexedEvent{
+		Txn:       txn,
+		TxnHash:   txn.Hash(),
+		BlockHash: blockHash,
+		Metadata:  txnMeta,
+	}
+	for _, handler := range handlers {
+		handler(indexedEvent)
+	}
+}
+
+func (em *EventManager) mempoolTxnAdded(mempoolTx *MempoolTx) {
+	em.mtx.RLock()
+	handlers := em.mempoolTxnAddedHandlers
+	em.mtx.RUnlock()
+
+	for _, handler := range handlers {
+		handler(&MempoolTxnEvent{MempoolTx: mempoolTx})
+	}
+}
+
+func (em *EventManager) mempoolTxnRemoved(mempoolTx *MempoolTx) {
+	em.mtx.RLock()
+	handlers := em.mempoolTxnRemovedHandlers
+	em.mtx.RUnlock()
+
+	for _, handler := range handlers {
+		handler(&MempoolTxnEvent{MempoolTx: mempoolTx})
+	}
+}
+
+// viewFlushed sends an event for each entry in a view that was just flushed. It
+// has to be called before the view's mappings are reset.
+func (em *EventManager) viewFlushed(bav *UtxoView) {
+	em.mtx.RLock()
+	handlers := em.entryFlushedHandlers
+	em.mtx.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+
+	send := func(entry interface{}, isDeleted bool) {
+		entryEvent := &EntryFlushedEvent{Entry: entry, IsDeleted: isDeleted}
+		for _, handler := range handlers {
+			handler(entryEvent)
+		}
+	}
+	for _, utxoEntry := range bav.UtxoKeyToUtxoEntry {
+		send(utxoEntry, utxoEntry.isSpent)
+	}
+	for _, messageEntry := range bav.MessageKeyToMessageEntry {
+		send(messageEntry, messageEntry.isDeleted)
+	}
+	for _, followEntry := range bav.FollowKeyToFollowEntry {
+		send(followEntry, followEntry.isDeleted)
+	}
+	for _, diamondEntry := range bav.DiamondKeyToDiamondEntry {
+		send(diamondEntry, diamondEntry.isDeleted)
+	}
+	for _, likeEntry := range bav.LikeKeyToLikeEntry {
+		send(likeEntry, likeEntry.isDeleted)
+	}
+	for _, recloutEntry := range bav.RecloutKeyToRecloutEntry {
+		send(recloutEntry, recloutEntry.isDeleted)
+	}
+	for _, postEntry := range bav.PostHashToPostEntry {
+		send(postEntry, postEntry.isDeleted)
+	}
+	for _, profileEntry := range bav.ProfilePKIDToProfileEntry {
+		send(profileEntry, profileEntry.isDeleted)
+	}
+	for _, balanceEntry := range bav.HODLerPKIDCreatorPKIDToBalanceEntry {
+		send(balanceEntry, balanceEntry.isDeleted)
+	}
+	for _, pkidEntry := range bav.PublicKeyToPKIDEntry {
+		send(pkidEntry, pkidEntry.isDeleted)
+	}
+	for _, derivedKeyEntry := range bav.DerivedKeyMapKeyToDerivedKeyEntry {
+		send(derivedKeyEntry, derivedKeyEntry.isDeleted)
+	}
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventManager(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	mempool.eventManager = chain.EventManager()
+
+	connectedBlocks := []*BlockEvent{}
+	connectedTxns := []*TransactionEvent{}
+	addedTxns := []*BlockHash{}
+	removedTxns := []*BlockHash{}
+	utxosAdded := 0
+	utxosSpent := 0
+	chain.EventManager().OnBlockConnected(func(event *BlockEvent) {
+		connectedBlocks = append(connectedBlocks, event)
+	})
+	chain.EventManager().OnTransactionConnected(func(event *TransactionEvent) {
+		connectedTxns = append(connectedTxns, event)
+	})
+	chain.EventManager().OnMempoolTxnAdded(func(event *MempoolTxnEvent) {
+		addedTxns = append(addedTxns, event.MempoolTx.Hash)
+	})
+	chain.EventManager().OnMempoolTxnRemoved(func(event *MempoolTxnEvent) {
+		removedTxns = append(removedTxns, event.MempoolTx.Hash)
+	})
+	chain.EventManager().OnEntryFlushed(func(event *EntryFlushedEvent) {
+		if _, isUtxo := event.Entry.(*UtxoEntry); !isUtxo {
+			return
+		}
+		if event.IsDeleted {
+			utxosSpent++
+		} else {
+			utxosAdded++
+		}
+	})
+
+	// Each block sends the block, its block reward, and the reward's utxo.
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	require.Equal(2, len(connectedBlocks))
+	assert.Equal(2, len(connectedTxns))
+	assert.Equal(2, utxosAdded)
+	assert.Equal(0, utxosSpent)
+
+	// A txn sends an event when it enters the mempool and another when the
+	// block that mines it takes it out.
+	txn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 0,
+		senderPkString, recipientPkString, senderPrivString, mempool)
+	_, err := mempool.processTransaction(txn, false /*allowUnconnectedTxn*/, false, /*rateLimit*/
+		0 /*peerID*/, true /*verifySignatures*/)
+	require.NoError(err)
+	assert.Equal([]*BlockHash{txn.Hash()}, addedTxns)
+	assert.Equal(0, len(removedTxns))
+
+	block, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	require.Equal(2, len(block.Txns))
+	assert.Equal([]*BlockHash{txn.Hash()}, removedTxns)
+	require.Equal(3, len(connectedBlocks))
+	assert.Equal(block, connectedBlocks[2].Block)
+	assert.Equal(len(block.Txns), len(connectedBlocks[2].UtxoOps))
+	require.Equal(4, len(connectedTxns))
+	assert.Equal(txn.Hash(), connectedTxns[3].TxnHash)
+	assert.NotEqual(0, len(connectedTxns[3].UtxoOps))
+	assert.True(utxosSpent > 0)
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+)
+
+// The FeeEstimator suggests a fee rate for a txn from the fee rates of the txns
+// in recent blocks and of the txns waiting in the mempool, so a wallet doesn't
+// have to pay the minimum network fee and hope for the best. Fee rates are in
+// nanos per KB like the rest of the node's fee settings.
+//
+// A txn's fee isn't in the block it's mined in, so the estimator remembers the
+// fee rate of each txn while it's in the mempool and looks the txns of a block
+// up when it's connected. The txns of a block that never went through this
+// node's mempool, like those it hears about only in the block, are left out.
+
+// FeeEstimatorNumBlocks is the number of recent blocks the FeeEstimator keeps
+// the fee rates of.
+const FeeEstimatorNumBlocks = 20
+
+type feeEstimatorMempoolTxn struct {
+	feeRateNanosPerKB uint64
+	sizeBytes         uint64
+}
+
+type feeEstimatorBlock struct {
+	hash BlockHash
+	// The fee rates of the block's txns that were in the mempool, lowest first.
+	feeRatesNanosPerKB []uint64
+}
+
+type FeeEstimator struct {
+	mtx sync.RWMutex
+
+	bc                   *Blockchain
+	minFeeRateNanosPerKB uint64
+	numBlocks            int
+
+	mempoolTxns map[BlockHash]*feeEstimatorMempoolTxn
+	// The most recent blocks connected to the main chain, oldest first.
+	blocks []*feeEstimatorBlock
+}
+
+// NewFeeEstimator creates an estimator that follows the chain and its mempool
+// through the chain's event manager and keeps the fee rates of the last
+// numBlocks blocks. Its estimates are never below minFeeRateNanosPerKB or the
+// network's minimum fee rate.
+func NewFeeEstimator(bc *Blockchain, minFeeRateNanosPerKB uint64, numBlocks int) *FeeEstimator {
+	feeEstimator := &FeeEstimator{
+		bc:                   bc,
+		minFeeRateNanosPerKB: minFeeRateNanosPerKB,
+		numBlocks:            numBlocks,
+		mempoolTxns:          make(map[BlockHash]*feeEstimatorMempoolTxn),
+	}
+	eventManager := bc.EventManager()
+	eventManager.OnMempoolTxnAdded(feeEstimator.mempoolTxnAdded)
+	eventManager.OnMempoolTxnRemoved(feeEstimator.mempoolTxnRemoved)
+	eventManager.OnBlockConnected(feeEstimator.blockConnected)
+	eventManager.OnBlockDisconnected(feeEstimator.blockDisconnected)
+	return feeEstimator
+}
+
+func (fe *FeeEstimator) mempoolTxnAdded(event *MempoolTxnEvent) {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+
+	fe.mempoolTxns[*event.MempoolTx.Hash] = &feeEstimatorMempoolTxn{
+		feeRateNanosPerKB: event.MempoolTx.FeePerKB,
+		sizeBytes:         event.MempoolTx.TxSizeBytes,
+	}
+}
+
+func (fe *FeeEstimator) mempoolTxnRemoved(event *MempoolTxnEvent) {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+
+	delete(fe.mempoolTxns, *event.MempoolTx.Hash)
+}
+
+// blockConnected is called before the mempool drops the block's txns so their
+// fee rates are still known.
+func (fe *FeeEstimator) blockConnected(event *BlockEvent) {
+	blockHash, err := event.Block.Header.Hash()
+	if err != nil {
+		return
+	}
+
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+
+	block := &feeEstimatorBlock{hash: *blockHash}
+	for _, txn := range event.Block.Txns {
+		if mempoolTxn, exists := fe.mempoolTxns[*txn.Hash()]; exists {
+			block.feeRatesNanosPerKB = append(block.feeRatesNanosPerKB, mempoolTxn.feeRateNanosPerKB)
+		}
+	}
+	sort.Slice(block.feeRatesNanosPerKB, func(ii, jj int) bool {
+		return block.feeRatesNanosPerKB[ii] < block.feeRatesNanosPerKB[jj]
+	})
+
+	fe.blocks = append(fe.blocks, block)
+	if len(fe.blocks) > fe.numBlocks {
+		fe.blocks = fe.blocks[len(fe.blocks)-fe.numBlocks:]
+	}
+}
+
+func (fe *FeeEstimator) blockDisconnected(event *BlockEvent) {
+	blockHash, err := event.Block.Header.Hash()
+	if err != nil {
+		return
+	}
+
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+
+	for ii, block := range fe.blocks {
+		if block.hash == *blockHash {
+			fe.blocks = append(fe.blocks[:ii], fe.blocks[ii+1:]...)
+			return
+		}
+	}
+}
+
+// _blocksFeeRate returns the lowest fee rate that got a txn into at least one of
+// every targetBlocks consecutive recent blocks, or 0 if there aren't enough blocks
+// with known fee rates to tell.
+func (fe *FeeEstimator) _blocksFeeRate(targetBlocks int) uint64 {
+	// Blocks without any txns from the mempool would have taken a txn at any
+	// fee rate so they count as zero.
+	blockMinFeeRates := []uint64{}
+	numBlocksWithFeeRates := 0
+	for _, block := range fe.blocks {
+		if len(block.feeRatesNanosPerKB) == 0 {
+			blockMinFeeRates = append(blockMinFeeRates, 0)
+			continue
+		}
+		blockMinFeeRates = append(blockMinFeeRates, block.feeRatesNanosPerKB[0])
+		numBlocksWithFeeRates++
+	}
+	if numBlocksWithFeeRates == 0 || len(blockMinFeeRates) < targetBlocks {
+		return 0
+	}
+
+	feeRate := uint64(0)
+	for start := 0; start+targetBlocks <= len(blockMinFeeRates); start++ {
+		windowFeeRate := blockMinFeeRates[start]
+		for _, blockFeeRate := range blockMinFeeRates[start+1 : start+targetBlocks] {
+			if blockFeeRate < windowFeeRate {
+				windowFeeRate = blockFeeRate
+			}
+		}
+		if windowFeeRate > feeRate {
+			feeRate = windowFeeRate
+		}
+	}
+	return feeRate
+}
+
+// _mempoolFeeRate returns the fee rate a txn needs to outbid enough of the
+// mempool to fit in the next targetBlocks blocks, or 0 if the whole mempool
+// already fits in them.
+func (fe *FeeEstimator) _mempoolFeeRate(targetBlocks int) uint64 {
+	mempoolTxns := make([]*feeEstimatorMempoolTxn, 0, len(fe.mempoolTxns))
+	for _, mempoolTxn := range fe.mempoolTxns {
+		mempoolTxns = append(mempoolTxns, mempoolTxn)
+	}
+	sort.Slice(mempoolTxns, func(ii, jj int) bool {
+		return mempoolTxns[ii].feeRateNanosPerKB > mempoolTxns[jj].feeRateNanosPerKB
+	})
+
+	spaceBytes := uint64(targetBlocks) * fe.bc.params.MinerMaxBlockSizeBytes
+	totalSizeBytes := uint64(0)
+	for _, mempoolTxn := range mempoolTxns {
+		totalSizeBytes += mempoolTxn.sizeBytes
+		if totalSizeBytes > spaceBytes {
+			return mempoolTxn.feeRateNanosPerKB + 1
+		}
+	}
+	return 0
+}
+
+// EstimateFeeRate returns the fee rate in nanos per KB a txn should pay to be
+// mined within targetBlocks blocks. It's the higher of the rate that would have
+// made it into recent blocks and the rate that beats enough of the mempool, and
+// it's never below the node's or the network's minimum fee rate. A targetBlocks
+// of 0 is treated as 1.
+func (fe *FeeEstimator) EstimateFeeRate(targetBlocks int) uint64 {
+	if targetBlocks < 1 {
+		targetBlocks = 1
+	}
+
+	fe.mtx.RLock()
+	feeRate := fe._blocksFeeRate(targetBlocks)
+	if mempoolFeeRate := fe._mempoolFeeRate(targetBlocks); mempoolFeeRate > feeRate {
+		feeRate = mempoolFeeRate
+	}
+	fe.mtx.RUnlock()
+
+	if feeRate < fe.minFeeRateNanosPerKB {
+		feeRate = fe.minFeeRateNanosPerKB
+	}
+	networkMinFeeRate := DbGetGlobalParamsEntry(fe.bc.DB()).MinimumNetworkFeeNanosPerKB
+	if feeRate < networkMinFeeRate {
+		feeRate = networkMinFeeRate
+	}
+	return feeRate
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeEstimator(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	mempool.eventManager = chain.EventManager()
+	feeEstimator := NewFeeEstimator(chain, 10 /*minFeeRateNanosPerKB*/, FeeEstimatorNumBlocks)
+
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	// With nothing to go on the estimate is the minimum.
+	assert.Equal(uint64(10), feeEstimator.EstimateFeeRate(1))
+
+	processTxn := func(feeRateNanosPerKB uint64) *MempoolTx {
+		txn := _assembleBasicTransferTxnFullySigned(t, chain, 10, feeRateNanosPerKB,
+			senderPkString, recipientPkString, senderPrivString, mempool)
+		_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+		require.NoError(err)
+		return mempool.poolMap[*txn.Hash()]
+	}
+
+	// A mined txn's fee rate would have gotten a txn into every block.
+	minedTxn := processTxn(1000)
+	_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	assert.Equal(minedTxn.FeePerKB, feeEstimator.EstimateFeeRate(1))
+	assert.Equal(minedTxn.FeePerKB, feeEstimator.EstimateFeeRate(0))
+	// Every two blocks in a row include one that took txns at any fee rate.
+	assert.Equal(uint64(10), feeEstimator.EstimateFeeRate(2))
+
+	// When the mempool holds more than the next block, a txn has to outbid the
+	// txns that don't fit.
+	highFeeTxn := processTxn(3000)
+	lowFeeTxn := processTxn(2000)
+	assert.Equal(minedTxn.FeePerKB, feeEstimator.EstimateFeeRate(1))
+	params.MinerMaxBlockSizeBytes = highFeeTxn.TxSizeBytes
+	assert.Equal(lowFeeTxn.FeePerKB+1, feeEstimator.EstimateFeeRate(1))
+	params.MinerMaxBlockSizeBytes = highFeeTxn.TxSizeBytes + lowFeeTxn.TxSizeBytes
+	assert.Equal(minedTxn.FeePerKB, feeEstimator.EstimateFeeRate(1))
+}
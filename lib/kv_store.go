@@ -0,0 +1,871 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// KVStore is the thin layer the db code needs from a key/value store: reads and
+// writes in transactions and iteration in key order. BadgerKVStore,
+// LevelDBKVStore and PebbleKVStore implement it, and MigrateKVStore copies a db
+// from one to another.
+//
+// The Db*WithTxn functions take a KVTxn so they run on any backend. The
+// functions that take a *badger.DB open their txns with DbView, DbUpdate or
+// DbAtomicUpdate, and TxnWriter, DbWriteBatch and DBIterator are still badger
+// only since they lean on badger's own txn limits and batching.
+type KVStore interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(txn KVTxn) error) error
+	// Update runs fn in a read-write transaction that's committed if fn returns
+	// nil and discarded otherwise.
+	Update(fn func(txn KVTxn) error) error
+	Close() error
+}
+
+type KVTxn interface {
+	// Get returns ErrKVKeyNotFound if the key isn't set. The value is a copy.
+	Get(key []byte) ([]byte, error)
+	Set(key []byte, val []byte) error
+	Delete(key []byte) error
+	// Iterate calls handler with every key under prefix at or after startKey, in
+	// key order, until handler returns false or an error. An empty startKey
+	// starts at the beginning of the prefix. The slices passed to handler are
+	// only valid until it returns.
+	Iterate(prefix []byte, startKey []byte, handler func(key []byte, val []byte) (_keepGoing bool, _err error)) error
+	// NewIterator returns an iterator over the txn. It has to be closed before
+	// the txn ends.
+	NewIterator(opts KVIteratorOptions) KVIterator
+}
+
+type KVIteratorOptions struct {
+	// Only keys that start with Prefix are visited. Empty means every key.
+	Prefix []byte
+	// Keys are visited from largest to smallest.
+	Reverse bool
+	// Values are only read when Value is called. Backends that can skip
+	// prefetching values do so, which makes iterating over keys much cheaper.
+	KeysOnly bool
+}
+
+// KVIterator walks the keys in a txn in order. It starts out unpositioned, so
+// Seek has to be called before anything else.
+type KVIterator interface {
+	// Seek moves to the first key at or after key. In reverse, it moves to the
+	// last key at or before key.
+	Seek(key []byte)
+	Valid() bool
+	// ValidForPrefix is Valid and the current key starts with prefix.
+	ValidForPrefix(prefix []byte) bool
+	Next()
+	// Key is only valid until the iterator moves.
+	Key() []byte
+	// Value returns a copy of the current value.
+	Value() ([]byte, error)
+	// ValueSize is the size of the current value. Badger knows it without
+	// reading the value.
+	ValueSize() int64
+	Close()
+}
+
+var ErrKVKeyNotFound = fmt.Errorf("Key not found")
+
+const (
+	KVBackendBadger  = "badger"
+	KVBackendLevelDB = "leveldb"
+	KVBackendPebble  = "pebble"
+)
+
+// OpenKVStore opens the store for a backend in dir, creating it if it doesn't
+// exist. Badger gets the same options the node uses for the chain db.
+func OpenKVStore(backend string, dir string) (KVStore, error) {
+	switch backend {
+	case KVBackendBadger:
+		db, err := OpenBadgerDb(dir, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "OpenKVStore: ")
+		}
+		return NewBadgerKVStore(db), nil
+	case KVBackendLevelDB:
+		db, err := leveldb.OpenFile(dir, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "OpenKVStore: ")
+		}
+		return NewLevelDBKVStore(db), nil
+	case KVBackendPebble:
+		db, err := pebble.Open(dir, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "OpenKVStore: ")
+		}
+		return NewPebbleKVStore(db), nil
+	}
+	return nil, fmt.Errorf("OpenKVStore: Unknown backend %v; must be %v, %v or %v",
+		backend, KVBackendBadger, KVBackendLevelDB, KVBackendPebble)
+}
+
+// -------------------------------------------------------------------------------------
+// Badger
+// -------------------------------------------------------------------------------------
+
+type BadgerKVStore struct {
+	handle *badger.DB
+}
+
+func NewBadgerKVStore(handle *badger.DB) *BadgerKVStore {
+	return &BadgerKVStore{handle: handle}
+}
+
+// DB returns the badger db under the store for the Db* functions that take a
+// *badger.DB.
+func (bkv *BadgerKVStore) DB() *badger.DB {
+	return bkv.handle
+}
+
+func (bkv *BadgerKVStore) View(fn func(txn KVTxn) error) error {
+	return DbView(bkv.handle, fn)
+}
+
+func (bkv *BadgerKVStore) Update(fn func(txn KVTxn) error) error {
+	return DbAtomicUpdate(bkv.handle, fn)
+}
+
+func (bkv *BadgerKVStore) Close() error {
+	return bkv.handle.Close()
+}
+
+type badgerKVTxn struct {
+	txn *badger.Txn
+}
+
+// NewBadgerKVTxn wraps a badger txn so it can be passed to the Db*WithTxn
+// functions.
+func NewBadgerKVTxn(txn *badger.Txn) KVTxn {
+	return &badgerKVTxn{txn: txn}
+}
+
+func (btxn *badgerKVTxn) Get(key []byte) ([]byte, error) {
+	item, err := btxn.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKVKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (btxn *badgerKVTxn) Set(key []byte, val []byte) error {
+	return btxn.txn.Set(key, val)
+}
+
+func (btxn *badgerKVTxn) Delete(key []byte) error {
+	return btxn.txn.Delete(key)
+}
+
+func (btxn *badgerKVTxn) Iterate(prefix []byte, startKey []byte,
+	handler func(key []byte, val []byte) (_keepGoing bool, _err error)) error {
+
+	if len(startKey) == 0 {
+		startKey = prefix
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	nodeIterator := btxn.txn.NewIterator(opts)
+	defer nodeIterator.Close()
+	for nodeIterator.Seek(startKey); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+		item := nodeIterator.Item()
+		keepGoing := true
+		err := item.Value(func(valBytes []byte) error {
+			var err error
+			keepGoing, err = handler(item.Key(), valBytes)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !keepGoing {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (btxn *badgerKVTxn) NewIterator(opts KVIteratorOptions) KVIterator {
+	badgerOpts := badger.DefaultIteratorOptions
+	badgerOpts.Prefix = opts.Prefix
+	badgerOpts.Reverse = opts.Reverse
+	badgerOpts.PrefetchValues = !opts.KeysOnly
+	return &badgerKVIterator{it: btxn.txn.NewIterator(badgerOpts)}
+}
+
+type badgerKVIterator struct {
+	it *badger.Iterator
+}
+
+// Badger already seeks to the last key at or before the one passed in reverse.
+func (bit *badgerKVIterator) Seek(key []byte) {
+	bit.it.Seek(key)
+}
+
+func (bit *badgerKVIterator) Valid() bool {
+	return bit.it.Valid()
+}
+
+func (bit *badgerKVIterator) ValidForPrefix(prefix []byte) bool {
+	return bit.it.ValidForPrefix(prefix)
+}
+
+func (bit *badgerKVIterator) Next() {
+	bit.it.Next()
+}
+
+func (bit *badgerKVIterator) Key() []byte {
+	return bit.it.Item().Key()
+}
+
+func (bit *badgerKVIterator) Value() ([]byte, error) {
+	return bit.it.Item().ValueCopy(nil)
+}
+
+func (bit *badgerKVIterator) ValueSize() int64 {
+	return bit.it.Item().ValueSize()
+}
+
+func (bit *badgerKVIterator) Close() {
+	bit.it.Close()
+}
+
+// -------------------------------------------------------------------------------------
+// LevelDB
+// -------------------------------------------------------------------------------------
+
+// LevelDBKVStore is a KVStore on top of goleveldb. LevelDB only allows one write
+// transaction at a time so Updates are serialized. Views read from a snapshot.
+type LevelDBKVStore struct {
+	handle *leveldb.DB
+}
+
+func NewLevelDBKVStore(handle *leveldb.DB) *LevelDBKVStore {
+	return &LevelDBKVStore{handle: handle}
+}
+
+// _levelDBReader is satisfied by both a leveldb.Snapshot and a
+// leveldb.Transaction.
+type _levelDBReader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+func (lkv *LevelDBKVStore) View(fn func(txn KVTxn) error) error {
+	snapshot, err := lkv.handle.GetSnapshot()
+	if err != nil {
+		return errors.Wrapf(err, "LevelDBKVStore.View: ")
+	}
+	defer snapshot.Release()
+	return fn(&levelDBKVTxn{reader: snapshot})
+}
+
+func (lkv *LevelDBKVStore) Update(fn func(txn KVTxn) error) error {
+	transaction, err := lkv.handle.OpenTransaction()
+	if err != nil {
+		return errors.Wrapf(err, "LevelDBKVStore.Update: ")
+	}
+	if err := fn(&levelDBKVTxn{reader: transaction, transaction: transaction}); err != nil {
+		transaction.Discard()
+		return err
+	}
+	return transaction.Commit()
+}
+
+func (lkv *LevelDBKVStore) Close() error {
+	return lkv.handle.Close()
+}
+
+type levelDBKVTxn struct {
+	reader _levelDBReader
+	// Nil in a View.
+	transaction *leveldb.Transaction
+}
+
+func (ltxn *levelDBKVTxn) Get(key []byte) ([]byte, error) {
+	val, err := ltxn.reader.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrKVKeyNotFound
+	}
+	return val, err
+}
+
+func (ltxn *levelDBKVTxn) Set(key []byte, val []byte) error {
+	if ltxn.transaction == nil {
+		return fmt.Errorf("levelDBKVTxn.Set: Can't write in a View")
+	}
+	return ltxn.transaction.Put(key, val, nil)
+}
+
+func (ltxn *levelDBKVTxn) Delete(key []byte) error {
+	if ltxn.transaction == nil {
+		return fmt.Errorf("levelDBKVTxn.Delete: Can't write in a View")
+	}
+	return ltxn.transaction.Delete(key, nil)
+}
+
+func (ltxn *levelDBKVTxn) Iterate(prefix []byte, startKey []byte,
+	handler func(key []byte, val []byte) (_keepGoing bool, _err error)) error {
+
+	if len(startKey) == 0 {
+		startKey = prefix
+	}
+	nodeIterator := ltxn.reader.NewIterator(util.BytesPrefix(prefix), nil)
+	defer nodeIterator.Release()
+	for ok := nodeIterator.Seek(startKey); ok; ok = nodeIterator.Next() {
+		keepGoing, err := handler(nodeIterator.Key(), nodeIterator.Value())
+		if err != nil {
+			return err
+		}
+		if !keepGoing {
+			return nil
+		}
+	}
+	return nodeIterator.Error()
+}
+
+func (ltxn *levelDBKVTxn) NewIterator(opts KVIteratorOptions) KVIterator {
+	return &levelDBKVIterator{
+		it:      ltxn.reader.NewIterator(util.BytesPrefix(opts.Prefix), nil),
+		reverse: opts.Reverse,
+	}
+}
+
+// levelDBKVIterator wraps a goleveldb iterator, which is bounded to the prefix
+// and can step both ways, so reverse only changes which way Seek and Next go.
+type levelDBKVIterator struct {
+	it      iterator.Iterator
+	reverse bool
+	valid   bool
+}
+
+func (lit *levelDBKVIterator) Seek(key []byte) {
+	if !lit.reverse {
+		lit.valid = lit.it.Seek(key)
+		return
+	}
+	// Seeking to the key right after this one lands past everything at or
+	// before it, so stepping back from there lands on the last of them.
+	if lit.it.Seek(_kvKeySuccessor(key)) {
+		lit.valid = lit.it.Prev()
+	} else {
+		lit.valid = lit.it.Last()
+	}
+}
+
+func (lit *levelDBKVIterator) Valid() bool {
+	return lit.valid
+}
+
+func (lit *levelDBKVIterator) ValidForPrefix(prefix []byte) bool {
+	return lit.valid && bytes.HasPrefix(lit.it.Key(), prefix)
+}
+
+func (lit *levelDBKVIterator) Next() {
+	if lit.reverse {
+		lit.valid = lit.it.Prev()
+	} else {
+		lit.valid = lit.it.Next()
+	}
+}
+
+func (lit *levelDBKVIterator) Key() []byte {
+	return lit.it.Key()
+}
+
+func (lit *levelDBKVIterator) Value() ([]byte, error) {
+	return append([]byte{}, lit.it.Value()...), lit.it.Error()
+}
+
+func (lit *levelDBKVIterator) ValueSize() int64 {
+	return int64(len(lit.it.Value()))
+}
+
+func (lit *levelDBKVIterator) Close() {
+	lit.it.Release()
+}
+
+// _kvKeySuccessor returns the smallest key that is bigger than key.
+func _kvKeySuccessor(key []byte) []byte {
+	return append(append([]byte{}, key...), 0)
+}
+
+// -------------------------------------------------------------------------------------
+// Pebble
+// -------------------------------------------------------------------------------------
+
+// PebbleKVStore is a KVStore on top of Pebble. Views read from a snapshot and
+// Updates write to an indexed batch, so they see their own writes, that's
+// committed at the end. Pebble doesn't detect conflicts between batches so
+// Updates are serialized.
+type PebbleKVStore struct {
+	handle *pebble.DB
+
+	updateLock sync.Mutex
+}
+
+func NewPebbleKVStore(handle *pebble.DB) *PebbleKVStore {
+	return &PebbleKVStore{handle: handle}
+}
+
+func (pkv *PebbleKVStore) View(fn func(txn KVTxn) error) error {
+	snapshot := pkv.handle.NewSnapshot()
+	defer snapshot.Close()
+	return fn(&pebbleKVTxn{reader: snapshot})
+}
+
+func (pkv *PebbleKVStore) Update(fn func(txn KVTxn) error) error {
+	pkv.updateLock.Lock()
+	defer pkv.updateLock.Unlock()
+
+	batch := pkv.handle.NewIndexedBatch()
+	defer batch.Close()
+	if err := fn(&pebbleKVTxn{reader: batch, batch: batch}); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+func (pkv *PebbleKVStore) Close() error {
+	return pkv.handle.Close()
+}
+
+type pebbleKVTxn struct {
+	reader pebble.Reader
+	// Nil in a View.
+	batch *pebble.Batch
+}
+
+func (ptxn *pebbleKVTxn) Get(key []byte) ([]byte, error) {
+	val, closer, err := ptxn.reader.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, ErrKVKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return append([]byte{}, val...), nil
+}
+
+func (ptxn *pebbleKVTxn) Set(key []byte, val []byte) error {
+	if ptxn.batch == nil {
+		return fmt.Errorf("pebbleKVTxn.Set: Can't write in a View")
+	}
+	return ptxn.batch.Set(key, val, nil)
+}
+
+func (ptxn *pebbleKVTxn) Delete(key []byte) error {
+	if ptxn.batch == nil {
+		return fmt.Errorf("pebbleKVTxn.Delete: Can't write in a View")
+	}
+	return ptxn.batch.Delete(key, nil)
+}
+
+func (ptxn *pebbleKVTxn) Iterate(prefix []byte, startKey []byte,
+	handler func(key []byte, val []byte) (_keepGoing bool, _err error)) error {
+
+	if len(startKey) == 0 {
+		startKey = prefix
+	}
+	nodeIterator := ptxn.reader.NewIter(_pebbleIterOptionsForPrefix(prefix))
+	for ok := nodeIterator.SeekGE(startKey); ok; ok = nodeIterator.Next() {
+		keepGoing, err := handler(nodeIterator.Key(), nodeIterator.Value())
+		if err != nil {
+			nodeIterator.Close()
+			return err
+		}
+		if !keepGoing {
+			break
+		}
+	}
+	return nodeIterator.Close()
+}
+
+func (ptxn *pebbleKVTxn) NewIterator(opts KVIteratorOptions) KVIterator {
+	return &pebbleKVIterator{
+		it:      ptxn.reader.NewIter(_pebbleIterOptionsForPrefix(opts.Prefix)),
+		reverse: opts.Reverse,
+	}
+}
+
+// _pebbleIterOptionsForPrefix bounds an iterator to the keys under prefix.
+func _pebbleIterOptionsForPrefix(prefix []byte) *pebble.IterOptions {
+	if len(prefix) == 0 {
+		return nil
+	}
+	return &pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: _dbKeyUpperBound(prefix),
+	}
+}
+
+type pebbleKVIterator struct {
+	it      *pebble.Iterator
+	reverse bool
+	valid   bool
+}
+
+func (pit *pebbleKVIterator) Seek(key []byte) {
+	if pit.reverse {
+		pit.valid = pit.it.SeekLT(_kvKeySuccessor(key))
+	} else {
+		pit.valid = pit.it.SeekGE(key)
+	}
+}
+
+func (pit *pebbleKVIterator) Valid() bool {
+	return pit.valid
+}
+
+func (pit *pebbleKVIterator) ValidForPrefix(prefix []byte) bool {
+	return pit.valid && bytes.HasPrefix(pit.it.Key(), prefix)
+}
+
+func (pit *pebbleKVIterator) Next() {
+	if pit.reverse {
+		pit.valid = pit.it.Prev()
+	} else {
+		pit.valid = pit.it.Next()
+	}
+}
+
+func (pit *pebbleKVIterator) Key() []byte {
+	return pit.it.Key()
+}
+
+func (pit *pebbleKVIterator) Value() ([]byte, error) {
+	return append([]byte{}, pit.it.Value()...), pit.it.Error()
+}
+
+func (pit *pebbleKVIterator) ValueSize() int64 {
+	return int64(len(pit.it.Value()))
+}
+
+func (pit *pebbleKVIterator) Close() {
+	pit.it.Close()
+}
+
+// -------------------------------------------------------------------------------------
+// Write sets
+// -------------------------------------------------------------------------------------
+
+// kvWriteSetTxn reads through to another txn but keeps its own writes in memory,
+// so a set of writes can be worked out against a read-only txn and then applied
+// somewhere else, like a DbWriteBatch. Reads see the writes made so far, and so do
+// iterators for the writes made before they were created.
+type kvWriteSetTxn struct {
+	reader KVTxn
+	// Keyed by string(key). A nil value means the key was deleted.
+	writes map[string][]byte
+}
+
+func newKVWriteSetTxn(reader KVTxn) *kvWriteSetTxn {
+	return &kvWriteSetTxn{
+		reader: reader,
+		writes: make(map[string][]byte),
+	}
+}
+
+func (wtxn *kvWriteSetTxn) Get(key []byte) ([]byte, error) {
+	if val, exists := wtxn.writes[string(key)]; exists {
+		if val == nil {
+			return nil, ErrKVKeyNotFound
+		}
+		return append([]byte{}, val...), nil
+	}
+	return wtxn.reader.Get(key)
+}
+
+func (wtxn *kvWriteSetTxn) Set(key []byte, val []byte) error {
+	wtxn.writes[string(key)] = append([]byte{}, val...)
+	return nil
+}
+
+func (wtxn *kvWriteSetTxn) Delete(key []byte) error {
+	wtxn.writes[string(key)] = nil
+	return nil
+}
+
+func (wtxn *kvWriteSetTxn) Iterate(prefix []byte, startKey []byte,
+	handler func(key []byte, val []byte) (_keepGoing bool, _err error)) error {
+
+	if len(startKey) == 0 {
+		startKey = prefix
+	}
+	nodeIterator := wtxn.NewIterator(KVIteratorOptions{Prefix: prefix})
+	defer nodeIterator.Close()
+	for nodeIterator.Seek(startKey); nodeIterator.ValidForPrefix(prefix); nodeIterator.Next() {
+		val, err := nodeIterator.Value()
+		if err != nil {
+			return err
+		}
+		keepGoing, err := handler(nodeIterator.Key(), val)
+		if err != nil {
+			return err
+		}
+		if !keepGoing {
+			return nil
+		}
+	}
+	return nil
+}
+
+// _sortedKeys returns the keys written under prefix in the order an iterator
+// visits them.
+func (wtxn *kvWriteSetTxn) _sortedKeys(prefix []byte, reverse bool) [][]byte {
+	keys := [][]byte{}
+	for keyStr := range wtxn.writes {
+		if bytes.HasPrefix([]byte(keyStr), prefix) {
+			keys = append(keys, []byte(keyStr))
+		}
+	}
+	sort.Slice(keys, func(ii, jj int) bool {
+		if reverse {
+			return bytes.Compare(keys[ii], keys[jj]) > 0
+		}
+		return bytes.Compare(keys[ii], keys[jj]) < 0
+	})
+	return keys
+}
+
+func (wtxn *kvWriteSetTxn) NewIterator(opts KVIteratorOptions) KVIterator {
+	return &kvWriteSetIterator{
+		wtxn:      wtxn,
+		base:      wtxn.reader.NewIterator(opts),
+		writeKeys: wtxn._sortedKeys(opts.Prefix, opts.Reverse),
+		reverse:   opts.Reverse,
+	}
+}
+
+// writeTo applies the writes to a DbWriteBatch in key order.
+func (wtxn *kvWriteSetTxn) writeTo(dbWriteBatch *DbWriteBatch) error {
+	for _, key := range wtxn._sortedKeys(nil, false) {
+		val := wtxn.writes[string(key)]
+		if val == nil {
+			if err := dbWriteBatch.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dbWriteBatch.Set(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kvWriteSetIterator merges the keys a kvWriteSetTxn wrote with the ones in the
+// txn it reads through to. A written key hides the key it overwrote, and a
+// deleted one is skipped along with it.
+type kvWriteSetIterator struct {
+	wtxn       *kvWriteSetTxn
+	base       KVIterator
+	writeKeys  [][]byte
+	writeIndex int
+	reverse    bool
+
+	valid bool
+	// Whether the current key is one of writeKeys rather than base's.
+	fromWrites bool
+}
+
+// _before returns whether the iterator visits a before b.
+func (wit *kvWriteSetIterator) _before(a []byte, b []byte) bool {
+	if wit.reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// _settle positions the iterator on whichever of base's key and the next written
+// key comes first.
+func (wit *kvWriteSetIterator) _settle() {
+	for {
+		baseValid := wit.base.Valid()
+		writeValid := wit.writeIndex < len(wit.writeKeys)
+		if !baseValid && !writeValid {
+			wit.valid = false
+			return
+		}
+		if !writeValid || (baseValid && wit._before(wit.base.Key(), wit.writeKeys[wit.writeIndex])) {
+			wit.valid = true
+			wit.fromWrites = false
+			return
+		}
+
+		writeKey := wit.writeKeys[wit.writeIndex]
+		if baseValid && bytes.Equal(wit.base.Key(), writeKey) {
+			wit.base.Next()
+		}
+		if wit.wtxn.writes[string(writeKey)] == nil {
+			wit.writeIndex++
+			continue
+		}
+		wit.valid = true
+		wit.fromWrites = true
+		return
+	}
+}
+
+func (wit *kvWriteSetIterator) Seek(key []byte) {
+	wit.base.Seek(key)
+	wit.writeIndex = sort.Search(len(wit.writeKeys), func(ii int) bool {
+		return !wit._before(wit.writeKeys[ii], key)
+	})
+	wit._settle()
+}
+
+func (wit *kvWriteSetIterator) Valid() bool {
+	return wit.valid
+}
+
+func (wit *kvWriteSetIterator) ValidForPrefix(prefix []byte) bool {
+	return wit.valid && bytes.HasPrefix(wit.Key(), prefix)
+}
+
+func (wit *kvWriteSetIterator) Next() {
+	if wit.fromWrites {
+		wit.writeIndex++
+	} else {
+		wit.base.Next()
+	}
+	wit._settle()
+}
+
+func (wit *kvWriteSetIterator) Key() []byte {
+	if wit.fromWrites {
+		return wit.writeKeys[wit.writeIndex]
+	}
+	return wit.base.Key()
+}
+
+func (wit *kvWriteSetIterator) Value() ([]byte, error) {
+	if wit.fromWrites {
+		return append([]byte{}, wit.wtxn.writes[string(wit.writeKeys[wit.writeIndex])]...), nil
+	}
+	return wit.base.Value()
+}
+
+func (wit *kvWriteSetIterator) ValueSize() int64 {
+	if wit.fromWrites {
+		return int64(len(wit.wtxn.writes[string(wit.writeKeys[wit.writeIndex])]))
+	}
+	return wit.base.ValueSize()
+}
+
+func (wit *kvWriteSetIterator) Close() {
+	wit.base.Close()
+}
+
+// -------------------------------------------------------------------------------------
+// Migration
+// -------------------------------------------------------------------------------------
+
+// MigrateKVStore copies every key in src to dst, committing every batchSize keys.
+// dst should be empty. The copy is read from a single View of src so src must
+// not be written to while it runs. Returns the number of keys copied.
+func MigrateKVStore(src KVStore, dst KVStore, batchSize int) (uint64, error) {
+	if batchSize <= 0 {
+		batchSize = 10000
+	}
+
+	numKeys := uint64(0)
+	batchKeys := [][]byte{}
+	batchVals := [][]byte{}
+	flushBatch := func() error {
+		if len(batchKeys) == 0 {
+			return nil
+		}
+		err := dst.Update(func(txn KVTxn) error {
+			for ii, key := range batchKeys {
+				if err := txn.Set(key, batchVals[ii]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		numKeys += uint64(len(batchKeys))
+		batchKeys = [][]byte{}
+		batchVals = [][]byte{}
+		if numKeys%(100*uint64(batchSize)) == 0 {
+			glog.Infof("MigrateKVStore: Copied %d keys", numKeys)
+		}
+		return nil
+	}
+
+	err := src.View(func(txn KVTxn) error {
+		return txn.Iterate([]byte{}, nil, func(key []byte, val []byte) (bool, error) {
+			batchKeys = append(batchKeys, append([]byte{}, key...))
+			batchVals = append(batchVals, append([]byte{}, val...))
+			if len(batchKeys) < batchSize {
+				return true, nil
+			}
+			return true, flushBatch()
+		})
+	})
+	if err == nil {
+		err = flushBatch()
+	}
+	if err != nil {
+		return numKeys, errors.Wrapf(err, "MigrateKVStore: Problem after copying %d keys", numKeys)
+	}
+	return numKeys, nil
+}
+
+// VerifyKVStoreMigration checks that dst has exactly the keys and values in src.
+func VerifyKVStoreMigration(src KVStore, dst KVStore) error {
+	return src.View(func(srcTxn KVTxn) error {
+		return dst.View(func(dstTxn KVTxn) error {
+			numSrcKeys := uint64(0)
+			err := srcTxn.Iterate([]byte{}, nil, func(key []byte, val []byte) (bool, error) {
+				numSrcKeys++
+				dstVal, err := dstTxn.Get(key)
+				if err != nil {
+					return false, errors.Wrapf(err, "VerifyKVStoreMigration: Problem "+
+						"reading key %v from dst", key)
+				}
+				if !bytes.Equal(val, dstVal) {
+					return false, fmt.Errorf("VerifyKVStoreMigration: Key %v has a "+
+						"different value in dst", key)
+				}
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+			numDstKeys := uint64(0)
+			err = dstTxn.Iterate([]byte{}, nil, func(key []byte, val []byte) (bool, error) {
+				numDstKeys++
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+			if numSrcKeys != numDstKeys {
+				return fmt.Errorf("VerifyKVStoreMigration: src has %d keys but dst has %d",
+					numSrcKeys, numDstKeys)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	levelDBDir, err := ioutil.TempDir("", "leveldb")
+	require.NoError(err)
+	defer os.RemoveAll(levelDBDir)
+	levelDBStore, err := OpenKVStore(KVBackendLevelDB, levelDBDir)
+	require.NoError(err)
+	defer levelDBStore.Close()
+	pebbleDir, err := ioutil.TempDir("", "pebble")
+	require.NoError(err)
+	defer os.RemoveAll(pebbleDir)
+	pebbleStore, err := OpenKVStore(KVBackendPebble, pebbleDir)
+	require.NoError(err)
+	defer pebbleStore.Close()
+
+	// Every backend behaves the same.
+	for _, store := range []KVStore{NewBadgerKVStore(db), levelDBStore, pebbleStore} {
+		require.NoError(store.Update(func(txn KVTxn) error {
+			for _, key := range []string{"a1", "a2", "a3", "b1"} {
+				if err := txn.Set([]byte(key), []byte("val"+key)); err != nil {
+					return err
+				}
+			}
+			// An update sees its own writes.
+			val, err := txn.Get([]byte("a3"))
+			require.NoError(err)
+			assert.Equal([]byte("vala3"), val, "%T", store)
+			return nil
+		}))
+		require.NoError(store.View(func(txn KVTxn) error {
+			val, err := txn.Get([]byte("a2"))
+			require.NoError(err)
+			assert.Equal([]byte("vala2"), val)
+			_, err = txn.Get([]byte("a4"))
+			assert.Equal(ErrKVKeyNotFound, err)
+			assert.Error(txn.Set([]byte("c1"), []byte{}), "%T", store)
+
+			keys := []string{}
+			require.NoError(txn.Iterate([]byte("a"), []byte("a2"), func(key []byte, val []byte) (bool, error) {
+				keys = append(keys, string(key))
+				return true, nil
+			}))
+			assert.Equal([]string{"a2", "a3"}, keys)
+			keys = []string{}
+			require.NoError(txn.Iterate([]byte("a"), nil, func(key []byte, val []byte) (bool, error) {
+				keys = append(keys, string(key))
+				return len(keys) < 2, nil
+			}))
+			assert.Equal([]string{"a1", "a2"}, keys)
+
+			iterKeys := func(opts KVIteratorOptions, seekKey string) []string {
+				it := txn.NewIterator(opts)
+				defer it.Close()
+				keys := []string{}
+				for it.Seek([]byte(seekKey)); it.ValidForPrefix(opts.Prefix); it.Next() {
+					val, err := it.Value()
+					require.NoError(err)
+					assert.Equal("val"+string(it.Key()), string(val))
+					keys = append(keys, string(it.Key()))
+				}
+				return keys
+			}
+			assert.Equal([]string{"a2", "a3"}, iterKeys(
+				KVIteratorOptions{Prefix: []byte("a")}, "a2"), "%T", store)
+			assert.Equal([]string{"a1", "a2", "a3", "b1"}, iterKeys(
+				KVIteratorOptions{KeysOnly: true}, ""), "%T", store)
+			// In reverse, Seek lands on the last key at or before the one passed.
+			assert.Equal([]string{"a3", "a2", "a1"}, iterKeys(
+				KVIteratorOptions{Prefix: []byte("a"), Reverse: true}, "a\xff"), "%T", store)
+			assert.Equal([]string{"a2", "a1"}, iterKeys(
+				KVIteratorOptions{Prefix: []byte("a"), Reverse: true}, "a2"), "%T", store)
+			assert.Equal([]string{"a2", "a1"}, iterKeys(
+				KVIteratorOptions{Prefix: []byte("a"), Reverse: true}, "a25"), "%T", store)
+			return nil
+		}))
+	}
+
+	// A migration copies every key and a failed Update writes nothing.
+	migratedDir, err := ioutil.TempDir("", "leveldb")
+	require.NoError(err)
+	defer os.RemoveAll(migratedDir)
+	migratedStore, err := OpenKVStore(KVBackendLevelDB, migratedDir)
+	require.NoError(err)
+	defer migratedStore.Close()
+	numKeys, err := MigrateKVStore(NewBadgerKVStore(db), migratedStore, 3)
+	require.NoError(err)
+	assert.Equal(uint64(4), numKeys)
+	require.NoError(VerifyKVStoreMigration(NewBadgerKVStore(db), migratedStore))
+
+	assert.Error(migratedStore.Update(func(txn KVTxn) error {
+		require.NoError(txn.Delete([]byte("a1")))
+		return ErrKVKeyNotFound
+	}))
+	require.NoError(VerifyKVStoreMigration(NewBadgerKVStore(db), migratedStore))
+	require.NoError(migratedStore.Update(func(txn KVTxn) error {
+		return txn.Delete([]byte("a1"))
+	}))
+	assert.Error(VerifyKVStoreMigration(NewBadgerKVStore(db), migratedStore))
+}
+
+func TestKVWriteSetTxn(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	db, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	require.NoError(DbUpdate(db, func(txn KVTxn) error {
+		for _, key := range []string{"a1", "a2", "a4", "b1"} {
+			if err := txn.Set([]byte(key), []byte("val"+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// Reads and iterators see the writes on top of the db without the db seeing
+	// them until they're applied.
+	var writeSetTxn *kvWriteSetTxn
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		writeSetTxn = newKVWriteSetTxn(txn)
+		require.NoError(writeSetTxn.Set([]byte("a3"), []byte("vala3")))
+		require.NoError(writeSetTxn.Set([]byte("a4"), []byte("newa4")))
+		require.NoError(writeSetTxn.Delete([]byte("a2")))
+		require.NoError(writeSetTxn.Delete([]byte("a5")))
+
+		val, err := writeSetTxn.Get([]byte("a4"))
+		require.NoError(err)
+		assert.Equal([]byte("newa4"), val)
+		_, err = writeSetTxn.Get([]byte("a2"))
+		assert.Equal(ErrKVKeyNotFound, err)
+		_, err = txn.Get([]byte("a3"))
+		assert.Equal(ErrKVKeyNotFound, err)
+
+		iterKeys := func(opts KVIteratorOptions, seekKey string) []string {
+			it := writeSetTxn.NewIterator(opts)
+			defer it.Close()
+			keys := []string{}
+			for it.Seek([]byte(seekKey)); it.ValidForPrefix(opts.Prefix); it.Next() {
+				val, err := it.Value()
+				require.NoError(err)
+				keys = append(keys, string(it.Key())+"="+string(val))
+			}
+			return keys
+		}
+		assert.Equal([]string{"a1=vala1", "a3=vala3", "a4=newa4"}, iterKeys(
+			KVIteratorOptions{Prefix: []byte("a")}, "a"))
+		assert.Equal([]string{"a3=vala3", "a4=newa4", "b1=valb1"}, iterKeys(
+			KVIteratorOptions{}, "a2"))
+		assert.Equal([]string{"a4=newa4", "a3=vala3", "a1=vala1"}, iterKeys(
+			KVIteratorOptions{Prefix: []byte("a"), Reverse: true}, "a\xff"))
+		assert.Equal([]string{"a1=vala1"}, iterKeys(
+			KVIteratorOptions{Prefix: []byte("a"), Reverse: true}, "a25"))
+		return nil
+	}))
+
+	require.NoError(DbUpdateWithWriteBatch(db, 0, nil, writeSetTxn.writeTo))
+	require.NoError(DbView(db, func(txn KVTxn) error {
+		keys := []string{}
+		require.NoError(txn.Iterate(nil, nil, func(key []byte, val []byte) (bool, error) {
+			keys = append(keys, string(key)+"="+string(val))
+			return true, nil
+		}))
+		assert.Equal([]string{"a1=vala1", "a3=vala3", "a4=newa4", "b1=valb1"}, keys)
+		return nil
+	}))
+}
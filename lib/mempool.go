@@ -18,8 +18,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/badger/v3"
-
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 
@@ -31,12 +29,17 @@ import (
 // mempool.go contains all of the mempool logic for the BitClout node.
 
 const (
-	// MaxTotalTransactionSizeBytes is the maximum number of bytes the pool can store
-	// across all of its transactions. Once this limit is reached, transactions must
+	// MaxTotalTransactionSizeBytes is the default maximum number of bytes the pool can
+	// store across all of its transactions. Once this limit is reached, transactions must
 	// be evicted from the pool based on their feerate before new transactions can be
 	// added.
 	MaxTotalTransactionSizeBytes = 250000000 // 250MB
 
+	// When the pool goes over its limit, it evicts txns until it's this percent of
+	// its limit so it doesn't have to be rebuilt for every txn that comes in while
+	// it's full.
+	MempoolEvictionTargetPercent = 90
+
 	// UnconnectedTxnExpirationInterval is how long we wait before automatically removing an
 	// unconnected transaction.
 	UnconnectedTxnExpirationInterval = time.Minute * 5
@@ -46,6 +49,10 @@ const (
 
 	// The maximum number of bytes a single unconnected transaction can take up
 	MaxUnconnectedTxSizeBytes = 100000
+
+	// The maximum number of unconnected transactions a single peer can have in
+	// the pool at once so one peer can't push out everyone else's.
+	MaxUnconnectedTxnsPerPeer = 100
 )
 
 var (
@@ -141,6 +148,19 @@ func (pq *MempoolTxFeeMinHeap) Pop() interface{} {
 	return item
 }
 
+// MempoolEvictionStats counts the txns the pool has evicted to stay under its
+// size limit.
+type MempoolEvictionStats struct {
+	// The number of times the pool went over its limit and evicted txns.
+	NumEvictions uint64
+	// The number of txns evicted, including the ones evicted because they
+	// depended on an evicted txn.
+	NumTxnsEvicted uint64
+	// The number of txns evicted because they depended on an evicted txn.
+	NumDescendantsEvicted uint64
+	NumBytesEvicted       uint64
+}
+
 // UnconnectedTx is a transaction that has dependencies that we haven't added yet.
 type UnconnectedTx struct {
 	tx *MsgBitCloutTxn
@@ -160,6 +180,11 @@ type BitCloutMempool struct {
 	// adding them to the pool.
 	bc *Blockchain
 
+	// Sends an event whenever a txn is added to or removed from the pool. Only
+	// set on the node's mempool and not on the temporary pools used to rebuild
+	// it, so rebuilding only sends events for the txns that actually changed.
+	eventManager *EventManager
+
 	// Transactions with a feerate below this threshold are outright rejected.
 	minFeeRateNanosPerKB uint64
 
@@ -183,6 +208,15 @@ type BitCloutMempool struct {
 	// use it to determine when the pool is nearing memory-exhaustion so we can start
 	// evicting transactions.
 	totalTxSizeBytes uint64
+	// maxTotalTxSizeBytes is the most totalTxSizeBytes can be before the txns with
+	// the lowest feerates are evicted.
+	maxTotalTxSizeBytes uint64
+	// evictionStats is shared with the temporary pools used to rebuild this one
+	// so the txns they evict are counted too.
+	evictionStats *MempoolEvictionStats
+	// limiter caps the txns each public key and source can have in the pool. It's
+	// nil when there are no limits, which is always the case for temporary pools.
+	limiter *MempoolLimiter
 	// Stores the inputs for every transaction stored in poolMap. Used to quickly check
 	// if a transaction is double-spending.
 	outpoints map[UtxoKey]*MsgBitCloutTxn
@@ -192,6 +226,10 @@ type BitCloutMempool struct {
 	// Organizes unconnectedTxns by their UTXOs. Used when adding a transaction to determine
 	// which unconnectedTxns are no longer missing parents.
 	unconnectedTxnsByPrev map[UtxoKey]map[BlockHash]*MsgBitCloutTxn
+	// The number of unconnectedTxns each peer sent, and the most a peer can have
+	// in the pool before the rest of its unconnected txns are rejected.
+	numUnconnectedTxnsForPeer map[uint64]int
+	maxUnconnectedTxnsPerPeer int
 	// An exponentially-decayed accumulator of "low-fee" transactions we've relayed.
 	// This is used to prevent someone from flooding the network with low-fee
 	// transactions.
@@ -305,6 +343,31 @@ func (mp *BitCloutMempool) removeUnconnectedTxn(tx *MsgBitCloutTxn, removeRedeem
 
 	// Delete the txn from the unconnectedTxn map
 	delete(mp.unconnectedTxns, *txHash)
+	mp.numUnconnectedTxnsForPeer[unconnectedTxn.peerID]--
+	if mp.numUnconnectedTxnsForPeer[unconnectedTxn.peerID] <= 0 {
+		delete(mp.numUnconnectedTxnsForPeer, unconnectedTxn.peerID)
+	}
+}
+
+// RemoveUnconnectedTxnsFromPeer removes the unconnected txns a peer sent, along
+// with the unconnected txns that spend them. It's called when the peer
+// disconnects.
+func (mp *BitCloutMempool) RemoveUnconnectedTxnsFromPeer(peerID uint64) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	numRemoved := 0
+	for _, unconnectedTxn := range mp.unconnectedTxns {
+		if unconnectedTxn.peerID != peerID {
+			continue
+		}
+		numRemoved++
+		mp.removeUnconnectedTxn(unconnectedTxn.tx, true)
+	}
+	if numRemoved > 0 {
+		glog.Debugf("RemoveUnconnectedTxnsFromPeer: Removed %d unconnected txns from peer %d "+
+			"(remaining: %d)", numRemoved, peerID, len(mp.unconnectedTxns))
+	}
 }
 
 // ResetPool replaces all of the internal data associated with a pool object with the
@@ -314,6 +377,22 @@ func (mp *BitCloutMempool) removeUnconnectedTxn(tx *MsgBitCloutTxn, removeRedeem
 //
 // Note the write lock must be held before calling this function.
 func (mp *BitCloutMempool) resetPool(newPool *BitCloutMempool) {
+	// Figure out which txns the new pool drops and which it adds before the old
+	// pool's mappings are replaced.
+	var removedTxns, addedTxns []*MempoolTx
+	if mp.eventManager != nil || mp.limiter != nil {
+		for poolHash, mempoolTx := range mp.poolMap {
+			if _, exists := newPool.poolMap[poolHash]; !exists {
+				removedTxns = append(removedTxns, mempoolTx)
+			}
+		}
+		for poolHash, mempoolTx := range newPool.poolMap {
+			if _, exists := mp.poolMap[poolHash]; !exists {
+				addedTxns = append(addedTxns, mempoolTx)
+			}
+		}
+	}
+
 	// Replace the internal mappings of the original pool with the mappings of the new
 	// pool.
 	mp.poolMap = newPool.poolMap
@@ -323,6 +402,7 @@ func (mp *BitCloutMempool) resetPool(newPool *BitCloutMempool) {
 	mp.pubKeyToTxnMap = newPool.pubKeyToTxnMap
 	mp.unconnectedTxns = newPool.unconnectedTxns
 	mp.unconnectedTxnsByPrev = newPool.unconnectedTxnsByPrev
+	mp.numUnconnectedTxnsForPeer = newPool.numUnconnectedTxnsForPeer
 	mp.unminedBitcoinTxns = newPool.unminedBitcoinTxns
 	mp.nextExpireScan = newPool.nextExpireScan
 	mp.backupUniversalUtxoView = newPool.backupUniversalUtxoView
@@ -349,6 +429,25 @@ func (mp *BitCloutMempool) resetPool(newPool *BitCloutMempool) {
 
 	// Don't adjust the lowFeeTxSizeAccumulator or the lastLowFeeTxUnixTime since
 	// the old values should be unaffected.
+
+	// The txns the new pool adds came out of the old pool's unconnected txns so
+	// the peers that sent them aren't known.
+	if mp.limiter != nil {
+		for _, mempoolTx := range removedTxns {
+			mp.limiter.removeTxn(mempoolTx.Hash)
+		}
+		for _, mempoolTx := range addedTxns {
+			mp.limiter.addTxn(mempoolTx, 0 /*peerID*/)
+		}
+	}
+	if mp.eventManager != nil {
+		for _, mempoolTx := range removedTxns {
+			mp.eventManager.mempoolTxnRemoved(mempoolTx)
+		}
+		for _, mempoolTx := range addedTxns {
+			mp.eventManager.mempoolTxnAdded(mempoolTx)
+		}
+	}
 }
 
 // UpdateAfterConnectBlock updates the mempool after a block has been added to the
@@ -389,6 +488,7 @@ func (mp *BitCloutMempool) UpdateAfterConnectBlock(blk *MsgBitCloutBlock) (_txns
 		"",    /*blockCypherAPIKey*/
 		false, /*runReadOnlyViewUpdater*/
 		"" /*dataDir*/, "")
+	mp._shareEvictionPolicy(newPool)
 
 	// Get all the transactions from the old pool object.
 	oldMempoolTxns, oldUnconnectedTxns, err := mp._getTransactionsOrderedByTimeAdded()
@@ -492,6 +592,7 @@ func (mp *BitCloutMempool) UpdateAfterDisconnectBlock(blk *MsgBitCloutBlock) {
 		0, /* minFeeRateNanosPerKB */
 		"" /*blockCypherAPIKey*/, false,
 		"" /*dataDir*/, "")
+	mp._shareEvictionPolicy(newPool)
 
 	// Add the transactions from the block to the new pool (except for the block reward,
 	// which should always be the first transaction). Break out if we encounter
@@ -578,6 +679,98 @@ func (mp *BitCloutMempool) GetTransaction(txId *BlockHash) (txn *MempoolTx) {
 	return mp.readOnlyUniversalTransactionMap[*txId]
 }
 
+// MempoolTxnQuery selects txns from the mempool. The zero value selects every
+// txn in the pool.
+type MempoolTxnQuery struct {
+	// Only txns of these types are returned. Empty means every type.
+	TxnTypes []TxnType
+	// Only txns with this transactor public key are returned. Empty means any
+	// transactor.
+	TransactorPublicKey []byte
+	// Only txns with a fee rate within this range are returned. A max of zero
+	// means there is no max.
+	MinFeeRateNanosPerKB uint64
+	MaxFeeRateNanosPerKB uint64
+	// Only txns that come after the cursor are returned. Nil starts from the txn
+	// that was added first.
+	Cursor *MempoolTxnCursor
+	// The most txns to return. Zero returns every txn that matches.
+	Limit int
+}
+
+// MempoolTxnCursor is a position in the mempool's txns ordered by when they
+// were added, with ties broken by hash. It stays valid after the txn it points
+// at leaves the pool.
+type MempoolTxnCursor struct {
+	AddedNanos int64
+	TxHash     BlockHash
+}
+
+func _mempoolTxnCursorFor(mempoolTx *MempoolTx) *MempoolTxnCursor {
+	return &MempoolTxnCursor{
+		AddedNanos: mempoolTx.Added.UnixNano(),
+		TxHash:     *mempoolTx.Hash,
+	}
+}
+
+// _isBefore returns true if the cursor comes before the other one.
+func (cursor *MempoolTxnCursor) _isBefore(other *MempoolTxnCursor) bool {
+	if cursor.AddedNanos != other.AddedNanos {
+		return cursor.AddedNanos < other.AddedNanos
+	}
+	return bytes.Compare(cursor.TxHash[:], other.TxHash[:]) < 0
+}
+
+// QueryTransactions returns the txns in the pool that match the query ordered
+// by when they were added, oldest first. It reads the pool's in-memory state
+// rather than the db. To fetch the next page, pass the returned cursor, which
+// is nil once there are no more matching txns.
+func (mp *BitCloutMempool) QueryTransactions(query *MempoolTxnQuery) (
+	_mempoolTxns []*MempoolTx, _nextCursor *MempoolTxnCursor) {
+
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	// The txns of a transactor are all indexed under its public key, so only
+	// those need to be looked at when there is one.
+	candidateTxns := mp.poolMap
+	if len(query.TransactorPublicKey) != 0 {
+		candidateTxns = mp.pubKeyToTxnMap[MakePkMapKey(query.TransactorPublicKey)]
+	}
+	txnTypes := make(map[TxnType]bool)
+	for _, txnType := range query.TxnTypes {
+		txnTypes[txnType] = true
+	}
+
+	mempoolTxns := []*MempoolTx{}
+	for _, mempoolTx := range candidateTxns {
+		if len(query.TransactorPublicKey) != 0 &&
+			!bytes.Equal(mempoolTx.Tx.PublicKey, query.TransactorPublicKey) {
+			continue
+		}
+		if len(txnTypes) != 0 && !txnTypes[mempoolTx.Tx.TxnMeta.GetTxnType()] {
+			continue
+		}
+		if mempoolTx.FeePerKB < query.MinFeeRateNanosPerKB ||
+			(query.MaxFeeRateNanosPerKB != 0 && mempoolTx.FeePerKB > query.MaxFeeRateNanosPerKB) {
+			continue
+		}
+		if query.Cursor != nil && !query.Cursor._isBefore(_mempoolTxnCursorFor(mempoolTx)) {
+			continue
+		}
+		mempoolTxns = append(mempoolTxns, mempoolTx)
+	}
+	sort.Slice(mempoolTxns, func(ii, jj int) bool {
+		return _mempoolTxnCursorFor(mempoolTxns[ii])._isBefore(_mempoolTxnCursorFor(mempoolTxns[jj]))
+	})
+
+	if query.Limit == 0 || len(mempoolTxns) <= query.Limit {
+		return mempoolTxns, nil
+	}
+	mempoolTxns = mempoolTxns[:query.Limit]
+	return mempoolTxns, _mempoolTxnCursorFor(mempoolTxns[len(mempoolTxns)-1])
+}
+
 // GetTransactionsOrderedByTimeAdded returns all transactions in the mempool ordered
 // by when they were added to the mempool.
 func (mp *BitCloutMempool) _getTransactionsOrderedByTimeAdded() (_poolTxns []*MempoolTx, _unconnectedTxns []*UnconnectedTx, _err error) {
@@ -645,6 +838,7 @@ func (mp *BitCloutMempool) addUnconnectedTxn(tx *MsgBitCloutTxn, peerID uint64)
 		peerID:     peerID,
 		expiration: time.Now().Add(UnconnectedTxnExpirationInterval),
 	}
+	mp.numUnconnectedTxnsForPeer[peerID]++
 	for _, txIn := range tx.TxInputs {
 		if _, exists := mp.unconnectedTxnsByPrev[UtxoKey(*txIn)]; !exists {
 			mp.unconnectedTxnsByPrev[UtxoKey(*txIn)] =
@@ -666,6 +860,9 @@ func (mp *BitCloutMempool) tryAddUnconnectedTxn(tx *MsgBitCloutTxn, peerID uint6
 	if serializedLen > MaxUnconnectedTxSizeBytes {
 		return TxErrorTooLarge
 	}
+	if mp.numUnconnectedTxnsForPeer[peerID] >= mp.maxUnconnectedTxnsPerPeer {
+		return TxErrorTooManyUnconnectedTxnsForPeer
+	}
 
 	mp.addUnconnectedTxn(tx, peerID)
 
@@ -772,10 +969,7 @@ func (mp *BitCloutMempool) OpenTempDBAndDumpTxns() error {
 	if err != nil {
 		return fmt.Errorf("OpenTempDBAndDumpTxns: Error making top-level dir: %v", err)
 	}
-	tempMempoolDBOpts := badger.DefaultOptions(tempMempoolDBDir)
-	tempMempoolDBOpts.ValueDir = tempMempoolDBDir
-	tempMempoolDBOpts.MemTableSize = 1024 << 20
-	tempMempoolDB, err := badger.Open(tempMempoolDBOpts)
+	tempMempoolDB, err := OpenBadgerDb(tempMempoolDBDir, nil)
 	if err != nil {
 		return fmt.Errorf("OpenTempDBAndDumpTxns: Could not open temp db to dump mempool: %v", err)
 	}
@@ -783,24 +977,13 @@ func (mp *BitCloutMempool) OpenTempDBAndDumpTxns() error {
 
 	// Dump txns into the temp mempool db.
 	startTime := time.Now()
-	// Flush the new mempool state to the DB.
-	//
-	// Dump 1k txns at a time to avoid overwhelming badger
-	txnsToDump := []*MempoolTx{}
-	for ii, mempoolTx := range allTxns {
-		txnsToDump = append(txnsToDump, mempoolTx)
-		// If we're at a multiple of 1k or we're at the end of the list
-		// then dump the txns to disk
-		if len(txnsToDump)%1000 == 0 || ii == len(allTxns)-1 {
-			glog.Infof("OpenTempDBAndDumpTxns: Dumping txns %v to %v", ii-len(txnsToDump)+1, ii)
-			err := tempMempoolDB.Update(func(txn *badger.Txn) error {
-				return FlushMempoolToDbWithTxn(txn, txnsToDump)
-			})
-			if err != nil {
-				return fmt.Errorf("OpenTempDBAndDumpTxns: Error flushing mempool txns to DB: %v", err)
-			}
-			txnsToDump = []*MempoolTx{}
-		}
+	// Flush the new mempool state to the DB. The write batch commits as it
+	// fills up so the dump doesn't have to fit in a single txn.
+	err = FlushMempoolToDb(tempMempoolDB, allTxns, 1000, func(numTxns uint64) {
+		glog.Infof("OpenTempDBAndDumpTxns: Dumped %v of %v txns", numTxns, len(allTxns))
+	})
+	if err != nil {
+		return fmt.Errorf("OpenTempDBAndDumpTxns: Error flushing mempool txns to DB: %v", err)
 	}
 	endTime := time.Now()
 	glog.Infof("OpenTempDBAndDumpTxns: Full txn dump of %v txns completed "+
@@ -810,9 +993,10 @@ func (mp *BitCloutMempool) OpenTempDBAndDumpTxns() error {
 
 // Adds a txn to the pool. This function does not do any validation, and so it should
 // only be called when one is sure that a transaction is valid. Otherwise, it could
-// mess up the UtxoViews that we store internally.
+// mess up the UtxoViews that we store internally. txMeta can be nil.
 func (mp *BitCloutMempool) addTransaction(
-	tx *MsgBitCloutTxn, height uint32, fee uint64, updateBackupView bool) (*MempoolTx, error) {
+	tx *MsgBitCloutTxn, height uint32, fee uint64, txMeta *TransactionMetadata,
+	updateBackupView bool) (*MempoolTx, error) {
 
 	// Add the transaction to the pool and mark the referenced outpoints
 	// as spent by the pool.
@@ -827,20 +1011,18 @@ func (mp *BitCloutMempool) addTransaction(
 		return nil, errors.Wrapf(err, "addTransaction: Problem hashing tx: ")
 	}
 
-	// If this txn would put us over our threshold then don't accept it.
-	//
-	// TODO: We don't replace txns in the mempool right now. Instead, a node can be
-	// rebooted with a higher fee if the transactions start to get rejected due to
-	// the mempool being full.
-	if serializedLen+mp.totalTxSizeBytes > MaxTotalTransactionSizeBytes {
-		return nil, errors.Wrapf(TxErrorInsufficientFeePriorityQueue, "addTransaction: ")
+	// If this txn would put us over our threshold then only accept it if it pays a
+	// higher feerate than the txns it would displace. processTransaction evicts them
+	// once the txn has been added.
+	if serializedLen+mp.totalTxSizeBytes > mp.maxTotalTxSizeBytes {
+		if len(mp.txFeeMinheap) == 0 || fee*1000/serializedLen <= mp.txFeeMinheap[0].FeePerKB {
+			return nil, errors.Wrapf(TxErrorInsufficientFeePriorityQueue, "addTransaction: ")
+		}
 	}
 
-	// At this point we are certain that the mempool has enough room to accomodate
-	// this transaction.
-
 	mempoolTx := &MempoolTx{
 		Tx:          tx,
+		TxMeta:      txMeta,
 		Hash:        txHash,
 		TxSizeBytes: uint64(serializedLen),
 		Added:       time.Now(),
@@ -905,6 +1087,10 @@ func (mp *BitCloutMempool) addTransaction(
 		}
 	}
 
+	if mp.eventManager != nil {
+		mp.eventManager.mempoolTxnAdded(mempoolTx)
+	}
+
 	return mempoolTx, nil
 }
 
@@ -1095,7 +1281,7 @@ func (mp *BitCloutMempool) tryAcceptBitcoinExchangeTxn(tx *MsgBitCloutTxn) (
 		// Add to transaction pool. We don't need to update the backup view since the call
 		// above will have done this.
 		mempoolTx, err := mp.addTransaction(
-			tx, bestHeight, txFee, false /*updateBackupView*/)
+			tx, bestHeight, txFee, nil /*txMeta*/, false /*updateBackupView*/)
 		if err != nil {
 			// We need to rebuild the backup view since the _connectTransaction broke it.
 			mp.rebuildBackupView()
@@ -1163,7 +1349,7 @@ func (mp *BitCloutMempool) tryAcceptBitcoinExchangeTxn(tx *MsgBitCloutTxn) (
 
 	// Add to transaction pool. Don't update the backup view, since the call above
 	// will have done this.
-	mempoolTx, err := mp.addTransaction(tx, bestHeight, txFee, false /*updateBackupView*/)
+	mempoolTx, err := mp.addTransaction(tx, bestHeight, txFee, nil /*txMeta*/, false /*updateBackupView*/)
 	if err != nil {
 		// We need to rebuild the backup view since the _connectTransaction broke it.
 		mp.rebuildBackupView()
@@ -1191,8 +1377,8 @@ func (mp *BitCloutMempool) rebuildBackupView() {
 //
 // TODO: Allow replacing a transaction with a higher fee.
 func (mp *BitCloutMempool) tryAcceptTransaction(
-	tx *MsgBitCloutTxn, rateLimit bool, rejectDupUnconnected bool, verifySignatures bool) (
-	_missingParents []*BlockHash, _mempoolTx *MempoolTx, _err error) {
+	tx *MsgBitCloutTxn, rateLimit bool, rejectDupUnconnected bool, verifySignatures bool,
+	peerID uint64) (_missingParents []*BlockHash, _mempoolTx *MempoolTx, _err error) {
 
 	// Block reward transactions shouldn't appear individually
 	if tx.TxnMeta != nil && tx.TxnMeta.GetTxnType() == TxnTypeBlockReward {
@@ -1249,7 +1435,7 @@ func (mp *BitCloutMempool) tryAcceptTransaction(
 	usdCentsPerBitcoinBefore := mp.backupUniversalUtxoView.GetCurrentUSDCentsPerBitcoin()
 	bestHeight := uint32(mp.bc.blockTip().Height + 1)
 	// We can skip verifying the transaction size as related to the minimum fee here.
-	_, totalInput, totalOutput, txFee, err := mp.backupUniversalUtxoView._connectTransaction(
+	utxoOps, totalInput, totalOutput, txFee, err := mp.backupUniversalUtxoView._connectTransaction(
 		tx, txHash, 0, bestHeight, verifySignatures,
 		false, /*checkMerkleProof*/
 		0, false /*ignoreUtxos*/)
@@ -1308,19 +1494,32 @@ func (mp *BitCloutMempool) tryAcceptTransaction(
 			"limit ~(%v) bytes/10m", oldTotal, mp.lowFeeTxSizeAccumulator, LowFeeTxLimitBytesPerTenMinutes)
 	}
 
+	// Keep a single public key or peer IP from flooding the pool.
+	if mp.limiter != nil {
+		if err := mp.limiter.checkTxn(tx, peerID, txFeePerKB, serializedLen); err != nil {
+			mp.rebuildBackupView()
+			return nil, nil, errors.Wrapf(err, "tryAcceptTransaction: ")
+		}
+	}
+
+	// Calculate metadata. The backup view already has the txn connected, and the
+	// metadata has to be set before the txn is added so it's there by the time
+	// the mempool's event handlers see the txn.
+	txnMeta, err := ComputeTransactionMetadata(tx, mp.backupUniversalUtxoView, tx.Hash(), totalNanosPurchasedBefore,
+		usdCentsPerBitcoinBefore, totalInput, totalOutput, txFee, uint64(0), utxoOps)
+	if err != nil {
+		txnMeta = nil
+	}
+
 	// Add to transaction pool. Don't update the backup view since the call above
 	// will have already done this.
-	mempoolTx, err := mp.addTransaction(tx, bestHeight, txFee, false /*updateBackupUniversalView*/)
+	mempoolTx, err := mp.addTransaction(tx, bestHeight, txFee, txnMeta, false /*updateBackupUniversalView*/)
 	if err != nil {
 		mp.rebuildBackupView()
 		return nil, nil, errors.Wrapf(err, "tryAcceptTransaction: ")
 	}
-
-	// Calculate metadata
-	txnMeta, err := ComputeTransactionMetadata(tx, mp.backupUniversalUtxoView, tx.Hash(), totalNanosPurchasedBefore,
-		usdCentsPerBitcoinBefore, totalInput, totalOutput, txFee, uint64(0))
-	if err == nil {
-		mempoolTx.TxMeta = txnMeta
+	if mp.limiter != nil {
+		mp.limiter.addTxn(mempoolTx, peerID)
 	}
 
 	glog.Tracef("tryAcceptTransaction: Accepted transaction %v (pool size: %v)", txHash,
@@ -1329,9 +1528,41 @@ func (mp *BitCloutMempool) tryAcceptTransaction(
 	return nil, mempoolTx, nil
 }
 
+// _txindexUtxosForUtxoOps returns the utxos spent and created by a txn's utxo
+// operations.
+func _txindexUtxosForUtxoOps(utxoOps []*UtxoOperation, params *BitCloutParams) (
+	_inputs []*TxindexUtxo, _outputs []*TxindexUtxo) {
+
+	inputs := []*TxindexUtxo{}
+	outputs := []*TxindexUtxo{}
+	for _, op := range utxoOps {
+		if op.Type != OperationTypeSpendUtxo && op.Type != OperationTypeAddUtxo {
+			continue
+		}
+		if op.Entry == nil || op.Key == nil {
+			continue
+		}
+		utxo := &TxindexUtxo{
+			TxIDHex:              hex.EncodeToString(op.Key.TxID[:]),
+			Index:                op.Key.Index,
+			PublicKeyBase58Check: PkToString(op.Entry.PublicKey, params),
+			AmountNanos:          op.Entry.AmountNanos,
+			UtxoType:             op.Entry.UtxoType.String(),
+		}
+		if op.Type == OperationTypeSpendUtxo {
+			inputs = append(inputs, utxo)
+		} else {
+			outputs = append(outputs, utxo)
+		}
+	}
+	return inputs, outputs
+}
+
 func ComputeTransactionMetadata(txn *MsgBitCloutTxn, utxoView *UtxoView, blockHash *BlockHash,
 	totalNanosPurchasedBefore uint64, usdCentsPerBitcoinBefore uint64, totalInput uint64, totalOutput uint64,
-	fees uint64, txnIndexInBlock uint64) (*TransactionMetadata, error) {
+	fees uint64, txnIndexInBlock uint64, utxoOps []*UtxoOperation) (*TransactionMetadata, error) {
+
+	inputs, outputs := _txindexUtxosForUtxoOps(utxoOps, utxoView.Params)
 
 	var err error
 	txnMeta := &TransactionMetadata{
@@ -1348,9 +1579,8 @@ func ComputeTransactionMetadata(txn *MsgBitCloutTxn, utxoView *UtxoView, blockHa
 			TotalInputNanos:  totalInput,
 			TotalOutputNanos: totalOutput,
 			FeeNanos:         fees,
-			// TODO: This doesn't add much value, and it makes output hard to read because
-			// it's so long so I'm commenting it out for now.
-			// UtxoOpsDump:      spew.Sdump(utxoOps),
+			Inputs:           inputs,
+			Outputs:          outputs,
 		},
 
 		TxnOutputs: txn.TxOutputs,
@@ -1395,15 +1625,7 @@ func ComputeTransactionMetadata(txn *MsgBitCloutTxn, utxoView *UtxoView, blockHa
 			BitCloutToSellNanos:    realTxMeta.BitCloutToSellNanos,
 			CreatorCoinToSellNanos: realTxMeta.CreatorCoinToSellNanos,
 			BitCloutToAddNanos:     realTxMeta.BitCloutToAddNanos,
-		}
-
-		// Set the type of the operation.
-		if realTxMeta.OperationType == CreatorCoinOperationTypeBuy {
-			txnMeta.CreatorCoinTxindexMetadata.OperationType = "buy"
-		} else if realTxMeta.OperationType == CreatorCoinOperationTypeSell {
-			txnMeta.CreatorCoinTxindexMetadata.OperationType = "sell"
-		} else {
-			txnMeta.CreatorCoinTxindexMetadata.OperationType = "add"
+			OperationType:          realTxMeta.OperationType.String(),
 		}
 
 		// Set the affected public key to the owner of the creator coin so that they
@@ -1695,14 +1917,18 @@ func ConnectTxnAndComputeTransactionMetadata(
 		false, /*checkMerkleProof*/
 		0,
 		false /*ignoreUtxos*/)
-	_ = utxoOps
 	if err != nil {
 		return nil, fmt.Errorf(
 			"UpdateTxindex: Error connecting txn to UtxoView: %v", err)
 	}
 
-	return ComputeTransactionMetadata(txn, utxoView, blockHash, totalNanosPurchasedBefore,
-		usdCentsPerBitcoinBefore, totalInput, totalOutput, fees, txnIndexInBlock)
+	txnMeta, err := ComputeTransactionMetadata(txn, utxoView, blockHash, totalNanosPurchasedBefore,
+		usdCentsPerBitcoinBefore, totalInput, totalOutput, fees, txnIndexInBlock, utxoOps)
+	if err != nil {
+		return nil, err
+	}
+	txnMeta.BlockHeight = blockHeight
+	return txnMeta, nil
 }
 
 // This is the main function used for adding a new txn to the pool. It will
@@ -1715,7 +1941,7 @@ func (mp *BitCloutMempool) TryAcceptTransaction(tx *MsgBitCloutTxn, rateLimit bo
 	mp.mtx.Lock()
 	defer mp.mtx.Unlock()
 
-	hashes, mempoolTx, err := mp.tryAcceptTransaction(tx, rateLimit, true, verifySignatures)
+	hashes, mempoolTx, err := mp.tryAcceptTransaction(tx, rateLimit, true, verifySignatures, 0 /*peerID*/)
 
 	return hashes, mempoolTx, err
 }
@@ -1744,8 +1970,12 @@ func (mp *BitCloutMempool) processUnconnectedTransactions(acceptedTx *MsgBitClou
 			}
 
 			for _, tx := range unconnectedTxns {
+				peerID := uint64(0)
+				if unconnectedTx, exists := mp.unconnectedTxns[*tx.Hash()]; exists {
+					peerID = unconnectedTx.peerID
+				}
 				missing, mempoolTx, err := mp.tryAcceptTransaction(
-					tx, rateLimit, false, verifySignatures)
+					tx, rateLimit, false, verifySignatures, peerID)
 				if err != nil {
 					mp.removeUnconnectedTxn(tx, true)
 					break
@@ -1893,8 +2123,15 @@ func (mp *BitCloutMempool) processTransaction(
 
 	// Run validation and try to add this txn to the pool.
 	missingParents, mempoolTx, err := mp.tryAcceptTransaction(
-		tx, rateLimit, true, verifySignatures)
+		tx, rateLimit, true, verifySignatures, peerID)
 	if err != nil {
+		// Count the rejection against the txn's source, and against its public
+		// key if its signature was verified, so a flood of bad txns makes their
+		// next ones score higher. Duplicates are left out since peers relay them
+		// to each other all the time.
+		if mp.limiter != nil && errors.Cause(err) != TxErrorDuplicate {
+			mp.limiter.recordRejection(tx, peerID, verifySignatures && _isRejectedAfterConnect(err))
+		}
 		return nil, err
 	}
 
@@ -1916,6 +2153,21 @@ func (mp *BitCloutMempool) processTransaction(
 		acceptedTxs[0] = mempoolTx
 		copy(acceptedTxs[1:], newTxs)
 
+		// Make room for the txns if they put the pool over its limit.
+		if evictedTxns := mp.evictLowFeeRateTxns(); len(evictedTxns) > 0 {
+			if evictedTxns[*txHash] {
+				return nil, errors.Wrapf(TxErrorInsufficientFeePriorityQueue, "ProcessTransaction: ")
+			}
+			// Evicting rebuilds the pool so return its MempoolTxs for the txns.
+			remainingTxs := []*MempoolTx{}
+			for _, acceptedTx := range acceptedTxs {
+				if poolTx, exists := mp.poolMap[*acceptedTx.Hash]; exists {
+					remainingTxs = append(remainingTxs, poolTx)
+				}
+			}
+			acceptedTxs = remainingTxs
+		}
+
 		return acceptedTxs, nil
 	}
 
@@ -2006,8 +2258,14 @@ func (mp *BitCloutMempool) GetMempoolSummaryStats() (_summaryStatsMap map[string
 }
 
 func (mp *BitCloutMempool) inefficientRemoveTransaction(tx *MsgBitCloutTxn) {
-	// In this case we remove the transaction by re-adding all the txns we can
-	// to the mempool except this one.
+	mp.inefficientRemoveTransactions(map[BlockHash]bool{*tx.Hash(): true})
+}
+
+// inefficientRemoveTransactions removes the txns with the given hashes along
+// with any txns that can't be connected without them.
+func (mp *BitCloutMempool) inefficientRemoveTransactions(txHashes map[BlockHash]bool) {
+	// In this case we remove the transactions by re-adding all the txns we can
+	// to the mempool except these ones.
 	// TODO(performance): This could be a bit slow.
 	//
 	// Create a new BitCloutMempool. No need to set the min fees since we're just using
@@ -2018,6 +2276,7 @@ func (mp *BitCloutMempool) inefficientRemoveTransaction(tx *MsgBitCloutTxn) {
 		0, /* minFeeRateNanosPerKB */
 		"" /*blockCypherAPIKey*/, false,
 		"" /*dataDir*/, "")
+	mp._shareEvictionPolicy(newPool)
 	// At this point the block txns have been added to the new pool. Now we need to
 	// add the txns from the original pool. Start by fetching them in slice form.
 	oldMempoolTxns, oldUnconnectedTxns, err := mp._getTransactionsOrderedByTimeAdded()
@@ -2027,7 +2286,7 @@ func (mp *BitCloutMempool) inefficientRemoveTransaction(tx *MsgBitCloutTxn) {
 	// Iterate through the pool transactions and add them to our new pool.
 
 	for _, mempoolTx := range oldMempoolTxns {
-		if *(mempoolTx.Tx.Hash()) == *(tx.Hash()) {
+		if txHashes[*mempoolTx.Hash] {
 			continue
 		}
 
@@ -2062,6 +2321,100 @@ func (mp *BitCloutMempool) inefficientRemoveTransaction(tx *MsgBitCloutTxn) {
 	mp.resetPool(newPool)
 }
 
+// _shareEvictionPolicy gives a temporary pool used to rebuild this one the same
+// limits and eviction stats.
+func (mp *BitCloutMempool) _shareEvictionPolicy(newPool *BitCloutMempool) {
+	newPool.maxTotalTxSizeBytes = mp.maxTotalTxSizeBytes
+	newPool.maxUnconnectedTxnsPerPeer = mp.maxUnconnectedTxnsPerPeer
+	newPool.evictionStats = mp.evictionStats
+}
+
+// evictLowFeeRateTxns evicts the txns with the lowest feerates, most recently
+// added first, when the pool is over its limit until it's down to
+// MempoolEvictionTargetPercent of it. The txns that can't be connected without an
+// evicted txn are evicted along with it. It returns the hashes of all the txns
+// it evicted.
+func (mp *BitCloutMempool) evictLowFeeRateTxns() map[BlockHash]bool {
+	if mp.totalTxSizeBytes <= mp.maxTotalTxSizeBytes {
+		return nil
+	}
+
+	txnsByFeeRate := append([]*MempoolTx{}, mp.txFeeMinheap...)
+	sort.Slice(txnsByFeeRate, func(ii, jj int) bool {
+		if txnsByFeeRate[ii].FeePerKB != txnsByFeeRate[jj].FeePerKB {
+			return txnsByFeeRate[ii].FeePerKB < txnsByFeeRate[jj].FeePerKB
+		}
+		return txnsByFeeRate[ii].Added.After(txnsByFeeRate[jj].Added)
+	})
+	targetTxSizeBytes := mp.maxTotalTxSizeBytes / 100 * MempoolEvictionTargetPercent
+	txnsToEvict := make(map[BlockHash]bool)
+	totalTxSizeBytes := mp.totalTxSizeBytes
+	for _, mempoolTx := range txnsByFeeRate {
+		if totalTxSizeBytes <= targetTxSizeBytes {
+			break
+		}
+		txnsToEvict[*mempoolTx.Hash] = true
+		totalTxSizeBytes -= mempoolTx.TxSizeBytes
+	}
+
+	// Rebuilding the pool without the txns drops the txns that depend on them.
+	oldPoolMap := mp.poolMap
+	mp.inefficientRemoveTransactions(txnsToEvict)
+
+	evictedTxns := make(map[BlockHash]bool)
+	mp.evictionStats.NumEvictions++
+	for txHash, mempoolTx := range oldPoolMap {
+		if _, exists := mp.poolMap[txHash]; exists {
+			continue
+		}
+		evictedTxns[txHash] = true
+		mp.evictionStats.NumTxnsEvicted++
+		mp.evictionStats.NumBytesEvicted += mempoolTx.TxSizeBytes
+		if !txnsToEvict[txHash] {
+			mp.evictionStats.NumDescendantsEvicted++
+		}
+	}
+	glog.Infof("evictLowFeeRateTxns: Evicted %d txns to get the mempool under %d bytes, "+
+		"%d of which depended on an evicted txn", len(evictedTxns), mp.maxTotalTxSizeBytes,
+		len(evictedTxns)-len(txnsToEvict))
+
+	return evictedTxns
+}
+
+// SetMaxTotalTxSizeBytes sets the most bytes the txns in the pool can add up to
+// and evicts txns right away if the pool is over it.
+func (mp *BitCloutMempool) SetMaxTotalTxSizeBytes(maxTotalTxSizeBytes uint64) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	mp.maxTotalTxSizeBytes = maxTotalTxSizeBytes
+	mp.evictLowFeeRateTxns()
+}
+
+// GetEvictionStats returns a copy of the pool's eviction counts.
+func (mp *BitCloutMempool) GetEvictionStats() MempoolEvictionStats {
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	return *mp.evictionStats
+}
+
+// SetLimiter holds the txns added to the pool from now on to the limiter's
+// limits. The txns already in the pool are counted against their public keys
+// without a source. A nil limiter turns the limits off.
+func (mp *BitCloutMempool) SetLimiter(limiter *MempoolLimiter) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	mp.limiter = limiter
+	if limiter == nil {
+		return
+	}
+	for _, mempoolTx := range mp.poolMap {
+		limiter.addTxn(mempoolTx, 0 /*peerID*/)
+	}
+}
+
 func (mp *BitCloutMempool) InefficientRemoveTransaction(tx *MsgBitCloutTxn) {
 	mp.mtx.Lock()
 	defer mp.mtx.Unlock()
@@ -2083,6 +2436,7 @@ func (mp *BitCloutMempool) EvictUnminedBitcoinTransactions(bitcoinTxnHashes []st
 
 	// Create a new pool to apply them to.
 	newPool := NewBitCloutMempool(mp.bc, 0, 0, "", false, "", "")
+	mp._shareEvictionPolicy(newPool)
 
 	isHashToEvict := func(evictHash string) bool {
 		for _, txnHash := range bitcoinTxnHashes {
@@ -2251,17 +2605,23 @@ func (mp *BitCloutMempool) LoadTxnsFromDB() {
 	}
 
 	// If we make it this far, we found a mempool dump to load.  Woohoo!
-	tempMempoolDBOpts := badger.DefaultOptions(savedTxnsDir)
-	tempMempoolDBOpts.ValueDir = savedTxnsDir
-	tempMempoolDBOpts.MemTableSize = 1024 << 20
 	glog.Infof("LoadTxnsFrom: Opening new temp db %v", savedTxnsDir)
-	tempMempoolDB, err := badger.Open(tempMempoolDBOpts)
+	tempMempoolDB, err := OpenBadgerDb(savedTxnsDir, nil)
 	if err != nil {
 		glog.Infof("LoadTxnsFrom: Could not open temp db to dump mempool: %v", err)
 		return
 	}
 	defer tempMempoolDB.Close()
 
+	// Dumps written before the txns were keyed by hash alone are rekeyed first.
+	numKeysMigrated, err := DbMigrateMempoolTxnsToHashKeys(tempMempoolDB)
+	if err != nil {
+		log.Fatalf("NewBitCloutMempool: Failed to migrate mempoolTxs in the DB: %v", err)
+	}
+	if numKeysMigrated > 0 {
+		glog.Infof("LoadTxnsFromDB: Rekeyed %v txns in the mempool dump by hash", numKeysMigrated)
+	}
+
 	// Get all saved mempool transactions from the DB.
 	dbMempoolTxnsOrderedByTime, err := DbGetAllMempoolTxnsSortedByTimeAdded(tempMempoolDB)
 	if err != nil {
@@ -2299,9 +2659,13 @@ func NewBitCloutMempool(_bc *Blockchain, _rateLimitFeerateNanosPerKB uint64,
 		bc:                              _bc,
 		rateLimitFeeRateNanosPerKB:      _rateLimitFeerateNanosPerKB,
 		minFeeRateNanosPerKB:            _minFeerateNanosPerKB,
+		maxTotalTxSizeBytes:             MaxTotalTransactionSizeBytes,
+		evictionStats:                   &MempoolEvictionStats{},
 		poolMap:                         make(map[BlockHash]*MempoolTx),
 		unconnectedTxns:                 make(map[BlockHash]*UnconnectedTx),
 		unconnectedTxnsByPrev:           make(map[UtxoKey]map[BlockHash]*MsgBitCloutTxn),
+		numUnconnectedTxnsForPeer:       make(map[uint64]int),
+		maxUnconnectedTxnsPerPeer:       MaxUnconnectedTxnsPerPeer,
 		outpoints:                       make(map[UtxoKey]*MsgBitCloutTxn),
 		pubKeyToTxnMap:                  make(map[PkMapKey]map[BlockHash]*MempoolTx),
 		unminedBitcoinTxns:              make(map[BlockHash]*MempoolTx),
@@ -0,0 +1,235 @@
+package lib
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The MempoolLimiter keeps a single public key or a single source of txns from
+// filling the mempool, like a bot flooding the network with posts or likes. It
+// caps the number of unconfirmed txns each transactor public key can have in the
+// pool and the number each source can have introduced, where a source is the IP
+// of the peer that relayed the txn. It also gives each txn a spam score from its
+// size, its feerate, and how many txns from the same public key and source were
+// rejected recently, and rejects the txns that score too high.
+//
+// The limiter is only called by the mempool with its lock held, so it doesn't
+// have a lock of its own.
+
+// MempoolLimiterRejectionHalfLife is how long it takes the count of recent
+// rejections of a public key or source to decay by half.
+const MempoolLimiterRejectionHalfLife = 10 * time.Minute
+
+// The rejection counts that have decayed below this are dropped.
+const mempoolLimiterMinRejections = 0.05
+
+// MempoolLimiterConfig holds the limits of a MempoolLimiter. A limit of zero
+// means no limit.
+type MempoolLimiterConfig struct {
+	// The most unconfirmed txns a transactor public key can have in the pool.
+	MaxTxnsPerPublicKey uint64
+	// The most unconfirmed txns the peers at an IP can have introduced to the
+	// pool. Txns submitted to the node directly don't have a source.
+	MaxTxnsPerSource uint64
+	// Txns with a spam score above this are rejected.
+	MaxSpamScore float64
+	// The feerate at which a 1KB txn from a public key and source without any
+	// recent rejections scores 1. Spam scores are zero when it's zero.
+	SpamReferenceFeeRateNanosPerKB uint64
+}
+
+type mempoolLimiterTxn struct {
+	publicKey PkMapKey
+	source    string
+}
+
+type mempoolLimiterRejections struct {
+	count    float64
+	lastTime time.Time
+}
+
+type MempoolLimiter struct {
+	config *MempoolLimiterConfig
+
+	// Returns the source of the txns relayed by a peer, or an empty string if
+	// it doesn't know the peer.
+	peerSource func(peerID uint64) string
+
+	txns                   map[BlockHash]*mempoolLimiterTxn
+	numTxnsForPublicKey    map[PkMapKey]uint64
+	numTxnsForSource       map[string]uint64
+	rejectionsForPublicKey map[PkMapKey]*mempoolLimiterRejections
+	rejectionsForSource    map[string]*mempoolLimiterRejections
+}
+
+// NewMempoolLimiter creates a limiter that finds the source of a peer's txns
+// with peerSource, which can be nil if txns shouldn't be limited by source.
+func NewMempoolLimiter(config *MempoolLimiterConfig, peerSource func(peerID uint64) string) *MempoolLimiter {
+	return &MempoolLimiter{
+		config:                 config,
+		peerSource:             peerSource,
+		txns:                   make(map[BlockHash]*mempoolLimiterTxn),
+		numTxnsForPublicKey:    make(map[PkMapKey]uint64),
+		numTxnsForSource:       make(map[string]uint64),
+		rejectionsForPublicKey: make(map[PkMapKey]*mempoolLimiterRejections),
+		rejectionsForSource:    make(map[string]*mempoolLimiterRejections),
+	}
+}
+
+func (ml *MempoolLimiter) _sourceForPeer(peerID uint64) string {
+	if peerID == 0 || ml.peerSource == nil {
+		return ""
+	}
+	return ml.peerSource(peerID)
+}
+
+// _decayedRejections returns the count of recent rejections decayed to now.
+func _decayedRejections(rejections *mempoolLimiterRejections, now time.Time) float64 {
+	if rejections == nil {
+		return 0
+	}
+	halfLives := float64(now.Sub(rejections.lastTime)) / float64(MempoolLimiterRejectionHalfLife)
+	return rejections.count / math.Pow(2.0, halfLives)
+}
+
+// SpamScore scores a txn by how much of the pool it takes up for what it pays,
+// scaled up by the recent rejections of its public key and source.
+func (ml *MempoolLimiter) SpamScore(publicKey []byte, peerID uint64, feePerKB uint64,
+	sizeBytes uint64) float64 {
+
+	return ml._spamScore(MakePkMapKey(publicKey), ml._sourceForPeer(peerID), feePerKB, sizeBytes, time.Now())
+}
+
+func (ml *MempoolLimiter) _spamScore(publicKey PkMapKey, source string, feePerKB uint64,
+	sizeBytes uint64, now time.Time) float64 {
+
+	if ml.config.SpamReferenceFeeRateNanosPerKB == 0 {
+		return 0
+	}
+	if feePerKB == 0 {
+		feePerKB = 1
+	}
+	score := float64(sizeBytes) / 1000 *
+		float64(ml.config.SpamReferenceFeeRateNanosPerKB) / float64(feePerKB)
+	rejections := _decayedRejections(ml.rejectionsForPublicKey[publicKey], now)
+	if source != "" {
+		rejections += _decayedRejections(ml.rejectionsForSource[source], now)
+	}
+	return score * (1 + rejections)
+}
+
+// checkTxn returns an error if adding the txn to the pool would put its public
+// key or source over their limits or if it scores too high.
+func (ml *MempoolLimiter) checkTxn(txn *MsgBitCloutTxn, peerID uint64, feePerKB uint64,
+	sizeBytes uint64) error {
+
+	publicKey := MakePkMapKey(txn.PublicKey)
+	source := ml._sourceForPeer(peerID)
+	if ml.config.MaxTxnsPerPublicKey != 0 && len(txn.PublicKey) != 0 &&
+		ml.numTxnsForPublicKey[publicKey] >= ml.config.MaxTxnsPerPublicKey {
+
+		return TxErrorTooManyTxnsForPublicKey
+	}
+	if ml.config.MaxTxnsPerSource != 0 && source != "" &&
+		ml.numTxnsForSource[source] >= ml.config.MaxTxnsPerSource {
+
+		return TxErrorTooManyTxnsForSource
+	}
+	if ml.config.MaxSpamScore != 0 &&
+		ml._spamScore(publicKey, source, feePerKB, sizeBytes, time.Now()) > ml.config.MaxSpamScore {
+
+		return TxErrorSpamScoreTooHigh
+	}
+	return nil
+}
+
+// addTxn counts a txn that was added to the pool against its public key and
+// source.
+func (ml *MempoolLimiter) addTxn(mempoolTx *MempoolTx, peerID uint64) {
+	if _, exists := ml.txns[*mempoolTx.Hash]; exists {
+		return
+	}
+	limiterTxn := &mempoolLimiterTxn{
+		publicKey: MakePkMapKey(mempoolTx.Tx.PublicKey),
+		source:    ml._sourceForPeer(peerID),
+	}
+	ml.txns[*mempoolTx.Hash] = limiterTxn
+	ml.numTxnsForPublicKey[limiterTxn.publicKey]++
+	if limiterTxn.source != "" {
+		ml.numTxnsForSource[limiterTxn.source]++
+	}
+}
+
+// removeTxn stops counting a txn that left the pool.
+func (ml *MempoolLimiter) removeTxn(txHash *BlockHash) {
+	limiterTxn, exists := ml.txns[*txHash]
+	if !exists {
+		return
+	}
+	delete(ml.txns, *txHash)
+	ml.numTxnsForPublicKey[limiterTxn.publicKey]--
+	if ml.numTxnsForPublicKey[limiterTxn.publicKey] == 0 {
+		delete(ml.numTxnsForPublicKey, limiterTxn.publicKey)
+	}
+	if limiterTxn.source != "" {
+		ml.numTxnsForSource[limiterTxn.source]--
+		if ml.numTxnsForSource[limiterTxn.source] == 0 {
+			delete(ml.numTxnsForSource, limiterTxn.source)
+		}
+	}
+}
+
+// _isRejectedAfterConnect returns true for the errors tryAcceptTransaction only
+// returns after the txn has connected to the view, which means its signature
+// has been checked if signatures are being verified. Every other error can come
+// from a txn anyone could have made up, so it isn't proof that the txn's public
+// key sent it.
+func _isRejectedAfterConnect(err error) bool {
+	switch errors.Cause(err) {
+	case TxErrorInsufficientFeeMinFee, TxErrorInsufficientFeeRateLimit,
+		TxErrorTooManyTxnsForPublicKey, TxErrorTooManyTxnsForSource, TxErrorSpamScoreTooHigh:
+
+		return true
+	}
+	return false
+}
+
+// recordRejection counts a rejected txn against its source so the source's next
+// txns score higher. The rejection is only counted against the txn's public key
+// when isSignedByPublicKey is set. Otherwise anyone could run up the score of
+// someone else's public key by sending badly signed txns under it.
+func (ml *MempoolLimiter) recordRejection(txn *MsgBitCloutTxn, peerID uint64, isSignedByPublicKey bool) {
+	now := time.Now()
+	_recordRejection := func(rejections *mempoolLimiterRejections) *mempoolLimiterRejections {
+		if rejections == nil {
+			rejections = &mempoolLimiterRejections{}
+		}
+		rejections.count = _decayedRejections(rejections, now) + 1
+		rejections.lastTime = now
+		return rejections
+	}
+
+	if isSignedByPublicKey && len(txn.PublicKey) != 0 {
+		publicKey := MakePkMapKey(txn.PublicKey)
+		ml.rejectionsForPublicKey[publicKey] = _recordRejection(ml.rejectionsForPublicKey[publicKey])
+	}
+	if source := ml._sourceForPeer(peerID); source != "" {
+		ml.rejectionsForSource[source] = _recordRejection(ml.rejectionsForSource[source])
+	}
+
+	// Drop the counts that have decayed away once there are a lot of them.
+	if len(ml.rejectionsForPublicKey)+len(ml.rejectionsForSource) > 10000 {
+		for publicKey, rejections := range ml.rejectionsForPublicKey {
+			if _decayedRejections(rejections, now) < mempoolLimiterMinRejections {
+				delete(ml.rejectionsForPublicKey, publicKey)
+			}
+		}
+		for source, rejections := range ml.rejectionsForSource {
+			if _decayedRejections(rejections, now) < mempoolLimiterMinRejections {
+				delete(ml.rejectionsForSource, source)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMempoolLimiter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	senderPkBytes, _, err := Base58CheckDecode(senderPkString)
+	require.NoError(err)
+	peerIPs := map[uint64]string{1: "1.1.1.1", 2: "2.2.2.2"}
+	peerSource := func(peerID uint64) string {
+		return peerIPs[peerID]
+	}
+	processTxn := func(feeRateNanosPerKB uint64, peerID uint64) error {
+		txn := _assembleBasicTransferTxnFullySigned(t, chain, 10, feeRateNanosPerKB,
+			senderPkString, recipientPkString, senderPrivString, mempool)
+		_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, peerID, true /*verifySignatures*/)
+		return err
+	}
+
+	// A public key can't go over its limit until its txns are mined.
+	mempool.SetLimiter(NewMempoolLimiter(&MempoolLimiterConfig{MaxTxnsPerPublicKey: 2}, peerSource))
+	require.NoError(processTxn(10, 1))
+	require.NoError(processTxn(10, 2))
+	err = processTxn(10, 1)
+	require.Error(err)
+	assert.Contains(err.Error(), string(TxErrorTooManyTxnsForPublicKey))
+	_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	assert.Equal(0, len(mempool.poolMap))
+	require.NoError(processTxn(10, 1))
+
+	// The txns already in the pool count against a new limiter, and txns from
+	// different IPs are limited separately.
+	mempool.SetLimiter(NewMempoolLimiter(&MempoolLimiterConfig{MaxTxnsPerSource: 1}, peerSource))
+	assert.Equal(uint64(1), mempool.limiter.numTxnsForPublicKey[MakePkMapKey(senderPkBytes)])
+	require.NoError(processTxn(10, 1))
+	err = processTxn(10, 1)
+	require.Error(err)
+	assert.Contains(err.Error(), string(TxErrorTooManyTxnsForSource))
+	require.NoError(processTxn(10, 2))
+	// Txns submitted directly don't have a source.
+	require.NoError(processTxn(10, 0))
+
+	// A big txn that pays little scores high, and rejections make the next txns
+	// from the same public key and source score higher.
+	limiter := NewMempoolLimiter(&MempoolLimiterConfig{SpamReferenceFeeRateNanosPerKB: 1000}, peerSource)
+	assert.Equal(1.0, limiter.SpamScore(senderPkBytes, 1, 1000, 1000))
+	assert.Equal(4.0, limiter.SpamScore(senderPkBytes, 1, 500, 2000))
+	limiter.recordRejection(&MsgBitCloutTxn{PublicKey: senderPkBytes}, 1, true /*isSignedByPublicKey*/)
+	assert.InDelta(3.0, limiter.SpamScore(senderPkBytes, 1, 1000, 1000), 0.01)
+	assert.InDelta(2.0, limiter.SpamScore(senderPkBytes, 2, 1000, 1000), 0.01)
+	// A rejection that doesn't prove the public key sent the txn only counts
+	// against the source.
+	limiter.recordRejection(&MsgBitCloutTxn{PublicKey: senderPkBytes}, 2, false /*isSignedByPublicKey*/)
+	assert.InDelta(2.0, limiter.SpamScore(senderPkBytes, 0, 1000, 1000), 0.01)
+	assert.InDelta(3.0, limiter.SpamScore(senderPkBytes, 2, 1000, 1000), 0.01)
+
+	mempool.SetLimiter(NewMempoolLimiter(&MempoolLimiterConfig{
+		MaxSpamScore: 1, SpamReferenceFeeRateNanosPerKB: 1000}, peerSource))
+	// A badly signed txn can't run up the score of the public key it names.
+	badTxn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 10000,
+		senderPkString, recipientPkString, recipientPrivString, mempool)
+	_, err = mempool.ProcessTransaction(badTxn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 1 /*peerID*/, true /*verifySignatures*/)
+	require.Error(err)
+	assert.Equal(0, len(mempool.limiter.rejectionsForPublicKey))
+	assert.Equal(1, len(mempool.limiter.rejectionsForSource))
+	err = processTxn(0, 2)
+	require.Error(err)
+	assert.Contains(err.Error(), string(TxErrorSpamScoreTooHigh))
+	assert.Equal(1, len(mempool.limiter.rejectionsForPublicKey))
+	require.NoError(processTxn(10000, 2))
+}
@@ -3,6 +3,7 @@ package lib
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -422,3 +423,280 @@ func TestMempoolAugmentedUtxoViewTransactionChain(t *testing.T) {
 
 	_, _, _, _, _ = mempoolTx1, mempoolTx2, mempoolTx3, mempoolTx4, params
 }
+
+// Fill the mempool up to its limit and make sure a txn that pays a higher
+// feerate evicts the txns with the lowest feerates along with the txns that
+// depend on them, and that a txn that doesn't pay more is rejected.
+func TestMempoolEviction(t *testing.T) {
+	require := require.New(t)
+
+	chain, _, senderPkBytes, recipientPkBytes := _setupFiveBlocks(t)
+	utxoEntries, err := chain.GetSpendableUtxosForPublicKey(senderPkBytes, nil, nil)
+	require.NoError(err)
+	require.GreaterOrEqual(len(utxoEntries), 4)
+
+	// Each txn spends a utxo of its own so they only depend on each other when
+	// they're built to.
+	makeTxn := func(input *BitCloutInput, amountNanos uint64, feeNanos uint64, publicKey []byte) *MsgBitCloutTxn {
+		return &MsgBitCloutTxn{
+			TxInputs: []*BitCloutInput{input},
+			TxOutputs: []*BitCloutOutput{
+				&BitCloutOutput{
+					PublicKey:   recipientPkBytes,
+					AmountNanos: amountNanos - feeNanos,
+				},
+			},
+			PublicKey: publicKey,
+			TxnMeta:   &BasicTransferMetadata{},
+		}
+	}
+	makeSenderTxn := func(utxoEntry *UtxoEntry, feeNanos uint64) *MsgBitCloutTxn {
+		input := BitCloutInput(*utxoEntry.UtxoKey)
+		return makeTxn(&input, utxoEntry.AmountNanos, feeNanos, senderPkBytes)
+	}
+	lowFeeTxn := makeSenderTxn(utxoEntries[0], 100)
+	// The child spends the low fee txn's output so it goes when its parent does
+	// even though it pays the highest feerate.
+	childTxn := makeTxn(&BitCloutInput{TxID: *lowFeeTxn.Hash(), Index: 0},
+		lowFeeTxn.TxOutputs[0].AmountNanos, 100000, recipientPkBytes)
+	midFeeTxn := makeSenderTxn(utxoEntries[1], 500)
+	highFeeTxn := makeSenderTxn(utxoEntries[2], 1000)
+	lowestFeeTxn := makeSenderTxn(utxoEntries[3], 50)
+
+	mp := NewBitCloutMempool(
+		chain, 0, /* rateLimitFeeRateNanosPerKB */
+		0 /* minFeeRateNanosPerKB */, "", true,
+		"" /*dataDir*/, "")
+	for _, txn := range []*MsgBitCloutTxn{lowFeeTxn, childTxn, midFeeTxn} {
+		_, err := mp.processTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, false /*verifySignatures*/)
+		require.NoError(err)
+	}
+	mp.SetMaxTotalTxSizeBytes(mp.totalTxSizeBytes)
+	require.Equal(MempoolEvictionStats{}, mp.GetEvictionStats())
+
+	// A txn that pays less than everything in the full pool is rejected.
+	_, err = mp.processTransaction(lowestFeeTxn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, false /*verifySignatures*/)
+	require.Error(err)
+	require.Contains(err.Error(), string(TxErrorInsufficientFeePriorityQueue))
+
+	// A txn that pays more evicts the lowest feerate txns until the pool is
+	// back under its target, and the child goes with its parent.
+	acceptedTxns, err := mp.processTransaction(highFeeTxn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, false /*verifySignatures*/)
+	require.NoError(err)
+	require.Equal(1, len(acceptedTxns))
+	require.Equal(highFeeTxn.Hash(), acceptedTxns[0].Hash)
+	require.Equal(1, len(mp.poolMap))
+	require.Contains(mp.poolMap, *highFeeTxn.Hash())
+	require.LessOrEqual(mp.totalTxSizeBytes, mp.maxTotalTxSizeBytes)
+	evictionStats := mp.GetEvictionStats()
+	require.Equal(uint64(1), evictionStats.NumEvictions)
+	require.Equal(uint64(3), evictionStats.NumTxnsEvicted)
+	require.Equal(uint64(1), evictionStats.NumDescendantsEvicted)
+}
+
+func TestMempoolQueryTransactions(t *testing.T) {
+	require := require.New(t)
+
+	chain, _, senderPkBytes, recipientPkBytes := _setupFiveBlocks(t)
+	utxoEntries, err := chain.GetSpendableUtxosForPublicKey(senderPkBytes, nil, nil)
+	require.NoError(err)
+	require.GreaterOrEqual(len(utxoEntries), 3)
+
+	makeTxn := func(input *BitCloutInput, amountNanos uint64, feeNanos uint64, publicKey []byte) *MsgBitCloutTxn {
+		return &MsgBitCloutTxn{
+			TxInputs: []*BitCloutInput{input},
+			TxOutputs: []*BitCloutOutput{
+				&BitCloutOutput{
+					PublicKey:   recipientPkBytes,
+					AmountNanos: amountNanos - feeNanos,
+				},
+			},
+			PublicKey: publicKey,
+			TxnMeta:   &BasicTransferMetadata{},
+		}
+	}
+	makeSenderTxn := func(utxoEntry *UtxoEntry, feeNanos uint64) *MsgBitCloutTxn {
+		input := BitCloutInput(*utxoEntry.UtxoKey)
+		return makeTxn(&input, utxoEntry.AmountNanos, feeNanos, senderPkBytes)
+	}
+	lowFeeTxn := makeSenderTxn(utxoEntries[0], 100)
+	childTxn := makeTxn(&BitCloutInput{TxID: *lowFeeTxn.Hash(), Index: 0},
+		lowFeeTxn.TxOutputs[0].AmountNanos, 100000, recipientPkBytes)
+	midFeeTxn := makeSenderTxn(utxoEntries[1], 500)
+	highFeeTxn := makeSenderTxn(utxoEntries[2], 1000)
+
+	mp := NewBitCloutMempool(
+		chain, 0, /* rateLimitFeeRateNanosPerKB */
+		0 /* minFeeRateNanosPerKB */, "", true,
+		"" /*dataDir*/, "")
+	addedTime := time.Now()
+	for _, txn := range []*MsgBitCloutTxn{lowFeeTxn, childTxn, midFeeTxn, highFeeTxn} {
+		_, err := mp.processTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, false /*verifySignatures*/)
+		require.NoError(err)
+		// Space the txns out so the order they were added in is unambiguous.
+		mp.poolMap[*txn.Hash()].Added = addedTime
+		addedTime = addedTime.Add(time.Second)
+	}
+
+	queryHashes := func(query *MempoolTxnQuery) ([]*BlockHash, *MempoolTxnCursor) {
+		mempoolTxns, nextCursor := mp.QueryTransactions(query)
+		txHashes := []*BlockHash{}
+		for _, mempoolTx := range mempoolTxns {
+			txHashes = append(txHashes, mempoolTx.Hash)
+		}
+		return txHashes, nextCursor
+	}
+
+	// Every txn comes back oldest first.
+	txHashes, nextCursor := queryHashes(&MempoolTxnQuery{})
+	require.Equal([]*BlockHash{lowFeeTxn.Hash(), childTxn.Hash(), midFeeTxn.Hash(), highFeeTxn.Hash()}, txHashes)
+	require.Nil(nextCursor)
+
+	// Filter by type, transactor and fee rate.
+	txHashes, _ = queryHashes(&MempoolTxnQuery{TxnTypes: []TxnType{TxnTypeBitcoinExchange}})
+	require.Equal(0, len(txHashes))
+	txHashes, _ = queryHashes(&MempoolTxnQuery{TxnTypes: []TxnType{TxnTypeBitcoinExchange, TxnTypeBasicTransfer}})
+	require.Equal(4, len(txHashes))
+	txHashes, _ = queryHashes(&MempoolTxnQuery{TransactorPublicKey: senderPkBytes})
+	require.Equal([]*BlockHash{lowFeeTxn.Hash(), midFeeTxn.Hash(), highFeeTxn.Hash()}, txHashes)
+	txHashes, _ = queryHashes(&MempoolTxnQuery{TransactorPublicKey: recipientPkBytes})
+	require.Equal([]*BlockHash{childTxn.Hash()}, txHashes)
+	midFeeRate := mp.poolMap[*midFeeTxn.Hash()].FeePerKB
+	txHashes, _ = queryHashes(&MempoolTxnQuery{MinFeeRateNanosPerKB: midFeeRate})
+	require.Equal([]*BlockHash{childTxn.Hash(), midFeeTxn.Hash(), highFeeTxn.Hash()}, txHashes)
+	txHashes, _ = queryHashes(&MempoolTxnQuery{MaxFeeRateNanosPerKB: midFeeRate})
+	require.Equal([]*BlockHash{lowFeeTxn.Hash(), midFeeTxn.Hash()}, txHashes)
+	txHashes, _ = queryHashes(&MempoolTxnQuery{
+		TransactorPublicKey: senderPkBytes, MinFeeRateNanosPerKB: midFeeRate, MaxFeeRateNanosPerKB: midFeeRate})
+	require.Equal([]*BlockHash{midFeeTxn.Hash()}, txHashes)
+
+	// Page through the txns of the sender.
+	txHashes, nextCursor = queryHashes(&MempoolTxnQuery{TransactorPublicKey: senderPkBytes, Limit: 2})
+	require.Equal([]*BlockHash{lowFeeTxn.Hash(), midFeeTxn.Hash()}, txHashes)
+	require.NotNil(nextCursor)
+	txHashes, nextCursor = queryHashes(&MempoolTxnQuery{TransactorPublicKey: senderPkBytes, Limit: 2, Cursor: nextCursor})
+	require.Equal([]*BlockHash{highFeeTxn.Hash()}, txHashes)
+	require.Nil(nextCursor)
+
+	// A cursor still works after its txn leaves the pool.
+	txHashes, nextCursor = queryHashes(&MempoolTxnQuery{Limit: 1})
+	require.Equal([]*BlockHash{lowFeeTxn.Hash()}, txHashes)
+	mp.inefficientRemoveTransaction(lowFeeTxn)
+	txHashes, nextCursor = queryHashes(&MempoolTxnQuery{Cursor: nextCursor})
+	require.ElementsMatch([]*BlockHash{midFeeTxn.Hash(), highFeeTxn.Hash()}, txHashes)
+	require.Nil(nextCursor)
+}
+
+func TestMempoolUnconnectedTxns(t *testing.T) {
+	require := require.New(t)
+
+	chain, _, senderPkBytes, recipientPkBytes := _setupFiveBlocks(t)
+	utxoEntries, err := chain.GetSpendableUtxosForPublicKey(senderPkBytes, nil, nil)
+	require.NoError(err)
+	require.GreaterOrEqual(len(utxoEntries), 1)
+
+	makeTxn := func(input *BitCloutInput, amountNanos uint64, publicKey []byte) *MsgBitCloutTxn {
+		return &MsgBitCloutTxn{
+			TxInputs: []*BitCloutInput{input},
+			TxOutputs: []*BitCloutOutput{
+				&BitCloutOutput{
+					PublicKey:   recipientPkBytes,
+					AmountNanos: amountNanos - 100,
+				},
+			},
+			PublicKey: publicKey,
+			TxnMeta:   &BasicTransferMetadata{},
+		}
+	}
+	parentInput := BitCloutInput(*utxoEntries[0].UtxoKey)
+	parentTxn := makeTxn(&parentInput, utxoEntries[0].AmountNanos, senderPkBytes)
+	childTxn := makeTxn(&BitCloutInput{TxID: *parentTxn.Hash(), Index: 0},
+		parentTxn.TxOutputs[0].AmountNanos, recipientPkBytes)
+	// These spend a txn that never shows up.
+	orphanTxns := []*MsgBitCloutTxn{}
+	for ii := 0; ii < 3; ii++ {
+		orphanTxns = append(orphanTxns, makeTxn(&BitCloutInput{TxID: BlockHash{0x01}, Index: uint32(ii)},
+			1000, recipientPkBytes))
+	}
+
+	mp := NewBitCloutMempool(
+		chain, 0, /* rateLimitFeeRateNanosPerKB */
+		0 /* minFeeRateNanosPerKB */, "", true,
+		"" /*dataDir*/, "")
+	mp.maxUnconnectedTxnsPerPeer = 2
+	processTxn := func(txn *MsgBitCloutTxn, peerID uint64) ([]*MempoolTx, error) {
+		return mp.processTransaction(txn, true /*allowUnconnectedTxn*/, false /*rateLimit*/, peerID, false /*verifySignatures*/)
+	}
+
+	// A txn that arrives before its parent waits in the unconnected pool.
+	acceptedTxns, err := processTxn(childTxn, 1)
+	require.NoError(err)
+	require.Equal(0, len(acceptedTxns))
+	require.Contains(mp.unconnectedTxns, *childTxn.Hash())
+
+	// A peer can only have so many unconnected txns at once.
+	_, err = processTxn(orphanTxns[0], 1)
+	require.NoError(err)
+	_, err = processTxn(orphanTxns[1], 1)
+	require.Error(err)
+	require.Contains(err.Error(), string(TxErrorTooManyUnconnectedTxnsForPeer))
+	_, err = processTxn(orphanTxns[1], 2)
+	require.NoError(err)
+	require.Equal(map[uint64]int{1: 2, 2: 1}, mp.numUnconnectedTxnsForPeer)
+
+	// The unconnected txns of a peer that disconnects are dropped.
+	mp.RemoveUnconnectedTxnsFromPeer(2)
+	require.NotContains(mp.unconnectedTxns, *orphanTxns[1].Hash())
+	require.Equal(map[uint64]int{1: 2}, mp.numUnconnectedTxnsForPeer)
+
+	// The child goes into the pool once its parent does, which makes room for
+	// another unconnected txn from the peer.
+	acceptedTxns, err = processTxn(parentTxn, 3)
+	require.NoError(err)
+	require.Equal(2, len(acceptedTxns))
+	require.Equal(parentTxn.Hash(), acceptedTxns[0].Hash)
+	require.Equal(childTxn.Hash(), acceptedTxns[1].Hash)
+	require.NotContains(mp.unconnectedTxns, *childTxn.Hash())
+	require.Equal(map[uint64]int{1: 1}, mp.numUnconnectedTxnsForPeer)
+	_, err = processTxn(orphanTxns[2], 1)
+	require.NoError(err)
+	require.Equal(map[uint64]int{1: 2}, mp.numUnconnectedTxnsForPeer)
+}
+
+func TestMempoolUnconnectedTxnParentInBlock(t *testing.T) {
+	require := require.New(t)
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+
+	// The child spends the recipient's only utxo, which the parent creates.
+	parentTxn := _assembleBasicTransferTxnFullySigned(t, chain, 1000000, 0,
+		senderPkString, recipientPkString, senderPrivString, mempool)
+	_, err := mempool.ProcessTransaction(parentTxn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+	require.NoError(err)
+	childTxn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 0,
+		recipientPkString, senderPkString, recipientPrivString, mempool)
+
+	// Another node only hears about the child until the parent shows up in a
+	// block.
+	otherMempool := NewBitCloutMempool(
+		chain, 0, /* rateLimitFeeRateNanosPerKB */
+		0 /* minFeeRateNanosPerKB */, "", true,
+		"" /*dataDir*/, "")
+	acceptedTxns, err := otherMempool.ProcessTransaction(childTxn, true /*allowUnconnectedTxn*/, false /*rateLimit*/, 1 /*peerID*/, true /*verifySignatures*/)
+	require.NoError(err)
+	require.Equal(0, len(acceptedTxns))
+	require.Contains(otherMempool.unconnectedTxns, *childTxn.Hash())
+
+	block, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+	require.NoError(err)
+	require.Equal(parentTxn.Hash(), block.Txns[1].Hash())
+	otherMempool.UpdateAfterConnectBlock(block)
+	require.Contains(otherMempool.poolMap, *childTxn.Hash())
+	require.Equal(0, len(otherMempool.unconnectedTxns))
+	require.Equal(0, len(otherMempool.numUnconnectedTxnsForPeer))
+}
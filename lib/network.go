@@ -93,8 +93,16 @@ const (
 	MsgTypeAddr MsgType = 15
 	// MsgTypeGetAddr is used to solicit Addr messages from peers.
 	MsgTypeGetAddr MsgType = 16
+	// MsgTypeGetStateChunk is used to fetch a chunk of the chain state under a
+	// prefix from a peer. See db_state_sync.go.
+	MsgTypeGetStateChunk MsgType = 18
+	// MsgTypeStateChunk contains a chunk of the chain state from a peer.
+	MsgTypeStateChunk MsgType = 19
+	// MsgTypePruneHeight tells a peer that we've pruned more blocks since we
+	// sent our version message.
+	MsgTypePruneHeight MsgType = 20
 
-	// NEXT_TAG = 18
+	// NEXT_TAG = 21
 
 	// Below are control messages used to signal to the Server from other parts of
 	// the code but not actually sent among peers.
@@ -156,6 +164,12 @@ func (msgType MsgType) String() string {
 		return "ADDR"
 	case MsgTypeGetAddr:
 		return "GET_ADDR"
+	case MsgTypeGetStateChunk:
+		return "GET_STATE_CHUNK"
+	case MsgTypeStateChunk:
+		return "STATE_CHUNK"
+	case MsgTypePruneHeight:
+		return "PRUNE_HEIGHT"
 	case MsgTypeQuit:
 		return "QUIT"
 	case MsgTypeNewPeer:
@@ -216,8 +230,11 @@ const (
 	TxnTypeSwapIdentity TxnType = 12
 	TxnTypeUpdateGlobalParams = 13
 	TxnTypeCreatorCoinTransfer TxnType = 14
+	TxnTypePoll TxnType = 15
+	TxnTypeAuthorizeDerivedKey TxnType = 16
+	TxnTypeUpdateTransferRestriction TxnType = 17
 
-	// NEXT_ID = 15
+	// NEXT_ID = 18
 )
 
 func (txnType TxnType) String() string {
@@ -250,6 +267,12 @@ func (txnType TxnType) String() string {
 		return "SWAP_IDENTITY"
 	case TxnTypeUpdateGlobalParams:
 		return "UPDATE_GLOBAL_PARAMS"
+	case TxnTypePoll:
+		return "POLL"
+	case TxnTypeAuthorizeDerivedKey:
+		return "AUTHORIZE_DERIVED_KEY"
+	case TxnTypeUpdateTransferRestriction:
+		return "UPDATE_TRANSFER_RESTRICTION"
 
 	default:
 		return fmt.Sprintf("UNRECOGNIZED(%d) - make sure String() is up to date", txnType)
@@ -293,6 +316,12 @@ func NewTxnMetadata(txType TxnType) (BitCloutTxnMetadata, error) {
 		return (&SwapIdentityMetadataa{}).New(), nil
 	case TxnTypeUpdateGlobalParams:
 		return (&UpdateGlobalParamsMetadata{}).New(), nil
+	case TxnTypePoll:
+		return (&PollMetadata{}).New(), nil
+	case TxnTypeAuthorizeDerivedKey:
+		return (&AuthorizeDerivedKeyMetadata{}).New(), nil
+	case TxnTypeUpdateTransferRestriction:
+		return (&UpdateTransferRestrictionMetadata{}).New(), nil
 
 	default:
 		return nil, fmt.Errorf("NewTxnMetadata: Unrecognized TxnType: %v; make sure you add the new type of transaction to NewTxnMetadata", txType)
@@ -511,6 +540,18 @@ func NewMessage(msgType MsgType) BitCloutMessage {
 		{
 			return &MsgBitCloutGetAddr{}
 		}
+	case MsgTypeGetStateChunk:
+		{
+			return &MsgBitCloutGetStateChunk{}
+		}
+	case MsgTypeStateChunk:
+		{
+			return &MsgBitCloutStateChunk{}
+		}
+	case MsgTypePruneHeight:
+		{
+			return &MsgBitCloutPruneHeight{}
+		}
 	default:
 		{
 			return nil
@@ -1190,6 +1231,11 @@ type MsgBitCloutVersion struct {
 	// MinFeeRateNanosPerKB is the minimum feerate that a peer will
 	// accept from other peers when validating transactions.
 	MinFeeRateNanosPerKB uint64
+
+	// PruneHeight is the height below which this node has pruned its
+	// blocks, or zero if it hasn't pruned anything. Peers shouldn't ask
+	// it for blocks below this height.
+	PruneHeight uint64
 }
 
 func (msg *MsgBitCloutVersion) ToBytes(preSignature bool) ([]byte, error) {
@@ -1223,8 +1269,11 @@ func (msg *MsgBitCloutVersion) ToBytes(preSignature bool) ([]byte, error) {
 	// MinFeeRateNanosPerKB
 	retBytes = append(retBytes, UintToBuf(uint64(msg.MinFeeRateNanosPerKB))...)
 
-	// JSONAPIPort - deprecated
-	retBytes = append(retBytes, UintToBuf(uint64(0))...)
+	// PruneHeight
+	//
+	// This used to be the JSONAPIPort, which was deprecated and always zero,
+	// so nodes that predate pruning are read as having pruned nothing.
+	retBytes = append(retBytes, UintToBuf(msg.PruneHeight)...)
 
 	return retBytes, nil
 }
@@ -1310,12 +1359,15 @@ func (msg *MsgBitCloutVersion) FromBytes(data []byte) error {
 		retVer.MinFeeRateNanosPerKB = minFeeRateNanosPerKB
 	}
 
-	// JSONAPIPort - deprecated
+	// PruneHeight
+	//
+	// Messages that end before this field come from nodes that don't prune.
 	{
-		_, err := ReadUvarint(rr)
-		if err != nil {
-			return errors.Wrapf(err, "MsgBitCloutVersion.FromBytes: Problem converting msg.JSONAPIPort")
+		pruneHeight, err := ReadUvarint(rr)
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "MsgBitCloutVersion.FromBytes: Problem converting msg.PruneHeight")
 		}
+		retVer.PruneHeight = pruneHeight
 	}
 
 	*msg = retVer
@@ -1338,6 +1390,10 @@ const (
 	// batch of addresses we've received recently.
 	AddrRelayIntervalSeconds = 60
 
+	// ScheduledPostCheckIntervalSeconds is how often we check for scheduled posts
+	// that are due to be published.
+	ScheduledPostCheckIntervalSeconds = 10
+
 	// RebroadcastNodeAddrIntervalMinutes is how often we broadcast our own address
 	// to our peers.
 	RebroadcastNodeAddrIntervalMinutes = 24 * 60
@@ -1493,6 +1549,181 @@ func (msg *MsgBitCloutGetAddr) GetMsgType() MsgType {
 	return MsgTypeGetAddr
 }
 
+// ==================================================================
+// GET_STATE_CHUNK Message
+// ==================================================================
+
+type MsgBitCloutGetStateChunk struct {
+	// BlockHash is the block whose state the chunk should come from. Peers only
+	// serve the states they've pinned; see DbStateChunkServer.
+	BlockHash *BlockHash
+	Prefix    []byte
+	// An empty StartKey starts at the beginning of the prefix.
+	StartKey []byte
+	Limit    uint64
+}
+
+func (msg *MsgBitCloutGetStateChunk) GetMsgType() MsgType {
+	return MsgTypeGetStateChunk
+}
+
+func (msg *MsgBitCloutGetStateChunk) ToBytes(preSignature bool) ([]byte, error) {
+	if msg.BlockHash == nil {
+		return nil, fmt.Errorf("MsgBitCloutGetStateChunk.ToBytes: BlockHash must be set")
+	}
+	data := []byte{}
+
+	data = append(data, msg.BlockHash[:]...)
+	data = append(data, UintToBuf(uint64(len(msg.Prefix)))...)
+	data = append(data, msg.Prefix...)
+	data = append(data, UintToBuf(uint64(len(msg.StartKey)))...)
+	data = append(data, msg.StartKey...)
+	data = append(data, UintToBuf(msg.Limit)...)
+
+	return data, nil
+}
+
+func (msg *MsgBitCloutGetStateChunk) FromBytes(data []byte) error {
+	rr := bytes.NewReader(data)
+	retMsg := MsgBitCloutGetStateChunk{
+		BlockHash: &BlockHash{},
+	}
+
+	if _, err := io.ReadFull(rr, retMsg.BlockHash[:]); err != nil {
+		return errors.Wrapf(err, "MsgBitCloutGetStateChunk.FromBytes: Problem reading BlockHash")
+	}
+	var err error
+	retMsg.Prefix, err = ReadVarString(rr)
+	if err != nil {
+		return errors.Wrapf(err, "MsgBitCloutGetStateChunk.FromBytes: Problem reading Prefix")
+	}
+	retMsg.StartKey, err = ReadVarString(rr)
+	if err != nil {
+		return errors.Wrapf(err, "MsgBitCloutGetStateChunk.FromBytes: Problem reading StartKey")
+	}
+	retMsg.Limit, err = ReadUvarint(rr)
+	if err != nil {
+		return errors.Wrapf(err, "MsgBitCloutGetStateChunk.FromBytes: Problem reading Limit")
+	}
+
+	*msg = retMsg
+	return nil
+}
+
+// ==================================================================
+// STATE_CHUNK Message
+// ==================================================================
+
+type MsgBitCloutStateChunk struct {
+	Chunk *DbStateChunk
+}
+
+func (msg *MsgBitCloutStateChunk) GetMsgType() MsgType {
+	return MsgTypeStateChunk
+}
+
+func (msg *MsgBitCloutStateChunk) ToBytes(preSignature bool) ([]byte, error) {
+	if msg.Chunk == nil || msg.Chunk.BlockHash == nil {
+		return nil, fmt.Errorf("MsgBitCloutStateChunk.ToBytes: Chunk and its BlockHash must be set")
+	}
+	if len(msg.Chunk.Keys) != len(msg.Chunk.Values) {
+		return nil, fmt.Errorf("MsgBitCloutStateChunk.ToBytes: Chunk has %d keys but %d values",
+			len(msg.Chunk.Keys), len(msg.Chunk.Values))
+	}
+	data := []byte{}
+
+	data = append(data, msg.Chunk.BlockHash[:]...)
+	data = append(data, UintToBuf(uint64(len(msg.Chunk.Prefix)))...)
+	data = append(data, msg.Chunk.Prefix...)
+	data = append(data, UintToBuf(uint64(len(msg.Chunk.Keys)))...)
+	for ii, key := range msg.Chunk.Keys {
+		data = append(data, UintToBuf(uint64(len(key)))...)
+		data = append(data, key...)
+		data = append(data, UintToBuf(uint64(len(msg.Chunk.Values[ii])))...)
+		data = append(data, msg.Chunk.Values[ii]...)
+	}
+	// An empty NextKey means this is the last chunk for the prefix.
+	data = append(data, UintToBuf(uint64(len(msg.Chunk.NextKey)))...)
+	data = append(data, msg.Chunk.NextKey...)
+
+	return data, nil
+}
+
+func (msg *MsgBitCloutStateChunk) FromBytes(data []byte) error {
+	rr := bytes.NewReader(data)
+	chunk := &DbStateChunk{
+		BlockHash: &BlockHash{},
+	}
+
+	if _, err := io.ReadFull(rr, chunk.BlockHash[:]); err != nil {
+		return errors.Wrapf(err, "MsgBitCloutStateChunk.FromBytes: Problem reading BlockHash")
+	}
+	var err error
+	chunk.Prefix, err = ReadVarString(rr)
+	if err != nil {
+		return errors.Wrapf(err, "MsgBitCloutStateChunk.FromBytes: Problem reading Prefix")
+	}
+	numKeys, err := ReadUvarint(rr)
+	if err != nil {
+		return errors.Wrapf(err, "MsgBitCloutStateChunk.FromBytes: Problem reading number of keys")
+	}
+	if numKeys > MaxStateChunkKeys {
+		return fmt.Errorf("MsgBitCloutStateChunk.FromBytes: Chunk has %d keys, "+
+			"which exceeds max %d", numKeys, MaxStateChunkKeys)
+	}
+	for ii := uint64(0); ii < numKeys; ii++ {
+		key, err := ReadVarString(rr)
+		if err != nil {
+			return errors.Wrapf(err, "MsgBitCloutStateChunk.FromBytes: Problem reading key %d", ii)
+		}
+		val, err := ReadVarString(rr)
+		if err != nil {
+			return errors.Wrapf(err, "MsgBitCloutStateChunk.FromBytes: Problem reading value %d", ii)
+		}
+		chunk.Keys = append(chunk.Keys, key)
+		chunk.Values = append(chunk.Values, val)
+	}
+	nextKey, err := ReadVarString(rr)
+	if err != nil {
+		return errors.Wrapf(err, "MsgBitCloutStateChunk.FromBytes: Problem reading NextKey")
+	}
+	if len(nextKey) > 0 {
+		chunk.NextKey = nextKey
+	}
+
+	*msg = MsgBitCloutStateChunk{Chunk: chunk}
+	return nil
+}
+
+// ==================================================================
+// PRUNE_HEIGHT Message
+// ==================================================================
+
+// MsgBitCloutPruneHeight is only sent to peers that negotiated at least
+// PruneHeightProtocolVersion since older nodes disconnect on message types
+// they don't know.
+type MsgBitCloutPruneHeight struct {
+	// PruneHeight has the same meaning as in the version message.
+	PruneHeight uint64
+}
+
+func (msg *MsgBitCloutPruneHeight) GetMsgType() MsgType {
+	return MsgTypePruneHeight
+}
+
+func (msg *MsgBitCloutPruneHeight) ToBytes(preSignature bool) ([]byte, error) {
+	return UintToBuf(msg.PruneHeight), nil
+}
+
+func (msg *MsgBitCloutPruneHeight) FromBytes(data []byte) error {
+	pruneHeight, err := ReadUvarint(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("MsgBitCloutPruneHeight.FromBytes: %v", err)
+	}
+	*msg = MsgBitCloutPruneHeight{PruneHeight: pruneHeight}
+	return nil
+}
+
 // ==================================================================
 // VERACK Message
 // ==================================================================
@@ -3550,6 +3781,19 @@ const (
 	CreatorCoinOperationTypeAddBitClout CreatorCoinOperationType = 2
 )
 
+func (opType CreatorCoinOperationType) String() string {
+	switch opType {
+	case CreatorCoinOperationTypeBuy:
+		return "buy"
+	case CreatorCoinOperationTypeSell:
+		return "sell"
+	case CreatorCoinOperationTypeAddBitClout:
+		return "add"
+	default:
+		return fmt.Sprintf("UNRECOGNIZED(%d)", opType)
+	}
+}
+
 type CreatorCoinMetadataa struct {
 	// ProfilePublicKey is the public key of the profile that owns the
 	// coin the person wants to operate on. Creator coins can only be
@@ -3800,3 +4044,421 @@ func (txnData *SwapIdentityMetadataa) FromBytes(dataa []byte) error {
 func (txnData *SwapIdentityMetadataa) New() BitCloutTxnMetadata {
 	return &SwapIdentityMetadataa{}
 }
+
+// ==================================================================
+// PollMetadata
+//
+// A poll is a list of options attached to a post by the post's
+// author. Once a poll exists, any user can vote for exactly one of
+// its options.
+// ==================================================================
+
+type PollOperationType uint8
+
+const (
+	PollOperationTypeCreate PollOperationType = 0
+	PollOperationTypeVote   PollOperationType = 1
+)
+
+func (opType PollOperationType) String() string {
+	switch opType {
+	case PollOperationTypeCreate:
+		return "create"
+	case PollOperationTypeVote:
+		return "vote"
+	default:
+		return fmt.Sprintf("UNRECOGNIZED(%d)", opType)
+	}
+}
+
+type PollMetadata struct {
+	// The post the poll is attached to. The creator of the poll and the
+	// voter are assumed to be the originator of the top-level transaction.
+	PostHash *BlockHash
+
+	// OperationType specifies whether this transaction creates a poll or
+	// votes in one.
+	OperationType PollOperationType
+
+	// In a Create operation, Options holds the text of each option in the
+	// order they should be displayed. In a Vote operation, OptionIndex is
+	// the index into the poll's Options being voted for. The unused field
+	// is ignored.
+	Options     [][]byte
+	OptionIndex uint64
+}
+
+func (txnData *PollMetadata) GetTxnType() TxnType {
+	return TxnTypePoll
+}
+
+func (txnData *PollMetadata) ToBytes(preSignature bool) ([]byte, error) {
+	// Post hash must be included and must have the expected length.
+	if len(txnData.PostHash) != HashSizeBytes {
+		return nil, fmt.Errorf("PollMetadata.ToBytes: PostHash "+
+			"has length %d != %d", len(txnData.PostHash), HashSizeBytes)
+	}
+
+	data := []byte{}
+
+	// PostHash
+	data = append(data, txnData.PostHash[:]...)
+
+	// OperationType byte
+	data = append(data, byte(txnData.OperationType))
+
+	// Options
+	data = append(data, UintToBuf(uint64(len(txnData.Options)))...)
+	for _, option := range txnData.Options {
+		data = append(data, UintToBuf(uint64(len(option)))...)
+		data = append(data, option...)
+	}
+
+	// OptionIndex uint64
+	data = append(data, UintToBuf(txnData.OptionIndex)...)
+
+	return data, nil
+}
+
+func (txnData *PollMetadata) FromBytes(dataa []byte) error {
+	ret := PollMetadata{}
+	rr := bytes.NewReader(dataa)
+
+	// PostHash
+	ret.PostHash = &BlockHash{}
+	_, err := io.ReadFull(rr, ret.PostHash[:])
+	if err != nil {
+		return fmt.Errorf(
+			"PollMetadata.FromBytes: Error reading PostHash: %v", err)
+	}
+
+	// OperationType byte
+	operationType, err := rr.ReadByte()
+	if err != nil {
+		return fmt.Errorf(
+			"PollMetadata.FromBytes: Error reading OperationType: %v", err)
+	}
+	ret.OperationType = PollOperationType(operationType)
+
+	// Options
+	numOptions, err := ReadUvarint(rr)
+	if err != nil {
+		return fmt.Errorf(
+			"PollMetadata.FromBytes: Error reading number of Options: %v", err)
+	}
+	// Every option takes at least one byte so reject counts that can't
+	// possibly fit in the metadata.
+	if numOptions > uint64(len(dataa)) {
+		return fmt.Errorf(
+			"PollMetadata.FromBytes: Number of Options %d exceeds metadata size %d",
+			numOptions, len(dataa))
+	}
+	for ii := uint64(0); ii < numOptions; ii++ {
+		option, err := ReadVarString(rr)
+		if err != nil {
+			return fmt.Errorf(
+				"PollMetadata.FromBytes: Error reading option %d: %v", ii, err)
+		}
+		ret.Options = append(ret.Options, option)
+	}
+
+	// OptionIndex uint64
+	ret.OptionIndex, err = ReadUvarint(rr)
+	if err != nil {
+		return fmt.Errorf(
+			"PollMetadata.FromBytes: Error reading OptionIndex: %v", err)
+	}
+
+	*txnData = ret
+	return nil
+}
+
+func (txnData *PollMetadata) New() BitCloutTxnMetadata {
+	return &PollMetadata{}
+}
+
+// ==================================================================
+// AuthorizeDerivedKeyMetadata
+//
+// A derived key is a key pair that an owner lets sign transactions
+// on their behalf until a block height, e.g. so a mobile app never
+// has to hold the owner's private key. Transactions signed by a
+// derived key name it in their ExtraData under
+// DerivedPublicKeyExtraDataKey.
+// ==================================================================
+
+type AuthorizeDerivedKeyOperationType uint8
+
+const (
+	AuthorizeDerivedKeyOperationNotValid AuthorizeDerivedKeyOperationType = 0
+	AuthorizeDerivedKeyOperationValid    AuthorizeDerivedKeyOperationType = 1
+)
+
+func (opType AuthorizeDerivedKeyOperationType) String() string {
+	switch opType {
+	case AuthorizeDerivedKeyOperationNotValid:
+		return "not_valid"
+	case AuthorizeDerivedKeyOperationValid:
+		return "valid"
+	default:
+		return fmt.Sprintf("UNRECOGNIZED(%d)", opType)
+	}
+}
+
+// TransactionSpendingLimit restricts what a derived key can sign. Each txn
+// the derived key signs uses up one of the count for its type and the nanos it
+// spends, counting fees, come out of GlobalBitCloutLimit.
+type TransactionSpendingLimit struct {
+	// The total BitClout nanos the derived key can still spend.
+	GlobalBitCloutLimit uint64
+
+	// How many more txns of each type the derived key can sign. Types that
+	// aren't in the map can't be signed at all.
+	TransactionCountLimitMap map[TxnType]uint64
+}
+
+// Copy returns a copy that doesn't share its map with the original.
+func (limit *TransactionSpendingLimit) Copy() *TransactionSpendingLimit {
+	if limit == nil {
+		return nil
+	}
+	newLimit := &TransactionSpendingLimit{
+		GlobalBitCloutLimit:      limit.GlobalBitCloutLimit,
+		TransactionCountLimitMap: make(map[TxnType]uint64, len(limit.TransactionCountLimitMap)),
+	}
+	for txnType, count := range limit.TransactionCountLimitMap {
+		newLimit.TransactionCountLimitMap[txnType] = count
+	}
+	return newLimit
+}
+
+func (limit *TransactionSpendingLimit) ToBytes() []byte {
+	data := []byte{}
+
+	// GlobalBitCloutLimit uint64
+	data = append(data, UintToBuf(limit.GlobalBitCloutLimit)...)
+
+	// TransactionCountLimitMap, sorted by type so the encoding is deterministic.
+	txnTypes := []TxnType{}
+	for txnType := range limit.TransactionCountLimitMap {
+		txnTypes = append(txnTypes, txnType)
+	}
+	sort.Slice(txnTypes, func(ii, jj int) bool {
+		return txnTypes[ii] < txnTypes[jj]
+	})
+	data = append(data, UintToBuf(uint64(len(txnTypes)))...)
+	for _, txnType := range txnTypes {
+		data = append(data, UintToBuf(uint64(txnType))...)
+		data = append(data, UintToBuf(limit.TransactionCountLimitMap[txnType])...)
+	}
+
+	return data
+}
+
+func (limit *TransactionSpendingLimit) FromBytes(rr *bytes.Reader) error {
+	ret := TransactionSpendingLimit{}
+
+	// GlobalBitCloutLimit uint64
+	var err error
+	ret.GlobalBitCloutLimit, err = ReadUvarint(rr)
+	if err != nil {
+		return fmt.Errorf(
+			"TransactionSpendingLimit.FromBytes: Error reading GlobalBitCloutLimit: %v", err)
+	}
+
+	// TransactionCountLimitMap
+	numTxnTypes, err := ReadUvarint(rr)
+	if err != nil {
+		return fmt.Errorf(
+			"TransactionSpendingLimit.FromBytes: Error reading number of txn types: %v", err)
+	}
+	// Every type takes at least two bytes so don't trust a count that's more
+	// than the bytes that are left.
+	if numTxnTypes > uint64(rr.Len()) {
+		return fmt.Errorf(
+			"TransactionSpendingLimit.FromBytes: %d txn types is more than the %d "+
+				"bytes left", numTxnTypes, rr.Len())
+	}
+	ret.TransactionCountLimitMap = make(map[TxnType]uint64, numTxnTypes)
+	for ii := uint64(0); ii < numTxnTypes; ii++ {
+		txnType, err := ReadUvarint(rr)
+		if err != nil {
+			return fmt.Errorf(
+				"TransactionSpendingLimit.FromBytes: Error reading txn type: %v", err)
+		}
+		count, err := ReadUvarint(rr)
+		if err != nil {
+			return fmt.Errorf(
+				"TransactionSpendingLimit.FromBytes: Error reading count for txn type %d: %v",
+				txnType, err)
+		}
+		ret.TransactionCountLimitMap[TxnType(txnType)] = count
+	}
+
+	*limit = ret
+	return nil
+}
+
+type AuthorizeDerivedKeyMetadata struct {
+	// The derived key being authorized or revoked. The owner is assumed to
+	// be the originator of the top-level transaction, which must be signed
+	// by the owner's own key.
+	DerivedPublicKey []byte
+
+	// The derived key can sign transactions in blocks below this height.
+	ExpirationBlock uint64
+
+	// OperationType specifies whether this transaction authorizes the
+	// derived key or revokes it. A revoked key can't be authorized again.
+	OperationType AuthorizeDerivedKeyOperationType
+
+	// When set, the derived key can only sign the txns the limit allows. It's
+	// only serialized when it's set so txns from before it existed keep the
+	// same bytes.
+	TransactionSpendingLimit *TransactionSpendingLimit
+}
+
+func (txnData *AuthorizeDerivedKeyMetadata) GetTxnType() TxnType {
+	return TxnTypeAuthorizeDerivedKey
+}
+
+func (txnData *AuthorizeDerivedKeyMetadata) ToBytes(preSignature bool) ([]byte, error) {
+	// The derived public key must be included and must have the expected length.
+	if len(txnData.DerivedPublicKey) != btcec.PubKeyBytesLenCompressed {
+		return nil, fmt.Errorf("AuthorizeDerivedKeyMetadata.ToBytes: DerivedPublicKey "+
+			"has length %d != %d", len(txnData.DerivedPublicKey), btcec.PubKeyBytesLenCompressed)
+	}
+
+	data := []byte{}
+
+	// DerivedPublicKey
+	data = append(data, UintToBuf(uint64(len(txnData.DerivedPublicKey)))...)
+	data = append(data, txnData.DerivedPublicKey...)
+
+	// ExpirationBlock uint64
+	data = append(data, UintToBuf(txnData.ExpirationBlock)...)
+
+	// OperationType byte
+	data = append(data, byte(txnData.OperationType))
+
+	// TransactionSpendingLimit, if any
+	if txnData.TransactionSpendingLimit != nil {
+		data = append(data, txnData.TransactionSpendingLimit.ToBytes()...)
+	}
+
+	return data, nil
+}
+
+func (txnData *AuthorizeDerivedKeyMetadata) FromBytes(dataa []byte) error {
+	ret := AuthorizeDerivedKeyMetadata{}
+	rr := bytes.NewReader(dataa)
+
+	// DerivedPublicKey
+	var err error
+	ret.DerivedPublicKey, err = ReadVarString(rr)
+	if err != nil {
+		return fmt.Errorf(
+			"AuthorizeDerivedKeyMetadata.FromBytes: Error reading DerivedPublicKey: %v", err)
+	}
+
+	// ExpirationBlock uint64
+	ret.ExpirationBlock, err = ReadUvarint(rr)
+	if err != nil {
+		return fmt.Errorf(
+			"AuthorizeDerivedKeyMetadata.FromBytes: Error reading ExpirationBlock: %v", err)
+	}
+
+	// OperationType byte
+	operationType, err := rr.ReadByte()
+	if err != nil {
+		return fmt.Errorf(
+			"AuthorizeDerivedKeyMetadata.FromBytes: Error reading OperationType: %v", err)
+	}
+	ret.OperationType = AuthorizeDerivedKeyOperationType(operationType)
+
+	// TransactionSpendingLimit, if any
+	if rr.Len() > 0 {
+		ret.TransactionSpendingLimit = &TransactionSpendingLimit{}
+		if err := ret.TransactionSpendingLimit.FromBytes(rr); err != nil {
+			return errors.Wrapf(err, "AuthorizeDerivedKeyMetadata.FromBytes: ")
+		}
+	}
+
+	*txnData = ret
+	return nil
+}
+
+func (txnData *AuthorizeDerivedKeyMetadata) New() BitCloutTxnMetadata {
+	return &AuthorizeDerivedKeyMetadata{}
+}
+
+// ==================================================================
+// UpdateTransferRestrictionMetadata
+//
+// Lets a creator restrict who their creator coin can be transferred
+// between, e.g. to issue a token that only members of a DAO can hold.
+// Buying and selling the coin from the protocol isn't restricted.
+// ==================================================================
+
+type TransferRestrictionStatus uint8
+
+const (
+	// Anyone can transfer the coin to anyone.
+	TransferRestrictionStatusUnrestricted TransferRestrictionStatus = 0
+	// Transfers must be to or from the profile owner.
+	TransferRestrictionStatusProfileOwnerOnly TransferRestrictionStatus = 1
+	// Transfers can only go to public keys that already hold the coin.
+	TransferRestrictionStatusDAOMembersOnly TransferRestrictionStatus = 2
+)
+
+func (status TransferRestrictionStatus) String() string {
+	switch status {
+	case TransferRestrictionStatusUnrestricted:
+		return "unrestricted"
+	case TransferRestrictionStatusProfileOwnerOnly:
+		return "profile_owner_only"
+	case TransferRestrictionStatusDAOMembersOnly:
+		return "dao_members_only"
+	default:
+		return fmt.Sprintf("UNRECOGNIZED(%d)", status)
+	}
+}
+
+type UpdateTransferRestrictionMetadata struct {
+	// The profile whose coin is being restricted is assumed to be the
+	// originator of the top-level transaction.
+	TransferRestrictionStatus TransferRestrictionStatus
+}
+
+func (txnData *UpdateTransferRestrictionMetadata) GetTxnType() TxnType {
+	return TxnTypeUpdateTransferRestriction
+}
+
+func (txnData *UpdateTransferRestrictionMetadata) ToBytes(preSignature bool) ([]byte, error) {
+	data := []byte{}
+
+	// TransferRestrictionStatus byte
+	data = append(data, byte(txnData.TransferRestrictionStatus))
+
+	return data, nil
+}
+
+func (txnData *UpdateTransferRestrictionMetadata) FromBytes(dataa []byte) error {
+	ret := UpdateTransferRestrictionMetadata{}
+	rr := bytes.NewReader(dataa)
+
+	// TransferRestrictionStatus byte
+	transferRestrictionStatus, err := rr.ReadByte()
+	if err != nil {
+		return fmt.Errorf(
+			"UpdateTransferRestrictionMetadata.FromBytes: Error reading TransferRestrictionStatus: %v", err)
+	}
+	ret.TransferRestrictionStatus = TransferRestrictionStatus(transferRestrictionStatus)
+
+	*txnData = ret
+	return nil
+}
+
+func (txnData *UpdateTransferRestrictionMetadata) New() BitCloutTxnMetadata {
+	return &UpdateTransferRestrictionMetadata{}
+}
@@ -53,12 +53,64 @@ func TestVersionConversion(t *testing.T) {
 		assert.Equal(expectedVer, testVer)
 	}
 
-	assert.Equalf(7, reflect.TypeOf(expectedVer).Elem().NumField(),
+	assert.Equalf(8, reflect.TypeOf(expectedVer).Elem().NumField(),
 		"Number of fields in VERSION message is different from expected. "+
 			"Did you add a new field? If so, make sure the serialization code "+
 			"works, add the new field to the test case, and fix this error.")
 }
 
+func TestVersionPruneHeight(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// The prune height round-trips.
+	prunedVer := *expectedVer
+	prunedVer.PruneHeight = 5
+	data, err := prunedVer.ToBytes(false)
+	require.NoError(err)
+	testVer := &MsgBitCloutVersion{}
+	require.NoError(testVer.FromBytes(data))
+	assert.Equal(&prunedVer, testVer)
+
+	// A message from a node that predates pruning ends after the fee rate and
+	// is read as having pruned nothing.
+	legacyData := []byte{}
+	legacyData = append(legacyData, UintToBuf(expectedVer.Version)...)
+	legacyData = append(legacyData, UintToBuf(uint64(expectedVer.Services))...)
+	legacyData = append(legacyData, IntToBuf(expectedVer.TstampSecs)...)
+	legacyData = append(legacyData, UintToBuf(expectedVer.Nonce)...)
+	legacyData = append(legacyData, UintToBuf(uint64(len(expectedVer.UserAgent)))...)
+	legacyData = append(legacyData, expectedVer.UserAgent...)
+	legacyData = append(legacyData, UintToBuf(uint64(expectedVer.StartBlockHeight))...)
+	legacyData = append(legacyData, UintToBuf(expectedVer.MinFeeRateNanosPerKB)...)
+	testVer = &MsgBitCloutVersion{}
+	require.NoError(testVer.FromBytes(legacyData))
+	assert.Equal(expectedVer, testVer)
+
+	// A message cut off in the middle of the prune height is still an error.
+	truncatedData := append(append([]byte{}, legacyData...), UintToBuf(1 << 20)[:1]...)
+	require.Error((&MsgBitCloutVersion{}).FromBytes(truncatedData))
+}
+
+func TestPruneHeight(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	networkType := NetworkType_MAINNET
+	var buf bytes.Buffer
+
+	pruneHeightMsg := &MsgBitCloutPruneHeight{PruneHeight: 123456}
+	_, err := WriteMessage(&buf, pruneHeightMsg, networkType)
+	require.NoError(err)
+	testMsg, _, err := ReadMessage(bytes.NewReader(buf.Bytes()), networkType)
+	require.NoError(err)
+	assert.Equal(pruneHeightMsg, testMsg)
+}
+
 func TestVerack(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -868,6 +920,51 @@ func TestSerializeCreatorCoinTransfer(t *testing.T) {
 	require.Equal(txMeta, testMeta)
 }
 
+func TestSerializeAuthorizeDerivedKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// Without a spending limit the metadata ends at the operation type.
+	txMeta := &AuthorizeDerivedKeyMetadata{
+		DerivedPublicKey: pkForTesting1,
+		ExpirationBlock:  1000,
+		OperationType:    AuthorizeDerivedKeyOperationValid,
+	}
+	unlimitedData, err := txMeta.ToBytes(false)
+	require.NoError(err)
+	testMeta, err := NewTxnMetadata(TxnTypeAuthorizeDerivedKey)
+	require.NoError(err)
+	require.NoError(testMeta.FromBytes(unlimitedData))
+	require.Equal(txMeta, testMeta)
+
+	txMeta.TransactionSpendingLimit = &TransactionSpendingLimit{
+		GlobalBitCloutLimit: 12345,
+		TransactionCountLimitMap: map[TxnType]uint64{
+			TxnTypeLike:   10,
+			TxnTypeFollow: 2,
+		},
+	}
+	data, err := txMeta.ToBytes(false)
+	require.NoError(err)
+	require.Equal(unlimitedData, data[:len(unlimitedData)])
+	testMeta, err = NewTxnMetadata(TxnTypeAuthorizeDerivedKey)
+	require.NoError(err)
+	require.NoError(testMeta.FromBytes(data))
+	require.Equal(txMeta, testMeta)
+
+	// The encoding doesn't depend on map order.
+	dataAgain, err := txMeta.ToBytes(false)
+	require.NoError(err)
+	require.Equal(data, dataAgain)
+
+	// A truncated limit is an error.
+	testMeta, err = NewTxnMetadata(TxnTypeAuthorizeDerivedKey)
+	require.NoError(err)
+	require.Error(testMeta.FromBytes(data[:len(data)-1]))
+}
+
 func TestDecodeHeaderVersion0(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
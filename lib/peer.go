@@ -50,11 +50,19 @@ type Peer struct {
 	timeOffsetSecs int64
 	timeConnected  time.Time
 	startingHeight uint32
-	ID             uint64
+	pruneHeight    uint64
+	// advertisedPruneHeight is the last prune height we told the peer about,
+	// either in our version message or in a PRUNE_HEIGHT message.
+	advertisedPruneHeight uint64
+	ID                    uint64
 	// Ping-related fields.
 	LastPingNonce  uint64
 	LastPingTime   time.Time
 	LastPingMicros int64
+	// A token bucket for the peer's GET_STATE_CHUNK requests. See
+	// AllowStateChunkRequest.
+	stateChunkTokens        float64
+	stateChunkTokensUpdated time.Time
 
 	// Connection info.
 	cmgr                              *ConnectionManager
@@ -496,9 +504,20 @@ func (pp *Peer) HandleGetBlocks(msg *MsgBitCloutGetBlocks) {
 	// Note that the requester should generally ask for the blocks in the
 	// order they'd like to receive them as we will typically honor this
 	// ordering.
+	advertisedPruneHeight := pp.AdvertisedPruneHeight()
 	for _, hashToSend := range msg.HashList {
 		blockToSend := pp.srv.blockchain.GetBlock(hashToSend)
 		if blockToSend == nil {
+			// The peer can't know about blocks we've pruned since we last told
+			// it our prune height, so tell it our new one rather than
+			// disconnecting it. It won't get the block from us either way.
+			if pruneHeight := pp.srv.blockchain.PruneHeight(); pruneHeight > advertisedPruneHeight {
+				glog.Debugf("Server._handleGetBlocks: Not sending block %v to peer %v "+
+					"because it may have been pruned; our prune height is now %d",
+					hashToSend, pp, pruneHeight)
+				pp.AdvertisePruneHeight(pruneHeight)
+				continue
+			}
 			// Don't ask us for blocks before verifying that we have them with a
 			// GetHeaders request.
 			glog.Errorf("Server._handleGetBlocks: Disconnecting peer %v because "+
@@ -506,6 +525,16 @@ func (pp *Peer) HandleGetBlocks(msg *MsgBitCloutGetBlocks) {
 			pp.Disconnect()
 			return
 		}
+		// Blocks below the prune height we told the peer about may not have been
+		// deleted yet but the peer shouldn't have asked for them. Blocks we've
+		// pruned since are still served for as long as we have them.
+		if blockToSend.Header.Height < advertisedPruneHeight {
+			glog.Errorf("Server._handleGetBlocks: Disconnecting peer %v because "+
+				"she asked for block %v at height %d, which is below our prune height %d",
+				pp, hashToSend, blockToSend.Header.Height, advertisedPruneHeight)
+			pp.Disconnect()
+			return
+		}
 		pp.AddBitCloutMessage(blockToSend, false)
 	}
 }
@@ -653,6 +682,80 @@ func (pp *Peer) StartingBlockHeight() uint32 {
 	return pp.startingHeight
 }
 
+// PruneHeight is the height below which the peer has pruned its blocks, or zero
+// if it hasn't pruned anything.
+func (pp *Peer) PruneHeight() uint64 {
+	pp.StatsMtx.RLock()
+	defer pp.StatsMtx.RUnlock()
+	return pp.pruneHeight
+}
+
+// SetPruneHeight records a new prune height the peer told us about after
+// version negotiation.
+func (pp *Peer) SetPruneHeight(pruneHeight uint64) {
+	pp.StatsMtx.Lock()
+	defer pp.StatsMtx.Unlock()
+	pp.pruneHeight = pruneHeight
+}
+
+// AllowStateChunkRequest reports whether the peer can make another
+// GET_STATE_CHUNK request at now. Serving a chunk means reading up to
+// MaxStateChunkBytes from the db, so each peer gets a bucket of
+// StateChunkRequestBurst requests that refills at StateChunkRequestsPerSecond.
+func (pp *Peer) AllowStateChunkRequest(now time.Time) bool {
+	pp.StatsMtx.Lock()
+	defer pp.StatsMtx.Unlock()
+
+	if pp.stateChunkTokensUpdated.IsZero() {
+		pp.stateChunkTokens = StateChunkRequestBurst
+	} else if now.After(pp.stateChunkTokensUpdated) {
+		pp.stateChunkTokens += now.Sub(pp.stateChunkTokensUpdated).Seconds() * StateChunkRequestsPerSecond
+		if pp.stateChunkTokens > StateChunkRequestBurst {
+			pp.stateChunkTokens = StateChunkRequestBurst
+		}
+	}
+	if now.After(pp.stateChunkTokensUpdated) {
+		pp.stateChunkTokensUpdated = now
+	}
+
+	if pp.stateChunkTokens < 1 {
+		return false
+	}
+	pp.stateChunkTokens--
+	return true
+}
+
+// AdvertisedPruneHeight is the last prune height we told the peer about. The
+// peer is only expected to avoid asking us for blocks below it.
+func (pp *Peer) AdvertisedPruneHeight() uint64 {
+	pp.StatsMtx.RLock()
+	defer pp.StatsMtx.RUnlock()
+	return pp.advertisedPruneHeight
+}
+
+// AdvertisePruneHeight sends the peer a PRUNE_HEIGHT message if pruneHeight is
+// above the last prune height we told it about. Peers that negotiated a protocol
+// version from before PRUNE_HEIGHT messages only ever get the prune height in
+// our version message.
+func (pp *Peer) AdvertisePruneHeight(pruneHeight uint64) {
+	pp.PeerInfoMtx.Lock()
+	negotiatedProtocolVersion := pp.negotiatedProtocolVersion
+	pp.PeerInfoMtx.Unlock()
+	if negotiatedProtocolVersion < PruneHeightProtocolVersion {
+		return
+	}
+
+	pp.StatsMtx.Lock()
+	if pruneHeight <= pp.advertisedPruneHeight {
+		pp.StatsMtx.Unlock()
+		return
+	}
+	pp.advertisedPruneHeight = pruneHeight
+	pp.StatsMtx.Unlock()
+
+	pp.AddBitCloutMessage(&MsgBitCloutPruneHeight{PruneHeight: pruneHeight}, false)
+}
+
 // NumBlocksToSend is the number of blocks the Peer has requested from
 // us that we have yet to send them.
 func (pp *Peer) NumBlocksToSend() uint32 {
@@ -1221,6 +1324,10 @@ func (pp *Peer) NewVersionMessage(params *BitCloutParams) *MsgBitCloutVersion {
 	// Server and the Blockchain.
 	if pp.srv != nil {
 		ver.StartBlockHeight = uint32(pp.srv.blockchain.blockTip().Header.Height)
+		ver.PruneHeight = pp.srv.blockchain.PruneHeight()
+		pp.StatsMtx.Lock()
+		pp.advertisedPruneHeight = ver.PruneHeight
+		pp.StatsMtx.Unlock()
 	} else {
 		ver.StartBlockHeight = uint32(0)
 	}
@@ -1327,6 +1434,7 @@ func (pp *Peer) readVersion() error {
 	// Set the stats-related fields.
 	pp.StatsMtx.Lock()
 	pp.startingHeight = verMsg.StartBlockHeight
+	pp.pruneHeight = verMsg.PruneHeight
 	pp.minTxFeeRateNanosPerKB = verMsg.MinFeeRateNanosPerKB
 	pp.timeConnected = time.Unix(verMsg.TstampSecs, 0)
 	pp.timeOffsetSecs = verMsg.TstampSecs - time.Now().Unix()
@@ -1 +1,60 @@
 package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvertisePruneHeight(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// A peer that predates PRUNE_HEIGHT messages is never sent one.
+	legacyPeer := &Peer{negotiatedProtocolVersion: PruneHeightProtocolVersion - 1}
+	legacyPeer.AdvertisePruneHeight(10)
+	assert.Nil(legacyPeer.MaybeDequeueBitCloutMessage())
+	assert.Equal(uint64(0), legacyPeer.AdvertisedPruneHeight())
+
+	// A peer is only told when the prune height goes past what it already knows.
+	pp := &Peer{negotiatedProtocolVersion: PruneHeightProtocolVersion, advertisedPruneHeight: 5}
+	pp.AdvertisePruneHeight(5)
+	assert.Nil(pp.MaybeDequeueBitCloutMessage())
+	pp.AdvertisePruneHeight(10)
+	msgMeta := pp.MaybeDequeueBitCloutMessage()
+	require.NotNil(msgMeta)
+	assert.False(msgMeta.Inbound)
+	assert.Equal(&MsgBitCloutPruneHeight{PruneHeight: 10}, msgMeta.BitCloutMessage)
+	assert.Equal(uint64(10), pp.AdvertisedPruneHeight())
+	pp.AdvertisePruneHeight(10)
+	assert.Nil(pp.MaybeDequeueBitCloutMessage())
+}
+
+func TestAllowStateChunkRequest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	// A new peer gets a full bucket, then has to wait for it to refill.
+	pp := &Peer{}
+	now := time.Unix(1000, 0)
+	for ii := 0; ii < StateChunkRequestBurst; ii++ {
+		assert.True(pp.AllowStateChunkRequest(now))
+	}
+	assert.False(pp.AllowStateChunkRequest(now))
+	now = now.Add(time.Second / StateChunkRequestsPerSecond)
+	assert.True(pp.AllowStateChunkRequest(now))
+	assert.False(pp.AllowStateChunkRequest(now))
+
+	// The bucket never holds more than a burst no matter how long the peer waits.
+	now = now.Add(time.Hour)
+	for ii := 0; ii < StateChunkRequestBurst; ii++ {
+		assert.True(pp.AllowStateChunkRequest(now))
+	}
+	assert.False(pp.AllowStateChunkRequest(now))
+}
@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// ReorgSimulationConfig describes the two forks built by SimulateReorg. Both
+// forks extend the same shared blocks and the winning fork must be longer so
+// the chain reorgs to it.
+type ReorgSimulationConfig struct {
+	// The sender needs two blocks of rewards before it can spend anything so
+	// this should be at least two.
+	NumSharedBlocks  int
+	NumLosingBlocks  int
+	NumWinningBlocks int
+
+	// Transfers from the sender to the recipient mined into every fork block.
+	// The transfers on each fork are different.
+	NumTxnsPerBlock int
+	// Transfers mined into the first block of both forks. These are disconnected
+	// with the losing fork and connected again with the winning one.
+	NumOverlappingTxns int
+}
+
+// ReorgSimulation holds a chain that connected the losing fork and then reorged
+// to the winning fork, along with a reference chain that only ever saw the
+// winning fork. Each has a txindex that was kept up to date as it went.
+type ReorgSimulation struct {
+	Params *BitCloutParams
+
+	Chain   *Blockchain
+	TXIndex *TXIndex
+
+	ReferenceChain   *Blockchain
+	ReferenceTXIndex *TXIndex
+
+	SharedBlocks  []*MsgBitCloutBlock
+	LosingBlocks  []*MsgBitCloutBlock
+	WinningBlocks []*MsgBitCloutBlock
+
+	tempDirs []string
+}
+
+// ReorgSimulationIgnoredPrefixes are allowed to differ between the reorged chain
+// and the reference chain. Blocks and block nodes from the losing fork are kept
+// around on purpose.
+var ReorgSimulationIgnoredPrefixes = [][]byte{
+	_PrefixBlockHashToBlock,
+	_PrefixBlockHashToDedupedBlock,
+	_PrefixTxnHashToBlockTxn,
+	_PrefixHeightHashToNodeInfo,
+	_PrefixBitcoinHeightHashToNodeInfo,
+}
+
+func _newReorgSimulationTXIndex(t *testing.T, sim *ReorgSimulation, chain *Blockchain) *TXIndex {
+	txIndexDb, dir := GetTestBadgerDb()
+	sim.tempDirs = append(sim.tempDirs, dir)
+	txIndex, err := NewTXIndexWithDb(chain, nil /*bitcoinManager*/, sim.Params, txIndexDb)
+	require.NoError(t, err)
+	return txIndex
+}
+
+// _mineReorgSimulationFork mines numBlocks blocks on chain. The txns are added to
+// the mempool before the first block and numTxnsPerBlock transfers starting at
+// firstAmountNanos are added before every block.
+func _mineReorgSimulationFork(t *testing.T, chain *Blockchain, mempool *BitCloutMempool,
+	miner *BitCloutMiner, txns []*MsgBitCloutTxn, numBlocks int, numTxnsPerBlock int,
+	firstAmountNanos uint64) []*MsgBitCloutBlock {
+
+	require := require.New(t)
+
+	for _, txn := range txns {
+		_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+		require.NoError(err)
+	}
+
+	blocks := []*MsgBitCloutBlock{}
+	amountNanos := firstAmountNanos
+	for ii := 0; ii < numBlocks; ii++ {
+		for jj := 0; jj < numTxnsPerBlock; jj++ {
+			txn := _assembleBasicTransferTxnFullySigned(t, chain, amountNanos, 0,
+				senderPkString, recipientPkString, senderPrivString, mempool)
+			_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+			require.NoError(err)
+			amountNanos++
+		}
+		block, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// SimulateReorg builds the two forks described by the config. The main chain
+// connects the shared blocks and the losing fork, updating its txindex, and then
+// processes the winning fork, which makes it reorg. The reference chain connects
+// the shared blocks and the winning fork. Call Cleanup when done.
+func SimulateReorg(t *testing.T, config *ReorgSimulationConfig) *ReorgSimulation {
+	require := require.New(t)
+	require.True(config.NumSharedBlocks >= 2, "NumSharedBlocks must be at least 2")
+	require.True(config.NumWinningBlocks > config.NumLosingBlocks,
+		"NumWinningBlocks must be greater than NumLosingBlocks")
+	require.True(config.NumLosingBlocks > 0, "NumLosingBlocks must be at least 1")
+
+	chain, params, _ := NewLowDifficultyBlockchain()
+	referenceChain, _, _ := NewLowDifficultyBlockchain()
+	sim := &ReorgSimulation{
+		Params:         params,
+		Chain:          chain,
+		ReferenceChain: referenceChain,
+	}
+	sim.TXIndex = _newReorgSimulationTXIndex(t, sim, chain)
+	sim.ReferenceTXIndex = _newReorgSimulationTXIndex(t, sim, referenceChain)
+
+	// Mine the shared blocks on the main chain and copy them to the reference chain.
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	sim.SharedBlocks = _mineReorgSimulationFork(
+		t, chain, mempool, miner, nil, config.NumSharedBlocks, 0, 0)
+	for _, block := range sim.SharedBlocks {
+		_, _, err := referenceChain.ProcessBlock(block, true /*verifySignatures*/)
+		require.NoError(err)
+	}
+	// The reference mempool is created after the shared blocks are connected so
+	// it sees their outputs.
+	referenceMempool, referenceMiner := NewTestMiner(t, referenceChain, params, true /*isSender*/)
+
+	// The overlapping txns only spend outputs from the shared blocks so they're
+	// valid on both forks.
+	overlappingTxns := []*MsgBitCloutTxn{}
+	for ii := 0; ii < config.NumOverlappingTxns; ii++ {
+		txn := _assembleBasicTransferTxnFullySigned(t, chain, uint64(1+ii), 0,
+			senderPkString, recipientPkString, senderPrivString, mempool)
+		_, err := mempool.ProcessTransaction(txn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+		require.NoError(err)
+		overlappingTxns = append(overlappingTxns, txn)
+	}
+
+	// The fork-specific transfers use different amounts on each fork so none of
+	// them are accidentally the same txn.
+	sim.LosingBlocks = _mineReorgSimulationFork(
+		t, chain, mempool, miner, nil, config.NumLosingBlocks, config.NumTxnsPerBlock, 1000)
+	require.NoError(sim.TXIndex.Update())
+
+	sim.WinningBlocks = _mineReorgSimulationFork(
+		t, referenceChain, referenceMempool, referenceMiner, overlappingTxns,
+		config.NumWinningBlocks, config.NumTxnsPerBlock, 2000)
+	require.NoError(sim.ReferenceTXIndex.Update())
+
+	// Process the winning fork on the main chain to make it reorg.
+	for _, block := range sim.WinningBlocks {
+		_, _, err := chain.ProcessBlock(block, true /*verifySignatures*/)
+		require.NoError(err)
+	}
+	lastWinningHash, err := sim.WinningBlocks[len(sim.WinningBlocks)-1].Hash()
+	require.NoError(err)
+	require.Equal(*lastWinningHash, *chain.blockTip().Hash)
+	require.NoError(sim.TXIndex.Update())
+
+	return sim
+}
+
+// _requireDbMatchesReference requires every key in db to match referenceDb
+// except for the ignored and node-local prefixes. Mismatches are reported by
+// the name of the prefix they belong to.
+func _requireDbMatchesReference(t *testing.T, dbName string, db *badger.DB,
+	referenceDb *badger.DB, ignoredPrefixes [][]byte) {
+
+	loadEntries := func(handle *badger.DB) map[string][]byte {
+		entries := make(map[string][]byte)
+		require.NoError(t, DbView(handle, func(txn KVTxn) error {
+			it := txn.NewIterator(KVIteratorOptions{})
+			defer it.Close()
+			for it.Seek(nil); it.Valid(); it.Next() {
+				key := append([]byte{}, it.Key()...)
+				if IsLocalOnlyDbKey(key) {
+					continue
+				}
+				ignored := false
+				for _, prefix := range ignoredPrefixes {
+					if bytes.HasPrefix(key, prefix) {
+						ignored = true
+						break
+					}
+				}
+				if ignored {
+					continue
+				}
+				val, err := it.Value()
+				if err != nil {
+					return err
+				}
+				entries[string(key)] = val
+			}
+			return nil
+		}))
+		return entries
+	}
+	prefixName := func(key string) string {
+		if prefixInfo := GetDbPrefixInfoForKey([]byte(key)); prefixInfo != nil {
+			return prefixInfo.Name
+		}
+		return "unregistered"
+	}
+
+	entries := loadEntries(db)
+	referenceEntries := loadEntries(referenceDb)
+	for key, val := range entries {
+		referenceVal, exists := referenceEntries[key]
+		if !exists {
+			t.Errorf("%s: %s key %x is left over from the losing fork", dbName, prefixName(key), key)
+			continue
+		}
+		if !bytes.Equal(val, referenceVal) {
+			t.Errorf("%s: %s key %x has value %x but expected %x",
+				dbName, prefixName(key), key, val, referenceVal)
+		}
+	}
+	for key := range referenceEntries {
+		if _, exists := entries[key]; !exists {
+			t.Errorf("%s: %s key %x from the winning fork is missing", dbName, prefixName(key), key)
+		}
+	}
+}
+
+// RequireOnlyWinningChain requires the main chain's db and txindex db to hold
+// exactly what the reference chain's do, apart from
+// ReorgSimulationIgnoredPrefixes. Any index that doesn't fully undo a
+// disconnected block shows up here without the test having to know about it.
+func (sim *ReorgSimulation) RequireOnlyWinningChain(t *testing.T) {
+	_requireDbMatchesReference(t, "core db", sim.Chain.DB(),
+		sim.ReferenceChain.DB(), ReorgSimulationIgnoredPrefixes)
+	_requireDbMatchesReference(t, "txindex db", sim.TXIndex.TXIndexChain.DB(),
+		sim.ReferenceTXIndex.TXIndexChain.DB(), ReorgSimulationIgnoredPrefixes)
+}
+
+// Cleanup closes the txindex dbs and removes their files.
+func (sim *ReorgSimulation) Cleanup() {
+	sim.TXIndex.Stop()
+	sim.ReferenceTXIndex.Stop()
+	for _, dir := range sim.tempDirs {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReorgSimulation(t *testing.T) {
+	for _, config := range []*ReorgSimulationConfig{
+		// A one block fork with no txns of its own.
+		{NumSharedBlocks: 2, NumLosingBlocks: 1, NumWinningBlocks: 2},
+		// Longer forks with their own txns and txns in common.
+		{NumSharedBlocks: 3, NumLosingBlocks: 2, NumWinningBlocks: 4,
+			NumTxnsPerBlock: 2, NumOverlappingTxns: 2},
+	} {
+		sim := SimulateReorg(t, config)
+		sim.RequireOnlyWinningChain(t)
+		sim.Cleanup()
+	}
+}
@@ -53,6 +53,10 @@ type Server struct {
 	mempool        *BitCloutMempool
 	miner          *BitCloutMiner
 	blockProducer  *BitCloutBlockProducer
+	feeEstimator   *FeeEstimator
+	// stateChunkServer serves GET_STATE_CHUNK requests from the states it pins
+	// as blocks connect.
+	stateChunkServer *DbStateChunkServer
 
 	// All messages received from peers get sent from the ConnectionManager to the
 	// Server through this channel.
@@ -130,6 +134,14 @@ func (srv *Server) HasProcessedFirstTransactionBundle() bool {
 	return srv.hasProcessedFirstTransactionBundle
 }
 
+// GetDbDecodeFailureAlerts returns the db prefixes with more values that failed
+// to decode than the node's alert threshold. A health check can fail while this
+// is non-empty since it usually means the db is corrupt or was written by an
+// incompatible version of the node.
+func (srv *Server) GetDbDecodeFailureAlerts() ([]*DecodeFailureCount, error) {
+	return DbGetDecodeFailureAlerts(srv.blockchain.db)
+}
+
 // ResetRequestQueues resets all the request queues.
 func (srv *Server) ResetRequestQueues() {
 	srv.dataLock.Lock()
@@ -188,6 +200,28 @@ func (srv *Server) GetMempool() *BitCloutMempool {
 	return srv.mempool
 }
 
+// TODO: The hallmark of a messy non-law-of-demeter-following interface...
+func (srv *Server) GetFeeEstimator() *FeeEstimator {
+	return srv.feeEstimator
+}
+
+// EnableMempoolLimiter holds the txns added to the mempool to the limits in
+// config, counting the txns relayed by a peer against the peer's IP.
+func (srv *Server) EnableMempoolLimiter(config *MempoolLimiterConfig) {
+	srv.mempool.SetLimiter(NewMempoolLimiter(config, srv._peerIP))
+}
+
+// _peerIP returns the IP of the connected peer with the given ID, or an empty
+// string if there isn't one.
+func (srv *Server) _peerIP(peerID uint64) string {
+	for _, pp := range srv.cmgr.GetAllPeers() {
+		if pp.ID == peerID {
+			return pp.IP()
+		}
+	}
+	return ""
+}
+
 // TODO: The hallmark of a messy non-law-of-demeter-following interface...
 func (srv *Server) GetBlockProducer() *BitCloutBlockProducer {
 	return srv.blockProducer
@@ -310,6 +344,7 @@ func NewServer(
 		disableNetworking:            _disableNetworking,
 		readOnlyMode:                 _readOnlyMode,
 		ignoreInboundPeerInvMessages: _ignoreInboundPeerInvMessages,
+		stateChunkServer:             NewDbStateChunkServer(_db, StateSyncSnapshotPeriodBlocks),
 	}
 
 	// The same timesource is used in the chain data structure and in the connection
@@ -361,12 +396,22 @@ func NewServer(
 		_chain.blockTip().Height,
 		hex.EncodeToString(_chain.blockTip().Hash[:]),
 		hex.EncodeToString(BigintToHash(_chain.blockTip().CumWork)[:]))
+	// If we stopped right at a pinned height, pin it again so we can keep serving
+	// the syncs that were using it.
+	if err := srv.stateChunkServer.MaybePin(_chain.blockTip().Hash, _chain.blockTip().Height); err != nil {
+		glog.Errorf("NewServer: Problem pinning state at the tip: %v", err)
+	}
 
 	// Create a mempool to store transactions until they're ready to be mined into
 	// blocks.
 	_mempool := NewBitCloutMempool(_chain, _rateLimitFeerateNanosPerKB,
 		_minFeeRateNanosPerKB, _blockCypherAPIKey, _runReadOnlyUtxoViewUpdater, _dataDir,
 		_mempoolDumpDir)
+	_mempool.eventManager = _chain.EventManager()
+
+	// Estimate fee rates for wallets from the mempool and the blocks connected
+	// from here on.
+	_feeEstimator := NewFeeEstimator(_chain, _minFeeRateNanosPerKB, FeeEstimatorNumBlocks)
 
 	// Useful for debugging. Every second, it outputs the contents of the mempool
 	// and the contents of the addrmanager.
@@ -422,6 +467,7 @@ func NewServer(
 	srv.blockchain = _chain
 	srv.bitcoinManager = _bitcoinManager
 	srv.mempool = _mempool
+	srv.feeEstimator = _feeEstimator
 	srv.miner = _miner
 	srv.blockProducer = _blockProducer
 	srv.incomingMessages = _incomingMessages
@@ -740,6 +786,10 @@ func (srv *Server) _startSync() {
 		if peer.StartingBlockHeight() < bestHeight {
 			continue
 		}
+		// A peer that has pruned blocks we still need can't sync us.
+		if peer.PruneHeight() > uint64(srv.blockchain.blockTip().Height)+1 {
+			continue
+		}
 
 		// TODO: Choose best peers based on ping time and/or the highest
 		// starting block height. For now, keeping it simple and just choosing
@@ -981,6 +1031,10 @@ func (srv *Server) _handleDonePeer(pp *Peer) {
 
 	srv._cleanupDonePeerPeerState(pp)
 
+	// Drop the unconnected txns the peer sent since it can't be asked about their
+	// parents anymore.
+	srv.mempool.RemoveUnconnectedTxnsFromPeer(pp.ID)
+
 	// Attempt to find a new peer to sync from if the quitting peer is the
 	// sync peer and if our blockchain isn't current.
 	if srv.SyncPeer == pp && srv.blockchain.isSyncing() {
@@ -1072,6 +1126,14 @@ func (srv *Server) _addNewTxn(
 // It's assumed that the caller will hold the ChainLock for reading so
 // that the mempool transactions don't shift under our feet.
 func (srv *Server) _handleBlockMainChainConnectedd(blk *MsgBitCloutBlock) {
+	// Pin the state for state sync before anything else can connect a block.
+	// This happens while we're syncing too so that peers can sync from us as soon
+	// as we reach a pinned height.
+	if blockHash, err := blk.Header.Hash(); err == nil {
+		if err := srv.stateChunkServer.MaybePin(blockHash, uint32(blk.Header.Height)); err != nil {
+			glog.Errorf("_handleBlockMainChainConnected: Problem pinning state: %v", err)
+		}
+	}
 
 	// Don't do anything mempool-related until our best block chain is done
 	// syncing.
@@ -1392,6 +1454,49 @@ func (srv *Server) _handleTransactionBundle(pp *Peer, msg *MsgBitCloutTransactio
 	pp.AddBitCloutMessage(msg, true /*inbound*/)
 }
 
+func (srv *Server) _handleGetStateChunk(pp *Peer, msg *MsgBitCloutGetStateChunk) {
+	glog.Debugf("Server._handleGetStateChunk: Received GetStateChunk message for "+
+		"prefix %v from Peer %v", msg.Prefix, pp)
+
+	if !pp.AllowStateChunkRequest(time.Now()) {
+		glog.Warningf("Server._handleGetStateChunk: Dropping request from Peer %v "+
+			"because it's over the rate limit", pp)
+		return
+	}
+
+	chunk, err := srv.stateChunkServer.ServeStateChunk(
+		msg.BlockHash, msg.Prefix, msg.StartKey, int(msg.Limit))
+	if err != nil {
+		glog.Errorf("Server._handleGetStateChunk: Problem serving chunk to Peer %v: %v", pp, err)
+		return
+	}
+	pp.AddBitCloutMessage(&MsgBitCloutStateChunk{Chunk: chunk}, false /*inbound*/)
+}
+
+func (srv *Server) _handleStateChunk(pp *Peer, msg *MsgBitCloutStateChunk) {
+	// We only ever request chunks through SyncStateFromPeer before the Server
+	// starts, so any chunk that reaches us here wasn't asked for.
+	glog.Debugf("Server._handleStateChunk: Ignoring unrequested StateChunk message "+
+		"from Peer %v", pp)
+}
+
+func (srv *Server) _handlePruneHeight(pp *Peer, msg *MsgBitCloutPruneHeight) {
+	glog.Debugf("Server._handlePruneHeight: Peer %v pruned its blocks up to height %d",
+		pp, msg.PruneHeight)
+
+	pp.SetPruneHeight(msg.PruneHeight)
+
+	// Switch to another sync peer if this one has pruned blocks we still need.
+	// The blocks we've already asked it for time out like any other stalled
+	// request.
+	if srv.SyncPeer == pp && srv.blockchain.isSyncing() &&
+		msg.PruneHeight > uint64(srv.blockchain.blockTip().Height)+1 {
+
+		srv.SyncPeer = nil
+		srv._startSync()
+	}
+}
+
 func (srv *Server) _handleMempool(pp *Peer, msg *MsgBitCloutMempool) {
 	glog.Debugf("Server._handleMempool: Received Mempool message from Peer %v", pp)
 
@@ -1415,6 +1520,12 @@ func (srv *Server) StartMempoolStatsReporter() {
 				total := len(mp.readOnlyUniversalTransactionList)
 				srv.statsdClient.Gauge("MEMPOOL.COUNT", float64(total), tags, 1)
 
+				evictionStats := mp.GetEvictionStats()
+				srv.statsdClient.Gauge("MEMPOOL.EVICTIONS", float64(evictionStats.NumEvictions), tags, 1)
+				srv.statsdClient.Gauge("MEMPOOL.EVICTED.COUNT", float64(evictionStats.NumTxnsEvicted), tags, 1)
+				srv.statsdClient.Gauge("MEMPOOL.EVICTED.DESCENDANTS", float64(evictionStats.NumDescendantsEvicted), tags, 1)
+				srv.statsdClient.Gauge("MEMPOOL.EVICTED.BYTES", float64(evictionStats.NumBytesEvicted), tags, 1)
+
 			case <-srv.mempool.quit:
 				break out
 			}
@@ -1539,6 +1650,12 @@ func (srv *Server) _handlePeerMessages(serverMessage *ServerMessage) {
 		srv._handleMempool(serverMessage.Peer, msg)
 	case *MsgBitCloutInv:
 		srv._handleInv(serverMessage.Peer, msg)
+	case *MsgBitCloutGetStateChunk:
+		srv._handleGetStateChunk(serverMessage.Peer, msg)
+	case *MsgBitCloutStateChunk:
+		srv._handleStateChunk(serverMessage.Peer, msg)
+	case *MsgBitCloutPruneHeight:
+		srv._handlePruneHeight(serverMessage.Peer, msg)
 	}
 }
 
@@ -1705,6 +1822,94 @@ func (srv *Server) _startTransactionRelayer() {
 	}
 }
 
+// StartScheduledPostPublisher submits scheduled posts to the mempool once they
+// are due, checking until the lifecycle is stopped. A post that fails to
+// broadcast is dropped rather than retried since a txn that fails validation
+// once, e.g. because its inputs were spent, won't succeed later.
+func (srv *Server) StartScheduledPostPublisher(lifecycle *CoreDBLifecycle) error {
+	return lifecycle.GoPeriodic("scheduled-post-publisher",
+		ScheduledPostCheckIntervalSeconds*time.Second, func() {
+			srv._publishDueScheduledPosts(lifecycle)
+		})
+}
+
+func (srv *Server) _publishDueScheduledPosts(lifecycle *CoreDBLifecycle) {
+	duePosts, err := DbGetScheduledPostTxns(lifecycle.DB(), uint64(time.Now().UnixNano()))
+	if err != nil {
+		glog.Errorf("Server._publishDueScheduledPosts: Problem fetching scheduled posts: %v", err)
+		return
+	}
+	for _, duePost := range duePosts {
+		if err := srv.VerifyAndBroadcastTransaction(duePost.Txn); err != nil {
+			glog.Errorf("Server._publishDueScheduledPosts: Dropping scheduled "+
+				"post %v: %v", duePost.DraftHash, err)
+		} else {
+			glog.Debugf("Server._publishDueScheduledPosts: Published "+
+				"scheduled post %v", duePost.DraftHash)
+		}
+		err := lifecycle.Update(func(txn KVTxn) error {
+			return DbDeleteScheduledPostTxnWithTxn(txn, duePost.PublishAtTstampNanos, duePost.DraftHash)
+		})
+		if err != nil {
+			glog.Errorf("Server._publishDueScheduledPosts: Problem deleting "+
+				"scheduled post %v: %v", duePost.DraftHash, err)
+		}
+	}
+}
+
+// StartDecodeFailureReporter periodically saves the decode failure counts,
+// reports them to statsd, and warns about prefixes that are over the alert
+// threshold until the lifecycle is stopped.
+func (srv *Server) StartDecodeFailureReporter(lifecycle *CoreDBLifecycle) error {
+	return lifecycle.GoPeriodic("decode-failure-reporter",
+		DecodeFailureReportIntervalSeconds*time.Second, func() {
+			srv._reportDecodeFailures(lifecycle)
+		})
+}
+
+func (srv *Server) _reportDecodeFailures(lifecycle *CoreDBLifecycle) {
+	if err := DbFlushDecodeFailureCountsWithUpdate(lifecycle.Update); err != nil {
+		glog.Errorf("Server._reportDecodeFailures: Problem saving decode failures: %v", err)
+		return
+	}
+	alerts, err := DbGetDecodeFailureAlerts(lifecycle.DB())
+	if err != nil {
+		glog.Errorf("Server._reportDecodeFailures: Problem checking decode failures: %v", err)
+		return
+	}
+	for _, alert := range alerts {
+		glog.Warningf("Server._reportDecodeFailures: %d values under prefix %s "+
+			"failed to decode; the db may be corrupt", alert.Count, alert.PrefixName)
+	}
+
+	if srv.statsdClient == nil {
+		return
+	}
+	decodeFailureCounts, err := DbGetDecodeFailureCounts(lifecycle.DB())
+	if err != nil {
+		glog.Errorf("Server._reportDecodeFailures: Problem fetching decode failures: %v", err)
+		return
+	}
+	tags := []string{}
+	for _, decodeFailureCount := range decodeFailureCounts {
+		srv.statsdClient.Gauge(fmt.Sprintf("DB.DECODE_FAILURES.%s", decodeFailureCount.PrefixName),
+			float64(decodeFailureCount.Count), tags, 1)
+	}
+	srv.statsdClient.Gauge("DB.DECODE_FAILURES.ALERTS", float64(len(alerts)), tags, 1)
+}
+
+// StartPruneHeightAdvertiser periodically tells peers about blocks we've pruned
+// since we last told them our prune height until the lifecycle is stopped.
+func (srv *Server) StartPruneHeightAdvertiser(lifecycle *CoreDBLifecycle) error {
+	return lifecycle.GoPeriodic("prune-height-advertiser",
+		PruneHeightAdvertiseIntervalSeconds*time.Second, func() {
+			pruneHeight := DbGetPruneHeight(lifecycle.DB())
+			for _, pp := range srv.cmgr.GetAllPeers() {
+				pp.AdvertisePruneHeight(pruneHeight)
+			}
+		})
+}
+
 func (srv *Server) Stop() {
 	glog.Info("Server.Stop: Gracefully shutting down Server")
 
@@ -1744,6 +1949,14 @@ func (srv *Server) Stop() {
 
 	// Wait for the server to fully shut down.
 	srv.waitGroup.Wait()
+
+	// Release the states we pinned for state sync now that nothing can serve them.
+	srv.stateChunkServer.Close()
+
+	// Save any decode failures that haven't been reported yet.
+	if err := DbFlushDecodeFailureCounts(srv.blockchain.db); err != nil {
+		glog.Errorf("Server.Stop: Problem saving decode failure counts: %v", err)
+	}
 	glog.Info("Server.Stop: Successfully shut down Server")
 }
 
@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/dgraph-io/badger/v3"
-	"path/filepath"
 	"reflect"
 	"time"
 
@@ -28,21 +27,50 @@ type TXIndex struct {
 
 	// Core params object
 	Params *BitCloutParams
+
+	// The txns in the core chain's mempool. Nil unless EnableMempoolView was
+	// called.
+	MempoolView *TxindexMempoolView
+
+	// The lifecycle of the txindex db when it's owned by a DbManager. The update
+	// loop runs through it so the db isn't closed out from under it. Nil when the
+	// TXIndex was set up on a db that's already open.
+	lifecycle *CoreDBLifecycle
 }
 
-func NewTXIndex(coreChain *Blockchain, bitcoinManager *BitcoinManager, params *BitCloutParams, dataDirectory string) (*TXIndex, error) {
+func NewTXIndex(coreChain *Blockchain, bitcoinManager *BitcoinManager, params *BitCloutParams, dbManager *DbManager) (*TXIndex, error) {
 	// Initialize database
-	txIndexDir := filepath.Join(GetBadgerDbPath(dataDirectory), "txindex")
-	txIndexOpts := badger.DefaultOptions(txIndexDir)
-	txIndexOpts.ValueDir = GetBadgerDbPath(txIndexDir)
-	txIndexOpts.MemTableSize = 1024 << 20
-	glog.Infof("TxIndex BadgerDB Dir: %v", txIndexOpts.Dir)
-	glog.Infof("TxIndex BadgerDB ValueDir: %v", txIndexOpts.ValueDir)
-	txIndexDb, err := badger.Open(txIndexOpts)
+	txIndexLifecycle, err := dbManager.OpenTxindexDb()
 	if err != nil {
 		glog.Fatal(err)
 	}
 
+	txIndex, err := NewTXIndexWithDb(coreChain, bitcoinManager, params, txIndexLifecycle.DB())
+	if err != nil {
+		return nil, err
+	}
+	txIndex.lifecycle = txIndexLifecycle
+	return txIndex, nil
+}
+
+// NewTXIndexWithDb sets up a TXIndex on a db that's already open. The db must
+// be separate from the core chain's db.
+func NewTXIndexWithDb(coreChain *Blockchain, bitcoinManager *BitcoinManager, params *BitCloutParams, txIndexDb *badger.DB) (*TXIndex, error) {
+	// Clean up after a failed genesis initialization before we decide whether
+	// the seed mappings below need to be written. Otherwise the wipe would
+	// happen after they're written, when the txindex chain is initialized.
+	if _, err := DbResetIncompleteGenesisInit(txIndexDb); err != nil {
+		return nil, fmt.Errorf("NewTXIndex: Error recovering from incomplete genesis initialization: %v", err)
+	}
+
+	// Move the public key mappings of a txindex built before they were keyed by
+	// the txn's position in the chain.
+	if numMappings, err := DbMigrateTxindexPublicKeyIndex(txIndexDb); err != nil {
+		return nil, fmt.Errorf("NewTXIndex: Error migrating public key index: %v", err)
+	} else if numMappings > 0 {
+		glog.Infof("NewTXIndex: Migrated %d public key mappings", numMappings)
+	}
+
 	// See if we have a best chain hash stored in the txindex db.
 	bestBlockHashBeforeInit := DbGetBestHash(txIndexDb, ChainTypeBitCloutBlock)
 
@@ -114,6 +142,28 @@ func NewTXIndex(coreChain *Blockchain, bitcoinManager *BitcoinManager, params *B
 		}
 	}
 
+	// Compute the activity of the public keys indexed before it was tracked.
+	if numPublicKeys, err := DbBackfillPublicKeyActivity(txIndexDb); err != nil {
+		return nil, fmt.Errorf("NewTXIndex: Error backfilling public key activity: %v", err)
+	} else if numPublicKeys > 0 {
+		glog.Infof("NewTXIndex: Computed activity for %d public keys", numPublicKeys)
+	}
+
+	// Add the txns indexed before the block explorer indexes existed to them.
+	if numTxns, err := DbBackfillTxindexExplorerIndexes(txIndexDb); err != nil {
+		return nil, fmt.Errorf("NewTXIndex: Error backfilling block explorer indexes: %v", err)
+	} else if numTxns > 0 {
+		glog.Infof("NewTXIndex: Added %d txns to the block explorer indexes", numTxns)
+	}
+
+	// Drop the UtxoOpsDumps of the txns indexed before they were replaced.
+	if numTxns, numBytesSaved, err := DbStripTxindexUtxoOpsDumps(txIndexDb); err != nil {
+		return nil, fmt.Errorf("NewTXIndex: Error stripping UtxoOpsDumps: %v", err)
+	} else if numTxns > 0 {
+		glog.Infof("NewTXIndex: Rewrote the metadata of %d txns without their UtxoOpsDumps, saving %d bytes",
+			numTxns, numBytesSaved)
+	}
+
 	// Ignore all the notifications from the txindex blockchain object
 	txIndexBlockchainNotificationChan := make(chan *ServerMessage, 1000)
 	go func() {
@@ -149,18 +199,26 @@ func (txi *TXIndex) Start() {
 
 	// Run a loop to continuously update the txindex. Note that this is a noop
 	// except when run the first time or when a new block has arrived.
+	tryUpdate := func() {
+		if txi.CoreChain.ChainState() == SyncStateFullyCurrent {
+			// If the node is fully synced, then try an update.
+			err := txi.Update()
+			if err != nil {
+				glog.Error(fmt.Errorf("tryUpdateTxindex: Problem running update: %v", err))
+			}
+		} else {
+			glog.Debugf("TXIndex: Waiting for node to sync before updating")
+		}
+	}
+	if txi.lifecycle != nil {
+		if err := txi.lifecycle.GoPeriodic("txindex-update", 1*time.Second, tryUpdate); err != nil {
+			glog.Errorf("TXIndex: Problem starting update thread: %v", err)
+		}
+		return
+	}
 	go func() {
 		for {
-			if txi.CoreChain.ChainState() == SyncStateFullyCurrent {
-				// If the node is fully synced, then try an update.
-				err := txi.Update()
-				if err != nil {
-					glog.Error(fmt.Errorf("tryUpdateTxindex: Problem running update: %v", err))
-				}
-			} else {
-				glog.Debugf("TXIndex: Waiting for node to sync before updating")
-			}
-
+			tryUpdate()
 			time.Sleep(1 * time.Second)
 		}
 	}()
@@ -169,6 +227,13 @@ func (txi *TXIndex) Start() {
 func (txi *TXIndex) Stop() {
 	glog.Info("TXIndex: Closing database")
 
+	if txi.lifecycle != nil {
+		// Waits for the update loop to finish before closing the db.
+		if err := txi.lifecycle.Stop(); err != nil {
+			glog.Errorf("TXIndex: Problem closing database: %v", err)
+		}
+		return
+	}
 	txi.TXIndexChain.DB().Close()
 }
 
@@ -281,49 +346,10 @@ func (txi *TXIndex) Update() error {
 
 		// Now that all the transactions have been deleted from our txindex,
 		// it's safe to disconnect the block from our txindex chain.
-		utxoView, err := NewUtxoView(
-			txi.TXIndexChain.DB(), txi.Params, txi.BitcoinManager)
-		if err != nil {
-			return fmt.Errorf(
-				"Update: Error initializing UtxoView: %v", err)
-		}
-		utxoOps, err := GetUtxoOperationsForBlock(
-			txi.TXIndexChain.DB(), blockToDetach.Hash)
-		if err != nil {
-			return fmt.Errorf(
-				"Update: Error getting UtxoOps for block %v: %v", blockToDetach, err)
-		}
-		// Compute the hashes for all the transactions.
-		txHashes, err := ComputeTransactionHashes(blockMsg.Txns)
-		if err != nil {
-			return fmt.Errorf(
-				"Update: Error computing tx hashes for block %v: %v",
-				blockToDetach, err)
-		}
-		if err := utxoView.DisconnectBlock(blockMsg, txHashes, utxoOps); err != nil {
-			return fmt.Errorf("Update: Error detaching block "+
-				"%v from UtxoView: %v", blockToDetach, err)
-		}
-		if err := utxoView.FlushToDb(); err != nil {
-			return fmt.Errorf("Update: Error flushing view to db for block "+
-				"%v: %v", blockToDetach, err)
-		}
-		// We have to flush a couple of extra things that the view doesn't flush...
-		if err := PutBestHash(utxoView.TipHash, txi.TXIndexChain.DB(), ChainTypeBitCloutBlock); err != nil {
-			return fmt.Errorf("Update: Error putting best hash for block "+
-				"%v: %v", blockToDetach, err)
-		}
-		err = txi.TXIndexChain.DB().Update(func(txn *badger.Txn) error {
-			if err := DeleteUtxoOperationsForBlockWithTxn(txn, blockToDetach.Hash); err != nil {
-				return fmt.Errorf("Update: Error deleting UtxoOperations 1 for block %v, %v", blockToDetach.Hash, err)
-			}
-			if err := txn.Delete(BlockHashToBlockKey(blockToDetach.Hash)); err != nil {
-				return fmt.Errorf("Update: Error deleting UtxoOperations 2 for block %v %v", blockToDetach.Hash, err)
-			}
-			return nil
-		})
-		if err != nil {
-			return fmt.Errorf("Update: Error updating badgger: %v", err)
+		if err := _disconnectTxindexBlock(
+			txi.TXIndexChain.DB(), txi.Params, txi.BitcoinManager, blockMsg); err != nil {
+
+			return fmt.Errorf("Update: %v", err)
 		}
 		// Delete this block from the chain db so we don't get duplicate block errors.
 
@@ -367,9 +393,17 @@ func (txi *TXIndex) Update() error {
 				"Update: Error initializing UtxoView: %v", err)
 		}
 
+		// The txns' bytes are stored along with their metadata if the node is
+		// configured to do so.
+		nodeConfig, err := DbGetNodeConfig(txi.CoreChain.DB())
+		if err != nil {
+			return fmt.Errorf("Update: Problem fetching node config: %v", err)
+		}
+
 		// Do each block update in a single transaction so we're safe in case the node
 		// restarts.
-		txi.TXIndexChain.DB().Update(func(dbTxn *badger.Txn) error {
+		txnMetas := []*TransactionMetadata{}
+		DbUpdate(txi.TXIndexChain.DB(), func(dbTxn KVTxn) error {
 
 			// Iterate through each transaction in the block and do the following:
 			// - Connect it to the view
@@ -388,6 +422,13 @@ func (txi *TXIndex) Update() error {
 					return fmt.Errorf("Update: Problem adding txn %v to txindex: %v",
 						txn, err)
 				}
+				if nodeConfig.TxindexTxnBytes {
+					if err := DbPutTxindexTxnBytesWithTxn(dbTxn, txn); err != nil {
+						return fmt.Errorf("Update: Problem adding bytes of txn %v to txindex: %v",
+							txn, err)
+					}
+				}
+				txnMetas = append(txnMetas, txnMeta)
 			}
 
 			return nil
@@ -400,6 +441,13 @@ func (txi *TXIndex) Update() error {
 			return fmt.Errorf("Update: Problem attaching block %v: %v",
 				blockToAttach, err)
 		}
+
+		// Let anyone following the core chain know the block's txns have been
+		// indexed.
+		for ii, txnMeta := range txnMetas {
+			txi.CoreChain.EventManager().transactionIndexed(
+				blockMsg.Txns[ii], blockToAttach.Hash, txnMeta)
+		}
 	}
 
 	glog.Infof("Update: Txindex update complete. New tip: (height: %d, hash: %v)",
@@ -407,3 +455,58 @@ func (txi *TXIndex) Update() error {
 
 	return nil
 }
+
+// _disconnectTxindexBlock disconnects the block at the tip of the txindex chain
+// from the txindex's view and deletes it and its UtxoOperations from the
+// txindex db. The block's transaction mappings have to be deleted first.
+func _disconnectTxindexBlock(txIndexDb *badger.DB, params *BitCloutParams,
+	bitcoinManager *BitcoinManager, blockMsg *MsgBitCloutBlock) error {
+
+	blockHash, err := blockMsg.Hash()
+	if err != nil {
+		return fmt.Errorf("_disconnectTxindexBlock: Error hashing block: %v", err)
+	}
+	utxoView, err := NewUtxoView(txIndexDb, params, bitcoinManager)
+	if err != nil {
+		return fmt.Errorf(
+			"_disconnectTxindexBlock: Error initializing UtxoView: %v", err)
+	}
+	utxoOps, err := GetUtxoOperationsForBlock(txIndexDb, blockHash)
+	if err != nil {
+		return fmt.Errorf(
+			"_disconnectTxindexBlock: Error getting UtxoOps for block %v: %v", blockHash, err)
+	}
+	// Compute the hashes for all the transactions.
+	txHashes, err := ComputeTransactionHashes(blockMsg.Txns)
+	if err != nil {
+		return fmt.Errorf(
+			"_disconnectTxindexBlock: Error computing tx hashes for block %v: %v",
+			blockHash, err)
+	}
+	if err := utxoView.DisconnectBlock(blockMsg, txHashes, utxoOps); err != nil {
+		return fmt.Errorf("_disconnectTxindexBlock: Error detaching block "+
+			"%v from UtxoView: %v", blockHash, err)
+	}
+	if err := utxoView.FlushToDb(); err != nil {
+		return fmt.Errorf("_disconnectTxindexBlock: Error flushing view to db for block "+
+			"%v: %v", blockHash, err)
+	}
+	// We have to flush a couple of extra things that the view doesn't flush...
+	if err := PutBestHash(utxoView.TipHash, txIndexDb, ChainTypeBitCloutBlock); err != nil {
+		return fmt.Errorf("_disconnectTxindexBlock: Error putting best hash for block "+
+			"%v: %v", blockHash, err)
+	}
+	err = DbUpdate(txIndexDb, func(txn KVTxn) error {
+		if err := DeleteUtxoOperationsForBlockWithTxn(txn, blockHash); err != nil {
+			return fmt.Errorf("Error deleting UtxoOperations for block %v, %v", blockHash, err)
+		}
+		if err := DeleteBlockWithTxn(txn, blockHash); err != nil {
+			return fmt.Errorf("Error deleting block %v %v", blockHash, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("_disconnectTxindexBlock: Error updating badger: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// The txindex only covers txns that have been mined, so a wallet following it
+// doesn't see a payment until it's in a block. The TxindexMempoolView indexes
+// the txns in the mempool as they're added and removed so they can be looked up
+// along with the mined ones. Its entries are kept in memory, or in the txindex
+// db under their own prefixes when the mempool is too big to keep in memory. They
+// don't survive a restart either way since the mempool doesn't.
+//
+// A txn is removed from the view as soon as it leaves the mempool, which for a
+// mined txn is before the txindex has caught up to its block, so a txn can be
+// missing from both for a moment.
+
+// TxindexTxnRef is a txn's metadata along with whether its txn has been mined.
+// The metadata of a txn that hasn't been mined has no block.
+type TxindexTxnRef struct {
+	TxID      *BlockHash
+	Metadata  *TransactionMetadata
+	Confirmed bool
+}
+
+type TxindexMempoolView struct {
+	mtx    sync.RWMutex
+	params *BitCloutParams
+
+	// When db is set the entries are stored in it rather than in the maps.
+	db                *badger.DB
+	txnMetas          map[BlockHash]*TransactionMetadata
+	txIDsForPublicKey map[PkMapKey]map[BlockHash]bool
+}
+
+// NewTxindexMempoolView creates a view that follows the mempool through the
+// event manager, starting from the next txn it adds. If db is set, the view is
+// stored in it and whatever was left there by the last run is cleared.
+func NewTxindexMempoolView(params *BitCloutParams, eventManager *EventManager, db *badger.DB) (
+	*TxindexMempoolView, error) {
+
+	if db != nil {
+		if err := db.DropPrefix(_PrefixMempoolTxIDToMetadata, _PrefixMempoolPublicKeyTxID); err != nil {
+			return nil, errors.Wrapf(err, "NewTxindexMempoolView: Problem clearing the last run's view: ")
+		}
+	}
+	view := &TxindexMempoolView{
+		params:            params,
+		db:                db,
+		txnMetas:          make(map[BlockHash]*TransactionMetadata),
+		txIDsForPublicKey: make(map[PkMapKey]map[BlockHash]bool),
+	}
+	eventManager.OnMempoolTxnAdded(func(event *MempoolTxnEvent) {
+		if err := view.addTxn(event.MempoolTx); err != nil {
+			glog.Errorf("TxindexMempoolView: Problem adding txn %v: %v", event.MempoolTx.Hash, err)
+		}
+	})
+	eventManager.OnMempoolTxnRemoved(func(event *MempoolTxnEvent) {
+		if err := view.removeTxn(event.MempoolTx); err != nil {
+			glog.Errorf("TxindexMempoolView: Problem removing txn %v: %v", event.MempoolTx.Hash, err)
+		}
+	})
+	return view, nil
+}
+
+// _txindexMempoolMetadata returns the metadata the mempool computed for the txn
+// without its block, or metadata built from the txn alone if the mempool didn't
+// compute any, which it doesn't for BitcoinExchange txns.
+func _txindexMempoolMetadata(mempoolTx *MempoolTx, params *BitCloutParams) *TransactionMetadata {
+	if mempoolTx.TxMeta != nil {
+		// The mempool computes the metadata with the txn's hash in place of its
+		// block's. Copy it rather than fix it since events are shared.
+		txnMeta := *mempoolTx.TxMeta
+		txnMeta.BlockHashHex = ""
+		return &txnMeta
+	}
+
+	txn := mempoolTx.Tx
+	txnMeta := &TransactionMetadata{
+		TxnType:                        txn.TxnMeta.GetTxnType().String(),
+		TransactorPublicKeyBase58Check: PkToString(txn.PublicKey, params),
+		TxnOutputs:                     txn.TxOutputs,
+	}
+	for _, output := range txn.TxOutputs {
+		txnMeta.AffectedPublicKeys = append(txnMeta.AffectedPublicKeys, &AffectedPublicKey{
+			PublicKeyBase58Check: PkToString(output.PublicKey, params),
+			Metadata:             "BasicTransferOutput",
+		})
+	}
+	return txnMeta
+}
+
+func _dbKeyForMempoolTxIDToMetadata(txID *BlockHash) []byte {
+	return append(append([]byte{}, _PrefixMempoolTxIDToMetadata...), txID[:]...)
+}
+
+func _dbKeyForMempoolPublicKeyTxID(publicKey []byte, txID *BlockHash) []byte {
+	key := append(append([]byte{}, _PrefixMempoolPublicKeyTxID...), publicKey...)
+	return append(key, txID[:]...)
+}
+
+func (view *TxindexMempoolView) addTxn(mempoolTx *MempoolTx) error {
+	txnMeta := _txindexMempoolMetadata(mempoolTx, view.params)
+	publicKeys := _getPublicKeysForTxn(mempoolTx.Tx, txnMeta, view.params)
+
+	view.mtx.Lock()
+	defer view.mtx.Unlock()
+
+	if view.db != nil {
+		return DbUpdate(view.db, func(txn KVTxn) error {
+			if err := txn.Set(_dbKeyForMempoolTxIDToMetadata(mempoolTx.Hash), txnMeta.ToBytes()); err != nil {
+				return err
+			}
+			for publicKey := range publicKeys {
+				if err := txn.Set(_dbKeyForMempoolPublicKeyTxID(publicKey[:], mempoolTx.Hash), []byte{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	view.txnMetas[*mempoolTx.Hash] = txnMeta
+	for publicKey := range publicKeys {
+		if _, exists := view.txIDsForPublicKey[publicKey]; !exists {
+			view.txIDsForPublicKey[publicKey] = make(map[BlockHash]bool)
+		}
+		view.txIDsForPublicKey[publicKey][*mempoolTx.Hash] = true
+	}
+	return nil
+}
+
+func (view *TxindexMempoolView) removeTxn(mempoolTx *MempoolTx) error {
+	view.mtx.Lock()
+	defer view.mtx.Unlock()
+
+	if view.db != nil {
+		return DbUpdate(view.db, func(txn KVTxn) error {
+			txnMeta := _dbGetMempoolTxnMetadataWithTxn(txn, mempoolTx.Hash)
+			if txnMeta == nil {
+				return nil
+			}
+			for publicKey := range _getPublicKeysForTxn(mempoolTx.Tx, txnMeta, view.params) {
+				if err := txn.Delete(_dbKeyForMempoolPublicKeyTxID(publicKey[:], mempoolTx.Hash)); err != nil {
+					return err
+				}
+			}
+			return txn.Delete(_dbKeyForMempoolTxIDToMetadata(mempoolTx.Hash))
+		})
+	}
+
+	txnMeta, exists := view.txnMetas[*mempoolTx.Hash]
+	if !exists {
+		return nil
+	}
+	for publicKey := range _getPublicKeysForTxn(mempoolTx.Tx, txnMeta, view.params) {
+		delete(view.txIDsForPublicKey[publicKey], *mempoolTx.Hash)
+		if len(view.txIDsForPublicKey[publicKey]) == 0 {
+			delete(view.txIDsForPublicKey, publicKey)
+		}
+	}
+	delete(view.txnMetas, *mempoolTx.Hash)
+	return nil
+}
+
+func _dbGetMempoolTxnMetadataWithTxn(txn KVTxn, txID *BlockHash) *TransactionMetadata {
+	valBytes, err := txn.Get(_dbKeyForMempoolTxIDToMetadata(txID))
+	if err != nil {
+		return nil
+	}
+	txnMeta := &TransactionMetadata{}
+	if err := txnMeta.FromBytes(valBytes); err != nil {
+		return nil
+	}
+	return txnMeta
+}
+
+// GetTransactionMetadata returns the metadata of a txn in the mempool or nil if
+// the view doesn't have it.
+func (view *TxindexMempoolView) GetTransactionMetadata(txID *BlockHash) *TransactionMetadata {
+	view.mtx.RLock()
+	defer view.mtx.RUnlock()
+
+	if view.db != nil {
+		var txnMeta *TransactionMetadata
+		DbView(view.db, func(txn KVTxn) error {
+			txnMeta = _dbGetMempoolTxnMetadataWithTxn(txn, txID)
+			return nil
+		})
+		return txnMeta
+	}
+	return view.txnMetas[*txID]
+}
+
+// GetTxnsForPublicKey returns the txns in the mempool the public key is involved
+// in, ordered by txid.
+func (view *TxindexMempoolView) GetTxnsForPublicKey(publicKey []byte) []*BlockHash {
+	view.mtx.RLock()
+	defer view.mtx.RUnlock()
+
+	txIDs := []*BlockHash{}
+	if view.db != nil {
+		prefix := append(append([]byte{}, _PrefixMempoolPublicKeyTxID...), publicKey...)
+		keys, _ := EnumerateKeysForPrefix(view.db, prefix)
+		for _, key := range keys {
+			if len(key) != len(_PrefixMempoolPublicKeyTxID)+btcec.PubKeyBytesLenCompressed+HashSizeBytes {
+				glog.Errorf("TxindexMempoolView.GetTxnsForPublicKey: Invalid key length %d", len(key))
+				continue
+			}
+			txID := &BlockHash{}
+			copy(txID[:], key[len(key)-HashSizeBytes:])
+			txIDs = append(txIDs, txID)
+		}
+		return txIDs
+	}
+
+	for txID := range view.txIDsForPublicKey[MakePkMapKey(publicKey)] {
+		txIDCopy := txID
+		txIDs = append(txIDs, &txIDCopy)
+	}
+	sort.Slice(txIDs, func(ii, jj int) bool {
+		return bytes.Compare(txIDs[ii][:], txIDs[jj][:]) < 0
+	})
+	return txIDs
+}
+
+// EnableMempoolView makes the txindex index the txns in the core chain's mempool
+// as well. The view is stored in the txindex db if inDb is set and in memory
+// otherwise. It should be called before the mempool starts accepting txns since
+// it only sees the txns added after it.
+func (txi *TXIndex) EnableMempoolView(inDb bool) error {
+	var db *badger.DB
+	if inDb {
+		db = txi.TXIndexChain.DB()
+	}
+	mempoolView, err := NewTxindexMempoolView(txi.Params, txi.CoreChain.EventManager(), db)
+	if err != nil {
+		return errors.Wrapf(err, "EnableMempoolView: ")
+	}
+	txi.MempoolView = mempoolView
+	return nil
+}
+
+// GetTransactionMetadata looks a txn up in the txindex and then in its mempool
+// view, if it has one. It returns nil if neither has the txn.
+func (txi *TXIndex) GetTransactionMetadata(txID *BlockHash) *TxindexTxnRef {
+	if txnMeta := DbGetTxindexTransactionRefByTxID(txi.TXIndexChain.DB(), txID); txnMeta != nil {
+		return &TxindexTxnRef{TxID: txID, Metadata: txnMeta, Confirmed: true}
+	}
+	if txi.MempoolView == nil {
+		return nil
+	}
+	if txnMeta := txi.MempoolView.GetTransactionMetadata(txID); txnMeta != nil {
+		return &TxindexTxnRef{TxID: txID, Metadata: txnMeta, Confirmed: false}
+	}
+	return nil
+}
+
+// GetTxnsForPublicKey returns the mined txns the public key is involved in, in
+// chain order, and the ones in the mempool view, ordered by txid. A txn that was
+// mined but is still in the view is only returned as mined.
+func (txi *TXIndex) GetTxnsForPublicKey(publicKey []byte) (
+	_confirmed []*BlockHash, _unconfirmed []*BlockHash) {
+
+	confirmed := DbGetTxindexTxnsForPublicKey(txi.TXIndexChain.DB(), publicKey)
+	unconfirmed := []*BlockHash{}
+	if txi.MempoolView == nil {
+		return confirmed, unconfirmed
+	}
+	isConfirmed := make(map[BlockHash]bool, len(confirmed))
+	for _, txID := range confirmed {
+		isConfirmed[*txID] = true
+	}
+	for _, txID := range txi.MempoolView.GetTxnsForPublicKey(publicKey) {
+		if !isConfirmed[*txID] {
+			unconfirmed = append(unconfirmed, txID)
+		}
+	}
+	return confirmed, unconfirmed
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxindexMempoolView(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	for _, inDb := range []bool{false, true} {
+		chain, params, _ := NewLowDifficultyBlockchain()
+		mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+		mempool.eventManager = chain.EventManager()
+		txIndexDb, dir := GetTestBadgerDb()
+		defer os.RemoveAll(dir)
+		txIndex, err := NewTXIndexWithDb(chain, nil /*bitcoinManager*/, params, txIndexDb)
+		require.NoError(err)
+		require.NoError(txIndex.EnableMempoolView(inDb))
+
+		for ii := 0; ii < 2; ii++ {
+			_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+			require.NoError(err)
+		}
+		require.NoError(txIndex.Update())
+
+		recipientPk, _, err := Base58CheckDecode(recipientPkString)
+		require.NoError(err)
+		transferTxn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 0,
+			senderPkString, recipientPkString, senderPrivString, mempool)
+		transferTxID := transferTxn.Hash()
+		assert.Nil(txIndex.GetTransactionMetadata(transferTxID))
+
+		// The txn is unconfirmed while it's in the mempool.
+		_, err = mempool.ProcessTransaction(transferTxn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+		require.NoError(err)
+		txnRef := txIndex.GetTransactionMetadata(transferTxID)
+		require.NotNil(txnRef)
+		assert.False(txnRef.Confirmed)
+		assert.Equal("", txnRef.Metadata.BlockHashHex)
+		assert.Equal(senderPkString, txnRef.Metadata.TransactorPublicKeyBase58Check)
+		confirmed, unconfirmed := txIndex.GetTxnsForPublicKey(recipientPk)
+		assert.Equal([]*BlockHash{transferTxID}, unconfirmed)
+		assert.NotContains(confirmed, transferTxID)
+
+		// Mining it takes it out of the view and the txindex picks it up.
+		_, err = miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+		assert.Nil(txIndex.MempoolView.GetTransactionMetadata(transferTxID))
+		require.NoError(txIndex.Update())
+		txnRef = txIndex.GetTransactionMetadata(transferTxID)
+		require.NotNil(txnRef)
+		assert.True(txnRef.Confirmed)
+		assert.NotEqual("", txnRef.Metadata.BlockHashHex)
+		confirmed, unconfirmed = txIndex.GetTxnsForPublicKey(recipientPk)
+		assert.Contains(confirmed, transferTxID)
+		assert.Equal(0, len(unconfirmed))
+	}
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// The txindex keeps its own copy of every block it has indexed, so a txindex that
+// was damaged, e.g. by a crash in the middle of an update or a bug in one of its
+// mapping writers, can be checked against those blocks instead of being wiped.
+// Public key mappings that are missing are written back from the txn metadata.
+// A txn whose metadata is missing can't be patched in place since its metadata
+// is computed by connecting it to the view the txindex had before its block, so
+// the txindex is rewound to before that block and the TXIndex update loop
+// replays the blocks after it through the mapping writers again.
+
+type TxindexResyncReport struct {
+	// The txns in the blocks from FromHeight to TipHeight were checked.
+	FromHeight uint32
+	TipHeight  uint32
+	NumTxns    int
+	// NumBadMetadata is the number of txns whose metadata was missing, couldn't be
+	// decoded, or pointed at a different block.
+	NumBadMetadata int
+	// NumMissingPublicKeyMappings is the number of txns missing from the txns of
+	// a public key their metadata involves them with.
+	NumMissingPublicKeyMappings int
+	// What was fixed. Both are zero on a dry run. Mappings that were missing from
+	// the blocks that were rewound are written when the blocks are replayed.
+	NumRepairedPublicKeyMappings int
+	NumBlocksRewound             int
+}
+
+type txindexMissingPublicKeyMapping struct {
+	publicKey   []byte
+	txID        *BlockHash
+	txnMeta     *TransactionMetadata
+	blockHeight uint32
+}
+
+// ResyncTxindex checks the txns in the txindex's blocks from fromHeight up to
+// its tip. Unless dryRun is set, it writes back missing public key mappings and
+// rewinds the txindex to before the first block with bad metadata. The blocks
+// it rewinds have to be in chainDB, which is where the TXIndex replays them
+// from. The txindex must not be running while this runs.
+func ResyncTxindex(txindexDB *badger.DB, chainDB *badger.DB, params *BitCloutParams,
+	fromHeight uint32, dryRun bool) (_report *TxindexResyncReport, _err error) {
+
+	// The genesis block's txns are never indexed. The seed txns are indexed in
+	// their place when the txindex is initialized.
+	if fromHeight == 0 {
+		fromHeight = 1
+	}
+	report := &TxindexResyncReport{FromHeight: fromHeight}
+
+	tipHash := DbGetBestHash(txindexDB, ChainTypeBitCloutBlock)
+	if tipHash == nil {
+		return nil, fmt.Errorf("ResyncTxindex: The txindex hasn't been initialized")
+	}
+	// Walk back from the tip to find the blocks to check. Only their hashes are
+	// kept so a full resync doesn't hold the whole chain in memory.
+	blockNodes := []*BlockNode{}
+	for blockHash := tipHash; ; {
+		blockMsg, err := GetBlock(blockHash, txindexDB)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ResyncTxindex: Problem fetching txindex block %v: ", blockHash)
+		}
+		blockHeight := uint32(blockMsg.Header.Height)
+		if len(blockNodes) == 0 {
+			report.TipHeight = blockHeight
+		}
+		if blockHeight < fromHeight {
+			break
+		}
+		blockNodes = append(blockNodes, &BlockNode{Hash: blockHash, Height: blockHeight})
+		blockHash = blockMsg.Header.PrevBlockHash
+	}
+
+	// Check the blocks oldest first.
+	missingMappings := []*txindexMissingPublicKeyMapping{}
+	missingMetadataTxIDs := make(map[BlockHash]bool)
+	var firstBadBlockNode *BlockNode
+	for ii := len(blockNodes) - 1; ii >= 0; ii-- {
+		blockNode := blockNodes[ii]
+		blockMsg, err := GetBlock(blockNode.Hash, txindexDB)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ResyncTxindex: Problem fetching txindex block %v: ", blockNode.Hash)
+		}
+		blockHashHex := hex.EncodeToString(blockNode.Hash[:])
+		err = DbView(txindexDB, func(dbTxn KVTxn) error {
+			for txnIndexInBlock, txn := range blockMsg.Txns {
+				report.NumTxns++
+				txID := txn.Hash()
+				txnMeta := DbGetTxindexTransactionRefByTxIDWithTxn(dbTxn, txID)
+				if txnMeta == nil || txnMeta.BlockHashHex != blockHashHex ||
+					txnMeta.TxnIndexInBlock != uint64(txnIndexInBlock) {
+
+					report.NumBadMetadata++
+					if txnMeta == nil {
+						missingMetadataTxIDs[*txID] = true
+					}
+					if firstBadBlockNode == nil {
+						firstBadBlockNode = blockNode
+					}
+					continue
+				}
+
+				for pkMapKey := range _getPublicKeysForTxn(txn, txnMeta, params) {
+					mappingKey, err := _dbKeyForTxindexPublicKeyTxnMetaWithTxn(dbTxn, pkMapKey[:], txID, txnMeta)
+					if err != nil {
+						return err
+					}
+					_, err = dbTxn.Get(mappingKey)
+					if err == nil {
+						continue
+					}
+					if err != ErrKVKeyNotFound {
+						return err
+					}
+					report.NumMissingPublicKeyMappings++
+					missingMappings = append(missingMappings, &txindexMissingPublicKeyMapping{
+						publicKey:   append([]byte{}, pkMapKey[:]...),
+						txID:        txID,
+						txnMeta:     txnMeta,
+						blockHeight: blockNode.Height,
+					})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "ResyncTxindex: Problem checking block %v: ", blockNode.Hash)
+		}
+	}
+	glog.Infof("ResyncTxindex: Checked %d txns in blocks %d to %d: %d with bad metadata, "+
+		"%d missing public key mappings", report.NumTxns, report.FromHeight, report.TipHeight,
+		report.NumBadMetadata, report.NumMissingPublicKeyMappings)
+	if dryRun {
+		return report, nil
+	}
+
+	// Mappings in the blocks that are about to be rewound are rewritten when
+	// they're replayed.
+	err := DbUpdateWithTxnWriter(txindexDB, func(txnWriter *TxnWriter) error {
+		for _, mappingIter := range missingMappings {
+			mapping := mappingIter
+			if firstBadBlockNode != nil && mapping.blockHeight >= firstBadBlockNode.Height {
+				continue
+			}
+			if err := txnWriter.Write(func(txn KVTxn) error {
+				if err := DbPutTxindexPublicKeyToTxnMappingSingleWithTxn(txn, mapping.publicKey, mapping.txID, mapping.txnMeta); err != nil {
+					return err
+				}
+				return _dbRecordPublicKeyActivityWithTxn(txn, mapping.publicKey, mapping.blockHeight)
+			}); err != nil {
+				return err
+			}
+			report.NumRepairedPublicKeyMappings++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "ResyncTxindex: Problem writing public key mappings: ")
+	}
+
+	if firstBadBlockNode == nil {
+		return report, nil
+	}
+	numBlocksRewound, err := _rewindTxindex(txindexDB, chainDB, params,
+		blockNodes, firstBadBlockNode.Height, missingMetadataTxIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ResyncTxindex: ")
+	}
+	report.NumBlocksRewound = numBlocksRewound
+	glog.Infof("ResyncTxindex: Rewound the txindex %d blocks to height %d; the blocks "+
+		"after it will be indexed again when the txindex starts",
+		numBlocksRewound, firstBadBlockNode.Height-1)
+	return report, nil
+}
+
+// _rewindTxindex disconnects the blocks at and above rewindHeight from the
+// txindex, newest first, along with their txns' mappings. blockNodes are the
+// txindex's blocks, newest first.
+func _rewindTxindex(txindexDB *badger.DB, chainDB *badger.DB, params *BitCloutParams,
+	blockNodes []*BlockNode, rewindHeight uint32, missingMetadataTxIDs map[BlockHash]bool) (int, error) {
+
+	// Make sure every block can be replayed before any of them is rewound.
+	blockNodesToRewind := []*BlockNode{}
+	for _, blockNode := range blockNodes {
+		if blockNode.Height < rewindHeight {
+			break
+		}
+		if _, err := GetBlock(blockNode.Hash, chainDB); err != nil {
+			return 0, errors.Wrapf(err, "_rewindTxindex: Block %v at height %d isn't in "+
+				"the chain db so it couldn't be replayed: ", blockNode.Hash, blockNode.Height)
+		}
+		blockNodesToRewind = append(blockNodesToRewind, blockNode)
+	}
+
+	// The public key mappings of a txn without metadata can only be found by
+	// looking through all of them.
+	staleKeysForTxID := make(map[BlockHash][][]byte)
+	if len(missingMetadataTxIDs) > 0 {
+		err := EnumerateKeysForPrefixWithCallback(txindexDB, _PrefixPublicKeyHeightTxnIndexTxID, func(key []byte, val []byte) (bool, error) {
+			txID := _txIDForTxindexPublicKeyTxnKey(key)
+			if txID == nil || !missingMetadataTxIDs[*txID] {
+				return true, nil
+			}
+			staleKeysForTxID[*txID] = append(staleKeysForTxID[*txID], append([]byte{}, key...))
+			return true, nil
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "_rewindTxindex: Problem finding stale public key mappings: ")
+		}
+	}
+
+	for _, blockNode := range blockNodesToRewind {
+		blockMsg, err := GetBlock(blockNode.Hash, txindexDB)
+		if err != nil {
+			return 0, errors.Wrapf(err, "_rewindTxindex: Problem fetching txindex block %v: ", blockNode.Hash)
+		}
+		err = DbUpdate(txindexDB, func(dbTxn KVTxn) error {
+			for txnIndexInBlock, txn := range blockMsg.Txns {
+				txID := txn.Hash()
+				if DbGetTxindexTransactionRefByTxIDWithTxn(dbTxn, txID) != nil {
+					if err := DbDeleteTxindexTransactionMappingsWithTxn(dbTxn, txn, params); err != nil {
+						return err
+					}
+					continue
+				}
+				// The block explorer keys are found by the txn's position.
+				if err := dbTxn.Delete(_dbKeyForTxindexHeightTxnIndex(
+					blockNode.Height, uint32(txnIndexInBlock))); err != nil {
+
+					return err
+				}
+				if err := dbTxn.Delete(_dbKeyForTxindexTxIDToBlockHeight(txID)); err != nil {
+					return err
+				}
+				for _, staleKey := range staleKeysForTxID[*txID] {
+					if err := dbTxn.Delete(staleKey); err != nil {
+						return err
+					}
+					publicKey := staleKey[len(_PrefixPublicKeyHeightTxnIndexTxID) : len(_PrefixPublicKeyHeightTxnIndexTxID)+btcec.PubKeyBytesLenCompressed]
+					if err := _dbRecomputePublicKeyActivityWithTxn(dbTxn, publicKey); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "_rewindTxindex: Problem deleting the mappings "+
+				"for block %v: ", blockNode.Hash)
+		}
+
+		if err := _disconnectTxindexBlock(txindexDB, params, nil, blockMsg); err != nil {
+			return 0, errors.Wrapf(err, "_rewindTxindex: ")
+		}
+		// Forget the block entirely so the txindex chain processes it again
+		// rather than rejecting it as a duplicate.
+		err = DbUpdate(txindexDB, func(dbTxn KVTxn) error {
+			return DbDeleteHeightHashToNodeInfoWithTxn(blockNode, dbTxn, false /*bitcoinNodes*/)
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "_rewindTxindex: Problem deleting block node %v: ", blockNode.Hash)
+		}
+	}
+	return len(blockNodesToRewind), nil
+}
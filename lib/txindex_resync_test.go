@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResyncTxindex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	chain, params, chainDb := NewLowDifficultyBlockchain()
+	mempool, miner := NewTestMiner(t, chain, params, true /*isSender*/)
+	txIndexDb, dir := GetTestBadgerDb()
+	defer os.RemoveAll(dir)
+	txIndex, err := NewTXIndexWithDb(chain, nil /*bitcoinManager*/, params, txIndexDb)
+	require.NoError(err)
+
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	transferTxn := _assembleBasicTransferTxnFullySigned(t, chain, 10, 0,
+		senderPkString, recipientPkString, senderPrivString, mempool)
+	_, err = mempool.ProcessTransaction(transferTxn, false /*allowUnconnectedTxn*/, false /*rateLimit*/, 0 /*peerID*/, true /*verifySignatures*/)
+	require.NoError(err)
+	for ii := 0; ii < 2; ii++ {
+		_, err := miner.MineAndProcessSingleBlock(0 /*threadIndex*/, mempool)
+		require.NoError(err)
+	}
+	require.NoError(txIndex.Update())
+
+	transferTxID := transferTxn.Hash()
+	transferTxnMeta := DbGetTxindexTransactionRefByTxID(txIndexDb, transferTxID)
+	require.NotNil(transferTxnMeta)
+	recipientPk, _, err := Base58CheckDecode(recipientPkString)
+	require.NoError(err)
+	recipientTxIDs := DbGetTxindexTxnsForPublicKey(txIndexDb, recipientPk)
+
+	// An intact txindex has nothing to fix.
+	report, err := ResyncTxindex(txIndexDb, chainDb, params, 0, false /*dryRun*/)
+	require.NoError(err)
+	assert.Equal(uint32(1), report.FromHeight)
+	assert.Equal(uint32(4), report.TipHeight)
+	assert.Equal(5, report.NumTxns)
+	assert.Equal(0, report.NumBadMetadata)
+	assert.Equal(0, report.NumMissingPublicKeyMappings)
+
+	// A missing public key mapping is written back.
+	require.NoError(DbUpdate(txIndexDb, func(txn KVTxn) error {
+		return DbDeleteTxindexPublicKeyToTxnMappingSingleWithTxn(txn, recipientPk, transferTxID, transferTxnMeta)
+	}))
+	assert.Equal(len(recipientTxIDs)-1, len(DbGetTxindexTxnsForPublicKey(txIndexDb, recipientPk)))
+	report, err = ResyncTxindex(txIndexDb, chainDb, params, 0, false /*dryRun*/)
+	require.NoError(err)
+	assert.Equal(1, report.NumMissingPublicKeyMappings)
+	assert.Equal(1, report.NumRepairedPublicKeyMappings)
+	assert.ElementsMatch(recipientTxIDs, DbGetTxindexTxnsForPublicKey(txIndexDb, recipientPk))
+
+	// Missing metadata rewinds the txindex to before the txn's block. A dry run
+	// only reports it.
+	require.NoError(DbUpdate(txIndexDb, func(txn KVTxn) error {
+		return txn.Delete(DbTxindexTxIDKey(transferTxID))
+	}))
+	report, err = ResyncTxindex(txIndexDb, chainDb, params, 3, true /*dryRun*/)
+	require.NoError(err)
+	assert.Equal(2, report.NumTxns)
+	assert.Equal(1, report.NumBadMetadata)
+	assert.Equal(0, report.NumBlocksRewound)
+	report, err = ResyncTxindex(txIndexDb, chainDb, params, 0, false /*dryRun*/)
+	require.NoError(err)
+	assert.Equal(1, report.NumBadMetadata)
+	assert.Equal(2, report.NumBlocksRewound)
+	assert.Nil(DbGetTxindexTransactionRefByTxID(txIndexDb, transferTxID))
+
+	// The txindex replays the rewound blocks when it's started again.
+	txIndex, err = NewTXIndexWithDb(chain, nil /*bitcoinManager*/, params, txIndexDb)
+	require.NoError(err)
+	assert.Equal(uint32(2), txIndex.TXIndexChain.BlockTip().Height)
+	require.NoError(txIndex.Update())
+	assert.Equal(transferTxnMeta, DbGetTxindexTransactionRefByTxID(txIndexDb, transferTxID))
+	assert.Equal(recipientTxIDs, DbGetTxindexTxnsForPublicKey(txIndexDb, recipientPk))
+	report, err = ResyncTxindex(txIndexDb, chainDb, params, 0, true /*dryRun*/)
+	require.NoError(err)
+	assert.Equal(0, report.NumBadMetadata)
+	assert.Equal(0, report.NumMissingPublicKeyMappings)
+}
@@ -0,0 +1,282 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// txn_display.go turns a serialized MsgBitCloutTxn into something a person can
+// read. Block explorers and CLIs should use DecodeTransactionForDisplay rather
+// than switching on the metadata type themselves so that new txn types show up
+// everywhere once they're added here.
+
+// TransactionInputForDisplay is a txn input, which is the utxo it spends.
+type TransactionInputForDisplay struct {
+	TxIDHex string
+	Index   uint32
+
+	// Only set by SetInputAmountsFromView.
+	AmountNanos          *uint64 `json:",omitempty"`
+	PublicKeyBase58Check string  `json:",omitempty"`
+}
+
+type TransactionOutputForDisplay struct {
+	PublicKeyBase58Check string
+	AmountNanos          uint64
+}
+
+// TransactionForDisplay is the human-readable form of a txn along with the raw
+// bytes it was decoded from.
+type TransactionForDisplay struct {
+	TxnHashHex string
+	TxnType    string
+	RawTxnHex  string
+
+	TransactorPublicKeyBase58Check string
+	Inputs                         []*TransactionInputForDisplay
+	Outputs                        []*TransactionOutputForDisplay
+
+	// The fields of the txn's metadata, keyed by field name. Public keys are
+	// base58 encoded, hashes and binary data are hex encoded, and everything
+	// else is formatted as a string.
+	Metadata map[string]string
+	// ExtraData values are hex encoded since they're arbitrary bytes.
+	ExtraData map[string]string
+
+	// Empty if the txn isn't signed yet.
+	SignatureHex string
+
+	TotalOutputNanos uint64
+	// The inputs only reference utxos so these are only set once the amounts
+	// are known. See SetInputAmountsFromView.
+	TotalInputNanos *uint64 `json:",omitempty"`
+	FeeNanos        *uint64 `json:",omitempty"`
+}
+
+// DecodeTransactionForDisplay decodes the txn and converts it to its
+// human-readable form. The public keys are encoded for the network in params.
+func DecodeTransactionForDisplay(txnBytes []byte, params *BitCloutParams) (*TransactionForDisplay, error) {
+	txn := &MsgBitCloutTxn{}
+	if err := txn.FromBytes(txnBytes); err != nil {
+		return nil, errors.Wrapf(err, "DecodeTransactionForDisplay: Problem decoding txn")
+	}
+	display, err := TransactionToDisplay(txn, params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DecodeTransactionForDisplay: ")
+	}
+	display.RawTxnHex = hex.EncodeToString(txnBytes)
+	return display, nil
+}
+
+// TransactionToDisplay is like DecodeTransactionForDisplay for a txn that has
+// already been decoded.
+func TransactionToDisplay(txn *MsgBitCloutTxn, params *BitCloutParams) (*TransactionForDisplay, error) {
+	if txn.TxnMeta == nil {
+		return nil, fmt.Errorf("TransactionToDisplay: Transaction is missing TxnMeta")
+	}
+	txnBytes, err := txn.ToBytes(false /*preSignature*/)
+	if err != nil {
+		return nil, errors.Wrapf(err, "TransactionToDisplay: Problem encoding txn")
+	}
+	metadata, err := _txnMetadataForDisplay(txn.TxnMeta, params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "TransactionToDisplay: ")
+	}
+
+	display := &TransactionForDisplay{
+		TxnType:   txn.TxnMeta.GetTxnType().String(),
+		RawTxnHex: hex.EncodeToString(txnBytes),
+		Metadata:  metadata,
+		ExtraData: make(map[string]string, len(txn.ExtraData)),
+	}
+	if txnHash := txn.Hash(); txnHash != nil {
+		display.TxnHashHex = hex.EncodeToString(txnHash[:])
+	}
+	if len(txn.PublicKey) != 0 {
+		display.TransactorPublicKeyBase58Check = PkToString(txn.PublicKey, params)
+	}
+	for _, input := range txn.TxInputs {
+		display.Inputs = append(display.Inputs, &TransactionInputForDisplay{
+			TxIDHex: hex.EncodeToString(input.TxID[:]),
+			Index:   input.Index,
+		})
+	}
+	for _, output := range txn.TxOutputs {
+		display.Outputs = append(display.Outputs, &TransactionOutputForDisplay{
+			PublicKeyBase58Check: PkToString(output.PublicKey, params),
+			AmountNanos:          output.AmountNanos,
+		})
+		display.TotalOutputNanos += output.AmountNanos
+	}
+	for key, value := range txn.ExtraData {
+		display.ExtraData[key] = hex.EncodeToString(value)
+	}
+	if txn.Signature != nil {
+		display.SignatureHex = hex.EncodeToString(txn.Signature.Serialize())
+	}
+
+	return display, nil
+}
+
+// SetInputAmountsFromView looks up the utxo each input spends in the view and
+// fills in the input amounts, the total input, and the fee. This only works
+// while the inputs are unspent, which is the case for txns that haven't been
+// mined yet. BitcoinExchange txns don't have inputs so their fee can't be
+// computed this way.
+func (display *TransactionForDisplay) SetInputAmountsFromView(utxoView *UtxoView) error {
+	totalInput := uint64(0)
+	for _, input := range display.Inputs {
+		txIDBytes, err := hex.DecodeString(input.TxIDHex)
+		if err != nil || len(txIDBytes) != HashSizeBytes {
+			return fmt.Errorf("SetInputAmountsFromView: Invalid TxIDHex %v", input.TxIDHex)
+		}
+		utxoKey := &UtxoKey{Index: input.Index}
+		copy(utxoKey.TxID[:], txIDBytes)
+
+		utxoEntry := utxoView.GetUtxoEntryForUtxoKey(utxoKey)
+		if utxoEntry == nil || utxoEntry.isSpent {
+			return fmt.Errorf("SetInputAmountsFromView: Utxo %v is missing or spent", utxoKey)
+		}
+		amountNanos := utxoEntry.AmountNanos
+		input.AmountNanos = &amountNanos
+		input.PublicKeyBase58Check = PkToString(utxoEntry.PublicKey, utxoView.Params)
+		totalInput += amountNanos
+	}
+	if totalInput < display.TotalOutputNanos {
+		return fmt.Errorf("SetInputAmountsFromView: Total input %d is less than total output %d",
+			totalInput, display.TotalOutputNanos)
+	}
+	feeNanos := totalInput - display.TotalOutputNanos
+	display.TotalInputNanos = &totalInput
+	display.FeeNanos = &feeNanos
+	return nil
+}
+
+func _pkForDisplay(pk []byte, params *BitCloutParams) string {
+	if len(pk) == 0 {
+		return ""
+	}
+	return PkToString(pk, params)
+}
+
+func _txnMetadataForDisplay(txnMeta BitCloutTxnMetadata, params *BitCloutParams) (map[string]string, error) {
+	fields := make(map[string]string)
+	switch realTxMeta := txnMeta.(type) {
+	case *BlockRewardMetadataa:
+		fields["ExtraDataHex"] = hex.EncodeToString(realTxMeta.ExtraData)
+
+	case *BasicTransferMetadata:
+		// Nothing beyond the inputs and outputs.
+
+	case *BitcoinExchangeMetadata:
+		if realTxMeta.BitcoinTransaction != nil {
+			fields["BitcoinTxnHash"] = realTxMeta.BitcoinTransaction.TxHash().String()
+		}
+		if realTxMeta.BitcoinBlockHash != nil {
+			fields["BitcoinBlockHash"] = realTxMeta.BitcoinBlockHash.String()
+		}
+		if realTxMeta.BitcoinMerkleRoot != nil {
+			fields["BitcoinMerkleRoot"] = realTxMeta.BitcoinMerkleRoot.String()
+		}
+		if realTxMeta.BitcoinTransaction != nil && len(realTxMeta.BitcoinTransaction.TxIn) > 0 {
+			spendPk, err := ExtractBitcoinPublicKeyFromBitcoinTransactionInputs(
+				realTxMeta.BitcoinTransaction, params.BitcoinBtcdParams)
+			if err == nil {
+				fields["BitcoinSpendPublicKeyBase58Check"] = PkToString(spendPk.SerializeCompressed(), params)
+			}
+		}
+
+	case *PrivateMessageMetadata:
+		fields["RecipientPublicKeyBase58Check"] = _pkForDisplay(realTxMeta.RecipientPublicKey, params)
+		fields["EncryptedTextHex"] = hex.EncodeToString(realTxMeta.EncryptedText)
+		fields["TimestampNanos"] = strconv.FormatUint(realTxMeta.TimestampNanos, 10)
+
+	case *SubmitPostMetadata:
+		fields["PostHashToModifyHex"] = hex.EncodeToString(realTxMeta.PostHashToModify)
+		fields["ParentStakeIDHex"] = hex.EncodeToString(realTxMeta.ParentStakeID)
+		fields["Body"] = string(realTxMeta.Body)
+		fields["CreatorBasisPoints"] = strconv.FormatUint(realTxMeta.CreatorBasisPoints, 10)
+		fields["StakeMultipleBasisPoints"] = strconv.FormatUint(realTxMeta.StakeMultipleBasisPoints, 10)
+		fields["TimestampNanos"] = strconv.FormatUint(realTxMeta.TimestampNanos, 10)
+		fields["IsHidden"] = strconv.FormatBool(realTxMeta.IsHidden)
+
+	case *UpdateProfileMetadata:
+		fields["ProfilePublicKeyBase58Check"] = _pkForDisplay(realTxMeta.ProfilePublicKey, params)
+		fields["NewUsername"] = string(realTxMeta.NewUsername)
+		fields["NewDescription"] = string(realTxMeta.NewDescription)
+		// Profile pics are large data URLs so only show their size.
+		fields["NewProfilePicLength"] = strconv.Itoa(len(realTxMeta.NewProfilePic))
+		fields["NewCreatorBasisPoints"] = strconv.FormatUint(realTxMeta.NewCreatorBasisPoints, 10)
+		fields["NewStakeMultipleBasisPoints"] = strconv.FormatUint(realTxMeta.NewStakeMultipleBasisPoints, 10)
+		fields["IsHidden"] = strconv.FormatBool(realTxMeta.IsHidden)
+
+	case *UpdateBitcoinUSDExchangeRateMetadataa:
+		fields["USDCentsPerBitcoin"] = strconv.FormatUint(realTxMeta.USDCentsPerBitcoin, 10)
+
+	case *UpdateGlobalParamsMetadata:
+		// The new values are in the txn's ExtraData.
+
+	case *FollowMetadata:
+		fields["FollowedPublicKeyBase58Check"] = _pkForDisplay(realTxMeta.FollowedPublicKey, params)
+		fields["IsUnfollow"] = strconv.FormatBool(realTxMeta.IsUnfollow)
+
+	case *LikeMetadata:
+		if realTxMeta.LikedPostHash != nil {
+			fields["LikedPostHashHex"] = hex.EncodeToString(realTxMeta.LikedPostHash[:])
+		}
+		fields["IsUnlike"] = strconv.FormatBool(realTxMeta.IsUnlike)
+
+	case *CreatorCoinMetadataa:
+		fields["ProfilePublicKeyBase58Check"] = _pkForDisplay(realTxMeta.ProfilePublicKey, params)
+		fields["OperationType"] = realTxMeta.OperationType.String()
+		fields["BitCloutToSellNanos"] = strconv.FormatUint(realTxMeta.BitCloutToSellNanos, 10)
+		fields["CreatorCoinToSellNanos"] = strconv.FormatUint(realTxMeta.CreatorCoinToSellNanos, 10)
+		fields["BitCloutToAddNanos"] = strconv.FormatUint(realTxMeta.BitCloutToAddNanos, 10)
+		fields["MinBitCloutExpectedNanos"] = strconv.FormatUint(realTxMeta.MinBitCloutExpectedNanos, 10)
+		fields["MinCreatorCoinExpectedNanos"] = strconv.FormatUint(realTxMeta.MinCreatorCoinExpectedNanos, 10)
+
+	case *CreatorCoinTransferMetadataa:
+		fields["ProfilePublicKeyBase58Check"] = _pkForDisplay(realTxMeta.ProfilePublicKey, params)
+		fields["CreatorCoinToTransferNanos"] = strconv.FormatUint(realTxMeta.CreatorCoinToTransferNanos, 10)
+		fields["ReceiverPublicKeyBase58Check"] = _pkForDisplay(realTxMeta.ReceiverPublicKey, params)
+
+	case *SwapIdentityMetadataa:
+		fields["FromPublicKeyBase58Check"] = _pkForDisplay(realTxMeta.FromPublicKey, params)
+		fields["ToPublicKeyBase58Check"] = _pkForDisplay(realTxMeta.ToPublicKey, params)
+
+	case *PollMetadata:
+		if realTxMeta.PostHash != nil {
+			fields["PostHashHex"] = hex.EncodeToString(realTxMeta.PostHash[:])
+		}
+		fields["OperationType"] = realTxMeta.OperationType.String()
+		if realTxMeta.OperationType == PollOperationTypeCreate {
+			for ii, option := range realTxMeta.Options {
+				fields[fmt.Sprintf("Option%d", ii)] = string(option)
+			}
+		} else {
+			fields["OptionIndex"] = strconv.FormatUint(realTxMeta.OptionIndex, 10)
+		}
+
+	case *AuthorizeDerivedKeyMetadata:
+		fields["DerivedPublicKeyBase58Check"] = _pkForDisplay(realTxMeta.DerivedPublicKey, params)
+		fields["ExpirationBlock"] = strconv.FormatUint(realTxMeta.ExpirationBlock, 10)
+		fields["OperationType"] = realTxMeta.OperationType.String()
+		if spendingLimit := realTxMeta.TransactionSpendingLimit; spendingLimit != nil {
+			fields["GlobalBitCloutLimit"] = strconv.FormatUint(spendingLimit.GlobalBitCloutLimit, 10)
+			for txnType, count := range spendingLimit.TransactionCountLimitMap {
+				fields["TransactionCountLimit."+txnType.String()] = strconv.FormatUint(count, 10)
+			}
+		}
+
+	case *UpdateTransferRestrictionMetadata:
+		fields["TransferRestrictionStatus"] = realTxMeta.TransferRestrictionStatus.String()
+
+	default:
+		return nil, fmt.Errorf("_txnMetadataForDisplay: Unrecognized TxnType %v; make sure "+
+			"you add the new type of transaction to _txnMetadataForDisplay", txnMeta.GetTxnType())
+	}
+	return fields, nil
+}
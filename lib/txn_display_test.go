@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeTransactionForDisplay(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	params := &BitCloutTestnetParams
+	postHash := &BlockHash{0x01, 0x02, 0x03}
+	txn := &MsgBitCloutTxn{
+		TxInputs: []*BitCloutInput{
+			{TxID: BlockHash{0x04}, Index: 2},
+		},
+		TxOutputs: []*BitCloutOutput{
+			{PublicKey: _strToPk(t, m1Pub), AmountNanos: 10},
+			{PublicKey: _strToPk(t, m0Pub), AmountNanos: 5},
+		},
+		TxnMeta: &PollMetadata{
+			PostHash:      postHash,
+			OperationType: PollOperationTypeCreate,
+			Options:       [][]byte{[]byte("yes"), []byte("no")},
+		},
+		PublicKey: _strToPk(t, m0Pub),
+		ExtraData: map[string][]byte{"key": {0xab}},
+	}
+	_signTxn(t, txn, m0Priv)
+	txnBytes, err := txn.ToBytes(false /*preSignature*/)
+	require.NoError(err)
+
+	display, err := DecodeTransactionForDisplay(txnBytes, params)
+	require.NoError(err)
+	require.Equal(hex.EncodeToString(txnBytes), display.RawTxnHex)
+	require.Equal(hex.EncodeToString(txn.Hash()[:]), display.TxnHashHex)
+	require.Equal("POLL", display.TxnType)
+	require.Equal(m0Pub, display.TransactorPublicKeyBase58Check)
+	require.Equal(1, len(display.Inputs))
+	require.Equal(hex.EncodeToString(txn.TxInputs[0].TxID[:]), display.Inputs[0].TxIDHex)
+	require.Equal(uint32(2), display.Inputs[0].Index)
+	require.Nil(display.Inputs[0].AmountNanos)
+	require.Equal([]*TransactionOutputForDisplay{
+		{PublicKeyBase58Check: m1Pub, AmountNanos: 10},
+		{PublicKeyBase58Check: m0Pub, AmountNanos: 5},
+	}, display.Outputs)
+	require.Equal(uint64(15), display.TotalOutputNanos)
+	require.Nil(display.FeeNanos)
+	require.Equal(map[string]string{
+		"PostHashHex":   hex.EncodeToString(postHash[:]),
+		"OperationType": "create",
+		"Option0":       "yes",
+		"Option1":       "no",
+	}, display.Metadata)
+	require.Equal(map[string]string{"key": "ab"}, display.ExtraData)
+	require.NotEmpty(display.SignatureHex)
+
+	// Garbage shouldn't decode.
+	_, err = DecodeTransactionForDisplay(txnBytes[:len(txnBytes)/2], params)
+	require.Error(err)
+}
+
+func TestTransactionToDisplayMetadata(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_ = assert
+	_ = require
+
+	params := &BitCloutTestnetParams
+	display, err := TransactionToDisplay(&MsgBitCloutTxn{
+		TxnMeta: &CreatorCoinMetadataa{
+			ProfilePublicKey:    _strToPk(t, m1Pub),
+			OperationType:       CreatorCoinOperationTypeSell,
+			BitCloutToSellNanos: 7,
+		},
+		PublicKey: _strToPk(t, m0Pub),
+	}, params)
+	require.NoError(err)
+	require.Equal("CREATOR_COIN", display.TxnType)
+	require.Equal(m1Pub, display.Metadata["ProfilePublicKeyBase58Check"])
+	require.Equal("sell", display.Metadata["OperationType"])
+	require.Equal("7", display.Metadata["BitCloutToSellNanos"])
+	require.Empty(display.SignatureHex)
+
+	display, err = TransactionToDisplay(&MsgBitCloutTxn{
+		TxnMeta:   &FollowMetadata{FollowedPublicKey: _strToPk(t, m1Pub), IsUnfollow: true},
+		PublicKey: _strToPk(t, m0Pub),
+	}, params)
+	require.NoError(err)
+	require.Equal(map[string]string{
+		"FollowedPublicKeyBase58Check": m1Pub,
+		"IsUnfollow":                   "true",
+	}, display.Metadata)
+}